@@ -0,0 +1,325 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+/*
+Package benchmarks runs reproducible end to end benchmarks of the pipeline
+core. Each scenario sends a fixed number of protobuf encoded messages from an
+input through the ProtobufDecoder and the router to a number of filters and an
+output, all running in-process, and measures the throughput and the latency of
+each message from its delivery by the input to its arrival at the output.
+
+Results can be compared w/ those of an earlier run to catch performance
+regressions in the router and the message matchers.
+*/
+package benchmarks
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"github.com/pborman/uuid"
+)
+
+// Type of the messages the benchmarks send.
+const MESSAGE_TYPE = "heka.bench"
+
+// A benchmark scenario.
+type Scenario struct {
+	// Name identifying the scenario's results, defaults to one derived from
+	// the other settings.
+	Name string `json:"name"`
+	// Number of messages sent.
+	Messages int `json:"messages"`
+	// Number of filters the router matches each message against.
+	Filters int `json:"filters"`
+	// Whether each filter only matches its own share of the messages rather
+	// than all of them. The router still evaluates every matcher.
+	Sharded bool `json:"sharded"`
+	// Size of each message's payload in bytes.
+	PayloadSize int `json:"payload_size"`
+	// How long to wait for all of the messages to arrive, defaults to five
+	// minutes.
+	Timeout time.Duration `json:"-"`
+}
+
+// Returns the scenario's name, deriving it from the settings if it's unset.
+func (s Scenario) FullName() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	name := fmt.Sprintf("filters=%d/payload=%d", s.Filters, s.PayloadSize)
+	if s.Sharded {
+		name += "/sharded"
+	}
+	return name
+}
+
+// The measurements of a scenario's run.
+type Result struct {
+	Name     string        `json:"name"`
+	Scenario Scenario      `json:"scenario"`
+	Messages int           `json:"messages"`
+	Duration time.Duration `json:"duration"`
+	// Messages per second.
+	Throughput float64       `json:"throughput"`
+	LatencyP50 time.Duration `json:"latency_p50"`
+	LatencyP90 time.Duration `json:"latency_p90"`
+	LatencyP99 time.Duration `json:"latency_p99"`
+	LatencyMax time.Duration `json:"latency_max"`
+	// Number of messages the filters received in all.
+	Filtered int64 `json:"filtered"`
+}
+
+func (r *Result) String() string {
+	return fmt.Sprintf("%s: %d msgs in %s, %.0f msgs/s, latency p50 %s p90 %s p99 %s max %s",
+		r.Name, r.Messages, r.Duration, r.Throughput, r.LatencyP50, r.LatencyP90,
+		r.LatencyP99, r.LatencyMax)
+}
+
+// State shared by the benchmark plugins of a run. Only one scenario runs at a
+// time.
+type benchRun struct {
+	scenario Scenario
+	msgs     [][]byte
+	sent     []time.Time
+	latency  []time.Duration
+	received int
+	first    time.Time
+	last     time.Time
+	filtered int64
+	done     chan struct{}
+	lock     sync.Mutex
+}
+
+var (
+	runLock sync.Mutex
+	current *benchRun
+)
+
+func activeRun() (*benchRun, error) {
+	if current == nil {
+		return nil, errors.New("no benchmark is running")
+	}
+	return current, nil
+}
+
+// Encodes the scenario's messages up front so their encoding isn't measured.
+func encodeMessages(s Scenario) ([][]byte, error) {
+	payload := strings.Repeat("x", s.PayloadSize)
+	hostname, _ := os.Hostname()
+	msgs := make([][]byte, s.Messages)
+	for i := range msgs {
+		msg := &message.Message{}
+		msg.SetUuid(uuid.NewRandom())
+		msg.SetTimestamp(time.Now().UnixNano())
+		msg.SetType(MESSAGE_TYPE)
+		msg.SetLogger("heka-bench")
+		msg.SetHostname(hostname)
+		msg.SetPayload(payload)
+		msg.SetInt("seq", int64(i))
+		if s.Filters > 0 {
+			msg.SetInt("shard", int64(i%s.Filters))
+		}
+		var err error
+		if msgs[i], err = proto.Marshal(msg); err != nil {
+			return nil, err
+		}
+	}
+	return msgs, nil
+}
+
+// Returns the TOML config running the scenario.
+func scenarioConfig(s Scenario) string {
+	var conf []string
+	conf = append(conf, `[BenchInput]
+decoder = "ProtobufDecoder"
+`)
+	conf = append(conf, fmt.Sprintf(`[BenchOutput]
+message_matcher = "Type == '%s'"
+`, MESSAGE_TYPE))
+	for i := 0; i < s.Filters; i++ {
+		matcher := fmt.Sprintf("Type == '%s'", MESSAGE_TYPE)
+		if s.Sharded {
+			matcher += fmt.Sprintf(" && Fields[shard] == %d", i)
+		}
+		conf = append(conf, fmt.Sprintf(`[BenchFilter%d]
+type = "BenchFilter"
+message_matcher = "%s"
+`, i, matcher))
+	}
+	return strings.Join(conf, "\n")
+}
+
+// Runs the scenario in a new pipeline, returning once all of its messages
+// have arrived at the output and the pipeline has shut down.
+func Run(s Scenario) (*Result, error) {
+	run, err := newBenchRun(s)
+	if err != nil {
+		return nil, err
+	}
+	return run.execute()
+}
+
+// Checks the scenario and prepares its messages.
+func newBenchRun(s Scenario) (*benchRun, error) {
+	if s.Messages <= 0 {
+		return nil, errors.New("a scenario must send at least one message")
+	}
+	if s.Filters < 0 || s.PayloadSize < 0 {
+		return nil, errors.New("filters and payload size can't be negative")
+	}
+	if s.Timeout == 0 {
+		s.Timeout = 5 * time.Minute
+	}
+	msgs, err := encodeMessages(s)
+	if err != nil {
+		return nil, fmt.Errorf("can't encode the messages: %s", err)
+	}
+	return &benchRun{
+		scenario: s,
+		msgs:     msgs,
+		sent:     make([]time.Time, s.Messages),
+		latency:  make([]time.Duration, s.Messages),
+		done:     make(chan struct{}),
+	}, nil
+}
+
+func (run *benchRun) execute() (*Result, error) {
+	s := run.scenario
+	baseDir, err := ioutil.TempDir("", "heka-bench")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(baseDir)
+	configPath := filepath.Join(baseDir, "bench.toml")
+	if err = ioutil.WriteFile(configPath, []byte(scenarioConfig(s)), 0644); err != nil {
+		return nil, err
+	}
+
+	runLock.Lock()
+	defer runLock.Unlock()
+	current = run
+	defer func() { current = nil }()
+
+	globals := pipeline.DefaultGlobals()
+	globals.BaseDir = baseDir
+	pConfig := pipeline.NewPipelineConfig(globals)
+	if err = pConfig.PreloadFromConfigFile(configPath); err != nil {
+		return nil, fmt.Errorf("can't load the scenario config: %s", err)
+	}
+	if err = pConfig.LoadConfig(); err != nil {
+		return nil, fmt.Errorf("can't load the scenario config: %s", err)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		pipeline.Run(pConfig)
+		close(stopped)
+	}()
+
+	select {
+	case <-run.done:
+	case <-stopped:
+		return nil, errors.New("the pipeline stopped before all messages arrived")
+	case <-time.After(s.Timeout):
+	}
+	globals.ShutDown(0)
+	<-stopped
+
+	run.lock.Lock()
+	defer run.lock.Unlock()
+	if run.received < s.Messages {
+		return nil, fmt.Errorf("only %d of %d messages arrived within %s",
+			run.received, s.Messages, s.Timeout)
+	}
+	return run.result(), nil
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// Returns the duration at the percentile of the sorted durations.
+func (d durations) percentile(p float64) time.Duration {
+	i := int(float64(len(d))*p/100+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(d) {
+		i = len(d) - 1
+	}
+	return d[i]
+}
+
+func (run *benchRun) result() *Result {
+	latency := durations(run.latency)
+	sort.Sort(latency)
+	elapsed := run.last.Sub(run.first)
+	r := &Result{
+		Name:       run.scenario.FullName(),
+		Scenario:   run.scenario,
+		Messages:   run.received,
+		Duration:   elapsed,
+		LatencyP50: latency.percentile(50),
+		LatencyP90: latency.percentile(90),
+		LatencyP99: latency.percentile(99),
+		LatencyMax: latency[len(latency)-1],
+		Filtered:   run.filtered,
+	}
+	if elapsed > 0 {
+		r.Throughput = float64(run.received) / elapsed.Seconds()
+	}
+	return r
+}
+
+// Compares the results to the baseline ones of the same names, returning a
+// description of each regression, i.e. of each throughput lower or median
+// latency higher than the baseline's by more than the tolerance, a fraction
+// of the baseline value. Results w/o a baseline aren't compared.
+func Compare(baseline, results []*Result, tolerance float64) []string {
+	byName := make(map[string]*Result, len(baseline))
+	for _, b := range baseline {
+		byName[b.Name] = b
+	}
+	var regressions []string
+	for _, r := range results {
+		b, ok := byName[r.Name]
+		if !ok {
+			continue
+		}
+		if r.Throughput < b.Throughput*(1-tolerance) {
+			regressions = append(regressions, fmt.Sprintf(
+				"%s: throughput dropped from %.0f to %.0f msgs/s", r.Name,
+				b.Throughput, r.Throughput))
+		}
+		if float64(r.LatencyP50) > float64(b.LatencyP50)*(1+tolerance) {
+			regressions = append(regressions, fmt.Sprintf(
+				"%s: median latency rose from %s to %s", r.Name, b.LatencyP50,
+				r.LatencyP50))
+		}
+	}
+	return regressions
+}
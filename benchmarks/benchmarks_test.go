@@ -0,0 +1,99 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package benchmarks
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/heka/pipeline"
+)
+
+func init() {
+	pipeline.LogInfo.SetOutput(ioutil.Discard)
+}
+
+func TestRun(t *testing.T) {
+	for _, s := range []Scenario{
+		{Messages: 1000, PayloadSize: 64},
+		{Messages: 1000, Filters: 4},
+		{Messages: 1000, Filters: 4, Sharded: true},
+	} {
+		r, err := Run(s)
+		if err != nil {
+			t.Fatalf("%s: %s", s.FullName(), err)
+		}
+		if r.Messages != s.Messages {
+			t.Errorf("%s: %d messages arrived, expected %d", r.Name, r.Messages,
+				s.Messages)
+		}
+		filtered := int64(s.Messages * s.Filters)
+		if s.Sharded {
+			filtered = int64(s.Messages)
+		}
+		if r.Filtered != filtered {
+			t.Errorf("%s: filters received %d messages, expected %d", r.Name,
+				r.Filtered, filtered)
+		}
+		if r.Throughput <= 0 || r.LatencyP50 > r.LatencyP99 || r.LatencyP99 > r.LatencyMax {
+			t.Errorf("%s: implausible result %s", r.Name, r)
+		}
+	}
+}
+
+func TestRunRejectsEmptyScenarios(t *testing.T) {
+	if _, err := Run(Scenario{}); err == nil {
+		t.Error("expected an error for a scenario w/o messages")
+	}
+}
+
+func TestCompare(t *testing.T) {
+	baseline := []*Result{
+		{Name: "a", Throughput: 1000, LatencyP50: time.Millisecond},
+		{Name: "b", Throughput: 1000, LatencyP50: time.Millisecond},
+	}
+	results := []*Result{
+		{Name: "a", Throughput: 950, LatencyP50: 1050 * time.Microsecond},
+		{Name: "b", Throughput: 800, LatencyP50: 2 * time.Millisecond},
+		{Name: "c", Throughput: 1},
+	}
+	regressions := Compare(baseline, results, 0.1)
+	if len(regressions) != 2 {
+		t.Fatalf("expected 2 regressions, got %v", regressions)
+	}
+	if !strings.HasPrefix(regressions[0], "b: throughput") ||
+		!strings.HasPrefix(regressions[1], "b: median latency") {
+		t.Errorf("unexpected regressions %v", regressions)
+	}
+}
+
+func benchmarkFilters(b *testing.B, filters int, sharded bool) {
+	run, err := newBenchRun(Scenario{Messages: b.N, Filters: filters,
+		Sharded: sharded, PayloadSize: 256})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	if _, err = run.execute(); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkNoFilters(b *testing.B)             { benchmarkFilters(b, 0, false) }
+func BenchmarkTenFilters(b *testing.B)            { benchmarkFilters(b, 10, false) }
+func BenchmarkHundredFilters(b *testing.B)        { benchmarkFilters(b, 100, false) }
+func BenchmarkHundredShardedFilters(b *testing.B) { benchmarkFilters(b, 100, true) }
@@ -0,0 +1,130 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package benchmarks
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/mozilla-services/heka/pipeline"
+)
+
+// Input delivering the running scenario's messages as fast as the pipeline
+// takes them.
+type BenchInput struct {
+	run      *benchRun
+	stopChan chan struct{}
+}
+
+func (bi *BenchInput) Init(config interface{}) (err error) {
+	bi.run, err = activeRun()
+	bi.stopChan = make(chan struct{})
+	return
+}
+
+func (bi *BenchInput) Run(ir pipeline.InputRunner, h pipeline.PluginHelper) error {
+	run := bi.run
+	inChan := ir.InChan()
+	var pack *pipeline.PipelinePack
+	for i, msgBytes := range run.msgs {
+		select {
+		case pack = <-inChan:
+		case <-bi.stopChan:
+			return nil
+		}
+		pack.MsgBytes = append(pack.MsgBytes[:0], msgBytes...)
+		run.sent[i] = time.Now()
+		if i == 0 {
+			run.lock.Lock()
+			run.first = run.sent[0]
+			run.lock.Unlock()
+		}
+		ir.Deliver(pack)
+	}
+	// An input exiting would shut the pipeline down.
+	<-bi.stopChan
+	return nil
+}
+
+func (bi *BenchInput) Stop() {
+	close(bi.stopChan)
+}
+
+// Filter counting the messages it's handed.
+type BenchFilter struct {
+	run *benchRun
+}
+
+func (bf *BenchFilter) Init(config interface{}) (err error) {
+	bf.run, err = activeRun()
+	return
+}
+
+func (bf *BenchFilter) Run(fr pipeline.FilterRunner, h pipeline.PluginHelper) error {
+	var count int64
+	for pack := range fr.InChan() {
+		if _, ok := pack.Message.GetFieldValue("seq"); ok {
+			count++
+		}
+		fr.UpdateCursor(pack.QueueCursor)
+		pack.Recycle(nil)
+	}
+	atomic.AddInt64(&bf.run.filtered, count)
+	return nil
+}
+
+// Output recording each message's latency, which signals the end of the
+// scenario once all of its messages have arrived.
+type BenchOutput struct {
+	run *benchRun
+}
+
+func (bo *BenchOutput) Init(config interface{}) (err error) {
+	bo.run, err = activeRun()
+	return
+}
+
+func (bo *BenchOutput) Run(or pipeline.OutputRunner, h pipeline.PluginHelper) error {
+	run := bo.run
+	for pack := range or.InChan() {
+		now := time.Now()
+		if seq, ok := pack.Message.GetFieldValue("seq"); ok {
+			i := int(seq.(int64))
+			run.lock.Lock()
+			run.latency[i] = now.Sub(run.sent[i])
+			run.received++
+			run.last = now
+			if run.received == len(run.msgs) {
+				close(run.done)
+			}
+			run.lock.Unlock()
+		}
+		or.UpdateCursor(pack.QueueCursor)
+		pack.Recycle(nil)
+	}
+	return nil
+}
+
+func init() {
+	pipeline.RegisterPlugin("BenchInput", func() interface{} {
+		return new(BenchInput)
+	})
+	pipeline.RegisterPlugin("BenchFilter", func() interface{} {
+		return new(BenchFilter)
+	})
+	pipeline.RegisterPlugin("BenchOutput", func() interface{} {
+		return new(BenchOutput)
+	})
+}
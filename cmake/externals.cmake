@@ -167,9 +167,12 @@ git_clone(https://github.com/eapache/go-resiliency v1.0.0)
 git_clone(https://github.com/eapache/queue v1.0.2)
 git_clone_to_path(https://github.com/rafrombrc/sarama f742e1e20b15b31320e0b6ff2f995bc5f0482fed github.com/Shopify/sarama)
 git_clone(https://github.com/davecgh/go-spew 2df174808ee097f90d259e432cc04442cf60be21)
+git_clone(https://github.com/boltdb/bolt v1.3.0)
+git_clone(https://github.com/soniah/gosnmp v1.22.0)
 
 add_dependencies(sarama snappy)
 
+
 if (INCLUDE_GEOIP)
     add_external_plugin(git https://github.com/abh/geoip da130741c8ed2052f5f455d56e552f2e997e1ce9)
 endif()
@@ -178,6 +181,23 @@ if (INCLUDE_DOCKER_PLUGINS)
     git_clone(https://github.com/fsouza/go-dockerclient 175e1df973274f04e9b459a62cffc49808f1a649)
 endif()
 
+git_clone_to_path(https://github.com/golang/net release-branch.go1.7 golang.org/x/net)
+git_clone_to_path(https://github.com/golang/text v0.3.0 golang.org/x/text)
+git_clone_to_path(https://github.com/golang/sys v0.1.0 golang.org/x/sys)
+git_clone_to_path(https://github.com/golang/crypto v0.1.0 golang.org/x/crypto)
+git_clone(https://github.com/kr/fs v0.1.0)
+git_clone(https://github.com/pkg/sftp v1.13.5)
+add_dependencies(crypto sys)
+add_dependencies(sftp crypto fs)
+git_clone(https://github.com/tetratelabs/wazero v1.8.0)
+
+if (INCLUDE_GRPC_PLUGINS)
+    # The .git suffix keeps the target name from clashing w/ gogo/protobuf.
+    git_clone_to_path(https://github.com/golang/protobuf.git v1.0.0 github.com/golang/protobuf)
+    git_clone_to_path(https://github.com/grpc/grpc-go v1.0.4 google.golang.org/grpc)
+    add_dependencies(grpc-go net protobuf.git)
+endif()
+
 if (INCLUDE_MOZSVC)
     #git_clone(https://github.com/bitly/go-simplejson ec501b3f691bcc79d97caf8fdf28bcf136efdab8)
     git_clone(https://github.com/AdRoll/goamz e0af8b0b22517e9fb1d6a4438fa8269c3e834d2d)
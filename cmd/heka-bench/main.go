@@ -0,0 +1,115 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+/*
+Heka benchmark runner.
+
+Runs the end to end pipeline benchmarks of the benchmarks package for a number
+of filter counts, printing the throughput and latency of each scenario. The
+results can be written out as JSON and later used as the baseline of another
+run, which then fails if any scenario has regressed by more than the
+tolerance.
+*/
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/mozilla-services/heka/benchmarks"
+	"github.com/mozilla-services/heka/pipeline"
+)
+
+func main() {
+	messages := flag.Int("messages", 100000, "Number of messages each scenario sends")
+	filters := flag.String("filters", "0,10,100",
+		"Comma separated filter counts, one scenario is run for each")
+	sharded := flag.Bool("sharded", false,
+		"Whether each filter only matches its share of the messages")
+	payload := flag.Int("payload", 256, "Payload size of the messages in bytes")
+	baseline := flag.String("baseline", "", "JSON results of an earlier run to compare to")
+	tolerance := flag.Float64("tolerance", 0.1,
+		"Fraction by which results may be worse than the baseline")
+	out := flag.String("out", "", "File to write the JSON results to")
+	verbose := flag.Bool("verbose", false, "Show the pipeline's log output")
+	flag.Parse()
+
+	if !*verbose {
+		pipeline.LogInfo.SetOutput(ioutil.Discard)
+	}
+
+	var scenarios []benchmarks.Scenario
+	for _, count := range strings.Split(*filters, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(count))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid filter count '%s'\n", count)
+			os.Exit(2)
+		}
+		scenarios = append(scenarios, benchmarks.Scenario{
+			Messages:    *messages,
+			Filters:     n,
+			Sharded:     *sharded,
+			PayloadSize: *payload,
+		})
+	}
+
+	var baseResults []*benchmarks.Result
+	if *baseline != "" {
+		data, err := ioutil.ReadFile(*baseline)
+		if err == nil {
+			err = json.Unmarshal(data, &baseResults)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading the baseline: %s\n", err)
+			os.Exit(2)
+		}
+	}
+
+	var results []*benchmarks.Result
+	for _, s := range scenarios {
+		r, err := benchmarks.Run(s)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", s.FullName(), err)
+			os.Exit(1)
+		}
+		fmt.Println(r)
+		results = append(results, r)
+	}
+
+	if *out != "" {
+		data, err := json.MarshalIndent(results, "", "  ")
+		if err == nil {
+			err = ioutil.WriteFile(*out, append(data, '\n'), 0644)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing the results: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if baseResults != nil {
+		regressions := benchmarks.Compare(baseResults, results, *tolerance)
+		for _, regression := range regressions {
+			fmt.Fprintf(os.Stderr, "REGRESSION %s\n", regression)
+		}
+		if len(regressions) > 0 {
+			os.Exit(3)
+		}
+	}
+}
@@ -0,0 +1,368 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+/*
+
+A command-line utility for inspecting and repairing the on-disk queue buffers
+of Heka plugins. Hekad must not be running w/ the queue's plugin while the
+queue is being modified.
+
+*/
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+)
+
+const usage = `Usage: heka-buffer <command> [options] <queue_dir>
+
+Commands:
+  stat     show the queue files, checkpoint, depth and age of the oldest record
+  dump     write the records matching a message matcher
+  purge    remove the unread records matching a message matcher
+  requeue  re-deliver records, from a queue cursor or a Heka stream file
+
+Run 'heka-buffer <command> -h' for the command's options.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(1)
+	}
+	var err error
+	switch os.Args[1] {
+	case "stat":
+		err = stat(os.Args[2:])
+	case "dump":
+		err = dump(os.Args[2:])
+	case "purge":
+		err = purge(os.Args[2:])
+	case "requeue":
+		err = requeue(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(2)
+	}
+}
+
+// Parses the command's flags and opens the queue named by its one argument.
+func openQueue(flags *flag.FlagSet, args []string) (*pipeline.BufferQueue, error) {
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.PrintDefaults()
+		os.Exit(1)
+	}
+	return pipeline.OpenBufferQueue(flags.Arg(0))
+}
+
+func stat(args []string) error {
+	flags := flag.NewFlagSet("stat", flag.ExitOnError)
+	queue, err := openQueue(flags, args)
+	if err != nil {
+		return err
+	}
+	defer queue.Close()
+	files, err := queue.Files()
+	if err != nil {
+		return err
+	}
+	cpId, cpOffset, err := queue.Checkpoint()
+	if err != nil {
+		return fmt.Errorf("can't read checkpoint: %s", err)
+	}
+
+	var size int64
+	for _, f := range files {
+		fmt.Printf("File: %d.log  Size: %d\n", f.Id, f.Size)
+		size += f.Size
+	}
+	var depth int64
+	var oldest *message.Message
+	err = queue.Scan(false, func(rec *pipeline.BufferQueueRecord) error {
+		if oldest == nil {
+			oldest = rec.Message
+		}
+		depth++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Files: %d  Size: %d\n", len(files), size)
+	fmt.Printf("Checkpoint: %d %d\n", cpId, cpOffset)
+	fmt.Printf("Depth: %d\n", depth)
+	if oldest != nil {
+		ts := time.Unix(0, oldest.GetTimestamp())
+		fmt.Printf("Oldest: %s  Age: %s\n", ts, time.Since(ts))
+	}
+	return nil
+}
+
+func dump(args []string) error {
+	flags := flag.NewFlagSet("dump", flag.ExitOnError)
+	flagMatch := flags.String("match", "TRUE", "message_matcher filter expression")
+	flagFormat := flags.String("format", "txt", "output format [txt|json|heka|count]")
+	flagOutput := flags.String("output", "", "output filename, defaults to stdout")
+	flagAll := flags.Bool("all", false, "include the delivered records still on disk")
+	queue, err := openQueue(flags, args)
+	if err != nil {
+		return err
+	}
+	defer queue.Close()
+	match, err := message.CreateMatcherSpecification(*flagMatch)
+	if err != nil {
+		return fmt.Errorf("Match specification - %s", err)
+	}
+
+	out := os.Stdout
+	if *flagOutput != "" {
+		if out, err = os.OpenFile(*flagOutput, os.O_WRONLY|os.O_CREATE|os.O_TRUNC,
+			0644); err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+
+	var processed, matched int64
+	err = queue.Scan(*flagAll, func(rec *pipeline.BufferQueueRecord) error {
+		processed++
+		if !match.Match(rec.Message) {
+			return nil
+		}
+		matched++
+		writeRecord(out, *flagFormat, rec)
+		return nil
+	})
+	fmt.Fprintf(os.Stderr, "Processed: %d, matched: %d messages\n", processed, matched)
+	return err
+}
+
+func writeRecord(out io.Writer, format string, rec *pipeline.BufferQueueRecord) {
+	msg := rec.Message
+	switch format {
+	case "count":
+		// no op
+	case "json":
+		contents, _ := json.Marshal(msg)
+		fmt.Fprintf(out, "%s\n", contents)
+	case "heka":
+		fmt.Fprintf(out, "%s", rec.Record)
+	default:
+		fmt.Fprintf(out, "Cursor: %d %d\n"+
+			"Delivered: %t\n"+
+			"Timestamp: %s\n"+
+			"Type: %s\n"+
+			"Hostname: %s\n"+
+			"Pid: %d\n"+
+			"UUID: %s\n"+
+			"Logger: %s\n"+
+			"Payload: %s\n"+
+			"EnvVersion: %s\n"+
+			"Severity: %d\n"+
+			"Fields: %+v\n",
+			rec.Id, rec.Offset, rec.Delivered,
+			time.Unix(0, msg.GetTimestamp()), msg.GetType(),
+			msg.GetHostname(), msg.GetPid(), msg.GetUuidString(),
+			msg.GetLogger(), msg.GetPayload(), msg.GetEnvVersion(),
+			msg.GetSeverity(), msg.Fields)
+		if lineage := pipeline.MessageLineage(msg); lineage != nil {
+			fmt.Fprintf(out, "Lineage: %s\n", strings.Join(lineage, " > "))
+		}
+		fmt.Fprintln(out)
+	}
+}
+
+// Rewrites the unread records, minus the purged ones, to a new queue file
+// and moves the checkpoint to its start.
+func purge(args []string) error {
+	flags := flag.NewFlagSet("purge", flag.ExitOnError)
+	flagMatch := flags.String("match", "TRUE", "message_matcher filter expression")
+	flagCount := flags.Int64("count", 0, "maximum number of records to purge, 0 for no limit")
+	flagDryRun := flags.Bool("dry-run", false, "only count the records that would be purged")
+	queue, err := openQueue(flags, args)
+	if err != nil {
+		return err
+	}
+	defer queue.Close()
+	match, err := message.CreateMatcherSpecification(*flagMatch)
+	if err != nil {
+		return fmt.Errorf("Match specification - %s", err)
+	}
+
+	var kept []*message.Message
+	var purged int64
+	err = queue.Scan(false, func(rec *pipeline.BufferQueueRecord) error {
+		if (*flagCount == 0 || purged < *flagCount) && match.Match(rec.Message) {
+			purged++
+		} else {
+			kept = append(kept, rec.Message)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Purged: %d, kept: %d messages\n", purged, len(kept))
+	if *flagDryRun || purged == 0 {
+		return nil
+	}
+	id, err := queue.Append(kept)
+	if err != nil {
+		return err
+	}
+	return queue.SetCheckpoint(id, 0)
+}
+
+// Re-delivers records, either by moving the checkpoint back to an already
+// delivered record still on disk, or by appending the matching records from
+// the delivered ones or a Heka stream file to the end of the queue.
+func requeue(args []string) error {
+	flags := flag.NewFlagSet("requeue", flag.ExitOnError)
+	flagFrom := flags.String("from", "",
+		"queue cursor ('<id> <offset>') of a delivered record to rewind the checkpoint to")
+	flagMatch := flags.String("match", "",
+		"message_matcher filter expression for the delivered records to append")
+	flagInput := flags.String("input", "",
+		"Heka stream file w/ the records to append, e.g. from heka-cat -format heka")
+	queue, err := openQueue(flags, args)
+	if err != nil {
+		return err
+	}
+	defer queue.Close()
+
+	if *flagFrom != "" {
+		if *flagMatch != "" || *flagInput != "" {
+			return fmt.Errorf("-from can't be combined w/ -match or -input")
+		}
+		return rewind(queue, *flagFrom)
+	}
+
+	match, err := message.CreateMatcherSpecification("TRUE")
+	if *flagMatch != "" {
+		match, err = message.CreateMatcherSpecification(*flagMatch)
+	}
+	if err != nil {
+		return fmt.Errorf("Match specification - %s", err)
+	}
+
+	var msgs []*message.Message
+	if *flagInput != "" {
+		msgs, err = readStream(*flagInput, match)
+	} else if *flagMatch != "" {
+		err = queue.Scan(true, func(rec *pipeline.BufferQueueRecord) error {
+			if rec.Delivered && match.Match(rec.Message) {
+				msgs = append(msgs, rec.Message)
+			}
+			return nil
+		})
+	} else {
+		return fmt.Errorf("requeue requires -from, -match or -input")
+	}
+	if err != nil {
+		return err
+	}
+	if len(msgs) == 0 {
+		fmt.Fprintln(os.Stderr, "Requeued: 0 messages")
+		return nil
+	}
+	id, err := queue.Append(msgs)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Requeued: %d messages to %d.log\n", len(msgs), id)
+	return nil
+}
+
+func rewind(queue *pipeline.BufferQueue, cursor string) error {
+	var id uint
+	var offset int64
+	if _, err := fmt.Sscanf(cursor, "%d %d", &id, &offset); err != nil {
+		return fmt.Errorf("invalid queue cursor '%s': %s", cursor, err)
+	}
+	var found bool
+	var requeued int64
+	err := queue.Scan(true, func(rec *pipeline.BufferQueueRecord) error {
+		if rec.Id == id && rec.Offset == offset {
+			found = true
+		}
+		if found && rec.Delivered {
+			requeued++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("no record at queue cursor '%s'", cursor)
+	}
+	if requeued == 0 {
+		return fmt.Errorf("the record at queue cursor '%s' hasn't been delivered", cursor)
+	}
+	fmt.Fprintf(os.Stderr, "Requeued: %d messages\n", requeued)
+	return queue.SetCheckpoint(id, offset)
+}
+
+func readStream(filename string, match *message.MatcherSpecification) (
+	[]*message.Message, error) {
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	splitter := &pipeline.HekaFramingSplitter{}
+	if err = splitter.Init(splitter.ConfigStruct()); err != nil {
+		return nil, fmt.Errorf("Error initializing HekaFramingSplitter: %s", err)
+	}
+	sRunner := pipeline.NewSplitterRunner("HekaFramingSplitter", splitter,
+		pipeline.CommonSplitterConfig{})
+
+	var msgs []*message.Message
+	for {
+		_, record, err := sRunner.GetRecordFromStream(file)
+		if err == io.EOF {
+			return msgs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) == 0 {
+			continue
+		}
+		msg := new(message.Message)
+		headerLen := int(record[1]) + message.HEADER_FRAMING_SIZE
+		if err = message.UnmarshalMessage(record[headerLen:], msg); err != nil {
+			fmt.Fprintf(os.Stderr, "Error unmarshalling message: %s\n", err)
+			continue
+		}
+		if match.Match(msg) {
+			msgs = append(msgs, msg)
+		}
+	}
+}
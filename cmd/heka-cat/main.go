@@ -28,9 +28,9 @@ import (
 	"io"
 	"math"
 	"os"
+	"strings"
 	"time"
 
-	"github.com/gogo/protobuf/proto"
 	"github.com/mozilla-services/heka/message"
 	"github.com/mozilla-services/heka/pipeline"
 )
@@ -128,7 +128,7 @@ func main() {
 			if len(record) > 0 {
 				processed += 1
 				headerLen := int(record[1]) + message.HEADER_FRAMING_SIZE
-				if err = proto.Unmarshal(record[headerLen:], msg); err != nil {
+				if err = message.UnmarshalMessage(record[headerLen:], msg); err != nil {
 					fmt.Fprintf(os.Stderr, "Error unmarshalling message at offset: %d error: %s\n", offset, err)
 					continue
 				}
@@ -156,11 +156,15 @@ func main() {
 						"Payload: %s\n"+
 						"EnvVersion: %s\n"+
 						"Severity: %d\n"+
-						"Fields: %+v\n\n",
+						"Fields: %+v\n",
 						time.Unix(0, msg.GetTimestamp()), msg.GetType(),
 						msg.GetHostname(), msg.GetPid(), msg.GetUuidString(),
 						msg.GetLogger(), msg.GetPayload(), msg.GetEnvVersion(),
 						msg.GetSeverity(), msg.Fields)
+					if lineage := pipeline.MessageLineage(msg); lineage != nil {
+						fmt.Fprintf(out, "Lineage: %s\n", strings.Join(lineage, " > "))
+					}
+					fmt.Fprintln(out)
 				}
 			}
 		}
@@ -0,0 +1,90 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+/*
+
+A command-line utility for generating config keys and encrypting config
+values, such as passwords, to be used as `enc:` values in a hekad config.
+
+*/
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mozilla-services/heka/pipeline"
+)
+
+func main() {
+	flagKeygen := flag.Bool("keygen", false, "output a new random config key and exit")
+	flagKeyFile := flag.String("key-file", "", "file holding the config key")
+	flagKeyCommand := flag.String("key-command", "",
+		"command outputting the config key, e.g. a KMS client")
+	flagDecrypt := flag.Bool("decrypt", false, "decrypt an `enc:` value rather than "+
+		"encrypting a value")
+	flag.Parse()
+
+	if *flagKeygen {
+		key, err := pipeline.NewConfigKey()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(key)
+		return
+	}
+
+	if flag.NArg() > 1 {
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	key, err := pipeline.LoadConfigKey(*flagKeyFile, *flagKeyCommand)
+	if err == nil && key == nil {
+		err = pipeline.ErrNoConfigKey
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(2)
+	}
+
+	// Read the value from stdin if it's not an argument, so it doesn't end up
+	// in the shell history.
+	var value string
+	if flag.NArg() == 1 {
+		value = flag.Arg(0)
+	} else {
+		if value, err = bufio.NewReader(os.Stdin).ReadString('\n'); err != nil &&
+			value == "" {
+			fmt.Fprintf(os.Stderr, "Error reading value: %s\n", err)
+			os.Exit(3)
+		}
+		value = strings.TrimRight(value, "\r\n")
+	}
+
+	if *flagDecrypt {
+		value, err = pipeline.DecryptConfigValue(key, value)
+	} else {
+		value, err = pipeline.EncryptConfigValue(key, value)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(4)
+	}
+	fmt.Println(value)
+}
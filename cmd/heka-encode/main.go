@@ -0,0 +1,240 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+/*
+
+A command-line utility that reads a Heka protobuf stream and writes the output
+of any encoder configured in a hekad config to stdout, w/o running a pipeline.
+
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bbangert/toml"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	_ "github.com/mozilla-services/heka/plugins"
+	_ "github.com/mozilla-services/heka/plugins/elasticsearch"
+)
+
+func makeSplitterRunner() (pipeline.SplitterRunner, error) {
+	splitter := &pipeline.HekaFramingSplitter{}
+	config := splitter.ConfigStruct()
+	err := splitter.Init(config)
+	if err != nil {
+		return nil, fmt.Errorf("Error initializing HekaFramingSplitter: %s", err)
+	}
+	srConfig := pipeline.CommonSplitterConfig{}
+	sRunner := pipeline.NewSplitterRunner("HekaFramingSplitter", splitter, srConfig)
+	return sRunner, nil
+}
+
+// Returns the config file, or all of the *.toml files in the config
+// directory.
+func configFiles(configPath string) ([]string, error) {
+	fi, err := os.Stat(configPath)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return []string{configPath}, nil
+	}
+	files, err := ioutil.ReadDir(configPath)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), ".toml") {
+			paths = append(paths, filepath.Join(configPath, f.Name()))
+		}
+	}
+	return paths, nil
+}
+
+// The [hekad] settings encoders might depend on, e.g. the SandboxEncoder
+// looking up its script in the share_dir.
+type hekadSection struct {
+	Hekad struct {
+		BaseDir  string `toml:"base_dir"`
+		ShareDir string `toml:"share_dir"`
+		Hostname string
+	}
+}
+
+func loadEncoder(configPath, name string) (pipeline.Encoder, error) {
+	globals := pipeline.DefaultGlobals()
+	var paths []string
+	if configPath != "" {
+		var err error
+		if paths, err = configFiles(configPath); err != nil {
+			return nil, err
+		}
+	}
+	for _, path := range paths {
+		var section hekadSection
+		contents, err := pipeline.ReplaceEnvsFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = toml.Decode(contents, &section); err != nil {
+			return nil, fmt.Errorf("Error decoding config file: %s", err)
+		}
+		if section.Hekad.BaseDir != "" {
+			globals.BaseDir = section.Hekad.BaseDir
+		}
+		if section.Hekad.ShareDir != "" {
+			globals.ShareDir = section.Hekad.ShareDir
+		}
+		if section.Hekad.Hostname != "" {
+			globals.Hostname = section.Hekad.Hostname
+		}
+	}
+
+	pConfig := pipeline.NewPipelineConfig(globals)
+	for _, path := range paths {
+		if err := pConfig.PreloadFromConfigFile(path); err != nil {
+			return nil, err
+		}
+	}
+	return pConfig.LoadEncoder(name)
+}
+
+func main() {
+	flagConfig := flag.String("config", "", "hekad config file or directory holding the encoder's config")
+	flagEncoder := flag.String("encoder", "ProtobufEncoder", "name of the encoder to use")
+	flagMatch := flag.String("match", "TRUE", "message_matcher filter expression")
+	flagFraming := flag.Bool("framing", false, "wrap the encoder's output in Heka's stream framing")
+	flagOutput := flag.String("output", "", "output filename, defaults to stdout")
+	flagMaxMessageSize := flag.Uint64("max-message-size", 4*1024*1024, "maximum message size in bytes")
+	flag.Parse()
+
+	if flag.NArg() > 1 {
+		fmt.Fprintln(os.Stderr, "usage: heka-encode [flags] [protobuf stream file, defaults to stdin]")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if *flagMaxMessageSize < math.MaxUint32 {
+		maxSize := uint32(*flagMaxMessageSize)
+		message.SetMaxMessageSize(maxSize)
+	} else {
+		fmt.Fprintf(os.Stderr, "Message size is too large: %d\n", flagMaxMessageSize)
+		os.Exit(8)
+	}
+
+	var err error
+	var match *message.MatcherSpecification
+	if match, err = message.CreateMatcherSpecification(*flagMatch); err != nil {
+		fmt.Fprintf(os.Stderr, "Match specification - %s\n", err)
+		os.Exit(2)
+	}
+
+	encoder, err := loadEncoder(*flagConfig, *flagEncoder)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading encoder: %s\n", err)
+		os.Exit(9)
+	}
+	msgEncoder := pipeline.NewMessageEncoder(encoder, *flagFraming)
+	defer msgEncoder.Stop()
+
+	var in *os.File
+	if flag.NArg() == 0 || flag.Arg(0) == "-" {
+		in = os.Stdin
+	} else {
+		if in, err = os.Open(flag.Arg(0)); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(3)
+		}
+		defer in.Close()
+	}
+
+	var out *os.File
+	if "" == *flagOutput {
+		out = os.Stdout
+	} else {
+		if out, err = os.OpenFile(*flagOutput, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(4)
+		}
+		defer out.Close()
+	}
+
+	sRunner, err := makeSplitterRunner()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(7)
+	}
+
+	var offset int64
+	var processed, matched, encoded, failed int64
+	for {
+		n, record, err := sRunner.GetRecordFromStream(in)
+		if n > 0 && n != len(record) {
+			fmt.Fprintf(os.Stderr, "Corruption detected at offset: %d bytes: %d\n", offset, n-len(record))
+		}
+		if err != nil {
+			if err != io.EOF {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+				os.Exit(6)
+			}
+			break
+		}
+		offset += int64(n)
+		if len(record) == 0 {
+			continue
+		}
+		processed++
+		msg := new(message.Message)
+		headerLen := int(record[1]) + message.HEADER_FRAMING_SIZE
+		msgBytes := record[headerLen:]
+		if err = message.UnmarshalMessage(msgBytes, msg); err != nil {
+			fmt.Fprintf(os.Stderr, "Error unmarshalling message at offset: %d error: %s\n", offset, err)
+			continue
+		}
+		if !match.Match(msg) {
+			continue
+		}
+		matched++
+
+		output, err := msgEncoder.Encode(msg, msgBytes)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error encoding message at offset: %d error: %s\n", offset, err)
+			failed++
+			continue
+		}
+		if output == nil {
+			continue
+		}
+		if _, err = out.Write(output); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(5)
+		}
+		encoded++
+	}
+	fmt.Fprintf(os.Stderr, "Processed: %d, matched: %d, encoded: %d, failed: %d messages\n",
+		processed, matched, encoded, failed)
+	if failed > 0 {
+		os.Exit(10)
+	}
+}
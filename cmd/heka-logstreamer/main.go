@@ -26,6 +26,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
@@ -54,6 +55,7 @@ type FileConfig map[string]toml.Primitive
 
 func main() {
 	configFile := flag.String("config", "logstreamer.toml", "Heka Logstreamer configuration file")
+	simulateFile := flag.String("simulate", "", "rotation sequence to simulate instead of scanning the log_directory")
 
 	flag.Parse()
 
@@ -105,26 +107,57 @@ func main() {
 		}
 	}
 
-	// Go through the logstreams and parse their configs
-	for name, prim := range inputs {
-		parseConfig(name, prim)
+	var steps []rotationStep
+	if *simulateFile != "" {
+		if steps, err = loadRotationSteps(*simulateFile); err != nil {
+			client.LogError.Fatalf("Error loading rotation sequence: %s", err)
+		}
+	}
+
+	// Go through the logstreams and parse their configs, in a stable order.
+	names := make([]string, 0, len(inputs))
+	for name := range inputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var warnings int
+	for _, name := range names {
+		config, ok := parseConfig(name, inputs[name])
+		if !ok {
+			warnings++
+			continue
+		}
+		if steps != nil {
+			warnings += simulateRotation(name, config, steps)
+		} else {
+			warnings += verifyConfig(name, config)
+		}
+	}
+	if warnings > 0 {
+		fmt.Printf("\n%d warning(s).\n", warnings)
+		os.Exit(1)
 	}
 }
 
-func parseConfig(name string, prim toml.Primitive) {
-	config := LogstreamerConfig{
+func parseConfig(name string, prim toml.Primitive) (config LogstreamerConfig, ok bool) {
+	config = LogstreamerConfig{
 		OldestDuration: "720h",
 		Differentiator: []string{name},
 		LogDirectory:   "/var/log",
 	}
 	if err := toml.PrimitiveDecode(prim, &config); err != nil {
 		client.LogError.Printf("Error decoding config file: %s", err)
-		return
+		return config, false
 	}
 
 	if len(config.FileMatch) > 0 && config.FileMatch[len(config.FileMatch)-1:] != "$" {
 		config.FileMatch += "$"
 	}
+	return config, true
+}
+
+func newLogstreamSet(config LogstreamerConfig, logDirectory, journalDir string) (
+	*logstreamer.LogstreamSet, error) {
 
 	sp := &logstreamer.SortPattern{
 		FileMatch:      config.FileMatch,
@@ -133,14 +166,19 @@ func parseConfig(name string, prim toml.Primitive) {
 		Differentiator: config.Differentiator,
 	}
 	oldest, _ := time.ParseDuration(config.OldestDuration)
-	ls, err := logstreamer.NewLogstreamSet(sp, oldest, config.LogDirectory, "", config.InitialTail)
+	return logstreamer.NewLogstreamSet(sp, oldest, logDirectory, journalDir, config.InitialTail)
+}
+
+// Prints the logstreams the config finds in the log directory along w/ any
+// problems found, returning the number of warnings.
+func verifyConfig(name string, config LogstreamerConfig) int {
+	ls, err := newLogstreamSet(config, config.LogDirectory, "")
 	if err != nil {
 		client.LogError.Fatalf("Error initializing LogstreamSet: %s\n", err.Error())
 	}
-	streams, errs := ls.ScanForLogstreams()
-	if errs.IsError() {
-		client.LogError.Fatalf("Error scanning: %s\n", errs)
-	}
+	// Problems w/ the scan are reported in more detail by Verify.
+	streams, _ := ls.ScanForLogstreams()
+	sort.Strings(streams)
 
 	fmt.Printf("Found %d Logstream(s) for section [%s].\n", len(streams), name)
 	for _, name := range streams {
@@ -151,7 +189,35 @@ func parseConfig(name string, prim toml.Primitive) {
 		fmt.Printf("Stream Choosing Filename: %s, SeekPosition: %d\n", filename, seekPosition)
 		fmt.Printf("Files: %d (printing oldest to newest)\n", len(stream.GetLogfiles()))
 		for _, logfile := range stream.GetLogfiles() {
-			fmt.Printf("\t%s\n", logfile.FileName)
+			fmt.Printf("\t%s%s\n", logfile.FileName, sortKeys(logfile, config.Priority))
 		}
 	}
+
+	warnings := ls.Verify()
+	printWarnings(name, warnings)
+	return len(warnings)
+}
+
+// Shows the values a logfile is sorted on, if there's more than one file to
+// sort.
+func sortKeys(logfile *logstreamer.Logfile, priority []string) string {
+	if len(priority) == 0 {
+		return ""
+	}
+	keys := make([]string, len(priority))
+	for i, part := range priority {
+		part = strings.TrimPrefix(part, "^")
+		keys[i] = fmt.Sprintf("%s=%d", part, logfile.MatchParts[part])
+	}
+	return "  (" + strings.Join(keys, ", ") + ")"
+}
+
+func printWarnings(name string, warnings []string) {
+	if len(warnings) == 0 {
+		return
+	}
+	fmt.Printf("\nWarnings for section [%s]:\n", name)
+	for _, w := range warnings {
+		fmt.Printf("\t%s\n", w)
+	}
 }
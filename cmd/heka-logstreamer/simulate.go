@@ -0,0 +1,212 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mozilla-services/heka/client"
+)
+
+// A file in the log directory after a rotation step, and the file it was
+// renamed from by the step, if any.
+type rotatedFile struct {
+	name string
+	from string
+}
+
+// The complete contents of the log directory after a rotation step.
+type rotationStep []rotatedFile
+
+// Loads a rotation sequence. Each step lists the files in the log directory,
+// relative to it, one per line. A `new < old` line means `old` was renamed to
+// `new` during the step. Steps are separated by `---` lines, and lines
+// starting w/ `#` are ignored. For example, two logrotate runs:
+//
+//     app.log
+//     ---
+//     app.log.1 < app.log
+//     app.log
+//     ---
+//     app.log.2 < app.log.1
+//     app.log.1 < app.log
+//     app.log
+func loadRotationSteps(path string) (steps []rotationStep, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var step rotationStep
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		case line == "---":
+			if len(step) > 0 {
+				steps = append(steps, step)
+			}
+			step = nil
+			continue
+		}
+		file := rotatedFile{name: line}
+		if i := strings.Index(line, "<"); i != -1 {
+			file.name = strings.TrimSpace(line[:i])
+			file.from = strings.TrimSpace(line[i+1:])
+		}
+		if file.name == "" || (file.from == "" && file.name != line) {
+			return nil, fmt.Errorf("invalid line in step %d: %s", len(steps)+1, line)
+		}
+		step = append(step, file)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(step) > 0 {
+		steps = append(steps, step)
+	}
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("%s holds no rotation steps", path)
+	}
+	return steps, nil
+}
+
+// Recreates each step of the rotation sequence in a temporary log directory
+// and shows the order the config's logstreams would read its files in. Every
+// file is tagged w/ the generation of its contents, i.e. the step it was
+// created in, so files must always be read w/ their generations ascending.
+// Returns the number of warnings.
+func simulateRotation(name string, config LogstreamerConfig, steps []rotationStep) int {
+	tmpDir, err := ioutil.TempDir("", "heka-logstreamer")
+	if err != nil {
+		client.LogError.Fatalf("Error creating simulation directory: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	if tmpDir, err = filepath.EvalSymlinks(tmpDir); err != nil {
+		client.LogError.Fatalf("Error resolving simulation directory: %s", err)
+	}
+	logDir := filepath.Join(tmpDir, "logs")
+	journalDir := filepath.Join(tmpDir, "journals")
+	relative := func(s string) string {
+		return strings.Replace(s, logDir+string(os.PathSeparator), "", -1)
+	}
+
+	fmt.Printf("Simulating %d rotation step(s) for section [%s].\n", len(steps), name)
+	var warnings []string
+	seen := make(map[string]bool)
+	warn := func(msg string) {
+		if !seen[msg] {
+			seen[msg] = true
+			warnings = append(warnings, msg)
+		}
+	}
+
+	generations := make(map[string]int)
+	for i, step := range steps {
+		// The files renamed away during this step, whose names are taken by
+		// new files unless they're renamed into again.
+		renamed := make(map[string]bool)
+		for _, file := range step {
+			if file.from != "" {
+				renamed[file.from] = true
+			}
+		}
+		current := make(map[string]int)
+		for _, file := range step {
+			gen, ok := generations[file.from]
+			switch {
+			case file.from != "" && !ok:
+				warn(fmt.Sprintf("step %d: %s is renamed from %s, which doesn't exist",
+					i+1, file.name, file.from))
+				gen = i + 1
+			case file.from == "":
+				if gen, ok = generations[file.name]; !ok || renamed[file.name] {
+					gen = i + 1
+				}
+			}
+			current[file.name] = gen
+		}
+		generations = current
+
+		if err = writeLogDir(logDir, generations); err != nil {
+			client.LogError.Fatalf("Error writing simulation step %d: %s", i+1, err)
+		}
+		ls, err := newLogstreamSet(config, logDir, journalDir)
+		if err != nil {
+			client.LogError.Fatalf("Error initializing LogstreamSet: %s\n", err.Error())
+		}
+		streams, _ := ls.ScanForLogstreams()
+		sort.Strings(streams)
+
+		fmt.Printf("\nStep %d:\n", i+1)
+		if len(streams) == 0 {
+			fmt.Println("\tNo logstreams found.")
+		}
+		for _, stream := range streams {
+			l, _ := ls.GetLogstream(stream)
+			logfiles := l.GetLogfiles()
+			files := make([]string, len(logfiles))
+			for j, logfile := range logfiles {
+				fileName := relative(logfile.FileName)
+				gen := generations[filepath.ToSlash(fileName)]
+				files[j] = fmt.Sprintf("%s (#%d)", fileName, gen)
+				if j > 0 {
+					prevName := relative(logfiles[j-1].FileName)
+					if prevGen := generations[filepath.ToSlash(prevName)]; prevGen > gen {
+						warn(fmt.Sprintf("step %d: logstream %s reads %s (#%d) before %s (#%d)",
+							i+1, stream, prevName, prevGen, fileName, gen))
+					}
+				}
+			}
+			fmt.Printf("\tLogstream [%s]: %s\n", stream, strings.Join(files, " > "))
+		}
+		for _, w := range ls.Verify() {
+			warn(relative(w))
+		}
+	}
+	printWarnings(name, warnings)
+	return len(warnings)
+}
+
+// Replaces the contents of the log directory w/ the given files, each holding
+// its generation.
+func writeLogDir(logDir string, generations map[string]int) error {
+	if err := os.RemoveAll(logDir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		return err
+	}
+	for name, gen := range generations {
+		path := filepath.Join(logDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		contents := []byte(fmt.Sprintf("generation %d\n", gen))
+		if err := ioutil.WriteFile(path, contents, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+/*
+
+A command-line utility for querying the live plugin report data of a running
+hekad through its admin API, i.e. its `admin_socket` or `admin_address`.
+
+*/
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// Report data as served by hekad: for each plugin type the plugins' names and
+// fields, each field holding a value and a representation.
+type reportData map[string][]map[string]interface{}
+
+// Order the plugin types are listed in.
+var pluginTypes = []string{"globals", "inputs", "splitters", "decoders",
+	"filters", "outputs", "encoders"}
+
+func main() {
+	socket := flag.String("socket", "", "hekad's admin_socket")
+	address := flag.String("address", "", "hekad's admin_address, as host:port")
+	token := flag.String("token", "", "hekad's admin_token, required w/ -address. "+
+		"Defaults to the HEKA_ADMIN_TOKEN environment variable")
+	pluginType := flag.String("type", "", "only show the plugins of this type "+
+		"[globals|inputs|splitters|decoders|filters|outputs|encoders]")
+	name := flag.String("name", "", "only show the plugins whose name matches "+
+		"this glob pattern")
+	format := flag.String("format", "table", "output format [table|json]")
+	flag.Parse()
+
+	if (*socket == "") == (*address == "") {
+		fmt.Fprintln(os.Stderr, "one of -socket or -address is required")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	if *format != "table" && *format != "json" {
+		fmt.Fprintf(os.Stderr, "unknown format '%s'\n", *format)
+		os.Exit(1)
+	}
+	if *token == "" {
+		*token = os.Getenv("HEKA_ADMIN_TOKEN")
+	}
+
+	query := url.Values{}
+	if *pluginType != "" {
+		query.Set("type", *pluginType)
+	}
+	if *name != "" {
+		query.Set("name", *name)
+	}
+	body, err := fetchReports(*socket, *address, *token, query)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(2)
+	}
+
+	if *format == "json" {
+		os.Stdout.Write(body)
+		return
+	}
+	var data reportData
+	if err = json.Unmarshal(body, &data); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid report data: %s\n", err)
+		os.Exit(2)
+	}
+	writeTable(os.Stdout, data)
+}
+
+// Requests the report data from hekad's admin API, over the unix socket if
+// one is given and over HTTP otherwise.
+func fetchReports(socket, address, token string, query url.Values) ([]byte, error) {
+	client := http.DefaultClient
+	host := address
+	if socket != "" {
+		client = &http.Client{
+			Transport: &http.Transport{
+				Dial: func(network, addr string) (net.Conn, error) {
+					return net.Dial("unix", socket)
+				},
+			},
+		}
+		host = "hekad"
+	}
+	u := url.URL{Scheme: "http", Host: host, Path: "/reports",
+		RawQuery: query.Encode()}
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("can't reach hekad: %s", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("can't read reports: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("hekad responded %s: %s", resp.Status,
+			strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+// Writes a row for each plugin, w/ its type, name and sorted report fields.
+func writeTable(w io.Writer, data reportData) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "TYPE\tNAME\tFIELDS")
+	for _, pluginType := range pluginTypes {
+		reports := data[pluginType]
+		sort.Sort(byName(reports))
+		for _, report := range reports {
+			name, _ := report["Name"].(string)
+			fields := make([]string, 0, len(report))
+			for field, value := range report {
+				if field == "Name" {
+					continue
+				}
+				fields = append(fields, fmt.Sprintf("%s=%s", field, formatValue(value)))
+			}
+			sort.Strings(fields)
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", pluginType, name, strings.Join(fields, " "))
+		}
+	}
+	tw.Flush()
+}
+
+// Returns a report field's value, followed by its representation if any.
+func formatValue(value interface{}) string {
+	field, ok := value.(map[string]interface{})
+	if !ok {
+		return fmt.Sprintf("%v", value)
+	}
+	s := fmt.Sprintf("%v", field["value"])
+	if rep, _ := field["representation"].(string); rep != "" && rep != "count" {
+		s += rep
+	}
+	return s
+}
+
+type byName []map[string]interface{}
+
+func (r byName) Len() int      { return len(r) }
+func (r byName) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r byName) Less(i, j int) bool {
+	a, _ := r[i]["Name"].(string)
+	b, _ := r[j]["Name"].(string)
+	return a < b
+}
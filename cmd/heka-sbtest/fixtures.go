@@ -0,0 +1,369 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	"github.com/pborman/uuid"
+)
+
+// A message fixture, i.e. a JSON object w/ the message headers as keys and a
+// "Fields" object holding the message fields. Input fixtures may instead hold
+// a "TimerEvent" key, which triggers a timer_event call w/ the given time.
+type fixture map[string]interface{}
+
+// Reads a JSON array of fixtures. Numbers are kept as json.Number so that
+// integers and doubles can be told apart.
+func readFixtures(filename string) ([]fixture, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.UseNumber()
+	var fixtures []fixture
+	if err = dec.Decode(&fixtures); err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	return fixtures, nil
+}
+
+// Parses a timestamp given as nanoseconds since the epoch or as an RFC 3339
+// string.
+func fixtureTimestamp(val interface{}) (int64, error) {
+	switch v := val.(type) {
+	case json.Number:
+		return v.Int64()
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return 0, err
+		}
+		return t.UnixNano(), nil
+	}
+	return 0, fmt.Errorf("invalid timestamp: %v", val)
+}
+
+func fixtureInt(name string, val interface{}) (int32, error) {
+	if n, ok := val.(json.Number); ok {
+		if i, err := n.Int64(); err == nil {
+			return int32(i), nil
+		}
+	}
+	return 0, fmt.Errorf("%s must be an integer", name)
+}
+
+func fixtureString(name string, val interface{}) (string, error) {
+	if s, ok := val.(string); ok {
+		return s, nil
+	}
+	return "", fmt.Errorf("%s must be a string", name)
+}
+
+// Converts a JSON value to a value that can be stored in a message field.
+func fieldValue(val interface{}) (interface{}, error) {
+	switch v := val.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i, nil
+		}
+		return v.Float64()
+	case string, bool:
+		return v, nil
+	}
+	return nil, fmt.Errorf("unsupported field value: %v", val)
+}
+
+// Creates a field from its fixture value, which is a scalar, an array of
+// scalars of the same type, or an object w/ "value" and "representation"
+// keys.
+func fixtureField(name string, val interface{}) (*message.Field, error) {
+	var representation string
+	if obj, ok := val.(map[string]interface{}); ok {
+		if rep, ok := obj["representation"]; ok {
+			if representation, ok = rep.(string); !ok {
+				return nil, fmt.Errorf("field %s: representation must be a string", name)
+			}
+		}
+		val = obj["value"]
+	}
+	values, ok := val.([]interface{})
+	if !ok {
+		values = []interface{}{val}
+	}
+	if len(values) == 0 {
+		return nil, fmt.Errorf("field %s has no values", name)
+	}
+
+	var field *message.Field
+	for _, v := range values {
+		fv, err := fieldValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %s", name, err)
+		}
+		if field == nil {
+			field, err = message.NewField(name, fv, representation)
+		} else {
+			err = field.AddValue(fv)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %s", name, err)
+		}
+	}
+	return field, nil
+}
+
+// Creates a message from an input fixture. Headers that aren't specified are
+// left empty, except for the Uuid which is always set.
+func (fx fixture) message() (msg *message.Message, err error) {
+	msg = new(message.Message)
+	msg.SetUuid(uuid.NewRandom())
+	for key, val := range fx {
+		var (
+			s string
+			i int32
+		)
+		switch key {
+		case "Uuid":
+			if s, err = fixtureString(key, val); err == nil {
+				if u := uuid.Parse(s); u != nil {
+					msg.SetUuid(u)
+				} else {
+					err = fmt.Errorf("invalid Uuid: %s", s)
+				}
+			}
+		case "Timestamp":
+			var ts int64
+			if ts, err = fixtureTimestamp(val); err == nil {
+				msg.SetTimestamp(ts)
+			}
+		case "Type":
+			if s, err = fixtureString(key, val); err == nil {
+				msg.SetType(s)
+			}
+		case "Logger":
+			if s, err = fixtureString(key, val); err == nil {
+				msg.SetLogger(s)
+			}
+		case "Payload":
+			if s, err = fixtureString(key, val); err == nil {
+				msg.SetPayload(s)
+			}
+		case "EnvVersion":
+			if s, err = fixtureString(key, val); err == nil {
+				msg.SetEnvVersion(s)
+			}
+		case "Hostname":
+			if s, err = fixtureString(key, val); err == nil {
+				msg.SetHostname(s)
+			}
+		case "Severity":
+			if i, err = fixtureInt(key, val); err == nil {
+				msg.SetSeverity(i)
+			}
+		case "Pid":
+			if i, err = fixtureInt(key, val); err == nil {
+				msg.SetPid(i)
+			}
+		case "Fields":
+			fields, ok := val.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("Fields must be an object")
+			}
+			// Add the fields in a stable order so read_next_field is
+			// deterministic.
+			names := make([]string, 0, len(fields))
+			for name := range fields {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				var field *message.Field
+				if field, err = fixtureField(name, fields[name]); err != nil {
+					return nil, err
+				}
+				msg.AddField(field)
+			}
+		case "ExpectFailure":
+		default:
+			err = fmt.Errorf("unknown message key: %s", key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
+
+func fieldValues(f *message.Field) []interface{} {
+	var values []interface{}
+	switch f.GetValueType() {
+	case message.Field_STRING:
+		for _, v := range f.ValueString {
+			values = append(values, v)
+		}
+	case message.Field_BYTES:
+		for _, v := range f.ValueBytes {
+			values = append(values, string(v))
+		}
+	case message.Field_INTEGER:
+		for _, v := range f.ValueInteger {
+			values = append(values, v)
+		}
+	case message.Field_DOUBLE:
+		for _, v := range f.ValueDouble {
+			values = append(values, v)
+		}
+	case message.Field_BOOL:
+		for _, v := range f.ValueBool {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// Converts a message to its fixture representation, used both to compare
+// against the expected messages and to print the generated messages.
+func messageFixture(msg *message.Message) fixture {
+	fx := fixture{
+		"Uuid":       msg.GetUuidString(),
+		"Timestamp":  msg.GetTimestamp(),
+		"Type":       msg.GetType(),
+		"Logger":     msg.GetLogger(),
+		"Severity":   msg.GetSeverity(),
+		"Payload":    msg.GetPayload(),
+		"EnvVersion": msg.GetEnvVersion(),
+		"Pid":        msg.GetPid(),
+		"Hostname":   msg.GetHostname(),
+	}
+	fields := make(map[string]interface{})
+	for _, f := range msg.Fields {
+		var val interface{}
+		if values := fieldValues(f); len(values) == 1 {
+			val = values[0]
+		} else {
+			val = values
+		}
+		if rep := f.GetRepresentation(); rep != "" {
+			val = map[string]interface{}{"value": val, "representation": rep}
+		}
+		fields[f.GetName()] = val
+	}
+	fx["Fields"] = fields
+	return fx
+}
+
+func toFloat(val interface{}) (float64, bool) {
+	switch v := val.(type) {
+	case int64:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// Compares an expected fixture value to the generated message's value and
+// returns a description of the first difference, or an empty string if they
+// match. Only the keys present in expected objects are compared, so the
+// expected messages only need to list what the test cares about.
+func compareValue(path string, expected, actual interface{}) string {
+	mismatch := func() string {
+		e, _ := json.Marshal(expected)
+		a, _ := json.Marshal(actual)
+		return fmt.Sprintf("%s: expected %s, got %s", path, e, a)
+	}
+	if a, ok := actual.(map[string]interface{}); ok {
+		if _, ok := expected.(map[string]interface{}); !ok {
+			// Fields w/ a representation can be compared by value alone.
+			if _, ok := a["representation"]; ok {
+				actual = a["value"]
+			}
+		}
+	}
+	switch e := expected.(type) {
+	case json.Number:
+		ef, err := e.Float64()
+		af, ok := toFloat(actual)
+		if err != nil || !ok || ef != af {
+			return mismatch()
+		}
+	case string, bool, nil:
+		if expected != actual {
+			return mismatch()
+		}
+	case []interface{}:
+		a, ok := actual.([]interface{})
+		if !ok || len(a) != len(e) {
+			return mismatch()
+		}
+		for i := range e {
+			if diff := compareValue(fmt.Sprintf("%s[%d]", path, i), e[i], a[i]); diff != "" {
+				return diff
+			}
+		}
+	case map[string]interface{}:
+		var a map[string]interface{}
+		switch v := actual.(type) {
+		case map[string]interface{}:
+			a = v
+		case fixture:
+			a = v
+		}
+		if a == nil {
+			return mismatch()
+		}
+		keys := make([]string, 0, len(e))
+		for key := range e {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			av, ok := a[key]
+			if !ok {
+				return fmt.Sprintf("%s: missing", strings.TrimPrefix(path+"."+key, "."))
+			}
+			if diff := compareValue(strings.TrimPrefix(path+"."+key, "."), e[key], av); diff != "" {
+				return diff
+			}
+		}
+	default:
+		return mismatch()
+	}
+	return ""
+}
+
+// Compares an expected message fixture to a generated message.
+func compareMessage(expected fixture, msg *message.Message) (string, error) {
+	if ts, ok := expected["Timestamp"]; ok {
+		// Accept the same timestamp formats as the input fixtures.
+		ns, err := fixtureTimestamp(ts)
+		if err != nil {
+			return "", err
+		}
+		expected["Timestamp"] = json.Number(fmt.Sprintf("%d", ns))
+	}
+	return compareValue("", map[string]interface{}(expected), messageFixture(msg)), nil
+}
@@ -0,0 +1,322 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+/*
+
+A command-line utility for unit testing Lua sandbox filters and decoders
+outside of hekad. The script is run against message fixtures read from a JSON
+file and the messages it generates are compared to the expected messages.
+
+*/
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bbangert/toml"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/sandbox"
+	"github.com/mozilla-services/heka/sandbox/lua"
+)
+
+type SbtestConfig struct {
+	// Sandbox script to test.
+	Filename string
+	// Either "filter" or "decoder".
+	PluginType string `toml:"plugin_type"`
+	// Plugin name, used as the Logger of messages generated by filters.
+	// Defaults to the script's filename w/o its extension.
+	Name             string
+	ModuleDirectory  string `toml:"module_directory"`
+	MemoryLimit      uint   `toml:"memory_limit"`
+	InstructionLimit uint   `toml:"instruction_limit"`
+	OutputLimit      uint   `toml:"output_limit"`
+	// Preserved sandbox data to start the script w/, if any.
+	StateFile string `toml:"state_file"`
+	// JSON file holding the input message fixtures.
+	Input string
+	// JSON file holding the messages the script is expected to generate.
+	Expected string
+	// Configuration made available to the script through read_config.
+	Config map[string]interface{}
+}
+
+// Runs a sandbox script the same way the SandboxFilter and SandboxDecoder
+// would, collecting every message it generates.
+type testRunner struct {
+	conf           *SbtestConfig
+	globals        *pipeline.GlobalConfigStruct
+	sb             sandbox.Sandbox
+	current        *message.Message
+	injected       []*message.Message
+	injectionCount uint
+}
+
+// Makes relative paths in the config relative to the config file.
+func resolvePath(base, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(base, path)
+}
+
+func loadConfig(filename string) (*SbtestConfig, error) {
+	globals := pipeline.DefaultGlobals()
+	conf := &SbtestConfig{
+		PluginType:       "filter",
+		ModuleDirectory:  globals.PrependShareDir("lua_modules"),
+		MemoryLimit:      8 * 1024 * 1024,
+		InstructionLimit: 1e6,
+		OutputLimit:      63 * 1024,
+	}
+	if _, err := toml.DecodeFile(filename, conf); err != nil {
+		return nil, fmt.Errorf("Error decoding config file: %s", err)
+	}
+	switch conf.PluginType {
+	case "filter", "decoder":
+	default:
+		return nil, fmt.Errorf("unsupported plugin_type: %s", conf.PluginType)
+	}
+	if conf.Filename == "" || conf.Input == "" {
+		return nil, errors.New("filename and input must be specified")
+	}
+
+	base := filepath.Dir(filename)
+	conf.Filename = resolvePath(base, conf.Filename)
+	conf.StateFile = resolvePath(base, conf.StateFile)
+	conf.Input = resolvePath(base, conf.Input)
+	conf.Expected = resolvePath(base, conf.Expected)
+	dirs := strings.Split(conf.ModuleDirectory, ";")
+	for i, dir := range dirs {
+		dirs[i] = resolvePath(base, dir)
+	}
+	conf.ModuleDirectory = strings.Join(dirs, ";")
+	if conf.Name == "" {
+		conf.Name = strings.TrimSuffix(filepath.Base(conf.Filename),
+			filepath.Ext(conf.Filename))
+	}
+	return conf, nil
+}
+
+func newTestRunner(conf *SbtestConfig) (*testRunner, error) {
+	r := &testRunner{conf: conf, globals: pipeline.DefaultGlobals()}
+	sbc := &sandbox.SandboxConfig{
+		ScriptType:       "lua",
+		ScriptFilename:   conf.Filename,
+		ModuleDirectory:  conf.ModuleDirectory,
+		MemoryLimit:      conf.MemoryLimit,
+		InstructionLimit: conf.InstructionLimit,
+		OutputLimit:      conf.OutputLimit,
+		Config:           conf.Config,
+		Globals:          r.globals,
+		PluginType:       conf.PluginType,
+	}
+	var err error
+	if r.sb, err = lua.CreateLuaSandbox(sbc); err != nil {
+		return nil, err
+	}
+	if err = r.sb.Init(conf.StateFile); err != nil {
+		r.sb.Destroy("")
+		return nil, err
+	}
+	r.sb.InjectMessage(r.inject)
+	return r, nil
+}
+
+func (r *testRunner) inject(payload, payload_type, payload_name string) int {
+	if r.conf.PluginType == "filter" {
+		// Filters are limited in how many messages they can inject per call.
+		if r.injectionCount == 0 {
+			return 2
+		}
+		r.injectionCount--
+	}
+
+	msg := new(message.Message)
+	if len(payload_type) == 0 { // heka protobuf message
+		if err := message.UnmarshalMessage([]byte(payload), msg); err != nil {
+			return 1
+		}
+		if r.conf.PluginType == "filter" {
+			msg.SetType("heka.sandbox." + msg.GetType())
+			msg.SetLogger(r.conf.Name)
+			msg.SetHostname(r.globals.Hostname)
+		} else if r.current != nil {
+			// Decoded messages inherit the headers they don't set.
+			if msg.Timestamp == nil {
+				msg.SetTimestamp(r.current.GetTimestamp())
+			}
+			if msg.Type == nil {
+				msg.SetType(r.current.GetType())
+			}
+			if msg.Logger == nil {
+				msg.SetLogger(r.current.GetLogger())
+			}
+			if msg.Hostname == nil {
+				msg.SetHostname(r.current.GetHostname())
+			}
+			if msg.Severity == nil {
+				msg.SetSeverity(r.current.GetSeverity())
+			}
+			if msg.Pid == nil {
+				msg.SetPid(r.current.GetPid())
+			}
+		}
+	} else {
+		if r.conf.PluginType == "filter" {
+			msg.SetType("heka.sandbox-output")
+			msg.SetLogger(r.conf.Name)
+			msg.SetHostname(r.globals.Hostname)
+		} else if r.current != nil {
+			r.current.Copy(msg)
+		}
+		msg.SetPayload(payload)
+		message.NewStringField(msg, "payload_type", payload_type)
+		message.NewStringField(msg, "payload_name", payload_name)
+	}
+	r.injected = append(r.injected, msg)
+	return 0
+}
+
+// Feeds a single input fixture to the sandbox.
+func (r *testRunner) process(fx fixture) error {
+	if ns, ok := fx["TimerEvent"]; ok {
+		if len(fx) != 1 {
+			return errors.New("TimerEvent can't be combined w/ message keys")
+		}
+		t, err := fixtureTimestamp(ns)
+		if err != nil {
+			return err
+		}
+		r.injectionCount = r.globals.MaxMsgTimerInject
+		if r.sb.TimerEvent(t) != 0 {
+			return fmt.Errorf("timer_event failed: %s", r.sb.LastError())
+		}
+		return nil
+	}
+
+	msg, err := fx.message()
+	if err != nil {
+		return err
+	}
+	r.current = msg
+	r.injectionCount = r.globals.MaxMsgProcessInject
+	count := len(r.injected)
+	pack := pipeline.NewPipelinePack(nil)
+	pack.Message = msg
+	retval := r.sb.ProcessMessage(pack)
+	r.current = nil
+
+	_, expectFailure := fx["ExpectFailure"]
+	switch {
+	case retval > 0:
+		return fmt.Errorf("fatal error: %s", r.sb.LastError())
+	case retval < 0 && !expectFailure:
+		return fmt.Errorf("process_message failed: %s", r.sb.LastError())
+	case retval == 0 && expectFailure:
+		return errors.New("process_message succeeded, expected a failure")
+	case retval == 0 && r.conf.PluginType == "decoder" && len(r.injected) == count:
+		// Decoders that don't inject pass on the (possibly modified) original.
+		r.injected = append(r.injected, msg)
+	}
+	return nil
+}
+
+func (r *testRunner) destroy() {
+	if r.sb != nil {
+		r.sb.Destroy("")
+		r.sb = nil
+	}
+}
+
+func main() {
+	configFile := flag.String("config", "sbtest.toml", "Sandbox test configuration file")
+	flagPrint := flag.Bool("print", false, "print the generated messages as JSON fixtures")
+	flag.Parse()
+
+	conf, err := loadConfig(*configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	inputs, err := readFixtures(conf.Input)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading input: %s\n", err)
+		os.Exit(1)
+	}
+	var expected []fixture
+	if conf.Expected != "" {
+		if expected, err = readFixtures(conf.Expected); err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading expected messages: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	r, err := newTestRunner(conf)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading %s: %s\n", conf.Filename, err)
+		os.Exit(2)
+	}
+	defer r.destroy()
+
+	failed := false
+	for i, fx := range inputs {
+		if err = r.process(fx); err != nil {
+			fmt.Fprintf(os.Stderr, "FAIL input %d: %s\n", i, err)
+			failed = true
+			break
+		}
+	}
+
+	if *flagPrint {
+		fixtures := make([]fixture, len(r.injected))
+		for i, msg := range r.injected {
+			fixtures[i] = messageFixture(msg)
+		}
+		out, _ := json.MarshalIndent(fixtures, "", "  ")
+		fmt.Println(string(out))
+	}
+
+	if expected != nil && !failed {
+		if len(r.injected) != len(expected) {
+			fmt.Fprintf(os.Stderr, "FAIL expected %d messages, got %d\n", len(expected),
+				len(r.injected))
+			failed = true
+		}
+		for i := 0; i < len(expected) && i < len(r.injected); i++ {
+			diff, err := compareMessage(expected[i], r.injected[i])
+			if err != nil {
+				diff = err.Error()
+			}
+			if diff != "" {
+				fmt.Fprintf(os.Stderr, "FAIL message %d: %s\n", i, diff)
+				failed = true
+			}
+		}
+	}
+
+	if failed {
+		r.destroy()
+		os.Exit(3)
+	}
+	fmt.Printf("PASS %s: %d inputs, %d messages\n", conf.Filename, len(inputs),
+		len(r.injected))
+}
@@ -30,24 +30,67 @@ import (
 )
 
 type HekadConfig struct {
-	Maxprocs              int    `toml:"maxprocs"`
-	PoolSize              int    `toml:"poolsize"`
-	ChanSize              int    `toml:"plugin_chansize"`
-	CpuProfName           string `toml:"cpuprof"`
-	MemProfName           string `toml:"memprof"`
-	MaxMsgLoops           uint   `toml:"max_message_loops"`
-	MaxMsgProcessInject   uint   `toml:"max_process_inject"`
-	MaxMsgProcessDuration uint64 `toml:"max_process_duration"`
-	MaxMsgTimerInject     uint   `toml:"max_timer_inject"`
-	MaxPackIdle           string `toml:"max_pack_idle"`
-	BaseDir               string `toml:"base_dir"`
-	ShareDir              string `toml:"share_dir"`
-	SampleDenominator     int    `toml:"sample_denominator"`
-	PidFile               string `toml:"pid_file"`
-	Hostname              string
-	MaxMessageSize        uint32 `toml:"max_message_size"`
-	LogFlags              int    `toml:"log_flags"`
-	FullBufferMaxRetries  uint32 `toml:"full_buffer_max_retries"`
+	Maxprocs                 int    `toml:"maxprocs"`
+	PoolSize                 int    `toml:"poolsize"`
+	ChanSize                 int    `toml:"plugin_chansize"`
+	CpuProfName              string `toml:"cpuprof"`
+	MemProfName              string `toml:"memprof"`
+	MaxMsgLoops              uint   `toml:"max_message_loops"`
+	MaxHops                  uint   `toml:"max_hops"`
+	TrackLineage             bool   `toml:"track_lineage"`
+	MaxMsgProcessInject      uint   `toml:"max_process_inject"`
+	MaxMsgProcessDuration    uint64 `toml:"max_process_duration"`
+	MaxMsgTimerInject        uint   `toml:"max_timer_inject"`
+	MaxPackIdle              string `toml:"max_pack_idle"`
+	BaseDir                  string `toml:"base_dir"`
+	ShareDir                 string `toml:"share_dir"`
+	SampleDenominator        int    `toml:"sample_denominator"`
+	PidFile                  string `toml:"pid_file"`
+	Hostname                 string
+	MaxMessageSize           uint32   `toml:"max_message_size"`
+	LogFlags                 int      `toml:"log_flags"`
+	FullBufferMaxRetries     uint32   `toml:"full_buffer_max_retries"`
+	User                     string   `toml:"user"`
+	Group                    string   `toml:"group"`
+	Chroot                   string   `toml:"chroot"`
+	MemoryWatermark          uint64   `toml:"memory_watermark"`
+	MemoryLowWatermark       uint64   `toml:"memory_low_watermark"`
+	MemoryCheckInterval      string   `toml:"memory_check_interval"`
+	MemoryShedPolicies       []string `toml:"memory_shed_policies"`
+	MemoryShedSeverity       int32    `toml:"memory_shed_severity"`
+	InputPoolSize            int      `toml:"input_poolsize"`
+	InputPoolSizeMax         int      `toml:"input_poolsize_max"`
+	InjectPoolSize           int      `toml:"inject_poolsize"`
+	InjectPoolSizeMax        int      `toml:"inject_poolsize_max"`
+	PoolShrinkInterval       string   `toml:"pool_shrink_interval"`
+	FieldIndexThreshold      int      `toml:"field_index_threshold"`
+	TraceSampleRate          float64  `toml:"trace_sample_rate"`
+	MaxBufferDiskUsage       uint64   `toml:"max_buffer_disk_usage"`
+	BufferAlertPercent       uint     `toml:"buffer_alert_percent"`
+	InjectWal                bool     `toml:"inject_wal"`
+	InjectWalEngine          string   `toml:"inject_wal_engine"`
+	InjectWalSync            bool     `toml:"inject_wal_sync"`
+	ConfigKeyFile            string   `toml:"config_key_file"`
+	ConfigKeyCommand         string   `toml:"config_key_command"`
+	Role                     string   `toml:"role"`
+	RemoteConfigURL          string   `toml:"remote_config_url"`
+	RemoteConfigSignatureURL string   `toml:"remote_config_signature_url"`
+	RemoteConfigVersionURL   string   `toml:"remote_config_version_url"`
+	RemoteConfigPublicKey    string   `toml:"remote_config_public_key"`
+	RemoteConfigDir          string   `toml:"remote_config_dir"`
+	RemoteConfigPollInterval string   `toml:"remote_config_poll_interval"`
+	RemoteConfigS3Region     string   `toml:"remote_config_s3_region"`
+	RemoteConfigS3Endpoint   string   `toml:"remote_config_s3_endpoint"`
+	OversizedMessageAction   string   `toml:"oversized_message_action"`
+	OversizedSpillDir        string   `toml:"oversized_spill_dir"`
+	ProfileMatchers          bool     `toml:"profile_matchers"`
+	ShareMatcherPredicates   bool     `toml:"share_matcher_predicates"`
+	MatcherNegativeCacheSize int      `toml:"matcher_negative_cache_size"`
+	AdminSocket              string   `toml:"admin_socket"`
+	AdminAddress             string   `toml:"admin_address"`
+	AdminToken               string   `toml:"admin_token"`
+	SnapshotDir              string   `toml:"snapshot_dir"`
+	PluginObjects            []string `toml:"plugin_objects"`
 }
 
 func LoadHekadConfig(configPath string) (config *HekadConfig, err error) {
@@ -57,22 +100,33 @@ func LoadHekadConfig(configPath string) (config *HekadConfig, err error) {
 	}
 
 	config = &HekadConfig{Maxprocs: 1,
-		PoolSize:              100,
-		ChanSize:              30,
-		CpuProfName:           "",
-		MemProfName:           "",
-		MaxMsgLoops:           4,
-		MaxMsgProcessInject:   1,
-		MaxMsgProcessDuration: 100000,
-		MaxMsgTimerInject:     10,
-		MaxPackIdle:           "2m",
-		BaseDir:               filepath.FromSlash("/var/cache/hekad"),
-		ShareDir:              filepath.FromSlash("/usr/share/heka"),
-		SampleDenominator:     1000,
-		PidFile:               "",
-		Hostname:              hostname,
-		LogFlags:              log.LstdFlags,
-		FullBufferMaxRetries:  10,
+		PoolSize:                 100,
+		ChanSize:                 30,
+		CpuProfName:              "",
+		MemProfName:              "",
+		MaxMsgLoops:              4,
+		MaxHops:                  8,
+		MaxMsgProcessInject:      1,
+		MaxMsgProcessDuration:    100000,
+		MaxMsgTimerInject:        10,
+		MaxPackIdle:              "2m",
+		BaseDir:                  filepath.FromSlash("/var/cache/hekad"),
+		ShareDir:                 filepath.FromSlash("/usr/share/heka"),
+		SampleDenominator:        1000,
+		PidFile:                  "",
+		Hostname:                 hostname,
+		LogFlags:                 log.LstdFlags,
+		FullBufferMaxRetries:     10,
+		MemoryCheckInterval:      "1s",
+		MemoryShedPolicies:       []string{pipeline.SHED_DROP_LOW_PRIORITY},
+		MemoryShedSeverity:       6,
+		PoolShrinkInterval:       "30s",
+		FieldIndexThreshold:      32,
+		BufferAlertPercent:       90,
+		InjectWalEngine:          "file",
+		OversizedMessageAction:   pipeline.OVERSIZED_DROP,
+		ShareMatcherPredicates:   true,
+		MatcherNegativeCacheSize: 1024,
 	}
 
 	var configFile map[string]toml.Primitive
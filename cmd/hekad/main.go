@@ -37,19 +37,29 @@ import (
 	"github.com/mozilla-services/heka/pipeline"
 	_ "github.com/mozilla-services/heka/plugins"
 	_ "github.com/mozilla-services/heka/plugins/amqp"
+	_ "github.com/mozilla-services/heka/plugins/check"
+	_ "github.com/mozilla-services/heka/plugins/collectd"
 	_ "github.com/mozilla-services/heka/plugins/dasher"
 	_ "github.com/mozilla-services/heka/plugins/elasticsearch"
 	_ "github.com/mozilla-services/heka/plugins/file"
 	_ "github.com/mozilla-services/heka/plugins/graphite"
 	_ "github.com/mozilla-services/heka/plugins/http"
+	_ "github.com/mozilla-services/heka/plugins/imap"
 	_ "github.com/mozilla-services/heka/plugins/irc"
 	_ "github.com/mozilla-services/heka/plugins/kafka"
+	_ "github.com/mozilla-services/heka/plugins/kubernetes"
 	_ "github.com/mozilla-services/heka/plugins/logstreamer"
+	_ "github.com/mozilla-services/heka/plugins/metadata"
 	_ "github.com/mozilla-services/heka/plugins/nagios"
+	_ "github.com/mozilla-services/heka/plugins/objectstore"
 	_ "github.com/mozilla-services/heka/plugins/payload"
 	_ "github.com/mozilla-services/heka/plugins/process"
+	_ "github.com/mozilla-services/heka/plugins/sftp"
+	_ "github.com/mozilla-services/heka/plugins/slo"
 	_ "github.com/mozilla-services/heka/plugins/smtp"
+	_ "github.com/mozilla-services/heka/plugins/snmp"
 	_ "github.com/mozilla-services/heka/plugins/statsd"
+	_ "github.com/mozilla-services/heka/plugins/system"
 	_ "github.com/mozilla-services/heka/plugins/tcp"
 	_ "github.com/mozilla-services/heka/plugins/udp"
 )
@@ -79,6 +89,9 @@ func setGlobalConfigs(config *HekadConfig) (*pipeline.GlobalConfigStruct, string
 	if globals.MaxMsgLoops == 0 {
 		globals.MaxMsgLoops = 1
 	}
+	globals.MaxHops = config.MaxHops
+	globals.TrackLineage = config.TrackLineage
+	globals.TraceSampleRate = config.TraceSampleRate
 	globals.MaxMsgProcessInject = maxMsgProcessInject
 	globals.MaxMsgProcessDuration = maxMsgProcessDuration
 	globals.MaxMsgTimerInject = maxMsgTimerInject
@@ -88,6 +101,37 @@ func setGlobalConfigs(config *HekadConfig) (*pipeline.GlobalConfigStruct, string
 	globals.SampleDenominator = config.SampleDenominator
 	globals.Hostname = config.Hostname
 	globals.FullBufferMaxRetries = uint(config.FullBufferMaxRetries)
+	globals.MemoryWatermark = config.MemoryWatermark
+	globals.MemoryLowWatermark = config.MemoryLowWatermark
+	globals.MemoryCheckInterval, _ = time.ParseDuration(config.MemoryCheckInterval)
+	globals.MemoryShedPolicies = config.MemoryShedPolicies
+	globals.MemoryShedSeverity = config.MemoryShedSeverity
+	globals.InputPoolSize = config.InputPoolSize
+	globals.InputPoolSizeMax = config.InputPoolSizeMax
+	globals.InjectPoolSize = config.InjectPoolSize
+	globals.InjectPoolSizeMax = config.InjectPoolSizeMax
+	globals.PoolShrinkInterval, _ = time.ParseDuration(config.PoolShrinkInterval)
+	globals.MaxBufferDiskUsage = config.MaxBufferDiskUsage
+	globals.BufferAlertPercent = config.BufferAlertPercent
+	globals.InjectWal = config.InjectWal
+	globals.InjectWalEngine = config.InjectWalEngine
+	globals.InjectWalSync = config.InjectWalSync
+	globals.OversizedMessageAction = config.OversizedMessageAction
+	globals.OversizedSpillDir = config.OversizedSpillDir
+	globals.ProfileMatchers = config.ProfileMatchers
+	globals.ShareMatcherPredicates = config.ShareMatcherPredicates
+	globals.MatcherNegativeCacheSize = config.MatcherNegativeCacheSize
+	globals.AdminSocket = config.AdminSocket
+	globals.AdminAddress = config.AdminAddress
+	globals.AdminToken = config.AdminToken
+	globals.SnapshotDir = config.SnapshotDir
+	// The upgraded hekad would start w/o the privileges to drop them again.
+	globals.Upgradable = config.User == "" && config.Group == "" && config.Chroot == ""
+	for _, role := range strings.Split(config.Role, ",") {
+		if role = strings.TrimSpace(role); role != "" {
+			globals.Roles = append(globals.Roles, role)
+		}
+	}
 
 	return globals, cpuProfName, memProfName
 }
@@ -106,18 +150,66 @@ func main() {
 		"Config file or directory. If directory is specified then all files "+
 			"in the directory will be loaded.")
 	version := flag.Bool("version", false, "Output version and exit")
+	graph := flag.String("graph", "", "Output the configured plugin graph in the "+
+		"specified format ('dot' or 'json') and exit.")
+	service := flag.String("service", "", "Windows only. Perform the specified "+
+		"action ('install', 'uninstall', 'start' or 'stop') on the hekad Windows "+
+		"service and exit.")
+	serviceName := flag.String("service_name", "hekad", "Windows only. Name of the "+
+		"Windows service to act on.")
+	exportState := flag.String("export_state", "", "Write the persistent plugin "+
+		"state in the 'base_dir' to the specified archive file and exit.")
+	importState := flag.String("import_state", "", "Restore the persistent plugin "+
+		"state from the specified archive file into an empty 'base_dir' and exit.")
+	restoreState := flag.String("restore_state", "", "Restore the persistent "+
+		"plugin state from the specified snapshot or archive file into an empty "+
+		"'base_dir', then start.")
+	role := flag.String("role", "", "Comma separated roles of this hekad, "+
+		"overriding the 'role' setting. Only the plugins without 'roles', or "+
+		"with one of these, are loaded.")
 	flag.Parse()
 
-	config := &HekadConfig{}
-	var err error
-	var cpuProfName string
-	var memProfName string
-
 	if *version {
 		fmt.Println(VERSION)
 		return
 	}
 
+	if *service != "" {
+		if err := controlService(*serviceName, *service, *configPath); err != nil {
+			pipeline.LogError.Printf("Error trying to %s service '%s': %s", *service,
+				*serviceName, err)
+			exitCode = 1
+		}
+		return
+	}
+
+	if *exportState != "" || *importState != "" {
+		exitCode = runStateCommand(*configPath, *exportState, *importState)
+		return
+	}
+
+	if isWindowsService() {
+		exitCode = runService(*serviceName, configPath)
+		return
+	}
+
+	exitCode = runHekad(configPath, *graph, *role, *restoreState, nil)
+}
+
+// runHekad loads the config and runs the Heka pipeline until shutdown,
+// returning the exit code. A non-empty role overrides the config's `role`
+// setting, a non-empty restore names a state snapshot to import before the
+// plugins are loaded. If globalsReady is not nil the global config will be
+// sent on it as soon as it has been created, to allow Heka to be controlled
+// from outside of the pipeline (e.g. by the Windows service manager).
+func runHekad(configPath *string, graph, role, restore string,
+	globalsReady chan<- *pipeline.GlobalConfigStruct) (exitCode int) {
+
+	config := &HekadConfig{}
+	var err error
+	var cpuProfName string
+	var memProfName string
+
 	config, err = LoadHekadConfig(*configPath)
 	if err != nil {
 		pipeline.LogError.Println("Error reading config: ", err)
@@ -126,6 +218,9 @@ func main() {
 	}
 	pipeline.LogInfo.SetFlags(config.LogFlags)
 	pipeline.LogError.SetFlags(config.LogFlags)
+	if role != "" {
+		config.Role = role
+	}
 	if config.SampleDenominator <= 0 {
 		pipeline.LogError.Println("'sample_denominator' value must be greater than 0.")
 		exitCode = 1
@@ -139,7 +234,133 @@ func main() {
 		return
 	}
 
+	if _, err = time.ParseDuration(config.MemoryCheckInterval); err != nil {
+		pipeline.LogError.Printf("Can't parse `memory_check_interval` time duration: %s\n",
+			config.MemoryCheckInterval)
+		exitCode = 1
+		return
+	}
+
+	if _, err = time.ParseDuration(config.PoolShrinkInterval); err != nil {
+		pipeline.LogError.Printf("Can't parse `pool_shrink_interval` time duration: %s\n",
+			config.PoolShrinkInterval)
+		exitCode = 1
+		return
+	}
+
+	if err = pipeline.ValidateMemoryShedPolicies(config.MemoryShedPolicies); err != nil {
+		pipeline.LogError.Println("Error in `memory_shed_policies`: ", err)
+		exitCode = 1
+		return
+	}
+
+	if err = pipeline.ValidateOversizedAction(config.OversizedMessageAction); err != nil {
+		pipeline.LogError.Println("Error in `oversized_message_action`: ", err)
+		exitCode = 1
+		return
+	}
+
+	if config.AdminAddress != "" && config.AdminToken == "" {
+		pipeline.LogError.Println("Error in `admin_address`: requires an `admin_token`")
+		exitCode = 1
+		return
+	}
+
+	if err = pipeline.ValidateTraceSampleRate(config.TraceSampleRate); err != nil {
+		pipeline.LogError.Println("Error in `trace_sample_rate`: ", err)
+		exitCode = 1
+		return
+	}
+
+	if config.BufferAlertPercent > 100 {
+		pipeline.LogError.Printf("`buffer_alert_percent` must be at most 100, got %d\n",
+			config.BufferAlertPercent)
+		exitCode = 1
+		return
+	}
+
+	if err = checkSnapshotDir(config.SnapshotDir, config.BaseDir); err != nil {
+		pipeline.LogError.Println("Error in `snapshot_dir`: ", err)
+		exitCode = 1
+		return
+	}
+
+	var remote *remoteConfig
+	var remotePollInterval time.Duration
+	if config.RemoteConfigURL != "" {
+		if remote, err = newRemoteConfig(config); err != nil {
+			pipeline.LogError.Println("Error in remote config settings: ", err)
+			exitCode = 1
+			return
+		}
+		if config.RemoteConfigPollInterval != "" {
+			remotePollInterval, err = time.ParseDuration(config.RemoteConfigPollInterval)
+			if err != nil {
+				pipeline.LogError.Printf("Can't parse `remote_config_poll_interval` "+
+					"time duration: %s\n", config.RemoteConfigPollInterval)
+				exitCode = 1
+				return
+			}
+		}
+	}
+
 	globals, cpuProfName, memProfName := setGlobalConfigs(config)
+	globals.ConfigKey, err = pipeline.LoadConfigKey(config.ConfigKeyFile,
+		config.ConfigKeyCommand)
+	if err != nil {
+		pipeline.LogError.Println("Error loading config key: ", err)
+		exitCode = 1
+		return
+	}
+	// The plugin types they register have to be known before any plugin
+	// config is read.
+	if err = pipeline.LoadPluginObjects(config.PluginObjects); err != nil {
+		pipeline.LogError.Println("Error loading plugin objects: ", err)
+		exitCode = 1
+		return
+	}
+	if globalsReady != nil {
+		globalsReady <- globals
+	}
+
+	if graph != "" {
+		pipeconf := pipeline.NewPipelineConfig(globals)
+		if err = preloadConfig(pipeconf, configPath); err == nil {
+			err = pipeconf.WriteGraph(os.Stdout, graph)
+		}
+		if err != nil {
+			pipeline.LogError.Println("Error generating graph: ", err)
+			exitCode = 1
+		}
+		return
+	}
+
+	// When started by an upgrade, the upgraded hekad is only shut down once
+	// the plugin config checks out, and its base_dir is only used once it
+	// has exited.
+	handedOver, err := pipeline.AwaitHandover(func() error {
+		return preloadConfig(pipeline.NewPipelineConfig(globals), configPath)
+	})
+	if err != nil {
+		pipeline.LogError.Println("Error taking over from the upgraded hekad: ", err)
+		exitCode = 1
+		return
+	}
+	if handedOver && restore != "" {
+		pipeline.LogInfo.Println("Upgraded, not restoring the state snapshot again")
+		restore = ""
+	}
+
+	if restore != "" {
+		var count int
+		if count, err = importBaseDir(config.BaseDir, restore); err != nil {
+			pipeline.LogError.Printf("Error restoring state from '%s': %s", restore, err)
+			exitCode = 1
+			return
+		}
+		pipeline.LogInfo.Printf("Restored %d files from '%s' to '%s'", count, restore,
+			config.BaseDir)
+	}
 
 	if err = os.MkdirAll(globals.BaseDir, 0755); err != nil {
 		pipeline.LogError.Printf("Error creating 'base_dir' %s: %s", config.BaseDir, err)
@@ -154,35 +375,12 @@ func main() {
 		exitCode = 1
 		return
 	}
+	message.SetFieldIndexThreshold(config.FieldIndexThreshold)
 	if config.PidFile != "" {
-		contents, err := ioutil.ReadFile(config.PidFile)
-		if err == nil {
-			pid, err := strconv.Atoi(strings.TrimSpace(string(contents)))
-			if err != nil {
-				pipeline.LogError.Printf("Error reading proccess id from pidfile '%s': %s",
-					config.PidFile, err)
-				exitCode = 1
-				return
-			}
-
-			process, err := os.FindProcess(pid)
-
-			// on Windows, err != nil if the process cannot be found
-			if runtime.GOOS == "windows" {
-				if err == nil {
-					pipeline.LogError.Printf("Process %d is already running.", pid)
-					exitCode = 1
-					return
-				}
-			} else if process != nil {
-				// err is always nil on POSIX, so we have to send the process
-				// a signal to check whether it exists
-				if err = process.Signal(syscall.Signal(0)); err == nil {
-					pipeline.LogError.Printf("Process %d is already running.", pid)
-					exitCode = 1
-					return
-				}
-			}
+		if err = checkPidFile(config.PidFile); err != nil {
+			pipeline.LogError.Println(err)
+			exitCode = 1
+			return
 		}
 		if err = ioutil.WriteFile(config.PidFile, []byte(strconv.Itoa(os.Getpid())),
 			0644); err != nil {
@@ -225,16 +423,90 @@ func main() {
 	}
 
 	// Set up and load the pipeline configuration and start the daemon.
+	var configDirs []string
+	if remote != nil {
+		if err = remote.load(); err != nil {
+			pipeline.LogError.Println("Error loading remote config: ", err)
+			exitCode = 1
+			return
+		}
+		configDirs = append(configDirs, remote.dir)
+	}
 	pipeconf := pipeline.NewPipelineConfig(globals)
-	if err = loadFullConfig(pipeconf, configPath); err != nil {
+	if err = loadFullConfig(pipeconf, configPath, configDirs...); err != nil {
 		pipeline.LogError.Println("Error reading config: ", err)
 		exitCode = 1
 		return
 	}
+	// All of the plugins have been initialized, so any privileged ports have
+	// already been bound.
+	if err = dropPrivileges(config, globals); err != nil {
+		pipeline.LogError.Println("Error dropping privileges: ", err)
+		exitCode = 1
+		return
+	}
+	if remote != nil && remotePollInterval > 0 {
+		go remote.poll(globals, remotePollInterval)
+	}
 	exitCode = pipeline.Run(pipeconf)
+	if snapshot := pipeconf.SnapshotPath(); snapshot != "" {
+		if err = writeSnapshot(globals.BaseDir, snapshot); err != nil {
+			pipeline.LogError.Println("Error writing state snapshot: ", err)
+			exitCode = 1
+		}
+	}
+	return
 }
 
-func loadFullConfig(pipeconf *pipeline.PipelineConfig, configPath *string) (err error) {
+// checkPidFile returns an error if the process whose id is in the pidfile is
+// still running.
+func checkPidFile(pidFile string) error {
+	contents, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		return nil
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(contents)))
+	if err != nil {
+		return fmt.Errorf("Error reading proccess id from pidfile '%s': %s", pidFile, err)
+	}
+
+	process, err := os.FindProcess(pid)
+
+	// on Windows, err != nil if the process cannot be found
+	if runtime.GOOS == "windows" {
+		if err == nil {
+			return fmt.Errorf("Process %d is already running.", pid)
+		}
+	} else if process != nil {
+		// err is always nil on POSIX, so we have to send the process
+		// a signal to check whether it exists
+		if err = process.Signal(syscall.Signal(0)); err == nil {
+			return fmt.Errorf("Process %d is already running.", pid)
+		}
+	}
+	return nil
+}
+
+// loadFullConfig loads the plugin configuration from the config file or dir,
+// and from any additional config dirs, then initializes the plugins.
+func loadFullConfig(pipeconf *pipeline.PipelineConfig, configPath *string,
+	configDirs ...string) (err error) {
+
+	if err = preloadConfig(pipeconf, configPath); err != nil {
+		return err
+	}
+	for _, dir := range configDirs {
+		if err = preloadConfig(pipeconf, &dir); err != nil {
+			return err
+		}
+	}
+	return pipeconf.LoadConfig()
+}
+
+// preloadConfig loads the plugin configuration from the config file, or all
+// of the *.toml files in the config directory, without initializing any
+// plugins.
+func preloadConfig(pipeconf *pipeline.PipelineConfig, configPath *string) (err error) {
 	p, err := os.Open(*configPath)
 	if err != nil {
 		return fmt.Errorf("error opening file: %s", err.Error())
@@ -260,8 +532,5 @@ func loadFullConfig(pipeconf *pipeline.PipelineConfig, configPath *string) (err
 	} else {
 		err = pipeconf.PreloadFromConfigFile(*configPath)
 	}
-	if err == nil {
-		err = pipeconf.LoadConfig()
-	}
 	return err
 }
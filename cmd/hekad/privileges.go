@@ -0,0 +1,117 @@
+// +build !windows
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	"github.com/mozilla-services/heka/pipeline"
+)
+
+// dropPrivileges chroots into the configured `chroot` directory, if any, and
+// switches to the configured `group` and `user`, if any. It then verifies that
+// the base_dir (which holds the buffers and other Heka state) is still
+// writable.
+func dropPrivileges(config *HekadConfig, globals *pipeline.GlobalConfigStruct) error {
+	if config.User == "" && config.Group == "" && config.Chroot == "" {
+		return nil
+	}
+
+	// Users and groups need to be looked up before the chroot, since the
+	// user database most likely won't be available inside of it.
+	uid, gid := -1, -1
+	var groups []int
+	if config.User != "" {
+		u, err := user.Lookup(config.User)
+		if err != nil {
+			return err
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return fmt.Errorf("invalid uid '%s' for user '%s'", u.Uid, config.User)
+		}
+		if gid, err = strconv.Atoi(u.Gid); err != nil {
+			return fmt.Errorf("invalid gid '%s' for user '%s'", u.Gid, config.User)
+		}
+		groupIds, err := u.GroupIds()
+		if err != nil {
+			return fmt.Errorf("can't look up groups for user '%s': %s", config.User,
+				err)
+		}
+		for _, groupId := range groupIds {
+			id, err := strconv.Atoi(groupId)
+			if err != nil {
+				return fmt.Errorf("invalid gid '%s' for user '%s'", groupId,
+					config.User)
+			}
+			groups = append(groups, id)
+		}
+	}
+	if config.Group != "" {
+		g, err := user.LookupGroup(config.Group)
+		if err != nil {
+			return err
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return fmt.Errorf("invalid gid '%s' for group '%s'", g.Gid, config.Group)
+		}
+	}
+
+	if config.Chroot != "" {
+		if err := syscall.Chroot(config.Chroot); err != nil {
+			return fmt.Errorf("can't chroot to '%s': %s", config.Chroot, err)
+		}
+		if err := os.Chdir("/"); err != nil {
+			return fmt.Errorf("can't chdir to chroot: %s", err)
+		}
+		pipeline.LogInfo.Printf("Chrooted to '%s'", config.Chroot)
+	}
+
+	// The group has to be changed first, we won't be allowed to once we're
+	// no longer root.
+	if gid != -1 {
+		if err := syscall.Setgroups(append(groups, gid)); err != nil {
+			return fmt.Errorf("can't set supplementary groups: %s", err)
+		}
+		if err := syscall.Setgid(gid); err != nil {
+			return fmt.Errorf("can't set gid to %d: %s", gid, err)
+		}
+	}
+	if uid != -1 {
+		if err := syscall.Setuid(uid); err != nil {
+			return fmt.Errorf("can't set uid to %d: %s", uid, err)
+		}
+	}
+	pipeline.LogInfo.Printf("Running as uid %d, gid %d", os.Getuid(), os.Getgid())
+
+	return checkWritable(globals.BaseDir)
+}
+
+// checkWritable makes sure that a file can be created in the provided
+// directory.
+func checkWritable(dir string) error {
+	f, err := ioutil.TempFile(dir, ".hekad-write-check")
+	if err != nil {
+		return fmt.Errorf("'%s' not writable after dropping privileges: %s", dir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
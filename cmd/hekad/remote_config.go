@@ -0,0 +1,432 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins/objectstore"
+)
+
+const (
+	// hekad's exit code when it shuts down to apply a changed remote config,
+	// so it can be told apart from a failure by the service manager
+	// restarting it.
+	remoteConfigChangedExitCode = 3
+	// Names of the copies of the installed bundle, its signature and its
+	// version kept in the remote config dir, which are used if the bundle
+	// can't be fetched.
+	remoteBundleName    = ".bundle"
+	remoteSignatureName = ".bundle.sig"
+	remoteVersionName   = ".bundle.version"
+	// Name of the config file a bundle that isn't a gzipped tar archive is
+	// installed as.
+	remoteConfigName = "remote.toml"
+)
+
+// How long fetching each of a bundle's parts may take.
+const remoteConfigTimeout = 30 * time.Second
+
+// A config bundle fetched over HTTP(S), from S3 or from etcd along w/ its
+// version and a detached signature of both, verified against a public key
+// and installed into a local dir that's loaded in addition to the local
+// config. Bundles older than the installed one are refused, so an old but
+// validly signed bundle can't be replayed.
+type remoteConfig struct {
+	url          string
+	signatureURL string
+	versionURL   string
+	publicKey    crypto.PublicKey
+	dir          string
+	client       *http.Client
+	s3Region     string
+	s3Endpoint   string
+	// Digest and version of the installed bundle.
+	digest  [sha256.Size]byte
+	version uint64
+}
+
+// A fetched or installed bundle. The signature covers the version file
+// followed by the bundle.
+type remoteBundle struct {
+	bundle      []byte
+	signature   []byte
+	versionFile []byte
+	version     uint64
+}
+
+func newRemoteConfig(config *HekadConfig) (*remoteConfig, error) {
+	rc := &remoteConfig{
+		url:          config.RemoteConfigURL,
+		signatureURL: config.RemoteConfigSignatureURL,
+		versionURL:   config.RemoteConfigVersionURL,
+		dir:          config.RemoteConfigDir,
+		client:       &http.Client{Timeout: remoteConfigTimeout},
+		s3Region:     config.RemoteConfigS3Region,
+		s3Endpoint:   config.RemoteConfigS3Endpoint,
+	}
+	if rc.signatureURL == "" {
+		rc.signatureURL = rc.url + ".sig"
+	}
+	if rc.versionURL == "" {
+		rc.versionURL = rc.url + ".version"
+	}
+	if rc.s3Region == "" {
+		rc.s3Region = "us-east-1"
+	}
+	if rc.dir == "" {
+		rc.dir = filepath.Join(config.BaseDir, "remote_config")
+	}
+	if config.RemoteConfigPublicKey == "" {
+		return nil, errors.New("'remote_config_public_key' is required")
+	}
+	var err error
+	if rc.publicKey, err = loadPublicKey(config.RemoteConfigPublicKey); err != nil {
+		return nil, err
+	}
+	return rc, nil
+}
+
+// loadPublicKey reads a PEM encoded RSA or ECDSA public key.
+func loadPublicKey(path string) (crypto.PublicKey, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("can't read public key: %s", err)
+	}
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in public key file '%s'", path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse public key: %s", err)
+	}
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		return key, nil
+	}
+	return nil, errors.New("public key must be an RSA or ECDSA key")
+}
+
+// verify checks the SHA-256 signature of the version file followed by the
+// bundle, as made by `openssl dgst -sha256 -sign`, and parses the version.
+func (rc *remoteConfig) verify(b *remoteBundle) error {
+	h := sha256.New()
+	h.Write(b.versionFile)
+	h.Write(b.bundle)
+	digest := h.Sum(nil)
+	if err := rc.checkSignature(digest, b.signature); err != nil {
+		return err
+	}
+	version, err := strconv.ParseUint(strings.TrimSpace(string(b.versionFile)), 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad version '%s'", strings.TrimSpace(string(b.versionFile)))
+	}
+	b.version = version
+	return nil
+}
+
+func (rc *remoteConfig) checkSignature(digest, signature []byte) error {
+	switch key := rc.publicKey.(type) {
+	case *rsa.PublicKey:
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest, signature) == nil {
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		var sig struct{ R, S *big.Int }
+		if _, err := asn1.Unmarshal(signature, &sig); err == nil &&
+			ecdsa.Verify(key, digest, sig.R, sig.S) {
+			return nil
+		}
+	}
+	return errors.New("signature verification failed")
+}
+
+// get fetches the contents of an http(s)://, s3://bucket/key or
+// etcd(s)://host:port/key URL.
+func (rc *remoteConfig) get(rawURL string) ([]byte, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return rc.getHTTP(rawURL)
+	case "s3":
+		return objectstore.GetS3Object(rc.s3Endpoint, rc.s3Region, u.Host,
+			strings.TrimPrefix(u.Path, "/"), remoteConfigTimeout)
+	case "etcd", "etcds":
+		return rc.getEtcd(u)
+	}
+	return nil, fmt.Errorf("unsupported remote config URL '%s'", rawURL)
+}
+
+func (rc *remoteConfig) getHTTP(url string) ([]byte, error) {
+	resp, err := rc.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("can't fetch '%s': %s", url, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// getEtcd reads a key w/ etcd's v2 keys API. The values are base64 encoded,
+// since etcd can't hold binary values such as gzipped bundles and
+// signatures.
+func (rc *remoteConfig) getEtcd(u *url.URL) ([]byte, error) {
+	scheme := "http"
+	if u.Scheme == "etcds" {
+		scheme = "https"
+	}
+	keyURL := fmt.Sprintf("%s://%s/v2/keys%s", scheme, u.Host, u.Path)
+	body, err := rc.getHTTP(keyURL)
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Node struct {
+			Value string `json:"value"`
+		} `json:"node"`
+	}
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("can't decode etcd response for '%s': %s", u.Path, err)
+	}
+	value, err := base64.StdEncoding.DecodeString(resp.Node.Value)
+	if err != nil {
+		return nil, fmt.Errorf("etcd key '%s' isn't base64 encoded: %s", u.Path, err)
+	}
+	return value, nil
+}
+
+// fetch downloads the bundle, its version and its signature, returning the
+// bundle if it's been verified.
+func (rc *remoteConfig) fetch() (b *remoteBundle, err error) {
+	b = new(remoteBundle)
+	if b.bundle, err = rc.get(rc.url); err != nil {
+		return nil, err
+	}
+	if b.versionFile, err = rc.get(rc.versionURL); err != nil {
+		return nil, err
+	}
+	if b.signature, err = rc.get(rc.signatureURL); err != nil {
+		return nil, err
+	}
+	if err = rc.verify(b); err != nil {
+		return nil, fmt.Errorf("'%s': %s", rc.url, err)
+	}
+	return b, nil
+}
+
+// isNewer tells whether a fetched bundle should replace the installed one,
+// returning an error if it's older, or if it has the installed one's version
+// but not its contents.
+func (rc *remoteConfig) isNewer(b *remoteBundle) (bool, error) {
+	if b.version > rc.version {
+		return true, nil
+	}
+	if b.version < rc.version {
+		return false, fmt.Errorf("'%s' version %d is older than the installed version %d",
+			rc.url, b.version, rc.version)
+	}
+	if sha256.Sum256(b.bundle) != rc.digest {
+		return false, fmt.Errorf("'%s' changed w/o a new version (%d)", rc.url, b.version)
+	}
+	return false, nil
+}
+
+// installed reads back the last bundle installed, if any.
+func (rc *remoteConfig) installed() (*remoteBundle, error) {
+	b := new(remoteBundle)
+	var err error
+	if b.bundle, err = ioutil.ReadFile(filepath.Join(rc.dir, remoteBundleName)); err != nil {
+		return nil, err
+	}
+	if b.signature, err = ioutil.ReadFile(filepath.Join(rc.dir, remoteSignatureName)); err != nil {
+		return nil, err
+	}
+	if b.versionFile, err = ioutil.ReadFile(filepath.Join(rc.dir, remoteVersionName)); err != nil {
+		return nil, err
+	}
+	if err = rc.verify(b); err != nil {
+		return nil, fmt.Errorf("installed remote config: %s", err)
+	}
+	return b, nil
+}
+
+// load installs the current remote config at startup, falling back to the
+// last bundle installed if it can't be fetched or is older.
+func (rc *remoteConfig) load() error {
+	current, cErr := rc.installed()
+	if cErr == nil {
+		rc.digest = sha256.Sum256(current.bundle)
+		rc.version = current.version
+	}
+	b, err := rc.fetch()
+	if err == nil {
+		if cErr != nil {
+			return rc.install(b)
+		}
+		var newer bool
+		if newer, err = rc.isNewer(b); newer {
+			return rc.install(b)
+		}
+		if err == nil {
+			// Unchanged.
+			return nil
+		}
+	}
+	pipeline.LogError.Printf("Error fetching remote config: %s", err)
+	if cErr != nil {
+		return fmt.Errorf("no remote config available: %s", err)
+	}
+	pipeline.LogInfo.Println("Using the previously installed remote config.")
+	return nil
+}
+
+// install extracts the bundle into a new dir that then replaces the remote
+// config dir, so a partly written config is never loaded.
+func (rc *remoteConfig) install(b *remoteBundle) error {
+	newDir := rc.dir + ".new"
+	oldDir := rc.dir + ".old"
+	if err := os.RemoveAll(newDir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(newDir, 0700); err != nil {
+		return err
+	}
+	if err := extractBundle(b.bundle, newDir); err != nil {
+		os.RemoveAll(newDir)
+		return err
+	}
+	err := ioutil.WriteFile(filepath.Join(newDir, remoteBundleName), b.bundle, 0600)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(newDir, remoteSignatureName), b.signature,
+			0600)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(newDir, remoteVersionName), b.versionFile,
+			0600)
+	}
+	if err != nil {
+		os.RemoveAll(newDir)
+		return err
+	}
+
+	os.RemoveAll(oldDir)
+	if err = os.Rename(rc.dir, oldDir); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err = os.Rename(newDir, rc.dir); err != nil {
+		return err
+	}
+	os.RemoveAll(oldDir)
+	rc.digest = sha256.Sum256(b.bundle)
+	rc.version = b.version
+	return nil
+}
+
+// extractBundle writes the TOML files in a gzipped tar bundle to the dir, or
+// the bundle itself if it's not compressed.
+func extractBundle(bundle []byte, dir string) error {
+	if len(bundle) < 2 || bundle[0] != 0x1f || bundle[1] != 0x8b {
+		return ioutil.WriteFile(filepath.Join(dir, remoteConfigName), bundle, 0600)
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(bundle))
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("can't read remote config bundle: %s", err)
+		}
+		name := filepath.Base(filepath.FromSlash(header.Name))
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA ||
+			!strings.HasSuffix(name, ".toml") {
+			continue
+		}
+		contents, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		if err = ioutil.WriteFile(filepath.Join(dir, name), contents, 0600); err != nil {
+			return err
+		}
+	}
+}
+
+// poll checks for a changed bundle every interval, installing it and shutting
+// hekad down so it's restarted w/ the new config.
+func (rc *remoteConfig) poll(globals *pipeline.GlobalConfigStruct,
+	interval time.Duration) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if globals.IsShuttingDown() {
+			return
+		}
+		b, err := rc.fetch()
+		if err != nil {
+			pipeline.LogError.Printf("Error fetching remote config: %s", err)
+			continue
+		}
+		newer, err := rc.isNewer(b)
+		if err != nil {
+			pipeline.LogError.Printf("Refusing remote config: %s", err)
+		}
+		if !newer {
+			continue
+		}
+		if err = rc.install(b); err != nil {
+			pipeline.LogError.Printf("Error installing remote config: %s", err)
+			continue
+		}
+		pipeline.LogInfo.Println("Remote config changed, shutting down to apply it.")
+		globals.ShutDown(remoteConfigChangedExitCode)
+		return
+	}
+}
@@ -0,0 +1,255 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func makeBundle(t *testing.T, files map[string]string) []byte {
+	buf := new(bytes.Buffer)
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	for name, contents := range files {
+		err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644,
+			Size: int64(len(contents))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = tw.Write([]byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestRemoteConfig(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "hekad-remote-config-tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubBytes, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubPath := filepath.Join(tmpDir, "pub.pem")
+	pubPem := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubBytes})
+	if err = ioutil.WriteFile(pubPath, pubPem, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Signs the version followed by the bundle.
+	sign := func(version string, bundle []byte) []byte {
+		digest := sha256.Sum256(append([]byte(version), bundle...))
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	}
+
+	bundle := makeBundle(t, map[string]string{
+		"conf/outputs.toml": "[LogOutput]\nmessage_matcher = \"TRUE\"\n",
+		"README":            "not loaded",
+	})
+	version := "1\n"
+	signature := sign(version, bundle)
+	// Serves the bundle over HTTP, and w/ etcd's v2 keys API and S3's path
+	// style URLs.
+	files := func(path string) []byte {
+		switch path {
+		case "/hekad.tar.gz":
+			return bundle
+		case "/hekad.tar.gz.sig":
+			return signature
+		case "/hekad.tar.gz.version":
+			return []byte(version)
+		}
+		return nil
+	}
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			path := r.URL.Path
+			etcd := strings.HasPrefix(path, "/v2/keys/heka/")
+			if etcd {
+				path = strings.TrimPrefix(path, "/v2/keys/heka")
+			} else {
+				path = strings.TrimPrefix(path, "/bucket")
+			}
+			contents := files(path)
+			if contents == nil {
+				http.NotFound(w, r)
+				return
+			}
+			if etcd {
+				var resp struct {
+					Node struct {
+						Value string `json:"value"`
+					} `json:"node"`
+				}
+				resp.Node.Value = base64.StdEncoding.EncodeToString(contents)
+				json.NewEncoder(w).Encode(resp)
+				return
+			}
+			w.Write(contents)
+		}))
+	defer server.Close()
+
+	config := &HekadConfig{
+		BaseDir:               tmpDir,
+		RemoteConfigURL:       server.URL + "/hekad.tar.gz",
+		RemoteConfigPublicKey: pubPath,
+	}
+	rc, err := newRemoteConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rc.load(); err != nil {
+		t.Fatal(err)
+	}
+	contents, err := ioutil.ReadFile(filepath.Join(tmpDir, "remote_config", "outputs.toml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "[LogOutput]\nmessage_matcher = \"TRUE\"\n" {
+		t.Errorf("Unexpected remote config contents: %s", contents)
+	}
+	if _, err = os.Stat(filepath.Join(rc.dir, "README")); !os.IsNotExist(err) {
+		t.Error("Expected only the TOML files to be installed")
+	}
+	if rc.version != 1 {
+		t.Errorf("Expected version 1 to be installed, got %d", rc.version)
+	}
+	firstBundle, firstSignature := bundle, signature
+
+	// A bundle w/ a bad signature isn't installed, the previous one is used.
+	bundle = []byte("[LogOutput]\nmessage_matcher = \"FALSE\"\n")
+	version = "2\n"
+	if _, err = rc.fetch(); err == nil {
+		t.Error("Expected a signature verification error")
+	}
+	if err = rc.load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(rc.dir, "outputs.toml")); err != nil {
+		t.Error("Expected the previous remote config to be kept")
+	}
+
+	// A signed plain TOML bundle is installed as is.
+	signature = sign(version, bundle)
+	if err = rc.load(); err != nil {
+		t.Fatal(err)
+	}
+	contents, err = ioutil.ReadFile(filepath.Join(rc.dir, remoteConfigName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != string(bundle) {
+		t.Errorf("Unexpected remote config contents: %s", contents)
+	}
+	if _, err = os.Stat(filepath.Join(rc.dir, "outputs.toml")); !os.IsNotExist(err) {
+		t.Error("Expected the previous remote config to be replaced")
+	}
+	if rc.version != 2 {
+		t.Errorf("Expected version 2 to be installed, got %d", rc.version)
+	}
+
+	// Replaying the older, validly signed bundle is refused, as is a bundle
+	// changed w/o a new version, also when hekad restarts.
+	latestBundle := bundle
+	bundle, signature, version = firstBundle, firstSignature, "1\n"
+	b, err := rc.fetch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = rc.isNewer(b); err == nil {
+		t.Error("Expected an older bundle to be refused")
+	}
+	bundle, version = []byte("# changed\n"), "2\n"
+	signature = sign(version, bundle)
+	if b, err = rc.fetch(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = rc.isNewer(b); err == nil {
+		t.Error("Expected a bundle changed w/o a new version to be refused")
+	}
+	if rc, err = newRemoteConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	if err = rc.load(); err != nil {
+		t.Fatal(err)
+	}
+	contents, err = ioutil.ReadFile(filepath.Join(rc.dir, remoteConfigName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != string(latestBundle) {
+		t.Errorf("Expected the installed remote config to be kept, got: %s", contents)
+	}
+
+	// The bundle can also be fetched from etcd or S3.
+	bundle, version = firstBundle, "1\n"
+	signature = sign(version, bundle)
+	host := strings.TrimPrefix(server.URL, "http://")
+	for _, source := range []struct{ url, endpoint string }{
+		{"etcd://" + host + "/heka/hekad.tar.gz", ""},
+		{"s3://bucket/hekad.tar.gz", server.URL},
+	} {
+		config := &HekadConfig{
+			BaseDir:                tmpDir,
+			RemoteConfigURL:        source.url,
+			RemoteConfigPublicKey:  pubPath,
+			RemoteConfigDir:        filepath.Join(tmpDir, "remote_"+source.url[:2]),
+			RemoteConfigS3Endpoint: source.endpoint,
+		}
+		if rc, err = newRemoteConfig(config); err != nil {
+			t.Fatal(err)
+		}
+		if err = rc.load(); err != nil {
+			t.Fatalf("%s: %s", source.url, err)
+		}
+		if _, err = os.Stat(filepath.Join(rc.dir, "outputs.toml")); err != nil {
+			t.Errorf("%s: expected the remote config to be installed", source.url)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+// +build !windows
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package main
+
+import "errors"
+
+// Service control is only available on Windows, see service_windows.go.
+
+func isWindowsService() bool {
+	return false
+}
+
+func controlService(name, action, configPath string) error {
+	return errors.New("service control is only supported on Windows")
+}
+
+func runService(name string, configPath *string) int {
+	return 1
+}
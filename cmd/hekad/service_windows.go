@@ -0,0 +1,248 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mozilla-services/heka/pipeline"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const eventLogId = 1
+
+func isWindowsService() bool {
+	isService, err := svc.IsWindowsService()
+	return err == nil && isService
+}
+
+// Returns the absolute path to the running hekad executable.
+func exePath() (string, error) {
+	prog := os.Args[0]
+	p, err := filepath.Abs(prog)
+	if err != nil {
+		return "", err
+	}
+	fi, err := os.Stat(p)
+	if err == nil {
+		if !fi.Mode().IsDir() {
+			return p, nil
+		}
+		err = fmt.Errorf("%s is directory", p)
+	}
+	if filepath.Ext(p) == "" {
+		p += ".exe"
+		fi, err := os.Stat(p)
+		if err == nil {
+			if !fi.Mode().IsDir() {
+				return p, nil
+			}
+			err = fmt.Errorf("%s is directory", p)
+		}
+	}
+	return "", err
+}
+
+// controlService performs the requested action (install, uninstall, start,
+// or stop) on the named service via the Windows service control manager.
+func controlService(name, action, configPath string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	if action == "install" {
+		return installService(m, name, configPath)
+	}
+
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("can't open service: %s", err)
+	}
+	defer s.Close()
+
+	switch action {
+	case "uninstall":
+		if err = s.Delete(); err != nil {
+			return err
+		}
+		return eventlog.Remove(name)
+	case "start":
+		return s.Start()
+	case "stop":
+		status, err := s.Control(svc.Stop)
+		if err != nil {
+			return err
+		}
+		// Heka may take a while to flush everything out, give it some time.
+		timeout := time.Now().Add(60 * time.Second)
+		for status.State != svc.Stopped {
+			if time.Now().After(timeout) {
+				return fmt.Errorf("timed out waiting for service to stop")
+			}
+			time.Sleep(300 * time.Millisecond)
+			if status, err = s.Query(); err != nil {
+				return fmt.Errorf("can't retrieve service status: %s", err)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown service action '%s'", action)
+}
+
+func installService(m *mgr.Mgr, name, configPath string) error {
+	exe, err := exePath()
+	if err != nil {
+		return err
+	}
+	if configPath, err = filepath.Abs(configPath); err != nil {
+		return err
+	}
+	s, err := m.OpenService(name)
+	if err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists", name)
+	}
+	config := mgr.Config{
+		DisplayName: "Heka",
+		Description: "Heka data collection and processing daemon.",
+		StartType:   mgr.StartAutomatic,
+	}
+	if s, err = m.CreateService(name, exe, config, "-config", configPath,
+		"-service_name", name); err != nil {
+		return err
+	}
+	defer s.Close()
+	err = eventlog.InstallAsEventCreate(name,
+		eventlog.Error|eventlog.Warning|eventlog.Info)
+	if err != nil {
+		s.Delete()
+		return fmt.Errorf("can't install event log source: %s", err)
+	}
+	return nil
+}
+
+// Writes error log output to the Windows event log.
+type eventLogWriter struct {
+	elog *eventlog.Log
+}
+
+func (w *eventLogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimSpace(string(p))
+	if err := w.elog.Error(eventLogId, msg); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Implements svc.Handler to drive hekad from the service control manager.
+type hekadService struct {
+	name       string
+	configPath *string
+	elog       *eventlog.Log
+}
+
+func (h *hekadService) Execute(args []string, r <-chan svc.ChangeRequest,
+	changes chan<- svc.Status) (svcSpecificEC bool, exitCode uint32) {
+
+	const accepts = svc.AcceptStop | svc.AcceptShutdown | svc.AcceptParamChange
+	changes <- svc.Status{State: svc.StartPending}
+
+	globalsReady := make(chan *pipeline.GlobalConfigStruct, 1)
+	done := make(chan int, 1)
+	go func() {
+		done <- runHekad(h.configPath, "", "", "", globalsReady)
+	}()
+
+	var (
+		globals     *pipeline.GlobalConfigStruct
+		stopPending bool
+	)
+	changes <- svc.Status{State: svc.Running, Accepts: accepts}
+	h.elog.Info(eventLogId, fmt.Sprintf("%s service started", h.name))
+
+	for {
+		select {
+		case code := <-done:
+			changes <- svc.Status{State: svc.StopPending}
+			if code != 0 {
+				return true, uint32(code)
+			}
+			return false, 0
+		case globals = <-globalsReady:
+			if stopPending {
+				globals.ShutDown(0)
+			}
+		case c := <-r:
+			switch c.Cmd {
+			case svc.Interrogate:
+				changes <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				changes <- svc.Status{State: svc.StopPending}
+				h.elog.Info(eventLogId, fmt.Sprintf("%s service stopping", h.name))
+				if globals == nil {
+					stopPending = true
+				} else {
+					globals.ShutDown(0)
+				}
+			case svc.ParamChange:
+				// Windows has no SIGHUP, so a parameter change request is used
+				// to trigger a reload, e.g. to reopen rotated output files.
+				if globals != nil {
+					go func() {
+						globals.SigChan() <- syscall.SIGHUP
+					}()
+				}
+				changes <- svc.Status{State: svc.Running, Accepts: accepts}
+			}
+		}
+	}
+}
+
+// runService runs hekad under the Windows service control manager,
+// returning once the service has been stopped.
+func runService(name string, configPath *string) int {
+	elog, err := eventlog.Open(name)
+	if err != nil {
+		pipeline.LogError.Printf("Can't open event log: %s", err)
+		return 1
+	}
+	defer elog.Close()
+
+	writer := io.MultiWriter(os.Stderr, &eventLogWriter{elog})
+	pipeline.LogError = log.New(writer, "", log.LstdFlags)
+
+	h := &hekadService{
+		name:       name,
+		configPath: configPath,
+		elog:       elog,
+	}
+	if err = svc.Run(name, h); err != nil {
+		elog.Error(eventLogId, fmt.Sprintf("%s service failed: %s", name, err))
+		return 1
+	}
+	elog.Info(eventLogId, fmt.Sprintf("%s service stopped", name))
+	return 0
+}
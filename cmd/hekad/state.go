@@ -0,0 +1,299 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mozilla-services/heka/pipeline"
+)
+
+// Name of the archive entry identifying a Heka state archive, holding the
+// version of hekad and the host it was exported from.
+const stateManifestName = "HEKA_STATE"
+
+// runStateCommand exports or imports the persistent plugin state in the
+// `base_dir`, i.e. the logstreamer journals, queue buffers and their cursors,
+// preserved sandbox state and any other plugin checkpoints, returning the exit
+// code. hekad mustn't be running w/ the same `base_dir` meanwhile, which is
+// checked if a `pid_file` is configured.
+func runStateCommand(configPath, exportFile, importFile string) (exitCode int) {
+	if exportFile != "" && importFile != "" {
+		pipeline.LogError.Println("Only one of -export_state and -import_state can be used.")
+		return 1
+	}
+	config, err := LoadHekadConfig(configPath)
+	if err != nil {
+		pipeline.LogError.Println("Error reading config: ", err)
+		return 1
+	}
+	if config.PidFile != "" {
+		if err = checkPidFile(config.PidFile); err != nil {
+			pipeline.LogError.Println(err)
+			return 1
+		}
+	}
+
+	if exportFile != "" {
+		var count int
+		if count, err = exportBaseDir(config.BaseDir, exportFile); err == nil {
+			pipeline.LogInfo.Printf("Exported %d files from '%s' to '%s'", count,
+				config.BaseDir, exportFile)
+		}
+	} else {
+		var count int
+		if count, err = importBaseDir(config.BaseDir, importFile); err == nil {
+			pipeline.LogInfo.Printf("Imported %d files from '%s' to '%s'", count,
+				importFile, config.BaseDir)
+		}
+	}
+	if err != nil {
+		pipeline.LogError.Println("Error: ", err)
+		return 1
+	}
+	return 0
+}
+
+// exportBaseDir writes all of the regular files in the base dir to a gzipped
+// tar archive, w/ paths relative to the base dir.
+func exportBaseDir(baseDir, archive string) (count int, err error) {
+	baseDir, err = filepath.Abs(baseDir)
+	if err != nil {
+		return 0, err
+	}
+	archivePath, err := filepath.Abs(archive)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = os.Stat(baseDir); err != nil {
+		return 0, fmt.Errorf("can't read 'base_dir': %s", err)
+	}
+
+	file, err := os.OpenFile(archive, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if e := file.Close(); err == nil {
+			err = e
+		}
+		if err != nil {
+			os.Remove(archive)
+		}
+	}()
+	gz := gzip.NewWriter(file)
+	tw := tar.NewWriter(gz)
+
+	hostname, _ := os.Hostname()
+	manifest := fmt.Sprintf("version = %q\nhostname = %q\nbase_dir = %q\n", VERSION,
+		hostname, baseDir)
+	err = tw.WriteHeader(&tar.Header{
+		Name:     stateManifestName,
+		Mode:     0644,
+		Size:     int64(len(manifest)),
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeReg,
+	})
+	if err == nil {
+		_, err = io.WriteString(tw, manifest)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	err = filepath.Walk(baseDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == baseDir || path == archivePath {
+			return nil
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			// Skip sockets, pipes and symlinks.
+			return nil
+		}
+		rel, err := filepath.Rel(baseDir, path)
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err = tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, err = io.CopyN(tw, f, info.Size()); err != nil {
+			return fmt.Errorf("can't archive '%s': %s", path, err)
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err = tw.Close(); err != nil {
+		return 0, err
+	}
+	return count, gz.Close()
+}
+
+// checkSnapshotDir returns an error if the snapshot dir is inside the base
+// dir, where the snapshots would end up archived in each other.
+func checkSnapshotDir(snapshotDir, baseDir string) error {
+	if snapshotDir == "" {
+		return nil
+	}
+	snapshotDir, err := filepath.Abs(snapshotDir)
+	if err != nil {
+		return err
+	}
+	baseDir, err = filepath.Abs(baseDir)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(baseDir, snapshotDir)
+	if err != nil {
+		return err
+	}
+	if rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))) {
+		return fmt.Errorf("%s can't be inside 'base_dir'", snapshotDir)
+	}
+	return nil
+}
+
+// writeSnapshot archives the base dir once hekad has shut down for the
+// snapshot requested through the admin API. The archive is renamed into
+// place once it's complete, so only whole snapshots are found at the path.
+func writeSnapshot(baseDir, snapshot string) error {
+	if err := os.MkdirAll(filepath.Dir(snapshot), 0700); err != nil {
+		return fmt.Errorf("can't create 'snapshot_dir': %s", err)
+	}
+	tmp := snapshot + ".tmp"
+	count, err := exportBaseDir(baseDir, tmp)
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, snapshot); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	pipeline.LogInfo.Printf("Wrote a snapshot of %d files from '%s' to '%s'", count,
+		baseDir, snapshot)
+	return nil
+}
+
+// importBaseDir extracts an archive written by exportBaseDir into the base
+// dir, which must be empty so the restored state can't be mixed up w/ the
+// state of this host.
+func importBaseDir(baseDir, archive string) (count int, err error) {
+	if err = os.MkdirAll(baseDir, 0755); err != nil {
+		return 0, fmt.Errorf("can't create 'base_dir': %s", err)
+	}
+	dir, err := os.Open(baseDir)
+	if err != nil {
+		return 0, err
+	}
+	names, err := dir.Readdirnames(1)
+	dir.Close()
+	if len(names) > 0 {
+		return 0, fmt.Errorf("'base_dir' %s isn't empty", baseDir)
+	}
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+
+	file, err := os.Open(archive)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return 0, fmt.Errorf("'%s' isn't a Heka state archive: %s", archive, err)
+	}
+	tr := tar.NewReader(gz)
+
+	header, err := tr.Next()
+	if err != nil || header.Name != stateManifestName {
+		return 0, fmt.Errorf("'%s' isn't a Heka state archive", archive)
+	}
+	for {
+		if header, err = tr.Next(); err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+		name := filepath.FromSlash(strings.TrimSuffix(header.Name, "/"))
+		if filepath.IsAbs(name) || name == ".." ||
+			strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+
+			return count, fmt.Errorf("invalid archive path '%s'", header.Name)
+		}
+		path := filepath.Join(baseDir, name)
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(path, os.FileMode(header.Mode).Perm()|0700)
+		case tar.TypeReg, tar.TypeRegA:
+			err = extractFile(tr, path, os.FileMode(header.Mode).Perm(), header.ModTime)
+			count++
+		default:
+			err = errors.New("unsupported entry type")
+		}
+		if err != nil {
+			return count, fmt.Errorf("can't extract '%s': %s", header.Name, err)
+		}
+	}
+}
+
+func extractFile(r io.Reader, path string, mode os.FileMode, modTime time.Time) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	// Keep the original modification times.
+	return os.Chtimes(path, modTime, modTime)
+}
@@ -0,0 +1,118 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExportImportState(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "hekad-state-tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	srcDir := filepath.Join(tmpDir, "src")
+	queueDir := filepath.Join(srcDir, "output_queue", "TestOutput")
+	if err = os.MkdirAll(queueDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(queueDir, "checkpoint.txt"), []byte("3 1024"),
+		0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(srcDir, "journal"), []byte("{}"),
+		0644); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := filepath.Join(tmpDir, "state.tar.gz")
+	count, err := exportBaseDir(srcDir, archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("Expected 2 exported files, got %d", count)
+	}
+
+	dstDir := filepath.Join(tmpDir, "dst")
+	if count, err = importBaseDir(dstDir, archive); err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("Expected 2 imported files, got %d", count)
+	}
+	contents, err := ioutil.ReadFile(filepath.Join(dstDir, "output_queue", "TestOutput",
+		"checkpoint.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "3 1024" {
+		t.Errorf("Expected checkpoint '3 1024', got '%s'", contents)
+	}
+
+	if _, err = importBaseDir(dstDir, archive); err == nil {
+		t.Error("Expected an error importing into a non-empty base_dir")
+	}
+	if _, err = importBaseDir(filepath.Join(tmpDir, "other"), filepath.Join(queueDir,
+		"checkpoint.txt")); err == nil {
+		t.Error("Expected an error importing a non-archive file")
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "hekad-snapshot-tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	baseDir := filepath.Join(tmpDir, "base")
+	if err = checkSnapshotDir(filepath.Join(baseDir, "snapshots"), baseDir); err == nil {
+		t.Error("Expected an error for a snapshot_dir inside the base_dir")
+	}
+	snapshotDir := filepath.Join(tmpDir, "snapshots")
+	if err = checkSnapshotDir(snapshotDir, baseDir); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = os.MkdirAll(baseDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(baseDir, "journal"), []byte("{}"),
+		0644); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := filepath.Join(snapshotDir, "heka-state.tar.gz")
+	if err = writeSnapshot(baseDir, snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(snapshot + ".tmp"); !os.IsNotExist(err) {
+		t.Error("Expected the temporary snapshot file to be renamed")
+	}
+
+	restoreDir := filepath.Join(tmpDir, "restored")
+	count, err := importBaseDir(restoreDir, snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("Expected 1 restored file, got %d", count)
+	}
+}
@@ -84,6 +84,22 @@ define(
     * @property {String} MatchAvgDuration.representation
     */
 
+    /**
+    * Number of messages delivered by an output.
+    *
+    * @property {Object} DeliveryLatencyCount
+    * @property {Number} DeliveryLatencyCount.value
+    * @property {String} DeliveryLatencyCount.representation
+    */
+
+    /**
+    * Sum of the delivery latencies of an output's messages.
+    *
+    * @property {Object} DeliveryLatencySum
+    * @property {Number} DeliveryLatencySum.value
+    * @property {String} DeliveryLatencySum.representation
+    */
+
     /**
     * Process message duration.
     *
@@ -71,6 +71,19 @@ define(
         }
       },
 
+      /**
+      * Average delivery latency of an output formatted with commas.
+      *
+      * @method DeliveryLatencyAvgFormatted
+      * @return {String} comma delimited number
+      */
+      DeliveryLatencyAvgFormatted: function() {
+        if (this.DeliveryLatencyCount && this.DeliveryLatencySum &&
+            this.DeliveryLatencyCount.value > 0) {
+          return numeral(this.DeliveryLatencySum.value / this.DeliveryLatencyCount.value).format("0,0");
+        }
+      },
+
       /**
       * Process message average duration formatted with commas.
       *
@@ -0,0 +1,173 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package framing
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+const (
+	// Header field number of a batch frame's message count (varint).
+	BATCH_FIELD = 8
+	// Header field number of a batch frame's compression codec (varint).
+	CODEC_FIELD = 9
+
+	batchKey  = BATCH_FIELD << 3
+	codecKey  = CODEC_FIELD << 3
+	lengthKey = 1 << 3 // message_length
+)
+
+var ErrBatchCorrupt = errors.New("corrupt batch frame")
+
+// Accumulates messages to be sent in a single batch frame. A batch frame's
+// header holds the number of messages it contains and, if its payload is
+// compressed, the codec used. The payload is the messages' protobuf encoding,
+// each preceded by its length as a varint. Neither the uncompressed nor the
+// compressed payload may exceed MAX_MESSAGE_SIZE.
+//
+// Batch frames are only understood by readers that know about them, so
+// they're only used on connections where the peer has agreed to them, see
+// Hello.
+type Batch struct {
+	payload []byte
+	count   int
+	zbuf    []byte
+	comps   compressors
+}
+
+// Number of messages in the batch.
+func (b *Batch) Len() int {
+	return b.count
+}
+
+// Size of the uncompressed payload, in bytes.
+func (b *Batch) Size() int {
+	return len(b.payload)
+}
+
+// Adds the message to the batch, returning false if it doesn't fit. A
+// message that doesn't fit in an empty batch has to be sent in a frame of its
+// own.
+func (b *Batch) Add(msgBytes []byte) bool {
+	var l [binary.MaxVarintLen32]byte
+	n := binary.PutUvarint(l[:], uint64(len(msgBytes)))
+	if len(b.payload)+n+len(msgBytes) > int(message.MAX_MESSAGE_SIZE) {
+		return false
+	}
+	b.payload = append(b.payload, l[:n]...)
+	b.payload = append(b.payload, msgBytes...)
+	b.count++
+	return true
+}
+
+// Appends the messages in the batch to msgs, for when the batch can't be
+// sent as a batch after all.
+func (b *Batch) Messages(msgs [][]byte) [][]byte {
+	for payload := b.payload; len(payload) > 0; {
+		l, n := binary.Uvarint(payload)
+		msgs = append(msgs, payload[n:n+int(l)])
+		payload = payload[n+int(l):]
+	}
+	return msgs
+}
+
+func (b *Batch) Reset() {
+	b.payload = b.payload[:0]
+	b.count = 0
+}
+
+// Frames the batch into outBytes. The payload is compressed w/ the codec
+// unless that doesn't make it any smaller. A batch holding a single message
+// is framed like any other message. All frames carry a CRC.
+func (b *Batch) Frame(outBytes *[]byte, codec Codec) error {
+	if b.count == 0 {
+		return errors.New("empty batch")
+	}
+	if b.count == 1 {
+		_, n := binary.Uvarint(b.payload)
+		return Frame(b.payload[n:], outBytes, nil, true)
+	}
+	payload := b.payload
+	if codec != CodecNone {
+		comp, err := b.comps.get(codec)
+		if err != nil {
+			return err
+		}
+		if b.zbuf, err = comp.Compress(b.zbuf[:0], b.payload); err != nil {
+			return err
+		}
+		if len(b.zbuf) < len(payload) {
+			payload = b.zbuf
+		} else {
+			codec = CodecNone
+		}
+	}
+
+	h := &message.Header{}
+	h.SetMessageLength(uint32(len(payload)))
+	h.XXX_unrecognized = appendVarint(h.XXX_unrecognized, batchKey, uint64(b.count))
+	if codec != CodecNone {
+		h.XXX_unrecognized = appendVarint(h.XXX_unrecognized, codecKey, uint64(codec))
+	}
+	SetCrc(h, payload)
+	return writeFrame(h, payload, outBytes)
+}
+
+// Returns the number of messages in a batch frame, ok is false if the frame
+// isn't a batch.
+func BatchCount(h *message.Header) (count int, ok bool) {
+	n, ok := getVarint(h.XXX_unrecognized, batchKey)
+	return int(n), ok
+}
+
+// Splits a batch frame's payload into its messages, appending them to msgs.
+// Compressed payloads are decompressed into buf, which is reused.
+type batchDecoder struct {
+	buf   []byte
+	comps compressors
+}
+
+func (d *batchDecoder) decode(h *message.Header, payload []byte,
+	msgs [][]byte) ([][]byte, error) {
+
+	count, _ := BatchCount(h)
+	if codec, _ := getVarint(h.XXX_unrecognized, codecKey); codec != 0 {
+		comp, err := d.comps.get(Codec(codec))
+		if err != nil {
+			return msgs, err
+		}
+		d.buf, err = comp.Decompress(d.buf[:0], payload, int(message.MAX_MESSAGE_SIZE))
+		if err != nil {
+			return msgs, ErrBatchCorrupt
+		}
+		payload = d.buf
+	}
+
+	for len(payload) > 0 {
+		l, n := binary.Uvarint(payload)
+		if n <= 0 || l > uint64(len(payload)-n) {
+			return msgs, ErrBatchCorrupt
+		}
+		msgs = append(msgs, payload[n:n+int(l)])
+		payload = payload[n+int(l):]
+	}
+	if len(msgs) != count {
+		return msgs, ErrBatchCorrupt
+	}
+	return msgs, nil
+}
@@ -0,0 +1,222 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package framing
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/golang/snappy"
+)
+
+var ErrDecompressedSize = errors.New("decompressed payload too large")
+
+// Compression codec of a batch frame's payload, identified on the wire by its
+// number.
+type Codec uint32
+
+const (
+	CodecNone Codec = iota
+	CodecDeflate
+	CodecSnappy
+)
+
+// Implementation of a batch frame compression codec. Compressors are only
+// used by one goroutine at a time, so they can keep state between calls.
+type Compressor interface {
+	// Appends the compressed src to dst.
+	Compress(dst, src []byte) ([]byte, error)
+	// Appends the decompressed src to dst, failing w/ ErrDecompressedSize if
+	// that would take more than limit bytes.
+	Decompress(dst, src []byte, limit int) ([]byte, error)
+}
+
+type codecInfo struct {
+	name    string
+	factory func() Compressor
+}
+
+var (
+	codecsLock sync.RWMutex
+	codecs     = make(map[Codec]codecInfo)
+)
+
+// Makes a codec available for batch frames. Peers only use codecs they've
+// both registered, so adding one doesn't affect existing connections. Meant
+// to be called from an init function; panics if the codec's number or name
+// is already taken.
+func RegisterCodec(codec Codec, name string, factory func() Compressor) {
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+	if codec == CodecNone {
+		panic("framing: codec 0 is reserved for uncompressed payloads")
+	}
+	for c, info := range codecs {
+		if c == codec || info.name == name {
+			panic(fmt.Sprintf("framing: codec %d (%s) registered twice", codec, name))
+		}
+	}
+	codecs[codec] = codecInfo{name, factory}
+}
+
+// Returns all the registered codecs, in order of their numbers.
+func Codecs() []Codec {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+	list := make([]Codec, 0, len(codecs))
+	for c := range codecs {
+		list = append(list, c)
+	}
+	sort.Sort(codecList(list))
+	return list
+}
+
+type codecList []Codec
+
+func (l codecList) Len() int           { return len(l) }
+func (l codecList) Less(i, j int) bool { return l[i] < l[j] }
+func (l codecList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+func (c Codec) String() string {
+	if c == CodecNone {
+		return "none"
+	}
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+	if info, ok := codecs[c]; ok {
+		return info.name
+	}
+	return fmt.Sprintf("codec(%d)", uint32(c))
+}
+
+func ParseCodec(name string) (Codec, error) {
+	if name == "" || name == "none" {
+		return CodecNone, nil
+	}
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+	for c, info := range codecs {
+		if info.name == name {
+			return c, nil
+		}
+	}
+	return CodecNone, fmt.Errorf("unsupported compression: %s", name)
+}
+
+// Returns true if the codec can be decoded by this process.
+func (c Codec) Supported() bool {
+	if c == CodecNone {
+		return true
+	}
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+	_, ok := codecs[c]
+	return ok
+}
+
+// Caches a Compressor per codec for a single Batch or Reader.
+type compressors map[Codec]Compressor
+
+func (cs *compressors) get(c Codec) (Compressor, error) {
+	if comp, ok := (*cs)[c]; ok {
+		return comp, nil
+	}
+	codecsLock.RLock()
+	info, ok := codecs[c]
+	codecsLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unsupported compression: %s", c)
+	}
+	if *cs == nil {
+		*cs = make(compressors)
+	}
+	comp := info.factory()
+	(*cs)[c] = comp
+	return comp, nil
+}
+
+type deflateCompressor struct {
+	buf bytes.Buffer
+	w   *flate.Writer
+	r   io.ReadCloser
+}
+
+func (d *deflateCompressor) Compress(dst, src []byte) ([]byte, error) {
+	d.buf.Reset()
+	if d.w == nil {
+		d.w, _ = flate.NewWriter(&d.buf, flate.BestSpeed)
+	} else {
+		d.w.Reset(&d.buf)
+	}
+	d.w.Write(src)
+	if err := d.w.Close(); err != nil {
+		return dst, err
+	}
+	return append(dst, d.buf.Bytes()...), nil
+}
+
+func (d *deflateCompressor) Decompress(dst, src []byte, limit int) ([]byte, error) {
+	if d.r == nil {
+		d.r = flate.NewReader(bytes.NewReader(src))
+	} else {
+		d.r.(flate.Resetter).Reset(bytes.NewReader(src), nil)
+	}
+	d.buf.Reset()
+	_, err := d.buf.ReadFrom(io.LimitReader(d.r, int64(limit)+1))
+	if err != nil {
+		return dst, err
+	}
+	if d.buf.Len() > limit {
+		return dst, ErrDecompressedSize
+	}
+	return append(dst, d.buf.Bytes()...), nil
+}
+
+type snappyCompressor struct {
+	buf []byte
+}
+
+func (s *snappyCompressor) Compress(dst, src []byte) ([]byte, error) {
+	s.buf = snappy.Encode(s.buf[:cap(s.buf)], src)
+	return append(dst, s.buf...), nil
+}
+
+func (s *snappyCompressor) Decompress(dst, src []byte, limit int) ([]byte, error) {
+	n, err := snappy.DecodedLen(src)
+	if err != nil {
+		return dst, err
+	}
+	if n > limit {
+		return dst, ErrDecompressedSize
+	}
+	if s.buf, err = snappy.Decode(s.buf[:cap(s.buf)], src); err != nil {
+		return dst, err
+	}
+	return append(dst, s.buf...), nil
+}
+
+func init() {
+	RegisterCodec(CodecDeflate, "deflate", func() Compressor {
+		return new(deflateCompressor)
+	})
+	RegisterCodec(CodecSnappy, "snappy", func() Compressor {
+		return new(snappyCompressor)
+	})
+}
@@ -0,0 +1,220 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+/*
+
+Reading and writing of Heka framed protobuf streams, as used by the TcpInput
+and TcpOutput, the output disk buffers, and the files read by heka-cat. Each
+frame is a record separator, the header length, a protobuf encoded
+message.Header, a unit separator, and the protobuf encoded message.
+
+Frames can carry a CRC32 (Castagnoli) of the message bytes, which lets readers
+detect corruption and resynchronize on the next intact frame instead of
+decoding garbage. The CRC is stored in field 7 of the header, which isn't part
+of the message.Header definition, so readers that don't know about it ignore
+it and frames w/ a CRC remain readable by older versions of Heka.
+
+Version 2 of the framing adds batch frames, which pack many messages into a
+single, optionally compressed, frame. They aren't readable by older versions,
+so they're only sent once both ends of a connection have agreed to them w/ a
+Hello handshake.
+
+*/
+package framing
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/mozilla-services/heka/message"
+)
+
+const (
+	// Header field number and fixed32 wire type key of the frame CRC.
+	CRC_FIELD = 7
+	crcKey    = CRC_FIELD<<3 | 5
+	crcSize   = 5
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Returns the CRC32 of a frame's message bytes, as stored in its header.
+func Checksum(msgBytes []byte) uint32 {
+	return crc32.Checksum(msgBytes, crcTable)
+}
+
+// Stores the CRC of the message bytes in the header, replacing any CRC
+// already there.
+func SetCrc(h *message.Header, msgBytes []byte) {
+	clearCrc(h)
+	var b [crcSize]byte
+	b[0] = crcKey
+	binary.LittleEndian.PutUint32(b[1:], Checksum(msgBytes))
+	h.XXX_unrecognized = append(h.XXX_unrecognized, b[:]...)
+}
+
+// Returns the CRC stored in the header, if there is one.
+func GetCrc(h *message.Header) (crc uint32, ok bool) {
+	if i := fieldOffset(h.XXX_unrecognized, crcKey); i >= 0 {
+		return binary.LittleEndian.Uint32(h.XXX_unrecognized[i+1 : i+crcSize]), true
+	}
+	return 0, false
+}
+
+// Returns false if the header holds a CRC that doesn't match the message
+// bytes. Frames w/o a CRC always pass.
+func CheckCrc(h *message.Header, msgBytes []byte) bool {
+	crc, ok := GetCrc(h)
+	return !ok || crc == Checksum(msgBytes)
+}
+
+// Returns the offset of the field w/ the given (single byte) key within the
+// encoded fields, or -1. An unparseable field ends the search.
+func fieldOffset(fields []byte, key byte) int {
+	for i := 0; i < len(fields); {
+		n, err := proto.Skip(fields[i:])
+		if err != nil || n <= 0 || i+n > len(fields) {
+			break
+		}
+		if fields[i] == key {
+			return i
+		}
+		i += n
+	}
+	return -1
+}
+
+// Returns the value of the varint field w/ the given key, if there is one.
+func getVarint(fields []byte, key byte) (v uint64, ok bool) {
+	if i := fieldOffset(fields, key); i >= 0 {
+		v, n := binary.Uvarint(fields[i+1:])
+		return v, n > 0
+	}
+	return 0, false
+}
+
+// Returns the values of all the varint fields w/ the given key, in order.
+func getVarints(fields []byte, key byte) (values []uint64) {
+	for i := 0; i < len(fields); {
+		n, err := proto.Skip(fields[i:])
+		if err != nil || n <= 0 || i+n > len(fields) {
+			break
+		}
+		if fields[i] == key {
+			v, _ := binary.Uvarint(fields[i+1:])
+			values = append(values, v)
+		}
+		i += n
+	}
+	return
+}
+
+// Returns the value of the length delimited field w/ the given key, if there
+// is one.
+func getBytes(fields []byte, key byte) (value []byte, ok bool) {
+	i := fieldOffset(fields, key)
+	if i < 0 {
+		return nil, false
+	}
+	l, n := binary.Uvarint(fields[i+1:])
+	if n <= 0 {
+		return nil, false
+	}
+	start := i + 1 + n
+	return fields[start : start+int(l)], true
+}
+
+func appendVarint(fields []byte, key byte, v uint64) []byte {
+	var b [binary.MaxVarintLen64 + 1]byte
+	b[0] = key
+	n := binary.PutUvarint(b[1:], v)
+	return append(fields, b[:n+1]...)
+}
+
+func clearCrc(h *message.Header) {
+	if i := fieldOffset(h.XXX_unrecognized, crcKey); i >= 0 {
+		h.XXX_unrecognized = append(h.XXX_unrecognized[:i],
+			h.XXX_unrecognized[i+crcSize:]...)
+	}
+}
+
+// Frames the protobuf encoded message into outBytes, reusing its storage if
+// it's large enough. The message is signed if msc isn't nil and a CRC is
+// added if crc is true.
+func Frame(msgBytes []byte, outBytes *[]byte, msc *message.MessageSigningConfig,
+	crc bool) error {
+
+	msgSize := uint32(len(msgBytes))
+	if msgSize > message.MAX_MESSAGE_SIZE {
+		return fmt.Errorf("Message too big, requires %d (MAX_MESSAGE_SIZE = %d)",
+			len(msgBytes), message.MAX_MESSAGE_SIZE)
+	}
+
+	h := &message.Header{}
+	h.SetMessageLength(msgSize)
+	if msc != nil {
+		h.SetHmacSigner(msc.Name)
+		h.SetHmacKeyVersion(msc.Version)
+		var hm hash.Hash
+		switch msc.Hash {
+		case "sha1":
+			hm = hmac.New(sha1.New, []byte(msc.Key))
+			h.SetHmacHashFunction(message.Header_SHA1)
+		default:
+			hm = hmac.New(md5.New, []byte(msc.Key))
+		}
+
+		hm.Write(msgBytes)
+		h.SetHmac(hm.Sum(nil))
+	}
+	if crc {
+		SetCrc(h, msgBytes)
+	}
+	return writeFrame(h, msgBytes, outBytes)
+}
+
+// Frames the payload w/ the given header, which must have its message length
+// set.
+func writeFrame(h *message.Header, payload []byte, outBytes *[]byte) error {
+	headerSize := proto.Size(h)
+	if headerSize > message.MAX_HEADER_SIZE {
+		return fmt.Errorf("Message header too big, requires %d (MAX_HEADER_SIZE = %d)",
+			headerSize, message.MAX_HEADER_SIZE)
+	}
+
+	requiredSize := message.HEADER_FRAMING_SIZE + headerSize + len(payload)
+	if cap(*outBytes) < requiredSize {
+		*outBytes = make([]byte, requiredSize)
+	} else {
+		*outBytes = (*outBytes)[:requiredSize]
+	}
+	(*outBytes)[0] = message.RECORD_SEPARATOR
+	(*outBytes)[1] = uint8(headerSize)
+	// This looks odd but is correct; it effectively "seeks" the initial write
+	// position for the protobuf output to be at the
+	// `(*outBytes)[message.HEADER_DELIMITER_SIZE]` position.
+	pbuf := proto.NewBuffer((*outBytes)[message.HEADER_DELIMITER_SIZE:message.HEADER_DELIMITER_SIZE])
+	if err := pbuf.Marshal(h); err != nil {
+		return err
+	}
+	(*outBytes)[headerSize+message.HEADER_DELIMITER_SIZE] = message.UNIT_SEPARATOR
+	copy((*outBytes)[message.HEADER_FRAMING_SIZE+headerSize:], payload)
+	return nil
+}
@@ -0,0 +1,290 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package framing
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/mozilla-services/heka/message"
+)
+
+func writeMessages(t *testing.T, w *Writer, payloads ...string) {
+	for _, p := range payloads {
+		msg := &message.Message{}
+		msg.SetPayload(p)
+		if err := w.WriteMessage(msg); err != nil {
+			t.Fatalf("WriteMessage failed: %s", err)
+		}
+	}
+}
+
+func readPayloads(t *testing.T, r *Reader) (payloads []string) {
+	msg := &message.Message{}
+	for {
+		err := r.ReadMessage(msg)
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			t.Fatalf("ReadMessage failed: %s", err)
+		}
+		payloads = append(payloads, msg.GetPayload())
+	}
+}
+
+func expectPayloads(t *testing.T, received []string, expected ...string) {
+	if fmt.Sprint(received) != fmt.Sprint(expected) {
+		t.Errorf("expected payloads: %q received: %q", expected, received)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, crc := range []bool{true, false} {
+		var buf bytes.Buffer
+		writeMessages(t, NewWriter(&buf, crc), "one", "two", "three")
+		r := NewReader(&buf)
+		_, msgBytes, err := r.Next()
+		if err != nil {
+			t.Fatalf("Next failed: %s", err)
+		}
+		if _, ok := GetCrc(r.header); ok != crc {
+			t.Errorf("crc: %t expected a CRC: %t", crc, ok)
+		}
+		if !CheckCrc(r.header, msgBytes) {
+			t.Errorf("crc: %t CRC mismatch", crc)
+		}
+		expectPayloads(t, readPayloads(t, r), "two", "three")
+		if r.Skipped() != 0 || r.Corrupt() != 0 {
+			t.Errorf("crc: %t skipped: %d corrupt: %d", crc, r.Skipped(), r.Corrupt())
+		}
+	}
+}
+
+func TestSetCrcReplaces(t *testing.T) {
+	h := &message.Header{}
+	SetCrc(h, []byte("first"))
+	SetCrc(h, []byte("second"))
+	if len(h.XXX_unrecognized) != crcSize {
+		t.Errorf("expected a single CRC, unknown fields: %#v", h.XXX_unrecognized)
+	}
+	if !CheckCrc(h, []byte("second")) || CheckCrc(h, []byte("first")) {
+		t.Error("CRC wasn't replaced")
+	}
+}
+
+func TestRequireCrc(t *testing.T) {
+	var buf bytes.Buffer
+	writeMessages(t, NewWriter(&buf, false), "plain")
+	writeMessages(t, NewWriter(&buf, true), "checked")
+	r := NewReader(&buf)
+	r.RequireCrc = true
+	expectPayloads(t, readPayloads(t, r), "checked")
+	if r.Corrupt() != 1 {
+		t.Errorf("expected 1 corrupt frame, got %d", r.Corrupt())
+	}
+}
+
+func TestResyncAfterGarbage(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf, true)
+	buf.Write([]byte{'x', message.RECORD_SEPARATOR, 3, 'y'})
+	writeMessages(t, w, "one")
+	buf.Write([]byte{message.RECORD_SEPARATOR, message.RECORD_SEPARATOR, 0, 'z'})
+	writeMessages(t, w, "two")
+	r := NewReader(&buf)
+	expectPayloads(t, readPayloads(t, r), "one", "two")
+	if r.Skipped() != 8 {
+		t.Errorf("expected 8 skipped bytes, got %d", r.Skipped())
+	}
+}
+
+func TestResyncAfterCorruption(t *testing.T) {
+	var frames [][]byte
+	for _, p := range []string{"one", "two", "three"} {
+		var buf bytes.Buffer
+		writeMessages(t, NewWriter(&buf, true), p)
+		frames = append(frames, buf.Bytes())
+	}
+	corrupt := func(i int, f func(frame []byte)) io.Reader {
+		var buf bytes.Buffer
+		for j, frame := range frames {
+			frame = append([]byte{}, frame...)
+			if i == j {
+				f(frame)
+			}
+			buf.Write(frame)
+		}
+		return &buf
+	}
+
+	// A flipped bit in the message fails the CRC.
+	r := NewReader(corrupt(1, func(frame []byte) { frame[len(frame)-1] ^= 1 }))
+	expectPayloads(t, readPayloads(t, r), "one", "three")
+	if r.Corrupt() != 1 {
+		t.Errorf("expected 1 corrupt frame, got %d", r.Corrupt())
+	}
+
+	// A message length claiming more data than the stream holds.
+	r = NewReader(corrupt(1, func(frame []byte) {
+		frame[message.HEADER_DELIMITER_SIZE+1] = 0x7f
+	}))
+	expectPayloads(t, readPayloads(t, r), "one", "three")
+
+	// A damaged header length.
+	r = NewReader(corrupt(0, func(frame []byte) { frame[1] += 2 }))
+	expectPayloads(t, readPayloads(t, r), "two", "three")
+}
+
+func TestResumeAfterEOF(t *testing.T) {
+	var frame bytes.Buffer
+	writeMessages(t, NewWriter(&frame, true), "tailed")
+	var buf bytes.Buffer
+	r := NewReader(&buf)
+	buf.Write(frame.Bytes()[:frame.Len()/2])
+	if _, _, err := r.Next(); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+	buf.Write(frame.Bytes()[frame.Len()/2:])
+	expectPayloads(t, readPayloads(t, r), "tailed")
+	if r.Skipped() != 0 {
+		t.Errorf("expected no skipped bytes, got %d", r.Skipped())
+	}
+}
+
+func TestBatchFrames(t *testing.T) {
+	for _, codec := range []Codec{CodecNone, CodecDeflate, CodecSnappy} {
+		var (
+			buf   bytes.Buffer
+			frame []byte
+			batch Batch
+		)
+		w := NewWriter(&buf, true)
+		writeMessages(t, w, "before")
+		for _, p := range []string{"one", "two", "three", "three", "three"} {
+			msg := &message.Message{}
+			msg.SetPayload(p)
+			msgBytes, _ := proto.Marshal(msg)
+			if !batch.Add(msgBytes) {
+				t.Fatal("message didn't fit in the batch")
+			}
+		}
+		if err := batch.Frame(&frame, codec); err != nil {
+			t.Fatalf("codec: %s Frame failed: %s", codec, err)
+		}
+		buf.Write(frame)
+		writeMessages(t, w, "after")
+
+		r := NewReader(&buf)
+		expectPayloads(t, readPayloads(t, r), "before", "one", "two", "three",
+			"three", "three", "after")
+		if r.Corrupt() != 0 {
+			t.Errorf("codec: %s corrupt: %d", codec, r.Corrupt())
+		}
+	}
+}
+
+func TestBatchLimit(t *testing.T) {
+	var batch Batch
+	big := make([]byte, message.MAX_MESSAGE_SIZE)
+	if batch.Add(big) {
+		t.Error("oversized message was added to the batch")
+	}
+	if !batch.Add(big[:message.MAX_MESSAGE_SIZE/2]) ||
+		batch.Add(big[:message.MAX_MESSAGE_SIZE/2]) {
+		t.Error("batch size limit wasn't enforced")
+	}
+}
+
+func TestHello(t *testing.T) {
+	var buf bytes.Buffer
+	sent := Hello{Version: 2, Codecs: []Codec{CodecSnappy, CodecDeflate},
+		Signer: "test_1"}
+	if err := WriteHello(&buf, sent); err != nil {
+		t.Fatalf("WriteHello failed: %s", err)
+	}
+	data := buf.Bytes()
+	if _, n, err := ParseHello(data[:len(data)-1]); n != 0 || err != nil {
+		t.Errorf("partial hello n: %d err: %v", n, err)
+	}
+	h, n, err := ParseHello(data)
+	if fmt.Sprint(h) != fmt.Sprint(sent) || n != len(data) || err != nil {
+		t.Errorf("ParseHello returned %+v, %d, %v", h, n, err)
+	}
+	if h, err := ReadHello(&buf); fmt.Sprint(h) != fmt.Sprint(sent) || err != nil {
+		t.Errorf("ReadHello returned %+v, %v", h, err)
+	}
+
+	// Regular frames aren't hellos, and hellos aren't frames.
+	writeMessages(t, NewWriter(&buf, false), "plain")
+	if _, _, err := ParseHello(buf.Bytes()); err != ErrNotHello {
+		t.Errorf("expected ErrNotHello, got %v", err)
+	}
+	buf.Reset()
+	WriteHello(&buf, sent)
+	r := NewReader(&buf)
+	if _, _, err := r.Next(); err != io.EOF || r.Corrupt() != 1 {
+		t.Errorf("hello wasn't rejected err: %v corrupt: %d", err, r.Corrupt())
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	offer := Hello{Version: 2, Codecs: []Codec{Codec(99), CodecSnappy, CodecDeflate}}
+	all := Codecs()
+	known := func(signer string) bool { return signer == "known_1" }
+
+	tests := []struct {
+		offer      Hello
+		maxVersion uint
+		codecs     []Codec
+		expected   Hello
+	}{
+		// Unsupported codecs are skipped, the sender's preference wins.
+		{offer, 2, all, Hello{Version: 2, Codecs: []Codec{CodecSnappy}}},
+		{offer, 2, []Codec{CodecDeflate}, Hello{Version: 2, Codecs: []Codec{CodecDeflate}}},
+		{offer, 2, nil, Hello{Version: 2}},
+		// Version 1 has no batches to compress.
+		{offer, 1, all, Hello{Version: 1}},
+		{Hello{Version: 5}, 2, all, Hello{Version: 2}},
+		// Signing rules out batches.
+		{Hello{Version: 2, Codecs: all, Signer: "known_1"}, 2, all,
+			Hello{Version: 1, Signer: "known_1"}},
+		{Hello{Version: 2, Signer: "unknown_1"}, 2, nil, Hello{Version: 2}},
+	}
+	for i, test := range tests {
+		reply := Negotiate(test.offer, test.maxVersion, test.codecs, known)
+		if fmt.Sprint(reply) != fmt.Sprint(test.expected) {
+			t.Errorf("%d: expected %+v got %+v", i, test.expected, reply)
+		}
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	if fmt.Sprint(Codecs()) != "[deflate snappy]" {
+		t.Errorf("unexpected codecs: %v", Codecs())
+	}
+	for _, c := range Codecs() {
+		parsed, err := ParseCodec(c.String())
+		if parsed != c || err != nil {
+			t.Errorf("ParseCodec(%q) returned %s, %v", c, parsed, err)
+		}
+	}
+	if _, err := ParseCodec("lzma"); err == nil {
+		t.Error("unknown codec was parsed")
+	}
+}
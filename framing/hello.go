@@ -0,0 +1,178 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package framing
+
+import (
+	"errors"
+	"io"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+const (
+	// Highest framing version supported by this package.
+	MAX_VERSION = 2
+
+	// Header field number of a hello frame's framing version (varint).
+	VERSION_FIELD = 10
+	// Header field number of a hello frame's signer (bytes).
+	SIGNER_FIELD = 11
+
+	versionKey = VERSION_FIELD << 3
+	signerKey  = SIGNER_FIELD<<3 | 2
+)
+
+var ErrNotHello = errors.New("not a hello frame")
+
+// Handshake that lets the two ends of a connection agree on how the stream
+// will be encoded. The sender of a stream opens the connection w/ a hello
+// frame advertising what it supports, and waits for the receiver to reply w/
+// a hello holding what will actually be used, see Negotiate. Version 1
+// streams contain only single message frames, version 2 streams may also
+// contain batch frames.
+//
+// A hello frame has no message length, so receivers that don't know about it
+// reject it as an invalid frame and never reply; senders carry on as if
+// version 1 had been agreed when no reply arrives in time.
+type Hello struct {
+	// Highest framing version supported, or the version agreed on.
+	Version uint
+	// Batch compression codecs supported, in order of preference, or the
+	// single codec agreed on. Codec 0 (no compression) is always supported
+	// and never listed.
+	Codecs []Codec
+	// Signer ("<name>_<version>") the sender can sign messages w/. Echoed in
+	// the reply if the receiver can verify its signatures, in which case the
+	// messages have to be signed.
+	Signer string
+}
+
+// Returns the codec agreed on.
+func (h Hello) Codec() Codec {
+	if len(h.Codecs) == 0 {
+		return CodecNone
+	}
+	return h.Codecs[0]
+}
+
+// Picks the best option both ends support for the offered hello, given the
+// highest framing version the receiver supports, the codecs it's willing to
+// decode, and whether it can verify signatures from the offered signer. The
+// sender's order of preference is used for the codecs. Signatures cover a
+// single message, so signed streams are limited to version 1.
+func Negotiate(offer Hello, maxVersion uint, codecs []Codec,
+	knownSigner func(signer string) bool) (reply Hello) {
+
+	reply.Version = offer.Version
+	if maxVersion < reply.Version {
+		reply.Version = maxVersion
+	}
+	if reply.Version < 1 {
+		reply.Version = 1
+	}
+	if offer.Signer != "" && knownSigner != nil && knownSigner(offer.Signer) {
+		reply.Signer = offer.Signer
+		reply.Version = 1
+	}
+	if reply.Version < 2 {
+		return
+	}
+	for _, c := range offer.Codecs {
+		if !c.Supported() {
+			continue
+		}
+		for _, allowed := range codecs {
+			if c == allowed {
+				reply.Codecs = []Codec{c}
+				return
+			}
+		}
+	}
+	return
+}
+
+func (h Hello) frame() []byte {
+	fields := appendVarint(nil, versionKey, uint64(h.Version))
+	for _, c := range h.Codecs {
+		fields = appendVarint(fields, codecKey, uint64(c))
+	}
+	if h.Signer != "" {
+		fields = appendVarint(fields, signerKey, uint64(len(h.Signer)))
+		fields = append(fields, h.Signer...)
+	}
+	frame := []byte{message.RECORD_SEPARATOR, uint8(len(fields))}
+	frame = append(frame, fields...)
+	return append(frame, message.UNIT_SEPARATOR)
+}
+
+func WriteHello(w io.Writer, h Hello) error {
+	frame := h.frame()
+	if len(frame) > message.HEADER_FRAMING_SIZE+message.MAX_HEADER_SIZE {
+		return errors.New("hello too large")
+	}
+	_, err := w.Write(frame)
+	return err
+}
+
+// Parses the hello frame at the start of data, returning the frame's length.
+// A length of 0 means more data is needed to tell whether data starts w/ a
+// hello, ErrNotHello is returned if it doesn't.
+func ParseHello(data []byte) (h Hello, n int, err error) {
+	if len(data) == 0 {
+		return
+	}
+	if data[0] != message.RECORD_SEPARATOR {
+		return h, 0, ErrNotHello
+	}
+	if len(data) < message.HEADER_DELIMITER_SIZE {
+		return
+	}
+	headerEnd := int(data[1]) + message.HEADER_FRAMING_SIZE
+	if len(data) < headerEnd {
+		return
+	}
+	fields := data[message.HEADER_DELIMITER_SIZE : headerEnd-1]
+	version, ok := getVarint(fields, versionKey)
+	if !ok || data[headerEnd-1] != message.UNIT_SEPARATOR ||
+		fieldOffset(fields, lengthKey) >= 0 {
+		return h, 0, ErrNotHello
+	}
+	h.Version = uint(version)
+	for _, c := range getVarints(fields, codecKey) {
+		h.Codecs = append(h.Codecs, Codec(c))
+	}
+	if signer, ok := getBytes(fields, signerKey); ok {
+		h.Signer = string(signer)
+	}
+	return h, headerEnd, nil
+}
+
+// Reads a single hello frame from r.
+func ReadHello(r io.Reader) (h Hello, err error) {
+	data := make([]byte, message.HEADER_DELIMITER_SIZE,
+		message.HEADER_FRAMING_SIZE+message.MAX_HEADER_SIZE)
+	if _, err = io.ReadFull(r, data); err != nil {
+		return
+	}
+	if data[0] != message.RECORD_SEPARATOR {
+		return h, ErrNotHello
+	}
+	data = data[:int(data[1])+message.HEADER_FRAMING_SIZE]
+	if _, err = io.ReadFull(r, data[message.HEADER_DELIMITER_SIZE:]); err != nil {
+		return
+	}
+	h, _, err = ParseHello(data)
+	return
+}
@@ -0,0 +1,257 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package framing
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/mozilla-services/heka/message"
+)
+
+// Reads frames from a Heka stream, skipping over anything that isn't an
+// intact frame. A candidate frame is only accepted if its header decodes, its
+// message length is within MAX_MESSAGE_SIZE, the header is followed by a unit
+// separator, and its CRC, if it has one, matches the message. When a
+// candidate is rejected the reader resumes the search one byte after its
+// record separator rather than after the claimed frame, so a corrupted length
+// can't make it skip intact frames.
+type Reader struct {
+	r      io.Reader
+	buf    []byte
+	start  int // Start of the unconsumed data in buf.
+	end    int // End of the data in buf.
+	header *message.Header
+	// Reject frames that don't carry a CRC.
+	RequireCrc bool
+	skipped    int64
+	corrupt    int64
+	batch      batchDecoder
+	msgs       [][]byte
+	pending    [][]byte // Messages of the current batch not yet returned.
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{
+		r:      r,
+		buf:    make([]byte, 2*message.MAX_RECORD_SIZE),
+		header: &message.Header{},
+	}
+}
+
+// Number of bytes discarded so far because they weren't part of an intact
+// frame.
+func (r *Reader) Skipped() int64 {
+	return r.skipped
+}
+
+// Number of frames rejected so far because their header or CRC was invalid.
+func (r *Reader) Corrupt() int64 {
+	return r.corrupt
+}
+
+// Returns the next intact frame's header and message bytes, which are only
+// valid until the next call. The messages of a batch frame are returned one
+// at a time, each w/ the batch's header. Returns io.EOF once the underlying
+// reader does, keeping any partial frame so reading can resume if more data
+// is appended later, e.g. when tailing a file that's still being written.
+func (r *Reader) Next() (header *message.Header, msgBytes []byte, err error) {
+	if len(r.pending) > 0 {
+		msgBytes, r.pending = r.pending[0], r.pending[1:]
+		return r.header, msgBytes, nil
+	}
+	for {
+		n, found, msgBytes := r.scan(r.buf[r.start:r.end], err == io.EOF)
+		r.start += n
+		if found {
+			if _, ok := BatchCount(r.header); !ok {
+				return r.header, msgBytes, nil
+			}
+			r.msgs, err = r.batch.decode(r.header, msgBytes, r.msgs[:0])
+			if err != nil || len(r.msgs) == 0 {
+				// The CRC matched so the batch was sent this way, there's
+				// nothing to resync.
+				r.corrupt++
+				err = nil
+				continue
+			}
+			r.pending = r.msgs[1:]
+			return r.header, r.msgs[0], nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		err = r.fill()
+		if err != nil && err != io.EOF {
+			return nil, nil, err
+		}
+	}
+}
+
+// Reads the next intact frame and decodes its message into msg.
+func (r *Reader) ReadMessage(msg *message.Message) error {
+	for {
+		_, msgBytes, err := r.Next()
+		if err != nil {
+			return err
+		}
+		msg.Reset()
+		if err = message.UnmarshalMessage(msgBytes, msg); err == nil {
+			return nil
+		}
+		// An intact frame w/o a CRC can still hold garbage.
+		r.corrupt++
+	}
+}
+
+// Moves the unconsumed data to the start of the buffer and reads more. Data
+// that can't be the start of a frame has already been consumed by scan.
+func (r *Reader) fill() error {
+	if r.start > 0 {
+		r.end = copy(r.buf, r.buf[r.start:r.end])
+		r.start = 0
+	}
+	if r.end == len(r.buf) {
+		// Can't happen, scan consumes the data once it holds a full record.
+		r.skipped += int64(r.end)
+		r.end = 0
+	}
+	n, err := r.r.Read(r.buf[r.end:])
+	r.end += n
+	if n > 0 {
+		return nil
+	}
+	if err == nil {
+		err = io.ErrNoProgress
+	}
+	return err
+}
+
+const (
+	frameInvalid = iota
+	framePartial
+	frameIntact
+)
+
+// Checks the candidate frame at the start of data, which begins w/ a record
+// separator. Intact frames have their header decoded into r.header and their
+// length returned.
+func (r *Reader) checkFrame(data []byte) (status, length int) {
+	if len(data) < message.HEADER_DELIMITER_SIZE {
+		return framePartial, 0
+	}
+	headerLength := int(data[1])
+	headerEnd := headerLength + message.HEADER_FRAMING_SIZE
+	if headerLength == 0 {
+		return frameInvalid, 0
+	}
+	if len(data) < headerEnd {
+		return framePartial, 0
+	}
+	if data[headerEnd-1] != message.UNIT_SEPARATOR {
+		return frameInvalid, 0
+	}
+	ok, err := message.DecodeHeader(data[message.HEADER_DELIMITER_SIZE:headerEnd], r.header)
+	if !ok || err != nil || r.header.MessageLength == nil {
+		return frameInvalid, 0
+	}
+	msgEnd := headerEnd + int(r.header.GetMessageLength())
+	if len(data) < msgEnd {
+		return framePartial, 0
+	}
+	_, hasCrc := GetCrc(r.header)
+	if !CheckCrc(r.header, data[headerEnd:msgEnd]) || (!hasCrc && r.RequireCrc) {
+		return frameInvalid, 0
+	}
+	return frameIntact, msgEnd
+}
+
+// Returns true if there's an intact frame anywhere in data.
+func (r *Reader) hasFrame(data []byte) bool {
+	for n := 0; ; n++ {
+		pos := bytes.IndexByte(data[n:], message.RECORD_SEPARATOR)
+		if pos < 0 {
+			return false
+		}
+		n += pos
+		if status, _ := r.checkFrame(data[n:]); status == frameIntact {
+			return true
+		}
+	}
+}
+
+// Looks for an intact frame in data. Returns the number of bytes that can be
+// consumed and, if a frame was found, its message bytes (the header is
+// decoded into r.header). At EOF a partial frame followed by an intact one
+// can't be a frame that's still being written, so it's treated as corrupt;
+// that's how a damaged message length claiming more data than the stream
+// holds is recovered from.
+func (r *Reader) scan(data []byte, eof bool) (n int, found bool, msgBytes []byte) {
+	for {
+		pos := bytes.IndexByte(data[n:], message.RECORD_SEPARATOR)
+		if pos < 0 {
+			r.skipped += int64(len(data) - n)
+			return len(data), false, nil
+		}
+		r.skipped += int64(pos)
+		n += pos
+
+		status, length := r.checkFrame(data[n:])
+		if status == frameIntact {
+			msgStart := length - int(r.header.GetMessageLength())
+			return n + length, true, data[n+msgStart : n+length]
+		}
+		if status == framePartial && !(eof && r.hasFrame(data[n+1:])) {
+			return n, false, nil
+		}
+		// Not an intact frame, resync on the next record separator.
+		r.corrupt++
+		r.skipped++
+		n++
+	}
+}
+
+// Writes framed messages to a Heka stream.
+type Writer struct {
+	w   io.Writer
+	buf []byte
+	// Add a CRC to every frame.
+	Crc bool
+	// Sign every message w/ this config, if set.
+	Signer *message.MessageSigningConfig
+}
+
+func NewWriter(w io.Writer, crc bool) *Writer {
+	return &Writer{w: w, Crc: crc}
+}
+
+// Writes a frame holding the protobuf encoded message bytes.
+func (w *Writer) WriteFrame(msgBytes []byte) error {
+	if err := Frame(msgBytes, &w.buf, w.Signer, w.Crc); err != nil {
+		return err
+	}
+	_, err := w.w.Write(w.buf)
+	return err
+}
+
+// Encodes the message and writes it as a frame.
+func (w *Writer) WriteMessage(msg *message.Message) error {
+	msgBytes, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return w.WriteFrame(msgBytes)
+}
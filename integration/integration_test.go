@@ -0,0 +1,117 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package integration
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	ts "github.com/mozilla-services/heka/pipeline/testsupport"
+)
+
+func startTopology(t *testing.T, config ts.TopologyConfig) *ts.Topology {
+	if testing.Short() {
+		t.Skip("integration tests run real hekad processes")
+	}
+	ts.HekadBinary(t)
+	topo := ts.NewTopology(t, config)
+	topo.Start()
+	return topo
+}
+
+func payloads(prefix string, n int) []string {
+	p := make([]string, n)
+	for i := range p {
+		p[i] = fmt.Sprintf("%s %d", prefix, i)
+	}
+	return p
+}
+
+// Fails the test unless every expected payload was delivered. Buffered
+// delivery is at least once, so duplicates are fine.
+func expectDelivered(t *testing.T, lines, expected []string) {
+	delivered := make(map[string]bool, len(lines))
+	for _, line := range lines {
+		delivered[line] = true
+	}
+	for _, payload := range expected {
+		if !delivered[payload] {
+			t.Errorf("'%s' wasn't delivered", payload)
+		}
+	}
+}
+
+func TestDelivery(t *testing.T) {
+	topo := startTopology(t, ts.TopologyConfig{})
+	defer topo.Stop()
+
+	sent := payloads("delivered", 100)
+	ts.SendPayloads(t, topo.Edge.Address, nil, sent...)
+	expectDelivered(t, ts.WaitForLines(t, topo.Output, len(sent)), sent)
+}
+
+func TestBufferingAcrossAggregatorRestart(t *testing.T) {
+	topo := startTopology(t, ts.TopologyConfig{})
+	defer topo.Stop()
+
+	before := payloads("before", 10)
+	ts.SendPayloads(t, topo.Edge.Address, nil, before...)
+	ts.WaitForLines(t, topo.Output, len(before))
+
+	// The edge buffers what it receives while the aggregator is down, and
+	// sends it once it reconnects.
+	topo.Aggregator.Stop()
+	during := payloads("during", 10)
+	ts.SendPayloads(t, topo.Edge.Address, nil, during...)
+	time.Sleep(500 * time.Millisecond)
+	topo.Aggregator.Start()
+
+	after := payloads("after", 10)
+	ts.SendPayloads(t, topo.Edge.Address, nil, after...)
+	expected := append(append(before, during...), after...)
+	expectDelivered(t, ts.WaitForLines(t, topo.Output, len(expected)), expected)
+}
+
+func TestSigning(t *testing.T) {
+	signer := &message.MessageSigningConfig{
+		Name:    "edge",
+		Hash:    "sha1",
+		Key:     "4865ey9urgkidls xtb0[7lf9rzcivthkm",
+		Version: 1,
+	}
+	topo := startTopology(t, ts.TopologyConfig{Signer: signer})
+	defer topo.Stop()
+
+	// Neither unsigned messages nor those signed w/ the wrong key make it
+	// past the aggregator.
+	ts.SendPayloads(t, topo.Aggregator.Address, nil, "unsigned")
+	forged := *signer
+	forged.Key = "guessed"
+	ts.SendPayloads(t, topo.Aggregator.Address, &forged, "forged")
+
+	signed := payloads("signed", 10)
+	ts.SendPayloads(t, topo.Edge.Address, nil, signed...)
+	ts.WaitForLines(t, topo.Output, len(signed))
+	time.Sleep(200 * time.Millisecond)
+	lines := ts.ReadLines(topo.Output)
+	expectDelivered(t, lines, signed)
+	for _, line := range lines {
+		if line == "unsigned" || line == "forged" {
+			t.Errorf("'%s' was delivered", line)
+		}
+	}
+}
@@ -353,6 +353,16 @@ func (l *Logstream) SavePosition() error {
 	return l.position.Save()
 }
 
+// Close the file currently being read, if any
+func (l *Logstream) Close() (err error) {
+	if l.fd != nil {
+		err = l.fd.Close()
+		l.fd = nil
+		l.reader = nil
+	}
+	return
+}
+
 // Get a copy of the logfiles
 func (l *Logstream) GetLogfiles() (logfiles Logfiles) {
 	l.lfMutex.RLock()
@@ -428,6 +438,23 @@ func (ls *LogstreamSet) GetLogstream(name string) (l *Logstream, ok bool) {
 	return
 }
 
+// Removes a logstream from the set, closing any file it has open and deleting
+// its journal. The logstream must no longer be in use.
+func (ls *LogstreamSet) RemoveLogstream(name string) (err error) {
+	ls.logstreamMutex.Lock()
+	defer ls.logstreamMutex.Unlock()
+	l, ok := ls.logstreams[name]
+	if !ok {
+		return
+	}
+	delete(ls.logstreams, name)
+	l.Close()
+	if err = os.Remove(l.position.JournalPath); os.IsNotExist(err) {
+		err = nil
+	}
+	return
+}
+
 // Get a list of all the logstream names
 func (ls *LogstreamSet) GetLogstreamNames() []string {
 	ls.logstreamMutex.RLock()
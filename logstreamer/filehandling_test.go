@@ -17,10 +17,13 @@ package logstreamer
 
 import (
 	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"runtime"
 	"sort"
+	"strings"
+	"time"
 )
 
 func FilehandlingSpec(c gs.Context) {
@@ -214,4 +217,104 @@ func FilehandlingSpec(c gs.Context) {
 			c.Expect(len(error), gs.Equals, 26)
 		})
 	})
+
+	c.Specify("Removing a logstream", func() {
+		tmpDir, err := ioutil.TempDir("", "logstreamer-tests")
+		c.Assume(err, gs.IsNil)
+		defer os.RemoveAll(tmpDir)
+		logDir := filepath.Join(tmpDir, "logs")
+		journalDir := filepath.Join(tmpDir, "journals")
+		c.Assume(os.MkdirAll(logDir, 0755), gs.IsNil)
+		c.Assume(os.MkdirAll(journalDir, 0755), gs.IsNil)
+		err = ioutil.WriteFile(filepath.Join(logDir, "app.log"), []byte("line\n"), 0644)
+		c.Assume(err, gs.IsNil)
+
+		sp := &SortPattern{
+			FileMatch:      `app\.log$`,
+			Differentiator: []string{"app"},
+		}
+		lss, err := NewLogstreamSet(sp, 0, logDir, journalDir, false)
+		c.Assume(err, gs.IsNil)
+		names, errs := lss.ScanForLogstreams()
+		c.Assume(errs.IsError(), gs.IsFalse)
+		c.Assume(len(names), gs.Equals, 1)
+		stream, ok := lss.GetLogstream("app")
+		c.Assume(ok, gs.IsTrue)
+		_, err = stream.Read(make([]byte, 5))
+		c.Assume(err, gs.IsNil)
+		stream.FlushBuffer(5)
+		c.Assume(stream.SavePosition(), gs.IsNil)
+
+		c.Specify("closes its file and deletes its journal", func() {
+			err = lss.RemoveLogstream("app")
+			c.Expect(err, gs.IsNil)
+			_, ok = lss.GetLogstream("app")
+			c.Expect(ok, gs.IsFalse)
+			c.Expect(stream.fd, gs.IsNil)
+			_, err = os.Stat(filepath.Join(journalDir, "app"))
+			c.Expect(os.IsNotExist(err), gs.IsTrue)
+		})
+
+		c.Specify("is a no-op for unknown logstreams", func() {
+			c.Expect(lss.RemoveLogstream("other"), gs.IsNil)
+			_, ok = lss.GetLogstream("app")
+			c.Expect(ok, gs.IsTrue)
+		})
+	})
+
+	c.Specify("Verifying a LogstreamSet", func() {
+		tmpDir, err := ioutil.TempDir("", "logstreamer-tests")
+		c.Assume(err, gs.IsNil)
+		defer os.RemoveAll(tmpDir)
+		for _, name := range []string{"app.log", "app.log.1", "app.log.x"} {
+			err = ioutil.WriteFile(filepath.Join(tmpDir, name), []byte("line\n"), 0644)
+			c.Assume(err, gs.IsNil)
+		}
+		sp := &SortPattern{
+			FileMatch:      `app\.log(\.(?P<Seq>\w+))?$`,
+			Differentiator: []string{"app"},
+			Priority:       []string{"^Seq"},
+		}
+
+		c.Specify("finds nothing wrong w/ a working config", func() {
+			sp.FileMatch = `app\.log(\.(?P<Seq>\d+))?$`
+			lss, err := NewLogstreamSet(sp, 0, tmpDir, "", false)
+			c.Assume(err, gs.IsNil)
+			c.Expect(len(lss.Verify()), gs.Equals, 0)
+		})
+
+		c.Specify("warns about unknown priorities and unordered files", func() {
+			sp.Priority = []string{"^Seq", "Day"}
+			lss, err := NewLogstreamSet(sp, 0, tmpDir, "", false)
+			c.Assume(err, gs.IsNil)
+			warnings := lss.Verify()
+			c.Assume(len(warnings), gs.Equals, 2)
+			c.Expect(warnings[0], gs.Equals,
+				"priority 'Day' isn't a named group of file_match, it won't affect the ordering")
+			c.Expect(strings.Contains(warnings[1], "have the same priority"), gs.IsTrue)
+		})
+
+		c.Specify("warns about streams skipped for lack of a priority", func() {
+			sp.Priority = nil
+			lss, err := NewLogstreamSet(sp, 0, tmpDir, "", false)
+			c.Assume(err, gs.IsNil)
+			warnings := lss.Verify()
+			c.Assume(len(warnings), gs.Equals, 1)
+			c.Expect(warnings[0], gs.Equals,
+				"skipping logstream app: 3 files but no priority to order them by")
+		})
+
+		c.Specify("warns about files older than oldest_duration", func() {
+			old := time.Now().Add(-2 * time.Hour)
+			err = os.Chtimes(filepath.Join(tmpDir, "app.log.x"), old, old)
+			c.Assume(err, gs.IsNil)
+			lss, err := NewLogstreamSet(sp, time.Hour, tmpDir, "", false)
+			c.Assume(err, gs.IsNil)
+			warnings := lss.Verify()
+			c.Assume(len(warnings), gs.Equals, 1)
+			c.Expect(strings.HasPrefix(warnings[0], "skipping "), gs.IsTrue)
+			c.Expect(strings.HasSuffix(warnings[0],
+				"app.log.x: last modified longer than oldest_duration ago"), gs.IsTrue)
+		})
+	})
 }
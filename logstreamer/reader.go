@@ -211,16 +211,18 @@ func (l *Logstream) NewerFileAvailable() (file string, ok bool) {
 		return "", false
 	}
 	fInfo, err := os.Stat(l.position.Filename)
-	if err != nil {
+	if err != nil && !os.IsNotExist(err) {
 		return "", false
 	}
 
 	priorWasEmpty := false
 	lastSize := currentInfo.Size()
-	newSize := fInfo.Size()
-	// 1. If our size is greater than the file at this filename, we're not the
+	// 1. If our file is gone, e.g. it was compressed and removed by logrotate,
+	// or our size is greater than the file at this filename, we're not the
 	// same file.
-	if lastSize > newSize {
+	if fInfo == nil {
+		ok = true
+	} else if newSize := fInfo.Size(); lastSize > newSize {
 		ok = true
 	} else if lastSize < newSize && lastSize == 0 {
 		// We have to double-check for cases where an empty file might have
@@ -250,6 +252,11 @@ func (l *Logstream) NewerFileAvailable() (file string, ok bool) {
 			fd.Close()
 		}
 
+		if err != nil && fInfo == nil {
+			// Keep reading what's left of the file we have open.
+			return "", false
+		}
+
 		if err != nil {
 			// Unable to locate prior position in our file-stream, are there
 			// any logfiles?
@@ -475,7 +482,7 @@ func SeekInFile(path string, position *LogstreamLocation) (*os.File, io.Reader,
 		n, err = io.ReadFull(reader, buf)
 		expectedN = int64(LINEBUFFERLEN)
 	} else {
-		n, err = reader.Read(buf[-seekPos:])
+		n, err = io.ReadFull(reader, buf[-seekPos:])
 		expectedN = position.SeekPosition
 	}
 	if (err == nil || err == io.EOF) && int64(n) == expectedN {
@@ -595,6 +602,11 @@ func (l *Logstream) readBytes(p []byte) (n int, err error) {
 	// We're ready to read, commit the read and update our position
 	// TODO: should anything be done with the fd?
 	n, err = l.reader.Read(p)
+	if n > 0 && err == io.EOF {
+		// Gzip readers return the last of the data along w/ the EOF, leave
+		// the EOF for the next read so the data isn't dropped.
+		err = nil
+	}
 
 	// If we read any bytes, write them to our saveBuffer.
 	// If our saveBuffer is smaller than the buffer we were just passed,
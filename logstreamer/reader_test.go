@@ -16,14 +16,55 @@
 package logstreamer
 
 import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
 	"github.com/mozilla-services/heka/ringbuf"
 	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"time"
 )
 
+// Writes a logfile of numbered lines, gzipped if the name ends in ".gz".
+func writeTestLog(path, prefix string, lines int) error {
+	var buf bytes.Buffer
+	for i := 0; i < lines; i++ {
+		fmt.Fprintf(&buf, "%s line %04d w/ some padding\n", prefix, i)
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		return ioutil.WriteFile(path, buf.Bytes(), 0644)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(f)
+	gz.Write(buf.Bytes())
+	gz.Close()
+	return f.Close()
+}
+
+// Reads the stream until it runs out of data or reads is reached, flushing
+// the position after each read the way the LogstreamerInput does.
+func readTestStream(stream *Logstream, reads int) string {
+	var out bytes.Buffer
+	b := make([]byte, 300)
+	for i := 0; i < reads; i++ {
+		n, err := stream.Read(b)
+		out.Write(b[:n])
+		stream.FlushBuffer(n)
+		if n == 0 && err == io.EOF {
+			break
+		}
+	}
+	return out.String()
+}
+
 func ReaderSpec(c gs.Context) {
 	here, err := os.Getwd()
 	c.Assume(err, gs.IsNil)
@@ -218,4 +259,81 @@ func ReaderSpec(c gs.Context) {
 		c.Expect(ls.position.Hash, gs.Equals, "72781af95a1583690cc97548fdcf3bb0efbe3119")
 		c.Expect(ls.position.Filename[len(testDirPath):], gs.Equals, "/2013/08/error.log")
 	})
+
+	c.Specify("Gzipped rotated files", func() {
+		logDir, err := ioutil.TempDir("", "logstreamer-gz")
+		c.Assume(err, gs.IsNil)
+		defer os.RemoveAll(logDir)
+		journalDir, err := ioutil.TempDir("", "logstreamer-gz-journal")
+		c.Assume(err, gs.IsNil)
+		defer os.RemoveAll(journalDir)
+
+		files := []struct {
+			name, prefix string
+		}{
+			{"app.log.3.gz", "three"},
+			{"app.log.2.gz", "two"},
+			{"app.log.1", "one"},
+			{"app.log", "zero"},
+		}
+		for _, f := range files {
+			err = writeTestLog(filepath.Join(logDir, f.name), f.prefix, 200)
+			c.Assume(err, gs.IsNil)
+		}
+		newStream := func() *Logstream {
+			sp := &SortPattern{
+				FileMatch:      `app\.log(\.(?P<Seq>\d+))?(\.gz)?$`,
+				Translation:    make(SubmatchTranslationMap),
+				Priority:       []string{"^Seq"},
+				Differentiator: []string{"app"},
+			}
+			ls, err := NewLogstreamSet(sp, 0, logDir, journalDir, false)
+			c.Assume(err, gs.IsNil)
+			ls.ScanForLogstreams()
+			stream, ok := ls.GetLogstream("app")
+			c.Assume(ok, gs.IsTrue)
+			return stream
+		}
+		expectAllLines := func(data string) {
+			for _, f := range files {
+				c.Expect(strings.Count(data, f.prefix+" line"), gs.Equals, 200)
+			}
+		}
+
+		c.Specify("are read completely in order", func() {
+			stream := newStream()
+			data := readTestStream(stream, 1000)
+			expectAllLines(data)
+			c.Expect(strings.Index(data, "three"), gs.Equals, 0)
+			c.Expect(strings.Index(data, "two") < strings.Index(data, "one"), gs.IsTrue)
+			c.Expect(stream.position.Filename, gs.Equals, filepath.Join(logDir, "app.log"))
+		})
+
+		c.Specify("are resumed after a restart", func() {
+			stream := newStream()
+			data := readTestStream(stream, 30)
+			c.Expect(strings.HasSuffix(stream.position.Filename, ".gz"), gs.IsTrue)
+			c.Expect(stream.SavePosition(), gs.IsNil)
+			stream.Close()
+
+			stream = newStream()
+			data += readTestStream(stream, 1000)
+			expectAllLines(data)
+		})
+
+		c.Specify("are found when the file being read is compressed", func() {
+			stream := newStream()
+			data := readTestStream(stream, 50)
+			c.Expect(stream.position.Filename, gs.Equals, filepath.Join(logDir, "app.log.1"))
+			// Compress it the way logrotate does, w/o delaycompress.
+			plain := filepath.Join(logDir, "app.log.1")
+			err = writeTestLog(plain+".gz", "one", 200)
+			c.Assume(err, gs.IsNil)
+			c.Assume(os.Remove(plain), gs.IsNil)
+
+			data += readTestStream(stream, 1000)
+			expectAllLines(data)
+			c.Expect(stream.position.Filename, gs.Equals, filepath.Join(logDir, "app.log"))
+		})
+	})
 }
@@ -0,0 +1,142 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package logstreamer
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Verify checks the sort pattern's settings against the named capture groups
+// of the file match regexp, returning a warning for each setting that can't
+// work as intended.
+func (sp *SortPattern) Verify(fileMatch *regexp.Regexp) (warnings []string) {
+	groups := make(map[string]bool)
+	for _, name := range fileMatch.SubexpNames() {
+		if name != "" {
+			groups[name] = true
+		}
+	}
+	differentiators := make(map[string]bool)
+	for _, d := range sp.Differentiator {
+		if groups[d] {
+			differentiators[d] = true
+		}
+	}
+	for _, part := range sp.Priority {
+		part = strings.TrimPrefix(part, "^")
+		if !groups[part] {
+			warnings = append(warnings, fmt.Sprintf(
+				"priority '%s' isn't a named group of file_match, it won't affect the ordering",
+				part))
+		} else if differentiators[part] {
+			warnings = append(warnings, fmt.Sprintf(
+				"'%s' is used as both priority and differentiator, each of its values "+
+					"will be a separate logstream", part))
+		}
+	}
+	names := make([]string, 0, len(sp.Translation))
+	for name := range sp.Translation {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !groups[name] {
+			warnings = append(warnings, fmt.Sprintf(
+				"translation '%s' isn't a named group of file_match, it won't be used",
+				name))
+		}
+	}
+	return
+}
+
+// Verify checks the LogstreamSet's config against the current contents of its
+// log directory w/o creating any logstreams, returning a warning for every
+// problem found, including each file that matches the file match regexp but
+// would be skipped.
+func (ls *LogstreamSet) Verify() (warnings []string) {
+	warnings = ls.sortPattern.Verify(ls.fileMatch)
+
+	logfiles := ScanDirectoryForLogfiles(ls.logRoot, ls.fileMatch)
+	if len(logfiles) == 0 {
+		return append(warnings, fmt.Sprintf("no files in %s match file_match '%s'",
+			ls.logRoot, ls.sortPattern.FileMatch))
+	}
+
+	if ls.oldestDuration != time.Duration(0) {
+		recent := logfiles.FilterOld(time.Now().Add(-ls.oldestDuration))
+		for _, logfile := range logfiles {
+			if recent.IndexOf(logfile.FileName) == -1 {
+				warnings = append(warnings, fmt.Sprintf(
+					"skipping %s: last modified longer than oldest_duration ago",
+					logfile.FileName))
+			}
+		}
+		logfiles = recent
+	}
+
+	for _, logfile := range logfiles {
+		if fd, err := os.Open(logfile.FileName); err != nil {
+			warnings = append(warnings, fmt.Sprintf("can't read %s: %s",
+				logfile.FileName, err))
+		} else {
+			fd.Close()
+		}
+	}
+
+	if err := logfiles.PopulateMatchParts(ls.fileMatch, ls.sortPattern.Translation); err != nil {
+		for _, msg := range *err.(*MultipleError) {
+			warnings = append(warnings, "can't translate file name: "+msg)
+		}
+	}
+
+	mfs := FilterMultipleStreamFiles(logfiles, ls.sortPattern.Differentiator)
+	names := make([]string, 0, len(mfs))
+	for name := range mfs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		files := mfs[name]
+		if len(files) < 2 {
+			continue
+		}
+		if len(ls.sortPattern.Priority) == 0 {
+			warnings = append(warnings, fmt.Sprintf(
+				"skipping logstream %s: %d files but no priority to order them by",
+				name, len(files)))
+			continue
+		}
+		byp := ByPriority{Logfiles: files, Priority: ls.sortPattern.Priority}
+		sort.Sort(byp)
+		for i := 1; i < len(files); i++ {
+			if !byp.Less(i-1, i) {
+				warnings = append(warnings, fmt.Sprintf(
+					"logstream %s: %s and %s have the same priority, their order is arbitrary",
+					name, files[i-1].FileName, files[i].FileName))
+			}
+		}
+		if ls.initialTail {
+			warnings = append(warnings, fmt.Sprintf(
+				"logstream %s: initial_tail skips all but %s if there's no journal",
+				name, files[len(files)-1].FileName))
+		}
+	}
+	return
+}
@@ -20,6 +20,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/gogo/protobuf/proto"
 	"github.com/pborman/uuid"
 	"github.com/rafrombrc/gospec/src/gospec"
 	gs "github.com/rafrombrc/gospec/src/gospec"
@@ -29,7 +30,11 @@ func TestAllSpecs(t *testing.T) {
 	r := gospec.NewRunner()
 	r.AddSpec(MessageFieldsSpec)
 	r.AddSpec(MessageEqualsSpec)
+	r.AddSpec(MessageDecodingSpec)
+	r.AddSpec(FieldAccessorsSpec)
+	r.AddSpec(MatcherCacheSpec)
 	r.AddSpec(MatcherSpecificationSpec)
+	r.AddSpec(RegexpSetSpec)
 	gospec.MainGoTest(r, t)
 }
 
@@ -227,6 +232,62 @@ func MessageEqualsSpec(c gospec.Context) {
 	})
 }
 
+func MessageDecodingSpec(c gospec.Context) {
+	c.Specify("Messages round trip", func() {
+		msg0 := getTestMessage()
+		b, err := proto.Marshal(msg0)
+		c.Assume(err, gs.IsNil)
+		msg1 := &Message{}
+		c.Expect(UnmarshalMessage(b, msg1), gs.IsNil)
+		c.Expect(msg1, gs.Equals, msg0)
+	})
+
+	c.Specify("Unknown fields are kept", func() {
+		data := []byte("\x1a\x04test\x78\x05\x82\x01\x02ab")
+		msg := &Message{}
+		c.Expect(UnmarshalMessage(data, msg), gs.IsNil)
+		c.Expect(msg.GetType(), gs.Equals, "test")
+		c.Expect(string(msg.XXX_unrecognized), gs.Equals, "\x78\x05\x82\x01\x02ab")
+	})
+
+	c.Specify("Malformed messages are rejected", func() {
+		for _, data := range []string{
+			// Logger w/ a negative length.
+			"\x22\xff\xff\xff\xff\xff\xff\xff\xff\xff\x01",
+			// Field w/ a name overflowing the field's length.
+			"\x52\x03\x0a\x7f\x00",
+			// Unknown group holding a field w/ a negative length.
+			"\x6b\x0a\xff\xff\xff\xff\xff\xff\xff\xff\xff\x01\x6c",
+			// Unknown group that's never ended.
+			"\x6b\x08\x01",
+			// Unknown field w/ a key padded to more bytes than it takes.
+			"\xf8\x80\x00\x01",
+			// Unknown field truncated after its key.
+			"\x78",
+		} {
+			msg := &Message{}
+			msg.SetType("stale")
+			c.Expect(UnmarshalMessage([]byte(data), msg), gs.Not(gs.IsNil))
+			c.Expect(msg.Type == nil, gs.IsTrue)
+		}
+	})
+
+	c.Specify("Malformed fields are rejected", func() {
+		field := &Field{}
+		c.Expect(UnmarshalField([]byte("\x0a\xff\xff\xff\xff\xff\xff\xff\xff\xff\x01"),
+			field), gs.Not(gs.IsNil))
+	})
+
+	c.Specify("Headers w/ invalid lengths are rejected and reset", func() {
+		header := &Header{}
+		header.SetMessageLength(10)
+		decoded, err := DecodeHeader([]byte("\x08\xff\xff\xff\xff\x0f\x22\x7f\x1f"), header)
+		c.Expect(decoded, gs.IsFalse)
+		c.Expect(err, gs.Not(gs.IsNil))
+		c.Expect(header.MessageLength == nil, gs.IsTrue)
+	})
+}
+
 func BenchmarkMessageCreation(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		msg := getTestMessage()
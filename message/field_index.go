@@ -0,0 +1,135 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package message
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+// Messages w/ at least this many fields get a field name index the first time
+// a field is looked up by name through a FieldIndex, 0 disables indexing.
+var fieldIndexThreshold = 32
+
+// Sets the number of fields a message needs before field lookups are indexed,
+// meant to be called once at startup.
+func SetFieldIndexThreshold(n int) {
+	fieldIndexThreshold = n
+}
+
+// FieldIndex looks up a message's fields by name through a hash index, built
+// the first time one of them is looked up. It's kept apart from the Message,
+// whose struct is generated from message.proto, by whatever holds the
+// message for the duration of its processing (i.e. the PipelinePack). It's
+// safe for concurrent use by the readers of the message, but must be Reset
+// before being used for another message.
+//
+// The index is rebuilt when the Fields slice is replaced or resized, so
+// adding or deleting fields is supported, the only unsupported mutation is
+// renaming a field or overwriting an element of Fields in place.
+type FieldIndex struct {
+	positions unsafe.Pointer // *fieldPositions
+	// Positions dropped by Reset, whose map is reused by the next build.
+	spare unsafe.Pointer
+}
+
+// Maps field names to the position of the first field w/ that name, in the
+// Fields slice it was built from.
+type fieldPositions struct {
+	array **Field // Start of the Fields backing array.
+	first *Field
+	n     int
+	pos   map[string]int
+}
+
+func (p *fieldPositions) valid(fields []*Field) bool {
+	return p != nil && p.n == len(fields) && p.array == &fields[0] &&
+		p.first == fields[0]
+}
+
+// Reset drops the index, readying it for a new message.
+func (idx *FieldIndex) Reset() {
+	if p := atomic.SwapPointer(&idx.positions, nil); p != nil {
+		atomic.StorePointer(&idx.spare, p)
+	}
+}
+
+// Returns the message's field positions, building them if there are none or
+// the Fields have changed since they were built. Concurrent readers may each
+// build them, the last ones stored win.
+func (idx *FieldIndex) get(m *Message) *fieldPositions {
+	p := (*fieldPositions)(atomic.LoadPointer(&idx.positions))
+	if p.valid(m.Fields) {
+		return p
+	}
+	// Positions that are stale rather than Reset may still be in use, only
+	// the spare ones can be recycled.
+	if p = (*fieldPositions)(atomic.SwapPointer(&idx.spare, nil)); p != nil {
+		for name := range p.pos {
+			delete(p.pos, name)
+		}
+	} else {
+		p = &fieldPositions{pos: make(map[string]int, len(m.Fields))}
+	}
+	p.array, p.first, p.n = &m.Fields[0], m.Fields[0], len(m.Fields)
+	for i, f := range m.Fields {
+		if f == nil {
+			continue
+		}
+		if _, ok := p.pos[f.GetName()]; !ok {
+			p.pos[f.GetName()] = i
+		}
+	}
+	atomic.StorePointer(&idx.positions, unsafe.Pointer(p))
+	return p
+}
+
+// Returns the position of the first field w/ the specified name, or -1. A nil
+// index scans the fields.
+func (idx *FieldIndex) fieldPos(m *Message, name string) int {
+	if m == nil {
+		return -1
+	}
+	if idx == nil || fieldIndexThreshold <= 0 || len(m.Fields) < fieldIndexThreshold {
+		for i, f := range m.Fields {
+			if f != nil && f.GetName() == name {
+				return i
+			}
+		}
+		return -1
+	}
+	if i, ok := idx.get(m).pos[name]; ok {
+		return i
+	}
+	return -1
+}
+
+// FindFirstField is Message.FindFirstField, using the index.
+func (idx *FieldIndex) FindFirstField(m *Message, name string) *Field {
+	if i := idx.fieldPos(m, name); i >= 0 {
+		return m.Fields[i]
+	}
+	return nil
+}
+
+// FindAllFields is Message.FindAllFields, using the index to find the first
+// of the fields.
+func (idx *FieldIndex) FindAllFields(m *Message, name string) []*Field {
+	first := idx.fieldPos(m, name)
+	if first < 0 {
+		return nil
+	}
+	return m.findAllFields(name, first)
+}
@@ -0,0 +1,256 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+// Typed field accessors and bulk field mutation. The getters avoid the
+// interface{} boxing of GetFieldValue and the setters reuse the existing
+// field's storage whenever possible, so they're cheap enough to use on every
+// message.
+
+package message
+
+import (
+	"strings"
+)
+
+// Returns the first value of the first field w/ the specified name, ok is
+// false if there's no such field or it doesn't hold a string.
+func (m *Message) GetString(name string) (value string, ok bool) {
+	f := m.FindFirstField(name)
+	if f == nil || f.GetValueType() != Field_STRING || len(f.ValueString) == 0 {
+		return
+	}
+	return f.ValueString[0], true
+}
+
+// Returns the first value of the first field w/ the specified name, ok is
+// false if there's no such field or it doesn't hold bytes.
+func (m *Message) GetBytes(name string) (value []byte, ok bool) {
+	f := m.FindFirstField(name)
+	if f == nil || f.GetValueType() != Field_BYTES || len(f.ValueBytes) == 0 {
+		return
+	}
+	return f.ValueBytes[0], true
+}
+
+// Returns the first value of the first field w/ the specified name, ok is
+// false if there's no such field or it doesn't hold an integer.
+func (m *Message) GetInt(name string) (value int64, ok bool) {
+	f := m.FindFirstField(name)
+	if f == nil || f.GetValueType() != Field_INTEGER || len(f.ValueInteger) == 0 {
+		return
+	}
+	return f.ValueInteger[0], true
+}
+
+// Returns the first value of the first field w/ the specified name, ok is
+// false if there's no such field or it doesn't hold a double.
+func (m *Message) GetDouble(name string) (value float64, ok bool) {
+	f := m.FindFirstField(name)
+	if f == nil || f.GetValueType() != Field_DOUBLE || len(f.ValueDouble) == 0 {
+		return
+	}
+	return f.ValueDouble[0], true
+}
+
+// Returns the first value of the first field w/ the specified name, ok is
+// false if there's no such field or it doesn't hold a bool.
+func (m *Message) GetBool(name string) (value bool, ok bool) {
+	f := m.FindFirstField(name)
+	if f == nil || f.GetValueType() != Field_BOOL || len(f.ValueBool) == 0 {
+		return
+	}
+	return f.ValueBool[0], true
+}
+
+// Returns the first field w/ the specified name, reset to hold a single value
+// of the specified type, adding a new field if there's none. The field's
+// representation is kept.
+func (m *Message) singleValueField(name string, valueType Field_ValueType) *Field {
+	f := m.FindFirstField(name)
+	if f == nil {
+		f = NewFieldInit(name, valueType, "")
+		m.AddField(f)
+	} else if f.GetValueType() != valueType {
+		*f.ValueType = valueType
+	}
+	if valueType != Field_STRING {
+		f.ValueString = nil
+	}
+	if valueType != Field_BYTES {
+		f.ValueBytes = nil
+	}
+	if valueType != Field_INTEGER {
+		f.ValueInteger = nil
+	}
+	if valueType != Field_DOUBLE {
+		f.ValueDouble = nil
+	}
+	if valueType != Field_BOOL {
+		f.ValueBool = nil
+	}
+	return f
+}
+
+// Sets the first field w/ the specified name to the single value, replacing
+// whatever it held before, or adds a new field if there's none. Any other
+// fields w/ the same name are left alone.
+func (m *Message) SetString(name, value string) {
+	if m == nil {
+		return
+	}
+	f := m.singleValueField(name, Field_STRING)
+	if len(f.ValueString) == 0 {
+		f.ValueString = []string{value}
+	} else {
+		f.ValueString = append(f.ValueString[:0], value)
+	}
+}
+
+// Sets the first field w/ the specified name to the single value, see
+// SetString. The bytes are copied.
+func (m *Message) SetBytes(name string, value []byte) {
+	if m == nil {
+		return
+	}
+	f := m.singleValueField(name, Field_BYTES)
+	b := make([]byte, len(value))
+	copy(b, value)
+	if len(f.ValueBytes) == 0 {
+		f.ValueBytes = [][]byte{b}
+	} else {
+		f.ValueBytes = append(f.ValueBytes[:0], b)
+	}
+}
+
+// Sets the first field w/ the specified name to the single value, see
+// SetString.
+func (m *Message) SetInt(name string, value int64) {
+	if m == nil {
+		return
+	}
+	f := m.singleValueField(name, Field_INTEGER)
+	if len(f.ValueInteger) == 0 {
+		f.ValueInteger = []int64{value}
+	} else {
+		f.ValueInteger = append(f.ValueInteger[:0], value)
+	}
+}
+
+// Sets the first field w/ the specified name to the single value, see
+// SetString.
+func (m *Message) SetDouble(name string, value float64) {
+	if m == nil {
+		return
+	}
+	f := m.singleValueField(name, Field_DOUBLE)
+	if len(f.ValueDouble) == 0 {
+		f.ValueDouble = []float64{value}
+	} else {
+		f.ValueDouble = append(f.ValueDouble[:0], value)
+	}
+}
+
+// Sets the first field w/ the specified name to the single value, see
+// SetString.
+func (m *Message) SetBool(name string, value bool) {
+	if m == nil {
+		return
+	}
+	f := m.singleValueField(name, Field_BOOL)
+	if len(f.ValueBool) == 0 {
+		f.ValueBool = []bool{value}
+	} else {
+		f.ValueBool = append(f.ValueBool[:0], value)
+	}
+}
+
+// Removes the fields for which remove returns true, preserving the order of
+// the remaining fields, and returns the number of fields removed.
+func (m *Message) deleteFields(remove func(f *Field) bool) (n int) {
+	if m == nil {
+		return
+	}
+	kept := m.Fields[:0]
+	for _, f := range m.Fields {
+		if f != nil && remove(f) {
+			n++
+		} else {
+			kept = append(kept, f)
+		}
+	}
+	// Don't keep the removed fields alive through the backing array.
+	for i := len(kept); i < len(m.Fields); i++ {
+		m.Fields[i] = nil
+	}
+	m.Fields = kept
+	return
+}
+
+// Deletes all the fields w/ the specified name and returns how many were
+// deleted.
+func (m *Message) DeleteFieldsByName(name string) int {
+	return m.deleteFields(func(f *Field) bool {
+		return f.GetName() == name
+	})
+}
+
+// Deletes all the fields whose name starts w/ the specified prefix and
+// returns how many were deleted.
+func (m *Message) DeleteFieldsByPrefix(prefix string) int {
+	return m.deleteFields(func(f *Field) bool {
+		return strings.HasPrefix(f.GetName(), prefix)
+	})
+}
+
+// Replaces the message's fields w/ the given ones in a single pass. Every
+// existing field that shares a name w/ one of the new fields is removed, the
+// new field takes the position of the first one it replaces, and new fields
+// w/o a counterpart are appended in the order given. If several of the new
+// fields share a name only the last one is used.
+func (m *Message) ReplaceFields(fields []*Field) {
+	if m == nil || len(fields) == 0 {
+		return
+	}
+	replacements := make(map[string]*Field, len(fields))
+	for _, f := range fields {
+		replacements[f.GetName()] = f
+	}
+	placed := make(map[string]bool, len(fields))
+	kept := m.Fields[:0]
+	for _, f := range m.Fields {
+		if f == nil {
+			kept = append(kept, f)
+			continue
+		}
+		name := f.GetName()
+		r, ok := replacements[name]
+		if !ok {
+			kept = append(kept, f)
+		} else if !placed[name] {
+			kept = append(kept, r)
+			placed[name] = true
+		}
+	}
+	for i := len(kept); i < len(m.Fields); i++ {
+		m.Fields[i] = nil
+	}
+	m.Fields = kept
+	for _, f := range fields {
+		name := f.GetName()
+		if !placed[name] {
+			m.AddField(replacements[name])
+			placed[name] = true
+		}
+	}
+}
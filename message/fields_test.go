@@ -0,0 +1,313 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package message
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/rafrombrc/gospec/src/gospec"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func fieldNames(msg *Message) []string {
+	names := make([]string, len(msg.Fields))
+	for i, f := range msg.Fields {
+		names[i] = f.GetName()
+	}
+	return names
+}
+
+func FieldAccessorsSpec(c gospec.Context) {
+	c.Specify("Typed getters", func() {
+		msg := getTestMessage()
+		f, _ := NewField("ratio", 0.5, "")
+		msg.AddField(f)
+		f, _ = NewField("ok", true, "")
+		msg.AddField(f)
+		f, _ = NewField("raw", []byte("data"), "")
+		msg.AddField(f)
+
+		s, ok := msg.GetString("foo")
+		c.Expect(ok, gs.IsTrue)
+		c.Expect(s, gs.Equals, "bar")
+		i, ok := msg.GetInt("number")
+		c.Expect(ok, gs.IsTrue)
+		c.Expect(i, gs.Equals, int64(64))
+		d, ok := msg.GetDouble("ratio")
+		c.Expect(ok, gs.IsTrue)
+		c.Expect(d, gs.Equals, 0.5)
+		b, ok := msg.GetBool("ok")
+		c.Expect(ok, gs.IsTrue)
+		c.Expect(b, gs.IsTrue)
+		raw, ok := msg.GetBytes("raw")
+		c.Expect(ok, gs.IsTrue)
+		c.Expect(string(raw), gs.Equals, "data")
+
+		c.Specify("report missing fields and type mismatches", func() {
+			_, ok = msg.GetString("missing")
+			c.Expect(ok, gs.IsFalse)
+			_, ok = msg.GetString("number")
+			c.Expect(ok, gs.IsFalse)
+			_, ok = msg.GetInt("foo")
+			c.Expect(ok, gs.IsFalse)
+			var nilMsg *Message
+			_, ok = nilMsg.GetInt("number")
+			c.Expect(ok, gs.IsFalse)
+		})
+	})
+
+	c.Specify("Typed setters", func() {
+		msg := getTestMessage()
+
+		c.Specify("replace an existing field in place", func() {
+			f := msg.FindFirstField("foo")
+			msg.SetString("foo", "baz")
+			c.Expect(msg.FindFirstField("foo"), gs.Equals, f)
+			s, _ := msg.GetString("foo")
+			c.Expect(s, gs.Equals, "baz")
+			c.Expect(len(msg.Fields), gs.Equals, 2)
+		})
+
+		c.Specify("change the type of an existing field", func() {
+			msg.SetDouble("number", 1.5)
+			_, ok := msg.GetInt("number")
+			c.Expect(ok, gs.IsFalse)
+			d, _ := msg.GetDouble("number")
+			c.Expect(d, gs.Equals, 1.5)
+			c.Expect(len(msg.FindFirstField("number").ValueInteger), gs.Equals, 0)
+		})
+
+		c.Specify("add missing fields", func() {
+			msg.SetInt("count", 3)
+			msg.SetBool("flag", true)
+			msg.SetBytes("raw", []byte{1, 2})
+			c.Expect(len(msg.Fields), gs.Equals, 5)
+			i, _ := msg.GetInt("count")
+			c.Expect(i, gs.Equals, int64(3))
+			b, _ := msg.GetBool("flag")
+			c.Expect(b, gs.IsTrue)
+			raw, _ := msg.GetBytes("raw")
+			c.Expect(len(raw), gs.Equals, 2)
+		})
+
+		c.Specify("collapse array values to a single value", func() {
+			f := msg.FindFirstField("number")
+			f.AddValue(65)
+			msg.SetInt("number", 1)
+			c.Expect(len(f.ValueInteger), gs.Equals, 1)
+			c.Expect(f.ValueInteger[0], gs.Equals, int64(1))
+		})
+	})
+
+	c.Specify("Deleting fields", func() {
+		msg := &Message{}
+		for _, name := range []string{"k8s.pod", "status", "k8s.node", "status", "k8s"} {
+			NewStringField(msg, name, "x")
+		}
+
+		c.Specify("by name", func() {
+			c.Expect(msg.DeleteFieldsByName("status"), gs.Equals, 2)
+			c.Expect(fieldNames(msg), gs.ContainsExactly, []string{"k8s.pod",
+				"k8s.node", "k8s"})
+			c.Expect(msg.DeleteFieldsByName("status"), gs.Equals, 0)
+		})
+
+		c.Specify("by prefix", func() {
+			c.Expect(msg.DeleteFieldsByPrefix("k8s."), gs.Equals, 2)
+			c.Expect(fieldNames(msg), gs.ContainsExactly, []string{"status",
+				"status", "k8s"})
+		})
+	})
+
+	c.Specify("A field index", func() {
+		SetFieldIndexThreshold(4)
+		defer SetFieldIndexThreshold(32)
+		msg := &Message{}
+		for _, name := range []string{"a", "b", "a", "c", "d"} {
+			NewStringField(msg, name, name)
+		}
+		idx := new(FieldIndex)
+		c.Expect(idx.FindFirstField(msg, "a"), gs.Equals, msg.Fields[0])
+		c.Expect(len(idx.FindAllFields(msg, "a")), gs.Equals, 2)
+		c.Expect(idx.FindFirstField(msg, "missing"), gs.IsNil)
+		c.Expect(idx.FindAllFields(msg, "missing"), gs.IsNil)
+		c.Expect(idx.positions != nil, gs.IsTrue)
+
+		c.Specify("is rebuilt after mutations", func() {
+			msg.DeleteFieldsByName("a")
+			c.Expect(idx.FindFirstField(msg, "a"), gs.IsNil)
+			c.Expect(idx.FindFirstField(msg, "c"), gs.Equals, msg.Fields[1])
+			NewStringField(msg, "e", "e")
+			c.Expect(idx.FindFirstField(msg, "e"), gs.Equals, msg.Fields[3])
+			newB, _ := NewField("b", "new", "")
+			msg.ReplaceFields([]*Field{newB})
+			c.Expect(idx.FindFirstField(msg, "b"), gs.Equals, newB)
+		})
+
+		c.Specify("detects a replaced Fields slice", func() {
+			fields := make([]*Field, len(msg.Fields))
+			copy(fields, msg.Fields)
+			fields[0], _ = NewField("z", "z", "")
+			msg.Fields = fields
+			c.Expect(idx.FindFirstField(msg, "z"), gs.Equals, fields[0])
+			c.Expect(idx.FindFirstField(msg, "a"), gs.Equals, fields[2])
+		})
+
+		c.Specify("is dropped by Reset", func() {
+			idx.Reset()
+			c.Expect(idx.positions == nil, gs.IsTrue)
+			other := &Message{}
+			NewStringField(other, "a", "other")
+			c.Expect(idx.FindFirstField(other, "a"), gs.Equals, other.Fields[0])
+		})
+
+		c.Specify("is used by the matchers", func() {
+			ms, err := CreateMatcherSpecification("Fields[a] == 'a' && Fields[d] == 'd'")
+			c.Assume(err, gs.IsNil)
+			idx.Reset()
+			c.Expect(ms.MatchShared(msg, nil, idx), gs.IsTrue)
+			c.Expect(idx.positions != nil, gs.IsTrue)
+		})
+
+		c.Specify("is optional", func() {
+			var none *FieldIndex
+			c.Expect(none.FindFirstField(msg, "c"), gs.Equals, msg.Fields[3])
+			c.Expect(len(none.FindAllFields(msg, "a")), gs.Equals, 2)
+		})
+	})
+
+	c.Specify("Replacing fields", func() {
+		msg := &Message{}
+		for _, name := range []string{"a", "b", "a", "c"} {
+			NewStringField(msg, name, "old")
+		}
+		newA, _ := NewField("a", "new", "")
+		newD, _ := NewField("d", "new", "")
+		msg.ReplaceFields([]*Field{newD, newA})
+		c.Expect(len(msg.Fields), gs.Equals, 4)
+		c.Expect(msg.Fields[0], gs.Equals, newA)
+		c.Expect(msg.Fields[1].GetName(), gs.Equals, "b")
+		c.Expect(msg.Fields[2].GetName(), gs.Equals, "c")
+		c.Expect(msg.Fields[3], gs.Equals, newD)
+	})
+
+	c.Specify("Binary payloads", func() {
+		payload := []byte{0x00, 0xff, 'h', 'e', 'k', 'a', 0xc3, 0x28, 0x00}
+		msg := getTestMessage()
+		msg.SetPayloadBytes(payload)
+
+		c.Specify("survive the accessors", func() {
+			c.Expect(string(msg.GetPayloadBytes()), gs.Equals, string(payload))
+			c.Expect(msg.GetPayload(), gs.Equals, string(payload))
+		})
+
+		c.Specify("survive a protobuf round trip", func() {
+			encoded, err := proto.Marshal(msg)
+			c.Assume(err, gs.IsNil)
+			decoded := new(Message)
+			c.Expect(proto.Unmarshal(encoded, decoded), gs.IsNil)
+			c.Expect(string(decoded.GetPayloadBytes()), gs.Equals, string(payload))
+		})
+
+		c.Specify("can be matched", func() {
+			ms, err := CreateMatcherSpecification("Payload =~ /heka/")
+			c.Assume(err, gs.IsNil)
+			c.Expect(ms.Match(msg), gs.IsTrue)
+		})
+	})
+}
+
+func benchmarkMessage(n int) *Message {
+	msg := &Message{}
+	for i := 0; i < n; i++ {
+		NewStringField(msg, fmt.Sprintf("field%d", i), "value")
+	}
+	NewInt64Field(msg, "count", 1, "")
+	return msg
+}
+
+func BenchmarkGetFieldValueInt(b *testing.B) {
+	msg := benchmarkMessage(10)
+	for i := 0; i < b.N; i++ {
+		if v, ok := msg.GetFieldValue("count"); ok {
+			_ = v.(int64)
+		}
+	}
+}
+
+func BenchmarkGetInt(b *testing.B) {
+	msg := benchmarkMessage(10)
+	for i := 0; i < b.N; i++ {
+		msg.GetInt("count")
+	}
+}
+
+func BenchmarkSetInt(b *testing.B) {
+	msg := benchmarkMessage(10)
+	for i := 0; i < b.N; i++ {
+		msg.SetInt("count", int64(i))
+	}
+}
+
+func BenchmarkDeleteFieldsByPrefix(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		msg := benchmarkMessage(50)
+		b.StartTimer()
+		msg.DeleteFieldsByPrefix("field1")
+	}
+}
+
+// The matchers of a message each look up a few of its fields, through an
+// index built for the message by the first of them.
+func benchmarkFieldLookups(b *testing.B, idx *FieldIndex) {
+	msg := benchmarkMessage(50)
+	names := []string{"count", "field49", "field40", "field30", "missing"}
+	for i := 0; i < b.N; i++ {
+		if idx != nil {
+			idx.Reset()
+		}
+		for j := 0; j < 4; j++ {
+			for _, name := range names {
+				idx.FindFirstField(msg, name)
+			}
+		}
+	}
+}
+
+func BenchmarkFieldLookups50(b *testing.B) {
+	benchmarkFieldLookups(b, new(FieldIndex))
+}
+
+func BenchmarkFieldLookups50NoIndex(b *testing.B) {
+	benchmarkFieldLookups(b, nil)
+}
+
+func BenchmarkFindFirstField50(b *testing.B) {
+	msg := benchmarkMessage(50)
+	idx := new(FieldIndex)
+	for i := 0; i < b.N; i++ {
+		idx.FindFirstField(msg, "count")
+	}
+}
+
+func BenchmarkFindFirstField50NoIndex(b *testing.B) {
+	msg := benchmarkMessage(50)
+	for i := 0; i < b.N; i++ {
+		msg.FindFirstField("count")
+	}
+}
@@ -0,0 +1,102 @@
+// +build gofuzz
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package message
+
+import (
+	"github.com/gogo/protobuf/proto"
+)
+
+// Entry points for go-fuzz (https://github.com/dvyukov/go-fuzz), e.g.
+//
+//   go-fuzz-build -func FuzzMatcher github.com/mozilla-services/heka/message
+//   go-fuzz -bin message-fuzz.zip -workdir fuzz/matcher
+
+// Matchers exercising each kind of test against decoded messages.
+var fuzzSpecs = []string{
+	"Type == 'test' && Severity < 7 && Pid > 0",
+	"Uuid == '0123456789abcdef' || Timestamp > now() - 1h",
+	"Payload =~ /^(GET|POST) / || Logger !~ /^heka/",
+	"Fields[foo] == 'bar' || Fields[foo][1] != NIL",
+	"Fields[n][0][1] > 3 || Fields[n] == NIL",
+	"Fields[b] == TRUE || Fields[bytes] =~ /x+/",
+	"Hostname == 'example.com' && Fields[f] >= 3.5 && Fields[host] < 'z'",
+}
+
+var fuzzMatchers []*MatcherSpecification
+
+func init() {
+	for _, spec := range fuzzSpecs {
+		ms, err := CreateMatcherSpecification(spec)
+		if err != nil {
+			panic(err)
+		}
+		fuzzMatchers = append(fuzzMatchers, ms)
+	}
+}
+
+// Returns a message w/ fields of all types for the fuzzed matchers to test.
+func fuzzMessage() *Message {
+	msg := &Message{}
+	msg.SetUuid([]byte("0123456789abcdef"))
+	msg.SetTimestamp(1464739200000000000)
+	msg.SetType("test")
+	msg.SetLogger("fuzz")
+	msg.SetSeverity(6)
+	msg.SetPayload("GET /index.html")
+	msg.SetPid(42)
+	msg.SetHostname("example.com")
+	msg.SetString("foo", "bar")
+	msg.SetInt("n", 7)
+	msg.SetDouble("f", 3.5)
+	msg.SetBool("b", true)
+	msg.SetBytes("bytes", []byte("xxx"))
+	msg.SetString("host", "example.com")
+	return msg
+}
+
+// Parses the data as a message matcher, which is then run against a message.
+func FuzzMatcher(data []byte) int {
+	ms, err := CreateMatcherSpecification(string(data))
+	if err != nil {
+		return 0
+	}
+	ms.Match(fuzzMessage())
+	return 1
+}
+
+// Decodes the data as a protobuf encoded message, which then goes through
+// the matchers and field accessors the router and plugins use.
+func FuzzMessage(data []byte) int {
+	msg := &Message{}
+	if err := UnmarshalMessage(data, msg); err != nil {
+		return 0
+	}
+	for _, ms := range fuzzMatchers {
+		ms.Match(msg)
+	}
+	for _, f := range msg.Fields {
+		msg.GetFieldValue(f.GetName())
+		f.GetValue()
+		CopyField(f)
+	}
+	msg.GetPayloadBytes()
+	CopyMessage(msg)
+	if _, err := proto.Marshal(msg); err != nil {
+		panic(err)
+	}
+	return 1
+}
@@ -0,0 +1,244 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package message
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sync"
+	"sync/atomic"
+)
+
+// Bounds the number of entries kept in the spec and regexp caches, so
+// matchers created on the fly, e.g. by sandbox managers, can't grow them
+// forever. Once full, new entries are compiled w/o being cached.
+const matcherCacheSize = 4096
+
+var (
+	// Compiled specs by spec string. Specs are immutable once created, so
+	// identical matchers can share one.
+	specCache     = make(map[string]*MatcherSpecification)
+	specCacheLock sync.Mutex
+	// Compiled regexps by expression, only accessed under parseLock.
+	regexpCache = make(map[string]*regexp.Regexp)
+	// Ids of the (sub-)expressions seen so far, by their canonical form.
+	predicateIDs    = make(map[string]int)
+	predicateIDLock sync.Mutex
+)
+
+// Returns the cached spec for the spec string, if any.
+func cachedSpec(spec string) *MatcherSpecification {
+	specCacheLock.Lock()
+	defer specCacheLock.Unlock()
+	return specCache[spec]
+}
+
+// Caches the spec, returning the one already cached for its spec string if
+// another caller got there first.
+func cacheSpec(ms *MatcherSpecification) *MatcherSpecification {
+	specCacheLock.Lock()
+	defer specCacheLock.Unlock()
+	if cached, ok := specCache[ms.spec]; ok {
+		return cached
+	}
+	if len(specCache) < matcherCacheSize {
+		specCache[ms.spec] = ms
+	}
+	return ms
+}
+
+// Compiles the regexp, sharing the compiled regexp w/ every matcher using the
+// same expression. Must be called w/ parseLock held.
+func compileRegexp(expr string) (*regexp.Regexp, error) {
+	if re, ok := regexpCache[expr]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	if len(regexpCache) < matcherCacheSize {
+		regexpCache[expr] = re
+	}
+	return re, nil
+}
+
+// Sets the id of each node of the tree, identical (sub-)expressions getting
+// the same id across all matcher specs. TRUE and FALSE leaves, which cost
+// nothing to evaluate, are left w/ a 0 id.
+func assignPredicateIDs(t *tree) {
+	predicateIDLock.Lock()
+	defer predicateIDLock.Unlock()
+	predicateKey(t)
+}
+
+// Returns the canonical form of the node's expression, setting its id and
+// those of its children along the way.
+func predicateKey(t *tree) string {
+	if t == nil {
+		return ""
+	}
+	var key string
+	if t.left != nil {
+		key = fmt.Sprintf("(%s %d %s)", predicateKey(t.left), t.stmt.op.tokenId,
+			predicateKey(t.right))
+	} else {
+		key = statementKey(t.stmt)
+		if t.stmt.op.tokenId == TRUE || t.stmt.op.tokenId == FALSE {
+			return key
+		}
+	}
+	id, ok := predicateIDs[key]
+	if !ok {
+		id = len(predicateIDs) + 1
+		predicateIDs[key] = id
+	}
+	t.id = id
+	return key
+}
+
+// Returns the canonical form of a test, covering everything evaluating it
+// depends on.
+func statementKey(stmt *Statement) string {
+	var b bytes.Buffer
+	f, op, v := &stmt.field, &stmt.op, &stmt.value
+	fmt.Fprintf(&b, "[%d %q %d %d %d %d %q %v %d %d", f.tokenId, f.token,
+		f.fieldIndex, f.arrayIndex, op.tokenId, v.tokenId, v.token, v.double,
+		v.fieldIndex, stmt.fn)
+	if stmt.lhs != nil {
+		fmt.Fprintf(&b, " %s %s", stmt.lhs, stmt.rhs)
+	}
+	if v.regexp != nil {
+		fmt.Fprintf(&b, " %q", v.regexp.String())
+	}
+	if v.regexpSet != nil {
+		for i := 0; i < v.regexpSet.Len(); i++ {
+			fmt.Fprintf(&b, " %q", v.regexpSet.Regexp(i).String())
+		}
+	}
+	b.WriteByte(']')
+	return b.String()
+}
+
+// PredicateSet holds the (sub-)expressions that more than one of a set of
+// matcher specs contain, e.g. a `Type == 'nginx.access'` test repeated across
+// hundreds of matchers. Matching a message w/ MatchShared evaluates each of
+// them at most once per message, whichever matcher gets to it first.
+type PredicateSet struct {
+	// Result slot + 1 by predicate id, 0 for the unshared ones.
+	slots []int32
+	count int
+}
+
+// NewPredicateSet finds the (sub-)expressions shared by the specs. Specs
+// created later can still be matched w/ the set, their expressions that are
+// new to it just aren't shared.
+func NewPredicateSet(specs []*MatcherSpecification) *PredicateSet {
+	counts := make(map[int]int)
+	var count func(t *tree)
+	count = func(t *tree) {
+		if t == nil {
+			return
+		}
+		if t.id != 0 {
+			counts[t.id]++
+		}
+		count(t.left)
+		count(t.right)
+	}
+	for _, spec := range specs {
+		if spec == nil {
+			continue
+		}
+		count(spec.vm)
+	}
+	maxID := 0
+	for id := range counts {
+		if id > maxID {
+			maxID = id
+		}
+	}
+	s := &PredicateSet{slots: make([]int32, maxID+1)}
+	for id, n := range counts {
+		if n > 1 {
+			s.count++
+			s.slots[id] = int32(s.count)
+		}
+	}
+	return s
+}
+
+// Len returns the number of shared expressions.
+func (s *PredicateSet) Len() int {
+	return s.count
+}
+
+// Returns the result slot of the node + 1, or 0 if it isn't shared.
+func (s *PredicateSet) slot(t *tree) int32 {
+	if t.id >= len(s.slots) {
+		return 0
+	}
+	return s.slots[t.id]
+}
+
+const (
+	predicateUnknown uint32 = iota
+	predicateFalse
+	predicateTrue
+)
+
+// PredicateResults holds the results of a PredicateSet's expressions for a
+// single message. It's safe for concurrent use by the matchers of the
+// message, but must be Reset before being used for another message.
+type PredicateResults struct {
+	set     *PredicateSet
+	results []uint32
+}
+
+// Reset forgets the results, readying them for a new message matched w/ the
+// set.
+func (r *PredicateResults) Reset(set *PredicateSet) {
+	r.set = set
+	if cap(r.results) < set.count {
+		r.results = make([]uint32, set.count)
+		return
+	}
+	r.results = r.results[:set.count]
+	for i := range r.results {
+		r.results[i] = predicateUnknown
+	}
+}
+
+// Returns the stored result of the node, if it's shared and was already
+// evaluated.
+func (r *PredicateResults) get(t *tree) (slot int32, result uint32) {
+	if r == nil || r.set == nil {
+		return 0, predicateUnknown
+	}
+	if slot = r.set.slot(t); slot == 0 {
+		return 0, predicateUnknown
+	}
+	return slot, atomic.LoadUint32(&r.results[slot-1])
+}
+
+// Stores the result of a shared node.
+func (r *PredicateResults) store(slot int32, b bool) {
+	result := predicateFalse
+	if b {
+		result = predicateTrue
+	}
+	atomic.StoreUint32(&r.results[slot-1], result)
+}
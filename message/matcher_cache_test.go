@@ -0,0 +1,130 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package message
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/rafrombrc/gospec/src/gospec"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func MatcherCacheSpec(c gospec.Context) {
+	msg := getTestMessage()
+
+	c.Specify("Matcher specs", func() {
+		c.Specify("are shared by identical spec strings", func() {
+			a, err := CreateMatcherSpecification("Type == 'cache' && Severity < 7")
+			c.Assume(err, gs.IsNil)
+			b, err := CreateMatcherSpecification("Type == 'cache' && Severity < 7")
+			c.Assume(err, gs.IsNil)
+			c.Expect(a == b, gs.IsTrue)
+		})
+
+		c.Specify("share compiled regexps", func() {
+			a, err := CreateMatcherSpecification("Payload =~ /cache\\d+/")
+			c.Assume(err, gs.IsNil)
+			b, err := CreateMatcherSpecification("Type == 'x' || Payload =~ /cache\\d+/")
+			c.Assume(err, gs.IsNil)
+			c.Expect(a.vm.stmt.value.regexp == b.vm.right.stmt.value.regexp, gs.IsTrue)
+		})
+
+		c.Specify("give identical sub-expressions the same id", func() {
+			a, err := CreateMatcherSpecification("Type == 'TEST' && Severity == 6")
+			c.Assume(err, gs.IsNil)
+			b, err := CreateMatcherSpecification("Type == 'TEST' && Logger == 'x'")
+			c.Assume(err, gs.IsNil)
+			c.Expect(a.vm.left.id, gs.Equals, b.vm.left.id)
+			c.Expect(a.vm.right.id, gs.Not(gs.Equals), b.vm.right.id)
+		})
+
+		c.Specify("tell functions and expressions apart", func() {
+			a, err := CreateMatcherSpecification("startswith(lower(Type), 'te') && Severity * 2 > 6")
+			c.Assume(err, gs.IsNil)
+			b, err := CreateMatcherSpecification("Type =~ /^te/ && Severity * 3 > 6")
+			c.Assume(err, gs.IsNil)
+			c.Expect(a.vm.left.id, gs.Not(gs.Equals), b.vm.left.id)
+			c.Expect(a.vm.right.id, gs.Not(gs.Equals), b.vm.right.id)
+		})
+	})
+
+	c.Specify("A PredicateSet", func() {
+		specs := make([]*MatcherSpecification, 0, 3)
+		for _, spec := range []string{
+			"Type == 'TEST' && Severity == 6",
+			"Type == 'TEST' && Logger == 'GoSpec'",
+			"Type == 'TEST' && Fields[foo] == 'bar'",
+		} {
+			ms, err := CreateMatcherSpecification(spec)
+			c.Assume(err, gs.IsNil)
+			specs = append(specs, ms)
+		}
+		set := NewPredicateSet(specs)
+
+		c.Specify("holds the shared expressions", func() {
+			c.Expect(set.Len(), gs.Equals, 1)
+			c.Expect(set.slot(specs[0].vm.left) > 0, gs.IsTrue)
+			c.Expect(set.slot(specs[0].vm.right), gs.Equals, int32(0))
+		})
+
+		c.Specify("evaluates each shared expression once per message", func() {
+			var results PredicateResults
+			results.Reset(set)
+			for _, ms := range specs {
+				c.Expect(ms.MatchShared(msg, &results, nil), gs.Equals, ms.Match(msg))
+			}
+			slot := set.slot(specs[0].vm.left)
+			c.Expect(results.results[slot-1], gs.Equals, predicateTrue)
+
+			c.Specify("reusing the stored result", func() {
+				results.store(slot, false)
+				c.Expect(specs[1].MatchShared(msg, &results, nil), gs.IsFalse)
+			})
+
+			c.Specify("until it's reset", func() {
+				results.Reset(set)
+				c.Expect(results.results[slot-1], gs.Equals, predicateUnknown)
+			})
+		})
+
+		c.Specify("leaves specs created later unshared", func() {
+			ms, err := CreateMatcherSpecification("Hostname == 'later' && Pid == 1")
+			c.Assume(err, gs.IsNil)
+			var results PredicateResults
+			results.Reset(set)
+			c.Expect(ms.MatchShared(msg, &results, nil), gs.Equals, ms.Match(msg))
+		})
+	})
+}
+
+func BenchmarkMatcherShared(b *testing.B) {
+	b.StopTimer()
+	specs := make([]*MatcherSpecification, 100)
+	for i := range specs {
+		specs[i], _ = CreateMatcherSpecification(fmt.Sprintf(
+			"Type == 'TEST' && Payload =~ /shared\\d+/ && Fields[foo] == 'bar%d'", i))
+	}
+	set := NewPredicateSet(specs)
+	var results PredicateResults
+	msg := getTestMessage()
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		results.Reset(set)
+		for _, ms := range specs {
+			ms.MatchShared(msg, &results, nil)
+		}
+	}
+}
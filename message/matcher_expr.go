@@ -0,0 +1,175 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package message
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// An arithmetic expression on one side of a numeric test, e.g.
+// `Fields[bytes] / 1024` or `now() - 1h`.
+type numericExpr struct {
+	// '+', '-', '*', '/' or '%', 0 for an operand.
+	op          rune
+	left, right *numericExpr
+	// The operand's token: a NUMERIC_VALUE, FN_NOW or a numeric variable.
+	operand Statement
+}
+
+// Returns the expression applying the operator to the operands, folded into a
+// single NUMERIC_VALUE if both are constant.
+func newArithmetic(op rune, left, right *numericExpr) *numericExpr {
+	e := &numericExpr{op: op, left: left, right: right}
+	if left.isConstant() && right.isConstant() {
+		v, _ := e.eval(nil, nil)
+		return newConstant(v)
+	}
+	return e
+}
+
+func newConstant(v float64) *numericExpr {
+	e := new(numericExpr)
+	e.operand.field.tokenId = NUMERIC_VALUE
+	e.operand.field.token = strconv.FormatFloat(v, 'g', -1, 64)
+	e.operand.field.double = v
+	return e
+}
+
+func newOperand(v yySymType) *numericExpr {
+	e := new(numericExpr)
+	e.operand.field = v
+	return e
+}
+
+// Returns the test comparing the variable to the expression. Comparisons to a
+// constant are turned into a plain variable test.
+func newNumericTest(variable, op yySymType, rhs *numericExpr) *Statement {
+	if rhs.isConstant() {
+		return &Statement{field: variable, op: op, value: rhs.operand.field}
+	}
+	return &Statement{op: op, lhs: newOperand(variable), rhs: rhs}
+}
+
+func (e *numericExpr) isConstant() bool {
+	return e.op == 0 && e.operand.field.tokenId == NUMERIC_VALUE
+}
+
+// Evaluates the expression for the message, returning false if a variable it
+// uses doesn't exist or isn't numeric.
+func (e *numericExpr) eval(msg *Message, index *FieldIndex) (v float64, ok bool) {
+	if e.op == 0 {
+		switch e.operand.field.tokenId {
+		case NUMERIC_VALUE:
+			return e.operand.field.double, true
+		case FN_NOW:
+			return float64(time.Now().UnixNano()), true
+		case VAR_FIELDS:
+			return getFieldNumber(msg, index, &e.operand.field)
+		}
+		return getNumericValue(msg, &e.operand), true
+	}
+	l, ok := e.left.eval(msg, index)
+	if !ok {
+		return 0, false
+	}
+	r, ok := e.right.eval(msg, index)
+	if !ok {
+		return 0, false
+	}
+	switch e.op {
+	case '+':
+		return l + r, true
+	case '-':
+		return l - r, true
+	case '*':
+		return l * r, true
+	case '/':
+		return l / r, true
+	case '%':
+		return math.Mod(l, r), true
+	}
+	return 0, false
+}
+
+// Returns the canonical form of the expression.
+func (e *numericExpr) String() string {
+	if e.op != 0 {
+		return fmt.Sprintf("(%s %c %s)", e.left, e.op, e.right)
+	}
+	f := &e.operand.field
+	switch f.tokenId {
+	case NUMERIC_VALUE:
+		return f.token
+	case FN_NOW:
+		return "now()"
+	}
+	return fmt.Sprintf("%d:%s:%d:%d", f.tokenId, f.token, f.fieldIndex, f.arrayIndex)
+}
+
+// Returns the value of the integer or double field the variable refers to.
+func getFieldNumber(msg *Message, index *FieldIndex, v *yySymType) (float64, bool) {
+	var field *Field
+	if v.fieldIndex != 0 {
+		fields := index.FindAllFields(msg, v.token)
+		if v.fieldIndex >= len(fields) {
+			return 0, false
+		}
+		field = fields[v.fieldIndex]
+	} else if field = index.FindFirstField(msg, v.token); field == nil {
+		return 0, false
+	}
+	ai := v.arrayIndex
+	switch field.GetValueType() {
+	case Field_INTEGER:
+		if ai < len(field.ValueInteger) {
+			return float64(field.ValueInteger[ai]), true
+		}
+	case Field_DOUBLE:
+		if ai < len(field.ValueDouble) {
+			return field.ValueDouble[ai], true
+		}
+	}
+	return 0, false
+}
+
+// Compares the values of the statement's expressions.
+func exprTest(msg *Message, index *FieldIndex, stmt *Statement) bool {
+	l, ok := stmt.lhs.eval(msg, index)
+	if !ok {
+		return false
+	}
+	r, ok := stmt.rhs.eval(msg, index)
+	if !ok {
+		return false
+	}
+	switch stmt.op.tokenId {
+	case OP_EQ:
+		return l == r
+	case OP_NE:
+		return l != r
+	case OP_LT:
+		return l < r
+	case OP_LTE:
+		return l <= r
+	case OP_GT:
+		return l > r
+	case OP_GTE:
+		return l >= r
+	}
+	return false
+}
@@ -24,7 +24,10 @@ package message
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"reflect"
 
 	"github.com/gogo/protobuf/proto"
@@ -44,6 +47,109 @@ var (
 	MAX_RECORD_SIZE  = uint32(HEADER_FRAMING_SIZE + MAX_HEADER_SIZE + MAX_MESSAGE_SIZE)
 )
 
+// Returned for a length that runs past the end of the data it's in.
+var ErrInvalidLengthMessage = errors.New("proto: invalid length found during unmarshaling")
+
+// Field numbers of the embedded messages of a message type, mapped to the
+// embedded message's type.
+type wireSchema map[uint64]wireSchema
+
+var (
+	fieldWire   = wireSchema{}
+	headerWire  = wireSchema{}
+	messageWire = wireSchema{10: fieldWire}
+)
+
+// Checks that the data is well formed protobuf encoding of the schema's
+// message type, before it's handed to the Unmarshal methods generated in
+// message.pb.go. The protoc-gen-gogo version they were generated w/ doesn't
+// check for negative or overflowing lengths, and the `proto.Skip` they skip
+// unknown fields w/ panics on some malformed input, so the Unmarshal methods
+// must only be given data that passed this check. Groups are rejected, Heka
+// never uses them, and so are field keys that aren't encoded in as few bytes
+// as possible, which the Unmarshal methods would skip incorrectly.
+func checkWire(data []byte, schema wireSchema) error {
+	for index := 0; index < len(data); {
+		key, n := binary.Uvarint(data[index:])
+		if n <= 0 {
+			return io.ErrUnexpectedEOF
+		}
+		if n != uvarintSize(key) {
+			return errors.New("proto: non-minimal field key")
+		}
+		index += n
+		if key>>3 == 0 {
+			return errors.New("proto: illegal field number 0")
+		}
+		switch wireType := key & 0x7; wireType {
+		case 0:
+			if _, n = binary.Uvarint(data[index:]); n <= 0 {
+				return io.ErrUnexpectedEOF
+			}
+			index += n
+		case 1:
+			if len(data)-index < 8 {
+				return io.ErrUnexpectedEOF
+			}
+			index += 8
+		case 2:
+			length, n := binary.Uvarint(data[index:])
+			if n <= 0 {
+				return io.ErrUnexpectedEOF
+			}
+			index += n
+			if length > uint64(len(data)-index) {
+				return ErrInvalidLengthMessage
+			}
+			end := index + int(length)
+			if embedded, ok := schema[key>>3]; ok {
+				if err := checkWire(data[index:end], embedded); err != nil {
+					return err
+				}
+			}
+			index = end
+		case 5:
+			if len(data)-index < 4 {
+				return io.ErrUnexpectedEOF
+			}
+			index += 4
+		default:
+			return fmt.Errorf("proto: unsupported wireType %d", wireType)
+		}
+	}
+	return nil
+}
+
+// Returns the number of bytes the minimal varint encoding of x takes.
+func uvarintSize(x uint64) (n int) {
+	for n = 1; x >= 0x80; n++ {
+		x >>= 7
+	}
+	return n
+}
+
+// Decodes protobuf encoded data into the message, checking that it's well
+// formed first. Data that didn't come from a proto.Marshal in this process,
+// and wasn't checked by this before, must be decoded w/ this rather than w/
+// proto.Unmarshal. The check is a second pass over the data, so data that's
+// known to be well formed is better decoded w/ proto.Unmarshal.
+func UnmarshalMessage(data []byte, msg *Message) error {
+	if err := checkWire(data, messageWire); err != nil {
+		msg.Reset()
+		return err
+	}
+	return proto.Unmarshal(data, msg)
+}
+
+// Decodes a protobuf encoded field, checking that it's well formed first.
+func UnmarshalField(data []byte, field *Field) error {
+	if err := checkWire(data, fieldWire); err != nil {
+		field.Reset()
+		return err
+	}
+	return proto.Unmarshal(data, field)
+}
+
 func SetMaxMessageSize(size uint32) {
 	MAX_MESSAGE_SIZE = size
 	MAX_RECORD_SIZE = uint32(HEADER_FRAMING_SIZE + MAX_HEADER_SIZE + MAX_MESSAGE_SIZE)
@@ -61,8 +167,13 @@ func DecodeHeader(buf []byte, header *Header) (bool, error) {
 	if buf[len(buf)-1] != UNIT_SEPARATOR {
 		return false, nil
 	}
-	err := proto.Unmarshal(buf[0:len(buf)-1], header)
+	err := checkWire(buf[0:len(buf)-1], headerWire)
+	if err == nil {
+		err = proto.Unmarshal(buf[0:len(buf)-1], header)
+	}
 	if err != nil {
+		// Don't leave a partially decoded header behind.
+		header.Reset()
 		return false, fmt.Errorf("error unmarshaling header: %s", err)
 	}
 	if header.GetMessageLength() > MAX_MESSAGE_SIZE {
@@ -161,6 +272,23 @@ func (m *Message) SetPayload(v string) {
 	}
 }
 
+// Sets the payload from a byte slice. The payload is a protobuf string, but
+// it's carried through the pipeline as is, so it can hold binary data.
+func (m *Message) SetPayloadBytes(v []byte) {
+	if m != nil {
+		payload := string(v)
+		m.Payload = &payload
+	}
+}
+
+// Returns a copy of the payload as a byte slice, for binary payloads.
+func (m *Message) GetPayloadBytes() []byte {
+	if m != nil && m.Payload != nil {
+		return []byte(*m.Payload)
+	}
+	return nil
+}
+
 func (m *Message) SetEnvVersion(v string) {
 	if m != nil {
 		m.EnvVersion = &v
@@ -505,7 +633,13 @@ func (m *Message) FindAllFields(name string) (all []*Field) {
 	if m == nil {
 		return
 	}
-	for _, v := range m.Fields {
+	return m.findAllFields(name, 0)
+}
+
+// Returns the fields w/ the specified name, starting the search at position
+// start.
+func (m *Message) findAllFields(name string, start int) (all []*Field) {
+	for _, v := range m.Fields[start:] {
 		if v != nil && v.GetName() == name {
 			l := len(all)
 			c := cap(all)
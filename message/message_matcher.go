@@ -14,30 +14,53 @@
 
 package message
 
-import "strings"
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
 
 // MatcherSpecification used by the message router to distribute messages
 type MatcherSpecification struct {
 	vm   *tree
 	spec string
+	// Whether the spec only tests the Type and Logger headers.
+	typeLoggerOnly bool
 }
 
 // CreateMatcherSpecification compiles the spec string into a simple
-// virtual machine for execution
+// virtual machine for execution. Specs are cached, so identical spec strings
+// share a single compiled spec.
 func CreateMatcherSpecification(spec string) (*MatcherSpecification, error) {
+	if ms := cachedSpec(spec); ms != nil {
+		return ms, nil
+	}
 	ms := new(MatcherSpecification)
 	ms.spec = spec
 	err := parseMatcherSpecification(ms)
 	if err != nil {
 		return nil, err
 	}
-	return ms, nil
+	ms.vm = mergeRegexpTests(ms.vm)
+	assignPredicateIDs(ms.vm)
+	ms.typeLoggerOnly = testsTypeLoggerOnly(ms.vm)
+	return cacheSpec(ms), nil
 }
 
 // Match compares the message against the matcher spec and return the match
 // result
 func (m *MatcherSpecification) Match(message *Message) bool {
-	return evalMatcherSpecification(m.vm, message)
+	return evalMatcherSpecification(m.vm, message, nil, nil)
+}
+
+// MatchShared is Match, reusing the results of the expressions shared w/
+// other matchers that were already evaluated for the message, and storing
+// those it evaluates. Fields are looked up through the message's field
+// index, if it's not nil.
+func (m *MatcherSpecification) MatchShared(message *Message,
+	results *PredicateResults, index *FieldIndex) bool {
+
+	return evalMatcherSpecification(m.vm, message, results, index)
 }
 
 // String outputs the spec as text
@@ -45,15 +68,54 @@ func (m *MatcherSpecification) String() string {
 	return m.spec
 }
 
-func evalMatcherSpecification(t *tree, msg *Message) (b bool) {
+// TypeLoggerOnly returns whether the spec only tests the message's Type and
+// Logger, i.e. whether its result for a message is determined by them.
+func (m *MatcherSpecification) TypeLoggerOnly() bool {
+	return m.typeLoggerOnly
+}
+
+func testsTypeLoggerOnly(t *tree) bool {
+	if t == nil {
+		return true
+	}
+	if t.left != nil {
+		return testsTypeLoggerOnly(t.left) && testsTypeLoggerOnly(t.right)
+	}
+	switch t.stmt.op.tokenId {
+	case TRUE, FALSE:
+		return true
+	}
+	switch t.stmt.field.tokenId {
+	case VAR_TYPE, VAR_LOGGER:
+		return true
+	}
+	return false
+}
+
+func evalMatcherSpecification(t *tree, msg *Message, results *PredicateResults,
+	index *FieldIndex) (b bool) {
+
 	if t == nil {
 		return false
 	}
+	slot, result := results.get(t)
+	if result != predicateUnknown {
+		return result == predicateTrue
+	}
+	b = evalNode(t, msg, results, index)
+	if slot != 0 {
+		results.store(slot, b)
+	}
+	return
+}
+
+func evalNode(t *tree, msg *Message, results *PredicateResults,
+	index *FieldIndex) (b bool) {
 
 	if t.left != nil {
-		b = evalMatcherSpecification(t.left, msg)
+		b = evalMatcherSpecification(t.left, msg, results, index)
 	} else {
-		return testExpr(msg, t.stmt)
+		return testExpr(msg, index, t.stmt)
 	}
 	if b == true && t.stmt.op.tokenId == OP_OR {
 		return // short circuit
@@ -63,7 +125,7 @@ func evalMatcherSpecification(t *tree, msg *Message) (b bool) {
 	}
 
 	if t.right != nil {
-		b = evalMatcherSpecification(t.right, msg)
+		b = evalMatcherSpecification(t.right, msg, results, index)
 	}
 	return
 }
@@ -102,6 +164,9 @@ func stringTest(s string, stmt *Statement) bool {
 	if stmt.value.tokenId == NUMERIC_VALUE {
 		return false
 	}
+	if stmt.fn == FN_LOWER {
+		s = strings.ToLower(s)
+	}
 	switch stmt.op.tokenId {
 	case OP_EQ:
 		if stmt.value.tokenId == NIL_VALUE {
@@ -122,7 +187,9 @@ func stringTest(s string, stmt *Statement) bool {
 	case OP_GTE:
 		return (s >= stmt.value.token)
 	case OP_RE:
-		if stmt.value.regexp != nil {
+		if stmt.value.regexpSet != nil {
+			return stmt.value.regexpSet.MatchString(s) != -1
+		} else if stmt.value.regexp != nil {
 			return stmt.value.regexp.MatchString(s)
 		} else if stmt.value.fieldIndex == STARTS_WITH {
 			return strings.HasPrefix(s, stmt.value.token)
@@ -172,13 +239,16 @@ func testNonExistence(stmt *Statement) bool {
 	return (stmt.value.tokenId == NIL_VALUE && stmt.op.tokenId == OP_EQ)
 }
 
-func testExpr(msg *Message, stmt *Statement) bool {
+func testExpr(msg *Message, index *FieldIndex, stmt *Statement) bool {
 	switch stmt.op.tokenId {
 	case TRUE:
 		return true
 	case FALSE:
 		return false
 	default:
+		if stmt.lhs != nil {
+			return exprTest(msg, index, stmt)
+		}
 		switch stmt.field.tokenId {
 		case VAR_UUID, VAR_TYPE, VAR_LOGGER, VAR_PAYLOAD,
 			VAR_ENVVERSION, VAR_HOSTNAME:
@@ -191,13 +261,13 @@ func testExpr(msg *Message, stmt *Statement) bool {
 			var field *Field
 
 			if fi != 0 {
-				fields := msg.FindAllFields(stmt.field.token)
+				fields := index.FindAllFields(msg, stmt.field.token)
 				if fi >= len(fields) {
 					return testNonExistence(stmt)
 				}
 				field = fields[fi]
 			} else {
-				if field = msg.FindFirstField(stmt.field.token); field == nil {
+				if field = index.FindFirstField(msg, stmt.field.token); field == nil {
 					return testNonExistence(stmt)
 				}
 			}
@@ -243,3 +313,74 @@ func testExpr(msg *Message, stmt *Statement) bool {
 	}
 	return false
 }
+
+// Merges the `=~` regexp tests that are OR'ed together and test the same
+// variable into a single test against a RegexpSet, so a message is tested
+// against all of the regexps in one pass.
+func mergeRegexpTests(t *tree) *tree {
+	if t == nil || t.left == nil {
+		return t
+	}
+	if t.stmt.op.tokenId != OP_OR {
+		t.left = mergeRegexpTests(t.left)
+		t.right = mergeRegexpTests(t.right)
+		return t
+	}
+
+	var terms []*tree
+	collectOrTerms(t, &terms)
+	groups := make(map[string][]*tree)
+	var merged []*tree
+	for _, term := range terms {
+		key, ok := regexpTestKey(term)
+		if !ok {
+			merged = append(merged, term)
+			continue
+		}
+		if _, seen := groups[key]; !seen {
+			// Placeholder, keeping the group at its first test's position.
+			merged = append(merged, &tree{stmt: term.stmt})
+		}
+		groups[key] = append(groups[key], term)
+	}
+	for _, term := range merged {
+		key, ok := regexpTestKey(term)
+		if !ok || len(groups[key]) < 2 {
+			continue
+		}
+		regexps := make([]*regexp.Regexp, len(groups[key]))
+		for i, test := range groups[key] {
+			regexps[i] = test.stmt.value.regexp
+		}
+		stmt := *term.stmt
+		stmt.value.regexpSet = NewRegexpSet(regexps)
+		term.stmt = &stmt
+	}
+
+	root := merged[0]
+	for _, term := range merged[1:] {
+		root = &tree{left: root, stmt: t.stmt, right: term}
+	}
+	return root
+}
+
+// Appends the operands of a chain of ORs to terms, merging their own regexp
+// tests along the way.
+func collectOrTerms(t *tree, terms *[]*tree) {
+	if t.left != nil && t.stmt.op.tokenId == OP_OR {
+		collectOrTerms(t.left, terms)
+		collectOrTerms(t.right, terms)
+		return
+	}
+	*terms = append(*terms, mergeRegexpTests(t))
+}
+
+// Identifies the variable tested by a `=~` test w/ a full regexp.
+func regexpTestKey(t *tree) (key string, ok bool) {
+	if t.left != nil || t.stmt.op.tokenId != OP_RE || t.stmt.value.regexp == nil {
+		return "", false
+	}
+	field := t.stmt.field
+	return fmt.Sprintf("%d:%s:%d:%d:%d", field.tokenId, field.token, field.fieldIndex,
+		field.arrayIndex, t.stmt.fn), true
+}
@@ -7,6 +7,7 @@ import (
 	"regexp"
 	"strconv"
 	"sync"
+	"time"
 	"unicode/utf8"
 )
 
@@ -30,16 +31,33 @@ var variables = map[string]int{
 	"FALSE":      FALSE,
 	"NIL":        NIL_VALUE}
 
+var functions = map[string]int{
+	"now":        FN_NOW,
+	"lower":      FN_LOWER,
+	"startswith": FN_STARTSWITH,
+	"endswith":   FN_ENDSWITH}
+
+// Returned by the lexer for input that isn't a token, e.g. an unknown word.
+// Unlike 0, which ends the spec, it fails the parse w/ a syntax error.
+const invalidToken = utf8.MaxRune + 1
+
 var parseLock sync.Mutex
 
 type Statement struct {
 	field, op, value yySymType
+	// Function applied to the tested string, FN_LOWER or 0.
+	fn int
+	// The sides of a test comparing arithmetic expressions, in which case
+	// field and value are unused.
+	lhs, rhs *numericExpr
 }
 
 type tree struct {
 	left  *tree
 	stmt  *Statement
 	right *tree
+	// Identifies the node's (sub-)expression, see predicateID.
+	id int
 }
 
 type stack struct {
@@ -77,6 +95,8 @@ var nodes []*tree
    fieldIndex  int
    arrayIndex  int
    regexp      *regexp.Regexp
+   regexpSet   *RegexpSet
+   expr        *numericExpr
 }
 
 %token OP_EQ OP_NE OP_GT OP_GTE OP_LT OP_LTE OP_RE OP_NRE
@@ -86,10 +106,13 @@ var nodes []*tree
 %token VAR_FIELDS
 %token STRING_VALUE NUMERIC_VALUE REGEXP_VALUE NIL_VALUE
 %token TRUE FALSE
+%token FN_NOW FN_LOWER FN_STARTSWITH FN_ENDSWITH
 
 %start spec
 %left OP_OR
 %left OP_AND
+%left '+' '-'
+%left '*' '/' '%'
 
 %%
 
@@ -123,44 +146,125 @@ numeric_vars : VAR_TIMESTAMP
 string_test : string_vars relational STRING_VALUE
        {
        //fmt.Println("string_test", $1, $2, $3)
-       nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
+       nodes = append(nodes, &tree{stmt:&Statement{field:$1, op:$2, value:$3}})
        }
    |   string_vars regexp REGEXP_VALUE
        {
        //fmt.Println("string_test regexp", $1, $2, $3)
-       nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
+       nodes = append(nodes, &tree{stmt:&Statement{field:$1, op:$2, value:$3}})
        }
 ;
-numeric_test : numeric_vars relational NUMERIC_VALUE
+lower_vars : string_vars
+   | VAR_FIELDS
+;
+lower_test : FN_LOWER '(' lower_vars ')' relational STRING_VALUE
+       {
+       //fmt.Println("lower_test", $3, $5, $6)
+       nodes = append(nodes, &tree{stmt:&Statement{field:$3, op:$5, value:$6, fn:FN_LOWER}})
+       }
+   |   FN_LOWER '(' lower_vars ')' regexp REGEXP_VALUE
+       {
+       //fmt.Println("lower_test regexp", $3, $5, $6)
+       nodes = append(nodes, &tree{stmt:&Statement{field:$3, op:$5, value:$6, fn:FN_LOWER}})
+       }
+;
+affix_fn : FN_STARTSWITH
+   | FN_ENDSWITH
+;
+affix_test : affix_fn '(' lower_vars ',' STRING_VALUE ')'
+       {
+       //fmt.Println("affix_test", $1, $3, $5)
+       nodes = append(nodes, &tree{stmt:&Statement{field:$3, op:affixOp(), value:affixValue($1, $5)}})
+       }
+   |   affix_fn '(' FN_LOWER '(' lower_vars ')' ',' STRING_VALUE ')'
+       {
+       //fmt.Println("affix_test lower", $1, $5, $8)
+       nodes = append(nodes, &tree{stmt:&Statement{field:$5, op:affixOp(), value:affixValue($1, $8), fn:FN_LOWER}})
+       }
+;
+now : FN_NOW '(' ')'
    {
-   //fmt.Println("numeric_test", $1, $2, $3)
-   nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
+   $$.expr = newOperand($1)
    }
 ;
-field_test : VAR_FIELDS relational NUMERIC_VALUE
+num_operand : NUMERIC_VALUE
+      {
+      $$.expr = newOperand($1)
+      }
+   | numeric_vars
+      {
+      $$.expr = newOperand($1)
+      }
+   | VAR_FIELDS
+      {
+      $$.expr = newOperand($1)
+      }
+   | now
+;
+arith_expr : num_expr '+' num_expr
+      {
+      $$.expr = newArithmetic('+', $1.expr, $3.expr)
+      }
+   | num_expr '-' num_expr
+      {
+      $$.expr = newArithmetic('-', $1.expr, $3.expr)
+      }
+   | num_expr '*' num_expr
+      {
+      $$.expr = newArithmetic('*', $1.expr, $3.expr)
+      }
+   | num_expr '/' num_expr
+      {
+      $$.expr = newArithmetic('/', $1.expr, $3.expr)
+      }
+   | num_expr '%' num_expr
+      {
+      $$.expr = newArithmetic('%', $1.expr, $3.expr)
+      }
+;
+num_expr : num_operand
+   | arith_expr
+;
+numeric_test : numeric_vars relational num_expr
+      {
+      //fmt.Println("numeric_test", $1, $2, $3)
+      nodes = append(nodes, &tree{stmt:newNumericTest($1, $2, $3.expr)})
+      }
+   | arith_expr relational num_expr
+      {
+      //fmt.Println("numeric_test arithmetic", $1, $2, $3)
+      nodes = append(nodes, &tree{stmt:&Statement{op:$2, lhs:$1.expr, rhs:$3.expr}})
+      }
+   | now relational num_expr
+      {
+      //fmt.Println("numeric_test now", $1, $2, $3)
+      nodes = append(nodes, &tree{stmt:&Statement{op:$2, lhs:$1.expr, rhs:$3.expr}})
+      }
+;
+field_test : VAR_FIELDS relational num_expr
       {
       //fmt.Println("field_test numeric", $1, $2, $3)
-      nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
+      nodes = append(nodes, &tree{stmt:newNumericTest($1, $2, $3.expr)})
       }
    | VAR_FIELDS relational STRING_VALUE
       {
       //fmt.Println("field_test string", $1, $2, $3)
-      nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
+      nodes = append(nodes, &tree{stmt:&Statement{field:$1, op:$2, value:$3}})
       }
    | VAR_FIELDS OP_EQ boolean
       {
       //fmt.Println("field_test boolean", $1, $2, $3)
-      nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
+      nodes = append(nodes, &tree{stmt:&Statement{field:$1, op:$2, value:$3}})
       }
    | VAR_FIELDS regexp REGEXP_VALUE
       {
       //fmt.Println("field_test regexp", $1, $2, $3)
-      nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
+      nodes = append(nodes, &tree{stmt:&Statement{field:$1, op:$2, value:$3}})
       }
    | VAR_FIELDS eqneq NIL_VALUE
       {
       //fmt.Println("field_test existence", $1, $2, $3)
-      nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
+      nodes = append(nodes, &tree{stmt:&Statement{field:$1, op:$2, value:$3}})
       }
 ;
 boolean : TRUE | FALSE
@@ -179,6 +283,8 @@ expr : '(' expr ')'
       nodes = append(nodes, &tree{stmt:&Statement{op:$2}})
       }
    | string_test
+   | lower_test
+   | affix_test
    | numeric_test
    | field_test
    | boolean
@@ -196,6 +302,8 @@ type MatcherSpecificationParser struct {
 	peekrune rune
 	lexPos   int
     reToken *regexp.Regexp
+	// The previously returned token, telling a division from a regexp.
+	lastToken int
 }
 
 func parseMatcherSpecification(ms *MatcherSpecification) error {
@@ -228,7 +336,26 @@ func (m *MatcherSpecificationParser) Error(s string) {
 	fmt.Errorf("syntax error: %s last token: %s pos: %d", m.sym, m.lexPos)
 }
 
+// Returns the test for the value starting or ending w/ the string of a
+// startswith or endswith call, i.e. `=~ /^string/` or `=~ /string$/`.
+func affixOp() yySymType {
+	return yySymType{tokenId: OP_RE, token: "=~"}
+}
+
+func affixValue(fn, s yySymType) yySymType {
+	v := yySymType{tokenId: REGEXP_VALUE, token: s.token, fieldIndex: STARTS_WITH}
+	if fn.tokenId == FN_ENDSWITH {
+		v.fieldIndex = ENDS_WITH
+	}
+	return v
+}
+
 func (m *MatcherSpecificationParser) Lex(yylval *yySymType) int {
+	m.lastToken = m.lex(yylval)
+	return m.lastToken
+}
+
+func (m *MatcherSpecificationParser) lex(yylval *yySymType) int {
 	var err error
 	var c, tmp rune
 	var i int
@@ -239,6 +366,7 @@ func (m *MatcherSpecificationParser) Lex(yylval *yySymType) int {
 	yylval.fieldIndex = 0
 	yylval.arrayIndex = 0
 	yylval.regexp = nil
+	yylval.expr = nil
 
 	c = m.peekrune
 	m.peekrune = ' '
@@ -247,6 +375,9 @@ loop:
 	if c >= 'A' && c <= 'Z' {
 		goto variable
 	}
+	if c >= 'a' && c <= 'z' {
+		goto function
+	}
 	if (c >= '0' && c <= '9') || c == '.' {
 		goto number
 	}
@@ -319,10 +450,26 @@ loop:
 	case '"', '\'':
 		goto quotestring
 	case '/':
-		goto regexpstring
+		// Anywhere but after a regexp operator it's a division.
+		if m.lastToken == OP_RE || m.lastToken == OP_NRE {
+			goto regexpstring
+		}
 	}
 	return int(c)
 
+function:
+	m.sym = ""
+	for c >= 'a' && c <= 'z' {
+		m.sym += string(c)
+		c = m.getrune()
+	}
+	m.peekrune = c
+	yylval.token = m.sym
+	if yylval.tokenId = functions[m.sym]; yylval.tokenId == 0 {
+		return invalidToken
+	}
+	return yylval.tokenId
+
 variable:
 	m.sym = ""
 	for i = 0; ; i++ {
@@ -398,6 +545,28 @@ number:
 		if !rdigit(c) {
 			break
 		}
+		// A sign only belongs to the number in an exponent, otherwise it's
+		// an arithmetic operator.
+		if (c == '+' || c == '-') && m.sym[len(m.sym)-1] != 'e' {
+			break
+		}
+	}
+	if c >= 'a' && c <= 'z' {
+		// A duration, e.g. 1h or 500ms, in nanoseconds.
+		unit := ""
+		for c >= 'a' && c <= 'z' {
+			unit += string(c)
+			c = m.getrune()
+		}
+		m.peekrune = c
+		d, err := time.ParseDuration(m.sym + unit)
+		if err != nil {
+			return invalidToken
+		}
+		yylval.double = float64(d)
+		yylval.token = m.sym + unit
+		yylval.tokenId = NUMERIC_VALUE
+		return yylval.tokenId
 	}
 	m.peekrune = c
 	yylval.double, err = strconv.ParseFloat(m.sym, 64)
@@ -481,7 +650,7 @@ regexpstring:
 			}
 		}
 	}
-	yylval.regexp, err = regexp.Compile(m.sym)
+	yylval.regexp, err = compileRegexp(m.sym)
 	if err != nil {
 		log.Printf("invalid regexp %v\n", m.sym)
 		return 0
@@ -79,6 +79,17 @@ func MatcherSpecificationSpec(c gospec.Context) {
 			"NIL",                                                         // invalid use of constant
 			"Type == NIL",                                                 // existence check only works on fields
 			"Fields[test] > NIL",                                          // existence check only works with equals and not equals
+			"Type / 2 == 1",                                               // arithmetic not allowed on strings
+			"Fields[int] + 'x' > 1",                                       // string operand
+			"lower(Severity) == 'x'",                                      // lower not allowed on numeric
+			"startswith(Type, 1)",                                         // number instead of string
+			"upper(Type) == 'TEST'",                                       // unknown function
+			"now == 1",                                                    // missing call parens
+			"Timestamp > now() - 1y",                                      // unknown duration unit
+			"Type == 'a' and Logger == 'b'",                               // unknown word after a test
+			"Type == 'a' junk",                                            // trailing unknown word
+			"Type == 'a' && Logger == 'b' or TRUE",                        // unknown operator
+			"Severity == 1y || TRUE",                                      // unknown duration unit
 		}
 
 		negative := []string{
@@ -116,6 +127,18 @@ func MatcherSpecificationSpec(c gospec.Context) {
 			"Type !~ /^TE/",
 			"Type !~ /ST$/",
 			"Logger =~ /./ && Type =~ /^anything/",
+			"Type =~ /foo\\d/ || Type =~ /bar\\d/ || Type =~ /TEST\\d/",
+			"(Type =~ /a+b/ || Type =~ /TE+ST/) && Severity == 7",
+			"Fields[int] / 9 != 111",
+			"Fields[int] % 2 == 0",
+			"Fields[missing] * 2 >= 0",
+			"Fields[foo] + 1 > 0",
+			"Severity == 2 + 2 * 3",
+			"Timestamp < now() - 1h",
+			"lower(Type) == 'TEST'",
+			"startswith(Type, 'te')",
+			"endswith(lower(Type), 'ST')",
+			"Type =~ /te.t/ || lower(Type) =~ /TE.T/",
 		}
 
 		positive := []string{
@@ -169,6 +192,29 @@ func MatcherSpecificationSpec(c gospec.Context) {
 			"Type =~ /ST$/",
 			"Type !~ /^te/",
 			"Type !~ /st$/",
+			"Type =~ /foo\\d/ || Type =~ /T.ST/ || Type =~ /bar\\d/",
+			"Type =~ /foo\\d/ || Payload =~ /Pay.oad/ || Type =~ /bar\\d/",
+			"Severity == 7 || (Type =~ /a+b/ || Type =~ /TE+ST/) && Severity == 6",
+			"Fields[foo] =~ /x\\d/ || Fields[foo] =~ /b.r/",
+			"Fields[int] / 9 == 111",
+			"Fields[int][0][1] / 1024 > 0.5",
+			"Fields[int] + Fields[double] > 1098",
+			"Fields[int] % 2 == 1",
+			"Severity * 2 - 2 == 10",
+			"Severity == 2 + 2 * 2",
+			"Severity==2*3",
+			"Severity > 5-1",
+			"Timestamp > now() - 1h",
+			"now() - 1m < Timestamp",
+			"Timestamp <= now() + 500ms",
+			"lower(Type) == 'test'",
+			"lower(Fields[foo]) != 'BAR'",
+			"lower(Logger) =~ /gosp.c/",
+			"startswith(Type, 'TE')",
+			"endswith(Payload, 'Payload')",
+			"startswith(lower(Type), 'te')",
+			"endswith(Fields[foo], 'ar')",
+			"lower(Type) =~ /t.st/ || Type =~ /t.st/",
 		}
 
 		c.Specify("malformed matcher tests", func() {
@@ -178,6 +224,24 @@ func MatcherSpecificationSpec(c gospec.Context) {
 			}
 		})
 
+		c.Specify("knows whether it only tests Type and Logger", func() {
+			only := map[string]bool{
+				"Type == 'TEST'":                           true,
+				"Type =~ /^TE/ && Logger != 'GoSpec'":      true,
+				"TRUE || Logger == 'GoSpec'":               true,
+				"Type == 'TEST' && Severity == 6":          false,
+				"Logger == 'GoSpec' || Fields[foo] != NIL": false,
+				"lower(Type) == 'test'":                    true,
+				"startswith(Logger, 'Go')":                 true,
+				"Timestamp > now() - 1h":                   false,
+			}
+			for spec, expected := range only {
+				ms, err := CreateMatcherSpecification(spec)
+				c.Assume(err, gs.IsNil)
+				c.Expect(ms.TypeLoggerOnly(), gs.Equals, expected)
+			}
+		})
+
 		c.Specify("negative matcher tests", func() {
 			for _, v := range negative {
 				ms, err := CreateMatcherSpecification(v)
@@ -303,3 +367,15 @@ func BenchmarkMatcherEndsWith(b *testing.B) {
 		ms.Match(msg)
 	}
 }
+
+func BenchmarkMatcherRegexSet(b *testing.B) {
+	b.StopTimer()
+	s := "Payload =~ /alpha=\\d+/ || Payload =~ /beta=\\d+/ || Payload =~ /gamma=\\d+/" +
+		" || Payload =~ /Test.Payload/"
+	ms, _ := CreateMatcherSpecification(s)
+	msg := getTestMessage()
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		ms.Match(msg)
+	}
+}
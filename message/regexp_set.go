@@ -0,0 +1,232 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package message
+
+import (
+	"regexp"
+	"regexp/syntax"
+)
+
+// RegexpSet tests strings against a list of regular expressions at once. The
+// literal text each regexp requires in order to match is searched for in a
+// single pass over the string, so only the regexps that can possibly match
+// are run. Regexps w/o any required literal, e.g. `^\d+$`, are always run.
+// A RegexpSet is safe for concurrent use.
+type RegexpSet struct {
+	regexps []*regexp.Regexp
+	// Prefilter over the required literals.
+	literals *literalMatcher
+	// Indexes of the regexps w/o a required literal.
+	unfiltered []int
+}
+
+// CompileRegexpSet compiles the expressions into a RegexpSet.
+func CompileRegexpSet(exprs []string) (*RegexpSet, error) {
+	regexps := make([]*regexp.Regexp, len(exprs))
+	for i, expr := range exprs {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		regexps[i] = re
+	}
+	return NewRegexpSet(regexps), nil
+}
+
+// NewRegexpSet creates a RegexpSet from already compiled regexps.
+func NewRegexpSet(regexps []*regexp.Regexp) *RegexpSet {
+	s := &RegexpSet{regexps: regexps}
+	var literals []string
+	var owners []int
+	for i, re := range regexps {
+		if lit := requiredLiteral(re.String()); lit != "" {
+			literals = append(literals, lit)
+			owners = append(owners, i)
+		} else {
+			s.unfiltered = append(s.unfiltered, i)
+		}
+	}
+	if len(literals) > 0 {
+		s.literals = newLiteralMatcher(literals, owners)
+	}
+	return s
+}
+
+// Len returns the number of regexps in the set.
+func (s *RegexpSet) Len() int {
+	return len(s.regexps)
+}
+
+// Regexp returns the regexp at index i.
+func (s *RegexpSet) Regexp(i int) *regexp.Regexp {
+	return s.regexps[i]
+}
+
+// MatchString returns the index of the first regexp, in the order they were
+// provided, that matches str, or -1 if none does.
+func (s *RegexpSet) MatchString(str string) int {
+	if s.literals == nil {
+		for i, re := range s.regexps {
+			if re.MatchString(str) {
+				return i
+			}
+		}
+		return -1
+	}
+
+	if len(s.regexps) <= 64 {
+		var candidates uint64
+		for _, i := range s.unfiltered {
+			candidates |= 1 << uint(i)
+		}
+		s.literals.scan(str, func(owner int) {
+			candidates |= 1 << uint(owner)
+		})
+		for i, re := range s.regexps {
+			if candidates&(1<<uint(i)) != 0 && re.MatchString(str) {
+				return i
+			}
+		}
+		return -1
+	}
+
+	candidates := make([]bool, len(s.regexps))
+	for _, i := range s.unfiltered {
+		candidates[i] = true
+	}
+	s.literals.scan(str, func(owner int) {
+		candidates[owner] = true
+	})
+	for i, ok := range candidates {
+		if ok && s.regexps[i].MatchString(str) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Returns the longest literal string any match of the expression must
+// contain, or "" if there's none.
+func requiredLiteral(expr string) string {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return ""
+	}
+	return string(literalOf(re.Simplify()))
+}
+
+func literalOf(re *syntax.Regexp) []rune {
+	switch re.Op {
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase != 0 {
+			return nil
+		}
+		return re.Rune
+	case syntax.OpCapture, syntax.OpPlus:
+		return literalOf(re.Sub[0])
+	case syntax.OpRepeat:
+		if re.Min > 0 {
+			return literalOf(re.Sub[0])
+		}
+	case syntax.OpConcat:
+		// Adjacent literals form a longer one.
+		var longest, run []rune
+		for _, sub := range re.Sub {
+			if sub.Op == syntax.OpLiteral && sub.Flags&syntax.FoldCase == 0 {
+				run = append(run, sub.Rune...)
+				continue
+			}
+			if len(run) > len(longest) {
+				longest = run
+			}
+			run = nil
+			if lit := literalOf(sub); len(lit) > len(longest) {
+				longest = lit
+			}
+		}
+		if len(run) > len(longest) {
+			longest = run
+		}
+		return longest
+	}
+	return nil
+}
+
+// Aho-Corasick automaton finding all of a list of literals in one pass, w/
+// the fail links resolved into a full transition table so each byte of the
+// input costs a single lookup.
+type literalMatcher struct {
+	next [][256]int32
+	// Owners of the literals ending at each node, including those reached
+	// through the fail links.
+	owners [][]int
+}
+
+func newLiteralMatcher(literals []string, owners []int) *literalMatcher {
+	m := &literalMatcher{
+		next:   make([][256]int32, 1),
+		owners: make([][]int, 1),
+	}
+	// Builds the trie, 0 marking missing transitions since nothing leads
+	// back to the root.
+	for i, lit := range literals {
+		n := int32(0)
+		for j := 0; j < len(lit); j++ {
+			if m.next[n][lit[j]] == 0 {
+				m.next = append(m.next, [256]int32{})
+				m.owners = append(m.owners, nil)
+				m.next[n][lit[j]] = int32(len(m.next) - 1)
+			}
+			n = m.next[n][lit[j]]
+		}
+		m.owners[n] = append(m.owners[n], owners[i])
+	}
+
+	// Breadth first, so a node's fail target is complete before its own
+	// children are visited.
+	fail := make([]int32, len(m.next))
+	var queue []int32
+	for b := 0; b < 256; b++ {
+		if child := m.next[0][b]; child != 0 {
+			queue = append(queue, child)
+		}
+	}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		m.owners[n] = append(m.owners[n], m.owners[fail[n]]...)
+		for b := 0; b < 256; b++ {
+			child := m.next[n][b]
+			if child == 0 {
+				m.next[n][b] = m.next[fail[n]][b]
+				continue
+			}
+			fail[child] = m.next[fail[n]][b]
+			queue = append(queue, child)
+		}
+	}
+	return m
+}
+
+// Calls found w/ the owner of every literal in str.
+func (m *literalMatcher) scan(str string, found func(owner int)) {
+	n := int32(0)
+	for i := 0; i < len(str); i++ {
+		n = m.next[n][str[i]]
+		for _, owner := range m.owners[n] {
+			found(owner)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package message
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/rafrombrc/gospec/src/gospec"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func RegexpSetSpec(c gospec.Context) {
+	exprs := []string{`foo\d+bar`, `^\d+$`, `(?i)hello`, `ab(c|d)xyz`, `she`,
+		`he`, `hers`, `x(yz)+w`}
+
+	c.Specify("A RegexpSet", func() {
+		set, err := CompileRegexpSet(exprs)
+		c.Assume(err, gs.IsNil)
+		c.Expect(set.Len(), gs.Equals, len(exprs))
+
+		c.Specify("finds the literals a match requires", func() {
+			c.Expect(requiredLiteral(`foo\d+bar`), gs.Equals, "foo")
+			c.Expect(requiredLiteral(`ab(c|d)xyz`), gs.Equals, "xyz")
+			c.Expect(requiredLiteral(`x(yz)+w`), gs.Equals, "yz")
+			c.Expect(requiredLiteral(`^\d+$`), gs.Equals, "")
+			c.Expect(requiredLiteral(`(?i)hello`), gs.Equals, "")
+		})
+
+		c.Specify("returns the first regexp that matches", func() {
+			inputs := []string{"foo12bar", "123", "HeLLo", "abcxyz", "ushers",
+				"his", "xyzyzw", "abdxy", "nothing"}
+			for _, input := range inputs {
+				expected := -1
+				for i, expr := range exprs {
+					if regexp.MustCompile(expr).MatchString(input) {
+						expected = i
+						break
+					}
+				}
+				c.Expect(set.MatchString(input), gs.Equals, expected)
+			}
+		})
+
+		c.Specify("handles more than 64 regexps", func() {
+			var many []string
+			for i := 0; i < 70; i++ {
+				many = append(many, `no\d+match`)
+			}
+			many = append(many, `(?P<word>hers)`)
+			set, err := CompileRegexpSet(many)
+			c.Assume(err, gs.IsNil)
+			c.Expect(set.MatchString("ushers"), gs.Equals, 70)
+			c.Expect(set.Regexp(70).String(), gs.Equals, `(?P<word>hers)`)
+		})
+
+		c.Specify("fails on an invalid regexp", func() {
+			_, err := CompileRegexpSet([]string{`\mtest`})
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+}
+
+var setBenchmarkExprs = []string{"alpha", "beta", "gamma", "delta", "epsilon", "zeta",
+	"eta", "theta", "iota", "kappa", "lambda", "mu"}
+
+const setBenchmarkInput = `10.0.0.1 - [10/Oct/2016:13:55:36 -0700] "mu /index.html HTTP/1.1" 200`
+
+func setBenchmarkRegexps() []*regexp.Regexp {
+	regexps := make([]*regexp.Regexp, len(setBenchmarkExprs))
+	for i, name := range setBenchmarkExprs {
+		regexps[i] = regexp.MustCompile(`^(\S+) (\S+) \[([^\]]+)\] "` + name +
+			` ([^"]+)" (\d+)`)
+	}
+	return regexps
+}
+
+func BenchmarkRegexpSetMatch(b *testing.B) {
+	b.StopTimer()
+	set := NewRegexpSet(setBenchmarkRegexps())
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		set.MatchString(setBenchmarkInput)
+	}
+}
+
+func BenchmarkRegexpSequentialMatch(b *testing.B) {
+	b.StopTimer()
+	regexps := setBenchmarkRegexps()
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		for _, re := range regexps {
+			if re.MatchString(setBenchmarkInput) {
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,236 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Report keys, i.e. plugin types, the admin API can filter the reports by.
+var adminReportTypes = map[string]bool{
+	"globals":   true,
+	"inputs":    true,
+	"splitters": true,
+	"decoders":  true,
+	"filters":   true,
+	"outputs":   true,
+	"encoders":  true,
+}
+
+// Serves the live plugin report data of a running hekad, as queried by the
+// heka-report command, takes state snapshots and upgrades hekad, over the
+// `admin_socket` unix socket and the `admin_address` HTTP listener. Requests
+// to the latter must carry the `admin_token` as a bearer token, the socket
+// relies on its file permissions.
+type adminServer struct {
+	pConfig   *PipelineConfig
+	listeners []net.Listener
+	socket    string
+}
+
+// Returns the admin server for the globals, or nil if neither an admin socket
+// nor an admin address is set.
+func newAdminServer(pConfig *PipelineConfig) (*adminServer, error) {
+	globals := pConfig.Globals
+	if globals.AdminSocket == "" && globals.AdminAddress == "" {
+		return nil, nil
+	}
+	if globals.AdminAddress != "" && globals.AdminToken == "" {
+		return nil, fmt.Errorf("admin_address requires an admin_token")
+	}
+	return &adminServer{pConfig: pConfig}, nil
+}
+
+// Starts listening, serving requests in the background until stop is called.
+func (a *adminServer) start() (err error) {
+	globals := a.pConfig.Globals
+	var listener net.Listener
+	if globals.AdminSocket != "" {
+		// A socket left behind by an unclean shutdown would block the listen.
+		os.Remove(globals.AdminSocket)
+		if listener, err = net.Listen("unix", globals.AdminSocket); err != nil {
+			return fmt.Errorf("can't listen on admin socket: %s", err)
+		}
+		if err = os.Chmod(globals.AdminSocket, 0600); err != nil {
+			listener.Close()
+			return fmt.Errorf("can't restrict admin socket: %s", err)
+		}
+		a.socket = globals.AdminSocket
+		a.serve(listener, "")
+	}
+	if globals.AdminAddress != "" {
+		if listener, err = net.Listen("tcp", globals.AdminAddress); err != nil {
+			a.stop()
+			return fmt.Errorf("can't listen on admin address: %s", err)
+		}
+		a.serve(listener, globals.AdminToken)
+	}
+	return nil
+}
+
+func (a *adminServer) serve(listener net.Listener, token string) {
+	a.listeners = append(a.listeners, listener)
+	mux := http.NewServeMux()
+	mux.Handle("/reports", a.authorize(token, http.HandlerFunc(a.handleReports)))
+	mux.Handle("/snapshot", a.authorize(token, http.HandlerFunc(a.handleSnapshot)))
+	mux.Handle("/upgrade", a.authorize(token, http.HandlerFunc(a.handleUpgrade)))
+	go http.Serve(listener, mux)
+}
+
+// Closes the listeners.
+func (a *adminServer) stop() {
+	for _, listener := range a.listeners {
+		listener.Close()
+	}
+	a.listeners = nil
+	if a.socket != "" {
+		os.Remove(a.socket)
+		a.socket = ""
+	}
+}
+
+// Wraps the handler to reject requests w/o the token, if any.
+func (a *adminServer) authorize(token string, h http.Handler) http.Handler {
+	if token == "" {
+		return h
+	}
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		auth := []byte(req.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(auth, expected) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="hekad"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// Writes the report data as JSON, keyed by plugin type. The `type` and `name`
+// query parameters limit it to the plugins of a type and those whose name
+// matches a glob pattern.
+func (a *adminServer) handleReports(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := req.URL.Query()
+	data, err := filterReportData(a.pConfig.reportData(), query.Get("type"),
+		query.Get("name"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(data)
+}
+
+// Shuts hekad down to snapshot its state, writing the path the snapshot
+// will be written to as JSON. The snapshot is only written once every plugin
+// has stopped and flushed its state, see PipelineConfig.SnapshotPath.
+func (a *adminServer) handleSnapshot(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	globals := a.pConfig.Globals
+	if globals.SnapshotDir == "" {
+		http.Error(w, "snapshots require a snapshot_dir", http.StatusNotImplemented)
+		return
+	}
+	name := fmt.Sprintf("heka-state-%s.tar.gz", time.Now().UTC().Format("20060102T150405Z"))
+	snapshotPath := filepath.Join(globals.SnapshotDir, name)
+	if !a.pConfig.requestSnapshot(snapshotPath) {
+		http.Error(w, "a snapshot is already in progress", http.StatusConflict)
+		return
+	}
+	LogInfo.Printf("Snapshot requested, shutting down to write it to '%s'", snapshotPath)
+	globals.ShutDown(0)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"path": snapshotPath})
+}
+
+// Starts the hekad binary at the path this one was started from, handing
+// over the listening sockets, then shuts down so the new hekad can take over
+// the base_dir. Writes the new hekad's pid as JSON.
+func (a *adminServer) handleUpgrade(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	globals := a.pConfig.Globals
+	if !globals.Upgradable {
+		http.Error(w, "hekad can't be upgraded once it has dropped its privileges",
+			http.StatusNotImplemented)
+		return
+	}
+	pid, err := a.pConfig.upgrade()
+	if err != nil {
+		LogError.Printf("Upgrade failed: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if pid == 0 {
+		http.Error(w, "an upgrade is already in progress", http.StatusConflict)
+		return
+	}
+	LogInfo.Printf("Upgrade started, shutting down to hand over to hekad %d", pid)
+	globals.ShutDown(0)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]int{"pid": pid})
+}
+
+// Returns the reports of the given plugin type whose name matches the glob
+// pattern. Empty filters match everything.
+func filterReportData(data fullReportDataMap, pluginType, pattern string) (
+	fullReportDataMap, error) {
+
+	pluginType = strings.ToLower(pluginType)
+	if pluginType != "" && !adminReportTypes[pluginType] {
+		return nil, fmt.Errorf("unknown plugin type '%s'", pluginType)
+	}
+	if pattern != "" {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid name pattern '%s': %s", pattern, err)
+		}
+	}
+	filtered := make(fullReportDataMap)
+	for key, reports := range data {
+		if pluginType != "" && key != pluginType {
+			continue
+		}
+		for _, report := range reports {
+			name, _ := report["Name"].(string)
+			if pattern != "" {
+				if matched, _ := path.Match(pattern, name); !matched {
+					continue
+				}
+			}
+			filtered[key] = append(filtered[key], report)
+		}
+	}
+	return filtered, nil
+}
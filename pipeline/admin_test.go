@@ -0,0 +1,164 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func AdminSpec(c gs.Context) {
+	pConfig := NewPipelineConfig(nil)
+	pConfig.reportRecycleChan <- NewPipelinePack(pConfig.reportRecycleChan)
+
+	c.Specify("The admin server", func() {
+		c.Specify("isn't created unless configured", func() {
+			admin, err := newAdminServer(pConfig)
+			c.Expect(err, gs.IsNil)
+			c.Expect(admin == nil, gs.IsTrue)
+		})
+
+		c.Specify("requires a token to listen on an address", func() {
+			pConfig.Globals.AdminAddress = "127.0.0.1:0"
+			_, err := newAdminServer(pConfig)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		pConfig.Globals.AdminAddress = "127.0.0.1:0"
+		pConfig.Globals.AdminToken = "s3cr3t"
+		admin, err := newAdminServer(pConfig)
+		c.Assume(err, gs.IsNil)
+		handler := admin.authorize("s3cr3t", http.HandlerFunc(admin.handleReports))
+
+		get := func(query, token string) *httptest.ResponseRecorder {
+			req, err := http.NewRequest("GET", "/reports"+query, nil)
+			c.Assume(err, gs.IsNil)
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			return w
+		}
+
+		c.Specify("rejects requests w/o the token", func() {
+			c.Expect(get("", "").Code, gs.Equals, http.StatusUnauthorized)
+			c.Expect(get("", "guess").Code, gs.Equals, http.StatusUnauthorized)
+		})
+
+		c.Specify("serves the report data", func() {
+			w := get("?type=globals&name=Router", "s3cr3t")
+			c.Assume(w.Code, gs.Equals, http.StatusOK)
+			var data fullReportDataMap
+			c.Expect(json.Unmarshal(w.Body.Bytes(), &data), gs.IsNil)
+			c.Expect(len(data), gs.Equals, 1)
+			c.Expect(len(data["globals"]), gs.Equals, 1)
+			c.Expect(data["globals"][0]["Name"], gs.Equals, "Router")
+		})
+
+		c.Specify("rejects unknown plugin types", func() {
+			w := get("?type=widgets", "s3cr3t")
+			c.Expect(w.Code, gs.Equals, http.StatusBadRequest)
+		})
+
+		c.Specify("takes snapshots", func() {
+			snapshot := admin.authorize("s3cr3t", http.HandlerFunc(admin.handleSnapshot))
+			request := func(method string) *httptest.ResponseRecorder {
+				req, err := http.NewRequest(method, "/snapshot", nil)
+				c.Assume(err, gs.IsNil)
+				req.Header.Set("Authorization", "Bearer s3cr3t")
+				w := httptest.NewRecorder()
+				snapshot.ServeHTTP(w, req)
+				return w
+			}
+
+			c.Specify("only if a snapshot_dir is set", func() {
+				c.Expect(request("POST").Code, gs.Equals, http.StatusNotImplemented)
+				c.Expect(pConfig.SnapshotPath(), gs.Equals, "")
+			})
+
+			c.Specify("only when POSTed", func() {
+				pConfig.Globals.SnapshotDir = "/var/backups/heka"
+				c.Expect(request("GET").Code, gs.Equals, http.StatusMethodNotAllowed)
+				c.Expect(pConfig.SnapshotPath(), gs.Equals, "")
+			})
+
+			c.Specify("one at a time, shutting down to write them", func() {
+				pConfig.Globals.SnapshotDir = "/var/backups/heka"
+				w := request("POST")
+				c.Assume(w.Code, gs.Equals, http.StatusAccepted)
+				var body map[string]string
+				c.Expect(json.Unmarshal(w.Body.Bytes(), &body), gs.IsNil)
+				c.Expect(body["path"], gs.Equals, pConfig.SnapshotPath())
+				c.Expect(filepath.Dir(body["path"]), gs.Equals, "/var/backups/heka")
+				c.Expect(<-pConfig.Globals.SigChan(), gs.Equals, os.Signal(syscall.SIGINT))
+				c.Expect(request("POST").Code, gs.Equals, http.StatusConflict)
+			})
+		})
+
+		c.Specify("only upgrades when allowed to", func() {
+			upgrade := admin.authorize("s3cr3t", http.HandlerFunc(admin.handleUpgrade))
+			request := func(method string) int {
+				req, err := http.NewRequest(method, "/upgrade", nil)
+				c.Assume(err, gs.IsNil)
+				req.Header.Set("Authorization", "Bearer s3cr3t")
+				w := httptest.NewRecorder()
+				upgrade.ServeHTTP(w, req)
+				return w.Code
+			}
+			c.Expect(request("POST"), gs.Equals, http.StatusNotImplemented)
+			pConfig.Globals.Upgradable = true
+			c.Expect(request("GET"), gs.Equals, http.StatusMethodNotAllowed)
+		})
+	})
+
+	c.Specify("Report data is filtered", func() {
+		data := fullReportDataMap{
+			"inputs": {
+				{"Name": "TcpInput"},
+				{"Name": "UdpInput"},
+			},
+			"outputs": {
+				{"Name": "TcpOutput"},
+			},
+		}
+
+		c.Specify("by plugin type", func() {
+			filtered, err := filterReportData(data, "Inputs", "")
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(filtered), gs.Equals, 1)
+			c.Expect(len(filtered["inputs"]), gs.Equals, 2)
+		})
+
+		c.Specify("by name pattern", func() {
+			filtered, err := filterReportData(data, "", "Tcp*")
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(filtered["inputs"]), gs.Equals, 1)
+			c.Expect(filtered["inputs"][0]["Name"], gs.Equals, "TcpInput")
+			c.Expect(len(filtered["outputs"]), gs.Equals, 1)
+		})
+
+		c.Specify("but not w/ an invalid pattern", func() {
+			_, err := filterReportData(data, "", "[")
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+}
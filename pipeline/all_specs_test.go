@@ -37,18 +37,48 @@ func TestAllSpecs(t *testing.T) {
 	r := gospec.NewRunner()
 	r.Parallel = false
 
+	r.AddSpec(AdminSpec)
+	r.AddSpec(BinaryPayloadSpec)
+	r.AddSpec(BufferEngineSpec)
+	r.AddSpec(BufferQueueSpec)
+	r.AddSpec(CardinalityFilterSpec)
+	r.AddSpec(CharsetSpec)
+	r.AddSpec(ClockSpec)
+	r.AddSpec(ConfigCryptSpec)
+	r.AddSpec(EncodingSpec)
+	r.AddSpec(FieldLimitsSpec)
+	r.AddSpec(FilterChainsSpec)
+	r.AddSpec(FilterRunnerSpec)
+	r.AddSpec(GraphSpec)
+	r.AddSpec(HandoverSpec)
 	r.AddSpec(HekaFramingSpec)
+	r.AddSpec(InjectWalSpec)
 	r.AddSpec(InputRunnerSpec)
+	r.AddSpec(JoinFilterSpec)
+	r.AddSpec(MemoryMonitorSpec)
 	r.AddSpec(MessageTemplateSpec)
+	r.AddSpec(MirrorFilterSpec)
+	r.AddSpec(NegativeCacheSpec)
 	r.AddSpec(OutputRunnerSpec)
+	r.AddSpec(OversizedSpec)
+	r.AddSpec(PackPoolSpec)
+	r.AddSpec(PluginObjectsSpec)
 	r.AddSpec(ProtobufDecoderSpec)
 	r.AddSpec(QueueBufferSpec)
 	r.AddSpec(PatternGroupingSpec)
 	r.AddSpec(RegexSpec)
 	r.AddSpec(ReportSpec)
+	r.AddSpec(RolesSpec)
+	r.AddSpec(RouterRulesSpec)
+	r.AddSpec(ScheduleSpec)
+	r.AddSpec(SessionFilterSpec)
+	r.AddSpec(SharderFilterSpec)
 	r.AddSpec(SplitterRunnerSpec)
 	r.AddSpec(StatAccumInputSpec)
+	r.AddSpec(SyslogFramingSpec)
 	r.AddSpec(TokenSpec)
+	r.AddSpec(TopKFilterSpec)
+	r.AddSpec(TraceSpec)
 
 	gospec.MainGoTest(r, t)
 }
@@ -0,0 +1,70 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+// Returned by BinaryPayloadMode.Text for binary payloads in "reject" mode.
+var ErrBinaryPayload = errors.New("payload isn't valid UTF-8")
+
+// How a text oriented plugin, e.g. one producing JSON, treats a message
+// payload that isn't valid UTF-8. Set w/ the plugin's `binary_payload`
+// config option.
+type BinaryPayloadMode int
+
+const (
+	// Uses the payload as is, the plugin's output format may replace the
+	// invalid bytes w/ U+FFFD. The default, for b/w compatibility.
+	BinaryPayloadReplace BinaryPayloadMode = iota
+	// Uses the payload's base64 encoding instead.
+	BinaryPayloadBase64
+	// Fails the message w/ ErrBinaryPayload.
+	BinaryPayloadReject
+)
+
+// Parses a `binary_payload` setting, one of "replace", "base64" or "reject".
+// An empty setting means "replace".
+func ParseBinaryPayloadMode(setting string) (BinaryPayloadMode, error) {
+	switch setting {
+	case "", "replace":
+		return BinaryPayloadReplace, nil
+	case "base64":
+		return BinaryPayloadBase64, nil
+	case "reject":
+		return BinaryPayloadReject, nil
+	}
+	return BinaryPayloadReplace, fmt.Errorf(
+		"invalid binary_payload '%s', must be 'replace', 'base64' or 'reject'", setting)
+}
+
+// Returns the payload to use as text. Valid UTF-8 payloads are always
+// returned unchanged.
+func (m BinaryPayloadMode) Text(payload string) (string, error) {
+	if utf8.ValidString(payload) {
+		return payload, nil
+	}
+	switch m {
+	case BinaryPayloadBase64:
+		return base64.StdEncoding.EncodeToString([]byte(payload)), nil
+	case BinaryPayloadReject:
+		return "", ErrBinaryPayload
+	}
+	return payload, nil
+}
@@ -0,0 +1,66 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func BinaryPayloadSpec(c gs.Context) {
+	binary := "\x00\xffheka"
+
+	c.Specify("Parsing binary_payload settings", func() {
+		mode, err := ParseBinaryPayloadMode("")
+		c.Expect(err, gs.IsNil)
+		c.Expect(mode, gs.Equals, BinaryPayloadReplace)
+		mode, err = ParseBinaryPayloadMode("base64")
+		c.Expect(err, gs.IsNil)
+		c.Expect(mode, gs.Equals, BinaryPayloadBase64)
+		mode, err = ParseBinaryPayloadMode("reject")
+		c.Expect(err, gs.IsNil)
+		c.Expect(mode, gs.Equals, BinaryPayloadReject)
+		_, err = ParseBinaryPayloadMode("hex")
+		c.Expect(err, gs.Not(gs.IsNil))
+	})
+
+	c.Specify("Text payloads are used as is", func() {
+		for _, mode := range []BinaryPayloadMode{BinaryPayloadReplace,
+			BinaryPayloadBase64, BinaryPayloadReject} {
+
+			text, err := mode.Text("héka")
+			c.Expect(err, gs.IsNil)
+			c.Expect(text, gs.Equals, "héka")
+		}
+	})
+
+	c.Specify("Binary payloads", func() {
+		c.Specify("are passed on in replace mode", func() {
+			text, err := BinaryPayloadReplace.Text(binary)
+			c.Expect(err, gs.IsNil)
+			c.Expect(text, gs.Equals, binary)
+		})
+
+		c.Specify("are base64 encoded in base64 mode", func() {
+			text, err := BinaryPayloadBase64.Text(binary)
+			c.Expect(err, gs.IsNil)
+			c.Expect(text, gs.Equals, "AP9oZWth")
+		})
+
+		c.Specify("fail in reject mode", func() {
+			_, err := BinaryPayloadReject.Text(binary)
+			c.Expect(err, gs.Equals, ErrBinaryPayload)
+		})
+	})
+}
@@ -0,0 +1,228 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Storage engine of a queue buffer. A queue is a sequence of numbered
+// segments, each holding the framed records appended to it, plus the
+// checkpoint recording how far the queue has been read. The BufferFeeder
+// appends to the newest segment while the BufferReader reads from the oldest
+// ones, so an engine must be safe for concurrent use.
+type BufferEngine interface {
+	// Returns the ids of the existing segments, oldest first.
+	Segments() ([]uint, error)
+	// Returns the size in bytes of a segment, or an error satisfying
+	// os.IsNotExist if there's no such segment.
+	SegmentSize(id uint) (int64, error)
+	// Opens a segment for appending, creating it if needed.
+	OpenSegment(id uint) (BufferSegment, error)
+	// Opens a segment for reading from the offset. Reads at the end of the
+	// segment return io.EOF, until more records are appended to it. Returns
+	// an error satisfying os.IsNotExist if there's no such segment.
+	ReadSegment(id uint, offset int64) (io.ReadCloser, error)
+	// Removes a segment, returning its size. Returns an error satisfying
+	// os.IsNotExist if there's no such segment.
+	RemoveSegment(id uint) (int64, error)
+	// Returns the total size in bytes of the segments.
+	Size() (uint64, error)
+	// Returns the checkpoint, "" if none was written yet.
+	Checkpoint() (string, error)
+	WriteCheckpoint(checkpoint string) error
+	// Releases the engine's resources once the queue isn't read anymore.
+	Close() error
+}
+
+// A queue segment open for appending.
+type BufferSegment interface {
+	// Appends the data to the segment. Nothing is appended if an error is
+	// returned, unless it's QueueCorrupt.
+	Append(data []byte) (int, error)
+	Close() error
+}
+
+// Implemented by the segments of engines that don't sync each append to
+// disk, flushing what was appended so far.
+type SyncableBufferSegment interface {
+	Sync() error
+}
+
+// Opens the engine storing the queue buffer kept in the directory.
+type BufferEngineMaker func(dir string) (BufferEngine, error)
+
+var (
+	bufferEngines = map[string]BufferEngineMaker{
+		"file": openFileBufferEngine,
+	}
+	bufferEnginesLock sync.RWMutex
+)
+
+// Makes a storage engine available to the queue buffers w/ the `engine`
+// setting of their `buffering` section.
+func RegisterBufferEngine(name string, maker BufferEngineMaker) {
+	bufferEnginesLock.Lock()
+	bufferEngines[name] = maker
+	bufferEnginesLock.Unlock()
+}
+
+func openBufferEngine(name, dir string) (BufferEngine, error) {
+	bufferEnginesLock.RLock()
+	maker, ok := bufferEngines[name]
+	bufferEnginesLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown buffer engine '%s'", name)
+	}
+	return maker(dir)
+}
+
+// Default engine, keeping each segment in a `<id>.log` file and the
+// checkpoint in `checkpoint.txt`. Writes aren't synced to disk, so records
+// written just before a power loss can be lost.
+type fileBufferEngine struct {
+	dir                string
+	checkpointFilename string
+	// Kept open by the reader, which is the only one writing checkpoints.
+	checkpointFile *os.File
+}
+
+func openFileBufferEngine(dir string) (BufferEngine, error) {
+	if err := os.MkdirAll(dir, 0766); err != nil {
+		return nil, fmt.Errorf("can't make queue directory: %s", err)
+	}
+	return &fileBufferEngine{
+		dir:                dir,
+		checkpointFilename: filepath.Join(dir, "checkpoint.txt"),
+	}, nil
+}
+
+func (e *fileBufferEngine) Segments() ([]uint, error) {
+	return sortedBufferIds(e.dir), nil
+}
+
+func (e *fileBufferEngine) SegmentSize(id uint) (int64, error) {
+	fileInfo, err := os.Stat(getQueueFilename(e.dir, id))
+	if err != nil {
+		return 0, err
+	}
+	return fileInfo.Size(), nil
+}
+
+func (e *fileBufferEngine) OpenSegment(id uint) (BufferSegment, error) {
+	file, err := os.OpenFile(getQueueFilename(e.dir, id),
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &fileBufferSegment{file}, nil
+}
+
+func (e *fileBufferEngine) ReadSegment(id uint, offset int64) (io.ReadCloser, error) {
+	file, err := os.Open(getQueueFilename(e.dir, id))
+	if err != nil {
+		return nil, err
+	}
+	if _, err = file.Seek(offset, 0); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func (e *fileBufferEngine) RemoveSegment(id uint) (int64, error) {
+	filename := getQueueFilename(e.dir, id)
+	fileInfo, err := os.Stat(filename)
+	if err != nil {
+		return 0, err
+	}
+	if err = os.Remove(filename); err != nil {
+		return 0, err
+	}
+	return fileInfo.Size(), nil
+}
+
+func (e *fileBufferEngine) Size() (uint64, error) {
+	return getQueueBufferSize(e.dir), nil
+}
+
+func (e *fileBufferEngine) Checkpoint() (string, error) {
+	checkpoint, err := ioutil.ReadFile(e.checkpointFilename)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return string(checkpoint), err
+}
+
+func (e *fileBufferEngine) WriteCheckpoint(checkpoint string) error {
+	var err error
+	if e.checkpointFile == nil {
+		if e.checkpointFile, err = os.OpenFile(e.checkpointFilename,
+			os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644); err != nil {
+			return err
+		}
+	}
+	e.checkpointFile.Seek(0, 0)
+	n, err := e.checkpointFile.WriteString(checkpoint)
+	if err != nil {
+		return err
+	}
+	return e.checkpointFile.Truncate(int64(n))
+}
+
+func (e *fileBufferEngine) Close() error {
+	if e.checkpointFile == nil {
+		return nil
+	}
+	err := e.checkpointFile.Close()
+	e.checkpointFile = nil
+	return err
+}
+
+type fileBufferSegment struct {
+	file *os.File
+}
+
+func (s *fileBufferSegment) Append(data []byte) (int, error) {
+	n, err := s.file.Write(data)
+	if err != nil && n > 0 {
+		// If we wrote some data but there was an error, that data is suspect
+		// so we need to seek back to before the bogus write happened.
+		ret, e := s.file.Seek(int64(-n), 2)
+		if e != nil {
+			return 0, QueueCorrupt
+		}
+		if e = s.file.Truncate(ret); e != nil {
+			return 0, QueueCorrupt
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (s *fileBufferSegment) Sync() error {
+	return s.file.Sync()
+}
+
+func (s *fileBufferSegment) Close() error {
+	return s.file.Close()
+}
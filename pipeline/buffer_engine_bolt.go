@@ -0,0 +1,267 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	boltQueueFilename    = "queue.bolt"
+	boltQueueOpenTimeout = 5 * time.Second
+)
+
+var (
+	boltSegmentsBucket = []byte("segments")
+	boltMetaBucket     = []byte("meta")
+	boltCheckpointKey  = []byte("checkpoint")
+
+	// Open queue databases by path. A database can only be opened once at a
+	// time, so they're kept open for the life of the process and shared w/
+	// any plugin restarted on the same queue.
+	boltQueueDbs     = make(map[string]*bolt.DB)
+	boltQueueDbsLock sync.Mutex
+)
+
+// Keeps the whole queue in a single BoltDB file. Each segment is a bucket of
+// chunks keyed by their offset in the segment, and every append is a
+// transaction synced to disk before QueueRecord returns, trading the file
+// engine's write throughput for no records being lost on a crash.
+type boltBufferEngine struct {
+	db   *bolt.DB
+	path string
+}
+
+func openBoltBufferEngine(dir string) (BufferEngine, error) {
+	if err := os.MkdirAll(dir, 0766); err != nil {
+		return nil, fmt.Errorf("can't make queue directory: %s", err)
+	}
+	path := filepath.Join(dir, boltQueueFilename)
+	boltQueueDbsLock.Lock()
+	defer boltQueueDbsLock.Unlock()
+	db, ok := boltQueueDbs[path]
+	if !ok {
+		var err error
+		db, err = bolt.Open(path, 0600, &bolt.Options{Timeout: boltQueueOpenTimeout})
+		if err != nil {
+			return nil, fmt.Errorf("can't open queue database: %s", err)
+		}
+		err = db.Update(func(tx *bolt.Tx) error {
+			if _, err := tx.CreateBucketIfNotExists(boltSegmentsBucket); err != nil {
+				return err
+			}
+			_, err := tx.CreateBucketIfNotExists(boltMetaBucket)
+			return err
+		})
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("can't initialize queue database: %s", err)
+		}
+		boltQueueDbs[path] = db
+	}
+	return &boltBufferEngine{db: db, path: path}, nil
+}
+
+func boltKey(n uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, n)
+	return key
+}
+
+// Returns an error satisfying os.IsNotExist for a missing segment.
+func (e *boltBufferEngine) notExist(id uint) error {
+	return &os.PathError{
+		Op:   "open",
+		Path: fmt.Sprintf("%s segment %d", e.path, id),
+		Err:  os.ErrNotExist,
+	}
+}
+
+func (e *boltBufferEngine) segment(tx *bolt.Tx, id uint) *bolt.Bucket {
+	return tx.Bucket(boltSegmentsBucket).Bucket(boltKey(uint64(id)))
+}
+
+// Returns the size of the segment, i.e. the end of its last chunk.
+func boltSegmentSize(b *bolt.Bucket) int64 {
+	k, v := b.Cursor().Last()
+	if k == nil {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(k)) + int64(len(v))
+}
+
+func (e *boltBufferEngine) Segments() ([]uint, error) {
+	var ids []uint
+	err := e.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltSegmentsBucket).Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			ids = append(ids, uint(binary.BigEndian.Uint64(k)))
+		}
+		return nil
+	})
+	return ids, err
+}
+
+func (e *boltBufferEngine) SegmentSize(id uint) (size int64, err error) {
+	err = e.db.View(func(tx *bolt.Tx) error {
+		b := e.segment(tx, id)
+		if b == nil {
+			return e.notExist(id)
+		}
+		size = boltSegmentSize(b)
+		return nil
+	})
+	return size, err
+}
+
+func (e *boltBufferEngine) OpenSegment(id uint) (BufferSegment, error) {
+	err := e.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.Bucket(boltSegmentsBucket).CreateBucketIfNotExists(
+			boltKey(uint64(id)))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &boltBufferSegment{engine: e, id: id}, nil
+}
+
+func (e *boltBufferEngine) ReadSegment(id uint, offset int64) (io.ReadCloser, error) {
+	if _, err := e.SegmentSize(id); err != nil {
+		return nil, err
+	}
+	return &boltSegmentReader{engine: e, id: id, pos: offset}, nil
+}
+
+func (e *boltBufferEngine) RemoveSegment(id uint) (size int64, err error) {
+	err = e.db.Update(func(tx *bolt.Tx) error {
+		b := e.segment(tx, id)
+		if b == nil {
+			return e.notExist(id)
+		}
+		size = boltSegmentSize(b)
+		return tx.Bucket(boltSegmentsBucket).DeleteBucket(boltKey(uint64(id)))
+	})
+	return size, err
+}
+
+func (e *boltBufferEngine) Size() (size uint64, err error) {
+	err = e.db.View(func(tx *bolt.Tx) error {
+		segments := tx.Bucket(boltSegmentsBucket)
+		c := segments.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			size += uint64(boltSegmentSize(segments.Bucket(k)))
+		}
+		return nil
+	})
+	return size, err
+}
+
+func (e *boltBufferEngine) Checkpoint() (checkpoint string, err error) {
+	err = e.db.View(func(tx *bolt.Tx) error {
+		// Converting copies the value, which is only valid during the tx.
+		checkpoint = string(tx.Bucket(boltMetaBucket).Get(boltCheckpointKey))
+		return nil
+	})
+	return checkpoint, err
+}
+
+func (e *boltBufferEngine) WriteCheckpoint(checkpoint string) error {
+	return e.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltMetaBucket).Put(boltCheckpointKey, []byte(checkpoint))
+	})
+}
+
+// The database stays open, see boltQueueDbs.
+func (e *boltBufferEngine) Close() error {
+	return nil
+}
+
+type boltBufferSegment struct {
+	engine *boltBufferEngine
+	id     uint
+}
+
+func (s *boltBufferSegment) Append(data []byte) (int, error) {
+	err := s.engine.db.Update(func(tx *bolt.Tx) error {
+		b := s.engine.segment(tx, s.id)
+		if b == nil {
+			return s.engine.notExist(s.id)
+		}
+		return b.Put(boltKey(uint64(boltSegmentSize(b))), data)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func (s *boltBufferSegment) Close() error {
+	return nil
+}
+
+// Reads a segment chunk by chunk, each Read in its own transaction so the
+// feeder can keep appending to it.
+type boltSegmentReader struct {
+	engine *boltBufferEngine
+	id     uint
+	pos    int64
+}
+
+func (r *boltSegmentReader) Read(p []byte) (n int, err error) {
+	err = r.engine.db.View(func(tx *bolt.Tx) error {
+		b := r.engine.segment(tx, r.id)
+		if b == nil {
+			// Removed while being read.
+			return io.EOF
+		}
+		// Finds the chunk holding pos, the last one starting at or before
+		// it.
+		c := b.Cursor()
+		k, v := c.Seek(boltKey(uint64(r.pos)))
+		if k == nil {
+			k, v = c.Last()
+		} else if int64(binary.BigEndian.Uint64(k)) > r.pos {
+			k, v = c.Prev()
+		}
+		if k == nil {
+			return io.EOF
+		}
+		start := int64(binary.BigEndian.Uint64(k))
+		if r.pos >= start+int64(len(v)) {
+			return io.EOF
+		}
+		n = copy(p, v[r.pos-start:])
+		return nil
+	})
+	r.pos += int64(n)
+	return n, err
+}
+
+func (r *boltSegmentReader) Close() error {
+	return nil
+}
+
+func init() {
+	RegisterBufferEngine("bolt", openBoltBufferEngine)
+}
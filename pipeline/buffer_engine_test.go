@@ -0,0 +1,161 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/gogo/protobuf/proto"
+	ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func BufferEngineSpec(c gs.Context) {
+	tmpDir, tmpErr := ioutil.TempDir("", "bufferengine-tests")
+	c.Assume(tmpErr, gs.IsNil)
+	defer func() {
+		tmpErr = os.RemoveAll(tmpDir)
+		c.Expect(tmpErr, gs.IsNil)
+	}()
+
+	c.Specify("Unknown engines are rejected", func() {
+		_, err := openBufferEngine("badger", tmpDir)
+		c.Expect(err, gs.Not(gs.IsNil))
+	})
+
+	for _, name := range []string{"file", "bolt"} {
+		name := name
+		dir := filepath.Join(tmpDir, name)
+
+		c.Specify("The "+name+" engine", func() {
+			engine, err := openBufferEngine(name, dir)
+			c.Assume(err, gs.IsNil)
+			defer engine.Close()
+
+			c.Specify("starts out empty", func() {
+				ids, err := engine.Segments()
+				c.Expect(err, gs.IsNil)
+				c.Expect(len(ids), gs.Equals, 0)
+				size, err := engine.Size()
+				c.Expect(err, gs.IsNil)
+				c.Expect(size, gs.Equals, uint64(0))
+				checkpoint, err := engine.Checkpoint()
+				c.Expect(err, gs.IsNil)
+				c.Expect(checkpoint, gs.Equals, "")
+				_, err = engine.ReadSegment(0, 0)
+				c.Expect(os.IsNotExist(err), gs.IsTrue)
+			})
+
+			c.Specify("appends to and reads segments", func() {
+				for _, id := range []uint{3, 1} {
+					segment, err := engine.OpenSegment(id)
+					c.Assume(err, gs.IsNil)
+					_, err = segment.Append([]byte("hello "))
+					c.Expect(err, gs.IsNil)
+					_, err = segment.Append([]byte("world"))
+					c.Expect(err, gs.IsNil)
+					c.Expect(segment.Close(), gs.IsNil)
+				}
+				ids, err := engine.Segments()
+				c.Expect(err, gs.IsNil)
+				c.Expect(ids, gs.Equals, []uint{1, 3})
+				size, err := engine.SegmentSize(3)
+				c.Expect(err, gs.IsNil)
+				c.Expect(size, gs.Equals, int64(11))
+				total, err := engine.Size()
+				c.Expect(err, gs.IsNil)
+				c.Expect(total, gs.Equals, uint64(22))
+
+				stream, err := engine.ReadSegment(3, 4)
+				c.Assume(err, gs.IsNil)
+				data, err := ioutil.ReadAll(stream)
+				c.Expect(err, gs.IsNil)
+				c.Expect(string(data), gs.Equals, "o world")
+				stream.Close()
+
+				size, err = engine.RemoveSegment(1)
+				c.Expect(err, gs.IsNil)
+				c.Expect(size, gs.Equals, int64(11))
+				_, err = engine.RemoveSegment(1)
+				c.Expect(os.IsNotExist(err), gs.IsTrue)
+				ids, err = engine.Segments()
+				c.Expect(err, gs.IsNil)
+				c.Expect(ids, gs.Equals, []uint{3})
+			})
+
+			c.Specify("reads what's appended after the end was reached", func() {
+				segment, err := engine.OpenSegment(0)
+				c.Assume(err, gs.IsNil)
+				defer segment.Close()
+				_, err = segment.Append([]byte("abc"))
+				c.Assume(err, gs.IsNil)
+				stream, err := engine.ReadSegment(0, 0)
+				c.Assume(err, gs.IsNil)
+				defer stream.Close()
+
+				buf := make([]byte, 10)
+				n, err := stream.Read(buf)
+				c.Expect(string(buf[:n]), gs.Equals, "abc")
+				n, err = stream.Read(buf)
+				c.Expect(err, gs.Equals, io.EOF)
+				_, err = segment.Append([]byte("def"))
+				c.Assume(err, gs.IsNil)
+				n, err = stream.Read(buf)
+				c.Expect(err, gs.IsNil)
+				c.Expect(string(buf[:n]), gs.Equals, "def")
+			})
+
+			c.Specify("keeps the checkpoint", func() {
+				c.Expect(engine.WriteCheckpoint("12 345"), gs.IsNil)
+				c.Expect(engine.WriteCheckpoint("2 0"), gs.IsNil)
+				checkpoint, err := engine.Checkpoint()
+				c.Expect(err, gs.IsNil)
+				c.Expect(checkpoint, gs.Equals, "2 0")
+			})
+
+			c.Specify("holds the records queued by a BufferFeeder", func() {
+				config := defaultQueueBufferConfig()
+				config.Engine = name
+				feeder, err := NewBufferFeeder(engine, config, &BufferSize{})
+				c.Assume(err, gs.IsNil)
+				pack := NewPipelinePack(nil)
+				pack.Message = ts.GetTestMessage()
+				pack.MsgBytes, err = proto.Marshal(pack.Message)
+				c.Assume(err, gs.IsNil)
+				c.Expect(feeder.QueueRecord(pack), gs.IsNil)
+				c.Expect(feeder.QueueRecord(pack), gs.IsNil)
+
+				queue, err := OpenBufferQueue(dir)
+				c.Assume(err, gs.IsNil)
+				defer queue.Close()
+				var count int
+				err = queue.Scan(true, func(rec *BufferQueueRecord) error {
+					c.Expect(rec.Message.GetPayload(), gs.Equals,
+						pack.Message.GetPayload())
+					count++
+					return nil
+				})
+				c.Expect(err, gs.IsNil)
+				c.Expect(count, gs.Equals, 2)
+				size, err := engine.Size()
+				c.Expect(err, gs.IsNil)
+				c.Expect(feeder.queueSize.Get(), gs.Equals, size)
+			})
+		})
+	}
+}
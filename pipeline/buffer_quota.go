@@ -0,0 +1,178 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+const bufferQuotaCheckInterval = time.Second
+
+// Tracks the disk usage of all of the queue buffers, against the global
+// `max_buffer_disk_usage` quota and each buffer's own `max_buffer_size`,
+// alerting when the usage crosses `buffer_alert_percent` of either.
+type bufferQuota struct {
+	pConfig      *PipelineConfig
+	limit        uint64
+	alertPercent uint
+	// Sum of the sizes of all of the buffers, each buffer's BufferSize adds
+	// to it.
+	usage    BufferSize
+	lock     sync.Mutex
+	buffers  map[string]*quotaBuffer
+	alerting bool
+	stopChan chan struct{}
+	stopOnce sync.Once
+}
+
+type quotaBuffer struct {
+	size     *BufferSize
+	limit    uint64
+	alerting bool
+}
+
+func newBufferQuota(pConfig *PipelineConfig) *bufferQuota {
+	return &bufferQuota{
+		pConfig:      pConfig,
+		limit:        pConfig.Globals.MaxBufferDiskUsage,
+		alertPercent: pConfig.Globals.BufferAlertPercent,
+		buffers:      make(map[string]*quotaBuffer),
+		stopChan:     make(chan struct{}),
+	}
+}
+
+// Registers a buffer's size, which from then on adds to the total usage.
+func (q *bufferQuota) register(name string, size *BufferSize, limit uint64) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if prev, ok := q.buffers[name]; ok {
+		// A restarted plugin re-opening its buffer.
+		q.usage.Add(^(prev.size.Get() - 1))
+		prev.size.total = nil
+	}
+	q.buffers[name] = &quotaBuffer{size: size, limit: limit}
+	size.total = &q.usage
+	q.usage.Add(size.Get())
+}
+
+// Whether adding this many bytes to the buffers would exceed the global
+// quota.
+func (q *bufferQuota) exceeded(delta uint64) bool {
+	return q.limit > 0 && q.usage.Get()+delta > q.limit
+}
+
+func (q *bufferQuota) run() {
+	if q.alertPercent == 0 {
+		return
+	}
+	ticker := time.NewTicker(bufferQuotaCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			q.check()
+		case <-q.stopChan:
+			return
+		}
+	}
+}
+
+func (q *bufferQuota) stop() {
+	q.stopOnce.Do(func() {
+		close(q.stopChan)
+	})
+}
+
+// Alerts on the quotas that have been crossed or recovered since the last
+// check.
+func (q *bufferQuota) check() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.alerting = q.checkOne("", q.usage.Get(), q.limit, q.alerting)
+	for name, buf := range q.buffers {
+		buf.alerting = q.checkOne(name, buf.size.Get(), buf.limit, buf.alerting)
+	}
+}
+
+func (q *bufferQuota) checkOne(name string, usage, limit uint64, alerting bool) bool {
+	if limit == 0 {
+		return false
+	}
+	threshold := limit / 100 * uint64(q.alertPercent)
+	switch {
+	case !alerting && usage >= threshold:
+		q.alert(name, usage, limit, "exceeded")
+		return true
+	case alerting && usage < threshold*9/10:
+		q.alert(name, usage, limit, "recovered")
+		return false
+	}
+	return alerting
+}
+
+// Logs the quota state change and injects a `heka.buffer-quota` message so
+// the condition can be acted upon by filters and outputs. An empty name is
+// the global quota.
+func (q *bufferQuota) alert(name string, usage, limit uint64, state string) {
+	scope := "global"
+	if name != "" {
+		scope = name
+	}
+	LogError.Printf("Buffer disk quota %s (%s): %d of %d bytes in use", state, scope,
+		usage, limit)
+
+	var pack *PipelinePack
+	select {
+	case pack = <-q.pConfig.injectRecycleChan:
+	default:
+		LogError.Println("No pack available for buffer quota alert message.")
+		return
+	}
+	msg := pack.Message
+	msg.SetTimestamp(time.Now().UnixNano())
+	msg.SetHostname(q.pConfig.hostname)
+	msg.SetPid(q.pConfig.pid)
+	msg.SetLogger(HEKA_DAEMON)
+	msg.SetType("heka.buffer-quota")
+	msg.SetSeverity(1)
+	msg.SetPayload(fmt.Sprintf("buffer disk quota %s (%s)", state, scope))
+	message.NewStringField(msg, "state", state)
+	message.NewStringField(msg, "scope", scope)
+	message.NewInt64Field(msg, "BufferSize", int64(usage), "B")
+	message.NewInt64Field(msg, "MaxBufferSize", int64(limit), "B")
+	q.pConfig.router.Inject(pack)
+}
+
+// Populates the provided message w/ the total and per buffer disk usage.
+func (q *bufferQuota) reportMsg(msg *message.Message) {
+	message.NewInt64Field(msg, "BufferDiskUsage", int64(q.usage.Get()), "B")
+	message.NewInt64Field(msg, "MaxBufferDiskUsage", int64(q.limit), "B")
+	q.lock.Lock()
+	names := make([]string, 0, len(q.buffers))
+	for name := range q.buffers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		message.NewInt64Field(msg, "BufferSize-"+name,
+			int64(q.buffers[name].size.Get()), "B")
+	}
+	q.lock.Unlock()
+}
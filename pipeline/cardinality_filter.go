@@ -0,0 +1,329 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// Filter that estimates the number of distinct values of a message variable,
+// e.g. unique users, optionally per value of another, e.g. per endpoint,
+// w/ a HyperLogLog sketch for each key. The estimates are injected every
+// ticker interval, or at the times of a cron schedule, and the sketches are
+// saved so they survive restarts.
+type CardinalityFilter struct {
+	droppedKeys int64
+	processed   int64
+	name        string
+	pConfig     *PipelineConfig
+	conf        *CardinalityFilterConfig
+	variable    *hashVariable
+	keyVariable *hashVariable
+	schedule    *Schedule
+	statePath   string
+	state       *cardinalityState
+}
+
+type CardinalityFilterConfig struct {
+	// Message variable whose distinct values are counted, in the
+	// SharderFilter's `hash_variable` format.
+	Variable string `toml:"variable"`
+	// Message variable whose values each get their own estimate, in the same
+	// format. If unset a single estimate is made.
+	KeyVariable string `toml:"key_variable"`
+	// Each sketch uses 2^precision bytes, for a standard error of about
+	// 1.04/sqrt(2^precision). Between 4 and 18, defaults to 14.
+	Precision uint `toml:"precision"`
+	// Maximum number of keys estimated, values of new keys past this are
+	// dropped. Defaults to 1000.
+	MaxKeys int `toml:"max_keys"`
+	// Whether the sketches are reset after the estimates are injected, so
+	// each estimate covers one interval. Defaults to true.
+	ResetAfterEmit bool `toml:"reset_after_emit"`
+	// Cron expression of the times the estimates are injected at, overriding
+	// the ticker interval.
+	Schedule string `toml:"schedule"`
+	// Timezone the schedule is interpreted in, defaults to the local one.
+	ScheduleTimezone string `toml:"schedule_timezone"`
+	// Defaults to an hour.
+	TickerInterval uint `toml:"ticker_interval"`
+	// File the sketches are saved to, relative to the base dir. Defaults to
+	// "cardinality/<filter name>.json".
+	StatePath string `toml:"state_path"`
+}
+
+// Sketches saved between restarts.
+type cardinalityState struct {
+	Precision uint8
+	// Start of the current interval, in nanoseconds since the epoch.
+	Start    int64
+	Sketches map[string]*hyperLogLog `json:"-"`
+	// Registers of each key's sketch.
+	Registers map[string][]byte
+}
+
+func (f *CardinalityFilter) SetName(name string) {
+	f.name = name
+}
+
+func (f *CardinalityFilter) SetPipelineConfig(pConfig *PipelineConfig) {
+	f.pConfig = pConfig
+}
+
+func (f *CardinalityFilter) ConfigStruct() interface{} {
+	return &CardinalityFilterConfig{
+		Precision:      14,
+		MaxKeys:        1000,
+		ResetAfterEmit: true,
+		TickerInterval: 3600,
+	}
+}
+
+func (f *CardinalityFilter) Init(config interface{}) (err error) {
+	conf := config.(*CardinalityFilterConfig)
+	if conf.Variable == "" {
+		return errors.New("CardinalityFilter requires a variable")
+	}
+	if f.variable, err = newHashVariable(conf.Variable); err != nil {
+		return fmt.Errorf("CardinalityFilter %s", err)
+	}
+	f.keyVariable = nil
+	if conf.KeyVariable != "" {
+		if f.keyVariable, err = newHashVariable(conf.KeyVariable); err != nil {
+			return fmt.Errorf("CardinalityFilter key_variable: %s", err)
+		}
+	}
+	if conf.Precision < 4 || conf.Precision > 18 {
+		return fmt.Errorf("CardinalityFilter precision must be between 4 and 18, got %d",
+			conf.Precision)
+	}
+	if conf.MaxKeys <= 0 {
+		return errors.New("CardinalityFilter max_keys must be positive")
+	}
+	f.schedule = nil
+	if conf.Schedule != "" {
+		loc := time.Local
+		if conf.ScheduleTimezone != "" {
+			if loc, err = time.LoadLocation(conf.ScheduleTimezone); err != nil {
+				return fmt.Errorf("CardinalityFilter invalid schedule_timezone: %s", err)
+			}
+		}
+		if f.schedule, err = ParseSchedule(conf.Schedule, loc); err != nil {
+			return fmt.Errorf("CardinalityFilter invalid schedule: %s", err)
+		}
+	}
+	statePath := conf.StatePath
+	if statePath == "" {
+		statePath = filepath.Join("cardinality", f.name+".json")
+	}
+	f.statePath = f.pConfig.Globals.PrependBaseDir(statePath)
+	f.conf = conf
+	f.state, err = loadCardinalityState(f.statePath, uint8(conf.Precision))
+	return err
+}
+
+func (f *CardinalityFilter) Run(fr FilterRunner, h PluginHelper) (err error) {
+	inChan := fr.InChan()
+	ticker := fr.Ticker()
+	if f.schedule != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		ticker = scheduleTicker(f.pConfig.Globals.Clock, f.schedule, 0, stop)
+	}
+	for {
+		select {
+		case pack, ok := <-inChan:
+			if !ok {
+				if err = f.state.save(f.statePath); err != nil {
+					fr.LogError(fmt.Errorf("can't save sketches: %s", err))
+				}
+				return nil
+			}
+			f.add(pack.Message)
+			fr.UpdateCursor(pack.QueueCursor)
+			pack.Recycle(nil)
+		case now := <-ticker:
+			if len(f.state.Sketches) > 0 {
+				pack, err := h.PipelinePack(0)
+				if err != nil {
+					fr.LogError(err)
+				} else {
+					pack.Message.SetLogger(fr.Name())
+					f.summarize(pack.Message, now)
+					fr.Inject(pack)
+				}
+			}
+			if f.conf.ResetAfterEmit {
+				f.state.reset(now)
+			}
+			if err = f.state.save(f.statePath); err != nil {
+				fr.LogError(fmt.Errorf("can't save sketches: %s", err))
+			}
+		}
+	}
+}
+
+func (f *CardinalityFilter) add(msg *message.Message) {
+	atomic.AddInt64(&f.processed, 1)
+	value, ok := f.variable.value(msg)
+	if !ok {
+		return
+	}
+	var key string
+	if f.keyVariable != nil {
+		if key, ok = f.keyVariable.value(msg); !ok {
+			return
+		}
+	}
+	sketch, ok := f.state.Sketches[key]
+	if !ok {
+		if len(f.state.Sketches) >= f.conf.MaxKeys {
+			atomic.AddInt64(&f.droppedKeys, 1)
+			return
+		}
+		sketch = newHyperLogLog(uint8(f.conf.Precision))
+		f.state.Sketches[key] = sketch
+	}
+	sketch.add(value)
+}
+
+// Fills the message w/ the estimates of the interval ending at `end`. The
+// payload holds a line per key, w/ the key and its estimate separated by a
+// tab, from the highest estimate down. The same are in the `Keys` and
+// `Estimates` fields.
+func (f *CardinalityFilter) summarize(msg *message.Message, end time.Time) {
+	estimates := make(cardinalityRanking, 0, len(f.state.Sketches))
+	for key, sketch := range f.state.Sketches {
+		estimates = append(estimates, cardinalityEstimate{key, sketch.estimate()})
+	}
+	sort.Sort(estimates)
+	msg.SetType("heka.cardinality")
+	msg.SetTimestamp(end.UnixNano())
+	keys := message.NewFieldInit("Keys", message.Field_STRING, "")
+	counts := message.NewFieldInit("Estimates", message.Field_INTEGER, "count")
+	var payload bytes.Buffer
+	for _, e := range estimates {
+		fmt.Fprintf(&payload, "%s\t%d\n", e.key, e.estimate)
+		keys.AddValue(e.key)
+		counts.AddValue(int64(e.estimate))
+	}
+	msg.SetPayload(payload.String())
+	msg.AddField(keys)
+	msg.AddField(counts)
+	msg.SetString("Variable", f.conf.Variable)
+	if f.conf.KeyVariable != "" {
+		msg.SetString("KeyVariable", f.conf.KeyVariable)
+	}
+	msg.SetInt("WindowStart", f.state.Start)
+}
+
+func (f *CardinalityFilter) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "ProcessMessageCount",
+		atomic.LoadInt64(&f.processed), "count")
+	message.NewInt64Field(msg, "DroppedKeyCount", atomic.LoadInt64(&f.droppedKeys),
+		"count")
+	return nil
+}
+
+type cardinalityEstimate struct {
+	key      string
+	estimate uint64
+}
+
+// Sorts estimates by decreasing value, then by key.
+type cardinalityRanking []cardinalityEstimate
+
+func (r cardinalityRanking) Len() int      { return len(r) }
+func (r cardinalityRanking) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r cardinalityRanking) Less(i, j int) bool {
+	if r[i].estimate != r[j].estimate {
+		return r[i].estimate > r[j].estimate
+	}
+	return r[i].key < r[j].key
+}
+
+// Loads the sketches saved at path, starting afresh if there are none or if
+// they were made w/ another precision.
+func loadCardinalityState(path string, precision uint8) (*cardinalityState, error) {
+	s := &cardinalityState{Precision: precision}
+	s.reset(time.Now())
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't read state file '%s': %s", path, err)
+	}
+	saved := new(cardinalityState)
+	if err = json.Unmarshal(data, saved); err != nil {
+		return nil, fmt.Errorf("can't decode state file '%s': %s", path, err)
+	}
+	if saved.Precision != precision {
+		return s, nil
+	}
+	for key, registers := range saved.Registers {
+		sketch, err := hyperLogLogFromBytes(precision, registers)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sketch '%s' in state file '%s': %s", key,
+				path, err)
+		}
+		s.Sketches[key] = sketch
+	}
+	s.Start = saved.Start
+	return s, nil
+}
+
+func (s *cardinalityState) reset(start time.Time) {
+	s.Start = start.UnixNano()
+	s.Sketches = make(map[string]*hyperLogLog)
+}
+
+// Writes the sketches out, replacing the file atomically.
+func (s *cardinalityState) save(path string) error {
+	s.Registers = make(map[string][]byte, len(s.Sketches))
+	for key, sketch := range s.Sketches {
+		s.Registers[key] = sketch.bytes()
+	}
+	data, err := json.Marshal(s)
+	s.Registers = nil
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func init() {
+	RegisterPlugin("CardinalityFilter", func() interface{} {
+		return new(CardinalityFilter)
+	})
+}
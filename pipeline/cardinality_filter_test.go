@@ -0,0 +1,145 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func CardinalityFilterSpec(c gs.Context) {
+	c.Specify("A HyperLogLog sketch", func() {
+		h := newHyperLogLog(14)
+
+		c.Specify("counts small cardinalities exactly", func() {
+			for i := 0; i < 3; i++ {
+				h.add("a")
+				h.add("b")
+			}
+			c.Expect(h.estimate(), gs.Equals, uint64(2))
+		})
+
+		c.Specify("estimates large cardinalities w/in a few percent", func() {
+			for i := 0; i < 200000; i++ {
+				h.add(strconv.Itoa(i))
+			}
+			estimate := float64(h.estimate())
+			c.Expect(estimate > 194000 && estimate < 206000, gs.IsTrue)
+		})
+
+		c.Specify("round trips its registers", func() {
+			h.add("a")
+			copied, err := hyperLogLogFromBytes(14, h.bytes())
+			c.Expect(err, gs.IsNil)
+			c.Expect(copied.estimate(), gs.Equals, uint64(1))
+			_, err = hyperLogLogFromBytes(12, h.bytes())
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+
+	c.Specify("A CardinalityFilter", func() {
+		tmpDir, err := ioutil.TempDir("", "cardinality-tests")
+		c.Assume(err, gs.IsNil)
+		defer os.RemoveAll(tmpDir)
+		globals := DefaultGlobals()
+		globals.BaseDir = tmpDir
+		pConfig := NewPipelineConfig(globals)
+
+		newFilter := func() (*CardinalityFilter, *CardinalityFilterConfig) {
+			filter := new(CardinalityFilter)
+			filter.SetName("UniqueUsers")
+			filter.SetPipelineConfig(pConfig)
+			config := filter.ConfigStruct().(*CardinalityFilterConfig)
+			config.Variable = "Fields[user]"
+			config.KeyVariable = "Fields[endpoint]"
+			return filter, config
+		}
+		filter, config := newFilter()
+
+		request := func(endpoint, user string) {
+			msg := new(message.Message)
+			msg.SetString("endpoint", endpoint)
+			msg.SetString("user", user)
+			filter.add(msg)
+		}
+
+		c.Specify("rejects an out of range precision", func() {
+			config.Precision = 20
+			c.Expect(filter.Init(config), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("rejects an invalid schedule", func() {
+			config.Schedule = "every hour"
+			c.Expect(filter.Init(config), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("is initialized", func() {
+			err := filter.Init(config)
+			c.Assume(err, gs.IsNil)
+			for i := 0; i < 5; i++ {
+				request("/login", strconv.Itoa(i))
+				request("/search", strconv.Itoa(i%2))
+			}
+			filter.add(new(message.Message))
+
+			c.Specify("estimates each key", func() {
+				msg := new(message.Message)
+				filter.summarize(msg, time.Unix(3600, 0))
+				c.Expect(msg.GetType(), gs.Equals, "heka.cardinality")
+				c.Expect(msg.GetPayload(), gs.Equals, "/login\t5\n/search\t2\n")
+				keys := msg.FindFirstField("Keys")
+				c.Expect(keys.ValueString, gs.ContainsInOrder,
+					[]string{"/login", "/search"})
+				estimates := msg.FindFirstField("Estimates")
+				c.Expect(estimates.ValueInteger, gs.ContainsInOrder, []int64{5, 2})
+			})
+
+			c.Specify("drops the values of keys past the maximum", func() {
+				filter.conf.MaxKeys = 2
+				request("/logout", "1")
+				c.Expect(len(filter.state.Sketches), gs.Equals, 2)
+				c.Expect(filter.droppedKeys, gs.Equals, int64(1))
+			})
+
+			c.Specify("restores its sketches after a restart", func() {
+				err := filter.state.save(filter.statePath)
+				c.Assume(err, gs.IsNil)
+				c.Expect(filter.statePath, gs.Equals,
+					filepath.Join(tmpDir, "cardinality", "UniqueUsers.json"))
+
+				restarted, config := newFilter()
+				err = restarted.Init(config)
+				c.Assume(err, gs.IsNil)
+				c.Expect(restarted.state.Start, gs.Equals, filter.state.Start)
+				c.Expect(restarted.state.Sketches["/login"].estimate(), gs.Equals,
+					uint64(5))
+
+				c.Specify("unless the precision changed", func() {
+					restarted, config := newFilter()
+					config.Precision = 10
+					err = restarted.Init(config)
+					c.Assume(err, gs.IsNil)
+					c.Expect(len(restarted.state.Sketches), gs.Equals, 0)
+				})
+			})
+		})
+	})
+}
@@ -0,0 +1,248 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/bbangert/toml"
+	"github.com/mozilla-services/heka/message"
+)
+
+const (
+	// Name of the config section declaring filter chains.
+	HEKA_CHAINS = "heka_chains"
+	// Name of the field Heka sets on messages injected by a chained filter
+	// to the name of that filter, so the chain's next stages receive them.
+	CHAIN_FIELD = "heka_chain"
+)
+
+// Filter chains, declared as lists of plugin names in the `heka_chains`
+// config section, e.g. `errors = ["ErrorFilter", "RateFilter", "AlertOutput"]`.
+// Every stage after the first receives the messages injected by the stages
+// preceding it in any chain, w/o needing a message_matcher of its own.
+type filterChains struct {
+	chains map[string][]string
+	// Stages each chained plugin follows, in any of the chains.
+	predecessors map[string][]string
+	// Stages each chained plugin precedes, in any of the chains.
+	successors map[string][]string
+	// Plugins left out of the config by their `roles`.
+	disabled map[string]bool
+}
+
+func newFilterChains() *filterChains {
+	return &filterChains{
+		chains:       make(map[string][]string),
+		predecessors: make(map[string][]string),
+		successors:   make(map[string][]string),
+		disabled:     make(map[string]bool),
+	}
+}
+
+// Adds the chains declared in a `heka_chains` section.
+func (fc *filterChains) addSection(section toml.Primitive) error {
+	var chains map[string][]string
+	if err := toml.PrimitiveDecode(section, &chains); err != nil {
+		return fmt.Errorf("can't decode %s: %s", HEKA_CHAINS, err)
+	}
+	for name, stages := range chains {
+		if _, ok := fc.chains[name]; ok {
+			return fmt.Errorf("chain '%s' is declared more than once", name)
+		}
+		if len(stages) < 2 {
+			return fmt.Errorf("chain '%s' needs at least two stages", name)
+		}
+		fc.chains[name] = stages
+		for i := 1; i < len(stages); i++ {
+			fc.addLink(stages[i-1], stages[i])
+		}
+	}
+	return nil
+}
+
+func (fc *filterChains) addLink(from, to string) {
+	for _, s := range fc.successors[from] {
+		if s == to {
+			// Already linked by another chain.
+			return
+		}
+	}
+	fc.successors[from] = append(fc.successors[from], to)
+	fc.predecessors[to] = append(fc.predecessors[to], from)
+}
+
+// Marks a plugin as left out of the config by its `roles`, so the chains it's
+// a stage of are dropped rather than failing validation.
+func (fc *filterChains) disable(name string) {
+	fc.disabled[name] = true
+}
+
+// Drops the chains w/ a disabled stage.
+func (fc *filterChains) prune() {
+	if len(fc.disabled) == 0 {
+		return
+	}
+	chains := fc.chains
+	fc.chains = make(map[string][]string)
+	fc.predecessors = make(map[string][]string)
+	fc.successors = make(map[string][]string)
+	for name, stages := range chains {
+		var disabled string
+		for _, stage := range stages {
+			if fc.disabled[stage] {
+				disabled = stage
+				break
+			}
+		}
+		if disabled != "" {
+			LogInfo.Printf("Skipping chain '%s', '%s' isn't in this hekad's roles\n",
+				name, disabled)
+			continue
+		}
+		fc.chains[name] = stages
+		for i := 1; i < len(stages); i++ {
+			fc.addLink(stages[i-1], stages[i])
+		}
+	}
+}
+
+// Checks that the chains are made of configured filters, w/ an output only
+// as the last stage, that no chained filter uses `route_to`, which would
+// bypass its successors' matchers, and that no chain loops back on itself.
+func (fc *filterChains) validate(makersByCategory map[string][]PluginMaker) error {
+	fc.prune()
+	categories := make(map[string]string)
+	routed := make(map[string]bool)
+	for _, category := range []string{"Filter", "Output"} {
+		for _, maker := range makersByCategory[category] {
+			categories[maker.Name()] = category
+			if category != "Filter" {
+				continue
+			}
+			common, err := maker.(*pluginMaker).PrepCommonTypedConfig()
+			if err == nil && len(common.(CommonFOConfig).RouteTo) > 0 {
+				routed[maker.Name()] = true
+			}
+		}
+	}
+
+	names := make([]string, 0, len(fc.chains))
+	for name := range fc.chains {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		stages := fc.chains[name]
+		for i, stage := range stages {
+			category, ok := categories[stage]
+			if !ok {
+				return fmt.Errorf("chain '%s' has unknown filter or output '%s'", name,
+					stage)
+			}
+			if i == len(stages)-1 {
+				continue
+			}
+			if category != "Filter" {
+				return fmt.Errorf("chain '%s' has output '%s' before its last stage",
+					name, stage)
+			}
+			if routed[stage] {
+				return fmt.Errorf("chain '%s' has filter '%s' w/ a route_to setting",
+					name, stage)
+			}
+		}
+	}
+	return fc.checkCycles()
+}
+
+// Fails if following the stages' successors can lead back to a stage, i.e.
+// a filter would be fed its own injected messages.
+func (fc *filterChains) checkCycles() error {
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := make(map[string]int)
+	var visit func(stage string, path []string) error
+	visit = func(stage string, path []string) error {
+		path = append(path, stage)
+		switch state[stage] {
+		case visiting:
+			return fmt.Errorf("filter chains form a loop: %s", strings.Join(path, " -> "))
+		case done:
+			return nil
+		}
+		state[stage] = visiting
+		for _, next := range fc.successors[stage] {
+			if err := visit(next, path); err != nil {
+				return err
+			}
+		}
+		state[stage] = done
+		return nil
+	}
+
+	stages := make([]string, 0, len(fc.successors))
+	for stage := range fc.successors {
+		stages = append(stages, stage)
+	}
+	sort.Strings(stages)
+	for _, stage := range stages {
+		if err := visit(stage, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the message_matcher of a plugin, extended to match the messages
+// injected by the stages it follows in any chain.
+func (fc *filterChains) matcher(name, matcher string) string {
+	preds := fc.predecessors[name]
+	if len(preds) == 0 {
+		return matcher
+	}
+	clauses := make([]string, len(preds))
+	for i, pred := range preds {
+		clauses[i] = fmt.Sprintf("Fields[%s] == \"%s\"", CHAIN_FIELD, pred)
+	}
+	chained := strings.Join(clauses, " || ")
+	if matcher == "" {
+		return chained
+	}
+	return fmt.Sprintf("(%s) || (%s)", matcher, chained)
+}
+
+// Sets the chain field of a message injected by a chained filter, so it
+// moves on to the filter's successors. Messages injected by the last stage
+// of a chain lose the field, so they're routed normally even if the filter
+// copied its input's fields.
+func (fc *filterChains) tag(msg *message.Message, filter string) {
+	_, isPred := fc.successors[filter]
+	_, isSucc := fc.predecessors[filter]
+	if !isPred && !isSucc {
+		// Not chained, so the field is left alone.
+		return
+	}
+	for _, field := range msg.FindAllFields(CHAIN_FIELD) {
+		msg.DeleteField(field)
+	}
+	if isPred {
+		message.NewStringField(msg, CHAIN_FIELD, filter)
+	}
+}
@@ -0,0 +1,178 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+var chainsTestPlugins = `
+[ErrorFilter]
+type = "CounterFilter"
+message_matcher = "Severity < 4"
+
+[RateFilter]
+type = "CounterFilter"
+
+[SummaryFilter]
+type = "CounterFilter"
+message_matcher = "Type == 'heka.summary'"
+
+[RoutedFilter]
+type = "CounterFilter"
+message_matcher = "TRUE"
+route_to = ["StoppingOutput"]
+
+[StoppingOutput]
+encoder = "ProtobufEncoder"
+`
+
+func FilterChainsSpec(c gs.Context) {
+	RegisterPlugin("StoppingOutput", func() interface{} {
+		return new(StoppingOutput)
+	})
+
+	tmpDir, err := ioutil.TempDir("", "chains-tests")
+	c.Assume(err, gs.IsNil)
+	defer os.RemoveAll(tmpDir)
+
+	loadChains := func(chains string) (*PipelineConfig, error) {
+		configPath := filepath.Join(tmpDir, "config.toml")
+		config := chainsTestPlugins + "\n[heka_chains]\n" + chains
+		err := ioutil.WriteFile(configPath, []byte(config), 0644)
+		c.Assume(err, gs.IsNil)
+		pConfig := NewPipelineConfig(nil)
+		err = pConfig.PreloadFromConfigFile(configPath)
+		c.Assume(err, gs.IsNil)
+		if pConfig.errcnt != 0 {
+			return pConfig, errors.New(pConfig.LogMsgs[0])
+		}
+		return pConfig, pConfig.chains.validate(pConfig.makersByCategory)
+	}
+
+	c.Specify("Filter chains", func() {
+		c.Specify("extend their stages' matchers", func() {
+			pConfig, err := loadChains(`
+errors = ["ErrorFilter", "RateFilter", "StoppingOutput"]
+summary = ["SummaryFilter", "RateFilter"]
+`)
+			c.Assume(err, gs.IsNil)
+			chains := pConfig.chains
+
+			c.Expect(chains.matcher("ErrorFilter", "Severity < 4"), gs.Equals,
+				"Severity < 4")
+			rate := chains.matcher("RateFilter", "")
+			c.Expect(strings.Contains(rate, `Fields[heka_chain] == "ErrorFilter"`),
+				gs.IsTrue)
+			c.Expect(strings.Contains(rate, `Fields[heka_chain] == "SummaryFilter"`),
+				gs.IsTrue)
+			c.Expect(chains.matcher("StoppingOutput", "Type == 'foo'"), gs.Equals,
+				`(Type == 'foo') || (Fields[heka_chain] == "RateFilter")`)
+
+			for _, maker := range pConfig.makersByCategory["Filter"] {
+				if maker.Name() != "RateFilter" {
+					continue
+				}
+				runner, err := maker.MakeRunner("")
+				c.Assume(err, gs.IsNil)
+				c.Expect(runner.(*foRunner).config.Matcher, gs.Equals, rate)
+			}
+		})
+
+		c.Specify("tag the messages injected by their stages", func() {
+			pConfig, err := loadChains(`
+errors = ["ErrorFilter", "RateFilter", "StoppingOutput"]
+`)
+			c.Assume(err, gs.IsNil)
+			msg := ts.GetTestMessage()
+
+			pConfig.chains.tag(msg, "ErrorFilter")
+			value, _ := msg.GetFieldValue(CHAIN_FIELD)
+			c.Expect(value, gs.Equals, "ErrorFilter")
+
+			// Copied fields are replaced rather than duplicated.
+			pConfig.chains.tag(msg, "RateFilter")
+			c.Expect(len(msg.FindAllFields(CHAIN_FIELD)), gs.Equals, 1)
+			value, _ = msg.GetFieldValue(CHAIN_FIELD)
+			c.Expect(value, gs.Equals, "RateFilter")
+
+			// Unchained filters leave the field alone.
+			pConfig.chains.tag(msg, "SummaryFilter")
+			value, _ = msg.GetFieldValue(CHAIN_FIELD)
+			c.Expect(value, gs.Equals, "RateFilter")
+		})
+
+		c.Specify("untag the messages injected by their last filter", func() {
+			pConfig, err := loadChains(`
+errors = ["ErrorFilter", "RateFilter"]
+`)
+			c.Assume(err, gs.IsNil)
+			msg := ts.GetTestMessage()
+			pConfig.chains.tag(msg, "ErrorFilter")
+			pConfig.chains.tag(msg, "RateFilter")
+			c.Expect(msg.FindFirstField(CHAIN_FIELD), gs.IsNil)
+		})
+
+		c.Specify("are graphed", func() {
+			pConfig, err := loadChains(`
+errors = ["ErrorFilter", "RateFilter", "StoppingOutput"]
+`)
+			c.Assume(err, gs.IsNil)
+			graph, err := pConfig.Graph()
+			c.Assume(err, gs.IsNil)
+			var chained []string
+			for _, edge := range graph.Edges {
+				if edge.Label == "chain" {
+					chained = append(chained, edge.From+">"+edge.To)
+				}
+			}
+			c.Expect(strings.Join(chained, ","), gs.Equals,
+				"ErrorFilter>RateFilter,RateFilter>StoppingOutput")
+		})
+
+		c.Specify("can't loop", func() {
+			_, err := loadChains(`
+one = ["ErrorFilter", "RateFilter", "SummaryFilter"]
+two = ["SummaryFilter", "ErrorFilter"]
+`)
+			c.Expect(err, gs.Not(gs.IsNil))
+			c.Expect(strings.Contains(err.Error(), "loop"), gs.IsTrue)
+
+			_, err = loadChains(`self = ["ErrorFilter", "ErrorFilter"]`)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("are validated", func() {
+			_, err := loadChains(`short = ["ErrorFilter"]`)
+			c.Expect(err, gs.Not(gs.IsNil))
+
+			_, err = loadChains(`unknown = ["ErrorFilter", "NoSuchFilter"]`)
+			c.Expect(err, gs.Not(gs.IsNil))
+
+			_, err = loadChains(`output = ["ErrorFilter", "StoppingOutput", "RateFilter"]`)
+			c.Expect(err, gs.Not(gs.IsNil))
+
+			_, err = loadChains(`routed = ["RoutedFilter", "RateFilter"]`)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+}
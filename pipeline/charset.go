@@ -0,0 +1,89 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+)
+
+// Source charsets payloads can be transcoded from, by lower cased name.
+var charsets = map[string]encoding.Encoding{
+	"latin-1":      charmap.ISO8859_1,
+	"latin1":       charmap.ISO8859_1,
+	"iso-8859-1":   charmap.ISO8859_1,
+	"iso-8859-15":  charmap.ISO8859_15,
+	"windows-1252": charmap.Windows1252,
+	"cp1252":       charmap.Windows1252,
+	"shift-jis":    japanese.ShiftJIS,
+	"shift_jis":    japanese.ShiftJIS,
+	"sjis":         japanese.ShiftJIS,
+	"euc-jp":       japanese.EUCJP,
+}
+
+// Makes sure the payloads an input feeds into the pipeline are valid UTF-8,
+// transcoding them from the `charset` set for the input or its decoder.
+type payloadTranscoder struct {
+	// Nil if payloads are only validated.
+	encoding encoding.Encoding
+}
+
+// Returns the transcoder for the charset, or nil if it's empty. A "utf-8"
+// charset only validates the payloads.
+func newPayloadTranscoder(charset string) (*payloadTranscoder, error) {
+	name := strings.ToLower(charset)
+	switch name {
+	case "":
+		return nil, nil
+	case "utf-8", "utf8":
+		return &payloadTranscoder{}, nil
+	}
+	enc, ok := charsets[name]
+	if !ok {
+		return nil, fmt.Errorf("unsupported charset '%s'", charset)
+	}
+	return &payloadTranscoder{encoding: enc}, nil
+}
+
+// Transcodes the pack's payload unless it's already valid UTF-8, so inputs
+// mixing UTF-8 w/ a legacy charset come out right. Whatever still isn't valid
+// is replaced w/ U+FFFD.
+func (t *payloadTranscoder) transcode(pack *PipelinePack) {
+	payload := pack.Message.GetPayload()
+	if utf8.ValidString(payload) {
+		return
+	}
+	if t.encoding != nil {
+		if decoded, err := t.encoding.NewDecoder().String(payload); err == nil {
+			payload = decoded
+		}
+	}
+	pack.Message.SetPayload(replaceInvalidUTF8(payload))
+	pack.TrustMsgBytes = false
+}
+
+// Returns the string w/ each invalid UTF-8 byte replaced by U+FFFD.
+func replaceInvalidUTF8(s string) string {
+	if utf8.ValidString(s) {
+		return s
+	}
+	// Converting to runes decodes each invalid byte as RuneError.
+	return string([]rune(s))
+}
@@ -0,0 +1,62 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func CharsetSpec(c gs.Context) {
+	pack := NewPipelinePack(nil)
+	transcode := func(charset, payload string) string {
+		t, err := newPayloadTranscoder(charset)
+		c.Assume(err, gs.IsNil)
+		pack.Message.SetPayload(payload)
+		pack.TrustMsgBytes = true
+		t.transcode(pack)
+		return pack.Message.GetPayload()
+	}
+
+	c.Specify("Charsets", func() {
+		c.Specify("aren't applied unless set", func() {
+			t, err := newPayloadTranscoder("")
+			c.Expect(err, gs.IsNil)
+			c.Expect(t == nil, gs.IsTrue)
+		})
+
+		c.Specify("must be supported", func() {
+			_, err := newPayloadTranscoder("ebcdic")
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("leave valid UTF-8 payloads alone", func() {
+			c.Expect(transcode("latin-1", "héka"), gs.Equals, "héka")
+			c.Expect(pack.TrustMsgBytes, gs.IsTrue)
+		})
+
+		c.Specify("replace invalid sequences when validating UTF-8", func() {
+			c.Expect(transcode("utf-8", "h\xffeka"), gs.Equals, "h�eka")
+			c.Expect(pack.TrustMsgBytes, gs.IsFalse)
+		})
+
+		c.Specify("transcode latin-1 payloads", func() {
+			c.Expect(transcode("ISO-8859-1", "caf\xe9"), gs.Equals, "café")
+		})
+
+		c.Specify("transcode shift-jis payloads", func() {
+			c.Expect(transcode("shift-jis", "\x93\xfa\x96\x7b"), gs.Equals, "日本")
+		})
+	})
+}
@@ -0,0 +1,252 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Source of the current time and of the timers and tickers Heka waits on.
+// The plugin runners, their RetryHelpers and the plugins that enforce
+// timeouts use the Clock in the GlobalConfigStruct, which tests can replace
+// w/ a MockClock to control when tickers fire and timeouts expire.
+type Clock interface {
+	Now() time.Time
+	// Like time.After.
+	After(d time.Duration) <-chan time.Time
+	// Like time.NewTimer.
+	NewTimer(d time.Duration) Timer
+	// Like time.NewTicker.
+	NewTicker(d time.Duration) Ticker
+	// Like time.Sleep.
+	Sleep(d time.Duration)
+}
+
+// A single event, like a time.Timer.
+type Timer interface {
+	Chan() <-chan time.Time
+	Stop() bool
+}
+
+// Repeated events, like a time.Ticker.
+type Ticker interface {
+	Chan() <-chan time.Time
+	Stop()
+}
+
+// The Clock backed by the time package.
+var RealClock Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+func (realClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) Chan() <-chan time.Time {
+	return t.C
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) Chan() <-chan time.Time {
+	return t.C
+}
+
+// A Clock whose time only moves when Add is called, which fires the timers
+// and tickers that are due by then. Lets tests drive tickers, retry backoff
+// and timeouts w/o waiting on, or racing against, the real time.
+type MockClock struct {
+	lock    sync.Mutex
+	changed *sync.Cond
+	now     time.Time
+	waiters []*mockWaiter
+}
+
+// A timer or ticker waiting on a MockClock. Like the time package's, their
+// channels hold a single event, further events are dropped until it's
+// received.
+type mockWaiter struct {
+	at     time.Time
+	period time.Duration // 0 for timers.
+	c      chan time.Time
+}
+
+// Creates a MockClock set to now.
+func NewMockClock(now time.Time) *MockClock {
+	m := &MockClock{now: now}
+	m.changed = sync.NewCond(&m.lock)
+	return m
+}
+
+func (m *MockClock) Now() time.Time {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.now
+}
+
+func (m *MockClock) After(d time.Duration) <-chan time.Time {
+	return m.NewTimer(d).Chan()
+}
+
+func (m *MockClock) NewTimer(d time.Duration) Timer {
+	return &mockTimer{m, m.wait(d, 0)}
+}
+
+func (m *MockClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for MockClock.NewTicker")
+	}
+	return &mockTicker{m, m.wait(d, d)}
+}
+
+// Blocks until the clock has been advanced by d.
+func (m *MockClock) Sleep(d time.Duration) {
+	<-m.After(d)
+}
+
+func (m *MockClock) wait(d, period time.Duration) *mockWaiter {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	w := &mockWaiter{
+		at:     m.now.Add(d),
+		period: period,
+		c:      make(chan time.Time, 1),
+	}
+	if d <= 0 {
+		// Due already, like a time.Timer.
+		w.c <- m.now
+		return w
+	}
+	m.waiters = append(m.waiters, w)
+	m.changed.Broadcast()
+	return w
+}
+
+// Removes the waiter, returns whether it was still waiting.
+func (m *MockClock) stop(w *mockWaiter) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for i, waiting := range m.waiters {
+		if waiting == w {
+			m.waiters = append(m.waiters[:i], m.waiters[i+1:]...)
+			m.changed.Broadcast()
+			return true
+		}
+	}
+	return false
+}
+
+type mockWaitersByTime []*mockWaiter
+
+func (s mockWaitersByTime) Len() int           { return len(s) }
+func (s mockWaitersByTime) Less(i, j int) bool { return s[i].at.Before(s[j].at) }
+func (s mockWaitersByTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// Moves the clock forward by d, firing the timers and tickers due by then in
+// the order they're due. A ticker fires once for each of its intervals that
+// has passed, of which its channel only holds the first that isn't received.
+func (m *MockClock) Add(d time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	until := m.now.Add(d)
+	for len(m.waiters) > 0 {
+		sort.Stable(mockWaitersByTime(m.waiters))
+		w := m.waiters[0]
+		if w.at.After(until) {
+			break
+		}
+		m.now = w.at
+		select {
+		case w.c <- m.now:
+		default:
+		}
+		if w.period > 0 {
+			w.at = w.at.Add(w.period)
+		} else {
+			m.waiters = m.waiters[1:]
+		}
+	}
+	m.now = until
+	m.changed.Broadcast()
+}
+
+// Blocks until at least n timers and tickers are waiting on the clock. Tests
+// call it before Add to be sure the code under test has started waiting, and
+// won't miss the events it's waiting for.
+func (m *MockClock) BlockUntil(n int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for len(m.waiters) < n {
+		m.changed.Wait()
+	}
+}
+
+// Returns the number of timers and tickers waiting on the clock.
+func (m *MockClock) Waiters() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.waiters)
+}
+
+type mockTimer struct {
+	clock  *MockClock
+	waiter *mockWaiter
+}
+
+func (t *mockTimer) Chan() <-chan time.Time {
+	return t.waiter.c
+}
+
+func (t *mockTimer) Stop() bool {
+	return t.clock.stop(t.waiter)
+}
+
+type mockTicker struct {
+	clock  *MockClock
+	waiter *mockWaiter
+}
+
+func (t *mockTicker) Chan() <-chan time.Time {
+	return t.waiter.c
+}
+
+func (t *mockTicker) Stop() {
+	t.clock.stop(t.waiter)
+}
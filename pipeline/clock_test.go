@@ -0,0 +1,145 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"time"
+
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func ClockSpec(c gs.Context) {
+	start := time.Date(2016, 3, 12, 23, 59, 30, 0, time.UTC)
+	clock := NewMockClock(start)
+
+	received := func(ch <-chan time.Time) (t time.Time, ok bool) {
+		select {
+		case t = <-ch:
+			return t, true
+		default:
+			return t, false
+		}
+	}
+
+	c.Specify("A MockClock", func() {
+		c.Specify("only moves when it's advanced", func() {
+			c.Expect(clock.Now(), gs.Equals, start)
+			clock.Add(time.Minute)
+			c.Expect(clock.Now(), gs.Equals, start.Add(time.Minute))
+		})
+
+		c.Specify("fires timers once they're due", func() {
+			after := clock.After(time.Second)
+			timer := clock.NewTimer(2 * time.Second)
+			c.Expect(clock.Waiters(), gs.Equals, 2)
+
+			clock.Add(999 * time.Millisecond)
+			_, ok := received(after)
+			c.Expect(ok, gs.IsFalse)
+
+			clock.Add(time.Millisecond)
+			t, ok := received(after)
+			c.Expect(ok, gs.IsTrue)
+			c.Expect(t, gs.Equals, start.Add(time.Second))
+			_, ok = received(timer.Chan())
+			c.Expect(ok, gs.IsFalse)
+			c.Expect(clock.Waiters(), gs.Equals, 1)
+
+			clock.Add(time.Hour)
+			t, ok = received(timer.Chan())
+			c.Expect(ok, gs.IsTrue)
+			c.Expect(t, gs.Equals, start.Add(2*time.Second))
+			c.Expect(timer.Stop(), gs.IsFalse)
+			c.Expect(clock.Waiters(), gs.Equals, 0)
+		})
+
+		c.Specify("doesn't fire stopped timers", func() {
+			timer := clock.NewTimer(time.Second)
+			c.Expect(timer.Stop(), gs.IsTrue)
+			clock.Add(time.Second)
+			_, ok := received(timer.Chan())
+			c.Expect(ok, gs.IsFalse)
+		})
+
+		c.Specify("fires timers w/o a duration right away", func() {
+			_, ok := received(clock.After(0))
+			c.Expect(ok, gs.IsTrue)
+			c.Expect(clock.Waiters(), gs.Equals, 0)
+		})
+
+		c.Specify("fires tickers at each interval, dropping unreceived ticks", func() {
+			ticker := clock.NewTicker(time.Second)
+			clock.Add(time.Second)
+			t, ok := received(ticker.Chan())
+			c.Expect(ok, gs.IsTrue)
+			c.Expect(t, gs.Equals, start.Add(time.Second))
+
+			clock.Add(3 * time.Second)
+			t, ok = received(ticker.Chan())
+			c.Expect(ok, gs.IsTrue)
+			c.Expect(t, gs.Equals, start.Add(2*time.Second))
+			_, ok = received(ticker.Chan())
+			c.Expect(ok, gs.IsFalse)
+
+			ticker.Stop()
+			clock.Add(time.Second)
+			_, ok = received(ticker.Chan())
+			c.Expect(ok, gs.IsFalse)
+		})
+
+		c.Specify("wakes sleepers", func() {
+			woke := make(chan time.Time)
+			go func() {
+				clock.Sleep(time.Minute)
+				woke <- clock.Now()
+			}()
+			clock.BlockUntil(1)
+			clock.Add(time.Minute)
+			c.Expect(<-woke, gs.Equals, start.Add(time.Minute))
+		})
+	})
+
+	c.Specify("A RetryHelper waits on its clock", func() {
+		rh, err := NewRetryHelper(RetryOptions{
+			Delay:      "10ms",
+			MaxDelay:   "25ms",
+			MaxJitter:  "1ns", // I.e. none.
+			MaxRetries: 3,
+		})
+		c.Assume(err, gs.IsNil)
+		rh.SetClock(clock)
+
+		waitFor := func(expected time.Duration) {
+			done := make(chan error)
+			go func() {
+				done <- rh.Wait()
+			}()
+			clock.BlockUntil(1)
+			clock.Add(expected - time.Millisecond)
+			c.Expect(clock.Waiters(), gs.Equals, 1)
+			clock.Add(time.Millisecond)
+			c.Expect(<-done, gs.IsNil)
+		}
+
+		// Backs off exponentially, up to the maximum delay.
+		waitFor(10 * time.Millisecond)
+		waitFor(20 * time.Millisecond)
+		waitFor(25 * time.Millisecond)
+		c.Expect(rh.Wait(), gs.Equals, ErrMaxRetriesExceeded)
+
+		rh.Reset()
+		waitFor(10 * time.Millisecond)
+	})
+}
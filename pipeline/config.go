@@ -134,6 +134,9 @@ type PipelineConfig struct {
 	// PipelinePack supply for Filter plugins (separate pool prevents
 	// deadlocks).
 	injectRecycleChan chan *PipelinePack
+	// Pools managing the packs on the input and inject recycle channels.
+	inputPool  *packPool
+	injectPool *packPool
 	// Stores log messages generated by plugin config errors.
 	LogMsgs []string
 	// Lock protecting access to the set of running filters so dynamic filters
@@ -176,6 +179,23 @@ type PipelineConfig struct {
 	outputsLock sync.RWMutex
 	// Internal reporting channel.
 	reportRecycleChan chan *PipelinePack
+	// Filter chains declared in the `heka_chains` config sections.
+	chains *filterChains
+	// Router rules declared in the `heka_rules` config sections.
+	rules *routerRules
+	// Samples packs for tracing, according to the trace_sample_rate settings.
+	tracer *tracer
+	// Tracks the disk usage of the queue buffers.
+	bufferQuota *bufferQuota
+	// Logs the messages injected by the filters, if `inject_wal` is set.
+	injectWal *injectWal
+	// Where the state snapshot requested through the admin API is written
+	// once the pipeline has shut down.
+	snapshotPath string
+	snapshotLock sync.Mutex
+	// Set once the admin API has started the hekad this one is upgraded to.
+	upgraded    bool
+	upgradeLock sync.Mutex
 
 	// The next few values are used only during the initial configuration
 	// loading process.
@@ -195,6 +215,9 @@ func NewPipelineConfig(globals *GlobalConfigStruct) (config *PipelineConfig) {
 	if globals == nil {
 		globals = DefaultGlobals()
 	}
+	if globals.Clock == nil {
+		globals.Clock = RealClock
+	}
 	config.Globals = globals
 	config.makers = make(map[string]map[string]PluginMaker)
 	config.makers["Input"] = make(map[string]PluginMaker)
@@ -211,8 +234,14 @@ func NewPipelineConfig(globals *GlobalConfigStruct) (config *PipelineConfig) {
 
 	config.allEncoders = make(map[string]Encoder)
 	config.router = NewMessageRouter(globals.PluginChanSize, globals.abortChan)
-	config.inputRecycleChan = make(chan *PipelinePack, globals.PoolSize)
-	config.injectRecycleChan = make(chan *PipelinePack, globals.PoolSize)
+	config.router.maxHops = globals.MaxHops
+	config.router.sharePredicates = globals.ShareMatcherPredicates
+	min, max := globals.inputPoolBounds()
+	config.inputPool = newPackPool("input", min, max, globals.PoolShrinkInterval)
+	config.inputRecycleChan = config.inputPool.recycleChan
+	min, max = globals.injectPoolBounds()
+	config.injectPool = newPackPool("inject", min, max, globals.PoolShrinkInterval)
+	config.injectRecycleChan = config.injectPool.recycleChan
 	config.LogMsgs = make([]string, 0, 4)
 	config.allDecoders = make([]DecoderRunner, 0, 10)
 	config.allSyncDecoders = make([]ReportingDecoder, 0, 10)
@@ -220,6 +249,11 @@ func NewPipelineConfig(globals *GlobalConfigStruct) (config *PipelineConfig) {
 	config.hostname = globals.Hostname
 	config.pid = int32(os.Getpid())
 	config.reportRecycleChan = make(chan *PipelinePack, 1)
+	config.chains = newFilterChains()
+	config.rules = newRouterRules()
+	config.router.rules = config.rules
+	config.tracer = newTracer(config)
+	config.bufferQuota = newBufferQuota(config)
 
 	return config
 }
@@ -228,12 +262,20 @@ func NewPipelineConfig(globals *GlobalConfigStruct) (config *PipelineConfig) {
 // objects they are holding. Returns a PipelinePack for injection into Heka
 // pipeline, or nil if the msgLoopCount is above the configured maximum.
 func (self *PipelineConfig) PipelinePack(msgLoopCount uint) (*PipelinePack, error) {
+	return self.packFromChan(msgLoopCount, self.injectRecycleChan)
+}
+
+// Fetches a pack from the provided recycle channel and initializes it for
+// injection.
+func (self *PipelineConfig) packFromChan(msgLoopCount uint,
+	recycleChan chan *PipelinePack) (*PipelinePack, error) {
+
 	if msgLoopCount++; msgLoopCount > self.Globals.MaxMsgLoops {
 		return nil, fmt.Errorf("exceeded MaxMsgLoops = %d", self.Globals.MaxMsgLoops)
 	}
 	var pack *PipelinePack
 	select {
-	case pack = <-self.injectRecycleChan:
+	case pack = <-recycleChan:
 	case <-self.Globals.abortChan:
 		return nil, AbortError
 	}
@@ -246,6 +288,40 @@ func (self *PipelineConfig) PipelinePack(msgLoopCount uint) (*PipelinePack, erro
 	return pack, nil
 }
 
+// Records the snapshot request, returning false if one was already made.
+func (self *PipelineConfig) requestSnapshot(path string) bool {
+	self.snapshotLock.Lock()
+	defer self.snapshotLock.Unlock()
+	if self.snapshotPath != "" {
+		return false
+	}
+	self.snapshotPath = path
+	return true
+}
+
+// Returns the path the base dir's state should be archived to now that Run
+// has returned, or "" if no snapshot was requested through the admin API.
+func (self *PipelineConfig) SnapshotPath() string {
+	self.snapshotLock.Lock()
+	defer self.snapshotLock.Unlock()
+	return self.snapshotPath
+}
+
+// Starts the hekad binary this one is upgraded to, see startUpgrade,
+// returning its pid, or 0 if one was already started.
+func (self *PipelineConfig) upgrade() (int, error) {
+	self.upgradeLock.Lock()
+	defer self.upgradeLock.Unlock()
+	if self.upgraded {
+		return 0, nil
+	}
+	pid, err := startUpgrade()
+	if err == nil {
+		self.upgraded = true
+	}
+	return pid, err
+}
+
 // Returns the router.
 func (self *PipelineConfig) Router() MessageRouter {
 	return self.router
@@ -303,6 +379,14 @@ func (self *PipelineConfig) Decoder(name string) (decoder Decoder, ok bool) {
 func (self *PipelineConfig) DecoderRunner(baseName, fullName string) (
 	dRunner DecoderRunner, ok bool) {
 
+	return self.startDecoderRunner(baseName, fullName, nil)
+}
+
+// Like DecoderRunner, but calls setup (if provided) w/ the new runner before
+// it's started.
+func (self *PipelineConfig) startDecoderRunner(baseName, fullName string,
+	setup func(dr *dRunner)) (runner DecoderRunner, ok bool) {
+
 	self.makersLock.RLock()
 	var maker PluginMaker
 	if maker, ok = self.DecoderMakers[baseName]; !ok {
@@ -310,18 +394,21 @@ func (self *PipelineConfig) DecoderRunner(baseName, fullName string) (
 		return
 	}
 
-	runner, err := maker.MakeRunner(fullName)
+	pRunner, err := maker.MakeRunner(fullName)
 	self.makersLock.RUnlock()
 	if err != nil {
 		return nil, false
 	}
 
-	dRunner = runner.(DecoderRunner)
+	runner = pRunner.(DecoderRunner)
+	if setup != nil {
+		setup(pRunner.(*dRunner))
+	}
 	self.allDecodersLock.Lock()
-	self.allDecoders = append(self.allDecoders, dRunner)
+	self.allDecoders = append(self.allDecoders, runner)
 	self.allDecodersLock.Unlock()
 	self.decodersWg.Add(1)
-	dRunner.Start(self, &self.decodersWg)
+	runner.Start(self, &self.decodersWg)
 	return
 }
 
@@ -536,10 +623,15 @@ func getPluginCategory(pluginType string) string {
 
 type CommonConfig struct {
 	Typ string `toml:"type"`
+	// Roles the plugin is loaded for, all of them if empty.
+	Roles []string `toml:"roles"`
 }
 
 type CommonInputConfig struct {
 	Ticker             uint `toml:"ticker_interval"`
+	Schedule           string
+	ScheduleTimezone   string `toml:"schedule_timezone"`
+	ScheduleJitter     uint   `toml:"schedule_jitter"`
 	Decoder            string
 	Splitter           string
 	SyncDecode         *bool `toml:"synchronous_decode"`
@@ -547,18 +639,38 @@ type CommonInputConfig struct {
 	LogDecodeFailures  *bool `toml:"log_decode_failures"`
 	CanExit            *bool `toml:"can_exit"`
 	Retries            RetryOptions
+	TraceRate          *float64 `toml:"trace_sample_rate"`
+	DecodeWorkers      uint     `toml:"decode_workers"`
+	PreserveOrder      *bool    `toml:"preserve_decode_order"`
+	// Override the decoder's field limits, if any.
+	FieldLimits *FieldLimitsConfig `toml:"field_limits"`
+	// Override the decoder's charset, if any.
+	Charset string `toml:"charset"`
+}
+
+type CommonDecoderConfig struct {
+	// Apply to the messages decoded for each input using the decoder.
+	FieldLimits *FieldLimitsConfig `toml:"field_limits"`
+	// Charset of the payloads each input using the decoder delivers to it.
+	Charset string `toml:"charset"`
 }
 
 type CommonFOConfig struct {
-	Ticker       uint   `toml:"ticker_interval"`
-	Matcher      string `toml:"message_matcher"`
-	Signer       string `toml:"message_signer"`
-	CanExit      *bool  `toml:"can_exit"`
-	Retries      RetryOptions
-	Encoder      string             // Output only.
-	UseFraming   *bool              `toml:"use_framing"` // Output only.
-	UseBuffering *bool              `toml:"use_buffering"`
-	Buffering    *QueueBufferConfig `toml:"buffering"`
+	Ticker         uint   `toml:"ticker_interval"`
+	Matcher        string `toml:"message_matcher"`
+	Signer         string `toml:"message_signer"`
+	CanExit        *bool  `toml:"can_exit"`
+	Retries        RetryOptions
+	Encoder        string             // Output only.
+	UseFraming     *bool              `toml:"use_framing"` // Output only.
+	UseBuffering   *bool              `toml:"use_buffering"`
+	Buffering      *QueueBufferConfig `toml:"buffering"`
+	LatencyBuckets []uint             `toml:"latency_buckets"`   // Output only.
+	Workers        int                `toml:"workers"`           // Output only.
+	RouteTo        []string           `toml:"route_to"`          // Filter only.
+	PoolSize       int                `toml:"poolsize"`          // Filter only.
+	PoolSizeMax    int                `toml:"poolsize_max"`      // Filter only.
+	TraceRate      *float64           `toml:"trace_sample_rate"` // Filter only.
 }
 
 type CommonSplitterConfig struct {
@@ -577,6 +689,7 @@ func makeDefaultConfigs() map[string]bool {
 		"PatternGroupingSplitter": false,
 		"HekaFramingSplitter":     false,
 		"NullSplitter":            false,
+		"SyslogFramingSplitter":   false,
 	}
 }
 
@@ -637,6 +750,31 @@ func (self *PipelineConfig) PreloadFromConfigFile(filename string) error {
 		if name == HEKA_DAEMON {
 			continue
 		}
+		if name == HEKA_CHAINS {
+			if err = self.chains.addSection(conf); err != nil {
+				self.log(err.Error())
+				self.errcnt++
+			}
+			continue
+		}
+		if name == HEKA_RULES {
+			if err = self.rules.addSection(conf); err != nil {
+				self.log(err.Error())
+				self.errcnt++
+			}
+			continue
+		}
+		if !self.inRoles(conf) {
+			LogInfo.Printf("Skipping: [%s], not in this hekad's roles\n", name)
+			self.chains.disable(name)
+			self.rules.disable(name)
+			continue
+		}
+		if _, err = decryptConfigValues(self.Globals.ConfigKey, name, conf); err != nil {
+			self.log(fmt.Sprintf("Error decrypting config: %s", err))
+			self.errcnt++
+			continue
+		}
 		if _, ok := self.defaultConfigs[name]; ok {
 			self.defaultConfigs[name] = true
 		}
@@ -704,6 +842,17 @@ func (self *PipelineConfig) LoadConfig() error {
 	makersByCategory["Decoder"] = append(makersByCategory["Decoder"],
 		makersByCategory["MultiDecoder"]...)
 
+	// Chains need to be checked before the filters' and outputs' runners are
+	// made, since the chains extend their matchers.
+	if err = self.chains.validate(makersByCategory); err != nil {
+		self.log(err.Error())
+		self.errcnt++
+	}
+	if err = self.rules.validate(makersByCategory); err != nil {
+		self.log(err.Error())
+		self.errcnt++
+	}
+
 	// Force decoders and encoders to be loaded before the other plugin
 	// types are initialized so we know they'll be there for inputs and
 	// outputs to use during initialization.
@@ -755,6 +904,27 @@ func (self *PipelineConfig) LoadConfig() error {
 	return nil
 }
 
+// Whether a plugin's config section applies to any of this hekad's roles.
+// Sections w/o a `roles` setting apply to all of them, as do sections whose
+// common config can't be decoded, so NewPluginMaker reports the error.
+func (self *PipelineConfig) inRoles(section toml.Primitive) bool {
+	var common CommonConfig
+	if err := toml.PrimitiveDecode(section, &common); err != nil {
+		return true
+	}
+	if len(common.Roles) == 0 {
+		return true
+	}
+	for _, role := range common.Roles {
+		for _, hekadRole := range self.Globals.Roles {
+			if role == hekadRole {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func subsFromSection(section toml.Primitive) []string {
 	secMap := section.(map[string]interface{})
 	var subs []string
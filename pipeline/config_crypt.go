@@ -0,0 +1,175 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const (
+	// Prefix of the config string values encrypted w/ EncryptConfigValue.
+	EncryptedValuePrefix = "enc:"
+	// Environment variable holding the config key when neither a key file
+	// nor a key command is configured.
+	ConfigKeyEnv  = "HEKA_CONFIG_KEY"
+	configKeySize = 32
+)
+
+var ErrNoConfigKey = errors.New("no config key configured, see `config_key_file`, " +
+	"`config_key_command` and " + ConfigKeyEnv)
+
+// Generates a new random config key, base64 encoded.
+func NewConfigKey() (string, error) {
+	key := make([]byte, configKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// Loads the base64 encoded key used to decrypt the config values from the
+// key file, or else from the output of the key command (e.g. a KMS client),
+// or else from the HEKA_CONFIG_KEY environment variable. Returns a nil key if
+// none of them is set.
+func LoadConfigKey(keyFile, keyCommand string) (key []byte, err error) {
+	var encoded []byte
+	switch {
+	case keyFile != "":
+		if encoded, err = ioutil.ReadFile(keyFile); err != nil {
+			return nil, fmt.Errorf("can't read config key file: %s", err)
+		}
+	case keyCommand != "":
+		args := strings.Fields(keyCommand)
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stderr = os.Stderr
+		if encoded, err = cmd.Output(); err != nil {
+			return nil, fmt.Errorf("config key command failed: %s", err)
+		}
+	default:
+		if encoded = []byte(os.Getenv(ConfigKeyEnv)); len(encoded) == 0 {
+			return nil, nil
+		}
+	}
+	return decodeConfigKey(strings.TrimSpace(string(encoded)))
+}
+
+func decodeConfigKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("config key isn't base64 encoded: %s", err)
+	}
+	if len(key) != configKeySize {
+		return nil, fmt.Errorf("config key must be %d bytes, got %d", configKeySize,
+			len(key))
+	}
+	return key, nil
+}
+
+func newConfigCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypts a config value w/ AES-256-GCM, returning it base64 encoded w/ the
+// `enc:` prefix, ready to be used as a TOML string value.
+func EncryptConfigValue(key []byte, value string) (string, error) {
+	aead, err := newConfigCipher(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(value), nil)
+	return EncryptedValuePrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypts a config value produced by EncryptConfigValue.
+func DecryptConfigValue(key []byte, value string) (string, error) {
+	if !strings.HasPrefix(value, EncryptedValuePrefix) {
+		return "", errors.New("value isn't encrypted")
+	}
+	if key == nil {
+		return "", ErrNoConfigKey
+	}
+	sealed, err := base64.StdEncoding.DecodeString(value[len(EncryptedValuePrefix):])
+	if err != nil {
+		return "", fmt.Errorf("encrypted value isn't base64 encoded: %s", err)
+	}
+	aead, err := newConfigCipher(key)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("encrypted value is too short")
+	}
+	nonce := sealed[:aead.NonceSize()]
+	plain, err := aead.Open(nil, nonce, sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("can't decrypt value, wrong config key?")
+	}
+	return string(plain), nil
+}
+
+// Replaces the encrypted string values in a decoded config section, including
+// those in nested tables and arrays, w/ their plain text. The errors name the
+// offending setting.
+func decryptConfigValues(key []byte, path string, value interface{}) (interface{}, error) {
+	var err error
+	switch v := value.(type) {
+	case string:
+		if strings.HasPrefix(v, EncryptedValuePrefix) {
+			if v, err = DecryptConfigValue(key, v); err != nil {
+				return nil, fmt.Errorf("%s: %s", path, err)
+			}
+		}
+		return v, nil
+	case map[string]interface{}:
+		for k, elem := range v {
+			if v[k], err = decryptConfigValues(key, path+"."+k, elem); err != nil {
+				return nil, err
+			}
+		}
+	case []map[string]interface{}:
+		for i, elem := range v {
+			if _, err = decryptConfigValues(key, fmt.Sprintf("%s[%d]", path, i),
+				elem); err != nil {
+				return nil, err
+			}
+		}
+	case []interface{}:
+		for i, elem := range v {
+			if v[i], err = decryptConfigValues(key, fmt.Sprintf("%s[%d]", path, i),
+				elem); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return value, nil
+}
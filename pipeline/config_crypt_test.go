@@ -0,0 +1,114 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bbangert/toml"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func ConfigCryptSpec(c gs.Context) {
+	tmpDir, err := ioutil.TempDir("", "configcrypt-tests")
+	c.Assume(err, gs.IsNil)
+	defer os.RemoveAll(tmpDir)
+
+	encodedKey, err := NewConfigKey()
+	c.Assume(err, gs.IsNil)
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	c.Assume(err, gs.IsNil)
+
+	c.Specify("Config encryption", func() {
+		c.Specify("round trips a value", func() {
+			enc, err := EncryptConfigValue(key, "s3cr3t \"quoted\"")
+			c.Expect(err, gs.IsNil)
+			c.Expect(strings.HasPrefix(enc, EncryptedValuePrefix), gs.IsTrue)
+			plain, err := DecryptConfigValue(key, enc)
+			c.Expect(err, gs.IsNil)
+			c.Expect(plain, gs.Equals, "s3cr3t \"quoted\"")
+		})
+
+		c.Specify("fails w/ the wrong key", func() {
+			enc, err := EncryptConfigValue(key, "s3cr3t")
+			c.Expect(err, gs.IsNil)
+			otherKey, err := NewConfigKey()
+			c.Expect(err, gs.IsNil)
+			other, _ := base64.StdEncoding.DecodeString(otherKey)
+			_, err = DecryptConfigValue(other, enc)
+			c.Expect(err, gs.Not(gs.IsNil))
+			_, err = DecryptConfigValue(nil, enc)
+			c.Expect(err, gs.Equals, ErrNoConfigKey)
+		})
+
+		c.Specify("loads the key", func() {
+			keyFile := filepath.Join(tmpDir, "key")
+			err := ioutil.WriteFile(keyFile, []byte(encodedKey+"\n"), 0600)
+			c.Assume(err, gs.IsNil)
+			loaded, err := LoadConfigKey(keyFile, "")
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(loaded), gs.Equals, string(key))
+
+			os.Setenv(ConfigKeyEnv, encodedKey)
+			defer os.Unsetenv(ConfigKeyEnv)
+			loaded, err = LoadConfigKey("", "")
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(loaded), gs.Equals, string(key))
+
+			os.Setenv(ConfigKeyEnv, "c2hvcnQ=")
+			_, err = LoadConfigKey("", "")
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("decrypts the values of a config section", func() {
+			password, err := EncryptConfigValue(key, "s3cr3t")
+			c.Assume(err, gs.IsNil)
+			token, err := EncryptConfigValue(key, "t0k3n")
+			c.Assume(err, gs.IsNil)
+			config := fmt.Sprintf(`[TestOutput]
+password = "%s"
+username = "heka"
+tokens = ["%s"]
+[TestOutput.headers]
+auth = "%s"
+`, password, token, token)
+
+			var configFile ConfigFile
+			_, err = toml.Decode(config, &configFile)
+			c.Assume(err, gs.IsNil)
+			_, err = decryptConfigValues(key, "TestOutput", configFile["TestOutput"])
+			c.Expect(err, gs.IsNil)
+			section := configFile["TestOutput"].(map[string]interface{})
+			c.Expect(section["password"], gs.Equals, "s3cr3t")
+			c.Expect(section["username"], gs.Equals, "heka")
+			c.Expect(section["tokens"].([]interface{})[0], gs.Equals, "t0k3n")
+			headers := section["headers"].(map[string]interface{})
+			c.Expect(headers["auth"], gs.Equals, "t0k3n")
+
+			c.Specify("and names the setting it can't decrypt", func() {
+				_, err = toml.Decode(config, &configFile)
+				c.Assume(err, gs.IsNil)
+				_, err = decryptConfigValues(nil, "TestOutput", configFile["TestOutput"])
+				c.Expect(err, gs.Not(gs.IsNil))
+				c.Expect(strings.HasPrefix(err.Error(), "TestOutput."), gs.IsTrue)
+			})
+		})
+	})
+}
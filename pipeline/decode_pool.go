@@ -0,0 +1,118 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// Spreads the decoding of an input's packs over several DecoderRunners, each
+// w/ its own Decoder instance and goroutine. When preserving order the packs
+// are handed to the workers strictly round robin, and a sequencer goroutine
+// collects the decoded packs from the workers in the same rotation, so they
+// reach the router in the order they were delivered. Otherwise each pack goes
+// to the first worker w/ room for it, and the workers inject directly.
+type decodePool struct {
+	runners []DecoderRunner
+	inChans []chan *PipelinePack
+	ordered bool
+	// Index of the next worker, guarded by lock when ordered.
+	next uint32
+	lock sync.Mutex
+}
+
+func newDecodePool(pConfig *PipelineConfig, decoderName, fullName string,
+	workers int, ordered bool, setup func(dr *dRunner)) *decodePool {
+
+	pool := &decodePool{
+		runners: make([]DecoderRunner, 0, workers),
+		inChans: make([]chan *PipelinePack, 0, workers),
+		ordered: ordered,
+	}
+	var decoded []chan []*PipelinePack
+	sequenced := make(chan struct{})
+	for i := 0; i < workers; i++ {
+		name := fmt.Sprintf("%s-%d", fullName, i)
+		dr, ok := pConfig.startDecoderRunner(decoderName, name, func(dr *dRunner) {
+			setup(dr)
+			if ordered {
+				dr.decoded = make(chan []*PipelinePack, cap(dr.inChan))
+				dr.sequenced = sequenced
+				decoded = append(decoded, dr.decoded)
+			}
+		})
+		if !ok {
+			continue
+		}
+		pool.runners = append(pool.runners, dr)
+		pool.inChans = append(pool.inChans, dr.InChan())
+	}
+	if ordered {
+		go sequence(pConfig.router, decoded, sequenced)
+	}
+	return pool
+}
+
+func (p *decodePool) deliver(pack *PipelinePack) {
+	n := uint32(len(p.inChans))
+	if p.ordered {
+		// Held while sending, so each worker gets its packs in the order
+		// the sequencer expects them.
+		p.lock.Lock()
+		p.inChans[p.next] <- pack
+		p.next = (p.next + 1) % n
+		p.lock.Unlock()
+		return
+	}
+	start := atomic.AddUint32(&p.next, 1)
+	for i := uint32(0); i < n; i++ {
+		select {
+		case p.inChans[(start+i)%n] <- pack:
+			return
+		default:
+		}
+	}
+	// All of the workers are busy.
+	p.inChans[start%n] <- pack
+}
+
+// Injects the packs decoded by an order preserving pool's workers, taking one
+// batch from each worker in turn, until all of the workers have stopped.
+func sequence(router *messageRouter, decoded []chan []*PipelinePack,
+	sequenced chan struct{}) {
+
+	open := len(decoded)
+	for open > 0 {
+		for i, ch := range decoded {
+			if ch == nil {
+				continue
+			}
+			packs, ok := <-ch
+			if !ok {
+				// Stopped, so the other workers won't get any more packs
+				// either, but they may still hold this round's.
+				decoded[i] = nil
+				open--
+				continue
+			}
+			for _, pack := range packs {
+				router.Inject(pack)
+			}
+		}
+	}
+	close(sequenced)
+}
@@ -0,0 +1,125 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+
+	"github.com/mozilla-services/heka/client"
+	"github.com/mozilla-services/heka/message"
+)
+
+// Encodes a pack w/ the provided encoder, wrapping the result in Heka's
+// stream framing if requested. Framed output too large for a single message
+// is handled according to the globals' oversized message action, or fails
+// if globals is nil. A nil output means the encoder skipped the message.
+func encodePack(encoder Encoder, pack *PipelinePack, useFraming bool,
+	globals *GlobalConfigStruct) (output []byte, err error) {
+
+	var encoded []byte
+	if encoded, err = encoder.Encode(pack); err != nil || encoded == nil {
+		return
+	}
+	if !useFraming {
+		return encoded, nil
+	}
+	if len(encoded) > int(message.MAX_MESSAGE_SIZE) {
+		return frameOversized(globals, pack, len(encoded), encoder, false)
+	}
+	err = client.CreateHekaStream(encoded, &output, nil)
+	return
+}
+
+// LoadEncoder creates the named encoder from the config sections loaded by
+// PreloadFromConfigFile, w/o loading or starting any of the other plugins,
+// so encoders can be used outside of a running pipeline. Default encoders,
+// such as the ProtobufEncoder, don't need a config section.
+func (self *PipelineConfig) LoadEncoder(name string) (Encoder, error) {
+	self.makersLock.RLock()
+	_, loaded := self.makers["Encoder"][name]
+	self.makersLock.RUnlock()
+
+	if !loaded {
+		var maker PluginMaker
+		for _, m := range self.makersByCategory["Encoder"] {
+			if m.Name() == name {
+				maker = m
+				break
+			}
+		}
+		if maker != nil {
+			if _, err := maker.PrepConfig(); err != nil {
+				return nil, err
+			}
+			self.makersLock.Lock()
+			self.makers["Encoder"][name] = maker
+			self.makersLock.Unlock()
+		} else if _, ok := makeDefaultConfigs()[name]; ok {
+			if err := self.RegisterDefault(name); err != nil {
+				return nil, err
+			}
+		} else {
+			return nil, fmt.Errorf("no encoder named '%s' is configured", name)
+		}
+	}
+
+	encoder, ok := self.Encoder(name, name)
+	if !ok {
+		return nil, fmt.Errorf("can't create encoder '%s'", name)
+	}
+	return encoder, nil
+}
+
+// Encodes standalone messages w/ an Encoder, e.g. for the offline conversion
+// of archived protobuf streams. Not safe for concurrent use.
+type MessageEncoder struct {
+	encoder    Encoder
+	useFraming bool
+	pack       *PipelinePack
+}
+
+// Creates a MessageEncoder using the provided encoder, optionally wrapping
+// its output in Heka's stream framing.
+func NewMessageEncoder(encoder Encoder, useFraming bool) *MessageEncoder {
+	return &MessageEncoder{
+		encoder:    encoder,
+		useFraming: useFraming,
+		pack:       NewPipelinePack(nil),
+	}
+}
+
+// Encodes a message. If the message's protobuf encoding is already at hand
+// it can be passed as msgBytes, otherwise it's generated when needed. A nil
+// output means the encoder skipped the message.
+func (e *MessageEncoder) Encode(msg *message.Message, msgBytes []byte) (
+	output []byte, err error) {
+
+	e.pack.Zero()
+	e.pack.Message = msg
+	if msgBytes != nil {
+		e.pack.MsgBytes = append(e.pack.MsgBytes, msgBytes...)
+		e.pack.TrustMsgBytes = true
+	} else if err = e.pack.EncodeMsgBytes(); err != nil {
+		return nil, fmt.Errorf("encoding message: %s", err)
+	}
+	return encodePack(e.encoder, e.pack, e.useFraming, nil)
+}
+
+// Lets the encoder clean up, if it needs to.
+func (e *MessageEncoder) Stop() {
+	if stopper, ok := e.encoder.(NeedsStopping); ok {
+		stopper.Stop()
+	}
+}
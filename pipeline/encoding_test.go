@@ -0,0 +1,69 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"github.com/gogo/protobuf/proto"
+	"github.com/mozilla-services/heka/message"
+	ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func EncodingSpec(c gs.Context) {
+	pConfig := NewPipelineConfig(nil)
+
+	c.Specify("LoadEncoder", func() {
+		c.Specify("loads a default encoder w/o a config section", func() {
+			encoder, err := pConfig.LoadEncoder("ProtobufEncoder")
+			c.Expect(err, gs.IsNil)
+			_, ok := encoder.(*ProtobufEncoder)
+			c.Expect(ok, gs.IsTrue)
+		})
+
+		c.Specify("fails for an unknown encoder", func() {
+			_, err := pConfig.LoadEncoder("NoSuchEncoder")
+			c.Expect(err.Error(), gs.Equals,
+				"no encoder named 'NoSuchEncoder' is configured")
+		})
+	})
+
+	c.Specify("A MessageEncoder", func() {
+		encoder, err := pConfig.LoadEncoder("ProtobufEncoder")
+		c.Assume(err, gs.IsNil)
+		msg := ts.GetTestMessage()
+		msgBytes, err := proto.Marshal(msg)
+		c.Assume(err, gs.IsNil)
+
+		c.Specify("encodes messages", func() {
+			msgEncoder := NewMessageEncoder(encoder, false)
+			output, err := msgEncoder.Encode(msg, nil)
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(output), gs.Equals, string(msgBytes))
+
+			output, err = msgEncoder.Encode(msg, msgBytes)
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(output), gs.Equals, string(msgBytes))
+		})
+
+		c.Specify("frames its output if requested", func() {
+			msgEncoder := NewMessageEncoder(encoder, true)
+			output, err := msgEncoder.Encode(msg, msgBytes)
+			c.Expect(err, gs.IsNil)
+			c.Expect(output[0], gs.Equals, byte(message.RECORD_SEPARATOR))
+			headerLen := int(output[1]) + message.HEADER_FRAMING_SIZE
+			c.Expect(string(output[headerLen:]), gs.Equals, string(msgBytes))
+		})
+	})
+}
@@ -0,0 +1,167 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	"sync/atomic"
+	"unicode/utf8"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// Limits on the fields of the messages an input feeds into the pipeline, set
+// in the `field_limits` section of the input or of its decoder.
+type FieldLimitsConfig struct {
+	// Maximum size in bytes of each string or bytes field value, 0 for no
+	// limit.
+	MaxValueSize int `toml:"max_value_size"`
+	// Maximum number of fields per message, 0 for no limit.
+	MaxFields int `toml:"max_fields"`
+	// What's done w/ a message exceeding a limit, one of "truncate", "drop"
+	// or "error". Defaults to "truncate".
+	Action string
+}
+
+// Enforces an input's field limits, counting the messages it changed or
+// dropped.
+type fieldLimiter struct {
+	// 64-bit values accessed atomically come first to guarantee alignment.
+	truncatedCount int64
+	droppedCount   int64
+	maxValueSize   int
+	maxFields      int
+	action         string
+}
+
+// Returns the limiter for the config, or nil if it doesn't set any limits.
+func newFieldLimiter(config *FieldLimitsConfig) (*fieldLimiter, error) {
+	if config == nil {
+		return nil, nil
+	}
+	if config.MaxValueSize < 0 || config.MaxFields < 0 {
+		return nil, fmt.Errorf("field limits can't be negative")
+	}
+	l := &fieldLimiter{
+		maxValueSize: config.MaxValueSize,
+		maxFields:    config.MaxFields,
+		action:       config.Action,
+	}
+	switch l.action {
+	case "":
+		l.action = "truncate"
+	case "truncate", "drop", "error":
+	default:
+		return nil, fmt.Errorf("unknown field_limits action '%s', must be "+
+			"'truncate', 'drop' or 'error'", l.action)
+	}
+	if l.maxValueSize == 0 && l.maxFields == 0 {
+		return nil, nil
+	}
+	return l, nil
+}
+
+// Applies the limits to the pack's message. Returns false, after recycling
+// the pack, if the message was dropped, logging why w/ logError if the action
+// is "error".
+func (l *fieldLimiter) admit(pack *PipelinePack, logError func(error)) bool {
+	msg := pack.Message
+	exceeded := l.exceeded(msg)
+	if exceeded == "" {
+		return true
+	}
+	if l.action == "truncate" {
+		l.truncate(msg)
+		pack.TrustMsgBytes = false
+		atomic.AddInt64(&l.truncatedCount, 1)
+		return true
+	}
+	if l.action == "error" {
+		logError(fmt.Errorf("dropped message %s: %s", msg.GetUuidString(), exceeded))
+	}
+	atomic.AddInt64(&l.droppedCount, 1)
+	pack.recycle()
+	return false
+}
+
+// Returns which limit the message exceeds, if any.
+func (l *fieldLimiter) exceeded(msg *message.Message) string {
+	if l.maxFields > 0 && len(msg.Fields) > l.maxFields {
+		return fmt.Sprintf("%d fields exceed max_fields %d", len(msg.Fields),
+			l.maxFields)
+	}
+	if l.maxValueSize == 0 {
+		return ""
+	}
+	for _, f := range msg.Fields {
+		if f == nil {
+			continue
+		}
+		for _, v := range f.ValueString {
+			if len(v) > l.maxValueSize {
+				return fmt.Sprintf("field '%s' exceeds max_value_size %d",
+					f.GetName(), l.maxValueSize)
+			}
+		}
+		for _, v := range f.ValueBytes {
+			if len(v) > l.maxValueSize {
+				return fmt.Sprintf("field '%s' exceeds max_value_size %d",
+					f.GetName(), l.maxValueSize)
+			}
+		}
+	}
+	return ""
+}
+
+// Drops the fields past the maximum number and cuts the values that are too
+// long, w/o splitting a UTF-8 character of a string value.
+func (l *fieldLimiter) truncate(msg *message.Message) {
+	if l.maxFields > 0 && len(msg.Fields) > l.maxFields {
+		for i := l.maxFields; i < len(msg.Fields); i++ {
+			msg.Fields[i] = nil
+		}
+		msg.Fields = msg.Fields[:l.maxFields]
+	}
+	if l.maxValueSize == 0 {
+		return
+	}
+	for _, f := range msg.Fields {
+		if f == nil {
+			continue
+		}
+		for i, v := range f.ValueString {
+			if len(v) > l.maxValueSize {
+				end := l.maxValueSize
+				for end > 0 && !utf8.RuneStart(v[end]) {
+					end--
+				}
+				f.ValueString[i] = v[:end]
+			}
+		}
+		for i, v := range f.ValueBytes {
+			if len(v) > l.maxValueSize {
+				f.ValueBytes[i] = v[:l.maxValueSize]
+			}
+		}
+	}
+}
+
+// Populates the provided message w/ the limiter's counters.
+func (l *fieldLimiter) reportMsg(msg *message.Message) {
+	message.NewInt64Field(msg, "FieldLimitTruncatedCount",
+		atomic.LoadInt64(&l.truncatedCount), "count")
+	message.NewInt64Field(msg, "FieldLimitDroppedCount",
+		atomic.LoadInt64(&l.droppedCount), "count")
+}
@@ -0,0 +1,107 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"strings"
+
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func FieldLimitsSpec(c gs.Context) {
+	recycleChan := make(chan *PipelinePack, 1)
+	pack := NewPipelinePack(recycleChan)
+	message.NewStringField(pack.Message, "short", "heka")
+	message.NewStringField(pack.Message, "long", strings.Repeat("é", 10))
+	message.NewStringField(pack.Message, "extra", "x")
+	pack.TrustMsgBytes = true
+
+	var logged []error
+	logError := func(err error) {
+		logged = append(logged, err)
+	}
+
+	c.Specify("Field limits", func() {
+		c.Specify("aren't enforced unless set", func() {
+			l, err := newFieldLimiter(nil)
+			c.Expect(err, gs.IsNil)
+			c.Expect(l == nil, gs.IsTrue)
+			l, err = newFieldLimiter(&FieldLimitsConfig{Action: "drop"})
+			c.Expect(err, gs.IsNil)
+			c.Expect(l == nil, gs.IsTrue)
+		})
+
+		c.Specify("reject unknown actions and negative limits", func() {
+			_, err := newFieldLimiter(&FieldLimitsConfig{MaxFields: 1, Action: "shrink"})
+			c.Expect(err, gs.Not(gs.IsNil))
+			_, err = newFieldLimiter(&FieldLimitsConfig{MaxValueSize: -1})
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("pass messages within the limits untouched", func() {
+			l, err := newFieldLimiter(&FieldLimitsConfig{MaxValueSize: 20, MaxFields: 3})
+			c.Assume(err, gs.IsNil)
+			c.Expect(l.admit(pack, logError), gs.IsTrue)
+			c.Expect(pack.TrustMsgBytes, gs.IsTrue)
+			c.Expect(len(pack.Message.Fields), gs.Equals, 3)
+		})
+
+		c.Specify("truncate by default", func() {
+			l, err := newFieldLimiter(&FieldLimitsConfig{MaxValueSize: 5, MaxFields: 2})
+			c.Assume(err, gs.IsNil)
+			c.Expect(l.admit(pack, logError), gs.IsTrue)
+			c.Expect(pack.TrustMsgBytes, gs.IsFalse)
+			c.Expect(len(pack.Message.Fields), gs.Equals, 2)
+			value, _ := pack.Message.GetFieldValue("short")
+			c.Expect(value, gs.Equals, "heka")
+			// Cut back to a character boundary.
+			value, _ = pack.Message.GetFieldValue("long")
+			c.Expect(value, gs.Equals, "éé")
+			c.Expect(l.truncatedCount, gs.Equals, int64(1))
+			c.Expect(l.droppedCount, gs.Equals, int64(0))
+		})
+
+		c.Specify("drop messages quietly", func() {
+			l, err := newFieldLimiter(&FieldLimitsConfig{MaxFields: 2, Action: "drop"})
+			c.Assume(err, gs.IsNil)
+			c.Expect(l.admit(pack, logError), gs.IsFalse)
+			c.Expect(<-recycleChan, gs.Equals, pack)
+			c.Expect(len(logged), gs.Equals, 0)
+			c.Expect(l.droppedCount, gs.Equals, int64(1))
+		})
+
+		c.Specify("drop messages w/ an error", func() {
+			l, err := newFieldLimiter(&FieldLimitsConfig{MaxValueSize: 5, Action: "error"})
+			c.Assume(err, gs.IsNil)
+			c.Expect(l.admit(pack, logError), gs.IsFalse)
+			c.Expect(<-recycleChan, gs.Equals, pack)
+			c.Expect(len(logged), gs.Equals, 1)
+			c.Expect(strings.Contains(logged[0].Error(), "'long'"), gs.IsTrue)
+		})
+
+		c.Specify("are counted in the report", func() {
+			l, err := newFieldLimiter(&FieldLimitsConfig{MaxFields: 2})
+			c.Assume(err, gs.IsNil)
+			l.admit(pack, logError)
+			msg := new(message.Message)
+			l.reportMsg(msg)
+			value, _ := msg.GetFieldValue("FieldLimitTruncatedCount")
+			c.Expect(value, gs.Equals, int64(1))
+			value, _ = msg.GetFieldValue("FieldLimitDroppedCount")
+			c.Expect(value, gs.Equals, int64(0))
+		})
+	})
+}
@@ -0,0 +1,114 @@
+// +build gofuzz
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"io"
+	"io/ioutil"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// Entry points for go-fuzz (https://github.com/dvyukov/go-fuzz), e.g.
+//
+//   go-fuzz-build -func FuzzHekaFraming github.com/mozilla-services/heka/pipeline
+//   go-fuzz -bin pipeline-fuzz.zip -workdir fuzz/heka_framing
+
+func init() {
+	LogError.SetOutput(ioutil.Discard)
+}
+
+// Hands out the data in small reads, so records get split across them as
+// they do when read from a network connection.
+type fuzzReader struct {
+	data []byte
+}
+
+func (r *fuzzReader) Read(p []byte) (n int, err error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	if len(p) > 61 {
+		p = p[:61]
+	}
+	n = copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// Reads the data as a stream w/ the splitter, calling fn w/ each record.
+// Returns the number of records found.
+func fuzzSplit(splitter Splitter, data []byte, fn func(record []byte)) int {
+	sr := NewSplitterRunner("FuzzSplitter", splitter, CommonSplitterConfig{})
+	r := &fuzzReader{data}
+	records := 0
+	for {
+		_, record, err := sr.GetRecordFromStream(r)
+		if len(record) > 0 {
+			records++
+			fn(record)
+		}
+		if err != nil && err != io.ErrShortBuffer {
+			break
+		}
+	}
+	return records
+}
+
+// Splits the data as a stream of Heka framed messages, which are then
+// authenticated and decoded.
+func FuzzHekaFraming(data []byte) int {
+	splitter := &HekaFramingSplitter{}
+	splitter.Init(&HekaFramingSplitterConfig{
+		Signers:     map[string]Signer{"test_1": {HmacKey: "secret"}},
+		UseMsgBytes: true,
+	})
+	records := fuzzSplit(splitter, data, func(record []byte) {
+		pack := NewPipelinePack(nil)
+		if unframed := splitter.UnframeRecord(record, pack); unframed != nil {
+			message.UnmarshalMessage(unframed, pack.Message)
+		}
+	})
+	if records == 0 {
+		return 0
+	}
+	return 1
+}
+
+// Splits the data as a syslog stream, the framing being picked by the first
+// byte.
+func FuzzSyslogFraming(data []byte) int {
+	if len(data) == 0 {
+		return -1
+	}
+	framings := []string{"auto", "octet_counting", "non_transparent"}
+	splitter := &SyslogFramingSplitter{}
+	if err := splitter.Init(&SyslogFramingSplitterConfig{
+		Framing: framings[int(data[0])%len(framings)],
+	}); err != nil {
+		panic(err)
+	}
+	records := fuzzSplit(splitter, data[1:], func(record []byte) {
+		if len(record) > int(message.MAX_RECORD_SIZE) {
+			panic("record exceeds MAX_RECORD_SIZE")
+		}
+	})
+	if records == 0 {
+		return 0
+	}
+	return 1
+}
@@ -0,0 +1,290 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Name of the node that represents the message router in a PipelineGraph.
+const RouterNodeName = "Router"
+
+// A single plugin (or the router) in a PipelineGraph.
+type GraphNode struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Category string `json:"category"`
+}
+
+// A directed connection between two PipelineGraph nodes. Edges from the
+// router to a filter or output are labeled with the message_matcher
+// expression.
+type GraphEdge struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Label string `json:"label,omitempty"`
+}
+
+// PipelineGraph describes how messages flow between the configured plugins.
+type PipelineGraph struct {
+	Nodes []GraphNode `json:"nodes"`
+	Edges []GraphEdge `json:"edges"`
+}
+
+var graphCategoryOrder = map[string]int{
+	"Input":    0,
+	"Splitter": 1,
+	"Decoder":  2,
+	"Router":   3,
+	"Filter":   4,
+	"Encoder":  5,
+	"Output":   6,
+}
+
+var graphCategoryShapes = map[string]string{
+	"Input":    "invhouse",
+	"Splitter": "cds",
+	"Decoder":  "box",
+	"Router":   "diamond",
+	"Filter":   "ellipse",
+	"Encoder":  "box",
+	"Output":   "house",
+}
+
+type graphBuilder struct {
+	nodes map[string]GraphNode
+	edges []GraphEdge
+}
+
+func (b *graphBuilder) addNode(name, typ, category string) {
+	if _, ok := b.nodes[name]; ok {
+		return
+	}
+	b.nodes[name] = GraphNode{Name: name, Type: typ, Category: category}
+}
+
+func (b *graphBuilder) addEdge(from, to, label string) {
+	b.edges = append(b.edges, GraphEdge{From: from, To: to, Label: label})
+}
+
+// Graph generates a PipelineGraph from the plugin configuration that has been
+// loaded via PreloadFromConfigFile. No plugins are initialized or started, so
+// this is safe to call without actually running Heka.
+func (self *PipelineConfig) Graph() (*PipelineGraph, error) {
+	b := &graphBuilder{nodes: make(map[string]GraphNode)}
+	b.addNode(RouterNodeName, "MessageRouter", "Router")
+
+	// Inputs referencing decoders or splitters that were never explicitly
+	// configured (e.g. ProtobufDecoder) still get a node.
+	implicit := func(name, category string) {
+		b.addNode(name, name, category)
+	}
+
+	isSub := make(map[string]bool)
+	var makers []PluginMaker
+	for _, categoryMakers := range self.makersByCategory {
+		makers = append(makers, categoryMakers...)
+	}
+	for _, maker := range makers {
+		b.addNode(maker.Name(), maker.Type(), maker.Category())
+	}
+
+	for _, maker := range makers {
+		name := maker.Name()
+		config, err := maker.PrepConfig()
+		if err != nil {
+			return nil, err
+		}
+		commonTyped, err := maker.(*pluginMaker).PrepCommonTypedConfig()
+		if err != nil {
+			return nil, err
+		}
+
+		switch maker.Category() {
+		case "Input":
+			common := commonTyped.(CommonInputConfig)
+			splitter := common.Splitter
+			if splitter == "" {
+				splitter = getAttr(config, "Splitter", "").(string)
+			}
+			if splitter != "" {
+				implicit(splitter, "Splitter")
+				b.addEdge(name, splitter, "")
+			}
+			decoder := common.Decoder
+			if decoder == "" {
+				decoder = getAttr(config, "Decoder", "").(string)
+			}
+			if decoder == "" {
+				b.addEdge(name, RouterNodeName, "")
+				continue
+			}
+			implicit(decoder, "Decoder")
+			b.addEdge(name, decoder, "")
+
+		case "Decoder":
+			if maker.Type() == "MultiDecoder" {
+				for _, sub := range subsFromSection(maker.(*pluginMaker).tomlSection) {
+					implicit(sub, "Decoder")
+					b.addEdge(name, sub, "subs")
+					isSub[sub] = true
+				}
+			}
+
+		case "Filter", "Output":
+			common := commonTyped.(CommonFOConfig)
+			matcher := common.Matcher
+			if matcher == "" {
+				matcher = getAttr(config, "MessageMatcher", "").(string)
+			}
+			b.addEdge(RouterNodeName, name, matcher)
+			if maker.Category() == "Filter" {
+				if len(common.RouteTo) > 0 {
+					for _, target := range common.RouteTo {
+						b.addEdge(name, target, "route_to")
+					}
+				} else {
+					b.addEdge(name, RouterNodeName, "inject")
+				}
+				continue
+			}
+			encoder := common.Encoder
+			if encoder == "" {
+				encoder = getAttr(config, "Encoder", "").(string)
+			}
+			if encoder != "" {
+				implicit(encoder, "Encoder")
+				b.addEdge(encoder, name, "")
+			}
+		}
+	}
+
+	// Chained filters' injected messages are matched by their successors.
+	self.chains.prune()
+	for from, successors := range self.chains.successors {
+		for _, to := range successors {
+			b.addEdge(from, to, "chain")
+		}
+	}
+
+	// Decoders feed the router, except for MultiDecoder subdecoders which
+	// hand their results back to the MultiDecoder.
+	for name, node := range b.nodes {
+		if node.Category == "Decoder" && !isSub[name] {
+			b.addEdge(name, RouterNodeName, "")
+		}
+	}
+
+	graph := &PipelineGraph{
+		Nodes: make([]GraphNode, 0, len(b.nodes)),
+		Edges: b.edges,
+	}
+	for _, node := range b.nodes {
+		graph.Nodes = append(graph.Nodes, node)
+	}
+	sort.Sort(graphNodes(graph.Nodes))
+	sort.Sort(graphEdges(graph.Edges))
+	return graph, nil
+}
+
+type graphNodes []GraphNode
+
+func (n graphNodes) Len() int      { return len(n) }
+func (n graphNodes) Swap(i, j int) { n[i], n[j] = n[j], n[i] }
+func (n graphNodes) Less(i, j int) bool {
+	ci, cj := graphCategoryOrder[n[i].Category], graphCategoryOrder[n[j].Category]
+	if ci != cj {
+		return ci < cj
+	}
+	return n[i].Name < n[j].Name
+}
+
+type graphEdges []GraphEdge
+
+func (e graphEdges) Len() int      { return len(e) }
+func (e graphEdges) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+func (e graphEdges) Less(i, j int) bool {
+	if e[i].From != e[j].From {
+		return e[i].From < e[j].From
+	}
+	if e[i].To != e[j].To {
+		return e[i].To < e[j].To
+	}
+	return e[i].Label < e[j].Label
+}
+
+// WriteJSON writes the graph to the provided writer as a JSON document.
+func (g *PipelineGraph) WriteJSON(w io.Writer) error {
+	enc, err := json.MarshalIndent(g, "", "  ")
+	if err != nil {
+		return err
+	}
+	enc = append(enc, '\n')
+	_, err = w.Write(enc)
+	return err
+}
+
+func dotQuote(s string) string {
+	s = strings.Replace(s, "\\", "\\\\", -1)
+	s = strings.Replace(s, "\"", "\\\"", -1)
+	s = strings.Replace(s, "\n", "\\n", -1)
+	return "\"" + s + "\""
+}
+
+// WriteDot writes the graph to the provided writer using the Graphviz DOT
+// language.
+func (g *PipelineGraph) WriteDot(w io.Writer) error {
+	lines := []string{"digraph heka {", "\trankdir=LR;"}
+	for _, node := range g.Nodes {
+		label := node.Name
+		if node.Type != node.Name {
+			label = fmt.Sprintf("%s\n(%s)", node.Name, node.Type)
+		}
+		lines = append(lines, fmt.Sprintf("\t%s [label=%s shape=%s];", dotQuote(node.Name),
+			dotQuote(label), graphCategoryShapes[node.Category]))
+	}
+	for _, edge := range g.Edges {
+		if edge.Label == "" {
+			lines = append(lines, fmt.Sprintf("\t%s -> %s;", dotQuote(edge.From),
+				dotQuote(edge.To)))
+		} else {
+			lines = append(lines, fmt.Sprintf("\t%s -> %s [label=%s];", dotQuote(edge.From),
+				dotQuote(edge.To), dotQuote(edge.Label)))
+		}
+	}
+	lines = append(lines, "}", "")
+	_, err := io.WriteString(w, strings.Join(lines, "\n"))
+	return err
+}
+
+// WriteGraph generates the pipeline graph and writes it to the provided
+// writer in the specified format, either "dot" or "json".
+func (self *PipelineConfig) WriteGraph(w io.Writer, format string) error {
+	graph, err := self.Graph()
+	if err != nil {
+		return err
+	}
+	switch format {
+	case "dot":
+		return graph.WriteDot(w)
+	case "json":
+		return graph.WriteJSON(w)
+	}
+	return fmt.Errorf("unknown graph format '%s', must be 'dot' or 'json'", format)
+}
@@ -0,0 +1,137 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+var graphTestConfig = `
+[StatAccumInput]
+decoder = "ProtobufDecoder"
+
+[CounterFilter]
+message_matcher = "Type == 'heka.statmetric'"
+
+[RoutedFilter]
+type = "CounterFilter"
+message_matcher = "Logger == \"bar\""
+route_to = ["StoppingOutput"]
+
+[StoppingOutput]
+message_matcher = "Type == 'heka.counter-output'"
+encoder = "ProtobufEncoder"
+`
+
+func GraphSpec(c gs.Context) {
+	RegisterPlugin("StoppingOutput", func() interface{} {
+		return new(StoppingOutput)
+	})
+
+	tmpDir, err := ioutil.TempDir("", "graph-tests")
+	c.Assume(err, gs.IsNil)
+	defer os.RemoveAll(tmpDir)
+	configPath := filepath.Join(tmpDir, "config.toml")
+	err = ioutil.WriteFile(configPath, []byte(graphTestConfig), 0644)
+	c.Assume(err, gs.IsNil)
+
+	c.Specify("A pipeline graph", func() {
+		pConfig := NewPipelineConfig(nil)
+		err := pConfig.PreloadFromConfigFile(configPath)
+		c.Assume(err, gs.IsNil)
+		graph, err := pConfig.Graph()
+		c.Assume(err, gs.IsNil)
+
+		hasEdge := func(from, to, label string) bool {
+			for _, edge := range graph.Edges {
+				if edge.From == from && edge.To == to && edge.Label == label {
+					return true
+				}
+			}
+			return false
+		}
+
+		c.Specify("includes implicitly referenced plugins", func() {
+			names := make([]string, len(graph.Nodes))
+			for i, node := range graph.Nodes {
+				names[i] = node.Name
+			}
+			c.Expect(strings.Join(names, ","), gs.Equals,
+				"StatAccumInput,ProtobufDecoder,Router,CounterFilter,RoutedFilter,"+
+					"ProtobufEncoder,StoppingOutput")
+		})
+
+		c.Specify("connects the plugins", func() {
+			c.Expect(hasEdge("StatAccumInput", "ProtobufDecoder", ""), gs.IsTrue)
+			c.Expect(hasEdge("ProtobufDecoder", RouterNodeName, ""), gs.IsTrue)
+			c.Expect(hasEdge(RouterNodeName, "CounterFilter", "Type == 'heka.statmetric'"),
+				gs.IsTrue)
+			c.Expect(hasEdge("CounterFilter", RouterNodeName, "inject"), gs.IsTrue)
+			c.Expect(hasEdge("RoutedFilter", "StoppingOutput", "route_to"), gs.IsTrue)
+			c.Expect(hasEdge("RoutedFilter", RouterNodeName, "inject"), gs.IsFalse)
+			c.Expect(hasEdge("ProtobufEncoder", "StoppingOutput", ""), gs.IsTrue)
+		})
+
+		c.Specify("orders edges between the same plugins by label", func() {
+			edges := graphEdges{
+				{From: RouterNodeName, To: "StoppingOutput", Label: "Type == 'c'"},
+				{From: RouterNodeName, To: "StoppingOutput", Label: "Type == 'b'"},
+				{From: RouterNodeName, To: "StoppingOutput", Label: "Type == 'a'"},
+			}
+			sort.Sort(edges)
+			c.Expect(edges[0].Label, gs.Equals, "Type == 'a'")
+			c.Expect(edges[1].Label, gs.Equals, "Type == 'b'")
+			c.Expect(edges[2].Label, gs.Equals, "Type == 'c'")
+		})
+
+		c.Specify("writes DOT output", func() {
+			var buf bytes.Buffer
+			err := pConfig.WriteGraph(&buf, "dot")
+			c.Expect(err, gs.IsNil)
+			dot := buf.String()
+			c.Expect(strings.HasPrefix(dot, "digraph heka {"), gs.IsTrue)
+			c.Expect(strings.Contains(dot,
+				`"Router" -> "RoutedFilter" [label="Logger == \"bar\""];`), gs.IsTrue)
+			c.Expect(strings.Contains(dot,
+				`"RoutedFilter" [label="RoutedFilter\n(CounterFilter)" shape=ellipse];`),
+				gs.IsTrue)
+		})
+
+		c.Specify("writes JSON output", func() {
+			var buf bytes.Buffer
+			err := pConfig.WriteGraph(&buf, "json")
+			c.Expect(err, gs.IsNil)
+			decoded := new(PipelineGraph)
+			err = json.Unmarshal(buf.Bytes(), decoded)
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(decoded.Nodes), gs.Equals, len(graph.Nodes))
+			c.Expect(len(decoded.Edges), gs.Equals, len(graph.Edges))
+		})
+
+		c.Specify("rejects unknown formats", func() {
+			var buf bytes.Buffer
+			err := pConfig.WriteGraph(&buf, "png")
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+}
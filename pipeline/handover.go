@@ -0,0 +1,164 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Environment variable holding the JSON list of the sockets an upgrading
+// hekad hands over, in the order of their file descriptors.
+const HANDOVER_LISTENERS_ENV = "HEKA_HANDOVER_LISTENERS"
+
+// A socket whose file can be handed over.
+type handoverSocket interface {
+	File() (*os.File, error)
+}
+
+// The listening sockets taken over from an upgraded hekad and those that
+// will be handed over when this one is upgraded, keyed by network and
+// address.
+var handover = struct {
+	sync.Mutex
+	inherited map[string]*os.File
+	sockets   map[string]handoverSocket
+}{
+	inherited: make(map[string]*os.File),
+	sockets:   make(map[string]handoverSocket),
+}
+
+func handoverKey(network, address string) string {
+	return network + " " + address
+}
+
+// Only TCP and UDP sockets are handed over, closing a Unix listener would
+// remove its socket file.
+func handoverable(network string) bool {
+	return strings.HasPrefix(network, "tcp") || strings.HasPrefix(network, "udp")
+}
+
+// Returns the inherited socket for the key, if there is one, which is then
+// owned by the caller.
+func takeInherited(key string) *os.File {
+	handover.Lock()
+	defer handover.Unlock()
+	f, ok := handover.inherited[key]
+	if ok {
+		delete(handover.inherited, key)
+	}
+	return f
+}
+
+// Registers the socket to be handed over if this hekad is upgraded, in place
+// of any socket previously opened for the same key.
+func trackSocket(key string, socket handoverSocket) {
+	handover.Lock()
+	handover.sockets[key] = socket
+	handover.Unlock()
+}
+
+// Listens on the network address like `net.Listen`, but takes over the socket
+// an upgraded hekad listened on for it if there's one, so connections are
+// accepted throughout the upgrade. TCP listeners are handed over in turn when
+// this hekad is upgraded.
+func HandoverListen(network, address string) (net.Listener, error) {
+	if !handoverable(network) {
+		return net.Listen(network, address)
+	}
+	key := handoverKey(network, address)
+	var (
+		listener net.Listener
+		err      error
+	)
+	if f := takeInherited(key); f != nil {
+		listener, err = net.FileListener(f)
+		f.Close()
+	} else {
+		listener, err = net.Listen(network, address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if socket, ok := listener.(handoverSocket); ok {
+		trackSocket(key, socket)
+	}
+	return listener, nil
+}
+
+// Listens on the network address like `net.ListenPacket`, taking over and
+// handing over UDP sockets in the same way as HandoverListen does.
+func HandoverListenPacket(network, address string) (net.PacketConn, error) {
+	if !handoverable(network) {
+		return net.ListenPacket(network, address)
+	}
+	key := handoverKey(network, address)
+	var (
+		conn net.PacketConn
+		err  error
+	)
+	if f := takeInherited(key); f != nil {
+		conn, err = net.FilePacketConn(f)
+		f.Close()
+	} else {
+		conn, err = net.ListenPacket(network, address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if socket, ok := conn.(handoverSocket); ok {
+		trackSocket(key, socket)
+	}
+	return conn, nil
+}
+
+// Returns the keys of the open sockets and a duplicate of each socket's file,
+// sorted by key. Sockets that have been closed since they were opened are
+// dropped.
+func handoverFiles() (keys []string, files []*os.File) {
+	handover.Lock()
+	defer handover.Unlock()
+	for key := range handover.sockets {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	open := keys[:0]
+	for _, key := range keys {
+		f, err := handover.sockets[key].File()
+		if err != nil {
+			delete(handover.sockets, key)
+			continue
+		}
+		setNonblock(f)
+		open = append(open, key)
+		files = append(files, f)
+	}
+	return open, files
+}
+
+// Closes the inherited sockets no plugin has taken over, i.e. those of
+// plugins the upgraded hekad's config no longer has.
+func closeInherited() {
+	handover.Lock()
+	defer handover.Unlock()
+	for key, f := range handover.inherited {
+		LogInfo.Printf("Closing handed over socket '%s', nothing listens on it", key)
+		f.Close()
+		delete(handover.inherited, key)
+	}
+}
@@ -0,0 +1,86 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"net"
+	"os"
+
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func HandoverSpec(c gs.Context) {
+	handover.inherited = make(map[string]*os.File)
+	handover.sockets = make(map[string]handoverSocket)
+
+	// Hands the socket over as an upgrade would, w/in this process.
+	handOver := func() []string {
+		keys, files := handoverFiles()
+		for i, key := range keys {
+			handover.inherited[key] = files[i]
+		}
+		handover.sockets = make(map[string]handoverSocket)
+		return keys
+	}
+
+	c.Specify("A TCP listener", func() {
+		listener, err := HandoverListen("tcp", "127.0.0.1:0")
+		c.Assume(err, gs.IsNil)
+
+		c.Specify("is taken over on the same socket", func() {
+			c.Expect(handOver(), gs.ContainsExactly, []string{"tcp 127.0.0.1:0"})
+			listener.Close()
+			newListener, err := HandoverListen("tcp", "127.0.0.1:0")
+			c.Assume(err, gs.IsNil)
+			defer newListener.Close()
+			c.Expect(newListener.Addr().String(), gs.Equals, listener.Addr().String())
+			c.Expect(len(handover.inherited), gs.Equals, 0)
+
+			conn, err := net.Dial("tcp", newListener.Addr().String())
+			c.Assume(err, gs.IsNil)
+			conn.Close()
+			conn, err = newListener.Accept()
+			c.Expect(err, gs.IsNil)
+			conn.Close()
+		})
+
+		c.Specify("isn't handed over once it's closed", func() {
+			listener.Close()
+			c.Expect(len(handOver()), gs.Equals, 0)
+		})
+	})
+
+	c.Specify("A UDP socket is taken over on the same socket", func() {
+		conn, err := HandoverListenPacket("udp", "127.0.0.1:0")
+		c.Assume(err, gs.IsNil)
+		c.Expect(handOver(), gs.ContainsExactly, []string{"udp 127.0.0.1:0"})
+		conn.Close()
+		newConn, err := HandoverListenPacket("udp", "127.0.0.1:0")
+		c.Assume(err, gs.IsNil)
+		defer newConn.Close()
+		c.Expect(newConn.LocalAddr().String(), gs.Equals, conn.LocalAddr().String())
+	})
+
+	c.Specify("Sockets no plugin takes over are closed", func() {
+		listener, err := HandoverListen("tcp", "127.0.0.1:0")
+		c.Assume(err, gs.IsNil)
+		handOver()
+		listener.Close()
+		closeInherited()
+		c.Expect(len(handover.inherited), gs.Equals, 0)
+		_, err = net.Dial("tcp", listener.Addr().String())
+		c.Expect(err, gs.Not(gs.IsNil))
+	})
+}
@@ -0,0 +1,94 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	"math"
+)
+
+// HyperLogLog sketch estimating the number of distinct values added to it in
+// 2^precision bytes, w/ a standard error of about 1.04/sqrt(2^precision),
+// e.g. 0.8% for the default precision of 14.
+type hyperLogLog struct {
+	precision uint8
+	registers []uint8
+}
+
+func newHyperLogLog(precision uint8) *hyperLogLog {
+	return &hyperLogLog{
+		precision: precision,
+		registers: make([]uint8, 1<<precision),
+	}
+}
+
+// Rebuilds a sketch from its registers, as returned by `bytes`.
+func hyperLogLogFromBytes(precision uint8, registers []byte) (*hyperLogLog, error) {
+	if len(registers) != 1<<precision {
+		return nil, fmt.Errorf("expected %d registers, got %d", 1<<precision,
+			len(registers))
+	}
+	h := newHyperLogLog(precision)
+	copy(h.registers, registers)
+	return h, nil
+}
+
+func (h *hyperLogLog) add(value string) {
+	x := mix64(hashString(value))
+	// The first bits pick the register, which keeps the longest run of
+	// leading zeros seen in the rest.
+	i := x >> (64 - h.precision)
+	w := x << h.precision
+	rank := uint8(1)
+	for max := 64 - h.precision; rank <= max && w&(1<<63) == 0; rank++ {
+		w <<= 1
+	}
+	if rank > h.registers[i] {
+		h.registers[i] = rank
+	}
+}
+
+func (h *hyperLogLog) estimate() uint64 {
+	m := float64(len(h.registers))
+	var sum float64
+	var zeros int
+	for _, r := range h.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	var alpha float64
+	switch len(h.registers) {
+	case 16:
+		alpha = 0.673
+	case 32:
+		alpha = 0.697
+	case 64:
+		alpha = 0.709
+	default:
+		alpha = 0.7213 / (1 + 1.079/m)
+	}
+	e := alpha * m * m / sum
+	if e <= 2.5*m && zeros > 0 {
+		// Small cardinalities are better estimated by linear counting.
+		e = m * math.Log(m/float64(zeros))
+	}
+	return uint64(e + 0.5)
+}
+
+func (h *hyperLogLog) bytes() []byte {
+	return h.registers
+}
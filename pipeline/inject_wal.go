@@ -0,0 +1,235 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/mozilla-services/heka/framing"
+	"github.com/mozilla-services/heka/message"
+)
+
+// Size past which the log moves on to a new segment. A segment is only
+// deleted once all of its messages are done w/, so this bounds how much
+// space delivered messages can hold on to.
+const injectWalMaxSegmentSize uint64 = 64 * 1024 * 1024
+
+// Write-ahead log of the messages injected by the filters, turned on w/ the
+// `inject_wal` global setting. Each message is appended to the log before
+// it's handed to the router, and is only let go once its pack is recycled,
+// i.e. once every plugin it was routed to is done w/ it. The messages still
+// in the log when hekad starts, because a crash or the shutdown caught them
+// in flight, are injected again. Delivery is at least once: the other
+// messages sharing a segment w/ an undelivered one are replayed too. If
+// `inject_wal_sync` is turned on each message is also synced to disk before
+// it's routed, so a host crash doesn't lose it either, which blocks the
+// injecting filter for the duration of the sync.
+type injectWal struct {
+	dir       string
+	engine    BufferEngine
+	globals   *GlobalConfigStruct
+	lock      sync.Mutex
+	segment   BufferSegment
+	writeId   uint
+	writeSize uint64
+	// Number of packs in circulation holding a message of each segment.
+	pending map[uint]int
+}
+
+func openInjectWal(globals *GlobalConfigStruct) (*injectWal, error) {
+	engineName := globals.InjectWalEngine
+	if engineName == "" {
+		engineName = "file"
+	}
+	w := &injectWal{
+		dir:     globals.PrependBaseDir("inject_wal"),
+		globals: globals,
+		pending: make(map[uint]int),
+	}
+	var err error
+	if w.engine, err = openBufferEngine(engineName, w.dir); err != nil {
+		return nil, err
+	}
+	ids, err := w.engine.Segments()
+	if err != nil {
+		w.engine.Close()
+		return nil, fmt.Errorf("can't list log segments: %s", err)
+	}
+	// Never append to a segment left over by a previous run, it's replayed
+	// as a whole.
+	if len(ids) > 0 {
+		w.writeId = ids[len(ids)-1] + 1
+	}
+	if w.segment, err = w.engine.OpenSegment(w.writeId); err != nil {
+		w.engine.Close()
+		return nil, fmt.Errorf("can't open log segment: %s", err)
+	}
+	return w, nil
+}
+
+// Appends the pack's message to the log, tying the pack to its segment
+// until it's recycled. Oversized messages are fitted as they would be by a
+// queue buffer.
+func (w *injectWal) append(pack *PipelinePack) error {
+	var (
+		outBytes []byte
+		err      error
+	)
+	if len(pack.MsgBytes) > int(message.MAX_MESSAGE_SIZE) {
+		outBytes, err = frameOversized(w.globals, pack, len(pack.MsgBytes), nil, true)
+	} else {
+		err = framing.Frame(pack.MsgBytes, &outBytes, nil, true)
+	}
+	if err != nil {
+		return fmt.Errorf("message framing error: %s", err)
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.segment == nil {
+		return fmt.Errorf("write-ahead log is closed")
+	}
+	if w.writeSize > 0 && w.writeSize+uint64(len(outBytes)) > injectWalMaxSegmentSize {
+		if err = w.roll(); err != nil {
+			return fmt.Errorf("log segment rotation error: %s", err)
+		}
+	}
+	n, err := w.segment.Append(outBytes)
+	if err != nil {
+		return fmt.Errorf("can't write to log: %s", err)
+	}
+	if syncer, ok := w.segment.(SyncableBufferSegment); ok && w.globals.InjectWalSync {
+		if err = syncer.Sync(); err != nil {
+			return fmt.Errorf("can't sync log: %s", err)
+		}
+	}
+	w.writeSize += uint64(n)
+	w.pending[w.writeId]++
+	pack.wal, pack.walId = w, w.writeId
+	return nil
+}
+
+// Moves on to a new segment. Expects the lock to be held.
+func (w *injectWal) roll() (err error) {
+	w.segment.Close()
+	oldId := w.writeId
+	w.writeId++
+	w.writeSize = 0
+	if w.pending[oldId] == 0 {
+		delete(w.pending, oldId)
+		if _, err = w.engine.RemoveSegment(oldId); err != nil {
+			LogError.Printf("Can't remove write-ahead log segment %d: %s", oldId, err)
+		}
+	}
+	w.segment, err = w.engine.OpenSegment(w.writeId)
+	return err
+}
+
+// Called when a pack holding a message of the segment is recycled, deleting
+// the segment once none are left and it's no longer written to.
+func (w *injectWal) release(id uint) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.pending[id]--; w.pending[id] > 0 {
+		return
+	}
+	delete(w.pending, id)
+	if id == w.writeId || w.segment == nil {
+		return
+	}
+	if _, err := w.engine.RemoveSegment(id); err != nil {
+		LogError.Printf("Can't remove write-ahead log segment %d: %s", id, err)
+	}
+}
+
+// Injects the messages of the segments left over by a previous run into the
+// router. Their routing isn't logged, so they go through the matchers even
+// if they were first injected w/ `route_to`.
+func (w *injectWal) replay(pConfig *PipelineConfig) error {
+	ids, err := w.engine.Segments()
+	if err != nil {
+		return fmt.Errorf("can't list log segments: %s", err)
+	}
+	// Holds on to each old segment while it's being read, so it can't be
+	// deleted from under us once the messages read so far are done w/, and
+	// so the empty ones get deleted afterwards.
+	var old []uint
+	w.lock.Lock()
+	for _, id := range ids {
+		if id < w.writeId {
+			w.pending[id]++
+			old = append(old, id)
+		}
+	}
+	w.lock.Unlock()
+	defer func() {
+		for _, id := range old {
+			w.release(id)
+		}
+	}()
+
+	var count int
+	queue := &BufferQueue{Dir: w.dir, engine: w.engine}
+	err = queue.Scan(true, func(rec *BufferQueueRecord) error {
+		if rec.Id >= w.writeId {
+			return ErrStopScan
+		}
+		pack, err := pConfig.PipelinePack(0)
+		if err != nil {
+			return err
+		}
+		// Outputs and encoders use the message's encoding, not the message.
+		pack.Message = rec.Message
+		if err = pack.EncodeMsgBytes(); err != nil {
+			pack.recycle()
+			return fmt.Errorf("can't encode message: %s", err)
+		}
+		w.lock.Lock()
+		w.pending[rec.Id]++
+		w.lock.Unlock()
+		pack.wal, pack.walId = w, rec.Id
+		if err = pConfig.router.Inject(pack); err != nil {
+			pack.recycle()
+			return err
+		}
+		count++
+		return nil
+	})
+	if count > 0 {
+		LogInfo.Printf("Replayed %d injected messages from the write-ahead log", count)
+	}
+	return err
+}
+
+// Closes the log once the pipeline has shut down, deleting the segment
+// being written to if none of its messages are still in circulation.
+func (w *injectWal) close() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.segment == nil {
+		return
+	}
+	w.segment.Close()
+	w.segment = nil
+	if w.pending[w.writeId] == 0 {
+		if _, err := w.engine.RemoveSegment(w.writeId); err != nil {
+			LogError.Printf("Can't remove write-ahead log segment %d: %s", w.writeId, err)
+		}
+	}
+	if err := w.engine.Close(); err != nil {
+		LogError.Printf("Can't close write-ahead log: %s", err)
+	}
+}
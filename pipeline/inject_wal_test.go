@@ -0,0 +1,148 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/mozilla-services/heka/message"
+	ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+// Counts the syncs of a wrapped segment.
+type syncCountingSegment struct {
+	BufferSegment
+	syncs int
+}
+
+func (s *syncCountingSegment) Sync() error {
+	s.syncs++
+	return nil
+}
+
+func InjectWalSpec(c gs.Context) {
+	tmpDir, tmpErr := ioutil.TempDir("", "injectwal-tests")
+	c.Assume(tmpErr, gs.IsNil)
+	defer func() {
+		tmpErr = os.RemoveAll(tmpDir)
+		c.Expect(tmpErr, gs.IsNil)
+	}()
+
+	globals := DefaultGlobals()
+	globals.BaseDir = tmpDir
+	globals.InjectWal = true
+	pConfig := NewPipelineConfig(globals)
+
+	wal, err := openInjectWal(globals)
+	c.Assume(err, gs.IsNil)
+
+	logged := func(payload string) *PipelinePack {
+		pack := NewPipelinePack(pConfig.injectRecycleChan)
+		pack.Message = ts.GetTestMessage()
+		pack.Message.SetPayload(payload)
+		c.Assume(pack.EncodeMsgBytes(), gs.IsNil)
+		c.Assume(wal.append(pack), gs.IsNil)
+		return pack
+	}
+
+	segments := func() []uint {
+		ids, err := wal.engine.Segments()
+		c.Expect(err, gs.IsNil)
+		return ids
+	}
+
+	c.Specify("An injected messages write-ahead log", func() {
+		c.Specify("ties the packs to the segment they're in", func() {
+			pack := logged("a")
+			c.Expect(pack.wal == wal, gs.IsTrue)
+			c.Expect(pack.walId, gs.Equals, uint(0))
+			c.Expect(wal.pending[0], gs.Equals, 1)
+			pack.recycle()
+			c.Expect(pack.wal == nil, gs.IsTrue)
+			c.Expect(wal.pending[0], gs.Equals, 0)
+			wal.close()
+		})
+
+		c.Specify("deletes the rolled segments once their packs are recycled", func() {
+			first := logged("a")
+			c.Expect(wal.roll(), gs.IsNil)
+			second := logged("b")
+			c.Expect(segments(), gs.Equals, []uint{0, 1})
+			first.recycle()
+			c.Expect(segments(), gs.Equals, []uint{1})
+			second.recycle()
+			wal.close()
+			c.Expect(len(segments()), gs.Equals, 0)
+		})
+
+		c.Specify("replays the messages still in circulation at close", func() {
+			logged("a")
+			logged("b").recycle()
+			wal.close()
+
+			wal, err = openInjectWal(globals)
+			c.Assume(err, gs.IsNil)
+			c.Expect(wal.writeId, gs.Equals, uint(1))
+			for i := 0; i < 2; i++ {
+				pConfig.injectRecycleChan <- NewPipelinePack(pConfig.injectRecycleChan)
+			}
+			c.Expect(wal.replay(pConfig), gs.IsNil)
+
+			// Delivery is at least once, both messages of the segment are
+			// replayed.
+			var replayed []*PipelinePack
+			for len(pConfig.router.inChan) > 0 {
+				replayed = append(replayed, <-pConfig.router.inChan)
+			}
+			c.Assume(len(replayed), gs.Equals, 2)
+			for i, payload := range []string{"a", "b"} {
+				pack := replayed[i]
+				c.Expect(pack.Message.GetPayload(), gs.Equals, payload)
+				c.Expect(pack.TrustMsgBytes, gs.IsTrue)
+				msg := new(message.Message)
+				c.Expect(message.UnmarshalMessage(pack.MsgBytes, msg), gs.IsNil)
+				c.Expect(msg.GetPayload(), gs.Equals, payload)
+			}
+			c.Expect(segments(), gs.Equals, []uint{0, 1})
+
+			replayed[0].recycle()
+			c.Expect(segments(), gs.Equals, []uint{0, 1})
+			replayed[1].recycle()
+			c.Expect(segments(), gs.Equals, []uint{1})
+			wal.close()
+		})
+
+		c.Specify("only syncs each message if told to", func() {
+			segment := &syncCountingSegment{BufferSegment: wal.segment}
+			wal.segment = segment
+			logged("a")
+			c.Expect(segment.syncs, gs.Equals, 0)
+			globals.InjectWalSync = true
+			logged("b")
+			c.Expect(segment.syncs, gs.Equals, 1)
+			wal.close()
+		})
+
+		c.Specify("refuses messages once closed", func() {
+			wal.close()
+			pack := NewPipelinePack(nil)
+			pack.Message = ts.GetTestMessage()
+			c.Assume(pack.EncodeMsgBytes(), gs.IsNil)
+			c.Expect(wal.append(pack), gs.Not(gs.IsNil))
+		})
+	})
+}
@@ -0,0 +1,298 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	"github.com/pborman/uuid"
+)
+
+// Filter that correlates two kinds of messages sharing a key, e.g. requests
+// and their responses or logins and the access logs of the session. Left
+// messages are held for a window, and a right message w/ the key of a held
+// one is injected as a copy enriched w/ the left message's fields.
+type JoinFilter struct {
+	joinedCount    int64
+	unmatchedCount int64
+	orphanCount    int64
+	evictedCount   int64
+	conf           *JoinFilterConfig
+	left           *message.MatcherSpecification
+	right          *message.MatcherSpecification
+	leftKey        *hashVariable
+	rightKey       *hashVariable
+	fields         map[string]bool
+	window         time.Duration
+	pending        map[string]*pendingLeft
+	// Held left messages from the oldest to the newest.
+	order *list.List
+	// Returns the current time, replaced in tests.
+	now func() time.Time
+}
+
+type JoinFilterConfig struct {
+	// Message matcher for the left messages, which are held.
+	LeftMatcher string `toml:"left_matcher"`
+	// Message matcher for the right messages, which are joined w/ a held
+	// left message.
+	RightMatcher string `toml:"right_matcher"`
+	// Message variable holding the left messages' key, in the
+	// SharderFilter's `hash_variable` format.
+	LeftKey string `toml:"left_key"`
+	// Message variable holding the right messages' key, defaults to the
+	// left_key.
+	RightKey string `toml:"right_key"`
+	// Seconds a left message is held for, defaults to 60.
+	Window uint `toml:"window"`
+	// Maximum number of held left messages, the oldest is dropped when a new
+	// one would exceed it. Defaults to 10000.
+	MaxPending int `toml:"max_pending"`
+	// Whether a left message is still held after it's been joined, so it
+	// can be joined w/ more right messages. Defaults to false.
+	KeepMatched bool `toml:"keep_matched"`
+	// Names of the left message fields copied to the joined messages,
+	// defaults to all of them.
+	Fields []string `toml:"fields"`
+	// Prepended to the names of the copied fields, defaults to "left_".
+	FieldPrefix string `toml:"field_prefix"`
+	// Type of the joined messages, defaults to "heka.join".
+	MessageType string `toml:"message_type"`
+	// Whether the left messages that expire w/o having been joined are
+	// injected, w/ a type of "heka.join-unmatched". Defaults to false.
+	EmitUnmatched bool `toml:"emit_unmatched"`
+	// Left messages are expired every ticker interval, defaults to 1 second.
+	TickerInterval uint `toml:"ticker_interval"`
+}
+
+type pendingLeft struct {
+	key     string
+	msg     *message.Message
+	arrived time.Time
+	matched bool
+	element *list.Element
+}
+
+func (f *JoinFilter) ConfigStruct() interface{} {
+	return &JoinFilterConfig{
+		Window:         60,
+		MaxPending:     10000,
+		FieldPrefix:    "left_",
+		MessageType:    "heka.join",
+		TickerInterval: 1,
+	}
+}
+
+func (f *JoinFilter) Init(config interface{}) (err error) {
+	conf := config.(*JoinFilterConfig)
+	if conf.LeftMatcher == "" || conf.RightMatcher == "" {
+		return errors.New("JoinFilter requires a left_matcher and a right_matcher")
+	}
+	if f.left, err = message.CreateMatcherSpecification(conf.LeftMatcher); err != nil {
+		return fmt.Errorf("JoinFilter invalid left_matcher: %s", err)
+	}
+	if f.right, err = message.CreateMatcherSpecification(conf.RightMatcher); err != nil {
+		return fmt.Errorf("JoinFilter invalid right_matcher: %s", err)
+	}
+	if conf.LeftKey == "" {
+		return errors.New("JoinFilter requires a left_key")
+	}
+	if f.leftKey, err = newHashVariable(conf.LeftKey); err != nil {
+		return fmt.Errorf("JoinFilter left_key: %s", err)
+	}
+	if conf.RightKey == "" {
+		conf.RightKey = conf.LeftKey
+	}
+	if f.rightKey, err = newHashVariable(conf.RightKey); err != nil {
+		return fmt.Errorf("JoinFilter right_key: %s", err)
+	}
+	if conf.Window == 0 {
+		return errors.New("JoinFilter window must be positive")
+	}
+	if conf.MaxPending <= 0 {
+		return errors.New("JoinFilter max_pending must be positive")
+	}
+	f.fields = nil
+	if len(conf.Fields) > 0 {
+		f.fields = make(map[string]bool, len(conf.Fields))
+		for _, name := range conf.Fields {
+			f.fields[name] = true
+		}
+	}
+	f.conf = conf
+	f.window = time.Duration(conf.Window) * time.Second
+	f.pending = make(map[string]*pendingLeft)
+	f.order = list.New()
+	f.now = time.Now
+	return nil
+}
+
+func (f *JoinFilter) Run(fr FilterRunner, h PluginHelper) (err error) {
+	inChan := fr.InChan()
+	ticker := fr.Ticker()
+	for {
+		select {
+		case pack, ok := <-inChan:
+			if !ok {
+				return nil
+			}
+			if left := f.match(pack.Message); left != nil {
+				f.inject(fr, h, pack, func(msg *message.Message) {
+					pack.Message.Copy(msg)
+					f.join(left, msg)
+				})
+			}
+			fr.UpdateCursor(pack.QueueCursor)
+			pack.Recycle(nil)
+		case <-ticker:
+			for _, left := range f.expire() {
+				f.inject(fr, h, nil, func(msg *message.Message) {
+					left.Copy(msg)
+					msg.SetString("OriginalType", left.GetType())
+					msg.SetType("heka.join-unmatched")
+				})
+			}
+		}
+	}
+}
+
+// Injects a new message filled by fill.
+func (f *JoinFilter) inject(fr FilterRunner, h PluginHelper, pack *PipelinePack,
+	fill func(msg *message.Message)) {
+
+	var loopCount uint
+	if pack != nil {
+		loopCount = pack.MsgLoopCount
+	}
+	newPack, err := h.PipelinePack(loopCount)
+	if err != nil {
+		fr.LogError(err)
+		return
+	}
+	fill(newPack.Message)
+	newPack.Message.SetUuid(uuid.NewRandom())
+	fr.Inject(newPack)
+}
+
+// Holds a left message, or returns the held left message a right message
+// joins w/, if any.
+func (f *JoinFilter) match(msg *message.Message) *message.Message {
+	if f.left.Match(msg) {
+		if key, ok := f.leftKey.value(msg); ok {
+			f.hold(key, msg)
+		}
+		return nil
+	}
+	if !f.right.Match(msg) {
+		return nil
+	}
+	key, ok := f.rightKey.value(msg)
+	if !ok {
+		atomic.AddInt64(&f.orphanCount, 1)
+		return nil
+	}
+	p, ok := f.pending[key]
+	if !ok || f.now().Sub(p.arrived) > f.window {
+		atomic.AddInt64(&f.orphanCount, 1)
+		return nil
+	}
+	if !f.conf.KeepMatched {
+		f.remove(p)
+	}
+	p.matched = true
+	atomic.AddInt64(&f.joinedCount, 1)
+	return p.msg
+}
+
+func (f *JoinFilter) hold(key string, msg *message.Message) {
+	if p, ok := f.pending[key]; ok {
+		// Only the latest left message of a key is held.
+		f.remove(p)
+	} else if len(f.pending) >= f.conf.MaxPending {
+		f.remove(f.order.Front().Value.(*pendingLeft))
+		atomic.AddInt64(&f.evictedCount, 1)
+	}
+	p := &pendingLeft{key: key, msg: message.CopyMessage(msg), arrived: f.now()}
+	p.element = f.order.PushBack(p)
+	f.pending[key] = p
+}
+
+func (f *JoinFilter) remove(p *pendingLeft) {
+	delete(f.pending, p.key)
+	f.order.Remove(p.element)
+}
+
+// Drops the left messages held for longer than the window, returning those
+// that weren't joined.
+func (f *JoinFilter) expire() (unmatched []*message.Message) {
+	now := f.now()
+	for e := f.order.Front(); e != nil; e = f.order.Front() {
+		p := e.Value.(*pendingLeft)
+		if now.Sub(p.arrived) <= f.window {
+			break
+		}
+		f.remove(p)
+		if !p.matched {
+			atomic.AddInt64(&f.unmatchedCount, 1)
+			if f.conf.EmitUnmatched {
+				unmatched = append(unmatched, p.msg)
+			}
+		}
+	}
+	return unmatched
+}
+
+// Turns msg, a copy of a right message, into the joined message by adding
+// the left message's fields and headers.
+func (f *JoinFilter) join(left, msg *message.Message) {
+	prefix := f.conf.FieldPrefix
+	msg.SetType(f.conf.MessageType)
+	msg.SetString(prefix+"Type", left.GetType())
+	msg.SetInt(prefix+"Timestamp", left.GetTimestamp())
+	msg.SetDouble("JoinLatency",
+		float64(msg.GetTimestamp()-left.GetTimestamp())/float64(time.Second))
+	for _, field := range left.Fields {
+		if f.fields != nil && !f.fields[field.GetName()] {
+			continue
+		}
+		copied := message.CopyField(field)
+		name := prefix + field.GetName()
+		copied.Name = &name
+		msg.AddField(copied)
+	}
+}
+
+func (f *JoinFilter) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "JoinedCount", atomic.LoadInt64(&f.joinedCount),
+		"count")
+	message.NewInt64Field(msg, "UnmatchedCount", atomic.LoadInt64(&f.unmatchedCount),
+		"count")
+	message.NewInt64Field(msg, "OrphanCount", atomic.LoadInt64(&f.orphanCount),
+		"count")
+	message.NewInt64Field(msg, "EvictedCount", atomic.LoadInt64(&f.evictedCount),
+		"count")
+	return nil
+}
+
+func init() {
+	RegisterPlugin("JoinFilter", func() interface{} {
+		return new(JoinFilter)
+	})
+}
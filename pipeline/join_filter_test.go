@@ -0,0 +1,126 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func JoinFilterSpec(c gs.Context) {
+	c.Specify("A JoinFilter", func() {
+		filter := new(JoinFilter)
+		config := filter.ConfigStruct().(*JoinFilterConfig)
+		config.LeftMatcher = "Type == 'request'"
+		config.RightMatcher = "Type == 'response'"
+		config.LeftKey = "Fields[request_id]"
+		config.Window = 10
+
+		start := time.Unix(1000, 0)
+		now := start
+		newMsg := func(msgType, id string) *message.Message {
+			msg := new(message.Message)
+			msg.SetType(msgType)
+			msg.SetTimestamp(now.UnixNano())
+			msg.SetString("request_id", id)
+			return msg
+		}
+		request := func(id, path string) {
+			msg := newMsg("request", id)
+			msg.SetString("path", path)
+			c.Expect(filter.match(msg), gs.IsNil)
+		}
+
+		c.Specify("requires both matchers", func() {
+			config.RightMatcher = ""
+			c.Expect(filter.Init(config), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("is initialized", func() {
+			err := filter.Init(config)
+			c.Assume(err, gs.IsNil)
+			filter.now = func() time.Time { return now }
+			request("1", "/search")
+
+			c.Specify("joins a right message w/ the held left one", func() {
+				now = start.Add(2 * time.Second)
+				response := newMsg("response", "1")
+				left := filter.match(response)
+				c.Assume(left, gs.Not(gs.IsNil))
+				c.Expect(len(filter.pending), gs.Equals, 0)
+
+				filter.join(left, response)
+				c.Expect(response.GetType(), gs.Equals, "heka.join")
+				path, _ := response.GetFieldValue("left_path")
+				c.Expect(path, gs.Equals, "/search")
+				leftType, _ := response.GetFieldValue("left_Type")
+				c.Expect(leftType, gs.Equals, "request")
+				latency, _ := response.GetFieldValue("JoinLatency")
+				c.Expect(latency, gs.Equals, 2.0)
+			})
+
+			c.Specify("only copies the configured fields", func() {
+				filter.fields = map[string]bool{"request_id": true}
+				response := newMsg("response", "1")
+				filter.join(filter.match(response), response)
+				_, ok := response.GetFieldValue("left_path")
+				c.Expect(ok, gs.IsFalse)
+				id, _ := response.GetFieldValue("left_request_id")
+				c.Expect(id, gs.Equals, "1")
+			})
+
+			c.Specify("doesn't join a right message w/o a held left one", func() {
+				c.Expect(filter.match(newMsg("response", "2")), gs.IsNil)
+				c.Expect(filter.orphanCount, gs.Equals, int64(1))
+			})
+
+			c.Specify("doesn't join a right message after the window", func() {
+				now = start.Add(11 * time.Second)
+				c.Expect(filter.match(newMsg("response", "1")), gs.IsNil)
+			})
+
+			c.Specify("keeps a matched left message if configured to", func() {
+				filter.conf.KeepMatched = true
+				c.Expect(filter.match(newMsg("response", "1")), gs.Not(gs.IsNil))
+				c.Expect(filter.match(newMsg("response", "1")), gs.Not(gs.IsNil))
+				now = start.Add(11 * time.Second)
+				c.Expect(len(filter.expire()), gs.Equals, 0)
+				c.Expect(filter.unmatchedCount, gs.Equals, int64(0))
+			})
+
+			c.Specify("expires unmatched left messages", func() {
+				filter.conf.EmitUnmatched = true
+				now = start.Add(5 * time.Second)
+				request("2", "/cart")
+				now = start.Add(11 * time.Second)
+				unmatched := filter.expire()
+				c.Expect(len(unmatched), gs.Equals, 1)
+				path, _ := unmatched[0].GetFieldValue("path")
+				c.Expect(path, gs.Equals, "/search")
+				c.Expect(len(filter.pending), gs.Equals, 1)
+			})
+
+			c.Specify("drops the oldest left message when full", func() {
+				filter.conf.MaxPending = 1
+				request("2", "/cart")
+				c.Expect(filter.match(newMsg("response", "1")), gs.IsNil)
+				c.Expect(filter.match(newMsg("response", "2")), gs.Not(gs.IsNil))
+				c.Expect(filter.evictedCount, gs.Equals, int64(1))
+			})
+		})
+	})
+}
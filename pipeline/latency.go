@@ -0,0 +1,99 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+const (
+	// Prefix of the report fields holding the cumulative count of messages
+	// an output delivered within each latency bucket, followed by the
+	// bucket's upper bound in milliseconds, e.g. "DeliveryLatency_le_100".
+	LATENCY_BUCKET_PREFIX = "DeliveryLatency_le_"
+	// Report field holding the number of messages an output delivered.
+	LATENCY_COUNT_FIELD = "DeliveryLatencyCount"
+	// Report field holding the sum of the delivery latencies, in ms.
+	LATENCY_SUM_FIELD = "DeliveryLatencySum"
+)
+
+// Upper bounds, in milliseconds, of the delivery latency buckets used when
+// an output doesn't specify `latency_buckets`.
+var defaultLatencyBuckets = []uint{1, 10, 100, 1000, 10000, 60000}
+
+// Histogram of the time it took messages to be delivered by an output, from
+// their timestamp to the output successfully processing them. Safe for
+// concurrent use.
+type latencyHistogram struct {
+	bounds []int64 // Bucket upper bounds, in ns, ascending.
+	counts []int64 // Non-cumulative, the last one counts everything slower.
+	count  int64
+	sum    int64 // In ns.
+}
+
+func newLatencyHistogram(buckets []uint) (*latencyHistogram, error) {
+	if len(buckets) == 0 {
+		buckets = defaultLatencyBuckets
+	}
+	h := &latencyHistogram{
+		bounds: make([]int64, len(buckets)),
+		counts: make([]int64, len(buckets)+1),
+	}
+	for i, bound := range buckets {
+		if i > 0 && bound <= buckets[i-1] {
+			return nil, fmt.Errorf("latency buckets must be ascending, got %v", buckets)
+		}
+		h.bounds[i] = int64(time.Duration(bound) * time.Millisecond)
+	}
+	return h, nil
+}
+
+// Records the latency of a message delivered now. Messages w/o a timestamp
+// are ignored, and clock skew can't make the latency negative.
+func (h *latencyHistogram) observe(msg *message.Message) {
+	ts := msg.GetTimestamp()
+	if ts == 0 {
+		return
+	}
+	latency := time.Now().UnixNano() - ts
+	if latency < 0 {
+		latency = 0
+	}
+	i := sort.Search(len(h.bounds), func(i int) bool { return latency <= h.bounds[i] })
+	atomic.AddInt64(&h.counts[i], 1)
+	atomic.AddInt64(&h.count, 1)
+	atomic.AddInt64(&h.sum, latency)
+}
+
+// Adds the histogram's cumulative bucket counts, total count and latency sum
+// to a report message.
+func (h *latencyHistogram) reportMsg(msg *message.Message) {
+	var cumulative int64
+	for i, bound := range h.bounds {
+		cumulative += atomic.LoadInt64(&h.counts[i])
+		name := fmt.Sprintf("%s%d", LATENCY_BUCKET_PREFIX, bound/int64(time.Millisecond))
+		message.NewInt64Field(msg, name, cumulative, "count")
+	}
+	message.NewInt64Field(msg, LATENCY_COUNT_FIELD, atomic.LoadInt64(&h.count), "count")
+	sum := float64(atomic.LoadInt64(&h.sum)) / float64(time.Millisecond)
+	if f, err := message.NewField(LATENCY_SUM_FIELD, sum, "ms"); err == nil {
+		msg.AddField(f)
+	}
+}
@@ -0,0 +1,63 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"strings"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+const (
+	// Name of the field listing the plugins a message went through when
+	// lineage tracking is turned on, e.g. "tcp:5565>ProtobufDecoder>RateFilter".
+	LINEAGE_FIELD = "heka_lineage"
+	// Separator of the plugin names in the lineage field.
+	LINEAGE_SEPARATOR = ">"
+)
+
+// Appends one or more plugin names to the lineage of a pack's message. The
+// message is modified, so its MsgBytes can't be trusted anymore.
+func trackLineage(pack *PipelinePack, names ...string) {
+	lineage := strings.Join(names, LINEAGE_SEPARATOR)
+	field := pack.Message.FindFirstField(LINEAGE_FIELD)
+	if field != nil && field.GetValueType() == message.Field_STRING &&
+		len(field.ValueString) == 1 && field.ValueString[0] != "" {
+
+		// Messages coming from another Heka instance, or copied from their
+		// filter's input, keep their lineage.
+		field.ValueString[0] += LINEAGE_SEPARATOR + lineage
+	} else {
+		if field != nil {
+			pack.Message.DeleteField(field)
+		}
+		message.NewStringField(pack.Message, LINEAGE_FIELD, lineage)
+	}
+	pack.TrustMsgBytes = false
+}
+
+// Returns the names of the plugins a message went through, oldest first, if
+// it was tracked.
+func MessageLineage(msg *message.Message) []string {
+	value, ok := msg.GetFieldValue(LINEAGE_FIELD)
+	if !ok {
+		return nil
+	}
+	lineage, ok := value.(string)
+	if !ok || lineage == "" {
+		return nil
+	}
+	return strings.Split(lineage, LINEAGE_SEPARATOR)
+}
@@ -0,0 +1,247 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// Load shedding policies that can be applied when the memory watermark is
+// exceeded.
+const (
+	// Stop handing out input packs, so inputs stop feeding new messages into
+	// the pipeline.
+	SHED_PAUSE_INPUTS = "pause_inputs"
+	// Have the router drop any message with a severity at or above
+	// `memory_shed_severity`.
+	SHED_DROP_LOW_PRIORITY = "drop_low_priority"
+	// Take half of the input packs out of circulation and release their
+	// buffers.
+	SHED_SHRINK_POOL = "shrink_pool"
+)
+
+// Verifies that all of the provided load shedding policy names are known.
+func ValidateMemoryShedPolicies(policies []string) error {
+	for _, policy := range policies {
+		switch policy {
+		case SHED_PAUSE_INPUTS, SHED_DROP_LOW_PRIORITY, SHED_SHRINK_POOL:
+		default:
+			return fmt.Errorf("unknown memory shed policy '%s'", policy)
+		}
+	}
+	return nil
+}
+
+// Periodically checks Heka's memory usage against the configured watermark,
+// shedding load until usage falls back below the low watermark.
+type memoryMonitor struct {
+	// 64-bit values accessed atomically come first to guarantee alignment.
+	inUse           uint64
+	droppedCount    int64
+	pConfig         *PipelineConfig
+	watermark       uint64
+	lowWatermark    uint64
+	interval        time.Duration
+	pauseInputs     bool
+	dropLowPriority bool
+	shrinkPool      bool
+	shedSeverity    int32
+	shedding        int32
+	// Input packs that have been taken out of circulation.
+	held     []*PipelinePack
+	readMem  func() uint64
+	stopChan chan struct{}
+	stopOnce sync.Once
+}
+
+func newMemoryMonitor(pConfig *PipelineConfig) *memoryMonitor {
+	globals := pConfig.Globals
+	m := &memoryMonitor{
+		pConfig:      pConfig,
+		watermark:    globals.MemoryWatermark,
+		lowWatermark: globals.MemoryLowWatermark,
+		interval:     globals.MemoryCheckInterval,
+		shedSeverity: globals.MemoryShedSeverity,
+		held:         make([]*PipelinePack, 0, globals.PoolSize),
+		readMem:      readMemInUse,
+		stopChan:     make(chan struct{}),
+	}
+	if m.lowWatermark == 0 || m.lowWatermark > m.watermark {
+		m.lowWatermark = m.watermark / 10 * 9
+	}
+	if m.interval <= 0 {
+		m.interval = time.Second
+	}
+	for _, policy := range globals.MemoryShedPolicies {
+		switch policy {
+		case SHED_PAUSE_INPUTS:
+			m.pauseInputs = true
+		case SHED_DROP_LOW_PRIORITY:
+			m.dropLowPriority = true
+		case SHED_SHRINK_POOL:
+			m.shrinkPool = true
+		}
+	}
+	return m
+}
+
+// Returns the amount of memory the Go runtime has obtained from the OS and
+// not yet returned.
+func readMemInUse() uint64 {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.Sys - stats.HeapReleased
+}
+
+func (m *memoryMonitor) run() {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.check()
+		case <-m.stopChan:
+			m.releasePacks()
+			return
+		}
+	}
+}
+
+func (m *memoryMonitor) stop() {
+	m.stopOnce.Do(func() {
+		close(m.stopChan)
+	})
+}
+
+// Compares current memory usage to the watermarks, starting or stopping load
+// shedding as appropriate.
+func (m *memoryMonitor) check() {
+	inUse := m.readMem()
+	atomic.StoreUint64(&m.inUse, inUse)
+	if m.isShedding() {
+		if inUse < m.lowWatermark {
+			atomic.StoreInt32(&m.shedding, 0)
+			m.releasePacks()
+			m.alert(inUse, "recovered")
+			return
+		}
+	} else {
+		if inUse <= m.watermark {
+			return
+		}
+		atomic.StoreInt32(&m.shedding, 1)
+		m.alert(inUse, "exceeded")
+	}
+	m.holdPacks()
+	if m.shrinkPool {
+		debug.FreeOSMemory()
+	}
+}
+
+func (m *memoryMonitor) isShedding() bool {
+	return atomic.LoadInt32(&m.shedding) == 1
+}
+
+// Called by the router for every incoming pack, returns true if the pack
+// should be dropped because we're shedding load.
+func (m *memoryMonitor) shouldDrop(pack *PipelinePack) bool {
+	if !m.dropLowPriority || !m.isShedding() {
+		return false
+	}
+	if pack.Message.GetSeverity() < m.shedSeverity {
+		return false
+	}
+	atomic.AddInt64(&m.droppedCount, 1)
+	return true
+}
+
+// Pulls available input packs out of the recycle channel until we're holding
+// as many as the active policies call for.
+func (m *memoryMonitor) holdPacks() {
+	var target int
+	poolSize := m.pConfig.inputPool.Size()
+	if m.pauseInputs {
+		target = poolSize
+	} else if m.shrinkPool {
+		target = poolSize / 2
+	}
+	for len(m.held) < target {
+		select {
+		case pack := <-m.pConfig.inputRecycleChan:
+			if m.shrinkPool {
+				// Let the GC reclaim the buffer, it will be reallocated as
+				// needed once the pack is back in circulation.
+				pack.MsgBytes = make([]byte, 0)
+			}
+			m.held = append(m.held, pack)
+		default:
+			return
+		}
+	}
+}
+
+// Puts any held packs back into circulation.
+func (m *memoryMonitor) releasePacks() {
+	for _, pack := range m.held {
+		m.pConfig.inputRecycleChan <- pack
+	}
+	m.held = m.held[:0]
+}
+
+// Logs the watermark state change and injects a `heka.memory-watermark`
+// message so the condition can be acted upon by filters and outputs.
+func (m *memoryMonitor) alert(inUse uint64, state string) {
+	LogError.Printf("Memory watermark %s: %d bytes in use, watermark %d bytes",
+		state, inUse, m.watermark)
+
+	var pack *PipelinePack
+	select {
+	case pack = <-m.pConfig.injectRecycleChan:
+	default:
+		LogError.Println("No pack available for memory watermark alert message.")
+		return
+	}
+	msg := pack.Message
+	msg.SetTimestamp(time.Now().UnixNano())
+	msg.SetHostname(m.pConfig.hostname)
+	msg.SetPid(m.pConfig.pid)
+	msg.SetLogger(HEKA_DAEMON)
+	msg.SetType("heka.memory-watermark")
+	msg.SetSeverity(1)
+	msg.SetPayload(fmt.Sprintf("memory watermark %s", state))
+	message.NewStringField(msg, "state", state)
+	message.NewInt64Field(msg, "MemoryInUse", int64(inUse), "B")
+	message.NewInt64Field(msg, "Watermark", int64(m.watermark), "B")
+	m.pConfig.router.Inject(pack)
+}
+
+// Populates the provided message with the monitor's current state.
+func (m *memoryMonitor) reportMsg(msg *message.Message) {
+	message.NewInt64Field(msg, "MemoryInUse", int64(atomic.LoadUint64(&m.inUse)), "B")
+	message.NewInt64Field(msg, "Watermark", int64(m.watermark), "B")
+	message.NewInt64Field(msg, "LowWatermark", int64(m.lowWatermark), "B")
+	if f, err := message.NewField("Shedding", m.isShedding(), ""); err == nil {
+		msg.AddField(f)
+	}
+	message.NewInt64Field(msg, "DroppedCount", atomic.LoadInt64(&m.droppedCount),
+		"count")
+}
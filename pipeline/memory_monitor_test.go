@@ -0,0 +1,122 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func MemoryMonitorSpec(c gs.Context) {
+	globals := DefaultGlobals()
+	globals.PoolSize = 10
+	globals.MemoryWatermark = 1000
+	pConfig := NewPipelineConfig(globals)
+	pConfig.inputPool.grow(globals.PoolSize)
+	pConfig.injectRecycleChan <- NewPipelinePack(pConfig.injectRecycleChan)
+
+	var memInUse uint64
+	newMonitor := func() *memoryMonitor {
+		m := newMemoryMonitor(pConfig)
+		m.readMem = func() uint64 { return memInUse }
+		return m
+	}
+
+	c.Specify("A memoryMonitor", func() {
+		c.Specify("defaults the low watermark to 90% of the watermark", func() {
+			m := newMonitor()
+			c.Expect(m.lowWatermark, gs.Equals, uint64(900))
+		})
+
+		c.Specify("doesn't shed load below the watermark", func() {
+			m := newMonitor()
+			memInUse = 999
+			m.check()
+			c.Expect(m.isShedding(), gs.IsFalse)
+			c.Expect(len(pConfig.router.InChan()), gs.Equals, 0)
+		})
+
+		c.Specify("drops low priority messages over the watermark", func() {
+			m := newMonitor()
+			memInUse = 2000
+			m.check()
+			c.Expect(m.isShedding(), gs.IsTrue)
+
+			alert := <-pConfig.router.InChan()
+			c.Expect(alert.Message.GetType(), gs.Equals, "heka.memory-watermark")
+			state, _ := alert.Message.GetFieldValue("state")
+			c.Expect(state.(string), gs.Equals, "exceeded")
+			c.Expect(m.shouldDrop(alert), gs.IsFalse)
+
+			pack := NewPipelinePack(nil)
+			pack.Message.SetSeverity(7)
+			c.Expect(m.shouldDrop(pack), gs.IsTrue)
+			pack.Message.SetSeverity(3)
+			c.Expect(m.shouldDrop(pack), gs.IsFalse)
+			c.Expect(m.droppedCount, gs.Equals, int64(1))
+
+			c.Specify("and stops once usage is below the low watermark", func() {
+				memInUse = 950
+				m.check()
+				c.Expect(m.isShedding(), gs.IsTrue)
+				memInUse = 899
+				m.check()
+				c.Expect(m.isShedding(), gs.IsFalse)
+				pack.Message.SetSeverity(7)
+				c.Expect(m.shouldDrop(pack), gs.IsFalse)
+			})
+		})
+
+		c.Specify("shrinks the input pool", func() {
+			globals.MemoryShedPolicies = []string{SHED_SHRINK_POOL}
+			m := newMonitor()
+			memInUse = 2000
+			m.check()
+			c.Expect(len(pConfig.inputRecycleChan), gs.Equals, globals.PoolSize/2)
+			c.Expect(len(m.held), gs.Equals, globals.PoolSize/2)
+			c.Expect(cap(m.held[0].MsgBytes), gs.Equals, 0)
+
+			memInUse = 100
+			m.check()
+			c.Expect(len(pConfig.inputRecycleChan), gs.Equals, globals.PoolSize)
+			c.Expect(len(m.held), gs.Equals, 0)
+		})
+
+		c.Specify("pauses inputs by holding every input pack", func() {
+			globals.MemoryShedPolicies = []string{SHED_PAUSE_INPUTS}
+			m := newMonitor()
+			memInUse = 2000
+			m.check()
+			c.Expect(len(pConfig.inputRecycleChan), gs.Equals, 0)
+
+			c.Specify("and releases them when stopped", func() {
+				done := make(chan struct{})
+				go func() {
+					m.run()
+					close(done)
+				}()
+				m.stop()
+				<-done
+				c.Expect(len(pConfig.inputRecycleChan), gs.Equals, globals.PoolSize)
+			})
+		})
+	})
+
+	c.Specify("ValidateMemoryShedPolicies", func() {
+		err := ValidateMemoryShedPolicies([]string{SHED_PAUSE_INPUTS, SHED_SHRINK_POOL})
+		c.Expect(err, gs.IsNil)
+		err = ValidateMemoryShedPolicies([]string{"drop_everything"})
+		c.Expect(err.Error(), gs.Equals, "unknown memory shed policy 'drop_everything'")
+	})
+}
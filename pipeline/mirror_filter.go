@@ -0,0 +1,152 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// Filter that duplicates a percentage of the messages it matches to a
+// secondary plugin, e.g. an output writing to a new cluster, w/o affecting
+// the delivery of the messages to the plugins already matching them.
+type MirrorFilter struct {
+	mirrorTo     string
+	route        []string
+	fraction     float64
+	variable     *hashVariable
+	dropWhenBusy bool
+	mirrored     int64
+	busy         int64
+}
+
+type MirrorFilterConfig struct {
+	// Name of the plugin the copies are routed to.
+	MirrorTo string `toml:"mirror_to"`
+	// Percentage of the matched messages to mirror, defaults to 100.
+	Percent float64 `toml:"percent"`
+	// If set, messages are sampled by hashing this message variable rather
+	// than at random, so all of the messages w/ the same value are either
+	// mirrored or not. See the SharderFilter's `hash_variable`.
+	HashVariable string `toml:"hash_variable"`
+	// Whether to drop the copies rather than wait when the mirror's input
+	// channel is full, so a slow mirror can't hold up the router. Defaults
+	// to true.
+	DropWhenBusy bool `toml:"drop_when_busy"`
+}
+
+func (m *MirrorFilter) ConfigStruct() interface{} {
+	return &MirrorFilterConfig{
+		Percent:      100,
+		DropWhenBusy: true,
+	}
+}
+
+func (m *MirrorFilter) Init(config interface{}) (err error) {
+	conf := config.(*MirrorFilterConfig)
+	if conf.MirrorTo == "" {
+		return errors.New("MirrorFilter requires a mirror_to plugin")
+	}
+	if conf.Percent <= 0 || conf.Percent > 100 {
+		return fmt.Errorf("MirrorFilter percent must be above 0 and at most 100, got %g",
+			conf.Percent)
+	}
+	m.variable = nil
+	if conf.HashVariable != "" {
+		if m.variable, err = newHashVariable(conf.HashVariable); err != nil {
+			return fmt.Errorf("MirrorFilter %s", err)
+		}
+	}
+	m.mirrorTo = conf.MirrorTo
+	m.route = []string{conf.MirrorTo}
+	m.fraction = conf.Percent / 100
+	m.dropWhenBusy = conf.DropWhenBusy
+	return nil
+}
+
+func (m *MirrorFilter) Run(fr FilterRunner, h PluginHelper) error {
+	if m.mirrorTo == fr.Name() {
+		return errors.New("can't mirror to itself")
+	}
+	pConfig := h.PipelineConfig()
+	var matcher *MatchRunner
+	if oRunner, ok := pConfig.Output(m.mirrorTo); ok {
+		matcher = oRunner.MatchRunner()
+	} else if fRunner, ok := pConfig.Filter(m.mirrorTo); ok {
+		matcher = fRunner.MatchRunner()
+	} else {
+		return fmt.Errorf("unknown mirror_to plugin %s", m.mirrorTo)
+	}
+
+	for pack := range fr.InChan() {
+		if !m.sampled(pack.Message) {
+			fr.UpdateCursor(pack.QueueCursor)
+			pack.Recycle(nil)
+			continue
+		}
+		if m.dropWhenBusy && matcher.InChanLen() >= cap(matcher.inChan) {
+			atomic.AddInt64(&m.busy, 1)
+			fr.UpdateCursor(pack.QueueCursor)
+			pack.Recycle(nil)
+			continue
+		}
+
+		newPack, err := h.PipelinePack(pack.MsgLoopCount)
+		if err != nil {
+			fr.UpdateCursor(pack.QueueCursor)
+			pack.Recycle(err)
+			return err
+		}
+		pack.Message.Copy(newPack.Message)
+		newPack.routeTo = m.route
+		if fr.Inject(newPack) {
+			atomic.AddInt64(&m.mirrored, 1)
+		}
+		fr.UpdateCursor(pack.QueueCursor)
+		pack.Recycle(nil)
+	}
+	return nil
+}
+
+// Whether the message is one of the mirrored percentage. Messages w/o the
+// hash variable are sampled at random.
+func (m *MirrorFilter) sampled(msg *message.Message) bool {
+	if m.fraction >= 1 {
+		return true
+	}
+	if m.variable != nil {
+		if key, ok := m.variable.value(msg); ok {
+			u := float64(mix64(hashString(key))>>11) / (1 << 53)
+			return u < m.fraction
+		}
+	}
+	return rand.Float64() < m.fraction
+}
+
+func (m *MirrorFilter) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "MirroredCount", atomic.LoadInt64(&m.mirrored), "count")
+	message.NewInt64Field(msg, "DroppedBusyCount", atomic.LoadInt64(&m.busy), "count")
+	return nil
+}
+
+func init() {
+	RegisterPlugin("MirrorFilter", func() interface{} {
+		return new(MirrorFilter)
+	})
+}
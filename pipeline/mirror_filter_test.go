@@ -0,0 +1,75 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"strconv"
+
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func MirrorFilterSpec(c gs.Context) {
+	c.Specify("A MirrorFilter", func() {
+		filter := new(MirrorFilter)
+		config := filter.ConfigStruct().(*MirrorFilterConfig)
+		config.MirrorTo = "es-new"
+		config.Percent = 20
+
+		c.Specify("samples the configured percentage by hash", func() {
+			config.HashVariable = "Fields[customer]"
+			err := filter.Init(config)
+			c.Assume(err, gs.IsNil)
+			msg := new(message.Message)
+			sampled := make(map[string]bool)
+			count := 0
+			for i := 0; i < 10000; i++ {
+				customer := strconv.Itoa(i % 1000)
+				msg.Fields = nil
+				message.NewStringField(msg, "customer", customer)
+				s := filter.sampled(msg)
+				if prev, ok := sampled[customer]; ok {
+					// The same customer is always either mirrored or not.
+					c.Expect(s, gs.Equals, prev)
+				}
+				sampled[customer] = s
+				if s {
+					count++
+				}
+			}
+			c.Expect(count > 1500 && count < 2500, gs.IsTrue)
+		})
+
+		c.Specify("mirrors everything at 100 percent", func() {
+			config.Percent = 100
+			err := filter.Init(config)
+			c.Assume(err, gs.IsNil)
+			c.Expect(filter.sampled(new(message.Message)), gs.IsTrue)
+		})
+
+		c.Specify("rejects invalid configs", func() {
+			config.Percent = 0
+			c.Expect(filter.Init(config), gs.Not(gs.IsNil))
+			config.Percent = 101
+			c.Expect(filter.Init(config), gs.Not(gs.IsNil))
+			config.Percent = 50
+			config.HashVariable = "Fields"
+			c.Expect(filter.Init(config), gs.Not(gs.IsNil))
+			config.HashVariable = ""
+			config.MirrorTo = ""
+			c.Expect(filter.Init(config), gs.Not(gs.IsNil))
+		})
+	})
+}
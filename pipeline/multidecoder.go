@@ -154,9 +154,11 @@ type MultiDecoder struct {
 	processMessageFailures []int64
 	processMessageSamples  []int64
 	processMessageDuration []int64
+	totalMessageCount      int64
 	totalMessageFailures   int64
 	totalMessageSamples    int64
 	totalMessageDuration   int64
+	processMessageSkipped  []int64
 	idx                    uint8
 	sampleDenominator      int
 	sample                 bool
@@ -165,6 +167,7 @@ type MultiDecoder struct {
 	Config                 *MultiDecoderConfig
 	Name                   string
 	Decoders               []Decoder
+	matchers               []*message.MatcherSpecification
 	dRunner                DecoderRunner
 	CascStrat              int
 	neverTrustEncodes      bool
@@ -174,18 +177,28 @@ type MultiDecoderConfig struct {
 	Subs            []string
 	LogSubErrors    bool   `toml:"log_sub_errors"`
 	CascadeStrategy string `toml:"cascade_strategy"`
+	// Message matchers keyed by subdecoder name, a subdecoder is only applied
+	// to the messages its matcher matches.
+	SubMatchers map[string]string `toml:"sub_matchers"`
 }
 
 const (
 	CASC_FIRST_WINS = iota
 	CASC_ALL
+	CASC_STOP_ON_ERROR
 )
 
-var mdStrategies = map[string]int{"first-wins": CASC_FIRST_WINS, "all": CASC_ALL}
+var mdStrategies = map[string]int{
+	"first-wins":    CASC_FIRST_WINS,
+	"all":           CASC_ALL,
+	"stop-on-error": CASC_STOP_ON_ERROR,
+}
 
 func (md *MultiDecoder) ConfigStruct() interface{} {
-	subs := make([]string, 0)
-	return &MultiDecoderConfig{subs, false, "first-wins"}
+	return &MultiDecoderConfig{
+		Subs:            make([]string, 0),
+		CascadeStrategy: "first-wins",
+	}
 }
 
 // Heka will call this before calling Init() to set the name of the
@@ -226,13 +239,24 @@ func (md *MultiDecoder) Init(config interface{}) (err error) {
 		md.Decoders[i] = decoder
 	}
 
+	md.matchers = make([]*message.MatcherSpecification, numSubs)
+	for name, matcher := range md.Config.SubMatchers {
+		i := md.subIndex(name)
+		if i < 0 {
+			return fmt.Errorf("Matcher for unlisted subdecoder: %s", name)
+		}
+		if md.matchers[i], err = message.CreateMatcherSpecification(matcher); err != nil {
+			return fmt.Errorf("Invalid matcher for subdecoder '%s': %s", name, err)
+		}
+	}
+
 	// We can trust the embedded decoders to leave the pack.MsgBytes and
 	// pack.TrustMsgBytes values in the right state in all cases except when
-	// cascade_strategy == "all", an earlier decoder sets the encoding, but
-	// the last one in the list does not. We check for this case and, if so,
-	// explicitly set pack.TrustMsgBytes to false for all packs on every
-	// successful decode.
-	if md.CascStrat == CASC_ALL {
+	// cascade_strategy is "all" or "stop-on-error", an earlier decoder sets
+	// the encoding, but the last one in the list does not. We check for this
+	// case and, if so, explicitly set pack.TrustMsgBytes to false for all
+	// packs on every successful decode.
+	if md.CascStrat != CASC_FIRST_WINS {
 		lastDecoder := md.Decoders[len(md.Decoders)-1]
 		_, ok = lastDecoder.(EncodesMsgBytes)
 		if !ok {
@@ -249,10 +273,32 @@ func (md *MultiDecoder) Init(config interface{}) (err error) {
 	md.processMessageFailures = make([]int64, numSubs)
 	md.processMessageSamples = make([]int64, numSubs)
 	md.processMessageDuration = make([]int64, numSubs)
+	md.processMessageSkipped = make([]int64, numSubs)
 	md.sampleDenominator = md.pConfig.Globals.SampleDenominator
 	return nil
 }
 
+// Returns the position of the named subdecoder in the subs list, or -1 if it
+// isn't listed.
+func (md *MultiDecoder) subIndex(name string) int {
+	for i, sub := range md.Config.Subs {
+		if sub == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Checks the pack's message against the i-th subdecoder's matcher, counting
+// the message as skipped if the subdecoder doesn't apply to it.
+func (md *MultiDecoder) applies(i int, pack *PipelinePack) bool {
+	if md.matchers[i] == nil || md.matchers[i].Match(pack.Message) {
+		return true
+	}
+	atomic.AddInt64(&md.processMessageSkipped[i], 1)
+	return false
+}
+
 // Heka will call this to give us access to the runner. We'll store it for
 // ourselves, but also have to pass on a wrapped version to any subdecoders
 // that might need it.
@@ -303,19 +349,27 @@ func (md *MultiDecoder) Shutdown() {
 }
 
 // Recurses through a decoder chain, decoding the original pack and returning
-// it and any generated extra packs.
+// it and any generated extra packs. Packs a subdecoder's matcher doesn't
+// match are passed on as is. W/ the "stop-on-error" strategy the first
+// subdecoder failure ends the recursion, returning the error along w/ the
+// packs decoded so far.
 func (md *MultiDecoder) getDecodedPacks(chain []Decoder, inPacks []*PipelinePack) (
-	packs []*PipelinePack, anyMatch bool) {
+	packs []*PipelinePack, anyMatch bool, err error) {
 
 	var startTime time.Time
 
 	decoder := chain[0]
-	for _, p := range inPacks {
+	idx := len(md.Decoders) - len(chain)
+	for i, p := range inPacks {
+		if !md.applies(idx, p) {
+			packs = append(packs, p)
+			continue
+		}
 		atomic.AddInt64(&md.processMessageCount[md.idx], 1)
 		if md.sample {
 			startTime = time.Now()
 		}
-		ps, err := decoder.Decode(p)
+		ps, decodeErr := decoder.Decode(p)
 		if md.sample {
 			duration := time.Since(startTime).Nanoseconds()
 			md.reportLock.Lock()
@@ -328,20 +382,27 @@ func (md *MultiDecoder) getDecodedPacks(chain []Decoder, inPacks []*PipelinePack
 			packs = append(packs, ps...)
 		} else {
 			atomic.AddInt64(&md.processMessageFailures[md.idx], 1)
-			if err != nil && md.Config.LogSubErrors {
-				idx := len(md.Decoders) - len(chain)
-				err = fmt.Errorf("Subdecoder '%s' decode error: %s",
-					md.Config.Subs[idx], err)
-				md.dRunner.LogError(err)
+			if decodeErr != nil && md.Config.LogSubErrors {
+				md.dRunner.LogError(fmt.Errorf("Subdecoder '%s' decode error: %s",
+					md.Config.Subs[idx], decodeErr))
 			}
 			packs = append(packs, p)
+			if md.CascStrat == CASC_STOP_ON_ERROR {
+				if decodeErr == nil {
+					decodeErr = errors.New("no message decoded")
+				}
+				err = fmt.Errorf("Subdecoder '%s' failed: %s", md.Config.Subs[idx],
+					decodeErr)
+				packs = append(packs, inPacks[i+1:]...)
+				return
+			}
 		}
 	}
 
 	if len(chain) > 1 {
 		md.idx++
 		var otherMatch bool
-		packs, otherMatch = md.getDecodedPacks(chain[1:], packs)
+		packs, otherMatch, err = md.getDecodedPacks(chain[1:], packs)
 		anyMatch = anyMatch || otherMatch
 	}
 
@@ -350,8 +411,8 @@ func (md *MultiDecoder) getDecodedPacks(chain []Decoder, inPacks []*PipelinePack
 
 // Runs the message payload against each of the decoders.
 func (md *MultiDecoder) Decode(pack *PipelinePack) (packs []*PipelinePack, err error) {
-	md.sample = (rand.Intn(md.sampleDenominator) == 0 ||
-		atomic.LoadInt64(&md.processMessageCount[0]) == 0)
+	count := atomic.AddInt64(&md.totalMessageCount, 1)
+	md.sample = rand.Intn(md.sampleDenominator) == 0 || count == 1
 
 	var startTime time.Time
 	if md.sample {
@@ -369,6 +430,9 @@ func (md *MultiDecoder) Decode(pack *PipelinePack) (packs []*PipelinePack, err e
 		var subStartTime time.Time
 
 		for i, d := range md.Decoders {
+			if !md.applies(i, pack) {
+				continue
+			}
 			count := atomic.AddInt64(&md.processMessageCount[i], 1)
 			if md.sample || count == 1 {
 				subStartTime = time.Now()
@@ -396,11 +460,22 @@ func (md *MultiDecoder) Decode(pack *PipelinePack) (packs []*PipelinePack, err e
 		err = errors.New("All subdecoders failed.")
 		packs = nil
 	} else {
-		// If we get here we know cascade_strategy == "all".
+		// If we get here we know cascade_strategy is "all" or
+		// "stop-on-error".
 		var anyMatch bool
 		md.idx = 0
-		packs, anyMatch = md.getDecodedPacks(md.Decoders, []*PipelinePack{pack})
-		if !anyMatch {
+		packs, anyMatch, err = md.getDecodedPacks(md.Decoders, []*PipelinePack{pack})
+		if err != nil {
+			// The original pack is recycled by the DecoderRunner, any extra
+			// packs generated before the failure have to be recycled here.
+			for _, p := range packs {
+				if p != pack {
+					p.recycle()
+				}
+			}
+			atomic.AddInt64(&md.totalMessageFailures, 1)
+			packs = nil
+		} else if !anyMatch {
 			atomic.AddInt64(&md.totalMessageFailures, 1)
 			err = errors.New("All subdecoders failed.")
 			packs = nil
@@ -431,6 +506,10 @@ func (md *MultiDecoder) ReportMsg(msg *message.Message) error {
 			fmt.Sprintf("ProcessMessageFailures-%s", sub),
 			atomic.LoadInt64(&md.processMessageFailures[i]), "count")
 
+		message.NewInt64Field(msg,
+			fmt.Sprintf("ProcessMessageSkipped-%s", sub),
+			atomic.LoadInt64(&md.processMessageSkipped[i]), "count")
+
 		message.NewInt64Field(msg,
 			fmt.Sprintf("ProcessMessageSamples-%s", sub),
 			md.processMessageSamples[i], "count")
@@ -443,7 +522,7 @@ func (md *MultiDecoder) ReportMsg(msg *message.Message) error {
 			fmt.Sprintf("ProcessMessageAvgDuration-%s", sub), tmp, "ns")
 	}
 	message.NewInt64Field(msg, "ProcessMessageCount",
-		atomic.LoadInt64(&md.processMessageCount[0]), "count")
+		atomic.LoadInt64(&md.totalMessageCount), "count")
 	message.NewInt64Field(msg, "ProcessMessageFailures",
 		atomic.LoadInt64(&md.totalMessageFailures), "count")
 	message.NewInt64Field(msg, "ProcessMessageSamples", md.totalMessageSamples, "count")
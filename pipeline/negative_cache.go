@@ -0,0 +1,86 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"sync/atomic"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+type headerKey struct {
+	typ, logger string
+}
+
+// Remembers the Type and Logger pairs of the messages a matcher didn't match,
+// for matchers that only test those headers, so their expression isn't
+// evaluated again for messages w/ the same headers. Only used from the
+// matcher's goroutine, except for the hit count.
+type negativeCache struct {
+	// 64-bit values accessed atomically come first to guarantee alignment.
+	hitCount   int64
+	misses     map[headerKey]struct{}
+	size       int
+	globals    *GlobalConfigStruct
+	generation int64
+}
+
+func newNegativeCache(size int, globals *GlobalConfigStruct) *negativeCache {
+	c := &negativeCache{
+		misses:  make(map[headerKey]struct{}),
+		size:    size,
+		globals: globals,
+	}
+	if globals != nil {
+		c.generation = globals.matcherCacheGeneration()
+	}
+	return c
+}
+
+// Returns whether the matcher is known not to match the message.
+func (c *negativeCache) known(msg *message.Message) bool {
+	if c.globals != nil {
+		// Forget everything learned before the last config reload.
+		if gen := c.globals.matcherCacheGeneration(); gen != c.generation {
+			c.misses = make(map[headerKey]struct{})
+			c.generation = gen
+		}
+	}
+	if _, ok := c.misses[headerKey{msg.GetType(), msg.GetLogger()}]; ok {
+		atomic.AddInt64(&c.hitCount, 1)
+		return true
+	}
+	return false
+}
+
+// Records that the matcher didn't match the message, starting over if the
+// cache is full.
+func (c *negativeCache) add(msg *message.Message) {
+	if len(c.misses) >= c.size {
+		c.misses = make(map[headerKey]struct{})
+	}
+	c.misses[headerKey{msg.GetType(), msg.GetLogger()}] = struct{}{}
+}
+
+// Returns the generation of the matchers' caches, bumped by
+// invalidateMatcherCaches.
+func (g *GlobalConfigStruct) matcherCacheGeneration() int64 {
+	return atomic.LoadInt64(&g.matcherCacheGen)
+}
+
+// Makes the matchers drop the results they cached, e.g. on config reload.
+func (g *GlobalConfigStruct) invalidateMatcherCaches() {
+	atomic.AddInt64(&g.matcherCacheGen, 1)
+}
@@ -0,0 +1,90 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func NegativeCacheSpec(c gs.Context) {
+	globals := DefaultGlobals()
+	msg := new(message.Message)
+	msg.SetType("miss")
+	msg.SetLogger("spec")
+
+	c.Specify("A negative cache", func() {
+		cache := newNegativeCache(2, globals)
+
+		c.Specify("remembers the headers of missed messages", func() {
+			c.Expect(cache.known(msg), gs.IsFalse)
+			cache.add(msg)
+			c.Expect(cache.known(msg), gs.IsTrue)
+			other := message.CopyMessage(msg)
+			other.SetLogger("other")
+			c.Expect(cache.known(other), gs.IsFalse)
+			c.Expect(cache.hitCount, gs.Equals, int64(1))
+		})
+
+		c.Specify("starts over when full", func() {
+			for _, typ := range []string{"a", "b", "c"} {
+				m := message.CopyMessage(msg)
+				m.SetType(typ)
+				cache.add(m)
+			}
+			c.Expect(len(cache.misses), gs.Equals, 1)
+		})
+
+		c.Specify("is invalidated on reload", func() {
+			cache.add(msg)
+			globals.invalidateMatcherCaches()
+			c.Expect(cache.known(msg), gs.IsFalse)
+		})
+	})
+
+	c.Specify("A matcher w/ a negative cache", func() {
+		spec := "Type == 'hit'"
+		matchChan := make(chan *PipelinePack, 1)
+		fRunner, err := NewFORunner("counter", new(CounterFilter),
+			CommonFOConfig{Matcher: spec}, "CounterFilter", 10)
+		c.Assume(err, gs.IsNil)
+		mr, err := NewMatchRunner(spec, "", fRunner, 10, matchChan)
+		c.Assume(err, gs.IsNil)
+		c.Assume(mr.spec.TypeLoggerOnly(), gs.IsTrue)
+		mr.globals = globals
+		mr.negCache = newNegativeCache(10, globals)
+
+		for _, typ := range []string{"miss", "hit", "miss", "miss"} {
+			pack := NewPipelinePack(make(chan *PipelinePack, 1))
+			pack.Message.SetType(typ)
+			mr.inChan <- pack
+		}
+		close(mr.inChan)
+		mr.run(1)
+
+		c.Specify("skips evaluating known misses", func() {
+			c.Expect(mr.negCache.hitCount, gs.Equals, int64(2))
+			c.Expect(len(matchChan), gs.Equals, 1)
+			report := new(message.Message)
+			mr.reportMsg(report)
+			value, _ := report.GetFieldValue("MatchEvalCount")
+			c.Expect(value, gs.Equals, int64(4))
+			value, _ = report.GetFieldValue("MatchMissCount")
+			c.Expect(value, gs.Equals, int64(3))
+			value, _ = report.GetFieldValue("MatchNegativeCacheHits")
+			c.Expect(value, gs.Equals, int64(2))
+		})
+	})
+}
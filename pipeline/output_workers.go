@@ -0,0 +1,310 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// One of the delivery goroutines of an output w/ a `workers` setting. Each
+// worker has its own plugin instance, encoder and ticker, and is the
+// OutputRunner its plugin sees. They share the output's input channel or, if
+// buffering, the records of its buffer.
+type outputWorker struct {
+	*foRunner
+	id      int
+	plugin  Plugin
+	encoder Encoder
+	ticker  <-chan time.Time
+}
+
+func (w *outputWorker) Encoder() Encoder {
+	return w.encoder
+}
+
+func (w *outputWorker) Encode(pack *PipelinePack) (output []byte, err error) {
+	return encodePack(w.encoder, pack, w.useFraming, w.globals())
+}
+
+func (w *outputWorker) Ticker() (ticker <-chan time.Time) {
+	return w.ticker
+}
+
+func (w *outputWorker) UpdateCursor(queueCursor string) {
+	if w.cursors == nil {
+		return
+	}
+	if err := w.cursors.delivered(w.id, queueCursor); err != nil {
+		w.LogError(fmt.Errorf("updating buffer cursor: %s", err))
+	}
+}
+
+// Creates the output's workers, the first using the output's own plugin and
+// encoder.
+func (foRunner *foRunner) makeWorkers() error {
+	if foRunner.maker == nil {
+		foRunner.pConfig.makersLock.RLock()
+		foRunner.maker = foRunner.pConfig.makers["Output"][foRunner.name]
+		foRunner.pConfig.makersLock.RUnlock()
+		if foRunner.maker == nil {
+			return fmt.Errorf("%s can't create workers w/o a plugin maker", foRunner.name)
+		}
+	}
+	foRunner.workers = make([]*outputWorker, foRunner.config.Workers)
+	for i := range foRunner.workers {
+		w := &outputWorker{
+			foRunner: foRunner,
+			id:       i,
+			plugin:   foRunner.plugin,
+			encoder:  foRunner.encoder,
+			ticker:   foRunner.ticker,
+		}
+		if i > 0 {
+			var err error
+			if w.plugin, _, err = foRunner.maker.Make(); err != nil {
+				return fmt.Errorf("%s can't create worker %d: %s", foRunner.name, i, err)
+			}
+			if foRunner.config.Encoder != "" {
+				fullName := fmt.Sprintf("%s-%s-%d", foRunner.name, foRunner.config.Encoder, i)
+				encoder, ok := foRunner.pConfig.Encoder(foRunner.config.Encoder, fullName)
+				if !ok {
+					return fmt.Errorf("%s can't create encoder %s", foRunner.name,
+						foRunner.config.Encoder)
+				}
+				w.encoder = encoder
+			}
+			if foRunner.config.Ticker != 0 {
+				tickLength := time.Duration(foRunner.config.Ticker) * time.Second
+				w.ticker = foRunner.pConfig.Globals.Clock.NewTicker(tickLength).Chan()
+			}
+		}
+		foRunner.workers[i] = w
+	}
+	if foRunner.useBuffering {
+		foRunner.work = make(chan bufferedWork)
+		foRunner.readerDone = make(chan struct{})
+		foRunner.cursors = &cursorTracker{reader: foRunner.bufReader}
+	}
+	return nil
+}
+
+// Runs all of the workers until they've stopped, along w/ the buffer reader
+// handing them the buffered records if buffering. Returns false if none of
+// the workers' plugins were ever run.
+func (foRunner *foRunner) runWorkers(h PluginHelper) bool {
+	var (
+		wg      sync.WaitGroup
+		started int32
+	)
+	for _, w := range foRunner.workers {
+		wg.Add(1)
+		go func(w *outputWorker) {
+			defer wg.Done()
+			if foRunner.runPlugin(w.plugin, w, h) {
+				atomic.StoreInt32(&started, 1)
+			}
+		}(w)
+	}
+	if foRunner.useBuffering {
+		workersDone := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(workersDone)
+		}()
+		dispatcher := &bufferDispatcher{foRunner: foRunner, workersDone: workersDone}
+		err := foRunner.bufReader.NewStreamOutput(dispatcher, foRunner.backChan, nil, nil,
+			foRunner.stopChan)
+		if err != nil {
+			foRunner.lastErr = err
+			foRunner.LogError(fmt.Errorf("StreamOutput stopped: %s", err.Error()))
+		}
+		close(foRunner.readerDone)
+		close(foRunner.work)
+	}
+	wg.Wait()
+	return atomic.LoadInt32(&started) == 1
+}
+
+// Whether the worker can't be restarted b/c the buffer reader feeding it has
+// stopped.
+func (w *outputWorker) readerStopped() bool {
+	if w.readerDone == nil {
+		return false
+	}
+	select {
+	case <-w.readerDone:
+		return true
+	default:
+		return false
+	}
+}
+
+// A buffered record handed to a worker.
+type bufferedWork struct {
+	pack  *PipelinePack
+	entry *cursorEntry
+}
+
+// The MessageProcessor the output's BufferReader feeds, handing each record
+// to the next free worker.
+type bufferDispatcher struct {
+	*foRunner
+	workersDone chan struct{}
+}
+
+var errWorkersStopped = NewPluginExitError("all workers have stopped")
+
+func (d *bufferDispatcher) ProcessMessage(pack *PipelinePack) error {
+	entry := d.cursors.dispatched(pack.QueueCursor)
+	// The reader recycles the pack once we return, the worker's reference
+	// keeps it from going back into the supply before the worker's done.
+	atomic.AddInt32(&pack.RefCount, 1)
+	select {
+	case d.work <- bufferedWork{pack: pack, entry: entry}:
+		return nil
+	case <-d.workersDone:
+		pack.recycle()
+		return errWorkersStopped
+	}
+}
+
+// bufferedLoop is run by each worker of a buffered output, processing the
+// records the buffer reader hands it.
+func (w *outputWorker) bufferedLoop(plugin MessageProcessor, tickReceiver TickerPlugin) error {
+	rh, _ := NewRetryHelper(RetryOptions{
+		MaxDelay:   "1s",
+		Delay:      "10ms",
+		MaxRetries: -1,
+	})
+	rh.SetClock(w.pConfig.Globals.Clock)
+
+	for {
+		select {
+		case work, ok := <-w.work:
+			if !ok {
+				return nil
+			}
+			w.cursors.claim(work.entry, w.id)
+			if err := w.deliverBuffered(plugin, work.pack, rh); err != nil {
+				return err
+			}
+		case <-w.ticker:
+			if err := tickReceiver.TimerEvent(); err != nil {
+				if _, isFatal := err.(PluginExitError); isFatal {
+					return err
+				}
+				w.LogError(fmt.Errorf("running TimerEvent: %s", err))
+			}
+		}
+	}
+}
+
+func (w *outputWorker) deliverBuffered(plugin MessageProcessor, pack *PipelinePack,
+	rh *RetryHelper) error {
+
+	defer rh.Reset()
+	for !w.pConfig.Globals.IsShuttingDown() {
+		err := plugin.ProcessMessage(pack)
+		if err == nil {
+			if w.latency != nil {
+				w.latency.observe(pack.Message)
+			}
+			pack.recycle()
+			return nil
+		}
+		switch err.(type) {
+		case PluginExitError:
+			pack.recycle()
+			return err
+		case RetryMessageError:
+			w.LogError(fmt.Errorf("can't send record: %s", err))
+			rh.Wait()
+		default:
+			w.LogError(err)
+			pack.recycle()
+			return nil
+		}
+	}
+	pack.recycle()
+	return nil
+}
+
+// A buffered record handed to a worker, identified by the queue cursor just
+// past it.
+type cursorEntry struct {
+	cursor    string
+	worker    int
+	delivered bool
+}
+
+// Tracks the buffered records handed to an output's workers, so the buffer's
+// cursor only advances past records once they've all been delivered, no
+// matter which worker finishes first. A worker updating the cursor to one of
+// its records means it's done w/ all of the records it was handed up to
+// that one.
+type cursorTracker struct {
+	lock    sync.Mutex
+	reader  *BufferReader
+	pending []*cursorEntry
+}
+
+func (t *cursorTracker) dispatched(cursor string) *cursorEntry {
+	entry := &cursorEntry{cursor: cursor, worker: -1}
+	t.lock.Lock()
+	t.pending = append(t.pending, entry)
+	t.lock.Unlock()
+	return entry
+}
+
+func (t *cursorTracker) claim(entry *cursorEntry, worker int) {
+	t.lock.Lock()
+	entry.worker = worker
+	t.lock.Unlock()
+}
+
+func (t *cursorTracker) delivered(worker int, cursor string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	last := -1
+	for i, entry := range t.pending {
+		if entry.worker == worker && entry.cursor == cursor {
+			last = i
+			break
+		}
+	}
+	if last == -1 {
+		// Already advanced past.
+		return nil
+	}
+	for _, entry := range t.pending[:last+1] {
+		if entry.worker == worker {
+			entry.delivered = true
+		}
+	}
+	// Advances past the delivered records at the front of the queue.
+	n := 0
+	for n < len(t.pending) && t.pending[n].delivered {
+		n++
+	}
+	if n == 0 {
+		return nil
+	}
+	cursor = t.pending[n-1].cursor
+	t.pending = append(t.pending[:0], t.pending[n:]...)
+	return t.reader.updateCursor(cursor)
+}
@@ -0,0 +1,207 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"unicode/utf8"
+
+	"github.com/mozilla-services/heka/framing"
+	"github.com/mozilla-services/heka/message"
+	"github.com/pborman/uuid"
+)
+
+// Actions that can be taken on a message whose encoding exceeds
+// MAX_MESSAGE_SIZE when it's framed, i.e. by an output using `use_framing`
+// or when it's written to a disk buffer.
+const (
+	// Drop the message, logging an error.
+	OVERSIZED_DROP = "drop"
+	// Cut the payload short, adding a `truncated_from` field w/ its original
+	// size.
+	OVERSIZED_TRUNCATE = "truncate"
+	// Split the payload across continuation messages, linked by their
+	// `continuation_of`, `continuation_index` and `continuation_count`
+	// fields.
+	OVERSIZED_SPLIT = "split"
+	// Write the full payload to a file in the spill directory, adding a
+	// `payload_spill_path` field and truncating the message's payload.
+	OVERSIZED_SPILL = "spill"
+)
+
+// Room left in a fitted message for the fields marking it.
+const oversizedMarkerSize = 256
+
+// Verifies that the provided oversized message action is known.
+func ValidateOversizedAction(action string) error {
+	switch action {
+	case OVERSIZED_DROP, OVERSIZED_TRUNCATE, OVERSIZED_SPLIT, OVERSIZED_SPILL:
+		return nil
+	}
+	return fmt.Errorf("unknown oversized message action '%s'", action)
+}
+
+// Returns the directory oversized payloads are spilled to.
+func (g *GlobalConfigStruct) spillDir() string {
+	if g.OversizedSpillDir != "" {
+		return g.OversizedSpillDir
+	}
+	return g.PrependBaseDir("spill")
+}
+
+// Returns the messages to frame in place of one whose encoding takes `size`
+// bytes, more than MAX_MESSAGE_SIZE, according to the oversized message
+// action. Only the payload is cut down, so an error is returned if the rest
+// of the message doesn't fit either.
+func (g *GlobalConfigStruct) fitMessage(msg *message.Message, size int) (
+	[]*message.Message, error) {
+
+	tooBig := fmt.Errorf("Message too big, requires %d (MAX_MESSAGE_SIZE = %d)",
+		size, message.MAX_MESSAGE_SIZE)
+	if g == nil || g.OversizedMessageAction == "" ||
+		g.OversizedMessageAction == OVERSIZED_DROP {
+		return nil, tooBig
+	}
+	payload := msg.GetPayload()
+	limit := int(message.MAX_MESSAGE_SIZE) - (size - len(payload)) - oversizedMarkerSize
+	if limit <= 0 {
+		return nil, fmt.Errorf("%s, even w/o its payload", tooBig)
+	}
+
+	switch g.OversizedMessageAction {
+	case OVERSIZED_TRUNCATE:
+		m := truncatePayload(msg, limit)
+		return []*message.Message{m}, nil
+	case OVERSIZED_SPILL:
+		path, err := g.spillPayload(msg)
+		if err != nil {
+			return nil, fmt.Errorf("can't spill oversized payload: %s", err)
+		}
+		m := truncatePayload(msg, limit)
+		message.NewStringField(m, "payload_spill_path", path)
+		return []*message.Message{m}, nil
+	case OVERSIZED_SPLIT:
+		ends := splitPayload(payload, limit)
+		count := len(ends)
+		parts := make([]*message.Message, 0, count)
+		start := 0
+		for i, end := range ends {
+			m := message.CopyMessage(msg)
+			m.SetPayload(payload[start:end])
+			start = end
+			if i > 0 {
+				m.SetUuid(uuid.NewRandom())
+			}
+			message.NewStringField(m, "continuation_of", msg.GetUuidString())
+			message.NewIntField(m, "continuation_index", i, "")
+			message.NewIntField(m, "continuation_count", count, "")
+			parts = append(parts, m)
+		}
+		return parts, nil
+	}
+	return nil, tooBig
+}
+
+// Returns the offsets at which the payload's parts of at most `limit` bytes
+// end, w/o splitting a UTF-8 character across two parts.
+func splitPayload(payload string, limit int) []int {
+	var ends []int
+	for start := 0; start < len(payload); {
+		end := start + limit
+		if end >= len(payload) {
+			end = len(payload)
+		} else {
+			for end > start && !utf8.RuneStart(payload[end]) {
+				end--
+			}
+			// Not even one character fits, cut it after all.
+			if end == start {
+				end = start + limit
+			}
+		}
+		ends = append(ends, end)
+		start = end
+	}
+	return ends
+}
+
+// Returns a copy of the message w/ its payload cut to at most `limit` bytes,
+// w/o splitting a UTF-8 character, and a field recording its original size.
+func truncatePayload(msg *message.Message, limit int) *message.Message {
+	payload := msg.GetPayload()
+	for limit > 0 && !utf8.RuneStart(payload[limit]) {
+		limit--
+	}
+	m := message.CopyMessage(msg)
+	m.SetPayload(payload[:limit])
+	message.NewIntField(m, "truncated_from", len(payload), "B")
+	return m
+}
+
+// Writes the message's payload to a file named after its UUID in the spill
+// directory, returning the file's path.
+func (g *GlobalConfigStruct) spillPayload(msg *message.Message) (string, error) {
+	dir := g.spillDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	name := msg.GetUuidString()
+	if name == "" {
+		name = uuid.NewRandom().String()
+	}
+	path := filepath.Join(dir, name+".payload")
+	if err := ioutil.WriteFile(path, msg.GetPayloadBytes(), 0600); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// Frames the messages fitted in place of the pack's oversized message one
+// after the other. Each is encoded w/ the encoder, or as protobuf if it's
+// nil.
+func frameOversized(g *GlobalConfigStruct, pack *PipelinePack, size int,
+	encoder Encoder, crc bool) (output []byte, err error) {
+
+	parts, err := g.fitMessage(pack.Message, size)
+	if err != nil {
+		return nil, err
+	}
+	partPack := NewPipelinePack(nil)
+	var encoded, framed []byte
+	for _, part := range parts {
+		partPack.Zero()
+		partPack.Message = part
+		if err = partPack.EncodeMsgBytes(); err != nil {
+			return nil, err
+		}
+		encoded = partPack.MsgBytes
+		if encoder != nil {
+			if encoded, err = encoder.Encode(partPack); err != nil {
+				return nil, err
+			}
+			if encoded == nil {
+				continue
+			}
+		}
+		if err = framing.Frame(encoded, &framed, nil, crc); err != nil {
+			return nil, err
+		}
+		output = append(output, framed...)
+	}
+	return output, nil
+}
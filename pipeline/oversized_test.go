@@ -0,0 +1,191 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/mozilla-services/heka/message"
+	ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+// Splits framed output back into its messages.
+func unframeMessages(output []byte) ([]*message.Message, error) {
+	var msgs []*message.Message
+	for len(output) > 0 {
+		headerLen := int(output[1]) + message.HEADER_FRAMING_SIZE
+		header := new(message.Header)
+		if _, err := message.DecodeHeader(output[2:headerLen], header); err != nil {
+			return nil, err
+		}
+		end := headerLen + int(header.GetMessageLength())
+		msg := new(message.Message)
+		if err := proto.Unmarshal(output[headerLen:end], msg); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+		output = output[end:]
+	}
+	return msgs, nil
+}
+
+func OversizedSpec(c gs.Context) {
+	tmpDir, err := ioutil.TempDir("", "oversized-tests")
+	c.Assume(err, gs.IsNil)
+	defer os.RemoveAll(tmpDir)
+
+	globals := DefaultGlobals()
+	globals.BaseDir = tmpDir
+	msg := ts.GetTestMessage()
+	payload := strings.Repeat("stack frame\n", int(message.MAX_MESSAGE_SIZE)/4)
+	msg.SetPayload(payload)
+	size := proto.Size(msg)
+
+	c.Specify("Oversized messages are dropped by default", func() {
+		_, err := globals.fitMessage(msg, size)
+		c.Expect(err, gs.Not(gs.IsNil))
+	})
+
+	c.Specify("Unknown oversized message actions are rejected", func() {
+		c.Expect(ValidateOversizedAction("split"), gs.IsNil)
+		c.Expect(ValidateOversizedAction("shrink"), gs.Not(gs.IsNil))
+	})
+
+	c.Specify("Truncated messages", func() {
+		globals.OversizedMessageAction = OVERSIZED_TRUNCATE
+		msgs, err := globals.fitMessage(msg, size)
+		c.Assume(err, gs.IsNil)
+		c.Expect(len(msgs), gs.Equals, 1)
+
+		c.Specify("fit in a single message", func() {
+			c.Expect(proto.Size(msgs[0]) <= int(message.MAX_MESSAGE_SIZE), gs.IsTrue)
+			c.Expect(strings.HasPrefix(payload, msgs[0].GetPayload()), gs.IsTrue)
+		})
+
+		c.Specify("record the original payload size", func() {
+			value, ok := msgs[0].GetFieldValue("truncated_from")
+			c.Expect(ok, gs.IsTrue)
+			c.Expect(value, gs.Equals, int64(len(payload)))
+		})
+
+		c.Specify("leave the original message alone", func() {
+			c.Expect(msg.GetPayload(), gs.Equals, payload)
+		})
+	})
+
+	c.Specify("Split messages", func() {
+		globals.OversizedMessageAction = OVERSIZED_SPLIT
+		msgs, err := globals.fitMessage(msg, size)
+		c.Assume(err, gs.IsNil)
+
+		c.Specify("carry the whole payload", func() {
+			c.Expect(len(msgs) > 1, gs.IsTrue)
+			parts := make([]string, len(msgs))
+			for i, m := range msgs {
+				c.Expect(proto.Size(m) <= int(message.MAX_MESSAGE_SIZE), gs.IsTrue)
+				parts[i] = m.GetPayload()
+			}
+			c.Expect(strings.Join(parts, ""), gs.Equals, payload)
+		})
+
+		c.Specify("are linked to the original message", func() {
+			for i, m := range msgs {
+				value, _ := m.GetFieldValue("continuation_of")
+				c.Expect(value, gs.Equals, msg.GetUuidString())
+				value, _ = m.GetFieldValue("continuation_index")
+				c.Expect(value, gs.Equals, int64(i))
+				value, _ = m.GetFieldValue("continuation_count")
+				c.Expect(value, gs.Equals, int64(len(msgs)))
+			}
+			c.Expect(msgs[0].GetUuidString(), gs.Equals, msg.GetUuidString())
+			c.Expect(msgs[1].GetUuidString(), gs.Not(gs.Equals), msg.GetUuidString())
+		})
+
+		c.Specify("don't split multi-byte characters", func() {
+			c.Expect(splitPayload("aéé", 2), gs.ContainsExactly, []int{1, 3, 5})
+			c.Expect(splitPayload("€€", 4), gs.ContainsExactly, []int{3, 6})
+
+			mbPayload := "a" + strings.Repeat("€", int(message.MAX_MESSAGE_SIZE)/2)
+			msg.SetPayload(mbPayload)
+			msgs, err := globals.fitMessage(msg, proto.Size(msg))
+			c.Assume(err, gs.IsNil)
+			c.Expect(len(msgs) > 1, gs.IsTrue)
+			parts := make([]string, len(msgs))
+			for i, m := range msgs {
+				c.Expect(utf8.ValidString(m.GetPayload()), gs.IsTrue)
+				parts[i] = m.GetPayload()
+			}
+			c.Expect(strings.Join(parts, ""), gs.Equals, mbPayload)
+		})
+	})
+
+	c.Specify("Spilled messages", func() {
+		globals.OversizedMessageAction = OVERSIZED_SPILL
+		msgs, err := globals.fitMessage(msg, size)
+		c.Assume(err, gs.IsNil)
+		c.Expect(len(msgs), gs.Equals, 1)
+
+		c.Specify("reference the full payload on disk", func() {
+			value, ok := msgs[0].GetFieldValue("payload_spill_path")
+			c.Expect(ok, gs.IsTrue)
+			path := value.(string)
+			c.Expect(strings.HasPrefix(path, globals.PrependBaseDir("spill")), gs.IsTrue)
+			contents, err := ioutil.ReadFile(path)
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(contents), gs.Equals, payload)
+		})
+	})
+
+	c.Specify("Messages w/ oversized fields can't be fitted", func() {
+		globals.OversizedMessageAction = OVERSIZED_TRUNCATE
+		bigMsg := ts.GetTestMessage()
+		message.NewStringField(bigMsg, "dump", payload)
+		_, err := globals.fitMessage(bigMsg, proto.Size(bigMsg))
+		c.Expect(err, gs.Not(gs.IsNil))
+	})
+
+	c.Specify("Framed output of an oversized message", func() {
+		pConfig := NewPipelineConfig(globals)
+		encoder, err := pConfig.LoadEncoder("ProtobufEncoder")
+		c.Assume(err, gs.IsNil)
+		pack := NewPipelinePack(nil)
+		pack.Message = msg
+		c.Assume(pack.EncodeMsgBytes(), gs.IsNil)
+
+		c.Specify("fails w/ the default action", func() {
+			_, err := encodePack(encoder, pack, true, globals)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("holds a frame for each split message", func() {
+			globals.OversizedMessageAction = OVERSIZED_SPLIT
+			output, err := encodePack(encoder, pack, true, globals)
+			c.Assume(err, gs.IsNil)
+			msgs, err := unframeMessages(output)
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(msgs) > 1, gs.IsTrue)
+			parts := make([]string, len(msgs))
+			for i, m := range msgs {
+				parts[i] = m.GetPayload()
+			}
+			c.Expect(strings.Join(parts, ""), gs.Equals, payload)
+		})
+	})
+}
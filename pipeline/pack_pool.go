@@ -0,0 +1,191 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// How often a pack pool checks whether it needs to grow.
+var packPoolCheckInterval = 100 * time.Millisecond
+
+// A supply of PipelinePacks that are handed out on (and recycled back onto) a
+// single channel. The pool starts out with `min` packs, and grows toward
+// `max` whenever every pack is in use. Packs that have gone unused for an
+// entire shrink interval are discarded, down to `min` again.
+type packPool struct {
+	// 64-bit values accessed atomically come first to guarantee alignment.
+	exhaustedCount int64
+	growCount      int64
+	shrinkCount    int64
+	size           int32
+	name           string
+	recycleChan    chan *PipelinePack
+	min            int
+	max            int
+	shrinkInterval time.Duration
+	tracker        *DiagnosticTracker
+	// Optional check that can veto pool growth, e.g. while shedding load.
+	canGrow  func() bool
+	stopChan chan struct{}
+	stopOnce sync.Once
+}
+
+// Creates a new (empty) pack pool. If max is less than min, the pool will be
+// a fixed size.
+func newPackPool(name string, min, max int, shrinkInterval time.Duration) *packPool {
+	if max < min {
+		max = min
+	}
+	return &packPool{
+		name:           name,
+		recycleChan:    make(chan *PipelinePack, max),
+		min:            min,
+		max:            max,
+		shrinkInterval: shrinkInterval,
+		stopChan:       make(chan struct{}),
+	}
+}
+
+// Current number of packs belonging to the pool, whether or not they're in
+// use.
+func (p *packPool) Size() int {
+	return int(atomic.LoadInt32(&p.size))
+}
+
+// Creates the initial set of packs and starts the goroutine that tracks
+// exhaustion and manages growing and shrinking the pool.
+func (p *packPool) start(tracker *DiagnosticTracker) {
+	p.tracker = tracker
+	p.grow(p.min)
+	go p.run()
+}
+
+func (p *packPool) stop() {
+	p.stopOnce.Do(func() {
+		close(p.stopChan)
+	})
+}
+
+func (p *packPool) run() {
+	ticker := time.NewTicker(packPoolCheckInterval)
+	defer ticker.Stop()
+	lastShrink := time.Now()
+	exhausted := false
+	// Fewest idle packs seen during the current shrink interval.
+	lowest := p.Size()
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.stopChan:
+			return
+		}
+
+		idle := len(p.recycleChan)
+		if idle < lowest {
+			lowest = idle
+		}
+		if idle == 0 {
+			size := p.Size()
+			if size < p.max && (p.canGrow == nil || p.canGrow()) {
+				// Grow by half again, but at least by one pack.
+				n := size / 2
+				if n == 0 {
+					n = 1
+				}
+				if size+n > p.max {
+					n = p.max - size
+				}
+				p.grow(n)
+				atomic.AddInt64(&p.growCount, 1)
+			} else if !exhausted {
+				exhausted = true
+				atomic.AddInt64(&p.exhaustedCount, 1)
+			}
+		} else {
+			exhausted = false
+		}
+
+		if p.shrinkInterval > 0 && time.Since(lastShrink) >= p.shrinkInterval {
+			if p.shrink(lowest) {
+				atomic.AddInt64(&p.shrinkCount, 1)
+			}
+			lowest = len(p.recycleChan)
+			lastShrink = time.Now()
+		}
+	}
+}
+
+// Adds n new packs to the pool.
+func (p *packPool) grow(n int) {
+	for i := 0; i < n; i++ {
+		pack := NewPipelinePack(p.recycleChan)
+		if p.tracker != nil {
+			p.tracker.AddPack(pack)
+		}
+		atomic.AddInt32(&p.size, 1)
+		p.recycleChan <- pack
+	}
+}
+
+// Discards up to n idle packs from the pool, without going below the minimum
+// size. Returns true if any packs were discarded.
+func (p *packPool) shrink(n int) bool {
+	if excess := p.Size() - p.min; n > excess {
+		n = excess
+	}
+	var removed int
+	for ; removed < n; removed++ {
+		select {
+		case pack := <-p.recycleChan:
+			if p.tracker != nil {
+				p.tracker.RemovePack(pack)
+			}
+			atomic.AddInt32(&p.size, -1)
+		default:
+			return removed > 0
+		}
+	}
+	return removed > 0
+}
+
+// Populates the provided message with the pool's size bounds and activity
+// counters.
+func (p *packPool) reportMsg(msg *message.Message) {
+	message.NewIntField(msg, "PoolSize", p.Size(), "count")
+	message.NewIntField(msg, "PoolMin", p.min, "count")
+	message.NewIntField(msg, "PoolMax", p.max, "count")
+	message.NewInt64Field(msg, "PoolExhaustedCount",
+		atomic.LoadInt64(&p.exhaustedCount), "count")
+	message.NewInt64Field(msg, "PoolGrowCount", atomic.LoadInt64(&p.growCount), "count")
+	message.NewInt64Field(msg, "PoolShrinkCount", atomic.LoadInt64(&p.shrinkCount),
+		"count")
+}
+
+// PluginHelper used by filters that have their own pack pool, so packs
+// requested via `PipelinePack` come from the filter's pool instead of the
+// shared injection pool.
+type poolHelper struct {
+	PluginHelper
+	pool *packPool
+}
+
+func (h *poolHelper) PipelinePack(msgLoopCount uint) (*PipelinePack, error) {
+	return h.PipelineConfig().packFromChan(msgLoopCount, h.pool.recycleChan)
+}
@@ -0,0 +1,127 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"sync/atomic"
+	"time"
+
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func PackPoolSpec(c gs.Context) {
+	origInterval := packPoolCheckInterval
+	packPoolCheckInterval = time.Millisecond
+	defer func() {
+		packPoolCheckInterval = origInterval
+	}()
+
+	globals := DefaultGlobals()
+	tracker := NewDiagnosticTracker("test", globals)
+
+	// Polls until the condition is true, giving up after a second.
+	eventually := func(cond func() bool) bool {
+		for i := 0; i < 1000; i++ {
+			if cond() {
+				return true
+			}
+			time.Sleep(time.Millisecond)
+		}
+		return false
+	}
+
+	c.Specify("A packPool", func() {
+		c.Specify("starts out with the minimum number of packs", func() {
+			pool := newPackPool("test", 4, 8, 0)
+			pool.start(tracker)
+			defer pool.stop()
+			c.Expect(pool.Size(), gs.Equals, 4)
+			c.Expect(len(pool.recycleChan), gs.Equals, 4)
+			c.Expect(cap(pool.recycleChan), gs.Equals, 8)
+			c.Expect(len(tracker.packs), gs.Equals, 4)
+		})
+
+		c.Specify("is a fixed size if max is less than min", func() {
+			pool := newPackPool("test", 4, 0, 0)
+			c.Expect(pool.max, gs.Equals, 4)
+		})
+
+		c.Specify("grows up to the max when exhausted", func() {
+			pool := newPackPool("test", 4, 8, 0)
+			pool.start(tracker)
+			defer pool.stop()
+
+			var packs []*PipelinePack
+			take := func() {
+				for {
+					select {
+					case pack := <-pool.recycleChan:
+						packs = append(packs, pack)
+					default:
+						return
+					}
+				}
+			}
+			take()
+			c.Expect(eventually(func() bool {
+				take()
+				return pool.Size() == 8
+			}), gs.IsTrue)
+			c.Expect(eventually(func() bool {
+				take()
+				return atomic.LoadInt64(&pool.exhaustedCount) == 1
+			}), gs.IsTrue)
+			c.Expect(len(packs), gs.Equals, 8)
+			c.Expect(atomic.LoadInt64(&pool.growCount) > 0, gs.IsTrue)
+
+			c.Specify("and shrinks back down once the packs are idle", func() {
+				for _, pack := range packs {
+					pack.recycle()
+				}
+				c.Expect(pool.shrink(len(pool.recycleChan)), gs.IsTrue)
+				c.Expect(pool.Size(), gs.Equals, 4)
+				c.Expect(len(pool.recycleChan), gs.Equals, 4)
+				c.Expect(len(tracker.packs), gs.Equals, 4)
+			})
+		})
+
+		c.Specify("doesn't grow when vetoed", func() {
+			pool := newPackPool("test", 2, 8, 0)
+			pool.canGrow = func() bool { return false }
+			pool.start(tracker)
+			defer pool.stop()
+			<-pool.recycleChan
+			<-pool.recycleChan
+			c.Expect(eventually(func() bool {
+				return atomic.LoadInt64(&pool.exhaustedCount) == 1
+			}), gs.IsTrue)
+			c.Expect(pool.Size(), gs.Equals, 2)
+		})
+	})
+
+	c.Specify("A filter with its own pool", func() {
+		pConfig := NewPipelineConfig(globals)
+		pool := newPackPool("filter", 1, 1, 0)
+		pool.start(nil)
+		defer pool.stop()
+		h := &poolHelper{PluginHelper: pConfig, pool: pool}
+
+		pack, err := h.PipelinePack(0)
+		c.Expect(err, gs.IsNil)
+		c.Expect(pack.RecycleChan, gs.Equals, pool.recycleChan)
+		c.Expect(pack.MsgLoopCount, gs.Equals, uint(1))
+		c.Expect(len(pConfig.injectRecycleChan), gs.Equals, 0)
+	})
+}
@@ -97,6 +97,10 @@ type DiagnosticTracker struct {
 	// Track all the packs that have been created.
 	packs []*PipelinePack
 
+	// Mutex protecting the packs slice, packs are added and removed as pack
+	// pools grow and shrink.
+	packsLock sync.Mutex
+
 	// Identify the name of the recycle channel it monitors packs for.
 	ChannelName string
 
@@ -115,7 +119,21 @@ func NewDiagnosticTracker(channelName string, globals *GlobalConfigStruct) *Diag
 
 // Add a pipeline pack for monitoring
 func (d *DiagnosticTracker) AddPack(pack *PipelinePack) {
+	d.packsLock.Lock()
 	d.packs = append(d.packs, pack)
+	d.packsLock.Unlock()
+}
+
+// Stop monitoring a pipeline pack
+func (d *DiagnosticTracker) RemovePack(pack *PipelinePack) {
+	d.packsLock.Lock()
+	for i, p := range d.packs {
+		if p == pack {
+			d.packs = append(d.packs[:i], d.packs[i+1:]...)
+			break
+		}
+	}
+	d.packsLock.Unlock()
 }
 
 // Run the monitoring routine, this should be spun up in a new goroutine
@@ -131,16 +149,20 @@ func (d *DiagnosticTracker) Run() {
 	idleMax := g.MaxPackIdle
 	idleMaxSecs := int(idleMax.Seconds())
 	probablePacks := make([]*PipelinePack, 0, len(d.packs))
+	packs := make([]*PipelinePack, 0, len(d.packs))
 	ticker := time.NewTicker(time.Duration(30) * time.Second)
 	for {
 		<-ticker.C
 		probablePacks = probablePacks[:0]
 		pluginCounts = make(map[PluginRunner]int)
+		d.packsLock.Lock()
+		packs = append(packs[:0], d.packs...)
+		d.packsLock.Unlock()
 
 		// Locate all the packs that have not been touched in idleMax duration
 		// that are not recycled.
 		earliestAccess = time.Now().Add(-idleMax)
-		for _, pack = range d.packs {
+		for _, pack = range packs {
 			if len(pack.diagnostics.lastPlugins) == 0 {
 				continue
 			}
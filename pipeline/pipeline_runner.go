@@ -42,10 +42,15 @@ var AbortError = errors.New("Aborting")
 
 // Struct for holding global pipeline config values.
 type GlobalConfigStruct struct {
+	// Accessed atomically, see invalidateMatcherCaches.
+	matcherCacheGen       int64
 	MaxMsgProcessDuration uint64
 	PoolSize              int
 	PluginChanSize        int
 	MaxMsgLoops           uint
+	MaxHops               uint
+	TrackLineage          bool
+	TraceSampleRate       float64
 	MaxMsgProcessInject   uint
 	MaxMsgTimerInject     uint
 	MaxPackIdle           time.Duration
@@ -60,6 +65,55 @@ type GlobalConfigStruct struct {
 	abortChan             chan struct{}
 	FullBufferMaxRetries  uint
 	exitCode              int
+	MemoryWatermark       uint64
+	MemoryLowWatermark    uint64
+	MemoryCheckInterval   time.Duration
+	MemoryShedPolicies    []string
+	MemoryShedSeverity    int32
+	InputPoolSize         int
+	InputPoolSizeMax      int
+	InjectPoolSize        int
+	InjectPoolSizeMax     int
+	PoolShrinkInterval    time.Duration
+	MaxBufferDiskUsage    uint64
+	BufferAlertPercent    uint
+	// Whether the messages injected by the filters go through a write-ahead
+	// log, its storage engine and whether each message is synced to disk
+	// before it's routed, see injectWal.
+	InjectWal       bool
+	InjectWalEngine string
+	InjectWalSync   bool
+	// Key decrypting the `enc:` config values, see LoadConfigKey.
+	ConfigKey []byte
+	// Roles selecting the plugin config sections that are loaded, see
+	// CommonConfig.Roles.
+	Roles []string
+	// What's done w/ messages too large to be framed, one of the OVERSIZED_*
+	// actions, and where the "spill" action writes their payloads.
+	OversizedMessageAction string
+	OversizedSpillDir      string
+	// Whether the expressions shared by message matchers are evaluated once
+	// per message, see message.PredicateSet.
+	ShareMatcherPredicates bool
+	// Number of Type and Logger pairs each matcher testing only those
+	// headers remembers not matching, 0 to disable. See negativeCache.
+	MatcherNegativeCacheSize int
+	// Whether each message matcher evaluation is timed, see
+	// MatchRunner.reportMsg.
+	ProfileMatchers bool
+	// Where the admin API serves the plugin reports, see adminServer.
+	AdminSocket  string
+	AdminAddress string
+	AdminToken   string
+	// Directory the state snapshots taken through the admin API are written
+	// to, "" if they're disabled.
+	SnapshotDir string
+	// Whether the admin API can upgrade hekad to a new binary, which isn't
+	// possible once it has dropped its privileges.
+	Upgradable bool
+	// Source of the time for the runners' tickers and retries, and for the
+	// plugins' timeouts. Tests can replace it w/ a MockClock.
+	Clock Clock
 }
 
 // Creates a GlobalConfigStruct object populated w/ default values.
@@ -67,20 +121,53 @@ func DefaultGlobals() (globals *GlobalConfigStruct) {
 	idle, _ := time.ParseDuration("2m")
 	hostname, _ := os.Hostname()
 	return &GlobalConfigStruct{
-		PoolSize:              100,
-		PluginChanSize:        50,
-		MaxMsgLoops:           4,
-		MaxMsgProcessInject:   1,
-		MaxMsgProcessDuration: 1000000,
-		MaxMsgTimerInject:     10,
-		MaxPackIdle:           idle,
-		SampleDenominator:     1000,
-		sigChan:               make(chan os.Signal, 1),
-		Hostname:              hostname,
-		abortChan:             make(chan struct{}),
+		PoolSize:                 100,
+		PluginChanSize:           50,
+		MaxMsgLoops:              4,
+		MaxHops:                  8,
+		MaxMsgProcessInject:      1,
+		MaxMsgProcessDuration:    1000000,
+		MaxMsgTimerInject:        10,
+		MaxPackIdle:              idle,
+		SampleDenominator:        1000,
+		MemoryCheckInterval:      time.Second,
+		MemoryShedPolicies:       []string{SHED_DROP_LOW_PRIORITY},
+		MemoryShedSeverity:       6,
+		PoolShrinkInterval:       30 * time.Second,
+		BufferAlertPercent:       90,
+		InjectWalEngine:          "file",
+		OversizedMessageAction:   OVERSIZED_DROP,
+		ShareMatcherPredicates:   true,
+		MatcherNegativeCacheSize: 1024,
+		sigChan:                  make(chan os.Signal, 1),
+		Hostname:                 hostname,
+		abortChan:                make(chan struct{}),
+		Clock:                    RealClock,
 	}
 }
 
+// Returns the min and max sizes of the input pack pool, falling back to
+// PoolSize for any that aren't set.
+func (g *GlobalConfigStruct) inputPoolBounds() (min, max int) {
+	return poolBounds(g.InputPoolSize, g.InputPoolSizeMax, g.PoolSize)
+}
+
+// Returns the min and max sizes of the inject pack pool, falling back to
+// PoolSize for any that aren't set.
+func (g *GlobalConfigStruct) injectPoolBounds() (min, max int) {
+	return poolBounds(g.InjectPoolSize, g.InjectPoolSizeMax, g.PoolSize)
+}
+
+func poolBounds(min, max, poolSize int) (int, int) {
+	if min <= 0 {
+		min = poolSize
+	}
+	if max < min {
+		max = min
+	}
+	return min, max
+}
+
 func (g *GlobalConfigStruct) SigChan() chan os.Signal {
 	return g.sigChan
 }
@@ -181,6 +268,22 @@ type PipelinePack struct {
 	BufferedPack bool
 	// Used to send delivery result error back to the buffered plugin.
 	DelivErrChan chan error
+	// Names of the plugins to which the router should deliver this pack
+	// directly, bypassing message matcher evaluation. Populated by filters
+	// using the `route_to` setting, or by the SharderFilter.
+	routeTo []string
+	// Set on the packs sampled for tracing, to record their timing.
+	trace *packTrace
+	// Results of the expressions shared by the matchers, reset by the router
+	// for each message.
+	predicates message.PredicateResults
+	// Index of the message's fields by name, built by the first lookup that
+	// goes through it.
+	fieldIndex message.FieldIndex
+	// Write-ahead log holding the injected message until the pack is
+	// recycled, and the id of the log segment it's in.
+	wal   *injectWal
+	walId uint
 }
 
 // Returns a new PipelinePack pointer that will recycle itself onto the
@@ -209,6 +312,10 @@ func (p *PipelinePack) Zero() {
 	p.Signer = ""
 	p.diagnostics.Reset()
 	p.TrustMsgBytes = false
+	p.routeTo = nil
+	p.trace = nil
+	p.wal = nil
+	p.fieldIndex.Reset()
 	if p.BufferedPack {
 		p.QueueCursor = ""
 	}
@@ -218,9 +325,21 @@ func (p *PipelinePack) Zero() {
 	p.Message = new(message.Message)
 }
 
+// FieldIndex returns the index of the message's fields, for looking up the
+// fields of messages that are read by name many times, e.g. by the sandboxes.
+func (p *PipelinePack) FieldIndex() *message.FieldIndex {
+	return &p.fieldIndex
+}
+
 func (p *PipelinePack) recycle() {
 	cnt := atomic.AddInt32(&p.RefCount, -1)
 	if cnt == 0 {
+		if p.trace != nil {
+			p.trace.finish(p.Message)
+		}
+		if p.wal != nil {
+			p.wal.release(p.walId)
+		}
 		p.Zero()
 		p.RecycleChan <- p
 	}
@@ -268,6 +387,14 @@ func Run(config *PipelineConfig) (exitCode int) {
 
 	globals := config.Globals
 
+	// Opened before any filter can inject a message.
+	if globals.InjectWal {
+		if config.injectWal, err = openInjectWal(globals); err != nil {
+			LogError.Printf("Can't open the injected messages write-ahead log: %s", err)
+			return 1
+		}
+	}
+
 	for name, output := range config.OutputRunners {
 		outputsWg.Add(1)
 		if err = output.Start(config, &outputsWg); err != nil {
@@ -304,20 +431,34 @@ func Run(config *PipelineConfig) (exitCode int) {
 	// Create the report pipeline pack
 	config.reportRecycleChan <- NewPipelinePack(config.reportRecycleChan)
 
-	// Initialize all of the PipelinePacks that we'll need
-	for i := 0; i < globals.PoolSize; i++ {
-		inputPack := NewPipelinePack(config.inputRecycleChan)
-		inputTracker.AddPack(inputPack)
-		config.inputRecycleChan <- inputPack
-
-		injectPack := NewPipelinePack(config.injectRecycleChan)
-		injectTracker.AddPack(injectPack)
-		config.injectRecycleChan <- injectPack
+	if globals.MemoryWatermark > 0 {
+		config.router.memMonitor = newMemoryMonitor(config)
+		// Growing the pool would defeat the point of shedding load.
+		config.inputPool.canGrow = func() bool {
+			return !config.router.memMonitor.isShedding()
+		}
 	}
 
+	// Initialize all of the PipelinePacks that we'll need
+	config.inputPool.start(inputTracker)
+	config.injectPool.start(injectTracker)
+
 	go inputTracker.Run()
 	go injectTracker.Run()
+
+	if config.router.memMonitor != nil {
+		go config.router.memMonitor.run()
+	}
 	config.router.Start()
+	go config.tracer.run()
+	go config.bufferQuota.run()
+
+	// Replayed once the filters and outputs are ready, before any new input.
+	if config.injectWal != nil {
+		if err = config.injectWal.replay(config); err != nil {
+			LogError.Printf("Can't replay the injected messages write-ahead log: %s", err)
+		}
+	}
 
 	for name, input := range config.InputRunners {
 		config.inputsWg.Add(1)
@@ -331,6 +472,18 @@ func Run(config *PipelineConfig) (exitCode int) {
 		}
 		LogInfo.Println("Input started:", name)
 	}
+	closeInherited()
+
+	admin, err := newAdminServer(config)
+	if err == nil && admin != nil {
+		err = admin.start()
+	}
+	if err != nil {
+		LogError.Printf("Admin API failed to start: %s", err)
+		admin = nil
+	} else if admin != nil {
+		LogInfo.Println("Admin API started")
+	}
 
 	// wait for sigint
 	signal.Notify(globals.sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP,
@@ -345,6 +498,7 @@ func Run(config *PipelineConfig) (exitCode int) {
 				if err := notify.Post(RELOAD, nil); err != nil {
 					LogError.Println("Error sending reload event: ", err)
 				}
+				globals.invalidateMatcherCaches()
 			case syscall.SIGINT, syscall.SIGTERM:
 				LogInfo.Println("Shutdown initiated.")
 				globals.stop()
@@ -358,6 +512,17 @@ func Run(config *PipelineConfig) (exitCode int) {
 		}
 	}
 
+	if admin != nil {
+		admin.stop()
+	}
+
+	// Held packs need to be released so blocked inputs can shut down.
+	if config.router.memMonitor != nil {
+		config.router.memMonitor.stop()
+	}
+	config.tracer.stop()
+	config.bufferQuota.stop()
+
 	config.inputsLock.Lock()
 	for _, input := range config.InputRunners {
 		input.Input().Stop()
@@ -403,6 +568,13 @@ func Run(config *PipelineConfig) (exitCode int) {
 		}
 	}
 
+	if config.injectWal != nil {
+		config.injectWal.close()
+	}
+
+	config.inputPool.stop()
+	config.injectPool.stop()
+
 	LogInfo.Println("Shutdown complete.")
 	return globals.exitCode
 }
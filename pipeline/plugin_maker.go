@@ -132,6 +132,10 @@ func (m *pluginMaker) OrigPrepCommonTypedConfig() (interface{}, error) {
 		}
 		err = toml.PrimitiveDecode(m.tomlSection, &commonFO)
 		commonTypedConfig = commonFO
+	case "Decoder":
+		commonDecoder := CommonDecoderConfig{}
+		err = toml.PrimitiveDecode(m.tomlSection, &commonDecoder)
+		commonTypedConfig = commonDecoder
 	case "Splitter":
 		commonSplitter := CommonSplitterConfig{}
 		err = toml.PrimitiveDecode(m.tomlSection, &commonSplitter)
@@ -358,6 +362,25 @@ func (m *pluginMaker) makeInputRunner(name string, config interface{}, input Inp
 		splitter := getAttr(config, "Splitter", "")
 		commonInput.Splitter = splitter.(string)
 	}
+	if commonInput.TraceRate != nil {
+		if err = ValidateTraceSampleRate(*commonInput.TraceRate); err != nil {
+			return nil, err
+		}
+	}
+	if commonInput.DecodeWorkers > 1 {
+		if commonInput.Decoder == "" {
+			return nil, errors.New("'decode_workers' requires a decoder")
+		}
+		if *commonInput.SyncDecode {
+			return nil, errors.New("'decode_workers' can't be used w/ 'synchronous_decode'")
+		}
+	}
+	if _, err = newFieldLimiter(commonInput.FieldLimits); err != nil {
+		return nil, err
+	}
+	if _, err = newPayloadTranscoder(commonInput.Charset); err != nil {
+		return nil, err
+	}
 	runner := NewInputRunner(name, input, commonInput)
 	return runner, nil
 }
@@ -416,6 +439,8 @@ func (m *pluginMaker) MakeRunner(name string) (PluginRunner, error) {
 		matcherVal := getAttr(config, "MessageMatcher", "")
 		commonFO.Matcher = matcherVal.(string)
 	}
+	// Stages of a filter chain also receive their predecessors' messages.
+	commonFO.Matcher = m.pConfig.chains.matcher(name, commonFO.Matcher)
 
 	if commonFO.Ticker == 0 {
 		commonFO.Ticker = defaultTick
@@ -0,0 +1,48 @@
+// +build linux,cgo darwin,cgo
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+
+package pipeline
+
+import (
+	"fmt"
+	"path/filepath"
+	"plugin"
+)
+
+// Opens the Go plugins built w/ `go build -buildmode=plugin` at the paths,
+// which may be glob patterns. The plugins' init functions register their
+// plugin types w/ RegisterPlugin, as if they had been built into hekad. The
+// `plugin` package only supports Linux and OS X and needs cgo, other builds
+// get the stub in plugin_objects_unsupported.go.
+func LoadPluginObjects(paths []string) error {
+	for _, pattern := range paths {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid plugin object path '%s': %s", pattern, err)
+		}
+		if len(matches) == 0 {
+			return fmt.Errorf("no plugin object matches '%s'", pattern)
+		}
+		for _, path := range matches {
+			if _, err = plugin.Open(path); err != nil {
+				return fmt.Errorf("can't load plugin object '%s': %s", path, err)
+			}
+			LogInfo.Printf("Loaded plugin object '%s'", path)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func PluginObjectsSpec(c gs.Context) {
+	tmpDir, tmpErr := ioutil.TempDir("", "plugin-objects-tests")
+	c.Assume(tmpErr, gs.IsNil)
+	defer func() {
+		tmpErr = os.RemoveAll(tmpDir)
+		c.Expect(tmpErr, gs.IsNil)
+	}()
+
+	c.Specify("Loading plugin objects", func() {
+		c.Specify("does nothing w/o any paths", func() {
+			c.Expect(LoadPluginObjects(nil), gs.IsNil)
+		})
+
+		c.Specify("fails for a path matching no file", func() {
+			err := LoadPluginObjects([]string{filepath.Join(tmpDir, "*.so")})
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("fails for a file that isn't a plugin", func() {
+			path := filepath.Join(tmpDir, "bogus.so")
+			c.Assume(ioutil.WriteFile(path, []byte("bogus"), 0644), gs.IsNil)
+			c.Expect(LoadPluginObjects([]string{path}), gs.Not(gs.IsNil))
+		})
+	})
+}
@@ -0,0 +1,29 @@
+// +build !cgo !linux,!darwin
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+
+package pipeline
+
+import "errors"
+
+// Go plugins can only be loaded by a hekad built w/ cgo, on Linux or OS X.
+func LoadPluginObjects(paths []string) error {
+	if len(paths) > 0 {
+		return errors.New("this hekad can't load plugin objects, that takes a " +
+			"build w/ cgo, on Linux or OS X")
+	}
+	return nil
+}
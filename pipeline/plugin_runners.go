@@ -23,7 +23,6 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/mozilla-services/heka/client"
 	"github.com/mozilla-services/heka/message"
 )
 
@@ -121,10 +120,10 @@ type Deliverer interface {
 }
 
 type deliverer struct {
-	deliver DeliverFunc
-	dRunner DecoderRunner
-	decoder Decoder
-	pConfig *PipelineConfig
+	deliver  DeliverFunc
+	dRunners []DecoderRunner
+	decoder  Decoder
+	pConfig  *PipelineConfig
 }
 
 func (d *deliverer) Deliver(pack *PipelinePack) {
@@ -136,8 +135,8 @@ func (d *deliverer) DeliverFunc() DeliverFunc {
 }
 
 func (d *deliverer) Done() {
-	if d.dRunner != nil {
-		d.pConfig.StopDecoderRunner(d.dRunner)
+	for _, dRunner := range d.dRunners {
+		d.pConfig.StopDecoderRunner(dRunner)
 	}
 
 	if d.decoder != nil {
@@ -204,16 +203,22 @@ type iRunner struct {
 	pConfig            *PipelineConfig
 	inChan             chan *PipelinePack
 	ticker             <-chan time.Time
+	stopTicker         chan struct{}
+	stopTickerOnce     sync.Once
 	transient          bool
 	syncDecode         bool
 	sendDecodeFailures bool
 	logDecodeFailures  bool
+	preserveOrder      bool
 	deliver            DeliverFunc
 	delivererOnce      sync.Once
 	delivererLock      sync.Mutex
 	canExit            bool
 	shutdownWanters    []WantsDecoderRunnerShutdown
 	shutdownLock       sync.Mutex
+	traceRate          float64
+	fieldLimits        *fieldLimiter
+	transcoder         *payloadTranscoder
 }
 
 func (ir *iRunner) Ticker() (ticker <-chan time.Time) {
@@ -257,6 +262,7 @@ func NewInputRunner(name string, input Input, config CommonInputConfig) (ir Inpu
 	if config.CanExit != nil && *config.CanExit {
 		runner.canExit = true
 	}
+	runner.preserveOrder = config.PreserveOrder == nil || *config.PreserveOrder
 
 	return runner
 }
@@ -273,10 +279,15 @@ func (ir *iRunner) Start(h PluginHelper, wg *sync.WaitGroup) (err error) {
 	ir.h = h
 	ir.pConfig = h.PipelineConfig()
 	ir.inChan = ir.pConfig.inputRecycleChan
+	ir.traceRate = traceSampleRate(ir.config.TraceRate, ir.pConfig.Globals)
 
-	if ir.config.Ticker != 0 {
+	if ir.config.Schedule != "" {
+		if err = ir.startSchedule(); err != nil {
+			return err
+		}
+	} else if ir.config.Ticker != 0 {
 		tickLength := time.Duration(ir.config.Ticker) * time.Second
-		ir.ticker = time.Tick(tickLength)
+		ir.ticker = ir.pConfig.Globals.Clock.NewTicker(tickLength).Chan()
 	}
 
 	if ir.config.Splitter == "" {
@@ -302,10 +313,67 @@ func (ir *iRunner) Start(h PluginHelper, wg *sync.WaitGroup) (err error) {
 			return fmt.Errorf("no registered '%s' decoder", ir.config.Decoder)
 		}
 	}
+	if err = ir.startDecodeOptions(); err != nil {
+		return err
+	}
 	go ir.Starter(h, wg)
 	return
 }
 
+// Sets up the ticker to tick on the configured cron schedule, which overrides
+// any ticker interval.
+func (ir *iRunner) startSchedule() error {
+	loc := time.Local
+	if ir.config.ScheduleTimezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(ir.config.ScheduleTimezone); err != nil {
+			return fmt.Errorf("%s invalid schedule_timezone: %s", ir.name, err)
+		}
+	}
+	schedule, err := ParseSchedule(ir.config.Schedule, loc)
+	if err != nil {
+		return fmt.Errorf("%s invalid schedule: %s", ir.name, err)
+	}
+	jitter := time.Duration(ir.config.ScheduleJitter) * time.Second
+	ir.stopTicker = make(chan struct{})
+	ir.ticker = scheduleTicker(ir.pConfig.Globals.Clock, schedule, jitter,
+		ir.stopTicker)
+	return nil
+}
+
+// Sets up the input's field limits and payload charset, falling back to its
+// decoder's for those it doesn't set.
+func (ir *iRunner) startDecodeOptions() (err error) {
+	limits := ir.config.FieldLimits
+	charset := ir.config.Charset
+	if ir.config.Decoder != "" && (limits == nil || charset == "") {
+		ir.pConfig.makersLock.RLock()
+		maker, ok := ir.pConfig.DecoderMakers[ir.config.Decoder]
+		ir.pConfig.makersLock.RUnlock()
+		if ok {
+			var common interface{}
+			if common, err = maker.(*pluginMaker).PrepCommonTypedConfig(); err != nil {
+				return fmt.Errorf("%s error preparing decoder %s config: %s", ir.name,
+					ir.config.Decoder, err)
+			}
+			decoderConfig := common.(CommonDecoderConfig)
+			if limits == nil {
+				limits = decoderConfig.FieldLimits
+			}
+			if charset == "" {
+				charset = decoderConfig.Charset
+			}
+		}
+	}
+	if ir.fieldLimits, err = newFieldLimiter(limits); err != nil {
+		return fmt.Errorf("%s invalid field_limits: %s", ir.name, err)
+	}
+	if ir.transcoder, err = newPayloadTranscoder(charset); err != nil {
+		return fmt.Errorf("%s invalid charset: %s", ir.name, err)
+	}
+	return nil
+}
+
 func (ir *iRunner) Starter(h PluginHelper, wg *sync.WaitGroup) {
 	defer wg.Done()
 
@@ -318,6 +386,7 @@ func (ir *iRunner) Starter(h PluginHelper, wg *sync.WaitGroup) {
 		}
 		return
 	}
+	rh.SetClock(globals.Clock)
 
 	for !globals.IsShuttingDown() {
 
@@ -391,6 +460,9 @@ func (ir *iRunner) Starter(h PluginHelper, wg *sync.WaitGroup) {
 }
 
 func (ir *iRunner) Unregister(pConfig *PipelineConfig) error {
+	if ir.stopTicker != nil {
+		ir.stopTickerOnce.Do(func() { close(ir.stopTicker) })
+	}
 	// Send shutdown signal to any decoders that need it.
 	if len(ir.shutdownWanters) > 0 {
 		ir.shutdownLock.Lock()
@@ -420,12 +492,26 @@ func (ir *iRunner) LogMessage(msg string) {
 	LogInfo.Printf("Input '%s': %s", ir.name, msg)
 }
 
-func (ir *iRunner) getDeliverFunc(token string) (DeliverFunc, DecoderRunner, Decoder) {
+func (ir *iRunner) getDeliverFunc(token string) (DeliverFunc, []DecoderRunner, Decoder) {
 	var deliver DeliverFunc
 	decoderName := ir.config.Decoder
 	// If no decoder is specified we just inject into the router.
+	lineage := ir.pConfig.Globals.TrackLineage
+	tracer := ir.pConfig.tracer
+	limits := ir.fieldLimits
+	transcoder := ir.transcoder
 	if decoderName == "" {
 		deliver = func(pack *PipelinePack) {
+			tracer.sample(pack, ir.name, ir.traceRate)
+			if transcoder != nil {
+				transcoder.transcode(pack)
+			}
+			if limits != nil && !limits.admit(pack, ir.LogError) {
+				return
+			}
+			if lineage {
+				trackLineage(pack, ir.name)
+			}
 			ir.Inject(pack)
 		}
 		return deliver, nil, nil
@@ -446,16 +532,39 @@ func (ir *iRunner) getDeliverFunc(token string) (DeliverFunc, DecoderRunner, Dec
 		fullName = fmt.Sprintf("%s-%s-%s", ir.name, decoderName, token)
 	}
 
-	// No synchronous decode means create a DecoderRunner and drop packs on
-	// its inChan.
+	// No synchronous decode means create a DecoderRunner, or a pool of them,
+	// and drop packs on its inChan.
 	if !ir.syncDecode {
-		dr, _ := ir.pConfig.DecoderRunner(decoderName, fullName)
-		dr.SetFailureHandling(ir.logDecodeFailures, ir.sendDecodeFailures)
+		setup := func(dr *dRunner) {
+			dr.SetFailureHandling(ir.logDecodeFailures, ir.sendDecodeFailures)
+			if lineage {
+				// The decoder replaces the message, so it records the input too.
+				dr.lineage = []string{ir.name, decoderName}
+			}
+			dr.fieldLimits = limits
+		}
+		if ir.config.DecodeWorkers > 1 {
+			pool := newDecodePool(ir.pConfig, decoderName, fullName,
+				int(ir.config.DecodeWorkers), ir.preserveOrder, setup)
+			deliver = func(pack *PipelinePack) {
+				tracer.sample(pack, ir.name, ir.traceRate)
+				if transcoder != nil {
+					transcoder.transcode(pack)
+				}
+				pool.deliver(pack)
+			}
+			return deliver, pool.runners, nil
+		}
+		dr, _ := ir.pConfig.startDecoderRunner(decoderName, fullName, setup)
 		inChan := dr.InChan()
 		deliver = func(pack *PipelinePack) {
+			tracer.sample(pack, ir.name, ir.traceRate)
+			if transcoder != nil {
+				transcoder.transcode(pack)
+			}
 			inChan <- pack
 		}
-		return deliver, dr, nil
+		return deliver, []DecoderRunner{dr}, nil
 	}
 
 	// Synchronous decode means create a decoder instance and call Decode
@@ -482,6 +591,10 @@ func (ir *iRunner) getDeliverFunc(token string) (DeliverFunc, DecoderRunner, Dec
 	// See if the decoder sets TrustMsgBytes for us.
 	_, trustMsgBytes := decoder.(EncodesMsgBytes)
 	deliver = func(pack *PipelinePack) {
+		tracer.sample(pack, ir.name, ir.traceRate)
+		if transcoder != nil {
+			transcoder.transcode(pack)
+		}
 		packs, err := decoder.Decode(pack)
 		if err != nil {
 			errMsg := err.Error()
@@ -497,6 +610,9 @@ func (ir *iRunner) getDeliverFunc(token string) (DeliverFunc, DecoderRunner, Dec
 				ir.LogError(err)
 			}
 			pack.TrustMsgBytes = false
+			if lineage {
+				trackLineage(pack, ir.name, decoderName)
+			}
 			ir.Inject(pack)
 			return
 		}
@@ -504,6 +620,15 @@ func (ir *iRunner) getDeliverFunc(token string) (DeliverFunc, DecoderRunner, Dec
 			if !trustMsgBytes {
 				p.TrustMsgBytes = false
 			}
+			if limits != nil && !limits.admit(p, ir.LogError) {
+				continue
+			}
+			if lineage {
+				trackLineage(p, ir.name, decoderName)
+			}
+			if p.trace != nil {
+				p.trace.stamp(decoderName)
+			}
 			ir.Inject(p)
 		}
 	}
@@ -511,12 +636,12 @@ func (ir *iRunner) getDeliverFunc(token string) (DeliverFunc, DecoderRunner, Dec
 }
 
 func (ir *iRunner) NewDeliverer(token string) Deliverer {
-	deliver, dRunner, decoder := ir.getDeliverFunc(token)
+	deliver, dRunners, decoder := ir.getDeliverFunc(token)
 	d := &deliverer{
-		deliver: deliver,
-		dRunner: dRunner,
-		decoder: decoder,
-		pConfig: ir.pConfig,
+		deliver:  deliver,
+		dRunners: dRunners,
+		decoder:  decoder,
+		pConfig:  ir.pConfig,
 	}
 	return d
 }
@@ -594,6 +719,15 @@ type dRunner struct {
 	sendFailure  bool
 	encodes      bool
 	globals      *GlobalConfigStruct
+	// The field limits of the input the runner decodes for, if any.
+	fieldLimits *fieldLimiter
+	// Recorded in the lineage of the decoded messages, if tracked.
+	lineage []string
+	// Set for the workers of an order preserving decodePool, which hand the
+	// packs decoded from each incoming pack to the pool's sequencer rather
+	// than injecting them, and wait for it to finish before exiting.
+	decoded   chan []*PipelinePack
+	sequenced chan struct{}
 }
 
 // Creates and returns a new (but not yet started) DecoderRunner for the
@@ -633,11 +767,7 @@ func (dr *dRunner) start(h PluginHelper, wg *sync.WaitGroup) {
 		err   error
 	)
 	for pack = range dr.inChan {
-		if packs, err = dr.decoder.Decode(pack); packs != nil {
-			for _, p := range packs {
-				dr.deliver(p)
-			}
-		} else {
+		if packs, err = dr.decoder.Decode(pack); packs == nil {
 			if err != nil {
 				if dr.printFailure {
 					dr.LogError(err)
@@ -647,13 +777,31 @@ func (dr *dRunner) start(h PluginHelper, wg *sync.WaitGroup) {
 						dr.LogError(err)
 					}
 					pack.TrustMsgBytes = false
-					dr.deliver(pack)
-					continue
+					packs = []*PipelinePack{pack}
 				}
 			}
-			pack.recycle()
+			if packs == nil {
+				pack.recycle()
+			}
+		}
+		if dr.decoded != nil {
+			// Always sent, even if empty, so the sequencer can keep count.
+			ready := make([]*PipelinePack, 0, len(packs))
+			for _, p := range packs {
+				if dr.prepare(p) {
+					ready = append(ready, p)
+				}
+			}
+			dr.decoded <- ready
 			continue
 		}
+		for _, p := range packs {
+			dr.deliver(p)
+		}
+	}
+	if dr.decoded != nil {
+		close(dr.decoded)
+		<-dr.sequenced
 	}
 	if wanter, ok := dr.decoder.(WantsDecoderRunnerShutdown); ok {
 		wanter.Shutdown()
@@ -663,16 +811,33 @@ func (dr *dRunner) start(h PluginHelper, wg *sync.WaitGroup) {
 }
 
 func (dr *dRunner) deliver(pack *PipelinePack) {
+	if dr.prepare(pack) {
+		dr.router.Inject(pack)
+	}
+}
+
+// Readies a decoded pack for the router, recycling it and returning false if
+// its message exceeds the field limits or can't be encoded.
+func (dr *dRunner) prepare(pack *PipelinePack) bool {
+	if dr.fieldLimits != nil && !dr.fieldLimits.admit(pack, dr.LogError) {
+		return false
+	}
+	if dr.lineage != nil {
+		trackLineage(pack, dr.lineage...)
+	}
+	if pack.trace != nil {
+		pack.trace.stamp(dr.name)
+	}
 	if !dr.encodes || !pack.TrustMsgBytes {
 		err := pack.EncodeMsgBytes()
 		if err != nil {
 			err = fmt.Errorf("encoding message: %s", err.Error())
 			dr.LogError(err)
 			pack.recycle()
-			return
+			return false
 		}
 	}
-	dr.router.Inject(pack)
+	return true
 }
 
 func (dr *dRunner) InChan() chan *PipelinePack {
@@ -857,6 +1022,13 @@ type foRunner struct {
 	lastErr      error
 	bufReader    *BufferReader
 	stopChan     chan bool
+	packPool     *packPool         // filter only
+	latency      *latencyHistogram // output only
+	workers      []*outputWorker   // output only
+	// Used by the workers of a buffered output.
+	work       chan bufferedWork
+	readerDone chan struct{}
+	cursors    *cursorTracker
 }
 
 const pluginPoolSize = 2
@@ -900,19 +1072,34 @@ func NewFORunner(name string, plugin Plugin, config CommonFOConfig,
 			config.Buffering.FullAction = "shutdown"
 		}
 		switch config.Buffering.FullAction {
-		case "shutdown", "drop", "block":
+		case "shutdown", "drop", "block", "drop_oldest":
 		default:
-			msg := "buffer full_action must be 'shutdown', 'drop', or 'block', got '%s'"
+			msg := "buffer full_action must be 'shutdown', 'drop', 'block', or " +
+				"'drop_oldest', got '%s'"
 			return nil, fmt.Errorf(msg, config.Buffering.FullAction)
 		}
 		runner.capacity = int(config.Buffering.MaxBufferSize) * 90 / 100
 	}
 
+	if config.Workers < 0 {
+		return nil, fmt.Errorf("'%s' workers can't be negative", name)
+	}
+	if config.Workers > 1 {
+		if _, ok := plugin.(Output); !ok {
+			return nil, fmt.Errorf("'%s' workers is only supported by outputs", name)
+		}
+	}
+
 	var matchChan chan *PipelinePack
 	if runner.useBuffering {
+		// Each worker holds on to a pack while the reader fills the next.
+		poolSize := pluginPoolSize
+		if config.Workers > 1 {
+			poolSize += config.Workers
+		}
 		runner.inChan = make(chan *PipelinePack, pluginPoolSize)
-		runner.backChan = make(chan *PipelinePack, pluginPoolSize)
-		for i := 0; i < pluginPoolSize; i++ {
+		runner.backChan = make(chan *PipelinePack, poolSize)
+		for i := 0; i < poolSize; i++ {
 			pack := NewPipelinePack(runner.backChan)
 			pack.BufferedPack = true
 			pack.DelivErrChan = make(chan error, 1)
@@ -953,6 +1140,46 @@ func NewFORunner(name string, plugin Plugin, config CommonFOConfig,
 		return nil, err
 	}
 
+	if runner.kind == foOutput {
+		if runner.latency, err = newLatencyHistogram(config.LatencyBuckets); err != nil {
+			return nil, fmt.Errorf("'%s' %s", name, err)
+		}
+	} else if len(config.LatencyBuckets) > 0 {
+		return nil, fmt.Errorf("'%s' latency_buckets is only supported by outputs", name)
+	}
+
+	if len(config.RouteTo) > 0 {
+		if runner.kind != foFilter {
+			return nil, fmt.Errorf("'%s' route_to is only supported by filters", name)
+		}
+		for _, target := range config.RouteTo {
+			if target == name {
+				return nil, fmt.Errorf("'%s' can't route_to itself", name)
+			}
+		}
+	}
+
+	if config.TraceRate != nil {
+		if runner.kind != foFilter {
+			return nil, fmt.Errorf("'%s' trace_sample_rate is only supported by filters", name)
+		}
+		if err = ValidateTraceSampleRate(*config.TraceRate); err != nil {
+			return nil, fmt.Errorf("'%s' %s", name, err)
+		}
+	}
+
+	if config.PoolSize > 0 || config.PoolSizeMax > 0 {
+		if runner.kind != foFilter {
+			return nil, fmt.Errorf("'%s' poolsize is only supported by filters", name)
+		}
+		if config.PoolSize <= 0 {
+			return nil, fmt.Errorf("'%s' poolsize_max requires a poolsize", name)
+		}
+		if config.PoolSizeMax != 0 && config.PoolSizeMax < config.PoolSize {
+			return nil, fmt.Errorf("'%s' poolsize_max can't be less than poolsize", name)
+		}
+	}
+
 	return runner, nil
 }
 
@@ -977,6 +1204,7 @@ func (foRunner *foRunner) waitForBackPressure() error {
 	if err != nil {
 		return fmt.Errorf("can't create retry helper: %s", err.Error())
 	}
+	retry.SetClock(globals.Clock)
 	for !globals.IsShuttingDown() {
 		bp := foRunner.BackPressured()
 		if !bp {
@@ -1015,7 +1243,7 @@ func (foRunner *foRunner) Start(h PluginHelper, wg *sync.WaitGroup) (err error)
 
 	if foRunner.config.Ticker != 0 {
 		tickLength := time.Duration(foRunner.config.Ticker) * time.Second
-		foRunner.ticker = time.Tick(tickLength)
+		foRunner.ticker = foRunner.pConfig.Globals.Clock.NewTicker(tickLength).Chan()
 	}
 
 	if foRunner.config.Encoder != "" {
@@ -1028,6 +1256,15 @@ func (foRunner *foRunner) Start(h PluginHelper, wg *sync.WaitGroup) (err error)
 		foRunner.encoder = encoder
 	}
 
+	for _, target := range foRunner.config.RouteTo {
+		_, isOutput := foRunner.pConfig.Output(target)
+		_, isFilter := foRunner.pConfig.Filter(target)
+		if !isOutput && !isFilter {
+			return fmt.Errorf("%s route_to specifies unknown plugin %s", foRunner.name,
+				target)
+		}
+	}
+
 	var bufFeeder *BufferFeeder
 	if foRunner.useBuffering {
 		bufFeeder, foRunner.bufReader, err = NewBufferSet("output_queue", foRunner.name,
@@ -1039,9 +1276,28 @@ func (foRunner *foRunner) Start(h PluginHelper, wg *sync.WaitGroup) (err error)
 
 	foRunner.stopChan = make(chan bool)
 
+	if foRunner.config.Workers > 1 {
+		if err = foRunner.makeWorkers(); err != nil {
+			return err
+		}
+	}
+
+	if foRunner.config.PoolSize > 0 {
+		foRunner.packPool = newPackPool(foRunner.name, foRunner.config.PoolSize,
+			foRunner.config.PoolSizeMax, foRunner.pConfig.Globals.PoolShrinkInterval)
+		foRunner.packPool.start(nil)
+		h = &poolHelper{PluginHelper: h, pool: foRunner.packPool}
+		foRunner.h = h
+	}
+
 	if foRunner.matcher != nil {
 		foRunner.matcher.bufFeeder = bufFeeder
 		foRunner.matcher.globals = foRunner.pConfig.Globals
+		globals := foRunner.pConfig.Globals
+		if globals.MatcherNegativeCacheSize > 0 && foRunner.matcher.spec.TypeLoggerOnly() {
+			foRunner.matcher.negCache = newNegativeCache(globals.MatcherNegativeCacheSize,
+				globals)
+		}
 		foRunner.matcher.stopChan = foRunner.stopChan
 		switch foRunner.kind {
 		case foFilter:
@@ -1098,7 +1354,7 @@ func (foRunner *foRunner) bufferLoop(plugin MessageProcessor, h PluginHelper,
 
 // channelLoop is invoked for plugins that support the newer API when buffering
 // is not turned on.
-func (foRunner *foRunner) channelLoop(plugin MessageProcessor, h PluginHelper,
+func (foRunner *foRunner) channelLoop(plugin MessageProcessor, ticker <-chan time.Time,
 	tickReceiver TickerPlugin) error {
 
 	rh, _ := NewRetryHelper(RetryOptions{
@@ -1106,6 +1362,7 @@ func (foRunner *foRunner) channelLoop(plugin MessageProcessor, h PluginHelper,
 		Delay:      "10ms",
 		MaxRetries: -1,
 	})
+	rh.SetClock(foRunner.pConfig.Globals.Clock)
 
 	resetNeeded := false
 	ok := true
@@ -1122,7 +1379,11 @@ func (foRunner *foRunner) channelLoop(plugin MessageProcessor, h PluginHelper,
 		RetryLoop:
 			for !foRunner.pConfig.Globals.IsShuttingDown() {
 				err := plugin.ProcessMessage(pack)
+				if pack.trace != nil {
+					pack.trace.stamp(foRunner.name + ".done")
+				}
 				if err == nil {
+					foRunner.observeLatency(pack)
 					pack.recycle()
 					break RetryLoop // Bumps us back to the outer loop.
 				}
@@ -1141,7 +1402,7 @@ func (foRunner *foRunner) channelLoop(plugin MessageProcessor, h PluginHelper,
 					break RetryLoop
 				}
 			}
-		case <-foRunner.ticker:
+		case <-ticker:
 			if tickReceiver == nil {
 				// Again, this shouldn't happen.
 				panic(fmt.Sprintf("Not a TickerPlugin: %s", foRunner.name))
@@ -1172,13 +1433,39 @@ func (foRunner *foRunner) Starter(plugin MessageProcessor, h PluginHelper,
 		foRunner.matcher.Start(globals.SampleDenominator)
 	}
 
+	if len(foRunner.workers) > 0 {
+		if foRunner.runWorkers(h) {
+			foRunner.exit()
+		}
+		return
+	}
+	if foRunner.runPlugin(foRunner.plugin, nil, h) {
+		foRunner.exit()
+	}
+}
+
+// Prepares and runs the plugin, restarting it if it's a restarting plugin,
+// until it stops for good. The worker is nil unless it's one of an output's
+// workers. Returns false if the plugin was never run.
+func (foRunner *foRunner) runPlugin(plugin Plugin, worker *outputWorker,
+	h PluginHelper) bool {
+
+	globals := foRunner.pConfig.Globals
+	proc := plugin.(MessageProcessor)
+	var or OutputRunner = foRunner
+	ticker := foRunner.ticker
+	if worker != nil {
+		or = worker
+		ticker = worker.ticker
+	}
+
 	var (
 		tickReceiver TickerPlugin
 		ok           bool
 		err          error
 	)
 
-	if foRunner.ticker != nil {
+	if ticker != nil {
 		tickReceiver, ok = plugin.(TickerPlugin)
 		if !ok {
 			// This shouldn't happen, config validation should prevent a non-
@@ -1193,21 +1480,20 @@ func (foRunner *foRunner) Starter(plugin MessageProcessor, h PluginHelper,
 		if !foRunner.IsStoppable() {
 			globals.ShutDown(1)
 		}
-		return
+		return false
 	}
-
-	defer foRunner.exit()
+	rh.SetClock(globals.Clock)
 
 	// Initial Prepare loop.
 	resetNeeded := false
 	for {
 		switch foRunner.kind {
 		case foFilter:
-			f := foRunner.plugin.(Filter)
+			f := plugin.(Filter)
 			err = f.Prepare(foRunner, h)
 		case foOutput:
-			o := foRunner.plugin.(Output)
-			err = o.Prepare(foRunner, h)
+			o := plugin.(Output)
+			err = o.Prepare(or, h)
 		}
 
 		if err == nil {
@@ -1221,7 +1507,7 @@ func (foRunner *foRunner) Starter(plugin MessageProcessor, h PluginHelper,
 		foRunner.LogError(err)
 		if globals.IsShuttingDown() {
 			foRunner.lastErr = err
-			return
+			return true
 		}
 
 		resetNeeded = true
@@ -1231,23 +1517,26 @@ func (foRunner *foRunner) Starter(plugin MessageProcessor, h PluginHelper,
 			if !foRunner.IsStoppable() {
 				globals.ShutDown(1)
 			}
-			return
+			return true
 		}
 	}
 
 	for !globals.IsShuttingDown() {
-		if foRunner.useBuffering {
-			err = foRunner.bufferLoop(plugin, h, tickReceiver)
-		} else {
-			err = foRunner.channelLoop(plugin, h, tickReceiver)
+		switch {
+		case worker != nil && foRunner.useBuffering:
+			err = worker.bufferedLoop(proc, tickReceiver)
+		case foRunner.useBuffering:
+			err = foRunner.bufferLoop(proc, h, tickReceiver)
+		default:
+			err = foRunner.channelLoop(proc, ticker, tickReceiver)
 		}
 
 		switch foRunner.kind {
 		case foFilter:
-			f := foRunner.plugin.(Filter)
+			f := plugin.(Filter)
 			f.CleanUp()
 		case foOutput:
-			o := foRunner.plugin.(Output)
+			o := plugin.(Output)
 			o.CleanUp()
 		}
 
@@ -1259,15 +1548,24 @@ func (foRunner *foRunner) Starter(plugin MessageProcessor, h PluginHelper,
 			foRunner.LogError(err)
 		}
 
-		foRunner.LogMessage("stopped")
+		if worker != nil {
+			foRunner.LogMessage(fmt.Sprintf("worker %d stopped", worker.id))
+		} else {
+			foRunner.LogMessage("stopped")
+		}
 
 		// Are we shutting down? Save ourselves some time by exiting now.
 		if globals.IsShuttingDown() {
 			break
 		}
 
+		// Workers can't outlive the buffer reader feeding them.
+		if worker != nil && worker.readerStopped() {
+			break
+		}
+
 		// We stop and let this quit if its not a restarting plugin.
-		recon, ok := foRunner.plugin.(Restarting)
+		recon, ok := plugin.(Restarting)
 		if !ok {
 			break
 		}
@@ -1302,23 +1600,24 @@ func (foRunner *foRunner) Starter(plugin MessageProcessor, h PluginHelper,
 			foRunner.LogError(err)
 			goto initLoop
 		}
-		if err = foRunner.plugin.Init(config); err != nil {
+		if err = plugin.Init(config); err != nil {
 			foRunner.LogError(err)
 			goto initLoop
 		}
 		switch foRunner.kind {
 		case foFilter:
-			f := foRunner.plugin.(Filter)
+			f := plugin.(Filter)
 			err = f.Prepare(foRunner, foRunner.h)
 		case foOutput:
-			o := foRunner.plugin.(Output)
-			err = o.Prepare(foRunner, foRunner.h)
+			o := plugin.(Output)
+			err = o.Prepare(or, foRunner.h)
 		}
 		if err != nil {
 			foRunner.LogError(err)
 			goto initLoop
 		}
 	}
+	return true
 }
 
 func (foRunner *foRunner) IsStoppable() bool {
@@ -1336,6 +1635,9 @@ func (foRunner *foRunner) Unregister(pConfig *PipelineConfig) error {
 }
 
 func (foRunner *foRunner) exit() {
+	if foRunner.packPool != nil {
+		foRunner.packPool.stop()
+	}
 	if !foRunner.useBuffering {
 		defer func() {
 			var orphaned int
@@ -1479,8 +1781,12 @@ func (foRunner *foRunner) OldStarter(helper PluginHelper, wg *sync.WaitGroup) {
 		}
 		return
 	}
+	rh.SetClock(globals.Clock)
 
 	if foRunner.matcher != nil {
+		if !foRunner.useBuffering {
+			foRunner.matcher.latency = foRunner.latency
+		}
 		foRunner.matcher.Start(globals.SampleDenominator)
 	}
 
@@ -1569,6 +1875,7 @@ func (foRunner foRunner) SendRecord(pack *PipelinePack) error {
 		case err := <-pack.DelivErrChan:
 			if err == nil {
 				atomic.AddInt64(&foRunner.processMessageCount, 1)
+				foRunner.observeLatency(pack)
 				pack.recycle()
 			} else {
 				if _, ok := err.(RetryMessageError); !ok {
@@ -1589,6 +1896,15 @@ func (foRunner foRunner) SendRecord(pack *PipelinePack) error {
 	}
 }
 
+// Records the delivery latency of a pack an output is done with.
+func (foRunner *foRunner) observeLatency(pack *PipelinePack) {
+	// The workers of a buffered output observe the packs as they deliver
+	// them, rather than when the buffer reader hands them over.
+	if foRunner.latency != nil && foRunner.cursors == nil {
+		foRunner.latency.observe(pack.Message)
+	}
+}
+
 func (foRunner *foRunner) UpdateCursor(queueCursor string) {
 	if foRunner.bufReader == nil {
 		return
@@ -1604,14 +1920,41 @@ func (foRunner *foRunner) Inject(pack *PipelinePack) bool {
 		foRunner.LogError(errors.New("can't inject buffered plugin pack"))
 		return false
 	}
-	// Make sure we're not creating an obvious infinite routing loop.
-	spec := foRunner.MatchRunner().MatcherSpecification()
-	match := spec.Match(pack.Message)
-	if match {
-		foRunner.LogError(errors.New("attempted to Inject a message to itself"))
+	pConfig := foRunner.h.PipelineConfig()
+	pConfig.chains.tag(pack.Message, foRunner.name)
+	if pConfig.Globals.TrackLineage {
+		trackLineage(pack, foRunner.name)
+	}
+	pConfig.tracer.sample(pack, foRunner.name,
+		traceSampleRate(foRunner.config.TraceRate, pConfig.Globals))
+	if err := pConfig.router.countHop(pack, foRunner.name); err != nil {
+		foRunner.LogError(err)
 		pack.recycle()
 		return false
 	}
+	if pack.routeTo != nil {
+		// Routed by the plugin itself, e.g. the SharderFilter.
+		for _, target := range pack.routeTo {
+			if target == foRunner.name {
+				foRunner.LogError(errors.New("attempted to Inject a message to itself"))
+				pack.recycle()
+				return false
+			}
+		}
+	} else if len(foRunner.config.RouteTo) > 0 {
+		// Explicit routing, the router will bypass matcher evaluation. We
+		// refuse to route_to ourself at config time so there's no loop check.
+		pack.routeTo = foRunner.config.RouteTo
+	} else {
+		// Make sure we're not creating an obvious infinite routing loop.
+		spec := foRunner.MatchRunner().MatcherSpecification()
+		match := spec.Match(pack.Message)
+		if match {
+			foRunner.LogError(errors.New("attempted to Inject a message to itself"))
+			pack.recycle()
+			return false
+		}
+	}
 	// Make sure the pack's MsgBytes is populated.
 	err := pack.EncodeMsgBytes()
 	if err != nil {
@@ -1619,11 +1962,19 @@ func (foRunner *foRunner) Inject(pack *PipelinePack) bool {
 		pack.recycle()
 		return false
 	}
+	// The message must be durable before the router sees it.
+	if pConfig.injectWal != nil {
+		if err = pConfig.injectWal.append(pack); err != nil {
+			foRunner.LogError(fmt.Errorf("can't log injected message: %s", err))
+			pack.recycle()
+			return false
+		}
+	}
 	// Do the actual injection in a separate goroutine so we free up the
 	// caller; this prevents deadlocks when the caller's InChan is backed up,
 	// backing up the router, which would block us here.
 	go func() {
-		foRunner.h.PipelineConfig().router.Inject(pack)
+		pConfig.router.Inject(pack)
 	}()
 	return true
 }
@@ -1692,16 +2043,15 @@ func (foRunner *foRunner) Encoder() Encoder {
 }
 
 func (foRunner *foRunner) Encode(pack *PipelinePack) (output []byte, err error) {
-	var encoded []byte
-	if encoded, err = foRunner.encoder.Encode(pack); err != nil || encoded == nil {
-		return
-	}
-	if foRunner.useFraming {
-		client.CreateHekaStream(encoded, &output, nil)
-	} else {
-		output = encoded
+	return encodePack(foRunner.encoder, pack, foRunner.useFraming, foRunner.globals())
+}
+
+// Returns the pipeline's globals, or nil if the runner hasn't been started.
+func (foRunner *foRunner) globals() *GlobalConfigStruct {
+	if foRunner.pConfig == nil {
+		return nil
 	}
-	return
+	return foRunner.pConfig.Globals
 }
 
 func (foRunner *foRunner) UsesFraming() bool {
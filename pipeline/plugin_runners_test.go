@@ -19,6 +19,7 @@ package pipeline
 import (
 	"bytes"
 	"errors"
+	"strconv"
 	"sync"
 
 	"github.com/gogo/protobuf/proto"
@@ -212,7 +213,7 @@ func InputRunnerSpec(c gs.Context) {
 
 				dWg := new(sync.WaitGroup)
 				dWg.Add(1)
-				d.dRunner.Start(pConfig, dWg)
+				d.dRunners[0].Start(pConfig, dWg)
 
 				// Make sure it was passed all the way through to the router.
 				recd := <-pConfig.router.inChan
@@ -228,7 +229,59 @@ func InputRunnerSpec(c gs.Context) {
 				pack.Recycle(nil)
 				input.Stop()
 				wg.Wait()
-				close(d.dRunner.InChan())
+				close(d.dRunners[0].InChan())
+			})
+
+			c.Specify("when using a decoder pool", func() {
+				commonInput.Decoder = "FooDecoder"
+				commonInput.DecodeWorkers = 3
+				packs := make([]*PipelinePack, 7)
+				for i := range packs {
+					packs[i] = NewPipelinePack(pConfig.inputRecycleChan)
+					packs[i].Message = ts.GetTestMessage()
+					packs[i].Message.SetLogger(strconv.Itoa(i))
+				}
+
+				c.Specify("it preserves the order of the packs", func() {
+					runner := NewInputRunner("pooled", input, commonInput).(*iRunner)
+					runner.pConfig = pConfig
+					d := runner.NewDeliverer("").(*deliverer)
+					c.Expect(len(d.dRunners), gs.Equals, 3)
+					c.Expect(d.dRunners[2].Name(), gs.Equals, "pooled-FooDecoder-2")
+
+					for _, pack := range packs {
+						d.Deliver(pack)
+					}
+					for i := range packs {
+						recd := <-pConfig.router.inChan
+						c.Expect(recd.Message.GetLogger(), gs.Equals, strconv.Itoa(i))
+						c.Expect(recd.Message.GetPayload(), gs.Equals, "FOO")
+						c.Expect(recd.TrustMsgBytes, gs.IsTrue)
+					}
+					d.Done()
+					pConfig.decodersWg.Wait()
+					c.Expect(len(pConfig.allDecoders), gs.Equals, 0)
+				})
+
+				c.Specify("it delivers every pack when unordered", func() {
+					preserveOrder := false
+					commonInput.PreserveOrder = &preserveOrder
+					runner := NewInputRunner("pooled", input, commonInput).(*iRunner)
+					runner.pConfig = pConfig
+					d := runner.NewDeliverer("").(*deliverer)
+
+					for _, pack := range packs {
+						d.Deliver(pack)
+					}
+					recd := make(map[string]bool)
+					for _ = range packs {
+						pack := <-pConfig.router.inChan
+						recd[pack.Message.GetLogger()] = true
+					}
+					c.Expect(len(recd), gs.Equals, len(packs))
+					d.Done()
+					pConfig.decodersWg.Wait()
+				})
 			})
 
 			c.Specify("when using a decoder", func() {
@@ -315,8 +368,6 @@ func FilterRunnerSpec(c gs.Context) {
 		pConfig.injectRecycleChan <- pack
 		pack.Message = ts.GetTestMessage()
 		c.Assume(pack.TrustMsgBytes, gs.IsFalse)
-		msgEncoding, err := proto.Marshal(pack.Message)
-		c.Assume(err, gs.IsNil)
 
 		c.Specify("puts protobuf encoding into MsgBytes before delivery", func() {
 			result := fRunner.Inject(pack)
@@ -324,8 +375,113 @@ func FilterRunnerSpec(c gs.Context) {
 			recd := <-pConfig.router.inChan
 			c.Expect(recd, gs.Equals, pack)
 			c.Expect(recd.TrustMsgBytes, gs.IsTrue)
+			// The encoding includes the hop count set during injection.
+			msgEncoding, err := proto.Marshal(recd.Message)
+			c.Assume(err, gs.IsNil)
 			c.Expect(bytes.Equal(msgEncoding, recd.MsgBytes), gs.IsTrue)
 		})
+
+		c.Specify("records the filter in the lineage of injected messages", func() {
+			pConfig.Globals.TrackLineage = true
+			defer func() {
+				pConfig.Globals.TrackLineage = false
+			}()
+			message.NewStringField(pack.Message, LINEAGE_FIELD, "tcp:5565>ProtobufDecoder")
+			result := fRunner.Inject(pack)
+			c.Expect(result, gs.IsTrue)
+			recd := <-pConfig.router.inChan
+			c.Expect(len(recd.Message.FindAllFields(LINEAGE_FIELD)), gs.Equals, 1)
+			lineage := MessageLineage(recd.Message)
+			c.Expect(len(lineage), gs.Equals, 3)
+			c.Expect(lineage[2], gs.Equals, "counterFilter")
+		})
+
+		c.Specify("counts injection hops", func() {
+			result := fRunner.Inject(pack)
+			c.Expect(result, gs.IsTrue)
+			recd := <-pConfig.router.inChan
+			hops, _ := recd.Message.GetFieldValue(HOPS_FIELD)
+			c.Expect(hops, gs.Equals, int64(1))
+			c.Expect(recd.MsgLoopCount, gs.Equals, uint(1))
+
+			c.Specify("carried over by copied fields", func() {
+				recd.Message.DeleteField(recd.Message.FindFirstField(HOPS_FIELD))
+				message.NewInt64Field(recd.Message, HOPS_FIELD, 5, "count")
+				result := fRunner.Inject(recd)
+				c.Expect(result, gs.IsTrue)
+				recd := <-pConfig.router.inChan
+				c.Expect(len(recd.Message.FindAllFields(HOPS_FIELD)), gs.Equals, 1)
+				hops, _ := recd.Message.GetFieldValue(HOPS_FIELD)
+				c.Expect(hops, gs.Equals, int64(6))
+			})
+
+			c.Specify("dropping messages past max_hops", func() {
+				pConfig.router.maxHops = 3
+				recd.MsgLoopCount = 4
+				result := fRunner.Inject(recd)
+				c.Expect(result, gs.IsFalse)
+				c.Expect(pConfig.router.loopDropCount, gs.Equals, int64(1))
+			})
+		})
+
+		c.Specify("refuses to Inject a message to itself", func() {
+			commonFO.Matcher = "TRUE"
+			fRunner, err := NewFORunner("loopFilter", filter, commonFO, "CounterFilter",
+				chanSize)
+			c.Assume(err, gs.IsNil)
+			fRunner.h = pConfig
+			result := fRunner.Inject(pack)
+			c.Expect(result, gs.IsFalse)
+		})
+
+		c.Specify("using route_to", func() {
+			c.Specify("can't route to itself", func() {
+				commonFO.RouteTo = []string{"counterFilter"}
+				_, err := NewFORunner("counterFilter", filter, commonFO, "CounterFilter",
+					chanSize)
+				c.Expect(err, gs.Not(gs.IsNil))
+			})
+
+			c.Specify("isn't supported by outputs", func() {
+				commonFO.RouteTo = []string{"counterFilter"}
+				_, err := NewFORunner("stopping", &StoppingOutput{}, commonFO,
+					"StoppingOutput", chanSize)
+				c.Expect(err, gs.Not(gs.IsNil))
+			})
+
+			c.Specify("marks injected packs for direct delivery", func() {
+				commonFO.Matcher = "TRUE"
+				commonFO.RouteTo = []string{"someOutput"}
+				fRunner, err := NewFORunner("routingFilter", filter, commonFO,
+					"CounterFilter", chanSize)
+				c.Assume(err, gs.IsNil)
+				fRunner.h = pConfig
+				result := fRunner.Inject(pack)
+				c.Expect(result, gs.IsTrue)
+				recd := <-pConfig.router.inChan
+				c.Expect(recd, gs.Equals, pack)
+				c.Expect(len(recd.routeTo), gs.Equals, 1)
+				c.Expect(recd.routeTo[0], gs.Equals, "someOutput")
+			})
+
+			c.Specify("the router only delivers to the named plugins", func() {
+				commonFO.Matcher = "FALSE"
+				targeted, err := NewFORunner("targeted", filter, commonFO,
+					"CounterFilter", chanSize)
+				c.Assume(err, gs.IsNil)
+				other, err := NewFORunner("other", filter, commonFO, "CounterFilter",
+					chanSize)
+				c.Assume(err, gs.IsNil)
+				router := pConfig.router
+				router.fMatchers = []*MatchRunner{other.matcher, targeted.matcher}
+
+				pack.routeTo = []string{"targeted"}
+				router.routeDirect(pack)
+				c.Expect(len(targeted.matcher.inChan), gs.Equals, 1)
+				c.Expect(len(other.matcher.inChan), gs.Equals, 0)
+				c.Expect(pack.RefCount, gs.Equals, int32(1))
+			})
+		})
 	})
 }
 
@@ -531,6 +687,46 @@ func OutputRunnerSpec(c gs.Context) {
 			c.Expect(len(pConfig.inputRecycleChan), gs.Equals, 1)
 		})
 
+		c.Specify("only supports workers for new style outputs", func() {
+			commonFO.Workers = 2
+			_, err := NewFORunner("stoppingOutput", output, commonFO, "StoppingOutput",
+				chanSize)
+			c.Expect(err, gs.Not(gs.IsNil))
+			_, err = NewFORunner("counterFilter", &CounterFilter{}, commonFO,
+				"CounterFilter", chanSize)
+			c.Expect(err, gs.Not(gs.IsNil))
+			commonFO.Workers = -1
+			_, err = NewFORunner("stoppingOutput", output, commonFO, "StoppingOutput",
+				chanSize)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("advances the buffer cursor only past records all workers delivered", func() {
+			reader := &BufferReader{config: &QueueBufferConfig{CursorUpdateCount: 100}}
+			tracker := &cursorTracker{reader: reader}
+			entries := make([]*cursorEntry, 4)
+			for i := range entries {
+				entries[i] = tracker.dispatched("0 " + strconv.Itoa((i+1)*10))
+			}
+			tracker.claim(entries[0], 0)
+			tracker.claim(entries[1], 1)
+			tracker.claim(entries[2], 0)
+			tracker.claim(entries[3], 1)
+
+			// Worker 1 finishing first doesn't move the cursor past worker 0's
+			// first record.
+			c.Expect(tracker.delivered(1, "0 20"), gs.IsNil)
+			c.Expect(reader.cursorOffset, gs.Equals, int64(0))
+			c.Expect(tracker.delivered(0, "0 10"), gs.IsNil)
+			c.Expect(reader.cursorOffset, gs.Equals, int64(20))
+			// Delivering a later record covers the worker's earlier ones.
+			c.Expect(tracker.delivered(1, "0 40"), gs.IsNil)
+			c.Expect(reader.cursorOffset, gs.Equals, int64(20))
+			c.Expect(tracker.delivered(0, "0 30"), gs.IsNil)
+			c.Expect(reader.cursorOffset, gs.Equals, int64(40))
+			c.Expect(len(tracker.pending), gs.Equals, 0)
+		})
+
 		c.Specify("encodes a message", func() {
 			oRunner, err := NewFORunner("stoppingOutput", output, commonFO, "StoppingOutput",
 				chanSize)
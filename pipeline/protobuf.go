@@ -21,7 +21,6 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/gogo/protobuf/proto"
 	"github.com/mozilla-services/heka/message"
 )
 
@@ -59,7 +58,7 @@ func (p *ProtobufDecoder) Decode(pack *PipelinePack) (
 		startTime = time.Now()
 	}
 
-	if err = proto.Unmarshal(pack.MsgBytes, pack.Message); err == nil {
+	if err = message.UnmarshalMessage(pack.MsgBytes, pack.Message); err == nil {
 		packs = []*PipelinePack{pack}
 		pack.TrustMsgBytes = true
 	} else {
@@ -29,7 +29,7 @@ import (
 	"time"
 
 	"github.com/gogo/protobuf/proto"
-	"github.com/mozilla-services/heka/client"
+	"github.com/mozilla-services/heka/framing"
 	"github.com/mozilla-services/heka/message"
 )
 
@@ -45,6 +45,8 @@ var _wordre = regexp.MustCompile("\\W")
 
 type BufferSize struct {
 	size uint64
+	// The buffers' total size, if the buffer's registered w/ the quota.
+	total *BufferSize
 }
 
 func (bs *BufferSize) Get() uint64 {
@@ -52,11 +54,17 @@ func (bs *BufferSize) Get() uint64 {
 }
 
 func (bs *BufferSize) Set(val uint64) {
-	atomic.StoreUint64(&bs.size, val)
+	old := atomic.SwapUint64(&bs.size, val)
+	if bs.total != nil {
+		bs.total.Add(val - old)
+	}
 }
 
 func (bs *BufferSize) Add(delta uint64) {
 	atomic.AddUint64(&bs.size, delta)
+	if bs.total != nil {
+		bs.total.Add(delta)
+	}
 }
 
 type QueueBufferConfig struct {
@@ -64,6 +72,9 @@ type QueueBufferConfig struct {
 	MaxBufferSize     uint64 `toml:"max_buffer_size"`
 	FullAction        string `toml:"full_action"`
 	CursorUpdateCount uint   `toml:"cursor_update_count"`
+	// Storage engine of the queue, see RegisterBufferEngine. Defaults to
+	// "file".
+	Engine string `toml:"engine"`
 }
 
 const DefaultBufferMaxFileSize uint64 = uint64(512 * 1024 * 1024)
@@ -74,6 +85,7 @@ func defaultQueueBufferConfig() *QueueBufferConfig {
 		MaxBufferSize:     uint64(0),
 		FullAction:        "shutdown",
 		CursorUpdateCount: uint(1),
+		Engine:            "file",
 	}
 }
 
@@ -83,16 +95,6 @@ func NewBufferSet(queueDir, queueName string, config *QueueBufferConfig,
 	globals := pConfig.Globals
 	queueName = _wordre.ReplaceAllString(queueName, "_")
 	queue := globals.PrependBaseDir(filepath.Join(queueDir, queueName))
-	if !fileExists(queue) {
-		err := os.MkdirAll(queue, 0766)
-		if err != nil {
-			return nil, nil, fmt.Errorf("can't make queue directory: %s", err)
-		}
-	}
-
-	queueSize := &BufferSize{
-		size: getQueueBufferSize(queue),
-	}
 
 	if config.CursorUpdateCount == 0 {
 		config.CursorUpdateCount = 1
@@ -106,13 +108,35 @@ func NewBufferSet(queueDir, queueName string, config *QueueBufferConfig,
 			message.MAX_RECORD_SIZE)
 		return nil, nil, err
 	}
+	if config.Engine == "" {
+		config.Engine = "file"
+	}
+
+	// The feeder and the reader share the engine.
+	engine, err := openBufferEngine(config.Engine, queue)
+	if err != nil {
+		return nil, nil, err
+	}
+	size, err := engine.Size()
+	if err != nil {
+		engine.Close()
+		return nil, nil, fmt.Errorf("can't get queue size: %s", err)
+	}
+	queueSize := &BufferSize{
+		size: size,
+	}
 
-	bf, err := NewBufferFeeder(queue, config, queueSize)
+	bf, err := NewBufferFeeder(engine, config, queueSize)
 	if err != nil {
 		return nil, nil, fmt.Errorf("can't create BufferFeeder: %s", err)
 	}
+	if pConfig.bufferQuota != nil {
+		pConfig.bufferQuota.register(queueName, queueSize, config.MaxBufferSize)
+		bf.quota = pConfig.bufferQuota
+	}
+	bf.globals = globals
 
-	br, err := NewBufferReader(queue, config, queueSize, runner, pConfig)
+	br, err := NewBufferReader(engine, config, queueSize, runner, pConfig)
 	if err != nil {
 		return nil, nil, fmt.Errorf("can't create BufferReader: %s", err)
 	}
@@ -121,55 +145,53 @@ func NewBufferSet(queueDir, queueName string, config *QueueBufferConfig,
 }
 
 type BufferFeeder struct {
-	writeFile     *os.File
+	segment       BufferSegment
 	writeFileSize uint64
 	writeId       uint
-	queue         string
+	engine        BufferEngine
 	queueSize     *BufferSize
 	Config        *QueueBufferConfig
+	// Global disk quota shared by all of the buffers, if any.
+	quota *bufferQuota
+	// Decide what's done w/ oversized messages, see frameOversized.
+	globals *GlobalConfigStruct
 }
 
-func NewBufferFeeder(queue string, config *QueueBufferConfig, queueSize *BufferSize) (
-	*BufferFeeder, error) {
+func NewBufferFeeder(engine BufferEngine, config *QueueBufferConfig,
+	queueSize *BufferSize) (*BufferFeeder, error) {
 
 	bf := &BufferFeeder{
-		queue:     queue,
+		engine:    engine,
 		queueSize: queueSize,
 		Config:    config,
 	}
 
-	var err error
-	if !fileExists(bf.queue) {
-		if err = os.MkdirAll(bf.queue, 0766); err != nil {
-			return nil, fmt.Errorf("can't make queue directory: %s", err)
-		}
+	ids, err := engine.Segments()
+	if err != nil {
+		return nil, fmt.Errorf("can't list queue segments: %s", err)
 	}
-	bf.writeId = findBufferId(bf.queue, true)
-	filename := getQueueFilename(bf.queue, bf.writeId)
-	if bf.writeId > 0 || fileExists(filename) {
-		bf.writeId++
+	// Never append to a segment left over by a previous run.
+	if len(ids) > 0 {
+		bf.writeId = ids[len(ids)-1] + 1
 	}
-	bf.writeFile, err = os.OpenFile(getQueueFilename(bf.queue, bf.writeId),
-		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
-	if err != nil {
-		return nil, fmt.Errorf("can't open write file: %s", err)
+	if bf.segment, err = engine.OpenSegment(bf.writeId); err != nil {
+		return nil, fmt.Errorf("can't open write segment: %s", err)
 	}
-	writeFileInfo, err := bf.writeFile.Stat()
+	size, err := engine.SegmentSize(bf.writeId)
 	if err != nil {
-		return nil, fmt.Errorf("can't stat write file: %s", err)
+		return nil, fmt.Errorf("can't get write segment size: %s", err)
 	}
-	bf.writeFileSize = uint64(writeFileInfo.Size())
+	bf.writeFileSize = uint64(size)
 	return bf, nil
 }
 
 func (bf *BufferFeeder) RollQueue() (err error) {
-	if bf.writeFile != nil {
-		bf.writeFile.Close()
-		bf.writeFile = nil
+	if bf.segment != nil {
+		bf.segment.Close()
+		bf.segment = nil
 	}
 	bf.writeId++
-	bf.writeFile, err = os.OpenFile(getQueueFilename(bf.queue, bf.writeId),
-		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	bf.segment, err = bf.engine.OpenSegment(bf.writeId)
 	bf.writeFileSize = 0
 	return err
 }
@@ -182,6 +204,9 @@ func (bf *BufferFeeder) QueueRecord(pack *PipelinePack) error {
 	if maxQueueSize > 0 && (bf.queueSize.Get()+uint64(len(pack.MsgBytes)) > maxQueueSize) {
 		return QueueIsFull
 	}
+	if bf.quota != nil && bf.quota.exceeded(uint64(len(pack.MsgBytes))) {
+		return QueueIsFull
+	}
 	maxQueueFileSize := bf.Config.MaxFileSize
 	if bf.writeFileSize+uint64(len(pack.MsgBytes)) > maxQueueFileSize {
 		if err := bf.RollQueue(); err != nil {
@@ -189,25 +214,24 @@ func (bf *BufferFeeder) QueueRecord(pack *PipelinePack) error {
 		}
 	}
 
-	var outBytes []byte
-	err := client.CreateHekaStream(pack.MsgBytes, &outBytes, nil)
+	var (
+		outBytes []byte
+		err      error
+	)
+	// Buffered records carry a CRC so a damaged queue file can be read past.
+	if len(pack.MsgBytes) > int(message.MAX_MESSAGE_SIZE) {
+		outBytes, err = frameOversized(bf.globals, pack, len(pack.MsgBytes), nil, true)
+	} else {
+		err = framing.Frame(pack.MsgBytes, &outBytes, nil, true)
+	}
 	if err != nil {
 		return fmt.Errorf("message framing error: %s", err)
 	}
 
-	n, err := bf.writeFile.Write(outBytes)
+	n, err := bf.segment.Append(outBytes)
 	if err != nil {
-		if n > 0 {
-			// If we wrote some data but there was an error, that data is
-			// suspect so we need to seek back to before the bogus write
-			// happened.
-			ret, e := bf.writeFile.Seek(int64(-n), 2)
-			if e != nil {
-				return QueueCorrupt
-			}
-			if e = bf.writeFile.Truncate(ret); e != nil {
-				return QueueCorrupt
-			}
+		if err == QueueCorrupt {
+			return err
 		}
 		return fmt.Errorf("can't write to queue: %s", err)
 	}
@@ -216,32 +240,54 @@ func (bf *BufferFeeder) QueueRecord(pack *PipelinePack) error {
 	return nil
 }
 
+// DropOldest deletes the oldest queue segment, other than the one being
+// written to, freeing up its space at the cost of its records never being
+// read. Returns false if there was no such segment to delete.
+func (bf *BufferFeeder) DropOldest() (bool, error) {
+	ids, err := bf.engine.Segments()
+	if err != nil {
+		return false, fmt.Errorf("can't list queue segments: %s", err)
+	}
+	if len(ids) == 0 || ids[0] >= bf.writeId {
+		return false, nil
+	}
+	size, err := bf.engine.RemoveSegment(ids[0])
+	if err != nil {
+		if os.IsNotExist(err) {
+			// The reader got to it first.
+			return true, nil
+		}
+		return false, fmt.Errorf("can't remove queue segment %d: %s", ids[0], err)
+	}
+	bf.queueSize.Add(^uint64(size - 1)) // Subtracts segment size.
+	return true, nil
+}
+
 type BufferReader struct {
-	readOffset         int64
-	cursorOffset       int64
-	config             *QueueBufferConfig
-	runner             *foRunner
-	sRunner            SplitterRunner
-	splitter           *HekaFramingSplitter
-	readFile           *os.File
-	readId             uint
-	cursorId           uint
-	cursorCount        uint
-	checkpointFilename string
-	checkpointFile     *os.File
-	queue              string
-	queueSize          *BufferSize
+	readOffset   int64
+	cursorOffset int64
+	config       *QueueBufferConfig
+	runner       *foRunner
+	sRunner      SplitterRunner
+	splitter     *HekaFramingSplitter
+	readStream   io.ReadCloser
+	readId       uint
+	cursorId     uint
+	cursorCount  uint
+	engine       BufferEngine
+	queueSize    *BufferSize
+	header       message.Header
 }
 
 type BufferSender interface {
 	SendRecord(pack *PipelinePack) error
 }
 
-func NewBufferReader(queue string, config *QueueBufferConfig, queueSize *BufferSize,
+func NewBufferReader(engine BufferEngine, config *QueueBufferConfig, queueSize *BufferSize,
 	runner *foRunner, pConfig *PipelineConfig) (*BufferReader, error) {
 
 	br := &BufferReader{
-		queue:     queue,
+		engine:    engine,
 		config:    config,
 		queueSize: queueSize,
 		runner:    runner,
@@ -262,8 +308,6 @@ func NewBufferReader(queue string, config *QueueBufferConfig, queueSize *BufferS
 	}
 	br.sRunner = sRunner.(SplitterRunner)
 
-	br.checkpointFilename = filepath.Join(queue, "checkpoint.txt")
-
 	if err = br.initReadFile(); err != nil {
 		return nil, fmt.Errorf("can't access read location: %s", err)
 	}
@@ -273,59 +317,69 @@ func NewBufferReader(queue string, config *QueueBufferConfig, queueSize *BufferS
 }
 
 func (br *BufferReader) initReadFile() error {
-	var err error
-	if fileExists(br.checkpointFilename) {
-		br.readId, br.readOffset, err = readCheckpoint(br.checkpointFilename)
+	checkpoint, err := br.engine.Checkpoint()
+	if err != nil {
+		return fmt.Errorf("can't read checkpoint: %s", err)
+	}
+	if checkpoint != "" {
+		br.readId, br.readOffset, err = parseQueueCursor([]byte(checkpoint))
 		if err != nil {
 			return fmt.Errorf("readCheckpoint %s", err)
 		}
 	} else {
 		br.readOffset = 0
-		br.readId = findBufferId(br.queue, false)
+		ids, err := br.engine.Segments()
+		if err != nil {
+			return fmt.Errorf("can't list queue segments: %s", err)
+		}
+		br.readId = 0
+		if len(ids) > 0 {
+			br.readId = ids[0]
+		}
 	}
 
-	filename := getQueueFilename(br.queue, br.readId)
-	if br.readId == 0 && br.readOffset == 0 && !fileExists(filename) {
-		// New queue, no content, not an error.
+	br.readStream, err = br.engine.ReadSegment(br.readId, br.readOffset)
+	if err == nil {
 		return nil
 	}
-	if !fileExists(filename) {
-		br.readOffset = 0
-		br.readFile, br.readId, err = br.getFileFromId(br.readId)
-		if err != nil {
-			br.readFile = nil
-			br.readId = 0
-		}
+	br.readStream = nil
+	if !os.IsNotExist(err) {
 		return err
 	}
-	if br.readFile, err = os.Open(filename); err != nil {
-		return err
+	if br.readId == 0 && br.readOffset == 0 {
+		// New queue, no content, not an error.
+		return nil
 	}
-	if _, err = br.readFile.Seek(br.readOffset, 0); err != nil {
-		br.readFile.Close()
-		br.readFile = nil
+	br.readOffset = 0
+	br.readStream, br.readId, err = br.getSegmentFromId(br.readId)
+	if err != nil {
+		br.readStream = nil
+		br.readId = 0
 	}
 	return err
 }
 
-func (br *BufferReader) getFileFromId(id uint) (file *os.File, foundId uint,
-	err error) {
+func (br *BufferReader) getSegmentFromId(id uint) (stream io.ReadCloser,
+	foundId uint, err error) {
 
-	filename := getQueueFilename(br.queue, id)
-	if fileExists(filename) {
-		if file, err = os.Open(filename); err == nil {
-			foundId = id
-		}
-		return file, foundId, err
+	stream, err = br.engine.ReadSegment(id, 0)
+	if err == nil {
+		return stream, id, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, 0, err
 	}
 
-	// If we got this far, there was no file matching our id when we checked.
-	// It might, however, have been created after we checked, but before we get
-	// our id list back from the sortedBufferIds call below. This is fine,
-	// we'll still find and return it.
-	ids := sortedBufferIds(br.queue)
+	// If we got this far, there was no segment matching our id when we
+	// checked. It might, however, have been created after we checked, but
+	// before we get our id list back from the Segments call below. This is
+	// fine, we'll still find and return it.
+	ids, err := br.engine.Segments()
+	if err != nil {
+		return nil, 0, err
+	}
 	if len(ids) == 0 || ids[len(ids)-1] < id {
-		// No log file for us, not an error.
+		// No segment for us, not an error.
 		return nil, 0, nil
 	}
 
@@ -337,9 +391,8 @@ func (br *BufferReader) getFileFromId(id uint) (file *os.File, foundId uint,
 			break
 		}
 	}
-	filename = getQueueFilename(br.queue, foundId)
-	file, err = os.Open(filename)
-	return file, foundId, err
+	stream, err = br.engine.ReadSegment(foundId, 0)
+	return stream, foundId, err
 }
 
 func (br *BufferReader) updateCursor(queueCursor string) error {
@@ -364,7 +417,7 @@ func (br *BufferReader) updateCursor(queueCursor string) error {
 		if br.cursorCount < br.config.CursorUpdateCount {
 			br.cursorCount++
 		} else {
-			if err = br.writeCheckpoint(queueCursor); err != nil {
+			if err = br.engine.WriteCheckpoint(queueCursor); err != nil {
 				return fmt.Errorf("can't write checkpoint file: %s", err)
 			}
 			br.cursorCount = 0
@@ -372,47 +425,44 @@ func (br *BufferReader) updateCursor(queueCursor string) error {
 		return nil
 	}
 
-	// If we got this far we've updated to a new index file, need to delete
+	// If we got this far we've updated to a new segment, need to delete
 	// any we've advanced past and decrement our queue size.
 	oldId := br.cursorId
 	br.cursorId = id
 	br.cursorOffset = offset
-	if err = br.writeCheckpoint(queueCursor); err != nil {
+	if err = br.engine.WriteCheckpoint(queueCursor); err != nil {
 		return fmt.Errorf("can't write checkpoint file: %s", err)
 	}
 	br.cursorCount = 0
 	for delId := oldId; delId < id; delId++ {
-		filename := getQueueFilename(br.queue, delId)
-		if !fileExists(filename) {
-			// We don't care if the file is already gone.
-			continue
-		}
-		fileInfo, err := os.Stat(filename)
+		size, err := br.engine.RemoveSegment(delId)
 		if err != nil {
-			return fmt.Errorf("can't stat queue file %s: %s", filename, err)
-		}
-		if err = os.Remove(filename); err != nil {
-			return fmt.Errorf("can't remove queue file %s: %s", filename, err)
+			if os.IsNotExist(err) {
+				// We don't care if the segment is already gone, e.g. dropped
+				// by the feeder in the meantime.
+				continue
+			}
+			return fmt.Errorf("can't remove queue segment %d: %s", delId, err)
 		}
-		br.queueSize.Add(^uint64(fileInfo.Size() - 1)) // Subtracts file size.
+		br.queueSize.Add(^uint64(size - 1)) // Subtracts segment size.
 	}
 	return nil
 }
 
-func (br *BufferReader) writeCheckpoint(queueCursor string) error {
-	var err error
-	if br.checkpointFile == nil {
-		if br.checkpointFile, err = os.OpenFile(br.checkpointFilename,
-			os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644); err != nil {
-			return err
-		}
-	}
-	br.checkpointFile.Seek(0, 0)
-	n, err := br.checkpointFile.WriteString(queueCursor)
+// Writes the final checkpoint and releases the reader's resources once it's
+// done streaming.
+func (br *BufferReader) closeStream() {
+	err := br.engine.WriteCheckpoint(fmt.Sprintf("%d %d", br.cursorId, br.cursorOffset))
 	if err != nil {
-		return err
+		br.runner.LogError(fmt.Errorf("can't write buffer checkpoint: %s", err))
+	}
+	if br.readStream != nil {
+		br.readStream.Close()
+		br.readStream = nil
+	}
+	if err = br.engine.Close(); err != nil {
+		br.runner.LogError(fmt.Errorf("can't close buffer engine: %s", err))
 	}
-	return br.checkpointFile.Truncate(int64(n))
 }
 
 func (br *BufferReader) runTimerEvent(tickerPlugin TickerPlugin) error {
@@ -433,20 +483,7 @@ func (br *BufferReader) NewStreamOutput(sender MessageProcessor, packSupply chan
 		return errors.New("Must provide TickerPlugin if tickChan is not nil.")
 	}
 
-	defer func() {
-		err := br.writeCheckpoint(fmt.Sprintf("%d %d", br.cursorId, br.cursorOffset))
-		if err != nil {
-			br.runner.LogError(fmt.Errorf("can't write buffer checkpoint: %s", err))
-		}
-		if br.checkpointFile != nil {
-			br.checkpointFile.Close()
-			br.checkpointFile = nil
-		}
-		if br.readFile != nil {
-			br.readFile.Close()
-			br.readFile = nil
-		}
-	}()
+	defer br.closeStream()
 
 	rh, _ := NewRetryHelper(RetryOptions{
 		MaxDelay:   "1s",
@@ -462,9 +499,9 @@ func (br *BufferReader) NewStreamOutput(sender MessageProcessor, packSupply chan
 
 	for {
 		if err = br.initReadFile(); err != nil {
-			return fmt.Errorf("can't initialize read file", err)
+			return fmt.Errorf("can't initialize read file: %s", err)
 		}
-		if br.readFile != nil {
+		if br.readStream != nil {
 			if resetNeeded {
 				rh.Reset()
 				resetNeeded = false
@@ -487,6 +524,8 @@ func (br *BufferReader) NewStreamOutput(sender MessageProcessor, packSupply chan
 				if e := br.runTimerEvent(tickerPlugin); e != nil {
 					return e
 				}
+				// Still no pack to read the next record into.
+				continue
 			case pack = <-packSupply:
 			}
 		} else {
@@ -536,6 +575,7 @@ func (br *BufferReader) NewStreamOutput(sender MessageProcessor, packSupply chan
 				}
 			} else {
 				atomic.AddInt64(&br.runner.processMessageCount, 1)
+				br.runner.observeLatency(pack)
 				pack.recycle()
 				break sendLoop
 			}
@@ -568,20 +608,7 @@ func (br *BufferReader) NewStreamOutput(sender MessageProcessor, packSupply chan
 func (br *BufferReader) StreamOutput(sender BufferSender,
 	packSupply chan *PipelinePack, stopChan chan bool) error {
 
-	defer func() {
-		err := br.writeCheckpoint(fmt.Sprintf("%d %d", br.cursorId, br.cursorOffset))
-		if err != nil {
-			br.runner.LogError(fmt.Errorf("can't write buffer checkpoint: %s", err))
-		}
-		if br.checkpointFile != nil {
-			br.checkpointFile.Close()
-			br.checkpointFile = nil
-		}
-		if br.readFile != nil {
-			br.readFile.Close()
-			br.readFile = nil
-		}
-	}()
+	defer br.closeStream()
 
 	rh, _ := NewRetryHelper(RetryOptions{
 		MaxDelay:   "2s",
@@ -597,9 +624,9 @@ func (br *BufferReader) StreamOutput(sender BufferSender,
 
 	for {
 		if err := br.initReadFile(); err != nil {
-			return fmt.Errorf("can't initialize read file", err)
+			return fmt.Errorf("can't initialize read file: %s", err)
 		}
-		if br.readFile != nil {
+		if br.readStream != nil {
 			if resetNeeded {
 				rh.Reset()
 				resetNeeded = false
@@ -665,34 +692,34 @@ func (br *BufferReader) StreamOutput(sender BufferSender,
 }
 
 func (br *BufferReader) NextRecord(pack *PipelinePack) error {
-	if br.readFile == nil {
+	if br.readStream == nil {
 		err := br.initReadFile()
 		if err != nil {
 			return fmt.Errorf("can't open read file: %s", err)
 		}
-		if br.readFile == nil {
+		if br.readStream == nil {
 			return QueueNoRecord
 		}
 	}
 
-	n, record, err := br.sRunner.GetRecordFromStream(br.readFile)
+	n, record, err := br.sRunner.GetRecordFromStream(br.readStream)
 	if err != nil {
 		if err == io.EOF {
-			// Look to see if there's a newer file, advance to it if so.
-			nextReadFile, nextFileId, err := br.getFileFromId(br.readId + 1)
+			// Look to see if there's a newer segment, advance to it if so.
+			nextStream, nextId, err := br.getSegmentFromId(br.readId + 1)
 			if err != nil {
-				return fmt.Errorf("can't lookup subsequent file: %s", err)
-			} else if nextReadFile == nil {
-				// No next file, current file might still grow.
+				return fmt.Errorf("can't lookup subsequent segment: %s", err)
+			} else if nextStream == nil {
+				// No next segment, current one might still grow.
 				return QueueNoRecord
 			}
-			// Newer file exists, bump the id and file and recurse.
-			oldReadFile := br.readFile
-			br.readFile = nextReadFile
-			br.readId = nextFileId
+			// Newer segment exists, bump the id and stream and recurse.
+			oldStream := br.readStream
+			br.readStream = nextStream
+			br.readId = nextId
 			br.readOffset = 0
-			if err = oldReadFile.Close(); err != nil {
-				return fmt.Errorf("can't close readfile: %s", err)
+			if err = oldStream.Close(); err != nil {
+				return fmt.Errorf("can't close read segment: %s", err)
 			}
 			return br.NextRecord(pack)
 		} else {
@@ -720,7 +747,19 @@ func (br *BufferReader) NextRecord(pack *PipelinePack) error {
 	}
 	copy(pack.MsgBytes, record[headerLen:])
 	pack.TrustMsgBytes = true
-	err = proto.Unmarshal(pack.MsgBytes, pack.Message)
+	// Records w/ a CRC that the splitter verified hold the bytes the
+	// BufferFeeder framed, which were encoded or checked by the decoder
+	// before, so they're decoded w/o checking them again. Records written by
+	// older versions are checked like any other input.
+	br.header.Reset()
+	if _, err = message.DecodeHeader(record[2:headerLen], &br.header); err != nil {
+		return fmt.Errorf("can't decode record header: %s", err)
+	}
+	if _, ok := framing.GetCrc(&br.header); ok {
+		err = proto.Unmarshal(pack.MsgBytes, pack.Message)
+	} else {
+		err = message.UnmarshalMessage(pack.MsgBytes, pack.Message)
+	}
 	if err != nil {
 		return fmt.Errorf("can't unmarshal record: %s", err)
 	}
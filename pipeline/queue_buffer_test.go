@@ -20,10 +20,12 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/bbangert/toml"
 	"github.com/gogo/protobuf/proto"
 	"github.com/mozilla-services/heka/client"
+	"github.com/mozilla-services/heka/framing"
 	"github.com/mozilla-services/heka/message"
 	ts "github.com/mozilla-services/heka/pipeline/testsupport"
 	"github.com/rafrombrc/gomock/gomock"
@@ -88,6 +90,7 @@ func QueueBufferSpec(c gs.Context) {
 		feeder, reader, err := NewBufferSet(tmpDir, "test", qConfig, or, pConfig)
 		// bufferedOutput, err := NewBufferedOutput(tmpDir, "test", or, h, uint64(0))
 		c.Assume(err, gs.IsNil)
+		queue := filepath.Join(tmpDir, "test")
 		msg := ts.GetTestMessage()
 
 		c.Specify("fileExists", func() {
@@ -122,23 +125,23 @@ func QueueBufferSpec(c gs.Context) {
 		})
 
 		c.Specify("writeCheckpoint", func() {
-			reader.checkpointFilename = filepath.Join(tmpDir, "cp.txt")
-			err := reader.writeCheckpoint("43 99999")
+			checkpointFilename := filepath.Join(queue, "checkpoint.txt")
+			err := reader.engine.WriteCheckpoint("43 99999")
 			c.Expect(err, gs.IsNil)
-			c.Expect(fileExists(reader.checkpointFilename), gs.IsTrue)
+			c.Expect(fileExists(checkpointFilename), gs.IsTrue)
 
-			id, offset, err := readCheckpoint(reader.checkpointFilename)
+			id, offset, err := readCheckpoint(checkpointFilename)
 			c.Expect(err, gs.IsNil)
 			c.Expect(id, gs.Equals, uint(43))
 			c.Expect(offset, gs.Equals, int64(99999))
 
-			err = reader.writeCheckpoint("43 1")
+			err = reader.engine.WriteCheckpoint("43 1")
 			c.Expect(err, gs.IsNil)
-			id, offset, err = readCheckpoint(reader.checkpointFilename)
+			id, offset, err = readCheckpoint(checkpointFilename)
 			c.Expect(err, gs.IsNil)
 			c.Expect(id, gs.Equals, uint(43))
 			c.Expect(offset, gs.Equals, int64(1))
-			reader.checkpointFile.Close()
+			reader.engine.Close()
 		})
 
 		c.Specify("readCheckpoint", func() {
@@ -173,31 +176,25 @@ func QueueBufferSpec(c gs.Context) {
 		})
 
 		c.Specify("RollQueue", func() {
-			feeder.queue = tmpDir
 			err := feeder.RollQueue()
 			c.Expect(err, gs.IsNil)
-			c.Expect(fileExists(getQueueFilename(feeder.queue,
+			c.Expect(fileExists(getQueueFilename(queue,
 				feeder.writeId)), gs.IsTrue)
-			feeder.writeFile.WriteString("this is a test item")
-			feeder.writeFile.Close()
+			feeder.segment.Append([]byte("this is a test item"))
+			feeder.segment.Close()
 
-			reader.checkpointFilename = filepath.Join(tmpDir, "cp.txt")
-			reader.queue = tmpDir
-			reader.writeCheckpoint(fmt.Sprintf("%d 10", feeder.writeId))
-			reader.checkpointFile.Close()
+			reader.engine.WriteCheckpoint(fmt.Sprintf("%d 10", feeder.writeId))
+			reader.engine.Close()
 			err = reader.initReadFile()
 			c.Assume(err, gs.IsNil)
 			buf := make([]byte, 4)
-			n, err := reader.readFile.Read(buf)
+			n, err := reader.readStream.Read(buf)
 			c.Expect(n, gs.Equals, 4)
 			c.Expect(string(buf), gs.Equals, "test")
-			feeder.writeFile.Close()
-			reader.readFile.Close()
+			reader.readStream.Close()
 		})
 
 		c.Specify("QueueRecord", func() {
-			reader.checkpointFilename = filepath.Join(tmpDir, "cp.txt")
-			reader.queue = tmpDir
 			newpack := NewPipelinePack(nil)
 			newpack.Message = msg
 			payload := "Write me out to the network"
@@ -205,16 +202,16 @@ func QueueBufferSpec(c gs.Context) {
 			encoder := client.NewProtobufEncoder(nil)
 			protoBytes, err := encoder.EncodeMessage(newpack.Message)
 			newpack.MsgBytes = protoBytes
-			expectedLen := 115
+			expectedLen := 120 // Includes the 5 byte frame CRC.
 
 			c.Specify("adds framing", func() {
 				err = feeder.RollQueue()
 				c.Expect(err, gs.IsNil)
 				err = feeder.QueueRecord(newpack)
-				fName := getQueueFilename(feeder.queue, feeder.writeId)
+				fName := getQueueFilename(queue, feeder.writeId)
 				c.Expect(fileExists(fName), gs.IsTrue)
 				c.Expect(err, gs.IsNil)
-				feeder.writeFile.Close()
+				feeder.segment.Close()
 
 				f, err := os.Open(fName)
 				c.Expect(err, gs.IsNil)
@@ -230,6 +227,32 @@ func QueueBufferSpec(c gs.Context) {
 				c.Expect(outMsg.GetPayload(), gs.Equals, payload)
 			})
 
+			c.Specify("is read back", func() {
+				err = feeder.RollQueue()
+				c.Assume(err, gs.IsNil)
+				c.Assume(feeder.QueueRecord(newpack), gs.IsNil)
+				outPack := NewPipelinePack(nil)
+				c.Expect(reader.NextRecord(outPack), gs.IsNil)
+				c.Expect(outPack.Message.GetPayload(), gs.Equals, payload)
+				c.Expect(outPack.TrustMsgBytes, gs.IsTrue)
+				reader.readStream.Close()
+			})
+
+			c.Specify("is checked if it has no CRC", func() {
+				err = feeder.RollQueue()
+				c.Assume(err, gs.IsNil)
+				// Logger w/ a negative length.
+				var framed []byte
+				malformed := []byte("\x22\xff\xff\xff\xff\xff\xff\xff\xff\xff\x01")
+				c.Assume(framing.Frame(malformed, &framed, nil, false), gs.IsNil)
+				_, err = feeder.segment.Append(framed)
+				c.Assume(err, gs.IsNil)
+				err = reader.NextRecord(NewPipelinePack(nil))
+				c.Expect(err, gs.Not(gs.IsNil))
+				c.Expect(strings.HasPrefix(err.Error(), "can't unmarshal record"), gs.IsTrue)
+				reader.readStream.Close()
+			})
+
 			c.Specify("when queue has limit", func() {
 				feeder.Config.MaxBufferSize = uint64(200)
 				c.Expect(feeder.queueSize.Get(), gs.Equals, uint64(0))
@@ -249,7 +272,7 @@ func QueueBufferSpec(c gs.Context) {
 				c.Expect(feeder.queueSize.Get(), gs.Equals, uint64(0))
 				err = feeder.RollQueue()
 				c.Expect(err, gs.IsNil)
-				queueFiles, err := ioutil.ReadDir(feeder.queue)
+				queueFiles, err := ioutil.ReadDir(queue)
 				c.Expect(err, gs.IsNil)
 				numFiles := len(queueFiles)
 
@@ -263,7 +286,7 @@ func QueueBufferSpec(c gs.Context) {
 				c.Expect(err, gs.IsNil)
 
 				// Queue should have rolled.
-				queueFiles, err = ioutil.ReadDir(feeder.queue)
+				queueFiles, err = ioutil.ReadDir(queue)
 				c.Expect(err, gs.IsNil)
 				c.Expect(len(queueFiles), gs.Equals, numFiles+1)
 
@@ -272,11 +295,55 @@ func QueueBufferSpec(c gs.Context) {
 				c.Expect(err, gs.Equals, QueueIsFull)
 
 				// Ensure queue didn't roll twice.
-				queueFiles, err = ioutil.ReadDir(feeder.queue)
+				queueFiles, err = ioutil.ReadDir(queue)
 				c.Expect(err, gs.IsNil)
 				c.Expect(len(queueFiles), gs.Equals, numFiles+1)
 			})
 
+			c.Specify("when the global disk quota is full", func() {
+				// One record per queue file.
+				feeder.Config.MaxFileSize = uint64(expectedLen + 1)
+				pConfig.bufferQuota.limit = uint64(expectedLen * 2)
+
+				err = feeder.QueueRecord(newpack)
+				c.Expect(err, gs.IsNil)
+				err = feeder.QueueRecord(newpack)
+				c.Expect(err, gs.IsNil)
+				c.Expect(pConfig.bufferQuota.usage.Get(), gs.Equals, uint64(expectedLen*2))
+				err = feeder.QueueRecord(newpack)
+				c.Expect(err, gs.Equals, QueueIsFull)
+
+				c.Specify("drops the oldest queue file", func() {
+					oldest := getQueueFilename(queue, sortedBufferIds(queue)[0])
+					dropped, err := feeder.DropOldest()
+					c.Expect(err, gs.IsNil)
+					c.Expect(dropped, gs.IsTrue)
+					c.Expect(fileExists(oldest), gs.IsFalse)
+					c.Expect(feeder.queueSize.Get(), gs.Equals, uint64(expectedLen))
+					c.Expect(pConfig.bufferQuota.usage.Get(), gs.Equals, uint64(expectedLen))
+					err = feeder.QueueRecord(newpack)
+					c.Expect(err, gs.IsNil)
+
+					// The file being written to is never dropped.
+					dropped, err = feeder.DropOldest()
+					c.Expect(err, gs.IsNil)
+					c.Expect(dropped, gs.IsTrue)
+					dropped, err = feeder.DropOldest()
+					c.Expect(err, gs.IsNil)
+					c.Expect(dropped, gs.IsFalse)
+				})
+
+				c.Specify("alerts when crossing the alert percentage", func() {
+					pConfig.injectRecycleChan <- NewPipelinePack(pConfig.injectRecycleChan)
+					pConfig.bufferQuota.check()
+					c.Expect(pConfig.bufferQuota.alerting, gs.IsTrue)
+					pack := <-pConfig.router.inChan
+					c.Expect(pack.Message.GetType(), gs.Equals, "heka.buffer-quota")
+					state, _ := pack.Message.GetFieldValue("state")
+					c.Expect(state, gs.Equals, "exceeded")
+				})
+			})
+
 			c.Specify("rolls when queue file hits max size", func() {
 				feeder.Config.MaxFileSize = uint64(300)
 				c.Assume(feeder.writeFileSize, gs.Equals, uint64(0))
@@ -287,7 +354,7 @@ func QueueBufferSpec(c gs.Context) {
 				err = feeder.QueueRecord(newpack)
 				c.Expect(err, gs.IsNil)
 				c.Expect(feeder.writeFileSize, gs.Equals, uint64(expectedLen*2))
-				queueFiles, err := ioutil.ReadDir(feeder.queue)
+				queueFiles, err := ioutil.ReadDir(queue)
 				c.Expect(err, gs.IsNil)
 				c.Expect(len(queueFiles), gs.Equals, 1)
 
@@ -295,7 +362,7 @@ func QueueBufferSpec(c gs.Context) {
 				err = feeder.QueueRecord(newpack)
 				c.Expect(err, gs.IsNil)
 				c.Expect(feeder.writeFileSize, gs.Equals, uint64(expectedLen))
-				queueFiles, err = ioutil.ReadDir(feeder.queue)
+				queueFiles, err = ioutil.ReadDir(queue)
 				c.Expect(err, gs.IsNil)
 				c.Expect(len(queueFiles), gs.Equals, 2)
 			})
@@ -0,0 +1,275 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/mozilla-services/heka/framing"
+	"github.com/mozilla-services/heka/message"
+)
+
+// BufferQueue gives offline access to a plugin's on-disk queue buffer, for
+// tools such as heka-buffer. It mustn't be used on the queue of a plugin
+// hekad is running, since the BufferReader keeps its cursor in memory and
+// would overwrite any changes to the checkpoint.
+type BufferQueue struct {
+	Dir    string
+	engine BufferEngine
+}
+
+// A queue file, or segment for the engines that don't keep one file per
+// segment, and its size in bytes.
+type BufferQueueFile struct {
+	Id   uint
+	Size int64
+}
+
+// A record read from a queue buffer.
+type BufferQueueRecord struct {
+	// Queue file id and offset of the start of the record.
+	Id     uint
+	Offset int64
+	// Offset just past the record, the queue cursor once it's delivered.
+	End int64
+	// The framed record, as written to the queue file. Only valid until the
+	// Scan callback returns.
+	Record  []byte
+	Message *message.Message
+	// Whether the record comes before the checkpoint, i.e. it was already
+	// delivered but its file hasn't been deleted yet.
+	Delivered bool
+}
+
+// Returned by a BufferQueue.Scan callback to stop scanning.
+var ErrStopScan = errors.New("stop scan")
+
+func OpenBufferQueue(dir string) (*BufferQueue, error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("%s isn't a queue directory", dir)
+	}
+	// The queue's engine isn't recorded anywhere, it's told by its files.
+	engineName := "file"
+	if fileExists(filepath.Join(dir, boltQueueFilename)) {
+		engineName = "bolt"
+	}
+	engine, err := openBufferEngine(engineName, dir)
+	if err != nil {
+		return nil, err
+	}
+	return &BufferQueue{Dir: dir, engine: engine}, nil
+}
+
+// Releases the queue's storage engine.
+func (q *BufferQueue) Close() error {
+	return q.engine.Close()
+}
+
+// Returns the queue files, oldest first.
+func (q *BufferQueue) Files() ([]BufferQueueFile, error) {
+	ids, err := q.engine.Segments()
+	if err != nil {
+		return nil, err
+	}
+	files := make([]BufferQueueFile, 0, len(ids))
+	for _, id := range ids {
+		size, err := q.engine.SegmentSize(id)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, BufferQueueFile{Id: id, Size: size})
+	}
+	return files, nil
+}
+
+// Returns the position the plugin will resume reading from, the start of
+// the oldest queue file if there's no checkpoint.
+func (q *BufferQueue) Checkpoint() (id uint, offset int64, err error) {
+	checkpoint, err := q.engine.Checkpoint()
+	if err != nil {
+		return 0, 0, err
+	}
+	if checkpoint != "" {
+		return parseQueueCursor([]byte(checkpoint))
+	}
+	ids, err := q.engine.Segments()
+	if err != nil || len(ids) == 0 {
+		return 0, 0, err
+	}
+	return ids[0], 0, nil
+}
+
+// Moves the position the plugin will resume reading from, deleting the queue
+// files before it.
+func (q *BufferQueue) SetCheckpoint(id uint, offset int64) error {
+	cursor := fmt.Sprintf("%d %d", id, offset)
+	if err := q.engine.WriteCheckpoint(cursor); err != nil {
+		return err
+	}
+	ids, err := q.engine.Segments()
+	if err != nil {
+		return err
+	}
+	for _, fileId := range ids {
+		if fileId >= id {
+			break
+		}
+		if _, err = q.engine.RemoveSegment(fileId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Calls fn w/ each of the records in the queue files, starting w/ the
+// oldest file still on disk if all is true, or at the checkpoint otherwise.
+// Records that can't be unmarshalled are skipped.
+func (q *BufferQueue) Scan(all bool, fn func(rec *BufferQueueRecord) error) error {
+	cpId, cpOffset, err := q.Checkpoint()
+	if err != nil {
+		return fmt.Errorf("can't read checkpoint: %s", err)
+	}
+	sRunner, err := newQueueSplitterRunner()
+	if err != nil {
+		return err
+	}
+	ids, err := q.engine.Segments()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if !all && id < cpId {
+			continue
+		}
+		err = q.scanFile(sRunner, id, func(rec *BufferQueueRecord) error {
+			rec.Delivered = id < cpId || (id == cpId && rec.Offset < cpOffset)
+			if rec.Delivered && !all {
+				return nil
+			}
+			return fn(rec)
+		})
+		if err == ErrStopScan {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (q *BufferQueue) scanFile(sRunner SplitterRunner, id uint,
+	fn func(rec *BufferQueueRecord) error) error {
+
+	stream, err := q.engine.ReadSegment(id, 0)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	// Drop anything left over from the previous file.
+	sRunner.GetRemainingData()
+	var offset int64
+	for {
+		n, record, err := sRunner.GetRecordFromStream(stream)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("can't read queue file %d: %s", id, err)
+		}
+		start := offset + int64(n-len(record))
+		offset += int64(n)
+		if len(record) == 0 {
+			continue
+		}
+		msg := new(message.Message)
+		headerLen := int(record[1]) + message.HEADER_FRAMING_SIZE
+		if headerLen > len(record) || message.UnmarshalMessage(record[headerLen:], msg) != nil {
+			continue
+		}
+		rec := &BufferQueueRecord{
+			Id:      id,
+			Offset:  start,
+			End:     offset,
+			Record:  record,
+			Message: msg,
+		}
+		if err = fn(rec); err != nil {
+			return err
+		}
+	}
+}
+
+// Writes the messages to a new queue file after all of the existing ones
+// and the checkpoint, returning its id.
+func (q *BufferQueue) Append(msgs []*message.Message) (id uint, err error) {
+	ids, err := q.engine.Segments()
+	if err != nil {
+		return 0, err
+	}
+	if len(ids) > 0 {
+		id = ids[len(ids)-1] + 1
+	}
+	checkpoint, err := q.engine.Checkpoint()
+	if err != nil {
+		return 0, fmt.Errorf("can't read checkpoint: %s", err)
+	}
+	if checkpoint != "" {
+		cpId, _, err := parseQueueCursor([]byte(checkpoint))
+		if err != nil {
+			return 0, fmt.Errorf("can't read checkpoint: %s", err)
+		}
+		if cpId >= id {
+			id = cpId + 1
+		}
+	}
+	var outBytes, data []byte
+	for _, msg := range msgs {
+		msgBytes, err := proto.Marshal(msg)
+		if err != nil {
+			return 0, fmt.Errorf("can't encode message: %s", err)
+		}
+		if err = framing.Frame(msgBytes, &outBytes, nil, true); err != nil {
+			return 0, fmt.Errorf("message framing error: %s", err)
+		}
+		data = append(data, outBytes...)
+	}
+	segment, err := q.engine.OpenSegment(id)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = segment.Append(data); err != nil {
+		segment.Close()
+		return 0, err
+	}
+	return id, segment.Close()
+}
+
+func newQueueSplitterRunner() (SplitterRunner, error) {
+	splitter := &HekaFramingSplitter{}
+	if err := splitter.Init(splitter.ConfigStruct()); err != nil {
+		return nil, fmt.Errorf("can't initialize HekaFramingSplitter: %s", err)
+	}
+	return NewSplitterRunner("HekaFramingSplitter", splitter, CommonSplitterConfig{}), nil
+}
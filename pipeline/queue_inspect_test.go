@@ -0,0 +1,126 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/mozilla-services/heka/message"
+	ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func BufferQueueSpec(c gs.Context) {
+	tmpDir, tmpErr := ioutil.TempDir("", "bufferqueue-tests")
+	c.Assume(tmpErr, gs.IsNil)
+	defer func() {
+		tmpErr = os.RemoveAll(tmpDir)
+		c.Expect(tmpErr, gs.IsNil)
+	}()
+
+	queue, err := OpenBufferQueue(tmpDir)
+	c.Assume(err, gs.IsNil)
+
+	makeMsgs := func(payloads ...string) []*message.Message {
+		msgs := make([]*message.Message, len(payloads))
+		for i, payload := range payloads {
+			msgs[i] = ts.GetTestMessage()
+			msgs[i].SetPayload(payload)
+		}
+		return msgs
+	}
+
+	scan := func(all bool) (recs []BufferQueueRecord) {
+		err := queue.Scan(all, func(rec *BufferQueueRecord) error {
+			recs = append(recs, *rec)
+			return nil
+		})
+		c.Expect(err, gs.IsNil)
+		return recs
+	}
+
+	c.Specify("rejects a missing directory", func() {
+		_, err := OpenBufferQueue(tmpDir + "/missing")
+		c.Expect(err, gs.Not(gs.IsNil))
+	})
+
+	c.Specify("appends new queue files", func() {
+		id, err := queue.Append(makeMsgs("a", "b"))
+		c.Expect(err, gs.IsNil)
+		c.Expect(id, gs.Equals, uint(0))
+		id, err = queue.Append(makeMsgs("c"))
+		c.Expect(err, gs.IsNil)
+		c.Expect(id, gs.Equals, uint(1))
+
+		files, err := queue.Files()
+		c.Expect(err, gs.IsNil)
+		c.Expect(len(files), gs.Equals, 2)
+		c.Expect(files[1].Id, gs.Equals, uint(1))
+
+		recs := scan(false)
+		c.Expect(len(recs), gs.Equals, 3)
+		c.Expect(recs[0].Message.GetPayload(), gs.Equals, "a")
+		c.Expect(recs[1].Offset, gs.Equals, recs[0].End)
+		c.Expect(recs[1].End, gs.Equals, files[0].Size)
+		c.Expect(recs[2].Id, gs.Equals, uint(1))
+		c.Expect(recs[2].Offset, gs.Equals, int64(0))
+
+		c.Specify("and scans from the checkpoint", func() {
+			err = queue.SetCheckpoint(0, recs[0].End)
+			c.Expect(err, gs.IsNil)
+			id, offset, err := queue.Checkpoint()
+			c.Expect(err, gs.IsNil)
+			c.Expect(id, gs.Equals, uint(0))
+			c.Expect(offset, gs.Equals, recs[0].End)
+
+			unread := scan(false)
+			c.Expect(len(unread), gs.Equals, 2)
+			c.Expect(unread[0].Message.GetPayload(), gs.Equals, "b")
+
+			all := scan(true)
+			c.Expect(len(all), gs.Equals, 3)
+			c.Expect(all[0].Delivered, gs.IsTrue)
+			c.Expect(all[1].Delivered, gs.IsFalse)
+		})
+
+		c.Specify("and removes the files before the checkpoint", func() {
+			err = queue.SetCheckpoint(1, 0)
+			c.Expect(err, gs.IsNil)
+			files, err := queue.Files()
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(files), gs.Equals, 1)
+			c.Expect(files[0].Id, gs.Equals, uint(1))
+		})
+
+		c.Specify("after the checkpoint", func() {
+			err = queue.SetCheckpoint(5, 0)
+			c.Expect(err, gs.IsNil)
+			id, err = queue.Append(makeMsgs("d"))
+			c.Expect(err, gs.IsNil)
+			c.Expect(id, gs.Equals, uint(6))
+		})
+
+		c.Specify("and stops scanning", func() {
+			var count int
+			err = queue.Scan(false, func(rec *BufferQueueRecord) error {
+				count++
+				return ErrStopScan
+			})
+			c.Expect(err, gs.IsNil)
+			c.Expect(count, gs.Equals, 1)
+		})
+	})
+}
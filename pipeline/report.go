@@ -66,9 +66,24 @@ func PopulateReportMsg(pr PluginRunner, msg *message.Message) (err error) {
 		}
 		fRunner.MatchRunner().reportLock.Unlock()
 		message.NewInt64Field(msg, "MatchAvgDuration", tmp, "ns")
+		fRunner.MatchRunner().reportMsg(msg)
+		if foRunner, ok := fRunner.(*foRunner); ok && foRunner.packPool != nil {
+			foRunner.packPool.reportMsg(msg)
+		}
+		if foRunner, ok := fRunner.(*foRunner); ok && foRunner.latency != nil {
+			foRunner.latency.reportMsg(msg)
+		}
+		if foRunner, ok := fRunner.(*foRunner); ok && foRunner.bufReader != nil {
+			message.NewInt64Field(msg, "BufferSize",
+				int64(foRunner.bufReader.queueSize.Get()), "B")
+			message.NewInt64Field(msg, "MaxBufferSize",
+				int64(foRunner.bufReader.config.MaxBufferSize), "B")
+		}
 	} else if dRunner, ok := pr.(DecoderRunner); ok {
 		message.NewIntField(msg, "InChanCapacity", cap(dRunner.InChan()), "count")
 		message.NewIntField(msg, "InChanLength", len(dRunner.InChan()), "count")
+	} else if iRunner, ok := pr.(*iRunner); ok && iRunner.fieldLimits != nil {
+		iRunner.fieldLimits.reportMsg(msg)
 	}
 	msg.SetType("heka.plugin-report")
 	return
@@ -88,6 +103,7 @@ func (pc *PipelineConfig) reports(reportChan chan *PipelinePack) {
 	msg = pack.Message
 	message.NewIntField(msg, "InChanCapacity", cap(pc.inputRecycleChan), "count")
 	message.NewIntField(msg, "InChanLength", len(pc.inputRecycleChan), "count")
+	pc.inputPool.reportMsg(msg)
 	msg.SetLogger(HEKA_DAEMON)
 	msg.SetType("heka.input-report")
 	message.NewStringField(msg, "name", "inputRecycleChan")
@@ -98,6 +114,7 @@ func (pc *PipelineConfig) reports(reportChan chan *PipelinePack) {
 	msg = pack.Message
 	message.NewIntField(msg, "InChanCapacity", cap(pc.injectRecycleChan), "count")
 	message.NewIntField(msg, "InChanLength", len(pc.injectRecycleChan), "count")
+	pc.injectPool.reportMsg(msg)
 	msg.SetLogger(HEKA_DAEMON)
 	msg.SetType("heka.inject-report")
 	message.NewStringField(msg, "name", "injectRecycleChan")
@@ -110,12 +127,36 @@ func (pc *PipelineConfig) reports(reportChan chan *PipelinePack) {
 	message.NewIntField(msg, "InChanLength", len(pc.router.InChan()), "count")
 	message.NewInt64Field(msg, "ProcessMessageCount",
 		atomic.LoadInt64(&pc.router.processMessageCount), "count")
+	message.NewInt64Field(msg, "LoopDropCount",
+		atomic.LoadInt64(&pc.router.loopDropCount), "count")
+	pc.tracer.reportMsg(msg)
+	pc.rules.reportMsg(msg)
 	msg.SetLogger(HEKA_DAEMON)
 	msg.SetType("heka.router-report")
 	message.NewStringField(msg, "name", "Router")
 	message.NewStringField(msg, "key", "globals")
 	reportChan <- pack
 
+	if pc.router.memMonitor != nil {
+		pack = <-pc.reportRecycleChan
+		msg = pack.Message
+		pc.router.memMonitor.reportMsg(msg)
+		msg.SetLogger(HEKA_DAEMON)
+		msg.SetType("heka.memory-report")
+		message.NewStringField(msg, "name", "MemoryMonitor")
+		message.NewStringField(msg, "key", "globals")
+		reportChan <- pack
+	}
+
+	pack = <-pc.reportRecycleChan
+	msg = pack.Message
+	pc.bufferQuota.reportMsg(msg)
+	msg.SetLogger(HEKA_DAEMON)
+	msg.SetType("heka.buffer-report")
+	message.NewStringField(msg, "name", "Buffers")
+	message.NewStringField(msg, "key", "globals")
+	reportChan <- pack
+
 	getReport := func(runner PluginRunner) (pack *PipelinePack) {
 		pack = <-pc.reportRecycleChan
 		if err = PopulateReportMsg(runner, pack.Message); err != nil {
@@ -218,10 +259,9 @@ func (pc *PipelineConfig) reports(reportChan chan *PipelinePack) {
 type pluginReportDataMap map[string]interface{}
 type fullReportDataMap map[string][]pluginReportDataMap
 
-// Generates a single message with a payload that is a string representation
-// of the fields data and payload extracted from each running plugin's report
-// message and hands the message to the router for delivery.
-func (pc *PipelineConfig) allReportsData() (report_type, msg_payload string) {
+// Collects the fields data extracted from each running plugin's report
+// message, by report key.
+func (pc *PipelineConfig) reportData() fullReportDataMap {
 	var (
 		iName, iKey interface{}
 		key, name   string
@@ -261,9 +301,16 @@ func (pc *PipelineConfig) allReportsData() (report_type, msg_payload string) {
 		data[key] = append(data[key], pData)
 		pack.recycle()
 	}
+	return data
+}
+
+// Generates a single message with a payload that is a string representation
+// of the fields data and payload extracted from each running plugin's report
+// message and hands the message to the router for delivery.
+func (pc *PipelineConfig) allReportsData() (report_type, msg_payload string) {
 	buffer := new(bytes.Buffer)
 	enc := json.NewEncoder(buffer)
-	enc.Encode(data)
+	enc.Encode(pc.reportData())
 
 	return "heka.all-report", buffer.String()
 }
@@ -15,6 +15,8 @@
 package pipeline
 
 import (
+	"time"
+
 	"github.com/mozilla-services/heka/message"
 	ts "github.com/mozilla-services/heka/pipeline/testsupport"
 	"github.com/rafrombrc/gomock/gomock"
@@ -113,6 +115,71 @@ func ReportSpec(c gs.Context) {
 			})
 		})
 
+		c.Specify("w/ an output's delivery latency", func() {
+			fRunner.latency, err = newLatencyHistogram([]uint{10, 1000})
+			c.Assume(err, gs.IsNil)
+			defer func() { fRunner.latency = nil }()
+			now := time.Now()
+			for _, age := range []time.Duration{time.Millisecond, 500 * time.Millisecond,
+				time.Minute} {
+
+				m := ts.GetTestMessage()
+				m.SetTimestamp(now.Add(-age).UnixNano())
+				fRunner.latency.observe(m)
+			}
+			err := PopulateReportMsg(fRunner, msg)
+			c.Assume(err, gs.IsNil)
+
+			expected := map[string]int64{
+				"DeliveryLatency_le_10":   1,
+				"DeliveryLatency_le_1000": 2,
+				"DeliveryLatencyCount":    3,
+			}
+			for name, count := range expected {
+				val, ok := msg.GetFieldValue(name)
+				c.Expect(ok, gs.IsTrue)
+				c.Expect(val, gs.Equals, count)
+			}
+			sum, ok := msg.GetFieldValue("DeliveryLatencySum")
+			c.Expect(ok, gs.IsTrue)
+			c.Expect(sum.(float64) >= 60501, gs.IsTrue)
+		})
+
+		c.Specify("rejects unordered latency buckets", func() {
+			_, err := newLatencyHistogram([]uint{100, 10})
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("w/ matcher evaluation counts", func() {
+			matchChan := make(chan *PipelinePack, 1)
+			mr, err := NewMatchRunner("Type == 'hit'", "", fRunner, chanSize, matchChan)
+			c.Assume(err, gs.IsNil)
+			mr.globals = NewPipelineConfig(nil).Globals
+			mr.globals.ProfileMatchers = true
+			for _, typ := range []string{"hit", "miss", "miss"} {
+				pack := NewPipelinePack(make(chan *PipelinePack, 1))
+				pack.Message.SetType(typ)
+				mr.inChan <- pack
+			}
+			close(mr.inChan)
+			mr.run(1)
+			mr.reportMsg(msg)
+
+			expected := map[string]int64{
+				"MatchEvalCount": 3,
+				"MatchHitCount":  1,
+				"MatchMissCount": 2,
+			}
+			for name, count := range expected {
+				val, ok := msg.GetFieldValue(name)
+				c.Expect(ok, gs.IsTrue)
+				c.Expect(val, gs.Equals, count)
+			}
+			duration, ok := msg.GetFieldValue("MatchTotalDuration")
+			c.Expect(ok, gs.IsTrue)
+			c.Expect(duration.(int64) > 0, gs.IsTrue)
+		})
+
 		c.Specify("w/ an input", func() {
 			err := PopulateReportMsg(iRunner, msg)
 			c.Assume(err, gs.IsNil)
@@ -58,6 +58,7 @@ type RetryHelper struct {
 	maxJitter time.Duration
 	retries   int
 	times     int
+	clock     Clock
 }
 
 // Creates and returns a RetryHelper pointer to be used when retrying
@@ -91,6 +92,7 @@ func NewRetryHelper(opts RetryOptions) (helper *RetryHelper, err error) {
 		retries:   opts.MaxRetries,
 		maxJitter: maxJitter,
 		times:     0,
+		clock:     RealClock,
 	}
 	return
 }
@@ -104,11 +106,7 @@ func (r *RetryHelper) Wait() error {
 	}
 	jitter, _ := rand.Int(rand.Reader, big.NewInt(r.maxJitter.Nanoseconds()))
 	jitterWait := time.Duration(jitter.Int64()) * time.Nanosecond
-	timer := time.NewTimer(r.curDelay + jitterWait)
-	select {
-	case <-timer.C:
-		break
-	}
+	r.clock.Sleep(r.curDelay + jitterWait)
 	r.curDelay *= 2
 	r.times += 1
 	if r.curDelay > r.maxDelay {
@@ -117,6 +115,11 @@ func (r *RetryHelper) Wait() error {
 	return nil
 }
 
+// Sets the Clock the retries wait on, the RealClock by default.
+func (r *RetryHelper) SetClock(clock Clock) {
+	r.clock = clock
+}
+
 // Reset the retry counter
 func (r *RetryHelper) Reset() {
 	r.times = 0
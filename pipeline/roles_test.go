@@ -0,0 +1,98 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+var rolesTestConfig = `
+[EdgeFilter]
+type = "CounterFilter"
+message_matcher = "TRUE"
+roles = ["edge"]
+
+[AggregatorFilter]
+type = "CounterFilter"
+message_matcher = "TRUE"
+roles = ["aggregator", "standalone"]
+
+[CommonFilter]
+type = "CounterFilter"
+message_matcher = "TRUE"
+
+[heka_chains]
+aggregate = ["CommonFilter", "AggregatorFilter"]
+`
+
+func RolesSpec(c gs.Context) {
+	tmpDir, err := ioutil.TempDir("", "roles-tests")
+	c.Assume(err, gs.IsNil)
+	defer os.RemoveAll(tmpDir)
+	configPath := filepath.Join(tmpDir, "config.toml")
+	err = ioutil.WriteFile(configPath, []byte(rolesTestConfig), 0644)
+	c.Assume(err, gs.IsNil)
+
+	load := func(roles ...string) (*PipelineConfig, map[string]bool) {
+		globals := DefaultGlobals()
+		globals.Roles = roles
+		pConfig := NewPipelineConfig(globals)
+		err := pConfig.PreloadFromConfigFile(configPath)
+		c.Assume(err, gs.IsNil)
+		c.Assume(pConfig.errcnt, gs.Equals, uint(0))
+		names := make(map[string]bool)
+		for _, maker := range pConfig.makersByCategory["Filter"] {
+			names[maker.Name()] = true
+		}
+		return pConfig, names
+	}
+
+	c.Specify("Plugin roles", func() {
+		c.Specify("load the sections w/ a matching role", func() {
+			pConfig, names := load("aggregator")
+			c.Expect(len(names), gs.Equals, 2)
+			c.Expect(names["AggregatorFilter"], gs.IsTrue)
+			c.Expect(names["CommonFilter"], gs.IsTrue)
+			err := pConfig.chains.validate(pConfig.makersByCategory)
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(pConfig.chains.chains), gs.Equals, 1)
+		})
+
+		c.Specify("load the sections of any of several roles", func() {
+			_, names := load("edge", "standalone")
+			c.Expect(len(names), gs.Equals, 3)
+		})
+
+		c.Specify("drop the chains of skipped sections", func() {
+			pConfig, names := load("edge")
+			c.Expect(len(names), gs.Equals, 2)
+			c.Expect(names["EdgeFilter"], gs.IsTrue)
+			err := pConfig.chains.validate(pConfig.makersByCategory)
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(pConfig.chains.chains), gs.Equals, 0)
+			c.Expect(len(pConfig.chains.successors), gs.Equals, 0)
+		})
+
+		c.Specify("only load the sections w/o roles when there's no role", func() {
+			_, names := load()
+			c.Expect(len(names), gs.Equals, 1)
+			c.Expect(names["CommonFilter"], gs.IsTrue)
+		})
+	})
+}
@@ -68,6 +68,19 @@ type messageRouter struct {
 	fMatcherMap map[string]*MatchRunner
 	oMatcherMap map[string]*MatchRunner
 	abortChan   chan struct{}
+	// Set when a memory watermark is configured, used to decide whether
+	// messages should be dropped to shed load.
+	memMonitor *memoryMonitor
+	// Number of injections a message may go through, 0 for no limit.
+	maxHops uint
+	// Number of injected messages dropped for exceeding maxHops.
+	loopDropCount int64
+	// Whether the expressions shared by the matchers are evaluated once per
+	// message, and the set of them found when the router started.
+	sharePredicates bool
+	predicates      *message.PredicateSet
+	// Rules applied to every message before it's matched.
+	rules *routerRules
 }
 
 // Creates and returns a (not yet started) Heka message router.
@@ -107,6 +120,37 @@ func (self *messageRouter) Inject(pack *PipelinePack) error {
 	}
 }
 
+// Name of the field counting the filter injections a message went through,
+// including those of the messages it was derived from when their fields were
+// copied over.
+const HOPS_FIELD = "heka_hops"
+
+// countHop records one more injection hop for a pack about to be injected by
+// the named filter, in both the pack's MsgLoopCount and the message's
+// HOPS_FIELD. Returns an error, and the pack shouldn't be injected, if the
+// message went through more than the allowed number of hops, meaning some
+// filters keep matching each other's (or their own) injected messages.
+func (self *messageRouter) countHop(pack *PipelinePack, filter string) error {
+	hops := int64(pack.MsgLoopCount)
+	for _, field := range pack.Message.FindAllFields(HOPS_FIELD) {
+		if prev, ok := field.GetValue().(int64); ok && prev >= hops {
+			hops = prev + 1
+		}
+		pack.Message.DeleteField(field)
+	}
+	if hops < 1 {
+		hops = 1
+	}
+	if self.maxHops > 0 && hops > int64(self.maxHops) {
+		atomic.AddInt64(&self.loopDropCount, 1)
+		return fmt.Errorf("injection loop detected: message from '%s' exceeded "+
+			"max_hops = %d, dropping it", filter, self.maxHops)
+	}
+	message.NewInt64Field(pack.Message, HOPS_FIELD, hops, "count")
+	pack.MsgLoopCount = uint(hops)
+	return nil
+}
+
 // initMatchSlices creates the `fMatchers` and `oMatchers` MatchRunner slices
 // and populates them with the matchers that are in the respective matcher
 // maps. Should be called exactly once after all of the config has been loaded
@@ -120,6 +164,19 @@ func (self *messageRouter) initMatchSlices() {
 	for _, matcher := range self.oMatcherMap {
 		self.oMatchers = append(self.oMatchers, matcher)
 	}
+	if self.sharePredicates {
+		specs := make([]*message.MatcherSpecification, 0,
+			len(self.fMatchers)+len(self.oMatchers))
+		for _, matchers := range [][]*MatchRunner{self.fMatchers, self.oMatchers} {
+			for _, matcher := range matchers {
+				specs = append(specs, matcher.spec)
+			}
+		}
+		self.predicates = message.NewPredicateSet(specs)
+		if self.predicates.Len() == 0 {
+			self.predicates = nil
+		}
+	}
 }
 
 // Spawns a goroutine within which the router listens for messages on the
@@ -180,7 +237,25 @@ func (self *messageRouter) Start() {
 					break
 				}
 				pack.diagnostics.Reset()
+				if pack.trace != nil {
+					pack.trace.stamp("router")
+				}
 				atomic.AddInt64(&self.processMessageCount, 1)
+				if self.memMonitor != nil && self.memMonitor.shouldDrop(pack) {
+					pack.recycle()
+					continue
+				}
+				if self.rules != nil && !self.rules.apply(pack) {
+					pack.recycle()
+					continue
+				}
+				if pack.routeTo != nil {
+					self.routeDirect(pack)
+					continue
+				}
+				if self.predicates != nil {
+					pack.predicates.Reset(self.predicates)
+				}
 				for _, matcher = range self.fMatchers {
 					if matcher != nil {
 						atomic.AddInt32(&pack.RefCount, 1)
@@ -209,10 +284,44 @@ func (self *messageRouter) Start() {
 	LogInfo.Println("MessageRouter started.")
 }
 
+// routeDirect hands the pack to the matchers of the plugins named in the
+// pack's routeTo list, skipping every other registered matcher.
+func (self *messageRouter) routeDirect(pack *PipelinePack) {
+	for _, matcher := range self.fMatchers {
+		if matcher != nil && isRouteTarget(pack, matcher) {
+			atomic.AddInt32(&pack.RefCount, 1)
+			matcher.inChan <- pack
+		}
+	}
+	for _, matcher := range self.oMatchers {
+		if matcher != nil && isRouteTarget(pack, matcher) {
+			atomic.AddInt32(&pack.RefCount, 1)
+			matcher.inChan <- pack
+		}
+	}
+	pack.recycle()
+}
+
+func isRouteTarget(pack *PipelinePack, matcher *MatchRunner) bool {
+	name := matcher.pluginRunner.Name()
+	for _, target := range pack.routeTo {
+		if target == name {
+			return true
+		}
+	}
+	return false
+}
+
 // Encapsulates the mechanics of testing messages against a specific plugin's
 // message_matcher value.
 type MatchRunner struct {
+	// 64-bit values accessed atomically come first to guarantee alignment.
+	evalCount int64
+	hitCount  int64
+	// Cumulative evaluation time, only tracked if matcher profiling is on.
+	evalDuration  int64
 	closing       int32
+	negCache      *negativeCache
 	matchSamples  int64
 	matchDuration int64
 	spec          *message.MatcherSpecification
@@ -225,6 +334,9 @@ type MatchRunner struct {
 	bufFeeder     *BufferFeeder
 	globals       *GlobalConfigStruct
 	retry         *RetryHelper
+	// Set for old-style outputs w/o buffering, which don't tell us when
+	// they're done w/ a pack, so delivery latency is recorded on hand off.
+	latency *latencyHistogram
 }
 
 // Creates and returns a new MatchRunner if possible, or a relevant error if
@@ -304,6 +416,7 @@ func (mr *MatchRunner) run(sampleDenom int) {
 	)
 
 	var capacity int64 = int64(cap(mr.inChan))
+	profile := mr.globals != nil && mr.globals.ProfileMatchers
 	for pack := range mr.inChan {
 		if len(mr.signer) != 0 && mr.signer != pack.Signer {
 			pack.recycle()
@@ -313,28 +426,46 @@ func (mr *MatchRunner) run(sampleDenom int) {
 		// In most cases the random sampling will capture the most common
 		// condition which is usesful for the overall system health but not
 		// matcher tuning.  Capturing the duration adds ~40ns
-		if counter == random {
+		if pack.routeTo != nil {
+			// Explicitly routed to us, no need to evaluate the matcher.
+			match = true
+		} else if mr.negCache != nil && mr.negCache.known(pack.Message) {
+			match = false
+			mr.countEval(false)
+		} else if counter == random || profile {
 			startTime = time.Now()
 
-			match = mr.spec.Match(pack.Message)
+			match = mr.spec.MatchShared(pack.Message, &pack.predicates, &pack.fieldIndex)
 
 			duration = time.Since(startTime).Nanoseconds()
-			mr.reportLock.Lock()
-			mr.matchDuration += duration
-			mr.matchSamples++
-			mr.reportLock.Unlock()
-			if mr.matchSamples > capacity {
-				// the timings can vary greatly, so we need to establish a
-				// decent baseline before we start sampling
-				counter = 0
+			if profile {
+				atomic.AddInt64(&mr.evalDuration, duration)
 			}
+			if counter == random {
+				mr.reportLock.Lock()
+				mr.matchDuration += duration
+				mr.matchSamples++
+				mr.reportLock.Unlock()
+				if mr.matchSamples > capacity {
+					// the timings can vary greatly, so we need to establish a
+					// decent baseline before we start sampling
+					counter = 0
+				}
+			} else {
+				counter++
+			}
+			mr.evaluated(pack, match)
 		} else {
-			match = mr.spec.Match(pack.Message)
+			match = mr.spec.MatchShared(pack.Message, &pack.predicates, &pack.fieldIndex)
 			counter++
+			mr.evaluated(pack, match)
 		}
 
 		if match {
 			pack.diagnostics.AddStamp(mr.pluginRunner)
+			if pack.trace != nil {
+				pack.trace.stamp(mr.pluginRunner.Name())
+			}
 			err := mr.deliver(pack)
 			if err != nil {
 				mr.pluginRunner.LogError(fmt.Errorf("can't deliver matched message: %s",
@@ -352,6 +483,39 @@ func (mr *MatchRunner) run(sampleDenom int) {
 	}
 }
 
+// Records the outcome of an evaluation of the matcher.
+func (mr *MatchRunner) evaluated(pack *PipelinePack, match bool) {
+	mr.countEval(match)
+	if !match && mr.negCache != nil {
+		mr.negCache.add(pack.Message)
+	}
+}
+
+func (mr *MatchRunner) countEval(match bool) {
+	atomic.AddInt64(&mr.evalCount, 1)
+	if match {
+		atomic.AddInt64(&mr.hitCount, 1)
+	}
+}
+
+// Populates the provided message w/ the runner's evaluation counts, and the
+// total time spent evaluating its matcher if matcher profiling is on.
+func (mr *MatchRunner) reportMsg(msg *message.Message) {
+	evals := atomic.LoadInt64(&mr.evalCount)
+	hits := atomic.LoadInt64(&mr.hitCount)
+	message.NewInt64Field(msg, "MatchEvalCount", evals, "count")
+	message.NewInt64Field(msg, "MatchHitCount", hits, "count")
+	message.NewInt64Field(msg, "MatchMissCount", evals-hits, "count")
+	if mr.negCache != nil {
+		message.NewInt64Field(msg, "MatchNegativeCacheHits",
+			atomic.LoadInt64(&mr.negCache.hitCount), "count")
+	}
+	if mr.globals != nil && mr.globals.ProfileMatchers {
+		message.NewInt64Field(msg, "MatchTotalDuration",
+			atomic.LoadInt64(&mr.evalDuration), "ns")
+	}
+}
+
 // Starts the runner listening for messages on its input channel. Any message
 // that is a match will be placed on the provided matchChan, or written out to
 // the disk queue if buffering is in play. Any messages that are not a match
@@ -379,6 +543,20 @@ func (mr *MatchRunner) deliver(pack *PipelinePack) error {
 					mr.retry.Wait()
 				}
 				mr.retry.Reset()
+			case "drop_oldest":
+				// Makes room by deleting the oldest queue files, dropping the
+				// record only once there are none left to delete.
+				for err == QueueIsFull {
+					dropped, e := mr.bufFeeder.DropOldest()
+					if e != nil {
+						err = e
+						break
+					}
+					if !dropped {
+						break
+					}
+					err = mr.bufFeeder.QueueRecord(pack)
+				}
 			case "drop":
 			}
 		}
@@ -386,6 +564,9 @@ func (mr *MatchRunner) deliver(pack *PipelinePack) error {
 		return err
 	}
 	if mr.matchChan != nil {
+		if mr.latency != nil {
+			mr.latency.observe(pack.Message)
+		}
 		mr.matchChan <- pack
 		return nil
 	}
@@ -0,0 +1,223 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync/atomic"
+
+	"github.com/bbangert/toml"
+	"github.com/gogo/protobuf/proto"
+	"github.com/mozilla-services/heka/message"
+)
+
+// Name of the config section declaring router rules.
+const HEKA_RULES = "heka_rules"
+
+// A rule declared in a `[[heka_rules]]` section.
+type RouterRuleConfig struct {
+	// Identifies the rule in the router's report.
+	Name    string
+	Matcher string `toml:"message_matcher"`
+	// Drop the matching messages.
+	Drop bool
+	// Keep this fraction of the matching messages, dropping the others.
+	SampleRate float64 `toml:"sample_rate"`
+	// Rename fields, from old name to new name.
+	RenameFields map[string]string `toml:"rename_fields"`
+	// Set fields, replacing any existing field of the same name.
+	SetFields map[string]interface{} `toml:"set_fields"`
+	// Deliver the matching messages only to the named filters and outputs,
+	// skipping every other matcher.
+	RouteTo []string `toml:"route_to"`
+}
+
+// A rule's compiled config and counters.
+type routerRule struct {
+	// 64-bit values accessed atomically come first to guarantee alignment.
+	matchCount   int64
+	droppedCount int64
+	name         string
+	spec         *message.MatcherSpecification
+	drop         bool
+	sampleRate   float64
+	renames      map[string]string
+	// Names of the fields to set, in order, and their values.
+	setNames  []string
+	setValues map[string]interface{}
+	routeTo   []string
+}
+
+// Rules applied in order by the router to every message before it's matched,
+// performing simple transforms natively rather than in a sandbox filter.
+type routerRules struct {
+	rules []*routerRule
+	// Plugins left out of the config by their `roles`.
+	disabled map[string]bool
+}
+
+func newRouterRules() *routerRules {
+	return &routerRules{disabled: make(map[string]bool)}
+}
+
+// Adds the rules declared in a `[[heka_rules]]` section.
+func (rr *routerRules) addSection(section toml.Primitive) error {
+	var configs []RouterRuleConfig
+	if err := toml.PrimitiveDecode(section, &configs); err != nil {
+		return fmt.Errorf("can't decode %s: %s", HEKA_RULES, err)
+	}
+	for _, config := range configs {
+		rule, err := newRouterRule(config)
+		if err != nil {
+			return err
+		}
+		for _, r := range rr.rules {
+			if r.name == rule.name {
+				return fmt.Errorf("rule '%s' is declared more than once", rule.name)
+			}
+		}
+		rr.rules = append(rr.rules, rule)
+	}
+	return nil
+}
+
+func newRouterRule(config RouterRuleConfig) (*routerRule, error) {
+	if config.Name == "" {
+		return nil, fmt.Errorf("%s rule w/o a name", HEKA_RULES)
+	}
+	if config.Matcher == "" {
+		return nil, fmt.Errorf("rule '%s' has no message_matcher", config.Name)
+	}
+	spec, err := message.CreateMatcherSpecification(config.Matcher)
+	if err != nil {
+		return nil, fmt.Errorf("rule '%s' has an invalid message_matcher: %s",
+			config.Name, err)
+	}
+	if config.SampleRate < 0 || config.SampleRate > 1 {
+		return nil, fmt.Errorf("rule '%s' sample_rate must be between 0 and 1",
+			config.Name)
+	}
+	rule := &routerRule{
+		name:       config.Name,
+		spec:       spec,
+		drop:       config.Drop,
+		sampleRate: config.SampleRate,
+		renames:    config.RenameFields,
+		setValues:  config.SetFields,
+		routeTo:    config.RouteTo,
+	}
+	for name, value := range config.SetFields {
+		switch value.(type) {
+		case string, int64, float64, bool:
+		default:
+			return nil, fmt.Errorf("rule '%s' can't set field '%s' to a %T",
+				config.Name, name, value)
+		}
+		rule.setNames = append(rule.setNames, name)
+	}
+	sort.Strings(rule.setNames)
+	return rule, nil
+}
+
+// Marks a plugin as left out of the config by its `roles`, so it's dropped
+// from the rules routing to it rather than failing validation.
+func (rr *routerRules) disable(name string) {
+	rr.disabled[name] = true
+}
+
+// Checks that the rules only route to configured filters and outputs.
+func (rr *routerRules) validate(makersByCategory map[string][]PluginMaker) error {
+	known := make(map[string]bool)
+	for _, category := range []string{"Filter", "Output"} {
+		for _, maker := range makersByCategory[category] {
+			known[maker.Name()] = true
+		}
+	}
+	for _, rule := range rr.rules {
+		if len(rule.routeTo) == 0 {
+			continue
+		}
+		routeTo := make([]string, 0, len(rule.routeTo))
+		for _, target := range rule.routeTo {
+			if rr.disabled[target] {
+				LogInfo.Printf("Rule '%s' skips route_to '%s', it isn't in this "+
+					"hekad's roles\n", rule.name, target)
+				continue
+			}
+			if !known[target] {
+				return fmt.Errorf("rule '%s' routes to unknown filter or output '%s'",
+					rule.name, target)
+			}
+			routeTo = append(routeTo, target)
+		}
+		rule.routeTo = routeTo
+	}
+	return nil
+}
+
+// Applies the rules matching the pack's message, in order. Returns false if a
+// rule dropped the message, in which case the caller recycles the pack.
+func (rr *routerRules) apply(pack *PipelinePack) bool {
+	for _, rule := range rr.rules {
+		if !rule.spec.Match(pack.Message) {
+			continue
+		}
+		atomic.AddInt64(&rule.matchCount, 1)
+		if rule.drop || (rule.sampleRate > 0 && rand.Float64() >= rule.sampleRate) {
+			atomic.AddInt64(&rule.droppedCount, 1)
+			return false
+		}
+		if rule.transform(pack.Message) {
+			pack.TrustMsgBytes = false
+		}
+		if len(rule.routeTo) > 0 {
+			pack.routeTo = rule.routeTo
+		}
+	}
+	return true
+}
+
+// Renames and sets the rule's fields, returning whether the message changed.
+func (rule *routerRule) transform(msg *message.Message) (changed bool) {
+	for from, to := range rule.renames {
+		for _, field := range msg.FindAllFields(from) {
+			msg.DeleteField(field)
+			field.Name = proto.String(to)
+			msg.AddField(field)
+			changed = true
+		}
+	}
+	for _, name := range rule.setNames {
+		for _, field := range msg.FindAllFields(name) {
+			msg.DeleteField(field)
+		}
+		field, _ := message.NewField(name, rule.setValues[name], "")
+		msg.AddField(field)
+		changed = true
+	}
+	return
+}
+
+// Populates the provided message w/ each rule's match and drop counts.
+func (rr *routerRules) reportMsg(msg *message.Message) {
+	for _, rule := range rr.rules {
+		message.NewInt64Field(msg, fmt.Sprintf("RuleMatchCount-%s", rule.name),
+			atomic.LoadInt64(&rule.matchCount), "count")
+		message.NewInt64Field(msg, fmt.Sprintf("RuleDropCount-%s", rule.name),
+			atomic.LoadInt64(&rule.droppedCount), "count")
+	}
+}
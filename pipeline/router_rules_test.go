@@ -0,0 +1,213 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func RouterRulesSpec(c gs.Context) {
+	RegisterPlugin("StoppingOutput", func() interface{} {
+		return new(StoppingOutput)
+	})
+
+	tmpDir, err := ioutil.TempDir("", "rules-tests")
+	c.Assume(err, gs.IsNil)
+	defer os.RemoveAll(tmpDir)
+
+	loadRules := func(rules string) (*PipelineConfig, error) {
+		configPath := filepath.Join(tmpDir, "config.toml")
+		config := chainsTestPlugins + "\n" + rules
+		err := ioutil.WriteFile(configPath, []byte(config), 0644)
+		c.Assume(err, gs.IsNil)
+		pConfig := NewPipelineConfig(nil)
+		err = pConfig.PreloadFromConfigFile(configPath)
+		c.Assume(err, gs.IsNil)
+		if pConfig.errcnt != 0 {
+			return pConfig, errors.New(pConfig.LogMsgs[0])
+		}
+		return pConfig, pConfig.rules.validate(pConfig.makersByCategory)
+	}
+
+	newPack := func() *PipelinePack {
+		pack := NewPipelinePack(nil)
+		pack.Message = ts.GetTestMessage()
+		pack.TrustMsgBytes = true
+		return pack
+	}
+
+	c.Specify("Router rules", func() {
+		c.Specify("are loaded in order", func() {
+			pConfig, err := loadRules(`
+[[heka_rules]]
+name = "first"
+message_matcher = "TRUE"
+
+[[heka_rules]]
+name = "second"
+message_matcher = "Type == 'TEST'"
+route_to = ["StoppingOutput"]
+`)
+			c.Assume(err, gs.IsNil)
+			rules := pConfig.rules.rules
+			c.Expect(len(rules), gs.Equals, 2)
+			c.Expect(rules[0].name, gs.Equals, "first")
+			c.Expect(rules[1].name, gs.Equals, "second")
+		})
+
+		c.Specify("are validated", func() {
+			_, err := loadRules(`
+[[heka_rules]]
+message_matcher = "TRUE"
+`)
+			c.Expect(err, gs.Not(gs.IsNil))
+
+			_, err = loadRules(`
+[[heka_rules]]
+name = "bad"
+message_matcher = "Type = 'x'"
+`)
+			c.Expect(err, gs.Not(gs.IsNil))
+
+			_, err = loadRules(`
+[[heka_rules]]
+name = "sample"
+message_matcher = "TRUE"
+sample_rate = 1.5
+`)
+			c.Expect(err, gs.Not(gs.IsNil))
+
+			_, err = loadRules(`
+[[heka_rules]]
+name = "set"
+message_matcher = "TRUE"
+
+[heka_rules.set_fields]
+list = ["a", "b"]
+`)
+			c.Expect(err, gs.Not(gs.IsNil))
+
+			_, err = loadRules(`
+[[heka_rules]]
+name = "route"
+message_matcher = "TRUE"
+route_to = ["NoSuchOutput"]
+`)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("transform the matching messages", func() {
+			pConfig, err := loadRules(`
+[[heka_rules]]
+name = "tag"
+message_matcher = "Type == 'TEST'"
+
+[heka_rules.rename_fields]
+foo = "bar"
+
+[heka_rules.set_fields]
+env = "prod"
+number = 42
+`)
+			c.Assume(err, gs.IsNil)
+			pack := newPack()
+			c.Expect(pConfig.rules.apply(pack), gs.IsTrue)
+			msg := pack.Message
+			c.Expect(msg.FindFirstField("foo"), gs.IsNil)
+			value, _ := msg.GetFieldValue("bar")
+			c.Expect(value, gs.Equals, "bar")
+			value, _ = msg.GetFieldValue("env")
+			c.Expect(value, gs.Equals, "prod")
+			c.Expect(len(msg.FindAllFields("number")), gs.Equals, 1)
+			value, _ = msg.GetFieldValue("number")
+			c.Expect(value, gs.Equals, int64(42))
+			c.Expect(pack.TrustMsgBytes, gs.IsFalse)
+			c.Expect(pConfig.rules.rules[0].matchCount, gs.Equals, int64(1))
+
+			c.Specify("leaving the others alone", func() {
+				pack := newPack()
+				pack.Message.SetType("other")
+				c.Expect(pConfig.rules.apply(pack), gs.IsTrue)
+				c.Expect(pack.Message.FindFirstField("env"), gs.IsNil)
+				c.Expect(pack.TrustMsgBytes, gs.IsTrue)
+			})
+		})
+
+		c.Specify("drop messages", func() {
+			pConfig, err := loadRules(`
+[[heka_rules]]
+name = "debug"
+message_matcher = "Severity > 5"
+drop = true
+
+[[heka_rules]]
+name = "never"
+message_matcher = "TRUE"
+
+[heka_rules.set_fields]
+seen = true
+`)
+			c.Assume(err, gs.IsNil)
+			pack := newPack()
+			c.Expect(pConfig.rules.apply(pack), gs.IsFalse)
+			c.Expect(pack.Message.FindFirstField("seen"), gs.IsNil)
+			c.Expect(pConfig.rules.rules[0].droppedCount, gs.Equals, int64(1))
+			c.Expect(pConfig.rules.rules[1].matchCount, gs.Equals, int64(0))
+		})
+
+		c.Specify("sample messages", func() {
+			pConfig, err := loadRules(`
+[[heka_rules]]
+name = "all"
+message_matcher = "TRUE"
+sample_rate = 1.0
+
+[[heka_rules]]
+name = "few"
+message_matcher = "TRUE"
+sample_rate = 0.000001
+`)
+			c.Assume(err, gs.IsNil)
+			kept := 0
+			for i := 0; i < 100; i++ {
+				if pConfig.rules.apply(newPack()) {
+					kept++
+				}
+			}
+			c.Expect(pConfig.rules.rules[0].droppedCount, gs.Equals, int64(0))
+			c.Expect(kept < 100, gs.IsTrue)
+		})
+
+		c.Specify("route messages", func() {
+			pConfig, err := loadRules(`
+[[heka_rules]]
+name = "route"
+message_matcher = "TRUE"
+route_to = ["StoppingOutput"]
+`)
+			c.Assume(err, gs.IsNil)
+			pack := newPack()
+			c.Expect(pConfig.rules.apply(pack), gs.IsTrue)
+			c.Expect(len(pack.routeTo), gs.Equals, 1)
+			c.Expect(pack.routeTo[0], gs.Equals, "StoppingOutput")
+		})
+	})
+}
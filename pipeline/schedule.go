@@ -0,0 +1,229 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A cron style schedule, w/ the standard five fields: minute, hour, day of
+// the month, month and day of the week.
+type Schedule struct {
+	minute, hour, dom, month, dow uint64 // Bit sets of the matching values.
+	// As in cron, if both the day of the month and the day of the week are
+	// restricted, a day matching either of them matches.
+	domStar, dowStar bool
+	loc              *time.Location
+}
+
+var scheduleMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var monthNames = map[string]int{"jan": 1, "feb": 2, "mar": 3, "apr": 4,
+	"may": 5, "jun": 6, "jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11,
+	"dec": 12}
+
+var dayNames = map[string]int{"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4,
+	"fri": 5, "sat": 6}
+
+// ParseSchedule parses a cron expression, e.g. "30 2 * * mon-fri", or one of
+// the @yearly, @monthly, @weekly, @daily and @hourly macros. Times are
+// matched in the provided location, UTC if it's nil.
+func ParseSchedule(expr string, loc *time.Location) (*Schedule, error) {
+	if macro, ok := scheduleMacros[strings.TrimSpace(expr)]; ok {
+		expr = macro
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("schedule '%s' doesn't have 5 fields", expr)
+	}
+	if loc == nil {
+		loc = time.UTC
+	}
+	s := &Schedule{loc: loc}
+	var err error
+	if s.minute, err = parseScheduleField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("invalid minute '%s': %s", fields[0], err)
+	}
+	if s.hour, err = parseScheduleField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("invalid hour '%s': %s", fields[1], err)
+	}
+	if s.dom, err = parseScheduleField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("invalid day of the month '%s': %s", fields[2], err)
+	}
+	if s.month, err = parseScheduleField(fields[3], 1, 12, monthNames); err != nil {
+		return nil, fmt.Errorf("invalid month '%s': %s", fields[3], err)
+	}
+	// Sunday is either 0 or 7.
+	if s.dow, err = parseScheduleField(fields[4], 0, 7, dayNames); err != nil {
+		return nil, fmt.Errorf("invalid day of the week '%s': %s", fields[4], err)
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domStar = strings.HasPrefix(fields[2], "*")
+	s.dowStar = strings.HasPrefix(fields[4], "*")
+	return s, nil
+}
+
+// Parses a comma separated list of values, ranges ("1-5") and steps ("*/15",
+// "1-30/2") into a bit set.
+func parseScheduleField(field string, min, max int, names map[string]int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if slash := strings.IndexByte(part, '/'); slash >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[slash+1:]); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step '%s'", part[slash+1:])
+			}
+			part = part[:slash]
+		}
+		var low, high int
+		if part == "*" {
+			low, high = min, max
+		} else {
+			var err error
+			bounds := strings.SplitN(part, "-", 2)
+			if low, err = parseScheduleValue(bounds[0], min, max, names); err != nil {
+				return 0, err
+			}
+			high = low
+			if len(bounds) == 2 {
+				if high, err = parseScheduleValue(bounds[1], min, max, names); err != nil {
+					return 0, err
+				}
+			} else if step > 1 {
+				// "5/15" means from 5 to the maximum, in steps of 15.
+				high = max
+			}
+			if high < low {
+				return 0, fmt.Errorf("range '%s' is reversed", part)
+			}
+		}
+		for i := low; i <= high; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+	return bits, nil
+}
+
+func parseScheduleValue(value string, min, max int, names map[string]int) (int, error) {
+	if n, ok := names[strings.ToLower(value)]; ok {
+		return n, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value '%s'", value)
+	}
+	if n < min || n > max {
+		return 0, fmt.Errorf("%d is out of range %d-%d", n, min, max)
+	}
+	return n, nil
+}
+
+func (s *Schedule) matchDay(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Next returns the first time matching the schedule that's strictly after t,
+// or the zero time if there is none within the next five years (e.g. for
+// "0 0 30 2 *").
+func (s *Schedule) Next(t time.Time) time.Time {
+	t = t.In(s.loc).Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = advance(t, time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, s.loc))
+			continue
+		}
+		if !s.matchDay(t) {
+			t = advance(t, time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, s.loc))
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = t.Add(time.Duration(60-t.Minute()) * time.Minute)
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// Returns next, unless a DST transition made time.Date pick a time that isn't
+// after t (the local midnight it was asked for doesn't exist), in which case
+// the search carries on from the next hour.
+func advance(t, next time.Time) time.Time {
+	if next.After(t) {
+		return next
+	}
+	return t.Add(time.Duration(60-t.Minute()) * time.Minute)
+}
+
+// Returns a channel that receives the time at each of the schedule's times,
+// delayed by a random duration of up to jitter so many hosts sharing a
+// schedule don't all poll at once. As w/ a time.Ticker, ticks are dropped if
+// the receiver falls behind. The channel stops ticking once stop is closed.
+func scheduleTicker(clock Clock, s *Schedule, jitter time.Duration,
+	stop chan struct{}) <-chan time.Time {
+
+	ticks := make(chan time.Time, 1)
+	go func() {
+		next := clock.Now()
+		for {
+			// Scheduled times are computed from the previous one rather than
+			// from the jittered tick, so jitter doesn't cause skipped ticks.
+			if next = s.Next(next); next.IsZero() {
+				return
+			}
+			at := next
+			if jitter > 0 {
+				at = at.Add(time.Duration(rand.Int63n(int64(jitter))))
+			}
+			timer := clock.NewTimer(at.Sub(clock.Now()))
+			select {
+			case <-stop:
+				timer.Stop()
+				return
+			case t := <-timer.Chan():
+				select {
+				case ticks <- t:
+				default:
+				}
+			}
+		}
+	}()
+	return ticks
+}
@@ -0,0 +1,124 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"time"
+
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func ScheduleSpec(c gs.Context) {
+	// A Saturday.
+	start := time.Date(2016, 3, 12, 23, 59, 30, 0, time.UTC)
+
+	next := func(expr string, n int) []time.Time {
+		s, err := ParseSchedule(expr, nil)
+		c.Assume(err, gs.IsNil)
+		times := make([]time.Time, n)
+		t := start
+		for i := range times {
+			t = s.Next(t)
+			times[i] = t
+		}
+		return times
+	}
+	date := func(month time.Month, day, hour, min int) time.Time {
+		return time.Date(2016, month, day, hour, min, 0, 0, time.UTC)
+	}
+
+	c.Specify("A Schedule", func() {
+		c.Specify("matches fixed times", func() {
+			times := next("30 2 * * *", 2)
+			c.Expect(times[0], gs.Equals, date(3, 13, 2, 30))
+			c.Expect(times[1], gs.Equals, date(3, 14, 2, 30))
+		})
+
+		c.Specify("supports steps, ranges and lists", func() {
+			times := next("5/20 1-2,4 * * *", 7)
+			c.Expect(times[0], gs.Equals, date(3, 13, 1, 5))
+			c.Expect(times[2], gs.Equals, date(3, 13, 1, 45))
+			c.Expect(times[3], gs.Equals, date(3, 13, 2, 5))
+			c.Expect(times[6], gs.Equals, date(3, 13, 4, 5))
+		})
+
+		c.Specify("supports names and macros", func() {
+			times := next("0 9 * * mon-fri", 2)
+			c.Expect(times[0], gs.Equals, date(3, 14, 9, 0))
+			c.Expect(times[1], gs.Equals, date(3, 15, 9, 0))
+			times = next("@monthly", 1)
+			c.Expect(times[0], gs.Equals, date(4, 1, 0, 0))
+			// Sunday is 7 as well as 0.
+			times = next("0 0 * * 7", 1)
+			c.Expect(times[0], gs.Equals, date(3, 13, 0, 0))
+		})
+
+		c.Specify("matches either day field if both are restricted", func() {
+			times := next("0 0 1 * mon", 3)
+			c.Expect(times[0], gs.Equals, date(3, 14, 0, 0))
+			c.Expect(times[2], gs.Equals, date(3, 28, 0, 0))
+			times = next("0 0 1 4 mon", 2)
+			c.Expect(times[0], gs.Equals, date(4, 1, 0, 0))
+			c.Expect(times[1], gs.Equals, date(4, 4, 0, 0))
+		})
+
+		c.Specify("uses its timezone", func() {
+			tz := time.FixedZone("UTC+2", 2*60*60)
+			s, err := ParseSchedule("0 2 * * *", tz)
+			c.Assume(err, gs.IsNil)
+			c.Expect(s.Next(start).Equal(date(3, 13, 0, 0)), gs.IsTrue)
+		})
+
+		c.Specify("returns the zero time if it never matches", func() {
+			s, err := ParseSchedule("0 0 30 2 *", nil)
+			c.Assume(err, gs.IsNil)
+			c.Expect(s.Next(start).IsZero(), gs.IsTrue)
+		})
+
+		c.Specify("rejects invalid expressions", func() {
+			for _, expr := range []string{"* * * *", "60 * * * *", "5-1 * * * *",
+				"*/0 * * * *", "* * * foo *", "@sometimes"} {
+
+				_, err := ParseSchedule(expr, nil)
+				c.Expect(err, gs.Not(gs.IsNil))
+			}
+		})
+	})
+
+	c.Specify("A schedule ticker ticks at the scheduled times", func() {
+		s, err := ParseSchedule("*/15 * * * *", nil)
+		c.Assume(err, gs.IsNil)
+		clock := NewMockClock(start)
+		stop := make(chan struct{})
+		ticks := scheduleTicker(clock, s, 0, stop)
+
+		clock.BlockUntil(1)
+		clock.Add(30 * time.Second)
+		c.Expect(<-ticks, gs.Equals, date(3, 13, 0, 0))
+
+		// Waits for the next time once the tick's been sent.
+		clock.BlockUntil(1)
+		clock.Add(14 * time.Minute)
+		select {
+		case <-ticks:
+			c.Expect("no tick", gs.Equals, "a tick before 00:15")
+		default:
+		}
+		clock.Add(time.Minute)
+		c.Expect(<-ticks, gs.Equals, date(3, 13, 0, 15))
+
+		close(stop)
+	})
+}
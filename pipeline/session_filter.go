@@ -0,0 +1,341 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// Filter that groups the messages it matches into sessions by a message
+// variable, e.g. a user or connection ID, injecting a summary of each session
+// once it's been inactive for the timeout. Open sessions are saved when Heka
+// shuts down and restored when it starts.
+type SessionFilter struct {
+	closedCount  int64
+	evictedCount int64
+	name         string
+	pConfig      *PipelineConfig
+	conf         *SessionFilterConfig
+	key          *hashVariable
+	timeout      int64
+	statePath    string
+	sessions     map[string]*session
+	// Sessions from the least to the most recently active.
+	lru *list.List
+	// Sessions closed since they were last injected.
+	closed []closedSession
+	// Returns the current time, replaced in tests.
+	now func() time.Time
+}
+
+type SessionFilterConfig struct {
+	// Message variable identifying the session a message belongs to, in the
+	// SharderFilter's `hash_variable` format.
+	SessionKey string `toml:"session_key"`
+	// Seconds w/o messages after which a session is closed, defaults to
+	// 1800.
+	Timeout uint `toml:"timeout"`
+	// Maximum number of open sessions, the least recently active one is
+	// closed early when a new one would exceed it. Defaults to 10000.
+	MaxSessions int `toml:"max_sessions"`
+	// Fields whose values in the first and last messages of a session are
+	// added to its summary.
+	Fields []string `toml:"fields"`
+	// Sessions are checked for inactivity every ticker interval, defaults to
+	// 10 seconds.
+	TickerInterval uint `toml:"ticker_interval"`
+	// File the open sessions are saved to, relative to the base dir.
+	// Defaults to "session/<filter name>.json".
+	StatePath string `toml:"state_path"`
+}
+
+type session struct {
+	key string
+	// Timestamps of the first and last messages.
+	start int64
+	last  int64
+	count int64
+	// Fields captured from the first and last messages, already renamed.
+	fields  map[string]*message.Field
+	element *list.Element
+}
+
+type closedSession struct {
+	*session
+	reason string
+}
+
+// Open session saved between restarts.
+type savedSession struct {
+	Key   string
+	Start int64
+	Last  int64
+	Count int64
+	// Protobuf encoding of each captured field.
+	Fields [][]byte
+}
+
+func (f *SessionFilter) SetName(name string) {
+	f.name = name
+}
+
+func (f *SessionFilter) SetPipelineConfig(pConfig *PipelineConfig) {
+	f.pConfig = pConfig
+}
+
+func (f *SessionFilter) ConfigStruct() interface{} {
+	return &SessionFilterConfig{
+		Timeout:        1800,
+		MaxSessions:    10000,
+		TickerInterval: 10,
+	}
+}
+
+func (f *SessionFilter) Init(config interface{}) (err error) {
+	conf := config.(*SessionFilterConfig)
+	if conf.SessionKey == "" {
+		return errors.New("SessionFilter requires a session_key")
+	}
+	if f.key, err = newHashVariable(conf.SessionKey); err != nil {
+		return fmt.Errorf("SessionFilter session_key: %s", err)
+	}
+	if conf.Timeout == 0 {
+		return errors.New("SessionFilter timeout must be positive")
+	}
+	if conf.MaxSessions <= 0 {
+		return errors.New("SessionFilter max_sessions must be positive")
+	}
+	statePath := conf.StatePath
+	if statePath == "" {
+		statePath = filepath.Join("session", f.name+".json")
+	}
+	f.statePath = f.pConfig.Globals.PrependBaseDir(statePath)
+	f.conf = conf
+	f.timeout = int64(conf.Timeout) * int64(time.Second)
+	f.sessions = make(map[string]*session)
+	f.lru = list.New()
+	f.closed = nil
+	f.now = time.Now
+	return f.load()
+}
+
+func (f *SessionFilter) Run(fr FilterRunner, h PluginHelper) (err error) {
+	inChan := fr.InChan()
+	ticker := fr.Ticker()
+	for {
+		select {
+		case pack, ok := <-inChan:
+			if !ok {
+				if err = f.save(); err != nil {
+					fr.LogError(fmt.Errorf("can't save sessions: %s", err))
+				}
+				return nil
+			}
+			f.add(pack.Message)
+			fr.UpdateCursor(pack.QueueCursor)
+			pack.Recycle(nil)
+		case <-ticker:
+			f.expire()
+		}
+		if len(f.closed) > 0 {
+			f.inject(fr, h)
+		}
+	}
+}
+
+// Adds the message to its session, opening one if needed.
+func (f *SessionFilter) add(msg *message.Message) {
+	key, ok := f.key.value(msg)
+	if !ok {
+		return
+	}
+	t := msg.GetTimestamp()
+	if t == 0 {
+		t = f.now().UnixNano()
+	}
+	s, ok := f.sessions[key]
+	if ok && t-s.last > f.timeout {
+		// The message arrived after its session timed out but before it was
+		// expired.
+		f.close(s, "timeout")
+		ok = false
+	}
+	if !ok {
+		if len(f.sessions) >= f.conf.MaxSessions {
+			f.close(f.lru.Front().Value.(*session), "evicted")
+			atomic.AddInt64(&f.evictedCount, 1)
+		}
+		s = &session{key: key, start: t, last: t,
+			fields: make(map[string]*message.Field)}
+		s.element = f.lru.PushBack(s)
+		f.sessions[key] = s
+	} else {
+		f.lru.MoveToBack(s.element)
+		if t > s.last {
+			s.last = t
+		}
+	}
+	s.count++
+	for _, name := range f.conf.Fields {
+		field := msg.FindFirstField(name)
+		if field == nil {
+			continue
+		}
+		if _, ok := s.fields["first_"+name]; !ok {
+			s.fields["first_"+name] = renamedField(field, "first_"+name)
+		}
+		s.fields["last_"+name] = renamedField(field, "last_"+name)
+	}
+}
+
+func renamedField(field *message.Field, name string) *message.Field {
+	renamed := message.CopyField(field)
+	renamed.Name = &name
+	return renamed
+}
+
+// Closes the sessions that have been inactive for the timeout.
+func (f *SessionFilter) expire() {
+	now := f.now().UnixNano()
+	for _, s := range f.sessions {
+		if now-s.last > f.timeout {
+			f.close(s, "timeout")
+		}
+	}
+}
+
+func (f *SessionFilter) close(s *session, reason string) {
+	delete(f.sessions, s.key)
+	f.lru.Remove(s.element)
+	f.closed = append(f.closed, closedSession{s, reason})
+	atomic.AddInt64(&f.closedCount, 1)
+}
+
+// Injects a summary of each closed session.
+func (f *SessionFilter) inject(fr FilterRunner, h PluginHelper) {
+	for _, s := range f.closed {
+		pack, err := h.PipelinePack(0)
+		if err != nil {
+			fr.LogError(err)
+			break
+		}
+		pack.Message.SetLogger(fr.Name())
+		f.summarize(s, pack.Message)
+		fr.Inject(pack)
+	}
+	f.closed = f.closed[:0]
+}
+
+func (f *SessionFilter) summarize(s closedSession, msg *message.Message) {
+	msg.SetType("heka.session")
+	msg.SetTimestamp(s.last)
+	msg.SetString("SessionKey", s.key)
+	msg.SetInt("Start", s.start)
+	msg.SetInt("End", s.last)
+	msg.SetDouble("Duration", float64(s.last-s.start)/float64(time.Second))
+	msg.SetInt("EventCount", s.count)
+	msg.SetString("CloseReason", s.reason)
+	for _, name := range f.conf.Fields {
+		for _, prefix := range []string{"first_", "last_"} {
+			if field, ok := s.fields[prefix+name]; ok {
+				msg.AddField(field)
+			}
+		}
+	}
+}
+
+// Restores the sessions saved at the state path, if any.
+func (f *SessionFilter) load() error {
+	data, err := ioutil.ReadFile(f.statePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("can't read state file '%s': %s", f.statePath, err)
+	}
+	var saved []savedSession
+	if err = json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("can't decode state file '%s': %s", f.statePath, err)
+	}
+	// Saved from the least to the most recently active.
+	for _, ss := range saved {
+		s := &session{key: ss.Key, start: ss.Start, last: ss.Last, count: ss.Count,
+			fields: make(map[string]*message.Field, len(ss.Fields))}
+		for _, encoded := range ss.Fields {
+			field := new(message.Field)
+			if err = message.UnmarshalField(encoded, field); err != nil {
+				return fmt.Errorf("invalid field of session '%s' in state file '%s': %s",
+					ss.Key, f.statePath, err)
+			}
+			s.fields[field.GetName()] = field
+		}
+		s.element = f.lru.PushBack(s)
+		f.sessions[s.key] = s
+	}
+	return nil
+}
+
+// Writes the open sessions out, replacing the file atomically.
+func (f *SessionFilter) save() error {
+	saved := make([]savedSession, 0, len(f.sessions))
+	for e := f.lru.Front(); e != nil; e = e.Next() {
+		s := e.Value.(*session)
+		ss := savedSession{Key: s.key, Start: s.start, Last: s.last, Count: s.count}
+		for _, field := range s.fields {
+			encoded, err := field.Marshal()
+			if err != nil {
+				return err
+			}
+			ss.Fields = append(ss.Fields, encoded)
+		}
+		saved = append(saved, ss)
+	}
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(f.statePath), 0700); err != nil {
+		return err
+	}
+	tmp := f.statePath + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.statePath)
+}
+
+func (f *SessionFilter) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "ClosedSessionCount", atomic.LoadInt64(&f.closedCount),
+		"count")
+	message.NewInt64Field(msg, "EvictedSessionCount",
+		atomic.LoadInt64(&f.evictedCount), "count")
+	return nil
+}
+
+func init() {
+	RegisterPlugin("SessionFilter", func() interface{} {
+		return new(SessionFilter)
+	})
+}
@@ -0,0 +1,144 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func SessionFilterSpec(c gs.Context) {
+	c.Specify("A SessionFilter", func() {
+		tmpDir, err := ioutil.TempDir("", "session-tests")
+		c.Assume(err, gs.IsNil)
+		defer os.RemoveAll(tmpDir)
+		globals := DefaultGlobals()
+		globals.BaseDir = tmpDir
+		pConfig := NewPipelineConfig(globals)
+
+		newFilter := func() (*SessionFilter, *SessionFilterConfig) {
+			filter := new(SessionFilter)
+			filter.SetName("UserSessions")
+			filter.SetPipelineConfig(pConfig)
+			config := filter.ConfigStruct().(*SessionFilterConfig)
+			config.SessionKey = "Fields[user]"
+			config.Timeout = 60
+			config.Fields = []string{"path"}
+			return filter, config
+		}
+		filter, config := newFilter()
+
+		start := time.Unix(1000, 0)
+		now := start
+		event := func(filter *SessionFilter, user, path string, at time.Duration) {
+			msg := new(message.Message)
+			msg.SetTimestamp(start.Add(at).UnixNano())
+			msg.SetString("user", user)
+			msg.SetString("path", path)
+			filter.add(msg)
+		}
+		summary := func(s closedSession) *message.Message {
+			msg := new(message.Message)
+			filter.summarize(s, msg)
+			return msg
+		}
+
+		c.Specify("requires a session key", func() {
+			config.SessionKey = ""
+			c.Expect(filter.Init(config), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("is initialized", func() {
+			err := filter.Init(config)
+			c.Assume(err, gs.IsNil)
+			filter.now = func() time.Time { return now }
+			event(filter, "alice", "/login", 0)
+			event(filter, "bob", "/login", 10*time.Second)
+			event(filter, "alice", "/search", 30*time.Second)
+			event(filter, "alice", "/logout", 50*time.Second)
+
+			c.Specify("keeps the sessions open until they time out", func() {
+				now = start.Add(65 * time.Second)
+				filter.expire()
+				c.Expect(len(filter.closed), gs.Equals, 0)
+
+				now = start.Add(111 * time.Second)
+				filter.expire()
+				c.Expect(len(filter.closed), gs.Equals, 2)
+				c.Expect(len(filter.sessions), gs.Equals, 0)
+			})
+
+			c.Specify("summarizes a closed session", func() {
+				now = start.Add(115 * time.Second)
+				filter.expire()
+				var alice closedSession
+				for _, s := range filter.closed {
+					if s.key == "alice" {
+						alice = s
+					}
+				}
+				msg := summary(alice)
+				c.Expect(msg.GetType(), gs.Equals, "heka.session")
+				c.Expect(msg.GetTimestamp(), gs.Equals, start.Add(50*time.Second).UnixNano())
+				duration, _ := msg.GetFieldValue("Duration")
+				c.Expect(duration, gs.Equals, 50.0)
+				count, _ := msg.GetFieldValue("EventCount")
+				c.Expect(count, gs.Equals, int64(3))
+				reason, _ := msg.GetFieldValue("CloseReason")
+				c.Expect(reason, gs.Equals, "timeout")
+				first, _ := msg.GetFieldValue("first_path")
+				c.Expect(first, gs.Equals, "/login")
+				last, _ := msg.GetFieldValue("last_path")
+				c.Expect(last, gs.Equals, "/logout")
+			})
+
+			c.Specify("starts a new session after a gap longer than the timeout", func() {
+				event(filter, "alice", "/login", 200*time.Second)
+				c.Expect(len(filter.closed), gs.Equals, 1)
+				c.Expect(filter.closed[0].count, gs.Equals, int64(3))
+				c.Expect(filter.sessions["alice"].count, gs.Equals, int64(1))
+			})
+
+			c.Specify("evicts the least recently active session when full", func() {
+				filter.conf.MaxSessions = 2
+				event(filter, "carol", "/login", 55*time.Second)
+				c.Expect(len(filter.closed), gs.Equals, 1)
+				c.Expect(filter.closed[0].key, gs.Equals, "bob")
+				c.Expect(filter.closed[0].reason, gs.Equals, "evicted")
+				c.Expect(filter.evictedCount, gs.Equals, int64(1))
+			})
+
+			c.Specify("restores its open sessions after a restart", func() {
+				c.Assume(filter.save(), gs.IsNil)
+				restarted, config := newFilter()
+				err := restarted.Init(config)
+				c.Assume(err, gs.IsNil)
+				c.Expect(len(restarted.sessions), gs.Equals, 2)
+				c.Expect(restarted.lru.Front().Value.(*session).key, gs.Equals, "bob")
+
+				alice := restarted.sessions["alice"]
+				c.Expect(alice.count, gs.Equals, int64(3))
+				c.Expect(alice.start, gs.Equals, start.UnixNano())
+				first := alice.fields["first_path"]
+				c.Expect(first.GetName(), gs.Equals, "first_path")
+				c.Expect(first.ValueString[0], gs.Equals, "/login")
+			})
+		})
+	})
+}
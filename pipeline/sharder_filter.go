@@ -0,0 +1,291 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"regexp"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// Filter that spreads messages over a set of outputs (or filters), routing
+// each one directly to a single shard picked by hashing one of its message
+// variables. Shards are picked by weighted rendezvous hashing, so messages
+// w/ the same key always go to the same shard, and adding, removing or
+// reweighting a shard only moves the keys that have to move.
+type SharderFilter struct {
+	shards       []*shard
+	variable     *hashVariable
+	defaultShard *shard
+	dropped      int64
+}
+
+type shard struct {
+	name   string
+	route  []string
+	seed   uint64
+	weight float64
+	count  int64
+}
+
+type SharderFilterConfig struct {
+	// Names of the plugins to shard the messages over.
+	Shards []string `toml:"shards"`
+	// Message variable hashed to pick a message's shard, either one of
+	// "Type", "Logger", "Hostname", "Payload" or "Uuid", or a field as
+	// "Fields[name]".
+	HashVariable string `toml:"hash_variable"`
+	// Relative weights of the shards, defaulting to 1. A weight of 0 drains
+	// the shard.
+	Weights map[string]uint `toml:"weights"`
+	// Shard the messages w/o the hash variable go to, if unset they're
+	// dropped.
+	DefaultShard string `toml:"default_shard"`
+}
+
+// A message variable whose value is hashed, either one of the "Type",
+// "Logger", "Hostname", "Payload" or "Uuid" headers, or a field as
+// "Fields[name]".
+type hashVariable struct {
+	header string
+	field  string
+}
+
+var hashFieldRegex = regexp.MustCompile(`^Fields\[([^\]]+)\]$`)
+
+func newHashVariable(spec string) (*hashVariable, error) {
+	switch spec {
+	case "Type", "Logger", "Hostname", "Payload", "Uuid":
+		return &hashVariable{header: spec}, nil
+	}
+	matches := hashFieldRegex.FindStringSubmatch(spec)
+	if matches == nil {
+		return nil, fmt.Errorf("invalid hash_variable '%s'", spec)
+	}
+	return &hashVariable{field: matches[1]}, nil
+}
+
+// Extracts the variable's value from the message, ok is false if the message
+// doesn't have it. Fields w/ several values use their first one.
+func (v *hashVariable) value(msg *message.Message) (val string, ok bool) {
+	switch v.header {
+	case "Type":
+		return msg.GetType(), true
+	case "Logger":
+		return msg.GetLogger(), true
+	case "Hostname":
+		return msg.GetHostname(), true
+	case "Payload":
+		return msg.GetPayload(), true
+	case "Uuid":
+		return msg.GetUuidString(), true
+	}
+	field := msg.FindFirstField(v.field)
+	if field == nil {
+		return "", false
+	}
+	switch field.GetValueType() {
+	case message.Field_STRING:
+		if len(field.ValueString) > 0 {
+			return field.ValueString[0], true
+		}
+	case message.Field_BYTES:
+		if len(field.ValueBytes) > 0 {
+			return string(field.ValueBytes[0]), true
+		}
+	case message.Field_INTEGER:
+		if len(field.ValueInteger) > 0 {
+			return strconv.FormatInt(field.ValueInteger[0], 10), true
+		}
+	case message.Field_DOUBLE:
+		if len(field.ValueDouble) > 0 {
+			return strconv.FormatFloat(field.ValueDouble[0], 'g', -1, 64), true
+		}
+	case message.Field_BOOL:
+		if len(field.ValueBool) > 0 {
+			return strconv.FormatBool(field.ValueBool[0]), true
+		}
+	}
+	return "", false
+}
+
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
+
+func (s *SharderFilter) ConfigStruct() interface{} {
+	return &SharderFilterConfig{
+		HashVariable: "Hostname",
+	}
+}
+
+func (s *SharderFilter) Init(config interface{}) error {
+	conf := config.(*SharderFilterConfig)
+	if len(conf.Shards) == 0 {
+		return errors.New("SharderFilter requires at least one shard")
+	}
+	var err error
+	if s.variable, err = newHashVariable(conf.HashVariable); err != nil {
+		return fmt.Errorf("SharderFilter %s", err)
+	}
+
+	s.shards = make([]*shard, 0, len(conf.Shards))
+	total := 0.0
+	for _, name := range conf.Shards {
+		for _, sh := range s.shards {
+			if sh.name == name {
+				return fmt.Errorf("SharderFilter duplicate shard '%s'", name)
+			}
+		}
+		weight := uint(1)
+		if w, ok := conf.Weights[name]; ok {
+			weight = w
+		}
+		s.shards = append(s.shards, &shard{
+			name:   name,
+			route:  []string{name},
+			seed:   hashString(name),
+			weight: float64(weight),
+		})
+		total += float64(weight)
+	}
+	for name := range conf.Weights {
+		if s.shard(name) == nil {
+			return fmt.Errorf("SharderFilter weight for unknown shard '%s'", name)
+		}
+	}
+	if total == 0 {
+		return errors.New("SharderFilter requires a shard w/ a weight above 0")
+	}
+
+	s.defaultShard = nil
+	if conf.DefaultShard != "" {
+		if s.defaultShard = s.shard(conf.DefaultShard); s.defaultShard == nil {
+			return fmt.Errorf("SharderFilter default_shard '%s' isn't one of the shards",
+				conf.DefaultShard)
+		}
+	}
+	return nil
+}
+
+func (s *SharderFilter) shard(name string) *shard {
+	for _, sh := range s.shards {
+		if sh.name == name {
+			return sh
+		}
+	}
+	return nil
+}
+
+func (s *SharderFilter) Run(fr FilterRunner, h PluginHelper) error {
+	pConfig := h.PipelineConfig()
+	for _, sh := range s.shards {
+		if sh.name == fr.Name() {
+			return fmt.Errorf("can't shard to itself")
+		}
+		_, isOutput := pConfig.Output(sh.name)
+		_, isFilter := pConfig.Filter(sh.name)
+		if !isOutput && !isFilter {
+			return fmt.Errorf("unknown shard %s", sh.name)
+		}
+	}
+
+	for pack := range fr.InChan() {
+		key, ok := s.variable.value(pack.Message)
+		var target *shard
+		if ok {
+			target = s.pick(key)
+		} else {
+			target = s.defaultShard
+		}
+		if target == nil {
+			atomic.AddInt64(&s.dropped, 1)
+			fr.UpdateCursor(pack.QueueCursor)
+			pack.Recycle(nil)
+			continue
+		}
+
+		newPack, err := h.PipelinePack(pack.MsgLoopCount)
+		if err != nil {
+			fr.UpdateCursor(pack.QueueCursor)
+			pack.Recycle(err)
+			return err
+		}
+		pack.Message.Copy(newPack.Message)
+		newPack.routeTo = target.route
+		if fr.Inject(newPack) {
+			atomic.AddInt64(&target.count, 1)
+		}
+		fr.UpdateCursor(pack.QueueCursor)
+		pack.Recycle(nil)
+	}
+	return nil
+}
+
+// Picks the shard w/ the highest weighted score for the key.
+func (s *SharderFilter) pick(key string) *shard {
+	keyHash := hashString(key)
+
+	var (
+		best      *shard
+		bestScore = math.Inf(-1)
+	)
+	for _, sh := range s.shards {
+		if sh.weight == 0 {
+			continue
+		}
+		// Uniform in (0, 1), the score's distribution making each shard's
+		// chance of winning proportional to its weight.
+		u := (float64(mix64(keyHash^sh.seed)>>11) + 0.5) / (1 << 53)
+		score := -sh.weight / math.Log(u)
+		if score > bestScore {
+			best, bestScore = sh, score
+		}
+	}
+	return best
+}
+
+// The splitmix64 finalizer, spreading the bits of the combined hashes.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func (s *SharderFilter) ReportMsg(msg *message.Message) error {
+	for _, sh := range s.shards {
+		message.NewInt64Field(msg, "ShardCount-"+sh.name,
+			atomic.LoadInt64(&sh.count), "count")
+	}
+	message.NewInt64Field(msg, "DroppedCount", atomic.LoadInt64(&s.dropped), "count")
+	return nil
+}
+
+func init() {
+	RegisterPlugin("SharderFilter", func() interface{} {
+		return new(SharderFilter)
+	})
+}
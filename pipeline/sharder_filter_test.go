@@ -0,0 +1,104 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"strconv"
+
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func SharderFilterSpec(c gs.Context) {
+	c.Specify("A SharderFilter", func() {
+		filter := new(SharderFilter)
+		config := filter.ConfigStruct().(*SharderFilterConfig)
+		config.Shards = []string{"es-1", "es-2", "es-3"}
+		config.HashVariable = "Fields[customer]"
+
+		assign := func(keys int) map[string]string {
+			assigned := make(map[string]string, keys)
+			for i := 0; i < keys; i++ {
+				key := strconv.Itoa(i)
+				assigned[key] = filter.pick(key).name
+			}
+			return assigned
+		}
+
+		c.Specify("spreads the keys over the shards by weight", func() {
+			config.Weights = map[string]uint{"es-3": 2}
+			err := filter.Init(config)
+			c.Assume(err, gs.IsNil)
+			counts := make(map[string]int)
+			for _, name := range assign(10000) {
+				counts[name]++
+			}
+			c.Expect(counts["es-1"] > 2000 && counts["es-1"] < 3000, gs.IsTrue)
+			c.Expect(counts["es-2"] > 2000 && counts["es-2"] < 3000, gs.IsTrue)
+			c.Expect(counts["es-3"] > 4500 && counts["es-3"] < 5500, gs.IsTrue)
+		})
+
+		c.Specify("only moves the keys of the changed shards", func() {
+			err := filter.Init(config)
+			c.Assume(err, gs.IsNil)
+			before := assign(1000)
+
+			config.Shards = append(config.Shards, "es-4")
+			err = filter.Init(config)
+			c.Assume(err, gs.IsNil)
+			for key, name := range assign(1000) {
+				if name != "es-4" {
+					c.Expect(name, gs.Equals, before[key])
+				}
+			}
+
+			config.Weights = map[string]uint{"es-2": 0}
+			err = filter.Init(config)
+			c.Assume(err, gs.IsNil)
+			for key, name := range assign(1000) {
+				c.Expect(name, gs.Not(gs.Equals), "es-2")
+				if before[key] != "es-2" && name != "es-4" {
+					c.Expect(name, gs.Equals, before[key])
+				}
+			}
+		})
+
+		c.Specify("hashes the configured variable", func() {
+			err := filter.Init(config)
+			c.Assume(err, gs.IsNil)
+			msg := new(message.Message)
+			_, ok := filter.variable.value(msg)
+			c.Expect(ok, gs.IsFalse)
+			message.NewInt64Field(msg, "customer", 42, "")
+			key, ok := filter.variable.value(msg)
+			c.Expect(ok, gs.IsTrue)
+			c.Expect(key, gs.Equals, "42")
+		})
+
+		c.Specify("rejects invalid configs", func() {
+			config.HashVariable = "Fields[customer"
+			c.Expect(filter.Init(config), gs.Not(gs.IsNil))
+			config.HashVariable = "Uuid"
+			config.DefaultShard = "es-9"
+			c.Expect(filter.Init(config), gs.Not(gs.IsNil))
+			config.DefaultShard = ""
+			config.Weights = map[string]uint{"es-1": 0, "es-2": 0, "es-3": 0}
+			c.Expect(filter.Init(config), gs.Not(gs.IsNil))
+			config.Weights = nil
+			config.Shards = []string{"es-1", "es-1"}
+			c.Expect(filter.Init(config), gs.Not(gs.IsNil))
+		})
+	})
+}
@@ -26,6 +26,7 @@ import (
 	"hash"
 	"regexp"
 
+	"github.com/mozilla-services/heka/framing"
 	"github.com/mozilla-services/heka/message"
 )
 
@@ -234,6 +235,104 @@ func (r *RegexSplitter) FindRecord(buf []byte) (bytesRead int, record []byte) {
 	return bytesRead, record
 }
 
+// Splits syslog streams framed as described in RFC 6587, using either octet
+// counting (each message prefixed by its length and a space) or
+// non-transparent framing (each message terminated by a newline). In the
+// default "auto" mode the framing is detected for each message, so senders
+// using either method are handled correctly.
+type SyslogFramingSplitter struct {
+	framing string
+	sr      SplitterRunner
+}
+
+type SyslogFramingSplitterConfig struct {
+	Framing string `toml:"framing"`
+}
+
+func (s *SyslogFramingSplitter) SetSplitterRunner(sr SplitterRunner) {
+	s.sr = sr
+}
+
+func (s *SyslogFramingSplitter) ConfigStruct() interface{} {
+	return &SyslogFramingSplitterConfig{
+		Framing: "auto",
+	}
+}
+
+func (s *SyslogFramingSplitter) Init(config interface{}) error {
+	conf := config.(*SyslogFramingSplitterConfig)
+	switch conf.Framing {
+	case "auto", "octet_counting", "non_transparent":
+	default:
+		return fmt.Errorf(
+			"framing must be 'auto', 'octet_counting', or 'non_transparent', got '%s'",
+			conf.Framing)
+	}
+	s.framing = conf.Framing
+	return nil
+}
+
+func (s *SyslogFramingSplitter) FindRecord(buf []byte) (bytesRead int, record []byte) {
+	// Skip any newlines left between messages, some senders append one to
+	// octet counted frames.
+	for bytesRead < len(buf) && (buf[bytesRead] == '\n' || buf[bytesRead] == '\r') {
+		bytesRead++
+	}
+	data := buf[bytesRead:]
+	if len(data) == 0 {
+		return bytesRead, nil
+	}
+
+	if s.framing != "non_transparent" && (s.framing == "octet_counting" ||
+		(data[0] >= '0' && data[0] <= '9')) {
+
+		headerLen, msgLen, valid := parseOctetCount(data)
+		if valid {
+			if headerLen == 0 || len(data) < headerLen+msgLen {
+				return bytesRead, nil // read more data to get the whole message
+			}
+			return bytesRead + headerLen + msgLen, data[headerLen : headerLen+msgLen]
+		}
+		if s.framing == "octet_counting" {
+			// Resync by discarding everything up to the next newline.
+			if s.sr != nil {
+				s.sr.LogError(errors.New("invalid octet count, discarding data"))
+			}
+			n := bytes.IndexByte(data, '\n')
+			if n == -1 {
+				return len(buf), nil
+			}
+			return bytesRead + n + 1, nil
+		}
+	}
+
+	n := bytes.IndexByte(data, '\n')
+	if n == -1 {
+		return bytesRead, nil
+	}
+	return bytesRead + n + 1, data[:n]
+}
+
+// Parses an RFC 6587 octet count header (a decimal message length followed by
+// a space). Returns a zero headerLen if more data is needed to parse the
+// header, and false if the data doesn't start with a valid header.
+func parseOctetCount(data []byte) (headerLen, msgLen int, valid bool) {
+	for i, b := range data {
+		switch {
+		case b >= '0' && b <= '9':
+			msgLen = msgLen*10 + int(b-'0')
+			if msgLen > int(message.MAX_RECORD_SIZE) {
+				return 0, 0, false
+			}
+		case b == ' ' && i > 0 && msgLen > 0:
+			return i + 1, msgLen, true
+		default:
+			return 0, 0, false
+		}
+	}
+	return 0, 0, true
+}
+
 // Heka Message signer object.
 type Signer struct {
 	HmacKey string `toml:"hmac_key"`
@@ -261,6 +360,8 @@ func authenticateMessage(signers map[string]Signer, header *message.Header,
 			hm = hmac.New(md5.New, []byte(key))
 		case message.Header_SHA1:
 			hm = hmac.New(sha1.New, []byte(key))
+		default:
+			return false
 		}
 		hm.Write(msg)
 		expectedDigest := hm.Sum(nil)
@@ -301,40 +402,44 @@ func (h *HekaFramingSplitter) Init(config interface{}) error {
 }
 
 func (h *HekaFramingSplitter) FindRecord(buf []byte) (bytesRead int, record []byte) {
-	bytesRead = bytes.IndexByte(buf, message.RECORD_SEPARATOR)
-	if bytesRead == -1 {
-		bytesRead = len(buf)
-		return // read more data to find the start of the next message
-	}
-
-	if len(buf) < bytesRead+message.HEADER_DELIMITER_SIZE {
-		return // read more data to get the header length byte
-	}
-	headerLength := int(buf[bytesRead+1])
-	headerEnd := bytesRead + headerLength + message.HEADER_FRAMING_SIZE
-	if len(buf) < headerEnd {
-		return // read more data to get the remainder of the header
-	}
-	decoded, err := message.DecodeHeader(
-		buf[bytesRead+message.HEADER_DELIMITER_SIZE:headerEnd], h.header)
-	if err != nil {
-		h.sr.LogError(err)
-	}
-	if h.header.MessageLength != nil || decoded {
-		messageEnd := headerEnd + int(h.header.GetMessageLength())
-		if len(buf) < messageEnd {
-			return // read more data to get the remainder of the message
+	// Loops rather than recursing past each invalid header, a buffer full of
+	// record separators could otherwise exhaust the stack.
+	for {
+		n := bytes.IndexByte(buf[bytesRead:], message.RECORD_SEPARATOR)
+		if n == -1 {
+			return len(buf), nil // read more data to find the start of the next message
 		}
-		record = buf[bytesRead:messageEnd]
-		bytesRead = messageEnd
-		h.header.Reset()
-	} else {
-		var n int
-		bytesRead++                               // advance over the current record separator
-		n, record = h.FindRecord(buf[bytesRead:]) // header was invalid, look again
 		bytesRead += n
+
+		if len(buf) < bytesRead+message.HEADER_DELIMITER_SIZE {
+			return // read more data to get the header length byte
+		}
+		headerLength := int(buf[bytesRead+1])
+		headerEnd := bytesRead + headerLength + message.HEADER_FRAMING_SIZE
+		if len(buf) < headerEnd {
+			return // read more data to get the remainder of the header
+		}
+		decoded, err := message.DecodeHeader(
+			buf[bytesRead+message.HEADER_DELIMITER_SIZE:headerEnd], h.header)
+		if err != nil {
+			h.sr.LogError(err)
+		}
+		if h.header.MessageLength != nil || decoded {
+			messageEnd := headerEnd + int(h.header.GetMessageLength())
+			if len(buf) < messageEnd {
+				return // read more data to get the remainder of the message
+			}
+			if framing.CheckCrc(h.header, buf[headerEnd:messageEnd]) {
+				record = buf[bytesRead:messageEnd]
+				h.header.Reset()
+				return messageEnd, record
+			}
+			// The message is corrupt, or the header is and isn't really a header.
+			h.sr.LogError(errors.New("frame CRC mismatch, skipping to the next frame"))
+			h.header.Reset()
+		}
+		bytesRead++ // advance over the current record separator, look again
 	}
-	return bytesRead, record
 }
 
 func (h *HekaFramingSplitter) UnframeRecord(framed []byte, pack *PipelinePack) []byte {
@@ -371,4 +476,7 @@ func init() {
 	RegisterPlugin("HekaFramingSplitter", func() interface{} {
 		return &HekaFramingSplitter{}
 	})
+	RegisterPlugin("SyslogFramingSplitter", func() interface{} {
+		return &SyslogFramingSplitter{}
+	})
 }
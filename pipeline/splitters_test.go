@@ -510,6 +510,133 @@ func HekaFramingSpec(c gs.Context) {
 				// to true, but `gs.IsNil` doesn't work here.
 				c.Expect(string(unframed), gs.Equals, "")
 			})
+
+			c.Specify("doesn't auth signed message w/ an unknown hash function", func() {
+				err := splitter.Init(config)
+				c.Assume(err, gs.IsNil)
+
+				header.SetHmacHashFunction(message.Header_HmacHashFunction(7))
+				header.SetHmacSigner(signer)
+				header.SetHmacKeyVersion(uint32(1))
+				header.SetHmac([]byte("not a digest"))
+				hbytes, _ := proto.Marshal(header)
+
+				framed := encodeMessage(hbytes, mbytes)
+				unframed := splitter.UnframeRecord(framed, pack)
+				c.Expect(pack.Signer, gs.Equals, "")
+				c.Expect(string(unframed), gs.Equals, "")
+			})
+		})
+
+		c.Specify("skips any number of record separators w/o valid headers", func() {
+			err := splitter.Init(config)
+			c.Assume(err, gs.IsNil)
+			b := bytes.Repeat([]byte{message.RECORD_SEPARATOR, 0}, 1<<20)
+			n, record := splitter.FindRecord(b)
+			c.Expect(n, gs.Equals, len(b)-2)
+			c.Expect(len(record), gs.Equals, 0)
+		})
+	})
+}
+
+func SyslogFramingSpec(c gs.Context) {
+	c.Specify("A SyslogFramingSplitter", func() {
+		splitter := &SyslogFramingSplitter{}
+		config := splitter.ConfigStruct().(*SyslogFramingSplitterConfig)
+
+		findAll := func(buf []byte) (records []string) {
+			for {
+				n, record := splitter.FindRecord(buf)
+				if n == 0 {
+					return records
+				}
+				if record != nil {
+					records = append(records, string(record))
+				}
+				buf = buf[n:]
+			}
+		}
+
+		c.Specify("rejects invalid framing types", func() {
+			config.Framing = "bogus"
+			err := splitter.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("in auto mode", func() {
+			err := splitter.Init(config)
+			c.Assume(err, gs.IsNil)
+
+			c.Specify("splits octet counted frames", func() {
+				buf := []byte("10 <13>hello\n11 <13>world\n!")
+				records := findAll(buf)
+				c.Expect(len(records), gs.Equals, 2)
+				c.Expect(records[0], gs.Equals, "<13>hello\n")
+				c.Expect(records[1], gs.Equals, "<13>world\n!")
+			})
+
+			c.Specify("splits newline terminated frames", func() {
+				buf := []byte("<13>hello\n<13>world\n<13>partial")
+				records := findAll(buf)
+				c.Expect(len(records), gs.Equals, 2)
+				c.Expect(records[0], gs.Equals, "<13>hello")
+				c.Expect(records[1], gs.Equals, "<13>world")
+			})
+
+			c.Specify("handles mixed framing", func() {
+				buf := []byte("9 <13>hello\n<13>world\n9 <13>again")
+				records := findAll(buf)
+				c.Expect(len(records), gs.Equals, 3)
+				c.Expect(records[0], gs.Equals, "<13>hello")
+				c.Expect(records[1], gs.Equals, "<13>world")
+				c.Expect(records[2], gs.Equals, "<13>again")
+			})
+
+			c.Specify("waits for the rest of an octet counted frame", func() {
+				n, record := splitter.FindRecord([]byte("20 <13>hello\n"))
+				c.Expect(n, gs.Equals, 0)
+				c.Expect(record, gs.IsNil)
+				n, record = splitter.FindRecord([]byte("20"))
+				c.Expect(n, gs.Equals, 0)
+				c.Expect(record, gs.IsNil)
+			})
+
+			c.Specify("falls back to newline framing w/ invalid counts", func() {
+				records := findAll([]byte("2015-06-01 was a good day\n"))
+				c.Expect(len(records), gs.Equals, 1)
+				c.Expect(records[0], gs.Equals, "2015-06-01 was a good day")
+			})
+
+			c.Specify("works with a SplitterRunner", func() {
+				sRunner := makeSplitterRunner("SyslogFramingSplitter", splitter)
+				reader := bytes.NewReader([]byte("9 <13>hello<13>world\n"))
+				n, record, err := sRunner.GetRecordFromStream(reader)
+				c.Expect(n, gs.Equals, 11)
+				c.Expect(err, gs.IsNil)
+				c.Expect(string(record), gs.Equals, "<13>hello")
+				n, record, err = sRunner.GetRecordFromStream(reader)
+				c.Expect(n, gs.Equals, 10)
+				c.Expect(err, gs.IsNil)
+				c.Expect(string(record), gs.Equals, "<13>world")
+			})
+		})
+
+		c.Specify("in octet_counting mode resyncs on invalid counts", func() {
+			config.Framing = "octet_counting"
+			err := splitter.Init(config)
+			c.Assume(err, gs.IsNil)
+			records := findAll([]byte("<13>garbage\n9 <13>hello"))
+			c.Expect(len(records), gs.Equals, 1)
+			c.Expect(records[0], gs.Equals, "<13>hello")
+		})
+
+		c.Specify("in non_transparent mode ignores counts", func() {
+			config.Framing = "non_transparent"
+			err := splitter.Init(config)
+			c.Assume(err, gs.IsNil)
+			records := findAll([]byte("9 <13>hello\n"))
+			c.Expect(len(records), gs.Equals, 1)
+			c.Expect(records[0], gs.Equals, "9 <13>hello")
 		})
 	})
 }
@@ -0,0 +1,360 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package testsupport
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/heka/client"
+	. "github.com/mozilla-services/heka/message"
+	"github.com/pborman/uuid"
+)
+
+// Environment variable naming the hekad binary the integration harness runs,
+// if it isn't set the harness builds one.
+const HEKAD_BIN_ENV = "HEKAD_BIN"
+
+// Message type of the traffic the harness sends through a topology.
+const INTEGRATION_TYPE = "integration"
+
+var (
+	// How long to wait for a hekad to start listening, to exit or for
+	// delivered output to show up.
+	HekadTimeout = 30 * time.Second
+
+	hekadBin struct {
+		sync.Once
+		path string
+		err  error
+	}
+)
+
+// Returns the hekad binary to run, building it the first time it's needed
+// unless HEKAD_BIN is set. Skips the test if there's no hekad to run.
+func HekadBinary(t testing.TB) string {
+	if runtime.GOOS == "windows" {
+		t.Skip("the integration harness stops hekad w/ SIGINT")
+	}
+	hekadBin.Do(func() {
+		if hekadBin.path = os.Getenv(HEKAD_BIN_ENV); hekadBin.path != "" {
+			_, hekadBin.err = os.Stat(hekadBin.path)
+			return
+		}
+		dir, err := ioutil.TempDir("", "heka-integration-bin")
+		if err != nil {
+			hekadBin.err = err
+			return
+		}
+		hekadBin.path = filepath.Join(dir, "hekad")
+		cmd := exec.Command("go", "build", "-o", hekadBin.path,
+			"github.com/mozilla-services/heka/cmd/hekad")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			hekadBin.err = fmt.Errorf("%s: %s", err, out)
+		}
+	})
+	if hekadBin.err != nil {
+		t.Skipf("no hekad binary, set %s to run the integration tests: %s",
+			HEKAD_BIN_ENV, hekadBin.err)
+	}
+	return hekadBin.path
+}
+
+// Returns a loopback address no one is listening on.
+func FreeAddress(t testing.TB) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("can't find a free port: %s", err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+// A hekad process run w/ a generated config. Its config, base_dir, output
+// files and log all live in Dir.
+type Hekad struct {
+	Name   string
+	Dir    string
+	Config string
+	// The address the hekad's TcpInput listens on, Start waits for it.
+	Address string
+	t       testing.TB
+	cmd     *exec.Cmd
+	done    chan error
+}
+
+// Creates a hekad named `name` w/ its own directory in `root`, writing out
+// the config. The `%BASE_DIR%` placeholder in the config is replaced w/ the
+// hekad's directory.
+func NewHekad(t testing.TB, root, name, address, config string) *Hekad {
+	dir := filepath.Join(root, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("%s: %s", name, err)
+	}
+	config = strings.Replace(config, "%BASE_DIR%", dir, -1)
+	h := &Hekad{
+		Name:    name,
+		Dir:     dir,
+		Config:  filepath.Join(dir, "hekad.toml"),
+		Address: address,
+		t:       t,
+	}
+	if err := ioutil.WriteFile(h.Config, []byte(config), 0644); err != nil {
+		t.Fatalf("%s: %s", name, err)
+	}
+	return h
+}
+
+// Returns the path of a file in the hekad's directory.
+func (h *Hekad) Path(name string) string {
+	return filepath.Join(h.Dir, name)
+}
+
+// Starts the hekad and waits until its TcpInput accepts connections.
+func (h *Hekad) Start() {
+	if h.cmd != nil {
+		h.t.Fatalf("%s: already running", h.Name)
+	}
+	logFile, err := os.OpenFile(h.Path("hekad.log"),
+		os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		h.t.Fatalf("%s: %s", h.Name, err)
+	}
+	defer logFile.Close()
+	h.cmd = exec.Command(HekadBinary(h.t), "-config", h.Config)
+	h.cmd.Stdout = logFile
+	h.cmd.Stderr = logFile
+	if err = h.cmd.Start(); err != nil {
+		h.cmd = nil
+		h.t.Fatalf("%s: %s", h.Name, err)
+	}
+	h.done = make(chan error, 1)
+	go func(cmd *exec.Cmd, done chan error) {
+		done <- cmd.Wait()
+	}(h.cmd, h.done)
+
+	deadline := time.Now().Add(HekadTimeout)
+	for {
+		conn, err := net.DialTimeout("tcp", h.Address, time.Second)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		select {
+		case err = <-h.done:
+			h.cmd = nil
+			h.t.Fatalf("%s exited on start: %v\n%s", h.Name, err, h.Log())
+		case <-time.After(50 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			h.Stop()
+			h.t.Fatalf("%s isn't listening on %s\n%s", h.Name, h.Address, h.Log())
+		}
+	}
+}
+
+// Shuts the hekad down w/ SIGINT, killing it if it doesn't exit in time.
+// Stopping a hekad that isn't running does nothing.
+func (h *Hekad) Stop() {
+	if h.cmd == nil {
+		return
+	}
+	defer func() { h.cmd = nil }()
+	h.cmd.Process.Signal(os.Interrupt)
+	select {
+	case <-h.done:
+	case <-time.After(HekadTimeout):
+		h.cmd.Process.Kill()
+		<-h.done
+		h.t.Errorf("%s didn't shut down, killed it\n%s", h.Name, h.Log())
+	}
+}
+
+// Returns what the hekad logged so far.
+func (h *Hekad) Log() string {
+	data, _ := ioutil.ReadFile(h.Path("hekad.log"))
+	return string(data)
+}
+
+// Options of the generated topology.
+type TopologyConfig struct {
+	// If set the edge signs the messages it forwards and the aggregator
+	// only outputs messages signed by it.
+	Signer *MessageSigningConfig
+}
+
+// An edge hekad that forwards the INTEGRATION_TYPE messages it receives on
+// its TcpInput to an aggregator hekad, through a buffered TcpOutput. The
+// aggregator writes the payloads of the messages it receives to Output, one
+// per line.
+type Topology struct {
+	Edge       *Hekad
+	Aggregator *Hekad
+	Output     string
+}
+
+// Generates the configs of a topology in a temp directory. Neither hekad is
+// started.
+func NewTopology(t testing.TB, config TopologyConfig) *Topology {
+	root, err := ioutil.TempDir("", "heka-integration")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	edgeAddr, aggAddr := FreeAddress(t), FreeAddress(t)
+
+	var edge, agg bytes.Buffer
+	fmt.Fprintf(&edge, `[hekad]
+base_dir = "%%BASE_DIR%%"
+
+[TcpInput]
+address = "%s"
+
+[aggregator_output]
+type = "TcpOutput"
+address = "%s"
+message_matcher = "Type == '%s'"
+use_buffering = true
+
+    [aggregator_output.buffering]
+    cursor_update_count = 1
+`, edgeAddr, aggAddr, INTEGRATION_TYPE)
+
+	fmt.Fprintf(&agg, `[hekad]
+base_dir = "%%BASE_DIR%%"
+
+[TcpInput]
+address = "%s"
+`, aggAddr)
+	matcher := fmt.Sprintf("Type == '%s'", INTEGRATION_TYPE)
+	signerOption := ""
+	if s := config.Signer; s != nil {
+		fmt.Fprintf(&edge, `
+    [aggregator_output.signer]
+    name = "%s"
+    hmac_hash = "%s"
+    hmac_key = "%s"
+    version = %d
+`, s.Name, s.Hash, s.Key, s.Version)
+		fmt.Fprintf(&agg, `splitter = "signed_splitter"
+
+[signed_splitter]
+type = "HekaFramingSplitter"
+
+    [signed_splitter.signer.%s_%d]
+    hmac_key = "%s"
+`, s.Name, s.Version, s.Key)
+		signerOption = fmt.Sprintf("message_signer = \"%s\"\n", s.Name)
+	}
+	fmt.Fprintf(&agg, `
+[PayloadEncoder]
+append_newlines = true
+
+[integration_output]
+type = "FileOutput"
+message_matcher = "%s"
+%spath = "%%BASE_DIR%%/output.log"
+encoder = "PayloadEncoder"
+flush_interval = 50
+`, matcher, signerOption)
+
+	topo := &Topology{
+		Edge:       NewHekad(t, root, "edge", edgeAddr, edge.String()),
+		Aggregator: NewHekad(t, root, "aggregator", aggAddr, agg.String()),
+	}
+	topo.Output = topo.Aggregator.Path("output.log")
+	return topo
+}
+
+// Starts the aggregator, then the edge.
+func (topo *Topology) Start() {
+	topo.Aggregator.Start()
+	topo.Edge.Start()
+}
+
+// Stops the edge, then the aggregator, and removes the topology's directory
+// unless the test failed.
+func (topo *Topology) Stop() {
+	topo.Edge.Stop()
+	topo.Aggregator.Stop()
+	if !topo.Edge.t.Failed() {
+		os.RemoveAll(filepath.Dir(topo.Edge.Dir))
+	}
+}
+
+// Sends INTEGRATION_TYPE messages w/ the given payloads to the address,
+// signing them w/ the signer if it isn't nil.
+func SendPayloads(t testing.TB, address string, signer *MessageSigningConfig,
+	payloads ...string) {
+
+	sender, err := client.NewNetworkSender("tcp", address)
+	if err != nil {
+		t.Fatalf("can't connect to %s: %s", address, err)
+	}
+	defer sender.Close()
+	c := client.NewClient(sender, client.NewProtobufEncoder(signer))
+	for _, payload := range payloads {
+		msg := &Message{}
+		msg.SetUuid(uuid.NewRandom())
+		msg.SetTimestamp(time.Now().UnixNano())
+		msg.SetType(INTEGRATION_TYPE)
+		msg.SetLogger("integration")
+		msg.SetPayload(payload)
+		if err = c.SendMessage(msg); err != nil {
+			t.Fatalf("sending to %s: %s", address, err)
+		}
+	}
+}
+
+// Returns the lines written to the file so far, nil if it doesn't exist yet.
+func ReadLines(path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines
+}
+
+// Waits until the file has at least n lines and returns them, failing the
+// test if it doesn't in time.
+func WaitForLines(t testing.TB, path string, n int) []string {
+	deadline := time.Now().Add(HekadTimeout)
+	for {
+		lines := ReadLines(path)
+		if len(lines) >= n {
+			return lines
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s has %d lines, expected %d", path, len(lines), n)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,276 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"bytes"
+	"container/heap"
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// Filter that tracks the most frequent values of a message variable, e.g.
+// the top client IPs or URLs, over each ticker interval, injecting a ranked
+// summary at the end of each. Values are counted w/ the Space-Saving
+// algorithm, so memory use is bounded by `capacity` however many distinct
+// values there are, at the cost of approximate counts for the rarer ones.
+type TopKFilter struct {
+	missing  int64
+	total    int64
+	variable *hashVariable
+	name     string
+	top      int
+	counter  *spaceSaving
+	start    time.Time
+}
+
+type TopKFilterConfig struct {
+	// Message variable whose values are counted, in the SharderFilter's
+	// `hash_variable` format.
+	Variable string `toml:"variable"`
+	// Number of values in each summary, defaults to 10.
+	Top int `toml:"top"`
+	// Number of values counted at once, defaults to 1000. The more values
+	// beyond the top ones are counted, the more accurate the top counts.
+	Capacity int `toml:"capacity"`
+	// Length of the windows summarized, defaults to 60 seconds.
+	TickerInterval uint `toml:"ticker_interval"`
+}
+
+func (f *TopKFilter) ConfigStruct() interface{} {
+	return &TopKFilterConfig{
+		Top:            10,
+		Capacity:       1000,
+		TickerInterval: 60,
+	}
+}
+
+func (f *TopKFilter) Init(config interface{}) (err error) {
+	conf := config.(*TopKFilterConfig)
+	if conf.Variable == "" {
+		return errors.New("TopKFilter requires a variable")
+	}
+	if f.variable, err = newHashVariable(conf.Variable); err != nil {
+		return fmt.Errorf("TopKFilter %s", err)
+	}
+	if conf.Top <= 0 {
+		return fmt.Errorf("TopKFilter top must be positive, got %d", conf.Top)
+	}
+	if conf.Capacity < conf.Top {
+		return fmt.Errorf("TopKFilter capacity must be at least top, got %d",
+			conf.Capacity)
+	}
+	f.name = conf.Variable
+	f.top = conf.Top
+	f.counter = newSpaceSaving(conf.Capacity)
+	return nil
+}
+
+func (f *TopKFilter) Run(fr FilterRunner, h PluginHelper) (err error) {
+	inChan := fr.InChan()
+	ticker := fr.Ticker()
+	f.start = time.Now()
+	for {
+		select {
+		case pack, ok := <-inChan:
+			if !ok {
+				return nil
+			}
+			f.count(pack.Message)
+			fr.UpdateCursor(pack.QueueCursor)
+			pack.Recycle(nil)
+		case now := <-ticker:
+			if f.counter.total > 0 {
+				pack, err := h.PipelinePack(0)
+				if err != nil {
+					fr.LogError(err)
+				} else {
+					pack.Message.SetLogger(fr.Name())
+					f.summarize(pack.Message, now)
+					fr.Inject(pack)
+				}
+			}
+			f.counter.reset()
+			f.start = now
+		}
+	}
+}
+
+func (f *TopKFilter) CleanupForRestart() {
+	f.counter.reset()
+}
+
+func (f *TopKFilter) count(msg *message.Message) {
+	atomic.AddInt64(&f.total, 1)
+	value, ok := f.variable.value(msg)
+	if !ok {
+		atomic.AddInt64(&f.missing, 1)
+		return
+	}
+	f.counter.add(value)
+}
+
+// Fills the message w/ the summary of the window ending at `end`. The
+// payload holds a line per top value, w/ the value, its count and the count's
+// maximum overestimation, separated by tabs. The same are in the `Values`,
+// `Counts` and `Errors` fields.
+func (f *TopKFilter) summarize(msg *message.Message, end time.Time) {
+	top := f.counter.top(f.top)
+	msg.SetType("heka.topk")
+	msg.SetTimestamp(end.UnixNano())
+	values := message.NewFieldInit("Values", message.Field_STRING, "")
+	counts := message.NewFieldInit("Counts", message.Field_INTEGER, "count")
+	errs := message.NewFieldInit("Errors", message.Field_INTEGER, "count")
+	var payload bytes.Buffer
+	for _, c := range top {
+		fmt.Fprintf(&payload, "%s\t%d\t%d\n", c.value, c.count, c.err)
+		values.AddValue(c.value)
+		counts.AddValue(c.count)
+		errs.AddValue(c.err)
+	}
+	msg.SetPayload(payload.String())
+	if len(top) > 0 {
+		msg.AddField(values)
+		msg.AddField(counts)
+		msg.AddField(errs)
+	}
+	msg.SetString("Variable", f.name)
+	msg.SetInt("Total", f.counter.total)
+	msg.SetInt("WindowStart", f.start.UnixNano())
+}
+
+func (f *TopKFilter) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "ProcessMessageCount", atomic.LoadInt64(&f.total),
+		"count")
+	message.NewInt64Field(msg, "MissingVariableCount",
+		atomic.LoadInt64(&f.missing), "count")
+	return nil
+}
+
+// Space-Saving counter, keeping approximate counts of the most frequent of
+// the values it's given in a fixed number of counters. When a value w/o a
+// counter arrives and all of them are in use, the counter of the least
+// frequent value is handed over to it, w/ the count it had as the new
+// value's maximum error.
+type spaceSaving struct {
+	capacity int
+	total    int64
+	counters map[string]*ssCounter
+	// Min-heap of the counters by count.
+	heap ssHeap
+}
+
+type ssCounter struct {
+	value string
+	count int64
+	err   int64
+	index int
+}
+
+type ssHeap []*ssCounter
+
+func (h ssHeap) Len() int           { return len(h) }
+func (h ssHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h ssHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *ssHeap) Push(x interface{}) {
+	c := x.(*ssCounter)
+	c.index = len(*h)
+	*h = append(*h, c)
+}
+
+func (h *ssHeap) Pop() interface{} {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+func newSpaceSaving(capacity int) *spaceSaving {
+	return &spaceSaving{
+		capacity: capacity,
+		counters: make(map[string]*ssCounter, capacity),
+		heap:     make(ssHeap, 0, capacity),
+	}
+}
+
+func (s *spaceSaving) add(value string) {
+	s.total++
+	if c, ok := s.counters[value]; ok {
+		c.count++
+		heap.Fix(&s.heap, c.index)
+		return
+	}
+	if len(s.heap) < s.capacity {
+		c := &ssCounter{value: value, count: 1}
+		s.counters[value] = c
+		heap.Push(&s.heap, c)
+		return
+	}
+	c := s.heap[0]
+	delete(s.counters, c.value)
+	c.value = value
+	c.err = c.count
+	c.count++
+	s.counters[value] = c
+	heap.Fix(&s.heap, 0)
+}
+
+// Returns copies of the counters of the n most frequent values, most
+// frequent first.
+func (s *spaceSaving) top(n int) []ssCounter {
+	all := make(ssRanking, len(s.heap))
+	for i, c := range s.heap {
+		all[i] = *c
+	}
+	sort.Sort(all)
+	if len(all) > n {
+		all = all[:n]
+	}
+	return all
+}
+
+func (s *spaceSaving) reset() {
+	s.total = 0
+	s.counters = make(map[string]*ssCounter, s.capacity)
+	s.heap = s.heap[:0]
+}
+
+// Sorts counters by decreasing count, then by value.
+type ssRanking []ssCounter
+
+func (r ssRanking) Len() int      { return len(r) }
+func (r ssRanking) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r ssRanking) Less(i, j int) bool {
+	if r[i].count != r[j].count {
+		return r[i].count > r[j].count
+	}
+	return r[i].value < r[j].value
+}
+
+func init() {
+	RegisterPlugin("TopKFilter", func() interface{} {
+		return new(TopKFilter)
+	})
+}
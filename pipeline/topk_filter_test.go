@@ -0,0 +1,118 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func TopKFilterSpec(c gs.Context) {
+	c.Specify("A Space-Saving counter", func() {
+		s := newSpaceSaving(3)
+
+		c.Specify("counts exactly while it has free counters", func() {
+			for _, v := range []string{"a", "b", "a", "c", "a", "b"} {
+				s.add(v)
+			}
+			top := s.top(2)
+			c.Expect(len(top), gs.Equals, 2)
+			c.Expect(top[0].value, gs.Equals, "a")
+			c.Expect(top[0].count, gs.Equals, int64(3))
+			c.Expect(top[1].value, gs.Equals, "b")
+			c.Expect(top[1].count, gs.Equals, int64(2))
+			c.Expect(top[1].err, gs.Equals, int64(0))
+		})
+
+		c.Specify("hands the least frequent counter over to new values", func() {
+			for _, v := range []string{"a", "a", "a", "b", "b", "c", "d"} {
+				s.add(v)
+			}
+			top := s.top(3)
+			c.Expect(top[0].value, gs.Equals, "a")
+			c.Expect(top[2].value, gs.Equals, "d")
+			c.Expect(top[2].count, gs.Equals, int64(2))
+			c.Expect(top[2].err, gs.Equals, int64(1))
+			c.Expect(s.total, gs.Equals, int64(7))
+		})
+
+		c.Specify("finds the heavy hitters among many rare values", func() {
+			s = newSpaceSaving(50)
+			for i := 0; i < 10000; i++ {
+				switch {
+				case i%10 == 0:
+					s.add("hot")
+				case i%25 == 1:
+					s.add("warm")
+				default:
+					s.add(strconv.Itoa(i))
+				}
+			}
+			top := s.top(2)
+			c.Expect(top[0].value, gs.Equals, "hot")
+			c.Expect(top[0].count-top[0].err <= 1000, gs.IsTrue)
+			c.Expect(top[0].count >= 1000, gs.IsTrue)
+			c.Expect(top[1].value, gs.Equals, "warm")
+		})
+	})
+
+	c.Specify("A TopKFilter", func() {
+		filter := new(TopKFilter)
+		config := filter.ConfigStruct().(*TopKFilterConfig)
+		config.Variable = "Fields[remote_addr]"
+
+		c.Specify("requires a valid variable", func() {
+			config.Variable = "remote_addr"
+			c.Expect(filter.Init(config), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("requires a capacity of at least top", func() {
+			config.Capacity = 5
+			c.Expect(filter.Init(config), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("summarizes the top values", func() {
+			config.Top = 2
+			err := filter.Init(config)
+			c.Assume(err, gs.IsNil)
+			filter.start = time.Unix(0, 0)
+			for _, addr := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.1", "10.0.0.3"} {
+				msg := new(message.Message)
+				msg.SetString("remote_addr", addr)
+				filter.count(msg)
+			}
+			filter.count(new(message.Message))
+			c.Expect(filter.missing, gs.Equals, int64(1))
+
+			msg := new(message.Message)
+			filter.summarize(msg, time.Unix(60, 0))
+			c.Expect(msg.GetType(), gs.Equals, "heka.topk")
+			c.Expect(msg.GetTimestamp(), gs.Equals, int64(60e9))
+			c.Expect(msg.GetPayload(), gs.Equals, "10.0.0.1\t2\t0\n10.0.0.2\t1\t0\n")
+			values := msg.FindFirstField("Values")
+			c.Expect(values.ValueString, gs.ContainsInOrder,
+				[]string{"10.0.0.1", "10.0.0.2"})
+			counts := msg.FindFirstField("Counts")
+			c.Expect(counts.ValueInteger, gs.ContainsInOrder, []int64{2, 1})
+			total, _ := msg.GetFieldValue("Total")
+			c.Expect(total, gs.Equals, int64(4))
+			variable, _ := msg.GetFieldValue("Variable")
+			c.Expect(variable, gs.Equals, "Fields[remote_addr]")
+		})
+	})
+}
@@ -0,0 +1,172 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// Type of the messages reporting the timing of a sampled pack.
+const TRACE_MSG_TYPE = "heka.trace"
+
+// Verifies that a trace_sample_rate setting is a fraction of packs.
+func ValidateTraceSampleRate(rate float64) error {
+	if rate < 0 || rate > 1 {
+		return fmt.Errorf("trace_sample_rate must be between 0 and 1, got %v", rate)
+	}
+	return nil
+}
+
+// Returns a plugin's trace sample rate, which overrides the global one if set.
+func traceSampleRate(rate *float64, globals *GlobalConfigStruct) float64 {
+	if rate != nil {
+		return *rate
+	}
+	return globals.TraceSampleRate
+}
+
+// A plugin a traced pack reached, and how long after the pack was sampled.
+type traceStage struct {
+	name   string
+	offset time.Duration
+}
+
+// Timing of a sampled pack's trip through the pipeline, reported in a
+// heka.trace message once the pack is recycled.
+type packTrace struct {
+	tracer *tracer
+	origin string
+	uuid   string
+	start  time.Time
+	lock   sync.Mutex
+	stages []traceStage
+}
+
+// Records that the pack reached the named stage.
+func (t *packTrace) stamp(name string) {
+	offset := time.Since(t.start)
+	t.lock.Lock()
+	t.stages = append(t.stages, traceStage{name, offset})
+	t.lock.Unlock()
+}
+
+// Hands the trace of a pack's message off to be reported, dropping it rather
+// than holding up the pack's recycling if the tracer is falling behind.
+func (t *packTrace) finish(msg *message.Message) {
+	t.stamp("recycled")
+	t.uuid = msg.GetUuidString()
+	select {
+	case t.tracer.traces <- t:
+	default:
+		atomic.AddInt64(&t.tracer.dropCount, 1)
+	}
+}
+
+// Samples packs entering the pipeline and turns their traces into heka.trace
+// messages.
+type tracer struct {
+	traceCount int64
+	dropCount  int64
+	pConfig    *PipelineConfig
+	traces     chan *packTrace
+	stopChan   chan struct{}
+	stopOnce   sync.Once
+}
+
+func newTracer(pConfig *PipelineConfig) *tracer {
+	return &tracer{
+		pConfig:  pConfig,
+		traces:   make(chan *packTrace, pConfig.Globals.PluginChanSize),
+		stopChan: make(chan struct{}),
+	}
+}
+
+// Starts tracing a pack fed into the pipeline by the named plugin w/ the
+// given probability, unless it's already being traced.
+func (t *tracer) sample(pack *PipelinePack, origin string, rate float64) {
+	if rate <= 0 || pack.trace != nil || rand.Float64() >= rate {
+		return
+	}
+	pack.trace = &packTrace{
+		tracer: t,
+		origin: origin,
+		start:  time.Now(),
+		stages: make([]traceStage, 0, 8),
+	}
+	pack.trace.stamp(origin)
+}
+
+func (t *tracer) run() {
+	for {
+		select {
+		case trace := <-t.traces:
+			t.inject(trace)
+		case <-t.stopChan:
+			return
+		}
+	}
+}
+
+func (t *tracer) stop() {
+	t.stopOnce.Do(func() {
+		close(t.stopChan)
+	})
+}
+
+// Injects a heka.trace message w/ one field per stage the trace went
+// through, holding the time in ns at which the stage was reached.
+func (t *tracer) inject(trace *packTrace) {
+	pack, err := t.pConfig.PipelinePack(0)
+	if err != nil {
+		LogError.Printf("can't get pack for trace message: %s", err)
+		return
+	}
+	atomic.AddInt64(&t.traceCount, 1)
+	msg := pack.Message
+	msg.SetLogger(HEKA_DAEMON)
+	msg.SetType(TRACE_MSG_TYPE)
+	message.NewStringField(msg, "origin", trace.origin)
+	if trace.uuid != "" {
+		message.NewStringField(msg, "trace_uuid", trace.uuid)
+	}
+	trace.lock.Lock()
+	names := make([]string, len(trace.stages))
+	for i, stage := range trace.stages {
+		names[i] = stage.name
+		message.NewInt64Field(msg, stage.name, int64(stage.offset), "ns")
+	}
+	total := trace.stages[len(trace.stages)-1].offset
+	trace.lock.Unlock()
+	message.NewInt64Field(msg, "TotalDuration", int64(total), "ns")
+	msg.SetPayload(strings.Join(names, " > "))
+	if err = pack.EncodeMsgBytes(); err != nil {
+		LogError.Printf("encoding trace message: %s", err)
+		pack.recycle()
+		return
+	}
+	t.pConfig.router.InChan() <- pack
+}
+
+func (t *tracer) reportMsg(msg *message.Message) {
+	message.NewInt64Field(msg, "TraceCount", atomic.LoadInt64(&t.traceCount), "count")
+	message.NewInt64Field(msg, "TraceDropCount", atomic.LoadInt64(&t.dropCount), "count")
+}
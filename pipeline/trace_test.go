@@ -0,0 +1,67 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func TraceSpec(c gs.Context) {
+	pConfig := NewPipelineConfig(nil)
+	pConfig.injectRecycleChan <- NewPipelinePack(pConfig.injectRecycleChan)
+	tracer := pConfig.tracer
+	recycleChan := make(chan *PipelinePack, 1)
+
+	c.Specify("A tracer", func() {
+		pack := NewPipelinePack(recycleChan)
+
+		c.Specify("doesn't sample packs w/ a zero rate", func() {
+			tracer.sample(pack, "TestInput", 0)
+			c.Expect(pack.trace, gs.IsNil)
+		})
+
+		c.Specify("reports the stages a sampled pack went through", func() {
+			tracer.sample(pack, "TestInput", 1)
+			c.Assume(pack.trace, gs.Not(gs.IsNil))
+			pack.trace.stamp("router")
+			pack.trace.stamp("TestOutput")
+			pack.recycle()
+			<-recycleChan
+			c.Expect(pack.trace, gs.IsNil)
+
+			trace := <-tracer.traces
+			tracer.inject(trace)
+			tracePack := <-pConfig.router.InChan()
+			msg := tracePack.Message
+			c.Expect(msg.GetType(), gs.Equals, TRACE_MSG_TYPE)
+			c.Expect(msg.GetPayload(), gs.Equals,
+				"TestInput > router > TestOutput > recycled")
+			origin, _ := msg.GetFieldValue("origin")
+			c.Expect(origin, gs.Equals, "TestInput")
+			for _, stage := range []string{"TestInput", "router", "TestOutput",
+				"recycled", "TotalDuration"} {
+
+				_, ok := msg.GetFieldValue(stage)
+				c.Expect(ok, gs.IsTrue)
+			}
+			c.Expect(tracer.traceCount, gs.Equals, int64(1))
+		})
+
+		c.Specify("validates sample rates", func() {
+			c.Expect(ValidateTraceSampleRate(0.01), gs.IsNil)
+			c.Expect(ValidateTraceSampleRate(1.5), gs.Not(gs.IsNil))
+		})
+	})
+}
@@ -0,0 +1,158 @@
+// +build !windows
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// How long an upgrade waits for the new hekad to load its config.
+const upgradeReadyTimeout = 30 * time.Second
+
+// Kept open until this hekad exits, the new hekad it was upgraded to waits
+// for it to be closed before using the base_dir.
+var upgradeExitPipe *os.File
+
+// Restores the non-blocking mode of a socket's duplicated file, which is
+// shared w/ the socket still in use.
+func setNonblock(f *os.File) {
+	syscall.SetNonblock(int(f.Fd()), true)
+}
+
+// Starts the hekad binary this one was started as, which may have been
+// replaced since, w/ the same arguments, handing over the listening sockets.
+// Returns the new hekad's pid once it has loaded its config. The new hekad
+// then waits for this one to exit before going on, so this hekad must be
+// shut down.
+func startUpgrade() (pid int, err error) {
+	path, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return 0, err
+	}
+	keys, files := handoverFiles()
+	defer func() {
+		// The new hekad has its own copies.
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	listeners, err := json.Marshal(keys)
+	if err != nil {
+		return 0, err
+	}
+	exitR, exitW, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer exitR.Close()
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		exitW.Close()
+		return 0, err
+	}
+	defer readyR.Close()
+
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), HANDOVER_LISTENERS_ENV+"="+string(listeners))
+	cmd.ExtraFiles = append([]*os.File{exitR, readyW}, files...)
+	err = cmd.Start()
+	readyW.Close()
+	// Starting the process puts the shared sockets in blocking mode.
+	for _, f := range files {
+		setNonblock(f)
+	}
+	if err != nil {
+		exitW.Close()
+		return 0, err
+	}
+
+	ready := make(chan error, 1)
+	go func() {
+		_, err := readyR.Read(make([]byte, 1))
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+		if err == io.EOF {
+			err = errors.New("exited before loading its config")
+		}
+	case <-time.After(upgradeReadyTimeout):
+		err = errors.New("timed out loading its config")
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		exitW.Close()
+		return 0, fmt.Errorf("new hekad %s", err)
+	}
+	upgradeExitPipe = exitW
+	return cmd.Process.Pid, nil
+}
+
+// Takes over the sockets handed over by the hekad that started this one to
+// upgrade itself and checks the config w/ check. Unless that fails, tells
+// the upgraded hekad the config has been loaded and waits for it to exit.
+// Returns false right away if this hekad wasn't started by an upgrade.
+func AwaitHandover(check func() error) (bool, error) {
+	listeners := os.Getenv(HANDOVER_LISTENERS_ENV)
+	if listeners == "" {
+		return false, nil
+	}
+	os.Unsetenv(HANDOVER_LISTENERS_ENV)
+	var keys []string
+	if err := json.Unmarshal([]byte(listeners), &keys); err != nil {
+		return true, fmt.Errorf("can't parse %s: %s", HANDOVER_LISTENERS_ENV, err)
+	}
+
+	// The pipes come first, then the sockets in the order of their keys.
+	exitPipe := os.NewFile(3, "upgrade-exit")
+	readyPipe := os.NewFile(4, "upgrade-ready")
+	handover.Lock()
+	for i, key := range keys {
+		handover.inherited[key] = os.NewFile(uintptr(5+i), key)
+	}
+	handover.Unlock()
+
+	// The upgraded hekad keeps running if the ready pipe is closed w/o
+	// anything written to it.
+	if err := check(); err != nil {
+		readyPipe.Close()
+		exitPipe.Close()
+		return true, err
+	}
+	_, err := readyPipe.Write([]byte{1})
+	readyPipe.Close()
+	if err != nil {
+		return true, fmt.Errorf("can't signal the upgraded hekad: %s", err)
+	}
+	LogInfo.Printf("Took over %d sockets, waiting for hekad %d to exit", len(keys),
+		os.Getppid())
+	// Nothing is written to the pipe, it's closed when the upgraded hekad
+	// exits.
+	_, err = ioutil.ReadAll(exitPipe)
+	exitPipe.Close()
+	return true, err
+}
@@ -0,0 +1,226 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package plugins
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+)
+
+// A message flow expected to keep a minimum rate.
+type AbsenceFlow struct {
+	// Message matcher selecting the flow's messages among the filter's.
+	Matcher string
+	// Length in seconds of the window the messages are counted over.
+	Window uint
+	// Number of messages expected in every window, defaults to 1, i.e. the
+	// flow is absent when it has been silent for a whole window.
+	MinCount int `toml:"min_count"`
+}
+
+type AbsenceFilterConfig struct {
+	// Flows keyed by name.
+	Flows map[string]AbsenceFlow `toml:"flows"`
+	// Type of the alert messages, defaults to "heka.absence".
+	MessageType string `toml:"message_type"`
+	// Defaults to checking the flows every 10 seconds.
+	TickerInterval uint `toml:"ticker_interval"`
+}
+
+// Filter that alerts when expected message flows go silent, or drop below
+// their minimum rate, e.g. because an app stopped logging.
+type AbsenceFilter struct {
+	messageType string
+	flows       []*absenceFlow
+	started     time.Time
+	now         func() time.Time
+}
+
+type absenceFlow struct {
+	name     string
+	matcher  *message.MatcherSpecification
+	window   time.Duration
+	minCount int
+	// Arrival times of the last minCount messages, a ring w/ next pointing
+	// at the oldest.
+	arrivals []time.Time
+	next     int
+	absent   bool
+}
+
+// Records a message's arrival.
+func (af *absenceFlow) record(t time.Time) {
+	af.arrivals[af.next] = t
+	af.next = (af.next + 1) % len(af.arrivals)
+}
+
+// Returns the number of messages, up to minCount, that arrived in the window
+// ending at `now`.
+func (af *absenceFlow) count(now time.Time) int {
+	since := now.Add(-af.window)
+	n := 0
+	for _, t := range af.arrivals {
+		if t.After(since) {
+			n++
+		}
+	}
+	return n
+}
+
+// Returns the last arrival time, zero if no message arrived yet.
+func (af *absenceFlow) lastSeen() time.Time {
+	return af.arrivals[(af.next+len(af.arrivals)-1)%len(af.arrivals)]
+}
+
+func (f *AbsenceFilter) ConfigStruct() interface{} {
+	return &AbsenceFilterConfig{
+		MessageType:    "heka.absence",
+		TickerInterval: 10,
+	}
+}
+
+func (f *AbsenceFilter) Init(config interface{}) (err error) {
+	conf := config.(*AbsenceFilterConfig)
+	if len(conf.Flows) == 0 {
+		return errors.New("AbsenceFilter requires at least one flow")
+	}
+	f.flows = make([]*absenceFlow, 0, len(conf.Flows))
+	for name, flow := range conf.Flows {
+		if flow.Window == 0 {
+			return fmt.Errorf("AbsenceFilter flow '%s' needs a positive window", name)
+		}
+		if flow.MinCount == 0 {
+			flow.MinCount = 1
+		}
+		if flow.MinCount < 0 {
+			return fmt.Errorf("AbsenceFilter flow '%s' min_count can't be negative",
+				name)
+		}
+		af := &absenceFlow{
+			name:     name,
+			window:   time.Duration(flow.Window) * time.Second,
+			minCount: flow.MinCount,
+			arrivals: make([]time.Time, flow.MinCount),
+		}
+		if flow.Matcher != "" {
+			if af.matcher, err = message.CreateMatcherSpecification(flow.Matcher); err != nil {
+				return fmt.Errorf("AbsenceFilter flow '%s' invalid matcher: %s",
+					name, err)
+			}
+		}
+		f.flows = append(f.flows, af)
+	}
+	// Check and alert in a stable order.
+	sort.Sort(absenceFlowsByName(f.flows))
+	f.messageType = conf.MessageType
+	if f.now == nil {
+		f.now = time.Now
+	}
+	f.started = f.now()
+	return nil
+}
+
+func (f *AbsenceFilter) Run(fr FilterRunner, h PluginHelper) (err error) {
+	inChan := fr.InChan()
+	ticker := fr.Ticker()
+	for {
+		select {
+		case pack, ok := <-inChan:
+			if !ok {
+				return nil
+			}
+			f.update(pack.Message)
+			fr.UpdateCursor(pack.QueueCursor)
+			pack.Recycle(nil)
+		case <-ticker:
+			now := f.now()
+			for _, af := range f.check(now) {
+				pack, err := h.PipelinePack(0)
+				if err != nil {
+					fr.LogError(err)
+					continue
+				}
+				f.fill(pack.Message, af, now)
+				pack.Message.SetLogger(fr.Name())
+				fr.Inject(pack)
+			}
+		}
+	}
+}
+
+// Records the message's arrival in the flows it belongs to.
+func (f *AbsenceFilter) update(msg *message.Message) {
+	now := f.now()
+	for _, af := range f.flows {
+		if af.matcher == nil || af.matcher.Match(msg) {
+			af.record(now)
+		}
+	}
+}
+
+// Returns the flows that became absent or recovered. A flow isn't absent
+// before a whole window has passed since the filter started.
+func (f *AbsenceFilter) check(now time.Time) (changed []*absenceFlow) {
+	for _, af := range f.flows {
+		if now.Sub(f.started) < af.window {
+			continue
+		}
+		absent := af.count(now) < af.minCount
+		if absent != af.absent {
+			af.absent = absent
+			changed = append(changed, af)
+		}
+	}
+	return changed
+}
+
+// Populates the message w/ the flow's alert.
+func (f *AbsenceFilter) fill(msg *message.Message, af *absenceFlow, now time.Time) {
+	msg.SetType(f.messageType)
+	msg.SetTimestamp(now.UnixNano())
+	status := "recovered"
+	if af.absent {
+		status = "absent"
+		msg.SetPayload(fmt.Sprintf("flow '%s' received fewer than %d messages "+
+			"in the last %s", af.name, af.minCount, af.window))
+	} else {
+		msg.SetPayload(fmt.Sprintf("flow '%s' recovered", af.name))
+	}
+	msg.SetString("flow", af.name)
+	msg.SetString("status", status)
+	msg.SetInt("count", int64(af.count(now)))
+	msg.SetInt("min_count", int64(af.minCount))
+	msg.SetInt("window", int64(af.window/time.Second))
+	if last := af.lastSeen(); !last.IsZero() {
+		msg.SetInt("last_seen", last.UnixNano())
+	}
+}
+
+type absenceFlowsByName []*absenceFlow
+
+func (s absenceFlowsByName) Len() int           { return len(s) }
+func (s absenceFlowsByName) Less(i, j int) bool { return s[i].name < s[j].name }
+func (s absenceFlowsByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func init() {
+	RegisterPlugin("AbsenceFilter", func() interface{} {
+		return new(AbsenceFilter)
+	})
+}
@@ -0,0 +1,115 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package plugins
+
+import (
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func AbsenceFilterSpec(c gs.Context) {
+	c.Specify("An AbsenceFilter", func() {
+		filter := new(AbsenceFilter)
+		config := filter.ConfigStruct().(*AbsenceFilterConfig)
+		config.Flows = map[string]AbsenceFlow{
+			"app":    {Matcher: "Logger == 'app'", Window: 60},
+			"access": {Matcher: "Logger == 'nginx'", Window: 60, MinCount: 3},
+		}
+		now := time.Unix(1000000000, 0)
+		filter.now = func() time.Time { return now }
+
+		receive := func(logger string, count int) {
+			msg := new(message.Message)
+			msg.SetLogger(logger)
+			for i := 0; i < count; i++ {
+				filter.update(msg)
+			}
+		}
+		names := func(flows []*absenceFlow) []string {
+			s := make([]string, len(flows))
+			for i, af := range flows {
+				s[i] = af.name
+			}
+			return s
+		}
+
+		c.Specify("requires a window", func() {
+			config.Flows["app"] = AbsenceFlow{Matcher: "TRUE"}
+			c.Expect(filter.Init(config), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("rejects an invalid matcher", func() {
+			config.Flows["app"] = AbsenceFlow{Matcher: "Logger ==", Window: 60}
+			c.Expect(filter.Init(config), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("is initialized", func() {
+			err := filter.Init(config)
+			c.Assume(err, gs.IsNil)
+
+			c.Specify("waits a window after starting", func() {
+				now = now.Add(30 * time.Second)
+				c.Expect(len(filter.check(now)), gs.Equals, 0)
+				now = now.Add(30 * time.Second)
+				c.Expect(names(filter.check(now)), gs.ContainsInOrder,
+					[]string{"access", "app"})
+			})
+
+			c.Specify("alerts once when a flow goes silent", func() {
+				now = now.Add(50 * time.Second)
+				receive("app", 1)
+				receive("nginx", 5)
+				now = now.Add(20 * time.Second)
+				c.Expect(len(filter.check(now)), gs.Equals, 0)
+				now = now.Add(50 * time.Second)
+				c.Expect(names(filter.check(now)), gs.ContainsInOrder,
+					[]string{"access", "app"})
+				c.Expect(len(filter.check(now.Add(10*time.Second))), gs.Equals, 0)
+
+				c.Specify("and when it recovers", func() {
+					receive("app", 1)
+					c.Expect(names(filter.check(now)), gs.ContainsInOrder,
+						[]string{"app"})
+					msg := new(message.Message)
+					filter.fill(msg, filter.flows[1], now)
+					c.Expect(msg.GetType(), gs.Equals, "heka.absence")
+					value, _ := msg.GetFieldValue("status")
+					c.Expect(value, gs.Equals, "recovered")
+					value, _ = msg.GetFieldValue("last_seen")
+					c.Expect(value, gs.Equals, now.UnixNano())
+				})
+			})
+
+			c.Specify("alerts when a flow drops below its rate", func() {
+				now = now.Add(50 * time.Second)
+				receive("app", 1)
+				receive("nginx", 2)
+				now = now.Add(20 * time.Second)
+				changed := filter.check(now)
+				c.Expect(names(changed), gs.ContainsInOrder, []string{"access"})
+				msg := new(message.Message)
+				filter.fill(msg, changed[0], now)
+				value, _ := msg.GetFieldValue("status")
+				c.Expect(value, gs.Equals, "absent")
+				value, _ = msg.GetFieldValue("count")
+				c.Expect(value, gs.Equals, int64(2))
+				value, _ = msg.GetFieldValue("min_count")
+				c.Expect(value, gs.Equals, int64(3))
+			})
+		})
+	})
+}
@@ -24,6 +24,12 @@ func TestAllSpecs(t *testing.T) {
 	r.Parallel = false
 
 	r.AddSpec(LoadFromConfigSpec)
+	r.AddSpec(JsonDecoderSpec)
+	r.AddSpec(MutateDecoderSpec)
+	r.AddSpec(KvDecoderSpec)
+	r.AddSpec(AbsenceFilterSpec)
+	r.AddSpec(ForecastFilterSpec)
+	r.AddSpec(XmlDecoderSpec)
 	r.AddSpec(ScribbleDecoderSpec)
 	r.AddSpec(PayloadEncoderSpec)
 	r.AddSpec(RstEncoderSpec)
@@ -0,0 +1,206 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package check
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"github.com/pborman/uuid"
+)
+
+type CheckInputConfig struct {
+	// Endpoints to check, as URLs whose scheme selects the check:
+	// "icmp://host" pings the host, "tcp://host:port" connects to the port,
+	// and "http://..." or "https://..." GETs the URL.
+	Targets []string
+	// Seconds between checks. Defaults to 10.
+	TickerInterval uint `toml:"ticker_interval"`
+	// Milliseconds a check may take before it fails. Defaults to 5000.
+	Timeout uint
+	// Use raw sockets for pings. See checkICMP. Defaults to false.
+	IcmpPrivileged bool `toml:"icmp_privileged"`
+	// Severity level of successful checks. Defaults to 6 (information).
+	SuccessSeverity int32 `toml:"success_severity"`
+	// Severity level of failed checks. Defaults to 1 (alert).
+	ErrorSeverity int32 `toml:"error_severity"`
+}
+
+type checkTarget struct {
+	name     string // As configured.
+	protocol string
+	address  string
+}
+
+// Input plugin that periodically checks the availability of endpoints,
+// reporting each check's outcome and latency.
+type CheckInput struct {
+	conf     *CheckInputConfig
+	targets  []checkTarget
+	timeout  time.Duration
+	client   *http.Client
+	stop     chan struct{}
+	runner   pipeline.InputRunner
+	hostname string
+}
+
+func (input *CheckInput) ConfigStruct() interface{} {
+	return &CheckInputConfig{
+		TickerInterval:  10,
+		Timeout:         5000,
+		SuccessSeverity: 6,
+		ErrorSeverity:   1,
+	}
+}
+
+func (input *CheckInput) Init(config interface{}) error {
+	input.conf = config.(*CheckInputConfig)
+	if len(input.conf.Targets) == 0 {
+		return errors.New("no `targets` configured")
+	}
+	if input.conf.Timeout == 0 {
+		return errors.New("`timeout` must be greater than 0")
+	}
+	input.targets = input.targets[:0]
+	for _, t := range input.conf.Targets {
+		target, err := parseTarget(t)
+		if err != nil {
+			return fmt.Errorf("invalid target '%s': %s", t, err)
+		}
+		input.targets = append(input.targets, target)
+	}
+	input.timeout = time.Duration(input.conf.Timeout) * time.Millisecond
+	input.client = &http.Client{Timeout: input.timeout}
+	input.stop = make(chan struct{})
+	return nil
+}
+
+func parseTarget(target string) (checkTarget, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return checkTarget{}, err
+	}
+	t := checkTarget{name: target, protocol: u.Scheme}
+	switch u.Scheme {
+	case "icmp":
+		if u.Host == "" {
+			return t, errors.New("no host")
+		}
+		t.address = u.Host
+	case "tcp":
+		if _, _, err = net.SplitHostPort(u.Host); err != nil {
+			return t, err
+		}
+		t.address = u.Host
+	case "http", "https":
+		if u.Host == "" {
+			return t, errors.New("no host")
+		}
+		t.protocol = "http"
+		t.address = target
+	default:
+		return t, fmt.Errorf("unsupported scheme '%s'", u.Scheme)
+	}
+	return t, nil
+}
+
+func (input *CheckInput) Stop() {
+	close(input.stop)
+}
+
+func (input *CheckInput) Run(runner pipeline.InputRunner,
+	helper pipeline.PluginHelper) error {
+
+	input.runner = runner
+	input.hostname = helper.Hostname()
+	tickChan := runner.Ticker()
+	packSupply := runner.InChan()
+
+	for {
+		select {
+		case <-input.stop:
+			return nil
+		case <-tickChan:
+		}
+		now := time.Now()
+		results := input.runChecks()
+		for i, r := range results {
+			pack := <-packSupply
+			input.populate(pack.Message, input.targets[i], r, now)
+			runner.Deliver(pack)
+		}
+	}
+}
+
+// Checks all the targets concurrently, so a target that's timing out doesn't
+// delay the checks of the others.
+func (input *CheckInput) runChecks() []checkResult {
+	results := make([]checkResult, len(input.targets))
+	var wg sync.WaitGroup
+	wg.Add(len(input.targets))
+	for i, t := range input.targets {
+		go func(i int, t checkTarget) {
+			defer wg.Done()
+			switch t.protocol {
+			case "icmp":
+				results[i] = checkICMP(t.address, input.timeout, input.conf.IcmpPrivileged)
+			case "tcp":
+				results[i] = checkTCP(t.address, input.timeout)
+			case "http":
+				results[i] = checkHTTP(input.client, t.address)
+			}
+		}(i, t)
+	}
+	wg.Wait()
+	return results
+}
+
+func (input *CheckInput) populate(msg *message.Message, t checkTarget,
+	r checkResult, now time.Time) {
+
+	msg.SetUuid(uuid.NewRandom())
+	msg.SetTimestamp(now.UnixNano())
+	msg.SetType("heka.check")
+	msg.SetLogger(t.name)
+	msg.SetHostname(input.hostname)
+
+	message.NewStringField(msg, "Protocol", t.protocol)
+	field, _ := message.NewField("Success", r.err == nil, "")
+	msg.AddField(field)
+	if r.statusCode != 0 {
+		message.NewIntField(msg, "StatusCode", r.statusCode, "")
+	}
+	if r.err != nil {
+		msg.SetSeverity(input.conf.ErrorSeverity)
+		msg.SetPayload(r.err.Error())
+		return
+	}
+	msg.SetSeverity(input.conf.SuccessSeverity)
+	field, _ = message.NewField("Latency", r.latency.Seconds()*1000, "ms")
+	msg.AddField(field)
+}
+
+func init() {
+	pipeline.RegisterPlugin("CheckInput", func() interface{} {
+		return new(CheckInput)
+	})
+}
@@ -0,0 +1,104 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package check
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func CheckInputSpec(c gs.Context) {
+	c.Specify("A CheckInput", func() {
+		input := new(CheckInput)
+		config := input.ConfigStruct().(*CheckInputConfig)
+
+		c.Specify("rejects unsupported targets", func() {
+			config.Targets = []string{"gopher://example.com"}
+			err := input.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+			config.Targets = []string{"tcp://example.com"}
+			err = input.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("checks TCP ports", func() {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			c.Assume(err, gs.IsNil)
+			open := listener.Addr().String()
+			// Nothing listens on a port that was just closed.
+			closing, err := net.Listen("tcp", "127.0.0.1:0")
+			c.Assume(err, gs.IsNil)
+			closed := closing.Addr().String()
+			closing.Close()
+			defer listener.Close()
+
+			config.Targets = []string{"tcp://" + open, "tcp://" + closed}
+			err = input.Init(config)
+			c.Assume(err, gs.IsNil)
+			results := input.runChecks()
+			c.Assume(len(results), gs.Equals, 2)
+			c.Expect(results[0].err, gs.IsNil)
+			c.Expect(results[1].err, gs.Not(gs.IsNil))
+
+			msg := new(message.Message)
+			input.populate(msg, input.targets[0], results[0], time.Now())
+			c.Expect(msg.GetType(), gs.Equals, "heka.check")
+			c.Expect(msg.GetLogger(), gs.Equals, "tcp://"+open)
+			c.Expect(msg.GetSeverity(), gs.Equals, int32(6))
+			success, _ := msg.GetFieldValue("Success")
+			c.Expect(success, gs.Equals, true)
+			_, ok := msg.GetFieldValue("Latency")
+			c.Expect(ok, gs.IsTrue)
+
+			msg = new(message.Message)
+			input.populate(msg, input.targets[1], results[1], time.Now())
+			c.Expect(msg.GetSeverity(), gs.Equals, int32(1))
+			success, _ = msg.GetFieldValue("Success")
+			c.Expect(success, gs.Equals, false)
+			c.Expect(msg.GetPayload(), gs.Not(gs.Equals), "")
+		})
+
+		c.Specify("checks HTTP URLs", func() {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+				r *http.Request) {
+
+				if r.URL.Path == "/broken" {
+					w.WriteHeader(http.StatusInternalServerError)
+				}
+			}))
+			defer ts.Close()
+
+			config.Targets = []string{ts.URL + "/ok", ts.URL + "/broken"}
+			err := input.Init(config)
+			c.Assume(err, gs.IsNil)
+			results := input.runChecks()
+			c.Assume(len(results), gs.Equals, 2)
+			c.Expect(results[0].err, gs.IsNil)
+			c.Expect(results[0].statusCode, gs.Equals, 200)
+			c.Expect(results[1].err, gs.Not(gs.IsNil))
+			c.Expect(results[1].statusCode, gs.Equals, 500)
+
+			msg := new(message.Message)
+			input.populate(msg, input.targets[1], results[1], time.Now())
+			status, _ := msg.GetFieldValue("StatusCode")
+			c.Expect(status, gs.Equals, int64(500))
+		})
+	})
+}
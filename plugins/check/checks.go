@@ -0,0 +1,140 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package check
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// The outcome of a single check.
+type checkResult struct {
+	latency    time.Duration
+	statusCode int // HTTP checks only.
+	err        error
+}
+
+// Checks that a TCP connection can be established to the address.
+func checkTCP(addr string, timeout time.Duration) (r checkResult) {
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		r.err = err
+		return
+	}
+	r.latency = time.Since(start)
+	conn.Close()
+	return
+}
+
+// Checks that a GET of the url succeeds. The latency includes reading the
+// whole response body. Responses w/ a status code >= 400 are failures.
+func checkHTTP(client *http.Client, url string) (r checkResult) {
+	start := time.Now()
+	resp, err := client.Get(url)
+	if err != nil {
+		r.err = err
+		return
+	}
+	defer resp.Body.Close()
+	r.statusCode = resp.StatusCode
+	if _, err = io.Copy(ioutil.Discard, resp.Body); err != nil {
+		r.err = fmt.Errorf("reading the response: %s", err)
+		return
+	}
+	r.latency = time.Since(start)
+	if resp.StatusCode >= 400 {
+		r.err = fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+	return
+}
+
+// ICMP's IANA protocol number, for parsing replies.
+const protocolICMP = 1
+
+var icmpSeq uint32
+
+// Sends an ICMP echo request to the host and waits for the reply. Privileged
+// pings use a raw socket, which requires root or CAP_NET_RAW. Unprivileged
+// ones use a datagram socket, which Linux only allows for the groups in the
+// net.ipv4.ping_group_range sysctl.
+func checkICMP(host string, timeout time.Duration, privileged bool) (r checkResult) {
+	ip, err := net.ResolveIPAddr("ip4", host)
+	if err != nil {
+		r.err = err
+		return
+	}
+	network := "udp4"
+	var dst net.Addr = &net.UDPAddr{IP: ip.IP}
+	if privileged {
+		network = "ip4:icmp"
+		dst = ip
+	}
+	conn, err := icmp.ListenPacket(network, "0.0.0.0")
+	if err != nil {
+		r.err = err
+		return
+	}
+	defer conn.Close()
+
+	seq := int(atomic.AddUint32(&icmpSeq, 1) & 0xffff)
+	data := []byte(fmt.Sprintf("heka check %d", seq))
+	echo := icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{ID: os.Getpid() & 0xffff, Seq: seq, Data: data},
+	}
+	req, err := echo.Marshal(nil)
+	if err != nil {
+		r.err = err
+		return
+	}
+	start := time.Now()
+	conn.SetReadDeadline(start.Add(timeout))
+	if _, err = conn.WriteTo(req, dst); err != nil {
+		r.err = err
+		return
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			r.err = err
+			return
+		}
+		reply, err := icmp.ParseMessage(protocolICMP, buf[:n])
+		if err != nil || reply.Type != ipv4.ICMPTypeEchoReply {
+			continue
+		}
+		// Raw sockets get the replies to everyone's pings. The kernel picks
+		// the ID of unprivileged ones, so those are matched on the data.
+		body, ok := reply.Body.(*icmp.Echo)
+		if !ok || body.Seq != seq || !bytes.Equal(body.Data, data) {
+			continue
+		}
+		r.latency = time.Since(start)
+		return
+	}
+}
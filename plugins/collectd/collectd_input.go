@@ -0,0 +1,199 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package collectd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"github.com/pborman/uuid"
+)
+
+type CollectdInputConfig struct {
+	// Network type ("udp", "udp4" or "udp6"). Defaults to "udp".
+	Net string
+	// Address to listen on. Defaults to ":25826", collectd's default port.
+	Address string
+	// Which packets to accept: "none" accepts anything, "sign" only signed or
+	// encrypted data and "encrypt" only encrypted data. Defaults to "none".
+	SecurityLevel string `toml:"security_level"`
+	// Path of a collectd auth file w/ the "user: password" lines of the users
+	// that may sign or encrypt data.
+	AuthFile string `toml:"auth_file"`
+	// Paths of collectd types.db files naming the values of each type.
+	TypesDb []string `toml:"types_db"`
+}
+
+// Input plugin that receives value lists and notifications from collectd's
+// network plugin.
+type CollectdInput struct {
+	conf     *CollectdInputConfig
+	listener *net.UDPConn
+	parser   *parser
+	types    map[string][]string
+	stopChan chan struct{}
+}
+
+func (ci *CollectdInput) ConfigStruct() interface{} {
+	return &CollectdInputConfig{
+		Net:           "udp",
+		Address:       ":25826",
+		SecurityLevel: "none",
+	}
+}
+
+func (ci *CollectdInput) Init(config interface{}) (err error) {
+	ci.conf = config.(*CollectdInputConfig)
+	level, ok := securityLevels[ci.conf.SecurityLevel]
+	if !ok {
+		return fmt.Errorf("invalid `security_level`: %s", ci.conf.SecurityLevel)
+	}
+	ci.parser = &parser{level: level}
+	if ci.conf.AuthFile != "" {
+		if ci.parser.passwords, err = readAuthFile(ci.conf.AuthFile); err != nil {
+			return fmt.Errorf("can't read `auth_file`: %s", err)
+		}
+	} else if level != securityNone {
+		return errors.New("`auth_file` is required w/ a `security_level`")
+	}
+	ci.types = make(map[string][]string)
+	for _, path := range ci.conf.TypesDb {
+		if err = readTypesDb(path, ci.types); err != nil {
+			return fmt.Errorf("can't read `types_db`: %s", err)
+		}
+	}
+
+	udpAddr, err := net.ResolveUDPAddr(ci.conf.Net, ci.conf.Address)
+	if err != nil {
+		return fmt.Errorf("ResolveUDPAddr failed: %s", err)
+	}
+	if ci.listener, err = net.ListenUDP(ci.conf.Net, udpAddr); err != nil {
+		return fmt.Errorf("ListenUDP failed: %s", err)
+	}
+	ci.stopChan = make(chan struct{})
+	return nil
+}
+
+func (ci *CollectdInput) Run(ir pipeline.InputRunner, h pipeline.PluginHelper) error {
+	packSupply := ir.InChan()
+	// The largest possible UDP payload, collectd's packets are much smaller.
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := ci.listener.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-ci.stopChan:
+				return nil
+			default:
+			}
+			ir.LogError(fmt.Errorf("read error: %s", err))
+			continue
+		}
+		records, err := ci.parser.parse(buf[:n])
+		if err != nil {
+			ir.LogError(fmt.Errorf("dropped packet from %s: %s", addr.IP, err))
+			continue
+		}
+		for _, r := range records {
+			pack := <-packSupply
+			ci.populate(pack.Message, r, ir.Name(), addr)
+			ir.Deliver(pack)
+		}
+	}
+}
+
+// Message severities of collectd's notification severities.
+var notificationSeverities = map[uint64]int32{
+	1: 2, // Failure, critical.
+	2: 4, // Warning.
+	4: 6, // Okay, informational.
+}
+
+func (ci *CollectdInput) populate(msg *message.Message, r *record, name string,
+	addr *net.UDPAddr) {
+
+	msg.SetUuid(uuid.NewRandom())
+	if r.time.IsZero() {
+		msg.SetTimestamp(time.Now().UnixNano())
+	} else {
+		msg.SetTimestamp(r.time.UnixNano())
+	}
+	msg.SetLogger(name)
+	// Packets w/o a host part are attributed to their sender.
+	if r.host != "" {
+		msg.SetHostname(r.host)
+	} else {
+		msg.SetHostname(addr.IP.String())
+	}
+
+	message.NewStringField(msg, "Plugin", r.plugin)
+	if r.pluginInstance != "" {
+		message.NewStringField(msg, "PluginInstance", r.pluginInstance)
+	}
+	message.NewStringField(msg, "Type", r.typ)
+	if r.typeInstance != "" {
+		message.NewStringField(msg, "TypeInstance", r.typeInstance)
+	}
+
+	if r.notification {
+		msg.SetType("heka.collectd.notification")
+		if severity, ok := notificationSeverities[r.severity]; ok {
+			msg.SetSeverity(severity)
+		}
+		msg.SetPayload(r.message)
+		return
+	}
+
+	msg.SetType("heka.collectd")
+	if r.interval > 0 {
+		field, _ := message.NewField("Interval", r.interval.Seconds(), "s")
+		msg.AddField(field)
+	}
+	names := ci.types[r.typ]
+	for i, value := range r.values {
+		field, _ := message.NewField(valueName(names, len(r.values), i), value,
+			dsTypeNames[r.dsTypes[i]])
+		msg.AddField(field)
+	}
+}
+
+// Returns the field name of a value, from the type's data source names if
+// they're known, or else "value" for a single value and "value0", "value1",
+// etc. for several of them.
+func valueName(names []string, count, i int) string {
+	if len(names) == count {
+		return names[i]
+	}
+	if count == 1 {
+		return "value"
+	}
+	return "value" + strconv.Itoa(i)
+}
+
+func (ci *CollectdInput) Stop() {
+	close(ci.stopChan)
+	ci.listener.Close()
+}
+
+func init() {
+	pipeline.RegisterPlugin("CollectdInput", func() interface{} {
+		return new(CollectdInput)
+	})
+}
@@ -0,0 +1,276 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package collectd
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	"github.com/mozilla-services/heka/pipelinemock"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+// Builds packets the way collectd's network plugin does.
+type packetBuilder []byte
+
+func (b *packetBuilder) part(typ uint16, body []byte) *packetBuilder {
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint16(header, typ)
+	binary.BigEndian.PutUint16(header[2:], uint16(4+len(body)))
+	*b = append(append(*b, header...), body...)
+	return b
+}
+
+func (b *packetBuilder) str(typ uint16, s string) *packetBuilder {
+	return b.part(typ, append([]byte(s), 0))
+}
+
+func (b *packetBuilder) number(typ uint16, n uint64) *packetBuilder {
+	body := make([]byte, 8)
+	binary.BigEndian.PutUint64(body, n)
+	return b.part(typ, body)
+}
+
+func (b *packetBuilder) values(dsTypes []byte, values ...float64) *packetBuilder {
+	body := make([]byte, 2+len(values)*9)
+	binary.BigEndian.PutUint16(body, uint16(len(values)))
+	copy(body[2:], dsTypes)
+	data := body[2+len(values):]
+	for i, v := range values {
+		if dsTypes[i] == dsGauge {
+			binary.LittleEndian.PutUint64(data[i*8:], math.Float64bits(v))
+		} else {
+			binary.BigEndian.PutUint64(data[i*8:], uint64(v))
+		}
+	}
+	return b.part(partValues, body)
+}
+
+func signPacket(user, password string, data []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(password))
+	mac.Write([]byte(user))
+	mac.Write(data)
+	signed := new(packetBuilder)
+	signed.part(partSignature, append(mac.Sum(nil), user...))
+	return append(*signed, data...)
+}
+
+func encryptPacket(user, password string, data []byte) []byte {
+	hash := sha1.Sum(data)
+	plain := append(hash[:], data...)
+	key := sha256.Sum256([]byte(password))
+	block, _ := aes.NewCipher(key[:])
+	iv := make([]byte, aes.BlockSize)
+	for i := range iv {
+		iv[i] = byte(i)
+	}
+	encrypted := make([]byte, len(plain))
+	cipher.NewOFB(block, iv).XORKeyStream(encrypted, plain)
+
+	body := make([]byte, 2)
+	binary.BigEndian.PutUint16(body, uint16(len(user)))
+	body = append(append(append(body, user...), iv...), encrypted...)
+	packet := new(packetBuilder)
+	return *packet.part(partEncryption, body)
+}
+
+func CollectdInputSpec(c gs.Context) {
+	t := new(pipeline_ts.SimpleT)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	tmpDir, err := ioutil.TempDir("", "collectd-test")
+	c.Assume(err, gs.IsNil)
+	defer os.RemoveAll(tmpDir)
+	authFile := filepath.Join(tmpDir, "passwd")
+	err = ioutil.WriteFile(authFile, []byte("# Users\nalice: secret\n"), 0600)
+	c.Assume(err, gs.IsNil)
+	typesDb := filepath.Join(tmpDir, "types.db")
+	err = ioutil.WriteFile(typesDb, []byte(
+		"load  shortterm:GAUGE:0:5000, midterm:GAUGE:0:5000, longterm:GAUGE:0:5000\n"), 0644)
+	c.Assume(err, gs.IsNil)
+
+	packet := new(packetBuilder)
+	packet.str(partHost, "web1").number(partTimeHR, 1400000000<<30|1<<29).
+		number(partIntervalHR, 10<<30).str(partPlugin, "interface").
+		str(partPluginInstance, "eth0").str(partType, "if_octets").
+		values([]byte{dsDerive, dsDerive}, 1000, 2000).
+		str(partPlugin, "load").str(partPluginInstance, "").str(partType, "load").
+		values([]byte{dsGauge, dsGauge, dsGauge}, 0.5, 0.25, 0.125)
+	data := []byte(*packet)
+
+	c.Specify("A collectd packet parser", func() {
+		p := &parser{level: securityNone, passwords: map[string]string{"alice": "secret"}}
+
+		c.Specify("parses value lists", func() {
+			records, err := p.parse(data)
+			c.Assume(err, gs.IsNil)
+			c.Assume(len(records), gs.Equals, 2)
+			r := records[0]
+			c.Expect(r.host, gs.Equals, "web1")
+			c.Expect(r.plugin, gs.Equals, "interface")
+			c.Expect(r.pluginInstance, gs.Equals, "eth0")
+			c.Expect(r.typ, gs.Equals, "if_octets")
+			c.Expect(r.time.UnixNano(), gs.Equals, int64(1400000000500000000))
+			c.Expect(r.interval, gs.Equals, 10*time.Second)
+			c.Expect(r.values, gs.Equals, []interface{}{int64(1000), int64(2000)})
+			// Previous parts carry over to the next value list.
+			r = records[1]
+			c.Expect(r.host, gs.Equals, "web1")
+			c.Expect(r.pluginInstance, gs.Equals, "")
+			c.Expect(r.values, gs.Equals, []interface{}{0.5, 0.25, 0.125})
+		})
+
+		c.Specify("parses notifications", func() {
+			packet := new(packetBuilder)
+			packet.str(partHost, "web1").number(partTime, 1400000000).
+				str(partPlugin, "df").number(partSeverity, 1).
+				str(partMessage, "Disk full")
+			records, err := p.parse(*packet)
+			c.Assume(err, gs.IsNil)
+			c.Assume(len(records), gs.Equals, 1)
+			c.Expect(records[0].notification, gs.IsTrue)
+			c.Expect(records[0].severity, gs.Equals, uint64(1))
+			c.Expect(records[0].message, gs.Equals, "Disk full")
+		})
+
+		c.Specify("rejects malformed parts", func() {
+			_, err := p.parse(data[:len(data)-3])
+			c.Expect(err, gs.Not(gs.IsNil))
+			packet := new(packetBuilder)
+			packet.part(partHost, []byte("web1"))
+			_, err = p.parse(*packet)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("decrypts encrypted data", func() {
+			records, err := p.parse(encryptPacket("alice", "secret", data))
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(records), gs.Equals, 2)
+			_, err = p.parse(encryptPacket("alice", "wrong", data))
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("w/ a security level of sign", func() {
+			p.level = securitySign
+
+			c.Specify("accepts correctly signed data", func() {
+				records, err := p.parse(signPacket("alice", "secret", data))
+				c.Expect(err, gs.IsNil)
+				c.Expect(len(records), gs.Equals, 2)
+			})
+
+			c.Specify("accepts encrypted data", func() {
+				records, err := p.parse(encryptPacket("alice", "secret", data))
+				c.Expect(err, gs.IsNil)
+				c.Expect(len(records), gs.Equals, 2)
+			})
+
+			c.Specify("rejects unsigned or badly signed data", func() {
+				_, err := p.parse(data)
+				c.Expect(err, gs.Not(gs.IsNil))
+				_, err = p.parse(signPacket("alice", "wrong", data))
+				c.Expect(err, gs.Not(gs.IsNil))
+				_, err = p.parse(signPacket("bob", "secret", data))
+				c.Expect(err, gs.Not(gs.IsNil))
+			})
+		})
+
+		c.Specify("w/ a security level of encrypt rejects signed data", func() {
+			p.level = securityEncrypt
+			_, err := p.parse(signPacket("alice", "secret", data))
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+
+	c.Specify("A CollectdInput", func() {
+		input := new(CollectdInput)
+		config := input.ConfigStruct().(*CollectdInputConfig)
+		config.Address = "127.0.0.1:0"
+
+		c.Specify("requires an auth file w/ a security level", func() {
+			config.SecurityLevel = "sign"
+			err := input.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("delivers received value lists", func() {
+			config.SecurityLevel = "encrypt"
+			config.AuthFile = authFile
+			config.TypesDb = []string{typesDb}
+			err := input.Init(config)
+			c.Assume(err, gs.IsNil)
+
+			pConfig := NewPipelineConfig(nil)
+			packSupply := make(chan *PipelinePack, 2)
+			for i := 0; i < cap(packSupply); i++ {
+				packSupply <- NewPipelinePack(pConfig.InputRecycleChan())
+			}
+			mockRunner := pipelinemock.NewMockInputRunner(ctrl)
+			mockHelper := pipelinemock.NewMockPluginHelper(ctrl)
+			mockRunner.EXPECT().InChan().Return(packSupply)
+			mockRunner.EXPECT().Name().Return("collectd").AnyTimes()
+			delivered := make(chan *PipelinePack, 2)
+			mockRunner.EXPECT().Deliver(gomock.Any()).Do(func(pack *PipelinePack) {
+				delivered <- pack
+			}).Times(2)
+
+			done := make(chan error)
+			go func() {
+				done <- input.Run(mockRunner, mockHelper)
+			}()
+			conn, err := net.Dial("udp", input.listener.LocalAddr().String())
+			c.Assume(err, gs.IsNil)
+			_, err = conn.Write(encryptPacket("alice", "secret", data))
+			c.Assume(err, gs.IsNil)
+			conn.Close()
+
+			pack := <-delivered
+			msg := pack.Message
+			c.Expect(msg.GetType(), gs.Equals, "heka.collectd")
+			c.Expect(msg.GetHostname(), gs.Equals, "web1")
+			c.Expect(msg.GetLogger(), gs.Equals, "collectd")
+			plugin, _ := msg.GetFieldValue("Plugin")
+			c.Expect(plugin, gs.Equals, "interface")
+			value, _ := msg.GetFieldValue("value1")
+			c.Expect(value, gs.Equals, int64(2000))
+			interval, _ := msg.GetFieldValue("Interval")
+			c.Expect(interval, gs.Equals, 10.0)
+
+			// Named from the types.db.
+			pack = <-delivered
+			value, _ = pack.Message.GetFieldValue("midterm")
+			c.Expect(value, gs.Equals, 0.25)
+			field := pack.Message.FindFirstField("midterm")
+			c.Expect(field.GetRepresentation(), gs.Equals, "gauge")
+
+			input.Stop()
+			c.Expect(<-done, gs.IsNil)
+		})
+	})
+}
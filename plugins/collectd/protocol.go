@@ -0,0 +1,370 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package collectd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+// Part types of collectd's binary network protocol, see
+// https://collectd.org/wiki/index.php/Binary_protocol.
+const (
+	partHost           = 0x0000
+	partTime           = 0x0001
+	partPlugin         = 0x0002
+	partPluginInstance = 0x0003
+	partType           = 0x0004
+	partTypeInstance   = 0x0005
+	partValues         = 0x0006
+	partInterval       = 0x0007
+	partTimeHR         = 0x0008
+	partIntervalHR     = 0x0009
+	partMessage        = 0x0100
+	partSeverity       = 0x0101
+	partSignature      = 0x0200
+	partEncryption     = 0x0210
+)
+
+// Data source types of the values in a values part.
+const (
+	dsCounter  = 0
+	dsGauge    = 1
+	dsDerive   = 2
+	dsAbsolute = 3
+)
+
+var dsTypeNames = map[byte]string{
+	dsCounter:  "counter",
+	dsGauge:    "gauge",
+	dsDerive:   "derive",
+	dsAbsolute: "absolute",
+}
+
+// Which packets are accepted, as w/ collectd's network plugin SecurityLevel.
+type securityLevel int
+
+const (
+	securityNone    securityLevel = iota // Anything, signatures aren't checked.
+	securitySign                         // Only signed or encrypted parts.
+	securityEncrypt                      // Only encrypted parts.
+)
+
+var securityLevels = map[string]securityLevel{
+	"none":    securityNone,
+	"sign":    securitySign,
+	"encrypt": securityEncrypt,
+}
+
+// A value list or a notification from a collectd packet.
+type record struct {
+	host           string
+	plugin         string
+	pluginInstance string
+	typ            string
+	typeInstance   string
+	time           time.Time
+	interval       time.Duration
+	// Set for value lists.
+	dsTypes []byte
+	values  []interface{} // Either int64 or float64.
+	// Set for notifications.
+	notification bool
+	severity     uint64
+	message      string
+}
+
+type parser struct {
+	level     securityLevel
+	passwords map[string]string // By user name.
+}
+
+// Parses a packet into the value lists and notifications it contains. Parts
+// only carry what changed since the previous value list, so each record gets
+// the host, identifier, time and interval read up to its values or message.
+func (p *parser) parse(data []byte) ([]*record, error) {
+	var (
+		state   record
+		records []*record
+	)
+	err := p.parseParts(data, &state, &records, false)
+	return records, err
+}
+
+// Parses the parts in data. secure is true for parts that were decrypted or
+// are covered by a verified signature.
+func (p *parser) parseParts(data []byte, state *record, records *[]*record,
+	secure bool) (err error) {
+
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return errors.New("truncated part header")
+		}
+		typ := binary.BigEndian.Uint16(data)
+		length := int(binary.BigEndian.Uint16(data[2:]))
+		if length < 4 || length > len(data) {
+			return fmt.Errorf("invalid length %d of part type 0x%04x", length, typ)
+		}
+		body, rest := data[4:length], data[length:]
+
+		switch typ {
+		case partSignature:
+			if secure || p.level == securityNone {
+				break
+			}
+			if p.level == securityEncrypt {
+				return errors.New("packet isn't encrypted")
+			}
+			if err = p.verify(body, rest); err != nil {
+				return err
+			}
+			// The signature covers the rest of the packet.
+			return p.parseParts(rest, state, records, true)
+		case partEncryption:
+			var plain []byte
+			if plain, err = p.decrypt(body); err != nil {
+				return err
+			}
+			if err = p.parseParts(plain, state, records, true); err != nil {
+				return err
+			}
+		default:
+			if !secure && p.level != securityNone {
+				return fmt.Errorf("unsigned part 0x%04x", typ)
+			}
+			if err = parsePart(typ, body, state, records); err != nil {
+				return err
+			}
+		}
+		data = rest
+	}
+	return nil
+}
+
+func parsePart(typ uint16, body []byte, state *record, records *[]*record) (err error) {
+	var n uint64
+	switch typ {
+	case partHost:
+		state.host, err = parseString(body)
+	case partPlugin:
+		state.plugin, err = parseString(body)
+	case partPluginInstance:
+		state.pluginInstance, err = parseString(body)
+	case partType:
+		state.typ, err = parseString(body)
+	case partTypeInstance:
+		state.typeInstance, err = parseString(body)
+	case partMessage:
+		if state.message, err = parseString(body); err == nil {
+			r := *state
+			r.notification = true
+			*records = append(*records, &r)
+		}
+	case partTime, partTimeHR, partInterval, partIntervalHR, partSeverity:
+		if n, err = parseNumber(body); err != nil {
+			break
+		}
+		switch typ {
+		case partTime:
+			state.time = time.Unix(int64(n), 0)
+		case partTimeHR:
+			state.time = time.Unix(0, int64(hrDuration(n)))
+		case partInterval:
+			state.interval = time.Duration(n) * time.Second
+		case partIntervalHR:
+			state.interval = hrDuration(n)
+		case partSeverity:
+			state.severity = n
+		}
+	case partValues:
+		r := *state
+		if r.dsTypes, r.values, err = parseValues(body); err == nil {
+			*records = append(*records, &r)
+		}
+	}
+	// Unknown parts are skipped, as collectd does.
+	if err != nil {
+		return fmt.Errorf("invalid part 0x%04x: %s", typ, err)
+	}
+	return nil
+}
+
+// Converts the high resolution times and intervals, in units of 2^-30
+// seconds.
+func hrDuration(n uint64) time.Duration {
+	return time.Duration(n>>30)*time.Second +
+		time.Duration(((n&(1<<30-1))*uint64(time.Second))>>30)
+}
+
+func parseString(body []byte) (string, error) {
+	if len(body) == 0 || body[len(body)-1] != 0 {
+		return "", errors.New("string isn't null terminated")
+	}
+	return string(body[:len(body)-1]), nil
+}
+
+func parseNumber(body []byte) (uint64, error) {
+	if len(body) != 8 {
+		return 0, fmt.Errorf("number is %d bytes long", len(body))
+	}
+	return binary.BigEndian.Uint64(body), nil
+}
+
+// Parses the number of values, their data source types, and the values
+// themselves. Gauges are little endian doubles, the other types big endian
+// integers.
+func parseValues(body []byte) (dsTypes []byte, values []interface{}, err error) {
+	if len(body) < 2 {
+		return nil, nil, errors.New("missing number of values")
+	}
+	count := int(binary.BigEndian.Uint16(body))
+	if len(body) != 2+count*9 {
+		return nil, nil, fmt.Errorf("wrong length for %d values", count)
+	}
+	dsTypes = make([]byte, count)
+	copy(dsTypes, body[2:2+count])
+	values = make([]interface{}, count)
+	data := body[2+count:]
+	for i, dsType := range dsTypes {
+		raw := data[i*8 : i*8+8]
+		switch dsType {
+		case dsGauge:
+			values[i] = math.Float64frombits(binary.LittleEndian.Uint64(raw))
+		case dsCounter, dsDerive, dsAbsolute:
+			values[i] = int64(binary.BigEndian.Uint64(raw))
+		default:
+			return nil, nil, fmt.Errorf("unknown data source type %d", dsType)
+		}
+	}
+	return dsTypes, values, nil
+}
+
+// Checks a signature part, i.e. an HMAC-SHA256 of the user name and the rest
+// of the packet followed by the user name.
+func (p *parser) verify(body, signed []byte) error {
+	if len(body) < sha256.Size {
+		return errors.New("truncated signature")
+	}
+	user := string(body[sha256.Size:])
+	password, ok := p.passwords[user]
+	if !ok {
+		return fmt.Errorf("signature of unknown user '%s'", user)
+	}
+	mac := hmac.New(sha256.New, []byte(password))
+	mac.Write(body[sha256.Size:])
+	mac.Write(signed)
+	if !hmac.Equal(mac.Sum(nil), body[:sha256.Size]) {
+		return fmt.Errorf("invalid signature of user '%s'", user)
+	}
+	return nil
+}
+
+// Decrypts an encryption part, i.e. the length of the user name, the user
+// name, an initialization vector, and the SHA-1 hash of the parts followed by
+// the parts themselves, encrypted w/ AES-256 in OFB mode using the SHA-256
+// hash of the user's password as the key.
+func (p *parser) decrypt(body []byte) ([]byte, error) {
+	if len(body) < 2 {
+		return nil, errors.New("truncated encryption header")
+	}
+	userLen := int(binary.BigEndian.Uint16(body))
+	if len(body) < 2+userLen+aes.BlockSize+sha1.Size {
+		return nil, errors.New("truncated encryption header")
+	}
+	user := string(body[2 : 2+userLen])
+	password, ok := p.passwords[user]
+	if !ok {
+		return nil, fmt.Errorf("encrypted by unknown user '%s'", user)
+	}
+	iv := body[2+userLen : 2+userLen+aes.BlockSize]
+	encrypted := body[2+userLen+aes.BlockSize:]
+
+	key := sha256.Sum256([]byte(password))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	plain := make([]byte, len(encrypted))
+	cipher.NewOFB(block, iv).XORKeyStream(plain, encrypted)
+	hash := sha1.Sum(plain[sha1.Size:])
+	if !bytes.Equal(hash[:], plain[:sha1.Size]) {
+		return nil, fmt.Errorf("can't decrypt data of user '%s'", user)
+	}
+	return plain[sha1.Size:], nil
+}
+
+// Reads the user names and passwords of an auth file in the format used by
+// collectd, i.e. "user: password" lines.
+func readAuthFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	passwords := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		colon := strings.IndexByte(line, ':')
+		if colon < 0 {
+			return nil, fmt.Errorf("invalid line in %s: %s", path, line)
+		}
+		passwords[strings.TrimSpace(line[:colon])] = strings.TrimSpace(line[colon+1:])
+	}
+	return passwords, scanner.Err()
+}
+
+// Reads the data source names of each type from a collectd types.db file,
+// whose lines are a type followed by its "name:type:min:max" data sources.
+func readTypesDb(path string, types map[string][]string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(strings.Replace(scanner.Text(), ",", " ", -1))
+		if len(fields) < 2 || fields[0][0] == '#' {
+			continue
+		}
+		names := make([]string, 0, len(fields)-1)
+		for _, ds := range fields[1:] {
+			parts := strings.Split(ds, ":")
+			if len(parts) != 4 {
+				return fmt.Errorf("invalid data source for '%s' in %s: %s",
+					fields[0], path, ds)
+			}
+			names = append(names, parts[0])
+		}
+		types[fields[0]] = names
+	}
+	return scanner.Err()
+}
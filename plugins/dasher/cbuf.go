@@ -0,0 +1,160 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package dasher
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Header of a sandbox circular buffer's text output. Only what's needed to
+// line rows up by time is decoded, the header line itself is passed through
+// untouched.
+type cbufHeader struct {
+	Time          int64           `json:"time"`
+	Rows          int             `json:"rows"`
+	Columns       int             `json:"columns"`
+	SecondsPerRow int64           `json:"seconds_per_row"`
+	ColumnInfo    json.RawMessage `json:"column_info"`
+}
+
+// A circular buffer as output by a sandbox, i.e. a JSON header line followed
+// by one line of tab separated values per row, oldest row first.
+type cbuf struct {
+	header     cbufHeader
+	headerLine string
+	rows       []string
+}
+
+func parseCbufHeader(line string) (header cbufHeader, err error) {
+	if err = json.Unmarshal([]byte(line), &header); err != nil {
+		return header, fmt.Errorf("invalid cbuf header: %s", err)
+	}
+	if header.Rows <= 0 || header.Columns <= 0 || header.SecondsPerRow <= 0 {
+		return header, errors.New("invalid cbuf header: bad dimensions")
+	}
+	return header, nil
+}
+
+func parseCbuf(payload string) (*cbuf, error) {
+	lines := strings.Split(strings.TrimRight(payload, "\n"), "\n")
+	header, err := parseCbufHeader(lines[0])
+	if err != nil {
+		return nil, err
+	}
+	cb := &cbuf{header: header, headerLine: lines[0], rows: lines[1:]}
+	if len(cb.rows) != header.Rows {
+		return nil, fmt.Errorf("expected %d cbuf rows, got %d", header.Rows,
+			len(cb.rows))
+	}
+	return cb, nil
+}
+
+// Returns the time of the row w/ the given index.
+func (cb *cbuf) rowTime(i int) int64 {
+	return cb.header.Time + int64(i)*cb.header.SecondsPerRow
+}
+
+// Returns the index of the row for the given time, or -1 if the buffer
+// doesn't cover that time.
+func (cb *cbuf) rowIndex(t int64) int {
+	offset := t - cb.header.Time
+	if offset < 0 || offset%cb.header.SecondsPerRow != 0 {
+		return -1
+	}
+	i := offset / cb.header.SecondsPerRow
+	if i >= int64(cb.header.Rows) {
+		return -1
+	}
+	return int(i)
+}
+
+// Whether the buffers have the same rows and columns, so that rows from one
+// can be compared w/ or copied into the other.
+func (cb *cbuf) sameLayout(other *cbuf) bool {
+	return cb.header.Rows == other.header.Rows &&
+		cb.header.Columns == other.header.Columns &&
+		cb.header.SecondsPerRow == other.header.SecondsPerRow &&
+		bytes.Equal(cb.header.ColumnInfo, other.header.ColumnInfo)
+}
+
+func (cb *cbuf) String() string {
+	return cb.headerLine + "\n" + strings.Join(cb.rows, "\n") + "\n"
+}
+
+// Returns the delta between two buffers w/ the same layout, i.e. the header
+// of the current buffer followed by a line for each row that has changed or
+// scrolled into view since the previous buffer, holding the row's time and
+// then its values. Also returns the number of rows in the delta.
+func cbufDelta(prev, cur *cbuf) (delta string, changed int) {
+	var buf bytes.Buffer
+	buf.WriteString(cur.headerLine)
+	buf.WriteByte('\n')
+	for i, row := range cur.rows {
+		t := cur.rowTime(i)
+		if j := prev.rowIndex(t); j >= 0 && prev.rows[j] == row {
+			continue
+		}
+		buf.WriteString(strconv.FormatInt(t, 10))
+		buf.WriteByte('\t')
+		buf.WriteString(row)
+		buf.WriteByte('\n')
+		changed++
+	}
+	return buf.String(), changed
+}
+
+// Rebuilds the full buffer described by a delta, taking unchanged rows from
+// the base buffer. Rows that aren't in the delta or the base, e.g. because the
+// base is nil or has a different layout, are filled w/ NaNs until the next
+// full buffer arrives.
+func applyCbufDelta(base *cbuf, delta string) (*cbuf, error) {
+	lines := strings.Split(strings.TrimRight(delta, "\n"), "\n")
+	header, err := parseCbufHeader(lines[0])
+	if err != nil {
+		return nil, err
+	}
+	cb := &cbuf{header: header, headerLine: lines[0], rows: make([]string, header.Rows)}
+	if base != nil && !base.sameLayout(cb) {
+		base = nil
+	}
+	nanRow := strings.TrimSuffix(strings.Repeat("nan\t", header.Columns), "\t")
+	for i := range cb.rows {
+		cb.rows[i] = nanRow
+		if base != nil {
+			if j := base.rowIndex(cb.rowTime(i)); j >= 0 {
+				cb.rows[i] = base.rows[j]
+			}
+		}
+	}
+	for _, line := range lines[1:] {
+		tab := strings.IndexByte(line, '\t')
+		if tab < 0 {
+			return nil, fmt.Errorf("invalid cbuf delta row: %q", line)
+		}
+		t, err := strconv.ParseInt(line[:tab], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cbuf delta row time: %s", err)
+		}
+		if i := cb.rowIndex(t); i >= 0 {
+			cb.rows[i] = line[tab+1:]
+		}
+	}
+	return cb, nil
+}
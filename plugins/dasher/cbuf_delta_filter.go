@@ -0,0 +1,149 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package dasher
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"github.com/pborman/uuid"
+)
+
+// Type of the messages generated by the CbufDeltaFilter.
+const cbufDeltaMsgType = "heka.cbuf-delta"
+
+// Filter that converts the circular buffers emitted by sandbox filters into
+// deltas holding only the rows that have changed since the last emission,
+// w/ a full buffer sent periodically. The DashboardOutput rebuilds the full
+// buffers from the deltas, so sending the deltas to a remote dashboard
+// instead of the full buffers greatly reduces the bandwidth high resolution
+// buffers need.
+type CbufDeltaFilter struct {
+	fullCount        int64
+	deltaCount       int64
+	skippedCount     int64
+	snapshotInterval time.Duration
+	buffers          map[string]*cbufState
+}
+
+// The last buffer seen for a single sandbox output.
+type cbufState struct {
+	last     *cbuf
+	lastFull time.Time
+}
+
+type CbufDeltaFilterConfig struct {
+	// Defaults to matching every sandbox circular buffer output.
+	MessageMatcher string `toml:"message_matcher"`
+	// Max number of seconds between full buffers.
+	SnapshotInterval uint `toml:"snapshot_interval"`
+}
+
+func (f *CbufDeltaFilter) ConfigStruct() interface{} {
+	return &CbufDeltaFilterConfig{
+		MessageMatcher:   "Type == 'heka.sandbox-output' && Fields[payload_type] == 'cbuf'",
+		SnapshotInterval: 300,
+	}
+}
+
+func (f *CbufDeltaFilter) Init(config interface{}) error {
+	conf := config.(*CbufDeltaFilterConfig)
+	f.snapshotInterval = time.Duration(conf.SnapshotInterval) * time.Second
+	f.buffers = make(map[string]*cbufState)
+	return nil
+}
+
+func (f *CbufDeltaFilter) Run(fr FilterRunner, h PluginHelper) (err error) {
+	for pack := range fr.InChan() {
+		f.processBuffer(fr, h, pack)
+		fr.UpdateCursor(pack.QueueCursor)
+		pack.Recycle(nil)
+	}
+	return
+}
+
+func (f *CbufDeltaFilter) CleanupForRestart() {
+	// Start over w/ full buffers, the receiver may have missed something.
+	f.buffers = make(map[string]*cbufState)
+}
+
+func (f *CbufDeltaFilter) processBuffer(fr FilterRunner, h PluginHelper,
+	pack *PipelinePack) {
+
+	msg := pack.Message
+	cb, err := parseCbuf(msg.GetPayload())
+	if err != nil {
+		fr.LogError(fmt.Errorf("from %s: %s", msg.GetLogger(), err))
+		return
+	}
+	payloadName, _ := msg.GetFieldValue("payload_name")
+	key := fmt.Sprintf("%s\x00%s\x00%v", msg.GetHostname(), msg.GetLogger(),
+		payloadName)
+
+	var payloadType, payload string
+	now := time.Now()
+	state, ok := f.buffers[key]
+	if !ok || !state.last.sameLayout(cb) || now.Sub(state.lastFull) >= f.snapshotInterval {
+		payloadType, payload = "cbuf", msg.GetPayload()
+		state = &cbufState{lastFull: now}
+		f.buffers[key] = state
+		atomic.AddInt64(&f.fullCount, 1)
+	} else {
+		var changed int
+		if payload, changed = cbufDelta(state.last, cb); changed == 0 {
+			atomic.AddInt64(&f.skippedCount, 1)
+			return
+		}
+		payloadType = "cbuf_delta"
+		atomic.AddInt64(&f.deltaCount, 1)
+	}
+	state.last = cb
+
+	outPack, err := h.PipelinePack(pack.MsgLoopCount)
+	if err != nil {
+		fr.LogError(err)
+		return
+	}
+	// Keep the original logger and fields so the dashboard names the output
+	// after the sandbox that generated it.
+	msg.Copy(outPack.Message)
+	outPack.Message.SetUuid(uuid.NewRandom())
+	outPack.Message.SetType(cbufDeltaMsgType)
+	outPack.Message.SetPayload(payload)
+	if field := outPack.Message.FindFirstField("payload_type"); field != nil {
+		outPack.Message.DeleteField(field)
+	}
+	message.NewStringField(outPack.Message, "payload_type", payloadType)
+	fr.Inject(outPack)
+}
+
+// Satisfies the `pipeline.ReportingPlugin` interface to provide plugin state
+// information to the Heka report and dashboard.
+func (f *CbufDeltaFilter) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "FullCount", atomic.LoadInt64(&f.fullCount), "count")
+	message.NewInt64Field(msg, "DeltaCount", atomic.LoadInt64(&f.deltaCount), "count")
+	message.NewInt64Field(msg, "SkippedCount", atomic.LoadInt64(&f.skippedCount),
+		"count")
+	return nil
+}
+
+func init() {
+	RegisterPlugin("CbufDeltaFilter", func() interface{} {
+		return new(CbufDeltaFilter)
+	})
+}
@@ -0,0 +1,170 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package dasher
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	"github.com/mozilla-services/heka/pipelinemock"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+// Builds a cbuf payload starting at the given time, w/ 60 second rows.
+func makeCbuf(start int64, rows ...string) string {
+	header := fmt.Sprintf(`{"time":%d,"rows":%d,"columns":2,"seconds_per_row":60,`+
+		`"column_info":[{"name":"Requests","unit":"count","aggregation":"sum"},`+
+		`{"name":"Errors","unit":"count","aggregation":"sum"}]}`, start, len(rows))
+	return header + "\n" + strings.Join(rows, "\n") + "\n"
+}
+
+func CbufSpec(c gs.Context) {
+	c.Specify("A cbuf", func() {
+		prev, err := parseCbuf(makeCbuf(0, "1\t0", "2\t0", "3\t1"))
+		c.Assume(err, gs.IsNil)
+
+		c.Specify("rejects a bad row count", func() {
+			_, err := parseCbuf(makeCbuf(0, "1\t0", "2\t0") + "3\t1\n")
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("has no delta rows if nothing changed", func() {
+			_, changed := cbufDelta(prev, prev)
+			c.Expect(changed, gs.Equals, 0)
+		})
+
+		c.Specify("round trips a delta for a changed row", func() {
+			cur, err := parseCbuf(makeCbuf(0, "1\t0", "2\t0", "5\t2"))
+			c.Assume(err, gs.IsNil)
+			delta, changed := cbufDelta(prev, cur)
+			c.Expect(changed, gs.Equals, 1)
+			c.Expect(strings.HasSuffix(delta, "\n120\t5\t2\n"), gs.IsTrue)
+
+			rebuilt, err := applyCbufDelta(prev, delta)
+			c.Expect(err, gs.IsNil)
+			c.Expect(rebuilt.String(), gs.Equals, cur.String())
+		})
+
+		c.Specify("round trips a delta after the buffer has scrolled", func() {
+			cur, err := parseCbuf(makeCbuf(120, "3\t1", "4\t0", "nan\tnan"))
+			c.Assume(err, gs.IsNil)
+			delta, changed := cbufDelta(prev, cur)
+			c.Expect(changed, gs.Equals, 2)
+
+			rebuilt, err := applyCbufDelta(prev, delta)
+			c.Expect(err, gs.IsNil)
+			c.Expect(rebuilt.String(), gs.Equals, cur.String())
+		})
+
+		c.Specify("fills rows missing from the base w/ NaNs", func() {
+			cur, err := parseCbuf(makeCbuf(120, "3\t1", "4\t0", "6\t0"))
+			c.Assume(err, gs.IsNil)
+			delta, _ := cbufDelta(prev, cur)
+
+			rebuilt, err := applyCbufDelta(nil, delta)
+			c.Expect(err, gs.IsNil)
+			c.Expect(rebuilt.rows[0], gs.Equals, "nan\tnan")
+			c.Expect(rebuilt.rows[1], gs.Equals, "4\t0")
+			c.Expect(rebuilt.rows[2], gs.Equals, "6\t0")
+		})
+
+		c.Specify("rejects a malformed delta row", func() {
+			delta := strings.SplitN(prev.String(), "\n", 2)[0] + "\nbogus\n"
+			_, err := applyCbufDelta(prev, delta)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+}
+
+func CbufDeltaFilterSpec(c gs.Context) {
+	t := new(pipeline_ts.SimpleT)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	fr := pipelinemock.NewMockFilterRunner(ctrl)
+	h := pipelinemock.NewMockPluginHelper(ctrl)
+
+	filter := new(CbufDeltaFilter)
+	config := filter.ConfigStruct().(*CbufDeltaFilterConfig)
+	err := filter.Init(config)
+	c.Assume(err, gs.IsNil)
+
+	newPack := func(payload string) *pipeline.PipelinePack {
+		pack := pipeline.NewPipelinePack(nil)
+		pack.Message.SetType("heka.sandbox-output")
+		pack.Message.SetLogger("stats_graph")
+		pack.Message.SetHostname("example.com")
+		pack.Message.SetPayload(payload)
+		message.NewStringField(pack.Message, "payload_type", "cbuf")
+		message.NewStringField(pack.Message, "payload_name", "requests")
+		return pack
+	}
+
+	// Expects a message to be injected, capturing it in `injected`.
+	var injected *pipeline.PipelinePack
+	expectInject := func() {
+		injected = pipeline.NewPipelinePack(nil)
+		h.EXPECT().PipelinePack(uint(0)).Return(injected, nil)
+		fr.EXPECT().Inject(injected).Return(true)
+	}
+
+	c.Specify("A CbufDeltaFilter", func() {
+		full := makeCbuf(0, "1\t0", "2\t0", "3\t1")
+
+		c.Specify("sends the first buffer in full", func() {
+			expectInject()
+			filter.processBuffer(fr, h, newPack(full))
+			c.Expect(injected.Message.GetType(), gs.Equals, cbufDeltaMsgType)
+			c.Expect(injected.Message.GetLogger(), gs.Equals, "stats_graph")
+			c.Expect(injected.Message.GetPayload(), gs.Equals, full)
+			payloadType, _ := injected.Message.GetFieldValue("payload_type")
+			c.Expect(payloadType, gs.Equals, "cbuf")
+		})
+
+		c.Specify("sends a delta for a changed buffer", func() {
+			expectInject()
+			filter.processBuffer(fr, h, newPack(full))
+			expectInject()
+			filter.processBuffer(fr, h, newPack(makeCbuf(60, "2\t0", "3\t1", "4\t0")))
+			payloadType, _ := injected.Message.GetFieldValue("payload_type")
+			c.Expect(payloadType, gs.Equals, "cbuf_delta")
+			c.Expect(strings.HasSuffix(injected.Message.GetPayload(), "\n180\t4\t0\n"),
+				gs.IsTrue)
+			c.Expect(filter.deltaCount, gs.Equals, int64(1))
+		})
+
+		c.Specify("skips an unchanged buffer", func() {
+			expectInject()
+			filter.processBuffer(fr, h, newPack(full))
+			filter.processBuffer(fr, h, newPack(full))
+			c.Expect(filter.skippedCount, gs.Equals, int64(1))
+		})
+
+		c.Specify("sends a full buffer when the snapshot interval has passed", func() {
+			filter.snapshotInterval = 0
+			expectInject()
+			filter.processBuffer(fr, h, newPack(full))
+			expectInject()
+			filter.processBuffer(fr, h, newPack(full))
+			payloadType, _ := injected.Message.GetFieldValue("payload_type")
+			c.Expect(payloadType, gs.Equals, "cbuf")
+			c.Expect(filter.fullCount, gs.Equals, int64(2))
+		})
+	})
+}
@@ -53,6 +53,9 @@ type DashboardOutputConfig struct {
 	MessageMatcher string
 	// Custom http headers
 	Headers http.Header
+	// Path at which the latest report is served in the Prometheus text
+	// format, defaults to "/metrics". An empty path turns it off.
+	MetricsPath string `toml:"metrics_path"`
 }
 
 func (self *DashboardOutput) ConfigStruct() interface{} {
@@ -61,7 +64,8 @@ func (self *DashboardOutput) ConfigStruct() interface{} {
 		StaticDirectory:  "dasher",
 		WorkingDirectory: "dashboard",
 		TickerInterval:   uint(5),
-		MessageMatcher:   "Type == 'heka.all-report' || Type == 'heka.sandbox-terminated' || Type == 'heka.sandbox-output'",
+		MetricsPath:      "/metrics",
+		MessageMatcher:   "Type == 'heka.all-report' || Type == 'heka.sandbox-terminated' || Type == 'heka.sandbox-output' || Type == 'heka.cbuf-delta'",
 	}
 }
 
@@ -74,6 +78,9 @@ type DashboardOutput struct {
 	handler          http.Handler
 	pConfig          *PipelineConfig
 	starterFunc      func(output *DashboardOutput) error
+	metrics          *prometheusHandler
+	// Buffers rebuilt from CbufDeltaFilter output, keyed by sandbox output.
+	cbufs map[string]*cbuf
 }
 
 // Heka will call this before calling any other methods to give us access to
@@ -154,9 +161,17 @@ func (self *DashboardOutput) Init(config interface{}) (err error) {
 		}
 		self.handler = http.FileServer(http.Dir(self.workingDirectory))
 	}
+	handler := self.handler
+	if conf.MetricsPath != "" {
+		self.metrics = new(prometheusHandler)
+		mux := http.NewServeMux()
+		mux.Handle(conf.MetricsPath, self.metrics)
+		mux.Handle("/", self.handler)
+		handler = mux
+	}
 	self.server = &http.Server{
 		Addr:         conf.Address,
-		Handler:      httpPlugin.CustomHeadersHandler(self.handler, conf.Headers),
+		Handler:      httpPlugin.CustomHeadersHandler(handler, conf.Headers),
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 10 * time.Second,
 	}
@@ -179,7 +194,6 @@ func (self *DashboardOutput) Run(or OutputRunner, h PluginHelper) (err error) {
 	// sandboxes.json file.
 	sandboxes := make(map[string]*DashPluginListItem)
 	sbxsLock := new(sync.Mutex)
-	reNotWord, _ := regexp.Compile("\\W")
 	for ok {
 		select {
 		case pack, ok = <-inChan:
@@ -191,6 +205,9 @@ func (self *DashboardOutput) Run(or OutputRunner, h PluginHelper) (err error) {
 			case "heka.all-report":
 				fn := filepath.Join(self.dataDirectory, "heka_report.json")
 				overwriteFile(fn, msg.GetPayload())
+				if self.metrics != nil {
+					self.metrics.setReport(msg.GetPayload())
+				}
 				sbxsLock.Lock()
 				if err := overwritePluginListFile(self.dataDirectory, sandboxes); err != nil {
 					or.LogError(fmt.Errorf("Can't write plugin list file to '%s': %s",
@@ -200,51 +217,15 @@ func (self *DashboardOutput) Run(or OutputRunner, h PluginHelper) (err error) {
 			case "heka.sandbox-output":
 				tmp, _ := msg.GetFieldValue("payload_type")
 				if payloadType, ok := tmp.(string); ok {
-					var payloadName, nameExt string
-					tmp, _ := msg.GetFieldValue("payload_name")
-					if payloadName, ok = tmp.(string); ok {
-						nameExt = reNotWord.ReplaceAllString(payloadName, "")
-					}
-					if len(nameExt) > 64 {
-						nameExt = nameExt[:64]
-					}
-					nameExt = "." + nameExt
-
-					payloadType = reNotWord.ReplaceAllString(payloadType, "")
-					filterName := msg.GetLogger()
-					fn := filterName + nameExt + "." + payloadType
-					ofn := filepath.Join(self.dataDirectory, fn)
-					relPath := path.Join(self.relDataPath, fn) // Used for generating HTTP URLs.
-					overwriteFile(ofn, msg.GetPayload())
-					sbxsLock.Lock()
-					if listItem, ok := sandboxes[filterName]; !ok {
-						// First time we've seen this sandbox, add it to the set.
-						output := &DashPluginOutput{
-							Name:     payloadName,
-							Filename: relPath,
-						}
-						sandboxes[filterName] = &DashPluginListItem{
-							Name:    filterName,
-							Outputs: []*DashPluginOutput{output},
-						}
-					} else {
-						// We've seen the sandbox, see if we already have this output.
-						found := false
-						for _, output := range listItem.Outputs {
-							if output.Name == payloadName {
-								found = true
-								break
-							}
-						}
-						if !found {
-							output := &DashPluginOutput{
-								Name:     payloadName,
-								Filename: relPath,
-							}
-							listItem.Outputs = append(listItem.Outputs, output)
-						}
-					}
-					sbxsLock.Unlock()
+					self.writeSandboxOutput(msg, payloadType, msg.GetPayload(),
+						sandboxes, sbxsLock)
+				}
+			case cbufDeltaMsgType:
+				if payload, err := self.rebuildCbuf(msg); err != nil {
+					or.LogError(fmt.Errorf("Can't rebuild cbuf from %s: %s",
+						msg.GetLogger(), err))
+				} else {
+					self.writeSandboxOutput(msg, "cbuf", payload, sandboxes, sbxsLock)
 				}
 			case "heka.sandbox-terminated":
 				var filterName string
@@ -296,6 +277,92 @@ func (self *DashboardOutput) Run(or OutputRunner, h PluginHelper) (err error) {
 	return
 }
 
+var reNotWord = regexp.MustCompile("\\W")
+
+// Writes a sandbox output to the data directory, adding it to the list of
+// outputs the dashboard displays if it's new.
+func (self *DashboardOutput) writeSandboxOutput(msg *message.Message,
+	payloadType, payload string, sandboxes map[string]*DashPluginListItem,
+	sbxsLock *sync.Mutex) {
+
+	var payloadName, nameExt string
+	tmp, _ := msg.GetFieldValue("payload_name")
+	if s, ok := tmp.(string); ok {
+		payloadName = s
+		nameExt = reNotWord.ReplaceAllString(payloadName, "")
+	}
+	if len(nameExt) > 64 {
+		nameExt = nameExt[:64]
+	}
+	nameExt = "." + nameExt
+
+	payloadType = reNotWord.ReplaceAllString(payloadType, "")
+	filterName := msg.GetLogger()
+	fn := filterName + nameExt + "." + payloadType
+	ofn := filepath.Join(self.dataDirectory, fn)
+	relPath := path.Join(self.relDataPath, fn) // Used for generating HTTP URLs.
+	overwriteFile(ofn, payload)
+	sbxsLock.Lock()
+	defer sbxsLock.Unlock()
+	if listItem, ok := sandboxes[filterName]; !ok {
+		// First time we've seen this sandbox, add it to the set.
+		output := &DashPluginOutput{
+			Name:     payloadName,
+			Filename: relPath,
+		}
+		sandboxes[filterName] = &DashPluginListItem{
+			Name:    filterName,
+			Outputs: []*DashPluginOutput{output},
+		}
+	} else {
+		// We've seen the sandbox, see if we already have this output.
+		found := false
+		for _, output := range listItem.Outputs {
+			if output.Name == payloadName {
+				found = true
+				break
+			}
+		}
+		if !found {
+			output := &DashPluginOutput{
+				Name:     payloadName,
+				Filename: relPath,
+			}
+			listItem.Outputs = append(listItem.Outputs, output)
+		}
+	}
+}
+
+// Returns the full circular buffer described by a CbufDeltaFilter message,
+// which holds either a full buffer or a delta to apply to the last one.
+func (self *DashboardOutput) rebuildCbuf(msg *message.Message) (string, error) {
+	payloadName, _ := msg.GetFieldValue("payload_name")
+	key := fmt.Sprintf("%s\x00%s\x00%v", msg.GetHostname(), msg.GetLogger(),
+		payloadName)
+	if self.cbufs == nil {
+		self.cbufs = make(map[string]*cbuf)
+	}
+
+	var (
+		cb  *cbuf
+		err error
+	)
+	tmp, _ := msg.GetFieldValue("payload_type")
+	switch tmp {
+	case "cbuf":
+		cb, err = parseCbuf(msg.GetPayload())
+	case "cbuf_delta":
+		cb, err = applyCbufDelta(self.cbufs[key], msg.GetPayload())
+	default:
+		err = fmt.Errorf("unexpected payload_type: %v", tmp)
+	}
+	if err != nil {
+		return "", err
+	}
+	self.cbufs[key] = cb
+	return cb.String(), nil
+}
+
 func defaultStarter(output *DashboardOutput) error {
 	return output.server.ListenAndServe()
 }
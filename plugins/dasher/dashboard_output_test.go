@@ -15,6 +15,7 @@
 package dasher
 
 import (
+	"bytes"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -37,6 +38,9 @@ func TestAllSpecs(t *testing.T) {
 	r.Parallel = false
 
 	r.AddSpec(DashboardOutputSpec)
+	r.AddSpec(CbufSpec)
+	r.AddSpec(CbufDeltaFilterSpec)
+	r.AddSpec(ReportFilterSpec)
 
 	gs.MainGoTest(r, t)
 }
@@ -62,6 +66,27 @@ func DashboardOutputSpec(c gs.Context) {
 		}()
 	}
 
+	c.Specify("Prometheus metrics", func() {
+		report := `{"outputs": [{"Name": "TcpOutput",
+			"InChanLength": {"value": 3, "representation": "count"},
+			"DeliveryLatency_le_1000": {"value": 5, "representation": "count"},
+			"DeliveryLatency_le_10": {"value": 2, "representation": "count"},
+			"DeliveryLatencyCount": {"value": 6, "representation": "count"},
+			"DeliveryLatencySum": {"value": 2500, "representation": "ms"}}]}`
+		out := new(bytes.Buffer)
+		err := writePrometheusMetrics(out, []byte(report))
+		c.Assume(err, gs.IsNil)
+		c.Expect(out.String(), gs.Equals, `# TYPE heka_outputs_inchanlength gauge
+heka_outputs_inchanlength{name="TcpOutput"} 3
+# TYPE heka_output_delivery_latency_seconds histogram
+heka_output_delivery_latency_seconds_bucket{name="TcpOutput",le="0.01"} 2
+heka_output_delivery_latency_seconds_bucket{name="TcpOutput",le="1"} 5
+heka_output_delivery_latency_seconds_bucket{name="TcpOutput",le="+Inf"} 6
+heka_output_delivery_latency_seconds_sum{name="TcpOutput"} 2.5
+heka_output_delivery_latency_seconds_count{name="TcpOutput"} 6
+`)
+	})
+
 	if runtime.GOOS != "windows" {
 		c.Specify("A DashboardOutput", func() {
 
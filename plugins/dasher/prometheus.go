@@ -0,0 +1,172 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package dasher
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mozilla-services/heka/pipeline"
+)
+
+// Serves the latest heka.all-report in the Prometheus text exposition
+// format. Every numeric report value becomes a `heka_<key>_<field>` gauge
+// labeled w/ the plugin name, except for the outputs' delivery latencies
+// which become a `heka_output_delivery_latency_seconds` histogram.
+type prometheusHandler struct {
+	lock   sync.RWMutex
+	report []byte
+}
+
+func (p *prometheusHandler) setReport(payload string) {
+	p.lock.Lock()
+	p.report = []byte(payload)
+	p.lock.Unlock()
+}
+
+func (p *prometheusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.lock.RLock()
+	report := p.report
+	p.lock.RUnlock()
+	if report == nil {
+		http.Error(w, "no report available yet", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := writePrometheusMetrics(w, report); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+var reNotMetricChar = regexp.MustCompile("[^a-zA-Z0-9_]")
+
+type reportValue struct {
+	Value interface{} `json:"value"`
+}
+
+type promSample struct {
+	labels string
+	value  float64
+}
+
+// Writes the metrics of a heka.all-report payload to w.
+func writePrometheusMetrics(w io.Writer, report []byte) error {
+	var data map[string][]map[string]json.RawMessage
+	if err := json.Unmarshal(report, &data); err != nil {
+		return fmt.Errorf("can't parse report: %s", err)
+	}
+
+	gauges := make(map[string][]promSample)
+	var histograms []string
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		for _, plugin := range data[key] {
+			var name string
+			json.Unmarshal(plugin["Name"], &name)
+			labels := fmt.Sprintf("name=%s", strconv.Quote(name))
+
+			var buckets []latencyBucket
+			var count, sum float64
+			for field, raw := range plugin {
+				var val reportValue
+				if field == "Name" || json.Unmarshal(raw, &val) != nil {
+					continue
+				}
+				f, ok := val.Value.(float64)
+				if !ok {
+					continue
+				}
+				switch {
+				case strings.HasPrefix(field, pipeline.LATENCY_BUCKET_PREFIX):
+					ms, err := strconv.ParseFloat(
+						field[len(pipeline.LATENCY_BUCKET_PREFIX):], 64)
+					if err == nil {
+						buckets = append(buckets, latencyBucket{ms / 1000, f})
+					}
+				case field == pipeline.LATENCY_COUNT_FIELD:
+					count = f
+				case field == pipeline.LATENCY_SUM_FIELD:
+					sum = f / 1000
+				default:
+					metric := fmt.Sprintf("heka_%s_%s", key, field)
+					metric = strings.ToLower(reNotMetricChar.ReplaceAllString(metric, "_"))
+					gauges[metric] = append(gauges[metric], promSample{labels, f})
+				}
+			}
+			if len(buckets) == 0 {
+				continue
+			}
+			sort.Sort(byBucketBound(buckets))
+			lines := make([]string, 0, len(buckets)+3)
+			for _, b := range buckets {
+				lines = append(lines, fmt.Sprintf(
+					"heka_output_delivery_latency_seconds_bucket{%s,le=\"%v\"} %v",
+					labels, b.bound, b.count))
+			}
+			lines = append(lines,
+				fmt.Sprintf("heka_output_delivery_latency_seconds_bucket{%s,le=\"+Inf\"} %v",
+					labels, count),
+				fmt.Sprintf("heka_output_delivery_latency_seconds_sum{%s} %v", labels, sum),
+				fmt.Sprintf("heka_output_delivery_latency_seconds_count{%s} %v", labels, count))
+			histograms = append(histograms, strings.Join(lines, "\n"))
+		}
+	}
+
+	metrics := make([]string, 0, len(gauges))
+	for metric := range gauges {
+		metrics = append(metrics, metric)
+	}
+	sort.Strings(metrics)
+	for _, metric := range metrics {
+		if _, err := fmt.Fprintf(w, "# TYPE %s gauge\n", metric); err != nil {
+			return err
+		}
+		for _, s := range gauges[metric] {
+			fmt.Fprintf(w, "%s{%s} %v\n", metric, s.labels, s.value)
+		}
+	}
+	if len(histograms) > 0 {
+		fmt.Fprintln(w, "# TYPE heka_output_delivery_latency_seconds histogram")
+		for _, h := range histograms {
+			fmt.Fprintln(w, h)
+		}
+	}
+	return nil
+}
+
+// Cumulative count of the messages delivered within a latency bound, in
+// seconds.
+type latencyBucket struct {
+	bound float64
+	count float64
+}
+
+type byBucketBound []latencyBucket
+
+func (b byBucketBound) Len() int           { return len(b) }
+func (b byBucketBound) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byBucketBound) Less(i, j int) bool { return b[i].bound < b[j].bound }
@@ -0,0 +1,377 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package dasher
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+)
+
+// Filter that keeps the latest output of each sandbox it's fed and, on a
+// cron schedule, renders a template over them, injecting the result as a
+// report message for e.g. an SmtpOutput to send.
+type ReportFilter struct {
+	reportCount int64
+	errorCount  int64
+	conf        *ReportFilterConfig
+	pConfig     *PipelineConfig
+	schedule    *Schedule
+	tmpl        *template.Template
+	buffers     map[string]*ReportBuffer
+	payloads    map[string]string
+	// Returns the current time, replaced in tests.
+	now func() time.Time
+}
+
+type ReportFilterConfig struct {
+	// Defaults to matching every sandbox output.
+	MessageMatcher string `toml:"message_matcher"`
+	// Cron expression of the times reports are generated at.
+	Schedule string
+	// Timezone the schedule is interpreted in, defaults to the local one.
+	ScheduleTimezone string `toml:"schedule_timezone"`
+	// Go text/template the report is rendered w/.
+	Template string
+	// File the template is read from instead, relative to the share dir.
+	TemplateFile string `toml:"template_file"`
+	// Type of the report messages, defaults to "heka.report".
+	MessageType string `toml:"message_type"`
+	// Set as the report messages' `payload_type` field, defaults to "txt".
+	PayloadType string `toml:"payload_type"`
+	// Set as the report messages' `payload_name` field, defaults to
+	// "report".
+	PayloadName string `toml:"payload_name"`
+	// Whether the collected outputs are forgotten after each report, so each
+	// report only covers what was received since the previous one.
+	ResetAfterReport bool `toml:"reset_after_report"`
+}
+
+// What the report template is executed w/.
+type ReportData struct {
+	// Time the report was generated.
+	Time time.Time
+	// Circular buffer outputs, keyed by "<logger>.<payload_name>".
+	Buffers map[string]*ReportBuffer
+	// Raw payloads of all outputs, keyed likewise.
+	Payloads map[string]string
+}
+
+// A circular buffer output by a sandbox, w/ helpers to summarize its
+// columns. NaN values, i.e. rows w/o data, are ignored by the helpers.
+type ReportBuffer struct {
+	Logger        string
+	PayloadName   string
+	Hostname      string
+	Columns       []string
+	Units         []string
+	SecondsPerRow int64
+	Rows          []ReportRow
+}
+
+type ReportRow struct {
+	Time   time.Time
+	Values []float64
+}
+
+func (f *ReportFilter) SetPipelineConfig(pConfig *PipelineConfig) {
+	f.pConfig = pConfig
+}
+
+func (f *ReportFilter) ConfigStruct() interface{} {
+	return &ReportFilterConfig{
+		MessageMatcher: "Type == 'heka.sandbox-output'",
+		MessageType:    "heka.report",
+		PayloadType:    "txt",
+		PayloadName:    "report",
+	}
+}
+
+func (f *ReportFilter) Init(config interface{}) (err error) {
+	conf := config.(*ReportFilterConfig)
+	var loc *time.Location
+	if conf.ScheduleTimezone != "" {
+		if loc, err = time.LoadLocation(conf.ScheduleTimezone); err != nil {
+			return fmt.Errorf("invalid schedule_timezone: %s", err)
+		}
+	} else {
+		loc = time.Local
+	}
+	if conf.Schedule == "" {
+		return errors.New("a schedule is required")
+	}
+	if f.schedule, err = ParseSchedule(conf.Schedule, loc); err != nil {
+		return fmt.Errorf("invalid schedule: %s", err)
+	}
+
+	text := conf.Template
+	if conf.TemplateFile != "" {
+		if text != "" {
+			return errors.New("only one of template and template_file can be set")
+		}
+		path := f.pConfig.Globals.PrependShareDir(conf.TemplateFile)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("can't read template_file: %s", err)
+		}
+		text = string(data)
+	}
+	if text == "" {
+		return errors.New("a template or template_file is required")
+	}
+	if f.tmpl, err = template.New("report").Parse(text); err != nil {
+		return fmt.Errorf("invalid template: %s", err)
+	}
+	f.conf = conf
+	f.buffers = make(map[string]*ReportBuffer)
+	f.payloads = make(map[string]string)
+	f.now = time.Now
+	return nil
+}
+
+func (f *ReportFilter) Run(fr FilterRunner, h PluginHelper) (err error) {
+	inChan := fr.InChan()
+	timer := time.NewTimer(f.untilNextReport())
+	defer timer.Stop()
+	for {
+		select {
+		case pack, ok := <-inChan:
+			if !ok {
+				return nil
+			}
+			if err := f.collect(pack.Message); err != nil {
+				fr.LogError(fmt.Errorf("from %s: %s", pack.Message.GetLogger(), err))
+			}
+			fr.UpdateCursor(pack.QueueCursor)
+			pack.Recycle(nil)
+		case <-timer.C:
+			f.report(fr, h)
+			timer.Reset(f.untilNextReport())
+		}
+	}
+}
+
+func (f *ReportFilter) untilNextReport() time.Duration {
+	now := f.now()
+	next := f.schedule.Next(now)
+	if next.IsZero() {
+		// The schedule never matches again, e.g. "0 0 30 2 *".
+		return math.MaxInt64
+	}
+	return next.Sub(now)
+}
+
+// Keeps the message's payload, parsing it if it's a circular buffer.
+func (f *ReportFilter) collect(msg *message.Message) error {
+	payloadName, _ := msg.GetFieldValue("payload_name")
+	name, _ := payloadName.(string)
+	key := msg.GetLogger() + "." + name
+	f.payloads[key] = msg.GetPayload()
+	if payloadType, _ := msg.GetFieldValue("payload_type"); payloadType != "cbuf" {
+		return nil
+	}
+	cb, err := parseCbuf(msg.GetPayload())
+	if err != nil {
+		return err
+	}
+	buf, err := newReportBuffer(cb)
+	if err != nil {
+		return err
+	}
+	buf.Logger = msg.GetLogger()
+	buf.PayloadName = name
+	buf.Hostname = msg.GetHostname()
+	f.buffers[key] = buf
+	return nil
+}
+
+// Renders the report and injects it.
+func (f *ReportFilter) report(fr FilterRunner, h PluginHelper) {
+	data := &ReportData{
+		Time:     f.now(),
+		Buffers:  f.buffers,
+		Payloads: f.payloads,
+	}
+	var payload bytes.Buffer
+	if err := f.tmpl.Execute(&payload, data); err != nil {
+		atomic.AddInt64(&f.errorCount, 1)
+		fr.LogError(fmt.Errorf("can't render report: %s", err))
+		return
+	}
+	if f.conf.ResetAfterReport {
+		f.buffers = make(map[string]*ReportBuffer)
+		f.payloads = make(map[string]string)
+	}
+	pack, err := h.PipelinePack(0)
+	if err != nil {
+		atomic.AddInt64(&f.errorCount, 1)
+		fr.LogError(err)
+		return
+	}
+	msg := pack.Message
+	msg.SetType(f.conf.MessageType)
+	msg.SetLogger(fr.Name())
+	msg.SetTimestamp(data.Time.UnixNano())
+	msg.SetPayload(payload.String())
+	message.NewStringField(msg, "payload_type", f.conf.PayloadType)
+	message.NewStringField(msg, "payload_name", f.conf.PayloadName)
+	fr.Inject(pack)
+	atomic.AddInt64(&f.reportCount, 1)
+}
+
+func (f *ReportFilter) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "ReportCount", atomic.LoadInt64(&f.reportCount),
+		"count")
+	message.NewInt64Field(msg, "ErrorCount", atomic.LoadInt64(&f.errorCount),
+		"count")
+	return nil
+}
+
+func newReportBuffer(cb *cbuf) (*ReportBuffer, error) {
+	var info []struct {
+		Name string `json:"name"`
+		Unit string `json:"unit"`
+	}
+	if len(cb.header.ColumnInfo) > 0 {
+		if err := json.Unmarshal(cb.header.ColumnInfo, &info); err != nil {
+			return nil, fmt.Errorf("invalid cbuf column_info: %s", err)
+		}
+	}
+	buf := &ReportBuffer{
+		Columns:       make([]string, cb.header.Columns),
+		Units:         make([]string, cb.header.Columns),
+		SecondsPerRow: cb.header.SecondsPerRow,
+		Rows:          make([]ReportRow, len(cb.rows)),
+	}
+	for i := range buf.Columns {
+		if i < len(info) {
+			buf.Columns[i], buf.Units[i] = info[i].Name, info[i].Unit
+		} else {
+			buf.Columns[i] = fmt.Sprintf("Column%d", i+1)
+		}
+	}
+	for i, row := range cb.rows {
+		fields := strings.Split(row, "\t")
+		if len(fields) != cb.header.Columns {
+			return nil, fmt.Errorf("expected %d cbuf columns, got %d",
+				cb.header.Columns, len(fields))
+		}
+		values := make([]float64, len(fields))
+		for j, field := range fields {
+			v, err := strconv.ParseFloat(field, 64)
+			if err != nil {
+				v = math.NaN()
+			}
+			values[j] = v
+		}
+		buf.Rows[i] = ReportRow{
+			Time:   time.Unix(cb.rowTime(i), 0).UTC(),
+			Values: values,
+		}
+	}
+	return buf, nil
+}
+
+// Returns the non NaN values of the named column, oldest first, and an error
+// if there's no such column.
+func (b *ReportBuffer) Column(name string) ([]float64, error) {
+	col := -1
+	for i, c := range b.Columns {
+		if c == name {
+			col = i
+			break
+		}
+	}
+	if col < 0 {
+		return nil, fmt.Errorf("no column '%s' in %s.%s", name, b.Logger,
+			b.PayloadName)
+	}
+	values := make([]float64, 0, len(b.Rows))
+	for _, row := range b.Rows {
+		if v := row.Values[col]; !math.IsNaN(v) {
+			values = append(values, v)
+		}
+	}
+	return values, nil
+}
+
+// Sum of the named column's values.
+func (b *ReportBuffer) Sum(name string) (sum float64, err error) {
+	values, err := b.Column(name)
+	for _, v := range values {
+		sum += v
+	}
+	return sum, err
+}
+
+// Average of the named column's values, NaN if it has none.
+func (b *ReportBuffer) Avg(name string) (float64, error) {
+	values, err := b.Column(name)
+	if len(values) == 0 {
+		return math.NaN(), err
+	}
+	sum, _ := b.Sum(name)
+	return sum / float64(len(values)), err
+}
+
+// Smallest of the named column's values, NaN if it has none.
+func (b *ReportBuffer) Min(name string) (float64, error) {
+	values, err := b.Column(name)
+	min := math.NaN()
+	for i, v := range values {
+		if i == 0 || v < min {
+			min = v
+		}
+	}
+	return min, err
+}
+
+// Largest of the named column's values, NaN if it has none.
+func (b *ReportBuffer) Max(name string) (float64, error) {
+	values, err := b.Column(name)
+	max := math.NaN()
+	for i, v := range values {
+		if i == 0 || v > max {
+			max = v
+		}
+	}
+	return max, err
+}
+
+// Most recent of the named column's values, NaN if it has none.
+func (b *ReportBuffer) Last(name string) (float64, error) {
+	values, err := b.Column(name)
+	if len(values) == 0 {
+		return math.NaN(), err
+	}
+	return values[len(values)-1], err
+}
+
+func init() {
+	RegisterPlugin("ReportFilter", func() interface{} {
+		return new(ReportFilter)
+	})
+}
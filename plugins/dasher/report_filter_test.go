@@ -0,0 +1,161 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package dasher
+
+import (
+	"math"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	"github.com/mozilla-services/heka/pipelinemock"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func ReportFilterSpec(c gs.Context) {
+	t := new(pipeline_ts.SimpleT)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	fr := pipelinemock.NewMockFilterRunner(ctrl)
+	h := pipelinemock.NewMockPluginHelper(ctrl)
+
+	filter := new(ReportFilter)
+	config := filter.ConfigStruct().(*ReportFilterConfig)
+	config.Schedule = "0 8 * * *"
+	config.ScheduleTimezone = "UTC"
+	config.Template = `{{with index .Buffers "stats_graph.requests"}}` +
+		`{{.Sum "Requests"}} requests, {{.Max "Errors"}} errors at most{{end}}`
+
+	newMsg := func(payloadType, payload string) *message.Message {
+		msg := new(message.Message)
+		msg.SetType("heka.sandbox-output")
+		msg.SetLogger("stats_graph")
+		msg.SetHostname("example.com")
+		msg.SetPayload(payload)
+		message.NewStringField(msg, "payload_type", payloadType)
+		message.NewStringField(msg, "payload_name", "requests")
+		return msg
+	}
+
+	c.Specify("A ReportFilter", func() {
+		c.Specify("requires a schedule", func() {
+			config.Schedule = ""
+			c.Expect(filter.Init(config), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("requires a template", func() {
+			config.Template = ""
+			c.Expect(filter.Init(config), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("rejects a malformed template", func() {
+			config.Template = "{{.Buffers"
+			c.Expect(filter.Init(config), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("is initialized", func() {
+			err := filter.Init(config)
+			c.Assume(err, gs.IsNil)
+			now := time.Date(2016, 3, 1, 7, 30, 0, 0, time.UTC)
+			filter.now = func() time.Time { return now }
+
+			c.Specify("waits for the next scheduled time", func() {
+				c.Expect(filter.untilNextReport(), gs.Equals, 30*time.Minute)
+			})
+
+			c.Specify("summarizes a cbuf's columns", func() {
+				err := filter.collect(newMsg("cbuf", makeCbuf(0, "1\t0", "nan\tnan", "3\t2")))
+				c.Assume(err, gs.IsNil)
+				buf := filter.buffers["stats_graph.requests"]
+				c.Expect(buf.Hostname, gs.Equals, "example.com")
+				c.Expect(buf.Rows[2].Time, gs.Equals, time.Unix(120, 0).UTC())
+				sum, err := buf.Sum("Requests")
+				c.Expect(err, gs.IsNil)
+				c.Expect(sum, gs.Equals, 4.0)
+				avg, _ := buf.Avg("Requests")
+				c.Expect(avg, gs.Equals, 2.0)
+				min, _ := buf.Min("Errors")
+				c.Expect(min, gs.Equals, 0.0)
+				last, _ := buf.Last("Errors")
+				c.Expect(last, gs.Equals, 2.0)
+				_, err = buf.Sum("Bogus")
+				c.Expect(err, gs.Not(gs.IsNil))
+			})
+
+			c.Specify("rejects a malformed cbuf", func() {
+				err := filter.collect(newMsg("cbuf", "bogus"))
+				c.Expect(err, gs.Not(gs.IsNil))
+			})
+
+			c.Specify("keeps other payloads as is", func() {
+				err := filter.collect(newMsg("txt", "all good"))
+				c.Expect(err, gs.IsNil)
+				c.Expect(filter.payloads["stats_graph.requests"], gs.Equals, "all good")
+				c.Expect(len(filter.buffers), gs.Equals, 0)
+			})
+
+			c.Specify("injects the rendered report", func() {
+				filter.collect(newMsg("cbuf", makeCbuf(0, "1\t0", "2\t5", "3\t1")))
+				injected := pipeline.NewPipelinePack(nil)
+				h.EXPECT().PipelinePack(uint(0)).Return(injected, nil)
+				fr.EXPECT().Name().Return("DailyReport")
+				fr.EXPECT().Inject(injected).Return(true)
+				filter.report(fr, h)
+
+				msg := injected.Message
+				c.Expect(msg.GetType(), gs.Equals, "heka.report")
+				c.Expect(msg.GetLogger(), gs.Equals, "DailyReport")
+				c.Expect(msg.GetTimestamp(), gs.Equals, now.UnixNano())
+				c.Expect(msg.GetPayload(), gs.Equals, "6 requests, 5 errors at most")
+				payloadName, _ := msg.GetFieldValue("payload_name")
+				c.Expect(payloadName, gs.Equals, "report")
+				c.Expect(filter.reportCount, gs.Equals, int64(1))
+				c.Expect(len(filter.buffers), gs.Equals, 1)
+			})
+
+			c.Specify("forgets the outputs after a report if configured to", func() {
+				filter.conf.ResetAfterReport = true
+				filter.collect(newMsg("cbuf", makeCbuf(0, "1\t0", "2\t5", "3\t1")))
+				injected := pipeline.NewPipelinePack(nil)
+				h.EXPECT().PipelinePack(uint(0)).Return(injected, nil)
+				fr.EXPECT().Name().Return("DailyReport")
+				fr.EXPECT().Inject(injected).Return(true)
+				filter.report(fr, h)
+				c.Expect(len(filter.buffers), gs.Equals, 0)
+				c.Expect(len(filter.payloads), gs.Equals, 0)
+			})
+
+			c.Specify("logs a template execution error", func() {
+				filter.collect(newMsg("cbuf", makeCbuf(0, "1\t0")))
+				filter.buffers["stats_graph.requests"].Columns[0] = "Renamed"
+				fr.EXPECT().LogError(gomock.Any())
+				filter.report(fr, h)
+				c.Expect(filter.errorCount, gs.Equals, int64(1))
+			})
+		})
+	})
+
+	c.Specify("An empty ReportBuffer's summaries are NaN", func() {
+		buf := &ReportBuffer{Columns: []string{"Requests"}}
+		avg, err := buf.Avg("Requests")
+		c.Expect(err, gs.IsNil)
+		c.Expect(math.IsNaN(avg), gs.IsTrue)
+		max, _ := buf.Max("Requests")
+		c.Expect(math.IsNaN(max), gs.IsTrue)
+	})
+}
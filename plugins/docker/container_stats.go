@@ -0,0 +1,194 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package docker
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// A container's resource usage at a point in time.
+type containerSample struct {
+	time     time.Time
+	cpuTotal uint64 // Nanoseconds of CPU time used.
+	memUsage uint64
+	memLimit uint64
+	memRss   uint64
+	memCache uint64
+	blkRead  uint64
+	blkWrite uint64
+	hasNet   bool // The cgroups don't account network traffic.
+	netRx    uint64
+	netTx    uint64
+}
+
+// Reads a single sample from the Docker stats API.
+func dockerSample(client DockerClient, id string, timeout time.Duration) (
+	*containerSample, error) {
+
+	statsChan := make(chan *docker.Stats, 1)
+	done := make(chan bool)
+	defer close(done)
+	errChan := make(chan error, 1)
+	go func() {
+		// Closes statsChan when it returns.
+		errChan <- client.Stats(docker.StatsOptions{
+			ID:      id,
+			Stats:   statsChan,
+			Stream:  false,
+			Done:    done,
+			Timeout: timeout,
+		})
+	}()
+	stats, ok := <-statsChan
+	if !ok {
+		if err := <-errChan; err != nil {
+			return nil, err
+		}
+		return nil, errors.New("no stats returned")
+	}
+
+	s := &containerSample{
+		time:     stats.Read,
+		cpuTotal: stats.CPUStats.CPUUsage.TotalUsage,
+		memUsage: stats.MemoryStats.Usage,
+		memLimit: stats.MemoryStats.Limit,
+		memRss:   stats.MemoryStats.Stats.Rss,
+		memCache: stats.MemoryStats.Stats.Cache,
+		hasNet:   true,
+	}
+	for _, entry := range stats.BlkioStats.IOServiceBytesRecursive {
+		switch entry.Op {
+		case "Read":
+			s.blkRead += entry.Value
+		case "Write":
+			s.blkWrite += entry.Value
+		}
+	}
+	// Older API versions only report the default network.
+	if len(stats.Networks) == 0 {
+		s.netRx, s.netTx = stats.Network.RxBytes, stats.Network.TxBytes
+	}
+	for _, network := range stats.Networks {
+		s.netRx += network.RxBytes
+		s.netTx += network.TxBytes
+	}
+	return s, nil
+}
+
+// Finds a container's cgroup in a subsystem's hierarchy, which depends on
+// whether Docker uses the cgroupfs or the systemd cgroup driver.
+func containerCgroup(cgroupPath, subsystem, id string) (string, error) {
+	for _, dir := range []string{
+		filepath.Join(cgroupPath, subsystem, "docker", id),
+		filepath.Join(cgroupPath, subsystem, "system.slice", "docker-"+id+".scope"),
+	} {
+		if _, err := os.Stat(dir); err == nil {
+			return dir, nil
+		}
+	}
+	return "", fmt.Errorf("no %s cgroup for container %s", subsystem, id)
+}
+
+func readCgroupUint(dir, name string) (uint64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// Reads a sample straight from the container's cgroups, w/o going through
+// the Docker daemon.
+func cgroupSample(cgroupPath, id string) (s *containerSample, err error) {
+	s = &containerSample{time: time.Now()}
+
+	dir, err := containerCgroup(cgroupPath, "cpuacct", id)
+	if err != nil {
+		return nil, err
+	}
+	if s.cpuTotal, err = readCgroupUint(dir, "cpuacct.usage"); err != nil {
+		return nil, err
+	}
+
+	if dir, err = containerCgroup(cgroupPath, "memory", id); err != nil {
+		return nil, err
+	}
+	if s.memUsage, err = readCgroupUint(dir, "memory.usage_in_bytes"); err != nil {
+		return nil, err
+	}
+	if s.memLimit, err = readCgroupUint(dir, "memory.limit_in_bytes"); err != nil {
+		return nil, err
+	}
+	err = readCgroupStats(filepath.Join(dir, "memory.stat"), func(fields []string) {
+		if len(fields) != 2 {
+			return
+		}
+		value, _ := strconv.ParseUint(fields[1], 10, 64)
+		switch fields[0] {
+		case "rss":
+			s.memRss = value
+		case "cache":
+			s.memCache = value
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if dir, err = containerCgroup(cgroupPath, "blkio", id); err != nil {
+		return nil, err
+	}
+	// Lines are "<major>:<minor> <op> <bytes>", plus a "Total <bytes>" line.
+	err = readCgroupStats(filepath.Join(dir, "blkio.throttle.io_service_bytes"),
+		func(fields []string) {
+			if len(fields) != 3 {
+				return
+			}
+			value, _ := strconv.ParseUint(fields[2], 10, 64)
+			switch fields[1] {
+			case "Read":
+				s.blkRead += value
+			case "Write":
+				s.blkWrite += value
+			}
+		})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func readCgroupStats(path string, line func(fields []string)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line(strings.Fields(scanner.Text()))
+	}
+	return scanner.Err()
+}
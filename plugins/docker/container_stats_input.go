@@ -0,0 +1,196 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package docker
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"github.com/pborman/uuid"
+)
+
+type ContainerStatsInputConfig struct {
+	// A Docker endpoint.
+	Endpoint string `toml:"endpoint"`
+	CertPath string `toml:"cert_path"`
+	// Where the stats are read from, "docker" for the Docker stats API or
+	// "cgroupfs" for the containers' cgroups. Defaults to "docker".
+	Source string `toml:"source"`
+	// Mount point of the cgroup hierarchies. Defaults to "/sys/fs/cgroup".
+	CgroupPath string `toml:"cgroup_path"`
+	// Seconds between polls. Defaults to 10.
+	TickerInterval uint `toml:"ticker_interval"`
+	// Milliseconds a container's stats may take to be read. Defaults to 5000.
+	Timeout          uint     `toml:"timeout"`
+	NameFromEnv      string   `toml:"name_from_env_var"`
+	FieldsFromEnv    []string `toml:"fields_from_env"`
+	FieldsFromLabels []string `toml:"fields_from_labels"`
+}
+
+// Input plugin that periodically reads the resource usage of all running
+// containers, emitting a message w/ the metrics of each of them.
+type ContainerStatsInput struct {
+	conf     *ContainerStatsInputConfig
+	client   DockerClient
+	timeout  time.Duration
+	stopChan chan struct{}
+	ir       pipeline.InputRunner
+	hostname string
+	// By container ID, for the containers running at the previous poll.
+	metadata map[string]map[string]string
+	previous map[string]*containerSample
+}
+
+func (ci *ContainerStatsInput) ConfigStruct() interface{} {
+	return &ContainerStatsInputConfig{
+		Endpoint:       "unix:///var/run/docker.sock",
+		Source:         "docker",
+		CgroupPath:     "/sys/fs/cgroup",
+		TickerInterval: 10,
+		Timeout:        5000,
+	}
+}
+
+func (ci *ContainerStatsInput) Init(config interface{}) (err error) {
+	ci.conf = config.(*ContainerStatsInputConfig)
+	if ci.conf.Source != "docker" && ci.conf.Source != "cgroupfs" {
+		return fmt.Errorf("ContainerStatsInput: invalid source: %s", ci.conf.Source)
+	}
+	// The containers and their metadata always come from Docker.
+	if ci.client, err = newDockerClient(ci.conf.CertPath, ci.conf.Endpoint); err != nil {
+		return fmt.Errorf("ContainerStatsInput: can't create client: %s", err)
+	}
+	ci.timeout = time.Duration(ci.conf.Timeout) * time.Millisecond
+	ci.metadata = make(map[string]map[string]string)
+	ci.previous = make(map[string]*containerSample)
+	ci.stopChan = make(chan struct{})
+	return nil
+}
+
+func (ci *ContainerStatsInput) Run(ir pipeline.InputRunner, h pipeline.PluginHelper) error {
+	ci.ir = ir
+	ci.hostname = h.Hostname()
+	ticker := ir.Ticker()
+	for {
+		select {
+		case <-ticker:
+			if err := ci.poll(); err != nil {
+				ir.LogError(fmt.Errorf("can't list containers: %s", err))
+			}
+		case <-ci.stopChan:
+			return nil
+		}
+	}
+}
+
+func (ci *ContainerStatsInput) poll() error {
+	containers, err := ci.client.ListContainers(docker.ListContainersOptions{})
+	if err != nil {
+		return err
+	}
+	running := make(map[string]bool, len(containers))
+	for _, c := range containers {
+		running[c.ID] = true
+		fields, ok := ci.metadata[c.ID]
+		if !ok {
+			// Containers are inspected once, their env and labels don't
+			// change while they're running.
+			fields, err = extractFields(c.ID, ci.client, ci.conf.FieldsFromLabels,
+				ci.conf.FieldsFromEnv, ci.conf.NameFromEnv)
+			if err != nil {
+				ci.ir.LogError(fmt.Errorf("can't inspect container %s: %s", c.ID, err))
+				continue
+			}
+			ci.metadata[c.ID] = fields
+		}
+
+		var sample *containerSample
+		if ci.conf.Source == "docker" {
+			sample, err = dockerSample(ci.client, c.ID, ci.timeout)
+		} else {
+			sample, err = cgroupSample(ci.conf.CgroupPath, c.ID)
+		}
+		if err != nil {
+			ci.ir.LogError(fmt.Errorf("can't read stats of container %s: %s",
+				fields["ContainerName"], err))
+			continue
+		}
+		pack := <-ci.ir.InChan()
+		ci.populate(pack.Message, fields, sample, ci.previous[c.ID])
+		ci.ir.Deliver(pack)
+		ci.previous[c.ID] = sample
+	}
+	for id := range ci.metadata {
+		if !running[id] {
+			delete(ci.metadata, id)
+			delete(ci.previous, id)
+		}
+	}
+	return nil
+}
+
+func (ci *ContainerStatsInput) populate(msg *message.Message,
+	fields map[string]string, s, prev *containerSample) {
+
+	msg.SetUuid(uuid.NewRandom())
+	msg.SetTimestamp(s.time.UnixNano())
+	msg.SetType("heka.containerstats")
+	msg.SetLogger(fields["ContainerName"])
+	msg.SetHostname(ci.hostname)
+	for name, value := range fields {
+		message.NewStringField(msg, name, value)
+	}
+
+	addInt := func(name string, value uint64, representation string) {
+		message.NewInt64Field(msg, name, int64(value), representation)
+	}
+	addFloat := func(name string, value float64) {
+		field, _ := message.NewField(name, value, "%")
+		msg.AddField(field)
+	}
+	// CPU usage is relative to a single CPU, so a container using two of
+	// them fully is at 200%.
+	if prev != nil && s.time.After(prev.time) && s.cpuTotal >= prev.cpuTotal {
+		elapsed := s.time.Sub(prev.time).Nanoseconds()
+		addFloat("CpuPercent", float64(s.cpuTotal-prev.cpuTotal)/float64(elapsed)*100)
+	}
+	addInt("CpuTotal", s.cpuTotal, "ns")
+	addInt("MemoryUsage", s.memUsage, "B")
+	addInt("MemoryLimit", s.memLimit, "B")
+	addInt("MemoryRss", s.memRss, "B")
+	addInt("MemoryCache", s.memCache, "B")
+	if s.memLimit > 0 {
+		addFloat("MemoryPercent", float64(s.memUsage)/float64(s.memLimit)*100)
+	}
+	addInt("BlkioReadBytes", s.blkRead, "B")
+	addInt("BlkioWriteBytes", s.blkWrite, "B")
+	if s.hasNet {
+		addInt("NetRxBytes", s.netRx, "B")
+		addInt("NetTxBytes", s.netTx, "B")
+	}
+}
+
+func (ci *ContainerStatsInput) Stop() {
+	close(ci.stopChan)
+}
+
+func init() {
+	pipeline.RegisterPlugin("ContainerStatsInput", func() interface{} {
+		return new(ContainerStatsInput)
+	})
+}
@@ -0,0 +1,296 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package docker
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	"github.com/mozilla-services/heka/pipelinemock"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+// DockerClient w/ canned containers and stats, keyed by container ID. A
+// container w/o stats has gone away by the time they're requested.
+type fakeDockerClient struct {
+	containers []docker.APIContainers
+	stats      map[string]string
+}
+
+func (f *fakeDockerClient) AddEventListener(listener chan<- *docker.APIEvents) error {
+	return nil
+}
+
+func (f *fakeDockerClient) RemoveEventListener(listener chan *docker.APIEvents) error {
+	return nil
+}
+
+func (f *fakeDockerClient) ListContainers(opts docker.ListContainersOptions) (
+	[]docker.APIContainers, error) {
+
+	return f.containers, nil
+}
+
+func (f *fakeDockerClient) InspectContainer(id string) (*docker.Container, error) {
+	return &docker.Container{
+		ID:   id,
+		Name: "/" + id + "-name",
+		Config: &docker.Config{
+			Image:  "heka",
+			Env:    []string{"APP=web"},
+			Labels: map[string]string{"tier": "front"},
+		},
+	}, nil
+}
+
+func (f *fakeDockerClient) AttachToContainer(opts docker.AttachToContainerOptions) error {
+	return nil
+}
+
+func (f *fakeDockerClient) Stats(opts docker.StatsOptions) error {
+	defer close(opts.Stats)
+	data, ok := f.stats[opts.ID]
+	if !ok {
+		return errors.New("no such container: " + opts.ID)
+	}
+	stats := new(docker.Stats)
+	if err := json.Unmarshal([]byte(data), stats); err != nil {
+		return err
+	}
+	opts.Stats <- stats
+	return nil
+}
+
+func (f *fakeDockerClient) Logs(opts docker.LogsOptions) error {
+	return nil
+}
+
+func (f *fakeDockerClient) Ping() error {
+	return nil
+}
+
+const dockerStatsJson = `{
+	"read": "2016-05-04T10:00:00Z",
+	"cpu_stats": {"cpu_usage": {"total_usage": 3000000000}},
+	"memory_stats": {
+		"usage": 256,
+		"limit": 1024,
+		"stats": {"rss": 128, "cache": 64}
+	},
+	"blkio_stats": {"io_service_bytes_recursive": [
+		{"major": 8, "minor": 0, "op": "Read", "value": 10},
+		{"major": 8, "minor": 0, "op": "Write", "value": 20},
+		{"major": 8, "minor": 16, "op": "Read", "value": 1},
+		{"major": 8, "minor": 16, "op": "Total", "value": 31}
+	]},
+	"networks": {
+		"eth0": {"rx_bytes": 100, "tx_bytes": 200},
+		"eth1": {"rx_bytes": 1, "tx_bytes": 2}
+	}
+}`
+
+func ContainerStatsInputSpec(c gs.Context) {
+	t := new(pipeline_ts.SimpleT)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	c.Specify("A container's cgroups", func() {
+		cgroupPath, err := ioutil.TempDir("", "containerstats-tests")
+		c.Assume(err, gs.IsNil)
+		defer os.RemoveAll(cgroupPath)
+
+		writeStat := func(dir, name, data string) {
+			c.Assume(os.MkdirAll(dir, 0700), gs.IsNil)
+			err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0600)
+			c.Assume(err, gs.IsNil)
+		}
+		writeCgroups := func(containerDir string) {
+			cpuDir := filepath.Join(cgroupPath, "cpuacct", containerDir)
+			memDir := filepath.Join(cgroupPath, "memory", containerDir)
+			blkDir := filepath.Join(cgroupPath, "blkio", containerDir)
+			writeStat(cpuDir, "cpuacct.usage", "123456789\n")
+			writeStat(memDir, "memory.usage_in_bytes", "4096\n")
+			writeStat(memDir, "memory.limit_in_bytes", "8192\n")
+			writeStat(memDir, "memory.stat", "cache 1024\nrss 2048\nrss_huge 0\n")
+			writeStat(blkDir, "blkio.throttle.io_service_bytes",
+				"8:0 Read 100\n8:0 Write 200\n8:0 Total 300\n"+
+					"8:16 Read 1\n8:16 Write 2\n8:16 Total 3\nTotal 303\n")
+		}
+		checkSample := func(s *containerSample) {
+			c.Expect(s.cpuTotal, gs.Equals, uint64(123456789))
+			c.Expect(s.memUsage, gs.Equals, uint64(4096))
+			c.Expect(s.memLimit, gs.Equals, uint64(8192))
+			c.Expect(s.memRss, gs.Equals, uint64(2048))
+			c.Expect(s.memCache, gs.Equals, uint64(1024))
+			c.Expect(s.blkRead, gs.Equals, uint64(101))
+			c.Expect(s.blkWrite, gs.Equals, uint64(202))
+			c.Expect(s.hasNet, gs.IsFalse)
+		}
+
+		c.Specify("are read w/ the cgroupfs driver", func() {
+			writeCgroups(filepath.Join("docker", "abc"))
+			s, err := cgroupSample(cgroupPath, "abc")
+			c.Assume(err, gs.IsNil)
+			checkSample(s)
+		})
+
+		c.Specify("are read w/ the systemd driver", func() {
+			writeCgroups(filepath.Join("system.slice", "docker-abc.scope"))
+			s, err := cgroupSample(cgroupPath, "abc")
+			c.Assume(err, gs.IsNil)
+			checkSample(s)
+		})
+
+		c.Specify("can't be read once the container is gone", func() {
+			writeCgroups(filepath.Join("docker", "abc"))
+			_, err := cgroupSample(cgroupPath, "def")
+			c.Expect(err.Error(), gs.Equals, "no cpuacct cgroup for container def")
+		})
+	})
+
+	c.Specify("The Docker stats", func() {
+		client := &fakeDockerClient{stats: map[string]string{"abc": dockerStatsJson}}
+
+		c.Specify("are decoded", func() {
+			s, err := dockerSample(client, "abc", time.Second)
+			c.Assume(err, gs.IsNil)
+			c.Expect(s.time.Equal(time.Date(2016, 5, 4, 10, 0, 0, 0, time.UTC)), gs.IsTrue)
+			c.Expect(s.cpuTotal, gs.Equals, uint64(3000000000))
+			c.Expect(s.memUsage, gs.Equals, uint64(256))
+			c.Expect(s.memLimit, gs.Equals, uint64(1024))
+			c.Expect(s.memRss, gs.Equals, uint64(128))
+			c.Expect(s.memCache, gs.Equals, uint64(64))
+			c.Expect(s.blkRead, gs.Equals, uint64(11))
+			c.Expect(s.blkWrite, gs.Equals, uint64(20))
+			c.Expect(s.hasNet, gs.IsTrue)
+			c.Expect(s.netRx, gs.Equals, uint64(101))
+			c.Expect(s.netTx, gs.Equals, uint64(202))
+		})
+
+		c.Specify("fall back to the default network w/ older APIs", func() {
+			client.stats["abc"] = `{"network": {"rx_bytes": 5, "tx_bytes": 6}}`
+			s, err := dockerSample(client, "abc", time.Second)
+			c.Assume(err, gs.IsNil)
+			c.Expect(s.netRx, gs.Equals, uint64(5))
+			c.Expect(s.netTx, gs.Equals, uint64(6))
+		})
+
+		c.Specify("can't be read once the container is gone", func() {
+			_, err := dockerSample(client, "def", time.Second)
+			c.Expect(err.Error(), gs.Equals, "no such container: def")
+		})
+	})
+
+	c.Specify("A ContainerStatsInput", func() {
+		client := &fakeDockerClient{
+			containers: []docker.APIContainers{{ID: "abc"}},
+			stats:      map[string]string{"abc": dockerStatsJson},
+		}
+		input := new(ContainerStatsInput)
+		input.conf = input.ConfigStruct().(*ContainerStatsInputConfig)
+		input.conf.FieldsFromEnv = []string{"APP"}
+		input.conf.FieldsFromLabels = []string{"tier"}
+		input.client = client
+		input.timeout = time.Second
+		input.hostname = "hekatests.example.com"
+		input.metadata = make(map[string]map[string]string)
+		input.previous = make(map[string]*containerSample)
+
+		mockIR := pipelinemock.NewMockInputRunner(ctrl)
+		input.ir = mockIR
+		recycleChan := make(chan *pipeline.PipelinePack, 1)
+		inChan := make(chan *pipeline.PipelinePack, 1)
+		mockIR.EXPECT().InChan().Return(inChan).AnyTimes()
+
+		getField := func(msg *message.Message, name string) interface{} {
+			value, _ := msg.GetFieldValue(name)
+			return value
+		}
+
+		c.Specify("emits the metrics of each container", func() {
+			pack := pipeline.NewPipelinePack(recycleChan)
+			inChan <- pack
+			mockIR.EXPECT().Deliver(pack)
+			c.Expect(input.poll(), gs.IsNil)
+
+			msg := pack.Message
+			c.Expect(msg.GetType(), gs.Equals, "heka.containerstats")
+			c.Expect(msg.GetLogger(), gs.Equals, "abc-name")
+			c.Expect(msg.GetHostname(), gs.Equals, "hekatests.example.com")
+			c.Expect(getField(msg, "ContainerID"), gs.Equals, "abc")
+			c.Expect(getField(msg, "ContainerImage"), gs.Equals, "heka")
+			c.Expect(getField(msg, "APP"), gs.Equals, "web")
+			c.Expect(getField(msg, "tier"), gs.Equals, "front")
+			c.Expect(getField(msg, "CpuTotal"), gs.Equals, int64(3000000000))
+			c.Expect(getField(msg, "MemoryUsage"), gs.Equals, int64(256))
+			c.Expect(getField(msg, "MemoryLimit"), gs.Equals, int64(1024))
+			c.Expect(getField(msg, "MemoryRss"), gs.Equals, int64(128))
+			c.Expect(getField(msg, "MemoryCache"), gs.Equals, int64(64))
+			c.Expect(getField(msg, "MemoryPercent"), gs.Equals, float64(25))
+			c.Expect(getField(msg, "BlkioReadBytes"), gs.Equals, int64(11))
+			c.Expect(getField(msg, "BlkioWriteBytes"), gs.Equals, int64(20))
+			c.Expect(getField(msg, "NetRxBytes"), gs.Equals, int64(101))
+			c.Expect(getField(msg, "NetTxBytes"), gs.Equals, int64(202))
+			// There's no previous sample to compute it from.
+			c.Expect(getField(msg, "CpuPercent"), gs.IsNil)
+
+			c.Specify("w/ the CPU usage since the previous poll", func() {
+				client.stats["abc"] = `{
+					"read": "2016-05-04T10:00:10Z",
+					"cpu_stats": {"cpu_usage": {"total_usage": 8000000000}}
+				}`
+				pack := pipeline.NewPipelinePack(recycleChan)
+				inChan <- pack
+				mockIR.EXPECT().Deliver(pack)
+				c.Expect(input.poll(), gs.IsNil)
+				// 5s of CPU time over 10s.
+				c.Expect(getField(pack.Message, "CpuPercent"), gs.Equals, float64(50))
+			})
+		})
+
+		c.Specify("logs the containers that went away", func() {
+			client.containers = append(client.containers, docker.APIContainers{ID: "def"})
+			pack := pipeline.NewPipelinePack(recycleChan)
+			inChan <- pack
+			mockIR.EXPECT().Deliver(pack)
+			mockIR.EXPECT().LogError(
+				errors.New("can't read stats of container def-name: no such container: def"))
+			c.Expect(input.poll(), gs.IsNil)
+			c.Expect(input.previous["abc"], gs.Not(gs.IsNil))
+			c.Expect(input.previous["def"], gs.IsNil)
+
+			c.Specify("and forgets them once they're no longer listed", func() {
+				client.containers = client.containers[:1]
+				pack := pipeline.NewPipelinePack(recycleChan)
+				inChan <- pack
+				mockIR.EXPECT().Deliver(pack)
+				c.Expect(input.poll(), gs.IsNil)
+				_, ok := input.metadata["def"]
+				c.Expect(ok, gs.IsFalse)
+				_, ok = input.metadata["abc"]
+				c.Expect(ok, gs.IsTrue)
+			})
+		})
+	})
+}
@@ -102,6 +102,9 @@ type ElasticSearchOutputConfig struct {
 	ConnectTimeout uint32 `toml:"connect_timeout"`
 	// Whether or not to buffer records to disk before sending to ElasticSearch.
 	UseBuffering bool `toml:"use_buffering"`
+	// Resolve the host and port of an HTTP(S) server URL from a Consul service
+	// or SRV records rather than using the URL's.
+	Discovery *tcp.DiscoveryConfig
 }
 
 func (o *ElasticSearchOutput) ConfigStruct() interface{} {
@@ -137,10 +140,19 @@ func (o *ElasticSearchOutput) Init(config interface{}) (err error) {
 				}
 			}
 
-			o.bulkIndexer = NewHttpBulkIndexer(scheme, serverUrl.Host, serverUrl.Path,
+			indexer := NewHttpBulkIndexer(scheme, serverUrl.Host, serverUrl.Path,
 				o.conf.FlushCount, o.conf.Username, o.conf.Password, o.conf.HTTPTimeout,
 				o.conf.HTTPDisableKeepalives, o.conf.ConnectTimeout, tlsConf)
+			if o.conf.Discovery != nil {
+				if indexer.Resolver, err = tcp.NewResolver(o.conf.Discovery); err != nil {
+					return err
+				}
+			}
+			o.bulkIndexer = indexer
 		case "udp":
+			if o.conf.Discovery != nil {
+				return errors.New("discovery is only supported for `http` and `https` URLs")
+			}
 			o.bulkIndexer = NewUDPBulkIndexer(serverUrl.Host, o.conf.FlushCount)
 		default:
 			err = errors.New("Server URL must specify one of `udp`, `http`, or `https`.")
@@ -345,6 +357,8 @@ type HttpBulkIndexer struct {
 	username string
 	// Optional password for HTTP authentication
 	password string
+	// Optional resolver for the Domain, which is ignored if it's set.
+	Resolver *tcp.Resolver
 }
 
 func NewHttpBulkIndexer(protocol string, domain string, path string, maxCount int,
@@ -389,7 +403,13 @@ func (h *HttpBulkIndexer) Index(body []byte) (err error, retry bool) {
 		return nil, false
 	}
 
-	url := fmt.Sprintf("%s://%s%s%s", h.Protocol, h.Domain, h.Path, "/_bulk")
+	domain := h.Domain
+	if h.Resolver != nil {
+		if domain, err = h.Resolver.Addr(); err != nil {
+			return err, true
+		}
+	}
+	url := fmt.Sprintf("%s://%s%s%s", h.Protocol, domain, h.Path, "/_bulk")
 
 	// Creating ElasticSearch Bulk HTTP request
 	request, err := http.NewRequest("POST", url, bytes.NewReader(body))
@@ -405,6 +425,9 @@ func (h *HttpBulkIndexer) Index(body []byte) (err error, retry bool) {
 	response, err := h.client.Do(request)
 	request_time := time.Since(request_start_time)
 	if err != nil {
+		if h.Resolver != nil {
+			h.Resolver.Failed(domain)
+		}
 		if (h.client.Timeout > 0) && (request_time >= h.client.Timeout) &&
 			(strings.Contains(err.Error(), "use of closed network connection")) {
 
@@ -245,6 +245,7 @@ type ESJsonEncoder struct {
 	dynamicFields     []string
 	usesDynamicFields bool
     	replaceDotsWith   string
+	binaryPayload     BinaryPayloadMode
 }
 
 // Heka fields to ElasticSearch mapping
@@ -284,6 +285,9 @@ type ESJsonEncoderConfig struct {
 	DynamicFields []string `toml:"dynamic_fields"`
    	// Replace dot (".") characters in JSON field names with a substitute string.
    	ReplaceDotsWith string `toml:"replace_dots_with"`
+	// How to write a payload that isn't valid UTF-8, one of "replace",
+	// "base64" or "reject". Defaults to "replace".
+	BinaryPayload string `toml:"binary_payload"`
 }
 
 func (e *ESJsonEncoder) ConfigStruct() interface{} {
@@ -326,6 +330,9 @@ func (e *ESJsonEncoder) Init(config interface{}) (err error) {
 	}
 	e.fieldMappings = conf.FieldMappings
 	e.dynamicFields = conf.DynamicFields
+	if e.binaryPayload, err = ParseBinaryPayloadMode(conf.BinaryPayload); err != nil {
+		return
+	}
 
 	usesDynamicFields := false
 	for i, f := range e.fields {
@@ -372,7 +379,11 @@ func (e *ESJsonEncoder) Encode(pack *PipelinePack) (output []byte, err error) {
 		case "severity":
 			writeIntField(first, &buf, e.fieldMappings.Severity, m.GetSeverity())
 		case "payload":
-			writeStringField(first, &buf, e.fieldMappings.Payload, m.GetPayload())
+			var payload string
+			if payload, err = e.binaryPayload.Text(m.GetPayload()); err != nil {
+				return nil, err
+			}
+			writeStringField(first, &buf, e.fieldMappings.Payload, payload)
 		case "envversion":
 			writeStringField(first, &buf, e.fieldMappings.EnvVersion, m.GetEnvVersion())
 		case "pid":
@@ -428,6 +439,7 @@ type ESLogstashV0Encoder struct {
 	dynamicFields   []string
 	useMessageType  bool
     	replaceDotsWith string
+	binaryPayload   BinaryPayloadMode
 }
 
 type ESLogstashV0EncoderConfig struct {
@@ -454,6 +466,9 @@ type ESLogstashV0EncoderConfig struct {
 	DynamicFields []string `toml:"dynamic_fields"`
 	// Replace dot (".") characters in JSON field names with a substitute string.
    	ReplaceDotsWith string `toml:"replace_dots_with"`
+	// How to write a payload that isn't valid UTF-8, one of "replace",
+	// "base64" or "reject". Defaults to "replace".
+	BinaryPayload string `toml:"binary_payload"`
 }
 
 func (e *ESLogstashV0Encoder) ConfigStruct() interface{} {
@@ -487,6 +502,9 @@ func (e *ESLogstashV0Encoder) Init(config interface{}) (err error) {
 		Id:                   conf.Id,
 	}
 	e.dynamicFields = conf.DynamicFields
+	if e.binaryPayload, err = ParseBinaryPayloadMode(conf.BinaryPayload); err != nil {
+		return
+	}
 
 	usesDynamicFields := false
 	for i, f := range e.fields {
@@ -543,7 +561,11 @@ func (e *ESLogstashV0Encoder) Encode(pack *PipelinePack) (output []byte, err err
 		case "severity":
 			writeIntField(first, &buf, `@severity`, m.GetSeverity())
 		case "payload":
-			writeStringField(first, &buf, `@message`, m.GetPayload())
+			var payload string
+			if payload, err = e.binaryPayload.Text(m.GetPayload()); err != nil {
+				return nil, err
+			}
+			writeStringField(first, &buf, `@message`, payload)
 		case "envversion":
 			writeStringField(first, &buf, `@envversion`, m.GetEnvVersion())
 		case "pid":
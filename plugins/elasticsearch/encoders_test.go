@@ -526,5 +526,38 @@ func ESEncodersSpec(c gs.Context) {
 				c.Expect(len(decoded), gs.Equals, 11) // 9 base fields and 2 dynamic fields.
 			})
 		})
+
+		c.Specify("handles binary payloads", func() {
+			pack.Message.SetPayloadBytes([]byte{0x00, 0xff, 'h', 'e', 'k', 'a'})
+			config.Fields = []string{"Payload"}
+
+			c.Specify("by base64 encoding them", func() {
+				config.BinaryPayload = "base64"
+				err := encoder.Init(config)
+				c.Assume(err, gs.IsNil)
+				b, err := encoder.Encode(pack)
+				c.Expect(err, gs.IsNil)
+
+				lines := strings.Split(string(b), string(NEWLINE))
+				decoded := make(map[string]interface{})
+				err = json.Unmarshal([]byte(lines[1]), &decoded)
+				c.Assume(err, gs.IsNil)
+				c.Expect(decoded["Payload"], gs.Equals, "AP9oZWth")
+			})
+
+			c.Specify("by rejecting them", func() {
+				config.BinaryPayload = "reject"
+				err := encoder.Init(config)
+				c.Assume(err, gs.IsNil)
+				_, err = encoder.Encode(pack)
+				c.Expect(err, gs.Equals, ErrBinaryPayload)
+			})
+
+			c.Specify("validates the binary_payload setting", func() {
+				config.BinaryPayload = "drop"
+				err := encoder.Init(config)
+				c.Expect(err, gs.Not(gs.IsNil))
+			})
+		})
 	})
 }
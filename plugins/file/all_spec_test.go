@@ -25,6 +25,7 @@ func TestAllSpecs(t *testing.T) {
 
 	r.AddSpec(FileOutputSpec)
 	r.AddSpec(FilePollingInputSpec)
+	r.AddSpec(SpoolDirInputSpec)
 
 	gospec.MainGoTest(r, t)
 }
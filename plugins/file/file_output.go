@@ -20,6 +20,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"os/user"
 	"path/filepath"
 	"strconv"
 	"time"
@@ -33,6 +34,14 @@ import (
 type outBatch struct {
 	data   []byte
 	cursor string
+	parts  []outPart
+}
+
+// Run of data in a partitioned FileOutput's batch that goes to a single file,
+// ending at offset end of the batch data.
+type outPart struct {
+	path string
+	end  int
 }
 
 func newOutBatch() *outBatch {
@@ -54,6 +63,11 @@ type FileOutput struct {
 	timerChan  <-chan time.Time
 	rotateChan chan time.Time
 	closing    chan struct{}
+	template   pathTemplate
+	files      *fileCache
+	uid        int
+	gid        int
+	dirty      bool
 }
 
 // ConfigStruct for FileOutput plugin.
@@ -62,8 +76,16 @@ type FileOutputConfig struct {
 	// If date rotation is in use, then the output file name can support
 	// Go's time.Format syntax to embed timestamps in the filename:
 	// http://golang.org/pkg/time/#Time.Format
+	// The path can also reference message headers, fields and the message
+	// timestamp w/ `%{...}`, e.g. `/data/%{Type}/%{2006-01-02}.log`, in
+	// which case each message is written to the file its path renders to.
 	Path string
 
+	// Maximum number of files a partitioned FileOutput keeps open at once,
+	// the least recently written is closed to make room for a new one
+	// (default 64).
+	MaxOpenFiles uint `toml:"max_open_files"`
+
 	// Output file permissions (default "644").
 	Perm string
 
@@ -86,6 +108,20 @@ type FileOutputConfig struct {
 	// "AND").
 	FlushOperator string `toml:"flush_operator"`
 
+	// User and group that should own the files the FileOutput creates, as
+	// names or numeric ids. Changing the owner requires Heka to be running
+	// as root, which is only the case until privileges are dropped.
+	Owner string
+	Group string
+
+	// Interval at which written data is synced to disk, in milliseconds.
+	// Set to 0 (the default) to sync after every write.
+	FsyncInterval uint32 `toml:"fsync_interval"`
+
+	// Truncate the output file when it's opened instead of appending to it
+	// (default false).
+	Truncate bool
+
 	// Permissions to apply to directories created for FileOutput's parent
 	// directory if it doesn't exist.  Must be a string representation of an
 	// octal integer. Defaults to "700".
@@ -111,6 +147,7 @@ func (o *FileOutput) ConfigStruct() interface{} {
 		FlushCount:       1,
 		FlushOperator:    "AND",
 		FolderPerm:       "700",
+		MaxOpenFiles:     64,
 		BufferConfig:     bufConfig,
 	}
 }
@@ -134,6 +171,10 @@ func (o *FileOutput) Init(config interface{}) (err error) {
 	}
 	o.perm = os.FileMode(intPerm)
 
+	if o.uid, o.gid, err = lookupOwner(conf.Owner, conf.Group); err != nil {
+		return fmt.Errorf("FileOutput '%s': %s", o.Path, err)
+	}
+
 	if conf.FlushCount < 1 {
 		err = fmt.Errorf("Parameter 'flush_count' needs to be greater 1.")
 		return err
@@ -149,6 +190,27 @@ func (o *FileOutput) Init(config interface{}) (err error) {
 		return err
 	}
 
+	if o.template, err = parsePathTemplate(conf.Path); err != nil {
+		return fmt.Errorf("FileOutput '%s' can't parse `path`: %s", o.Path, err)
+	}
+	if o.template != nil {
+		if conf.RotationInterval != 0 {
+			return errors.New("Parameter 'rotation_interval' can't be used w/ a partitioned `path`, use a timestamp reference instead.")
+		}
+		if conf.Truncate {
+			return errors.New("Parameter 'truncate' can't be used w/ a partitioned `path`.")
+		}
+		if conf.MaxOpenFiles < 1 {
+			return errors.New("Parameter 'max_open_files' needs to be at least 1.")
+		}
+		o.files = newFileCache(int(conf.MaxOpenFiles), o.openPath)
+		o.closing = make(chan struct{})
+		o.batchChan = make(chan *outBatch)
+		o.backChan = make(chan *outBatch, 2)
+		o.rotateChan = make(chan time.Time)
+		return nil
+	}
+
 	o.closing = make(chan struct{})
 	switch conf.RotationInterval {
 	case 0:
@@ -208,10 +270,93 @@ func (o *FileOutput) openFile() (err error) {
 	if err = plugins.CheckWritePermission(basePath); err != nil {
 		return
 	}
-	o.file, err = os.OpenFile(o.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, o.perm)
+	o.file, err = o.createFile(o.path)
 	return
 }
 
+// Opens one of a partitioned FileOutput's files, creating its folder if
+// needed.
+func (o *FileOutput) openPath(path string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), o.folderPerm); err != nil {
+		return nil, fmt.Errorf("Can't create the folder for '%s': %s", path, err)
+	}
+	return o.createFile(path)
+}
+
+// Opens the file for appending, or truncates it, creating it if needed. New
+// files get the configured owner and exactly the configured permissions,
+// regardless of the umask.
+func (o *FileOutput) createFile(path string) (file *os.File, err error) {
+	flags := os.O_WRONLY | os.O_CREATE
+	if o.Truncate {
+		flags |= os.O_TRUNC
+	} else {
+		flags |= os.O_APPEND
+	}
+	_, err = os.Stat(path)
+	created := os.IsNotExist(err)
+	if file, err = os.OpenFile(path, flags, o.perm); err != nil || !created {
+		return
+	}
+	if err = file.Chmod(o.perm); err == nil && (o.uid != -1 || o.gid != -1) {
+		err = file.Chown(o.uid, o.gid)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Can't set the ownership of '%s': %s", path, err)
+	}
+	return
+}
+
+// Returns the uid and gid for the owner and group, -1 for either if it
+// isn't set.
+func lookupOwner(owner, group string) (uid, gid int, err error) {
+	uid, gid = -1, -1
+	if owner != "" {
+		id := owner
+		if _, e := strconv.Atoi(owner); e != nil {
+			u, e := user.Lookup(owner)
+			if e != nil {
+				return uid, gid, fmt.Errorf("unknown `owner` '%s': %s", owner, e)
+			}
+			id = u.Uid
+		}
+		if uid, err = strconv.Atoi(id); err != nil {
+			return -1, -1, fmt.Errorf("invalid uid '%s' for `owner` '%s'", id, owner)
+		}
+	}
+	if group != "" {
+		id := group
+		if _, e := strconv.Atoi(group); e != nil {
+			g, e := user.LookupGroup(group)
+			if e != nil {
+				return uid, gid, fmt.Errorf("unknown `group` '%s': %s", group, e)
+			}
+			id = g.Gid
+		}
+		if gid, err = strconv.Atoi(id); err != nil {
+			return -1, -1, fmt.Errorf("invalid gid '%s' for `group` '%s'", id, group)
+		}
+	}
+	return
+}
+
+// Syncs the written data to disk right away, or marks it as needing to be
+// synced at the next fsync interval.
+func (o *FileOutput) syncFile(file *os.File) {
+	if o.FsyncInterval == 0 {
+		file.Sync()
+	} else {
+		o.dirty = true
+	}
+}
+
+// Makes sure everything written to the file is on disk before closing it.
+func closeFile(file *os.File) {
+	file.Sync()
+	file.Close()
+}
+
 func (o *FileOutput) Run(or OutputRunner, h PluginHelper) error {
 	enc := or.Encoder()
 	if enc == nil {
@@ -271,6 +416,9 @@ func (o *FileOutput) receiver(or OutputRunner, errChan chan error) (err error) {
 			if outBytes != nil {
 				out.data = append(out.data, outBytes...)
 				out.cursor = pack.QueueCursor
+				if o.template != nil {
+					out.addPart(o.template.render(pack.Message))
+				}
 				msgCounter++
 			}
 			pack.Recycle(nil)
@@ -314,6 +462,45 @@ func (o *FileOutput) receiver(or OutputRunner, errChan chan error) (err error) {
 	return err
 }
 
+// Extends the last part of the batch to the end of the data if it's for the
+// same file, otherwise starts a new part.
+func (out *outBatch) addPart(path string) {
+	if n := len(out.parts); n > 0 && out.parts[n-1].path == path {
+		out.parts[n-1].end = len(out.data)
+		return
+	}
+	out.parts = append(out.parts, outPart{path, len(out.data)})
+}
+
+// Writes each part of a partitioned FileOutput's batch to its file. The
+// cursor is only advanced if all the writes succeeded.
+func (o *FileOutput) commitParts(or OutputRunner, out *outBatch) {
+	start := 0
+	failed := false
+	for _, part := range out.parts {
+		data := out.data[start:part.end]
+		start = part.end
+		file, err := o.files.get(part.path)
+		if err != nil {
+			or.LogError(fmt.Errorf("Can't open %s: %s", part.path, err))
+			failed = true
+			continue
+		}
+		n, err := file.Write(data)
+		if err != nil {
+			or.LogError(fmt.Errorf("Can't write to %s: %s", part.path, err))
+			failed = true
+		} else if n != len(data) {
+			or.LogError(fmt.Errorf("data loss - truncated output for %s", part.path))
+		} else {
+			o.syncFile(file)
+		}
+	}
+	if !failed {
+		or.UpdateCursor(out.cursor)
+	}
+}
+
 // Runs in a separate goroutine, waits for buffered data on the committer
 // channel, writes it out to the filesystem, and puts the now empty buffer on
 // the return channel for reuse.
@@ -327,15 +514,33 @@ func (o *FileOutput) committer(or OutputRunner, errChan chan error) {
 	hupChan := make(chan interface{})
 	notify.Start(RELOAD, hupChan)
 
+	var syncChan <-chan time.Time
+	if o.FsyncInterval > 0 {
+		ticker := time.NewTicker(time.Duration(o.FsyncInterval) * time.Millisecond)
+		defer ticker.Stop()
+		syncChan = ticker.C
+	}
+
 	for ok {
 		select {
 		case out, ok = <-o.batchChan:
 			if !ok {
 				// Channel is closed => we're shutting down, exit cleanly.
-				o.file.Close()
+				if o.files != nil {
+					o.files.closeAll()
+				} else {
+					closeFile(o.file)
+				}
 				close(o.closing)
 				break
 			}
+			if o.files != nil {
+				o.commitParts(or, out)
+				out.data = out.data[:0]
+				out.parts = out.parts[:0]
+				o.backChan <- out
+				continue
+			}
 			n, err := o.file.Write(out.data)
 			if err != nil {
 				or.LogError(fmt.Errorf("Can't write to %s: %s", o.path, err))
@@ -343,13 +548,18 @@ func (o *FileOutput) committer(or OutputRunner, errChan chan error) {
 				or.LogError(fmt.Errorf("data loss - truncated output for %s", o.path))
 				or.UpdateCursor(out.cursor)
 			} else {
-				o.file.Sync()
+				o.syncFile(o.file)
 				or.UpdateCursor(out.cursor)
 			}
 			out.data = out.data[:0]
 			o.backChan <- out
 		case <-hupChan:
-			o.file.Close()
+			if o.files != nil {
+				// Files are reopened when they're next written to.
+				o.files.closeAll()
+				continue
+			}
+			closeFile(o.file)
 			if err = o.openFile(); err != nil {
 				close(o.closing)
 				err = fmt.Errorf("unable to reopen file '%s': %s", o.path, err)
@@ -357,8 +567,18 @@ func (o *FileOutput) committer(or OutputRunner, errChan chan error) {
 				ok = false
 				break
 			}
+		case <-syncChan:
+			if !o.dirty {
+				continue
+			}
+			if o.files != nil {
+				o.files.syncAll()
+			} else {
+				o.file.Sync()
+			}
+			o.dirty = false
 		case rotateTime := <-o.rotateChan:
-			o.file.Close()
+			closeFile(o.file)
 			o.path = gostrftime.Strftime(o.FileOutputConfig.Path, rotateTime)
 			if err = o.openFile(); err != nil {
 				close(o.closing)
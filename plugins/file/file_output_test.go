@@ -228,6 +228,34 @@ func FileOutputSpec(c gs.Context) {
 			})
 		})
 
+		c.Specify("truncates the file if configured to", func() {
+			err := ioutil.WriteFile(tmpFilePath, []byte("old contents\n"), 0644)
+			c.Assume(err, gs.IsNil)
+			config.Truncate = true
+			config.FsyncInterval = 10
+			err = fileOutput.Init(config)
+			c.Assume(err, gs.IsNil)
+			oth.MockOutputRunner.EXPECT().UpdateCursor(pack.QueueCursor)
+
+			go fileOutput.committer(oth.MockOutputRunner, errChan)
+			go func() {
+				fileOutput.batchChan <- &outBatch{data: []byte("new"), cursor: pack.QueueCursor}
+				<-fileOutput.backChan
+				close(fileOutput.batchChan)
+			}()
+			<-fileOutput.closing
+
+			contents, err := ioutil.ReadFile(tmpFilePath)
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(contents), gs.Equals, "new")
+		})
+
+		c.Specify("fails Init w/ an unknown owner", func() {
+			config.Owner = "no-such-heka-user"
+			err := fileOutput.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
 		if runtime.GOOS != "windows" {
 			if u, err := user.Current(); err != nil && u.Uid != "0" {
 				c.Specify("Init halts if basedirectory is not writable", func() {
@@ -255,6 +283,68 @@ func FileOutputSpec(c gs.Context) {
 			})
 		}
 
+		c.Specify("renders partitioned paths", func() {
+			tmpl, err := parsePathTemplate("/data/%{Type}/%{Fields[foo]}/%{missing}/%{2006-01}.log")
+			c.Assume(err, gs.IsNil)
+			c.Expect(tmpl.render(msg), gs.Equals, "/data/TEST/bar/_/2006-01.log")
+
+			tmpl, err = parsePathTemplate("/data/%{Hostname}/%{%Y}.log")
+			c.Assume(err, gs.IsNil)
+			msg.SetHostname("../../etc")
+			c.Expect(tmpl.render(msg), gs.Equals, "/data/.._.._etc/2006.log")
+
+			tmpl, err = parsePathTemplate(tmpFilePath)
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(tmpl), gs.Equals, 0)
+			_, err = parsePathTemplate("/data/%{Type.log")
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("partitions output by message", func() {
+			tmpDir := filepath.Join(os.TempDir(), fmt.Sprintf("%s-partitions", tmpFileName))
+			defer os.RemoveAll(tmpDir)
+			config.Path = filepath.Join(tmpDir, "%{Logger}", "%{foo}.log")
+			config.FlushInterval = 0
+			config.MaxOpenFiles = 1 // Forces files to be closed and reopened.
+			err := fileOutput.Init(config)
+			c.Assume(err, gs.IsNil)
+			c.Expect(fileOutput.file == nil, gs.IsTrue)
+
+			var packs []*PipelinePack
+			for _, logger := range []string{"one", "two", "one"} {
+				p := NewPipelinePack(pConfig.InputRecycleChan())
+				p.Message = pipeline_ts.GetTestMessage()
+				p.Message.SetLogger(logger)
+				p.Message.SetPayload(logger)
+				oth.MockOutputRunner.EXPECT().Encode(p).Return(encoder.Encode(p))
+				packs = append(packs, p)
+			}
+			oth.MockOutputRunner.EXPECT().InChan().Return(inChan)
+			oth.MockOutputRunner.EXPECT().UpdateCursor(gomock.Any()).Times(3)
+
+			go fileOutput.committer(oth.MockOutputRunner, errChan)
+			go fileOutput.receiver(oth.MockOutputRunner, errChan)
+			for _, p := range packs {
+				inChan <- p
+			}
+			close(inChan)
+			<-fileOutput.closing
+
+			contents, err := ioutil.ReadFile(filepath.Join(tmpDir, "one", "bar.log"))
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(contents), gs.Equals, "one\none\n")
+			contents, err = ioutil.ReadFile(filepath.Join(tmpDir, "two", "bar.log"))
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(contents), gs.Equals, "two\n")
+		})
+
+		c.Specify("rejects rotation w/ a partitioned path", func() {
+			config.Path = filepath.Join(os.TempDir(), "%{Type}.log")
+			config.RotationInterval = 24
+			err := fileOutput.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
 		c.Specify("that starts receiving w/ a flush interval", func() {
 			config.FlushInterval = 100000000 // We'll trigger the timer manually.
 			inChan := make(chan *PipelinePack)
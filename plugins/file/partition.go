@@ -0,0 +1,218 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package file
+
+import (
+	"container/list"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cactus/gostrftime"
+	"github.com/mozilla-services/heka/message"
+)
+
+// Replaces interpolated values that are empty or that would change the
+// directory structure of the path.
+const missingValue = "_"
+
+const (
+	partLiteral = iota
+	partHeader
+	partField
+	partTime
+)
+
+type pathPart struct {
+	kind  int
+	value string
+}
+
+// Output path w/ `%{...}` references to message headers, fields, and the
+// message timestamp, parsed once so rendering a message's path is cheap.
+type pathTemplate []pathPart
+
+// Parses a path, returning nil if it doesn't reference anything. A reference
+// is a header name (`%{Hostname}`), a dynamic field as either `%{name}` or
+// `%{Fields[name]}`, or a timestamp layout, either Go's reference time
+// (`%{2006-01-02}`) or strftime (`%{%Y-%m-%d}`). Anything containing a digit
+// or a `%` is taken to be a timestamp layout.
+func parsePathTemplate(path string) (pathTemplate, error) {
+	var tmpl pathTemplate
+	hasRefs := false
+	for len(path) > 0 {
+		start := strings.Index(path, "%{")
+		if start < 0 {
+			tmpl = append(tmpl, pathPart{partLiteral, path})
+			break
+		}
+		end := strings.Index(path[start:], "}")
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated reference in path: %s", path[start:])
+		}
+		if start > 0 {
+			tmpl = append(tmpl, pathPart{partLiteral, path[:start]})
+		}
+		ref := path[start+2 : start+end]
+		path = path[start+end+1:]
+		switch {
+		case ref == "":
+			return nil, fmt.Errorf("empty reference in path")
+		case ref == "Type" || ref == "Logger" || ref == "Hostname" ||
+			ref == "EnvVersion" || ref == "Pid" || ref == "Severity" ||
+			ref == "Uuid" || ref == "UUID":
+			tmpl = append(tmpl, pathPart{partHeader, ref})
+		case strings.HasPrefix(ref, "Fields[") && strings.HasSuffix(ref, "]"):
+			tmpl = append(tmpl, pathPart{partField, ref[7 : len(ref)-1]})
+		case strings.ContainsAny(ref, "%0123456789"):
+			tmpl = append(tmpl, pathPart{partTime, ref})
+		default:
+			tmpl = append(tmpl, pathPart{partField, ref})
+		}
+		hasRefs = true
+	}
+	if !hasRefs {
+		return nil, nil
+	}
+	return tmpl, nil
+}
+
+// Returns the path of the file the message should be written to. Timestamps
+// are rendered in local time, using the current time for messages w/o one.
+func (tmpl pathTemplate) render(m *message.Message) string {
+	var (
+		buf []byte
+		t   time.Time
+	)
+	for _, part := range tmpl {
+		var value string
+		switch part.kind {
+		case partLiteral:
+			buf = append(buf, part.value...)
+			continue
+		case partHeader:
+			switch part.value {
+			case "Type":
+				value = m.GetType()
+			case "Logger":
+				value = m.GetLogger()
+			case "Hostname":
+				value = m.GetHostname()
+			case "EnvVersion":
+				value = m.GetEnvVersion()
+			case "Pid":
+				value = strconv.Itoa(int(m.GetPid()))
+			case "Severity":
+				value = strconv.Itoa(int(m.GetSeverity()))
+			default:
+				value = m.GetUuidString()
+			}
+		case partField:
+			if v, ok := m.GetFieldValue(part.value); ok {
+				value = fmt.Sprint(v)
+			}
+		case partTime:
+			if t.IsZero() {
+				if m.Timestamp != nil {
+					t = time.Unix(0, m.GetTimestamp())
+				} else {
+					t = time.Now()
+				}
+			}
+			if strings.Contains(part.value, "%") {
+				value = gostrftime.Strftime(part.value, t)
+			} else {
+				value = t.Format(part.value)
+			}
+		}
+		buf = append(buf, cleanPathValue(value)...)
+	}
+	return string(buf)
+}
+
+// Keeps message data from escaping the directory structure of the template.
+func cleanPathValue(value string) string {
+	if value == "" || value == "." || value == ".." {
+		return missingValue
+	}
+	if strings.ContainsAny(value, "/\\\x00") {
+		value = strings.Map(func(r rune) rune {
+			if r == '/' || r == '\\' || r == 0 {
+				return '_'
+			}
+			return r
+		}, value)
+	}
+	return value
+}
+
+type cachedFile struct {
+	path string
+	file *os.File
+}
+
+// LRU of the files a partitioned FileOutput has open.
+type fileCache struct {
+	max   int
+	open  func(path string) (*os.File, error)
+	order *list.List
+	files map[string]*list.Element
+}
+
+func newFileCache(max int, open func(path string) (*os.File, error)) *fileCache {
+	return &fileCache{
+		max:   max,
+		open:  open,
+		order: list.New(),
+		files: make(map[string]*list.Element),
+	}
+}
+
+// Returns the open file for the path, opening it (and closing the least
+// recently used file if too many are open) if needed.
+func (fc *fileCache) get(path string) (*os.File, error) {
+	if e, ok := fc.files[path]; ok {
+		fc.order.MoveToFront(e)
+		return e.Value.(*cachedFile).file, nil
+	}
+	file, err := fc.open(path)
+	if err != nil {
+		return nil, err
+	}
+	for fc.order.Len() >= fc.max {
+		oldest := fc.order.Back()
+		closeFile(oldest.Value.(*cachedFile).file)
+		delete(fc.files, oldest.Value.(*cachedFile).path)
+		fc.order.Remove(oldest)
+	}
+	fc.files[path] = fc.order.PushFront(&cachedFile{path, file})
+	return file, nil
+}
+
+func (fc *fileCache) syncAll() {
+	for e := fc.order.Front(); e != nil; e = e.Next() {
+		e.Value.(*cachedFile).file.Sync()
+	}
+}
+
+func (fc *fileCache) closeAll() {
+	for e := fc.order.Front(); e != nil; e = e.Next() {
+		closeFile(e.Value.(*cachedFile).file)
+	}
+	fc.order.Init()
+	fc.files = make(map[string]*list.Element)
+}
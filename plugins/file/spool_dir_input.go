@@ -0,0 +1,213 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package file
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+)
+
+type SpoolDirInputConfig struct {
+	// Directory that's watched for dropped files.
+	Directory string
+	// Glob pattern the names of the files to ingest must match, defaults to
+	// "*". Names starting w/ a dot are always ignored, so producers can write
+	// to a hidden file then rename it.
+	FilePattern string `toml:"file_pattern"`
+	// What's done w/ a file once it's been ingested, "archive" or "delete".
+	// Defaults to "archive".
+	ProcessedAction string `toml:"processed_action"`
+	// Directory the ingested files are moved to by the "archive" action,
+	// defaults to the "archive" subdirectory of the spool directory.
+	ArchiveDirectory string `toml:"archive_directory"`
+	// Seconds between scans of the directory on platforms w/o inotify, where
+	// a file is deemed complete once its size and modification time haven't
+	// changed between two scans. Defaults to 1.
+	PollInterval uint `toml:"poll_interval"`
+}
+
+type SpoolDirInput struct {
+	*SpoolDirInputConfig
+	stop     chan bool
+	runner   pipeline.InputRunner
+	hostname string
+}
+
+func (input *SpoolDirInput) ConfigStruct() interface{} {
+	return &SpoolDirInputConfig{
+		FilePattern:     "*",
+		ProcessedAction: "archive",
+		PollInterval:    1,
+	}
+}
+
+func (input *SpoolDirInput) Init(config interface{}) error {
+	conf := config.(*SpoolDirInputConfig)
+	if conf.Directory == "" {
+		return fmt.Errorf("SpoolDirInput needs a directory")
+	}
+	if _, err := filepath.Match(conf.FilePattern, ""); err != nil {
+		return fmt.Errorf("SpoolDirInput bad file_pattern: %s", err)
+	}
+	switch conf.ProcessedAction {
+	case "delete":
+	case "archive":
+		if conf.ArchiveDirectory == "" {
+			conf.ArchiveDirectory = filepath.Join(conf.Directory, "archive")
+		}
+		if err := os.MkdirAll(conf.ArchiveDirectory, 0755); err != nil {
+			return fmt.Errorf("SpoolDirInput can't create archive directory: %s", err)
+		}
+	default:
+		return fmt.Errorf("SpoolDirInput unknown processed_action '%s'",
+			conf.ProcessedAction)
+	}
+	if conf.PollInterval == 0 {
+		return fmt.Errorf("SpoolDirInput poll_interval must be positive")
+	}
+	input.SpoolDirInputConfig = conf
+	input.stop = make(chan bool)
+	return nil
+}
+
+func (input *SpoolDirInput) Stop() {
+	close(input.stop)
+}
+
+func (input *SpoolDirInput) Run(runner pipeline.InputRunner,
+	helper pipeline.PluginHelper) error {
+
+	input.runner = runner
+	input.hostname = helper.Hostname()
+
+	// Watch before the initial scan so no file is missed, a file seen by both
+	// is gone by the time its event is handled.
+	watcher, err := newSpoolWatcher(input.Directory,
+		time.Duration(input.PollInterval)*time.Second)
+	if err != nil {
+		return fmt.Errorf("can't watch '%s': %s", input.Directory, err)
+	}
+	defer watcher.close()
+	input.scan()
+
+	for {
+		select {
+		case <-input.stop:
+			return nil
+		case name, ok := <-watcher.ready:
+			if !ok {
+				return fmt.Errorf("watcher of '%s' stopped", input.Directory)
+			}
+			if name == "" {
+				// Events were lost.
+				input.scan()
+			} else {
+				input.ingest(name)
+			}
+		case err := <-watcher.errors:
+			runner.LogError(err)
+		}
+	}
+}
+
+// Ingests all the files in the directory, in name order.
+func (input *SpoolDirInput) scan() {
+	infos, err := ioutil.ReadDir(input.Directory)
+	if err != nil {
+		input.runner.LogError(fmt.Errorf("can't list '%s': %s", input.Directory, err))
+		return
+	}
+	for _, info := range infos {
+		select {
+		case <-input.stop:
+			return
+		default:
+		}
+		input.ingest(info.Name())
+	}
+}
+
+func (input *SpoolDirInput) matches(name string) bool {
+	if strings.HasPrefix(name, ".") {
+		return false
+	}
+	ok, _ := filepath.Match(input.FilePattern, name)
+	return ok
+}
+
+// Streams the file through a splitter runner of its own, then archives or
+// deletes it.
+func (input *SpoolDirInput) ingest(name string) {
+	if !input.matches(name) {
+		return
+	}
+	path := filepath.Join(input.Directory, name)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		// Already ingested.
+		return
+	}
+	if err != nil {
+		input.runner.LogError(fmt.Errorf("can't open '%s': %s", path, err))
+		return
+	}
+	if info, err := f.Stat(); err != nil || !info.Mode().IsRegular() {
+		f.Close()
+		return
+	}
+
+	sRunner := input.runner.NewSplitterRunner(name)
+	if !sRunner.UseMsgBytes() {
+		sRunner.SetPackDecorator(func(pack *pipeline.PipelinePack) {
+			pack.Message.SetType("heka.spooldir")
+			pack.Message.SetHostname(input.hostname)
+			pack.Message.SetLogger(input.runner.Name())
+			message.NewStringField(pack.Message, "FilePath", path)
+		})
+	}
+	for err == nil {
+		err = sRunner.SplitStream(f, nil)
+	}
+	sRunner.Done()
+	f.Close()
+	if err != io.EOF {
+		input.runner.LogError(fmt.Errorf("can't read '%s': %s", path, err))
+		return
+	}
+
+	if input.ProcessedAction == "delete" {
+		err = os.Remove(path)
+	} else {
+		err = os.Rename(path, filepath.Join(input.ArchiveDirectory, name))
+	}
+	if err != nil {
+		input.runner.LogError(fmt.Errorf("can't %s '%s': %s", input.ProcessedAction,
+			path, err))
+	}
+}
+
+func init() {
+	pipeline.RegisterPlugin("SpoolDirInput", func() interface{} {
+		return new(SpoolDirInput)
+	})
+}
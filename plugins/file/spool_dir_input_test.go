@@ -0,0 +1,116 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package file
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	"github.com/mozilla-services/heka/pipelinemock"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func SpoolDirInputSpec(c gs.Context) {
+	t := new(pipeline_ts.SimpleT)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	tmpDir, err := ioutil.TempDir("", "spooldirinput-tests")
+	c.Assume(err, gs.IsNil)
+	defer os.RemoveAll(tmpDir)
+
+	c.Specify("A SpoolDirInput", func() {
+		input := new(SpoolDirInput)
+		config := input.ConfigStruct().(*SpoolDirInputConfig)
+		config.Directory = tmpDir
+
+		mockIR := pipelinemock.NewMockInputRunner(ctrl)
+		mockSR := pipelinemock.NewMockSplitterRunner(ctrl)
+		mockHelper := pipelinemock.NewMockPluginHelper(ctrl)
+		mockHelper.EXPECT().Hostname().Return("hekatests.example.com")
+		mockIR.EXPECT().Name().Return("SpoolDirInput").AnyTimes()
+		mockIR.EXPECT().NewSplitterRunner(gomock.Any()).Return(mockSR).AnyTimes()
+		mockSR.EXPECT().UseMsgBytes().Return(false).AnyTimes()
+		mockSR.EXPECT().SetPackDecorator(gomock.Any()).AnyTimes()
+		mockSR.EXPECT().Done().AnyTimes()
+		read := make(chan string, 10)
+		split := mockSR.EXPECT().SplitStream(gomock.Any(), nil).AnyTimes()
+		split.Do(func(r io.Reader, del Deliverer) {
+			data, _ := ioutil.ReadAll(r)
+			read <- string(data)
+		}).Return(io.EOF)
+
+		errChan := make(chan error, 1)
+		startInput := func() {
+			c.Assume(input.Init(config), gs.IsNil)
+			go func() {
+				errChan <- input.Run(mockIR, mockHelper)
+			}()
+		}
+		nextRead := func() string {
+			select {
+			case data := <-read:
+				return data
+			case <-time.After(5 * time.Second):
+				return "timed out"
+			}
+		}
+		exists := func(path string) bool {
+			_, err := os.Stat(filepath.Join(tmpDir, path))
+			return err == nil
+		}
+
+		c.Specify("ingests the files already in the directory", func() {
+			err := ioutil.WriteFile(filepath.Join(tmpDir, "old.log"), []byte("old"), 0600)
+			c.Assume(err, gs.IsNil)
+			startInput()
+			c.Expect(nextRead(), gs.Equals, "old")
+			input.Stop()
+			c.Expect(<-errChan, gs.IsNil)
+			c.Expect(exists("old.log"), gs.IsFalse)
+			c.Expect(exists("archive/old.log"), gs.IsTrue)
+		})
+
+		c.Specify("ingests dropped files once they're complete", func() {
+			config.ProcessedAction = "delete"
+			startInput()
+			f, err := os.Create(filepath.Join(tmpDir, "new.log"))
+			c.Assume(err, gs.IsNil)
+			f.Write([]byte("first half, "))
+			f.Sync()
+			f.Write([]byte("second half"))
+			f.Close()
+			c.Expect(nextRead(), gs.Equals, "first half, second half")
+
+			// Hidden files are left alone until they're renamed.
+			hidden := filepath.Join(tmpDir, ".moved.tmp")
+			err = ioutil.WriteFile(hidden, []byte("moved"), 0600)
+			c.Assume(err, gs.IsNil)
+			c.Assume(os.Rename(hidden, filepath.Join(tmpDir, "moved.log")), gs.IsNil)
+			c.Expect(nextRead(), gs.Equals, "moved")
+
+			input.Stop()
+			c.Expect(<-errChan, gs.IsNil)
+			c.Expect(exists("new.log"), gs.IsFalse)
+			c.Expect(exists("moved.log"), gs.IsFalse)
+		})
+	})
+}
@@ -0,0 +1,105 @@
+// +build !linux
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package file
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// Reports the files that are complete in a directory by scanning it, a file
+// is deemed complete once its size and modification time haven't changed
+// between two scans.
+type spoolWatcher struct {
+	ready  chan string
+	errors chan error
+	stop   chan bool
+	done   chan bool
+}
+
+type spoolFileState struct {
+	size     int64
+	modTime  time.Time
+	reported bool
+}
+
+func newSpoolWatcher(dir string, interval time.Duration) (*spoolWatcher, error) {
+	w := &spoolWatcher{
+		ready:  make(chan string),
+		errors: make(chan error),
+		stop:   make(chan bool),
+		done:   make(chan bool),
+	}
+	go w.run(dir, interval)
+	return w, nil
+}
+
+func (w *spoolWatcher) run(dir string, interval time.Duration) {
+	defer close(w.done)
+	seen := make(map[string]*spoolFileState)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+		}
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			select {
+			case w.errors <- fmt.Errorf("can't list '%s': %s", dir, err):
+			case <-w.stop:
+				return
+			}
+			continue
+		}
+		present := make(map[string]bool, len(infos))
+		for _, info := range infos {
+			if !info.Mode().IsRegular() {
+				continue
+			}
+			name := info.Name()
+			present[name] = true
+			st, ok := seen[name]
+			if !ok || st.size != info.Size() || !st.modTime.Equal(info.ModTime()) {
+				seen[name] = &spoolFileState{size: info.Size(), modTime: info.ModTime()}
+				continue
+			}
+			if st.reported {
+				continue
+			}
+			st.reported = true
+			select {
+			case w.ready <- name:
+			case <-w.stop:
+				return
+			}
+		}
+		for name := range seen {
+			if !present[name] {
+				delete(seen, name)
+			}
+		}
+	}
+}
+
+func (w *spoolWatcher) close() {
+	close(w.stop)
+	<-w.done
+}
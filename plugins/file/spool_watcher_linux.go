@@ -0,0 +1,95 @@
+// +build linux
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package file
+
+import (
+	"bytes"
+	"fmt"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Reports the files that are complete in a directory, i.e. that were closed
+// after being written to or were moved into it, using inotify. An empty name
+// is sent when events were lost and the directory should be scanned.
+type spoolWatcher struct {
+	ready  chan string
+	errors chan error
+	fd     int
+	wd     int
+}
+
+func newSpoolWatcher(dir string, _ time.Duration) (*spoolWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	wd, err := syscall.InotifyAddWatch(fd, dir,
+		syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO|syscall.IN_ONLYDIR)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	w := &spoolWatcher{
+		ready:  make(chan string),
+		errors: make(chan error, 1),
+		fd:     fd,
+		wd:     wd,
+	}
+	go w.run()
+	return w, nil
+}
+
+func (w *spoolWatcher) run() {
+	defer close(w.ready)
+	defer syscall.Close(w.fd)
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := syscall.Read(w.fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			w.errors <- fmt.Errorf("inotify read: %s", err)
+			return
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			start := offset + syscall.SizeofInotifyEvent
+			name := buf[start : start+int(event.Len)]
+			offset = start + int(event.Len)
+			switch {
+			case event.Mask&syscall.IN_IGNORED != 0:
+				// The watch was removed, by close or because the directory
+				// is gone.
+				return
+			case event.Mask&syscall.IN_Q_OVERFLOW != 0:
+				w.ready <- ""
+			case event.Mask&syscall.IN_ISDIR == 0:
+				w.ready <- string(bytes.TrimRight(name, "\x00"))
+			}
+		}
+	}
+}
+
+// Stops the watcher, removing the watch wakes the reading goroutine up.
+func (w *spoolWatcher) close() {
+	syscall.InotifyRmWatch(w.fd, uint32(w.wd))
+	for range w.ready {
+	}
+}
@@ -0,0 +1,418 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package plugins
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+)
+
+type ForecastFilterConfig struct {
+	// Numeric message field the series is made of, not needed when
+	// counting messages.
+	Field string
+	// How the messages of an interval make the series' value, one of "avg"
+	// or "sum" of the field's values, or "count" of the messages. Defaults
+	// to "avg".
+	Aggregation string
+	// Length in seconds of the series' intervals, defaults to 60.
+	Interval uint
+	// Number of intervals in a season, e.g. 1440 for a daily season of 1
+	// minute intervals. Defaults to 0, meaning no seasonality.
+	SeasonLength uint `toml:"season_length"`
+	// Smoothing factors of the level, trend and seasonal components, which
+	// also smooths the deviations. A beta of 0 w/o a season makes the
+	// forecast an EWMA. Default to 0.5, 0.1 and 0.1.
+	Alpha float64
+	Beta  float64
+	Gamma float64
+	// Width of the confidence band, in smoothed absolute deviations.
+	// Defaults to 3.
+	Deviations float64
+	// Number of intervals observed before deviations are alerted on,
+	// defaults to two seasons, or 10 intervals w/o a season.
+	Warmup uint
+	// Message field whose values are forecast as separate series, e.g. a
+	// service's name.
+	GroupBy string `toml:"group_by"`
+	// Maximum number of series, the messages of new series past this are
+	// dropped. Defaults to 100.
+	MaxSeries int `toml:"max_series"`
+	// Whether a `heka.forecast` message is generated for every interval,
+	// defaults to false.
+	EmitForecasts bool `toml:"emit_forecasts"`
+	// Defaults to closing ended intervals every 10 seconds.
+	TickerInterval uint `toml:"ticker_interval"`
+}
+
+// Filter that forecasts a numeric field's time series w/ Holt-Winters
+// exponential smoothing and alerts when the observed values leave the
+// forecast's confidence band.
+type ForecastFilter struct {
+	// 64-bit values accessed atomically come first to guarantee alignment.
+	skipped       int64
+	droppedSeries int64
+	conf          *ForecastFilterConfig
+	intervalSecs  int64
+	warmup        int
+	series        map[string]*forecastSeries
+	now           func() time.Time
+}
+
+// A series' model and the values of its current interval.
+type forecastSeries struct {
+	name   string
+	model  *holtWinters
+	bucket int64
+	sum    float64
+	count  int
+	// Last value observed.
+	last      float64
+	anomalous bool
+}
+
+// Outcome of an interval of a series.
+type forecastResult struct {
+	series    string
+	start     int64
+	observed  float64
+	forecast  float64
+	lower     float64
+	upper     float64
+	anomalous bool
+	// Whether the series started or stopped being anomalous.
+	transition bool
+}
+
+// Additive Holt-Winters model w/ Brutlag's confidence bands.
+type holtWinters struct {
+	alpha, beta, gamma float64
+	level, trend       float64
+	// Seasonal components and smoothed absolute deviations per position in
+	// the season, a single position w/o seasonality.
+	season    []float64
+	deviation []float64
+	// Number of observations so far.
+	n int
+	// Values of the first season, which initialize the model.
+	first []float64
+}
+
+func newHoltWinters(alpha, beta, gamma float64, seasonLength int) *holtWinters {
+	if seasonLength == 0 {
+		seasonLength = 1
+	}
+	return &holtWinters{
+		alpha:     alpha,
+		beta:      beta,
+		gamma:     gamma,
+		season:    make([]float64, seasonLength),
+		deviation: make([]float64, seasonLength),
+	}
+}
+
+// Returns the forecast of the next value and its smoothed deviation, ok is
+// false until the model has been initialized.
+func (hw *holtWinters) forecast() (value, deviation float64, ok bool) {
+	if hw.n < len(hw.season) {
+		return 0, 0, false
+	}
+	pos := hw.n % len(hw.season)
+	return hw.level + hw.trend + hw.season[pos], hw.deviation[pos], true
+}
+
+// Updates the model w/ the next value.
+func (hw *holtWinters) observe(y float64) {
+	pos := hw.n % len(hw.season)
+	hw.n++
+	if hw.n <= len(hw.season) {
+		hw.first = append(hw.first, y)
+		if hw.n < len(hw.season) {
+			return
+		}
+		var sum float64
+		for _, v := range hw.first {
+			sum += v
+		}
+		hw.level = sum / float64(len(hw.first))
+		if len(hw.season) > 1 {
+			for i, v := range hw.first {
+				hw.season[i] = v - hw.level
+			}
+		}
+		hw.first = nil
+		return
+	}
+	yhat := hw.level + hw.trend + hw.season[pos]
+	hw.deviation[pos] = hw.gamma*math.Abs(y-yhat) + (1-hw.gamma)*hw.deviation[pos]
+	level := hw.alpha*(y-hw.season[pos]) + (1-hw.alpha)*(hw.level+hw.trend)
+	hw.trend = hw.beta*(level-hw.level) + (1-hw.beta)*hw.trend
+	if len(hw.season) > 1 {
+		hw.season[pos] = hw.gamma*(y-level) + (1-hw.gamma)*hw.season[pos]
+	}
+	hw.level = level
+}
+
+func (f *ForecastFilter) ConfigStruct() interface{} {
+	return &ForecastFilterConfig{
+		Aggregation:    "avg",
+		Interval:       60,
+		Alpha:          0.5,
+		Beta:           0.1,
+		Gamma:          0.1,
+		Deviations:     3,
+		MaxSeries:      100,
+		TickerInterval: 10,
+	}
+}
+
+func (f *ForecastFilter) Init(config interface{}) error {
+	conf := config.(*ForecastFilterConfig)
+	switch conf.Aggregation {
+	case "avg", "sum":
+		if conf.Field == "" {
+			return fmt.Errorf("ForecastFilter needs a field to %s", conf.Aggregation)
+		}
+	case "count":
+	default:
+		return fmt.Errorf("ForecastFilter unknown aggregation '%s'", conf.Aggregation)
+	}
+	if conf.Interval == 0 {
+		return errors.New("ForecastFilter interval must be positive")
+	}
+	if conf.Alpha <= 0 || conf.Alpha > 1 || conf.Beta < 0 || conf.Beta > 1 ||
+		conf.Gamma < 0 || conf.Gamma > 1 {
+		return errors.New("ForecastFilter alpha must be in (0, 1], beta and " +
+			"gamma in [0, 1]")
+	}
+	if conf.Deviations <= 0 {
+		return errors.New("ForecastFilter deviations must be positive")
+	}
+	if conf.MaxSeries <= 0 {
+		return errors.New("ForecastFilter max_series must be positive")
+	}
+	f.warmup = int(conf.Warmup)
+	if f.warmup == 0 {
+		f.warmup = 2 * int(conf.SeasonLength)
+		if f.warmup == 0 {
+			f.warmup = 10
+		}
+	}
+	f.conf = conf
+	f.intervalSecs = int64(conf.Interval)
+	f.series = make(map[string]*forecastSeries)
+	if f.now == nil {
+		f.now = time.Now
+	}
+	return nil
+}
+
+func (f *ForecastFilter) Run(fr FilterRunner, h PluginHelper) (err error) {
+	inChan := fr.InChan()
+	ticker := fr.Ticker()
+	for {
+		select {
+		case pack, ok := <-inChan:
+			if !ok {
+				return nil
+			}
+			for _, res := range f.update(pack.Message) {
+				f.emit(fr, h, res)
+			}
+			fr.UpdateCursor(pack.QueueCursor)
+			pack.Recycle(nil)
+		case <-ticker:
+			for _, res := range f.tick() {
+				f.emit(fr, h, res)
+			}
+		}
+	}
+}
+
+// Adds the message to its series' current interval, returning the results
+// of the intervals that ended before it.
+func (f *ForecastFilter) update(msg *message.Message) []*forecastResult {
+	var value float64
+	if f.conf.Aggregation != "count" {
+		switch v, _ := msg.GetFieldValue(f.conf.Field); v := v.(type) {
+		case int64:
+			value = float64(v)
+		case float64:
+			value = v
+		default:
+			atomic.AddInt64(&f.skipped, 1)
+			return nil
+		}
+	}
+	var name string
+	if f.conf.GroupBy != "" {
+		switch v, _ := msg.GetFieldValue(f.conf.GroupBy); v := v.(type) {
+		case nil:
+		case []byte:
+			name = string(v)
+		default:
+			name = fmt.Sprint(v)
+		}
+	}
+	bucket := f.now().Unix() / f.intervalSecs
+	s, ok := f.series[name]
+	if !ok {
+		if len(f.series) >= f.conf.MaxSeries {
+			atomic.AddInt64(&f.droppedSeries, 1)
+			return nil
+		}
+		s = &forecastSeries{
+			name: name,
+			model: newHoltWinters(f.conf.Alpha, f.conf.Beta, f.conf.Gamma,
+				int(f.conf.SeasonLength)),
+			bucket: bucket,
+		}
+		f.series[name] = s
+	}
+	results := f.close(s, bucket)
+	s.sum += value
+	s.count++
+	return results
+}
+
+// Closes the ended intervals of every series, returning their results
+// sorted by series.
+func (f *ForecastFilter) tick() (results []*forecastResult) {
+	bucket := f.now().Unix() / f.intervalSecs
+	names := make([]string, 0, len(f.series))
+	for name := range f.series {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		results = append(results, f.close(f.series[name], bucket)...)
+	}
+	return results
+}
+
+// Feeds the series' intervals before `bucket` to its model. The intervals
+// w/o messages count as 0 when summing or counting, and are filled in w/ the
+// forecast, or the last value before the model is initialized, when
+// averaging.
+func (f *ForecastFilter) close(s *forecastSeries, bucket int64) (
+	results []*forecastResult) {
+
+	for ; s.bucket < bucket; s.bucket++ {
+		var y float64
+		switch {
+		case f.conf.Aggregation == "avg" && s.count > 0:
+			y = s.sum / float64(s.count)
+		case f.conf.Aggregation == "avg":
+			// Keep the season's positions aligned w/ the intervals.
+			if yhat, _, ok := s.model.forecast(); ok {
+				s.model.observe(yhat)
+			} else if s.model.n > 0 {
+				s.model.observe(s.last)
+			}
+			continue
+		case f.conf.Aggregation == "sum":
+			y = s.sum
+		default:
+			y = float64(s.count)
+		}
+		s.sum, s.count = 0, 0
+		s.last = y
+		yhat, dev, ok := s.model.forecast()
+		warm := s.model.n >= f.warmup
+		s.model.observe(y)
+		if !ok || !warm {
+			continue
+		}
+		band := f.conf.Deviations * dev
+		res := &forecastResult{
+			series:    s.name,
+			start:     s.bucket * f.intervalSecs,
+			observed:  y,
+			forecast:  yhat,
+			lower:     yhat - band,
+			upper:     yhat + band,
+			anomalous: y < yhat-band || y > yhat+band,
+		}
+		if res.anomalous != s.anomalous {
+			s.anomalous = res.anomalous
+			res.transition = true
+		}
+		results = append(results, res)
+	}
+	return results
+}
+
+// Injects an alert for a result that changed its series' state, and the
+// forecast if they're emitted.
+func (f *ForecastFilter) emit(fr FilterRunner, h PluginHelper, res *forecastResult) {
+	inject := func(msgType string) {
+		pack, err := h.PipelinePack(0)
+		if err != nil {
+			fr.LogError(err)
+			return
+		}
+		f.fill(pack.Message, msgType, res)
+		pack.Message.SetLogger(fr.Name())
+		fr.Inject(pack)
+	}
+	if f.conf.EmitForecasts {
+		inject("heka.forecast")
+	}
+	if res.transition {
+		inject("heka.forecast-alert")
+	}
+}
+
+// Populates the message w/ the interval's result.
+func (f *ForecastFilter) fill(msg *message.Message, msgType string,
+	res *forecastResult) {
+
+	msg.SetType(msgType)
+	msg.SetTimestamp(res.start * int64(time.Second))
+	if msgType == "heka.forecast-alert" {
+		status := "normal"
+		if res.anomalous {
+			status = "anomalous"
+		}
+		msg.SetString("status", status)
+	}
+	if f.conf.GroupBy != "" {
+		msg.SetString(f.conf.GroupBy, res.series)
+	}
+	msg.SetDouble("observed", res.observed)
+	msg.SetDouble("forecast", res.forecast)
+	msg.SetDouble("lower", res.lower)
+	msg.SetDouble("upper", res.upper)
+}
+
+func (f *ForecastFilter) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "SkippedCount", atomic.LoadInt64(&f.skipped), "count")
+	message.NewInt64Field(msg, "DroppedSeriesCount",
+		atomic.LoadInt64(&f.droppedSeries), "count")
+	return nil
+}
+
+func init() {
+	RegisterPlugin("ForecastFilter", func() interface{} {
+		return new(ForecastFilter)
+	})
+}
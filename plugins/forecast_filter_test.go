@@ -0,0 +1,135 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package plugins
+
+import (
+	"math"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func ForecastFilterSpec(c gs.Context) {
+	c.Specify("A Holt-Winters model", func() {
+		pattern := []float64{10, 20, 30, 20}
+		hw := newHoltWinters(0.5, 0.1, 0.5, len(pattern))
+
+		c.Specify("needs a season to forecast", func() {
+			hw.observe(10)
+			_, _, ok := hw.forecast()
+			c.Expect(ok, gs.IsFalse)
+		})
+
+		c.Specify("learns a seasonal pattern", func() {
+			for i := 0; i < 5*len(pattern); i++ {
+				hw.observe(pattern[i%len(pattern)])
+			}
+			for _, y := range pattern {
+				yhat, _, ok := hw.forecast()
+				c.Expect(ok, gs.IsTrue)
+				c.Expect(math.Abs(yhat-y) < 0.5, gs.IsTrue)
+				hw.observe(y)
+			}
+		})
+	})
+
+	c.Specify("A ForecastFilter", func() {
+		filter := new(ForecastFilter)
+		config := filter.ConfigStruct().(*ForecastFilterConfig)
+		config.Field = "latency"
+		now := time.Unix(1000000020, 0)
+		filter.now = func() time.Time { return now }
+
+		// Receives the values in the current interval and closes it.
+		interval := func(values ...float64) []*forecastResult {
+			for _, v := range values {
+				msg := new(message.Message)
+				msg.SetDouble("latency", v)
+				c.Expect(len(filter.update(msg)), gs.Equals, 0)
+			}
+			now = now.Add(60 * time.Second)
+			return filter.tick()
+		}
+
+		c.Specify("requires a field to average", func() {
+			config.Field = ""
+			c.Expect(filter.Init(config), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("rejects an unknown aggregation", func() {
+			config.Aggregation = "median"
+			c.Expect(filter.Init(config), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("rejects a smoothing factor out of range", func() {
+			config.Gamma = 1.5
+			c.Expect(filter.Init(config), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("is initialized", func() {
+			err := filter.Init(config)
+			c.Assume(err, gs.IsNil)
+			var results []*forecastResult
+			for i := 0; i < 20; i++ {
+				results = append(results, interval(100, 100+float64(i%2)*2)...)
+			}
+
+			c.Specify("waits for the warmup", func() {
+				c.Expect(len(results), gs.Equals, 10)
+			})
+
+			c.Specify("stays in the band while the series is steady", func() {
+				for _, res := range results {
+					c.Expect(res.anomalous, gs.IsFalse)
+					c.Expect(res.transition, gs.IsFalse)
+				}
+			})
+
+			c.Specify("alerts when a value leaves the band", func() {
+				results = interval(500)
+				c.Expect(len(results), gs.Equals, 1)
+				res := results[0]
+				c.Expect(res.anomalous, gs.IsTrue)
+				c.Expect(res.transition, gs.IsTrue)
+				c.Expect(res.start, gs.Equals, now.Unix()-60)
+
+				msg := new(message.Message)
+				filter.fill(msg, "heka.forecast-alert", res)
+				value, _ := msg.GetFieldValue("status")
+				c.Expect(value, gs.Equals, "anomalous")
+				value, _ = msg.GetFieldValue("observed")
+				c.Expect(value, gs.Equals, 500.0)
+
+				c.Specify("and when it's back to normal", func() {
+					recovered := false
+					for i := 0; i < 10 && !recovered; i++ {
+						results = interval(100)
+						recovered = results[0].transition
+					}
+					c.Expect(recovered, gs.IsTrue)
+					c.Expect(results[0].anomalous, gs.IsFalse)
+				})
+			})
+
+			c.Specify("fills in intervals w/o messages", func() {
+				now = now.Add(120 * time.Second)
+				results = filter.tick()
+				c.Expect(len(results), gs.Equals, 0)
+				c.Expect(filter.series[""].model.n, gs.Equals, 22)
+			})
+		})
+	})
+}
@@ -0,0 +1,67 @@
+// +build gofuzz
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package plugins
+
+import (
+	. "github.com/mozilla-services/heka/pipeline"
+)
+
+// Entry points for go-fuzz (https://github.com/dvyukov/go-fuzz), e.g.
+//
+//   go-fuzz-build -func FuzzJsonDecoder github.com/mozilla-services/heka/plugins
+//   go-fuzz -bin plugins-fuzz.zip -workdir fuzz/json_decoder
+
+var fuzzJsonDecoders []*JsonDecoder
+
+func init() {
+	for _, parser := range []string{"encoding/json", "scanner"} {
+		jd := new(JsonDecoder)
+		conf := jd.ConfigStruct().(*JsonDecoderConfig)
+		conf.Parser = parser
+		conf.MaximumDepth = 3
+		conf.MapFields = map[string]string{
+			"Uuid":      "uuid",
+			"Timestamp": "time",
+			"Severity":  "level",
+			"Pid":       "pid",
+			"Hostname":  "host",
+		}
+		if err := jd.Init(conf); err != nil {
+			panic(err)
+		}
+		fuzzJsonDecoders = append(fuzzJsonDecoders, jd)
+	}
+}
+
+// Decodes the data as JSON w/ both of the JsonDecoder's parsers, which must
+// agree on whether it's valid.
+func FuzzJsonDecoder(data []byte) int {
+	valid := make([]bool, len(fuzzJsonDecoders))
+	for i, jd := range fuzzJsonDecoders {
+		pack := NewPipelinePack(nil)
+		pack.Message.SetPayload(string(data))
+		_, err := jd.Decode(pack)
+		valid[i] = err == nil
+	}
+	if valid[0] != valid[1] {
+		panic("JsonDecoder parsers disagree on the validity of the JSON")
+	}
+	if !valid[0] {
+		return 0
+	}
+	return 1
+}
@@ -0,0 +1,252 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package grpc
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+)
+
+// Output plugin that hands messages to an external plugin process, such as
+// one built w/ ServeOutputPlugin, over the same gRPC stream the GrpcOutput
+// uses. The process is started w/ the output and restarted whenever it
+// exits, and messages are resent until the plugin has acknowledged them.
+type ExternalOutput struct {
+	restartCount int64
+	GrpcOutput
+	extConf      *ExternalOutputConfig
+	startTimeout time.Duration
+	cmd          *exec.Cmd
+	stdin        io.WriteCloser
+	// Closed once the plugin process has exited.
+	exited chan struct{}
+}
+
+type ExternalOutputConfig struct {
+	// Path of the plugin executable.
+	Command string
+	// Arguments the plugin is started w/.
+	Args []string
+	// Seconds to wait for the plugin to serve, and to exit when stopped.
+	StartTimeout uint `toml:"start_timeout"`
+	// Max number of sent messages that may be awaiting acknowledgement.
+	MaxUnacked int `toml:"max_unacked"`
+	// Seconds to wait for an ack before the stream is considered dead.
+	AckTimeout uint `toml:"ack_timeout"`
+	// So we can default to using ProtobufEncoder.
+	Encoder string
+	// So acks are processed even when no messages are being sent.
+	TickerInterval uint `toml:"ticker_interval"`
+	// Defaults to true for ExternalOutput.
+	UseBuffering *bool `toml:"use_buffering"`
+	Buffering    QueueBufferConfig
+}
+
+func (e *ExternalOutput) ConfigStruct() interface{} {
+	grpcConf := e.GrpcOutput.ConfigStruct().(*GrpcOutputConfig)
+	return &ExternalOutputConfig{
+		StartTimeout:   10,
+		MaxUnacked:     grpcConf.MaxUnacked,
+		AckTimeout:     grpcConf.AckTimeout,
+		Encoder:        grpcConf.Encoder,
+		TickerInterval: grpcConf.TickerInterval,
+		UseBuffering:   grpcConf.UseBuffering,
+		Buffering:      grpcConf.Buffering,
+	}
+}
+
+func (e *ExternalOutput) Init(config interface{}) error {
+	e.extConf = config.(*ExternalOutputConfig)
+	if e.extConf.Command == "" {
+		return errors.New("command must be set")
+	}
+	if e.extConf.StartTimeout == 0 {
+		return errors.New("start_timeout must be greater than 0")
+	}
+	e.startTimeout = time.Duration(e.extConf.StartTimeout) * time.Second
+	// The address is only known once the plugin has started.
+	return e.GrpcOutput.Init(&GrpcOutputConfig{
+		MaxUnacked:     e.extConf.MaxUnacked,
+		AckTimeout:     e.extConf.AckTimeout,
+		ConnectTimeout: e.extConf.StartTimeout,
+	})
+}
+
+func (e *ExternalOutput) Prepare(or OutputRunner, h PluginHelper) error {
+	if err := e.GrpcOutput.Prepare(or, h); err != nil {
+		return err
+	}
+	return e.start()
+}
+
+// Starts the plugin process and waits for its handshake, pointing the stream
+// at the address it serves on.
+func (e *ExternalOutput) start() (err error) {
+	cmd := exec.Command(e.extConf.Command, e.extConf.Args...)
+	cmd.Env = append(os.Environ(), PLUGIN_PROTOCOL_ENV+"="+pluginProtocolVersion)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err = cmd.Start(); err != nil {
+		return fmt.Errorf("can't start '%s': %s", e.extConf.Command, err)
+	}
+
+	handshake := make(chan string, 1)
+	exited := make(chan struct{})
+	var outputWg sync.WaitGroup
+	outputWg.Add(2)
+	go e.logOutput(stdout, handshake, &outputWg)
+	go e.logOutput(stderr, nil, &outputWg)
+	go func() {
+		// The output has to be read to the end before waiting.
+		outputWg.Wait()
+		cmd.Wait()
+		close(exited)
+	}()
+
+	select {
+	case line, ok := <-handshake:
+		if ok {
+			e.conf.Address, err = parseHandshake(line)
+		} else {
+			err = errors.New("exited w/o a handshake")
+		}
+	case <-time.After(e.startTimeout):
+		err = errors.New("timed out waiting for the handshake")
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		<-exited
+		return fmt.Errorf("plugin '%s' %s", e.extConf.Command, err)
+	}
+	e.cmd, e.stdin, e.exited = cmd, stdin, exited
+	return nil
+}
+
+// Logs the lines the plugin writes to stdout or stderr, except for the
+// handshake, which is sent on handshake if it's not nil.
+func (e *ExternalOutput) logOutput(r io.Reader, handshake chan<- string,
+	wg *sync.WaitGroup) {
+
+	defer wg.Done()
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if handshake != nil {
+			handshake <- scanner.Text()
+			close(handshake)
+			handshake = nil
+			continue
+		}
+		e.or.LogMessage(scanner.Text())
+	}
+	if handshake != nil {
+		close(handshake)
+	}
+	// Don't let an overlong line block the plugin.
+	io.Copy(ioutil.Discard, r)
+}
+
+// Restarts the plugin process if it has exited, dropping the connection to
+// it.
+func (e *ExternalOutput) ensureRunning() error {
+	if e.exited != nil {
+		select {
+		case <-e.exited:
+			e.or.LogError(fmt.Errorf("plugin '%s' exited: %s", e.extConf.Command,
+				e.cmd.ProcessState))
+		default:
+			return nil
+		}
+	}
+	e.resetStream()
+	if e.conn != nil {
+		e.conn.Close()
+		e.conn = nil
+	}
+	e.cmd, e.stdin, e.exited = nil, nil, nil
+	if err := e.start(); err != nil {
+		return err
+	}
+	atomic.AddInt64(&e.restartCount, 1)
+	return nil
+}
+
+func (e *ExternalOutput) ProcessMessage(pack *PipelinePack) error {
+	if err := e.ensureRunning(); err != nil {
+		return NewRetryMessageError("can't restart: %s", err)
+	}
+	return e.GrpcOutput.ProcessMessage(pack)
+}
+
+func (e *ExternalOutput) TimerEvent() error {
+	if err := e.ensureRunning(); err != nil {
+		e.or.LogError(fmt.Errorf("can't restart: %s", err))
+		return nil
+	}
+	return e.GrpcOutput.TimerEvent()
+}
+
+// Closes the stream, then asks the plugin to exit by closing its stdin,
+// killing it if it doesn't.
+func (e *ExternalOutput) CleanUp() {
+	e.GrpcOutput.CleanUp()
+	if e.exited == nil {
+		return
+	}
+	e.stdin.Close()
+	select {
+	case <-e.exited:
+	case <-time.After(e.startTimeout):
+		e.or.LogError(fmt.Errorf("plugin '%s' didn't exit, killing it",
+			e.extConf.Command))
+		e.cmd.Process.Kill()
+		<-e.exited
+	}
+}
+
+// Satisfies the `pipeline.ReportingPlugin` interface to provide plugin state
+// information to the Heka report and dashboard.
+func (e *ExternalOutput) ReportMsg(msg *message.Message) error {
+	e.GrpcOutput.ReportMsg(msg)
+	message.NewInt64Field(msg, "RestartCount", atomic.LoadInt64(&e.restartCount),
+		"count")
+	return nil
+}
+
+func init() {
+	RegisterPlugin("ExternalOutput", func() interface{} {
+		return new(ExternalOutput)
+	})
+}
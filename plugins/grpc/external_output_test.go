@@ -0,0 +1,113 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package grpc
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/mozilla-services/heka/message"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"golang.org/x/net/context"
+	grpclib "google.golang.org/grpc"
+)
+
+func ExternalOutputSpec(c gs.Context) {
+	c.Specify("A plugin handshake", func() {
+		c.Specify("holds the address", func() {
+			address, err := parseHandshake("1|tcp|127.0.0.1:34567\n")
+			c.Expect(err, gs.IsNil)
+			c.Expect(address, gs.Equals, "127.0.0.1:34567")
+		})
+
+		c.Specify("is rejected if it's malformed", func() {
+			for _, line := range []string{"", "1|tcp", "1|tcp|", "2|tcp|127.0.0.1:1",
+				"1|unix|/tmp/plugin.sock"} {
+
+				_, err := parseHandshake(line)
+				c.Expect(err, gs.Not(gs.IsNil))
+			}
+		})
+	})
+
+	c.Specify("A plugin process", func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		c.Assume(err, gs.IsNil)
+		stdinR, stdinW := io.Pipe()
+		stdoutR, stdoutW := io.Pipe()
+		defer stdinW.Close()
+		var delivered []*message.Message
+		var failDelivery bool
+		deliver := func(msg *message.Message) error {
+			if failDelivery {
+				return errors.New("delivery failed")
+			}
+			delivered = append(delivered, msg)
+			return nil
+		}
+		served := make(chan error, 1)
+		go func() {
+			served <- servePlugin(listener, stdinR, stdoutW, deliver)
+		}()
+
+		line, err := bufio.NewReader(stdoutR).ReadString('\n')
+		c.Assume(err, gs.IsNil)
+		address, err := parseHandshake(line)
+		c.Assume(err, gs.IsNil)
+		c.Expect(address, gs.Equals, listener.Addr().String())
+
+		conn, err := grpclib.Dial(address, grpclib.WithCodec(hekaCodec{}),
+			grpclib.WithInsecure(), grpclib.WithBlock(),
+			grpclib.WithTimeout(5*time.Second))
+		c.Assume(err, gs.IsNil)
+		defer conn.Close()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		stream, err := grpclib.NewClientStream(ctx, &serviceDesc.Streams[0], conn,
+			streamMethod)
+		c.Assume(err, gs.IsNil)
+
+		msg := pipeline_ts.GetTestMessage()
+		record, err := proto.Marshal(msg)
+		c.Assume(err, gs.IsNil)
+
+		c.Specify("acks the messages it delivers", func() {
+			c.Assume(stream.SendMsg(&record), gs.IsNil)
+			c.Assume(stream.SendMsg(&record), gs.IsNil)
+			a := new(ack)
+			c.Expect(stream.RecvMsg(a), gs.IsNil)
+			c.Expect(stream.RecvMsg(a), gs.IsNil)
+			c.Expect(a.Count, gs.Equals, uint64(2))
+			c.Expect(len(delivered), gs.Equals, 2)
+			c.Expect(delivered[0].GetUuidString(), gs.Equals, msg.GetUuidString())
+		})
+
+		c.Specify("ends the stream when delivery fails", func() {
+			failDelivery = true
+			c.Assume(stream.SendMsg(&record), gs.IsNil)
+			c.Expect(stream.RecvMsg(new(ack)), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("stops serving once its stdin is closed", func() {
+			stdinW.Close()
+			c.Expect(<-served, gs.IsNil)
+		})
+	})
+}
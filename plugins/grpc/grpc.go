@@ -0,0 +1,106 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+// Package grpc provides input and output plugins that exchange Heka messages
+// between Heka instances over a bidirectional gRPC stream, as described by
+// heka.proto. The sending side streams protobuf encoded messages and the
+// receiving side streams back acknowledgements once the messages have been
+// delivered to its pipeline.
+package grpc
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gogo/protobuf/proto"
+	grpclib "google.golang.org/grpc"
+)
+
+// Full name of the streaming method defined in heka.proto.
+const streamMethod = "/heka.Heka/Stream"
+
+// Acknowledgement sent by the receiving side of a stream, holding the total
+// number of messages received on the stream that have been delivered to the
+// pipeline. Acks are cumulative, so a lost ack is covered by the next one.
+type ack struct {
+	Count uint64
+}
+
+// gRPC codec that sends messages as the raw protobuf encoded bytes Heka
+// already has on hand, avoiding a decode / reencode on both ends of the
+// stream.
+type hekaCodec struct{}
+
+// Protobuf key of the ack message's count field, field number 1 w/ the
+// varint wire type.
+const ackCountKey = 1<<3 | 0
+
+func (c hekaCodec) Marshal(v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case *[]byte:
+		return *v, nil
+	case *ack:
+		return append(proto.EncodeVarint(ackCountKey), proto.EncodeVarint(v.Count)...), nil
+	}
+	return nil, fmt.Errorf("can't marshal %T", v)
+}
+
+func (c hekaCodec) Unmarshal(data []byte, v interface{}) error {
+	switch v := v.(type) {
+	case *[]byte:
+		*v = append((*v)[:0], data...)
+		return nil
+	case *ack:
+		v.Count = 0
+		for len(data) > 0 {
+			key, n := proto.DecodeVarint(data)
+			if n == 0 || key != ackCountKey {
+				return errors.New("invalid ack")
+			}
+			data = data[n:]
+			if v.Count, n = proto.DecodeVarint(data); n == 0 {
+				return errors.New("invalid ack count")
+			}
+			data = data[n:]
+		}
+		return nil
+	}
+	return fmt.Errorf("can't unmarshal into %T", v)
+}
+
+func (c hekaCodec) String() string {
+	return "heka"
+}
+
+// Implemented by GrpcInput to receive the streams opened by GrpcOutputs.
+type streamHandler interface {
+	handleStream(stream grpclib.ServerStream) error
+}
+
+var serviceDesc = grpclib.ServiceDesc{
+	ServiceName: "heka.Heka",
+	HandlerType: (*streamHandler)(nil),
+	Methods:     []grpclib.MethodDesc{},
+	Streams: []grpclib.StreamDesc{
+		{
+			StreamName: "Stream",
+			Handler: func(srv interface{}, stream grpclib.ServerStream) error {
+				return srv.(streamHandler).handleStream(stream)
+			},
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "heka.proto",
+}
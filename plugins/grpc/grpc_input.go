@@ -0,0 +1,223 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package grpc
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins/tcp"
+	grpclib "google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// Input plugin that accepts message streams from GrpcOutputs, acknowledging
+// messages once they've been delivered to the pipeline.
+type GrpcInput struct {
+	receivedCount int64
+	activeStreams int64
+	streamCount   int64
+	config        *GrpcInputConfig
+	ackInterval   time.Duration
+	listener      net.Listener
+	server        *grpclib.Server
+	ir            InputRunner
+	stopChan      chan struct{}
+}
+
+type GrpcInputConfig struct {
+	// TCP address on which to listen for streams (e.g. "0.0.0.0:5566").
+	Address string
+	// Set to true if the streams should be secured with TLS.
+	UseTls bool `toml:"use_tls"`
+	// Subsection for TLS configuration.
+	Tls tcp.TlsConfig
+	// Number of delivered messages after which an ack is sent.
+	AckCount uint64 `toml:"ack_count"`
+	// Max number of milliseconds delivered messages go unacknowledged.
+	AckInterval uint `toml:"ack_interval"`
+	// Max number of concurrent streams per connection, 0 for gRPC's default.
+	MaxConcurrentStreams uint32 `toml:"max_concurrent_streams"`
+	// So we can default to using ProtobufDecoder.
+	Decoder string
+}
+
+func (g *GrpcInput) ConfigStruct() interface{} {
+	config := &GrpcInputConfig{
+		Address:     "127.0.0.1:5566",
+		AckCount:    100,
+		AckInterval: 100,
+		Decoder:     "ProtobufDecoder",
+	}
+	config.Tls = tcp.TlsConfig{PreferServerCiphers: true}
+	return config
+}
+
+func (g *GrpcInput) Init(config interface{}) (err error) {
+	g.config = config.(*GrpcInputConfig)
+	if g.config.AckCount == 0 {
+		return errors.New("ack_count must be greater than 0")
+	}
+	if g.config.AckInterval == 0 {
+		return errors.New("ack_interval must be greater than 0")
+	}
+	g.ackInterval = time.Duration(g.config.AckInterval) * time.Millisecond
+
+	opts := []grpclib.ServerOption{grpclib.CustomCodec(hekaCodec{})}
+	if g.config.UseTls {
+		goTlsConfig, err := tcp.CreateGoTlsConfig(&g.config.Tls)
+		if err != nil {
+			return fmt.Errorf("TLS init error: %s", err)
+		}
+		opts = append(opts, grpclib.Creds(credentials.NewTLS(goTlsConfig)))
+	}
+	if g.config.MaxConcurrentStreams > 0 {
+		opts = append(opts, grpclib.MaxConcurrentStreams(g.config.MaxConcurrentStreams))
+	}
+
+	if g.listener, err = net.Listen("tcp", g.config.Address); err != nil {
+		return fmt.Errorf("Listener failed to start: %s", err)
+	}
+	g.server = grpclib.NewServer(opts...)
+	g.server.RegisterService(&serviceDesc, g)
+	g.stopChan = make(chan struct{})
+	return nil
+}
+
+func (g *GrpcInput) Run(ir InputRunner, h PluginHelper) error {
+	g.ir = ir
+	err := g.server.Serve(g.listener)
+	select {
+	case <-g.stopChan:
+		// Serve always returns an error once it's been stopped.
+		return nil
+	default:
+	}
+	return err
+}
+
+func (g *GrpcInput) Stop() {
+	close(g.stopChan)
+	g.server.Stop()
+}
+
+// Called by the gRPC server for every stream a GrpcOutput opens. Received
+// messages are delivered to the pipeline as they arrive, while a separate
+// goroutine sends back acks.
+func (g *GrpcInput) handleStream(stream grpclib.ServerStream) (err error) {
+	atomic.AddInt64(&g.activeStreams, 1)
+	defer atomic.AddInt64(&g.activeStreams, -1)
+	token := strconv.FormatInt(atomic.AddInt64(&g.streamCount, 1), 10)
+	deliverer := g.ir.NewDeliverer(token)
+	defer deliverer.Done()
+
+	var delivered uint64
+	nudge := make(chan struct{}, 1)
+	done := make(chan struct{})
+	acksDone := make(chan struct{})
+	go g.sendAcks(stream, &delivered, nudge, done, acksDone)
+
+	for {
+		// Not reading from the stream while we're waiting for a pack lets
+		// gRPC's flow control push back on the sender.
+		var pack *PipelinePack
+		select {
+		case pack = <-g.ir.InChan():
+		case <-g.stopChan:
+		}
+		if pack == nil {
+			break
+		}
+		if err = stream.RecvMsg(&pack.MsgBytes); err != nil {
+			pack.Recycle(nil)
+			break
+		}
+		deliverer.Deliver(pack)
+		atomic.AddInt64(&g.receivedCount, 1)
+		if n := atomic.AddUint64(&delivered, 1); n%g.config.AckCount == 0 {
+			select {
+			case nudge <- struct{}{}:
+			default:
+			}
+		}
+	}
+	// Make sure the final ack is sent before the stream is closed.
+	close(done)
+	<-acksDone
+
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		select {
+		case <-g.stopChan:
+		default:
+			g.ir.LogError(fmt.Errorf("stream %s: %s", token, err))
+		}
+	}
+	return err
+}
+
+// Acks the delivered messages every ack interval, whenever the ack count is
+// reached, and one last time when the stream ends.
+func (g *GrpcInput) sendAcks(stream grpclib.ServerStream, delivered *uint64,
+	nudge, done, acksDone chan struct{}) {
+
+	defer close(acksDone)
+	ticker := time.NewTicker(g.ackInterval)
+	defer ticker.Stop()
+	var acked uint64
+	for {
+		finished := false
+		select {
+		case <-ticker.C:
+		case <-nudge:
+		case <-done:
+			finished = true
+		}
+		if n := atomic.LoadUint64(delivered); n != acked {
+			if err := stream.SendMsg(&ack{Count: n}); err != nil {
+				return
+			}
+			acked = n
+		}
+		if finished {
+			return
+		}
+	}
+}
+
+// Satisfies the `pipeline.ReportingPlugin` interface to provide plugin state
+// information to the Heka report and dashboard.
+func (g *GrpcInput) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "ReceivedCount", atomic.LoadInt64(&g.receivedCount),
+		"count")
+	message.NewInt64Field(msg, "ActiveStreams", atomic.LoadInt64(&g.activeStreams),
+		"count")
+	return nil
+}
+
+func init() {
+	RegisterPlugin("GrpcInput", func() interface{} {
+		return new(GrpcInput)
+	})
+}
@@ -0,0 +1,117 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package grpc
+
+import (
+	"io"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	. "github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	"github.com/mozilla-services/heka/pipelinemock"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"golang.org/x/net/context"
+	grpclib "google.golang.org/grpc"
+)
+
+func GrpcInputSpec(c gs.Context) {
+	t := &pipeline_ts.SimpleT{}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	pConfig := NewPipelineConfig(nil)
+	mockIR := pipelinemock.NewMockInputRunner(ctrl)
+	mockHelper := pipelinemock.NewMockPluginHelper(ctrl)
+	mockDeliverer := pipelinemock.NewMockDeliverer(ctrl)
+
+	msg := pipeline_ts.GetTestMessage()
+	msgBytes, err := proto.Marshal(msg)
+	c.Assume(err, gs.IsNil)
+
+	c.Specify("A GrpcInput", func() {
+		input := new(GrpcInput)
+		config := input.ConfigStruct().(*GrpcInputConfig)
+		config.Address = "127.0.0.1:55666"
+		config.AckCount = 2
+
+		c.Specify("rejects a zero ack count", func() {
+			config.AckCount = 0
+			err := input.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("delivers and acks streamed messages", func() {
+			err := input.Init(config)
+			c.Assume(err, gs.IsNil)
+
+			packSupply := make(chan *PipelinePack, 2)
+			packSupply <- NewPipelinePack(pConfig.InputRecycleChan())
+			packSupply <- NewPipelinePack(pConfig.InputRecycleChan())
+			mockIR.EXPECT().InChan().Return(packSupply).AnyTimes()
+			mockIR.EXPECT().NewDeliverer("1").Return(mockDeliverer)
+			mockDeliverer.EXPECT().Done()
+
+			delivered := make(chan []byte, 3)
+			mockDeliverer.EXPECT().Deliver(gomock.Any()).Times(3).Do(
+				func(pack *PipelinePack) {
+					b := make([]byte, len(pack.MsgBytes))
+					copy(b, pack.MsgBytes)
+					delivered <- b
+					packSupply <- pack
+				})
+
+			errChan := make(chan error, 1)
+			go func() {
+				errChan <- input.Run(mockIR, mockHelper)
+			}()
+
+			conn, err := grpclib.Dial(config.Address, grpclib.WithCodec(hekaCodec{}),
+				grpclib.WithInsecure(), grpclib.WithBlock(),
+				grpclib.WithTimeout(5*time.Second))
+			c.Assume(err, gs.IsNil)
+			defer conn.Close()
+			stream, err := grpclib.NewClientStream(context.Background(),
+				&serviceDesc.Streams[0], conn, streamMethod)
+			c.Assume(err, gs.IsNil)
+
+			for i := 0; i < 3; i++ {
+				err = stream.SendMsg(&msgBytes)
+				c.Expect(err, gs.IsNil)
+			}
+			for i := 0; i < 3; i++ {
+				c.Expect(string(<-delivered), gs.Equals, string(msgBytes))
+			}
+
+			// Acks are cumulative, so keep reading until all three are
+			// covered.
+			a := new(ack)
+			for a.Count < 3 {
+				err = stream.RecvMsg(a)
+				c.Assume(err, gs.IsNil)
+			}
+			c.Expect(a.Count, gs.Equals, uint64(3))
+
+			err = stream.CloseSend()
+			c.Expect(err, gs.IsNil)
+			err = stream.RecvMsg(a)
+			c.Expect(err, gs.Equals, io.EOF)
+
+			input.Stop()
+			c.Expect(<-errChan, gs.IsNil)
+		})
+	})
+}
@@ -0,0 +1,354 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package grpc
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins/tcp"
+	"golang.org/x/net/context"
+	grpclib "google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// Output plugin that streams messages to a GrpcInput. Sent messages are held
+// in memory until they've been acknowledged, and are resent on a new stream if
+// the current one fails. The queue buffer cursor is only advanced as messages
+// are acknowledged, so unacknowledged messages are also resent after a
+// restart.
+type GrpcOutput struct {
+	processMessageCount int64
+	dropMessageCount    int64
+	ackedCount          int64
+	reconnectCount      int64
+	unackedCount        int64
+	conf                *GrpcOutputConfig
+	ackTimeout          time.Duration
+	dialOpts            []grpclib.DialOption
+	conn                *grpclib.ClientConn
+	stream              *outputStream
+	// Sent but unacknowledged records, oldest first.
+	window       []sentRecord
+	lastProgress time.Time
+	or           OutputRunner
+}
+
+type GrpcOutputConfig struct {
+	// TCP address of the GrpcInput to send to.
+	Address string
+	// Set to true if the stream should be secured with TLS.
+	UseTls bool `toml:"use_tls"`
+	// Subsection for TLS configuration.
+	Tls tcp.TlsConfig
+	// Max number of sent messages that may be awaiting acknowledgement.
+	MaxUnacked int `toml:"max_unacked"`
+	// Seconds to wait for an ack before the stream is considered dead.
+	AckTimeout uint `toml:"ack_timeout"`
+	// Seconds to wait for a connection to be established.
+	ConnectTimeout uint `toml:"connect_timeout"`
+	// So we can default to using ProtobufEncoder.
+	Encoder string
+	// So acks are processed even when no messages are being sent.
+	TickerInterval uint `toml:"ticker_interval"`
+	// Defaults to true for GrpcOutput.
+	UseBuffering *bool `toml:"use_buffering"`
+	Buffering    QueueBufferConfig
+}
+
+// A record that has been sent but not yet acknowledged.
+type sentRecord struct {
+	record []byte
+	cursor string
+}
+
+// A single client stream, along with the goroutine reading its acks.
+type outputStream struct {
+	// Total number of messages acked on the stream, accessed atomically.
+	acked uint64
+	// Number of acks already applied to the window.
+	applied uint64
+	stream  grpclib.ClientStream
+	cancel  context.CancelFunc
+	signal  chan struct{}
+	dead    chan struct{}
+	// Set before dead is closed.
+	err error
+}
+
+func (s *outputStream) readAcks() {
+	a := new(ack)
+	for {
+		if err := s.stream.RecvMsg(a); err != nil {
+			s.err = err
+			close(s.dead)
+			return
+		}
+		atomic.StoreUint64(&s.acked, a.Count)
+		select {
+		case s.signal <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (g *GrpcOutput) ConfigStruct() interface{} {
+	b := true
+	queueConfig := QueueBufferConfig{
+		CursorUpdateCount: 50,
+		MaxBufferSize:     0,
+		MaxFileSize:       128 * 1024 * 1024,
+		FullAction:        "shutdown",
+	}
+	return &GrpcOutputConfig{
+		Address:        "localhost:5566",
+		MaxUnacked:     1000,
+		AckTimeout:     30,
+		ConnectTimeout: 10,
+		Encoder:        "ProtobufEncoder",
+		TickerInterval: 1,
+		UseBuffering:   &b,
+		Buffering:      queueConfig,
+	}
+}
+
+func (g *GrpcOutput) Init(config interface{}) error {
+	g.conf = config.(*GrpcOutputConfig)
+	if g.conf.MaxUnacked < 1 {
+		return errors.New("max_unacked must be greater than 0")
+	}
+	if g.conf.AckTimeout == 0 {
+		return errors.New("ack_timeout must be greater than 0")
+	}
+	g.ackTimeout = time.Duration(g.conf.AckTimeout) * time.Second
+
+	g.dialOpts = []grpclib.DialOption{
+		grpclib.WithCodec(hekaCodec{}),
+		grpclib.WithBlock(),
+		grpclib.WithTimeout(time.Duration(g.conf.ConnectTimeout) * time.Second),
+	}
+	if g.conf.UseTls {
+		goTlsConfig, err := tcp.CreateGoTlsConfig(&g.conf.Tls)
+		if err != nil {
+			return fmt.Errorf("TLS init error: %s", err)
+		}
+		g.dialOpts = append(g.dialOpts,
+			grpclib.WithTransportCredentials(credentials.NewTLS(goTlsConfig)))
+	} else {
+		g.dialOpts = append(g.dialOpts, grpclib.WithInsecure())
+	}
+	g.window = make([]sentRecord, 0, g.conf.MaxUnacked)
+	return nil
+}
+
+func (g *GrpcOutput) Prepare(or OutputRunner, h PluginHelper) error {
+	// The GrpcInput expects the messages to be protobuf encoded.
+	if _, ok := or.Encoder().(*ProtobufEncoder); !ok {
+		return errors.New("GrpcOutput requires a ProtobufEncoder")
+	}
+	g.or = or
+	return nil
+}
+
+// Opens a new stream, resending any unacknowledged records on it.
+func (g *GrpcOutput) connect() (err error) {
+	if g.conn == nil {
+		if g.conn, err = grpclib.Dial(g.conf.Address, g.dialOpts...); err != nil {
+			g.conn = nil
+			return err
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := grpclib.NewClientStream(ctx, &serviceDesc.Streams[0], g.conn,
+		streamMethod)
+	if err != nil {
+		cancel()
+		return err
+	}
+	s := &outputStream{
+		stream: stream,
+		cancel: cancel,
+		signal: make(chan struct{}, 1),
+		dead:   make(chan struct{}),
+	}
+	for i := range g.window {
+		if err = stream.SendMsg(&g.window[i].record); err != nil {
+			cancel()
+			return err
+		}
+	}
+	if len(g.window) > 0 {
+		atomic.AddInt64(&g.reconnectCount, 1)
+	}
+	go s.readAcks()
+	g.stream = s
+	g.lastProgress = time.Now()
+	return nil
+}
+
+func (g *GrpcOutput) resetStream() {
+	if g.stream != nil {
+		g.stream.cancel()
+		g.stream = nil
+	}
+}
+
+// Drops acknowledged records from the window, advancing the buffer cursor.
+func (g *GrpcOutput) applyAcks() {
+	if g.stream == nil {
+		return
+	}
+	n := int(atomic.LoadUint64(&g.stream.acked) - g.stream.applied)
+	if n <= 0 {
+		return
+	}
+	if n > len(g.window) {
+		// Shouldn't happen, but don't let a confused receiver panic us.
+		n = len(g.window)
+	}
+	cursor := g.window[n-1].cursor
+	remaining := copy(g.window, g.window[n:])
+	for i := remaining; i < len(g.window); i++ {
+		g.window[i] = sentRecord{}
+	}
+	g.window = g.window[:remaining]
+	g.stream.applied += uint64(n)
+	g.lastProgress = time.Now()
+	atomic.AddInt64(&g.ackedCount, int64(n))
+	atomic.StoreInt64(&g.unackedCount, int64(len(g.window)))
+	if cursor != "" {
+		g.or.UpdateCursor(cursor)
+	}
+}
+
+func (g *GrpcOutput) ProcessMessage(pack *PipelinePack) (err error) {
+	if g.stream == nil {
+		if err = g.connect(); err != nil {
+			return NewRetryMessageError("can't connect to %s: %s", g.conf.Address, err)
+		}
+	}
+
+	// Wait for acks if too many messages are already in flight.
+	g.applyAcks()
+	for len(g.window) >= g.conf.MaxUnacked {
+		select {
+		case <-g.stream.signal:
+			g.applyAcks()
+		case <-g.stream.dead:
+			err = g.stream.err
+			g.resetStream()
+			return NewRetryMessageError("stream to %s failed: %s", g.conf.Address, err)
+		case <-time.After(g.ackTimeout):
+			g.resetStream()
+			return NewRetryMessageError("timed out waiting for acks from %s",
+				g.conf.Address)
+		}
+	}
+
+	var record []byte
+	if record, err = g.or.Encode(pack); err != nil {
+		atomic.AddInt64(&g.dropMessageCount, 1)
+		return fmt.Errorf("can't encode: %s", err)
+	}
+	// The encoded bytes may belong to the pack, which is about to be recycled.
+	sent := sentRecord{
+		record: make([]byte, len(record)),
+		cursor: pack.QueueCursor,
+	}
+	copy(sent.record, record)
+	if err = g.stream.stream.SendMsg(&sent.record); err != nil {
+		g.resetStream()
+		return NewRetryMessageError("sending to %s: %s", g.conf.Address, err)
+	}
+	if len(g.window) == 0 {
+		g.lastProgress = time.Now()
+	}
+	g.window = append(g.window, sent)
+	atomic.StoreInt64(&g.unackedCount, int64(len(g.window)))
+	atomic.AddInt64(&g.processMessageCount, 1)
+	return nil
+}
+
+// Processes any acks that have arrived while we weren't sending, and makes
+// sure unacknowledged messages are resent if the stream has died in the
+// meantime.
+func (g *GrpcOutput) TimerEvent() error {
+	if g.stream != nil {
+		g.applyAcks()
+		select {
+		case <-g.stream.dead:
+			g.or.LogError(fmt.Errorf("stream to %s failed: %s", g.conf.Address,
+				g.stream.err))
+			g.resetStream()
+		default:
+			if len(g.window) > 0 && time.Since(g.lastProgress) > g.ackTimeout {
+				g.or.LogError(fmt.Errorf("timed out waiting for acks from %s",
+					g.conf.Address))
+				g.resetStream()
+			}
+		}
+	}
+	if g.stream == nil && len(g.window) > 0 {
+		if err := g.connect(); err != nil {
+			g.or.LogError(fmt.Errorf("can't connect to %s: %s", g.conf.Address, err))
+		}
+	}
+	return nil
+}
+
+// Closes the stream, giving the receiver a chance to ack whatever is still in
+// flight.
+func (g *GrpcOutput) CleanUp() {
+	if g.stream != nil {
+		if err := g.stream.stream.CloseSend(); err == nil {
+			// The receiver sends its final ack before ending the stream.
+			select {
+			case <-g.stream.dead:
+			case <-time.After(g.ackTimeout):
+			}
+			g.applyAcks()
+		}
+		g.resetStream()
+	}
+	if g.conn != nil {
+		g.conn.Close()
+		g.conn = nil
+	}
+}
+
+// Satisfies the `pipeline.ReportingPlugin` interface to provide plugin state
+// information to the Heka report and dashboard.
+func (g *GrpcOutput) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "ProcessMessageCount",
+		atomic.LoadInt64(&g.processMessageCount), "count")
+	message.NewInt64Field(msg, "DropMessageCount",
+		atomic.LoadInt64(&g.dropMessageCount), "count")
+	message.NewInt64Field(msg, "AckedCount", atomic.LoadInt64(&g.ackedCount), "count")
+	message.NewInt64Field(msg, "UnackedCount", atomic.LoadInt64(&g.unackedCount),
+		"count")
+	message.NewInt64Field(msg, "ReconnectCount", atomic.LoadInt64(&g.reconnectCount),
+		"count")
+	return nil
+}
+
+func init() {
+	RegisterPlugin("GrpcOutput", func() interface{} {
+		return new(GrpcOutput)
+	})
+}
@@ -0,0 +1,174 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package grpc
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	. "github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	"github.com/mozilla-services/heka/plugins"
+	plugins_ts "github.com/mozilla-services/heka/plugins/testsupport"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	grpclib "google.golang.org/grpc"
+)
+
+// Stream receiver that records what it's sent, acking every message unless
+// told to drop the stream.
+type testReceiver struct {
+	lock     sync.Mutex
+	received [][]byte
+	// Number of streams to fail after their first message is received.
+	failStreams int
+}
+
+func (r *testReceiver) handleStream(stream grpclib.ServerStream) error {
+	var count uint64
+	for {
+		var record []byte
+		if err := stream.RecvMsg(&record); err != nil {
+			return nil
+		}
+		r.lock.Lock()
+		r.received = append(r.received, record)
+		fail := r.failStreams > 0
+		if fail {
+			r.failStreams--
+		}
+		r.lock.Unlock()
+		if fail {
+			return errors.New("dropping stream")
+		}
+		count++
+		if err := stream.SendMsg(&ack{Count: count}); err != nil {
+			return err
+		}
+	}
+}
+
+func (r *testReceiver) receivedCount() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.received)
+}
+
+func GrpcOutputSpec(c gs.Context) {
+	t := new(pipeline_ts.SimpleT)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	pConfig := NewPipelineConfig(nil)
+	oth := plugins_ts.NewOutputTestHelper(ctrl)
+
+	msg := pipeline_ts.GetTestMessage()
+	msgBytes, err := proto.Marshal(msg)
+	c.Assume(err, gs.IsNil)
+	pack := NewPipelinePack(pConfig.InputRecycleChan())
+	pack.Message = msg
+	pack.QueueCursor = "queuecursor"
+
+	c.Specify("A GrpcOutput", func() {
+		output := new(GrpcOutput)
+		config := output.ConfigStruct().(*GrpcOutputConfig)
+		config.Address = "127.0.0.1:55667"
+		config.AckTimeout = 1
+
+		c.Specify("requires a ProtobufEncoder", func() {
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			oth.MockOutputRunner.EXPECT().Encoder().Return(new(plugins.PayloadEncoder))
+			err = output.Prepare(oth.MockOutputRunner, oth.MockHelper)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("w/ a receiver", func() {
+			receiver := new(testReceiver)
+			listener, err := net.Listen("tcp", config.Address)
+			c.Assume(err, gs.IsNil)
+			server := grpclib.NewServer(grpclib.CustomCodec(hekaCodec{}))
+			server.RegisterService(&serviceDesc, receiver)
+			go server.Serve(listener)
+			defer server.Stop()
+
+			oth.MockOutputRunner.EXPECT().Encoder().Return(new(ProtobufEncoder))
+			oth.MockOutputRunner.EXPECT().Encode(pack).Return(msgBytes, nil).AnyTimes()
+			var cursorLock sync.Mutex
+			var cursor string
+			oth.MockOutputRunner.EXPECT().UpdateCursor(gomock.Any()).AnyTimes().Do(
+				func(cur string) {
+					cursorLock.Lock()
+					cursor = cur
+					cursorLock.Unlock()
+				})
+
+			c.Specify("sends messages and advances the cursor as they're acked",
+				func() {
+					err := output.Init(config)
+					c.Assume(err, gs.IsNil)
+					err = output.Prepare(oth.MockOutputRunner, oth.MockHelper)
+					c.Assume(err, gs.IsNil)
+
+					for i := 0; i < 3; i++ {
+						err = output.ProcessMessage(pack)
+						c.Expect(err, gs.IsNil)
+					}
+					output.CleanUp()
+
+					c.Expect(receiver.receivedCount(), gs.Equals, 3)
+					c.Expect(string(receiver.received[0]), gs.Equals, string(msgBytes))
+					c.Expect(len(output.window), gs.Equals, 0)
+					c.Expect(output.ackedCount, gs.Equals, int64(3))
+					cursorLock.Lock()
+					c.Expect(cursor, gs.Equals, "queuecursor")
+					cursorLock.Unlock()
+				})
+
+			c.Specify("resends unacked messages on a new stream", func() {
+				config.MaxUnacked = 1
+				receiver.failStreams = 1
+				err := output.Init(config)
+				c.Assume(err, gs.IsNil)
+				err = output.Prepare(oth.MockOutputRunner, oth.MockHelper)
+				c.Assume(err, gs.IsNil)
+				oth.MockOutputRunner.EXPECT().LogError(gomock.Any())
+
+				err = output.ProcessMessage(pack)
+				c.Expect(err, gs.IsNil)
+				c.Expect(len(output.window), gs.Equals, 1)
+
+				// Wait for the receiver to drop the stream, then let the
+				// timer event reconnect.
+				select {
+				case <-output.stream.dead:
+				case <-time.After(5 * time.Second):
+					c.Assume("stream wasn't dropped", gs.IsNil)
+				}
+				err = output.TimerEvent()
+				c.Expect(err, gs.IsNil)
+				c.Expect(output.reconnectCount, gs.Equals, int64(1))
+
+				output.CleanUp()
+				c.Expect(receiver.receivedCount(), gs.Equals, 2)
+				c.Expect(len(output.window), gs.Equals, 0)
+				c.Expect(output.ackedCount, gs.Equals, int64(1))
+			})
+		})
+	})
+}
@@ -0,0 +1,62 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package grpc
+
+import (
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func CodecSpec(c gs.Context) {
+	codec := hekaCodec{}
+
+	c.Specify("The heka codec", func() {
+		c.Specify("passes message bytes through untouched", func() {
+			record := []byte("some protobuf bytes")
+			data, err := codec.Marshal(&record)
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(data), gs.Equals, string(record))
+
+			var out []byte
+			err = codec.Unmarshal(data, &out)
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(out), gs.Equals, string(record))
+		})
+
+		c.Specify("round trips acks", func() {
+			data, err := codec.Marshal(&ack{Count: 300})
+			c.Expect(err, gs.IsNil)
+			// Field 1, varint wire type, followed by 300 as a varint.
+			c.Expect(string(data), gs.Equals, string([]byte{0x08, 0xac, 0x02}))
+
+			a := new(ack)
+			err = codec.Unmarshal(data, a)
+			c.Expect(err, gs.IsNil)
+			c.Expect(a.Count, gs.Equals, uint64(300))
+		})
+
+		c.Specify("rejects malformed acks", func() {
+			a := new(ack)
+			err := codec.Unmarshal([]byte{0x10, 0x01}, a)
+			c.Expect(err, gs.Not(gs.IsNil))
+			err = codec.Unmarshal([]byte{0x08, 0xac}, a)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("rejects unknown types", func() {
+			_, err := codec.Marshal("string")
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+}
@@ -0,0 +1,137 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package grpc
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/mozilla-services/heka/message"
+	grpclib "google.golang.org/grpc"
+)
+
+// Environment variable set for the plugin processes an ExternalOutput starts,
+// holding the version of the external plugin protocol.
+const PLUGIN_PROTOCOL_ENV = "HEKA_PLUGIN_PROTOCOL"
+
+// Version of the external plugin protocol. A plugin process serves the Heka
+// gRPC service on a local TCP address, then writes a
+// `<version>|tcp|<address>` handshake line to its stdout. It exits once its
+// stdin is closed.
+const pluginProtocolVersion = "1"
+
+// Serves an output plugin in a process started by an ExternalOutput, which is
+// the SDK for plugins kept out of hekad's build. deliver is called w/ each
+// message the ExternalOutput sends, one at a time and in order. Once it
+// returns nil the message is acknowledged; an error ends the stream, so the
+// message is sent again along w/ the ones after it. Returns once hekad closes
+// the process's stdin, which is how it asks the plugin to exit.
+func ServeOutputPlugin(deliver func(msg *message.Message) error) error {
+	if version := os.Getenv(PLUGIN_PROTOCOL_ENV); version != pluginProtocolVersion {
+		return fmt.Errorf("not started by an ExternalOutput w/ protocol version %s",
+			pluginProtocolVersion)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	return servePlugin(listener, os.Stdin, os.Stdout, deliver)
+}
+
+// Implements the Heka gRPC service for a plugin process.
+type pluginServer struct {
+	lock    sync.Mutex
+	deliver func(msg *message.Message) error
+}
+
+func servePlugin(listener net.Listener, stdin io.Reader, stdout io.Writer,
+	deliver func(msg *message.Message) error) error {
+
+	server := grpclib.NewServer(grpclib.CustomCodec(hekaCodec{}))
+	server.RegisterService(&serviceDesc, &pluginServer{deliver: deliver})
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(listener)
+	}()
+	if _, err := fmt.Fprintf(stdout, "%s|tcp|%s\n", pluginProtocolVersion,
+		listener.Addr()); err != nil {
+		server.Stop()
+		return err
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, stdin)
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		server.Stop()
+		return nil
+	case err := <-served:
+		return err
+	}
+}
+
+// Delivers the messages of a stream, acking each one once it's delivered.
+func (p *pluginServer) handleStream(stream grpclib.ServerStream) error {
+	var (
+		record []byte
+		count  uint64
+	)
+	for {
+		if err := stream.RecvMsg(&record); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		msg := new(message.Message)
+		if err := message.UnmarshalMessage(record, msg); err != nil {
+			return fmt.Errorf("can't decode message: %s", err)
+		}
+		p.lock.Lock()
+		err := p.deliver(msg)
+		p.lock.Unlock()
+		if err != nil {
+			return err
+		}
+		count++
+		if err = stream.SendMsg(&ack{Count: count}); err != nil {
+			return err
+		}
+	}
+}
+
+// Parses a plugin process's handshake line, returning the address it serves
+// on.
+func parseHandshake(line string) (string, error) {
+	parts := strings.Split(strings.TrimSpace(line), "|")
+	if len(parts) != 3 || parts[2] == "" {
+		return "", fmt.Errorf("invalid handshake '%s'", line)
+	}
+	if parts[0] != pluginProtocolVersion {
+		return "", fmt.Errorf("unsupported protocol version '%s'", parts[0])
+	}
+	if parts[1] != "tcp" {
+		return "", fmt.Errorf("unsupported network '%s'", parts[1])
+	}
+	return parts[2], nil
+}
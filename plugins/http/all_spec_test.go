@@ -23,9 +23,14 @@ func TestAllSpecs(t *testing.T) {
 	r := gospec.NewRunner()
 	r.Parallel = false
 
+	r.AddSpec(HttpAuthSpec)
 	r.AddSpec(HttpInputSpec)
 	r.AddSpec(HttpListenInputSpec)
 	r.AddSpec(HttpOutputSpec)
+	r.AddSpec(JolokiaInputSpec)
+	r.AddSpec(SseOutputSpec)
+	r.AddSpec(WebSocketInputSpec)
+	r.AddSpec(WebSocketOutputSpec)
 
 	gospec.MainGoTest(r, t)
 }
@@ -0,0 +1,268 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package http
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Largest request body that will be read into memory so its signature can be
+// verified.
+const maxSignedBodySize = 16 * 1024 * 1024
+
+// Decides whether a request may submit data to an HttpListenInput.
+type requestAuthenticator interface {
+	// Returns an error if the request should be rejected. The body is only
+	// provided if `needsBody` returns true, otherwise it's nil.
+	authenticate(req *http.Request, body []byte) error
+	// Whether the request body must be read before authenticating.
+	needsBody() bool
+	// Value of the WWW-Authenticate header sent w/ rejections, if any.
+	challenge() string
+}
+
+// Creates the authenticator for the configured auth_type, nil if requests
+// don't need to be authenticated.
+func newAuthenticator(conf *HttpListenInputConfig) (requestAuthenticator, error) {
+	switch conf.AuthType {
+	case "":
+		return nil, nil
+	case "Basic":
+		if conf.Username == "" || conf.Password == "" {
+			return nil, errors.New("Basic auth requires a username and password")
+		}
+		return &basicAuth{conf.Username, conf.Password}, nil
+	case "API":
+		if conf.Key == "" {
+			return nil, errors.New("API auth requires an api_key")
+		}
+		return &apiKeyAuth{conf.Key}, nil
+	case "Bearer":
+		return newBearerAuth(conf.BearerTokens, conf.BearerTokenFile)
+	case "HMAC":
+		return newHmacAuth(conf)
+	case "ClientCert":
+		if !conf.UseTls {
+			return nil, errors.New("ClientCert auth requires use_tls")
+		}
+		switch conf.Tls.ClientAuth {
+		case "RequireAndVerifyClientCert", "VerifyClientCertIfGiven":
+		default:
+			return nil, errors.New("ClientCert auth requires a tls client_auth " +
+				"setting that verifies client certificates")
+		}
+		return &clientCertAuth{conf.AllowedClientCNs}, nil
+	}
+	return nil, fmt.Errorf("unknown auth_type: %s", conf.AuthType)
+}
+
+// Compares strings w/o leaking how much of them matched through timing.
+func secureCompare(given, expected string) bool {
+	return subtle.ConstantTimeCompare([]byte(given), []byte(expected)) == 1
+}
+
+type basicAuth struct {
+	username string
+	password string
+}
+
+func (a *basicAuth) authenticate(req *http.Request, body []byte) error {
+	user, pass, ok := req.BasicAuth()
+	// Always check both, so the time taken doesn't reveal a valid username.
+	userOk := secureCompare(user, a.username)
+	passOk := secureCompare(pass, a.password)
+	if !ok || !userOk || !passOk {
+		return errors.New("Basic Auth Failed")
+	}
+	return nil
+}
+
+func (a *basicAuth) needsBody() bool   { return false }
+func (a *basicAuth) challenge() string { return `Basic realm="heka"` }
+
+type apiKeyAuth struct {
+	key string
+}
+
+func (a *apiKeyAuth) authenticate(req *http.Request, body []byte) error {
+	if !secureCompare(req.Header.Get("X-API-Key"), a.key) {
+		return errors.New("API Auth Failed")
+	}
+	return nil
+}
+
+func (a *apiKeyAuth) needsBody() bool   { return false }
+func (a *apiKeyAuth) challenge() string { return "" }
+
+type bearerAuth struct {
+	tokens []string
+}
+
+// Combines the configured tokens w/ those in the token file, which holds one
+// token per line and may contain blank lines and `#` comments.
+func newBearerAuth(tokens []string, tokenFile string) (*bearerAuth, error) {
+	a := &bearerAuth{tokens: append([]string{}, tokens...)}
+	if tokenFile != "" {
+		f, err := os.Open(tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't open bearer_token_file: %s", err)
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line != "" && !strings.HasPrefix(line, "#") {
+				a.tokens = append(a.tokens, line)
+			}
+		}
+		if err = scanner.Err(); err != nil {
+			return nil, fmt.Errorf("reading bearer_token_file: %s", err)
+		}
+	}
+	if len(a.tokens) == 0 {
+		return nil, errors.New("Bearer auth requires at least one token")
+	}
+	return a, nil
+}
+
+func (a *bearerAuth) authenticate(req *http.Request, body []byte) error {
+	authz := req.Header.Get("Authorization")
+	if len(authz) < 7 || !strings.EqualFold(authz[:7], "Bearer ") {
+		return errors.New("missing bearer token")
+	}
+	given := strings.TrimSpace(authz[7:])
+	matched := false
+	for _, token := range a.tokens {
+		if secureCompare(given, token) {
+			matched = true
+		}
+	}
+	if !matched {
+		return errors.New("Bearer Auth Failed")
+	}
+	return nil
+}
+
+func (a *bearerAuth) needsBody() bool   { return false }
+func (a *bearerAuth) challenge() string { return `Bearer realm="heka"` }
+
+var hmacHashes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+// Verifies a hex encoded HMAC of the request body, optionally prefixed w/ the
+// hash name (e.g. "sha256=..."), which is the format GitHub and most other
+// webhook senders use. If a max skew is set the signature must also cover a
+// timestamp header, i.e. it's the HMAC of "<timestamp>.<body>", so captured
+// requests can't be replayed later.
+type hmacAuth struct {
+	key             []byte
+	hashName        string
+	newHash         func() hash.Hash
+	header          string
+	timestampHeader string
+	maxSkew         time.Duration
+}
+
+func newHmacAuth(conf *HttpListenInputConfig) (*hmacAuth, error) {
+	if conf.HmacKey == "" {
+		return nil, errors.New("HMAC auth requires an hmac_key")
+	}
+	newHash, ok := hmacHashes[conf.HmacHash]
+	if !ok {
+		return nil, fmt.Errorf("unsupported hmac_hash: %s", conf.HmacHash)
+	}
+	return &hmacAuth{
+		key:             []byte(conf.HmacKey),
+		hashName:        conf.HmacHash,
+		newHash:         newHash,
+		header:          conf.HmacHeader,
+		timestampHeader: conf.HmacTimestampHeader,
+		maxSkew:         time.Duration(conf.HmacMaxSkew) * time.Second,
+	}, nil
+}
+
+func (a *hmacAuth) authenticate(req *http.Request, body []byte) error {
+	sig := req.Header.Get(a.header)
+	sig = strings.TrimPrefix(sig, a.hashName+"=")
+	given, err := hex.DecodeString(sig)
+	if err != nil || len(given) == 0 {
+		return errors.New("missing or malformed signature")
+	}
+
+	mac := hmac.New(a.newHash, a.key)
+	if a.maxSkew > 0 {
+		timestamp := req.Header.Get(a.timestampHeader)
+		secs, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return errors.New("missing or malformed timestamp")
+		}
+		skew := time.Since(time.Unix(secs, 0))
+		if skew > a.maxSkew || skew < -a.maxSkew {
+			return errors.New("timestamp outside the allowed skew")
+		}
+		mac.Write([]byte(timestamp))
+		mac.Write([]byte{'.'})
+	}
+	mac.Write(body)
+	if !hmac.Equal(given, mac.Sum(nil)) {
+		return errors.New("HMAC Auth Failed")
+	}
+	return nil
+}
+
+func (a *hmacAuth) needsBody() bool   { return true }
+func (a *hmacAuth) challenge() string { return "" }
+
+// Accepts requests made w/ a client certificate that has been verified by the
+// TLS handshake, optionally restricted to certain common names.
+type clientCertAuth struct {
+	allowedCNs []string
+}
+
+func (a *clientCertAuth) authenticate(req *http.Request, body []byte) error {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+		return errors.New("no verified client certificate")
+	}
+	if len(a.allowedCNs) == 0 {
+		return nil
+	}
+	cn := req.TLS.VerifiedChains[0][0].Subject.CommonName
+	for _, allowed := range a.allowedCNs {
+		if cn == allowed {
+			return nil
+		}
+	}
+	return fmt.Errorf("client certificate CN not allowed: %s", cn)
+}
+
+func (a *clientCertAuth) needsBody() bool   { return false }
+func (a *clientCertAuth) challenge() string { return "" }
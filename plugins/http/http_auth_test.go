@@ -0,0 +1,196 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package http
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	"github.com/mozilla-services/heka/pipelinemock"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func HttpAuthSpec(c gs.Context) {
+	t := &pipeline_ts.SimpleT{}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	input := new(HttpListenInput)
+	config := input.ConfigStruct().(*HttpListenInputConfig)
+	newRequest := func(body string) *http.Request {
+		req, err := http.NewRequest("POST", "http://localhost/", strings.NewReader(body))
+		c.Assume(err, gs.IsNil)
+		return req
+	}
+
+	c.Specify("Request authentication", func() {
+		c.Specify("is disabled by default", func() {
+			auth, err := newAuthenticator(config)
+			c.Expect(err, gs.IsNil)
+			c.Expect(auth, gs.IsNil)
+		})
+
+		c.Specify("rejects an unknown auth type", func() {
+			config.AuthType = "Kerberos"
+			_, err := newAuthenticator(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("requires credentials for Basic auth", func() {
+			config.AuthType = "Basic"
+			config.Username = "foo"
+			_, err := newAuthenticator(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+
+			config.Password = "bar"
+			auth, err := newAuthenticator(config)
+			c.Assume(err, gs.IsNil)
+			req := newRequest("")
+			req.SetBasicAuth("foo", "baz")
+			c.Expect(auth.authenticate(req, nil), gs.Not(gs.IsNil))
+			req.SetBasicAuth("foo", "bar")
+			c.Expect(auth.authenticate(req, nil), gs.IsNil)
+		})
+
+		c.Specify("accepts any listed bearer token", func() {
+			tmpDir, err := ioutil.TempDir("", "http-auth")
+			c.Assume(err, gs.IsNil)
+			defer os.RemoveAll(tmpDir)
+			tokenFile := filepath.Join(tmpDir, "tokens")
+			err = ioutil.WriteFile(tokenFile, []byte("# comment\n\ntoken2\n"), 0600)
+			c.Assume(err, gs.IsNil)
+
+			config.AuthType = "Bearer"
+			config.BearerTokens = []string{"token1"}
+			config.BearerTokenFile = tokenFile
+			auth, err := newAuthenticator(config)
+			c.Assume(err, gs.IsNil)
+			c.Expect(auth.challenge(), gs.Equals, `Bearer realm="heka"`)
+
+			req := newRequest("")
+			c.Expect(auth.authenticate(req, nil), gs.Not(gs.IsNil))
+			req.Header.Set("Authorization", "Bearer token3")
+			c.Expect(auth.authenticate(req, nil), gs.Not(gs.IsNil))
+			req.Header.Set("Authorization", "Bearer token1")
+			c.Expect(auth.authenticate(req, nil), gs.IsNil)
+			req.Header.Set("Authorization", "bearer token2")
+			c.Expect(auth.authenticate(req, nil), gs.IsNil)
+		})
+
+		c.Specify("verifies HMAC signatures", func() {
+			config.AuthType = "HMAC"
+			config.HmacKey = "secret"
+			body := []byte("the body")
+			sign := func(data []byte) string {
+				mac := hmac.New(sha256.New, []byte("secret"))
+				mac.Write(data)
+				return hex.EncodeToString(mac.Sum(nil))
+			}
+
+			c.Specify("w/ or w/o the hash name prefix", func() {
+				auth, err := newAuthenticator(config)
+				c.Assume(err, gs.IsNil)
+				req := newRequest("")
+				c.Expect(auth.authenticate(req, body), gs.Not(gs.IsNil))
+				req.Header.Set("X-Signature", sign([]byte("other body")))
+				c.Expect(auth.authenticate(req, body), gs.Not(gs.IsNil))
+				req.Header.Set("X-Signature", sign(body))
+				c.Expect(auth.authenticate(req, body), gs.IsNil)
+				req.Header.Set("X-Signature", "sha256="+sign(body))
+				c.Expect(auth.authenticate(req, body), gs.IsNil)
+			})
+
+			c.Specify("covering a timestamp if there's a max skew", func() {
+				config.HmacMaxSkew = 60
+				auth, err := newAuthenticator(config)
+				c.Assume(err, gs.IsNil)
+				req := newRequest("")
+				now := strconv.FormatInt(time.Now().Unix(), 10)
+				req.Header.Set("X-Signature", sign(body))
+				req.Header.Set("X-Signature-Timestamp", now)
+				c.Expect(auth.authenticate(req, body), gs.Not(gs.IsNil))
+
+				req.Header.Set("X-Signature", sign([]byte(now+".the body")))
+				c.Expect(auth.authenticate(req, body), gs.IsNil)
+
+				old := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+				req.Header.Set("X-Signature", sign([]byte(old+".the body")))
+				req.Header.Set("X-Signature-Timestamp", old)
+				c.Expect(auth.authenticate(req, body), gs.Not(gs.IsNil))
+			})
+		})
+
+		c.Specify("checks verified client certificates", func() {
+			config.AuthType = "ClientCert"
+			_, err := newAuthenticator(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+
+			config.UseTls = true
+			config.Tls.ClientAuth = "RequireAndVerifyClientCert"
+			config.AllowedClientCNs = []string{"good-client"}
+			auth, err := newAuthenticator(config)
+			c.Assume(err, gs.IsNil)
+
+			req := newRequest("")
+			c.Expect(auth.authenticate(req, nil), gs.Not(gs.IsNil))
+			cert := &x509.Certificate{Subject: pkix.Name{CommonName: "bad-client"}}
+			req.TLS = &tls.ConnectionState{
+				VerifiedChains: [][]*x509.Certificate{{cert}},
+			}
+			c.Expect(auth.authenticate(req, nil), gs.Not(gs.IsNil))
+			cert.Subject.CommonName = "good-client"
+			c.Expect(auth.authenticate(req, nil), gs.IsNil)
+		})
+
+		c.Specify("rejects requests w/ a 401 and counts them", func() {
+			config.AuthType = "API"
+			config.Key = "123"
+			err := input.Init(config)
+			c.Assume(err, gs.IsNil)
+			mockIR := pipelinemock.NewMockInputRunner(ctrl)
+			mockIR.EXPECT().LogError(gomock.Any())
+			input.ir = mockIR
+
+			req := newRequest("data")
+			req.Header.Set("X-API-Key", "456")
+			recorder := httptest.NewRecorder()
+			input.RequestHandler(recorder, req)
+			c.Expect(recorder.Code, gs.Equals, http.StatusUnauthorized)
+
+			msg := new(message.Message)
+			err = input.ReportMsg(msg)
+			c.Assume(err, gs.IsNil)
+			rejected, _ := msg.GetFieldValue("RejectedCount")
+			c.Expect(rejected, gs.Equals, int64(1))
+			requests, _ := msg.GetFieldValue("RequestCount")
+			c.Expect(requests, gs.Equals, int64(1))
+		})
+	})
+}
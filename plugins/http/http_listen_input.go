@@ -17,13 +17,18 @@
 package http
 
 import (
+	"bytes"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
 
 	"github.com/mozilla-services/heka/message"
 	. "github.com/mozilla-services/heka/pipeline"
@@ -31,14 +36,20 @@ import (
 )
 
 type HttpListenInput struct {
-	conf        *HttpListenInputConfig
-	listener    net.Listener
-	stopChan    chan bool
-	ir          InputRunner
-	server      *http.Server
-	starterFunc func(hli *HttpListenInput) error
-	hekaPid     int32
-	hostname    string
+	requestCount  int64
+	rejectedCount int64
+	conf          *HttpListenInputConfig
+	auth          requestAuthenticator
+	queryParams   map[string]bool
+	trustedNets   []*net.IPNet
+	pathRegex     *regexp.Regexp
+	listener      net.Listener
+	stopChan      chan bool
+	ir            InputRunner
+	server        *http.Server
+	starterFunc   func(hli *HttpListenInput) error
+	hekaPid       int32
+	hostname      string
 }
 
 // HTTP Listen Input config struct
@@ -52,6 +63,33 @@ type HttpListenInputConfig struct {
 	Username       string   `toml:"username"`
 	Password       string   `toml:"password"`
 	Key            string   `toml:"api_key"`
+	// Tokens accepted when AuthType is "Bearer".
+	BearerTokens []string `toml:"bearer_tokens"`
+	// File holding additional bearer tokens, one per line.
+	BearerTokenFile string `toml:"bearer_token_file"`
+	// Shared secret used to verify request signatures when AuthType is
+	// "HMAC".
+	HmacKey string `toml:"hmac_key"`
+	// Hash function used for request signatures, "md5", "sha1", or "sha256".
+	HmacHash string `toml:"hmac_hash"`
+	// Request header holding the signature.
+	HmacHeader string `toml:"hmac_header"`
+	// Request header holding the signature timestamp.
+	HmacTimestampHeader string `toml:"hmac_timestamp_header"`
+	// Max seconds a signature timestamp may be off by, 0 if requests aren't
+	// timestamped.
+	HmacMaxSkew uint `toml:"hmac_max_skew"`
+	// Client certificate CNs accepted when AuthType is "ClientCert", any
+	// verified certificate is accepted if empty.
+	AllowedClientCNs []string `toml:"allowed_client_cns"`
+	// Query params added as fields, all of them are added if empty.
+	QueryParams []string `toml:"query_params"`
+	// Networks (in CIDR notation) of the proxies whose X-Forwarded-For
+	// headers are trusted when determining the client IP.
+	TrustedProxies []string `toml:"trusted_proxies"`
+	// Regular expression matched against the URL path, each named capture
+	// is added as a field.
+	PathMatch string `toml:"path_match"`
 	// Set to true if the TCP connection should be tunneled through TLS.
 	// Requires additional Tls config section.
 	UseTls bool `toml:"use_tls"`
@@ -61,16 +99,19 @@ type HttpListenInputConfig struct {
 
 func (hli *HttpListenInput) ConfigStruct() interface{} {
 	config := &HttpListenInputConfig{
-		Address:        "127.0.0.1:8325",
-		Headers:        make(http.Header),
-		RequestHeaders: []string{},
+		Address:             "127.0.0.1:8325",
+		Headers:             make(http.Header),
+		RequestHeaders:      []string{},
+		HmacHash:            "sha256",
+		HmacHeader:          "X-Signature",
+		HmacTimestampHeader: "X-Signature-Timestamp",
 	}
 	config.Tls = TlsConfig{PreferServerCiphers: true}
 	return config
 }
 
 func defaultStarter(hli *HttpListenInput) (err error) {
-	hli.listener, err = net.Listen("tcp", hli.conf.Address)
+	hli.listener, err = HandoverListen("tcp", hli.conf.Address)
 	if err != nil {
 		return fmt.Errorf("Listener [%s] start fail: %s",
 			hli.conf.Address, err.Error())
@@ -160,7 +201,26 @@ func (hli *HttpListenInput) makePackDecorator(req *http.Request) func(*PipelineP
 				pack.Message.AddField(field)
 			}
 		}
+		if len(hli.trustedNets) > 0 {
+			if field, err := hli.makeField("ClientIP", hli.clientIP(req, host)); err == nil {
+				pack.Message.AddField(field)
+			}
+		}
+		if hli.pathRegex != nil {
+			matches := hli.pathRegex.FindStringSubmatch(req.URL.Path)
+			for i, name := range hli.pathRegex.SubexpNames() {
+				if i == 0 || name == "" || matches == nil || matches[i] == "" {
+					continue
+				}
+				if field, err := hli.makeField(name, matches[i]); err == nil {
+					pack.Message.AddField(field)
+				}
+			}
+		}
 		for key, values := range req.URL.Query() {
+			if hli.queryParams != nil && !hli.queryParams[key] {
+				continue
+			}
 			for i := range values {
 				value := values[i]
 				if field, err := hli.makeField(key, value); err == nil {
@@ -172,43 +232,126 @@ func (hli *HttpListenInput) makePackDecorator(req *http.Request) func(*PipelineP
 	return packDecorator
 }
 
-func (hli *HttpListenInput) RequestHandler(w http.ResponseWriter, req *http.Request) {
-	var err error
-
-	if hli.conf.AuthType == "Basic" {
-		if hli.conf.Username != "" && hli.conf.Password != "" {
-			user, pass, ok := req.BasicAuth()
-			if !ok || user != hli.conf.Username || pass != hli.conf.Password {
-				err = fmt.Errorf("Basic Auth Failed")
-				hli.ir.LogError(err)
-			}
+// Checks the request against the configured authenticator, writing an error
+// response and returning false if it's rejected. The returned reader should
+// be used in place of the request body, which may have been consumed.
+func (hli *HttpListenInput) authenticate(w http.ResponseWriter,
+	req *http.Request) (body io.Reader, ok bool) {
+
+	if hli.auth == nil {
+		return req.Body, true
+	}
+	var data []byte
+	if hli.auth.needsBody() {
+		var err error
+		data, err = ioutil.ReadAll(io.LimitReader(req.Body, maxSignedBodySize+1))
+		if err != nil {
+			hli.ir.LogError(fmt.Errorf("receiving request body: %s", err.Error()))
+			http.Error(w, "error reading body", http.StatusBadRequest)
+			return nil, false
+		}
+		if len(data) > maxSignedBodySize {
+			atomic.AddInt64(&hli.rejectedCount, 1)
+			http.Error(w, "body too large", http.StatusRequestEntityTooLarge)
+			return nil, false
 		}
 	}
-	if hli.conf.AuthType == "API" {
-		if hli.conf.Key != "" {
-			api_key := req.Header.Get("X-API-Key")
-			if api_key != hli.conf.Key {
-				err = fmt.Errorf("API Auth Failed")
-				hli.ir.LogError(err)
-			}
+	if err := hli.auth.authenticate(req, data); err != nil {
+		atomic.AddInt64(&hli.rejectedCount, 1)
+		hli.ir.LogError(fmt.Errorf("rejected request from %s: %s", req.RemoteAddr,
+			err))
+		if challenge := hli.auth.challenge(); challenge != "" {
+			w.Header().Set("WWW-Authenticate", challenge)
 		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return nil, false
 	}
-	if err == nil {
-		sRunner := hli.ir.NewSplitterRunner(req.RemoteAddr)
-		if !sRunner.UseMsgBytes() {
-			sRunner.SetPackDecorator(hli.makePackDecorator(req))
+	if data != nil {
+		return bytes.NewReader(data), true
+	}
+	return req.Body, true
+}
+
+func (hli *HttpListenInput) isTrusted(ip net.IP) bool {
+	for _, ipNet := range hli.trustedNets {
+		if ipNet.Contains(ip) {
+			return true
 		}
-		err = sRunner.SplitStreamNullSplitterToEOF(req.Body, nil)
-		if err != nil && err != io.EOF {
-			hli.ir.LogError(fmt.Errorf("receiving request body: %s", err.Error()))
+	}
+	return false
+}
+
+// Returns the IP of the client that made the request. If the request came
+// from a trusted proxy the X-Forwarded-For header is walked from the right,
+// skipping any other trusted proxies, so clients can't spoof their IP by
+// sending a header of their own.
+func (hli *HttpListenInput) clientIP(req *http.Request, remoteAddr string) string {
+	ip := net.ParseIP(remoteAddr)
+	if ip == nil || !hli.isTrusted(ip) {
+		return remoteAddr
+	}
+	var hops []string
+	for _, value := range req.Header[http.CanonicalHeaderKey("X-Forwarded-For")] {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+	client := remoteAddr
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		hopIP := net.ParseIP(hop)
+		if hopIP == nil {
+			break
 		}
-		req.Body.Close()
-		sRunner.Done()
+		client = hop
+		if !hli.isTrusted(hopIP) {
+			break
+		}
+	}
+	return client
+}
+
+func (hli *HttpListenInput) RequestHandler(w http.ResponseWriter, req *http.Request) {
+	atomic.AddInt64(&hli.requestCount, 1)
+	defer req.Body.Close()
+	body, ok := hli.authenticate(w, req)
+	if !ok {
+		return
+	}
+
+	sRunner := hli.ir.NewSplitterRunner(req.RemoteAddr)
+	if !sRunner.UseMsgBytes() {
+		sRunner.SetPackDecorator(hli.makePackDecorator(req))
+	}
+	err := sRunner.SplitStreamNullSplitterToEOF(body, nil)
+	if err != nil && err != io.EOF {
+		hli.ir.LogError(fmt.Errorf("receiving request body: %s", err.Error()))
 	}
+	sRunner.Done()
 }
 
 func (hli *HttpListenInput) Init(config interface{}) (err error) {
 	hli.conf = config.(*HttpListenInputConfig)
+	if hli.auth, err = newAuthenticator(hli.conf); err != nil {
+		return err
+	}
+	if len(hli.conf.QueryParams) > 0 {
+		hli.queryParams = make(map[string]bool)
+		for _, param := range hli.conf.QueryParams {
+			hli.queryParams[param] = true
+		}
+	}
+	hli.trustedNets = nil
+	for _, cidr := range hli.conf.TrustedProxies {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid trusted_proxies entry: %s", err)
+		}
+		hli.trustedNets = append(hli.trustedNets, ipNet)
+	}
+	if hli.conf.PathMatch != "" {
+		if hli.pathRegex, err = regexp.Compile(hli.conf.PathMatch); err != nil {
+			return fmt.Errorf("invalid path_match: %s", err)
+		}
+	}
 	if hli.starterFunc == nil {
 		hli.starterFunc = defaultStarter
 	}
@@ -243,6 +386,16 @@ func (hli *HttpListenInput) Stop() {
 	close(hli.stopChan)
 }
 
+// Satisfies the `pipeline.ReportingPlugin` interface to provide plugin state
+// information to the Heka report and dashboard.
+func (hli *HttpListenInput) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "RequestCount", atomic.LoadInt64(&hli.requestCount),
+		"count")
+	message.NewInt64Field(msg, "RejectedCount", atomic.LoadInt64(&hli.rejectedCount),
+		"count")
+	return nil
+}
+
 func init() {
 	RegisterPlugin("HttpListenInput", func() interface{} {
 		return new(HttpListenInput)
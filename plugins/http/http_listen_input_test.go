@@ -238,6 +238,49 @@ func HttpListenInputSpec(c gs.Context) {
 			c.Expect(ip != nil, gs.IsTrue)
 		})
 
+		c.Specify("Captures the client IP, path segments, and selected query params",
+			func() {
+				config.TrustedProxies = []string{"127.0.0.0/8", "10.0.0.0/8"}
+				config.PathMatch = `^/apps/(?P<App>[^/]+)/(?P<Env>[^/]+)`
+				config.QueryParams = []string{"user"}
+				err := httpListenInput.Init(config)
+				c.Assume(err, gs.IsNil)
+				ts.Config = httpListenInput.server
+
+				splitCall.Return(io.EOF)
+				startInput()
+				<-startedChan
+
+				client := &http.Client{}
+				req, err := http.NewRequest("GET", ts.URL+"/apps/web/prod?user=bob&skip=1",
+					nil)
+				c.Assume(err, gs.IsNil)
+				// The leftmost entry was sent by the client and can't be trusted.
+				req.Header.Add("X-Forwarded-For", "1.1.1.1, 2.2.2.2")
+				req.Header.Add("X-Forwarded-For", "10.1.2.3")
+				resp, err := client.Do(req)
+				c.Assume(err, gs.IsNil)
+				resp.Body.Close()
+				c.Assume(resp.StatusCode, gs.Equals, 200)
+
+				packDec := <-decChan
+				packDec(ith.Pack)
+				fieldValue, ok := ith.Pack.Message.GetFieldValue("ClientIP")
+				c.Assume(ok, gs.IsTrue)
+				c.Expect(fieldValue, gs.Equals, "2.2.2.2")
+				fieldValue, ok = ith.Pack.Message.GetFieldValue("App")
+				c.Assume(ok, gs.IsTrue)
+				c.Expect(fieldValue, gs.Equals, "web")
+				fieldValue, ok = ith.Pack.Message.GetFieldValue("Env")
+				c.Assume(ok, gs.IsTrue)
+				c.Expect(fieldValue, gs.Equals, "prod")
+				fieldValue, ok = ith.Pack.Message.GetFieldValue("user")
+				c.Assume(ok, gs.IsTrue)
+				c.Expect(fieldValue, gs.Equals, "bob")
+				_, ok = ith.Pack.Message.GetFieldValue("skip")
+				c.Expect(ok, gs.IsFalse)
+			})
+
 		c.Specify("Test API Authentication", func() {
 			config.AuthType = "API"
 			config.Key = "123"
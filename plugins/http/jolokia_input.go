@@ -0,0 +1,242 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"github.com/pborman/uuid"
+)
+
+// The MBean attributes making up one of a JolokiaInput's metrics.
+type JolokiaMetric struct {
+	// MBean name, which may be a pattern such as
+	// "java.lang:type=GarbageCollector,name=*".
+	Mbean string
+	// Attributes to read. Defaults to all of the MBean's attributes.
+	Attributes []string
+	// Path within the attributes' values, e.g. "used" for the used memory
+	// of HeapMemoryUsage.
+	Path string
+}
+
+type JolokiaInputConfig struct {
+	// Jolokia agent URLs to poll, e.g. "http://localhost:8778/jolokia/".
+	Urls []string
+	// Username and password for Basic Authentication.
+	Username string
+	Password string
+	// Seconds between polls. Defaults to 10.
+	TickerInterval uint `toml:"ticker_interval"`
+	// Milliseconds a poll may take before it fails. Defaults to 5000.
+	Timeout uint
+	// Metrics to read, by name.
+	Metrics map[string]*JolokiaMetric
+}
+
+// A read request of Jolokia's protocol, see
+// https://jolokia.org/reference/html/protocol.html.
+type jolokiaRequest struct {
+	Type      string   `json:"type"`
+	Mbean     string   `json:"mbean"`
+	Attribute []string `json:"attribute,omitempty"`
+	Path      string   `json:"path,omitempty"`
+}
+
+type jolokiaResponse struct {
+	Status int
+	Error  string
+	Value  interface{}
+}
+
+// Input plugin that polls Jolokia agents for JVM MBean attributes, emitting
+// a message w/ a numeric field for each of the values read.
+type JolokiaInput struct {
+	conf     *JolokiaInputConfig
+	names    []string // Sorted metric names, in the order they're requested.
+	body     []byte
+	client   *http.Client
+	stopChan chan struct{}
+	ir       InputRunner
+	hostname string
+}
+
+func (ji *JolokiaInput) ConfigStruct() interface{} {
+	return &JolokiaInputConfig{
+		TickerInterval: 10,
+		Timeout:        5000,
+	}
+}
+
+func (ji *JolokiaInput) Init(config interface{}) (err error) {
+	ji.conf = config.(*JolokiaInputConfig)
+	if len(ji.conf.Urls) == 0 {
+		return errors.New("no `urls` configured")
+	}
+	if len(ji.conf.Metrics) == 0 {
+		return errors.New("no `metrics` configured")
+	}
+	ji.names = ji.names[:0]
+	for name, metric := range ji.conf.Metrics {
+		if metric.Mbean == "" {
+			return fmt.Errorf("metric '%s' has no `mbean`", name)
+		}
+		ji.names = append(ji.names, name)
+	}
+	sort.Strings(ji.names)
+
+	// The same bulk request is sent on every poll.
+	requests := make([]jolokiaRequest, len(ji.names))
+	for i, name := range ji.names {
+		metric := ji.conf.Metrics[name]
+		requests[i] = jolokiaRequest{
+			Type:      "read",
+			Mbean:     metric.Mbean,
+			Attribute: metric.Attributes,
+			Path:      metric.Path,
+		}
+	}
+	if ji.body, err = json.Marshal(requests); err != nil {
+		return err
+	}
+	ji.client = &http.Client{
+		Timeout: time.Duration(ji.conf.Timeout) * time.Millisecond,
+	}
+	ji.stopChan = make(chan struct{})
+	return nil
+}
+
+func (ji *JolokiaInput) Run(ir InputRunner, h PluginHelper) error {
+	ji.ir = ir
+	ji.hostname = h.Hostname()
+	ticker := ir.Ticker()
+	for {
+		select {
+		case <-ticker:
+			for _, url := range ji.conf.Urls {
+				ji.poll(url)
+			}
+		case <-ji.stopChan:
+			return nil
+		}
+	}
+}
+
+func (ji *JolokiaInput) poll(url string) {
+	now := time.Now()
+	responses, err := ji.read(url)
+	if err != nil {
+		ji.ir.LogError(fmt.Errorf("can't poll %s: %s", url, err))
+		return
+	}
+
+	pack := <-ji.ir.InChan()
+	msg := pack.Message
+	msg.SetUuid(uuid.NewRandom())
+	msg.SetTimestamp(now.UnixNano())
+	msg.SetType("heka.jolokia")
+	msg.SetLogger(url)
+	msg.SetHostname(ji.hostname)
+	for i, resp := range responses {
+		name := ji.names[i]
+		if resp.Status != 200 {
+			// The other metrics are still reported, e.g. if one MBean isn't
+			// registered in this JVM.
+			ji.ir.LogError(fmt.Errorf("can't read metric '%s' from %s: %s",
+				name, url, resp.Error))
+			continue
+		}
+		addJolokiaFields(msg, name, resp.Value)
+	}
+	ji.ir.Deliver(pack)
+}
+
+func (ji *JolokiaInput) read(url string) ([]jolokiaResponse, error) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(ji.body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Heka")
+	if ji.conf.Username != "" {
+		req.SetBasicAuth(ji.conf.Username, ji.conf.Password)
+	}
+	resp, err := ji.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("response status: %s", resp.Status)
+	}
+
+	var responses []jolokiaResponse
+	decoder := json.NewDecoder(resp.Body)
+	// Keeps integers from being turned into floats.
+	decoder.UseNumber()
+	if err = decoder.Decode(&responses); err != nil {
+		return nil, fmt.Errorf("invalid response: %s", err)
+	}
+	if len(responses) != len(ji.names) {
+		return nil, fmt.Errorf("got %d responses to %d requests", len(responses),
+			len(ji.names))
+	}
+	return responses, nil
+}
+
+// Adds a field for each numeric value, named for its metric and the keys
+// leading to it joined by dots, e.g. "heap.HeapMemoryUsage.used". Other
+// values are skipped.
+func addJolokiaFields(msg *message.Message, name string, value interface{}) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			addJolokiaFields(msg, name+"."+key, v[key])
+		}
+	case json.Number:
+		var field *message.Field
+		if i, err := v.Int64(); err == nil {
+			field, _ = message.NewField(name, i, "")
+		} else if f, err := v.Float64(); err == nil {
+			field, _ = message.NewField(name, f, "")
+		} else {
+			return
+		}
+		msg.AddField(field)
+	}
+}
+
+func (ji *JolokiaInput) Stop() {
+	close(ji.stopChan)
+}
+
+func init() {
+	RegisterPlugin("JolokiaInput", func() interface{} {
+		return new(JolokiaInput)
+	})
+}
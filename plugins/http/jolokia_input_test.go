@@ -0,0 +1,140 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package http
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	"github.com/mozilla-services/heka/pipelinemock"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+const jolokiaResponseBody = `[
+  {"request": {"type": "read", "mbean": "java.lang:type=GarbageCollector,name=*"},
+   "status": 200,
+   "value": {
+     "java.lang:name=PS Scavenge,type=GarbageCollector": {
+       "CollectionCount": 12, "CollectionTime": 345, "Name": "PS Scavenge"}}},
+  {"request": {"type": "read", "mbean": "java.lang:type=Memory"},
+   "status": 200,
+   "value": {"HeapMemoryUsage": {"used": 1048576, "max": 4194304},
+             "ObjectPendingFinalizationCount": 0}},
+  {"request": {"type": "read", "mbean": "java.lang:type=Missing"},
+   "status": 404,
+   "error": "javax.management.InstanceNotFoundException"},
+  {"request": {"type": "read", "mbean": "java.lang:type=OperatingSystem"},
+   "status": 200,
+   "value": {"SystemLoadAverage": 0.75, "Arch": "amd64"}}
+]`
+
+func JolokiaInputSpec(c gs.Context) {
+	t := &pipeline_ts.SimpleT{}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	pConfig := NewPipelineConfig(nil)
+
+	var requests []jolokiaRequest
+	var username, password string
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			json.Unmarshal(body, &requests)
+			username, password, _ = r.BasicAuth()
+			w.Write([]byte(jolokiaResponseBody))
+		}))
+	defer server.Close()
+
+	c.Specify("A JolokiaInput", func() {
+		input := new(JolokiaInput)
+		config := input.ConfigStruct().(*JolokiaInputConfig)
+		config.Urls = []string{server.URL + "/jolokia/"}
+		config.Metrics = map[string]*JolokiaMetric{
+			"memory": &JolokiaMetric{
+				Mbean:      "java.lang:type=Memory",
+				Attributes: []string{"HeapMemoryUsage", "ObjectPendingFinalizationCount"},
+			},
+			"gc":      &JolokiaMetric{Mbean: "java.lang:type=GarbageCollector,name=*"},
+			"missing": &JolokiaMetric{Mbean: "java.lang:type=Missing"},
+			"os":      &JolokiaMetric{Mbean: "java.lang:type=OperatingSystem"},
+		}
+
+		c.Specify("requires metrics", func() {
+			config.Metrics = nil
+			err := input.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("polls the configured MBeans", func() {
+			config.Username = "user"
+			config.Password = "password"
+			err := input.Init(config)
+			c.Assume(err, gs.IsNil)
+
+			mockRunner := pipelinemock.NewMockInputRunner(ctrl)
+			mockHelper := pipelinemock.NewMockPluginHelper(ctrl)
+			tickChan := make(chan time.Time)
+			mockRunner.EXPECT().Ticker().Return(tickChan)
+			mockHelper.EXPECT().Hostname().Return("hekatests.example.com")
+			packSupply := make(chan *PipelinePack, 1)
+			packSupply <- NewPipelinePack(pConfig.InputRecycleChan())
+			mockRunner.EXPECT().InChan().Return(packSupply)
+			mockRunner.EXPECT().LogError(gomock.Any())
+			delivered := make(chan *PipelinePack, 1)
+			mockRunner.EXPECT().Deliver(gomock.Any()).Do(func(pack *PipelinePack) {
+				delivered <- pack
+			})
+
+			done := make(chan error)
+			go func() {
+				done <- input.Run(mockRunner, mockHelper)
+			}()
+			tickChan <- time.Now()
+			pack := <-delivered
+			input.Stop()
+			c.Expect(<-done, gs.IsNil)
+
+			c.Expect(username, gs.Equals, "user")
+			c.Expect(password, gs.Equals, "password")
+			c.Assume(len(requests), gs.Equals, 4)
+			c.Expect(requests[2].Mbean, gs.Equals, "java.lang:type=Memory")
+			c.Expect(requests[2].Attribute, gs.Equals,
+				[]string{"HeapMemoryUsage", "ObjectPendingFinalizationCount"})
+
+			msg := pack.Message
+			c.Expect(msg.GetType(), gs.Equals, "heka.jolokia")
+			c.Expect(msg.GetLogger(), gs.Equals, server.URL+"/jolokia/")
+			value, _ := msg.GetFieldValue("memory.HeapMemoryUsage.used")
+			c.Expect(value, gs.Equals, int64(1048576))
+			value, _ = msg.GetFieldValue("memory.ObjectPendingFinalizationCount")
+			c.Expect(value, gs.Equals, int64(0))
+			value, _ = msg.GetFieldValue(
+				"gc.java.lang:name=PS Scavenge,type=GarbageCollector.CollectionCount")
+			c.Expect(value, gs.Equals, int64(12))
+			value, _ = msg.GetFieldValue("os.SystemLoadAverage")
+			c.Expect(value, gs.Equals, 0.75)
+			// Non-numeric values are skipped.
+			_, ok := msg.GetFieldValue("os.Arch")
+			c.Expect(ok, gs.IsFalse)
+		})
+	})
+}
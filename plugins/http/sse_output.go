@@ -0,0 +1,326 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package http
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	. "github.com/mozilla-services/heka/plugins/tcp"
+)
+
+// Output plugin that streams encoded messages to connected browsers as
+// Server-Sent Events. As w/ the WebSocketOutput, clients can subscribe to a
+// subset of the messages by passing a message matcher in the `matcher` query
+// parameter.
+type SseOutput struct {
+	processMessageCount   int64
+	dropMessageCount      int64
+	slowClientDropCount   int64
+	slowClientDisconnects int64
+	eventId               uint64
+	conf                  *SseOutputConfig
+	keepAlive             time.Duration
+	listener              net.Listener
+	server                *http.Server
+	stopChan              chan struct{}
+	clientsLock           sync.RWMutex
+	clients               map[*sseClient]struct{}
+	clientsWg             sync.WaitGroup
+}
+
+type SseOutputConfig struct {
+	// TCP address to listen on for connections. Defaults to "127.0.0.1:8329".
+	Address string
+	// URL path on which events are served. Defaults to "/".
+	Path string
+	// Event name sent w/ every event, browsers default to "message" if empty.
+	Event string
+	// Headers added to every response, e.g. for CORS.
+	Headers http.Header
+	// Number of events queued for each client before the slow client policy
+	// kicks in.
+	QueueSize int `toml:"queue_size"`
+	// What to do when a client's queue is full, either "drop" to skip the
+	// event for that client or "disconnect" to close its connection.
+	SlowClientPolicy string `toml:"slow_client_policy"`
+	// Max number of connected clients, 0 for no limit.
+	MaxClients int `toml:"max_clients"`
+	// Seconds between keepalive comments sent to idle clients, 0 to disable.
+	KeepAliveInterval uint `toml:"keep_alive_interval"`
+	// Set to true if the TCP connection should be tunneled through TLS.
+	// Requires additional Tls config section.
+	UseTls bool `toml:"use_tls"`
+	// Subsection for TLS configuration.
+	Tls TlsConfig
+}
+
+// A connected client and the events it's subscribed to.
+type sseClient struct {
+	matcher    *message.MatcherSpecification
+	events     chan []byte
+	kicked     chan struct{}
+	kickedOnce sync.Once
+}
+
+func (so *SseOutput) ConfigStruct() interface{} {
+	config := &SseOutputConfig{
+		Address:           "127.0.0.1:8329",
+		Path:              "/",
+		Headers:           make(http.Header),
+		QueueSize:         100,
+		SlowClientPolicy:  "drop",
+		KeepAliveInterval: 15,
+	}
+	config.Tls = TlsConfig{PreferServerCiphers: true}
+	return config
+}
+
+func (so *SseOutput) Init(config interface{}) (err error) {
+	so.conf = config.(*SseOutputConfig)
+	if so.conf.QueueSize < 1 {
+		return errors.New("queue_size must be greater than 0")
+	}
+	switch so.conf.SlowClientPolicy {
+	case "drop", "disconnect":
+	default:
+		return fmt.Errorf("unknown slow_client_policy: %s", so.conf.SlowClientPolicy)
+	}
+	if bytes.ContainsAny([]byte(so.conf.Event), "\r\n") {
+		return errors.New("event can't contain line breaks")
+	}
+	so.keepAlive = time.Duration(so.conf.KeepAliveInterval) * time.Second
+
+	so.listener, err = net.Listen("tcp", so.conf.Address)
+	if err != nil {
+		return fmt.Errorf("Listener [%s] start fail: %s", so.conf.Address, err)
+	}
+	if so.conf.UseTls {
+		if so.conf.Tls.CertFile == "" || so.conf.Tls.KeyFile == "" {
+			so.listener.Close()
+			return errors.New("TLS config requires both cert_file and key_file value.")
+		}
+		var goConf *tls.Config
+		if goConf, err = CreateGoTlsConfig(&so.conf.Tls); err != nil {
+			so.listener.Close()
+			return fmt.Errorf("TLS init error: %s", err)
+		}
+		so.listener = tls.NewListener(so.listener, goConf)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(so.conf.Path, CustomHeadersHandler(http.HandlerFunc(so.handleClient),
+		so.conf.Headers))
+	so.server = &http.Server{Handler: mux}
+	so.clients = make(map[*sseClient]struct{})
+	so.stopChan = make(chan struct{})
+	return nil
+}
+
+func (so *SseOutput) clientCount() int {
+	so.clientsLock.RLock()
+	defer so.clientsLock.RUnlock()
+	return len(so.clients)
+}
+
+func (so *SseOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	if or.Encoder() == nil {
+		return errors.New("Encoder must be specified.")
+	}
+	go so.server.Serve(so.listener)
+
+	var (
+		e        error
+		outBytes []byte
+	)
+	for pack := range or.InChan() {
+		if outBytes, e = or.Encode(pack); e != nil {
+			atomic.AddInt64(&so.dropMessageCount, 1)
+			or.UpdateCursor(pack.QueueCursor)
+			pack.Recycle(fmt.Errorf("can't encode: %s", e))
+			continue
+		}
+		if outBytes != nil {
+			so.broadcast(pack.Message, outBytes)
+		}
+		atomic.AddInt64(&so.processMessageCount, 1)
+		or.UpdateCursor(pack.QueueCursor)
+		pack.Recycle(nil)
+	}
+
+	close(so.stopChan)
+	so.listener.Close()
+	so.clientsWg.Wait()
+	return nil
+}
+
+// Formats the encoded message as an event. Every line of the message becomes
+// a data line, as event data can't contain line breaks.
+func (so *SseOutput) formatEvent(outBytes []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("id: ")
+	buf.WriteString(strconv.FormatUint(atomic.AddUint64(&so.eventId, 1), 10))
+	buf.WriteByte('\n')
+	if so.conf.Event != "" {
+		buf.WriteString("event: ")
+		buf.WriteString(so.conf.Event)
+		buf.WriteByte('\n')
+	}
+	outBytes = bytes.TrimRight(outBytes, "\r\n")
+	for _, line := range bytes.Split(outBytes, []byte{'\n'}) {
+		buf.WriteString("data: ")
+		buf.Write(bytes.TrimRight(line, "\r"))
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// Queues the event for every client subscribed to it, applying the slow client
+// policy to any client whose queue is full.
+func (so *SseOutput) broadcast(msg *message.Message, outBytes []byte) {
+	var event []byte
+	so.clientsLock.RLock()
+	defer so.clientsLock.RUnlock()
+	for client := range so.clients {
+		if client.matcher != nil && !client.matcher.Match(msg) {
+			continue
+		}
+		if event == nil {
+			event = so.formatEvent(outBytes)
+		}
+		select {
+		case client.events <- event:
+		default:
+			if so.conf.SlowClientPolicy == "disconnect" {
+				client.kickedOnce.Do(func() {
+					atomic.AddInt64(&so.slowClientDisconnects, 1)
+					close(client.kicked)
+				})
+			} else {
+				atomic.AddInt64(&so.slowClientDropCount, 1)
+			}
+		}
+	}
+}
+
+func (so *SseOutput) handleClient(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	matcher, err := subscriptionMatcher(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	client := &sseClient{
+		matcher: matcher,
+		events:  make(chan []byte, so.conf.QueueSize),
+		kicked:  make(chan struct{}),
+	}
+
+	so.clientsLock.Lock()
+	select {
+	case <-so.stopChan:
+		so.clientsLock.Unlock()
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	default:
+	}
+	if so.conf.MaxClients > 0 && len(so.clients) >= so.conf.MaxClients {
+		so.clientsLock.Unlock()
+		http.Error(w, "too many clients", http.StatusServiceUnavailable)
+		return
+	}
+	so.clients[client] = struct{}{}
+	so.clientsWg.Add(1)
+	so.clientsLock.Unlock()
+	defer func() {
+		so.clientsLock.Lock()
+		delete(so.clients, client)
+		so.clientsLock.Unlock()
+		so.clientsWg.Done()
+	}()
+
+	header := w.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	var keepAlive <-chan time.Time
+	if so.keepAlive > 0 {
+		ticker := time.NewTicker(so.keepAlive)
+		defer ticker.Stop()
+		keepAlive = ticker.C
+	}
+	var gone <-chan bool
+	if notifier, ok := w.(http.CloseNotifier); ok {
+		gone = notifier.CloseNotify()
+	}
+
+	for {
+		select {
+		case event := <-client.events:
+			_, err = w.Write(event)
+		case <-keepAlive:
+			_, err = w.Write([]byte(": keepalive\n\n"))
+		case <-client.kicked:
+			return
+		case <-gone:
+			return
+		case <-so.stopChan:
+			return
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// Satisfies the `pipeline.ReportingPlugin` interface to provide plugin state
+// information to the Heka report and dashboard.
+func (so *SseOutput) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "ProcessMessageCount",
+		atomic.LoadInt64(&so.processMessageCount), "count")
+	message.NewInt64Field(msg, "DropMessageCount",
+		atomic.LoadInt64(&so.dropMessageCount), "count")
+	message.NewInt64Field(msg, "SlowClientDropCount",
+		atomic.LoadInt64(&so.slowClientDropCount), "count")
+	message.NewInt64Field(msg, "SlowClientDisconnects",
+		atomic.LoadInt64(&so.slowClientDisconnects), "count")
+	message.NewIntField(msg, "ClientCount", so.clientCount(), "count")
+	return nil
+}
+
+func init() {
+	RegisterPlugin("SseOutput", func() interface{} {
+		return new(SseOutput)
+	})
+}
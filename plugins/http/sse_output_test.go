@@ -0,0 +1,131 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package http
+
+import (
+	"bufio"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	"github.com/mozilla-services/heka/plugins"
+	ts "github.com/mozilla-services/heka/plugins/testsupport"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func SseOutputSpec(c gs.Context) {
+	t := new(pipeline_ts.SimpleT)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	pConfig := pipeline.NewPipelineConfig(nil)
+	oth := ts.NewOutputTestHelper(ctrl)
+	encoder := new(plugins.PayloadEncoder)
+
+	c.Specify("An SseOutput", func() {
+		output := new(SseOutput)
+		config := output.ConfigStruct().(*SseOutputConfig)
+		config.Address = "127.0.0.1:58329"
+		config.Event = "heka"
+
+		c.Specify("rejects an unknown slow client policy", func() {
+			config.SlowClientPolicy = "ignore"
+			err := output.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("formats multi-line messages as multiple data lines", func() {
+			output.conf = config
+			event := output.formatEvent([]byte("line one\r\nline two\n"))
+			c.Expect(string(event), gs.Equals,
+				"id: 1\nevent: heka\ndata: line one\ndata: line two\n\n")
+		})
+
+		c.Specify("disconnects slow clients if configured to", func() {
+			config.SlowClientPolicy = "disconnect"
+			config.QueueSize = 1
+			output.conf = config
+			output.clients = make(map[*sseClient]struct{})
+			client := &sseClient{
+				events: make(chan []byte, config.QueueSize),
+				kicked: make(chan struct{}),
+			}
+			output.clients[client] = struct{}{}
+			msg := pipeline_ts.GetTestMessage()
+
+			output.broadcast(msg, []byte("one"))
+			output.broadcast(msg, []byte("two"))
+			output.broadcast(msg, []byte("three"))
+			c.Expect(len(client.events), gs.Equals, 1)
+			c.Expect(output.slowClientDisconnects, gs.Equals, int64(1))
+			select {
+			case <-client.kicked:
+			default:
+				c.Expect("client wasn't kicked", gs.IsNil)
+			}
+		})
+
+		c.Specify("streams subscribed messages to a client", func() {
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+
+			inChan := make(chan *pipeline.PipelinePack, 1)
+			oth.MockOutputRunner.EXPECT().Encoder().Return(encoder)
+			oth.MockOutputRunner.EXPECT().InChan().Return(inChan)
+			oth.MockOutputRunner.EXPECT().UpdateCursor(gomock.Any()).AnyTimes()
+			errChan := make(chan error, 1)
+			go func() {
+				errChan <- output.Run(oth.MockOutputRunner, oth.MockHelper)
+			}()
+
+			query := url.Values{"matcher": {"Type == 'wanted'"}}
+			resp, err := http.Get("http://" + config.Address + "/?" + query.Encode())
+			c.Assume(err, gs.IsNil)
+			defer resp.Body.Close()
+			c.Expect(resp.StatusCode, gs.Equals, 200)
+			c.Expect(resp.Header.Get("Content-Type"), gs.Equals, "text/event-stream")
+			for i := 0; i < 500 && output.clientCount() < 1; i++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+			c.Assume(output.clientCount(), gs.Equals, 1)
+
+			for _, msgType := range []string{"unwanted", "wanted"} {
+				pack := pipeline.NewPipelinePack(pConfig.InputRecycleChan())
+				pack.Message = pipeline_ts.GetTestMessage()
+				pack.Message.SetType(msgType)
+				oth.MockOutputRunner.EXPECT().Encode(pack).Return(
+					[]byte(msgType+" payload"), nil)
+				inChan <- pack
+			}
+
+			reader := bufio.NewReader(resp.Body)
+			lines := make([]string, 3)
+			for i := range lines {
+				lines[i], err = reader.ReadString('\n')
+				c.Assume(err, gs.IsNil)
+			}
+			// Unwanted messages don't use up an event id.
+			c.Expect(strings.Join(lines, ""), gs.Equals,
+				"id: 1\nevent: heka\ndata: wanted payload\n")
+
+			close(inChan)
+			c.Expect(<-errChan, gs.IsNil)
+		})
+	})
+}
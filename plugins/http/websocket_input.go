@@ -0,0 +1,390 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package http
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	. "github.com/mozilla-services/heka/plugins/tcp"
+	"github.com/pborman/uuid"
+	"golang.org/x/net/websocket"
+)
+
+// Input plugin that accepts WebSocket connections, turning every frame a
+// client sends into a message.
+type WebSocketInput struct {
+	conf      *WebSocketInputConfig
+	listener  net.Listener
+	server    *http.Server
+	ir        InputRunner
+	stopChan  chan struct{}
+	connsLock sync.Mutex
+	conns     map[*websocket.Conn]struct{}
+	connsWg   sync.WaitGroup
+	hekaPid   int32
+	hostname  string
+}
+
+type WebSocketInputConfig struct {
+	// TCP address to listen on for connections. Defaults to "127.0.0.1:8327".
+	Address string
+	// URL path on which connections are accepted. Defaults to "/".
+	Path string
+	// How each frame is interpreted, one of "json", "protobuf", or "payload".
+	Format string
+	// Origins allowed to connect, all origins are allowed if empty.
+	AllowedOrigins []string `toml:"allowed_origins"`
+	// Headers added to the handshake response.
+	Headers http.Header
+	// Set to true if the TCP connection should be tunneled through TLS.
+	// Requires additional Tls config section.
+	UseTls bool `toml:"use_tls"`
+	// Subsection for TLS configuration.
+	Tls TlsConfig
+}
+
+func (wi *WebSocketInput) ConfigStruct() interface{} {
+	config := &WebSocketInputConfig{
+		Address: "127.0.0.1:8327",
+		Path:    "/",
+		Format:  "json",
+		Headers: make(http.Header),
+	}
+	config.Tls = TlsConfig{PreferServerCiphers: true}
+	return config
+}
+
+func (wi *WebSocketInput) Init(config interface{}) (err error) {
+	wi.conf = config.(*WebSocketInputConfig)
+	switch wi.conf.Format {
+	case "json", "protobuf", "payload":
+	default:
+		return fmt.Errorf("unknown format: %s", wi.conf.Format)
+	}
+
+	wi.listener, err = net.Listen("tcp", wi.conf.Address)
+	if err != nil {
+		return fmt.Errorf("Listener [%s] start fail: %s", wi.conf.Address, err)
+	}
+	if wi.conf.UseTls {
+		if wi.conf.Tls.CertFile == "" || wi.conf.Tls.KeyFile == "" {
+			wi.listener.Close()
+			return errors.New("TLS config requires both cert_file and key_file value.")
+		}
+		var goConf *tls.Config
+		if goConf, err = CreateGoTlsConfig(&wi.conf.Tls); err != nil {
+			wi.listener.Close()
+			return fmt.Errorf("TLS init error: %s", err)
+		}
+		wi.listener = tls.NewListener(wi.listener, goConf)
+	}
+
+	wsServer := websocket.Server{
+		Handshake: checkOrigin(wi.conf.AllowedOrigins),
+		Handler:   wi.handleConn,
+	}
+	mux := http.NewServeMux()
+	mux.Handle(wi.conf.Path, CustomHeadersHandler(wsServer, wi.conf.Headers))
+	wi.server = &http.Server{Handler: mux}
+	wi.conns = make(map[*websocket.Conn]struct{})
+	wi.stopChan = make(chan struct{})
+	wi.hekaPid = int32(os.Getpid())
+	wi.hostname, _ = os.Hostname()
+	return nil
+}
+
+// Returns a handshake function that rejects connections from origins that
+// aren't in the allowed list, if there is one.
+func checkOrigin(allowed []string) func(*websocket.Config, *http.Request) error {
+	return func(config *websocket.Config, req *http.Request) (err error) {
+		if config.Origin, err = websocket.Origin(config, req); err != nil {
+			return err
+		}
+		if len(allowed) == 0 {
+			return nil
+		}
+		if config.Origin == nil {
+			return errors.New("missing origin")
+		}
+		origin := config.Origin.Scheme + "://" + config.Origin.Host
+		for _, o := range allowed {
+			if o == origin {
+				return nil
+			}
+		}
+		return fmt.Errorf("origin not allowed: %s", origin)
+	}
+}
+
+func (wi *WebSocketInput) Run(ir InputRunner, h PluginHelper) error {
+	wi.ir = ir
+	ir.LogMessage(fmt.Sprintf("Listening on %s", wi.conf.Address))
+	err := wi.server.Serve(wi.listener)
+	select {
+	case <-wi.stopChan:
+		err = nil
+	default:
+	}
+
+	// Serve doesn't wait for hijacked connections, so close them ourselves.
+	wi.connsLock.Lock()
+	for ws := range wi.conns {
+		ws.Close()
+	}
+	wi.connsLock.Unlock()
+	wi.connsWg.Wait()
+	return err
+}
+
+func (wi *WebSocketInput) Stop() {
+	close(wi.stopChan)
+	wi.listener.Close()
+}
+
+func (wi *WebSocketInput) handleConn(ws *websocket.Conn) {
+	wi.connsLock.Lock()
+	select {
+	case <-wi.stopChan:
+		wi.connsLock.Unlock()
+		ws.Close()
+		return
+	default:
+	}
+	wi.conns[ws] = struct{}{}
+	wi.connsWg.Add(1)
+	wi.connsLock.Unlock()
+	defer func() {
+		wi.connsLock.Lock()
+		delete(wi.conns, ws)
+		wi.connsLock.Unlock()
+		ws.Close()
+		wi.connsWg.Done()
+	}()
+
+	req := ws.Request()
+	sRunner := wi.ir.NewSplitterRunner(req.RemoteAddr)
+	defer sRunner.Done()
+
+	// ProtobufDecoder wants the frames as message bytes, everything else
+	// wants them in the payload.
+	if sRunner.UseMsgBytes() != (wi.conf.Format == "protobuf") {
+		wi.ir.LogError(errors.New(
+			"the protobuf format must be used, and only used, w/ a ProtobufDecoder"))
+		return
+	}
+	if !sRunner.UseMsgBytes() {
+		sRunner.SetPackDecorator(wi.makePackDecorator(req))
+	}
+
+	var frame []byte
+	for {
+		if err := websocket.Message.Receive(ws, &frame); err != nil {
+			select {
+			case <-wi.stopChan:
+			default:
+				if err != io.EOF {
+					wi.ir.LogError(fmt.Errorf("receiving from %s: %s",
+						req.RemoteAddr, err))
+				}
+			}
+			return
+		}
+		if len(frame) > int(message.MAX_RECORD_SIZE) {
+			wi.ir.LogError(fmt.Errorf("frame from %s exceeds the max record size",
+				req.RemoteAddr))
+			continue
+		}
+		sRunner.DeliverRecord(frame, nil)
+	}
+}
+
+func (wi *WebSocketInput) makePackDecorator(req *http.Request) func(*PipelinePack) {
+	remoteAddr, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		// Fall back to the un-split value.
+		remoteAddr = req.RemoteAddr
+	}
+	return func(pack *PipelinePack) {
+		pack.Message.SetType("heka.websocket")
+		pack.Message.SetPid(wi.hekaPid)
+		pack.Message.SetSeverity(int32(6))
+		pack.Message.SetHostname(wi.hostname)
+		pack.Message.SetEnvVersion("1")
+		if wi.conf.Format == "json" {
+			payload := pack.Message.GetPayload()
+			pack.Message.SetPayload("")
+			if err := messageFromJson([]byte(payload), pack.Message); err != nil {
+				wi.ir.LogError(fmt.Errorf("invalid JSON message from %s: %s",
+					req.RemoteAddr, err))
+				pack.Message.SetType("heka.websocket.error")
+				pack.Message.SetPayload(payload)
+			}
+		}
+		message.NewStringField(pack.Message, "RemoteAddr", remoteAddr)
+	}
+}
+
+// Populates a message from a JSON object using the same names as Heka's
+// message schema, e.g. `{"Type": "app.event", "Payload": "hello", "Fields":
+// {"status": 200, "tags": ["a", "b"]}}`. Timestamp may be given either as
+// nanoseconds since the epoch or as an RFC 3339 string.
+func messageFromJson(data []byte, msg *message.Message) error {
+	var obj map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&obj); err != nil {
+		return err
+	}
+	for key, val := range obj {
+		var err error
+		switch key {
+		case "Uuid":
+			s, _ := val.(string)
+			u := uuid.Parse(s)
+			if u == nil {
+				return fmt.Errorf("invalid Uuid: %v", val)
+			}
+			msg.SetUuid(u)
+		case "Timestamp":
+			switch v := val.(type) {
+			case json.Number:
+				var ts int64
+				if ts, err = v.Int64(); err == nil {
+					msg.SetTimestamp(ts)
+				}
+			case string:
+				var t time.Time
+				if t, err = time.Parse(time.RFC3339Nano, v); err == nil {
+					msg.SetTimestamp(t.UnixNano())
+				}
+			default:
+				err = errors.New("unsupported type")
+			}
+		case "Type", "Logger", "Payload", "EnvVersion", "Hostname":
+			s, ok := val.(string)
+			if !ok {
+				err = errors.New("must be a string")
+				break
+			}
+			switch key {
+			case "Type":
+				msg.SetType(s)
+			case "Logger":
+				msg.SetLogger(s)
+			case "Payload":
+				msg.SetPayload(s)
+			case "EnvVersion":
+				msg.SetEnvVersion(s)
+			case "Hostname":
+				msg.SetHostname(s)
+			}
+		case "Severity", "Pid":
+			var i int64
+			if n, ok := val.(json.Number); !ok {
+				err = errors.New("must be an integer")
+			} else if i, err = n.Int64(); err == nil {
+				if key == "Severity" {
+					msg.SetSeverity(int32(i))
+				} else {
+					msg.SetPid(int32(i))
+				}
+			}
+		case "Fields":
+			fields, ok := val.(map[string]interface{})
+			if !ok {
+				err = errors.New("must be an object")
+				break
+			}
+			for name, fieldVal := range fields {
+				var field *message.Field
+				if field, err = jsonField(name, fieldVal); err != nil {
+					return fmt.Errorf("field %s: %s", name, err)
+				}
+				msg.AddField(field)
+			}
+		default:
+			err = errors.New("unknown key")
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", key, err)
+		}
+	}
+	return nil
+}
+
+// Creates a message field from a decoded JSON value. Arrays become multi-value
+// fields, and must hold values of a single type.
+func jsonField(name string, val interface{}) (field *message.Field, err error) {
+	vals, isArray := val.([]interface{})
+	if !isArray {
+		vals = []interface{}{val}
+	}
+	if len(vals) == 0 {
+		return nil, errors.New("empty array")
+	}
+	// A number that isn't an integer makes every number in the field a
+	// double, so arrays like [1, 2.5] don't have mixed types.
+	useDouble := false
+	for _, v := range vals {
+		if n, ok := v.(json.Number); ok {
+			if _, err = n.Int64(); err != nil {
+				useDouble = true
+			}
+		}
+	}
+	for _, v := range vals {
+		switch n := v.(type) {
+		case json.Number:
+			if useDouble {
+				v, err = n.Float64()
+			} else {
+				v, err = n.Int64()
+			}
+			if err != nil {
+				return nil, err
+			}
+		case string, bool:
+		default:
+			return nil, fmt.Errorf("unsupported value: %v", v)
+		}
+		if field == nil {
+			field, err = message.NewField(name, v, "")
+		} else {
+			err = field.AddValue(v)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return field, nil
+}
+
+func init() {
+	RegisterPlugin("WebSocketInput", func() interface{} {
+		return new(WebSocketInput)
+	})
+}
@@ -0,0 +1,141 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package http
+
+import (
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	"github.com/mozilla-services/heka/pipelinemock"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"golang.org/x/net/websocket"
+)
+
+func WebSocketInputSpec(c gs.Context) {
+	t := &pipeline_ts.SimpleT{}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	pConfig := NewPipelineConfig(nil)
+	mockIR := pipelinemock.NewMockInputRunner(ctrl)
+	mockHelper := pipelinemock.NewMockPluginHelper(ctrl)
+	mockSR := pipelinemock.NewMockSplitterRunner(ctrl)
+
+	c.Specify("A WebSocketInput", func() {
+		input := new(WebSocketInput)
+		config := input.ConfigStruct().(*WebSocketInputConfig)
+		config.Address = "127.0.0.1:58327"
+
+		c.Specify("rejects an unknown format", func() {
+			config.Format = "xml"
+			err := input.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("turns JSON frames into messages", func() {
+			err := input.Init(config)
+			c.Assume(err, gs.IsNil)
+
+			mockIR.EXPECT().LogMessage(gomock.Any())
+			mockIR.EXPECT().NewSplitterRunner(gomock.Any()).Return(mockSR)
+			mockSR.EXPECT().UseMsgBytes().Return(false).Times(2)
+			decChan := make(chan func(*PipelinePack), 1)
+			mockSR.EXPECT().SetPackDecorator(gomock.Any()).Do(
+				func(decorator func(*PipelinePack)) {
+					decChan <- decorator
+				})
+			recordChan := make(chan []byte, 1)
+			mockSR.EXPECT().DeliverRecord(gomock.Any(), nil).Do(
+				func(record []byte, del Deliverer) {
+					recordChan <- record
+				})
+			doneChan := make(chan struct{})
+			mockSR.EXPECT().Done().Do(func() {
+				close(doneChan)
+			})
+
+			errChan := make(chan error, 1)
+			go func() {
+				errChan <- input.Run(mockIR, mockHelper)
+			}()
+
+			ws, err := websocket.Dial("ws://"+config.Address+"/", "", "http://localhost/")
+			c.Assume(err, gs.IsNil)
+			frame := `{"Type": "app.event", "Payload": "hello", "Severity": 3,
+				"Fields": {"status": 200, "tags": ["a", "b"]}}`
+			err = websocket.Message.Send(ws, frame)
+			c.Expect(err, gs.IsNil)
+
+			record := <-recordChan
+			c.Expect(string(record), gs.Equals, frame)
+
+			pack := NewPipelinePack(pConfig.InputRecycleChan())
+			pack.Message.SetPayload(string(record))
+			decorator := <-decChan
+			decorator(pack)
+			c.Expect(pack.Message.GetType(), gs.Equals, "app.event")
+			c.Expect(pack.Message.GetPayload(), gs.Equals, "hello")
+			c.Expect(pack.Message.GetSeverity(), gs.Equals, int32(3))
+			status, _ := pack.Message.GetFieldValue("status")
+			c.Expect(status, gs.Equals, int64(200))
+			tags := pack.Message.FindFirstField("tags")
+			c.Assume(tags, gs.Not(gs.IsNil))
+			c.Expect(len(tags.GetValueString()), gs.Equals, 2)
+			remoteAddr, _ := pack.Message.GetFieldValue("RemoteAddr")
+			c.Expect(remoteAddr, gs.Equals, "127.0.0.1")
+
+			ws.Close()
+			select {
+			case <-doneChan:
+			case <-time.After(5 * time.Second):
+				c.Assume("splitter runner wasn't released", gs.IsNil)
+			}
+			input.Stop()
+			c.Expect(<-errChan, gs.IsNil)
+		})
+	})
+
+	c.Specify("JSON messages", func() {
+		msg := new(message.Message)
+
+		c.Specify("accept timestamps as nanoseconds or RFC 3339", func() {
+			err := messageFromJson([]byte(`{"Timestamp": 1000000000}`), msg)
+			c.Expect(err, gs.IsNil)
+			c.Expect(msg.GetTimestamp(), gs.Equals, int64(1000000000))
+			err = messageFromJson([]byte(`{"Timestamp": "1970-01-01T00:00:02Z"}`), msg)
+			c.Expect(err, gs.IsNil)
+			c.Expect(msg.GetTimestamp(), gs.Equals, int64(2000000000))
+		})
+
+		c.Specify("use doubles for arrays w/ non-integer numbers", func() {
+			err := messageFromJson([]byte(`{"Fields": {"vals": [1, 2.5]}}`), msg)
+			c.Expect(err, gs.IsNil)
+			vals := msg.FindFirstField("vals")
+			c.Assume(vals, gs.Not(gs.IsNil))
+			c.Expect(vals.GetValueType(), gs.Equals, message.Field_DOUBLE)
+			c.Expect(len(vals.GetValueDouble()), gs.Equals, 2)
+		})
+
+		c.Specify("reject unknown keys and mixed arrays", func() {
+			err := messageFromJson([]byte(`{"Bogus": "value"}`), msg)
+			c.Expect(err, gs.Not(gs.IsNil))
+			err = messageFromJson([]byte(`{"Fields": {"vals": [1, "a"]}}`), msg)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+}
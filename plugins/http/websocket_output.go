@@ -0,0 +1,297 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package http
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	. "github.com/mozilla-services/heka/plugins/tcp"
+	"golang.org/x/net/websocket"
+)
+
+// Output plugin that pushes encoded messages to connected WebSocket clients.
+// Clients can subscribe to a subset of the messages the output receives by
+// passing a message matcher in the `matcher` query parameter.
+type WebSocketOutput struct {
+	processMessageCount int64
+	dropMessageCount    int64
+	slowClientDropCount int64
+	conf                *WebSocketOutputConfig
+	listener            net.Listener
+	server              *http.Server
+	or                  OutputRunner
+	binary              bool
+	stopChan            chan struct{}
+	clientsLock         sync.RWMutex
+	clients             map[*wsClient]struct{}
+	clientsWg           sync.WaitGroup
+}
+
+type WebSocketOutputConfig struct {
+	// TCP address to listen on for connections. Defaults to "127.0.0.1:8328".
+	Address string
+	// URL path on which connections are accepted. Defaults to "/".
+	Path string
+	// Origins allowed to connect, all origins are allowed if empty.
+	AllowedOrigins []string `toml:"allowed_origins"`
+	// Headers added to the handshake response.
+	Headers http.Header
+	// Number of frames queued for each client before messages are dropped.
+	QueueSize int `toml:"queue_size"`
+	// Max number of connected clients, 0 for no limit.
+	MaxClients int `toml:"max_clients"`
+	// Set to true if the TCP connection should be tunneled through TLS.
+	// Requires additional Tls config section.
+	UseTls bool `toml:"use_tls"`
+	// Subsection for TLS configuration.
+	Tls TlsConfig
+}
+
+// A connected client and the messages it's subscribed to.
+type wsClient struct {
+	ws      *websocket.Conn
+	matcher *message.MatcherSpecification
+	frames  chan []byte
+}
+
+func (wo *WebSocketOutput) ConfigStruct() interface{} {
+	config := &WebSocketOutputConfig{
+		Address:   "127.0.0.1:8328",
+		Path:      "/",
+		Headers:   make(http.Header),
+		QueueSize: 100,
+	}
+	config.Tls = TlsConfig{PreferServerCiphers: true}
+	return config
+}
+
+func (wo *WebSocketOutput) Init(config interface{}) (err error) {
+	wo.conf = config.(*WebSocketOutputConfig)
+	if wo.conf.QueueSize < 1 {
+		return errors.New("queue_size must be greater than 0")
+	}
+
+	wo.listener, err = net.Listen("tcp", wo.conf.Address)
+	if err != nil {
+		return fmt.Errorf("Listener [%s] start fail: %s", wo.conf.Address, err)
+	}
+	if wo.conf.UseTls {
+		if wo.conf.Tls.CertFile == "" || wo.conf.Tls.KeyFile == "" {
+			wo.listener.Close()
+			return errors.New("TLS config requires both cert_file and key_file value.")
+		}
+		var goConf *tls.Config
+		if goConf, err = CreateGoTlsConfig(&wo.conf.Tls); err != nil {
+			wo.listener.Close()
+			return fmt.Errorf("TLS init error: %s", err)
+		}
+		wo.listener = tls.NewListener(wo.listener, goConf)
+	}
+
+	originCheck := checkOrigin(wo.conf.AllowedOrigins)
+	wsServer := websocket.Server{
+		Handshake: func(config *websocket.Config, req *http.Request) error {
+			if err := originCheck(config, req); err != nil {
+				return err
+			}
+			// Reject bad subscriptions before the connection is upgraded.
+			if _, err := subscriptionMatcher(req); err != nil {
+				return err
+			}
+			if wo.conf.MaxClients > 0 && wo.clientCount() >= wo.conf.MaxClients {
+				return errors.New("too many clients")
+			}
+			return nil
+		},
+		Handler: wo.handleConn,
+	}
+	mux := http.NewServeMux()
+	mux.Handle(wo.conf.Path, CustomHeadersHandler(wsServer, wo.conf.Headers))
+	wo.server = &http.Server{Handler: mux}
+	wo.clients = make(map[*wsClient]struct{})
+	wo.stopChan = make(chan struct{})
+	return nil
+}
+
+// Returns the matcher from the request's `matcher` query parameter, or nil if
+// the client wants every message.
+func subscriptionMatcher(req *http.Request) (*message.MatcherSpecification, error) {
+	spec := req.URL.Query().Get("matcher")
+	if spec == "" {
+		return nil, nil
+	}
+	matcher, err := message.CreateMatcherSpecification(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid matcher: %s", err)
+	}
+	return matcher, nil
+}
+
+func (wo *WebSocketOutput) clientCount() int {
+	wo.clientsLock.RLock()
+	defer wo.clientsLock.RUnlock()
+	return len(wo.clients)
+}
+
+func (wo *WebSocketOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	if or.Encoder() == nil {
+		return errors.New("Encoder must be specified.")
+	}
+	// Protobuf encoded messages aren't valid text frames.
+	_, wo.binary = or.Encoder().(*ProtobufEncoder)
+	wo.or = or
+	go wo.server.Serve(wo.listener)
+
+	var (
+		e        error
+		outBytes []byte
+	)
+	for pack := range or.InChan() {
+		if outBytes, e = or.Encode(pack); e != nil {
+			atomic.AddInt64(&wo.dropMessageCount, 1)
+			or.UpdateCursor(pack.QueueCursor)
+			pack.Recycle(fmt.Errorf("can't encode: %s", e))
+			continue
+		}
+		if outBytes != nil {
+			wo.broadcast(pack.Message, outBytes)
+		}
+		atomic.AddInt64(&wo.processMessageCount, 1)
+		or.UpdateCursor(pack.QueueCursor)
+		pack.Recycle(nil)
+	}
+
+	close(wo.stopChan)
+	wo.listener.Close()
+	wo.clientsLock.RLock()
+	for client := range wo.clients {
+		client.ws.Close()
+	}
+	wo.clientsLock.RUnlock()
+	wo.clientsWg.Wait()
+	return nil
+}
+
+// Queues the encoded message for every client subscribed to it. Clients that
+// can't keep up miss messages rather than holding up the output.
+func (wo *WebSocketOutput) broadcast(msg *message.Message, outBytes []byte) {
+	var frame []byte
+	wo.clientsLock.RLock()
+	defer wo.clientsLock.RUnlock()
+	for client := range wo.clients {
+		if client.matcher != nil && !client.matcher.Match(msg) {
+			continue
+		}
+		if frame == nil {
+			// The encoder reuses its buffer, but the clients only read the
+			// frame so they can share a single copy.
+			frame = make([]byte, len(outBytes))
+			copy(frame, outBytes)
+		}
+		select {
+		case client.frames <- frame:
+		default:
+			atomic.AddInt64(&wo.slowClientDropCount, 1)
+		}
+	}
+}
+
+func (wo *WebSocketOutput) handleConn(ws *websocket.Conn) {
+	defer ws.Close()
+	matcher, err := subscriptionMatcher(ws.Request())
+	if err != nil {
+		// Already vetted by the handshake, shouldn't happen.
+		return
+	}
+	client := &wsClient{
+		ws:      ws,
+		matcher: matcher,
+		frames:  make(chan []byte, wo.conf.QueueSize),
+	}
+	wo.clientsLock.Lock()
+	select {
+	case <-wo.stopChan:
+		wo.clientsLock.Unlock()
+		return
+	default:
+	}
+	wo.clients[client] = struct{}{}
+	wo.clientsWg.Add(1)
+	wo.clientsLock.Unlock()
+	defer func() {
+		wo.clientsLock.Lock()
+		delete(wo.clients, client)
+		wo.clientsLock.Unlock()
+		wo.clientsWg.Done()
+	}()
+
+	// Clients aren't expected to send anything, but reading is how we find
+	// out they've gone away.
+	gone := make(chan struct{})
+	go func() {
+		var discard []byte
+		for {
+			if err := websocket.Message.Receive(ws, &discard); err != nil {
+				close(gone)
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case frame := <-client.frames:
+			if wo.binary {
+				err = websocket.Message.Send(ws, frame)
+			} else {
+				err = websocket.Message.Send(ws, string(frame))
+			}
+			if err != nil {
+				return
+			}
+		case <-gone:
+			return
+		case <-wo.stopChan:
+			return
+		}
+	}
+}
+
+// Satisfies the `pipeline.ReportingPlugin` interface to provide plugin state
+// information to the Heka report and dashboard.
+func (wo *WebSocketOutput) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "ProcessMessageCount",
+		atomic.LoadInt64(&wo.processMessageCount), "count")
+	message.NewInt64Field(msg, "DropMessageCount",
+		atomic.LoadInt64(&wo.dropMessageCount), "count")
+	message.NewInt64Field(msg, "SlowClientDropCount",
+		atomic.LoadInt64(&wo.slowClientDropCount), "count")
+	message.NewIntField(msg, "ClientCount", wo.clientCount(), "count")
+	return nil
+}
+
+func init() {
+	RegisterPlugin("WebSocketOutput", func() interface{} {
+		return new(WebSocketOutput)
+	})
+}
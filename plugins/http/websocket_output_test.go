@@ -0,0 +1,100 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package http
+
+import (
+	"net/url"
+	"time"
+
+	"github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	"github.com/mozilla-services/heka/plugins"
+	ts "github.com/mozilla-services/heka/plugins/testsupport"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"golang.org/x/net/websocket"
+)
+
+func WebSocketOutputSpec(c gs.Context) {
+	t := new(pipeline_ts.SimpleT)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	pConfig := pipeline.NewPipelineConfig(nil)
+	oth := ts.NewOutputTestHelper(ctrl)
+	encoder := new(plugins.PayloadEncoder)
+
+	c.Specify("A WebSocketOutput", func() {
+		output := new(WebSocketOutput)
+		config := output.ConfigStruct().(*WebSocketOutputConfig)
+		config.Address = "127.0.0.1:58328"
+		err := output.Init(config)
+		c.Assume(err, gs.IsNil)
+
+		inChan := make(chan *pipeline.PipelinePack, 1)
+		oth.MockOutputRunner.EXPECT().Encoder().Return(encoder).AnyTimes()
+		oth.MockOutputRunner.EXPECT().InChan().Return(inChan)
+		oth.MockOutputRunner.EXPECT().UpdateCursor(gomock.Any()).AnyTimes()
+
+		errChan := make(chan error, 1)
+		go func() {
+			errChan <- output.Run(oth.MockOutputRunner, oth.MockHelper)
+		}()
+
+		send := func(msgType, payload string) {
+			pack := pipeline.NewPipelinePack(pConfig.InputRecycleChan())
+			pack.Message = pipeline_ts.GetTestMessage()
+			pack.Message.SetType(msgType)
+			oth.MockOutputRunner.EXPECT().Encode(pack).Return([]byte(payload), nil)
+			inChan <- pack
+		}
+
+		// Clients register after the handshake completes, so wait for them
+		// before sending anything.
+		waitForClients := func(n int) {
+			for i := 0; i < 500 && output.clientCount() < n; i++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+			c.Assume(output.clientCount(), gs.Equals, n)
+		}
+
+		c.Specify("only pushes subscribed messages to a client", func() {
+			query := url.Values{"matcher": {"Type == 'wanted'"}}
+			ws, err := websocket.Dial("ws://"+config.Address+"/?"+query.Encode(),
+				"", "http://localhost/")
+			c.Assume(err, gs.IsNil)
+			defer ws.Close()
+			waitForClients(1)
+
+			send("unwanted", "skip me")
+			send("wanted", "push me")
+
+			var frame string
+			err = websocket.Message.Receive(ws, &frame)
+			c.Expect(err, gs.IsNil)
+			c.Expect(frame, gs.Equals, "push me")
+		})
+
+		c.Specify("rejects invalid subscriptions", func() {
+			query := url.Values{"matcher": {"Type =="}}
+			_, err := websocket.Dial("ws://"+config.Address+"/?"+query.Encode(),
+				"", "http://localhost/")
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		close(inChan)
+		c.Expect(<-errChan, gs.IsNil)
+	})
+}
@@ -0,0 +1,212 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package imap
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Minimal IMAP4rev1 session, covering just the commands ImapInput needs.
+type imapSession struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+	tag     int
+	conf    *ImapInputConfig
+	expunge bool
+}
+
+func newImapSession(conn net.Conn, conf *ImapInputConfig) (*imapSession, error) {
+	s := &imapSession{
+		conn:    conn,
+		r:       bufio.NewReader(conn),
+		timeout: time.Duration(conf.Timeout) * time.Second,
+		conf:    conf,
+	}
+	s.deadline()
+	greeting, err := s.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(greeting, "* OK") && !strings.HasPrefix(greeting, "* PREAUTH") {
+		return nil, fmt.Errorf("unexpected greeting: %s", greeting)
+	}
+	if _, err = s.command("LOGIN %s %s", imapQuote(conf.User),
+		imapQuote(conf.Password)); err != nil {
+		return nil, err
+	}
+	if _, err = s.command("SELECT %s", imapQuote(conf.Mailbox)); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *imapSession) deadline() {
+	if s.timeout > 0 {
+		s.conn.SetDeadline(time.Now().Add(s.timeout))
+	}
+}
+
+func (s *imapSession) readLine() (string, error) {
+	line, err := s.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// An untagged response, w/ the literals it holds.
+type imapResponse struct {
+	// Text of the response, w/ each literal replaced by its size marker.
+	text     string
+	literals [][]byte
+}
+
+// Sends the command, returning the untagged responses it got. An error is
+// returned unless the command completes w/ OK.
+func (s *imapSession) command(format string, args ...interface{}) (
+	[]imapResponse, error) {
+
+	s.deadline()
+	s.tag++
+	tag := "a" + strconv.Itoa(s.tag)
+	cmd := fmt.Sprintf(format, args...)
+	if _, err := fmt.Fprintf(s.conn, "%s %s\r\n", tag, cmd); err != nil {
+		return nil, err
+	}
+	var (
+		untagged []imapResponse
+		current  imapResponse
+	)
+	for {
+		line, err := s.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if current.text == "" && strings.HasPrefix(line, tag+" ") {
+			status := line[len(tag)+1:]
+			if !strings.HasPrefix(status, "OK") {
+				verb := strings.SplitN(cmd, " ", 2)[0]
+				return nil, fmt.Errorf("%s failed: %s", verb, status)
+			}
+			return untagged, nil
+		}
+		current.text += line
+		if size, ok := imapLiteralSize(line); ok {
+			literal := make([]byte, size)
+			if _, err = io.ReadFull(s.r, literal); err != nil {
+				return nil, err
+			}
+			current.literals = append(current.literals, literal)
+			continue
+		}
+		untagged = append(untagged, current)
+		current = imapResponse{}
+	}
+}
+
+// Returns the size of the literal announced at the end of the line, if any.
+func imapLiteralSize(line string) (int, bool) {
+	if !strings.HasSuffix(line, "}") {
+		return 0, false
+	}
+	start := strings.LastIndex(line, "{")
+	if start < 0 {
+		return 0, false
+	}
+	size, err := strconv.Atoi(line[start+1 : len(line)-1])
+	if err != nil || size < 0 {
+		return 0, false
+	}
+	return size, true
+}
+
+func imapQuote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
+}
+
+func (s *imapSession) list() ([]string, error) {
+	criteria := "NOT DELETED"
+	if s.conf.ProcessedAction == "mark_seen" {
+		criteria = "UNSEEN"
+	}
+	untagged, err := s.command("UID SEARCH %s", criteria)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, resp := range untagged {
+		if fields := strings.Fields(resp.text); len(fields) > 1 &&
+			fields[1] == "SEARCH" {
+			ids = append(ids, fields[2:]...)
+		}
+	}
+	return ids, nil
+}
+
+func (s *imapSession) fetch(id string) ([]byte, error) {
+	untagged, err := s.command("UID FETCH %s BODY.PEEK[]", id)
+	if err != nil {
+		return nil, err
+	}
+	for _, resp := range untagged {
+		// The body is the response's only literal, unless the server sent
+		// other attributes as literals too.
+		marker := strings.Index(resp.text, "BODY[] {")
+		if marker < 0 {
+			continue
+		}
+		index := strings.Count(resp.text[:marker], "{")
+		if index < len(resp.literals) {
+			return resp.literals[index], nil
+		}
+	}
+	return nil, fmt.Errorf("no body in FETCH response")
+}
+
+func (s *imapSession) done(id string) (err error) {
+	switch s.conf.ProcessedAction {
+	case "mark_seen":
+		_, err = s.command(`UID STORE %s +FLAGS.SILENT (\Seen)`, id)
+	case "move":
+		if _, err = s.command("UID COPY %s %s", id,
+			imapQuote(s.conf.ArchiveMailbox)); err != nil {
+			return err
+		}
+		fallthrough
+	case "delete":
+		_, err = s.command(`UID STORE %s +FLAGS.SILENT (\Seen \Deleted)`, id)
+		s.expunge = true
+	}
+	return err
+}
+
+func (s *imapSession) close() error {
+	defer s.conn.Close()
+	if s.expunge {
+		if _, err := s.command("EXPUNGE"); err != nil {
+			return err
+		}
+	}
+	_, err := s.command("LOGOUT")
+	return err
+}
@@ -0,0 +1,247 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package imap
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins/tcp"
+	"github.com/pborman/uuid"
+)
+
+type ImapInputConfig struct {
+	// Address of the mail server, as host:port.
+	Address string
+	// Either "imap" or "pop3", defaults to "imap".
+	Protocol string
+	// Whether to connect w/ TLS, defaults to true.
+	UseTls bool `toml:"use_tls"`
+	Tls    tcp.TlsConfig
+	User   string
+	// Password of the user.
+	Password string
+	// IMAP mailbox that's polled, defaults to "INBOX".
+	Mailbox string
+	// What's done w/ the mail once it's been delivered: "mark_seen" (IMAP
+	// only, the default for IMAP), "move" to the archive mailbox (IMAP only)
+	// or "delete" (the default, and only action, for POP3).
+	ProcessedAction string `toml:"processed_action"`
+	// IMAP mailbox the processed mail is moved to w/ the "move" action.
+	ArchiveMailbox string `toml:"archive_mailbox"`
+	// Whether attachments are added to the messages, as bytes fields, or
+	// dropped, either "keep" or "drop". Defaults to "drop".
+	Attachments string
+	// Attachments larger than this many bytes are dropped even when they're
+	// kept, 0 for no limit. Defaults to 1MiB.
+	MaxAttachmentSize int `toml:"max_attachment_size"`
+	// Seconds a mail server has to answer each command, defaults to 30.
+	Timeout uint
+	// Seconds between polls, defaults to 60.
+	TickerInterval uint `toml:"ticker_interval"`
+}
+
+// A session w/ a mail server.
+type mailSession interface {
+	// Returns the ids of the mail to process.
+	list() ([]string, error)
+	// Returns the full text of the mail.
+	fetch(id string) ([]byte, error)
+	// Marks, moves or deletes the mail once it's been delivered.
+	done(id string) error
+	// Commits the changes to the mailbox and ends the session.
+	close() error
+}
+
+type ImapInput struct {
+	conf     *ImapInputConfig
+	tlsConf  *tls.Config
+	ir       InputRunner
+	hostname string
+	stopChan chan bool
+	// Opens a session, replaced in tests.
+	open func() (mailSession, error)
+}
+
+func (ii *ImapInput) ConfigStruct() interface{} {
+	return &ImapInputConfig{
+		Protocol:          "imap",
+		UseTls:            true,
+		Mailbox:           "INBOX",
+		Attachments:       "drop",
+		MaxAttachmentSize: 1 << 20,
+		Timeout:           30,
+		TickerInterval:    60,
+	}
+}
+
+func (ii *ImapInput) Init(config interface{}) (err error) {
+	conf := config.(*ImapInputConfig)
+	if conf.Address == "" {
+		return fmt.Errorf("ImapInput needs a server address")
+	}
+	switch conf.Protocol {
+	case "imap":
+		if conf.ProcessedAction == "" {
+			conf.ProcessedAction = "mark_seen"
+		}
+		switch conf.ProcessedAction {
+		case "mark_seen", "delete":
+		case "move":
+			if conf.ArchiveMailbox == "" {
+				return fmt.Errorf("ImapInput 'move' action needs an archive_mailbox")
+			}
+		default:
+			return fmt.Errorf("ImapInput unknown processed_action '%s'",
+				conf.ProcessedAction)
+		}
+	case "pop3":
+		if conf.ProcessedAction == "" {
+			conf.ProcessedAction = "delete"
+		}
+		if conf.ProcessedAction != "delete" {
+			return fmt.Errorf("ImapInput POP3 mail can only be deleted once processed")
+		}
+	default:
+		return fmt.Errorf("ImapInput unknown protocol '%s'", conf.Protocol)
+	}
+	if conf.Attachments != "keep" && conf.Attachments != "drop" {
+		return fmt.Errorf("ImapInput attachments must be 'keep' or 'drop'")
+	}
+	if conf.UseTls {
+		if ii.tlsConf, err = tcp.CreateGoTlsConfig(&conf.Tls); err != nil {
+			return fmt.Errorf("ImapInput TLS config: %s", err)
+		}
+		if ii.tlsConf.ServerName == "" {
+			ii.tlsConf.ServerName, _, _ = net.SplitHostPort(conf.Address)
+		}
+	}
+	ii.conf = conf
+	ii.open = ii.dial
+	ii.stopChan = make(chan bool)
+	return nil
+}
+
+// Connects and logs in to the mail server.
+func (ii *ImapInput) dial() (mailSession, error) {
+	timeout := time.Duration(ii.conf.Timeout) * time.Second
+	var (
+		conn net.Conn
+		err  error
+	)
+	if ii.tlsConf != nil {
+		dialer := &net.Dialer{Timeout: timeout}
+		conn, err = tls.DialWithDialer(dialer, "tcp", ii.conf.Address, ii.tlsConf)
+	} else {
+		conn, err = net.DialTimeout("tcp", ii.conf.Address, timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var session mailSession
+	if ii.conf.Protocol == "pop3" {
+		session, err = newPop3Session(conn, ii.conf)
+	} else {
+		session, err = newImapSession(conn, ii.conf)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return session, nil
+}
+
+func (ii *ImapInput) Run(ir InputRunner, h PluginHelper) error {
+	ii.ir = ir
+	ii.hostname = h.Hostname()
+	ticker := ir.Ticker()
+	for {
+		select {
+		case <-ticker:
+			ii.poll()
+		case <-ii.stopChan:
+			return nil
+		}
+	}
+}
+
+// Delivers a message for each new mail, disposing of each mail after it's
+// been delivered.
+func (ii *ImapInput) poll() {
+	session, err := ii.open()
+	if err != nil {
+		ii.ir.LogError(fmt.Errorf("can't open mailbox: %s", err))
+		return
+	}
+	defer func() {
+		if err := session.close(); err != nil {
+			ii.ir.LogError(fmt.Errorf("can't close mailbox: %s", err))
+		}
+	}()
+	ids, err := session.list()
+	if err != nil {
+		ii.ir.LogError(fmt.Errorf("can't list mail: %s", err))
+		return
+	}
+	for _, id := range ids {
+		select {
+		case <-ii.stopChan:
+			return
+		default:
+		}
+		raw, err := session.fetch(id)
+		if err != nil {
+			ii.ir.LogError(fmt.Errorf("can't fetch mail %s: %s", id, err))
+			return
+		}
+		pack := <-ii.ir.InChan()
+		ii.fillMessage(pack.Message, raw)
+		ii.ir.Deliver(pack)
+		if err = session.done(id); err != nil {
+			ii.ir.LogError(fmt.Errorf("can't %s mail %s: %s",
+				ii.conf.ProcessedAction, id, err))
+			return
+		}
+	}
+}
+
+// Fills the message from the mail, falling back to the whole mail as payload
+// if it can't be parsed.
+func (ii *ImapInput) fillMessage(msg *message.Message, raw []byte) {
+	msg.SetUuid(uuid.NewRandom())
+	msg.SetTimestamp(time.Now().UnixNano())
+	msg.SetType("heka.mail")
+	msg.SetHostname(ii.hostname)
+	msg.SetLogger(ii.ir.Name())
+	keep := ii.conf.Attachments == "keep"
+	if err := fillMailMessage(msg, raw, keep, ii.conf.MaxAttachmentSize); err != nil {
+		ii.ir.LogError(fmt.Errorf("can't parse mail: %s", err))
+		msg.SetPayloadBytes(raw)
+	}
+}
+
+func (ii *ImapInput) Stop() {
+	close(ii.stopChan)
+}
+
+func init() {
+	RegisterPlugin("ImapInput", func() interface{} {
+		return new(ImapInput)
+	})
+}
@@ -0,0 +1,252 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package imap
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+
+	. "github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	"github.com/mozilla-services/heka/pipelinemock"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+const testMail = "From: alerts@example.com\r\n" +
+	"Subject: disk full\r\n" +
+	"Date: Mon, 02 Jan 2006 15:04:05 +0000\r\n" +
+	"\r\n" +
+	"/var is at 100%\r\n"
+
+// Serves the mail over a minimal IMAP conversation, sending the commands it
+// got on the returned channel.
+func fakeImapServer(conn net.Conn, mails map[string]string) chan string {
+	commands := make(chan string, 100)
+	go func() {
+		defer conn.Close()
+		defer close(commands)
+		r := bufio.NewReader(conn)
+		fmt.Fprint(conn, "* OK fake IMAP ready\r\n")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			parts := strings.SplitN(strings.TrimSpace(line), " ", 2)
+			tag, cmd := parts[0], parts[1]
+			commands <- cmd
+			fields := strings.Fields(cmd)
+			switch {
+			case strings.HasPrefix(cmd, "UID SEARCH"):
+				fmt.Fprint(conn, "* SEARCH")
+				for _, uid := range []string{"3", "7"} {
+					if _, ok := mails[uid]; ok {
+						fmt.Fprintf(conn, " %s", uid)
+					}
+				}
+				fmt.Fprint(conn, "\r\n")
+			case strings.HasPrefix(cmd, "UID FETCH"):
+				mail := mails[fields[2]]
+				fmt.Fprintf(conn, "* 1 FETCH (UID %s BODY[] {%d}\r\n%s)\r\n",
+					fields[2], len(mail), mail)
+			case cmd == "LOGOUT":
+				fmt.Fprintf(conn, "* BYE\r\n%s OK LOGOUT completed\r\n", tag)
+				return
+			case strings.HasPrefix(cmd, "LOGIN") && strings.Contains(cmd, "wrong"):
+				fmt.Fprintf(conn, "%s NO bad credentials\r\n", tag)
+				continue
+			}
+			fmt.Fprintf(conn, "%s OK done\r\n", tag)
+		}
+	}()
+	return commands
+}
+
+// Serves the mail over a minimal POP3 conversation, sending the commands it
+// got on the returned channel.
+func fakePop3Server(conn net.Conn, mails []string) chan string {
+	commands := make(chan string, 100)
+	go func() {
+		defer conn.Close()
+		defer close(commands)
+		r := bufio.NewReader(conn)
+		fmt.Fprint(conn, "+OK fake POP3 ready\r\n")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			cmd := strings.TrimSpace(line)
+			commands <- cmd
+			fields := strings.Fields(cmd)
+			switch fields[0] {
+			case "LIST":
+				fmt.Fprint(conn, "+OK\r\n")
+				for i, mail := range mails {
+					fmt.Fprintf(conn, "%d %d\r\n", i+1, len(mail))
+				}
+				fmt.Fprint(conn, ".\r\n")
+			case "RETR":
+				var i int
+				fmt.Sscan(fields[1], &i)
+				fmt.Fprintf(conn, "+OK\r\n%s.\r\n", mails[i-1])
+			case "QUIT":
+				fmt.Fprint(conn, "+OK bye\r\n")
+				return
+			default:
+				fmt.Fprint(conn, "+OK\r\n")
+			}
+		}
+	}()
+	return commands
+}
+
+func ImapInputSpec(c gs.Context) {
+	t := &pipeline_ts.SimpleT{}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	pConfig := NewPipelineConfig(nil)
+
+	c.Specify("An ImapInput", func() {
+		input := new(ImapInput)
+		config := input.ConfigStruct().(*ImapInputConfig)
+		config.Address = "mail.example.com:993"
+		config.User = "alerts"
+		config.Password = "secret"
+
+		c.Specify("defaults to marking IMAP mail as seen", func() {
+			err := input.Init(config)
+			c.Assume(err, gs.IsNil)
+			c.Expect(config.ProcessedAction, gs.Equals, "mark_seen")
+			c.Expect(input.tlsConf.ServerName, gs.Equals, "mail.example.com")
+		})
+
+		c.Specify("validates its config", func() {
+			config.ProcessedAction = "move"
+			c.Expect(input.Init(config), gs.Not(gs.IsNil))
+			config.Protocol = "pop3"
+			c.Expect(input.Init(config), gs.Not(gs.IsNil))
+			config.ProcessedAction = ""
+			c.Expect(input.Init(config), gs.IsNil)
+			c.Expect(config.ProcessedAction, gs.Equals, "delete")
+			config.Attachments = "inline"
+			c.Expect(input.Init(config), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("polling a mailbox", func() {
+			config.UseTls = false
+			mockIR := pipelinemock.NewMockInputRunner(ctrl)
+			mockIR.EXPECT().Name().Return("ImapInput").AnyTimes()
+			inChan := make(chan *PipelinePack, 1)
+			mockIR.EXPECT().InChan().Return(inChan).AnyTimes()
+			var delivered []string
+			mockIR.EXPECT().Deliver(gomock.Any()).Do(func(pack *PipelinePack) {
+				delivered = append(delivered, pack.Message.GetPayload())
+				subject, _ := pack.Message.GetFieldValue("Subject")
+				c.Expect(subject, gs.Equals, "disk full")
+				c.Expect(pack.Message.GetType(), gs.Equals, "heka.mail")
+				c.Expect(pack.Message.GetLogger(), gs.Equals, "ImapInput")
+				c.Expect(pack.Message.GetHostname(), gs.Equals, "hekatests.example.com")
+				inChan <- NewPipelinePack(pConfig.InputRecycleChan())
+			}).AnyTimes()
+			inChan <- NewPipelinePack(pConfig.InputRecycleChan())
+
+			var commands chan string
+			startPoll := func(serve func(net.Conn) chan string) {
+				c.Assume(input.Init(config), gs.IsNil)
+				input.ir = mockIR
+				input.hostname = "hekatests.example.com"
+				input.open = func() (mailSession, error) {
+					client, server := net.Pipe()
+					commands = serve(server)
+					var (
+						session mailSession
+						err     error
+					)
+					if config.Protocol == "pop3" {
+						session, err = newPop3Session(client, config)
+					} else {
+						session, err = newImapSession(client, config)
+					}
+					if err != nil {
+						client.Close()
+						return nil, err
+					}
+					return session, nil
+				}
+				input.poll()
+			}
+			received := func() (cmds []string) {
+				for cmd := range commands {
+					cmds = append(cmds, cmd)
+				}
+				return cmds
+			}
+			imapServer := func(conn net.Conn) chan string {
+				return fakeImapServer(conn, map[string]string{
+					"3": testMail,
+					"7": strings.Replace(testMail, "/var", "/home", 1),
+				})
+			}
+
+			c.Specify("over IMAP marks the mail as seen", func() {
+				startPoll(imapServer)
+				c.Expect(strings.Join(delivered, ""), gs.Equals,
+					"/var is at 100%\r\n/home is at 100%\r\n")
+				cmds := received()
+				c.Expect(cmds[0], gs.Equals, `LOGIN "alerts" "secret"`)
+				c.Expect(cmds[1], gs.Equals, `SELECT "INBOX"`)
+				c.Expect(cmds[2], gs.Equals, "UID SEARCH UNSEEN")
+				c.Expect(cmds[3], gs.Equals, "UID FETCH 3 BODY.PEEK[]")
+				c.Expect(cmds[4], gs.Equals, `UID STORE 3 +FLAGS.SILENT (\Seen)`)
+				c.Expect(cmds[len(cmds)-1], gs.Equals, "LOGOUT")
+			})
+
+			c.Specify("over IMAP moves the mail to the archive", func() {
+				config.ProcessedAction = "move"
+				config.ArchiveMailbox = "Processed"
+				startPoll(imapServer)
+				c.Expect(len(delivered), gs.Equals, 2)
+				cmds := received()
+				c.Expect(cmds[2], gs.Equals, "UID SEARCH NOT DELETED")
+				c.Expect(cmds[4], gs.Equals, `UID COPY 3 "Processed"`)
+				c.Expect(cmds[5], gs.Equals, `UID STORE 3 +FLAGS.SILENT (\Seen \Deleted)`)
+				c.Expect(cmds[len(cmds)-2], gs.Equals, "EXPUNGE")
+			})
+
+			c.Specify("w/ rejected credentials delivers nothing", func() {
+				config.Password = "wrong"
+				mockIR.EXPECT().LogError(gomock.Any())
+				startPoll(imapServer)
+				c.Expect(len(delivered), gs.Equals, 0)
+			})
+
+			c.Specify("over POP3 deletes the mail", func() {
+				config.Protocol = "pop3"
+				startPoll(func(conn net.Conn) chan string {
+					return fakePop3Server(conn, []string{testMail})
+				})
+				c.Expect(delivered, gs.ContainsExactly, []string{"/var is at 100%\n"})
+				cmds := received()
+				c.Expect(cmds, gs.ContainsInOrder, []string{"USER alerts",
+					"PASS secret", "LIST", "RETR 1", "DELE 1", "QUIT"})
+			})
+		})
+	})
+}
@@ -0,0 +1,184 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package imap
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"sort"
+	"strings"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+var headerDecoder = new(mime.WordDecoder)
+
+// Body and attachments collected from the parts of a mail.
+type mailParts struct {
+	text        []byte
+	html        []byte
+	names       []string
+	attachments [][]byte
+	dropped     int
+	keep        bool
+	maxSize     int
+}
+
+// Fills the message from the raw mail: each header is added as a string
+// field, the date as the timestamp, the plain text body (or the HTML one,
+// lacking it) as the payload and, if they're kept, the attachments as the
+// values of the `Attachments` bytes field.
+func fillMailMessage(msg *message.Message, raw []byte, keep bool,
+	maxSize int) error {
+
+	m, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(m.Header))
+	for name := range m.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		field := message.NewFieldInit(name, message.Field_STRING, "")
+		for _, v := range m.Header[name] {
+			if decoded, err := headerDecoder.DecodeHeader(v); err == nil {
+				v = decoded
+			}
+			field.AddValue(v)
+		}
+		msg.DeleteFieldsByName(name)
+		msg.AddField(field)
+	}
+	if date, err := m.Header.Date(); err == nil {
+		msg.SetTimestamp(date.UnixNano())
+	}
+
+	parts := &mailParts{keep: keep, maxSize: maxSize}
+	header := map[string][]string(m.Header)
+	if err = parts.add(header, m.Body); err != nil {
+		return err
+	}
+	if parts.text != nil {
+		msg.SetPayloadBytes(parts.text)
+	} else {
+		msg.SetPayloadBytes(parts.html)
+	}
+	if len(parts.attachments) > 0 {
+		field := message.NewFieldInit("Attachments", message.Field_BYTES, "")
+		names := message.NewFieldInit("AttachmentNames", message.Field_STRING, "")
+		for i, a := range parts.attachments {
+			field.AddValue(a)
+			names.AddValue(parts.names[i])
+		}
+		msg.AddField(field)
+		msg.AddField(names)
+	}
+	if parts.dropped > 0 {
+		msg.SetInt("AttachmentsDropped", int64(parts.dropped))
+	}
+	return nil
+}
+
+// Adds the part w/ the header and body, walking the parts of multipart
+// bodies.
+func (p *mailParts) add(header map[string][]string, body io.Reader) error {
+	get := func(key string) string {
+		if v := header[key]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	mediaType, params, err := mime.ParseMediaType(get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", nil
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		if params["boundary"] == "" {
+			return fmt.Errorf("multipart body w/o a boundary")
+		}
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err = p.add(part.Header, part); err != nil {
+				return err
+			}
+		}
+	}
+
+	switch strings.ToLower(get("Content-Transfer-Encoding")) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	disposition, dparams, _ := mime.ParseMediaType(get("Content-Disposition"))
+	name := dparams["filename"]
+	if name == "" {
+		name = params["name"]
+	}
+	isText := mediaType == "text/plain" || mediaType == "text/html"
+	if disposition == "attachment" || !isText ||
+		(mediaType == "text/plain" && p.text != nil) ||
+		(mediaType == "text/html" && p.html != nil) {
+		return p.attach(name, body)
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	if mediaType == "text/plain" {
+		p.text = data
+	} else {
+		p.html = data
+	}
+	return nil
+}
+
+// Keeps the attachment, unless attachments are dropped or it's too big.
+func (p *mailParts) attach(name string, body io.Reader) error {
+	if !p.keep {
+		p.dropped++
+		return nil
+	}
+	if p.maxSize > 0 {
+		body = io.LimitReader(body, int64(p.maxSize)+1)
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	if p.maxSize > 0 && len(data) > p.maxSize {
+		p.dropped++
+		return nil
+	}
+	p.names = append(p.names, name)
+	p.attachments = append(p.attachments, data)
+	return nil
+}
@@ -0,0 +1,103 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package imap
+
+import (
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+const multipartMail = "From: =?UTF-8?Q?Syst=C3=A8me?= <monitor@example.com>\r\n" +
+	"To: ops@example.com\r\n" +
+	"Subject: backup failed\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=XYZ\r\n" +
+	"\r\n" +
+	"--XYZ\r\n" +
+	"Content-Type: multipart/alternative; boundary=ABC\r\n" +
+	"\r\n" +
+	"--ABC\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"Backup of db1 failed =E2=80=94 see log.\r\n" +
+	"--ABC\r\n" +
+	"Content-Type: text/html\r\n" +
+	"\r\n" +
+	"<p>Backup of db1 failed</p>\r\n" +
+	"--ABC--\r\n" +
+	"--XYZ\r\n" +
+	"Content-Type: text/plain; name=backup.log\r\n" +
+	"Content-Disposition: attachment; filename=backup.log\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"ZXJyb3I6IGRp\r\n" +
+	"c2sgZnVsbA==\r\n" +
+	"--XYZ--\r\n"
+
+func MailMessageSpec(c gs.Context) {
+	c.Specify("A converted mail", func() {
+		msg := new(message.Message)
+
+		c.Specify("has its headers as fields and its date as timestamp", func() {
+			err := fillMailMessage(msg, []byte(testMail), false, 0)
+			c.Assume(err, gs.IsNil)
+			from, _ := msg.GetFieldValue("From")
+			c.Expect(from, gs.Equals, "alerts@example.com")
+			date := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+			c.Expect(msg.GetTimestamp(), gs.Equals, date.UnixNano())
+			c.Expect(msg.GetPayload(), gs.Equals, "/var is at 100%\r\n")
+		})
+
+		c.Specify("w/ parts", func() {
+			c.Specify("decodes the headers and the plain text body", func() {
+				err := fillMailMessage(msg, []byte(multipartMail), false, 0)
+				c.Assume(err, gs.IsNil)
+				from, _ := msg.GetFieldValue("From")
+				c.Expect(from, gs.Equals, "Système <monitor@example.com>")
+				c.Expect(msg.GetPayload(), gs.Equals, "Backup of db1 failed — see log.")
+			})
+
+			c.Specify("drops the attachments by default", func() {
+				err := fillMailMessage(msg, []byte(multipartMail), false, 0)
+				c.Assume(err, gs.IsNil)
+				_, ok := msg.GetFieldValue("Attachments")
+				c.Expect(ok, gs.IsFalse)
+				dropped, _ := msg.GetFieldValue("AttachmentsDropped")
+				c.Expect(dropped, gs.Equals, int64(1))
+			})
+
+			c.Specify("keeps the attachments if asked to", func() {
+				err := fillMailMessage(msg, []byte(multipartMail), true, 0)
+				c.Assume(err, gs.IsNil)
+				attachment, _ := msg.GetFieldValue("Attachments")
+				c.Expect(string(attachment.([]byte)), gs.Equals, "error: disk full")
+				name, _ := msg.GetFieldValue("AttachmentNames")
+				c.Expect(name, gs.Equals, "backup.log")
+			})
+
+			c.Specify("drops the attachments that are too big", func() {
+				err := fillMailMessage(msg, []byte(multipartMail), true, 8)
+				c.Assume(err, gs.IsNil)
+				_, ok := msg.GetFieldValue("Attachments")
+				c.Expect(ok, gs.IsFalse)
+				dropped, _ := msg.GetFieldValue("AttachmentsDropped")
+				c.Expect(dropped, gs.Equals, int64(1))
+			})
+		})
+	})
+}
@@ -0,0 +1,111 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package imap
+
+import (
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Minimal POP3 session, covering just the commands ImapInput needs.
+type pop3Session struct {
+	conn    net.Conn
+	text    *textproto.Conn
+	timeout time.Duration
+}
+
+func newPop3Session(conn net.Conn, conf *ImapInputConfig) (*pop3Session, error) {
+	s := &pop3Session{
+		conn:    conn,
+		text:    textproto.NewConn(conn),
+		timeout: time.Duration(conf.Timeout) * time.Second,
+	}
+	s.deadline()
+	if _, err := s.readStatus(); err != nil {
+		return nil, err
+	}
+	if _, err := s.command("USER %s", conf.User); err != nil {
+		return nil, err
+	}
+	if _, err := s.command("PASS %s", conf.Password); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *pop3Session) deadline() {
+	if s.timeout > 0 {
+		s.conn.SetDeadline(time.Now().Add(s.timeout))
+	}
+}
+
+// Reads a status line, returning an error w/ its text if it's not +OK.
+func (s *pop3Session) readStatus() (string, error) {
+	line, err := s.text.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(line, "+OK") {
+		return strings.TrimSpace(line[3:]), nil
+	}
+	return "", fmt.Errorf("POP3 error: %s", line)
+}
+
+func (s *pop3Session) command(format string, args ...interface{}) (string, error) {
+	s.deadline()
+	if err := s.text.PrintfLine(format, args...); err != nil {
+		return "", err
+	}
+	return s.readStatus()
+}
+
+func (s *pop3Session) list() ([]string, error) {
+	if _, err := s.command("LIST"); err != nil {
+		return nil, err
+	}
+	lines, err := s.text.ReadDotLines()
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			ids = append(ids, fields[0])
+		}
+	}
+	return ids, nil
+}
+
+func (s *pop3Session) fetch(id string) ([]byte, error) {
+	if _, err := s.command("RETR %s", id); err != nil {
+		return nil, err
+	}
+	return s.text.ReadDotBytes()
+}
+
+func (s *pop3Session) done(id string) error {
+	_, err := s.command("DELE %s", id)
+	return err
+}
+
+// Ends the session, the server only deletes the mail once it's QUIT.
+func (s *pop3Session) close() error {
+	defer s.text.Close()
+	_, err := s.command("QUIT")
+	return err
+}
@@ -0,0 +1,225 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package plugins
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"github.com/pborman/uuid"
+)
+
+type JsonDecoderConfig struct {
+	// Type of the decoded messages, unless mapped from the JSON. Defaults to
+	// "json".
+	MessageType string `toml:"message_type"`
+
+	// Whether to keep the JSON text as the message payload, defaults to
+	// false.
+	PayloadKeep bool `toml:"payload_keep"`
+
+	// Maps message header names (Payload, Uuid, Type, Logger, Hostname,
+	// Severity, EnvVersion, Pid and Timestamp) to the top level JSON keys
+	// holding their values. Mapped keys aren't added as fields.
+	MapFields map[string]string `toml:"map_fields"`
+
+	// Layout of string timestamps, see message.ForgivingTimeParse. Numeric
+	// timestamps are nanoseconds since the epoch, unless the layout is one of
+	// the Epoch* layouts.
+	TimestampLayout string `toml:"timestamp_layout"`
+
+	// Time zone string timestamps are presumed to be in, defaults to "UTC".
+	TimestampLocation string `toml:"timestamp_location"`
+
+	// Objects nested deeper than this are added as single fields holding
+	// their JSON text, 0 meaning no limit. Arrays are always kept as JSON
+	// text.
+	MaximumDepth uint `toml:"maximum_depth"`
+
+	// Joins the keys of nested objects into field names, defaults to ".".
+	Separator string `toml:"separator"`
+
+	// JSON parser to use, either "encoding/json" (the default) or "scanner",
+	// a hand written parser that's several times faster and allocates only
+	// for the strings containing escapes.
+	Parser string `toml:"parser"`
+}
+
+type JsonDecoder struct {
+	messageType  string
+	payloadKeep  bool
+	headers      map[string]string
+	layout       string
+	tzLocation   *time.Location
+	maximumDepth uint
+	separator    string
+	flatten      jsonFlattener
+}
+
+var jsonHeaders = []string{"Payload", "Uuid", "Type", "Logger", "Hostname",
+	"Severity", "EnvVersion", "Pid", "Timestamp"}
+
+func (jd *JsonDecoder) ConfigStruct() interface{} {
+	return &JsonDecoderConfig{
+		MessageType: "json",
+		Separator:   ".",
+		Parser:      "encoding/json",
+	}
+}
+
+func (jd *JsonDecoder) Init(config interface{}) (err error) {
+	conf := config.(*JsonDecoderConfig)
+	switch conf.Parser {
+	case "encoding/json":
+		jd.flatten = unmarshalJson
+	case "scanner":
+		jd.flatten = scanJson
+	default:
+		return fmt.Errorf("JsonDecoder unknown parser '%s'", conf.Parser)
+	}
+	// Keyed by JSON key, for the lookup while decoding.
+	jd.headers = make(map[string]string)
+	for header, key := range conf.MapFields {
+		known := false
+		for _, h := range jsonHeaders {
+			if h == header {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("JsonDecoder can't map to unknown header '%s'", header)
+		}
+		jd.headers[key] = header
+	}
+	if jd.tzLocation, err = time.LoadLocation(conf.TimestampLocation); err != nil {
+		return fmt.Errorf("JsonDecoder unknown timestamp_location '%s': %s",
+			conf.TimestampLocation, err)
+	}
+	jd.messageType = conf.MessageType
+	jd.payloadKeep = conf.PayloadKeep
+	jd.layout = conf.TimestampLayout
+	jd.maximumDepth = conf.MaximumDepth
+	jd.separator = conf.Separator
+	return
+}
+
+func (jd *JsonDecoder) Decode(pack *PipelinePack) (packs []*PipelinePack, err error) {
+	msg := pack.Message
+	data := msg.GetPayload()
+	msg.SetType(jd.messageType)
+	if !jd.payloadKeep {
+		msg.SetPayload("")
+	}
+	emit := func(key string, topLevel bool, val jsonValue) error {
+		if topLevel {
+			if header, ok := jd.headers[key]; ok {
+				return jd.setHeader(msg, header, val)
+			}
+		}
+		switch val.kind {
+		case jsonString, jsonRaw:
+			msg.SetString(key, val.str)
+		case jsonNumber:
+			msg.SetDouble(key, val.num)
+		case jsonBool:
+			msg.SetBool(key, val.b)
+		}
+		return nil
+	}
+	if err = jd.flatten(data, jd.maximumDepth, jd.separator, emit); err != nil {
+		return nil, fmt.Errorf("JsonDecoder failed to parse: %s", err)
+	}
+	return []*PipelinePack{pack}, nil
+}
+
+// Sets the header from the JSON value, nulls leaving it alone.
+func (jd *JsonDecoder) setHeader(msg *message.Message, header string, val jsonValue) error {
+	if val.kind == jsonNull {
+		return nil
+	}
+	switch header {
+	case "Severity", "Pid":
+		n := int32(val.num)
+		if val.kind != jsonNumber {
+			i, err := strconv.ParseInt(val.str, 10, 32)
+			if val.kind != jsonString || err != nil {
+				return fmt.Errorf("%s isn't an integer", header)
+			}
+			n = int32(i)
+		}
+		if header == "Severity" {
+			msg.SetSeverity(n)
+		} else {
+			msg.SetPid(n)
+		}
+		return nil
+	case "Timestamp":
+		return jd.setTimestamp(msg, val)
+	}
+
+	str := val.str
+	if val.kind == jsonBool {
+		str = strconv.FormatBool(val.b)
+	}
+	switch header {
+	case "Payload":
+		msg.SetPayload(str)
+	case "Uuid":
+		u := uuid.Parse(str)
+		if u == nil {
+			return fmt.Errorf("invalid Uuid '%s'", str)
+		}
+		msg.SetUuid(u)
+	case "Type":
+		msg.SetType(str)
+	case "Logger":
+		msg.SetLogger(str)
+	case "Hostname":
+		msg.SetHostname(str)
+	case "EnvVersion":
+		msg.SetEnvVersion(str)
+	}
+	return nil
+}
+
+func (jd *JsonDecoder) setTimestamp(msg *message.Message, val jsonValue) error {
+	switch {
+	case val.kind == jsonNumber && jd.layout == "":
+		ns, err := strconv.ParseInt(val.str, 10, 64)
+		if err != nil {
+			ns = int64(val.num)
+		}
+		msg.SetTimestamp(ns)
+		return nil
+	case val.kind != jsonString && val.kind != jsonNumber:
+		return fmt.Errorf("Timestamp isn't a string or number")
+	}
+	t, err := message.ForgivingTimeParse(jd.layout, val.str, jd.tzLocation)
+	if err != nil {
+		return fmt.Errorf("can't parse Timestamp '%s': %s", val.str, err)
+	}
+	msg.SetTimestamp(t.UnixNano())
+	return nil
+}
+
+func init() {
+	RegisterPlugin("JsonDecoder", func() interface{} {
+		return new(JsonDecoder)
+	})
+}
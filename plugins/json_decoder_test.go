@@ -0,0 +1,180 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package plugins
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/mozilla-services/heka/pipeline"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+const jsonDecoderPayload = `{
+	"msg": "started \"worker\" é😀",
+	"uuid": "8e414f01-9d7f-4a48-a5e1-ae92e5954df5",
+	"host": "example.com",
+	"level": 4,
+	"ts": "2016-05-04T03:02:01Z",
+	"latency": 12.5,
+	"ok": true,
+	"missing": null,
+	"tags": ["a", "b"],
+	"request": {"method": "GET", "headers": {"agent": "curl", "bytes": 512}}
+}`
+
+func JsonDecoderSpec(c gs.Context) {
+	c.Specify("A JsonDecoder", func() {
+		decoder := new(JsonDecoder)
+		config := decoder.ConfigStruct().(*JsonDecoderConfig)
+		supply := make(chan *PipelinePack, 1)
+		pack := NewPipelinePack(supply)
+		pack.Message.SetPayload(jsonDecoderPayload)
+
+		for _, parser := range []string{"encoding/json", "scanner"} {
+			parser := parser
+			config.Parser = parser
+
+			c.Specify("w/ the "+parser+" parser", func() {
+				c.Specify("flattens nested objects into fields", func() {
+					err := decoder.Init(config)
+					c.Assume(err, gs.IsNil)
+					packs, err := decoder.Decode(pack)
+					c.Expect(err, gs.IsNil)
+					c.Expect(len(packs), gs.Equals, 1)
+
+					msg := pack.Message
+					c.Expect(msg.GetType(), gs.Equals, "json")
+					c.Expect(msg.GetPayload(), gs.Equals, "")
+					value, _ := msg.GetFieldValue("msg")
+					c.Expect(value, gs.Equals, "started \"worker\" é\U0001F600")
+					value, _ = msg.GetFieldValue("level")
+					c.Expect(value, gs.Equals, float64(4))
+					value, _ = msg.GetFieldValue("ok")
+					c.Expect(value, gs.Equals, true)
+					value, _ = msg.GetFieldValue("tags")
+					c.Expect(value, gs.Equals, `["a", "b"]`)
+					value, _ = msg.GetFieldValue("request.method")
+					c.Expect(value, gs.Equals, "GET")
+					value, _ = msg.GetFieldValue("request.headers.bytes")
+					c.Expect(value, gs.Equals, float64(512))
+					_, ok := msg.GetFieldValue("missing")
+					c.Expect(ok, gs.IsFalse)
+					c.Expect(len(msg.Fields), gs.Equals, 11)
+				})
+
+				c.Specify("maps keys to the headers", func() {
+					config.PayloadKeep = true
+					config.MapFields = map[string]string{
+						"Uuid":      "uuid",
+						"Hostname":  "host",
+						"Severity":  "level",
+						"Timestamp": "ts",
+						"Type":      "missing",
+					}
+					err := decoder.Init(config)
+					c.Assume(err, gs.IsNil)
+					_, err = decoder.Decode(pack)
+					c.Expect(err, gs.IsNil)
+
+					msg := pack.Message
+					c.Expect(msg.GetPayload(), gs.Equals, jsonDecoderPayload)
+					c.Expect(msg.GetType(), gs.Equals, "json")
+					c.Expect(msg.GetUuidString(), gs.Equals, "8e414f01-9d7f-4a48-a5e1-ae92e5954df5")
+					c.Expect(msg.GetHostname(), gs.Equals, "example.com")
+					c.Expect(msg.GetSeverity(), gs.Equals, int32(4))
+					ts := time.Date(2016, 5, 4, 3, 2, 1, 0, time.UTC)
+					c.Expect(msg.GetTimestamp(), gs.Equals, ts.UnixNano())
+					_, ok := msg.GetFieldValue("host")
+					c.Expect(ok, gs.IsFalse)
+				})
+
+				c.Specify("keeps objects beyond the maximum depth as JSON", func() {
+					config.MaximumDepth = 2
+					config.Separator = "_"
+					err := decoder.Init(config)
+					c.Assume(err, gs.IsNil)
+					_, err = decoder.Decode(pack)
+					c.Expect(err, gs.IsNil)
+
+					value, _ := pack.Message.GetFieldValue("request_method")
+					c.Expect(value, gs.Equals, "GET")
+					value, _ = pack.Message.GetFieldValue("request_headers")
+					c.Expect(value, gs.Equals, `{"agent": "curl", "bytes": 512}`)
+				})
+
+				c.Specify("parses epoch timestamps w/o losing precision", func() {
+					pack.Message.SetPayload(`{"ts": 1462330921.123456789}`)
+					config.MapFields = map[string]string{"Timestamp": "ts"}
+					config.TimestampLayout = "Epoch"
+					err := decoder.Init(config)
+					c.Assume(err, gs.IsNil)
+					_, err = decoder.Decode(pack)
+					c.Expect(err, gs.IsNil)
+					c.Expect(pack.Message.GetTimestamp(), gs.Equals, int64(1462330921123456789))
+				})
+
+				c.Specify("fails on invalid JSON", func() {
+					err := decoder.Init(config)
+					c.Assume(err, gs.IsNil)
+					for _, payload := range []string{`["not", "an", "object"]`,
+						`{"a": 1`, `{"a": tru}`, `{"a": "b"} trailing`, `{"a" 1}`,
+						`{"a": 01}`, `{"a": 1.}`, `{"a": [1, }`, `{"a": [1}`,
+						`{"a": {"b": {[]}}}`} {
+
+						pack.Message.SetPayload(payload)
+						_, err = decoder.Decode(pack)
+						c.Expect(err, gs.Not(gs.IsNil))
+					}
+				})
+			})
+		}
+
+		c.Specify("rejects unknown parsers and headers", func() {
+			config.Parser = "simdjson"
+			c.Expect(decoder.Init(config), gs.Not(gs.IsNil))
+			config.Parser = "scanner"
+			config.MapFields = map[string]string{"Fields": "f"}
+			c.Expect(decoder.Init(config), gs.Not(gs.IsNil))
+		})
+	})
+}
+
+func benchmarkJsonDecoder(b *testing.B, parser string) {
+	decoder := new(JsonDecoder)
+	config := decoder.ConfigStruct().(*JsonDecoderConfig)
+	config.Parser = parser
+	config.MapFields = map[string]string{"Hostname": "host", "Severity": "level"}
+	if err := decoder.Init(config); err != nil {
+		b.Fatal(err)
+	}
+	pack := NewPipelinePack(make(chan *PipelinePack, 1))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pack.Message.SetPayload(jsonDecoderPayload)
+		pack.Message.Fields = pack.Message.Fields[:0]
+		if _, err := decoder.Decode(pack); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkJsonDecoderEncodingJson(b *testing.B) {
+	benchmarkJsonDecoder(b, "encoding/json")
+}
+
+func BenchmarkJsonDecoderScanner(b *testing.B) {
+	benchmarkJsonDecoder(b, "scanner")
+}
@@ -0,0 +1,479 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package plugins
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+type jsonKind int
+
+const (
+	jsonString jsonKind = iota
+	jsonNumber
+	jsonBool
+	jsonNull
+	// Arrays, and objects nested deeper than the maximum depth, as JSON text.
+	jsonRaw
+)
+
+// A scalar JSON value, or the text of a value that isn't flattened. Numbers
+// keep their text too, so they can be reparsed w/o losing precision.
+type jsonValue struct {
+	kind jsonKind
+	str  string
+	num  float64
+	b    bool
+}
+
+// Receives the flattened values of a JSON object, w/ nested keys joined by the
+// separator. Top level keys are flagged so they can be mapped to the message
+// headers.
+type jsonEmitter func(key string, topLevel bool, val jsonValue) error
+
+// Flattens the JSON object in data, calling emit for each value.
+type jsonFlattener func(data string, maxDepth uint, sep string, emit jsonEmitter) error
+
+var errJsonNotObject = errors.New("not a JSON object")
+
+// Hand written flattener that walks the JSON text once w/o any reflection or
+// intermediate maps, string values w/o escapes being sliced out of the input
+// rather than copied.
+func scanJson(data string, maxDepth uint, sep string, emit jsonEmitter) error {
+	s := &jsonScanner{data: data, maxDepth: maxDepth, sep: sep, emit: emit}
+	s.skipSpace()
+	if s.pos >= len(s.data) || s.data[s.pos] != '{' {
+		return errJsonNotObject
+	}
+	if err := s.object("", 1); err != nil {
+		return err
+	}
+	s.skipSpace()
+	if s.pos != len(s.data) {
+		return s.errorf("unexpected data after the top level object")
+	}
+	return nil
+}
+
+type jsonScanner struct {
+	data     string
+	pos      int
+	maxDepth uint
+	sep      string
+	emit     jsonEmitter
+}
+
+func (s *jsonScanner) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("offset %d: %s", s.pos, fmt.Sprintf(format, args...))
+}
+
+func (s *jsonScanner) skipSpace() {
+	for s.pos < len(s.data) {
+		switch s.data[s.pos] {
+		case ' ', '\t', '\n', '\r':
+			s.pos++
+		default:
+			return
+		}
+	}
+}
+
+// Parses the object starting at the current position, named prefix and
+// nested depth levels deep.
+func (s *jsonScanner) object(prefix string, depth uint) error {
+	s.pos++ // '{'
+	s.skipSpace()
+	if s.pos < len(s.data) && s.data[s.pos] == '}' {
+		s.pos++
+		return nil
+	}
+	for {
+		s.skipSpace()
+		if s.pos >= len(s.data) || s.data[s.pos] != '"' {
+			return s.errorf("expected an object key")
+		}
+		key, err := s.str()
+		if err != nil {
+			return err
+		}
+		if prefix != "" {
+			key = prefix + s.sep + key
+		}
+		s.skipSpace()
+		if s.pos >= len(s.data) || s.data[s.pos] != ':' {
+			return s.errorf("expected ':' after object key")
+		}
+		s.pos++
+		s.skipSpace()
+		if s.pos >= len(s.data) {
+			return s.errorf("unexpected end of input")
+		}
+		if s.data[s.pos] == '{' && (s.maxDepth == 0 || depth < s.maxDepth) {
+			err = s.object(key, depth+1)
+		} else {
+			var val jsonValue
+			if val, err = s.value(); err == nil {
+				err = s.emit(key, depth == 1, val)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		s.skipSpace()
+		if s.pos >= len(s.data) {
+			return s.errorf("unexpected end of input")
+		}
+		switch s.data[s.pos] {
+		case ',':
+			s.pos++
+		case '}':
+			s.pos++
+			return nil
+		default:
+			return s.errorf("expected ',' or '}' after object value")
+		}
+	}
+}
+
+// Parses the value starting at the current position, returning objects and
+// arrays as raw JSON text.
+func (s *jsonScanner) value() (val jsonValue, err error) {
+	switch c := s.data[s.pos]; {
+	case c == '"':
+		val.str, err = s.str()
+	case c == '{' || c == '[':
+		start := s.pos
+		if err = s.skipComposite(); err == nil {
+			val.kind, val.str = jsonRaw, s.data[start:s.pos]
+		}
+	case c == 't':
+		val.kind, val.b = jsonBool, true
+		err = s.literal("true")
+	case c == 'f':
+		val.kind = jsonBool
+		err = s.literal("false")
+	case c == 'n':
+		val.kind = jsonNull
+		err = s.literal("null")
+	case c == '-' || (c >= '0' && c <= '9'):
+		start := s.pos
+		for s.pos < len(s.data) && isNumberByte(s.data[s.pos]) {
+			s.pos++
+		}
+		val.kind, val.str = jsonNumber, s.data[start:s.pos]
+		if !isJsonNumber(val.str) {
+			err = s.errorf("invalid number '%s'", val.str)
+		} else if val.num, err = strconv.ParseFloat(val.str, 64); err != nil {
+			err = s.errorf("invalid number '%s'", val.str)
+		}
+	default:
+		err = s.errorf("unexpected character '%c'", c)
+	}
+	return
+}
+
+func isNumberByte(c byte) bool {
+	return (c >= '0' && c <= '9') || c == '-' || c == '+' || c == '.' || c == 'e' ||
+		c == 'E'
+}
+
+// Whether the text is a number as JSON defines them, which ParseFloat is more
+// lenient about, e.g. accepting leading zeros.
+func isJsonNumber(num string) bool {
+	i := 0
+	digits := func() bool {
+		start := i
+		for i < len(num) && num[i] >= '0' && num[i] <= '9' {
+			i++
+		}
+		return i > start
+	}
+	if i < len(num) && num[i] == '-' {
+		i++
+	}
+	if i < len(num) && num[i] == '0' {
+		i++
+	} else if !digits() {
+		return false
+	}
+	if i < len(num) && num[i] == '.' {
+		i++
+		if !digits() {
+			return false
+		}
+	}
+	if i < len(num) && (num[i] == 'e' || num[i] == 'E') {
+		i++
+		if i < len(num) && (num[i] == '+' || num[i] == '-') {
+			i++
+		}
+		if !digits() {
+			return false
+		}
+	}
+	return i == len(num)
+}
+
+func (s *jsonScanner) literal(lit string) error {
+	if len(s.data)-s.pos < len(lit) || s.data[s.pos:s.pos+len(lit)] != lit {
+		return s.errorf("invalid literal")
+	}
+	s.pos += len(lit)
+	return nil
+}
+
+// Skips the object or array starting at the current position, checking that
+// it's valid JSON. Keeps a stack of the enclosing composites' closing brackets
+// rather than recursing, so deeply nested input can't exhaust the stack.
+func (s *jsonScanner) skipComposite() error {
+	var closers []byte
+	for {
+		// A value is expected at the current position.
+		if s.pos >= len(s.data) {
+			return s.errorf("unexpected end of input")
+		}
+		switch c := s.data[s.pos]; c {
+		case '{', '[':
+			closer := byte(']')
+			if c == '{' {
+				closer = '}'
+			}
+			s.pos++
+			s.skipSpace()
+			if s.pos < len(s.data) && s.data[s.pos] == closer {
+				s.pos++
+				break // empty, on to what follows it
+			}
+			closers = append(closers, closer)
+			if c == '{' {
+				if err := s.skipKey(); err != nil {
+					return err
+				}
+			}
+			continue
+		default:
+			if _, err := s.value(); err != nil {
+				return err
+			}
+		}
+		// Close the composites the value ends, up to the next one's comma.
+		for {
+			s.skipSpace()
+			if len(closers) == 0 {
+				return nil
+			}
+			if s.pos >= len(s.data) {
+				return s.errorf("unterminated object or array")
+			}
+			c := s.data[s.pos]
+			closer := closers[len(closers)-1]
+			s.pos++
+			if c == closer {
+				closers = closers[:len(closers)-1]
+				continue
+			}
+			if c != ',' {
+				return s.errorf("expected ',' or '%c'", closer)
+			}
+			s.skipSpace()
+			if closer == '}' {
+				if err := s.skipKey(); err != nil {
+					return err
+				}
+			}
+			break
+		}
+	}
+}
+
+// Skips an object key and the colon after it.
+func (s *jsonScanner) skipKey() error {
+	if s.pos >= len(s.data) || s.data[s.pos] != '"' {
+		return s.errorf("expected an object key")
+	}
+	if _, err := s.str(); err != nil {
+		return err
+	}
+	s.skipSpace()
+	if s.pos >= len(s.data) || s.data[s.pos] != ':' {
+		return s.errorf("expected ':' after object key")
+	}
+	s.pos++
+	s.skipSpace()
+	return nil
+}
+
+// Parses the string starting at the current position.
+func (s *jsonScanner) str() (string, error) {
+	s.pos++ // opening quote
+	start := s.pos
+	for s.pos < len(s.data) {
+		c := s.data[s.pos]
+		if c == '"' {
+			s.pos++
+			return s.data[start : s.pos-1], nil
+		}
+		if c == '\\' {
+			return s.unescape(start)
+		}
+		if c < 0x20 {
+			return "", s.errorf("control character in string")
+		}
+		s.pos++
+	}
+	return "", s.errorf("unterminated string")
+}
+
+// Slow path of str for strings containing escapes, which have to be copied.
+func (s *jsonScanner) unescape(start int) (string, error) {
+	buf := make([]byte, 0, s.pos-start+16)
+	buf = append(buf, s.data[start:s.pos]...)
+	for s.pos < len(s.data) {
+		c := s.data[s.pos]
+		switch {
+		case c == '"':
+			s.pos++
+			return string(buf), nil
+		case c < 0x20:
+			return "", s.errorf("control character in string")
+		case c != '\\':
+			buf = append(buf, c)
+			s.pos++
+			continue
+		}
+		s.pos++
+		if s.pos >= len(s.data) {
+			break
+		}
+		switch s.data[s.pos] {
+		case '"', '\\', '/':
+			buf = append(buf, s.data[s.pos])
+		case 'b':
+			buf = append(buf, '\b')
+		case 'f':
+			buf = append(buf, '\f')
+		case 'n':
+			buf = append(buf, '\n')
+		case 'r':
+			buf = append(buf, '\r')
+		case 't':
+			buf = append(buf, '\t')
+		case 'u':
+			r, ok := s.hex4(s.pos + 1)
+			if !ok {
+				return "", s.errorf("invalid unicode escape")
+			}
+			s.pos += 4
+			if utf16.IsSurrogate(r) {
+				// Pairs w/ a following low surrogate, if there's one.
+				r2, ok := rune(-1), false
+				if s.pos+2 < len(s.data) && s.data[s.pos+1] == '\\' && s.data[s.pos+2] == 'u' {
+					r2, ok = s.hex4(s.pos + 3)
+				}
+				if dec := utf16.DecodeRune(r, r2); ok && dec != utf8.RuneError {
+					r = dec
+					s.pos += 6
+				} else {
+					r = utf8.RuneError
+				}
+			}
+			var enc [utf8.UTFMax]byte
+			n := utf8.EncodeRune(enc[:], r)
+			buf = append(buf, enc[:n]...)
+		default:
+			return "", s.errorf("invalid escape character")
+		}
+		s.pos++
+	}
+	return "", s.errorf("unterminated string")
+}
+
+func (s *jsonScanner) hex4(pos int) (rune, bool) {
+	if pos+4 > len(s.data) {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(s.data[pos:pos+4], 16, 16)
+	return rune(n), err == nil
+}
+
+// Flattener using the encoding/json package.
+func unmarshalJson(data string, maxDepth uint, sep string, emit jsonEmitter) error {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(data), &obj); err != nil {
+		return err
+	}
+	if obj == nil {
+		return errJsonNotObject
+	}
+	return flattenJson(obj, "", 1, maxDepth, sep, emit)
+}
+
+func flattenJson(obj map[string]json.RawMessage, prefix string, depth, maxDepth uint,
+	sep string, emit jsonEmitter) (err error) {
+
+	// Sorted, as map order is random.
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		raw := obj[key]
+		name := key
+		if prefix != "" {
+			name = prefix + sep + key
+		}
+		var val jsonValue
+		switch raw[0] {
+		case '{':
+			if maxDepth == 0 || depth < maxDepth {
+				var nested map[string]json.RawMessage
+				if err = json.Unmarshal(raw, &nested); err != nil {
+					return err
+				}
+				if err = flattenJson(nested, name, depth+1, maxDepth, sep, emit); err != nil {
+					return err
+				}
+				continue
+			}
+			val.kind, val.str = jsonRaw, string(raw)
+		case '[':
+			val.kind, val.str = jsonRaw, string(raw)
+		case '"':
+			err = json.Unmarshal(raw, &val.str)
+		case 't', 'f':
+			val.kind = jsonBool
+			err = json.Unmarshal(raw, &val.b)
+		case 'n':
+			val.kind = jsonNull
+		default:
+			val.kind, val.str = jsonNumber, string(raw)
+			val.num, err = strconv.ParseFloat(val.str, 64)
+		}
+		if err != nil {
+			return err
+		}
+		if err = emit(name, depth == 1, val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
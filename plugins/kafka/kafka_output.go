@@ -38,6 +38,8 @@ type KafkaOutputConfig struct {
 	MetadataRetries            int    `toml:"metadata_retries"`
 	WaitForElection            uint32 `toml:"wait_for_election"`
 	BackgroundRefreshFrequency uint32 `toml:"background_refresh_frequency"`
+	// Resolves the bootstrap brokers instead of Addrs
+	Discovery *tcp.DiscoveryConfig
 
 	// TLS Config
 	UseTls bool `toml:"use_tls"`
@@ -207,7 +209,11 @@ func (k *KafkaOutput) SetPipelineConfig(pConfig *pipeline.PipelineConfig) {
 
 func (k *KafkaOutput) Init(config interface{}) (err error) {
 	k.config = config.(*KafkaOutputConfig)
-	if len(k.config.Addrs) == 0 {
+	if k.config.Discovery != nil {
+		if len(k.config.Addrs) > 0 {
+			return errors.New("addrs and discovery cannot both be set")
+		}
+	} else if len(k.config.Addrs) == 0 {
 		return errors.New("addrs must have at least one entry")
 	}
 
@@ -289,11 +295,23 @@ func (k *KafkaOutput) Init(config interface{}) (err error) {
 	k.saramaConfig.Producer.Flush.Bytes = int(k.config.MaxBufferedBytes)
 	k.saramaConfig.Producer.Flush.Frequency = time.Duration(k.config.MaxBufferTime) * time.Millisecond
 
-	k.client, err = sarama.NewClient(k.config.Addrs, k.saramaConfig)
+	addrs := k.config.Addrs
+	if k.config.Discovery != nil {
+		// Resolved again whenever the plugin is restarted.
+		var resolver *tcp.Resolver
+		if resolver, err = tcp.NewResolver(k.config.Discovery); err != nil {
+			return err
+		}
+		if addrs, err = resolver.Addrs(); err != nil {
+			return err
+		}
+	}
+
+	k.client, err = sarama.NewClient(addrs, k.saramaConfig)
 	if err != nil {
 		return err
 	}
-	k.producer, err = sarama.NewAsyncProducer(k.config.Addrs, k.saramaConfig)
+	k.producer, err = sarama.NewAsyncProducer(addrs, k.saramaConfig)
 	return err
 }
 
@@ -0,0 +1,496 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package kubernetes
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	ls "github.com/mozilla-services/heka/logstreamer"
+	"github.com/mozilla-services/heka/message"
+	p "github.com/mozilla-services/heka/pipeline"
+)
+
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	// The kubelet names container log files
+	// <pod>_<namespace>_<container>-<container id>.log.
+	containerLogMatch = `(?P<PodName>[^_/]+)_(?P<Namespace>[^_/]+)_(?P<ContainerName>[^_/]+)-(?P<ContainerId>[0-9a-f]{64})\.log$`
+)
+
+// Logstream names are the log file names w/o the extension.
+var (
+	streamDifferentiator = []string{"PodName", "_", "Namespace", "_", "ContainerName",
+		"-", "ContainerId"}
+	streamNameRegex = regexp.MustCompile(`^([^_]+)_([^_]+)_([^_]+)-([0-9a-f]{64})$`)
+)
+
+type KubernetesInputConfig struct {
+	// Directory containing the container log files (or symlinks to them).
+	LogDirectory string `toml:"log_directory"`
+	// Directory in which the read position of each log file is saved.
+	JournalDirectory string `toml:"journal_directory"`
+	// Log line format, one of "docker", "cri", or "auto".
+	Format string `toml:"format"`
+	// How often to look for new container log files.
+	RescanInterval string `toml:"rescan_interval"`
+	// How often to check the log files for new data.
+	CheckDataInterval string `toml:"check_data_interval"`
+	// Log files that haven't been modified for this long are ignored.
+	OldestDuration string `toml:"oldest_duration"`
+	// Whether to start reading files from the end the first time they're
+	// seen.
+	InitialTail bool `toml:"initial_tail"`
+	// So we can default to TokenSplitter.
+	Splitter string
+	// Whether to watch the Kubernetes API for pod metadata.
+	WatchPods bool `toml:"watch_pods"`
+	// Kubernetes API server URL, defaults to the in cluster service address.
+	ApiServerUrl string `toml:"api_server_url"`
+	// Service account credentials used to talk to the API server.
+	TokenFile string `toml:"token_file"`
+	CaFile    string `toml:"ca_file"`
+	// Only pods scheduled on this node are watched, defaults to $NODE_NAME.
+	NodeName string `toml:"node_name"`
+	// How often the full pod list is refetched from the API server.
+	ResyncInterval string `toml:"resync_interval"`
+}
+
+// Input that tails the log files the kubelet creates for every container on
+// a node, tagging each message with the container's pod metadata.
+type KubernetesInput struct {
+	pConfig           *p.PipelineConfig
+	logstreamSet      *ls.LogstreamSet
+	informer          *podInformer
+	parse             func(line []byte, entry *logEntry) error
+	rescanInterval    time.Duration
+	checkDataInterval time.Duration
+	hostName          string
+	logDirectory      string
+	ir                p.InputRunner
+	streamsLock       sync.Mutex
+	streams           map[string]*containerStream
+	streamCount       int
+	wg                sync.WaitGroup
+	stopChan          chan struct{}
+}
+
+func (ki *KubernetesInput) SetPipelineConfig(pConfig *p.PipelineConfig) {
+	ki.pConfig = pConfig
+}
+
+func (ki *KubernetesInput) ConfigStruct() interface{} {
+	baseDir := ki.pConfig.Globals.BaseDir
+	return &KubernetesInputConfig{
+		LogDirectory:      "/var/log/containers",
+		JournalDirectory:  filepath.Join(baseDir, "kubernetes"),
+		Format:            "auto",
+		RescanInterval:    "5s",
+		CheckDataInterval: "250ms",
+		OldestDuration:    "720h",
+		Splitter:          "TokenSplitter",
+		WatchPods:         true,
+		TokenFile:         filepath.Join(serviceAccountDir, "token"),
+		CaFile:            filepath.Join(serviceAccountDir, "ca.crt"),
+		NodeName:          os.Getenv("NODE_NAME"),
+		ResyncInterval:    "10m",
+	}
+}
+
+func (ki *KubernetesInput) Init(config interface{}) (err error) {
+	var oldest time.Duration
+	conf := config.(*KubernetesInputConfig)
+
+	switch conf.Format {
+	case "auto":
+		ki.parse = parseAutoLine
+	case "docker":
+		ki.parse = parseDockerLine
+	case "cri":
+		ki.parse = parseCriLine
+	default:
+		return fmt.Errorf("format must be 'auto', 'docker', or 'cri', got '%s'",
+			conf.Format)
+	}
+	if ki.rescanInterval, err = time.ParseDuration(conf.RescanInterval); err != nil {
+		return
+	}
+	if ki.checkDataInterval, err = time.ParseDuration(conf.CheckDataInterval); err != nil {
+		return
+	}
+	if oldest, err = time.ParseDuration(conf.OldestDuration); err != nil {
+		return
+	}
+	if err = os.MkdirAll(conf.JournalDirectory, 0744); err != nil {
+		return
+	}
+
+	sp := &ls.SortPattern{
+		FileMatch:      containerLogMatch,
+		Differentiator: streamDifferentiator,
+	}
+	ki.logstreamSet, err = ls.NewLogstreamSet(sp, oldest, conf.LogDirectory,
+		conf.JournalDirectory, conf.InitialTail)
+	if err != nil {
+		return
+	}
+
+	if conf.WatchPods {
+		if ki.informer, err = newPodInformer(conf); err != nil {
+			return
+		}
+	}
+	ki.logDirectory = conf.LogDirectory
+	ki.hostName = ki.pConfig.Hostname()
+	ki.streams = make(map[string]*containerStream)
+	ki.stopChan = make(chan struct{})
+	return nil
+}
+
+func (ki *KubernetesInput) Run(ir p.InputRunner, h p.PluginHelper) error {
+	ki.ir = ir
+	if ki.informer != nil {
+		ki.informer.logError = ir.LogError
+		go ki.informer.run()
+	}
+
+	ki.scan()
+	rescan := ki.pConfig.Globals.Clock.NewTicker(ki.rescanInterval)
+	defer rescan.Stop()
+	for {
+		select {
+		case <-rescan.Chan():
+			ki.scan()
+		case <-ki.stopChan:
+			if ki.informer != nil {
+				ki.informer.stop()
+			}
+			ki.wg.Wait()
+			return nil
+		}
+	}
+}
+
+// Looks for new container log files, starting a goroutine to read from each
+// one that's found.
+func (ki *KubernetesInput) scan() {
+	names, errs := ki.logstreamSet.ScanForLogstreams()
+	if errs.IsError() {
+		ki.ir.LogError(errs)
+	}
+	for _, name := range names {
+		stream, ok := ki.logstreamSet.GetLogstream(name)
+		if !ok {
+			ki.ir.LogError(fmt.Errorf("Found new logstream: %s, but couldn't fetch it.",
+				name))
+			continue
+		}
+		matches := streamNameRegex.FindStringSubmatch(name)
+		if matches == nil {
+			continue
+		}
+		cs := &containerStream{
+			ki:          ki,
+			stream:      stream,
+			name:        name,
+			path:        filepath.Join(ki.logDirectory, name+".log"),
+			pod:         matches[1],
+			namespace:   matches[2],
+			container:   matches[3],
+			containerId: matches[4],
+		}
+		ki.streamsLock.Lock()
+		ki.streams[name] = cs
+		ki.streamCount++
+		token := strconv.Itoa(ki.streamCount)
+		ki.streamsLock.Unlock()
+
+		cs.deliverer = ki.ir.NewDeliverer(token)
+		cs.sRunner = ki.ir.NewSplitterRunner(token)
+		ki.wg.Add(1)
+		go cs.run()
+	}
+}
+
+// Called by a container stream once its log file has been removed and fully
+// read, so we don't hold on to it forever.
+func (ki *KubernetesInput) removeStream(cs *containerStream) {
+	ki.streamsLock.Lock()
+	delete(ki.streams, cs.name)
+	ki.streamsLock.Unlock()
+	if err := ki.logstreamSet.RemoveLogstream(cs.name); err != nil {
+		ki.ir.LogError(fmt.Errorf("removing %s logstream: %s", cs.name, err))
+	}
+}
+
+func (ki *KubernetesInput) Stop() {
+	close(ki.stopChan)
+}
+
+// ReportMsg provides plugin state to Heka report and dashboard.
+func (ki *KubernetesInput) ReportMsg(msg *message.Message) error {
+	ki.streamsLock.Lock()
+	streamCount := len(ki.streams)
+	ki.streamsLock.Unlock()
+	message.NewIntField(msg, "ContainerLogCount", streamCount, "count")
+	if ki.informer != nil {
+		message.NewIntField(msg, "CachedPodCount", ki.informer.podCount(), "count")
+	}
+	return nil
+}
+
+// A single decoded container log line.
+type logEntry struct {
+	stream    string
+	timestamp int64
+	log       []byte
+	// Whether the log line continues in the next entry.
+	partial bool
+}
+
+type dockerLogLine struct {
+	Log    string    `json:"log"`
+	Stream string    `json:"stream"`
+	Time   time.Time `json:"time"`
+}
+
+// Parses a line written by Docker's json-file logging driver, e.g.
+// {"log":"hello\n","stream":"stdout","time":"2016-04-05T17:18:11.123Z"}.
+func parseDockerLine(line []byte, entry *logEntry) error {
+	dl := new(dockerLogLine)
+	if err := json.Unmarshal(line, dl); err != nil {
+		return fmt.Errorf("invalid docker log line: %s", err)
+	}
+	entry.stream = dl.Stream
+	entry.timestamp = dl.Time.UnixNano()
+	entry.log = []byte(dl.Log)
+	// Docker splits long lines across multiple entries, only the last of
+	// which ends with a newline.
+	if n := len(entry.log); n > 0 && entry.log[n-1] == '\n' {
+		entry.log = entry.log[:n-1]
+		entry.partial = false
+	} else {
+		entry.partial = true
+	}
+	return nil
+}
+
+// Parses a line written by a CRI container runtime, e.g.
+// 2016-04-05T17:18:11.123456789Z stdout F hello.
+func parseCriLine(line []byte, entry *logEntry) error {
+	parts := bytes.SplitN(line, []byte(" "), 4)
+	if len(parts) < 3 {
+		return fmt.Errorf("invalid CRI log line: %q", line)
+	}
+	t, err := time.Parse(time.RFC3339Nano, string(parts[0]))
+	if err != nil {
+		return fmt.Errorf("invalid CRI log line timestamp: %s", err)
+	}
+	entry.stream = string(parts[1])
+	entry.timestamp = t.UnixNano()
+	entry.partial = false
+	switch tag := string(parts[2]); tag {
+	case "P", "F":
+		entry.partial = tag == "P"
+		entry.log = nil
+		if len(parts) == 4 {
+			entry.log = parts[3]
+		}
+	default:
+		// Older runtimes don't write the partial / full tag.
+		entry.log = bytes.SplitN(line, []byte(" "), 3)[2]
+	}
+	return nil
+}
+
+func parseAutoLine(line []byte, entry *logEntry) error {
+	if line[0] == '{' {
+		return parseDockerLine(line, entry)
+	}
+	return parseCriLine(line, entry)
+}
+
+// Reads the log file of a single container.
+type containerStream struct {
+	ki            *KubernetesInput
+	stream        *ls.Logstream
+	name          string
+	path          string
+	pod           string
+	namespace     string
+	container     string
+	containerId   string
+	deliverer     p.Deliverer
+	sRunner       p.SplitterRunner
+	entry         logEntry
+	partial       []byte
+	prevTruncated bool
+	recordCount   int
+}
+
+func (cs *containerStream) run() {
+	defer cs.ki.wg.Done()
+	if !cs.sRunner.UseMsgBytes() {
+		cs.sRunner.SetPackDecorator(cs.packDecorator)
+	}
+
+	tick := cs.ki.pConfig.Globals.Clock.NewTicker(cs.ki.checkDataInterval)
+	defer tick.Stop()
+	removed := false
+	for !removed {
+		err := cs.deliverRecords()
+		// Save our position if the stream hasn't done so for us, unless
+		// we're in the middle of a partial line.
+		if err != io.EOF && len(cs.partial) == 0 {
+			cs.stream.SavePosition()
+		}
+		cs.recordCount = 0
+		if err != nil && err != io.EOF {
+			cs.ki.ir.LogError(fmt.Errorf("%s: %s", cs.name, err))
+		}
+
+		// The kubelet removes the log file symlink when the container is
+		// deleted, at which point we've read everything there is to read.
+		if err == io.EOF {
+			if _, statErr := os.Stat(cs.path); os.IsNotExist(statErr) {
+				removed = true
+				continue
+			}
+		}
+
+		select {
+		case <-cs.ki.stopChan:
+			cs.deliverer.Done()
+			cs.sRunner.Done()
+			return
+		case <-tick.Chan():
+		}
+	}
+	if len(cs.partial) > 0 {
+		cs.deliver(cs.partial)
+	}
+	cs.deliverer.Done()
+	cs.sRunner.Done()
+	cs.ki.removeStream(cs)
+}
+
+func (cs *containerStream) deliverRecords() (err error) {
+	var (
+		record []byte
+		n      int
+	)
+	for err == nil {
+		select {
+		case <-cs.ki.stopChan:
+			return
+		default:
+		}
+		truncated := false
+		n, record, err = cs.sRunner.GetRecordFromStream(cs.stream)
+		if err == io.ErrShortBuffer {
+			cs.ki.ir.LogError(fmt.Errorf("%s: record exceeded MAX_RECORD_SIZE %d and was dropped",
+				cs.name, message.MAX_RECORD_SIZE))
+			err = nil // non-fatal, keep going
+			truncated = true
+		}
+		if n > 0 {
+			cs.stream.FlushBuffer(n)
+		}
+		// The remainder of a truncated record is dropped as well.
+		if len(record) > 0 && !truncated && !cs.prevTruncated {
+			cs.handleRecord(record)
+		}
+		cs.prevTruncated = truncated
+	}
+	return err
+}
+
+// Parses a single log line, delivering it unless it's the start of a line
+// that's split across multiple entries, in which case it's held until the
+// rest of it arrives.
+func (cs *containerStream) handleRecord(record []byte) {
+	record = bytes.TrimRight(record, "\r\n")
+	if len(record) == 0 {
+		return
+	}
+	if err := cs.ki.parse(record, &cs.entry); err != nil {
+		cs.ki.ir.LogError(fmt.Errorf("%s: %s", cs.name, err))
+		return
+	}
+	if cs.entry.partial &&
+		len(cs.partial)+len(cs.entry.log) < int(message.MAX_RECORD_SIZE) {
+
+		cs.partial = append(cs.partial, cs.entry.log...)
+		return
+	}
+	log := cs.entry.log
+	if len(cs.partial) > 0 {
+		// The timestamp and stream of the final entry are used.
+		log = append(cs.partial, log...)
+	}
+	cs.deliver(log)
+}
+
+func (cs *containerStream) deliver(log []byte) {
+	cs.sRunner.DeliverRecord(log, cs.deliverer)
+	cs.partial = cs.partial[:0]
+	cs.recordCount++
+	if cs.recordCount > 500 {
+		cs.stream.SavePosition()
+		cs.recordCount = 0
+	}
+}
+
+func (cs *containerStream) packDecorator(pack *p.PipelinePack) {
+	msg := pack.Message
+	msg.SetType("KubernetesLog")
+	msg.SetLogger(cs.entry.stream) // stdout or stderr
+	msg.SetHostname(cs.ki.hostName)
+	if cs.entry.timestamp > 0 {
+		msg.SetTimestamp(cs.entry.timestamp)
+	}
+	message.NewStringField(msg, "KubernetesPodName", cs.pod)
+	message.NewStringField(msg, "KubernetesNamespace", cs.namespace)
+	message.NewStringField(msg, "KubernetesContainerName", cs.container)
+	message.NewStringField(msg, "ContainerId", cs.containerId)
+	if cs.ki.informer == nil {
+		return
+	}
+	meta := cs.ki.informer.get(cs.namespace, cs.pod)
+	if meta == nil {
+		return
+	}
+	message.NewStringField(msg, "KubernetesPodUid", meta.uid)
+	if meta.nodeName != "" {
+		message.NewStringField(msg, "KubernetesNodeName", meta.nodeName)
+	}
+	for _, name := range meta.labelNames {
+		message.NewStringField(msg, "KubernetesLabel_"+name, meta.labels[name])
+	}
+}
+
+func init() {
+	p.RegisterPlugin("KubernetesInput", func() interface{} {
+		return new(KubernetesInput)
+	})
+}
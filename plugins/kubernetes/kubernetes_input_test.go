@@ -0,0 +1,368 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package kubernetes
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	"github.com/mozilla-services/heka/pipelinemock"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func TestAllSpecs(t *testing.T) {
+	r := gs.NewRunner()
+	r.Parallel = false
+	r.AddSpec(LogLineParsingSpec)
+	r.AddSpec(PodInformerSpec)
+	r.AddSpec(KubernetesInputSpec)
+	gs.MainGoTest(r, t)
+}
+
+const testPodList = `{"metadata": {"resourceVersion": "10"}, "items": [
+	{"metadata": {"name": "web-1", "namespace": "prod", "uid": "abc-123",
+	 "resourceVersion": "9", "labels": {"tier": "frontend", "app": "web"}},
+	 "spec": {"nodeName": "node-3"}}
+]}`
+
+// Serves a pod list and, for watch requests, the provided events. Watches
+// are held open until the returned channel is closed.
+func newApiServer(events func(r *http.Request) string) (*httptest.Server, chan struct{}) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+
+		if r.URL.Path != "/api/v1/pods" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.URL.Query().Get("watch") != "true" {
+			w.Write([]byte(testPodList))
+			return
+		}
+		body := events(r)
+		w.Write([]byte(body))
+		if !strings.Contains(body, `"ERROR"`) {
+			w.(http.Flusher).Flush()
+			<-done
+		}
+	}))
+	return server, done
+}
+
+func LogLineParsingSpec(c gs.Context) {
+	entry := new(logEntry)
+	ts := int64(1459876691123456789)
+
+	c.Specify("Docker log lines", func() {
+		c.Specify("are parsed", func() {
+			line := `{"log":"hello world\n","stream":"stderr","time":"2016-04-05T17:18:11.123456789Z"}`
+			err := parseDockerLine([]byte(line), entry)
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(entry.log), gs.Equals, "hello world")
+			c.Expect(entry.stream, gs.Equals, "stderr")
+			c.Expect(entry.timestamp, gs.Equals, ts)
+			c.Expect(entry.partial, gs.IsFalse)
+		})
+
+		c.Specify("w/o a trailing newline are partial", func() {
+			line := `{"log":"hello","stream":"stdout","time":"2016-04-05T17:18:11.123456789Z"}`
+			err := parseDockerLine([]byte(line), entry)
+			c.Expect(err, gs.IsNil)
+			c.Expect(entry.partial, gs.IsTrue)
+		})
+
+		c.Specify("that are invalid return an error", func() {
+			err := parseDockerLine([]byte(`{"log":`), entry)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+
+	c.Specify("CRI log lines", func() {
+		c.Specify("are parsed", func() {
+			line := "2016-04-05T17:18:11.123456789Z stdout F hello world"
+			err := parseCriLine([]byte(line), entry)
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(entry.log), gs.Equals, "hello world")
+			c.Expect(entry.stream, gs.Equals, "stdout")
+			c.Expect(entry.timestamp, gs.Equals, ts)
+			c.Expect(entry.partial, gs.IsFalse)
+		})
+
+		c.Specify("tagged P are partial", func() {
+			line := "2016-04-05T17:18:11.123456789Z stdout P hello"
+			err := parseCriLine([]byte(line), entry)
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(entry.log), gs.Equals, "hello")
+			c.Expect(entry.partial, gs.IsTrue)
+		})
+
+		c.Specify("w/o a tag are parsed", func() {
+			line := "2016-04-05T17:18:11.123456789Z stdout hello world"
+			err := parseCriLine([]byte(line), entry)
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(entry.log), gs.Equals, "hello world")
+			c.Expect(entry.partial, gs.IsFalse)
+		})
+
+		c.Specify("that are invalid return an error", func() {
+			err := parseCriLine([]byte("hello world"), entry)
+			c.Expect(err, gs.Not(gs.IsNil))
+			err = parseCriLine([]byte("yesterday stdout F hello"), entry)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+
+	c.Specify("Auto detection handles both formats", func() {
+		err := parseAutoLine([]byte(`{"log":"a\n","stream":"stdout","time":"2016-04-05T17:18:11Z"}`),
+			entry)
+		c.Expect(err, gs.IsNil)
+		c.Expect(string(entry.log), gs.Equals, "a")
+		err = parseAutoLine([]byte("2016-04-05T17:18:11Z stdout F b"), entry)
+		c.Expect(err, gs.IsNil)
+		c.Expect(string(entry.log), gs.Equals, "b")
+	})
+}
+
+func PodInformerSpec(c gs.Context) {
+	var events string
+	watchVersion := make(chan string, 10)
+	server, done := newApiServer(func(r *http.Request) string {
+		watchVersion <- r.URL.Query().Get("resourceVersion")
+		return events
+	})
+	defer server.Close()
+	defer close(done)
+
+	conf := &KubernetesInputConfig{
+		ApiServerUrl:   server.URL,
+		NodeName:       "node-3",
+		ResyncInterval: "10m",
+	}
+
+	c.Specify("A podInformer", func() {
+		pi, err := newPodInformer(conf)
+		c.Assume(err, gs.IsNil)
+		c.Expect(pi.fieldSelector, gs.Equals, "spec.nodeName=node-3")
+
+		c.Specify("lists pods", func() {
+			err = pi.list()
+			c.Expect(err, gs.IsNil)
+			c.Expect(pi.resourceVersion, gs.Equals, "10")
+			meta := pi.get("prod", "web-1")
+			c.Assume(meta, gs.Not(gs.IsNil))
+			c.Expect(meta.uid, gs.Equals, "abc-123")
+			c.Expect(meta.nodeName, gs.Equals, "node-3")
+			c.Expect(strings.Join(meta.labelNames, ","), gs.Equals, "app,tier")
+			c.Expect(pi.get("prod", "web-2"), gs.IsNil)
+		})
+
+		c.Specify("applies watch events", func() {
+			events = `{"type": "ADDED", "object": {"metadata": {"name": "web-2",
+				"namespace": "prod", "resourceVersion": "11"}}}
+				{"type": "DELETED", "object": {"metadata": {"name": "web-1",
+				"namespace": "prod", "resourceVersion": "12"}}}`
+			err = pi.list()
+			c.Assume(err, gs.IsNil)
+			watchErr := make(chan error, 1)
+			go func() {
+				watchErr <- pi.watchOnce(60)
+			}()
+			c.Expect(<-watchVersion, gs.Equals, "10")
+			c.Expect(func() bool {
+				return pi.get("prod", "web-2") != nil
+			}, gs.IsTrue.Eventually())
+			c.Expect(func() bool {
+				return !pi.get("prod", "web-1").deleted.IsZero()
+			}, gs.IsTrue.Eventually())
+			pi.stop()
+			c.Expect(<-watchErr, gs.IsNil)
+			c.Expect(pi.resourceVersion, gs.Equals, "12")
+
+			c.Specify("and keeps deleted pods until they expire", func() {
+				err = pi.list()
+				c.Expect(err, gs.IsNil)
+				c.Expect(pi.get("prod", "web-2"), gs.Not(gs.IsNil))
+				pi.get("prod", "web-2").deleted = time.Now().Add(-time.Hour)
+				err = pi.list()
+				c.Expect(err, gs.IsNil)
+				c.Expect(pi.get("prod", "web-2"), gs.IsNil)
+			})
+		})
+
+		c.Specify("relists when the watch expires", func() {
+			events = `{"type": "ERROR", "object": {"kind": "Status", "code": 410,
+				"message": "too old resource version"}}`
+			err = pi.list()
+			c.Assume(err, gs.IsNil)
+			err = pi.watchOnce(60)
+			c.Expect(err, gs.Equals, errWatchExpired)
+			err = pi.watch()
+			c.Expect(err, gs.IsNil)
+		})
+
+		c.Specify("reports watch errors", func() {
+			events = `{"type": "ERROR", "object": {"kind": "Status", "code": 500,
+				"message": "boom"}}`
+			err = pi.watchOnce(60)
+			c.Expect(err.Error(), gs.Equals, "pod watch error: boom")
+		})
+
+		c.Specify("sends the service account token", func() {
+			tokenFile, err := ioutil.TempFile("", "token")
+			c.Assume(err, gs.IsNil)
+			defer os.Remove(tokenFile.Name())
+			tokenFile.WriteString("secret\n")
+			tokenFile.Close()
+
+			var auth string
+			authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+				r *http.Request) {
+				auth = r.Header.Get("Authorization")
+				w.Write([]byte(testPodList))
+			}))
+			defer authServer.Close()
+			conf.ApiServerUrl = authServer.URL
+			conf.TokenFile = tokenFile.Name()
+			pi, err = newPodInformer(conf)
+			c.Assume(err, gs.IsNil)
+			err = pi.list()
+			c.Expect(err, gs.IsNil)
+			c.Expect(auth, gs.Equals, "Bearer secret")
+		})
+	})
+}
+
+func KubernetesInputSpec(c gs.Context) {
+	t := &pipeline_ts.SimpleT{}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	tmpDir, err := ioutil.TempDir("", "kubernetes-tests")
+	c.Assume(err, gs.IsNil)
+	defer os.RemoveAll(tmpDir)
+	logDir := filepath.Join(tmpDir, "containers")
+	c.Assume(os.MkdirAll(logDir, 0755), gs.IsNil)
+	containerId := strings.Repeat("0123456789abcdef", 4)
+	logFile := filepath.Join(logDir, "web-1_prod_app-"+containerId+".log")
+	c.Assume(ioutil.WriteFile(logFile, []byte("\n"), 0644), gs.IsNil)
+
+	server, done := newApiServer(func(r *http.Request) string { return "" })
+	defer server.Close()
+	defer close(done)
+
+	globals := DefaultGlobals()
+	globals.BaseDir = tmpDir
+	pConfig := NewPipelineConfig(globals)
+	ir := pipelinemock.NewMockInputRunner(ctrl)
+	sr := pipelinemock.NewMockSplitterRunner(ctrl)
+	deliverer := pipelinemock.NewMockDeliverer(ctrl)
+	helper := pipelinemock.NewMockPluginHelper(ctrl)
+
+	c.Specify("A KubernetesInput", func() {
+		input := &KubernetesInput{pConfig: pConfig}
+		config := input.ConfigStruct().(*KubernetesInputConfig)
+		config.LogDirectory = logDir
+		config.ApiServerUrl = server.URL
+		config.TokenFile = ""
+		config.CaFile = ""
+
+		c.Specify("rejects unknown formats", func() {
+			config.Format = "syslog"
+			err := input.Init(config)
+			c.Expect(err.Error(), gs.Equals,
+				"format must be 'auto', 'docker', or 'cri', got 'syslog'")
+		})
+
+		c.Specify("delivers container log lines w/ pod metadata", func() {
+			err := input.Init(config)
+			c.Assume(err, gs.IsNil)
+			c.Assume(input.informer.list(), gs.IsNil)
+
+			ir.EXPECT().LogError(gomock.Any()).AnyTimes()
+			ir.EXPECT().NewDeliverer("1").Return(deliverer)
+			ir.EXPECT().NewSplitterRunner("1").Return(sr)
+			sr.EXPECT().UseMsgBytes().Return(false)
+			var decorator func(*PipelinePack)
+			sr.EXPECT().SetPackDecorator(gomock.Any()).Do(func(d func(*PipelinePack)) {
+				decorator = d
+			})
+			lines := []string{
+				`{"log":"hel","stream":"stdout","time":"2016-04-05T17:18:11Z"}`,
+				`{"log":"lo\n","stream":"stdout","time":"2016-04-05T17:18:12Z"}`,
+				"2016-04-05T17:18:13Z stderr P good",
+				"2016-04-05T17:18:14Z stderr F bye\n",
+			}
+			for _, line := range lines {
+				sr.EXPECT().GetRecordFromStream(gomock.Any()).Return(len(line),
+					[]byte(line), nil)
+			}
+			sr.EXPECT().GetRecordFromStream(gomock.Any()).Return(0, []byte{},
+				io.EOF).AnyTimes()
+
+			packs := make(chan *PipelinePack, 2)
+			sr.EXPECT().DeliverRecord(gomock.Any(), deliverer).Times(2).Do(
+				func(record []byte, del Deliverer) {
+					pack := NewPipelinePack(nil)
+					pack.Message.SetPayload(string(record))
+					decorator(pack)
+					packs <- pack
+				})
+			sr.EXPECT().Done()
+			deliverer.EXPECT().Done()
+
+			runErr := make(chan error, 1)
+			go func() {
+				runErr <- input.Run(ir, helper)
+			}()
+
+			pack := <-packs
+			msg := pack.Message
+			c.Expect(msg.GetPayload(), gs.Equals, "hello")
+			c.Expect(msg.GetType(), gs.Equals, "KubernetesLog")
+			c.Expect(msg.GetLogger(), gs.Equals, "stdout")
+			c.Expect(msg.GetTimestamp(), gs.Equals, int64(1459876692000000000))
+			value, _ := msg.GetFieldValue("KubernetesPodName")
+			c.Expect(value, gs.Equals, "web-1")
+			value, _ = msg.GetFieldValue("KubernetesNamespace")
+			c.Expect(value, gs.Equals, "prod")
+			value, _ = msg.GetFieldValue("KubernetesContainerName")
+			c.Expect(value, gs.Equals, "app")
+			value, _ = msg.GetFieldValue("ContainerId")
+			c.Expect(value, gs.Equals, containerId)
+			value, _ = msg.GetFieldValue("KubernetesPodUid")
+			c.Expect(value, gs.Equals, "abc-123")
+			value, _ = msg.GetFieldValue("KubernetesLabel_app")
+			c.Expect(value, gs.Equals, "web")
+
+			pack = <-packs
+			c.Expect(pack.Message.GetPayload(), gs.Equals, "goodbye")
+			c.Expect(pack.Message.GetLogger(), gs.Equals, "stderr")
+
+			input.Stop()
+			c.Expect(<-runErr, gs.IsNil)
+		})
+	})
+}
@@ -0,0 +1,370 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package kubernetes
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Returned when the API server no longer has the resource version we asked
+// to watch from, meaning we have to relist.
+var errWatchExpired = errors.New("pod watch resource version expired")
+
+// Pod metadata used to enrich container log messages.
+type podMeta struct {
+	uid        string
+	nodeName   string
+	labels     map[string]string
+	labelNames []string
+	// When the pod was deleted, zero if it still exists.
+	deleted time.Time
+}
+
+// Subset of the API server's pod representation that we care about.
+type kubePod struct {
+	Metadata struct {
+		Name            string            `json:"name"`
+		Namespace       string            `json:"namespace"`
+		Uid             string            `json:"uid"`
+		ResourceVersion string            `json:"resourceVersion"`
+		Labels          map[string]string `json:"labels"`
+	} `json:"metadata"`
+	Spec struct {
+		NodeName string `json:"nodeName"`
+	} `json:"spec"`
+}
+
+type kubePodList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []kubePod `json:"items"`
+}
+
+type kubeWatchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// Object sent along with ERROR watch events.
+type kubeStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func newPodMeta(pod *kubePod) *podMeta {
+	meta := &podMeta{
+		uid:        pod.Metadata.Uid,
+		nodeName:   pod.Spec.NodeName,
+		labels:     pod.Metadata.Labels,
+		labelNames: make([]string, 0, len(pod.Metadata.Labels)),
+	}
+	for name := range meta.labels {
+		meta.labelNames = append(meta.labelNames, name)
+	}
+	sort.Strings(meta.labelNames)
+	return meta
+}
+
+// Keeps a local cache of pod metadata in sync with the Kubernetes API server
+// in the same way the Kubernetes client informers do, i.e. by listing all of
+// the pods and then watching for changes, relisting every resync interval or
+// whenever the watch can't be resumed. Deleted pods are kept around for one
+// resync interval so messages from their log files can still be enriched
+// while the files are drained.
+type podInformer struct {
+	apiUrl         string
+	tokenFile      string
+	fieldSelector  string
+	resyncInterval time.Duration
+	retryInterval  time.Duration
+	client         *http.Client
+	logError       func(error)
+	podsLock       sync.RWMutex
+	pods           map[string]*podMeta
+	// Only accessed from the informer's goroutine.
+	resourceVersion string
+	// Response body of the in-flight watch request, closed to interrupt it.
+	bodyLock sync.Mutex
+	body     io.Closer
+	stopChan chan struct{}
+	stopOnce sync.Once
+}
+
+func newPodInformer(conf *KubernetesInputConfig) (*podInformer, error) {
+	resyncInterval, err := time.ParseDuration(conf.ResyncInterval)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse resync_interval value '%s': %s",
+			conf.ResyncInterval, err)
+	}
+	if resyncInterval < time.Second {
+		return nil, errors.New("resync_interval must be at least one second")
+	}
+
+	apiUrl := conf.ApiServerUrl
+	if apiUrl == "" {
+		// Use the service environment variables set in every pod if present.
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host != "" && port != "" {
+			apiUrl = fmt.Sprintf("https://%s:%s", host, port)
+		} else {
+			apiUrl = "https://kubernetes.default.svc"
+		}
+	}
+
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if conf.CaFile != "" {
+		pem, err := ioutil.ReadFile(conf.CaFile)
+		if err == nil {
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in ca_file '%s'", conf.CaFile)
+			}
+			transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		} else if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("can't read ca_file '%s': %s", conf.CaFile, err)
+		}
+	}
+
+	pi := &podInformer{
+		apiUrl:         strings.TrimRight(apiUrl, "/"),
+		tokenFile:      conf.TokenFile,
+		resyncInterval: resyncInterval,
+		retryInterval:  5 * time.Second,
+		client:         &http.Client{Transport: transport},
+		pods:           make(map[string]*podMeta),
+		stopChan:       make(chan struct{}),
+	}
+	if conf.NodeName != "" {
+		pi.fieldSelector = "spec.nodeName=" + conf.NodeName
+	}
+	return pi, nil
+}
+
+// Returns the cached metadata for the specified pod, or nil if we don't know
+// about it (yet).
+func (pi *podInformer) get(namespace, name string) *podMeta {
+	pi.podsLock.RLock()
+	defer pi.podsLock.RUnlock()
+	return pi.pods[namespace+"/"+name]
+}
+
+func (pi *podInformer) podCount() int {
+	pi.podsLock.RLock()
+	defer pi.podsLock.RUnlock()
+	return len(pi.pods)
+}
+
+func (pi *podInformer) run() {
+	for !pi.isStopped() {
+		err := pi.list()
+		if err == nil {
+			err = pi.watch()
+		}
+		if err == nil {
+			continue
+		}
+		pi.logError(err)
+		select {
+		case <-time.After(pi.retryInterval):
+		case <-pi.stopChan:
+		}
+	}
+}
+
+func (pi *podInformer) stop() {
+	pi.stopOnce.Do(func() {
+		close(pi.stopChan)
+		pi.bodyLock.Lock()
+		if pi.body != nil {
+			pi.body.Close()
+		}
+		pi.bodyLock.Unlock()
+	})
+}
+
+func (pi *podInformer) isStopped() bool {
+	select {
+	case <-pi.stopChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// Issues a GET request against the API server's pod collection.
+func (pi *podInformer) request(params url.Values) (*http.Response, error) {
+	if pi.fieldSelector != "" {
+		params.Set("fieldSelector", pi.fieldSelector)
+	}
+	req, err := http.NewRequest("GET", pi.apiUrl+"/api/v1/pods?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	// Service account tokens can be rotated, so we reread it every time.
+	if pi.tokenFile != "" {
+		if token, err := ioutil.ReadFile(pi.tokenFile); err == nil {
+			req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+		}
+	}
+	resp, err := pi.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("pod request returned status %d", resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// Replaces the cache contents with a full listing of pods from the API
+// server.
+func (pi *podInformer) list() error {
+	resp, err := pi.request(url.Values{})
+	if err != nil {
+		return fmt.Errorf("can't list pods: %s", err)
+	}
+	defer resp.Body.Close()
+	podList := new(kubePodList)
+	if err = json.NewDecoder(resp.Body).Decode(podList); err != nil {
+		return fmt.Errorf("can't parse pod list: %s", err)
+	}
+
+	pods := make(map[string]*podMeta, len(podList.Items))
+	for i := range podList.Items {
+		pod := &podList.Items[i]
+		pods[pod.Metadata.Namespace+"/"+pod.Metadata.Name] = newPodMeta(pod)
+	}
+	now := time.Now()
+	pi.podsLock.Lock()
+	for key, meta := range pi.pods {
+		if _, ok := pods[key]; ok {
+			continue
+		}
+		// We may have missed the delete event, so treat pods that disappeared
+		// as having been deleted just now.
+		if meta.deleted.IsZero() {
+			meta.deleted = now
+		}
+		if now.Sub(meta.deleted) < pi.resyncInterval {
+			pods[key] = meta
+		}
+	}
+	pi.pods = pods
+	pi.podsLock.Unlock()
+	pi.resourceVersion = podList.Metadata.ResourceVersion
+	return nil
+}
+
+// Watches for pod changes until it's time to resync, resuming the watch
+// whenever the API server times it out.
+func (pi *podInformer) watch() error {
+	deadline := time.Now().Add(pi.resyncInterval)
+	for !pi.isStopped() {
+		remaining := deadline.Sub(time.Now())
+		if remaining <= 0 {
+			return nil
+		}
+		err := pi.watchOnce(int(remaining/time.Second) + 1)
+		if err == errWatchExpired {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (pi *podInformer) watchOnce(timeout int) error {
+	params := url.Values{}
+	params.Set("watch", "true")
+	params.Set("resourceVersion", pi.resourceVersion)
+	params.Set("timeoutSeconds", strconv.Itoa(timeout))
+	resp, err := pi.request(params)
+	if err != nil {
+		return fmt.Errorf("can't watch pods: %s", err)
+	}
+	pi.bodyLock.Lock()
+	pi.body = resp.Body
+	pi.bodyLock.Unlock()
+	defer func() {
+		pi.bodyLock.Lock()
+		pi.body = nil
+		pi.bodyLock.Unlock()
+		resp.Body.Close()
+	}()
+	// We might have been stopped before the body was registered.
+	if pi.isStopped() {
+		return nil
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		event := new(kubeWatchEvent)
+		if err = decoder.Decode(event); err != nil {
+			// EOF means the server ended the watch, which it does
+			// periodically.
+			if err == io.EOF || pi.isStopped() {
+				return nil
+			}
+			return fmt.Errorf("error reading pod watch: %s", err)
+		}
+		switch event.Type {
+		case "ADDED", "MODIFIED", "DELETED":
+			pod := new(kubePod)
+			if err = json.Unmarshal(event.Object, pod); err != nil {
+				return fmt.Errorf("can't parse pod watch event: %s", err)
+			}
+			pi.update(event.Type, pod)
+		case "ERROR":
+			status := new(kubeStatus)
+			json.Unmarshal(event.Object, status)
+			if status.Code == http.StatusGone {
+				return errWatchExpired
+			}
+			return fmt.Errorf("pod watch error: %s", status.Message)
+		}
+	}
+}
+
+func (pi *podInformer) update(eventType string, pod *kubePod) {
+	key := pod.Metadata.Namespace + "/" + pod.Metadata.Name
+	pi.podsLock.Lock()
+	if eventType == "DELETED" {
+		if meta, ok := pi.pods[key]; ok {
+			meta.deleted = time.Now()
+		}
+	} else {
+		pi.pods[key] = newPodMeta(pod)
+	}
+	pi.podsLock.Unlock()
+	pi.resourceVersion = pod.Metadata.ResourceVersion
+}
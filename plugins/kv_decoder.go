@@ -0,0 +1,294 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package plugins
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+)
+
+type KvDecoderConfig struct {
+	// Type of the decoded messages. Defaults to "kv".
+	MessageType string `toml:"message_type"`
+
+	// Whether to keep the parsed text as the message payload, defaults to
+	// false.
+	PayloadKeep bool `toml:"payload_keep"`
+
+	// Separates the pairs, defaults to "" meaning any run of whitespace, as
+	// in logfmt.
+	PairSeparator string `toml:"pair_separator"`
+
+	// Separates each key from its value, defaults to "=".
+	KvSeparator string `toml:"kv_separator"`
+
+	// Characters that can quote keys and values, defaults to `"`. Set to ""
+	// to turn quoting off.
+	QuoteChars string `toml:"quote_chars"`
+
+	// Only the keys in this list are added as fields, if it isn't empty.
+	IncludeKeys []string `toml:"include_keys"`
+
+	// Keys that aren't added as fields.
+	ExcludeKeys []string `toml:"exclude_keys"`
+
+	// Whether unquoted integer, float and boolean values are added as fields
+	// of those types rather than as strings, defaults to true.
+	TypeInference bool `toml:"type_inference"`
+}
+
+type KvDecoder struct {
+	messageType   string
+	payloadKeep   bool
+	pairSep       string
+	kvSep         string
+	quoteChars    string
+	include       map[string]bool
+	exclude       map[string]bool
+	typeInference bool
+}
+
+func (kd *KvDecoder) ConfigStruct() interface{} {
+	return &KvDecoderConfig{
+		MessageType:   "kv",
+		KvSeparator:   "=",
+		QuoteChars:    `"`,
+		TypeInference: true,
+	}
+}
+
+func (kd *KvDecoder) Init(config interface{}) error {
+	conf := config.(*KvDecoderConfig)
+	if conf.KvSeparator == "" {
+		return errors.New("KvDecoder kv_separator can't be empty")
+	}
+	if conf.PairSeparator == conf.KvSeparator {
+		return errors.New("KvDecoder pair_separator and kv_separator must differ")
+	}
+	if strings.ContainsAny(conf.QuoteChars, conf.KvSeparator+conf.PairSeparator) {
+		return errors.New("KvDecoder quote_chars can't contain the separators")
+	}
+	kd.messageType = conf.MessageType
+	kd.payloadKeep = conf.PayloadKeep
+	kd.pairSep = conf.PairSeparator
+	kd.kvSep = conf.KvSeparator
+	kd.quoteChars = conf.QuoteChars
+	kd.include = kvKeySet(conf.IncludeKeys)
+	kd.exclude = kvKeySet(conf.ExcludeKeys)
+	kd.typeInference = conf.TypeInference
+	return nil
+}
+
+func kvKeySet(keys []string) map[string]bool {
+	if len(keys) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		set[k] = true
+	}
+	return set
+}
+
+func (kd *KvDecoder) Decode(pack *PipelinePack) (packs []*PipelinePack, err error) {
+	msg := pack.Message
+	data := msg.GetPayload()
+	msg.SetType(kd.messageType)
+	if !kd.payloadKeep {
+		msg.SetPayload("")
+	}
+	emit := func(key, value string, quoted, bare bool) {
+		if (kd.include != nil && !kd.include[key]) || kd.exclude[key] {
+			return
+		}
+		if !kd.typeInference || quoted {
+			msg.SetString(key, value)
+			return
+		}
+		if bare {
+			// A key w/o a value is a flag, as in logfmt.
+			msg.SetBool(key, true)
+			return
+		}
+		kvSetInferred(msg, key, value)
+	}
+	if err = kd.parse(data, emit); err != nil {
+		return nil, fmt.Errorf("KvDecoder failed to parse: %s", err)
+	}
+	return []*PipelinePack{pack}, nil
+}
+
+// Adds the value as an integer, double or boolean field if it looks like
+// one, as a string field otherwise.
+func kvSetInferred(msg *message.Message, key, value string) {
+	if value == "" {
+		msg.SetString(key, value)
+		return
+	}
+	switch c := value[0]; {
+	case c >= '0' && c <= '9', c == '-', c == '+', c == '.':
+		if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+			msg.SetInt(key, i)
+			return
+		}
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			msg.SetDouble(key, f)
+			return
+		}
+	case value == "true":
+		msg.SetBool(key, true)
+		return
+	case value == "false":
+		msg.SetBool(key, false)
+		return
+	}
+	msg.SetString(key, value)
+}
+
+// Calls emit w/ each pair of the text in turn. `quoted` is set when the
+// value was quoted, `bare` when the key had no separator and value.
+func (kd *KvDecoder) parse(data string, emit func(key, value string,
+	quoted, bare bool)) error {
+
+	pos := 0
+	for {
+		pos = kd.skipPairSeps(data, pos)
+		if pos == len(data) {
+			return nil
+		}
+		key, _, end, err := kd.token(data, pos, true)
+		if err != nil {
+			return err
+		}
+		if key == "" {
+			return fmt.Errorf("missing key at offset %d", pos)
+		}
+		pos = end
+		if !strings.HasPrefix(data[pos:], kd.kvSep) {
+			emit(key, "", false, true)
+			continue
+		}
+		pos += len(kd.kvSep)
+		value, quoted, end, err := kd.token(data, pos, false)
+		if err != nil {
+			return err
+		}
+		pos = end
+		emit(key, value, quoted, false)
+	}
+}
+
+// Returns the position of the first character after any pair separators
+// starting at pos.
+func (kd *KvDecoder) skipPairSeps(data string, pos int) int {
+	for pos < len(data) {
+		if kd.pairSep == "" {
+			if !kvIsSpace(data[pos]) {
+				break
+			}
+			pos++
+		} else if strings.HasPrefix(data[pos:], kd.pairSep) {
+			pos += len(kd.pairSep)
+		} else {
+			break
+		}
+	}
+	return pos
+}
+
+// Reads the key or value starting at pos, returning it, whether it was
+// quoted and the position right after it. Keys also end at the kv
+// separator, quoted tokens must be followed by a separator or the end of the
+// text.
+func (kd *KvDecoder) token(data string, pos int, isKey bool) (tok string,
+	quoted bool, end int, err error) {
+
+	if pos < len(data) && strings.IndexByte(kd.quoteChars, data[pos]) >= 0 {
+		if tok, end, err = kvUnquote(data, pos); err != nil {
+			return
+		}
+		if end < len(data) && !kd.atPairSep(data, end) &&
+			!(isKey && strings.HasPrefix(data[end:], kd.kvSep)) {
+			err = fmt.Errorf("unexpected character after quoted text at offset %d",
+				end)
+		}
+		return tok, true, end, err
+	}
+	for end = pos; end < len(data); end++ {
+		if kd.atPairSep(data, end) ||
+			(isKey && strings.HasPrefix(data[end:], kd.kvSep)) {
+			break
+		}
+	}
+	return data[pos:end], false, end, nil
+}
+
+func (kd *KvDecoder) atPairSep(data string, pos int) bool {
+	if kd.pairSep == "" {
+		return kvIsSpace(data[pos])
+	}
+	return strings.HasPrefix(data[pos:], kd.pairSep)
+}
+
+func kvIsSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// Reads the text quoted by the character at pos, in which a backslash
+// escapes the next character. Returns the unescaped text and the position
+// after the closing quote.
+func kvUnquote(data string, pos int) (string, int, error) {
+	quote := data[pos]
+	start := pos + 1
+	i := strings.IndexByte(data[start:], quote)
+	if i < 0 {
+		return "", 0, fmt.Errorf("unterminated quote at offset %d", pos)
+	}
+	if strings.IndexByte(data[start:start+i], '\\') < 0 {
+		// No escapes, no need to copy.
+		return data[start : start+i], start + i + 1, nil
+	}
+	buf := make([]byte, 0, i)
+	for j := start; j < len(data); j++ {
+		c := data[j]
+		switch {
+		case c == quote:
+			return string(buf), j + 1, nil
+		case c == '\\' && j+1 < len(data):
+			j++
+			switch c = data[j]; c {
+			case 'n':
+				c = '\n'
+			case 't':
+				c = '\t'
+			case 'r':
+				c = '\r'
+			}
+		}
+		buf = append(buf, c)
+	}
+	return "", 0, fmt.Errorf("unterminated quote at offset %d", pos)
+}
+
+func init() {
+	RegisterPlugin("KvDecoder", func() interface{} {
+		return new(KvDecoder)
+	})
+}
@@ -0,0 +1,122 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package plugins
+
+import (
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func KvDecoderSpec(c gs.Context) {
+	c.Specify("A KvDecoder", func() {
+		decoder := new(KvDecoder)
+		config := decoder.ConfigStruct().(*KvDecoderConfig)
+		supply := make(chan *PipelinePack, 1)
+		pack := NewPipelinePack(supply)
+		msg := pack.Message
+
+		decode := func(payload string) error {
+			if err := decoder.Init(config); err != nil {
+				return err
+			}
+			msg.SetPayload(payload)
+			packs, err := decoder.Decode(pack)
+			if err == nil {
+				c.Expect(len(packs), gs.Equals, 1)
+			}
+			return err
+		}
+
+		c.Specify("decodes logfmt", func() {
+			err := decode(`level=info msg="user \"bob\" logged in" status=200 ` +
+				`took=0.25 cached=false debug`)
+			c.Assume(err, gs.IsNil)
+			c.Expect(msg.GetType(), gs.Equals, "kv")
+			c.Expect(msg.GetPayload(), gs.Equals, "")
+			value, _ := msg.GetString("msg")
+			c.Expect(value, gs.Equals, `user "bob" logged in`)
+			status := msg.FindFirstField("status")
+			c.Expect(status.GetValueType(), gs.Equals, message.Field_INTEGER)
+			n, _ := msg.GetInt("status")
+			c.Expect(n, gs.Equals, int64(200))
+			took, _ := msg.GetDouble("took")
+			c.Expect(took, gs.Equals, 0.25)
+			cached, ok := msg.GetBool("cached")
+			c.Expect(ok, gs.IsTrue)
+			c.Expect(cached, gs.IsFalse)
+			debug, _ := msg.GetBool("debug")
+			c.Expect(debug, gs.IsTrue)
+		})
+
+		c.Specify("leaves quoted values and values w/o inference as strings", func() {
+			err := decode(`a="42" b=42`)
+			c.Assume(err, gs.IsNil)
+			value, _ := msg.GetString("a")
+			c.Expect(value, gs.Equals, "42")
+			c.Expect(msg.FindFirstField("b").GetValueType(), gs.Equals,
+				message.Field_INTEGER)
+
+			config.TypeInference = false
+			err = decode(`c=42`)
+			c.Assume(err, gs.IsNil)
+			value, _ = msg.GetString("c")
+			c.Expect(value, gs.Equals, "42")
+		})
+
+		c.Specify("uses configured separators and quotes", func() {
+			config.PairSeparator = ", "
+			config.KvSeparator = ": "
+			config.QuoteChars = `'"`
+			err := decode(`user: bob smith, role: 'admin, ops', id: 7`)
+			c.Assume(err, gs.IsNil)
+			value, _ := msg.GetString("user")
+			c.Expect(value, gs.Equals, "bob smith")
+			value, _ = msg.GetString("role")
+			c.Expect(value, gs.Equals, "admin, ops")
+			n, _ := msg.GetInt("id")
+			c.Expect(n, gs.Equals, int64(7))
+		})
+
+		c.Specify("filters keys", func() {
+			config.IncludeKeys = []string{"a", "b"}
+			config.ExcludeKeys = []string{"b"}
+			err := decode(`a=1 b=2 c=3`)
+			c.Assume(err, gs.IsNil)
+			c.Expect(len(msg.Fields), gs.Equals, 1)
+			c.Expect(msg.FindFirstField("a"), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("keeps the payload if asked to", func() {
+			config.PayloadKeep = true
+			c.Assume(decode(`a=1`), gs.IsNil)
+			c.Expect(msg.GetPayload(), gs.Equals, "a=1")
+		})
+
+		c.Specify("fails on malformed text", func() {
+			c.Expect(decode(`a="unterminated`), gs.Not(gs.IsNil))
+			c.Expect(decode(`=value`), gs.Not(gs.IsNil))
+			c.Expect(decode(`a="x"y`), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("rejects invalid separators", func() {
+			config.KvSeparator = ""
+			c.Expect(decoder.Init(config), gs.Not(gs.IsNil))
+			config.KvSeparator = "="
+			config.QuoteChars = `"=`
+			c.Expect(decoder.Init(config), gs.Not(gs.IsNil))
+		})
+	})
+}
@@ -0,0 +1,285 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package metadata
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+)
+
+const (
+	defaultAwsMetadataUrl = "http://169.254.169.254/latest/meta-data"
+	defaultGceMetadataUrl = "http://metadata.google.internal/computeMetadata/v1"
+	serviceAccountNsFile  = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+	selfCgroupFile        = "/proc/self/cgroup"
+)
+
+// Matches the 64 character hex container id in a cgroup path, e.g.
+// /docker/<id> or /kubepods/burstable/pod<uid>/<id>.
+var containerIdRegex = regexp.MustCompile(`[0-9a-f]{64}`)
+
+type HostMetadataDecoderConfig struct {
+	// Cloud provider whose metadata service should be queried, one of "aws",
+	// "gce", "auto", or "none".
+	Cloud string `toml:"cloud"`
+	// Timeout in seconds for each metadata service request.
+	Timeout uint `toml:"timeout"`
+	// Whether or not the id of the container Heka is running in should be
+	// added.
+	Container bool `toml:"container"`
+	// Whether or not Kubernetes pod metadata should be added.
+	Kubernetes bool `toml:"kubernetes"`
+	// Optional kubelet URL from which pod labels will be fetched.
+	KubeletUrl string `toml:"kubelet_url"`
+	// Static tags added to every message.
+	Tags map[string]string `toml:"tags"`
+	// Metadata service URLs, overridable mostly for testing purposes.
+	AwsMetadataUrl string `toml:"aws_metadata_url"`
+	GceMetadataUrl string `toml:"gce_metadata_url"`
+	// File containing the pod's namespace if POD_NAMESPACE isn't set.
+	NamespaceFile string `toml:"namespace_file"`
+	// File listing the cgroups of the Heka process.
+	CgroupFile string `toml:"cgroup_file"`
+}
+
+// Decoder that stamps every message with metadata about the host on which
+// Heka is running, gathered once at startup.
+type HostMetadataDecoder struct {
+	fieldNames []string
+	fields     map[string]string
+	client     *http.Client
+}
+
+func (hm *HostMetadataDecoder) ConfigStruct() interface{} {
+	return &HostMetadataDecoderConfig{
+		Cloud:          "none",
+		Timeout:        2,
+		AwsMetadataUrl: defaultAwsMetadataUrl,
+		GceMetadataUrl: defaultGceMetadataUrl,
+		NamespaceFile:  serviceAccountNsFile,
+		CgroupFile:     selfCgroupFile,
+	}
+}
+
+func (hm *HostMetadataDecoder) Init(config interface{}) (err error) {
+	conf := config.(*HostMetadataDecoderConfig)
+	hm.fields = make(map[string]string)
+	hm.client = &http.Client{
+		Timeout: time.Duration(conf.Timeout) * time.Second,
+	}
+
+	switch conf.Cloud {
+	case "none":
+	case "aws":
+		err = hm.loadAws(conf.AwsMetadataUrl)
+	case "gce":
+		err = hm.loadGce(conf.GceMetadataUrl)
+	case "auto":
+		// Not finding any metadata service isn't an error in auto mode.
+		if hm.loadAws(conf.AwsMetadataUrl) != nil {
+			hm.loadGce(conf.GceMetadataUrl)
+		}
+	default:
+		err = fmt.Errorf("cloud must be 'aws', 'gce', 'auto', or 'none', got '%s'",
+			conf.Cloud)
+	}
+	if err != nil {
+		return
+	}
+
+	if conf.Container {
+		hm.loadContainerId(conf.CgroupFile)
+	}
+
+	if conf.Kubernetes {
+		if err = hm.loadKubernetes(conf); err != nil {
+			return
+		}
+	}
+
+	for name, value := range conf.Tags {
+		hm.fields[name] = value
+	}
+	hm.fieldNames = make([]string, 0, len(hm.fields))
+	for name := range hm.fields {
+		hm.fieldNames = append(hm.fieldNames, name)
+	}
+	sort.Strings(hm.fieldNames)
+	return nil
+}
+
+// Fetches a single value from a metadata service.
+func (hm *HostMetadataDecoder) fetch(url string, header http.Header) (string, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := hm.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+func (hm *HostMetadataDecoder) loadAws(baseUrl string) error {
+	instanceId, err := hm.fetch(baseUrl+"/instance-id", nil)
+	if err != nil {
+		return fmt.Errorf("can't fetch AWS instance id: %s", err)
+	}
+	zone, err := hm.fetch(baseUrl+"/placement/availability-zone", nil)
+	if err != nil {
+		return fmt.Errorf("can't fetch AWS availability zone: %s", err)
+	}
+	hm.fields["CloudProvider"] = "aws"
+	hm.fields["InstanceId"] = instanceId
+	hm.fields["AvailabilityZone"] = zone
+	// Region is the zone w/o the trailing zone letter, e.g. us-east-1a.
+	if len(zone) > 1 {
+		hm.fields["Region"] = zone[:len(zone)-1]
+	}
+	return nil
+}
+
+func (hm *HostMetadataDecoder) loadGce(baseUrl string) error {
+	header := http.Header{"Metadata-Flavor": []string{"Google"}}
+	instanceId, err := hm.fetch(baseUrl+"/instance/id", header)
+	if err != nil {
+		return fmt.Errorf("can't fetch GCE instance id: %s", err)
+	}
+	zone, err := hm.fetch(baseUrl+"/instance/zone", header)
+	if err != nil {
+		return fmt.Errorf("can't fetch GCE zone: %s", err)
+	}
+	// Zone is returned as projects/<project-number>/zones/<zone>.
+	zone = zone[strings.LastIndex(zone, "/")+1:]
+	hm.fields["CloudProvider"] = "gce"
+	hm.fields["InstanceId"] = instanceId
+	hm.fields["AvailabilityZone"] = zone
+	if i := strings.LastIndex(zone, "-"); i > 0 {
+		hm.fields["Region"] = zone[:i]
+	}
+	return nil
+}
+
+// Extracts the container id from the cgroup membership of the Heka process,
+// if it's running in a container.
+func (hm *HostMetadataDecoder) loadContainerId(cgroupFile string) {
+	contents, err := ioutil.ReadFile(cgroupFile)
+	if err != nil {
+		return
+	}
+	if id := containerIdRegex.Find(contents); id != nil {
+		hm.fields["ContainerId"] = string(id)
+	}
+}
+
+// Subset of the kubelet's pod list response that we care about.
+type kubeletPodList struct {
+	Items []struct {
+		Metadata struct {
+			Name      string            `json:"name"`
+			Namespace string            `json:"namespace"`
+			Labels    map[string]string `json:"labels"`
+		} `json:"metadata"`
+	} `json:"items"`
+}
+
+// Gathers pod metadata from the downward API environment variables, falling
+// back to the hostname and service account namespace, and optionally fetches
+// the pod's labels from the kubelet.
+func (hm *HostMetadataDecoder) loadKubernetes(conf *HostMetadataDecoderConfig) error {
+	podName := os.Getenv("POD_NAME")
+	if podName == "" {
+		// The hostname of a pod is its name by default.
+		podName, _ = os.Hostname()
+	}
+	namespace := os.Getenv("POD_NAMESPACE")
+	if namespace == "" && conf.NamespaceFile != "" {
+		if contents, err := ioutil.ReadFile(conf.NamespaceFile); err == nil {
+			namespace = strings.TrimSpace(string(contents))
+		}
+	}
+	if podName != "" {
+		hm.fields["KubernetesPodName"] = podName
+	}
+	if namespace != "" {
+		hm.fields["KubernetesNamespace"] = namespace
+	}
+	if nodeName := os.Getenv("NODE_NAME"); nodeName != "" {
+		hm.fields["KubernetesNodeName"] = nodeName
+	}
+
+	if conf.KubeletUrl == "" {
+		return nil
+	}
+	body, err := hm.fetch(strings.TrimRight(conf.KubeletUrl, "/")+"/pods", nil)
+	if err != nil {
+		return fmt.Errorf("can't fetch pods from kubelet: %s", err)
+	}
+	pods := new(kubeletPodList)
+	if err = json.Unmarshal([]byte(body), pods); err != nil {
+		return fmt.Errorf("can't parse kubelet pod list: %s", err)
+	}
+	for _, pod := range pods.Items {
+		if pod.Metadata.Name != podName ||
+			(namespace != "" && pod.Metadata.Namespace != namespace) {
+			continue
+		}
+		hm.fields["KubernetesNamespace"] = pod.Metadata.Namespace
+		for name, value := range pod.Metadata.Labels {
+			hm.fields["KubernetesLabel_"+name] = value
+		}
+		break
+	}
+	return nil
+}
+
+func (hm *HostMetadataDecoder) Decode(pack *PipelinePack) (packs []*PipelinePack, err error) {
+	for _, name := range hm.fieldNames {
+		// Don't clobber anything that was set by an earlier decoder.
+		if pack.Message.FindFirstField(name) != nil {
+			continue
+		}
+		message.NewStringField(pack.Message, name, hm.fields[name])
+	}
+	return []*PipelinePack{pack}, nil
+}
+
+func init() {
+	RegisterPlugin("HostMetadataDecoder", func() interface{} {
+		return new(HostMetadataDecoder)
+	})
+}
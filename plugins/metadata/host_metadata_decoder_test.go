@@ -0,0 +1,203 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package metadata
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func TestAllSpecs(t *testing.T) {
+	r := gs.NewRunner()
+	r.Parallel = false
+	r.AddSpec(HostMetadataDecoderSpec)
+	gs.MainGoTest(r, t)
+}
+
+func HostMetadataDecoderSpec(c gs.Context) {
+	responses := map[string]string{
+		"/latest/meta-data/instance-id":                 "i-12345678",
+		"/latest/meta-data/placement/availability-zone": "us-west-2b",
+		"/computeMetadata/v1/instance/id":               "4520031799277581759",
+		"/computeMetadata/v1/instance/zone":             "projects/123456/zones/europe-west1-d",
+		"/pods": `{"items": [
+			{"metadata": {"name": "other", "namespace": "prod"}},
+			{"metadata": {"name": "web-1", "namespace": "prod",
+			 "labels": {"app": "web"}}}
+		]}`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+
+		if r.URL.Path == "/computeMetadata/v1/instance/id" &&
+			r.Header.Get("Metadata-Flavor") != "Google" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		body, ok := responses[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	decoder := new(HostMetadataDecoder)
+	config := decoder.ConfigStruct().(*HostMetadataDecoderConfig)
+	config.AwsMetadataUrl = server.URL + "/latest/meta-data"
+	config.GceMetadataUrl = server.URL + "/computeMetadata/v1"
+	config.NamespaceFile = ""
+	pack := NewPipelinePack(make(chan *PipelinePack, 1))
+
+	decode := func() *message.Message {
+		packs, err := decoder.Decode(pack)
+		c.Assume(err, gs.IsNil)
+		c.Expect(len(packs), gs.Equals, 1)
+		return packs[0].Message
+	}
+	fieldValue := func(msg *message.Message, name string) string {
+		value, ok := msg.GetFieldValue(name)
+		if !ok {
+			return ""
+		}
+		return value.(string)
+	}
+
+	c.Specify("A HostMetadataDecoder", func() {
+		c.Specify("adds static tags", func() {
+			config.Tags = map[string]string{"Environment": "production"}
+			err := decoder.Init(config)
+			c.Assume(err, gs.IsNil)
+			msg := decode()
+			c.Expect(fieldValue(msg, "Environment"), gs.Equals, "production")
+			c.Expect(len(msg.Fields), gs.Equals, 1)
+		})
+
+		c.Specify("doesn't overwrite existing fields", func() {
+			config.Tags = map[string]string{"Environment": "production"}
+			err := decoder.Init(config)
+			c.Assume(err, gs.IsNil)
+			message.NewStringField(pack.Message, "Environment", "staging")
+			msg := decode()
+			c.Expect(fieldValue(msg, "Environment"), gs.Equals, "staging")
+			c.Expect(len(msg.Fields), gs.Equals, 1)
+		})
+
+		c.Specify("adds AWS metadata", func() {
+			config.Cloud = "aws"
+			err := decoder.Init(config)
+			c.Assume(err, gs.IsNil)
+			msg := decode()
+			c.Expect(fieldValue(msg, "CloudProvider"), gs.Equals, "aws")
+			c.Expect(fieldValue(msg, "InstanceId"), gs.Equals, "i-12345678")
+			c.Expect(fieldValue(msg, "AvailabilityZone"), gs.Equals, "us-west-2b")
+			c.Expect(fieldValue(msg, "Region"), gs.Equals, "us-west-2")
+		})
+
+		c.Specify("adds GCE metadata", func() {
+			config.Cloud = "gce"
+			err := decoder.Init(config)
+			c.Assume(err, gs.IsNil)
+			msg := decode()
+			c.Expect(fieldValue(msg, "CloudProvider"), gs.Equals, "gce")
+			c.Expect(fieldValue(msg, "InstanceId"), gs.Equals, "4520031799277581759")
+			c.Expect(fieldValue(msg, "AvailabilityZone"), gs.Equals, "europe-west1-d")
+			c.Expect(fieldValue(msg, "Region"), gs.Equals, "europe-west1")
+		})
+
+		c.Specify("falls back to GCE in auto mode", func() {
+			delete(responses, "/latest/meta-data/instance-id")
+			config.Cloud = "auto"
+			err := decoder.Init(config)
+			c.Assume(err, gs.IsNil)
+			msg := decode()
+			c.Expect(fieldValue(msg, "CloudProvider"), gs.Equals, "gce")
+		})
+
+		c.Specify("fails if an explicit cloud provider can't be reached", func() {
+			delete(responses, "/latest/meta-data/instance-id")
+			config.Cloud = "aws"
+			err := decoder.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("rejects unknown cloud providers", func() {
+			config.Cloud = "cloudy"
+			err := decoder.Init(config)
+			c.Expect(err.Error(), gs.Equals,
+				"cloud must be 'aws', 'gce', 'auto', or 'none', got 'cloudy'")
+		})
+
+		c.Specify("adds the container id", func() {
+			cgroupFile, err := ioutil.TempFile("", "cgroup")
+			c.Assume(err, gs.IsNil)
+			defer os.Remove(cgroupFile.Name())
+			id := strings.Repeat("0123456789abcdef", 4)
+			cgroupFile.WriteString("11:memory:/docker/" + id + "\n10:cpu:/docker/" + id + "\n")
+			cgroupFile.Close()
+
+			config.Container = true
+			config.CgroupFile = cgroupFile.Name()
+			err = decoder.Init(config)
+			c.Assume(err, gs.IsNil)
+			msg := decode()
+			c.Expect(fieldValue(msg, "ContainerId"), gs.Equals, id)
+		})
+
+		c.Specify("adds kubernetes metadata", func() {
+			os.Setenv("POD_NAME", "web-1")
+			os.Setenv("NODE_NAME", "node-3")
+			defer os.Setenv("POD_NAME", "")
+			defer os.Setenv("NODE_NAME", "")
+
+			nsFile, err := ioutil.TempFile("", "namespace")
+			c.Assume(err, gs.IsNil)
+			defer os.Remove(nsFile.Name())
+			nsFile.WriteString("prod\n")
+			nsFile.Close()
+
+			config.Kubernetes = true
+			config.NamespaceFile = nsFile.Name()
+
+			c.Specify("from the downward API", func() {
+				err := decoder.Init(config)
+				c.Assume(err, gs.IsNil)
+				msg := decode()
+				c.Expect(fieldValue(msg, "KubernetesPodName"), gs.Equals, "web-1")
+				c.Expect(fieldValue(msg, "KubernetesNamespace"), gs.Equals, "prod")
+				c.Expect(fieldValue(msg, "KubernetesNodeName"), gs.Equals, "node-3")
+				c.Expect(fieldValue(msg, "KubernetesLabel_app"), gs.Equals, "")
+			})
+
+			c.Specify("with labels from the kubelet", func() {
+				config.KubeletUrl = server.URL + "/"
+				err := decoder.Init(config)
+				c.Assume(err, gs.IsNil)
+				msg := decode()
+				c.Expect(fieldValue(msg, "KubernetesPodName"), gs.Equals, "web-1")
+				c.Expect(fieldValue(msg, "KubernetesLabel_app"), gs.Equals, "web")
+			})
+		})
+	})
+}
@@ -0,0 +1,287 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package plugins
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+)
+
+// A single MutateDecoder operation on the fields w/ a given name.
+type MutateOperation struct {
+	// One of "rename", "copy", "remove", "add", "gsub", "split" or
+	// "convert".
+	Op string
+	// Name of the fields operated on.
+	Field string
+	// New name of the fields, for "rename" and "copy".
+	To string
+	// Value of the field, for "add".
+	Value interface{}
+	// Regular expression replaced in string and bytes values, for "gsub".
+	Pattern string
+	// Replacement for the pattern, which can refer to its capture groups,
+	// e.g. `${1}`.
+	Replacement string
+	// Separator of the values a string field is split into, for "split".
+	Separator string
+	// Value type the fields are converted to, one of "string", "integer",
+	// "double" or "bool", for "convert".
+	Type string
+}
+
+type MutateDecoderConfig struct {
+	// Applied to each message's fields in order.
+	Operations []MutateOperation `toml:"operations"`
+}
+
+// Applies an operation to a message.
+type mutateFunc func(msg *message.Message) error
+
+type MutateDecoder struct {
+	operations []mutateFunc
+}
+
+func (md *MutateDecoder) ConfigStruct() interface{} {
+	return new(MutateDecoderConfig)
+}
+
+func (md *MutateDecoder) Init(config interface{}) (err error) {
+	conf := config.(*MutateDecoderConfig)
+	md.operations = make([]mutateFunc, len(conf.Operations))
+	for i, op := range conf.Operations {
+		if md.operations[i], err = newMutateFunc(op); err != nil {
+			return fmt.Errorf("MutateDecoder operation %d: %s", i+1, err)
+		}
+	}
+	return nil
+}
+
+func newMutateFunc(op MutateOperation) (mutateFunc, error) {
+	if op.Field == "" {
+		return nil, fmt.Errorf("'%s' w/o a field", op.Op)
+	}
+	switch op.Op {
+	case "rename", "copy":
+		if op.To == "" || op.To == op.Field {
+			return nil, fmt.Errorf("'%s' needs a new field name in 'to'", op.Op)
+		}
+		copying := op.Op == "copy"
+		return func(msg *message.Message) error {
+			mutateRename(msg, op.Field, op.To, copying)
+			return nil
+		}, nil
+	case "remove":
+		return func(msg *message.Message) error {
+			msg.DeleteFieldsByName(op.Field)
+			return nil
+		}, nil
+	case "add":
+		switch op.Value.(type) {
+		case string, int64, float64, bool:
+		default:
+			return nil, fmt.Errorf("can't add field '%s' w/ a %T value", op.Field,
+				op.Value)
+		}
+		return func(msg *message.Message) error {
+			msg.DeleteFieldsByName(op.Field)
+			field, _ := message.NewField(op.Field, op.Value, "")
+			msg.AddField(field)
+			return nil
+		}, nil
+	case "gsub":
+		re, err := regexp.Compile(op.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern '%s': %s", op.Pattern, err)
+		}
+		return func(msg *message.Message) error {
+			for _, field := range msg.FindAllFields(op.Field) {
+				for i, v := range field.ValueString {
+					field.ValueString[i] = re.ReplaceAllString(v, op.Replacement)
+				}
+				for i, v := range field.ValueBytes {
+					field.ValueBytes[i] = re.ReplaceAll(v, []byte(op.Replacement))
+				}
+			}
+			return nil
+		}, nil
+	case "split":
+		if op.Separator == "" {
+			return nil, fmt.Errorf("'split' w/o a separator")
+		}
+		return func(msg *message.Message) error {
+			for _, field := range msg.FindAllFields(op.Field) {
+				var values []string
+				for _, v := range field.ValueString {
+					values = append(values, strings.Split(v, op.Separator)...)
+				}
+				field.ValueString = values
+			}
+			return nil
+		}, nil
+	case "convert":
+		valueType, ok := mutateTypes[op.Type]
+		if !ok {
+			return nil, fmt.Errorf("can't convert to unknown type '%s'", op.Type)
+		}
+		return func(msg *message.Message) error {
+			for _, field := range msg.FindAllFields(op.Field) {
+				if err := convertField(field, valueType); err != nil {
+					return fmt.Errorf("can't convert field '%s' to %s: %s", op.Field,
+						op.Type, err)
+				}
+			}
+			return nil
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown operation '%s'", op.Op)
+}
+
+var mutateTypes = map[string]message.Field_ValueType{
+	"string":  message.Field_STRING,
+	"integer": message.Field_INTEGER,
+	"double":  message.Field_DOUBLE,
+	"bool":    message.Field_BOOL,
+}
+
+// Renames, or copies, the fields w/ the name, replacing any fields already
+// having the new name.
+func mutateRename(msg *message.Message, from, to string, copying bool) {
+	fields := msg.FindAllFields(from)
+	if len(fields) == 0 {
+		return
+	}
+	msg.DeleteFieldsByName(to)
+	for _, field := range fields {
+		if copying {
+			field = message.CopyField(field)
+		} else {
+			msg.DeleteField(field)
+		}
+		field.Name = proto.String(to)
+		msg.AddField(field)
+	}
+}
+
+// Converts the field's values to the value type, in place.
+func convertField(field *message.Field, valueType message.Field_ValueType) error {
+	if field.GetValueType() == valueType {
+		return nil
+	}
+	var values []interface{}
+	for _, v := range field.ValueString {
+		values = append(values, v)
+	}
+	for _, v := range field.ValueBytes {
+		values = append(values, string(v))
+	}
+	for _, v := range field.ValueInteger {
+		values = append(values, v)
+	}
+	for _, v := range field.ValueDouble {
+		values = append(values, v)
+	}
+	for _, v := range field.ValueBool {
+		values = append(values, v)
+	}
+	converted := message.NewFieldInit(field.GetName(), valueType,
+		field.GetRepresentation())
+	for _, v := range values {
+		c, err := convertValue(v, valueType)
+		if err != nil {
+			return err
+		}
+		converted.AddValue(c)
+	}
+	*field = *converted
+	return nil
+}
+
+func convertValue(v interface{}, valueType message.Field_ValueType) (interface{}, error) {
+	switch valueType {
+	case message.Field_STRING:
+		return fmt.Sprint(v), nil
+	case message.Field_INTEGER:
+		switch v := v.(type) {
+		case string:
+			if i, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64); err == nil {
+				return i, nil
+			}
+			f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil {
+				return nil, fmt.Errorf("'%s' isn't a number", v)
+			}
+			return int64(f), nil
+		case float64:
+			return int64(v), nil
+		case bool:
+			if v {
+				return int64(1), nil
+			}
+			return int64(0), nil
+		}
+	case message.Field_DOUBLE:
+		switch v := v.(type) {
+		case string:
+			f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil {
+				return nil, fmt.Errorf("'%s' isn't a number", v)
+			}
+			return f, nil
+		case int64:
+			return float64(v), nil
+		case bool:
+			if v {
+				return float64(1), nil
+			}
+			return float64(0), nil
+		}
+	case message.Field_BOOL:
+		switch v := v.(type) {
+		case string:
+			b, err := strconv.ParseBool(strings.TrimSpace(v))
+			if err != nil {
+				return nil, fmt.Errorf("'%s' isn't a boolean", v)
+			}
+			return b, nil
+		case int64:
+			return v != 0, nil
+		case float64:
+			return v != 0, nil
+		}
+	}
+	return v, nil
+}
+
+func (md *MutateDecoder) Decode(pack *PipelinePack) (packs []*PipelinePack, err error) {
+	for _, op := range md.operations {
+		if err = op(pack.Message); err != nil {
+			return nil, fmt.Errorf("MutateDecoder %s", err)
+		}
+	}
+	return []*PipelinePack{pack}, nil
+}
+
+func init() {
+	RegisterPlugin("MutateDecoder", func() interface{} {
+		return new(MutateDecoder)
+	})
+}
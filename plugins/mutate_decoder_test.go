@@ -0,0 +1,119 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package plugins
+
+import (
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func MutateDecoderSpec(c gs.Context) {
+	c.Specify("A MutateDecoder", func() {
+		decoder := new(MutateDecoder)
+		config := decoder.ConfigStruct().(*MutateDecoderConfig)
+		supply := make(chan *PipelinePack, 1)
+		pack := NewPipelinePack(supply)
+		msg := pack.Message
+		msg.SetString("remote_addr", "10.0.0.1")
+		msg.SetString("path", "/api/v1//users/")
+		msg.SetString("tags", "a,b,c")
+		msg.SetString("bytes", "512")
+		msg.SetString("debug", "x")
+
+		decode := func(ops ...MutateOperation) error {
+			config.Operations = ops
+			if err := decoder.Init(config); err != nil {
+				return err
+			}
+			packs, err := decoder.Decode(pack)
+			if err == nil {
+				c.Expect(len(packs), gs.Equals, 1)
+			}
+			return err
+		}
+
+		c.Specify("renames and copies fields", func() {
+			err := decode(
+				MutateOperation{Op: "rename", Field: "remote_addr", To: "client_ip"},
+				MutateOperation{Op: "copy", Field: "client_ip", To: "origin"},
+			)
+			c.Assume(err, gs.IsNil)
+			c.Expect(msg.FindFirstField("remote_addr"), gs.IsNil)
+			value, _ := msg.GetString("client_ip")
+			c.Expect(value, gs.Equals, "10.0.0.1")
+			value, _ = msg.GetString("origin")
+			c.Expect(value, gs.Equals, "10.0.0.1")
+		})
+
+		c.Specify("removes and adds fields", func() {
+			err := decode(
+				MutateOperation{Op: "remove", Field: "debug"},
+				MutateOperation{Op: "add", Field: "env", Value: "prod"},
+				MutateOperation{Op: "add", Field: "tags", Value: int64(3)},
+			)
+			c.Assume(err, gs.IsNil)
+			c.Expect(msg.FindFirstField("debug"), gs.IsNil)
+			value, _ := msg.GetString("env")
+			c.Expect(value, gs.Equals, "prod")
+			c.Expect(len(msg.FindAllFields("tags")), gs.Equals, 1)
+			n, _ := msg.GetInt("tags")
+			c.Expect(n, gs.Equals, int64(3))
+		})
+
+		c.Specify("substitutes patterns", func() {
+			err := decode(MutateOperation{Op: "gsub", Field: "path", Pattern: "/+",
+				Replacement: "/"})
+			c.Assume(err, gs.IsNil)
+			value, _ := msg.GetString("path")
+			c.Expect(value, gs.Equals, "/api/v1/users/")
+		})
+
+		c.Specify("splits fields into arrays", func() {
+			err := decode(MutateOperation{Op: "split", Field: "tags", Separator: ","})
+			c.Assume(err, gs.IsNil)
+			field := msg.FindFirstField("tags")
+			c.Expect(len(field.ValueString), gs.Equals, 3)
+			c.Expect(field.ValueString[2], gs.Equals, "c")
+		})
+
+		c.Specify("converts fields", func() {
+			err := decode(MutateOperation{Op: "convert", Field: "bytes", Type: "integer"})
+			c.Assume(err, gs.IsNil)
+			field := msg.FindFirstField("bytes")
+			c.Expect(field.GetValueType(), gs.Equals, message.Field_INTEGER)
+			n, _ := msg.GetInt("bytes")
+			c.Expect(n, gs.Equals, int64(512))
+
+			c.Specify("failing on invalid values", func() {
+				err := decode(MutateOperation{Op: "convert", Field: "tags", Type: "double"})
+				c.Expect(err, gs.Not(gs.IsNil))
+			})
+		})
+
+		c.Specify("rejects invalid operations", func() {
+			c.Expect(decode(MutateOperation{Op: "explode", Field: "x"}), gs.Not(gs.IsNil))
+			c.Expect(decode(MutateOperation{Op: "remove"}), gs.Not(gs.IsNil))
+			c.Expect(decode(MutateOperation{Op: "rename", Field: "x"}), gs.Not(gs.IsNil))
+			c.Expect(decode(MutateOperation{Op: "gsub", Field: "x", Pattern: "("}),
+				gs.Not(gs.IsNil))
+			c.Expect(decode(MutateOperation{Op: "split", Field: "x"}), gs.Not(gs.IsNil))
+			c.Expect(decode(MutateOperation{Op: "convert", Field: "x", Type: "date"}),
+				gs.Not(gs.IsNil))
+			c.Expect(decode(MutateOperation{Op: "add", Field: "x",
+				Value: []interface{}{"a"}}), gs.Not(gs.IsNil))
+		})
+	})
+}
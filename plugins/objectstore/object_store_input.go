@@ -0,0 +1,289 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package objectstore
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+)
+
+type ObjectStoreInputConfig struct {
+	// Bucket that's polled.
+	Bucket string
+	// Only the objects whose keys start w/ the prefix are ingested.
+	Prefix string
+	// Only the objects whose keys sort after this one are ingested, to skip
+	// part of a backfill.
+	StartAfter string `toml:"start_after"`
+	// Region of the bucket, defaults to "us-east-1".
+	Region string
+	// URL of the S3 compatible API, defaults to the AWS endpoint of the
+	// region. E.g. "https://storage.googleapis.com" for Google Cloud Storage.
+	Endpoint string
+	// Whether the bucket is part of the URL path rather than of the host
+	// name, defaults to false.
+	PathStyle bool `toml:"path_style"`
+	// Credentials, defaulting to the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY
+	// and AWS_SESSION_TOKEN environment variables. Requests are sent unsigned
+	// w/o an access key, for public buckets.
+	AccessKeyId     string `toml:"access_key_id"`
+	SecretAccessKey string `toml:"secret_access_key"`
+	SessionToken    string `toml:"session_token"`
+	// Path of the manifest recording the ingested objects, relative to the
+	// base dir. Defaults to "objectstore/<plugin name>.json".
+	ManifestPath string `toml:"manifest_path"`
+	// Seconds each request has to complete, defaults to 300.
+	Timeout uint
+	// Seconds between polls, defaults to 300.
+	TickerInterval uint `toml:"ticker_interval"`
+}
+
+type ObjectStoreInput struct {
+	conf     *ObjectStoreInputConfig
+	name     string
+	pConfig  *PipelineConfig
+	client   *s3Client
+	manifest *objectManifest
+	ir       InputRunner
+	hostname string
+	stopChan chan bool
+}
+
+func (osi *ObjectStoreInput) SetName(name string) {
+	osi.name = name
+}
+
+func (osi *ObjectStoreInput) SetPipelineConfig(pConfig *PipelineConfig) {
+	osi.pConfig = pConfig
+}
+
+func (osi *ObjectStoreInput) ConfigStruct() interface{} {
+	return &ObjectStoreInputConfig{
+		Region:         "us-east-1",
+		Timeout:        300,
+		TickerInterval: 300,
+	}
+}
+
+func (osi *ObjectStoreInput) Init(config interface{}) (err error) {
+	conf := config.(*ObjectStoreInputConfig)
+	if conf.Bucket == "" {
+		return fmt.Errorf("ObjectStoreInput needs a bucket")
+	}
+	if conf.Endpoint == "" {
+		conf.Endpoint = "https://s3." + conf.Region + ".amazonaws.com"
+	}
+	endpoint, err := url.Parse(conf.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return fmt.Errorf("ObjectStoreInput bad endpoint '%s'", conf.Endpoint)
+	}
+	if conf.AccessKeyId == "" {
+		conf.AccessKeyId = os.Getenv("AWS_ACCESS_KEY_ID")
+		conf.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		conf.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	osi.client = &s3Client{
+		endpoint:     endpoint,
+		bucket:       conf.Bucket,
+		region:       conf.Region,
+		accessKey:    conf.AccessKeyId,
+		secretKey:    conf.SecretAccessKey,
+		sessionToken: conf.SessionToken,
+		pathStyle:    conf.PathStyle,
+		client:       &http.Client{Timeout: time.Duration(conf.Timeout) * time.Second},
+		now:          time.Now,
+	}
+	manifestPath := conf.ManifestPath
+	if manifestPath == "" {
+		manifestPath = filepath.Join("objectstore", osi.name+".json")
+	}
+	manifestPath = osi.pConfig.Globals.PrependBaseDir(manifestPath)
+	if osi.manifest, err = loadObjectManifest(manifestPath); err != nil {
+		return fmt.Errorf("ObjectStoreInput %s", err)
+	}
+	osi.conf = conf
+	osi.stopChan = make(chan bool)
+	return nil
+}
+
+func (osi *ObjectStoreInput) Run(ir InputRunner, h PluginHelper) error {
+	osi.ir = ir
+	osi.hostname = h.Hostname()
+	ticker := ir.Ticker()
+	for {
+		select {
+		case <-ticker:
+			osi.poll()
+		case <-osi.stopChan:
+			return nil
+		}
+	}
+}
+
+func (osi *ObjectStoreInput) stopping() bool {
+	select {
+	case <-osi.stopChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// Ingests the new objects, page by page of the listing, saving the manifest
+// after each page. An object that fails to download is retried on the next
+// poll.
+func (osi *ObjectStoreInput) poll() {
+	marker := osi.conf.StartAfter
+	for {
+		objects, truncated, err := osi.client.list(osi.conf.Prefix, marker)
+		if err != nil {
+			osi.ir.LogError(fmt.Errorf("can't list bucket '%s': %s", osi.conf.Bucket,
+				err))
+			return
+		}
+		ingested := osi.ingestPage(objects)
+		if ingested > 0 {
+			if err = osi.manifest.save(); err != nil {
+				osi.ir.LogError(fmt.Errorf("can't save manifest: %s", err))
+			}
+		}
+		if !truncated || len(objects) == 0 || osi.stopping() {
+			return
+		}
+		marker = objects[len(objects)-1].Key
+	}
+}
+
+// Ingests the objects of a listing page that aren't in the manifest yet,
+// returning how many were.
+func (osi *ObjectStoreInput) ingestPage(objects []s3Object) (ingested int) {
+	for _, obj := range objects {
+		if osi.stopping() {
+			return
+		}
+		if osi.manifest.Objects[obj.Key] == obj.ETag {
+			continue
+		}
+		if err := osi.ingest(obj.Key); err != nil {
+			osi.ir.LogError(fmt.Errorf("can't ingest '%s': %s", obj.Key, err))
+			continue
+		}
+		osi.manifest.Objects[obj.Key] = obj.ETag
+		ingested++
+	}
+	return ingested
+}
+
+// Streams the object through a splitter runner of its own, decompressing it
+// if it's gzipped.
+func (osi *ObjectStoreInput) ingest(key string) error {
+	body, err := osi.client.get(key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	var r io.Reader = bufio.NewReader(body)
+	if magic, _ := r.(*bufio.Reader).Peek(2); len(magic) == 2 &&
+		magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	sRunner := osi.ir.NewSplitterRunner(key)
+	defer sRunner.Done()
+	if !sRunner.UseMsgBytes() {
+		sRunner.SetPackDecorator(func(pack *PipelinePack) {
+			pack.Message.SetType("heka.objectstore")
+			pack.Message.SetHostname(osi.hostname)
+			pack.Message.SetLogger(osi.ir.Name())
+			message.NewStringField(pack.Message, "Bucket", osi.conf.Bucket)
+			message.NewStringField(pack.Message, "Key", key)
+		})
+	}
+	for err == nil {
+		err = sRunner.SplitStream(r, nil)
+	}
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+func (osi *ObjectStoreInput) Stop() {
+	close(osi.stopChan)
+}
+
+// Records the ETag of each ingested object in a JSON file, an object whose
+// ETag changed is ingested again.
+type objectManifest struct {
+	path    string
+	Objects map[string]string
+}
+
+func loadObjectManifest(path string) (*objectManifest, error) {
+	m := &objectManifest{path: path, Objects: make(map[string]string)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't read manifest '%s': %s", path, err)
+	}
+	if err = json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("can't decode manifest '%s': %s", path, err)
+	}
+	if m.Objects == nil {
+		m.Objects = make(map[string]string)
+	}
+	return m, nil
+}
+
+// Writes the manifest out, replacing the file atomically.
+func (m *objectManifest) save() error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(m.path), 0700); err != nil {
+		return err
+	}
+	tmp := m.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.path)
+}
+
+func init() {
+	RegisterPlugin("ObjectStoreInput", func() interface{} {
+		return new(ObjectStoreInput)
+	})
+}
@@ -0,0 +1,250 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package objectstore
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Hash of an empty payload, which is what GET requests carry.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// Minimal client of the S3 REST API, signing requests w/ AWS signature
+// version 4. Other stores exposing an S3 compatible API, e.g. Google Cloud
+// Storage w/ HMAC keys or MinIO, work too.
+type s3Client struct {
+	endpoint     *url.URL
+	bucket       string
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	pathStyle    bool
+	client       *http.Client
+	// Returns the current time, replaced in tests.
+	now func() time.Time
+}
+
+type s3Object struct {
+	Key  string
+	ETag string
+	Size int64
+}
+
+type s3ListResult struct {
+	IsTruncated bool
+	Contents    []s3Object
+}
+
+// Returns the URL of the key, or of the bucket if the key is empty.
+func (c *s3Client) objectURL(key string, query url.Values) *url.URL {
+	u := *c.endpoint
+	if c.pathStyle {
+		u.Path = "/" + c.bucket + "/" + key
+	} else {
+		u.Host = c.bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	u.RawPath = s3Escape(u.Path, false)
+	u.RawQuery = s3Query(query)
+	return &u
+}
+
+// Lists up to a thousand objects under the prefix whose keys sort after the
+// marker, returning whether there are more.
+func (c *s3Client) list(prefix, marker string) ([]s3Object, bool, error) {
+	query := url.Values{"prefix": {prefix}}
+	if marker != "" {
+		query.Set("marker", marker)
+	}
+	resp, err := c.do(c.objectURL("", query))
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	result := new(s3ListResult)
+	if err = xml.NewDecoder(resp.Body).Decode(result); err != nil {
+		return nil, false, fmt.Errorf("can't decode listing: %s", err)
+	}
+	return result.Contents, result.IsTruncated, nil
+}
+
+// Returns the contents of the object, which the caller must close.
+func (c *s3Client) get(key string) (io.ReadCloser, error) {
+	resp, err := c.do(c.objectURL(key, nil))
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Returns the contents of an object in an S3 compatible store, signing the
+// request w/ the credentials in the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY
+// and AWS_SESSION_TOKEN environment variables if they're set. The endpoint
+// defaults to AWS's for the region, other endpoints are addressed path style.
+// Used by hekad to fetch a remote config bundle.
+func GetS3Object(endpoint, region, bucket, key string, timeout time.Duration) (
+	[]byte, error) {
+
+	pathStyle := endpoint != ""
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("bad S3 endpoint '%s'", endpoint)
+	}
+	c := &s3Client{
+		endpoint:     u,
+		bucket:       bucket,
+		region:       region,
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		pathStyle:    pathStyle,
+		client:       &http.Client{Timeout: timeout},
+		now:          time.Now,
+	}
+	body, err := c.get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return ioutil.ReadAll(body)
+}
+
+// Sends a signed GET request, returning an error for any non 200 response.
+func (c *s3Client) do(u *url.URL) (*http.Response, error) {
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.accessKey != "" {
+		c.sign(req, c.now().UTC())
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s: %s", u.Path, resp.Status,
+			strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+// Adds the signature version 4 headers to the request.
+func (c *s3Client) sign(req *http.Request, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := amzDate[:8]
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", emptyPayloadHash)
+	if c.sessionToken != "" {
+		req.Header.Set("x-amz-security-token", c.sessionToken)
+	}
+
+	// Host plus the x-amz-* headers, sorted.
+	names := []string{"host"}
+	values := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") {
+			names = append(names, lower)
+			values[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	sort.Strings(names)
+	var canonicalHeaders string
+	for _, name := range names {
+		canonicalHeaders += name + ":" + values[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path, false),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		emptyPayloadHash,
+	}, "\n")
+	scope := day + "/" + c.region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" +
+		hex.EncodeToString(hash[:])
+
+	key := hmacSha256([]byte("AWS4"+c.secretKey), day)
+	key = hmacSha256(key, c.region)
+	key = hmacSha256(key, "s3")
+	key = hmacSha256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// Encodes the query w/ its keys sorted, escaping as signature version 4
+// requires, so it can be used as is in the canonical request.
+func s3Query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// Percent encodes everything but the unreserved characters of RFC 3986, and
+// the slashes unless encodeSlash is set.
+func s3Escape(s string, encodeSlash bool) string {
+	var buf []byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') ||
+			(c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.' ||
+			c == '~' || (c == '/' && !encodeSlash) {
+			buf = append(buf, c)
+		} else {
+			buf = append(buf, fmt.Sprintf("%%%02X", c)...)
+		}
+	}
+	return string(buf)
+}
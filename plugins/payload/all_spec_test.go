@@ -23,6 +23,7 @@ func TestAllSpecs(t *testing.T) {
 	r := gospec.NewRunner()
 	r.Parallel = false
 
+	r.AddSpec(GrokDecoderSpec)
 	r.AddSpec(MultiDecoderSpec)
 	r.AddSpec(PayloadDecodersSpec)
 
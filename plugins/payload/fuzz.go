@@ -0,0 +1,78 @@
+// +build gofuzz
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package payload
+
+import (
+	. "github.com/mozilla-services/heka/pipeline"
+)
+
+// Entry points for go-fuzz (https://github.com/dvyukov/go-fuzz), e.g.
+//
+//   go-fuzz-build -func FuzzPayloadRegexDecoder github.com/mozilla-services/heka/plugins/payload
+//   go-fuzz -bin payload-fuzz.zip -workdir fuzz/payload_regex_decoder
+
+// A decoder for each kind of timestamp layout, the data's first byte picking
+// the one used.
+var fuzzRegexDecoders []*PayloadRegexDecoder
+
+func init() {
+	for _, layout := range []string{"", "Jan _2 15:04:05", "EpochMilli"} {
+		ld := new(PayloadRegexDecoder)
+		conf := ld.ConfigStruct().(*PayloadRegexDecoderConfig)
+		conf.MatchRegex = `^(?P<Timestamp>\S+) (?P<Hostname>\S+) (?P<Severity>\w+) ` +
+			`(?P<Pid>[\d.]*) (?P<Uuid>\S*): (?P<Message>.*)$`
+		conf.MatchRegexes = []string{`^(?P<Message>.*)$`}
+		conf.SeverityMap = map[string]int32{"error": 3, "info": 6}
+		conf.MessageFields = MessageTemplate{
+			"Type":         "fuzz",
+			"Hostname":     "%Hostname%",
+			"Pid":          "%Pid%",
+			"Uuid":         "%Uuid%",
+			"Payload":      "%Message%",
+			"message|text": "%Message% on %Hostname%",
+		}
+		conf.TimestampLayout = layout
+		conf.LogErrors = false
+		if err := ld.Init(conf); err != nil {
+			panic(err)
+		}
+		ld.SetDecoderRunner(fuzzDecoderRunner{})
+		fuzzRegexDecoders = append(fuzzRegexDecoders, ld)
+	}
+}
+
+// Only takes the errors the decoder logs, a decoder being fuzzed has no
+// other use for its runner.
+type fuzzDecoderRunner struct {
+	DecoderRunner
+}
+
+func (dr fuzzDecoderRunner) LogError(err error) {}
+
+// Decodes the data as a payload w/ the PayloadRegexDecoder.
+func FuzzPayloadRegexDecoder(data []byte) int {
+	if len(data) == 0 {
+		return -1
+	}
+	ld := fuzzRegexDecoders[int(data[0])%len(fuzzRegexDecoders)]
+	pack := NewPipelinePack(nil)
+	pack.Message.SetPayload(string(data[1:]))
+	if packs, err := ld.Decode(pack); err != nil || len(packs) == 0 {
+		return 0
+	}
+	return 1
+}
@@ -0,0 +1,373 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package payload
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+)
+
+type GrokDecoderConfig struct {
+	// Grok expressions tried in order, the first one matching the payload
+	// setting the message fields.
+	Match []string `toml:"match"`
+
+	// Patterns keyed by name, overriding the bundled and loaded ones.
+	Patterns map[string]string `toml:"patterns"`
+
+	// Files of patterns in Logstash's format, each line holding a pattern
+	// name and its definition. Relative paths are relative to the share dir.
+	PatternFiles []string `toml:"pattern_files"`
+
+	// Whether only the patterns given a field name are captured, defaults to
+	// true. If false the others are captured too, in fields named after the
+	// patterns.
+	NamedCapturesOnly bool `toml:"named_captures_only"`
+
+	// Whether captures that matched empty text are added as fields, defaults
+	// to false.
+	KeepEmptyCaptures bool `toml:"keep_empty_captures"`
+
+	// Type of the decoded messages, left as is if empty.
+	MessageType string `toml:"message_type"`
+
+	// Whether payloads that match none of the expressions should be logged.
+	LogErrors bool `toml:"log_errors"`
+}
+
+// A field set from the text captured by one or more groups.
+type grokField struct {
+	name string
+	// One of "", "int" or "float".
+	typ    string
+	groups []int
+}
+
+// A compiled grok expression.
+type grokExpr struct {
+	re     *regexp.Regexp
+	fields []grokField
+}
+
+type GrokDecoder struct {
+	exprs       []*grokExpr
+	matchSet    *message.RegexpSet
+	keepEmpty   bool
+	messageType string
+	logErrors   bool
+	pConfig     *PipelineConfig
+}
+
+// Heka will call this before calling any other methods to give us access to
+// the pipeline configuration.
+func (gd *GrokDecoder) SetPipelineConfig(pConfig *PipelineConfig) {
+	gd.pConfig = pConfig
+}
+
+func (gd *GrokDecoder) ConfigStruct() interface{} {
+	return &GrokDecoderConfig{
+		NamedCapturesOnly: true,
+		LogErrors:         true,
+	}
+}
+
+func (gd *GrokDecoder) Init(config interface{}) (err error) {
+	conf := config.(*GrokDecoderConfig)
+	if len(conf.Match) == 0 {
+		return fmt.Errorf("GrokDecoder needs at least one expression to match")
+	}
+	lib := make(grokLibrary)
+	if err = lib.load(strings.NewReader(grokBasePatterns)); err != nil {
+		return fmt.Errorf("GrokDecoder base patterns: %s", err)
+	}
+	for _, path := range conf.PatternFiles {
+		if err = lib.loadFile(gd.pConfig.Globals.PrependShareDir(path)); err != nil {
+			return fmt.Errorf("GrokDecoder pattern file '%s': %s", path, err)
+		}
+	}
+	for name, pattern := range conf.Patterns {
+		lib[name] = pattern
+	}
+
+	gd.exprs = make([]*grokExpr, len(conf.Match))
+	regexps := make([]*regexp.Regexp, len(conf.Match))
+	for i, expr := range conf.Match {
+		if gd.exprs[i], err = lib.compile(expr, conf.NamedCapturesOnly); err != nil {
+			return fmt.Errorf("GrokDecoder expression '%s': %s", expr, err)
+		}
+		regexps[i] = gd.exprs[i].re
+	}
+	gd.matchSet = nil
+	if len(regexps) > 1 {
+		gd.matchSet = message.NewRegexpSet(regexps)
+	}
+	gd.keepEmpty = conf.KeepEmptyCaptures
+	gd.messageType = conf.MessageType
+	gd.logErrors = conf.LogErrors
+	return nil
+}
+
+func (gd *GrokDecoder) Decode(pack *PipelinePack) (packs []*PipelinePack, err error) {
+	payload := pack.Message.GetPayload()
+	expr := gd.exprs[0]
+	if gd.matchSet != nil {
+		i := gd.matchSet.MatchString(payload)
+		if i == -1 {
+			if gd.logErrors {
+				err = fmt.Errorf("No match: %s", payload)
+			}
+			return
+		}
+		expr = gd.exprs[i]
+	}
+	loc := expr.re.FindStringSubmatchIndex(payload)
+	if loc == nil {
+		if gd.logErrors {
+			err = fmt.Errorf("No match: %s", payload)
+		}
+		return
+	}
+
+	msg := pack.Message
+	for _, f := range expr.fields {
+		var field *message.Field
+		for _, g := range f.groups {
+			start, end := loc[2*g], loc[2*g+1]
+			if start < 0 || (start == end && !gd.keepEmpty) {
+				continue
+			}
+			if field == nil {
+				field = message.NewFieldInit(f.name, grokValueType(f.typ), "")
+			}
+			if err = grokAddValue(field, f.typ, payload[start:end]); err != nil {
+				return nil, fmt.Errorf("GrokDecoder field '%s': %s", f.name, err)
+			}
+		}
+		if field != nil {
+			msg.DeleteFieldsByName(f.name)
+			msg.AddField(field)
+		}
+	}
+	if gd.messageType != "" {
+		msg.SetType(gd.messageType)
+	}
+	return []*PipelinePack{pack}, nil
+}
+
+func grokValueType(typ string) message.Field_ValueType {
+	switch typ {
+	case "int":
+		return message.Field_INTEGER
+	case "float":
+		return message.Field_DOUBLE
+	}
+	return message.Field_STRING
+}
+
+// Adds the captured text to the field, converted to the capture's type.
+// Integers are truncated from any decimal number, as in Logstash.
+func grokAddValue(field *message.Field, typ, text string) error {
+	switch typ {
+	case "int":
+		i, err := strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			f, err := strconv.ParseFloat(text, 64)
+			if err != nil {
+				return fmt.Errorf("'%s' isn't a number", text)
+			}
+			i = int64(f)
+		}
+		return field.AddValue(i)
+	case "float":
+		f, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return fmt.Errorf("'%s' isn't a number", text)
+		}
+		return field.AddValue(f)
+	}
+	return field.AddValue(text)
+}
+
+// Grok pattern definitions keyed by name.
+type grokLibrary map[string]string
+
+// Loads the patterns in Logstash's pattern file format: each line holds a
+// name and, after whitespace, its definition. Blank lines and lines starting
+// w/ '#' are skipped.
+func (lib grokLibrary) load(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexAny(line, " \t")
+		if i < 0 {
+			return fmt.Errorf("line %d: pattern '%s' has no definition", lineNum, line)
+		}
+		lib[line[:i]] = strings.TrimLeft(line[i:], " \t")
+	}
+	return scanner.Err()
+}
+
+func (lib grokLibrary) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return lib.load(f)
+}
+
+// Matches pattern references, `%{NAME}`, `%{NAME:field}` or
+// `%{NAME:field:type}`, and named groups, `(?<field>` or `(?P<field>`.
+var grokToken = regexp.MustCompile(
+	`%\{(\w+)(?::([^:}]+))?(?::([^:}]+))?\}|\(\?P?<([\w@.\[\]-]+)>`)
+
+// Tracks the state of the expansion of an expression.
+type grokCompiler struct {
+	lib       grokLibrary
+	namedOnly bool
+	// Names of the groups, indexed by the order they're opened in.
+	groupFields []string
+	groupTypes  []string
+	// Patterns being expanded, to catch recursive definitions.
+	expanding map[string]bool
+}
+
+// Compiles a grok expression into a regexp, replacing the pattern
+// references w/ their definitions.
+func (lib grokLibrary) compile(expr string, namedOnly bool) (*grokExpr, error) {
+	gc := &grokCompiler{lib: lib, namedOnly: namedOnly,
+		expanding: make(map[string]bool)}
+	expanded, err := gc.expand(expr)
+	if err != nil {
+		return nil, err
+	}
+	re, err := regexp.Compile(expanded)
+	if err != nil {
+		return nil, err
+	}
+
+	// Groups capturing into the same field make a single field w/ multiple
+	// values, in the order of the groups.
+	ge := &grokExpr{re: re}
+	byName := make(map[string]int)
+	for i, name := range re.SubexpNames() {
+		if !strings.HasPrefix(name, "grok") {
+			continue
+		}
+		n, _ := strconv.Atoi(name[len("grok"):])
+		field := gc.groupFields[n]
+		j, ok := byName[field]
+		if !ok {
+			j = len(ge.fields)
+			byName[field] = j
+			ge.fields = append(ge.fields, grokField{name: field, typ: gc.groupTypes[n]})
+		} else if ge.fields[j].typ != gc.groupTypes[n] {
+			return nil, fmt.Errorf("field '%s' captured w/ different types", field)
+		}
+		ge.fields[j].groups = append(ge.fields[j].groups, i)
+	}
+	return ge, nil
+}
+
+// Returns the name of a new capturing group for the field.
+func (gc *grokCompiler) group(field, typ string) string {
+	gc.groupFields = append(gc.groupFields, field)
+	gc.groupTypes = append(gc.groupTypes, typ)
+	return fmt.Sprintf("(?P<grok%d>", len(gc.groupFields)-1)
+}
+
+func (gc *grokCompiler) expand(expr string) (string, error) {
+	var buf []byte
+	last := 0
+	for _, m := range grokToken.FindAllStringSubmatchIndex(expr, -1) {
+		start, end := m[0], m[1]
+		if grokEscaped(expr, start) {
+			continue
+		}
+		buf = append(buf, expr[last:start]...)
+		last = end
+		if m[8] >= 0 {
+			// A named group.
+			buf = append(buf, gc.group(expr[m[8]:m[9]], "")...)
+			continue
+		}
+
+		name := expr[m[2]:m[3]]
+		var field, typ string
+		if m[4] >= 0 {
+			field = expr[m[4]:m[5]]
+		}
+		if m[6] >= 0 {
+			typ = expr[m[6]:m[7]]
+			if typ != "int" && typ != "float" {
+				return "", fmt.Errorf("unknown type '%s' for '%s'", typ, field)
+			}
+		}
+		def, ok := gc.lib[name]
+		if !ok {
+			return "", fmt.Errorf("unknown pattern '%s'", name)
+		}
+		if gc.expanding[name] {
+			return "", fmt.Errorf("pattern '%s' refers to itself", name)
+		}
+		gc.expanding[name] = true
+		if field == "" && !gc.namedOnly {
+			field = name
+		}
+		if field != "" {
+			buf = append(buf, gc.group(field, typ)...)
+		} else {
+			buf = append(buf, "(?:"...)
+		}
+		expanded, err := gc.expand(def)
+		if err != nil {
+			return "", err
+		}
+		delete(gc.expanding, name)
+		buf = append(buf, expanded...)
+		buf = append(buf, ')')
+	}
+	buf = append(buf, expr[last:]...)
+	return string(buf), nil
+}
+
+// Whether the character at i is escaped by an odd number of backslashes.
+func grokEscaped(s string, i int) bool {
+	n := 0
+	for i > 0 && s[i-1] == '\\' {
+		n++
+		i--
+	}
+	return n%2 == 1
+}
+
+func init() {
+	RegisterPlugin("GrokDecoder", func() interface{} {
+		return new(GrokDecoder)
+	})
+}
@@ -0,0 +1,143 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package payload
+
+import (
+	"io/ioutil"
+	"os"
+
+	. "github.com/mozilla-services/heka/pipeline"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func GrokDecoderSpec(c gs.Context) {
+	pConfig := NewPipelineConfig(nil)
+
+	c.Specify("A GrokDecoder", func() {
+		decoder := new(GrokDecoder)
+		decoder.SetPipelineConfig(pConfig)
+		conf := decoder.ConfigStruct().(*GrokDecoderConfig)
+		supply := make(chan *PipelinePack, 1)
+		pack := NewPipelinePack(supply)
+		msg := pack.Message
+
+		decode := func(payload string) error {
+			if err := decoder.Init(conf); err != nil {
+				return err
+			}
+			msg.SetPayload(payload)
+			packs, err := decoder.Decode(pack)
+			if err == nil {
+				c.Expect(len(packs), gs.Equals, 1)
+			}
+			return err
+		}
+
+		c.Specify("decodes w/ the bundled patterns", func() {
+			conf.Match = []string{"%{COMBINEDAPACHELOG}"}
+			err := decode(`127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] ` +
+				`"GET /apache_pb.gif HTTP/1.0" 200 2326 "http://example.com/" "Mozilla/4.08"`)
+			c.Assume(err, gs.IsNil)
+			value, _ := msg.GetString("clientip")
+			c.Expect(value, gs.Equals, "127.0.0.1")
+			value, _ = msg.GetString("timestamp")
+			c.Expect(value, gs.Equals, "10/Oct/2000:13:55:36 -0700")
+			value, _ = msg.GetString("request")
+			c.Expect(value, gs.Equals, "/apache_pb.gif")
+			value, _ = msg.GetString("agent")
+			c.Expect(value, gs.Equals, `"Mozilla/4.08"`)
+			// Unnamed patterns aren't captured by default.
+			c.Expect(msg.FindFirstField("IPORHOST"), gs.IsNil)
+		})
+
+		c.Specify("converts typed captures", func() {
+			conf.Match = []string{`%{NUMBER:took:float}s %{NUMBER:bytes:int}`}
+			c.Assume(decode("0.25s 1024.0"), gs.IsNil)
+			took, _ := msg.GetDouble("took")
+			c.Expect(took, gs.Equals, 0.25)
+			bytes, _ := msg.GetInt("bytes")
+			c.Expect(bytes, gs.Equals, int64(1024))
+		})
+
+		c.Specify("tries the expressions in order", func() {
+			conf.Match = []string{`^%{INT:code} `, `^%{WORD:word} %{GREEDYDATA:rest}`}
+			conf.MessageType = "grokked"
+			c.Assume(decode("hello big world"), gs.IsNil)
+			c.Expect(msg.FindFirstField("code"), gs.IsNil)
+			value, _ := msg.GetString("rest")
+			c.Expect(value, gs.Equals, "big world")
+			c.Expect(msg.GetType(), gs.Equals, "grokked")
+		})
+
+		c.Specify("uses custom patterns and named groups", func() {
+			conf.Match = []string{`%{TICKET:ticket} (?<owner>\w+)`}
+			conf.Patterns = map[string]string{"TICKET": `[A-Z]+-\d+`}
+			c.Assume(decode("HEKA-1212 bob"), gs.IsNil)
+			value, _ := msg.GetString("ticket")
+			c.Expect(value, gs.Equals, "HEKA-1212")
+			value, _ = msg.GetString("owner")
+			c.Expect(value, gs.Equals, "bob")
+		})
+
+		c.Specify("loads pattern files", func() {
+			f, err := ioutil.TempFile("", "grok-patterns")
+			c.Assume(err, gs.IsNil)
+			defer os.Remove(f.Name())
+			f.WriteString("# Request ids\nREQID req-%{BASE16NUM}\n\nDURATION %{NUMBER}ms\n")
+			f.Close()
+			conf.PatternFiles = []string{f.Name()}
+			conf.Match = []string{`%{REQID:req_id} took %{DURATION:duration}`}
+			c.Assume(decode("req-3fa9 took 12ms"), gs.IsNil)
+			value, _ := msg.GetString("req_id")
+			c.Expect(value, gs.Equals, "req-3fa9")
+			value, _ = msg.GetString("duration")
+			c.Expect(value, gs.Equals, "12ms")
+		})
+
+		c.Specify("captures unnamed patterns if asked to", func() {
+			conf.Match = []string{`%{WORD} %{WORD}`}
+			conf.NamedCapturesOnly = false
+			c.Assume(decode("one two"), gs.IsNil)
+			field := msg.FindFirstField("WORD")
+			c.Expect(len(field.ValueString), gs.Equals, 2)
+			c.Expect(field.ValueString[1], gs.Equals, "two")
+		})
+
+		c.Specify("fails on payloads that don't match", func() {
+			conf.Match = []string{`^%{INT:code}$`}
+			c.Expect(decode("abc"), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("rejects invalid expressions", func() {
+			conf.Match = []string{`%{NOPE:x}`}
+			c.Expect(decoder.Init(conf), gs.Not(gs.IsNil))
+			conf.Match = []string{`%{INT:x:bool}`}
+			c.Expect(decoder.Init(conf), gs.Not(gs.IsNil))
+			conf.Match = []string{`%{LOOP}`}
+			conf.Patterns = map[string]string{"LOOP": "a%{LOOP}"}
+			c.Expect(decoder.Init(conf), gs.Not(gs.IsNil))
+			conf.Match = nil
+			c.Expect(decoder.Init(conf), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("checks field types", func() {
+			conf.Match = []string{`%{INT:n:int} %{INT:n}`}
+			c.Expect(decoder.Init(conf), gs.Not(gs.IsNil))
+			conf.Match = []string{`%{INT:n:int}`}
+			c.Assume(decoder.Init(conf), gs.IsNil)
+			c.Expect(decoder.exprs[0].fields[0].typ, gs.Equals, "int")
+		})
+	})
+}
@@ -287,6 +287,101 @@ func MultiDecoderSpec(c gospec.Context) {
 					c.Expect(ok, gs.IsFalse)
 				})
 			})
+
+			c.Specify("and using `stop-on-error` cascading", func() {
+				conf.CascadeStrategy = "stop-on-error"
+
+				c.Specify("stops at the first failure", func() {
+					err := decoder.Init(conf)
+					c.Assume(err, gs.IsNil)
+					decoder.SetDecoderRunner(dRunner)
+
+					pack.Message.SetPayload("matches twice")
+					packs, err := decoder.Decode(pack)
+					c.Expect(len(packs), gs.Equals, 0)
+					c.Expect(err.Error(), gs.Equals,
+						"Subdecoder 'StartsWithS' failed: No match: matches twice")
+					_, ok = pack.Message.GetFieldValue("StartsWithM")
+					c.Expect(ok, gs.IsTrue)
+					_, ok = pack.Message.GetFieldValue("StartsWithM2")
+					c.Expect(ok, gs.IsFalse)
+				})
+
+				c.Specify("succeeds when the subdecoders that apply succeed", func() {
+					conf.SubMatchers = map[string]string{"StartsWithS": "Type == 'sfmt'"}
+					err := decoder.Init(conf)
+					c.Assume(err, gs.IsNil)
+					decoder.SetDecoderRunner(dRunner)
+
+					pack.Message.SetPayload("matches twice")
+					_, err = decoder.Decode(pack)
+					c.Expect(err, gs.IsNil)
+					_, ok = pack.Message.GetFieldValue("StartsWithM")
+					c.Expect(ok, gs.IsTrue)
+					_, ok = pack.Message.GetFieldValue("StartsWithM2")
+					c.Expect(ok, gs.IsTrue)
+				})
+			})
+
+			c.Specify("and using subdecoder matchers", func() {
+				conf.SubMatchers = map[string]string{"StartsWithM": "Type == 'mfmt'"}
+
+				c.Specify("skips the subdecoders they don't match", func() {
+					err := decoder.Init(conf)
+					c.Assume(err, gs.IsNil)
+					decoder.SetDecoderRunner(dRunner)
+
+					pack.Message.SetPayload("match first")
+					_, err = decoder.Decode(pack)
+					c.Expect(err, gs.IsNil)
+					_, ok = pack.Message.GetFieldValue("StartsWithM")
+					c.Expect(ok, gs.IsFalse)
+					_, ok = pack.Message.GetFieldValue("StartsWithM2")
+					c.Expect(ok, gs.IsTrue)
+
+					msg := new(message.Message)
+					c.Expect(decoder.ReportMsg(msg), gs.IsNil)
+					value, _ := msg.GetFieldValue("ProcessMessageSkipped-StartsWithM")
+					c.Expect(value, gs.Equals, int64(1))
+					value, _ = msg.GetFieldValue("ProcessMessageCount-StartsWithM")
+					c.Expect(value, gs.Equals, int64(0))
+				})
+
+				c.Specify("applies the subdecoders they match", func() {
+					err := decoder.Init(conf)
+					c.Assume(err, gs.IsNil)
+					decoder.SetDecoderRunner(dRunner)
+
+					pack.Message.SetType("mfmt")
+					pack.Message.SetPayload("match first")
+					_, err = decoder.Decode(pack)
+					c.Expect(err, gs.IsNil)
+					_, ok = pack.Message.GetFieldValue("StartsWithM")
+					c.Expect(ok, gs.IsTrue)
+					_, ok = pack.Message.GetFieldValue("StartsWithM2")
+					c.Expect(ok, gs.IsFalse)
+				})
+
+				c.Specify("rejects invalid matchers", func() {
+					conf.SubMatchers["StartsWithS"] = "Type =="
+					err := decoder.Init(conf)
+					c.Expect(err, gs.Not(gs.IsNil))
+					// Appease gomock, no runner is set.
+					for i := 0; i < 3; i++ {
+						dRunner.LogError(errors.New("foo"))
+					}
+				})
+
+				c.Specify("rejects matchers for unlisted subdecoders", func() {
+					conf.SubMatchers["Nope"] = "TRUE"
+					err := decoder.Init(conf)
+					c.Expect(err.Error(), gs.Equals,
+						"Matcher for unlisted subdecoder: Nope")
+					for i := 0; i < 3; i++ {
+						dRunner.LogError(errors.New("foo"))
+					}
+				})
+			})
 		})
 	})
 
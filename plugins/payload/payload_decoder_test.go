@@ -162,6 +162,31 @@ func PayloadDecodersSpec(c gospec.Context) {
 			pack.Zero()
 		})
 
+		c.Specify("uses the first of several regexes that matches", func() {
+			conf.MatchRegex = `^GET (?P<Url>\S+)`
+			conf.MatchRegexes = []string{`^(?P<Method>POST|PUT) (?P<Url>\S+)`,
+				`^(?P<Method>\w+) (?P<Url>\S+)`}
+			conf.MessageFields = MessageTemplate{"Url": "%Url%", "Method": "%Method%"}
+			err := decoder.Init(conf)
+			c.Assume(err, gs.IsNil)
+			dRunner := pipelinemock.NewMockDecoderRunner(ctrl)
+			decoder.SetDecoderRunner(dRunner)
+
+			pack.Message.SetPayload("PUT /upload")
+			_, err = decoder.Decode(pack)
+			c.Expect(err, gs.IsNil)
+			method, _ := pack.Message.GetFieldValue("Method")
+			c.Expect(method, gs.Equals, "PUT")
+			url, _ := pack.Message.GetFieldValue("Url")
+			c.Expect(url, gs.Equals, "/upload")
+			pack.Zero()
+
+			pack.Message.SetPayload("invalid")
+			_, err = decoder.Decode(pack)
+			c.Expect(err.Error(), gs.Equals, "No match: invalid")
+			pack.Zero()
+		})
+
 		c.Specify("ignores invalid messages when log_errors is disabled", func() {
 			conf.MatchRegex = `\[(?P<Timestamp>[^\]]+)\]`
 			conf.LogErrors = false
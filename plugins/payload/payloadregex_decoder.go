@@ -17,6 +17,7 @@ package payload
 
 import (
 	"fmt"
+	"github.com/mozilla-services/heka/message"
 	. "github.com/mozilla-services/heka/pipeline"
 	"regexp"
 	"time"
@@ -27,6 +28,10 @@ type PayloadRegexDecoderConfig struct {
 	// values.
 	MatchRegex string `toml:"match_regex"`
 
+	// Additional regular expressions tried in order if `MatchRegex` doesn't
+	// match, the payload being tested against all of them in a single pass.
+	MatchRegexes []string `toml:"match_regexes"`
+
 	// Maps severity strings to their int version
 	SeverityMap map[string]int32 `toml:"severity_map"`
 
@@ -55,6 +60,7 @@ type PayloadRegexDecoderConfig struct {
 
 type PayloadRegexDecoder struct {
 	Match           *regexp.Regexp
+	matchSet        *message.RegexpSet
 	SeverityMap     map[string]int32
 	MessageFields   MessageTemplate
 	TimestampLayout string
@@ -71,13 +77,24 @@ func (ld *PayloadRegexDecoder) ConfigStruct() interface{} {
 
 func (ld *PayloadRegexDecoder) Init(config interface{}) (err error) {
 	conf := config.(*PayloadRegexDecoderConfig)
-	if ld.Match, err = regexp.Compile(conf.MatchRegex); err != nil {
-		err = fmt.Errorf("PayloadRegexDecoder: %s", err)
-		return
+	exprs := conf.MatchRegexes
+	if conf.MatchRegex != "" || len(exprs) == 0 {
+		exprs = append([]string{conf.MatchRegex}, exprs...)
 	}
-	if ld.Match.NumSubexp() == 0 {
-		err = fmt.Errorf("PayloadRegexDecoder regex must contain capture groups")
-		return
+	regexps := make([]*regexp.Regexp, len(exprs))
+	for i, expr := range exprs {
+		if regexps[i], err = regexp.Compile(expr); err != nil {
+			err = fmt.Errorf("PayloadRegexDecoder: %s", err)
+			return
+		}
+		if regexps[i].NumSubexp() == 0 {
+			err = fmt.Errorf("PayloadRegexDecoder regex must contain capture groups")
+			return
+		}
+	}
+	ld.Match = regexps[0]
+	if len(regexps) > 1 {
+		ld.matchSet = message.NewRegexpSet(regexps)
 	}
 
 	ld.SeverityMap = make(map[string]int32)
@@ -131,8 +148,20 @@ func tryMatch(re *regexp.Regexp, s string) (match bool, captures map[string]stri
 // message will be populated based on the decoder's message template, with
 // capture values interpolated into the message template values.
 func (ld *PayloadRegexDecoder) Decode(pack *PipelinePack) (packs []*PipelinePack, err error) {
-	// First try to match the regex.
-	match, captures := tryMatch(ld.Match, pack.Message.GetPayload())
+	// First try to match the regex, finding the one that matches first if
+	// there are several.
+	re := ld.Match
+	if ld.matchSet != nil {
+		i := ld.matchSet.MatchString(pack.Message.GetPayload())
+		if i == -1 {
+			if ld.logErrors {
+				err = fmt.Errorf("No match: %s", pack.Message.GetPayload())
+			}
+			return
+		}
+		re = ld.matchSet.Regexp(i)
+	}
+	match, captures := tryMatch(re, pack.Message.GetPayload())
 	if !match {
 		if ld.logErrors {
 			err = fmt.Errorf("No match: %s", pack.Message.GetPayload())
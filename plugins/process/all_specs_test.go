@@ -26,6 +26,12 @@ func TestAllSpecs(t *testing.T) {
 	r.AddSpec(ProcessChainSpec)
 	r.AddSpec(ProcessInputSpec)
 	r.AddSpec(ProcessDirectoryInputSpec)
+	r.AddSpec(ExecOutputSpec)
+	r.AddSpec(NagiosDecoderSpec)
+	r.AddSpec(OutputFormatSpec)
+	r.AddSpec(ExternalProtocolSpec)
+	r.AddSpec(ExternalFilterSpec)
+	r.AddSpec(ExternalDecoderSpec)
 
 	gospec.MainGoTest(r, t)
 }
@@ -0,0 +1,76 @@
+// +build !windows
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package process
+
+import (
+	"fmt"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// The user and group a command is run as.
+type credential struct {
+	uid, gid uint32
+}
+
+// Looks up the user, and the group if any, by name or numeric id. Commands
+// are run w/ the user's primary group if no group is given.
+func lookupCredential(userName, groupName string) (*credential, error) {
+	u, err := user.Lookup(userName)
+	if err != nil {
+		if u, err = user.LookupId(userName); err != nil {
+			return nil, fmt.Errorf("unknown user '%s'", userName)
+		}
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("user '%s' has a non-numeric uid: %s", userName, u.Uid)
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("user '%s' has a non-numeric gid: %s", userName, u.Gid)
+	}
+	if groupName != "" {
+		if gid, err = lookupGid(groupName); err != nil {
+			return nil, err
+		}
+	}
+	return &credential{uint32(uid), uint32(gid)}, nil
+}
+
+func lookupGid(groupName string) (uint64, error) {
+	if g, err := user.LookupGroup(groupName); err == nil {
+		return strconv.ParseUint(g.Gid, 10, 32)
+	}
+	if gid, err := strconv.ParseUint(groupName, 10, 32); err == nil {
+		return gid, nil
+	}
+	return 0, fmt.Errorf("unknown group '%s'", groupName)
+}
+
+// Makes the command run as the user and group, w/o any supplementary groups.
+// Only works if Heka is running as root.
+func setCredential(cmd *exec.Cmd, c *credential) {
+	if c == nil {
+		return
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: c.uid, Gid: c.gid, Groups: []uint32{}},
+	}
+}
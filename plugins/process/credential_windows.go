@@ -0,0 +1,28 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package process
+
+import (
+	"errors"
+	"os/exec"
+)
+
+type credential struct{}
+
+func lookupCredential(userName, groupName string) (*credential, error) {
+	return nil, errors.New("running commands as another user isn't supported on windows")
+}
+
+func setCredential(cmd *exec.Cmd, c *credential) {}
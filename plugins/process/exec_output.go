@@ -0,0 +1,344 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+#***** END LICENSE BLOCK *****/
+
+package process
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+)
+
+type ExecOutputConfig struct {
+	// Path to executable file.
+	Bin string
+
+	// Command arguments.
+	Args []string
+
+	// Environment variables.
+	Env []string
+
+	// Working directory of the command.
+	Directory string
+
+	// Either "stream", to keep a single instance of the command running and
+	// write each encoded message to its stdin (restarting it if it exits),
+	// or "batch", to run the command once per batch of messages w/ the batch
+	// on its stdin. Defaults to "stream".
+	Mode string
+
+	// Batch mode: number of messages that triggers running the command.
+	// Defaults to 1000.
+	FlushCount uint `toml:"flush_count"`
+
+	// Batch mode: maximum time in milliseconds a message may wait in a
+	// batch before the command is run. Defaults to 1000.
+	FlushInterval uint `toml:"flush_interval"`
+
+	// Batch mode: seconds a single run of the command may take before it's
+	// killed and the batch is retried. Defaults to 0 (no timeout).
+	TimeoutSeconds uint `toml:"timeout"`
+
+	// Stream mode: seconds to wait for the command to exit after its stdin
+	// has been closed at shutdown, before it's killed. Defaults to 5.
+	StopTimeout uint `toml:"stop_timeout"`
+
+	// Interval in seconds at which batches are checked for having waited
+	// longer than FlushInterval. Defaults to 1.
+	TickerInterval uint `toml:"ticker_interval"`
+
+	// Specifies whether or not Heka's stream framing will be applied to the
+	// output. We do some magic to default to true if ProtobufEncoder is used,
+	// false otherwise.
+	UseFraming *bool `toml:"use_framing"`
+}
+
+// Output plugin that pipes encoded messages to an external command.
+type ExecOutput struct {
+	conf          *ExecOutputConfig
+	or            OutputRunner
+	batching      bool
+	flushInterval time.Duration
+	stopTimeout   time.Duration
+	clock         Clock
+
+	// Stream mode.
+	cmd     *ManagedCmd
+	stdin   io.WriteCloser
+	exited  chan struct{}
+	started bool
+
+	// Batch mode.
+	batch       []byte
+	batchLen    uint
+	batchStart  time.Time
+	batchCursor string
+
+	processMessageCount int64
+	dropMessageCount    int64
+	restartCount        int64
+	batchCount          int64
+}
+
+func (e *ExecOutput) ConfigStruct() interface{} {
+	return &ExecOutputConfig{
+		Mode:           "stream",
+		FlushCount:     1000,
+		FlushInterval:  1000,
+		StopTimeout:    5,
+		TickerInterval: 1,
+	}
+}
+
+// Heka will call this before calling any other methods to give us access to
+// the pipeline configuration.
+func (e *ExecOutput) SetPipelineConfig(pConfig *PipelineConfig) {
+	e.clock = pConfig.Globals.Clock
+}
+
+func (e *ExecOutput) Init(config interface{}) (err error) {
+	e.conf = config.(*ExecOutputConfig)
+	if e.clock == nil {
+		e.clock = RealClock
+	}
+	if e.conf.Bin == "" {
+		return errors.New("`bin` must be specified")
+	}
+	switch e.conf.Mode {
+	case "stream":
+	case "batch":
+		e.batching = true
+		if e.conf.FlushCount < 1 {
+			return errors.New("`flush_count` must be at least 1")
+		}
+	default:
+		return fmt.Errorf("`mode` must be 'stream' or 'batch', got: '%s'", e.conf.Mode)
+	}
+	e.flushInterval = time.Duration(e.conf.FlushInterval) * time.Millisecond
+	e.stopTimeout = time.Duration(e.conf.StopTimeout) * time.Second
+	return nil
+}
+
+func (e *ExecOutput) Prepare(or OutputRunner, h PluginHelper) error {
+	if e.conf.UseFraming == nil {
+		// Nothing was specified, we'll default to framing IFF ProtobufEncoder
+		// is being used.
+		if _, ok := or.Encoder().(*ProtobufEncoder); ok {
+			or.SetUseFraming(true)
+		}
+	}
+	e.or = or
+	return nil
+}
+
+func (e *ExecOutput) newCmd(timeout time.Duration) *ManagedCmd {
+	cmd := NewManagedCmd(e.conf.Bin, e.conf.Args, timeout)
+	cmd.SetClock(e.clock)
+	if e.conf.Directory != "" {
+		cmd.Dir = e.conf.Directory
+	}
+	if e.conf.Env != nil {
+		cmd.Env = e.conf.Env
+	}
+	return cmd
+}
+
+func (e *ExecOutput) ProcessMessage(pack *PipelinePack) (err error) {
+	record, err := e.or.Encode(pack)
+	if err != nil || record == nil {
+		if err != nil {
+			atomic.AddInt64(&e.dropMessageCount, 1)
+			err = fmt.Errorf("can't encode: %s", err)
+		}
+		return err
+	}
+	if e.batching {
+		return e.batchMessage(record, pack.QueueCursor)
+	}
+
+	if e.cmd != nil {
+		select {
+		case <-e.exited:
+			e.cmd = nil
+		default:
+		}
+	}
+	if e.cmd == nil {
+		if err = e.start(); err != nil {
+			return NewRetryMessageError("can't start %s: %s", e.conf.Bin, err)
+		}
+	}
+	if _, err = e.stdin.Write(record); err != nil {
+		e.stop()
+		return NewRetryMessageError("writing to %s: %s", e.conf.Bin, err)
+	}
+	atomic.AddInt64(&e.processMessageCount, 1)
+	e.or.UpdateCursor(pack.QueueCursor)
+	return nil
+}
+
+// Starts the long running command, logging its stderr output and its exit.
+func (e *ExecOutput) start() (err error) {
+	cmd := e.newCmd(0)
+	if e.stdin, err = cmd.StdinPipe(); err != nil {
+		return err
+	}
+	if err = cmd.Start(true); err != nil {
+		return err
+	}
+	if e.started {
+		atomic.AddInt64(&e.restartCount, 1)
+	}
+	e.started = true
+	e.cmd = cmd
+	e.exited = make(chan struct{})
+	go io.Copy(ioutil.Discard, cmd.Stdout_r)
+	go e.logStderr(cmd.Stderr_r)
+	go func(exited chan struct{}) {
+		if err := cmd.Wait(); err != nil {
+			e.or.LogError(fmt.Errorf("%s exited: %s", e.conf.Bin, err))
+		}
+		close(exited)
+	}(e.exited)
+	return nil
+}
+
+func (e *ExecOutput) logStderr(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		e.or.LogError(fmt.Errorf("%s: %s", e.conf.Bin, scanner.Text()))
+	}
+	// Keep the pipe drained even if a line was too long to scan.
+	io.Copy(ioutil.Discard, r)
+}
+
+// Closes the command's stdin and waits for it to exit, killing it if it
+// doesn't do so in time.
+func (e *ExecOutput) stop() {
+	if e.cmd == nil {
+		return
+	}
+	e.stdin.Close()
+	select {
+	case <-e.exited:
+	case <-e.clock.After(e.stopTimeout):
+		e.cmd.Stopchan <- true
+		<-e.exited
+	}
+	e.cmd = nil
+}
+
+// Adds the record to the current batch, running the command first if the
+// batch is full or has waited long enough. The cursor is only advanced once
+// the command has successfully processed a batch. A batch the command failed
+// on is kept and retried before the message being retried is added to it.
+func (e *ExecOutput) batchMessage(record []byte, cursor string) error {
+	if e.batchLen >= e.conf.FlushCount ||
+		(e.batchLen > 0 && e.clock.Now().Sub(e.batchStart) >= e.flushInterval) {
+
+		if err := e.flush(); err != nil {
+			return err
+		}
+	}
+	if e.batchLen == 0 {
+		e.batchStart = e.clock.Now()
+	}
+	e.batch = append(e.batch, record...)
+	e.batchLen++
+	e.batchCursor = cursor
+	atomic.AddInt64(&e.processMessageCount, 1)
+	if e.batchLen >= e.conf.FlushCount {
+		if err := e.flush(); err != nil {
+			// The batch will be retried w/ the next message.
+			e.or.LogError(err)
+		}
+	}
+	return nil
+}
+
+// Runs the command w/ the current batch on its stdin.
+func (e *ExecOutput) flush() error {
+	var stderr bytes.Buffer
+	cmd := e.newCmd(time.Duration(e.conf.TimeoutSeconds) * time.Second)
+	cmd.Stdin = bytes.NewReader(e.batch)
+	cmd.Stdout = ioutil.Discard
+	cmd.Stderr = &stderr
+	err := cmd.Start(false)
+	if err == nil {
+		err = cmd.Wait()
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return NewRetryMessageError("%s failed on a batch of %d messages: %s: %s",
+				e.conf.Bin, e.batchLen, err, msg)
+		}
+		return NewRetryMessageError("%s failed on a batch of %d messages: %s",
+			e.conf.Bin, e.batchLen, err)
+	}
+	e.batch = e.batch[:0]
+	e.batchLen = 0
+	atomic.AddInt64(&e.batchCount, 1)
+	e.or.UpdateCursor(e.batchCursor)
+	return nil
+}
+
+// Runs the command for the current batch once it has waited long enough, so
+// batched messages aren't held indefinitely when traffic is light.
+func (e *ExecOutput) TimerEvent() error {
+	if e.batchLen > 0 && e.clock.Now().Sub(e.batchStart) >= e.flushInterval {
+		if err := e.flush(); err != nil {
+			e.or.LogError(err)
+		}
+	}
+	return nil
+}
+
+func (e *ExecOutput) CleanUp() {
+	if e.batchLen > 0 {
+		if err := e.flush(); err != nil {
+			e.or.LogError(err)
+		}
+	}
+	e.stop()
+}
+
+// Satisfies the `pipeline.ReportingPlugin` interface to provide plugin state
+// information to the Heka report and dashboard.
+func (e *ExecOutput) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "ProcessMessageCount",
+		atomic.LoadInt64(&e.processMessageCount), "count")
+	message.NewInt64Field(msg, "DropMessageCount",
+		atomic.LoadInt64(&e.dropMessageCount), "count")
+	message.NewInt64Field(msg, "RestartCount",
+		atomic.LoadInt64(&e.restartCount), "count")
+	message.NewInt64Field(msg, "BatchCount",
+		atomic.LoadInt64(&e.batchCount), "count")
+	return nil
+}
+
+func init() {
+	RegisterPlugin("ExecOutput", func() interface{} {
+		return new(ExecOutput)
+	})
+}
@@ -0,0 +1,128 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package process
+
+import (
+	"sync/atomic"
+
+	. "github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	"github.com/mozilla-services/heka/plugins"
+	plugins_ts "github.com/mozilla-services/heka/plugins/testsupport"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func ExecOutputSpec(c gs.Context) {
+	t := new(pipeline_ts.SimpleT)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	oth := plugins_ts.NewOutputTestHelper(ctrl)
+	pConfig := NewPipelineConfig(nil)
+
+	c.Specify("An ExecOutput", func() {
+		output := new(ExecOutput)
+		config := output.ConfigStruct().(*ExecOutputConfig)
+		config.Bin = EXECOUTPUT_CMD
+		config.Args = EXECOUTPUT_CMD_ARGS
+
+		encoder := new(plugins.PayloadEncoder)
+		encoder.Init(encoder.ConfigStruct())
+		prepare := func() {
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			oth.MockOutputRunner.EXPECT().Encoder().Return(encoder)
+			err = output.Prepare(oth.MockOutputRunner, oth.MockHelper)
+			c.Assume(err, gs.IsNil)
+		}
+
+		newPack := func(cursor string) *PipelinePack {
+			pack := NewPipelinePack(pConfig.InputRecycleChan())
+			pack.Message = pipeline_ts.GetTestMessage()
+			pack.QueueCursor = cursor
+			oth.MockOutputRunner.EXPECT().Encode(pack).Return(encoder.Encode(pack))
+			return pack
+		}
+
+		c.Specify("rejects an unknown mode", func() {
+			config.Mode = "sometimes"
+			err := output.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("in stream mode", func() {
+			prepare()
+			defer output.CleanUp()
+
+			c.Specify("writes messages to the command", func() {
+				oth.MockOutputRunner.EXPECT().UpdateCursor("one")
+				err := output.ProcessMessage(newPack("one"))
+				c.Expect(err, gs.IsNil)
+				c.Expect(output.cmd, gs.Not(gs.IsNil))
+			})
+
+			c.Specify("restarts the command if it exits", func() {
+				oth.MockOutputRunner.EXPECT().UpdateCursor("one")
+				oth.MockOutputRunner.EXPECT().UpdateCursor("two")
+				oth.MockOutputRunner.EXPECT().LogError(gomock.Any()).AnyTimes()
+				err := output.ProcessMessage(newPack("one"))
+				c.Assume(err, gs.IsNil)
+				output.cmd.Process.Kill()
+				<-output.exited
+
+				err = output.ProcessMessage(newPack("two"))
+				c.Expect(err, gs.IsNil)
+				c.Expect(atomic.LoadInt64(&output.restartCount), gs.Equals, int64(1))
+			})
+		})
+
+		c.Specify("in batch mode", func() {
+			config.Mode = "batch"
+			config.FlushCount = 2
+
+			c.Specify("runs the command once per batch", func() {
+				prepare()
+				oth.MockOutputRunner.EXPECT().UpdateCursor("two")
+
+				err := output.ProcessMessage(newPack("one"))
+				c.Expect(err, gs.IsNil)
+				c.Expect(output.batchLen, gs.Equals, uint(1))
+				err = output.ProcessMessage(newPack("two"))
+				c.Expect(err, gs.IsNil)
+				c.Expect(output.batchLen, gs.Equals, uint(0))
+				c.Expect(atomic.LoadInt64(&output.batchCount), gs.Equals, int64(1))
+			})
+
+			c.Specify("keeps the batch if the command fails", func() {
+				config.Bin = EXECOUTPUT_FAIL_CMD
+				config.Args = EXECOUTPUT_FAIL_CMD_ARGS
+				prepare()
+				oth.MockOutputRunner.EXPECT().LogError(gomock.Any())
+
+				err := output.ProcessMessage(newPack("one"))
+				c.Expect(err, gs.IsNil)
+				err = output.ProcessMessage(newPack("two"))
+				c.Expect(err, gs.IsNil)
+				// The second message fills the batch, which fails and is
+				// retried w/ the third.
+				err = output.ProcessMessage(newPack("three"))
+				_, isRetry := err.(RetryMessageError)
+				c.Expect(isRetry, gs.IsTrue)
+				c.Expect(output.batchLen, gs.Equals, uint(2))
+			})
+		})
+	})
+}
@@ -0,0 +1,195 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package process
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+)
+
+type ExternalDecoderConfig struct {
+	// Path to the plugin executable.
+	Bin string
+
+	// Command arguments.
+	Args []string
+
+	// Environment variables.
+	Env []string
+
+	// Working directory of the plugin.
+	Directory string
+
+	// Seconds to wait for each frame of the plugin's reply to a message
+	// before it's considered hung and restarted. Defaults to 5, 0 waits
+	// forever.
+	Timeout uint `toml:"timeout"`
+
+	// Seconds to wait for the plugin to exit after its stdin has been
+	// closed, before it's killed. Defaults to 5.
+	StopTimeout uint `toml:"stop_timeout"`
+}
+
+// Decoder plugin that hands each message to a plugin process speaking the
+// external plugin protocol. The messages the plugin sends back are the
+// decoded ones, the first of them replacing the original message.
+type ExternalDecoder struct {
+	conf        *ExternalDecoderConfig
+	dr          DecoderRunner
+	proc        *externalProcess
+	timeout     time.Duration
+	stopTimeout time.Duration
+	started     bool
+
+	processMessageCount    int64
+	processMessageFailures int64
+	restartCount           int64
+}
+
+func (d *ExternalDecoder) ConfigStruct() interface{} {
+	return &ExternalDecoderConfig{
+		Timeout:     5,
+		StopTimeout: 5,
+	}
+}
+
+func (d *ExternalDecoder) Init(config interface{}) error {
+	d.conf = config.(*ExternalDecoderConfig)
+	if d.conf.Bin == "" {
+		return errors.New("`bin` must be specified")
+	}
+	d.timeout = time.Duration(d.conf.Timeout) * time.Second
+	d.stopTimeout = time.Duration(d.conf.StopTimeout) * time.Second
+	return nil
+}
+
+// Implements WantsDecoderRunner, the runner provides the packs for any extra
+// messages and logs the plugin's output.
+func (d *ExternalDecoder) SetDecoderRunner(dr DecoderRunner) {
+	d.dr = dr
+}
+
+// Starts a new plugin process if there's none yet or the current one has
+// exited.
+func (d *ExternalDecoder) ensureRunning() (err error) {
+	if d.proc != nil && d.proc.hasExited() {
+		d.stop()
+	}
+	if d.proc != nil {
+		return nil
+	}
+	cmd := newExternalCmd(d.conf.Bin, d.conf.Args, d.conf.Env, d.conf.Directory)
+	if d.proc, err = startExternal(cmd, d.stopTimeout, d.dr); err != nil {
+		return fmt.Errorf("can't start %s: %s", d.conf.Bin, err)
+	}
+	if d.started {
+		atomic.AddInt64(&d.restartCount, 1)
+	}
+	d.started = true
+	return nil
+}
+
+func (d *ExternalDecoder) stop() {
+	if d.proc != nil {
+		d.proc.stop()
+		d.proc = nil
+	}
+}
+
+func (d *ExternalDecoder) Decode(pack *PipelinePack) (packs []*PipelinePack, err error) {
+	if packs, err = d.decode(pack); err != nil {
+		atomic.AddInt64(&d.processMessageFailures, 1)
+		return nil, err
+	}
+	atomic.AddInt64(&d.processMessageCount, 1)
+	return packs, nil
+}
+
+func (d *ExternalDecoder) decode(pack *PipelinePack) (packs []*PipelinePack, err error) {
+	if err = d.ensureRunning(); err != nil {
+		return nil, err
+	}
+	if err = pack.EncodeMsgBytes(); err != nil {
+		return nil, fmt.Errorf("can't encode message: %s", err)
+	}
+	var msgs []*message.Message
+	if err = d.proc.send(frameMessage, pack.MsgBytes); err == nil {
+		err = d.proc.reply(d.timeout, func(data []byte) {
+			msg := new(message.Message)
+			if e := unmarshalExternal(data, msg); e != nil {
+				d.dr.LogError(fmt.Errorf("%s: %s", d.conf.Bin, e))
+				return
+			}
+			msgs = append(msgs, msg)
+		})
+	}
+	if err != nil {
+		if _, ok := err.(externalError); !ok {
+			// The plugin exited, hung or broke the protocol, a new one is
+			// started for the next message.
+			d.stop()
+		}
+		return nil, err
+	}
+	if len(msgs) == 0 {
+		// Dropped by the plugin.
+		return nil, nil
+	}
+	packs = make([]*PipelinePack, 0, len(msgs))
+	for i, msg := range msgs {
+		p := pack
+		if i > 0 {
+			if p = d.dr.NewPack(); p == nil {
+				// We're shutting down.
+				for _, extra := range packs[1:] {
+					extra.Recycle(nil)
+				}
+				return nil, errors.New("no pack for the decoded message")
+			}
+		}
+		p.Message = msg
+		p.TrustMsgBytes = false
+		packs = append(packs, p)
+	}
+	return packs, nil
+}
+
+// Implements WantsDecoderRunnerShutdown, stopping the plugin process.
+func (d *ExternalDecoder) Shutdown() {
+	d.stop()
+}
+
+// Satisfies the `pipeline.ReportingPlugin` interface to provide plugin state
+// information to the Heka report and dashboard.
+func (d *ExternalDecoder) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "ProcessMessageCount",
+		atomic.LoadInt64(&d.processMessageCount), "count")
+	message.NewInt64Field(msg, "ProcessMessageFailures",
+		atomic.LoadInt64(&d.processMessageFailures), "count")
+	message.NewInt64Field(msg, "RestartCount",
+		atomic.LoadInt64(&d.restartCount), "count")
+	return nil
+}
+
+func init() {
+	RegisterPlugin("ExternalDecoder", func() interface{} {
+		return new(ExternalDecoder)
+	})
+}
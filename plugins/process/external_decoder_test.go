@@ -0,0 +1,115 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package process
+
+import (
+	"sync/atomic"
+
+	. "github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	"github.com/mozilla-services/heka/pipelinemock"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func ExternalDecoderSpec(c gs.Context) {
+	t := new(pipeline_ts.SimpleT)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	pConfig := NewPipelineConfig(nil)
+
+	c.Specify("An ExternalDecoder", func() {
+		dr := pipelinemock.NewMockDecoderRunner(ctrl)
+		dr.EXPECT().LogMessage(gomock.Any()).AnyTimes()
+		dr.EXPECT().LogError(gomock.Any()).AnyTimes()
+
+		decoder := new(ExternalDecoder)
+		config := decoder.ConfigStruct().(*ExternalDecoderConfig)
+		config.Bin = EXTERNAL_PLUGIN_CMD
+		config.Args = EXTERNAL_PLUGIN_ARGS
+		config.Env = EXTERNAL_PLUGIN_ENV
+		decoder.SetDecoderRunner(dr)
+		defer decoder.Shutdown()
+
+		pack := NewPipelinePack(pConfig.InputRecycleChan())
+		pack.Message = pipeline_ts.GetTestMessage()
+
+		c.Specify("replaces the message w/ the plugin's", func() {
+			c.Assume(decoder.Init(config), gs.IsNil)
+			packs, err := decoder.Decode(pack)
+			c.Expect(err, gs.IsNil)
+			c.Assume(len(packs), gs.Equals, 1)
+			c.Expect(packs[0], gs.Equals, pack)
+			c.Expect(pack.Message.GetType(), gs.Equals, "echo")
+			c.Expect(pack.Message.GetPayload(), gs.Equals, "Test Payload")
+		})
+
+		c.Specify("returns extra messages in new packs", func() {
+			c.Assume(decoder.Init(config), gs.IsNil)
+			extra := NewPipelinePack(pConfig.InputRecycleChan())
+			dr.EXPECT().NewPack().Return(extra)
+			pack.Message.SetType("split")
+			pack.Message.SetPayload("one two")
+			packs, err := decoder.Decode(pack)
+			c.Expect(err, gs.IsNil)
+			c.Assume(len(packs), gs.Equals, 2)
+			c.Expect(packs[0], gs.Equals, pack)
+			c.Expect(packs[1], gs.Equals, extra)
+			c.Expect(pack.Message.GetPayload(), gs.Equals, "one")
+			c.Expect(extra.Message.GetPayload(), gs.Equals, "two")
+		})
+
+		c.Specify("drops messages the plugin doesn't send back", func() {
+			c.Assume(decoder.Init(config), gs.IsNil)
+			pack.Message.SetType("drop")
+			packs, err := decoder.Decode(pack)
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(packs), gs.Equals, 0)
+		})
+
+		c.Specify("fails to decode if the plugin", func() {
+			c.Specify("sends an error", func() {
+				c.Assume(decoder.Init(config), gs.IsNil)
+				pack.Message.SetType("fail")
+				_, err := decoder.Decode(pack)
+				c.Expect(err, gs.Not(gs.IsNil))
+				c.Expect(pack.Message.GetType(), gs.Equals, "fail")
+			})
+
+			c.Specify("exits, restarting it", func() {
+				c.Assume(decoder.Init(config), gs.IsNil)
+				pack.Message.SetType("crash")
+				_, err := decoder.Decode(pack)
+				c.Expect(err, gs.Not(gs.IsNil))
+				pack.Message.SetType("TEST")
+				pack.TrustMsgBytes = false
+				_, err = decoder.Decode(pack)
+				c.Expect(err, gs.IsNil)
+				c.Expect(atomic.LoadInt64(&decoder.restartCount), gs.Equals, int64(1))
+			})
+
+			c.Specify("doesn't reply in time", func() {
+				config.Timeout = 1
+				config.StopTimeout = 0
+				c.Assume(decoder.Init(config), gs.IsNil)
+				pack.Message.SetType("hang")
+				_, err := decoder.Decode(pack)
+				c.Expect(err, gs.Not(gs.IsNil))
+				c.Expect(decoder.proc == nil, gs.IsTrue)
+			})
+		})
+	})
+}
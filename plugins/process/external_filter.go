@@ -0,0 +1,223 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package process
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+)
+
+type ExternalFilterConfig struct {
+	// Path to the plugin executable.
+	Bin string
+
+	// Command arguments.
+	Args []string
+
+	// Environment variables.
+	Env []string
+
+	// Working directory of the plugin.
+	Directory string
+
+	// Seconds to wait for each frame of the plugin's reply to a message or
+	// timer event before it's considered hung and restarted. Defaults to 5,
+	// 0 waits forever.
+	Timeout uint `toml:"timeout"`
+
+	// Seconds to wait for the plugin to exit after its stdin has been
+	// closed, before it's killed. Defaults to 5.
+	StopTimeout uint `toml:"stop_timeout"`
+}
+
+// Filter plugin that hands each message to a plugin process speaking the
+// external plugin protocol and injects the messages it sends back.
+type ExternalFilter struct {
+	conf        *ExternalFilterConfig
+	fr          FilterRunner
+	h           PluginHelper
+	proc        *externalProcess
+	timeout     time.Duration
+	stopTimeout time.Duration
+	started     bool
+
+	// The message the plugin last exited or hung on, it's only retried once.
+	failedPack *PipelinePack
+
+	processMessageCount    int64
+	processMessageFailures int64
+	injectMessageCount     int64
+	restartCount           int64
+}
+
+func (f *ExternalFilter) ConfigStruct() interface{} {
+	return &ExternalFilterConfig{
+		Timeout:     5,
+		StopTimeout: 5,
+	}
+}
+
+func (f *ExternalFilter) Init(config interface{}) error {
+	f.conf = config.(*ExternalFilterConfig)
+	if f.conf.Bin == "" {
+		return errors.New("`bin` must be specified")
+	}
+	f.timeout = time.Duration(f.conf.Timeout) * time.Second
+	f.stopTimeout = time.Duration(f.conf.StopTimeout) * time.Second
+	return nil
+}
+
+func (f *ExternalFilter) Prepare(fr FilterRunner, h PluginHelper) error {
+	f.fr = fr
+	f.h = h
+	return f.start()
+}
+
+func (f *ExternalFilter) start() (err error) {
+	cmd := newExternalCmd(f.conf.Bin, f.conf.Args, f.conf.Env, f.conf.Directory)
+	if f.proc, err = startExternal(cmd, f.stopTimeout, f.fr); err != nil {
+		return fmt.Errorf("can't start %s: %s", f.conf.Bin, err)
+	}
+	if f.started {
+		atomic.AddInt64(&f.restartCount, 1)
+	}
+	f.started = true
+	return nil
+}
+
+// Starts a new plugin process if the current one has exited or was stopped.
+func (f *ExternalFilter) ensureRunning() error {
+	if f.proc != nil && f.proc.hasExited() {
+		f.stop()
+	}
+	if f.proc == nil {
+		return f.start()
+	}
+	return nil
+}
+
+func (f *ExternalFilter) stop() {
+	if f.proc != nil {
+		f.proc.stop()
+		f.proc = nil
+	}
+}
+
+// Sends the message to the plugin and waits for it to be done w/ it, so a
+// slow plugin holds up its message matcher rather than messages piling up in
+// between.
+func (f *ExternalFilter) ProcessMessage(pack *PipelinePack) error {
+	if err := f.ensureRunning(); err != nil {
+		return NewRetryMessageError(err.Error())
+	}
+	if err := pack.EncodeMsgBytes(); err != nil {
+		atomic.AddInt64(&f.processMessageFailures, 1)
+		return fmt.Errorf("can't encode message: %s", err)
+	}
+	err := f.proc.send(frameMessage, pack.MsgBytes)
+	if err == nil {
+		err = f.reply(pack.MsgLoopCount)
+	}
+	if err == nil {
+		f.failedPack = nil
+		atomic.AddInt64(&f.processMessageCount, 1)
+		f.fr.UpdateCursor(pack.QueueCursor)
+		return nil
+	}
+	atomic.AddInt64(&f.processMessageFailures, 1)
+	if _, ok := err.(externalError); ok {
+		return err
+	}
+	// The plugin exited, hung or broke the protocol. It's replaced and the
+	// message retried, unless the message already failed this way before.
+	f.stop()
+	if f.failedPack != pack {
+		f.failedPack = pack
+		return NewRetryMessageError("%s, retrying w/ a new plugin process", err)
+	}
+	f.failedPack = nil
+	return err
+}
+
+func (f *ExternalFilter) reply(msgLoopCount uint) error {
+	return f.proc.reply(f.timeout, func(data []byte) {
+		f.inject(data, msgLoopCount)
+	})
+}
+
+func (f *ExternalFilter) inject(data []byte, msgLoopCount uint) {
+	pack, err := f.h.PipelinePack(msgLoopCount)
+	if err != nil {
+		f.fr.LogError(err)
+		return
+	}
+	if err = unmarshalExternal(data, pack.Message); err != nil {
+		f.fr.LogError(fmt.Errorf("%s: %s", f.conf.Bin, err))
+		pack.Recycle(nil)
+		return
+	}
+	if pack.Message.GetLogger() == "" {
+		pack.Message.SetLogger(f.fr.Name())
+	}
+	if f.fr.Inject(pack) {
+		atomic.AddInt64(&f.injectMessageCount, 1)
+	}
+}
+
+// Hands the timer event to the plugin, restarting it first if it has exited.
+func (f *ExternalFilter) TimerEvent() error {
+	if err := f.ensureRunning(); err != nil {
+		return err
+	}
+	err := f.proc.send(frameTimer, nil)
+	if err == nil {
+		err = f.reply(0)
+	}
+	if err != nil {
+		if _, ok := err.(externalError); !ok {
+			f.stop()
+		}
+	}
+	return err
+}
+
+func (f *ExternalFilter) CleanUp() {
+	f.stop()
+}
+
+// Satisfies the `pipeline.ReportingPlugin` interface to provide plugin state
+// information to the Heka report and dashboard.
+func (f *ExternalFilter) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "ProcessMessageCount",
+		atomic.LoadInt64(&f.processMessageCount), "count")
+	message.NewInt64Field(msg, "ProcessMessageFailures",
+		atomic.LoadInt64(&f.processMessageFailures), "count")
+	message.NewInt64Field(msg, "InjectMessageCount",
+		atomic.LoadInt64(&f.injectMessageCount), "count")
+	message.NewInt64Field(msg, "RestartCount",
+		atomic.LoadInt64(&f.restartCount), "count")
+	return nil
+}
+
+func init() {
+	RegisterPlugin("ExternalFilter", func() interface{} {
+		return new(ExternalFilter)
+	})
+}
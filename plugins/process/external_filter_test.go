@@ -0,0 +1,112 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package process
+
+import (
+	"sync/atomic"
+
+	. "github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	"github.com/mozilla-services/heka/pipelinemock"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func ExternalFilterSpec(c gs.Context) {
+	t := new(pipeline_ts.SimpleT)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	pConfig := NewPipelineConfig(nil)
+
+	c.Specify("An ExternalFilter", func() {
+		fr := pipelinemock.NewMockFilterRunner(ctrl)
+		h := pipelinemock.NewMockPluginHelper(ctrl)
+		fr.EXPECT().Name().Return("external").AnyTimes()
+		fr.EXPECT().LogMessage(gomock.Any()).AnyTimes()
+		fr.EXPECT().LogError(gomock.Any()).AnyTimes()
+
+		filter := new(ExternalFilter)
+		config := filter.ConfigStruct().(*ExternalFilterConfig)
+		config.Bin = EXTERNAL_PLUGIN_CMD
+		config.Args = EXTERNAL_PLUGIN_ARGS
+		config.Env = EXTERNAL_PLUGIN_ENV
+		err := filter.Init(config)
+		c.Assume(err, gs.IsNil)
+		err = filter.Prepare(fr, h)
+		c.Assume(err, gs.IsNil)
+		defer filter.CleanUp()
+
+		newPack := func(msgType string) *PipelinePack {
+			pack := NewPipelinePack(pConfig.InputRecycleChan())
+			pack.Message = pipeline_ts.GetTestMessage()
+			pack.Message.SetType(msgType)
+			pack.QueueCursor = msgType
+			return pack
+		}
+		expectInject := func() *PipelinePack {
+			pack := NewPipelinePack(pConfig.InjectRecycleChan())
+			h.EXPECT().PipelinePack(uint(0)).Return(pack, nil)
+			fr.EXPECT().Inject(pack).Return(true)
+			return pack
+		}
+
+		c.Specify("injects the messages the plugin sends back", func() {
+			injected := expectInject()
+			fr.EXPECT().UpdateCursor("TEST")
+			err := filter.ProcessMessage(newPack("TEST"))
+			c.Expect(err, gs.IsNil)
+			c.Expect(injected.Message.GetType(), gs.Equals, "echo")
+			c.Expect(injected.Message.GetPayload(), gs.Equals, "Test Payload")
+			c.Expect(atomic.LoadInt64(&filter.injectMessageCount), gs.Equals, int64(1))
+		})
+
+		c.Specify("hands timer events to the plugin", func() {
+			injected := expectInject()
+			err := filter.TimerEvent()
+			c.Expect(err, gs.IsNil)
+			c.Expect(injected.Message.GetType(), gs.Equals, "tick")
+			c.Expect(injected.Message.GetLogger(), gs.Equals, "external")
+			c.Expect(len(injected.Message.GetUuid()), gs.Equals, 16)
+		})
+
+		c.Specify("returns the errors the plugin sends", func() {
+			err := filter.ProcessMessage(newPack("fail"))
+			c.Expect(err, gs.Not(gs.IsNil))
+			_, retry := err.(RetryMessageError)
+			c.Expect(retry, gs.IsFalse)
+			c.Expect(filter.proc.hasExited(), gs.IsFalse)
+		})
+
+		c.Specify("restarts the plugin if it exits", func() {
+			pack := newPack("crash")
+			err := filter.ProcessMessage(pack)
+			_, retry := err.(RetryMessageError)
+			c.Expect(retry, gs.IsTrue)
+
+			// Only retried once.
+			err = filter.ProcessMessage(pack)
+			c.Expect(err, gs.Not(gs.IsNil))
+			_, retry = err.(RetryMessageError)
+			c.Expect(retry, gs.IsFalse)
+
+			expectInject()
+			fr.EXPECT().UpdateCursor("TEST")
+			err = filter.ProcessMessage(newPack("TEST"))
+			c.Expect(err, gs.IsNil)
+			c.Expect(atomic.LoadInt64(&filter.restartCount), gs.Equals, int64(2))
+		})
+	})
+}
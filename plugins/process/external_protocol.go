@@ -0,0 +1,283 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package process
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	"github.com/pborman/uuid"
+)
+
+// Frame types of the external plugin protocol. Each frame is a 4 byte big
+// endian length, covering the type byte and the payload, followed by the
+// type byte and the payload.
+const (
+	// A protobuf encoded message, sent in both directions.
+	frameMessage = 'M'
+	// A timer event, sent to the plugin w/o a payload.
+	frameTimer = 'T'
+	// Sent by the plugin when it's done w/ a message or timer event.
+	frameDone = 'D'
+	// Sent by the plugin in place of a done frame when it failed to process
+	// a message or timer event, the payload holds the error text.
+	frameError = 'E'
+	// A line of text the plugin wants logged.
+	frameLog = 'L'
+)
+
+// Size of a frame's length and type byte.
+const frameOverhead = 5
+
+var errPluginExited = errors.New("plugin process exited")
+
+// Error text a plugin sent in an error frame.
+type externalError string
+
+func (e externalError) Error() string {
+	return string(e)
+}
+
+// Writes a single frame, w/ a single write so frames of concurrent writers
+// can't interleave.
+func writeFrame(w io.Writer, kind byte, payload []byte) error {
+	frame := make([]byte, frameOverhead+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(1+len(payload)))
+	frame[4] = kind
+	copy(frame[frameOverhead:], payload)
+	_, err := w.Write(frame)
+	return err
+}
+
+// Reads the next frame, returning io.EOF only if the stream ended cleanly
+// between frames.
+func readFrame(r io.Reader) (kind byte, payload []byte, err error) {
+	var header [4]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size == 0 || size > message.MAX_MESSAGE_SIZE+1 {
+		return 0, nil, fmt.Errorf("invalid frame size: %d", size)
+	}
+	frame := make([]byte, size)
+	if _, err = io.ReadFull(r, frame); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	return frame[0], frame[1:], nil
+}
+
+// Decodes a message sent by a plugin, giving it a UUID and timestamp if the
+// plugin left them out.
+func unmarshalExternal(data []byte, msg *message.Message) error {
+	if err := message.UnmarshalMessage(data, msg); err != nil {
+		return fmt.Errorf("can't decode message: %s", err)
+	}
+	if len(msg.GetUuid()) == 0 {
+		msg.SetUuid(uuid.NewRandom())
+	}
+	if msg.Timestamp == nil {
+		msg.SetTimestamp(time.Now().UnixNano())
+	}
+	return nil
+}
+
+type externalFrame struct {
+	kind    byte
+	payload []byte
+}
+
+// Where the output of a plugin process is logged, satisfied by both the
+// FilterRunner and the DecoderRunner.
+type externalLogger interface {
+	LogError(err error)
+	LogMessage(msg string)
+}
+
+// A running plugin process speaking the external plugin protocol on its
+// stdin and stdout.
+type externalProcess struct {
+	bin         string
+	cmd         *ManagedCmd
+	stdin       io.WriteCloser
+	frames      chan externalFrame
+	exited      chan struct{}
+	stopping    chan struct{}
+	stopTimeout time.Duration
+	logger      externalLogger
+}
+
+// Starts the command as a plugin process, logging its stderr output, the
+// log frames it sends and its exit.
+func startExternal(cmd *ManagedCmd, stopTimeout time.Duration,
+	logger externalLogger) (p *externalProcess, err error) {
+
+	p = &externalProcess{
+		bin:         cmd.Path,
+		cmd:         cmd,
+		frames:      make(chan externalFrame),
+		exited:      make(chan struct{}),
+		stopping:    make(chan struct{}),
+		stopTimeout: stopTimeout,
+		logger:      logger,
+	}
+	if p.stdin, err = cmd.StdinPipe(); err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(true); err != nil {
+		return nil, err
+	}
+	go p.readFrames(cmd.Stdout_r)
+	go p.logStderr(cmd.Stderr_r)
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			logger.LogError(fmt.Errorf("%s exited: %s", p.bin, err))
+		}
+		close(p.exited)
+	}()
+	return p, nil
+}
+
+// Hands the frames read from the plugin's stdout to `receive`, until the
+// stream ends or is corrupt. The stream is drained afterwards so the plugin
+// never blocks writing to it.
+func (p *externalProcess) readFrames(r io.Reader) {
+	defer close(p.frames)
+	br := bufio.NewReader(r)
+	for {
+		kind, payload, err := readFrame(br)
+		if err != nil {
+			if err != io.EOF {
+				p.logger.LogError(fmt.Errorf("%s: reading frame: %s", p.bin, err))
+			}
+			io.Copy(ioutil.Discard, br)
+			return
+		}
+		if kind == frameLog {
+			p.logger.LogMessage(fmt.Sprintf("%s: %s", p.bin, payload))
+			continue
+		}
+		select {
+		case p.frames <- externalFrame{kind, payload}:
+		case <-p.stopping:
+			io.Copy(ioutil.Discard, br)
+			return
+		}
+	}
+}
+
+func (p *externalProcess) logStderr(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		p.logger.LogError(fmt.Errorf("%s: %s", p.bin, scanner.Text()))
+	}
+	// Keep the pipe drained even if a line was too long to scan.
+	io.Copy(ioutil.Discard, r)
+}
+
+// Builds the command for a plugin process.
+func newExternalCmd(bin string, args, env []string, dir string) *ManagedCmd {
+	cmd := NewManagedCmd(bin, args, 0)
+	if dir != "" {
+		cmd.Dir = dir
+	}
+	if env != nil {
+		cmd.Env = env
+	}
+	return cmd
+}
+
+func (p *externalProcess) send(kind byte, payload []byte) error {
+	if err := writeFrame(p.stdin, kind, payload); err != nil {
+		return fmt.Errorf("writing to %s: %s", p.bin, err)
+	}
+	return nil
+}
+
+// Returns the next frame from the plugin, waiting at most for the timeout
+// unless it's zero. Returns errPluginExited if the plugin exited or its
+// output can't be read anymore.
+func (p *externalProcess) receive(timeout time.Duration) (externalFrame, error) {
+	var timer <-chan time.Time
+	if timeout > 0 {
+		timer = time.After(timeout)
+	}
+	select {
+	case frame, ok := <-p.frames:
+		if !ok {
+			return frame, errPluginExited
+		}
+		return frame, nil
+	case <-timer:
+		return externalFrame{}, fmt.Errorf("%s didn't reply within %s", p.bin,
+			timeout)
+	}
+}
+
+// Reads the plugin's reply to a message or timer event, handing each message
+// it sends to the callback until it's done. Returns an externalError if the
+// plugin replied w/ an error frame.
+func (p *externalProcess) reply(timeout time.Duration,
+	handle func(data []byte)) error {
+
+	for {
+		frame, err := p.receive(timeout)
+		if err != nil {
+			return err
+		}
+		switch frame.kind {
+		case frameMessage:
+			handle(frame.payload)
+		case frameDone:
+			return nil
+		case frameError:
+			return externalError(fmt.Sprintf("%s: %s", p.bin, frame.payload))
+		default:
+			return fmt.Errorf("%s sent an unknown frame type: %q", p.bin, frame.kind)
+		}
+	}
+}
+
+// Closes the plugin's stdin and waits for it to exit, killing it if it
+// doesn't do so in time.
+func (p *externalProcess) stop() {
+	close(p.stopping)
+	p.stdin.Close()
+	select {
+	case <-p.exited:
+	case <-time.After(p.stopTimeout):
+		p.cmd.Stopchan <- true
+		<-p.exited
+	}
+}
+
+// Whether the plugin has exited on its own.
+func (p *externalProcess) hasExited() bool {
+	select {
+	case <-p.exited:
+		return true
+	default:
+		return false
+	}
+}
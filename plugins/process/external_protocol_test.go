@@ -0,0 +1,133 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package process
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+// Set to make the test binary act as the external plugin the specs talk to.
+const EXTERNAL_PLUGIN_HELPER_ENV = "HEKA_TEST_EXTERNAL_PLUGIN"
+
+// Config to run the test binary as the external plugin.
+var (
+	EXTERNAL_PLUGIN_CMD  = os.Args[0]
+	EXTERNAL_PLUGIN_ARGS = []string{"-test.run=TestExternalPluginHelper"}
+	EXTERNAL_PLUGIN_ENV  = append(os.Environ(), EXTERNAL_PLUGIN_HELPER_ENV+"=1")
+)
+
+// Not a real test, it's the external plugin when the test binary is run w/
+// the helper env var set. Messages are echoed back w/ their type set to
+// "echo", unless their type asks the plugin to behave differently.
+func TestExternalPluginHelper(t *testing.T) {
+	if os.Getenv(EXTERNAL_PLUGIN_HELPER_ENV) != "1" {
+		return
+	}
+	in := bufio.NewReader(os.Stdin)
+	out := bufio.NewWriter(os.Stdout)
+	send := func(msg *message.Message) {
+		data, _ := proto.Marshal(msg)
+		writeFrame(out, frameMessage, data)
+	}
+	for {
+		kind, payload, err := readFrame(in)
+		if err != nil {
+			os.Exit(0)
+		}
+		switch kind {
+		case frameTimer:
+			msg := new(message.Message)
+			msg.SetType("tick")
+			send(msg)
+		case frameMessage:
+			msg := new(message.Message)
+			proto.Unmarshal(payload, msg)
+			switch msg.GetType() {
+			case "crash":
+				os.Exit(1)
+			case "hang":
+				time.Sleep(time.Hour)
+			case "fail":
+				writeFrame(out, frameError, []byte("can't process"))
+				out.Flush()
+				continue
+			case "drop":
+			case "split":
+				for _, word := range strings.Fields(msg.GetPayload()) {
+					part := new(message.Message)
+					part.SetType("word")
+					part.SetPayload(word)
+					send(part)
+				}
+			default:
+				writeFrame(out, frameLog, []byte("echoing"))
+				msg.SetType("echo")
+				send(msg)
+			}
+		}
+		writeFrame(out, frameDone, nil)
+		out.Flush()
+	}
+}
+
+func ExternalProtocolSpec(c gs.Context) {
+	c.Specify("External plugin frames", func() {
+		var buf bytes.Buffer
+
+		c.Specify("are read back as written", func() {
+			c.Expect(writeFrame(&buf, frameMessage, []byte("data")), gs.IsNil)
+			c.Expect(writeFrame(&buf, frameDone, nil), gs.IsNil)
+			c.Expect(buf.Len(), gs.Equals, 2*frameOverhead+4)
+
+			kind, payload, err := readFrame(&buf)
+			c.Expect(err, gs.IsNil)
+			c.Expect(kind, gs.Equals, byte(frameMessage))
+			c.Expect(string(payload), gs.Equals, "data")
+			kind, payload, err = readFrame(&buf)
+			c.Expect(err, gs.IsNil)
+			c.Expect(kind, gs.Equals, byte(frameDone))
+			c.Expect(len(payload), gs.Equals, 0)
+			_, _, err = readFrame(&buf)
+			c.Expect(err, gs.Equals, io.EOF)
+		})
+
+		c.Specify("can't be truncated", func() {
+			writeFrame(&buf, frameMessage, []byte("data"))
+			buf.Truncate(buf.Len() - 1)
+			_, _, err := readFrame(&buf)
+			c.Expect(err, gs.Equals, io.ErrUnexpectedEOF)
+		})
+
+		c.Specify("can't be empty or oversized", func() {
+			buf.Write([]byte{0, 0, 0, 0})
+			_, _, err := readFrame(&buf)
+			c.Expect(err, gs.Not(gs.IsNil))
+
+			writeFrame(&buf, frameMessage, make([]byte, message.MAX_MESSAGE_SIZE+1))
+			_, _, err = readFrame(&buf)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+}
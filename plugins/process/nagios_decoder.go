@@ -0,0 +1,129 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+#***** END LICENSE BLOCK *****/
+
+package process
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+)
+
+type NagiosDecoderConfig struct {
+	// Name of the field holding the Nagios plugin's exit status, from which
+	// its state is determined. Defaults to "ExitStatus", as set by
+	// ProcessInput.
+	ExitStatusField string `toml:"exit_status_field"`
+
+	// Message severity of each Nagios state, overriding the defaults of 6
+	// for OK, 4 for WARNING, 2 for CRITICAL and 3 for UNKNOWN.
+	Severities map[string]int32
+
+	// Also add the warning and critical thresholds and the minimum and
+	// maximum of each performance data value as fields. Defaults to false.
+	Thresholds bool
+
+	// Message type to set on decoded messages. Defaults to leaving the type
+	// unchanged.
+	Type string
+}
+
+// Decoder that parses the output of Nagios plugins, such as that captured by
+// a ProcessInput running existing check scripts, into message fields.
+type NagiosDecoder struct {
+	conf       *NagiosDecoderConfig
+	severities map[string]int32
+}
+
+func (nd *NagiosDecoder) ConfigStruct() interface{} {
+	return &NagiosDecoderConfig{
+		ExitStatusField: "ExitStatus",
+	}
+}
+
+func (nd *NagiosDecoder) Init(config interface{}) error {
+	nd.conf = config.(*NagiosDecoderConfig)
+	nd.severities = make(map[string]int32, len(nagiosSeverities))
+	for state, severity := range nagiosSeverities {
+		nd.severities[state] = severity
+	}
+	for state, severity := range nd.conf.Severities {
+		upper := strings.ToUpper(state)
+		if _, ok := nagiosSeverities[upper]; !ok {
+			return fmt.Errorf("unknown Nagios state in `severities`: %s", state)
+		}
+		nd.severities[upper] = severity
+	}
+	return nil
+}
+
+func (nd *NagiosDecoder) Decode(pack *PipelinePack) ([]*PipelinePack, error) {
+	n, err := parseNagios(pack.Message.GetPayload())
+	if err != nil {
+		return nil, err
+	}
+	state := nd.state(pack.Message, n)
+	addNagiosFields(pack.Message, n, state)
+	if nd.conf.Thresholds {
+		addNagiosThresholds(pack.Message, n)
+	}
+	pack.Message.SetSeverity(nd.severities[state])
+	if nd.conf.Type != "" {
+		pack.Message.SetType(nd.conf.Type)
+	}
+	return []*PipelinePack{pack}, nil
+}
+
+// Determines the plugin's state from its exit status if there is one, or
+// else from the state plugins conventionally put in their status text, e.g.
+// "DISK WARNING - free space: ...".
+func (nd *NagiosDecoder) state(msg *message.Message, n *nagiosOutput) string {
+	if value, ok := msg.GetFieldValue(nd.conf.ExitStatusField); ok {
+		if status, ok := value.(int64); ok {
+			return nagiosState(int(status))
+		}
+	}
+	words := strings.FieldsFunc(n.text, func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+	for _, word := range words {
+		if _, ok := nagiosSeverities[word]; ok {
+			return word
+		}
+	}
+	return "UNKNOWN"
+}
+
+// Adds the thresholds and range of each performance data value, as strings
+// since thresholds may be ranges such as "10:20".
+func addNagiosThresholds(msg *message.Message, n *nagiosOutput) {
+	for _, pv := range n.perfdata {
+		for _, t := range []struct{ suffix, value string }{
+			{"warn", pv.warn}, {"crit", pv.crit}, {"min", pv.min}, {"max", pv.max},
+		} {
+			if t.value != "" {
+				message.NewStringField(msg, pv.label+"."+t.suffix, t.value)
+			}
+		}
+	}
+}
+
+func init() {
+	RegisterPlugin("NagiosDecoder", func() interface{} {
+		return new(NagiosDecoder)
+	})
+}
@@ -0,0 +1,84 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package process
+
+import (
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func NagiosDecoderSpec(c gs.Context) {
+	pConfig := NewPipelineConfig(nil)
+
+	c.Specify("A NagiosDecoder", func() {
+		decoder := new(NagiosDecoder)
+		config := decoder.ConfigStruct().(*NagiosDecoderConfig)
+		pack := NewPipelinePack(pConfig.InputRecycleChan())
+		pack.Message.SetPayload("LOAD WARNING - load average: 5.12, 4.01, 3.20" +
+			"|load1=5.120;5.000;10.000;0; load5=4.010;4.000;6.000;0;\n")
+		value := func(name string) interface{} {
+			v, _ := pack.Message.GetFieldValue(name)
+			return v
+		}
+
+		c.Specify("uses the exit status", func() {
+			err := decoder.Init(config)
+			c.Assume(err, gs.IsNil)
+			field, _ := message.NewField("ExitStatus", 2, "")
+			pack.Message.AddField(field)
+			packs, err := decoder.Decode(pack)
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(packs), gs.Equals, 1)
+			c.Expect(value("NagiosState"), gs.Equals, "CRITICAL")
+			c.Expect(value("NagiosOutput"), gs.Equals,
+				"LOAD WARNING - load average: 5.12, 4.01, 3.20")
+			c.Expect(value("load1"), gs.Equals, 5.12)
+			c.Expect(value("load5"), gs.Equals, 4.01)
+			c.Expect(pack.Message.GetSeverity(), gs.Equals, int32(2))
+		})
+
+		c.Specify("falls back to the status text", func() {
+			config.Severities = map[string]int32{"warning": 5}
+			config.Thresholds = true
+			config.Type = "nagios.load"
+			err := decoder.Init(config)
+			c.Assume(err, gs.IsNil)
+			_, err = decoder.Decode(pack)
+			c.Expect(err, gs.IsNil)
+			c.Expect(value("NagiosState"), gs.Equals, "WARNING")
+			c.Expect(pack.Message.GetSeverity(), gs.Equals, int32(5))
+			c.Expect(pack.Message.GetType(), gs.Equals, "nagios.load")
+			c.Expect(value("load1.warn"), gs.Equals, "5.000")
+			c.Expect(value("load5.crit"), gs.Equals, "6.000")
+			_, ok := pack.Message.GetFieldValue("load5.max")
+			c.Expect(ok, gs.IsFalse)
+		})
+
+		c.Specify("rejects unknown states", func() {
+			config.Severities = map[string]int32{"PANIC": 0}
+			err := decoder.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("fails on invalid perfdata", func() {
+			err := decoder.Init(config)
+			c.Assume(err, gs.IsNil)
+			pack.Message.SetPayload("OK | load=high")
+			_, err = decoder.Decode(pack)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+}
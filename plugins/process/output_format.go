@@ -0,0 +1,274 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+#***** END LICENSE BLOCK *****/
+
+package process
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// Parses a command's output, adding what it finds to the message. The
+// command's exit status is provided for formats that give it a meaning.
+type outputParser func(output string, exitStatus int, msg *message.Message) error
+
+var outputParsers = map[string]outputParser{
+	"json":     parseJsonOutput,
+	"nagios":   parseNagiosOutput,
+	"graphite": parseGraphiteOutput,
+}
+
+// Adds each of the JSON object's values as a field. Nested objects are
+// flattened, w/ their keys joined by dots, and arrays are added as JSON.
+func parseJsonOutput(output string, exitStatus int, msg *message.Message) error {
+	var obj map[string]interface{}
+	if err := json.Unmarshal([]byte(output), &obj); err != nil {
+		return fmt.Errorf("invalid JSON output: %s", err)
+	}
+	return addJsonFields(msg, "", obj)
+}
+
+func addJsonFields(msg *message.Message, prefix string, obj map[string]interface{}) error {
+	// Sorted, so the fields are always in the same order.
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		name := prefix + key
+		switch v := obj[key].(type) {
+		case nil:
+		case map[string]interface{}:
+			if err := addJsonFields(msg, name+".", v); err != nil {
+				return err
+			}
+		case []interface{}:
+			data, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			message.NewStringField(msg, name, string(data))
+		default:
+			field, err := message.NewField(name, v, "")
+			if err != nil {
+				return fmt.Errorf("can't add field '%s': %s", name, err)
+			}
+			msg.AddField(field)
+		}
+	}
+	return nil
+}
+
+// Adds a float field for each line of Graphite's plaintext protocol, i.e.
+// "<metric path> <value> <timestamp>", named for the metric path.
+func parseGraphiteOutput(output string, exitStatus int, msg *message.Message) error {
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return fmt.Errorf("invalid Graphite line: '%s'", line)
+		}
+		value, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return fmt.Errorf("invalid value for '%s': %s", fields[0], err)
+		}
+		field, _ := message.NewField(fields[0], value, "")
+		msg.AddField(field)
+	}
+	return nil
+}
+
+// The states of a Nagios plugin, by exit status.
+var nagiosStates = []string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
+// Message severities of the Nagios states, from the syslog severities.
+var nagiosSeverities = map[string]int32{
+	"OK":       6, // Informational.
+	"WARNING":  4,
+	"CRITICAL": 2,
+	"UNKNOWN":  3, // Error.
+}
+
+// Returns the Nagios state of the exit status. Nagios itself treats any exit
+// status it doesn't know as UNKNOWN.
+func nagiosState(exitStatus int) string {
+	if exitStatus < 0 || exitStatus >= len(nagiosStates) {
+		return "UNKNOWN"
+	}
+	return nagiosStates[exitStatus]
+}
+
+// A single performance data value from a Nagios plugin's output, see
+// https://nagios-plugins.org/doc/guidelines.html#AEN200.
+type perfValue struct {
+	label                string
+	value                float64
+	uom                  string
+	warn, crit, min, max string
+}
+
+// The parts of a Nagios plugin's output: its status text on the first line,
+// the optional long text on the following lines, and the performance data
+// following a '|' on the first line or any of the long text lines.
+type nagiosOutput struct {
+	text     string
+	longText string
+	perfdata []perfValue
+}
+
+func parseNagios(output string) (*nagiosOutput, error) {
+	var (
+		n        = new(nagiosOutput)
+		long     []string
+		perfdata []string
+		inPerf   bool
+	)
+	lines := strings.Split(strings.TrimRight(output, "\n"), "\n")
+	for i, line := range lines {
+		if inPerf {
+			// Once the long text's perfdata starts, it takes the rest of the
+			// output.
+			perfdata = append(perfdata, line)
+			continue
+		}
+		text := line
+		if bar := strings.IndexByte(line, '|'); bar >= 0 {
+			text = line[:bar]
+			perfdata = append(perfdata, line[bar+1:])
+			inPerf = i > 0
+		}
+		if i == 0 {
+			n.text = strings.TrimSpace(text)
+		} else {
+			long = append(long, text)
+		}
+	}
+	n.longText = strings.TrimSpace(strings.Join(long, "\n"))
+	for _, p := range perfdata {
+		values, err := parsePerfdata(p)
+		if err != nil {
+			return nil, err
+		}
+		n.perfdata = append(n.perfdata, values...)
+	}
+	return n, nil
+}
+
+// Parses space separated 'label'=value[UOM];[warn];[crit];[min];[max] items.
+// Labels may be quoted w/ single quotes to contain spaces or '=', w/ two
+// single quotes standing for a literal one.
+func parsePerfdata(perfdata string) ([]perfValue, error) {
+	var values []perfValue
+	s := strings.TrimSpace(perfdata)
+	for s != "" {
+		var label string
+		if s[0] == '\'' {
+			end := 1
+			for {
+				q := strings.IndexByte(s[end:], '\'')
+				if q < 0 {
+					return nil, fmt.Errorf("unterminated label in perfdata: %s", s)
+				}
+				end += q
+				if end+1 < len(s) && s[end+1] == '\'' {
+					end += 2
+					continue
+				}
+				break
+			}
+			label = strings.Replace(s[1:end], "''", "'", -1)
+			s = s[end+1:]
+			if s == "" || s[0] != '=' {
+				return nil, fmt.Errorf("missing value for '%s' in perfdata", label)
+			}
+		} else {
+			eq := strings.IndexByte(s, '=')
+			if eq < 0 {
+				return nil, fmt.Errorf("missing value in perfdata: %s", s)
+			}
+			label = s[:eq]
+			s = s[eq:]
+		}
+		item := s[1:]
+		if sp := strings.IndexAny(item, " \t"); sp >= 0 {
+			item, s = item[:sp], strings.TrimSpace(item[sp:])
+		} else {
+			s = ""
+		}
+
+		parts := strings.Split(item, ";")
+		pv := perfValue{label: label}
+		// The value is a number followed by its unit of measurement.
+		end := strings.IndexFunc(parts[0], func(r rune) bool {
+			return !strings.ContainsRune("0123456789.-+eE", r)
+		})
+		if end < 0 {
+			end = len(parts[0])
+		}
+		num := parts[0][:end]
+		// Plugins report "U" when a value can't be determined.
+		if num == "" && parts[0] == "U" {
+			continue
+		}
+		var err error
+		if pv.value, err = strconv.ParseFloat(num, 64); err != nil {
+			return nil, fmt.Errorf("invalid value for '%s' in perfdata: %s", label, parts[0])
+		}
+		pv.uom = parts[0][end:]
+		for i, threshold := range []*string{&pv.warn, &pv.crit, &pv.min, &pv.max} {
+			if i+1 < len(parts) {
+				*threshold = parts[i+1]
+			}
+		}
+		values = append(values, pv)
+	}
+	return values, nil
+}
+
+// Sets the message's fields from a Nagios plugin's output: the state given
+// by the exit status, the status text, the long text if any, and a float
+// field for each performance data value, w/ its unit of measurement as the
+// representation.
+func addNagiosFields(msg *message.Message, n *nagiosOutput, state string) {
+	message.NewStringField(msg, "NagiosState", state)
+	message.NewStringField(msg, "NagiosOutput", n.text)
+	if n.longText != "" {
+		message.NewStringField(msg, "NagiosLongOutput", n.longText)
+	}
+	for _, pv := range n.perfdata {
+		field, _ := message.NewField(pv.label, pv.value, pv.uom)
+		msg.AddField(field)
+	}
+}
+
+// Parses the output of a Nagios plugin, setting the message's severity from
+// the plugin's state.
+func parseNagiosOutput(output string, exitStatus int, msg *message.Message) error {
+	n, err := parseNagios(output)
+	if err != nil {
+		return err
+	}
+	state := nagiosState(exitStatus)
+	addNagiosFields(msg, n, state)
+	msg.SetSeverity(nagiosSeverities[state])
+	return nil
+}
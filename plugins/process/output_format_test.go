@@ -0,0 +1,125 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package process
+
+import (
+	"os"
+
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func OutputFormatSpec(c gs.Context) {
+	msg := new(message.Message)
+	value := func(name string) interface{} {
+		v, _ := msg.GetFieldValue(name)
+		return v
+	}
+
+	c.Specify("JSON output", func() {
+		output := `{"status": "ok", "count": 3, "db": {"up": true}, "tags": ["a", "b"]}`
+		err := parseJsonOutput(output, 0, msg)
+		c.Expect(err, gs.IsNil)
+		c.Expect(value("status"), gs.Equals, "ok")
+		c.Expect(value("count"), gs.Equals, 3.0)
+		c.Expect(value("db.up"), gs.Equals, true)
+		c.Expect(value("tags"), gs.Equals, `["a","b"]`)
+
+		err = parseJsonOutput("not json", 0, msg)
+		c.Expect(err, gs.Not(gs.IsNil))
+	})
+
+	c.Specify("Graphite output", func() {
+		output := "servers.web1.load 0.5 1451606400\nservers.web1.users 12 1451606400\n"
+		err := parseGraphiteOutput(output, 0, msg)
+		c.Expect(err, gs.IsNil)
+		c.Expect(value("servers.web1.load"), gs.Equals, 0.5)
+		c.Expect(value("servers.web1.users"), gs.Equals, 12.0)
+
+		err = parseGraphiteOutput("servers.web1.load high", 0, msg)
+		c.Expect(err, gs.Not(gs.IsNil))
+	})
+
+	c.Specify("Nagios output", func() {
+		c.Specify("w/ perfdata on the first line", func() {
+			output := "DISK OK - free space: / 3326 MB (56%); | /=2643MB;5948;5958;0;5968\n"
+			err := parseNagiosOutput(output, 0, msg)
+			c.Expect(err, gs.IsNil)
+			c.Expect(value("NagiosState"), gs.Equals, "OK")
+			c.Expect(value("NagiosOutput"), gs.Equals, "DISK OK - free space: / 3326 MB (56%);")
+			c.Expect(value("/"), gs.Equals, 2643.0)
+			c.Expect(msg.FindFirstField("/").GetRepresentation(), gs.Equals, "MB")
+			c.Expect(msg.GetSeverity(), gs.Equals, int32(6))
+		})
+
+		c.Specify("w/ long text and quoted labels", func() {
+			output := "PING CRITICAL - Packet loss = 100%\n" +
+				"host unreachable\n" +
+				"last seen yesterday | 'packet loss'=100%;20;60 rta=U\n" +
+				"'it''s'=5s\n"
+			err := parseNagiosOutput(output, 2, msg)
+			c.Expect(err, gs.IsNil)
+			c.Expect(value("NagiosState"), gs.Equals, "CRITICAL")
+			c.Expect(value("NagiosLongOutput"), gs.Equals,
+				"host unreachable\nlast seen yesterday")
+			c.Expect(value("packet loss"), gs.Equals, 100.0)
+			c.Expect(value("it's"), gs.Equals, 5.0)
+			_, ok := msg.GetFieldValue("rta")
+			c.Expect(ok, gs.IsFalse)
+			c.Expect(msg.GetSeverity(), gs.Equals, int32(2))
+		})
+
+		c.Specify("w/ an unknown exit status", func() {
+			err := parseNagiosOutput("weird", 42, msg)
+			c.Expect(err, gs.IsNil)
+			c.Expect(value("NagiosState"), gs.Equals, "UNKNOWN")
+		})
+
+		c.Specify("w/ invalid perfdata", func() {
+			err := parseNagiosOutput("OK | 'broken=1", 0, msg)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+
+	c.Specify("A ProcessInput", func() {
+		pInput := ProcessInput{}
+		config := pInput.ConfigStruct().(*ProcessInputConfig)
+		config.Command = map[string]cmdConfig{
+			"0": {Bin: PROCESSINPUT_TEST1_CMD, Args: PROCESSINPUT_TEST1_CMD_ARGS},
+		}
+
+		c.Specify("rejects an unknown output format", func() {
+			config.OutputFormat = "yaml"
+			err := pInput.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("applies the environment and directory to its commands", func() {
+			config.Environment = map[string]string{"CHECK_MODE": "strict"}
+			config.Directory = os.TempDir()
+			err := pInput.Init(config)
+			c.Assume(err, gs.IsNil)
+			cmd := pInput.cc.Cmds[0]
+			c.Expect(cmd.Dir, gs.Equals, os.TempDir())
+			c.Expect(cmd.Env[len(cmd.Env)-1], gs.Equals, "CHECK_MODE=strict")
+		})
+
+		c.Specify("rejects an unknown user", func() {
+			config.User = "no-such-heka-user"
+			err := pInput.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+}
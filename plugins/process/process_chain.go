@@ -22,6 +22,8 @@ import (
 	"os/exec"
 	"strings"
 	"time"
+
+	"github.com/mozilla-services/heka/pipeline"
 )
 
 // ManagedCmd extends exec.Cmd to support killing of a subprocess if a timeout
@@ -38,13 +40,14 @@ type ManagedCmd struct {
 	// close to the timeout interval, it is possible that the timeout may only
 	// occur *after* the command has been restarted.
 	timeout_duration time.Duration
+	clock            pipeline.Clock
 
 	Stdout_r *io.PipeReader
 	Stderr_r *io.PipeReader
 }
 
 func NewManagedCmd(path string, args []string, timeout time.Duration) (mc *ManagedCmd) {
-	mc = &ManagedCmd{timeout_duration: timeout}
+	mc = &ManagedCmd{timeout_duration: timeout, clock: pipeline.RealClock}
 	mc.done = make(chan error)
 	mc.Stopchan = make(chan bool, 1)
 	mc.Cmd = exec.Command(path, args...)
@@ -68,12 +71,14 @@ func (mc *ManagedCmd) Wait() (err error) {
 
 	done := false
 	if mc.timeout_duration != 0 {
+		timer := mc.clock.NewTimer(mc.timeout_duration)
+		defer timer.Stop()
 		for !done {
 			select {
 			case <-mc.Stopchan:
 				err = fmt.Errorf("ManagedCmd was stopped with error: [%s]", mc.kill())
 				done = true
-			case <-time.After(mc.timeout_duration):
+			case <-timer.Chan():
 				mc.Stopchan <- true
 				err = fmt.Errorf("ManagedCmd timedout")
 			case err = <-mc.done:
@@ -103,6 +108,11 @@ func (mc *ManagedCmd) Wait() (err error) {
 	return err
 }
 
+// Sets the Clock the timeout is measured on, the RealClock by default.
+func (mc *ManagedCmd) SetClock(clock pipeline.Clock) {
+	mc.clock = clock
+}
+
 // Kill the current process. This will always return an error code.
 func (mc *ManagedCmd) kill() (err error) {
 	if err := mc.Process.Kill(); err != nil {
@@ -119,8 +129,10 @@ func (mc *ManagedCmd) clone() (clone *ManagedCmd) {
 	// mc.Args[0] should always be == mc.Path, so mc.Args[1:] should be safe
 	// to use here.
 	clone = NewManagedCmd(mc.Path, mc.Args[1:], mc.timeout_duration)
+	clone.clock = mc.clock
 	clone.Env = mc.Env
 	clone.Dir = mc.Dir
+	clone.SysProcAttr = mc.SysProcAttr
 	return clone
 }
 
@@ -132,6 +144,7 @@ type CommandChain struct {
 	// The timeout duration is the maximum time that each stage of the
 	// pipeline should run for before the Wait() returns a timeout error.
 	timeout_duration time.Duration
+	clock            pipeline.Clock
 
 	done     chan CommandChainStatus
 	Stopchan chan bool
@@ -147,7 +160,7 @@ type CommandChainStatus struct {
 }
 
 func NewCommandChain(timeout time.Duration) (cc *CommandChain) {
-	cc = &CommandChain{timeout_duration: timeout}
+	cc = &CommandChain{timeout_duration: timeout, clock: pipeline.RealClock}
 	cc.done = make(chan CommandChainStatus)
 	cc.Stopchan = make(chan bool, 1)
 	return cc
@@ -157,6 +170,7 @@ func NewCommandChain(timeout time.Duration) (cc *CommandChain) {
 // stage.
 func (cc *CommandChain) AddStep(Path string, Args ...string) (cmd *ManagedCmd) {
 	cmd = NewManagedCmd(Path, Args, cc.timeout_duration)
+	cmd.clock = cc.clock
 
 	cc.Cmds = append(cc.Cmds, cmd)
 	if len(cc.Cmds) > 1 {
@@ -167,6 +181,15 @@ func (cc *CommandChain) AddStep(Path string, Args ...string) (cmd *ManagedCmd) {
 	return cmd
 }
 
+// Sets the Clock each stage's timeout is measured on, the RealClock by
+// default.
+func (cc *CommandChain) SetClock(clock pipeline.Clock) {
+	cc.clock = clock
+	for _, cmd := range cc.Cmds {
+		cmd.clock = clock
+	}
+}
+
 func (cc *CommandChain) Stdout_r() (stdout io.Reader, err error) {
 	if len(cc.Cmds) == 0 {
 		return nil, fmt.Errorf("No commands are in this chain")
@@ -253,12 +276,14 @@ func (cc *CommandChain) Wait() (cc_status CommandChainStatus) {
 // Usually so that a chain can be restarted.
 func (cc *CommandChain) clone() (clone *CommandChain) {
 	clone = NewCommandChain(cc.timeout_duration)
+	clone.clock = cc.clock
 	for _, orig := range cc.Cmds {
 		// mc.Args[0] should always be == mc.Path, so mc.Args[1:] should be
 		// safe to use here.
 		cmd := clone.AddStep(orig.Path, orig.Args[1:]...)
 		cmd.Env = orig.Env
 		cmd.Dir = orig.Dir
+		cmd.SysProcAttr = orig.SysProcAttr
 	}
 	return clone
 }
@@ -60,3 +60,12 @@ const PROCESSINPUT_PIPE_CMD2 = "grep"
 
 var PROCESSINPUT_PIPE_CMD2_ARGS = []string{"ignore"}
 var PROCESSINPUT_PIPE_OUTPUT = "ignore this line"
+
+// ExecOutput test configuration
+const EXECOUTPUT_CMD = "cat"
+
+var EXECOUTPUT_CMD_ARGS = []string{}
+
+const EXECOUTPUT_FAIL_CMD = "false"
+
+var EXECOUTPUT_FAIL_CMD_ARGS = []string{}
@@ -60,3 +60,12 @@ const PROCESSINPUT_PIPE_CMD2 = "findstr"
 
 var PROCESSINPUT_PIPE_CMD2_ARGS = []string{"ignore"}
 var PROCESSINPUT_PIPE_OUTPUT = []string{"ignore ", "this ", "line\r"}
+
+// ExecOutput test configuration
+const EXECOUTPUT_CMD = "findstr"
+
+var EXECOUTPUT_CMD_ARGS = []string{"/r", ".*"}
+
+const EXECOUTPUT_FAIL_CMD = "cmd"
+
+var EXECOUTPUT_FAIL_CMD_ARGS = []string{"/c", "exit 1"}
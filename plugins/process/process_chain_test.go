@@ -18,6 +18,7 @@ package process
 import (
 	"bytes"
 	"fmt"
+	"github.com/mozilla-services/heka/pipeline"
 	gs "github.com/rafrombrc/gospec/src/gospec"
 	"io"
 	"io/ioutil"
@@ -26,6 +27,9 @@ import (
 )
 
 func ProcessChainSpec(c gs.Context) {
+	// The timeouts only expire when the tests advance the clock, no matter
+	// how long the commands take to start.
+	clock := pipeline.NewMockClock(time.Now())
 
 	readCommandOutput := func(reader io.Reader, resultChan chan string) {
 		data, err := ioutil.ReadAll(reader)
@@ -51,20 +55,24 @@ func ProcessChainSpec(c gs.Context) {
 		})
 
 		c.Specify("honors nonzero timeouts", func() {
-			// Timeout should always occur inside of 10 seconds.
 			Path := NONZERO_TIMEOUT_CMD
 			timeout := NONZERO_TIMEOUT
 			cmd := NewManagedCmd(Path, NONZERO_TIMEOUT_ARGS, timeout)
+			cmd.SetClock(clock)
 			output := make(chan string)
 			cmd.Start(true)
-			start := time.Now()
 			go readCommandOutput(cmd.Stdout_r, output)
-			cmd.Wait()
-			end := time.Now()
+			waitErr := make(chan error)
+			go func() {
+				waitErr <- cmd.Wait()
+			}()
+			clock.BlockUntil(1)
+			clock.Add(timeout)
+			err := <-waitErr
+			c.Expect(err, gs.Not(gs.IsNil))
+			c.Expect(strings.Contains(err.Error(), "was killed"), gs.IsTrue)
 			outputStr := <-output
 			c.Expect(strings.HasPrefix(outputStr, "TESTERROR"), gs.IsFalse)
-			actualDuration := end.Sub(start)
-			c.Expect(actualDuration < time.Second*10, gs.Equals, true)
 		})
 
 		c.Specify("reads process stderr properly", func() {
@@ -91,19 +99,21 @@ func ProcessChainSpec(c gs.Context) {
 			Path := NONZERO_TIMEOUT_CMD
 			timeout := time.Second * 30
 			cmd := NewManagedCmd(Path, NONZERO_TIMEOUT_ARGS, timeout)
+			cmd.SetClock(clock)
 
 			stdoutResults := make(chan string, 1)
 
 			cmd.Start(true)
-			start := time.Now()
 			go readCommandOutput(cmd.Stdout_r, stdoutResults)
-			time.Sleep(NONZERO_TIMEOUT)
+			waitErr := make(chan error)
+			go func() {
+				waitErr <- cmd.Wait()
+			}()
+			clock.BlockUntil(1)
 			cmd.Stopchan <- true
-			cmd.Wait()
-			end := time.Now()
-
-			actualDuration := end.Sub(start)
-			c.Expect(actualDuration < timeout, gs.Equals, true)
+			err := <-waitErr
+			c.Expect(err, gs.Not(gs.IsNil))
+			c.Expect(strings.Contains(err.Error(), "was stopped"), gs.IsTrue)
 		})
 
 		c.Specify("can reset commands to run again", func() {
@@ -155,23 +165,30 @@ func ProcessChainSpec(c gs.Context) {
 		})
 
 		c.Specify("will honor timeouts", func() {
-			// This test must timeout within 10 seconds.
 			var err error
 
 			timeout := NONZERO_TIMEOUT
 			chain := NewCommandChain(timeout)
+			chain.SetClock(clock)
 			chain.AddStep(TIMEOUT_PIPE_CMD1, TIMEOUT_PIPE_CMD1_ARGS...)
 			chain.AddStep(TIMEOUT_PIPE_CMD2, TIMEOUT_PIPE_CMD2_ARGS...)
 
 			err = chain.Start()
-			start := time.Now()
 			c.Expect(err, gs.IsNil)
-			cc := chain.Wait()
-			end := time.Now()
-			actual_duration := end.Sub(start)
+			stdoutReader, err := chain.Stdout_r()
+			c.Expect(err, gs.IsNil)
+			go readCommandOutput(stdoutReader, make(chan string, 1))
+			status := make(chan CommandChainStatus)
+			go func() {
+				status <- chain.Wait()
+			}()
+			// Only the first stage times out, the second exits once its
+			// stdin is closed.
+			clock.BlockUntil(1)
+			clock.Add(timeout)
+			cc := <-status
 			c.Expect(cc.SubcmdErrors, gs.Not(gs.IsNil))
 			c.Expect(strings.Contains(cc.SubcmdErrors.Error(), "was killed"), gs.Equals, true)
-			c.Expect(actual_duration < time.Second*10, gs.Equals, true)
 		})
 
 		c.Specify("will stop chains before timeout has completed", func() {
@@ -179,20 +196,17 @@ func ProcessChainSpec(c gs.Context) {
 
 			timeout := time.Second * 30
 			chain := NewCommandChain(timeout)
+			chain.SetClock(clock)
 			chain.AddStep(TIMEOUT_PIPE_CMD1, TIMEOUT_PIPE_CMD1_ARGS...)
 			chain.AddStep(TIMEOUT_PIPE_CMD2, TIMEOUT_PIPE_CMD2_ARGS...)
 
 			err = chain.Start()
-			start := time.Now()
 			c.Expect(err, gs.IsNil)
-			time.Sleep(NONZERO_TIMEOUT)
 
 			chain.Stopchan <- true
 			cc := chain.Wait()
-			end := time.Now()
-			actual_duration := end.Sub(start)
 			c.Expect(cc.SubcmdErrors, gs.Not(gs.IsNil))
-			c.Expect(actual_duration < timeout, gs.Equals, true)
+			c.Expect(clock.Waiters(), gs.Equals, 0)
 		})
 
 		c.Specify("can reset chains to run again", func() {
@@ -255,16 +255,26 @@ func (pdi *ProcessDirectoryInput) loadProcessFile(path string) (*ProcessEntry, e
 	mutMaker := maker.(MutableMaker)
 	mutMaker.SetName(path)
 
+	// Processes that don't have their own retry policy get one that keeps
+	// retrying.
+	var settings map[string]toml.Primitive
+	if err = toml.PrimitiveDecode(section, &settings); err != nil {
+		return nil, err
+	}
+	_, hasRetries := settings["retries"]
+
 	prepCommonTypedConfig := func() (interface{}, error) {
 		commonTypedConfig, err := mutMaker.OrigPrepCommonTypedConfig()
 		if err != nil {
 			return nil, err
 		}
 		commonInput := commonTypedConfig.(CommonInputConfig)
-		commonInput.Retries = RetryOptions{
-			MaxDelay:   "30s",
-			Delay:      "250ms",
-			MaxRetries: -1,
+		if !hasRetries {
+			commonInput.Retries = RetryOptions{
+				MaxDelay:   "30s",
+				Delay:      "250ms",
+				MaxRetries: -1,
+			}
 		}
 		if commonInput.CanExit == nil {
 			b := true
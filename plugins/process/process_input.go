@@ -17,10 +17,12 @@
 package process
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -91,6 +93,21 @@ type ProcessInputConfig struct {
 
 	ParseStdout bool `toml:"stdout"`
 	ParseStderr bool `toml:"stderr"`
+
+	// Environment variables added to the environment of all the commands.
+	Environment map[string]string
+
+	// Working directory of the commands that don't specify their own.
+	Directory string
+
+	// User and group to run the commands as. Requires Heka to be running as
+	// root. Defaults to Heka's own.
+	User  string
+	Group string
+
+	// Format of the commands' output, which is parsed into message fields:
+	// one of "json", "nagios" or "graphite". Defaults to none.
+	OutputFormat string `toml:"output_format"`
 }
 
 // Helper function for manually comparing structs since a map attribute means
@@ -108,6 +125,18 @@ func (pic *ProcessInputConfig) Equals(otherPic *ProcessInputConfig) bool {
 	if pic.ParseStderr != otherPic.ParseStderr {
 		return false
 	}
+	if pic.Directory != otherPic.Directory || pic.User != otherPic.User ||
+		pic.Group != otherPic.Group || pic.OutputFormat != otherPic.OutputFormat {
+		return false
+	}
+	if len(pic.Environment) != len(otherPic.Environment) {
+		return false
+	}
+	for k, v := range pic.Environment {
+		if otherV, ok := otherPic.Environment[k]; !ok || otherV != v {
+			return false
+		}
+	}
 	if len(pic.Command) != len(otherPic.Command) {
 		return false
 	}
@@ -148,6 +177,8 @@ type ProcessInput struct {
 	hekaPid        int32
 	tickInterval   uint
 	immediateStart bool
+	outputParser   outputParser
+	clock          Clock
 
 	once sync.Once
 }
@@ -163,9 +194,18 @@ func (pi *ProcessInput) ConfigStruct() interface{} {
 	}
 }
 
+// Heka will call this before calling any other methods to give us access to
+// the pipeline configuration.
+func (pi *ProcessInput) SetPipelineConfig(pConfig *PipelineConfig) {
+	pi.clock = pConfig.Globals.Clock
+}
+
 // Init implements the Plugin interface.
 func (pi *ProcessInput) Init(config interface{}) (err error) {
 	conf := config.(*ProcessInputConfig)
+	if pi.clock == nil {
+		pi.clock = RealClock
+	}
 
 	pi.tickInterval = conf.TickerInterval
 	pi.immediateStart = conf.ImmediateStart
@@ -176,7 +216,29 @@ func (pi *ProcessInput) Init(config interface{}) (err error) {
 		return fmt.Errorf("No Command Configured")
 	}
 
+	pi.outputParser = nil
+	if conf.OutputFormat != "" {
+		var ok bool
+		if pi.outputParser, ok = outputParsers[conf.OutputFormat]; !ok {
+			return fmt.Errorf("unsupported output_format: %s", conf.OutputFormat)
+		}
+	}
+	var cred *credential
+	if conf.User != "" {
+		if cred, err = lookupCredential(conf.User, conf.Group); err != nil {
+			return err
+		}
+	} else if conf.Group != "" {
+		return errors.New("`group` requires a `user`")
+	}
+	var env []string
+	for k, v := range conf.Environment {
+		env = append(env, fmt.Sprintf("%s=%s", k, v))
+	}
+	sort.Strings(env)
+
 	pi.cc = NewCommandChain(time.Duration(conf.TimeoutSeconds) * time.Second)
+	pi.cc.SetClock(pi.clock)
 
 	// We need to mangle the indexes to be integers
 	for idx := 0; idx < len(conf.Command); idx++ {
@@ -191,10 +253,20 @@ func (pi *ProcessInput) Init(config interface{}) (err error) {
 
 		if cmdCfg.Directory != "" {
 			cmd.Dir = cmdCfg.Directory
+		} else {
+			cmd.Dir = conf.Directory
 		}
 		if cmdCfg.Env != nil {
 			cmd.Env = cmdCfg.Env
 		}
+		if env != nil {
+			// A command's own `env` replaces Heka's environment.
+			if cmd.Env == nil {
+				cmd.Env = os.Environ()
+			}
+			cmd.Env = append(append([]string{}, cmd.Env...), env...)
+		}
+		setCredential(cmd.Cmd, cred)
 	}
 
 	pi.hekaPid = int32(os.Getpid())
@@ -283,6 +355,14 @@ func (pi *ProcessInput) initDelivery(streamName string) (Deliverer, SplitterRunn
 					pi.ir.LogError(err)
 				}
 			}
+
+			if streamName == "stdout" && pi.outputParser != nil {
+				// Unparseable output is still delivered, as is.
+				err = pi.outputParser(pack.Message.GetPayload(), r, pack.Message)
+				if err != nil {
+					pi.ir.LogError(err)
+				}
+			}
 		}
 		sRunner.SetPackDecorator(packDecorator)
 	}
@@ -0,0 +1,123 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package sftp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// The file operations SftpInput needs from the remote server.
+type remoteFS interface {
+	ReadDir(dir string) ([]os.FileInfo, error)
+	Open(path string) (io.ReadCloser, error)
+	Remove(path string) error
+	Rename(oldPath, newPath string) error
+	Close() error
+}
+
+// A remoteFS backed by an SFTP session.
+type sftpFS struct {
+	*sftp.Client
+	conn *ssh.Client
+}
+
+func (fs *sftpFS) Open(path string) (io.ReadCloser, error) {
+	return fs.Client.Open(path)
+}
+
+func (fs *sftpFS) Close() error {
+	err := fs.Client.Close()
+	fs.conn.Close()
+	return err
+}
+
+// Returns the SSH client config for the input's config.
+func sshClientConfig(conf *SftpInputConfig) (*ssh.ClientConfig, error) {
+	sshConf := &ssh.ClientConfig{User: conf.User}
+	if conf.KeyFile != "" {
+		pem, err := ioutil.ReadFile(conf.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't read key_file: %s", err)
+		}
+		signer, err := ssh.ParsePrivateKey(pem)
+		if err != nil {
+			return nil, fmt.Errorf("can't parse key_file: %s", err)
+		}
+		sshConf.Auth = append(sshConf.Auth, ssh.PublicKeys(signer))
+	}
+	if conf.Password != "" {
+		sshConf.Auth = append(sshConf.Auth, ssh.Password(conf.Password))
+	}
+	if len(sshConf.Auth) == 0 {
+		return nil, fmt.Errorf("a password or a key_file is needed")
+	}
+
+	if conf.HostKey == "" {
+		if !conf.InsecureIgnoreHostKey {
+			return nil, fmt.Errorf("host_key is needed unless insecure_ignore_host_key is set")
+		}
+		sshConf.HostKeyCallback = func(string, net.Addr, ssh.PublicKey) error {
+			return nil
+		}
+		return sshConf, nil
+	}
+	expected, _, _, _, err := ssh.ParseAuthorizedKey([]byte(conf.HostKey))
+	if err != nil {
+		return nil, fmt.Errorf("can't parse host_key: %s", err)
+	}
+	sshConf.HostKeyCallback = func(host string, _ net.Addr, key ssh.PublicKey) error {
+		if !bytes.Equal(key.Marshal(), expected.Marshal()) {
+			return fmt.Errorf("host key of %s doesn't match host_key", host)
+		}
+		return nil
+	}
+	return sshConf, nil
+}
+
+// Opens an SFTP session w/ the server.
+func dialSftp(address string, sshConf *ssh.ClientConfig, timeout time.Duration) (
+	remoteFS, error) {
+
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		// Only the handshake is bounded, transfers can take longer.
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, address, sshConf)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	sshClient := ssh.NewClient(c, chans, reqs)
+	client, err := sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return nil, err
+	}
+	return &sftpFS{Client: client, conn: sshClient}, nil
+}
@@ -0,0 +1,253 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package sftp
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"golang.org/x/crypto/ssh"
+)
+
+type SftpInputConfig struct {
+	// Address of the SFTP server, as host:port.
+	Address string
+	User    string
+	// Password of the user, optional if a key file is set.
+	Password string
+	// Path of the PEM encoded private key used to authenticate.
+	KeyFile string `toml:"key_file"`
+	// Public key of the server, in authorized_keys format, it's checked
+	// against to guard against man in the middle attacks.
+	HostKey string `toml:"host_key"`
+	// Whether to accept any server key when host_key isn't set.
+	InsecureIgnoreHostKey bool `toml:"insecure_ignore_host_key"`
+	// Remote directory that's polled.
+	Directory string
+	// Glob pattern the names of the files to process must match, defaults to
+	// "*".
+	FilePattern string `toml:"file_pattern"`
+	// Files modified less than this many seconds ago are left for a later
+	// poll, so files still being uploaded aren't processed. Defaults to 0.
+	MinAge uint `toml:"min_age"`
+	// What's done w/ a file once it's been processed: "none", "delete" or
+	// "move" to the archive directory. Defaults to "none".
+	ProcessedAction string `toml:"processed_action"`
+	// Remote directory the processed files are moved to w/ the "move"
+	// action.
+	ArchiveDirectory string `toml:"archive_directory"`
+	// Path of the file recording the processed files, relative to the base
+	// dir. Defaults to "sftp/<plugin name>.json".
+	StatePath string `toml:"state_path"`
+	// Seconds to wait for the connection to be set up, defaults to 30.
+	Timeout uint
+	// Seconds between polls, defaults to 60.
+	TickerInterval uint `toml:"ticker_interval"`
+}
+
+type SftpInput struct {
+	conf     *SftpInputConfig
+	name     string
+	pConfig  *PipelineConfig
+	ir       InputRunner
+	hostname string
+	state    *sftpState
+	stopChan chan bool
+	// Opens a session w/ the server, replaced in tests.
+	open func() (remoteFS, error)
+}
+
+func (si *SftpInput) SetName(name string) {
+	si.name = name
+}
+
+func (si *SftpInput) SetPipelineConfig(pConfig *PipelineConfig) {
+	si.pConfig = pConfig
+}
+
+func (si *SftpInput) ConfigStruct() interface{} {
+	return &SftpInputConfig{
+		FilePattern:     "*",
+		ProcessedAction: "none",
+		Timeout:         30,
+		TickerInterval:  60,
+	}
+}
+
+func (si *SftpInput) Init(config interface{}) (err error) {
+	conf := config.(*SftpInputConfig)
+	if conf.Address == "" || conf.Directory == "" {
+		return fmt.Errorf("SftpInput needs an address and a directory")
+	}
+	if _, err = path.Match(conf.FilePattern, ""); err != nil {
+		return fmt.Errorf("SftpInput bad file_pattern: %s", err)
+	}
+	switch conf.ProcessedAction {
+	case "none", "delete":
+	case "move":
+		if conf.ArchiveDirectory == "" {
+			return fmt.Errorf("SftpInput 'move' action needs an archive_directory")
+		}
+	default:
+		return fmt.Errorf("SftpInput unknown processed_action '%s'",
+			conf.ProcessedAction)
+	}
+	var sshConf *ssh.ClientConfig
+	if sshConf, err = sshClientConfig(conf); err != nil {
+		return fmt.Errorf("SftpInput %s", err)
+	}
+	statePath := conf.StatePath
+	if statePath == "" {
+		statePath = filepath.Join("sftp", si.name+".json")
+	}
+	statePath = si.pConfig.Globals.PrependBaseDir(statePath)
+	if si.state, err = loadSftpState(statePath); err != nil {
+		return fmt.Errorf("SftpInput %s", err)
+	}
+	si.conf = conf
+	si.open = func() (remoteFS, error) {
+		return dialSftp(conf.Address, sshConf, time.Duration(conf.Timeout)*time.Second)
+	}
+	si.stopChan = make(chan bool)
+	return nil
+}
+
+func (si *SftpInput) Run(ir InputRunner, h PluginHelper) error {
+	si.ir = ir
+	si.hostname = h.Hostname()
+	ticker := ir.Ticker()
+	for {
+		select {
+		case <-ticker:
+			si.poll()
+		case <-si.stopChan:
+			return nil
+		}
+	}
+}
+
+// Processes the new files of the remote directory, in name order.
+func (si *SftpInput) poll() {
+	fs, err := si.open()
+	if err != nil {
+		si.ir.LogError(fmt.Errorf("can't connect: %s", err))
+		return
+	}
+	defer fs.Close()
+	infos, err := fs.ReadDir(si.conf.Directory)
+	if err != nil {
+		si.ir.LogError(fmt.Errorf("can't list '%s': %s", si.conf.Directory, err))
+		return
+	}
+
+	present := make(map[string]bool, len(infos))
+	var names []string
+	byName := make(map[string]os.FileInfo, len(infos))
+	newest := time.Now().Add(-time.Duration(si.conf.MinAge) * time.Second)
+	for _, info := range infos {
+		name := info.Name()
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		if ok, _ := path.Match(si.conf.FilePattern, name); !ok {
+			continue
+		}
+		present[name] = true
+		if si.state.processed(name, info) ||
+			(si.conf.MinAge > 0 && info.ModTime().After(newest)) {
+			continue
+		}
+		names = append(names, name)
+		byName[name] = info
+	}
+	si.state.prune(present)
+	sort.Strings(names)
+
+	for _, name := range names {
+		select {
+		case <-si.stopChan:
+			return
+		default:
+		}
+		remotePath := path.Join(si.conf.Directory, name)
+		if err = si.ingest(fs, remotePath); err != nil {
+			si.ir.LogError(fmt.Errorf("can't read '%s': %s", remotePath, err))
+			continue
+		}
+		si.state.record(name, byName[name])
+		if err = si.state.save(); err != nil {
+			si.ir.LogError(fmt.Errorf("can't save state: %s", err))
+		}
+		if err = si.dispose(fs, remotePath, name); err != nil {
+			si.ir.LogError(fmt.Errorf("can't %s '%s': %s", si.conf.ProcessedAction,
+				remotePath, err))
+		}
+	}
+}
+
+// Streams the file through a splitter runner of its own, so a partial final
+// record doesn't carry over to the next file.
+func (si *SftpInput) ingest(fs remoteFS, remotePath string) error {
+	f, err := fs.Open(remotePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sRunner := si.ir.NewSplitterRunner(remotePath)
+	defer sRunner.Done()
+	if !sRunner.UseMsgBytes() {
+		sRunner.SetPackDecorator(func(pack *PipelinePack) {
+			pack.Message.SetType("heka.sftp")
+			pack.Message.SetHostname(si.hostname)
+			pack.Message.SetLogger(si.ir.Name())
+			message.NewStringField(pack.Message, "FilePath", remotePath)
+		})
+	}
+	for err == nil {
+		err = sRunner.SplitStream(f, nil)
+	}
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+// Deletes or archives the processed file, as configured.
+func (si *SftpInput) dispose(fs remoteFS, remotePath, name string) error {
+	switch si.conf.ProcessedAction {
+	case "delete":
+		return fs.Remove(remotePath)
+	case "move":
+		return fs.Rename(remotePath, path.Join(si.conf.ArchiveDirectory, name))
+	}
+	return nil
+}
+
+func (si *SftpInput) Stop() {
+	close(si.stopChan)
+}
+
+func init() {
+	RegisterPlugin("SftpInput", func() interface{} {
+		return new(SftpInput)
+	})
+}
@@ -0,0 +1,185 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package sftp
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	"github.com/mozilla-services/heka/pipelinemock"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+// A remoteFS serving a local directory tree.
+type localFS struct {
+	root string
+}
+
+func (fs *localFS) ReadDir(dir string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(filepath.Join(fs.root, dir))
+}
+
+func (fs *localFS) Open(path string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(fs.root, path))
+}
+
+func (fs *localFS) Remove(path string) error {
+	return os.Remove(filepath.Join(fs.root, path))
+}
+
+func (fs *localFS) Rename(oldPath, newPath string) error {
+	return os.Rename(filepath.Join(fs.root, oldPath), filepath.Join(fs.root, newPath))
+}
+
+func (fs *localFS) Close() error {
+	return nil
+}
+
+func SftpInputSpec(c gs.Context) {
+	t := &pipeline_ts.SimpleT{}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	tmpDir, err := ioutil.TempDir("", "sftp-tests")
+	c.Assume(err, gs.IsNil)
+	defer os.RemoveAll(tmpDir)
+	remoteDir := filepath.Join(tmpDir, "remote")
+	c.Assume(os.MkdirAll(filepath.Join(remoteDir, "drop"), 0700), gs.IsNil)
+	c.Assume(os.MkdirAll(filepath.Join(remoteDir, "done"), 0700), gs.IsNil)
+
+	globals := DefaultGlobals()
+	globals.BaseDir = tmpDir
+	pConfig := NewPipelineConfig(globals)
+
+	writeRemote := func(name, contents string) {
+		err := ioutil.WriteFile(filepath.Join(remoteDir, "drop", name),
+			[]byte(contents), 0600)
+		c.Assume(err, gs.IsNil)
+	}
+	exists := func(path string) bool {
+		_, err := os.Stat(filepath.Join(remoteDir, path))
+		return err == nil
+	}
+
+	c.Specify("An SftpInput", func() {
+		input := new(SftpInput)
+		input.SetName("PartnerDrop")
+		input.SetPipelineConfig(pConfig)
+		config := input.ConfigStruct().(*SftpInputConfig)
+		config.Address = "sftp.example.com:22"
+		config.User = "heka"
+		config.Password = "secret"
+		config.InsecureIgnoreHostKey = true
+		config.Directory = "drop"
+
+		c.Specify("validates its config", func() {
+			config.ProcessedAction = "move"
+			c.Expect(input.Init(config), gs.Not(gs.IsNil))
+			config.ArchiveDirectory = "done"
+			c.Expect(input.Init(config), gs.IsNil)
+			config.InsecureIgnoreHostKey = false
+			c.Expect(input.Init(config), gs.Not(gs.IsNil))
+			config.HostKey = "ssh-rsa not-a-key"
+			c.Expect(input.Init(config), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("polling the remote directory", func() {
+			mockIR := pipelinemock.NewMockInputRunner(ctrl)
+			mockSR := pipelinemock.NewMockSplitterRunner(ctrl)
+			mockIR.EXPECT().Name().Return("PartnerDrop").AnyTimes()
+			var read []string
+			mockIR.EXPECT().NewSplitterRunner(gomock.Any()).Return(mockSR).AnyTimes()
+			mockSR.EXPECT().UseMsgBytes().Return(false).AnyTimes()
+			mockSR.EXPECT().SetPackDecorator(gomock.Any()).AnyTimes()
+			mockSR.EXPECT().Done().AnyTimes()
+			split := mockSR.EXPECT().SplitStream(gomock.Any(), nil).AnyTimes()
+			split.Do(func(r io.Reader, del Deliverer) {
+				data, err := ioutil.ReadAll(r)
+				c.Expect(err, gs.IsNil)
+				read = append(read, string(data))
+			}).Return(io.EOF)
+
+			poll := func() {
+				c.Assume(input.Init(config), gs.IsNil)
+				input.ir = mockIR
+				input.open = func() (remoteFS, error) {
+					return &localFS{remoteDir}, nil
+				}
+				input.poll()
+			}
+			writeRemote("b.log", "second\n")
+			writeRemote("a.log", "first\n")
+			writeRemote("notes.txt", "skipped\n")
+			config.FilePattern = "*.log"
+
+			c.Specify("reads the matching files in name order", func() {
+				poll()
+				c.Expect(read, gs.ContainsExactly, []string{"first\n", "second\n"})
+			})
+
+			c.Specify("records the processed files across restarts", func() {
+				poll()
+				input = new(SftpInput)
+				input.SetName("PartnerDrop")
+				input.SetPipelineConfig(pConfig)
+				writeRemote("c.log", "third\n")
+				poll()
+				c.Expect(read, gs.ContainsExactly, []string{"first\n", "second\n",
+					"third\n"})
+				_, err := os.Stat(filepath.Join(tmpDir, "sftp", "PartnerDrop.json"))
+				c.Expect(err, gs.IsNil)
+			})
+
+			c.Specify("reads a file again once it changed", func() {
+				poll()
+				writeRemote("a.log", "first\nmore\n")
+				poll()
+				c.Expect(len(read), gs.Equals, 3)
+				c.Expect(read[2], gs.Equals, "first\nmore\n")
+			})
+
+			c.Specify("leaves recent files for later", func() {
+				config.MinAge = 3600
+				old := time.Now().Add(-2 * time.Hour)
+				os.Chtimes(filepath.Join(remoteDir, "drop", "a.log"), old, old)
+				poll()
+				c.Expect(read, gs.ContainsExactly, []string{"first\n"})
+			})
+
+			c.Specify("deletes the processed files", func() {
+				config.ProcessedAction = "delete"
+				poll()
+				c.Expect(exists("drop/a.log"), gs.IsFalse)
+				c.Expect(exists("drop/b.log"), gs.IsFalse)
+				c.Expect(exists("drop/notes.txt"), gs.IsTrue)
+			})
+
+			c.Specify("moves the processed files", func() {
+				config.ProcessedAction = "move"
+				config.ArchiveDirectory = "done"
+				poll()
+				c.Expect(exists("drop/a.log"), gs.IsFalse)
+				c.Expect(exists("done/a.log"), gs.IsTrue)
+				c.Expect(exists("done/b.log"), gs.IsTrue)
+			})
+		})
+	})
+}
@@ -0,0 +1,90 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package sftp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Size and modification time of a processed file, a file that changes after
+// it's been processed is processed again.
+type fileState struct {
+	Size    int64
+	ModTime int64
+}
+
+// Records the remote files that have been processed in a JSON file, so they
+// aren't processed again after a restart.
+type sftpState struct {
+	path  string
+	Files map[string]fileState
+}
+
+// Loads the state from the file at path, starting afresh if it doesn't exist.
+func loadSftpState(path string) (*sftpState, error) {
+	s := &sftpState{path: path, Files: make(map[string]fileState)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't read state file '%s': %s", path, err)
+	}
+	if err = json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("can't decode state file '%s': %s", path, err)
+	}
+	if s.Files == nil {
+		s.Files = make(map[string]fileState)
+	}
+	return s, nil
+}
+
+func (s *sftpState) processed(name string, info os.FileInfo) bool {
+	st, ok := s.Files[name]
+	return ok && st.Size == info.Size() && st.ModTime == info.ModTime().UnixNano()
+}
+
+func (s *sftpState) record(name string, info os.FileInfo) {
+	s.Files[name] = fileState{Size: info.Size(), ModTime: info.ModTime().UnixNano()}
+}
+
+// Forgets the files that are gone from the remote directory.
+func (s *sftpState) prune(present map[string]bool) {
+	for name := range s.Files {
+		if !present[name] {
+			delete(s.Files, name)
+		}
+	}
+}
+
+// Writes the state out, replacing the file atomically.
+func (s *sftpState) save() error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
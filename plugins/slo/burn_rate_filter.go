@@ -0,0 +1,331 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package slo
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+)
+
+// Filter tracking the error rate of the messages it matches against an
+// objective, alerting when the error budget burns too fast over both a long
+// and a short window, as in the multiwindow, multi-burn-rate alerts of the
+// Site Reliability Workbook.
+type BurnRateFilter struct {
+	droppedGroups int64
+	alertCount    int64
+	conf          *BurnRateFilterConfig
+	failure       *message.MatcherSpecification
+	budget        float64
+	bucketSecs    int64
+	buckets       int
+	groups        map[string]*burnRateGroup
+	// Returns the current time, replaced in tests.
+	now func() time.Time
+}
+
+// An alert, firing when the error budget burns at least `burn_rate` times
+// faster than the objective allows over both windows.
+type BurnRateAlert struct {
+	// Set as the alert messages' severity field, e.g. "page" or "ticket".
+	Severity string
+	// Length of the long window in seconds.
+	LongWindow uint `toml:"long_window"`
+	// Length of the short window in seconds, which lets the alert resolve
+	// soon after the errors stop.
+	ShortWindow uint `toml:"short_window"`
+	// Burn rate over which the alert fires.
+	BurnRate float64 `toml:"burn_rate"`
+}
+
+type BurnRateFilterConfig struct {
+	// Message matcher for the failed events among the matched ones, the
+	// others being successes.
+	FailureMatcher string `toml:"failure_matcher"`
+	// Percentage of the events that should succeed, defaults to 99.9.
+	Objective float64
+	// Events are counted in buckets of this many seconds, defaults to 10.
+	BucketInterval uint `toml:"bucket_interval"`
+	// The alerts are evaluated every ticker interval, defaults to 60
+	// seconds.
+	TickerInterval uint `toml:"ticker_interval"`
+	// Name of a message field whose values are tracked separately, e.g. the
+	// service or the endpoint.
+	GroupBy string `toml:"group_by"`
+	// Maximum number of groups tracked, events of new groups past this are
+	// dropped. Defaults to 100.
+	MaxGroups int `toml:"max_groups"`
+	// Defaults to the alerts recommended by the Site Reliability Workbook
+	// for paging: 14.4 over 1h and 5m, and 6 over 6h and 30m.
+	Alerts []BurnRateAlert `toml:"alerts"`
+}
+
+// Event counts and alert states of a group.
+type burnRateGroup struct {
+	good []int64
+	bad  []int64
+	// Index of the current bucket in the slices.
+	pos int
+	// Start of the current bucket, in bucket intervals since the epoch.
+	bucket int64
+	firing []bool
+}
+
+func (f *BurnRateFilter) ConfigStruct() interface{} {
+	return &BurnRateFilterConfig{
+		Objective:      99.9,
+		BucketInterval: 10,
+		TickerInterval: 60,
+		MaxGroups:      100,
+	}
+}
+
+func (f *BurnRateFilter) Init(config interface{}) (err error) {
+	conf := config.(*BurnRateFilterConfig)
+	if conf.FailureMatcher == "" {
+		return errors.New("BurnRateFilter requires a failure_matcher")
+	}
+	if f.failure, err = message.CreateMatcherSpecification(conf.FailureMatcher); err != nil {
+		return fmt.Errorf("BurnRateFilter invalid failure_matcher: %s", err)
+	}
+	if conf.Objective <= 0 || conf.Objective >= 100 {
+		return fmt.Errorf("BurnRateFilter objective must be above 0 and below 100, got %g",
+			conf.Objective)
+	}
+	if conf.BucketInterval == 0 {
+		return errors.New("BurnRateFilter bucket_interval must be positive")
+	}
+	if conf.MaxGroups <= 0 {
+		return errors.New("BurnRateFilter max_groups must be positive")
+	}
+	if len(conf.Alerts) == 0 {
+		conf.Alerts = []BurnRateAlert{
+			{Severity: "page", LongWindow: 3600, ShortWindow: 300, BurnRate: 14.4},
+			{Severity: "page", LongWindow: 21600, ShortWindow: 1800, BurnRate: 6},
+		}
+	}
+	var longest uint
+	for i, alert := range conf.Alerts {
+		if alert.ShortWindow == 0 || alert.LongWindow < alert.ShortWindow {
+			return fmt.Errorf("BurnRateFilter alert %d needs a short_window that's "+
+				"positive and at most its long_window", i+1)
+		}
+		if alert.BurnRate <= 0 {
+			return fmt.Errorf("BurnRateFilter alert %d needs a positive burn_rate", i+1)
+		}
+		if alert.LongWindow > longest {
+			longest = alert.LongWindow
+		}
+	}
+	f.conf = conf
+	f.budget = (100 - conf.Objective) / 100
+	f.bucketSecs = int64(conf.BucketInterval)
+	f.buckets = f.windowBuckets(longest)
+	f.groups = make(map[string]*burnRateGroup)
+	f.now = time.Now
+	return nil
+}
+
+// Number of buckets covering the window, rounded up.
+func (f *BurnRateFilter) windowBuckets(window uint) int {
+	return int((int64(window) + f.bucketSecs - 1) / f.bucketSecs)
+}
+
+func (f *BurnRateFilter) Run(fr FilterRunner, h PluginHelper) (err error) {
+	inChan := fr.InChan()
+	ticker := fr.Ticker()
+	for {
+		select {
+		case pack, ok := <-inChan:
+			if !ok {
+				return nil
+			}
+			f.count(pack.Message)
+			fr.UpdateCursor(pack.QueueCursor)
+			pack.Recycle(nil)
+		case <-ticker:
+			f.evaluate(fr, h)
+		}
+	}
+}
+
+func (f *BurnRateFilter) CleanupForRestart() {
+	f.groups = make(map[string]*burnRateGroup)
+}
+
+// Counts the message as a success or a failure of its group.
+func (f *BurnRateFilter) count(msg *message.Message) {
+	var name string
+	if f.conf.GroupBy != "" {
+		switch value, _ := msg.GetFieldValue(f.conf.GroupBy); v := value.(type) {
+		case nil:
+		case []byte:
+			name = string(v)
+		default:
+			name = fmt.Sprint(v)
+		}
+	}
+	g, ok := f.groups[name]
+	if !ok {
+		if len(f.groups) >= f.conf.MaxGroups {
+			atomic.AddInt64(&f.droppedGroups, 1)
+			return
+		}
+		g = &burnRateGroup{
+			good:   make([]int64, f.buckets),
+			bad:    make([]int64, f.buckets),
+			bucket: f.now().Unix() / f.bucketSecs,
+			firing: make([]bool, len(f.conf.Alerts)),
+		}
+		f.groups[name] = g
+	}
+	g.advance(f.now().Unix() / f.bucketSecs)
+	if f.failure.Match(msg) {
+		g.bad[g.pos]++
+	} else {
+		g.good[g.pos]++
+	}
+}
+
+// Moves the group's current bucket forward to the given one, clearing the
+// buckets in between.
+func (g *burnRateGroup) advance(bucket int64) {
+	n := int64(len(g.good))
+	if bucket-g.bucket >= n {
+		for i := range g.good {
+			g.good[i], g.bad[i] = 0, 0
+		}
+		g.bucket = bucket
+		return
+	}
+	for g.bucket < bucket {
+		g.bucket++
+		g.pos = (g.pos + 1) % len(g.good)
+		g.good[g.pos], g.bad[g.pos] = 0, 0
+	}
+}
+
+// Returns the group's error rate over its last `buckets` buckets, and
+// whether it had any events.
+func (g *burnRateGroup) errorRate(buckets int) (float64, bool) {
+	var good, bad int64
+	for i := 0; i < buckets; i++ {
+		pos := (g.pos - i + len(g.good)) % len(g.good)
+		good += g.good[pos]
+		bad += g.bad[pos]
+	}
+	if good+bad == 0 {
+		return 0, false
+	}
+	return float64(bad) / float64(good+bad), true
+}
+
+// Returns the rate at which the group's error budget burns over the window.
+func (f *BurnRateFilter) burnRate(g *burnRateGroup, window uint) float64 {
+	rate, _ := g.errorRate(f.windowBuckets(window))
+	return rate / f.budget
+}
+
+// Updates the state of each alert of each group, injecting a message for
+// each alert that starts or stops firing.
+func (f *BurnRateFilter) evaluate(fr FilterRunner, h PluginHelper) {
+	bucket := f.now().Unix() / f.bucketSecs
+	for name, g := range f.groups {
+		g.advance(bucket)
+		if _, ok := g.errorRate(f.buckets); !ok {
+			// No events left in any window.
+			delete(f.groups, name)
+			if !anyFiring(g.firing) {
+				continue
+			}
+		}
+		for i, alert := range f.conf.Alerts {
+			long := f.burnRate(g, alert.LongWindow)
+			short := f.burnRate(g, alert.ShortWindow)
+			firing := long >= alert.BurnRate && short >= alert.BurnRate
+			if firing == g.firing[i] {
+				continue
+			}
+			g.firing[i] = firing
+			if err := f.inject(fr, h, name, alert, firing, long, short); err != nil {
+				fr.LogError(err)
+			}
+		}
+	}
+}
+
+func anyFiring(firing []bool) bool {
+	for _, f := range firing {
+		if f {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *BurnRateFilter) inject(fr FilterRunner, h PluginHelper, group string,
+	alert BurnRateAlert, firing bool, long, short float64) error {
+
+	pack, err := h.PipelinePack(0)
+	if err != nil {
+		return err
+	}
+	status := "resolved"
+	if firing {
+		status = "firing"
+	}
+	msg := pack.Message
+	msg.SetType("heka.burn-rate-alert")
+	msg.SetLogger(fr.Name())
+	msg.SetTimestamp(f.now().UnixNano())
+	msg.SetPayload(fmt.Sprintf("%s %s: error budget burning at %.1fx over %s "+
+		"and %.1fx over %s, alerting at %gx for a %g%% objective", status,
+		alert.Severity, long, time.Duration(alert.LongWindow)*time.Second, short,
+		time.Duration(alert.ShortWindow)*time.Second, alert.BurnRate,
+		f.conf.Objective))
+	msg.SetString("status", status)
+	msg.SetString("severity", alert.Severity)
+	if f.conf.GroupBy != "" {
+		msg.SetString(f.conf.GroupBy, group)
+	}
+	msg.SetDouble("objective", f.conf.Objective)
+	msg.SetDouble("burn_rate_threshold", alert.BurnRate)
+	msg.SetInt("long_window", int64(alert.LongWindow))
+	msg.SetDouble("long_burn_rate", long)
+	msg.SetInt("short_window", int64(alert.ShortWindow))
+	msg.SetDouble("short_burn_rate", short)
+	fr.Inject(pack)
+	atomic.AddInt64(&f.alertCount, 1)
+	return nil
+}
+
+func (f *BurnRateFilter) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "AlertCount", atomic.LoadInt64(&f.alertCount),
+		"count")
+	message.NewInt64Field(msg, "DroppedGroupCount",
+		atomic.LoadInt64(&f.droppedGroups), "count")
+	return nil
+}
+
+func init() {
+	RegisterPlugin("BurnRateFilter", func() interface{} {
+		return new(BurnRateFilter)
+	})
+}
@@ -0,0 +1,177 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package slo
+
+import (
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	"github.com/mozilla-services/heka/pipelinemock"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func BurnRateFilterSpec(c gs.Context) {
+	t := new(pipeline_ts.SimpleT)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	fr := pipelinemock.NewMockFilterRunner(ctrl)
+	h := pipelinemock.NewMockPluginHelper(ctrl)
+
+	filter := new(BurnRateFilter)
+	config := filter.ConfigStruct().(*BurnRateFilterConfig)
+	config.FailureMatcher = "Fields[status] >= 500"
+	config.Objective = 99
+	config.Alerts = []BurnRateAlert{
+		{Severity: "page", LongWindow: 600, ShortWindow: 60, BurnRate: 10},
+	}
+
+	// Counts `total` requests to the service, `failed` of which failed.
+	requests := func(service string, total, failed int) {
+		for i := 0; i < total; i++ {
+			msg := new(message.Message)
+			msg.SetString("service", service)
+			if i < failed {
+				msg.SetInt("status", 503)
+			} else {
+				msg.SetInt("status", 200)
+			}
+			filter.count(msg)
+		}
+	}
+
+	// Expects an alert to be injected, capturing it in `injected`.
+	var injected *pipeline.PipelinePack
+	expectInject := func() {
+		injected = pipeline.NewPipelinePack(nil)
+		h.EXPECT().PipelinePack(uint(0)).Return(injected, nil)
+		fr.EXPECT().Name().Return("ApiSlo")
+		fr.EXPECT().Inject(injected).Return(true)
+	}
+
+	c.Specify("A BurnRateFilter", func() {
+		c.Specify("requires a failure matcher", func() {
+			config.FailureMatcher = ""
+			c.Expect(filter.Init(config), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("rejects an objective of 100%", func() {
+			config.Objective = 100
+			c.Expect(filter.Init(config), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("rejects a short window longer than the long one", func() {
+			config.Alerts[0].ShortWindow = 3600
+			c.Expect(filter.Init(config), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("defaults to the workbook's paging alerts", func() {
+			config.Alerts = nil
+			c.Assume(filter.Init(config), gs.IsNil)
+			c.Expect(len(filter.conf.Alerts), gs.Equals, 2)
+			c.Expect(filter.buckets, gs.Equals, 2160)
+		})
+
+		c.Specify("is initialized", func() {
+			c.Assume(filter.Init(config), gs.IsNil)
+			now := time.Unix(1000000, 0)
+			filter.now = func() time.Time { return now }
+
+			c.Specify("computes burn rates over each window", func() {
+				requests("", 100, 0)
+				now = now.Add(5 * time.Minute)
+				requests("", 100, 4)
+				g := filter.groups[""]
+				c.Expect(filter.burnRate(g, 60), gs.Equals, 4.0)
+				c.Expect(filter.burnRate(g, 600), gs.Equals, 2.0)
+			})
+
+			c.Specify("forgets the events that left the windows", func() {
+				requests("", 100, 50)
+				now = now.Add(time.Hour)
+				requests("", 100, 0)
+				c.Expect(filter.burnRate(filter.groups[""], 600), gs.Equals, 0.0)
+			})
+
+			c.Specify("doesn't fire for a low burn rate", func() {
+				requests("", 100, 5)
+				filter.evaluate(fr, h)
+				c.Expect(filter.alertCount, gs.Equals, int64(0))
+			})
+
+			c.Specify("fires when both windows burn too fast", func() {
+				requests("", 100, 20)
+				expectInject()
+				filter.evaluate(fr, h)
+				msg := injected.Message
+				c.Expect(msg.GetType(), gs.Equals, "heka.burn-rate-alert")
+				c.Expect(msg.GetLogger(), gs.Equals, "ApiSlo")
+				status, _ := msg.GetFieldValue("status")
+				c.Expect(status, gs.Equals, "firing")
+				severity, _ := msg.GetFieldValue("severity")
+				c.Expect(severity, gs.Equals, "page")
+				rate, _ := msg.GetFieldValue("long_burn_rate")
+				c.Expect(rate, gs.Equals, 20.0)
+
+				c.Specify("and doesn't fire again while it burns", func() {
+					filter.evaluate(fr, h)
+					c.Expect(filter.alertCount, gs.Equals, int64(1))
+				})
+
+				c.Specify("and resolves once the short window recovers", func() {
+					now = now.Add(2 * time.Minute)
+					requests("", 100, 0)
+					expectInject()
+					filter.evaluate(fr, h)
+					status, _ := injected.Message.GetFieldValue("status")
+					c.Expect(status, gs.Equals, "resolved")
+					c.Expect(filter.alertCount, gs.Equals, int64(2))
+				})
+
+				c.Specify("and resolves once all events are gone", func() {
+					now = now.Add(time.Hour)
+					expectInject()
+					filter.evaluate(fr, h)
+					status, _ := injected.Message.GetFieldValue("status")
+					c.Expect(status, gs.Equals, "resolved")
+					c.Expect(len(filter.groups), gs.Equals, 0)
+				})
+			})
+
+			c.Specify("tracks each group separately", func() {
+				filter.conf.GroupBy = "service"
+				requests("search", 100, 0)
+				requests("checkout", 100, 20)
+				expectInject()
+				filter.evaluate(fr, h)
+				service, _ := injected.Message.GetFieldValue("service")
+				c.Expect(service, gs.Equals, "checkout")
+				c.Expect(len(filter.groups), gs.Equals, 2)
+			})
+
+			c.Specify("drops the events of groups past the maximum", func() {
+				filter.conf.GroupBy = "service"
+				filter.conf.MaxGroups = 1
+				requests("search", 10, 0)
+				requests("checkout", 10, 0)
+				c.Expect(len(filter.groups), gs.Equals, 1)
+				c.Expect(filter.droppedGroups, gs.Equals, int64(10))
+			})
+		})
+	})
+}
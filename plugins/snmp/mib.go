@@ -0,0 +1,134 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package snmp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Names of the commonly polled objects of SNMPv2-MIB and IF-MIB, so they can
+// be configured and reported by name w/o an alias map.
+var defaultNames = map[string]string{
+	"sysDescr":    "1.3.6.1.2.1.1.1",
+	"sysUpTime":   "1.3.6.1.2.1.1.3",
+	"sysContact":  "1.3.6.1.2.1.1.4",
+	"sysName":     "1.3.6.1.2.1.1.5",
+	"sysLocation": "1.3.6.1.2.1.1.6",
+
+	"ifNumber":         "1.3.6.1.2.1.2.1",
+	"ifIndex":          "1.3.6.1.2.1.2.2.1.1",
+	"ifDescr":          "1.3.6.1.2.1.2.2.1.2",
+	"ifType":           "1.3.6.1.2.1.2.2.1.3",
+	"ifMtu":            "1.3.6.1.2.1.2.2.1.4",
+	"ifSpeed":          "1.3.6.1.2.1.2.2.1.5",
+	"ifAdminStatus":    "1.3.6.1.2.1.2.2.1.7",
+	"ifOperStatus":     "1.3.6.1.2.1.2.2.1.8",
+	"ifInOctets":       "1.3.6.1.2.1.2.2.1.10",
+	"ifInUcastPkts":    "1.3.6.1.2.1.2.2.1.11",
+	"ifInDiscards":     "1.3.6.1.2.1.2.2.1.13",
+	"ifInErrors":       "1.3.6.1.2.1.2.2.1.14",
+	"ifOutOctets":      "1.3.6.1.2.1.2.2.1.16",
+	"ifOutUcastPkts":   "1.3.6.1.2.1.2.2.1.17",
+	"ifOutDiscards":    "1.3.6.1.2.1.2.2.1.19",
+	"ifOutErrors":      "1.3.6.1.2.1.2.2.1.20",
+	"ifName":           "1.3.6.1.2.1.31.1.1.1.1",
+	"ifHCInOctets":     "1.3.6.1.2.1.31.1.1.1.6",
+	"ifHCInUcastPkts":  "1.3.6.1.2.1.31.1.1.1.7",
+	"ifHCOutOctets":    "1.3.6.1.2.1.31.1.1.1.10",
+	"ifHCOutUcastPkts": "1.3.6.1.2.1.31.1.1.1.11",
+	"ifHighSpeed":      "1.3.6.1.2.1.31.1.1.1.15",
+	"ifAlias":          "1.3.6.1.2.1.31.1.1.1.18",
+}
+
+// Maps between object names and OIDs, in both directions.
+type mib struct {
+	oids  map[string]string // By name.
+	names map[string]string // By OID.
+}
+
+// Returns the default names, overridden and extended by the provided ones.
+func newMib(names map[string]string) (*mib, error) {
+	m := &mib{
+		oids:  make(map[string]string, len(defaultNames)+len(names)),
+		names: make(map[string]string, len(defaultNames)+len(names)),
+	}
+	for _, source := range []map[string]string{defaultNames, names} {
+		for name, oid := range source {
+			oid = strings.TrimPrefix(oid, ".")
+			if !isNumericOid(oid) {
+				return nil, fmt.Errorf("invalid OID for '%s': %s", name, oid)
+			}
+			if old, ok := m.oids[name]; ok {
+				delete(m.names, old)
+			}
+			m.oids[name] = oid
+			m.names[oid] = name
+		}
+	}
+	return m, nil
+}
+
+func isNumericOid(oid string) bool {
+	if oid == "" {
+		return false
+	}
+	for _, part := range strings.Split(oid, ".") {
+		if _, err := strconv.ParseUint(part, 10, 32); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Resolves an OID given either numerically, e.g. "1.3.6.1.2.1.2.2.1.10.1", or
+// as a name optionally followed by an index, e.g. "ifInOctets.1".
+func (m *mib) resolve(oid string) (string, error) {
+	oid = strings.TrimPrefix(oid, ".")
+	if isNumericOid(oid) {
+		return oid, nil
+	}
+	name, index := oid, ""
+	if dot := strings.IndexByte(oid, '.'); dot >= 0 {
+		name, index = oid[:dot], oid[dot:]
+	}
+	base, ok := m.oids[name]
+	if !ok {
+		return "", fmt.Errorf("unknown object name '%s'", name)
+	}
+	if index != "" && !isNumericOid(index[1:]) {
+		return "", fmt.Errorf("invalid index in '%s'", oid)
+	}
+	return base + index, nil
+}
+
+// Returns the name of the longest known OID prefixing the OID, followed by
+// the rest of the OID, e.g. "ifInOctets.1". OIDs w/o any known prefix are
+// returned as is.
+func (m *mib) name(oid string) string {
+	oid = strings.TrimPrefix(oid, ".")
+	for prefix := oid; prefix != ""; {
+		if name, ok := m.names[prefix]; ok {
+			return name + oid[len(prefix):]
+		}
+		dot := strings.LastIndex(prefix, ".")
+		if dot < 0 {
+			break
+		}
+		prefix = prefix[:dot]
+	}
+	return oid
+}
@@ -0,0 +1,416 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package snmp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"github.com/pborman/uuid"
+	"github.com/soniah/gosnmp"
+)
+
+// SNMPv3 user based security settings.
+type SnmpV3Config struct {
+	Username string
+	// "noAuthNoPriv", "authNoPriv" or "authPriv". Defaults to "authPriv".
+	SecurityLevel string `toml:"security_level"`
+	// "MD5" or "SHA". Defaults to "SHA".
+	AuthProtocol string `toml:"auth_protocol"`
+	AuthPassword string `toml:"auth_password"`
+	// "DES" or "AES". Defaults to "AES".
+	PrivProtocol string `toml:"priv_protocol"`
+	PrivPassword string `toml:"priv_password"`
+	ContextName  string `toml:"context_name"`
+}
+
+type SnmpInputConfig struct {
+	// Agents to poll, as "host" or "host:port". The port defaults to 161.
+	Targets []string
+	// SNMP version, "2c" or "3". Defaults to "2c".
+	Version string
+	// Community of SNMPv2c requests. Defaults to "public".
+	Community string
+	// SNMPv3 security settings, required w/ version 3.
+	V3 *SnmpV3Config `toml:"v3"`
+	// OIDs to poll, either numeric or as a name followed by an optional
+	// index, e.g. "ifHCInOctets.1".
+	Oids []string
+	// Names of OIDs, in addition to the built-in ones. Fields are named for
+	// the longest named OID prefixing the polled OID.
+	Names map[string]string
+	// Seconds between polls. Defaults to 60.
+	TickerInterval uint `toml:"ticker_interval"`
+	// Milliseconds to wait for each response. Defaults to 5000.
+	Timeout uint
+	// Number of times a request is retried. Defaults to 1.
+	Retries int
+}
+
+// The part of a gosnmp.GoSNMP connection SnmpInput needs, so tests can stub
+// out the agents.
+type snmpClient interface {
+	Get(oids []string) ([]gosnmp.SnmpPDU, error)
+	Close() error
+}
+
+type goSnmpClient struct {
+	snmp *gosnmp.GoSNMP
+}
+
+func (c goSnmpClient) Get(oids []string) ([]gosnmp.SnmpPDU, error) {
+	packet, err := c.snmp.Get(oids)
+	if err != nil {
+		return nil, err
+	}
+	return packet.Variables, nil
+}
+
+func (c goSnmpClient) Close() error {
+	return c.snmp.Conn.Close()
+}
+
+type snmpTarget struct {
+	name   string // As configured.
+	host   string
+	port   uint16
+	client snmpClient // Nil until connected, or after an error.
+}
+
+// Input plugin that periodically polls SNMP agents for the configured OIDs,
+// emitting a message per agent w/ a field for each of the values.
+type SnmpInput struct {
+	conf     *SnmpInputConfig
+	mib      *mib
+	oids     []string
+	targets  []*snmpTarget
+	connect  func(t *snmpTarget) (snmpClient, error)
+	stop     chan struct{}
+	runner   pipeline.InputRunner
+	hostname string
+	v3       *gosnmp.UsmSecurityParameters
+	msgFlags gosnmp.SnmpV3MsgFlags
+	timeout  time.Duration
+}
+
+func (input *SnmpInput) ConfigStruct() interface{} {
+	return &SnmpInputConfig{
+		Version:        "2c",
+		Community:      "public",
+		TickerInterval: 60,
+		Timeout:        5000,
+		Retries:        1,
+	}
+}
+
+var v3SecurityLevels = map[string]gosnmp.SnmpV3MsgFlags{
+	"noAuthNoPriv": gosnmp.NoAuthNoPriv,
+	"authNoPriv":   gosnmp.AuthNoPriv,
+	"authPriv":     gosnmp.AuthPriv,
+}
+
+var v3AuthProtocols = map[string]gosnmp.SnmpV3AuthProtocol{
+	"MD5": gosnmp.MD5,
+	"SHA": gosnmp.SHA,
+}
+
+var v3PrivProtocols = map[string]gosnmp.SnmpV3PrivProtocol{
+	"DES": gosnmp.DES,
+	"AES": gosnmp.AES,
+}
+
+func (input *SnmpInput) Init(config interface{}) (err error) {
+	input.conf = config.(*SnmpInputConfig)
+	if len(input.conf.Targets) == 0 {
+		return errors.New("no `targets` configured")
+	}
+	if len(input.conf.Oids) == 0 {
+		return errors.New("no `oids` configured")
+	}
+	if input.conf.Timeout == 0 {
+		return errors.New("`timeout` must be greater than 0")
+	}
+	switch input.conf.Version {
+	case "2c":
+	case "3":
+		if err = input.initV3(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported `version`: %s", input.conf.Version)
+	}
+
+	if input.mib, err = newMib(input.conf.Names); err != nil {
+		return err
+	}
+	input.oids = input.oids[:0]
+	for _, o := range input.conf.Oids {
+		oid, err := input.mib.resolve(o)
+		if err != nil {
+			return err
+		}
+		input.oids = append(input.oids, oid)
+	}
+
+	input.targets = input.targets[:0]
+	for _, t := range input.conf.Targets {
+		target := &snmpTarget{name: t, host: t, port: 161}
+		if host, port, err := net.SplitHostPort(t); err == nil {
+			p, err := strconv.ParseUint(port, 10, 16)
+			if err != nil {
+				return fmt.Errorf("invalid port in target '%s'", t)
+			}
+			target.host, target.port = host, uint16(p)
+		}
+		input.targets = append(input.targets, target)
+	}
+	input.timeout = time.Duration(input.conf.Timeout) * time.Millisecond
+	if input.connect == nil {
+		input.connect = input.connectGoSnmp
+	}
+	input.stop = make(chan struct{})
+	return nil
+}
+
+func (input *SnmpInput) initV3() error {
+	v3 := input.conf.V3
+	if v3 == nil || v3.Username == "" {
+		return errors.New("version 3 requires a `v3` section w/ a `username`")
+	}
+	if v3.SecurityLevel == "" {
+		v3.SecurityLevel = "authPriv"
+	}
+	var ok bool
+	if input.msgFlags, ok = v3SecurityLevels[v3.SecurityLevel]; !ok {
+		return fmt.Errorf("invalid `security_level`: %s", v3.SecurityLevel)
+	}
+	input.v3 = &gosnmp.UsmSecurityParameters{
+		UserName:               v3.Username,
+		AuthenticationProtocol: gosnmp.NoAuth,
+		PrivacyProtocol:        gosnmp.NoPriv,
+	}
+	if input.msgFlags == gosnmp.NoAuthNoPriv {
+		return nil
+	}
+	if v3.AuthProtocol == "" {
+		v3.AuthProtocol = "SHA"
+	}
+	if input.v3.AuthenticationProtocol, ok = v3AuthProtocols[v3.AuthProtocol]; !ok {
+		return fmt.Errorf("invalid `auth_protocol`: %s", v3.AuthProtocol)
+	}
+	if v3.AuthPassword == "" {
+		return errors.New("no `auth_password` configured")
+	}
+	input.v3.AuthenticationPassphrase = v3.AuthPassword
+	if input.msgFlags == gosnmp.AuthNoPriv {
+		return nil
+	}
+	if v3.PrivProtocol == "" {
+		v3.PrivProtocol = "AES"
+	}
+	if input.v3.PrivacyProtocol, ok = v3PrivProtocols[v3.PrivProtocol]; !ok {
+		return fmt.Errorf("invalid `priv_protocol`: %s", v3.PrivProtocol)
+	}
+	if v3.PrivPassword == "" {
+		return errors.New("no `priv_password` configured")
+	}
+	input.v3.PrivacyPassphrase = v3.PrivPassword
+	return nil
+}
+
+func (input *SnmpInput) connectGoSnmp(t *snmpTarget) (snmpClient, error) {
+	snmp := &gosnmp.GoSNMP{
+		Target:    t.host,
+		Port:      t.port,
+		Community: input.conf.Community,
+		Version:   gosnmp.Version2c,
+		Timeout:   input.timeout,
+		Retries:   input.conf.Retries,
+		MaxOids:   gosnmp.MaxOids,
+	}
+	if input.conf.Version == "3" {
+		snmp.Version = gosnmp.Version3
+		snmp.SecurityModel = gosnmp.UserSecurityModel
+		snmp.MsgFlags = input.msgFlags
+		// Each connection discovers its agent's engine, which is stored in
+		// the security parameters, so they can't be shared.
+		snmp.SecurityParameters = &gosnmp.UsmSecurityParameters{
+			UserName:                 input.v3.UserName,
+			AuthenticationProtocol:   input.v3.AuthenticationProtocol,
+			AuthenticationPassphrase: input.v3.AuthenticationPassphrase,
+			PrivacyProtocol:          input.v3.PrivacyProtocol,
+			PrivacyPassphrase:        input.v3.PrivacyPassphrase,
+		}
+		snmp.ContextName = input.conf.V3.ContextName
+	}
+	if err := snmp.Connect(); err != nil {
+		return nil, err
+	}
+	return goSnmpClient{snmp}, nil
+}
+
+func (input *SnmpInput) Stop() {
+	close(input.stop)
+}
+
+func (input *SnmpInput) Run(runner pipeline.InputRunner,
+	helper pipeline.PluginHelper) error {
+
+	input.runner = runner
+	input.hostname = helper.Hostname()
+	tickChan := runner.Ticker()
+	packSupply := runner.InChan()
+	defer func() {
+		for _, t := range input.targets {
+			if t.client != nil {
+				t.client.Close()
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-input.stop:
+			return nil
+		case <-tickChan:
+		}
+		now := time.Now()
+		results := input.pollAll()
+		for i, pdus := range results {
+			if pdus == nil {
+				continue
+			}
+			pack := <-packSupply
+			input.populate(pack.Message, input.targets[i], pdus, now)
+			runner.Deliver(pack)
+		}
+	}
+}
+
+// Polls all the targets concurrently, so an agent that's timing out doesn't
+// delay the polls of the others. Failed polls are logged and have nil
+// results.
+func (input *SnmpInput) pollAll() [][]gosnmp.SnmpPDU {
+	results := make([][]gosnmp.SnmpPDU, len(input.targets))
+	var wg sync.WaitGroup
+	wg.Add(len(input.targets))
+	for i, t := range input.targets {
+		go func(i int, t *snmpTarget) {
+			defer wg.Done()
+			pdus, err := input.poll(t)
+			if err != nil {
+				input.runner.LogError(fmt.Errorf("can't poll %s: %s", t.name, err))
+				return
+			}
+			results[i] = pdus
+		}(i, t)
+	}
+	wg.Wait()
+	return results
+}
+
+func (input *SnmpInput) poll(t *snmpTarget) (pdus []gosnmp.SnmpPDU, err error) {
+	if t.client == nil {
+		if t.client, err = input.connect(t); err != nil {
+			return nil, err
+		}
+	}
+	// Agents limit the number of OIDs per request.
+	for start := 0; start < len(input.oids); start += gosnmp.MaxOids {
+		end := start + gosnmp.MaxOids
+		if end > len(input.oids) {
+			end = len(input.oids)
+		}
+		vars, err := t.client.Get(input.oids[start:end])
+		if err != nil {
+			// Reconnect on the next poll, in case the agent restarted w/ a
+			// new engine ID and boot count.
+			t.client.Close()
+			t.client = nil
+			return nil, err
+		}
+		pdus = append(pdus, vars...)
+	}
+	return pdus, nil
+}
+
+func (input *SnmpInput) populate(msg *message.Message, t *snmpTarget,
+	pdus []gosnmp.SnmpPDU, now time.Time) {
+
+	msg.SetUuid(uuid.NewRandom())
+	msg.SetTimestamp(now.UnixNano())
+	msg.SetType("heka.snmp")
+	msg.SetLogger(t.name)
+	msg.SetHostname(input.hostname)
+	for _, pdu := range pdus {
+		value, ok := snmpValue(pdu)
+		if !ok {
+			continue
+		}
+		field, err := message.NewField(input.mib.name(pdu.Name), value, "")
+		if err != nil {
+			input.runner.LogError(fmt.Errorf("can't add field for %s: %s",
+				pdu.Name, err))
+			continue
+		}
+		msg.AddField(field)
+	}
+}
+
+// Converts a PDU's value to a field value: counters, gauges, time ticks and
+// integers to ints, strings, OIDs and IP addresses to strings. Missing
+// objects and unsupported types are skipped.
+func snmpValue(pdu gosnmp.SnmpPDU) (interface{}, bool) {
+	switch pdu.Type {
+	case gosnmp.Integer, gosnmp.Counter32, gosnmp.Gauge32, gosnmp.TimeTicks,
+		gosnmp.Counter64, gosnmp.Uinteger32:
+		n := gosnmp.ToBigInt(pdu.Value)
+		if n.Sign() < 0 {
+			return n.Int64(), true
+		}
+		// Counter64 values over the int64 maximum wrap around, like the
+		// counters themselves do.
+		return int64(n.Uint64()), true
+	case gosnmp.OctetString:
+		if b, ok := pdu.Value.([]byte); ok {
+			return string(b), true
+		}
+	case gosnmp.ObjectIdentifier, gosnmp.IPAddress:
+		if s, ok := pdu.Value.(string); ok {
+			return s, true
+		}
+	case gosnmp.OpaqueFloat:
+		if f, ok := pdu.Value.(float32); ok {
+			return float64(f), true
+		}
+	case gosnmp.OpaqueDouble:
+		if f, ok := pdu.Value.(float64); ok {
+			return f, true
+		}
+	}
+	return nil, false
+}
+
+func init() {
+	pipeline.RegisterPlugin("SnmpInput", func() interface{} {
+		return new(SnmpInput)
+	})
+}
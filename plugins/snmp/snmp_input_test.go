@@ -0,0 +1,197 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package snmp
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	. "github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	"github.com/mozilla-services/heka/pipelinemock"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"github.com/soniah/gosnmp"
+)
+
+// Answers Gets from a fixed set of values, like an agent would.
+type stubClient struct {
+	values map[string]gosnmp.SnmpPDU
+	gets   [][]string
+	closed bool
+}
+
+func (s *stubClient) Get(oids []string) ([]gosnmp.SnmpPDU, error) {
+	if s.values == nil {
+		return nil, errors.New("request timeout")
+	}
+	s.gets = append(s.gets, oids)
+	pdus := make([]gosnmp.SnmpPDU, len(oids))
+	for i, oid := range oids {
+		pdu, ok := s.values[oid]
+		if !ok {
+			pdu = gosnmp.SnmpPDU{Type: gosnmp.NoSuchObject}
+		}
+		// Agents return OIDs w/ a leading dot.
+		pdu.Name = "." + oid
+		pdus[i] = pdu
+	}
+	return pdus, nil
+}
+
+func (s *stubClient) Close() error {
+	s.closed = true
+	return nil
+}
+
+func SnmpInputSpec(c gs.Context) {
+	t := new(pipeline_ts.SimpleT)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	c.Specify("A mib", func() {
+		m, err := newMib(map[string]string{
+			"myCounter": ".1.3.6.1.4.1.9999.1",
+			"ifDescr":   "1.3.6.1.4.1.9999.2",
+		})
+		c.Assume(err, gs.IsNil)
+
+		c.Specify("resolves names w/ indexes", func() {
+			oid, err := m.resolve("ifHCInOctets.3")
+			c.Expect(err, gs.IsNil)
+			c.Expect(oid, gs.Equals, "1.3.6.1.2.1.31.1.1.1.6.3")
+			oid, err = m.resolve("myCounter")
+			c.Expect(err, gs.IsNil)
+			c.Expect(oid, gs.Equals, "1.3.6.1.4.1.9999.1")
+			oid, err = m.resolve(".1.3.6.1.2.1.1.3.0")
+			c.Expect(err, gs.IsNil)
+			c.Expect(oid, gs.Equals, "1.3.6.1.2.1.1.3.0")
+			_, err = m.resolve("noSuchName.1")
+			c.Expect(err, gs.Not(gs.IsNil))
+			_, err = m.resolve("ifInOctets.x")
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("names OIDs for their longest named prefix", func() {
+			c.Expect(m.name(".1.3.6.1.2.1.2.2.1.10.3"), gs.Equals, "ifInOctets.3")
+			c.Expect(m.name("1.3.6.1.4.1.9999.1.0"), gs.Equals, "myCounter.0")
+			c.Expect(m.name("1.3.6.1.4.1.8888.1"), gs.Equals, "1.3.6.1.4.1.8888.1")
+			// Overridden names replace the built-in ones.
+			c.Expect(m.name("1.3.6.1.2.1.2.2.1.2.1"), gs.Equals, "1.3.6.1.2.1.2.2.1.2.1")
+			c.Expect(m.name("1.3.6.1.4.1.9999.2.1"), gs.Equals, "ifDescr.1")
+		})
+
+		c.Specify("rejects invalid OIDs", func() {
+			_, err := newMib(map[string]string{"bad": "1.3.x"})
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+
+	c.Specify("An SnmpInput", func() {
+		input := new(SnmpInput)
+		config := input.ConfigStruct().(*SnmpInputConfig)
+		config.Targets = []string{"switch1", "router1:1161"}
+		config.Oids = []string{"sysUpTime.0", "ifDescr.1", "ifHCInOctets.1", "ifInErrors.1"}
+
+		clients := map[string]*stubClient{
+			"switch1": &stubClient{values: map[string]gosnmp.SnmpPDU{
+				"1.3.6.1.2.1.1.3.0":        {Type: gosnmp.TimeTicks, Value: uint32(123456)},
+				"1.3.6.1.2.1.2.2.1.2.1":    {Type: gosnmp.OctetString, Value: []byte("eth0")},
+				"1.3.6.1.2.1.31.1.1.1.6.1": {Type: gosnmp.Counter64, Value: uint64(1 << 40)},
+				"1.3.6.1.2.1.2.2.1.14.1":   {Type: gosnmp.Counter32, Value: uint(7)},
+			}},
+			// Never answers.
+			"router1": &stubClient{},
+		}
+		// Targets are polled concurrently.
+		var (
+			connected []*snmpTarget
+			lock      sync.Mutex
+		)
+		input.connect = func(t *snmpTarget) (snmpClient, error) {
+			lock.Lock()
+			defer lock.Unlock()
+			connected = append(connected, t)
+			return clients[t.host], nil
+		}
+
+		c.Specify("validates its config", func() {
+			config.Version = "1"
+			c.Expect(input.Init(config), gs.Not(gs.IsNil))
+			config.Version = "3"
+			c.Expect(input.Init(config), gs.Not(gs.IsNil))
+			config.V3 = &SnmpV3Config{Username: "heka", AuthPassword: "secret"}
+			// authPriv is the default.
+			c.Expect(input.Init(config), gs.Not(gs.IsNil))
+			config.V3.PrivPassword = "secret"
+			c.Expect(input.Init(config), gs.IsNil)
+			c.Expect(input.v3.PrivacyProtocol, gs.Equals, gosnmp.AES)
+			config.Oids = []string{"bogus.1"}
+			c.Expect(input.Init(config), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("polls each target", func() {
+			err := input.Init(config)
+			c.Assume(err, gs.IsNil)
+
+			pConfig := NewPipelineConfig(nil)
+			mockRunner := pipelinemock.NewMockInputRunner(ctrl)
+			mockHelper := pipelinemock.NewMockPluginHelper(ctrl)
+			tickChan := make(chan time.Time)
+			mockRunner.EXPECT().Ticker().Return(tickChan)
+			mockHelper.EXPECT().Hostname().Return("hekatests.example.com")
+			packSupply := make(chan *PipelinePack, 1)
+			packSupply <- NewPipelinePack(pConfig.InputRecycleChan())
+			mockRunner.EXPECT().InChan().Return(packSupply)
+			logged := make(chan error, 1)
+			mockRunner.EXPECT().LogError(gomock.Any()).Do(func(err error) {
+				logged <- err
+			})
+			delivered := make(chan *PipelinePack, 1)
+			mockRunner.EXPECT().Deliver(gomock.Any()).Do(func(pack *PipelinePack) {
+				delivered <- pack
+			})
+
+			done := make(chan error)
+			go func() {
+				done <- input.Run(mockRunner, mockHelper)
+			}()
+			tickChan <- time.Now()
+			pack := <-delivered
+			<-logged
+			input.Stop()
+			c.Expect(<-done, gs.IsNil)
+
+			c.Expect(len(connected), gs.Equals, 2)
+			c.Expect(clients["switch1"].gets, gs.Equals, [][]string{input.oids})
+			// The failed client is dropped, to be reconnected next time.
+			c.Expect(clients["router1"].closed, gs.IsTrue)
+			c.Expect(input.targets[1].port, gs.Equals, uint16(1161))
+
+			msg := pack.Message
+			c.Expect(msg.GetType(), gs.Equals, "heka.snmp")
+			c.Expect(msg.GetLogger(), gs.Equals, "switch1")
+			value, _ := msg.GetFieldValue("sysUpTime.0")
+			c.Expect(value, gs.Equals, int64(123456))
+			value, _ = msg.GetFieldValue("ifDescr.1")
+			c.Expect(value, gs.Equals, "eth0")
+			value, _ = msg.GetFieldValue("ifHCInOctets.1")
+			c.Expect(value, gs.Equals, int64(1<<40))
+			value, _ = msg.GetFieldValue("ifInErrors.1")
+			c.Expect(value, gs.Equals, int64(7))
+		})
+	})
+}
@@ -23,6 +23,8 @@ func TestAllSpecs(t *testing.T) {
 	r := gospec.NewRunner()
 	r.Parallel = false
 
+	r.AddSpec(DerivedMetricFilterSpec)
+	r.AddSpec(RollupFilterSpec)
 	r.AddSpec(StatsdInputSpec)
 	r.AddSpec(StatsToFieldsDecoderSpec)
 
@@ -0,0 +1,275 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package statsd
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+)
+
+// A metric derived from the messages matching its matcher.
+type DerivedMetric struct {
+	// One of "Counter", "Timer" or "Gauge".
+	Type_ string `toml:"type"`
+	// Message matcher selecting the messages the metric is derived from,
+	// defaults to all of the filter's messages.
+	Matcher string
+	// Name of the metric's bucket, which can refer to the message's fields
+	// and `Logger`, `Hostname`, `Type` and `Payload` as in "%Hostname%".
+	Name string
+	// Value added to a counter, a timing or a gauge's value, which can refer
+	// to the message like the name. Counters default to "1".
+	Value string
+	// Whether dots in the values substituted into the name are replaced by
+	// underscores, so they don't add levels to the metric's name.
+	ReplaceDot bool `toml:"replace_dot"`
+}
+
+// Filter that turns log messages into statsd metrics: each metric's counter,
+// timer or gauge is updated whenever a message matches its matcher, and the
+// accumulated values are flushed to a StatAccumInput every ticker interval.
+type DerivedMetricFilter struct {
+	skipped       int64
+	metrics       []*derivedMetric
+	statAccumName string
+	counters      map[string]float64
+	timers        map[string][]float64
+	gauges        map[string]float64
+}
+
+type derivedMetric struct {
+	DerivedMetric
+	matcher *message.MatcherSpecification
+	// Message variables the name and value refer to.
+	vars []string
+}
+
+type DerivedMetricFilterConfig struct {
+	// Metrics keyed by an arbitrary ID.
+	Metrics map[string]DerivedMetric `toml:"metrics"`
+	// Name of the StatAccumInput the metrics are flushed to, defaults to
+	// "StatAccumInput".
+	StatAccumName string `toml:"stat_accum_name"`
+	// Defaults to flushing every 10 seconds.
+	TickerInterval uint `toml:"ticker_interval"`
+}
+
+var derivedVarRegex = regexp.MustCompile(`%(\w+)%`)
+
+func (f *DerivedMetricFilter) ConfigStruct() interface{} {
+	return &DerivedMetricFilterConfig{
+		StatAccumName:  "StatAccumInput",
+		TickerInterval: 10,
+	}
+}
+
+func (f *DerivedMetricFilter) Init(config interface{}) (err error) {
+	conf := config.(*DerivedMetricFilterConfig)
+	if len(conf.Metrics) == 0 {
+		return errors.New("DerivedMetricFilter requires at least one metric")
+	}
+	f.metrics = make([]*derivedMetric, 0, len(conf.Metrics))
+	for id, met := range conf.Metrics {
+		if met.Name == "" {
+			return fmt.Errorf("DerivedMetricFilter metric '%s' has no name", id)
+		}
+		switch met.Type_ {
+		case "Counter":
+			if met.Value == "" {
+				met.Value = "1"
+			}
+		case "Timer", "Gauge":
+			if met.Value == "" {
+				return fmt.Errorf("DerivedMetricFilter metric '%s' has no value", id)
+			}
+		default:
+			return fmt.Errorf("DerivedMetricFilter metric '%s' has unknown type '%s'",
+				id, met.Type_)
+		}
+		dm := &derivedMetric{DerivedMetric: met}
+		if met.Matcher != "" {
+			if dm.matcher, err = message.CreateMatcherSpecification(met.Matcher); err != nil {
+				return fmt.Errorf("DerivedMetricFilter metric '%s' invalid matcher: %s",
+					id, err)
+			}
+		}
+		for _, m := range derivedVarRegex.FindAllStringSubmatch(met.Name+met.Value, -1) {
+			dm.vars = append(dm.vars, m[1])
+		}
+		f.metrics = append(f.metrics, dm)
+	}
+	f.statAccumName = conf.StatAccumName
+	f.reset()
+	return nil
+}
+
+func (f *DerivedMetricFilter) reset() {
+	f.counters = make(map[string]float64)
+	f.timers = make(map[string][]float64)
+	f.gauges = make(map[string]float64)
+}
+
+func (f *DerivedMetricFilter) Run(fr FilterRunner, h PluginHelper) (err error) {
+	var statAccum StatAccumulator
+	if statAccum, err = h.StatAccumulator(f.statAccumName); err != nil {
+		return
+	}
+	inChan := fr.InChan()
+	ticker := fr.Ticker()
+	for {
+		select {
+		case pack, ok := <-inChan:
+			if !ok {
+				f.flush(fr, statAccum)
+				return nil
+			}
+			f.update(pack.Message)
+			fr.UpdateCursor(pack.QueueCursor)
+			pack.Recycle(nil)
+		case <-ticker:
+			f.flush(fr, statAccum)
+		}
+	}
+}
+
+// Updates the metrics whose matchers match the message.
+func (f *DerivedMetricFilter) update(msg *message.Message) {
+	var values map[string]string
+	for _, met := range f.metrics {
+		if met.matcher != nil && !met.matcher.Match(msg) {
+			continue
+		}
+		if values == nil {
+			values = derivedValues(msg)
+		}
+		name, ok := met.interpolate(met.Name, values, met.ReplaceDot)
+		if !ok {
+			atomic.AddInt64(&f.skipped, 1)
+			continue
+		}
+		text, ok := met.interpolate(met.Value, values, false)
+		if !ok {
+			atomic.AddInt64(&f.skipped, 1)
+			continue
+		}
+		value, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			atomic.AddInt64(&f.skipped, 1)
+			continue
+		}
+		switch met.Type_ {
+		case "Counter":
+			f.counters[name] += value
+		case "Timer":
+			f.timers[name] = append(f.timers[name], value)
+		case "Gauge":
+			f.gauges[name] = value
+		}
+	}
+}
+
+// Returns the values the metrics can refer to.
+func derivedValues(msg *message.Message) map[string]string {
+	values := map[string]string{
+		"Logger":   msg.GetLogger(),
+		"Hostname": msg.GetHostname(),
+		"Type":     msg.GetType(),
+		"Payload":  msg.GetPayload(),
+	}
+	for _, field := range msg.Fields {
+		switch field.GetValueType() {
+		case message.Field_STRING:
+			if len(field.ValueString) > 0 {
+				values[field.GetName()] = field.ValueString[0]
+			}
+		case message.Field_INTEGER:
+			if len(field.ValueInteger) > 0 {
+				values[field.GetName()] = strconv.FormatInt(field.ValueInteger[0], 10)
+			}
+		case message.Field_DOUBLE:
+			if len(field.ValueDouble) > 0 {
+				values[field.GetName()] = strconv.FormatFloat(field.ValueDouble[0],
+					'f', -1, 64)
+			}
+		case message.Field_BOOL:
+			if len(field.ValueBool) > 0 {
+				values[field.GetName()] = strconv.FormatBool(field.ValueBool[0])
+			}
+		}
+	}
+	return values
+}
+
+// Substitutes the values into the template, ok is false if the message lacks
+// one of the variables the metric refers to.
+func (met *derivedMetric) interpolate(template string, values map[string]string,
+	replaceDot bool) (string, bool) {
+
+	for _, v := range met.vars {
+		if _, ok := values[v]; !ok {
+			return "", false
+		}
+	}
+	if !replaceDot {
+		return InterpolateString(template, values), true
+	}
+	replaced := make(map[string]string, len(met.vars))
+	for _, v := range met.vars {
+		replaced[v] = strings.Replace(values[v], ".", "_", -1)
+	}
+	return InterpolateString(template, replaced), true
+}
+
+// Hands the accumulated values over to the StatAccumInput.
+func (f *DerivedMetricFilter) flush(fr FilterRunner, statAccum StatAccumulator) {
+	drop := func(stat Stat) {
+		stat.Sampling = 1.0
+		if !statAccum.DropStat(stat) {
+			fr.LogError(fmt.Errorf("Undelivered stat: %v", stat))
+		}
+	}
+	for name, value := range f.counters {
+		drop(Stat{Bucket: name, Value: strconv.FormatFloat(value, 'f', -1, 64)})
+	}
+	for name, values := range f.timers {
+		for _, value := range values {
+			drop(Stat{Bucket: name, Value: strconv.FormatFloat(value, 'f', -1, 64),
+				Modifier: "ms"})
+		}
+	}
+	for name, value := range f.gauges {
+		drop(Stat{Bucket: name, Value: strconv.FormatFloat(value, 'f', -1, 64),
+			Modifier: "g"})
+	}
+	f.reset()
+}
+
+func (f *DerivedMetricFilter) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "SkippedCount", atomic.LoadInt64(&f.skipped), "count")
+	return nil
+}
+
+func init() {
+	RegisterPlugin("DerivedMetricFilter", func() interface{} {
+		return new(DerivedMetricFilter)
+	})
+}
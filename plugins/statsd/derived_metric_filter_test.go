@@ -0,0 +1,114 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package statsd
+
+import (
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+// StatAccumulator collecting the dropped stats.
+type statCollector struct {
+	stats []Stat
+}
+
+func (s *statCollector) DropStat(stat Stat) bool {
+	s.stats = append(s.stats, stat)
+	return true
+}
+
+func DerivedMetricFilterSpec(c gs.Context) {
+	c.Specify("A DerivedMetricFilter", func() {
+		filter := new(DerivedMetricFilter)
+		config := filter.ConfigStruct().(*DerivedMetricFilterConfig)
+		config.Metrics = map[string]DerivedMetric{
+			"errors": {
+				Type_:      "Counter",
+				Matcher:    "Fields[status] >= 500",
+				Name:       "%Hostname%.errors.%status%",
+				ReplaceDot: true,
+			},
+			"latency": {
+				Type_: "Timer",
+				Name:  "%Hostname%.latency",
+				Value: "%request_time%",
+			},
+		}
+		collector := new(statCollector)
+
+		access := func(status int64, requestTime float64) {
+			msg := new(message.Message)
+			msg.SetHostname("web1.example.com")
+			msg.SetInt("status", status)
+			msg.SetDouble("request_time", requestTime)
+			filter.update(msg)
+		}
+
+		c.Specify("requires a known metric type", func() {
+			config.Metrics["errors"] = DerivedMetric{Type_: "Histogram", Name: "x"}
+			c.Expect(filter.Init(config), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("requires a value for timers", func() {
+			config.Metrics["latency"] = DerivedMetric{Type_: "Timer", Name: "x"}
+			c.Expect(filter.Init(config), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("rejects an invalid matcher", func() {
+			config.Metrics["errors"] = DerivedMetric{Type_: "Counter", Name: "x",
+				Matcher: "Fields[status] >"}
+			c.Expect(filter.Init(config), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("is initialized", func() {
+			err := filter.Init(config)
+			c.Assume(err, gs.IsNil)
+			access(200, 12)
+			access(503, 40)
+			access(503, 31.5)
+
+			c.Specify("counts the matching messages", func() {
+				c.Expect(len(filter.counters), gs.Equals, 1)
+				c.Expect(filter.counters["web1_example_com.errors.503"], gs.Equals, 2.0)
+			})
+
+			c.Specify("records every timing", func() {
+				c.Expect(filter.timers["web1.example.com.latency"], gs.ContainsInOrder,
+					[]float64{12, 40, 31.5})
+			})
+
+			c.Specify("skips metrics referring to a missing variable", func() {
+				filter.update(new(message.Message))
+				c.Expect(filter.skipped, gs.Equals, int64(1))
+			})
+
+			c.Specify("flushes the accumulated values", func() {
+				filter.flush(nil, collector)
+				c.Expect(collector.stats, gs.ContainsExactly, []Stat{
+					{Bucket: "web1_example_com.errors.503", Value: "2", Sampling: 1},
+					{Bucket: "web1.example.com.latency", Value: "12", Modifier: "ms",
+						Sampling: 1},
+					{Bucket: "web1.example.com.latency", Value: "40", Modifier: "ms",
+						Sampling: 1},
+					{Bucket: "web1.example.com.latency", Value: "31.5", Modifier: "ms",
+						Sampling: 1},
+				})
+				c.Expect(len(filter.counters), gs.Equals, 0)
+				c.Expect(len(filter.timers), gs.Equals, 0)
+			})
+		})
+	})
+}
@@ -0,0 +1,381 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package statsd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+)
+
+// Aggregation applied to the metrics whose names match its pattern.
+type RollupRule struct {
+	// Regular expression matched against the metric names.
+	Pattern string
+	// How a metric's values in an interval are combined, one of "avg",
+	// "sum", "min", "max", "last" or "count".
+	Aggregation string
+}
+
+type RollupFilterConfig struct {
+	// Length in seconds of the intervals the metrics are rolled up into,
+	// defaults to 60.
+	Interval uint `toml:"interval"`
+	// Rules choosing each metric's aggregation, the first whose pattern
+	// matches applies.
+	Rules []RollupRule `toml:"rules"`
+	// Aggregation of the metrics no rule matches, defaults to "avg".
+	DefaultAggregation string `toml:"default_aggregation"`
+	// Seconds to wait after an interval ends before it's emitted, for
+	// metrics arriving late. Defaults to 10.
+	Grace uint `toml:"grace"`
+	// Maximum number of metrics per interval, defaults to 10000.
+	MaxMetrics int `toml:"max_metrics"`
+	// Type of the generated messages, defaults to "heka.statmetric.rollup".
+	MessageType string `toml:"message_type"`
+	// Whether the rolled up metrics are written to the payload as graphite
+	// lines, defaults to true.
+	EmitInPayload bool `toml:"emit_in_payload"`
+	// Whether the rolled up metrics are added as message fields, defaults to
+	// false.
+	EmitInFields bool `toml:"emit_in_fields"`
+	// Defaults to checking for ended intervals every 10 seconds.
+	TickerInterval uint `toml:"ticker_interval"`
+}
+
+// Filter that rolls up statmetric messages, such as those generated by a
+// StatAccumInput, into coarser intervals, combining each metric's values in
+// an interval w/ the aggregation its rule picks.
+type RollupFilter struct {
+	// 64-bit values accessed atomically come first to guarantee alignment.
+	malformed    int64
+	late         int64
+	dropped      int64
+	conf         *RollupFilterConfig
+	interval     int64
+	rules        []*regexp.Regexp
+	aggregations []string
+	// Aggregation of each metric name seen, looked up in the rules once.
+	names map[string]string
+	// Intervals being rolled up, keyed by their start.
+	windows map[int64]map[string]*rollupValue
+	// Start of the earliest interval that hasn't been emitted yet.
+	watermark int64
+	now       func() time.Time
+}
+
+// Values of a metric seen in an interval.
+type rollupValue struct {
+	aggregation string
+	count       int
+	sum         float64
+	min         float64
+	max         float64
+	last        float64
+}
+
+func (r *rollupValue) add(value float64) {
+	if r.count == 0 || value < r.min {
+		r.min = value
+	}
+	if r.count == 0 || value > r.max {
+		r.max = value
+	}
+	r.count++
+	r.sum += value
+	r.last = value
+}
+
+func (r *rollupValue) value() float64 {
+	switch r.aggregation {
+	case "sum":
+		return r.sum
+	case "min":
+		return r.min
+	case "max":
+		return r.max
+	case "last":
+		return r.last
+	case "count":
+		return float64(r.count)
+	}
+	return r.sum / float64(r.count)
+}
+
+func validRollupAggregation(aggregation string) bool {
+	switch aggregation {
+	case "avg", "sum", "min", "max", "last", "count":
+		return true
+	}
+	return false
+}
+
+func (f *RollupFilter) ConfigStruct() interface{} {
+	return &RollupFilterConfig{
+		Interval:           60,
+		DefaultAggregation: "avg",
+		Grace:              10,
+		MaxMetrics:         10000,
+		MessageType:        "heka.statmetric.rollup",
+		EmitInPayload:      true,
+		TickerInterval:     10,
+	}
+}
+
+func (f *RollupFilter) Init(config interface{}) error {
+	conf := config.(*RollupFilterConfig)
+	if conf.Interval == 0 {
+		return errors.New("RollupFilter interval must be positive")
+	}
+	if !conf.EmitInPayload && !conf.EmitInFields {
+		return errors.New(
+			"RollupFilter needs one of emit_in_payload or emit_in_fields set")
+	}
+	if !validRollupAggregation(conf.DefaultAggregation) {
+		return fmt.Errorf("RollupFilter unknown default_aggregation '%s'",
+			conf.DefaultAggregation)
+	}
+	f.rules = make([]*regexp.Regexp, len(conf.Rules))
+	f.aggregations = make([]string, len(conf.Rules))
+	for i, rule := range conf.Rules {
+		if !validRollupAggregation(rule.Aggregation) {
+			return fmt.Errorf("RollupFilter rule %d has unknown aggregation '%s'",
+				i+1, rule.Aggregation)
+		}
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return fmt.Errorf("RollupFilter rule %d invalid pattern: %s", i+1, err)
+		}
+		f.rules[i] = re
+		f.aggregations[i] = rule.Aggregation
+	}
+	f.conf = conf
+	f.interval = int64(conf.Interval)
+	f.names = make(map[string]string)
+	f.windows = make(map[int64]map[string]*rollupValue)
+	if f.now == nil {
+		f.now = time.Now
+	}
+	return nil
+}
+
+func (f *RollupFilter) Run(fr FilterRunner, h PluginHelper) (err error) {
+	inChan := fr.InChan()
+	ticker := fr.Ticker()
+	for {
+		select {
+		case pack, ok := <-inChan:
+			if !ok {
+				// Nothing else is coming, emit the partial intervals too.
+				f.flush(fr, h, 1<<62)
+				return nil
+			}
+			f.update(pack.Message)
+			fr.UpdateCursor(pack.QueueCursor)
+			pack.Recycle(nil)
+		case <-ticker:
+			f.flush(fr, h, f.now().Unix()-int64(f.conf.Grace))
+		}
+	}
+}
+
+// Adds the message's metrics to the intervals their timestamps fall in.
+func (f *RollupFilter) update(msg *message.Message) {
+	if payload := msg.GetPayload(); payload != "" {
+		for _, line := range strings.Split(strings.Trim(payload, "\n"), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) != 3 {
+				atomic.AddInt64(&f.malformed, 1)
+				continue
+			}
+			value, err := strconv.ParseFloat(fields[1], 64)
+			if err != nil {
+				atomic.AddInt64(&f.malformed, 1)
+				continue
+			}
+			ts, err := strconv.ParseInt(fields[2], 10, 64)
+			if err != nil {
+				atomic.AddInt64(&f.malformed, 1)
+				continue
+			}
+			f.add(fields[0], value, ts)
+		}
+		return
+	}
+	// Metrics in fields, as w/ a StatAccumInput's `emit_in_fields`.
+	ts := msg.GetTimestamp() / int64(time.Second)
+	if v, ok := msg.GetFieldValue("timestamp"); ok {
+		if t, ok := v.(int64); ok {
+			ts = t
+		}
+	}
+	for _, field := range msg.Fields {
+		name := field.GetName()
+		if name == "timestamp" {
+			continue
+		}
+		switch field.GetValueType() {
+		case message.Field_INTEGER:
+			if len(field.ValueInteger) > 0 {
+				f.add(name, float64(field.ValueInteger[0]), ts)
+			}
+		case message.Field_DOUBLE:
+			if len(field.ValueDouble) > 0 {
+				f.add(name, field.ValueDouble[0], ts)
+			}
+		}
+	}
+}
+
+func (f *RollupFilter) add(name string, value float64, ts int64) {
+	start := ts - ts%f.interval
+	if start < f.watermark {
+		// Its interval has already been emitted.
+		atomic.AddInt64(&f.late, 1)
+		return
+	}
+	window, ok := f.windows[start]
+	if !ok {
+		window = make(map[string]*rollupValue)
+		f.windows[start] = window
+	}
+	rv, ok := window[name]
+	if !ok {
+		if len(window) >= f.conf.MaxMetrics {
+			atomic.AddInt64(&f.dropped, 1)
+			return
+		}
+		rv = &rollupValue{aggregation: f.aggregation(name)}
+		window[name] = rv
+	}
+	rv.add(value)
+}
+
+// Returns the aggregation of the first rule matching the name.
+func (f *RollupFilter) aggregation(name string) string {
+	if aggregation, ok := f.names[name]; ok {
+		return aggregation
+	}
+	aggregation := f.conf.DefaultAggregation
+	for i, re := range f.rules {
+		if re.MatchString(name) {
+			aggregation = f.aggregations[i]
+			break
+		}
+	}
+	if len(f.names) >= f.conf.MaxMetrics {
+		f.names = make(map[string]string)
+	}
+	f.names[name] = aggregation
+	return aggregation
+}
+
+// Returns the starts of the intervals that ended by `until`, in order,
+// removing them from the pending ones.
+func (f *RollupFilter) ended(until int64) []int64 {
+	var starts []int64
+	for start := range f.windows {
+		if start+f.interval <= until {
+			starts = append(starts, start)
+		}
+	}
+	sort.Sort(int64Slice(starts))
+	if len(starts) > 0 && starts[len(starts)-1]+f.interval > f.watermark {
+		f.watermark = starts[len(starts)-1] + f.interval
+	}
+	return starts
+}
+
+// Emits a message for each interval that ended by `until`.
+func (f *RollupFilter) flush(fr FilterRunner, h PluginHelper, until int64) {
+	for _, start := range f.ended(until) {
+		window := f.windows[start]
+		delete(f.windows, start)
+		pack, err := h.PipelinePack(0)
+		if err != nil {
+			fr.LogError(err)
+			continue
+		}
+		if err = f.fill(pack.Message, start, window); err != nil {
+			fr.LogError(err)
+			pack.Recycle(nil)
+			continue
+		}
+		pack.Message.SetLogger(fr.Name())
+		fr.Inject(pack)
+	}
+}
+
+// Populates the message w/ the interval's rolled up metrics, sorted by name.
+func (f *RollupFilter) fill(msg *message.Message, start int64,
+	window map[string]*rollupValue) error {
+
+	msg.SetType(f.conf.MessageType)
+	msg.SetTimestamp(start * int64(time.Second))
+	names := make([]string, 0, len(window))
+	for name := range window {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if f.conf.EmitInFields {
+		message.NewInt64Field(msg, "timestamp", start, "")
+	}
+	buffer := new(bytes.Buffer)
+	for _, name := range names {
+		value := window[name].value()
+		if f.conf.EmitInPayload {
+			fmt.Fprintf(buffer, "%s %s %d\n", name,
+				strconv.FormatFloat(value, 'f', -1, 64), start)
+		}
+		if f.conf.EmitInFields {
+			field, err := message.NewField(name, value, "")
+			if err != nil {
+				return fmt.Errorf("can't add field '%s': %s", name, err)
+			}
+			msg.AddField(field)
+		}
+	}
+	msg.SetPayload(buffer.String())
+	return nil
+}
+
+func (f *RollupFilter) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "MalformedCount", atomic.LoadInt64(&f.malformed),
+		"count")
+	message.NewInt64Field(msg, "LateCount", atomic.LoadInt64(&f.late), "count")
+	message.NewInt64Field(msg, "DroppedCount", atomic.LoadInt64(&f.dropped), "count")
+	return nil
+}
+
+type int64Slice []int64
+
+func (s int64Slice) Len() int           { return len(s) }
+func (s int64Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s int64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func init() {
+	RegisterPlugin("RollupFilter", func() interface{} {
+		return new(RollupFilter)
+	})
+}
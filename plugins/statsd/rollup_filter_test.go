@@ -0,0 +1,117 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package statsd
+
+import (
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func RollupFilterSpec(c gs.Context) {
+	c.Specify("A RollupFilter", func() {
+		filter := new(RollupFilter)
+		config := filter.ConfigStruct().(*RollupFilterConfig)
+		config.Rules = []RollupRule{
+			{Pattern: `\.count$`, Aggregation: "sum"},
+			{Pattern: `\.upper$`, Aggregation: "max"},
+		}
+
+		c.Specify("rejects an unknown aggregation", func() {
+			config.Rules[1].Aggregation = "median"
+			c.Expect(filter.Init(config), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("rejects an invalid pattern", func() {
+			config.Rules[0].Pattern = `(\.count`
+			c.Expect(filter.Init(config), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("is initialized", func() {
+			err := filter.Init(config)
+			c.Assume(err, gs.IsNil)
+			filter.update(statMessage("" +
+				"stats.counters.hits.count 4 1000000810\n" +
+				"stats.timers.db.upper 12.5 1000000810\n" +
+				"stats.gauges.queue 3 1000000810\n"))
+			filter.update(statMessage("" +
+				"stats.counters.hits.count 6 1000000830\n" +
+				"stats.timers.db.upper 40 1000000830\n" +
+				"stats.gauges.queue 6 1000000830\n" +
+				"stats.counters.hits.count 1 1000000860\n"))
+
+			c.Specify("buckets the metrics by interval", func() {
+				c.Expect(len(filter.windows), gs.Equals, 2)
+				c.Expect(len(filter.windows[1000000800]), gs.Equals, 3)
+				c.Expect(len(filter.windows[1000000860]), gs.Equals, 1)
+			})
+
+			c.Specify("reads metrics from the fields", func() {
+				msg := new(message.Message)
+				message.NewInt64Field(msg, "timestamp", 1000000840, "")
+				msg.SetDouble("stats.gauges.queue", 9)
+				filter.update(msg)
+				c.Expect(filter.windows[1000000800]["stats.gauges.queue"].count,
+					gs.Equals, 3)
+			})
+
+			c.Specify("counts malformed lines", func() {
+				filter.update(statMessage("stats.gauges.queue x 1\n"))
+				c.Expect(filter.malformed, gs.Equals, int64(1))
+			})
+
+			c.Specify("emits the ended intervals", func() {
+				starts := filter.ended(1000000870)
+				c.Expect(starts, gs.ContainsInOrder, []int64{1000000800})
+				msg := new(message.Message)
+				err := filter.fill(msg, 1000000800, filter.windows[1000000800])
+				c.Expect(err, gs.IsNil)
+				c.Expect(msg.GetType(), gs.Equals, "heka.statmetric.rollup")
+				c.Expect(msg.GetTimestamp(), gs.Equals, int64(1000000800*time.Second))
+				c.Expect(msg.GetPayload(), gs.Equals, ""+
+					"stats.counters.hits.count 10 1000000800\n"+
+					"stats.gauges.queue 4.5 1000000800\n"+
+					"stats.timers.db.upper 40 1000000800\n")
+
+				c.Specify("and drops metrics arriving late for them", func() {
+					filter.update(statMessage(
+						"stats.counters.hits.count 1 1000000850\n"))
+					c.Expect(filter.late, gs.Equals, int64(1))
+				})
+			})
+
+			c.Specify("emits fields like a StatAccumInput", func() {
+				config.EmitInFields = true
+				config.EmitInPayload = false
+				msg := new(message.Message)
+				err := filter.fill(msg, 1000000860, filter.windows[1000000860])
+				c.Expect(err, gs.IsNil)
+				c.Expect(msg.GetPayload(), gs.Equals, "")
+				value, _ := msg.GetFieldValue("timestamp")
+				c.Expect(value, gs.Equals, int64(1000000860))
+				value, _ = msg.GetFieldValue("stats.counters.hits.count")
+				c.Expect(value, gs.Equals, 1.0)
+			})
+		})
+	})
+}
+
+// Returns a message holding the graphite lines in its payload.
+func statMessage(lines string) *message.Message {
+	msg := new(message.Message)
+	msg.SetPayload(lines)
+	return msg
+}
@@ -70,10 +70,11 @@ func (s *StatsdInput) Init(config interface{}) error {
 	if err != nil {
 		return fmt.Errorf("ResolveUDPAddr failed: %s\n", err.Error())
 	}
-	s.listener, err = net.ListenUDP("udp", udpAddr)
+	conn, err := HandoverListenPacket("udp", udpAddr.String())
 	if err != nil {
 		return fmt.Errorf("ListenUDP failed: %s\n", err.Error())
 	}
+	s.listener = conn.(net.Conn)
 	s.statAccumName = conf.StatAccumName
 	s.maxMsgSize = conf.MaxMsgSize
 	s.stopChan = make(chan bool)
@@ -0,0 +1,42 @@
+// +build !windows
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package system
+
+import (
+	"syscall"
+)
+
+// Space and inode usage of a mounted filesystem.
+type diskUsage struct {
+	total, free, avail uint64 // In bytes.
+	inodes, freeInodes uint64
+}
+
+func readDiskUsage(path string) (*diskUsage, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return nil, err
+	}
+	bsize := uint64(st.Bsize)
+	return &diskUsage{
+		total:      uint64(st.Blocks) * bsize,
+		free:       uint64(st.Bfree) * bsize,
+		avail:      uint64(st.Bavail) * bsize,
+		inodes:     uint64(st.Files),
+		freeInodes: uint64(st.Ffree),
+	}, nil
+}
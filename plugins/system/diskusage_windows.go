@@ -0,0 +1,28 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package system
+
+import (
+	"errors"
+)
+
+type diskUsage struct {
+	total, free, avail uint64
+	inodes, freeInodes uint64
+}
+
+func readDiskUsage(path string) (*diskUsage, error) {
+	return nil, errors.New("disk usage isn't supported on windows")
+}
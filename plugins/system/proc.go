@@ -0,0 +1,319 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package system
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Clock ticks per second used by the kernel for the times in /proc. This is
+// USER_HZ, which is 100 on all the architectures Heka supports.
+const clockTicks = 100
+
+var errProcStat = errors.New("unexpected stat format")
+
+// A single sample of a process's stats, as read from /proc/<pid>.
+type procSample struct {
+	pid       int
+	name      string
+	cmdline   string
+	startTime uint64 // In clock ticks since boot, tells reused pids apart.
+	cpuTicks  uint64 // User + system time.
+	threads   int64
+	vms       int64
+	rss       int64
+	fds       int64 // -1 if the fd directory can't be read.
+}
+
+// Lists the pids of all the processes in the proc filesystem.
+func listPids(procPath string) ([]int, error) {
+	dir, err := os.Open(procPath)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	pids := make([]int, 0, len(names))
+	for _, name := range names {
+		if pid, err := strconv.Atoi(name); err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
+
+// Reads the name and stats of a process from its stat file, see proc(5).
+func readProcStat(procPath string, pid int) (*procSample, error) {
+	data, err := ioutil.ReadFile(filepath.Join(procPath, strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return nil, err
+	}
+	// The name is in parentheses and may contain anything, including spaces
+	// and parentheses.
+	start := bytes.IndexByte(data, '(')
+	end := bytes.LastIndex(data, []byte(")"))
+	if start < 0 || end < start {
+		return nil, errProcStat
+	}
+	// Fields from the process state (field 3) onwards.
+	fields := strings.Fields(string(data[end+1:]))
+	if len(fields) < 22 {
+		return nil, errProcStat
+	}
+	s := &procSample{pid: pid, name: string(data[start+1 : end])}
+	field := func(n int) string { return fields[n-3] }
+	utime, err1 := strconv.ParseUint(field(14), 10, 64)
+	stime, err2 := strconv.ParseUint(field(15), 10, 64)
+	threads, err3 := strconv.ParseInt(field(20), 10, 64)
+	startTime, err4 := strconv.ParseUint(field(22), 10, 64)
+	vms, err5 := strconv.ParseInt(field(23), 10, 64)
+	rss, err6 := strconv.ParseInt(field(24), 10, 64)
+	for _, err := range []error{err1, err2, err3, err4, err5, err6} {
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", errProcStat, err)
+		}
+	}
+	s.cpuTicks = utime + stime
+	s.threads = threads
+	s.startTime = startTime
+	s.vms = vms
+	s.rss = rss * int64(os.Getpagesize())
+	return s, nil
+}
+
+// Returns the process's command line w/ its arguments separated by spaces,
+// empty for kernel threads.
+func readCmdline(procPath string, pid int) string {
+	data, err := ioutil.ReadFile(filepath.Join(procPath, strconv.Itoa(pid), "cmdline"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(bytes.Replace(data, []byte{0}, []byte{' '}, -1)))
+}
+
+// Returns the number of open file descriptors, or -1 if they can't be listed
+// (usually because the process belongs to another user).
+func countFds(procPath string, pid int) int64 {
+	dir, err := os.Open(filepath.Join(procPath, strconv.Itoa(pid), "fd"))
+	if err != nil {
+		return -1
+	}
+	defer dir.Close()
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return -1
+	}
+	return int64(len(names))
+}
+
+// Load averages and process counts from /proc/loadavg.
+type loadAvg struct {
+	load1, load5, load15 float64
+	running, total       int64
+}
+
+func readLoadAvg(procPath string) (*loadAvg, error) {
+	data, err := ioutil.ReadFile(filepath.Join(procPath, "loadavg"))
+	if err != nil {
+		return nil, err
+	}
+	// E.g. "0.20 0.18 0.12 1/80 11206".
+	fields := strings.Fields(string(data))
+	if len(fields) < 4 {
+		return nil, errors.New("unexpected loadavg format")
+	}
+	l := new(loadAvg)
+	var errs [5]error
+	l.load1, errs[0] = strconv.ParseFloat(fields[0], 64)
+	l.load5, errs[1] = strconv.ParseFloat(fields[1], 64)
+	l.load15, errs[2] = strconv.ParseFloat(fields[2], 64)
+	procs := strings.SplitN(fields[3], "/", 2)
+	if len(procs) != 2 {
+		return nil, errors.New("unexpected loadavg format")
+	}
+	l.running, errs[3] = strconv.ParseInt(procs[0], 10, 64)
+	l.total, errs[4] = strconv.ParseInt(procs[1], 10, 64)
+	for _, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("unexpected loadavg format: %s", err)
+		}
+	}
+	return l, nil
+}
+
+// Names of the cpu states in /proc/stat, in order. Guest time is already
+// included in user time, so it isn't reported separately.
+var cpuStates = []string{"User", "Nice", "System", "Idle", "Iowait", "Irq",
+	"Softirq", "Steal"}
+
+// Reads the time spent in each state by all the cpus combined ("cpu") and by
+// each core ("cpu0", "cpu1", ...), in clock ticks. Older kernels don't report
+// all the states, the missing ones are left at zero.
+func readCpuTimes(procPath string) (map[string][]uint64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(procPath, "stat"))
+	if err != nil {
+		return nil, err
+	}
+	times := make(map[string][]uint64)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 || !strings.HasPrefix(fields[0], "cpu") {
+			continue
+		}
+		ticks := make([]uint64, len(cpuStates))
+		for i := range ticks {
+			if i+1 >= len(fields) {
+				break
+			}
+			if ticks[i], err = strconv.ParseUint(fields[i+1], 10, 64); err != nil {
+				return nil, fmt.Errorf("unexpected stat format: %s", err)
+			}
+		}
+		times[fields[0]] = ticks
+	}
+	if len(times) == 0 {
+		return nil, errors.New("no cpu times found in stat")
+	}
+	return times, nil
+}
+
+// Reads /proc/meminfo, w/ all the values in bytes.
+func readMeminfo(procPath string) (map[string]int64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(procPath, "meminfo"))
+	if err != nil {
+		return nil, err
+	}
+	info := make(map[string]int64)
+	for _, line := range strings.Split(string(data), "\n") {
+		// E.g. "MemTotal:        2048468 kB".
+		colon := strings.IndexByte(line, ':')
+		if colon < 0 {
+			continue
+		}
+		fields := strings.Fields(line[colon+1:])
+		if len(fields) == 0 {
+			continue
+		}
+		value, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		if len(fields) > 1 && fields[1] == "kB" {
+			value *= 1024
+		}
+		info[line[:colon]] = value
+	}
+	return info, nil
+}
+
+// IO counters of a block device, from /proc/diskstats.
+type diskStats struct {
+	device                 string
+	reads, writes          uint64
+	readBytes, writeBytes  uint64
+	ioTime, weightedIoTime uint64 // In milliseconds.
+}
+
+// The kernel always counts disk sectors in units of 512 bytes, whatever the
+// device's actual sector size.
+const sectorSize = 512
+
+func readDiskStats(procPath string) ([]diskStats, error) {
+	data, err := ioutil.ReadFile(filepath.Join(procPath, "diskstats"))
+	if err != nil {
+		return nil, err
+	}
+	var stats []diskStats
+	for _, line := range strings.Split(string(data), "\n") {
+		// Major, minor, name, then the counters, see the kernel's
+		// Documentation/iostats.txt.
+		fields := strings.Fields(line)
+		if len(fields) < 14 {
+			continue
+		}
+		var counters [11]uint64
+		for i := range counters {
+			if counters[i], err = strconv.ParseUint(fields[i+3], 10, 64); err != nil {
+				return nil, fmt.Errorf("unexpected diskstats format: %s", err)
+			}
+		}
+		stats = append(stats, diskStats{
+			device:         fields[2],
+			reads:          counters[0],
+			readBytes:      counters[2] * sectorSize,
+			writes:         counters[4],
+			writeBytes:     counters[6] * sectorSize,
+			ioTime:         counters[9],
+			weightedIoTime: counters[10],
+		})
+	}
+	return stats, nil
+}
+
+// Traffic counters of a network interface, from /proc/net/dev.
+type netStats struct {
+	iface                                 string
+	rxBytes, rxPackets, rxErrors, rxDrops uint64
+	txBytes, txPackets, txErrors, txDrops uint64
+}
+
+func readNetDev(procPath string) ([]netStats, error) {
+	data, err := ioutil.ReadFile(filepath.Join(procPath, "net", "dev"))
+	if err != nil {
+		return nil, err
+	}
+	var stats []netStats
+	for _, line := range strings.Split(string(data), "\n") {
+		// E.g. "  eth0: 1234 12 0 0 0 0 0 0 5678 34 0 0 0 0 0 0", skipping
+		// the two header lines. Older kernels don't put a space after the
+		// colon.
+		colon := strings.IndexByte(line, ':')
+		if colon < 0 {
+			continue
+		}
+		fields := strings.Fields(line[colon+1:])
+		if len(fields) < 16 {
+			continue
+		}
+		var counters [16]uint64
+		for i := range counters {
+			if counters[i], err = strconv.ParseUint(fields[i], 10, 64); err != nil {
+				return nil, fmt.Errorf("unexpected net/dev format: %s", err)
+			}
+		}
+		stats = append(stats, netStats{
+			iface:     strings.TrimSpace(line[:colon]),
+			rxBytes:   counters[0],
+			rxPackets: counters[1],
+			rxErrors:  counters[2],
+			rxDrops:   counters[3],
+			txBytes:   counters[8],
+			txPackets: counters[9],
+			txErrors:  counters[10],
+			txDrops:   counters[11],
+		})
+	}
+	return stats, nil
+}
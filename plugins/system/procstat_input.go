@@ -0,0 +1,205 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package system
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"github.com/pborman/uuid"
+)
+
+type ProcstatInputConfig struct {
+	// Seconds between polls. Defaults to 10.
+	TickerInterval uint `toml:"ticker_interval"`
+	// Process groups to report on, mapping each group's name to a regular
+	// expression matched against the process name (or the command line if
+	// MatchCmdline is set).
+	Processes map[string]string
+	// Match the patterns against the full command line instead of the
+	// process name. Defaults to false.
+	MatchCmdline bool `toml:"match_cmdline"`
+	// Where the proc filesystem is mounted. Defaults to "/proc".
+	ProcPath string `toml:"proc_path"`
+}
+
+type procGroup struct {
+	name    string
+	pattern *regexp.Regexp
+}
+
+// Input plugin that periodically polls the proc filesystem for the cpu,
+// memory, file descriptor and thread usage of selected processes.
+type ProcstatInput struct {
+	conf     *ProcstatInputConfig
+	groups   []procGroup
+	stop     chan struct{}
+	runner   pipeline.InputRunner
+	hostname string
+	// Previous sample of each process, for computing its cpu usage.
+	samples  map[int]*procSample
+	lastPoll time.Time
+}
+
+func (input *ProcstatInput) ConfigStruct() interface{} {
+	return &ProcstatInputConfig{
+		TickerInterval: 10,
+		ProcPath:       "/proc",
+	}
+}
+
+func (input *ProcstatInput) Init(config interface{}) error {
+	input.conf = config.(*ProcstatInputConfig)
+	if len(input.conf.Processes) == 0 {
+		return errors.New("no `processes` configured")
+	}
+	if _, err := os.Stat(input.conf.ProcPath); err != nil {
+		return fmt.Errorf("can't use `proc_path`: %s", err)
+	}
+	input.groups = input.groups[:0]
+	for name, expr := range input.conf.Processes {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return fmt.Errorf("invalid pattern for '%s': %s", name, err)
+		}
+		input.groups = append(input.groups, procGroup{name, re})
+	}
+	// Report the groups in a predictable order.
+	sort.Sort(procGroups(input.groups))
+	input.samples = make(map[int]*procSample)
+	input.stop = make(chan struct{})
+	return nil
+}
+
+type procGroups []procGroup
+
+func (g procGroups) Len() int           { return len(g) }
+func (g procGroups) Less(i, j int) bool { return g[i].name < g[j].name }
+func (g procGroups) Swap(i, j int)      { g[i], g[j] = g[j], g[i] }
+
+func (input *ProcstatInput) Stop() {
+	close(input.stop)
+}
+
+func (input *ProcstatInput) Run(runner pipeline.InputRunner,
+	helper pipeline.PluginHelper) error {
+
+	input.runner = runner
+	input.hostname = helper.Hostname()
+	tickChan := runner.Ticker()
+	packSupply := runner.InChan()
+
+	for {
+		select {
+		case <-input.stop:
+			return nil
+		case <-tickChan:
+		}
+		if err := input.poll(packSupply); err != nil {
+			runner.LogError(err)
+		}
+	}
+}
+
+// Samples all the matching processes, delivering a message for each.
+func (input *ProcstatInput) poll(packSupply chan *pipeline.PipelinePack) error {
+	pids, err := listPids(input.conf.ProcPath)
+	if err != nil {
+		return fmt.Errorf("can't list processes: %s", err)
+	}
+	now := time.Now()
+	elapsed := now.Sub(input.lastPoll).Seconds()
+	input.lastPoll = now
+	sort.Ints(pids)
+	samples := make(map[int]*procSample, len(input.samples))
+
+	for _, pid := range pids {
+		group, s := input.match(pid)
+		if s == nil {
+			continue
+		}
+		s.fds = countFds(input.conf.ProcPath, pid)
+		samples[pid] = s
+
+		pack := <-packSupply
+		input.populate(pack.Message, group, s, elapsed)
+		input.runner.Deliver(pack)
+	}
+	// Processes that have exited are forgotten.
+	input.samples = samples
+	return nil
+}
+
+// Returns the name of the first group matching the process, and its stats.
+// Processes that exit while they're read are skipped.
+func (input *ProcstatInput) match(pid int) (string, *procSample) {
+	s, err := readProcStat(input.conf.ProcPath, pid)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			input.runner.LogError(fmt.Errorf("can't read process %d: %s", pid, err))
+		}
+		return "", nil
+	}
+	s.cmdline = readCmdline(input.conf.ProcPath, pid)
+	subject := s.name
+	if input.conf.MatchCmdline {
+		subject = s.cmdline
+	}
+	for _, g := range input.groups {
+		if g.pattern.MatchString(subject) {
+			return g.name, s
+		}
+	}
+	return "", nil
+}
+
+func (input *ProcstatInput) populate(msg *message.Message, group string,
+	s *procSample, elapsed float64) {
+
+	msg.SetUuid(uuid.NewRandom())
+	msg.SetTimestamp(input.lastPoll.UnixNano())
+	msg.SetType("heka.procstat")
+	msg.SetHostname(input.hostname)
+	msg.SetPayload(s.cmdline)
+
+	message.NewStringField(msg, "ProcessGroup", group)
+	message.NewStringField(msg, "ProcessName", s.name)
+	message.NewInt64Field(msg, "ProcessPid", int64(s.pid), "")
+	message.NewInt64Field(msg, "Threads", s.threads, "count")
+	message.NewInt64Field(msg, "RssBytes", s.rss, "B")
+	message.NewInt64Field(msg, "VmsBytes", s.vms, "B")
+	if s.fds >= 0 {
+		message.NewInt64Field(msg, "OpenFds", s.fds, "count")
+	}
+	// Cpu usage needs a previous sample of the same process.
+	prev, ok := input.samples[s.pid]
+	if ok && prev.startTime == s.startTime && elapsed > 0 && s.cpuTicks >= prev.cpuTicks {
+		pct := float64(s.cpuTicks-prev.cpuTicks) / clockTicks / elapsed * 100
+		field, _ := message.NewField("CpuPercent", pct, "%")
+		msg.AddField(field)
+	}
+}
+
+func init() {
+	pipeline.RegisterPlugin("ProcstatInput", func() interface{} {
+		return new(ProcstatInput)
+	})
+}
@@ -0,0 +1,150 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package system
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	. "github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	"github.com/mozilla-services/heka/pipelinemock"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+// Writes the files the ProcstatInput reads for a process to a fake proc
+// filesystem.
+func writeProc(c gs.Context, procPath string, pid int, name, cmdline string,
+	utime, fds int) {
+
+	dir := filepath.Join(procPath, strconv.Itoa(pid))
+	err := os.MkdirAll(filepath.Join(dir, "fd"), 0755)
+	c.Assume(err, gs.IsNil)
+	stat := fmt.Sprintf("%d (%s) S 1 %d %d 0 -1 4194560 100 0 0 0 %d 50 0 0 20 0 4 0 5000 104857600 256 18446744073709551615\n",
+		pid, name, pid, pid, utime)
+	err = ioutil.WriteFile(filepath.Join(dir, "stat"), []byte(stat), 0644)
+	c.Assume(err, gs.IsNil)
+	cmdline = string(append([]byte(cmdline), 0))
+	err = ioutil.WriteFile(filepath.Join(dir, "cmdline"), []byte(cmdline), 0644)
+	c.Assume(err, gs.IsNil)
+	for i := 0; i < fds; i++ {
+		err = ioutil.WriteFile(filepath.Join(dir, "fd", strconv.Itoa(i)), nil, 0644)
+		c.Assume(err, gs.IsNil)
+	}
+}
+
+func ProcstatInputSpec(c gs.Context) {
+	t := new(pipeline_ts.SimpleT)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	procPath, err := ioutil.TempDir("", "procstat-test")
+	c.Assume(err, gs.IsNil)
+	defer os.RemoveAll(procPath)
+
+	pConfig := NewPipelineConfig(nil)
+	packSupply := make(chan *PipelinePack, 2)
+
+	c.Specify("A ProcstatInput", func() {
+		input := new(ProcstatInput)
+		config := input.ConfigStruct().(*ProcstatInputConfig)
+		config.ProcPath = procPath
+		config.Processes = map[string]string{"web": "^nginx$"}
+
+		mockRunner := pipelinemock.NewMockInputRunner(ctrl)
+		input.runner = mockRunner
+		var delivered []*PipelinePack
+		mockRunner.EXPECT().Deliver(gomock.Any()).Do(func(pack *PipelinePack) {
+			delivered = append(delivered, pack)
+		}).AnyTimes()
+		supplyPack := func() {
+			pack := NewPipelinePack(pConfig.InputRecycleChan())
+			packSupply <- pack
+		}
+
+		writeProc(c, procPath, 100, "nginx", "nginx: master process", 150, 3)
+		writeProc(c, procPath, 200, "bash", "-bash", 10, 1)
+
+		c.Specify("reports the matching processes", func() {
+			err := input.Init(config)
+			c.Assume(err, gs.IsNil)
+			supplyPack()
+			err = input.poll(packSupply)
+			c.Expect(err, gs.IsNil)
+			c.Assume(len(delivered), gs.Equals, 1)
+
+			msg := delivered[0].Message
+			c.Expect(msg.GetType(), gs.Equals, "heka.procstat")
+			c.Expect(msg.GetPayload(), gs.Equals, "nginx: master process")
+			group, _ := msg.GetFieldValue("ProcessGroup")
+			c.Expect(group, gs.Equals, "web")
+			pid, _ := msg.GetFieldValue("ProcessPid")
+			c.Expect(pid, gs.Equals, int64(100))
+			threads, _ := msg.GetFieldValue("Threads")
+			c.Expect(threads, gs.Equals, int64(4))
+			rss, _ := msg.GetFieldValue("RssBytes")
+			c.Expect(rss, gs.Equals, int64(256*os.Getpagesize()))
+			fds, _ := msg.GetFieldValue("OpenFds")
+			c.Expect(fds, gs.Equals, int64(3))
+			_, ok := msg.GetFieldValue("CpuPercent")
+			c.Expect(ok, gs.IsFalse)
+
+			c.Specify("w/ cpu usage on the next poll", func() {
+				writeProc(c, procPath, 100, "nginx", "nginx: master process", 250, 3)
+				input.lastPoll = time.Now().Add(-10 * time.Second)
+				supplyPack()
+				err = input.poll(packSupply)
+				c.Expect(err, gs.IsNil)
+				c.Assume(len(delivered), gs.Equals, 2)
+				cpu, ok := delivered[1].Message.GetFieldValue("CpuPercent")
+				c.Expect(ok, gs.IsTrue)
+				// 100 ticks over 10 seconds.
+				c.Expect(cpu.(float64) > 9.9 && cpu.(float64) <= 10, gs.IsTrue)
+			})
+		})
+
+		c.Specify("matches command lines if configured to", func() {
+			config.Processes = map[string]string{"shells": "^-bash"}
+			config.MatchCmdline = true
+			err := input.Init(config)
+			c.Assume(err, gs.IsNil)
+			supplyPack()
+			err = input.poll(packSupply)
+			c.Expect(err, gs.IsNil)
+			c.Assume(len(delivered), gs.Equals, 1)
+			name, _ := delivered[0].Message.GetFieldValue("ProcessName")
+			c.Expect(name, gs.Equals, "bash")
+		})
+
+		c.Specify("handles names w/ spaces and parentheses", func() {
+			writeProc(c, procPath, 300, "tmux: (client)", "tmux", 10, 0)
+			s, err := readProcStat(procPath, 300)
+			c.Expect(err, gs.IsNil)
+			c.Expect(s.name, gs.Equals, "tmux: (client)")
+			c.Expect(s.cpuTicks, gs.Equals, uint64(60))
+		})
+
+		c.Specify("rejects invalid patterns", func() {
+			config.Processes = map[string]string{"bad": "(("}
+			err := input.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+}
@@ -0,0 +1,380 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package system
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"github.com/pborman/uuid"
+)
+
+type SystemMetricsInputConfig struct {
+	// Seconds between polls. Defaults to 10.
+	TickerInterval uint `toml:"ticker_interval"`
+	// Where the proc filesystem is mounted. Defaults to "/proc".
+	ProcPath string `toml:"proc_path"`
+	// Report the load averages. Defaults to true.
+	Load bool
+	// Report the cpu usage of all the cpus combined. Defaults to true.
+	Cpu bool
+	// Also report the cpu usage of each core. Defaults to true.
+	PerCpu bool `toml:"per_cpu"`
+	// Report the memory and swap usage. Defaults to true.
+	Memory bool
+	// Report the space and inode usage of the filesystems mounted at
+	// DiskPaths. Defaults to true.
+	DiskUsage bool     `toml:"disk_usage"`
+	DiskPaths []string `toml:"disk_paths"`
+	// Report the IO counters of the block devices, restricted to Devices if
+	// any are listed. Defaults to true.
+	DiskIO  bool `toml:"disk_io"`
+	Devices []string
+	// Report the traffic counters of the network interfaces, restricted to
+	// Interfaces if any are listed. Defaults to true.
+	Network    bool
+	Interfaces []string
+}
+
+type metricsCollector struct {
+	name    string
+	collect func(packSupply chan *pipeline.PipelinePack) error
+}
+
+// Input plugin that periodically emits host level metrics read from the proc
+// filesystem.
+type SystemMetricsInput struct {
+	conf       *SystemMetricsInputConfig
+	collectors []metricsCollector
+	devices    map[string]bool
+	interfaces map[string]bool
+	stop       chan struct{}
+	runner     pipeline.InputRunner
+	hostname   string
+	now        time.Time
+	// Previous cpu times, for computing the cpu usage.
+	cpuTimes map[string][]uint64
+}
+
+func (input *SystemMetricsInput) ConfigStruct() interface{} {
+	return &SystemMetricsInputConfig{
+		TickerInterval: 10,
+		ProcPath:       "/proc",
+		Load:           true,
+		Cpu:            true,
+		PerCpu:         true,
+		Memory:         true,
+		DiskUsage:      true,
+		DiskPaths:      []string{"/"},
+		DiskIO:         true,
+		Network:        true,
+	}
+}
+
+func (input *SystemMetricsInput) Init(config interface{}) error {
+	conf := config.(*SystemMetricsInputConfig)
+	input.conf = conf
+	if _, err := os.Stat(conf.ProcPath); err != nil {
+		return fmt.Errorf("can't use `proc_path`: %s", err)
+	}
+
+	input.collectors = input.collectors[:0]
+	if conf.Load {
+		input.collectors = append(input.collectors,
+			metricsCollector{"load", input.collectLoad})
+	}
+	if conf.Cpu || conf.PerCpu {
+		input.collectors = append(input.collectors,
+			metricsCollector{"cpu", input.collectCpu})
+	}
+	if conf.Memory {
+		input.collectors = append(input.collectors,
+			metricsCollector{"memory", input.collectMemory})
+	}
+	if conf.DiskUsage {
+		for _, path := range conf.DiskPaths {
+			if _, err := readDiskUsage(path); err != nil {
+				return fmt.Errorf("can't read the disk usage of '%s': %s", path, err)
+			}
+		}
+		input.collectors = append(input.collectors,
+			metricsCollector{"disk usage", input.collectDiskUsage})
+	}
+	if conf.DiskIO {
+		input.devices = nameSet(conf.Devices)
+		input.collectors = append(input.collectors,
+			metricsCollector{"disk IO", input.collectDiskIO})
+	}
+	if conf.Network {
+		input.interfaces = nameSet(conf.Interfaces)
+		input.collectors = append(input.collectors,
+			metricsCollector{"network", input.collectNetwork})
+	}
+	if len(input.collectors) == 0 {
+		return errors.New("all the metrics are disabled")
+	}
+
+	input.cpuTimes = nil
+	input.stop = make(chan struct{})
+	return nil
+}
+
+// Returns nil if there are no names, so everything is included.
+func nameSet(names []string) map[string]bool {
+	if len(names) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		set[name] = true
+	}
+	return set
+}
+
+func (input *SystemMetricsInput) Stop() {
+	close(input.stop)
+}
+
+func (input *SystemMetricsInput) Run(runner pipeline.InputRunner,
+	helper pipeline.PluginHelper) error {
+
+	input.runner = runner
+	input.hostname = helper.Hostname()
+	tickChan := runner.Ticker()
+	packSupply := runner.InChan()
+
+	for {
+		select {
+		case <-input.stop:
+			return nil
+		case <-tickChan:
+		}
+		input.poll(packSupply)
+	}
+}
+
+// Runs all the enabled collectors. One failing doesn't keep the others from
+// reporting.
+func (input *SystemMetricsInput) poll(packSupply chan *pipeline.PipelinePack) {
+	input.now = time.Now()
+	for _, c := range input.collectors {
+		if err := c.collect(packSupply); err != nil {
+			input.runner.LogError(fmt.Errorf("can't collect %s metrics: %s", c.name, err))
+		}
+	}
+}
+
+// Returns a pack w/ the common message headers set.
+func (input *SystemMetricsInput) newPack(packSupply chan *pipeline.PipelinePack,
+	kind string) *pipeline.PipelinePack {
+
+	pack := <-packSupply
+	pack.Message.SetUuid(uuid.NewRandom())
+	pack.Message.SetTimestamp(input.now.UnixNano())
+	pack.Message.SetType("heka.sysmetrics." + kind)
+	pack.Message.SetHostname(input.hostname)
+	return pack
+}
+
+func addFloatField(msg *message.Message, name string, value float64,
+	representation string) {
+
+	field, _ := message.NewField(name, value, representation)
+	msg.AddField(field)
+}
+
+func (input *SystemMetricsInput) collectLoad(packSupply chan *pipeline.PipelinePack) error {
+	l, err := readLoadAvg(input.conf.ProcPath)
+	if err != nil {
+		return err
+	}
+	pack := input.newPack(packSupply, "load")
+	addFloatField(pack.Message, "Load1", l.load1, "")
+	addFloatField(pack.Message, "Load5", l.load5, "")
+	addFloatField(pack.Message, "Load15", l.load15, "")
+	message.NewInt64Field(pack.Message, "RunningProcesses", l.running, "count")
+	message.NewInt64Field(pack.Message, "TotalProcesses", l.total, "count")
+	input.runner.Deliver(pack)
+	return nil
+}
+
+// Reports the percentage of time each cpu spent in each state since the
+// previous poll, so nothing is reported on the first one.
+func (input *SystemMetricsInput) collectCpu(packSupply chan *pipeline.PipelinePack) error {
+	times, err := readCpuTimes(input.conf.ProcPath)
+	if err != nil {
+		return err
+	}
+	prevTimes := input.cpuTimes
+	input.cpuTimes = times
+
+	names := make([]string, 0, len(times))
+	for name := range times {
+		if (name == "cpu" && input.conf.Cpu) || (name != "cpu" && input.conf.PerCpu) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		prev, ok := prevTimes[name]
+		if !ok {
+			continue
+		}
+		deltas := make([]float64, len(cpuStates))
+		var total float64
+		for i, ticks := range times[name] {
+			// Counters can go backwards when a core is taken offline.
+			if ticks >= prev[i] {
+				deltas[i] = float64(ticks - prev[i])
+				total += deltas[i]
+			}
+		}
+		if total == 0 {
+			continue
+		}
+		pack := input.newPack(packSupply, "cpu")
+		message.NewStringField(pack.Message, "Cpu", name)
+		for i, state := range cpuStates {
+			addFloatField(pack.Message, state+"Percent", deltas[i]/total*100, "%")
+		}
+		input.runner.Deliver(pack)
+	}
+	return nil
+}
+
+// The meminfo values that are reported, when the kernel provides them.
+var memFields = []string{"MemTotal", "MemFree", "MemAvailable", "Buffers",
+	"Cached", "SwapTotal", "SwapFree"}
+
+func (input *SystemMetricsInput) collectMemory(packSupply chan *pipeline.PipelinePack) error {
+	info, err := readMeminfo(input.conf.ProcPath)
+	if err != nil {
+		return err
+	}
+	total, ok := info["MemTotal"]
+	if !ok {
+		return errors.New("no MemTotal in meminfo")
+	}
+	pack := input.newPack(packSupply, "memory")
+	for _, name := range memFields {
+		if value, ok := info[name]; ok {
+			message.NewInt64Field(pack.Message, name, value, "B")
+		}
+	}
+	// MemAvailable is the kernel's estimate of the memory available w/o
+	// swapping, which accounts for caches that can't be reclaimed. It's only
+	// provided by kernels >= 3.14.
+	avail, ok := info["MemAvailable"]
+	if !ok {
+		avail = info["MemFree"] + info["Buffers"] + info["Cached"]
+	}
+	if total > 0 {
+		addFloatField(pack.Message, "MemUsedPercent",
+			float64(total-avail)/float64(total)*100, "%")
+	}
+	if swap := info["SwapTotal"]; swap > 0 {
+		addFloatField(pack.Message, "SwapUsedPercent",
+			float64(swap-info["SwapFree"])/float64(swap)*100, "%")
+	}
+	input.runner.Deliver(pack)
+	return nil
+}
+
+func (input *SystemMetricsInput) collectDiskUsage(packSupply chan *pipeline.PipelinePack) error {
+	var failed []string
+	for _, path := range input.conf.DiskPaths {
+		u, err := readDiskUsage(path)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", path, err))
+			continue
+		}
+		pack := input.newPack(packSupply, "disk")
+		message.NewStringField(pack.Message, "Path", path)
+		message.NewInt64Field(pack.Message, "TotalBytes", int64(u.total), "B")
+		message.NewInt64Field(pack.Message, "FreeBytes", int64(u.free), "B")
+		message.NewInt64Field(pack.Message, "AvailableBytes", int64(u.avail), "B")
+		message.NewInt64Field(pack.Message, "UsedBytes", int64(u.total-u.free), "B")
+		// The percentage df reports, of the space available to unprivileged
+		// users.
+		if used := u.total - u.free; used+u.avail > 0 {
+			addFloatField(pack.Message, "UsedPercent",
+				float64(used)/float64(used+u.avail)*100, "%")
+		}
+		message.NewInt64Field(pack.Message, "TotalInodes", int64(u.inodes), "count")
+		message.NewInt64Field(pack.Message, "FreeInodes", int64(u.freeInodes), "count")
+		input.runner.Deliver(pack)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%v", failed)
+	}
+	return nil
+}
+
+func (input *SystemMetricsInput) collectDiskIO(packSupply chan *pipeline.PipelinePack) error {
+	stats, err := readDiskStats(input.conf.ProcPath)
+	if err != nil {
+		return err
+	}
+	for _, s := range stats {
+		if input.devices != nil && !input.devices[s.device] {
+			continue
+		}
+		pack := input.newPack(packSupply, "diskio")
+		message.NewStringField(pack.Message, "Device", s.device)
+		message.NewInt64Field(pack.Message, "Reads", int64(s.reads), "count")
+		message.NewInt64Field(pack.Message, "ReadBytes", int64(s.readBytes), "B")
+		message.NewInt64Field(pack.Message, "Writes", int64(s.writes), "count")
+		message.NewInt64Field(pack.Message, "WriteBytes", int64(s.writeBytes), "B")
+		message.NewInt64Field(pack.Message, "IoTime", int64(s.ioTime), "ms")
+		message.NewInt64Field(pack.Message, "WeightedIoTime", int64(s.weightedIoTime), "ms")
+		input.runner.Deliver(pack)
+	}
+	return nil
+}
+
+func (input *SystemMetricsInput) collectNetwork(packSupply chan *pipeline.PipelinePack) error {
+	stats, err := readNetDev(input.conf.ProcPath)
+	if err != nil {
+		return err
+	}
+	for _, s := range stats {
+		if input.interfaces != nil && !input.interfaces[s.iface] {
+			continue
+		}
+		pack := input.newPack(packSupply, "net")
+		message.NewStringField(pack.Message, "Interface", s.iface)
+		message.NewInt64Field(pack.Message, "RxBytes", int64(s.rxBytes), "B")
+		message.NewInt64Field(pack.Message, "RxPackets", int64(s.rxPackets), "count")
+		message.NewInt64Field(pack.Message, "RxErrors", int64(s.rxErrors), "count")
+		message.NewInt64Field(pack.Message, "RxDropped", int64(s.rxDrops), "count")
+		message.NewInt64Field(pack.Message, "TxBytes", int64(s.txBytes), "B")
+		message.NewInt64Field(pack.Message, "TxPackets", int64(s.txPackets), "count")
+		message.NewInt64Field(pack.Message, "TxErrors", int64(s.txErrors), "count")
+		message.NewInt64Field(pack.Message, "TxDropped", int64(s.txDrops), "count")
+		input.runner.Deliver(pack)
+	}
+	return nil
+}
+
+func init() {
+	pipeline.RegisterPlugin("SystemMetricsInput", func() interface{} {
+		return new(SystemMetricsInput)
+	})
+}
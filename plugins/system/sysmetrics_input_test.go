@@ -0,0 +1,194 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package system
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	. "github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	"github.com/mozilla-services/heka/pipelinemock"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+const testMeminfo = `MemTotal:        2000000 kB
+MemFree:          500000 kB
+MemAvailable:    1000000 kB
+Buffers:          100000 kB
+Cached:           300000 kB
+SwapTotal:       1000000 kB
+SwapFree:         750000 kB
+HugePages_Total:       0
+`
+
+const testDiskstats = `   8       0 sda 1000 10 20000 500 2000 20 40000 800 0 1200 1300
+   8       1 sda1 900 10 18000 450 1900 20 38000 750 0 1100 1200
+`
+
+const testNetDev = `Inter-|   Receive                                                |  Transmit
+ face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed
+    lo:  5000      50    0    0    0     0          0         0     5000      50    0    0    0     0       0          0
+  eth0:123456    1000    1    2    0     0          0         0    65432     900    3    4    0     0       0          0
+`
+
+func SystemMetricsInputSpec(c gs.Context) {
+	t := new(pipeline_ts.SimpleT)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	procPath, err := ioutil.TempDir("", "sysmetrics-test")
+	c.Assume(err, gs.IsNil)
+	defer os.RemoveAll(procPath)
+
+	writeFile := func(name, content string) {
+		path := filepath.Join(procPath, name)
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		c.Assume(err, gs.IsNil)
+		err = ioutil.WriteFile(path, []byte(content), 0644)
+		c.Assume(err, gs.IsNil)
+	}
+
+	pConfig := NewPipelineConfig(nil)
+	packSupply := make(chan *PipelinePack, 10)
+
+	c.Specify("A SystemMetricsInput", func() {
+		input := new(SystemMetricsInput)
+		config := input.ConfigStruct().(*SystemMetricsInputConfig)
+		config.ProcPath = procPath
+		config.Load = false
+		config.Cpu = false
+		config.PerCpu = false
+		config.Memory = false
+		config.DiskUsage = false
+		config.DiskIO = false
+		config.Network = false
+
+		mockRunner := pipelinemock.NewMockInputRunner(ctrl)
+		input.runner = mockRunner
+		var delivered []*PipelinePack
+		mockRunner.EXPECT().Deliver(gomock.Any()).Do(func(pack *PipelinePack) {
+			delivered = append(delivered, pack)
+		}).AnyTimes()
+		poll := func() {
+			for len(packSupply) < cap(packSupply) {
+				packSupply <- NewPipelinePack(pConfig.InputRecycleChan())
+			}
+			input.poll(packSupply)
+		}
+		field := func(pack *PipelinePack, name string) interface{} {
+			value, _ := pack.Message.GetFieldValue(name)
+			return value
+		}
+
+		c.Specify("requires some metrics", func() {
+			err := input.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("reports the load averages", func() {
+			writeFile("loadavg", "0.20 0.18 0.12 1/80 11206\n")
+			config.Load = true
+			err := input.Init(config)
+			c.Assume(err, gs.IsNil)
+			poll()
+			c.Assume(len(delivered), gs.Equals, 1)
+			c.Expect(delivered[0].Message.GetType(), gs.Equals, "heka.sysmetrics.load")
+			c.Expect(field(delivered[0], "Load5"), gs.Equals, 0.18)
+			c.Expect(field(delivered[0], "RunningProcesses"), gs.Equals, int64(1))
+			c.Expect(field(delivered[0], "TotalProcesses"), gs.Equals, int64(80))
+		})
+
+		c.Specify("reports the cpu usage since the previous poll", func() {
+			writeFile("stat", "cpu  100 0 100 800 0 0 0 0 0 0\n"+
+				"cpu0 100 0 100 800 0 0 0 0 0 0\nintr 12345\n")
+			config.Cpu = true
+			err := input.Init(config)
+			c.Assume(err, gs.IsNil)
+			poll()
+			c.Expect(len(delivered), gs.Equals, 0)
+
+			writeFile("stat", "cpu  150 0 150 900 0 0 0 0 0 0\n"+
+				"cpu0 150 0 150 900 0 0 0 0 0 0\nintr 12345\n")
+			poll()
+			// Just the combined usage w/o `per_cpu`.
+			c.Assume(len(delivered), gs.Equals, 1)
+			c.Expect(field(delivered[0], "Cpu"), gs.Equals, "cpu")
+			c.Expect(field(delivered[0], "UserPercent"), gs.Equals, 25.0)
+			c.Expect(field(delivered[0], "IdlePercent"), gs.Equals, 50.0)
+		})
+
+		c.Specify("reports the memory usage", func() {
+			writeFile("meminfo", testMeminfo)
+			config.Memory = true
+			err := input.Init(config)
+			c.Assume(err, gs.IsNil)
+			poll()
+			c.Assume(len(delivered), gs.Equals, 1)
+			c.Expect(field(delivered[0], "MemTotal"), gs.Equals, int64(2000000*1024))
+			c.Expect(field(delivered[0], "MemUsedPercent"), gs.Equals, 50.0)
+			c.Expect(field(delivered[0], "SwapUsedPercent"), gs.Equals, 25.0)
+		})
+
+		c.Specify("reports the disk IO of the configured devices", func() {
+			writeFile("diskstats", testDiskstats)
+			config.DiskIO = true
+			config.Devices = []string{"sda"}
+			err := input.Init(config)
+			c.Assume(err, gs.IsNil)
+			poll()
+			c.Assume(len(delivered), gs.Equals, 1)
+			c.Expect(field(delivered[0], "Device"), gs.Equals, "sda")
+			c.Expect(field(delivered[0], "ReadBytes"), gs.Equals, int64(20000*512))
+			c.Expect(field(delivered[0], "Writes"), gs.Equals, int64(2000))
+			c.Expect(field(delivered[0], "IoTime"), gs.Equals, int64(1200))
+		})
+
+		c.Specify("reports the network traffic", func() {
+			writeFile("net/dev", testNetDev)
+			config.Network = true
+			err := input.Init(config)
+			c.Assume(err, gs.IsNil)
+			poll()
+			c.Assume(len(delivered), gs.Equals, 2)
+			c.Expect(field(delivered[1], "Interface"), gs.Equals, "eth0")
+			c.Expect(field(delivered[1], "RxBytes"), gs.Equals, int64(123456))
+			c.Expect(field(delivered[1], "TxDropped"), gs.Equals, int64(4))
+		})
+
+		if runtime.GOOS != "windows" {
+			c.Specify("reports the disk usage", func() {
+				config.DiskUsage = true
+				config.DiskPaths = []string{procPath}
+				err := input.Init(config)
+				c.Assume(err, gs.IsNil)
+				poll()
+				c.Assume(len(delivered), gs.Equals, 1)
+				c.Expect(field(delivered[0], "Path"), gs.Equals, procPath)
+				c.Expect(field(delivered[0], "TotalBytes").(int64) > 0, gs.IsTrue)
+			})
+
+			c.Specify("fails Init w/ a missing disk path", func() {
+				config.DiskUsage = true
+				config.DiskPaths = []string{filepath.Join(procPath, "missing")}
+				err := input.Init(config)
+				c.Expect(err, gs.Not(gs.IsNil))
+			})
+		}
+	})
+}
@@ -0,0 +1,221 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package tcp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Replaced by the tests.
+var lookupSRV = net.LookupSRV
+
+// Config for resolving an output's destination from a Consul service
+// catalogue or DNS SRV records, used instead of a fixed address.
+type DiscoveryConfig struct {
+	// Either "consul" or "srv".
+	Type string
+	// Name of the Consul service, or the full name of the SRV record, e.g.
+	// "_heka._tcp.example.com".
+	Service string
+	// Only use the Consul service instances w/ this tag.
+	Tag string
+	// Consul datacenter to query, defaults to the agent's own.
+	Datacenter string
+	// Base URL of the Consul HTTP API. Defaults to "http://localhost:8500".
+	ConsulUrl string `toml:"consul_url"`
+	// Seconds after which the addresses are resolved again. Defaults to 30.
+	RefreshInterval uint `toml:"refresh_interval"`
+}
+
+// Resolves and caches a service's "host:port" addresses. Consul only returns
+// the instances passing their health checks, SRV records are ordered by
+// priority and weight.
+type Resolver struct {
+	conf     DiscoveryConfig
+	client   *http.Client
+	interval time.Duration
+	lock     sync.Mutex
+	addrs    []string
+	resolved time.Time
+	failed   string
+}
+
+func NewResolver(conf *DiscoveryConfig) (*Resolver, error) {
+	r := &Resolver{conf: *conf}
+	if r.conf.Service == "" {
+		return nil, errors.New("discovery service must be set")
+	}
+	switch r.conf.Type {
+	case "consul":
+		if r.conf.ConsulUrl == "" {
+			r.conf.ConsulUrl = "http://localhost:8500"
+		}
+		r.client = &http.Client{Timeout: 10 * time.Second}
+	case "srv":
+	default:
+		return nil, fmt.Errorf("unknown discovery type '%s', must be 'consul' or 'srv'",
+			r.conf.Type)
+	}
+	if r.conf.RefreshInterval == 0 {
+		r.conf.RefreshInterval = 30
+	}
+	r.interval = time.Duration(r.conf.RefreshInterval) * time.Second
+	return r, nil
+}
+
+// Returns the service's addresses, resolving them again if they're older than
+// the refresh interval or one of them has failed. The previously resolved
+// addresses are kept if they can't be resolved again.
+func (r *Resolver) Addrs() ([]string, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.refresh()
+}
+
+func (r *Resolver) refresh() ([]string, error) {
+	if r.addrs != nil && time.Since(r.resolved) < r.interval {
+		return r.addrs, nil
+	}
+	var (
+		addrs []string
+		err   error
+	)
+	if r.conf.Type == "consul" {
+		addrs, err = r.lookupConsul()
+	} else {
+		addrs, err = r.lookupSRV()
+	}
+	if err == nil && len(addrs) == 0 {
+		err = fmt.Errorf("no healthy instances of service '%s'", r.conf.Service)
+	}
+	// Don't resolve again before the next interval either way.
+	r.resolved = time.Now()
+	if err != nil {
+		if r.addrs != nil {
+			return r.addrs, nil
+		}
+		return nil, fmt.Errorf("can't resolve '%s': %s", r.conf.Service, err)
+	}
+	r.addrs = addrs
+	return addrs, nil
+}
+
+// Returns the address to connect to, the first one that hasn't failed last.
+func (r *Resolver) Addr() (string, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	addrs, err := r.refresh()
+	if err != nil {
+		return "", err
+	}
+	for _, addr := range addrs {
+		if addr != r.failed {
+			return addr, nil
+		}
+	}
+	return addrs[0], nil
+}
+
+// Reports that the address couldn't be reached, so it's tried last and the
+// addresses are resolved again the next time they're needed.
+func (r *Resolver) Failed(addr string) {
+	r.lock.Lock()
+	r.failed = addr
+	r.resolved = time.Time{}
+	r.lock.Unlock()
+}
+
+// Returns whether the address is still among the service's addresses.
+func (r *Resolver) Healthy(addr string) bool {
+	addrs, err := r.Addrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Resolver) lookupConsul() ([]string, error) {
+	query := url.Values{}
+	query.Set("passing", "1")
+	if r.conf.Tag != "" {
+		query.Set("tag", r.conf.Tag)
+	}
+	if r.conf.Datacenter != "" {
+		query.Set("dc", r.conf.Datacenter)
+	}
+	resp, err := r.client.Get(fmt.Sprintf("%s/v1/health/service/%s?%s",
+		strings.TrimRight(r.conf.ConsulUrl, "/"), url.QueryEscape(r.conf.Service),
+		query.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Consul request failed: %s", resp.Status)
+	}
+	var entries []struct {
+		Node struct {
+			Address string
+		}
+		Service struct {
+			Address string
+			Port    int
+		}
+	}
+	if err = json.Unmarshal(body, &entries); err != nil {
+		return nil, fmt.Errorf("can't decode Consul response: %s", err)
+	}
+	addrs := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		host := entry.Service.Address
+		if host == "" {
+			host = entry.Node.Address
+		}
+		addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(entry.Service.Port)))
+	}
+	return addrs, nil
+}
+
+func (r *Resolver) lookupSRV() ([]string, error) {
+	_, records, err := lookupSRV("", "", r.conf.Service)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, 0, len(records))
+	for _, rec := range records {
+		addrs = append(addrs, net.JoinHostPort(strings.TrimSuffix(rec.Target, "."),
+			strconv.Itoa(int(rec.Port))))
+	}
+	return addrs, nil
+}
@@ -0,0 +1,146 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package tcp
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func DiscoverySpec(c gs.Context) {
+	c.Specify("A Consul resolver", func() {
+		var (
+			query  string
+			body   string
+			status = http.StatusOK
+		)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+			r *http.Request) {
+
+			query = r.URL.RequestURI()
+			w.WriteHeader(status)
+			w.Write([]byte(body))
+		}))
+		defer server.Close()
+		body = `[
+			{"Node": {"Address": "10.0.0.1"}, "Service": {"Address": "", "Port": 5565}},
+			{"Node": {"Address": "10.0.0.2"}, "Service": {"Address": "10.0.1.2", "Port": 5566}}
+		]`
+		r, err := NewResolver(&DiscoveryConfig{
+			Type:       "consul",
+			Service:    "aggregator",
+			Tag:        "prod",
+			Datacenter: "east",
+			ConsulUrl:  server.URL + "/",
+		})
+		c.Assume(err, gs.IsNil)
+
+		c.Specify("returns the healthy instances", func() {
+			addrs, err := r.Addrs()
+			c.Expect(err, gs.IsNil)
+			c.Expect(query, gs.Equals,
+				"/v1/health/service/aggregator?dc=east&passing=1&tag=prod")
+			c.Expect(len(addrs), gs.Equals, 2)
+			c.Expect(addrs[0], gs.Equals, "10.0.0.1:5565")
+			c.Expect(addrs[1], gs.Equals, "10.0.1.2:5566")
+			c.Expect(r.Healthy("10.0.1.2:5566"), gs.IsTrue)
+			c.Expect(r.Healthy("10.0.0.3:5565"), gs.IsFalse)
+		})
+
+		c.Specify("caches the addresses", func() {
+			_, err := r.Addrs()
+			c.Assume(err, gs.IsNil)
+			query = ""
+			_, err = r.Addrs()
+			c.Expect(err, gs.IsNil)
+			c.Expect(query, gs.Equals, "")
+		})
+
+		c.Specify("moves on from a failed address", func() {
+			addr, err := r.Addr()
+			c.Expect(err, gs.IsNil)
+			c.Expect(addr, gs.Equals, "10.0.0.1:5565")
+			r.Failed(addr)
+			query = ""
+			addr, err = r.Addr()
+			c.Expect(err, gs.IsNil)
+			c.Expect(addr, gs.Equals, "10.0.1.2:5566")
+			// Resolved again after the failure.
+			c.Expect(query, gs.Not(gs.Equals), "")
+		})
+
+		c.Specify("keeps the last addresses if Consul is unavailable", func() {
+			_, err := r.Addrs()
+			c.Assume(err, gs.IsNil)
+			status = http.StatusInternalServerError
+			r.Failed("10.0.0.1:5565")
+			addrs, err := r.Addrs()
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(addrs), gs.Equals, 2)
+		})
+
+		c.Specify("fails w/o any healthy instances", func() {
+			body = "[]"
+			_, err := r.Addr()
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+
+	c.Specify("An SRV resolver", func() {
+		origLookup := lookupSRV
+		defer func() {
+			lookupSRV = origLookup
+		}()
+		var name string
+		lookupSRV = func(service, proto, n string) (string, []*net.SRV, error) {
+			name = n
+			return n, []*net.SRV{
+				{Target: "agg1.example.com.", Port: 5565, Priority: 10},
+				{Target: "agg2.example.com.", Port: 5565, Priority: 20},
+			}, nil
+		}
+		r, err := NewResolver(&DiscoveryConfig{
+			Type:    "srv",
+			Service: "_heka._tcp.example.com",
+		})
+		c.Assume(err, gs.IsNil)
+
+		c.Specify("returns the records in order", func() {
+			addrs, err := r.Addrs()
+			c.Expect(err, gs.IsNil)
+			c.Expect(name, gs.Equals, "_heka._tcp.example.com")
+			c.Expect(len(addrs), gs.Equals, 2)
+			c.Expect(addrs[0], gs.Equals, "agg1.example.com:5565")
+			c.Expect(addrs[1], gs.Equals, "agg2.example.com:5565")
+		})
+
+		c.Specify("returns the lookup error", func() {
+			lookupSRV = func(service, proto, n string) (string, []*net.SRV, error) {
+				return "", nil, errors.New("no such host")
+			}
+			_, err := r.Addr()
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+
+	c.Specify("An unknown discovery type is rejected", func() {
+		_, err := NewResolver(&DiscoveryConfig{Type: "zookeeper", Service: "agg"})
+		c.Expect(err, gs.Not(gs.IsNil))
+	})
+}
@@ -16,13 +16,17 @@
 package tcp
 
 import (
+	"bufio"
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"sync"
 	"time"
 
+	"github.com/mozilla-services/heka/framing"
+	"github.com/mozilla-services/heka/message"
 	. "github.com/mozilla-services/heka/pipeline"
 )
 
@@ -30,11 +34,13 @@ import (
 // specified TCP socket. Creates a separate goroutine for each TCP connection.
 type TcpInput struct {
 	keepAliveDuration time.Duration
+	idleTimeout       time.Duration
 	listener          net.Listener
 	wg                sync.WaitGroup
 	stopChan          chan bool
 	ir                InputRunner
 	config            *TcpInputConfig
+	codecs            []framing.Codec
 }
 
 type TcpInputConfig struct {
@@ -53,17 +59,27 @@ type TcpInputConfig struct {
 	KeepAlive bool `toml:"keep_alive"`
 	// Integer indicating seconds between keep alives.
 	KeepAlivePeriod int `toml:"keep_alive_period"`
+	// Integer indicating seconds a connection may go without receiving any
+	// data before it is closed. Defaults to 0 (never).
+	IdleTimeout uint `toml:"idle_timeout"`
 	// So we can default to using ProtobufDecoder.
 	Decoder string
 	// So we can default to using HekaFramingSplitter.
 	Splitter string
+	// Set to false to refuse batch frames from TcpOutputs that ask to use
+	// them. Only applies when using the HekaFramingSplitter.
+	AcceptBatching bool `toml:"accept_batching"`
+	// Batch compression codecs that senders may use. Defaults to all the
+	// supported codecs.
+	Codecs []string
 }
 
 func (t *TcpInput) ConfigStruct() interface{} {
 	config := &TcpInputConfig{
-		Net:      "tcp",
-		Decoder:  "ProtobufDecoder",
-		Splitter: "HekaFramingSplitter",
+		Net:            "tcp",
+		Decoder:        "ProtobufDecoder",
+		Splitter:       "HekaFramingSplitter",
+		AcceptBatching: true,
 	}
 	config.Tls = TlsConfig{PreferServerCiphers: true}
 	return config
@@ -76,7 +92,8 @@ func (t *TcpInput) Init(config interface{}) error {
 	if err != nil {
 		return fmt.Errorf("ResolveTCPAddress failed: %s\n", err.Error())
 	}
-	t.listener, err = net.ListenTCP(t.config.Net, address)
+	// Takes over the socket from the hekad this one was upgraded from.
+	t.listener, err = HandoverListen(t.config.Net, address.String())
 	if err != nil {
 		return fmt.Errorf("ListenTCP failed: %s\n", err.Error())
 	}
@@ -95,6 +112,20 @@ func (t *TcpInput) Init(config interface{}) error {
 	if t.config.KeepAlivePeriod != 0 {
 		t.keepAliveDuration = time.Duration(t.config.KeepAlivePeriod) * time.Second
 	}
+	if t.config.IdleTimeout != 0 {
+		t.idleTimeout = time.Duration(t.config.IdleTimeout) * time.Second
+	}
+	if t.config.Codecs == nil {
+		t.codecs = framing.Codecs()
+	} else {
+		for _, name := range t.config.Codecs {
+			codec, err := framing.ParseCodec(name)
+			if err != nil {
+				return err
+			}
+			t.codecs = append(t.codecs, codec)
+		}
+	}
 	t.stopChan = make(chan bool)
 	closeIt = false
 	return nil
@@ -111,6 +142,21 @@ func (t *TcpInput) setupTls(tomlConf *TlsConfig) (err error) {
 	return
 }
 
+// Wraps a net.Conn to keep track of when data was last read from the
+// connection, so idle connections can be detected and closed.
+type idleTrackingConn struct {
+	net.Conn
+	lastRead time.Time
+}
+
+func (c *idleTrackingConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	if n > 0 {
+		c.lastRead = time.Now()
+	}
+	return
+}
+
 // Listen on the provided TCP connection, extracting messages from the incoming
 // data until the connection is closed or Stop is called on the input.
 func (t *TcpInput) handleConnection(conn net.Conn) {
@@ -139,18 +185,48 @@ func (t *TcpInput) handleConnection(conn net.Conn) {
 		sr.SetPackDecorator(packDec)
 	}
 
+	var idleConn *idleTrackingConn
+	readTimeout := 5 * time.Second
+	if t.idleTimeout != 0 {
+		idleConn = &idleTrackingConn{Conn: conn, lastRead: time.Now()}
+		conn = idleConn
+		if t.idleTimeout < readTimeout {
+			readTimeout = t.idleTimeout
+		}
+	}
+
+	var (
+		reader  io.Reader = conn
+		batched bool
+	)
 	stopped := false
+	if splitter, ok := sr.Splitter().(*HekaFramingSplitter); ok {
+		// The peer may open w/ a hello to negotiate the stream's encoding.
+		br := bufio.NewReader(conn)
+		reader = br
+		batched, stopped = t.negotiate(conn, br, splitter, idleConn, readTimeout)
+	}
+	if batched {
+		t.readBatched(conn, reader, sr, deliverer, idleConn, readTimeout)
+		return
+	}
+
 	for !stopped {
-		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		conn.SetReadDeadline(time.Now().Add(readTimeout))
 		select {
 		case <-t.stopChan:
 			stopped = true
 		default:
-			err = sr.SplitStream(conn, deliverer)
+			err = sr.SplitStream(reader, deliverer)
 			if err != nil {
 				if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
 					// keep the connection open, we are just checking to see if
 					// we are shutting down: Issue #354
+					if idleConn != nil && time.Since(idleConn.lastRead) >= t.idleTimeout {
+						t.ir.LogMessage(fmt.Sprintf("closing idle connection from %s",
+							raddr))
+						stopped = true
+					}
 				} else {
 					stopped = true
 				}
@@ -159,6 +235,110 @@ func (t *TcpInput) handleConnection(conn net.Conn) {
 	}
 }
 
+// Waits for the first frame on the connection and, if it's a hello, replies
+// w/ the framing version, codec and signing to use. Returns whether the peer
+// will be sending batch frames, and whether the connection should be closed.
+func (t *TcpInput) negotiate(conn net.Conn, br *bufio.Reader,
+	splitter *HekaFramingSplitter, idleConn *idleTrackingConn,
+	readTimeout time.Duration) (batched, stop bool) {
+
+	maxVersion := uint(1)
+	if t.config.AcceptBatching {
+		maxVersion = framing.MAX_VERSION
+	}
+	knownSigner := func(signer string) bool {
+		if splitter.HekaFramingSplitterConfig == nil || splitter.SkipAuth {
+			return false
+		}
+		_, ok := splitter.Signers[signer]
+		return ok
+	}
+
+	peekLen := message.HEADER_DELIMITER_SIZE
+	for {
+		conn.SetReadDeadline(time.Now().Add(readTimeout))
+		data, err := br.Peek(peekLen)
+		hello, n, herr := framing.ParseHello(data)
+		if herr != nil {
+			return false, false
+		}
+		if n > 0 {
+			br.Discard(n)
+			reply := framing.Negotiate(hello, maxVersion, t.codecs, knownSigner)
+			conn.SetWriteDeadline(time.Now().Add(readTimeout))
+			if err = framing.WriteHello(conn, reply); err != nil {
+				t.ir.LogError(fmt.Errorf("replying to hello from %s: %s",
+					conn.RemoteAddr(), err))
+				return false, true
+			}
+			conn.SetWriteDeadline(time.Time{})
+			return reply.Version >= 2, false
+		}
+		if len(data) == peekLen {
+			// Have the header length, wait for the whole header.
+			peekLen = int(data[1]) + message.HEADER_FRAMING_SIZE
+			continue
+		}
+		if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+			if idleConn != nil && time.Since(idleConn.lastRead) >= t.idleTimeout {
+				t.ir.LogMessage(fmt.Sprintf("closing idle connection from %s",
+					conn.RemoteAddr()))
+				return false, true
+			}
+			select {
+			case <-t.stopChan:
+				return false, true
+			default:
+				continue
+			}
+		}
+		// Let the regular read loop deal w/ whatever is there.
+		return false, err != nil && len(data) == 0
+	}
+}
+
+// Reads a connection that can contain batch frames, delivering each message
+// as a regular frame so the splitter can authenticate and unframe it as
+// usual.
+func (t *TcpInput) readBatched(conn net.Conn, r io.Reader, sr SplitterRunner,
+	deliverer Deliverer, idleConn *idleTrackingConn, readTimeout time.Duration) {
+
+	var record []byte
+	stopped := false
+	fr := framing.NewReader(r)
+	for !stopped {
+		conn.SetReadDeadline(time.Now().Add(readTimeout))
+		select {
+		case <-t.stopChan:
+			stopped = true
+			continue
+		default:
+		}
+		_, msgBytes, err := fr.Next()
+		if err == nil {
+			if err = framing.Frame(msgBytes, &record, nil, false); err == nil {
+				sr.DeliverRecord(record, deliverer)
+			} else {
+				t.ir.LogError(err)
+			}
+			continue
+		}
+		if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+			if idleConn != nil && time.Since(idleConn.lastRead) >= t.idleTimeout {
+				t.ir.LogMessage(fmt.Sprintf("closing idle connection from %s",
+					conn.RemoteAddr()))
+				stopped = true
+			}
+		} else {
+			stopped = true
+		}
+	}
+	if fr.Corrupt() > 0 {
+		t.ir.LogError(fmt.Errorf("discarded %d corrupt frames from %s",
+			fr.Corrupt(), conn.RemoteAddr()))
+	}
+}
+
 func (t *TcpInput) Run(ir InputRunner, h PluginHelper) error {
 	t.ir = ir
 	var conn net.Conn
@@ -23,6 +23,8 @@ import (
 	"sync"
 	"time"
 
+	"github.com/mozilla-services/heka/framing"
+	"github.com/mozilla-services/heka/message"
 	. "github.com/mozilla-services/heka/pipeline"
 	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
 	"github.com/mozilla-services/heka/pipelinemock"
@@ -44,6 +46,13 @@ func (a *address) String() string {
 	return a.str
 }
 
+// net.Error implementation that always reports itself as a timeout.
+type timeoutError struct{}
+
+func (e timeoutError) Error() string   { return "i/o timeout" }
+func (e timeoutError) Timeout() bool   { return true }
+func (e timeoutError) Temporary() bool { return true }
+
 func TcpInputSpec(c gs.Context) {
 	t := &pipeline_ts.SimpleT{}
 	ctrl := gomock.NewController(t)
@@ -83,6 +92,7 @@ func TcpInputSpec(c gs.Context) {
 				ith.MockSplitterRunner)
 			ith.MockSplitterRunner.EXPECT().UseMsgBytes().Return(false)
 			ith.MockSplitterRunner.EXPECT().SetPackDecorator(gomock.Any())
+			ith.MockSplitterRunner.EXPECT().Splitter().Return(nil)
 			ith.MockSplitterRunner.EXPECT().Done().Do(func() {
 				srDoneWG.Done()
 			})
@@ -128,6 +138,143 @@ func TcpInputSpec(c gs.Context) {
 			})
 		})
 
+		c.Specify("using the HekaFramingSplitter", func() {
+			config.AcceptBatching = true
+			config.Codecs = []string{"deflate"}
+			err := tcpInput.Init(config)
+			c.Assume(err, gs.IsNil)
+
+			srDoneWG.Add(1)
+			ith.MockInputRunner.EXPECT().Name().Return("mock_name")
+			ith.MockInputRunner.EXPECT().NewDeliverer(gomock.Any()).Return(ith.MockDeliverer)
+			ith.MockDeliverer.EXPECT().Done()
+			ith.MockInputRunner.EXPECT().NewSplitterRunner(gomock.Any()).Return(
+				ith.MockSplitterRunner)
+			ith.MockSplitterRunner.EXPECT().UseMsgBytes().Return(true)
+			ith.MockSplitterRunner.EXPECT().Splitter().Return(&HekaFramingSplitter{})
+			ith.MockSplitterRunner.EXPECT().Done().Do(func() {
+				srDoneWG.Done()
+			})
+			go func() {
+				errChan <- tcpInput.Run(ith.MockInputRunner, ith.MockHelper)
+			}()
+
+			c.Specify("accepts batch frames after a hello", func() {
+				records := make(chan []byte, 2)
+				ith.MockSplitterRunner.EXPECT().DeliverRecord(gomock.Any(),
+					ith.MockDeliverer).Times(2).Do(func(record []byte, del Deliverer) {
+					records <- append([]byte{}, record...)
+				})
+
+				outConn, err := net.Dial("tcp", ith.AddrStr)
+				c.Assume(err, gs.IsNil)
+				outConn.SetDeadline(time.Now().Add(5 * time.Second))
+				// Snappy is preferred, but isn't allowed by the config.
+				err = framing.WriteHello(outConn, framing.Hello{Version: 2,
+					Codecs: []framing.Codec{framing.CodecSnappy, framing.CodecDeflate}})
+				c.Assume(err, gs.IsNil)
+				hello, err := framing.ReadHello(outConn)
+				c.Expect(err, gs.IsNil)
+				c.Expect(hello.Version, gs.Equals, uint(2))
+				c.Expect(hello.Codec(), gs.Equals, framing.CodecDeflate)
+
+				var (
+					batch framing.Batch
+					frame []byte
+				)
+				batch.Add([]byte("first message"))
+				batch.Add([]byte("second message"))
+				c.Assume(batch.Frame(&frame, hello.Codec()), gs.IsNil)
+				_, err = outConn.Write(frame)
+				c.Expect(err, gs.IsNil)
+
+				for _, expected := range []string{"first message", "second message"} {
+					record := <-records
+					headerLen := int(record[1]) + message.HEADER_FRAMING_SIZE
+					c.Expect(string(record[headerLen:]), gs.Equals, expected)
+				}
+				outConn.Close()
+				srDoneWG.Wait()
+
+				tcpInput.Stop()
+				err = <-errChan
+				c.Expect(err, gs.IsNil)
+			})
+
+			c.Specify("passes regular streams to the splitter", func() {
+				ith.MockSplitterRunner.EXPECT().SplitStream(gomock.Any(),
+					ith.MockDeliverer).Do(func(r io.Reader, del Deliverer) {
+					recd, _ := ioutil.ReadAll(r)
+					bytesChan <- recd
+				}).Return(io.EOF)
+
+				var frame []byte
+				c.Assume(framing.Frame([]byte("a message"), &frame, nil, false), gs.IsNil)
+				outConn, err := net.Dial("tcp", ith.AddrStr)
+				c.Assume(err, gs.IsNil)
+				_, err = outConn.Write(frame)
+				c.Expect(err, gs.IsNil)
+				outConn.Close()
+
+				recd := <-bytesChan
+				c.Expect(string(recd), gs.Equals, string(frame))
+				srDoneWG.Wait()
+
+				tcpInput.Stop()
+				err = <-errChan
+				c.Expect(err, gs.IsNil)
+			})
+		})
+
+		c.Specify("with an idle timeout", func() {
+			config.IdleTimeout = 1
+			err := tcpInput.Init(config)
+			c.Assume(err, gs.IsNil)
+
+			c.Specify("closes connections that don't send any data", func() {
+				srDoneWG.Add(1)
+				ith.MockInputRunner.EXPECT().Name().Return("mock_name")
+				ith.MockInputRunner.EXPECT().NewDeliverer(gomock.Any()).Return(ith.MockDeliverer)
+				ith.MockDeliverer.EXPECT().Done()
+				ith.MockInputRunner.EXPECT().NewSplitterRunner(gomock.Any()).Return(
+					ith.MockSplitterRunner)
+				ith.MockSplitterRunner.EXPECT().UseMsgBytes().Return(false)
+				ith.MockSplitterRunner.EXPECT().SetPackDecorator(gomock.Any())
+				ith.MockSplitterRunner.EXPECT().Splitter().Return(nil)
+				ith.MockSplitterRunner.EXPECT().Done().Do(func() {
+					srDoneWG.Done()
+				})
+				ith.MockInputRunner.EXPECT().LogMessage(gomock.Any())
+
+				splitCall := ith.MockSplitterRunner.EXPECT().SplitStream(gomock.Any(),
+					ith.MockDeliverer).AnyTimes()
+				splitCall.Do(func(conn net.Conn, del Deliverer) {
+					// Block until the read deadline passes, as a real read
+					// would.
+					b := make([]byte, 1)
+					conn.Read(b)
+				})
+				splitCall.Return(timeoutError{})
+
+				go func() {
+					errChan <- tcpInput.Run(ith.MockInputRunner, ith.MockHelper)
+				}()
+
+				outConn, err := net.Dial("tcp", ith.AddrStr)
+				c.Assume(err, gs.IsNil)
+				outConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+				b := make([]byte, 1)
+				_, err = outConn.Read(b)
+				c.Expect(err, gs.Equals, io.EOF)
+				outConn.Close()
+				srDoneWG.Wait()
+
+				tcpInput.Stop()
+				err = <-errChan
+				c.Expect(err, gs.IsNil)
+			})
+		})
+
 		c.Specify("using TLS", func() {
 			config.UseTls = true
 
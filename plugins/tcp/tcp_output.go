@@ -18,6 +18,7 @@ package tcp
 
 import (
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"regexp"
@@ -25,6 +26,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/mozilla-services/heka/framing"
 	"github.com/mozilla-services/heka/message"
 	. "github.com/mozilla-services/heka/pipeline"
 )
@@ -34,14 +36,33 @@ type TcpOutput struct {
 	processMessageCount int64
 	dropMessageCount    int64
 	keepAliveDuration   time.Duration
+	writeTimeout        time.Duration
+	idleTimeout         time.Duration
+	lastWrite           time.Time
 	conf                *TcpOutputConfig
 	address             string
+	resolver            *Resolver
 	localAddress        net.Addr
 	connection          net.Conn
 	name                string
 	reportLock          sync.Mutex
 	or                  OutputRunner
 	pConfig             *PipelineConfig
+	// Batching state, only used if the peer agreed to batch frames.
+	batchCount       int64
+	codec            framing.Codec
+	batchMaxWait     time.Duration
+	handshakeTimeout time.Duration
+	batching         bool
+	signing          bool
+	offer            framing.Hello
+	batch            framing.Batch
+	batchCursor      string
+	batchStart       time.Time
+	frame            []byte
+	sinceConnect     int64
+	// Closed once the peer has closed the current connection.
+	peerClosed chan struct{}
 }
 
 // ConfigStruct for TcpOutput plugin.
@@ -52,8 +73,8 @@ type TcpOutputConfig struct {
 	LocalAddress string `toml:"local_address"`
 	UseTls       bool   `toml:"use_tls"`
 	Tls          TlsConfig
-	// Interval at which the output queue logs will roll, in seconds. Defaults
-	// to 300.
+	// Interval in seconds at which batches are checked for having waited
+	// longer than BatchMaxWait. Defaults to 1.
 	TickerInterval uint `toml:"ticker_interval"`
 	// Allows for a default encoder.
 	Encoder string
@@ -61,6 +82,12 @@ type TcpOutputConfig struct {
 	KeepAlive bool `toml:"keep_alive"`
 	// Integer indicating seconds between keep alives.
 	KeepAlivePeriod int `toml:"keep_alive_period"`
+	// Integer indicating seconds to wait for a single write to complete
+	// before the connection is considered dead. Defaults to 0 (no timeout).
+	WriteTimeout uint `toml:"write_timeout"`
+	// Integer indicating seconds a connection may go unused before it is
+	// closed and re-established on the next write. Defaults to 0 (never).
+	IdleTimeout uint `toml:"idle_timeout"`
 	// Number of successfully processed messages to re-establish the TCP
 	// connection after.  Defaults to 0 (never)
 	ReconnectAfter int64 `toml:"reconnect_after"`
@@ -71,6 +98,26 @@ type TcpOutputConfig struct {
 	// Defaults to true for TcpOutput.
 	UseBuffering *bool `toml:"use_buffering"`
 	Buffering    QueueBufferConfig
+	// Set to true to ask the TcpInput on the other end to accept batch
+	// frames, which pack many messages into a single frame. Falls back to
+	// sending one message per frame if it doesn't agree.
+	UseBatching bool `toml:"use_batching"`
+	// Preferred compression for batch frames, "deflate", "snappy" or "none".
+	// The other supported codecs are offered as well, unless this is "none".
+	// Defaults to "deflate".
+	Compression string
+	// Maximum number of milliseconds a message may wait in a batch before
+	// the batch is sent. Defaults to 100.
+	BatchMaxWait uint `toml:"batch_max_wait"`
+	// Integer indicating seconds to wait for the TcpInput to reply to the
+	// handshake. Defaults to 5.
+	HandshakeTimeout uint `toml:"handshake_timeout"`
+	// Sign outgoing messages w/ this signer, if the TcpInput can verify the
+	// signatures.
+	Signer *message.MessageSigningConfig
+	// Resolve the address from a Consul service or SRV records rather than
+	// using Address.
+	Discovery *DiscoveryConfig
 }
 
 func (t *TcpOutput) ConfigStruct() interface{} {
@@ -82,10 +129,14 @@ func (t *TcpOutput) ConfigStruct() interface{} {
 		FullAction:        "shutdown",
 	}
 	return &TcpOutputConfig{
-		Address:      "localhost:9125",
-		Encoder:      "ProtobufEncoder",
-		UseBuffering: &b,
-		Buffering:    queueConfig,
+		Address:          "localhost:9125",
+		Encoder:          "ProtobufEncoder",
+		UseBuffering:     &b,
+		Buffering:        queueConfig,
+		TickerInterval:   1,
+		Compression:      "deflate",
+		BatchMaxWait:     100,
+		HandshakeTimeout: 5,
 	}
 }
 
@@ -97,6 +148,11 @@ func (t *TcpOutput) SetName(name string) {
 func (t *TcpOutput) Init(config interface{}) (err error) {
 	t.conf = config.(*TcpOutputConfig)
 	t.address = t.conf.Address
+	if t.conf.Discovery != nil {
+		if t.resolver, err = NewResolver(t.conf.Discovery); err != nil {
+			return err
+		}
+	}
 
 	if t.conf.LocalAddress != "" {
 		// Error out if use_tls and local_address options are both set for now.
@@ -110,6 +166,35 @@ func (t *TcpOutput) Init(config interface{}) (err error) {
 	if t.conf.KeepAlivePeriod != 0 {
 		t.keepAliveDuration = time.Duration(t.conf.KeepAlivePeriod) * time.Second
 	}
+	t.writeTimeout = time.Duration(t.conf.WriteTimeout) * time.Second
+	t.idleTimeout = time.Duration(t.conf.IdleTimeout) * time.Second
+
+	t.offer = framing.Hello{Version: 1}
+	if t.conf.UseBatching {
+		t.offer.Version = framing.MAX_VERSION
+		var codec framing.Codec
+		if codec, err = framing.ParseCodec(t.conf.Compression); err != nil {
+			return err
+		}
+		if codec != framing.CodecNone {
+			t.offer.Codecs = append(t.offer.Codecs, codec)
+			for _, c := range framing.Codecs() {
+				if c != codec {
+					t.offer.Codecs = append(t.offer.Codecs, c)
+				}
+			}
+		}
+		t.batchMaxWait = time.Duration(t.conf.BatchMaxWait) * time.Millisecond
+	}
+	if t.conf.Signer != nil {
+		switch t.conf.Signer.Hash {
+		case "", "md5", "sha1":
+		default:
+			return fmt.Errorf("unsupported signer hmac_hash: %s", t.conf.Signer.Hash)
+		}
+		t.offer.Signer = fmt.Sprintf("%s_%d", t.conf.Signer.Name, t.conf.Signer.Version)
+	}
+	t.handshakeTimeout = time.Duration(t.conf.HandshakeTimeout) * time.Second
 
 	return
 }
@@ -123,6 +208,10 @@ func (t *TcpOutput) Prepare(or OutputRunner, h PluginHelper) (err error) {
 		}
 	}
 
+	if (t.conf.UseBatching || t.conf.Signer != nil) && !or.UsesFraming() {
+		return errors.New("use_batching and signer require Heka's stream framing")
+	}
+
 	t.pConfig = h.PipelineConfig()
 	t.or = or
 
@@ -137,10 +226,32 @@ func (t *TcpOutput) cleanupConn() {
 }
 
 func (t *TcpOutput) CleanUp() {
+	if t.connection != nil && t.batch.Len() > 0 {
+		if err := t.flush(); err != nil {
+			t.or.LogError(err)
+		}
+	}
 	t.cleanupConn()
 }
 
 func (t *TcpOutput) ProcessMessage(pack *PipelinePack) (err error) {
+	if t.connection != nil && t.idleTimeout != 0 &&
+		time.Since(t.lastWrite) >= t.idleTimeout {
+
+		// The connection may have been silently dropped by a firewall or
+		// NAT device while it was idle, start over with a fresh one.
+		t.cleanupConn()
+	}
+	if t.connection != nil && t.hungUp() {
+		// Writing to it would likely succeed anyway, losing the message.
+		t.or.LogMessage(fmt.Sprintf("%s closed the connection, reconnecting", t.address))
+		t.cleanupConn()
+	}
+	if t.connection != nil && t.resolver != nil && !t.resolver.Healthy(t.address) {
+		// Move on to a healthy instance of the service.
+		t.or.LogMessage(fmt.Sprintf("%s is no longer healthy, reconnecting", t.address))
+		t.cleanupConn()
+	}
 	if t.connection == nil {
 		if err = t.connect(); err != nil {
 			// Explicitly set t.connection to nil because Go, see
@@ -150,16 +261,34 @@ func (t *TcpOutput) ProcessMessage(pack *PipelinePack) (err error) {
 		}
 	}
 
+	if t.batching {
+		return t.batchMessage(pack)
+	}
+	if t.batch.Len() > 0 {
+		// Left over from a connection that used batching.
+		if err = t.flush(); err != nil {
+			return err
+		}
+	}
+
 	var (
 		n      int
 		record []byte
 	)
 
-	if record, err = t.or.Encode(pack); err != nil {
+	if t.signing {
+		record, err = t.encodeSigned(pack)
+	} else {
+		record, err = t.or.Encode(pack)
+	}
+	if err != nil {
 		atomic.AddInt64(&t.dropMessageCount, 1)
 		return fmt.Errorf("can't encode: %s", err)
 	}
 
+	if t.writeTimeout != 0 {
+		t.connection.SetWriteDeadline(time.Now().Add(t.writeTimeout))
+	}
 	if n, err = t.connection.Write(record); err != nil {
 		t.cleanupConn()
 		err = NewRetryMessageError("writing to %s: %s", t.address, err)
@@ -167,6 +296,7 @@ func (t *TcpOutput) ProcessMessage(pack *PipelinePack) (err error) {
 		t.cleanupConn()
 		err = NewRetryMessageError("truncated output to: %s", t.address)
 	} else {
+		t.lastWrite = time.Now()
 		atomic.AddInt64(&t.processMessageCount, 1)
 		t.or.UpdateCursor(pack.QueueCursor)
 		if t.conf.ReconnectAfter > 0 &&
@@ -181,6 +311,16 @@ func (t *TcpOutput) ProcessMessage(pack *PipelinePack) (err error) {
 
 func (t *TcpOutput) connect() (err error) {
 	dialer := &net.Dialer{LocalAddr: t.localAddress}
+	if t.resolver != nil {
+		if t.address, err = t.resolver.Addr(); err != nil {
+			return
+		}
+		defer func() {
+			if err != nil {
+				t.resolver.Failed(t.address)
+			}
+		}()
+	}
 
 	if t.conf.UseTls {
 		var goTlsConf *tls.Config
@@ -194,6 +334,12 @@ func (t *TcpOutput) connect() (err error) {
 	} else {
 		t.connection, err = dialer.Dial("tcp", t.address)
 	}
+	if err == nil {
+		t.lastWrite = time.Now()
+		t.sinceConnect = 0
+		t.batching = false
+		t.signing = false
+	}
 	if err == nil && t.conf.KeepAlive {
 		tcpConn, ok := t.connection.(*net.TCPConn)
 		if !ok {
@@ -205,9 +351,218 @@ func (t *TcpOutput) connect() (err error) {
 			}
 		}
 	}
+	if err == nil && (t.conf.UseBatching || t.conf.Signer != nil) {
+		if err = t.negotiate(); err != nil {
+			t.cleanupConn()
+		}
+	}
+	if err == nil {
+		t.watchConn()
+	}
 	return
 }
 
+// The TcpInput never sends anything after the handshake, so a read on the
+// connection only returns once the peer has closed it or the connection is
+// otherwise gone. Watches for that in the background so we can reconnect
+// before writing to a connection the peer already closed, which usually
+// succeeds w/o an error.
+func (t *TcpOutput) watchConn() {
+	closed := make(chan struct{})
+	t.peerClosed = closed
+	go func(conn net.Conn) {
+		b := make([]byte, 1)
+		for {
+			if _, err := conn.Read(b); err != nil {
+				close(closed)
+				return
+			}
+		}
+	}(t.connection)
+}
+
+// Whether the peer has closed the current connection.
+func (t *TcpOutput) hungUp() bool {
+	select {
+	case <-t.peerClosed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Offers the TcpInput the framing version, codecs and signer we support, and
+// uses whatever it picks. Inputs that don't know about the handshake never
+// reply, so if it times out we carry on w/ version 1 framing, signed if a
+// signer is configured.
+func (t *TcpOutput) negotiate() error {
+	t.connection.SetDeadline(time.Now().Add(t.handshakeTimeout))
+	defer t.connection.SetDeadline(time.Time{})
+	if err := framing.WriteHello(t.connection, t.offer); err != nil {
+		return fmt.Errorf("sending hello: %s", err)
+	}
+	reply, err := framing.ReadHello(t.connection)
+	if err != nil {
+		if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+			t.or.LogMessage(fmt.Sprintf("%s didn't reply to the handshake, "+
+				"using version 1 framing", t.address))
+			t.signing = t.conf.Signer != nil
+			return nil
+		}
+		return fmt.Errorf("reading hello: %s", err)
+	}
+	if reply.Version > t.offer.Version || !reply.Codec().Supported() ||
+		(reply.Signer != "" && reply.Signer != t.offer.Signer) {
+		return fmt.Errorf("invalid hello reply: %+v", reply)
+	}
+	t.batching = reply.Version >= 2
+	t.codec = reply.Codec()
+	t.signing = reply.Signer != ""
+	return nil
+}
+
+// Encodes and frames the message, signing it w/ the configured signer.
+func (t *TcpOutput) encodeSigned(pack *PipelinePack) (record []byte, err error) {
+	msgBytes, err := t.or.Encoder().Encode(pack)
+	if err != nil || msgBytes == nil {
+		return nil, err
+	}
+	if err = framing.Frame(msgBytes, &t.frame, t.conf.Signer, false); err != nil {
+		return nil, err
+	}
+	return t.frame, nil
+}
+
+// Adds the message to the current batch, sending the batch first if it's
+// full or has waited long enough. The buffer cursor is only advanced once a
+// batch has been sent, and a batch that couldn't be sent is kept and sent
+// again (before the message being retried is added to it) once the
+// connection has been re-established.
+func (t *TcpOutput) batchMessage(pack *PipelinePack) (err error) {
+	msgBytes, err := t.or.Encoder().Encode(pack)
+	if err != nil || msgBytes == nil {
+		if err != nil {
+			atomic.AddInt64(&t.dropMessageCount, 1)
+			err = fmt.Errorf("can't encode: %s", err)
+		}
+		return err
+	}
+	if t.batch.Len() > 0 && time.Since(t.batchStart) >= t.batchMaxWait {
+		if err = t.flush(); err != nil {
+			return err
+		}
+	}
+	if !t.batch.Add(msgBytes) {
+		if t.batch.Len() > 0 {
+			if err = t.flush(); err != nil {
+				return err
+			}
+		}
+		if !t.batch.Add(msgBytes) {
+			return t.sendUnbatched(msgBytes, pack.QueueCursor)
+		}
+	}
+	if t.batch.Len() == 1 {
+		t.batchStart = time.Now()
+	}
+	t.batchCursor = pack.QueueCursor
+	atomic.AddInt64(&t.processMessageCount, 1)
+	return nil
+}
+
+// Sends the current batch in a single frame, or as one frame per message if
+// the current connection doesn't use batching.
+func (t *TcpOutput) flush() error {
+	var err error
+	if t.batching {
+		err = t.batch.Frame(&t.frame, t.codec)
+	} else {
+		var (
+			record []byte
+			msc    *message.MessageSigningConfig
+		)
+		if t.signing {
+			msc = t.conf.Signer
+		}
+		t.frame = t.frame[:0]
+		for _, msgBytes := range t.batch.Messages(nil) {
+			if err = framing.Frame(msgBytes, &record, msc, false); err != nil {
+				break
+			}
+			t.frame = append(t.frame, record...)
+		}
+	}
+	if err != nil {
+		// Not something a retry will fix.
+		t.or.LogError(fmt.Errorf("dropping %d batched messages: %s",
+			t.batch.Len(), err))
+		atomic.AddInt64(&t.dropMessageCount, int64(t.batch.Len()))
+		t.batch.Reset()
+		return nil
+	}
+	count := t.batch.Len()
+	if err = t.write(t.frame); err != nil {
+		return err
+	}
+	t.batch.Reset()
+	atomic.AddInt64(&t.batchCount, 1)
+	t.or.UpdateCursor(t.batchCursor)
+	t.sinceConnect += int64(count)
+	if t.conf.ReconnectAfter > 0 && t.sinceConnect >= t.conf.ReconnectAfter {
+		t.cleanupConn()
+	}
+	return nil
+}
+
+// Sends a message too large for a batch in a frame of its own, which is only
+// done while the batch is empty so ordering is preserved.
+func (t *TcpOutput) sendUnbatched(msgBytes []byte, cursor string) error {
+	if err := framing.Frame(msgBytes, &t.frame, nil, true); err != nil {
+		atomic.AddInt64(&t.dropMessageCount, 1)
+		return fmt.Errorf("can't frame: %s", err)
+	}
+	if err := t.write(t.frame); err != nil {
+		return err
+	}
+	atomic.AddInt64(&t.processMessageCount, 1)
+	t.or.UpdateCursor(cursor)
+	t.sinceConnect++
+	return nil
+}
+
+// Writes the record, dropping the connection on failure.
+func (t *TcpOutput) write(record []byte) error {
+	if t.connection == nil {
+		return NewRetryMessageError("not connected to %s", t.address)
+	}
+	if t.writeTimeout != 0 {
+		t.connection.SetWriteDeadline(time.Now().Add(t.writeTimeout))
+	}
+	n, err := t.connection.Write(record)
+	if err != nil {
+		t.cleanupConn()
+		return NewRetryMessageError("writing to %s: %s", t.address, err)
+	} else if n != len(record) {
+		t.cleanupConn()
+		return NewRetryMessageError("truncated output to: %s", t.address)
+	}
+	t.lastWrite = time.Now()
+	return nil
+}
+
+// Sends the current batch once it has waited long enough, so batched
+// messages aren't held indefinitely when traffic is light.
+func (t *TcpOutput) TimerEvent() error {
+	if t.connection != nil && t.batch.Len() > 0 &&
+		time.Since(t.batchStart) >= t.batchMaxWait {
+
+		if err := t.flush(); err != nil {
+			t.or.LogError(err)
+		}
+	}
+	return nil
+}
+
 // Satisfies the `pipeline.ReportingPlugin` interface to provide plugin state
 // information to the Heka report and dashboard.
 func (t *TcpOutput) ReportMsg(msg *message.Message) error {
@@ -218,6 +573,8 @@ func (t *TcpOutput) ReportMsg(msg *message.Message) error {
 		atomic.LoadInt64(&t.processMessageCount), "count")
 	message.NewInt64Field(msg, "DropMessageCount",
 		atomic.LoadInt64(&t.dropMessageCount), "count")
+	message.NewInt64Field(msg, "BatchCount",
+		atomic.LoadInt64(&t.batchCount), "count")
 
 	return nil
 }
@@ -23,6 +23,8 @@ import (
 	"time"
 
 	"github.com/gogo/protobuf/proto"
+	"github.com/mozilla-services/heka/framing"
+	"github.com/mozilla-services/heka/message"
 	. "github.com/mozilla-services/heka/pipeline"
 	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
 	"github.com/mozilla-services/heka/plugins"
@@ -148,6 +150,206 @@ func TcpOutputSpec(c gs.Context) {
 			tcpOutput.CleanUp()
 		})
 
+		c.Specify("reconnects after the idle timeout", func() {
+			ln, err := net.Listen("tcp", "localhost:9125")
+			c.Assume(err, gs.IsNil)
+			connChan := make(chan net.Conn, 2)
+			go func() {
+				for i := 0; i < 2; i++ {
+					conn, err := ln.Accept()
+					if err != nil {
+						return
+					}
+					connChan <- conn
+				}
+			}()
+
+			config.IdleTimeout = 1
+			err = tcpOutput.Init(config)
+			c.Assume(err, gs.IsNil)
+
+			oth.MockOutputRunner.EXPECT().Encoder().Return(encoder)
+			oth.MockOutputRunner.EXPECT().SetUseFraming(true)
+			err = tcpOutput.Prepare(oth.MockOutputRunner, oth.MockHelper)
+			c.Assume(err, gs.IsNil)
+
+			oth.MockOutputRunner.EXPECT().Encode(pack).Return(encoder.Encode(pack)).Times(2)
+			oth.MockOutputRunner.EXPECT().UpdateCursor(pack.QueueCursor).Times(2)
+
+			err = tcpOutput.ProcessMessage(pack)
+			c.Expect(err, gs.IsNil)
+			first := <-connChan
+
+			// Pretend the connection has been sitting idle.
+			tcpOutput.lastWrite = time.Now().Add(-2 * time.Second)
+			err = tcpOutput.ProcessMessage(pack)
+			c.Expect(err, gs.IsNil)
+			second := <-connChan
+			c.Expect(second, gs.Not(gs.Equals), first)
+
+			first.Close()
+			second.Close()
+			ln.Close()
+			tcpOutput.CleanUp()
+		})
+
+		c.Specify("reconnects if the peer closed the connection", func() {
+			ln, err := net.Listen("tcp", "localhost:9125")
+			c.Assume(err, gs.IsNil)
+			connChan := make(chan net.Conn, 2)
+			go func() {
+				for i := 0; i < 2; i++ {
+					conn, err := ln.Accept()
+					if err != nil {
+						return
+					}
+					connChan <- conn
+				}
+			}()
+
+			err = tcpOutput.Init(config)
+			c.Assume(err, gs.IsNil)
+
+			oth.MockOutputRunner.EXPECT().Encoder().Return(encoder)
+			oth.MockOutputRunner.EXPECT().SetUseFraming(true)
+			err = tcpOutput.Prepare(oth.MockOutputRunner, oth.MockHelper)
+			c.Assume(err, gs.IsNil)
+
+			oth.MockOutputRunner.EXPECT().Encode(pack).Return(encoder.Encode(pack)).Times(2)
+			oth.MockOutputRunner.EXPECT().UpdateCursor(pack.QueueCursor).Times(2)
+			oth.MockOutputRunner.EXPECT().LogMessage(gomock.Any())
+
+			err = tcpOutput.ProcessMessage(pack)
+			c.Expect(err, gs.IsNil)
+			first := <-connChan
+			first.Close()
+			for i := 0; i < 100 && !tcpOutput.hungUp(); i++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+			c.Assume(tcpOutput.hungUp(), gs.IsTrue)
+
+			err = tcpOutput.ProcessMessage(pack)
+			c.Expect(err, gs.IsNil)
+			second := <-connChan
+			c.Expect(second, gs.Not(gs.Equals), first)
+
+			second.Close()
+			ln.Close()
+			tcpOutput.CleanUp()
+		})
+
+		c.Specify("with batching", func() {
+			ln, err := net.Listen("tcp", "localhost:9125")
+			c.Assume(err, gs.IsNil)
+			defer ln.Close()
+			connChan := make(chan net.Conn, 1)
+			go func() {
+				if conn, err := ln.Accept(); err == nil {
+					connChan <- conn
+				}
+			}()
+
+			config.UseBatching = true
+			config.HandshakeTimeout = 1
+			err = tcpOutput.Init(config)
+			c.Assume(err, gs.IsNil)
+			oth.MockOutputRunner.EXPECT().Encoder().Return(encoder).AnyTimes()
+			oth.MockOutputRunner.EXPECT().SetUseFraming(true)
+			oth.MockOutputRunner.EXPECT().UsesFraming().Return(true)
+			err = tcpOutput.Prepare(oth.MockOutputRunner, oth.MockHelper)
+			c.Assume(err, gs.IsNil)
+
+			c.Specify("sends batch frames if the peer agrees", func() {
+				go func() {
+					conn := <-connChan
+					if _, err := framing.ReadHello(conn); err == nil {
+						framing.WriteHello(conn, framing.Hello{Version: 2,
+							Codecs: []framing.Codec{framing.CodecDeflate}})
+					}
+					connChan <- conn
+				}()
+				oth.MockOutputRunner.EXPECT().UpdateCursor(pack.QueueCursor)
+
+				err = tcpOutput.ProcessMessage(pack)
+				c.Expect(err, gs.IsNil)
+				err = tcpOutput.ProcessMessage(pack)
+				c.Expect(err, gs.IsNil)
+				c.Expect(tcpOutput.batching, gs.IsTrue)
+				c.Expect(tcpOutput.batch.Len(), gs.Equals, 2)
+
+				// Pretend the batch has been waiting for a while.
+				tcpOutput.batchStart = time.Now().Add(-time.Second)
+				c.Expect(tcpOutput.TimerEvent(), gs.IsNil)
+				c.Expect(tcpOutput.batch.Len(), gs.Equals, 0)
+				c.Expect(atomic.LoadInt64(&tcpOutput.batchCount), gs.Equals, int64(1))
+
+				conn := <-connChan
+				fr := framing.NewReader(conn)
+				for i := 0; i < 2; i++ {
+					header, msgBytes, err := fr.Next()
+					c.Expect(err, gs.IsNil)
+					count, ok := framing.BatchCount(header)
+					c.Expect(ok, gs.IsTrue)
+					c.Expect(count, gs.Equals, 2)
+					c.Expect(string(msgBytes), gs.Equals, string(matchBytes))
+				}
+				conn.Close()
+				tcpOutput.CleanUp()
+			})
+
+			c.Specify("signs messages if the peer can verify them", func() {
+				config.Signer = &message.MessageSigningConfig{
+					Name:    "test",
+					Hash:    "sha1",
+					Key:     "secret",
+					Version: 1,
+				}
+				err = tcpOutput.Init(config)
+				c.Assume(err, gs.IsNil)
+				c.Expect(tcpOutput.offer.Signer, gs.Equals, "test_1")
+				go func() {
+					conn := <-connChan
+					if offer, err := framing.ReadHello(conn); err == nil {
+						framing.WriteHello(conn, framing.Negotiate(offer, 2, nil,
+							func(string) bool { return true }))
+					}
+					connChan <- conn
+				}()
+				oth.MockOutputRunner.EXPECT().UpdateCursor(pack.QueueCursor)
+
+				err = tcpOutput.ProcessMessage(pack)
+				c.Expect(err, gs.IsNil)
+				c.Expect(tcpOutput.batching, gs.IsFalse)
+				c.Expect(tcpOutput.signing, gs.IsTrue)
+
+				conn := <-connChan
+				header, msgBytes, err := framing.NewReader(conn).Next()
+				c.Expect(err, gs.IsNil)
+				c.Expect(header.GetHmacSigner(), gs.Equals, "test")
+				c.Expect(header.GetHmacKeyVersion(), gs.Equals, uint32(1))
+				c.Expect(string(msgBytes), gs.Equals, string(matchBytes))
+				conn.Close()
+				tcpOutput.CleanUp()
+			})
+
+			c.Specify("sends regular frames if the peer doesn't reply", func() {
+				oth.MockOutputRunner.EXPECT().LogMessage(gomock.Any())
+				oth.MockOutputRunner.EXPECT().Encode(pack).Return(encoder.Encode(pack))
+				oth.MockOutputRunner.EXPECT().UpdateCursor(pack.QueueCursor)
+
+				err = tcpOutput.ProcessMessage(pack)
+				c.Expect(err, gs.IsNil)
+				c.Expect(tcpOutput.batching, gs.IsFalse)
+
+				conn := <-connChan
+				_, msgBytes, err := framing.NewReader(conn).Next()
+				c.Expect(err, gs.IsNil)
+				c.Expect(string(msgBytes), gs.Equals, string(matchBytes))
+				conn.Close()
+				tcpOutput.CleanUp()
+			})
+		})
+
 		c.Specify("far end not initially listening", func() {
 			oth.MockOutputRunner.EXPECT().LogError(gomock.Any()).AnyTimes()
 
@@ -117,10 +117,11 @@ func (u *UdpInput) Init(config interface{}) (err error) {
 		if err != nil {
 			return fmt.Errorf("ResolveUDPAddr failed: %s\n", err.Error())
 		}
-		u.listener, err = net.ListenUDP(u.config.Net, udpAddr)
+		conn, err := HandoverListenPacket(u.config.Net, udpAddr.String())
 		if err != nil {
 			return fmt.Errorf("ListenUDP failed: %s\n", err.Error())
 		}
+		u.listener = conn.(net.Conn)
 		if u.config.SetHostname {
 			u.reader = UdpInputReader {
 				u.listener.(*net.UDPConn),
@@ -0,0 +1,196 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package plugins
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+)
+
+type XmlDecoderConfig struct {
+	// Type of the decoded messages, unless mapped from the XML. Defaults to
+	// "xml".
+	MessageType string `toml:"message_type"`
+
+	// Whether to keep the XML text as the message payload, defaults to
+	// false.
+	PayloadKeep bool `toml:"payload_keep"`
+
+	// Maps the namespace prefixes used in the paths to namespace URIs.
+	Namespaces map[string]string `toml:"namespaces"`
+
+	// Maps field names to the paths of the values they're set to.
+	Fields map[string]string `toml:"fields"`
+
+	// Maps message header names (Type, Logger, Hostname, Severity,
+	// EnvVersion, Pid and Timestamp) to the paths of their values.
+	MapFields map[string]string `toml:"map_fields"`
+
+	// Layout of the timestamps, see message.ForgivingTimeParse.
+	TimestampLayout string `toml:"timestamp_layout"`
+
+	// Time zone timestamps are presumed to be in, defaults to "UTC".
+	TimestampLocation string `toml:"timestamp_location"`
+}
+
+// A field or header and the path of its values.
+type xmlMapping struct {
+	name string
+	path *xmlPath
+}
+
+type XmlDecoder struct {
+	messageType string
+	payloadKeep bool
+	fields      []xmlMapping
+	headers     []xmlMapping
+	layout      string
+	tzLocation  *time.Location
+}
+
+var xmlHeaders = []string{"Type", "Logger", "Hostname", "Severity",
+	"EnvVersion", "Pid", "Timestamp"}
+
+func (xd *XmlDecoder) ConfigStruct() interface{} {
+	return &XmlDecoderConfig{
+		MessageType: "xml",
+	}
+}
+
+func (xd *XmlDecoder) Init(config interface{}) (err error) {
+	conf := config.(*XmlDecoderConfig)
+	if xd.fields, err = xmlMappings(conf.Fields, conf.Namespaces); err != nil {
+		return err
+	}
+	if xd.headers, err = xmlMappings(conf.MapFields, conf.Namespaces); err != nil {
+		return err
+	}
+	for _, m := range xd.headers {
+		known := false
+		for _, h := range xmlHeaders {
+			if h == m.name {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("XmlDecoder can't map to unknown header '%s'", m.name)
+		}
+	}
+	if xd.tzLocation, err = time.LoadLocation(conf.TimestampLocation); err != nil {
+		return fmt.Errorf("XmlDecoder unknown timestamp_location '%s': %s",
+			conf.TimestampLocation, err)
+	}
+	xd.messageType = conf.MessageType
+	xd.payloadKeep = conf.PayloadKeep
+	xd.layout = conf.TimestampLayout
+	return nil
+}
+
+// Compiles the paths, sorted by name so fields are always added in the same
+// order.
+func xmlMappings(paths, namespaces map[string]string) ([]xmlMapping, error) {
+	names := make([]string, 0, len(paths))
+	for name := range paths {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	mappings := make([]xmlMapping, len(names))
+	for i, name := range names {
+		path, err := compileXmlPath(paths[name], namespaces)
+		if err != nil {
+			return nil, fmt.Errorf("XmlDecoder invalid path '%s' for '%s': %s",
+				paths[name], name, err)
+		}
+		mappings[i] = xmlMapping{name, path}
+	}
+	return mappings, nil
+}
+
+func (xd *XmlDecoder) Decode(pack *PipelinePack) (packs []*PipelinePack, err error) {
+	msg := pack.Message
+	doc, err := parseXml(msg.GetPayload())
+	if err != nil {
+		return nil, fmt.Errorf("XmlDecoder failed to parse: %s", err)
+	}
+	msg.SetType(xd.messageType)
+	if !xd.payloadKeep {
+		msg.SetPayload("")
+	}
+	for _, m := range xd.headers {
+		values := m.path.eval(doc)
+		if len(values) == 0 {
+			continue
+		}
+		if err = xd.setHeader(msg, m.name, values[0]); err != nil {
+			return nil, fmt.Errorf("XmlDecoder can't set %s: %s", m.name, err)
+		}
+	}
+	for _, m := range xd.fields {
+		values := m.path.eval(doc)
+		if len(values) == 0 {
+			continue
+		}
+		// Multiple matches make a single field w/ multiple values.
+		field := message.NewFieldInit(m.name, message.Field_STRING, "")
+		for _, v := range values {
+			field.AddValue(v)
+		}
+		msg.DeleteFieldsByName(m.name)
+		msg.AddField(field)
+	}
+	return []*PipelinePack{pack}, nil
+}
+
+func (xd *XmlDecoder) setHeader(msg *message.Message, header, value string) error {
+	switch header {
+	case "Severity", "Pid":
+		n, err := strconv.ParseInt(value, 10, 32)
+		if err != nil {
+			return fmt.Errorf("'%s' isn't an integer", value)
+		}
+		if header == "Severity" {
+			msg.SetSeverity(int32(n))
+		} else {
+			msg.SetPid(int32(n))
+		}
+	case "Timestamp":
+		t, err := message.ForgivingTimeParse(xd.layout, value, xd.tzLocation)
+		if err != nil {
+			return fmt.Errorf("can't parse '%s': %s", value, err)
+		}
+		msg.SetTimestamp(t.UnixNano())
+	case "Type":
+		msg.SetType(value)
+	case "Logger":
+		msg.SetLogger(value)
+	case "Hostname":
+		msg.SetHostname(value)
+	case "EnvVersion":
+		msg.SetEnvVersion(value)
+	}
+	return nil
+}
+
+func init() {
+	RegisterPlugin("XmlDecoder", func() interface{} {
+		return new(XmlDecoder)
+	})
+}
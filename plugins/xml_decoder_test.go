@@ -0,0 +1,155 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package plugins
+
+import (
+	"time"
+
+	. "github.com/mozilla-services/heka/pipeline"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+const windowsEventXml = `<?xml version="1.0" encoding="UTF-16"?>
+<Event xmlns='http://schemas.microsoft.com/win/2004/08/events/event'>
+  <System>
+    <Provider Name='Microsoft-Windows-Security-Auditing'/>
+    <EventID>4624</EventID>
+    <Level>4</Level>
+    <TimeCreated SystemTime='2016-05-04T12:00:00.5Z'/>
+    <Computer>dc1.example.com</Computer>
+  </System>
+  <EventData>
+    <Data Name='SubjectUserName'>-</Data>
+    <Data Name='TargetUserName'>bob</Data>
+    <Data Name='IpAddress'>10.0.0.5</Data>
+  </EventData>
+</Event>`
+
+const soapXml = `<soap:Envelope xmlns:soap="http://www.w3.org/2003/05/soap-envelope"
+  xmlns:m="urn:example:prices">
+  <soap:Body>
+    <m:GetPriceResponse>
+      <m:Price currency="EUR">1.90</m:Price>
+      <m:Price currency="USD">2.10</m:Price>
+      <Price>ignored</Price>
+    </m:GetPriceResponse>
+  </soap:Body>
+</soap:Envelope>`
+
+func XmlDecoderSpec(c gs.Context) {
+	c.Specify("An XmlDecoder", func() {
+		decoder := new(XmlDecoder)
+		config := decoder.ConfigStruct().(*XmlDecoderConfig)
+		config.Namespaces = map[string]string{
+			"e":    "http://schemas.microsoft.com/win/2004/08/events/event",
+			"soap": "http://www.w3.org/2003/05/soap-envelope",
+			"m":    "urn:example:prices",
+		}
+		supply := make(chan *PipelinePack, 1)
+		pack := NewPipelinePack(supply)
+		msg := pack.Message
+
+		decode := func(payload string) error {
+			if err := decoder.Init(config); err != nil {
+				return err
+			}
+			msg.SetPayload(payload)
+			packs, err := decoder.Decode(pack)
+			if err == nil {
+				c.Expect(len(packs), gs.Equals, 1)
+			}
+			return err
+		}
+
+		c.Specify("extracts Windows event fields and headers", func() {
+			config.Fields = map[string]string{
+				"EventID":  "/e:Event/e:System/e:EventID",
+				"Provider": "/Event/System/Provider/@Name",
+				"User":     "//Data[@Name='TargetUserName']",
+				"Second":   "/Event/EventData/Data[2]",
+				"Missing":  "/Event/System/Keywords",
+			}
+			config.MapFields = map[string]string{
+				"Hostname":  "//Computer",
+				"Severity":  "//Level",
+				"Timestamp": "//TimeCreated/@SystemTime",
+			}
+			err := decode(windowsEventXml)
+			c.Assume(err, gs.IsNil)
+			c.Expect(msg.GetType(), gs.Equals, "xml")
+			c.Expect(msg.GetPayload(), gs.Equals, "")
+			value, _ := msg.GetString("EventID")
+			c.Expect(value, gs.Equals, "4624")
+			value, _ = msg.GetString("Provider")
+			c.Expect(value, gs.Equals, "Microsoft-Windows-Security-Auditing")
+			value, _ = msg.GetString("User")
+			c.Expect(value, gs.Equals, "bob")
+			value, _ = msg.GetString("Second")
+			c.Expect(value, gs.Equals, "bob")
+			c.Expect(msg.FindFirstField("Missing"), gs.IsNil)
+			c.Expect(msg.GetHostname(), gs.Equals, "dc1.example.com")
+			c.Expect(msg.GetSeverity(), gs.Equals, int32(4))
+			ts := time.Date(2016, 5, 4, 12, 0, 0, 5e8, time.UTC)
+			c.Expect(msg.GetTimestamp(), gs.Equals, ts.UnixNano())
+		})
+
+		c.Specify("matches namespaced names", func() {
+			config.Fields = map[string]string{
+				"Prices":   "//m:Price",
+				"Currency": "//m:Price[@currency='USD']/@currency",
+				"All":      "/soap:Envelope/soap:Body//Price",
+			}
+			err := decode(soapXml)
+			c.Assume(err, gs.IsNil)
+			field := msg.FindFirstField("Prices")
+			c.Expect(len(field.ValueString), gs.Equals, 2)
+			c.Expect(field.ValueString[1], gs.Equals, "2.10")
+			value, _ := msg.GetString("Currency")
+			c.Expect(value, gs.Equals, "USD")
+			field = msg.FindFirstField("All")
+			c.Expect(len(field.ValueString), gs.Equals, 3)
+		})
+
+		c.Specify("keeps the payload if asked to", func() {
+			config.PayloadKeep = true
+			c.Assume(decode(soapXml), gs.IsNil)
+			c.Expect(msg.GetPayload(), gs.Equals, soapXml)
+		})
+
+		c.Specify("fails on malformed XML", func() {
+			c.Expect(decode("<a><b></a>"), gs.Not(gs.IsNil))
+			c.Expect(decode("not xml"), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("fails on headers that can't be set", func() {
+			config.MapFields = map[string]string{"Pid": "//Computer"}
+			c.Expect(decode(windowsEventXml), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("rejects invalid config", func() {
+			config.Fields = map[string]string{"x": "/x:Event"}
+			c.Expect(decoder.Init(config), gs.Not(gs.IsNil))
+			config.Fields = map[string]string{"x": "Event"}
+			c.Expect(decoder.Init(config), gs.Not(gs.IsNil))
+			config.Fields = map[string]string{"x": "/Event/@Name/x"}
+			c.Expect(decoder.Init(config), gs.Not(gs.IsNil))
+			config.Fields = map[string]string{"x": "/Event[0]"}
+			c.Expect(decoder.Init(config), gs.Not(gs.IsNil))
+			config.Fields = nil
+			config.MapFields = map[string]string{"Payload": "/Event"}
+			c.Expect(decoder.Init(config), gs.Not(gs.IsNil))
+		})
+	})
+}
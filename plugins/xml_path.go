@@ -0,0 +1,348 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package plugins
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// An element of a parsed XML document.
+type xmlNode struct {
+	name     xml.Name
+	attrs    []xml.Attr
+	children []*xmlNode
+	// Span of the element's text content in the document's text, all of the
+	// character data being kept in a single buffer.
+	textStart int
+	textEnd   int
+}
+
+type xmlDoc struct {
+	// Holds the document element, the way the XPath root node does.
+	root *xmlNode
+	text []byte
+}
+
+// Parses an XML document, resolving the namespaces of its element and
+// attribute names.
+func parseXml(data string) (*xmlDoc, error) {
+	d := xml.NewDecoder(strings.NewReader(data))
+	// The payload has already been read as text, whatever encoding the XML
+	// declaration mentions.
+	d.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	doc := &xmlDoc{root: new(xmlNode)}
+	stack := []*xmlNode{doc.root}
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			n := &xmlNode{name: t.Name, attrs: t.Attr, textStart: len(doc.text)}
+			parent := stack[len(stack)-1]
+			parent.children = append(parent.children, n)
+			stack = append(stack, n)
+		case xml.EndElement:
+			stack[len(stack)-1].textEnd = len(doc.text)
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			if len(stack) > 1 {
+				doc.text = append(doc.text, t...)
+			}
+		}
+	}
+	if len(doc.root.children) == 0 {
+		return nil, errors.New("no XML element found")
+	}
+	doc.root.textEnd = len(doc.text)
+	return doc, nil
+}
+
+// Returns the text content of the node, w/o surrounding whitespace.
+func (doc *xmlDoc) value(n *xmlNode) string {
+	return strings.TrimSpace(string(doc.text[n.textStart:n.textEnd]))
+}
+
+// Matches element or attribute names.
+type xmlName struct {
+	space string
+	local string
+	// Set for names w/o a prefix, which match the local name in any
+	// namespace.
+	anySpace bool
+}
+
+func (xn xmlName) matches(name xml.Name) bool {
+	return (xn.local == "*" || xn.local == name.Local) &&
+		(xn.anySpace || xn.space == name.Space)
+}
+
+// Filters the nodes selected by a step.
+type xmlPredicate struct {
+	// Position of the node among those selected, starting at 1, or 0 for a
+	// comparison.
+	index int
+	attr  bool
+	name  xmlName
+	value string
+}
+
+// One step of an XML path, selecting child elements, or attributes if it's
+// the last step.
+type xmlStep struct {
+	// Selects descendants rather than children, i.e. preceded by "//".
+	descendant bool
+	attr       bool
+	name       xmlName
+	predicates []xmlPredicate
+}
+
+// A compiled XPath-like expression.
+type xmlPath struct {
+	expr  string
+	steps []xmlStep
+}
+
+// Compiles an absolute path made of element name steps, optionally ending
+// w/ an attribute step, e.g. `/soap:Envelope//m:Price/@currency`. Name
+// prefixes are looked up in namespaces. Each step can have predicates, of
+// the [N], [@attr='value'] or [child='value'] forms.
+func compileXmlPath(expr string, namespaces map[string]string) (*xmlPath, error) {
+	p := &xmlPath{expr: expr}
+	rest := expr
+	for rest != "" {
+		if rest[0] != '/' {
+			return nil, fmt.Errorf("expected '/' at '%s'", rest)
+		}
+		var step xmlStep
+		rest = rest[1:]
+		if strings.HasPrefix(rest, "/") {
+			step.descendant = true
+			rest = rest[1:]
+		}
+		end := xmlStepEnd(rest)
+		if err := step.parse(rest[:end], namespaces); err != nil {
+			return nil, err
+		}
+		rest = rest[end:]
+		if step.attr && rest != "" {
+			return nil, errors.New("attribute step must be the last one")
+		}
+		p.steps = append(p.steps, step)
+	}
+	if len(p.steps) == 0 {
+		return nil, errors.New("empty path")
+	}
+	return p, nil
+}
+
+// Returns the length of the step at the start of s, which ends at the first
+// slash outside of quotes.
+func xmlStepEnd(s string) int {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '/':
+			return i
+		}
+	}
+	return len(s)
+}
+
+func (step *xmlStep) parse(s string, namespaces map[string]string) (err error) {
+	if strings.HasPrefix(s, "@") {
+		step.attr = true
+		s = s[1:]
+	}
+	name := s
+	if i := strings.IndexByte(s, '['); i >= 0 {
+		name, s = s[:i], s[i:]
+	} else {
+		s = ""
+	}
+	if step.name, err = parseXmlName(name, namespaces); err != nil {
+		return err
+	}
+	for s != "" {
+		end := strings.IndexByte(s, ']')
+		if s[0] != '[' || end < 0 {
+			return fmt.Errorf("malformed predicate '%s'", s)
+		}
+		pred, err := parseXmlPredicate(s[1:end], namespaces)
+		if err != nil {
+			return err
+		}
+		step.predicates = append(step.predicates, pred)
+		s = s[end+1:]
+	}
+	return nil
+}
+
+func parseXmlName(name string, namespaces map[string]string) (xmlName, error) {
+	if name == "" {
+		return xmlName{}, errors.New("missing name")
+	}
+	i := strings.IndexByte(name, ':')
+	if i < 0 {
+		return xmlName{local: name, anySpace: true}, nil
+	}
+	space, ok := namespaces[name[:i]]
+	if !ok {
+		return xmlName{}, fmt.Errorf("unknown namespace prefix '%s'", name[:i])
+	}
+	return xmlName{space: space, local: name[i+1:]}, nil
+}
+
+func parseXmlPredicate(s string, namespaces map[string]string) (
+	pred xmlPredicate, err error) {
+
+	if n, err := strconv.Atoi(s); err == nil {
+		if n < 1 {
+			return pred, fmt.Errorf("invalid position [%s]", s)
+		}
+		pred.index = n
+		return pred, nil
+	}
+	i := strings.IndexByte(s, '=')
+	if i < 0 {
+		return pred, fmt.Errorf("unsupported predicate [%s]", s)
+	}
+	name := strings.TrimSpace(s[:i])
+	value := strings.TrimSpace(s[i+1:])
+	if len(value) < 2 || (value[0] != '\'' && value[0] != '"') ||
+		value[len(value)-1] != value[0] {
+		return pred, fmt.Errorf("predicate [%s] value must be quoted", s)
+	}
+	pred.value = value[1 : len(value)-1]
+	if strings.HasPrefix(name, "@") {
+		pred.attr = true
+		name = name[1:]
+	}
+	pred.name, err = parseXmlName(name, namespaces)
+	return pred, err
+}
+
+// Returns the text content of the elements, or the values of the
+// attributes, the path selects in the document.
+func (p *xmlPath) eval(doc *xmlDoc) (values []string) {
+	nodes := []*xmlNode{doc.root}
+	for _, step := range p.steps {
+		if step.descendant {
+			nodes = xmlDescendantsOrSelf(nodes)
+		}
+		if step.attr {
+			for _, n := range nodes {
+				for _, a := range n.attrs {
+					if a.Name.Space != "xmlns" && a.Name.Local != "xmlns" &&
+						step.name.matches(a.Name) {
+						values = append(values, a.Value)
+					}
+				}
+			}
+			return values
+		}
+		var next []*xmlNode
+		for _, n := range nodes {
+			next = append(next, step.selectChildren(doc, n)...)
+		}
+		nodes = next
+	}
+	for _, n := range nodes {
+		values = append(values, doc.value(n))
+	}
+	return values
+}
+
+// Returns the node's children matching the step's name and predicates.
+func (step *xmlStep) selectChildren(doc *xmlDoc, n *xmlNode) []*xmlNode {
+	var selected []*xmlNode
+	for _, child := range n.children {
+		if step.name.matches(child.name) {
+			selected = append(selected, child)
+		}
+	}
+	for _, pred := range step.predicates {
+		if pred.index > 0 {
+			if pred.index > len(selected) {
+				return nil
+			}
+			selected = selected[pred.index-1 : pred.index]
+			continue
+		}
+		kept := selected[:0]
+		for _, s := range selected {
+			if pred.matches(doc, s) {
+				kept = append(kept, s)
+			}
+		}
+		selected = kept
+	}
+	return selected
+}
+
+func (pred *xmlPredicate) matches(doc *xmlDoc, n *xmlNode) bool {
+	if pred.attr {
+		for _, a := range n.attrs {
+			if pred.name.matches(a.Name) && a.Value == pred.value {
+				return true
+			}
+		}
+		return false
+	}
+	for _, child := range n.children {
+		if pred.name.matches(child.name) && doc.value(child) == pred.value {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the nodes and all of their descendants, each only once.
+func xmlDescendantsOrSelf(nodes []*xmlNode) []*xmlNode {
+	var all []*xmlNode
+	seen := make(map[*xmlNode]bool)
+	var walk func(n *xmlNode)
+	walk = func(n *xmlNode) {
+		if seen[n] {
+			return
+		}
+		seen[n] = true
+		all = append(all, n)
+		for _, child := range n.children {
+			walk(child)
+		}
+	}
+	for _, n := range nodes {
+		walk(n)
+	}
+	return all
+}
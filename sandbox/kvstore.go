@@ -0,0 +1,136 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package sandbox
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	KV_EXT        = ".kv"
+	KV_MAX_KEY    = 1024
+	kvBucket      = "kv"
+	kvOpenTimeout = 5 * time.Second
+)
+
+var (
+	ErrKvQuota   = errors.New("kv store quota exceeded")
+	ErrKvBadKey  = errors.New("kv keys must be 1 to 1024 bytes long")
+	ErrKvBadSize = errors.New("kv store quota must be greater than 0")
+)
+
+// Persistent key/value store available to a single sandbox. Unlike preserved
+// data, which is only written when the sandbox shuts down, every change is
+// written to disk as it's made, and the store survives script changes that
+// would cause preserved data to be discarded. The total size of the keys and
+// values is limited by the quota.
+type KvStore struct {
+	size  int64 // Read by the plugin's ReportMsg, accessed atomically.
+	db    *bolt.DB
+	quota int64
+}
+
+// Opens (creating if necessary) the key/value store in the given file.
+func OpenKvStore(path string, quota uint) (*KvStore, error) {
+	if quota == 0 {
+		return nil, ErrKvBadSize
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: kvOpenTimeout})
+	if err != nil {
+		return nil, err
+	}
+	s := &KvStore{db: db, quota: int64(quota)}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(kvBucket))
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			s.size += int64(len(k) + len(v))
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Returns the value stored under the key, and whether there was one.
+func (s *KvStore) Get(key string) (value string, ok bool, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket([]byte(kvBucket)).Get([]byte(key)); v != nil {
+			value, ok = string(v), true
+		}
+		return nil
+	})
+	return
+}
+
+// Stores the value under the key, replacing any existing value. Returns
+// ErrKvQuota w/o storing anything if that would take the store over its
+// quota.
+func (s *KvStore) Set(key, value string) error {
+	if len(key) == 0 || len(key) > KV_MAX_KEY {
+		return ErrKvBadKey
+	}
+	size := atomic.LoadInt64(&s.size) + int64(len(key)+len(value))
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(kvBucket))
+		if old := b.Get([]byte(key)); old != nil {
+			size -= int64(len(key) + len(old))
+		}
+		if size > s.quota {
+			return ErrKvQuota
+		}
+		return b.Put([]byte(key), []byte(value))
+	})
+	if err == nil {
+		atomic.StoreInt64(&s.size, size)
+	}
+	return err
+}
+
+// Removes the key from the store, if it's there.
+func (s *KvStore) Delete(key string) error {
+	size := atomic.LoadInt64(&s.size)
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(kvBucket))
+		old := b.Get([]byte(key))
+		if old == nil {
+			return nil
+		}
+		size -= int64(len(key) + len(old))
+		return b.Delete([]byte(key))
+	})
+	if err == nil {
+		atomic.StoreInt64(&s.size, size)
+	}
+	return err
+}
+
+// Total size of the stored keys and values, in bytes.
+func (s *KvStore) Size() int64 {
+	return atomic.LoadInt64(&s.size)
+}
+
+func (s *KvStore) Close() error {
+	return s.db.Close()
+}
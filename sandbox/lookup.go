@@ -0,0 +1,335 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package sandbox
+
+import (
+	"bufio"
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const LOOKUP_MAX_VALUE = 64 * 1024
+
+var (
+	ErrLookupSource = errors.New("unknown lookup source")
+	ErrLookupBusy   = errors.New("too many concurrent lookups")
+	ErrLookupSize   = errors.New("lookup value too large")
+)
+
+// Configuration for a single source of the sandbox lookup() function.
+type LookupConfig struct {
+	// Either "http" or "redis".
+	Type string
+	// HTTP sources: URL to request, w/ "%s" replaced by the query escaped
+	// key. A 200 response's body is the value, a 404 means there isn't one.
+	Url string
+	// Redis sources: host:port of the server; the value is the result of a
+	// GET of the key prefixed w/ KeyPrefix.
+	Address   string
+	KeyPrefix string `toml:"key_prefix"`
+	// Maximum time in milliseconds a lookup can take, including waiting for
+	// a free connection.
+	Timeout uint
+	// Maximum number of lookups in flight at once.
+	MaxConcurrent uint `toml:"max_concurrent"`
+	// Number of keys to cache, 0 to use the default and -1 to disable.
+	CacheSize int `toml:"cache_size"`
+	// Seconds a cached value (or the lack of one) is used for.
+	CacheTtl uint `toml:"cache_ttl"`
+}
+
+type lookupFetcher interface {
+	fetch(key string, deadline time.Time) (value string, ok bool, err error)
+	close()
+}
+
+type cacheEntry struct {
+	key     string
+	value   string
+	ok      bool
+	expires time.Time
+}
+
+// LRU cache of lookup results.
+type lookupCache struct {
+	size    int
+	ttl     time.Duration
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+func (c *lookupCache) get(key string, now time.Time) (e *cacheEntry) {
+	if el, ok := c.entries[key]; ok {
+		e = el.Value.(*cacheEntry)
+		if now.Before(e.expires) {
+			c.lru.MoveToFront(el)
+			return e
+		}
+		c.lru.Remove(el)
+		delete(c.entries, key)
+	}
+	return nil
+}
+
+func (c *lookupCache) add(key, value string, ok bool, now time.Time) {
+	if c.size <= 0 {
+		return
+	}
+	if el, found := c.entries[key]; found {
+		c.lru.Remove(el)
+	} else if c.lru.Len() >= c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+	e := &cacheEntry{key: key, value: value, ok: ok, expires: now.Add(c.ttl)}
+	c.entries[key] = c.lru.PushFront(e)
+}
+
+type lookupSource struct {
+	fetcher lookupFetcher
+	timeout time.Duration
+	slots   chan struct{} // Limits the number of concurrent lookups.
+	lock    sync.Mutex    // Protects the cache.
+	cache   lookupCache
+}
+
+// The configured lookup sources of a plugin, shared by every sandbox the
+// plugin creates so the cache outlives script reloads.
+type Lookup struct {
+	sources map[string]*lookupSource
+}
+
+func NewLookup(configs map[string]LookupConfig) (*Lookup, error) {
+	l := &Lookup{sources: make(map[string]*lookupSource)}
+	for name, conf := range configs {
+		if conf.Timeout == 0 {
+			conf.Timeout = 250
+		}
+		if conf.MaxConcurrent == 0 {
+			conf.MaxConcurrent = 4
+		}
+		if conf.CacheSize == 0 {
+			conf.CacheSize = 10000
+		}
+		if conf.CacheTtl == 0 {
+			conf.CacheTtl = 300
+		}
+		src := &lookupSource{
+			timeout: time.Duration(conf.Timeout) * time.Millisecond,
+			slots:   make(chan struct{}, conf.MaxConcurrent),
+			cache: lookupCache{
+				size:    conf.CacheSize,
+				ttl:     time.Duration(conf.CacheTtl) * time.Second,
+				entries: make(map[string]*list.Element),
+				lru:     list.New(),
+			},
+		}
+		switch conf.Type {
+		case "http":
+			if !strings.Contains(conf.Url, "%s") {
+				l.Close()
+				return nil, fmt.Errorf("lookup %s: url must contain %%s", name)
+			}
+			src.fetcher = &httpFetcher{
+				url:    conf.Url,
+				client: &http.Client{Timeout: src.timeout},
+			}
+		case "redis":
+			if conf.Address == "" {
+				l.Close()
+				return nil, fmt.Errorf("lookup %s: address must be specified", name)
+			}
+			src.fetcher = &redisFetcher{
+				address: conf.Address,
+				prefix:  conf.KeyPrefix,
+				idle:    make(chan *redisConn, conf.MaxConcurrent),
+			}
+		default:
+			l.Close()
+			return nil, fmt.Errorf("lookup %s: unsupported type: %s", name, conf.Type)
+		}
+		l.sources[name] = src
+	}
+	return l, nil
+}
+
+// Returns the value of the key in the named source, and whether there was
+// one. Both values and missing keys are served from the cache until they
+// expire; failed lookups aren't cached.
+func (l *Lookup) Lookup(source, key string) (value string, ok bool, err error) {
+	src, found := l.sources[source]
+	if !found {
+		return "", false, ErrLookupSource
+	}
+	now := time.Now()
+	src.lock.Lock()
+	e := src.cache.get(key, now)
+	src.lock.Unlock()
+	if e != nil {
+		return e.value, e.ok, nil
+	}
+
+	deadline := now.Add(src.timeout)
+	timer := time.NewTimer(src.timeout)
+	select {
+	case src.slots <- struct{}{}:
+		timer.Stop()
+	case <-timer.C:
+		return "", false, ErrLookupBusy
+	}
+	value, ok, err = src.fetcher.fetch(key, deadline)
+	<-src.slots
+	if err != nil {
+		return "", false, err
+	}
+
+	src.lock.Lock()
+	src.cache.add(key, value, ok, time.Now())
+	src.lock.Unlock()
+	return value, ok, nil
+}
+
+func (l *Lookup) Close() {
+	for _, src := range l.sources {
+		src.fetcher.close()
+	}
+}
+
+type httpFetcher struct {
+	url    string
+	client *http.Client
+}
+
+func (h *httpFetcher) fetch(key string, deadline time.Time) (string, bool, error) {
+	resp, err := h.client.Get(strings.Replace(h.url, "%s", url.QueryEscape(key), -1))
+	if err != nil {
+		return "", false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return "", false, nil
+	default:
+		return "", false, fmt.Errorf("HTTP status %d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, LOOKUP_MAX_VALUE+1))
+	if err != nil {
+		return "", false, err
+	}
+	if len(body) > LOOKUP_MAX_VALUE {
+		return "", false, ErrLookupSize
+	}
+	return string(body), true, nil
+}
+
+func (h *httpFetcher) close() {}
+
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// Minimal Redis client, only GET is needed.
+type redisFetcher struct {
+	address string
+	prefix  string
+	idle    chan *redisConn
+}
+
+func (r *redisFetcher) fetch(key string, deadline time.Time) (string, bool, error) {
+	var rc *redisConn
+	select {
+	case rc = <-r.idle:
+	default:
+		conn, err := net.DialTimeout("tcp", r.address, deadline.Sub(time.Now()))
+		if err != nil {
+			return "", false, err
+		}
+		rc = &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+	}
+	value, ok, err := rc.get(r.prefix+key, deadline)
+	if err != nil {
+		// The connection's state is unknown.
+		rc.conn.Close()
+		return "", false, err
+	}
+	select {
+	case r.idle <- rc:
+	default:
+		rc.conn.Close()
+	}
+	return value, ok, nil
+}
+
+func (r *redisFetcher) close() {
+	for {
+		select {
+		case rc := <-r.idle:
+			rc.conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+func (rc *redisConn) get(key string, deadline time.Time) (string, bool, error) {
+	rc.conn.SetDeadline(deadline)
+	_, err := fmt.Fprintf(rc.conn, "*2\r\n$3\r\nGET\r\n$%d\r\n%s\r\n", len(key), key)
+	if err != nil {
+		return "", false, err
+	}
+	line, err := rc.reader.ReadString('\n')
+	if err != nil {
+		return "", false, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if len(line) == 0 {
+		return "", false, errors.New("invalid redis reply")
+	}
+	switch line[0] {
+	case '$':
+	case '-':
+		return "", false, fmt.Errorf("redis error: %s", line[1:])
+	default:
+		return "", false, fmt.Errorf("unexpected redis reply: %s", line)
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return "", false, errors.New("invalid redis reply")
+	}
+	if n < 0 { // nil bulk reply
+		return "", false, nil
+	}
+	if n > LOOKUP_MAX_VALUE {
+		return "", false, ErrLookupSize
+	}
+	buf := make([]byte, n+2)
+	if _, err = io.ReadFull(rc.reader, buf); err != nil {
+		return "", false, err
+	}
+	return string(buf[:n]), true, nil
+}
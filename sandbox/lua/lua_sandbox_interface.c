@@ -268,9 +268,9 @@ int write_message(lua_State* lua)
     }
     case LUA_TSTRING: {
         size_t len;
-        const char* value = lua_tostring(lua, 2);
+        const char* value = lua_tolstring(lua, 2, &len);
         result = go_lua_write_message_string(lsb_get_parent(lsb), (char*)field,
-            (char*)value, (char*)rep, fi, ai);
+            (char*)value, (int)len, (char*)rep, fi, ai);
         break;
     }
     case LUA_TNIL: {
@@ -477,7 +477,139 @@ int inject_payload(lua_State* lua)
 }
 
 ////////////////////////////////////////////////////////////////////////////////
-int sandbox_init(lua_sandbox* lsb, const char* data_file, const char* plugin_type)
+static lua_sandbox* kv_sandbox(lua_State* lua, const char* fn)
+{
+    void* luserdata = lua_touserdata(lua, lua_upvalueindex(1));
+    if (NULL == luserdata) {
+        luaL_error(lua, "%s invalid lightuserdata", fn);
+    }
+    return (lua_sandbox*)luserdata;
+}
+
+////////////////////////////////////////////////////////////////////////////////
+static void kv_error(lua_State* lua, const char* fn, int result)
+{
+    switch (result) {
+    case 0:
+        break;
+    case 1:
+        luaL_error(lua, "%s quota exceeded", fn);
+        break;
+    case 2:
+        luaL_error(lua, "%s invalid key", fn);
+        break;
+    default:
+        luaL_error(lua, "%s store error", fn);
+        break;
+    }
+}
+
+////////////////////////////////////////////////////////////////////////////////
+int kv_get(lua_State* lua)
+{
+    static const char* fn = "kv_get()";
+    lua_sandbox* lsb = kv_sandbox(lua, fn);
+    if (lua_gettop(lua) != 1) {
+        luaL_error(lua, "%s takes a single key argument", fn);
+    }
+    size_t len = 0;
+    const char* key = luaL_checklstring(lua, 1, &len);
+
+    struct go_lua_kv_get_return gr;
+    // Cast away constness of the Lua string, the value is not modified
+    // and it will save a copy.
+    gr = go_lua_kv_get(lsb_get_parent(lsb), (char*)key, (int)len);
+    switch (gr.r0) {
+    case 0:
+        lua_pushlstring(lua, gr.r1, gr.r2);
+        free(gr.r1);
+        break;
+    case 1:
+        lua_pushnil(lua);
+        break;
+    default:
+        kv_error(lua, fn, 3);
+        break;
+    }
+    return 1;
+}
+
+////////////////////////////////////////////////////////////////////////////////
+int kv_set(lua_State* lua)
+{
+    static const char* fn = "kv_set()";
+    lua_sandbox* lsb = kv_sandbox(lua, fn);
+    int t = lua_type(lua, 2);
+    if (lua_gettop(lua) != 2 || (t != LUA_TSTRING && t != LUA_TNUMBER)) {
+        luaL_error(lua, "%s takes a key and a string or number value", fn);
+    }
+    size_t klen = 0, vlen = 0;
+    const char* key = luaL_checklstring(lua, 1, &klen);
+    const char* value = lua_tolstring(lua, 2, &vlen);
+
+    int result = go_lua_kv_set(lsb_get_parent(lsb), (char*)key, (int)klen,
+                               (char*)value, (int)vlen);
+    kv_error(lua, fn, result);
+    return 0;
+}
+
+////////////////////////////////////////////////////////////////////////////////
+int kv_delete(lua_State* lua)
+{
+    static const char* fn = "kv_delete()";
+    lua_sandbox* lsb = kv_sandbox(lua, fn);
+    if (lua_gettop(lua) != 1) {
+        luaL_error(lua, "%s takes a single key argument", fn);
+    }
+    size_t len = 0;
+    const char* key = luaL_checklstring(lua, 1, &len);
+
+    int result = go_lua_kv_delete(lsb_get_parent(lsb), (char*)key, (int)len);
+    kv_error(lua, fn, result);
+    return 0;
+}
+
+////////////////////////////////////////////////////////////////////////////////
+int lookup_value(lua_State* lua)
+{
+    static const char* fn = "lookup()";
+    void* luserdata = lua_touserdata(lua, lua_upvalueindex(1));
+    if (NULL == luserdata) {
+        luaL_error(lua, "%s invalid lightuserdata", fn);
+    }
+    lua_sandbox* lsb = (lua_sandbox*)luserdata;
+    if (lua_gettop(lua) != 2) {
+        luaL_error(lua, "%s takes a source and a key argument", fn);
+    }
+    const char* source = luaL_checkstring(lua, 1);
+    size_t len = 0;
+    const char* key = luaL_checklstring(lua, 2, &len);
+
+    struct go_lua_lookup_return gr;
+    gr = go_lua_lookup(lsb_get_parent(lsb), (char*)source, (char*)key, (int)len);
+    switch (gr.r0) {
+    case 0:
+        lua_pushlstring(lua, gr.r1, gr.r2);
+        free(gr.r1);
+        return 1;
+    case 1:
+        lua_pushnil(lua);
+        return 1;
+    case 2:
+        lua_pushnil(lua);
+        lua_pushlstring(lua, gr.r1, gr.r2);
+        free(gr.r1);
+        return 2;
+    default:
+        luaL_error(lua, "%s unknown source: %s", fn, source);
+        break;
+    }
+    return 0;
+}
+
+////////////////////////////////////////////////////////////////////////////////
+int sandbox_init(lua_sandbox* lsb, const char* data_file, const char* plugin_type,
+                 int kv_store, int lookup_sources)
 {
     static const char *output = "output";
     if (!lsb || !plugin_type) return 1;
@@ -487,6 +619,16 @@ int sandbox_init(lua_sandbox* lsb, const char* data_file, const char* plugin_typ
     lsb_add_function(lsb, &read_config, "read_config");
     lsb_add_function(lsb, &lsb_decode_protobuf, "decode_message");
 
+    if (kv_store) {
+        lsb_add_function(lsb, &kv_get, "kv_get");
+        lsb_add_function(lsb, &kv_set, "kv_set");
+        lsb_add_function(lsb, &kv_delete, "kv_delete");
+    }
+
+    if (lookup_sources) {
+        lsb_add_function(lsb, &lookup_value, "lookup");
+    }
+
     if (strcmp(plugin_type, "input") == 0) {
         lsb_add_function(lsb, &inject_message, "inject_message");
     }
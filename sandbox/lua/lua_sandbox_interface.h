@@ -79,16 +79,60 @@ int read_next_field(lua_State* lua);
 */
 int inject_message(lua_State* lua);
 
+/**
+* Returns the value stored under a key in the plugin's key/value store, or nil
+* if there is none.
+*
+* @param lua Pointer to the Lua state.
+*
+* @return int Returns one value on the stack.
+*/
+int kv_get(lua_State* lua);
+
+/**
+* Stores a string or number value under a key in the plugin's key/value store.
+* Raises an error if the store's quota would be exceeded.
+*
+* @param lua Pointer to the Lua state.
+*
+* @return int Returns zero values on the stack.
+*/
+int kv_set(lua_State* lua);
+
+/**
+* Removes a key from the plugin's key/value store.
+*
+* @param lua Pointer to the Lua state.
+*
+* @return int Returns zero values on the stack.
+*/
+int kv_delete(lua_State* lua);
+
+/**
+* Looks up a key in one of the plugin's configured lookup sources.
+*
+* @param lua Pointer to the Lua state.
+*
+* @return int Returns the value, or nil and an error message if the lookup
+*             failed, on the stack.
+*/
+int lookup_value(lua_State* lua);
+
 /**
  * Initializes the sandbox and sets up the above callbacks.
  *
  * @param lsb Pointer to the sandbox.
  * @param data_file File used for the data restoration (empty or NULL for no
  *                  restoration)
+ * @param plugin_type Type of plugin the sandbox is running in
+ * @param kv_store Non-zero if the key/value store functions should be
+ *                 available
+ * @param lookup_sources Non-zero if the lookup function should be available
  *
  * @return int 0 on success
  */
-int sandbox_init(lua_sandbox* lsb, const char* data_file, const char* plugin_type);
+int sandbox_init(lua_sandbox* lsb, const char* data_file, const char* plugin_type,
+                 int kv_store, int lookup_sources);
 
 /**
  * Sends a shutdown message to the sandbox.
@@ -15,6 +15,9 @@
 package lua_test
 
 import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -1218,6 +1221,134 @@ func TestElasticSearch(t *testing.T) {
 	sb.Destroy("")
 }
 
+func TestKvStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "kv"+KV_EXT)
+
+	var sbc SandboxConfig
+	sbc.ScriptFilename = "./testsupport/kv.lua"
+	sbc.MemoryLimit = 32767
+	sbc.InstructionLimit = 1000
+	sbc.OutputLimit = 1024
+	sbc.PluginType = "filter"
+	pack := getTestPack()
+
+	var payloads []string
+	run := func(timerEvent bool) {
+		if sbc.KvStore, err = OpenKvStore(path, 64); err != nil {
+			t.Fatalf("%s", err)
+		}
+		defer sbc.KvStore.Close()
+		sb, err := lua.CreateLuaSandbox(&sbc)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		defer sb.Destroy("")
+		if err = sb.Init(""); err != nil {
+			t.Fatalf("%s", err)
+		}
+		sb.InjectMessage(func(p, pt, pn string) int {
+			payloads = append(payloads, p)
+			return 0
+		})
+		for i := 0; i < 2; i++ {
+			if r := sb.ProcessMessage(pack); r != 0 {
+				t.Fatalf("ProcessMessage() expected: 0, received: %d %s", r, sb.LastError())
+			}
+		}
+		if timerEvent {
+			if r := sb.TimerEvent(0); r != 0 {
+				t.Fatalf("TimerEvent() expected: 0, received: %d %s", r, sb.LastError())
+			}
+		}
+	}
+
+	run(false)
+	run(true) // the count must survive reopening the store
+	run(false)
+	expected := []string{"1", "2", "3", "4", "kv_set() quota exceeded", "1", "2"}
+	if len(payloads) != len(expected) {
+		t.Fatalf("expected %d payloads, received: %v", len(expected), payloads)
+	}
+	for i, p := range payloads {
+		if p != expected[i] {
+			t.Errorf("payload %d expected: %s, received: %s", i, expected[i], p)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch r.URL.Query().Get("id") {
+		case "1":
+			w.Write([]byte("alice"))
+		case "2":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	var sbc SandboxConfig
+	sbc.ScriptFilename = "./testsupport/lookup.lua"
+	sbc.MemoryLimit = 32767
+	sbc.InstructionLimit = 1000
+	sbc.OutputLimit = 1024
+	sbc.PluginType = "filter"
+	var err error
+	sbc.Lookup, err = NewLookup(map[string]LookupConfig{
+		"accounts": {Type: "http", Url: server.URL + "/?id=%s"},
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer sbc.Lookup.Close()
+	sb, err := lua.CreateLuaSandbox(&sbc)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer sb.Destroy("")
+	if err = sb.Init(""); err != nil {
+		t.Fatalf("%s", err)
+	}
+	var payloads []string
+	sb.InjectMessage(func(p, pt, pn string) int {
+		payloads = append(payloads, p)
+		return 0
+	})
+
+	pack := getTestPack()
+	for _, key := range []string{"1", "2", "3", "1", "2"} {
+		pack.Message.SetPayload(key)
+		if r := sb.ProcessMessage(pack); r != 0 {
+			t.Fatalf("ProcessMessage() expected: 0, received: %d %s", r, sb.LastError())
+		}
+	}
+	if r := sb.TimerEvent(0); r != 0 {
+		t.Fatalf("TimerEvent() expected: 0, received: %d %s", r, sb.LastError())
+	}
+	expected := []string{"alice", "nil", "error", "alice", "nil",
+		"lookup() unknown source: unknown"}
+	if len(payloads) != len(expected) {
+		t.Fatalf("expected %d payloads, received: %v", len(expected), payloads)
+	}
+	for i, p := range payloads {
+		if p != expected[i] {
+			t.Errorf("payload %d expected: %s, received: %s", i, expected[i], p)
+		}
+	}
+	if requests != 3 {
+		t.Errorf("expected 3 requests, the rest cached, received: %d", requests)
+	}
+}
+
 func BenchmarkSandboxCreateInitDestroy(b *testing.B) {
 	var sbc SandboxConfig
 	sbc.ScriptFilename = "./testsupport/serialize.lua"
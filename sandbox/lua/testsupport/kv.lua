@@ -0,0 +1,18 @@
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+function process_message ()
+    local count = tonumber(kv_get("count")) or 0
+    count = count + 1
+    kv_set("count", count)
+    inject_payload("txt", "", count)
+    return 0
+end
+
+function timer_event()
+    local ok, err = pcall(kv_set, "big", string.rep("x", 100))
+    if ok then error("quota not enforced") end
+    inject_payload("txt", "", err)
+    kv_delete("count")
+end
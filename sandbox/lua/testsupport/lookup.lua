@@ -0,0 +1,18 @@
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+function process_message ()
+    local value, err = lookup("accounts", read_message("Payload"))
+    if err then
+        inject_payload("txt", "", "error")
+    else
+        inject_payload("txt", "", value or "nil")
+    end
+    return 0
+end
+
+function timer_event()
+    local ok, err = pcall(lookup, "unknown", "1")
+    inject_payload("txt", "", err)
+end
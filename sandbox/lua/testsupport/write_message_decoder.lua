@@ -18,6 +18,10 @@ function process_message ()
 		write_message("Type", "my_type")
 		write_message("Payload", "my_payload")
 	end
+	if msg:sub(1, 6) == "binary" then
+		write_message("Payload", msg .. "\0\255")
+		write_message("Fields[binary]", msg)
+	end
 	if msg == "set field value with representation" then
 		write_message("Fields[rep]", "foo", "representation")
 	end
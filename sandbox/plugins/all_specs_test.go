@@ -34,6 +34,8 @@ func TestAllSpecs(t *testing.T) {
 	r.AddSpec(DecoderSpec)
 	r.AddSpec(EncoderSpec)
 	r.AddSpec(OutputSpec)
+	r.AddSpec(ReloadSpec)
+	r.AddSpec(RegistrySpec)
 
 	gs.MainGoTest(r, t)
 }
@@ -25,11 +25,11 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/gogo/protobuf/proto"
 	"github.com/mozilla-services/heka/message"
 	"github.com/mozilla-services/heka/pipeline"
 	. "github.com/mozilla-services/heka/sandbox"
 	"github.com/mozilla-services/heka/sandbox/lua"
+	"github.com/mozilla-services/heka/sandbox/wasm"
 	"github.com/pborman/uuid"
 )
 
@@ -51,6 +51,8 @@ type SandboxDecoder struct {
 	tz                     *time.Location
 	sampleDenominator      int
 	pConfig                *pipeline.PipelineConfig
+	inject                 func(payload, payload_type, payload_name string) int
+	watcher                *scriptWatcher
 }
 
 func (s *SandboxDecoder) ConfigStruct() interface{} {
@@ -92,7 +94,7 @@ func (s *SandboxDecoder) Init(config interface{}) (err error) {
 	}
 
 	switch s.sbc.ScriptType {
-	case "lua":
+	case "lua", "wasm":
 	default:
 		return fmt.Errorf("unsupported script type: %s", s.sbc.ScriptType)
 	}
@@ -147,11 +149,28 @@ func (s *SandboxDecoder) SetDecoderRunner(dr pipeline.DecoderRunner) {
 	var original *message.Message
 	var err error
 
-	switch s.sbc.ScriptType {
-	case "lua":
-		s.sb, err = lua.CreateLuaSandbox(s.sbc)
-	default:
-		err = fmt.Errorf("unsupported script type: %s", s.sbc.ScriptType)
+	if s.sbc.UseKvStore {
+		s.sbc.KvStore, err = OpenKvStore(filepath.Join(
+			s.pConfig.Globals.PrependBaseDir(DATA_DIR), dr.Name()+KV_EXT),
+			s.sbc.KvStoreQuota)
+		if err != nil {
+			err = fmt.Errorf("can't open the kv store: %s", err)
+		}
+	}
+
+	if err == nil && len(s.sbc.Lookups) > 0 {
+		s.sbc.Lookup, err = NewLookup(s.sbc.Lookups)
+	}
+
+	if err == nil {
+		switch s.sbc.ScriptType {
+		case "lua":
+			s.sb, err = lua.CreateLuaSandbox(s.sbc)
+		case "wasm":
+			s.sb, err = wasm.CreateWasmSandbox(s.sbc)
+		default:
+			err = fmt.Errorf("unsupported script type: %s", s.sbc.ScriptType)
+		}
 	}
 
 	if err == nil {
@@ -169,11 +188,19 @@ func (s *SandboxDecoder) SetDecoderRunner(dr pipeline.DecoderRunner) {
 			s.sb.Destroy("")
 			s.sb = nil
 		}
+		if s.sbc.KvStore != nil {
+			s.sbc.KvStore.Close()
+			s.sbc.KvStore = nil
+		}
+		if s.sbc.Lookup != nil {
+			s.sbc.Lookup.Close()
+			s.sbc.Lookup = nil
+		}
 		s.pConfig.Globals.ShutDown(1)
 		return
 	}
 
-	s.sb.InjectMessage(func(payload, payload_type, payload_name string) int {
+	s.inject = func(payload, payload_type, payload_name string) int {
 		if s.pack == nil {
 			s.pack = dr.NewPack()
 			if s.pack == nil {
@@ -200,7 +227,7 @@ func (s *SandboxDecoder) SetDecoderRunner(dr pipeline.DecoderRunner) {
 				original = new(message.Message)
 				copyMessageHeaders(original, s.pack.Message) // save off the header values since unmarshal will wipe them out
 			}
-			if nil != proto.Unmarshal(s.pack.MsgBytes, s.pack.Message) {
+			if nil != message.UnmarshalMessage(s.pack.MsgBytes, s.pack.Message) {
 				return 1
 			}
 			if s.tz != time.UTC {
@@ -254,7 +281,36 @@ func (s *SandboxDecoder) SetDecoderRunner(dr pipeline.DecoderRunner) {
 		s.packs = append(s.packs, s.pack)
 		s.pack = nil
 		return 0
-	})
+	}
+	s.sb.InjectMessage(s.inject)
+
+	if s.sbc.WatchScript {
+		s.watcher = newScriptWatcher(s.sbc.ScriptFilename,
+			time.Duration(s.sbc.WatchInterval)*time.Millisecond)
+	}
+}
+
+// Swaps in the modified script, keeping the sandbox's global state.
+func (s *SandboxDecoder) reload() {
+	s.reportLock.Lock()
+	defer s.reportLock.Unlock()
+	sb, err := reloadSandbox(s.sb, s.sbc, s.preservationFile+".reload")
+	switch {
+	case sb == nil:
+		s.sb = nil
+		s.dRunner.LogError(fmt.Errorf("script reload failed: %s", err))
+		s.pConfig.Globals.ShutDown(1)
+	case sb == s.sb:
+		s.dRunner.LogError(fmt.Errorf("script not reloaded: %s", err))
+	default:
+		s.sb = sb
+		s.sb.InjectMessage(s.inject)
+		if err != nil {
+			s.dRunner.LogError(fmt.Errorf("script reloaded: %s", err))
+		} else {
+			s.dRunner.LogMessage("script reloaded")
+		}
+	}
 }
 
 func (s *SandboxDecoder) Shutdown() {
@@ -276,6 +332,14 @@ func (s *SandboxDecoder) destroy() error {
 		}
 		s.sb = nil
 	}
+	if s.sbc.KvStore != nil {
+		s.sbc.KvStore.Close()
+		s.sbc.KvStore = nil
+	}
+	if s.sbc.Lookup != nil {
+		s.sbc.Lookup.Close()
+		s.sbc.Lookup = nil
+	}
 	s.reportLock.Unlock()
 	return err
 }
@@ -283,6 +347,9 @@ func (s *SandboxDecoder) destroy() error {
 func (s *SandboxDecoder) Decode(pack *pipeline.PipelinePack) (packs []*pipeline.PipelinePack,
 	err error) {
 
+	if s.watcher != nil && s.watcher.due(time.Now()) && s.watcher.modified() {
+		s.reload()
+	}
 	if s.sb == nil {
 		err = fmt.Errorf("SandboxDecoder has been terminated")
 		return
@@ -357,6 +424,9 @@ func (s *SandboxDecoder) ReportMsg(msg *message.Message) error {
 		TYPE_INSTRUCTIONS, STAT_MAXIMUM)), "count")
 	message.NewIntField(msg, "MaxOutput", int(s.sb.Usage(TYPE_OUTPUT,
 		STAT_MAXIMUM)), "B")
+	if s.sbc.KvStore != nil {
+		message.NewInt64Field(msg, "KvStoreSize", s.sbc.KvStore.Size(), "B")
+	}
 	message.NewInt64Field(msg, "ProcessMessageCount", atomic.LoadInt64(&s.processMessageCount), "count")
 	message.NewInt64Field(msg, "ProcessMessageFailures", atomic.LoadInt64(&s.processMessageFailures), "count")
 	message.NewInt64Field(msg, "ProcessMessageSamples", s.processMessageSamples, "count")
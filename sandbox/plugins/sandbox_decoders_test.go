@@ -160,6 +160,19 @@ func DecoderSpec(c gs.Context) {
 				c.Expect(pack.Message.GetPayload(), gs.Equals, "my_payload")
 			})
 
+			c.Specify("round trips binary data", func() {
+				data := "binary\x00\xff"
+				pack.Message.SetPayload(data)
+				packs, err := decoder.Decode(pack)
+				c.Expect(err, gs.IsNil)
+				c.Expect(len(packs), gs.Equals, 1)
+				c.Expect(string(pack.Message.GetPayloadBytes()), gs.Equals,
+					"binary\x00\xff\x00\xff")
+				value, ok := pack.Message.GetFieldValue("binary")
+				c.Expect(ok, gs.IsTrue)
+				c.Expect(value, gs.Equals, data)
+			})
+
 			c.Specify("sets field value with representation", func() {
 				data := "set field value with representation"
 				pack.Message.SetPayload(data)
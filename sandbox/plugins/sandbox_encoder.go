@@ -29,6 +29,7 @@ import (
 	"github.com/mozilla-services/heka/pipeline"
 	"github.com/mozilla-services/heka/sandbox"
 	"github.com/mozilla-services/heka/sandbox/lua"
+	"github.com/mozilla-services/heka/sandbox/wasm"
 )
 
 type SandboxEncoder struct {
@@ -123,6 +124,8 @@ func (s *SandboxEncoder) Init(config interface{}) (err error) {
 	switch s.sbc.ScriptType {
 	case "lua":
 		s.sb, err = lua.CreateLuaSandbox(s.sbc)
+	case "wasm":
+		s.sb, err = wasm.CreateWasmSandbox(s.sbc)
 	default:
 		return fmt.Errorf("Unsupported script type: %s", s.sbc.ScriptType)
 	}
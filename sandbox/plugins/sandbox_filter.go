@@ -26,11 +26,11 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/gogo/protobuf/proto"
 	"github.com/mozilla-services/heka/message"
 	"github.com/mozilla-services/heka/pipeline"
 	. "github.com/mozilla-services/heka/sandbox"
 	"github.com/mozilla-services/heka/sandbox/lua"
+	"github.com/mozilla-services/heka/sandbox/wasm"
 )
 
 func fileExists(path string) bool {
@@ -99,12 +99,43 @@ func (this *SandboxFilter) Init(config interface{}) (err error) {
 		}
 	}
 
+	if this.sbc.UseKvStore {
+		this.sbc.KvStore, err = OpenKvStore(filepath.Join(data_dir, this.name+KV_EXT),
+			this.sbc.KvStoreQuota)
+		if err != nil {
+			return fmt.Errorf("can't open the kv store: %s", err)
+		}
+		defer func() {
+			if err != nil {
+				this.sbc.KvStore.Close()
+				this.sbc.KvStore = nil
+			}
+		}()
+	}
+
+	if len(this.sbc.Lookups) > 0 {
+		if this.sbc.Lookup, err = NewLookup(this.sbc.Lookups); err != nil {
+			return
+		}
+		defer func() {
+			if err != nil {
+				this.sbc.Lookup.Close()
+				this.sbc.Lookup = nil
+			}
+		}()
+	}
+
 	switch this.sbc.ScriptType {
 	case "lua":
 		this.sb, err = lua.CreateLuaSandbox(this.sbc)
 		if err != nil {
 			return
 		}
+	case "wasm":
+		this.sb, err = wasm.CreateWasmSandbox(this.sbc)
+		if err != nil {
+			return
+		}
 	default:
 		return fmt.Errorf("unsupported script type: %s", this.sbc.ScriptType)
 	}
@@ -136,6 +167,9 @@ func (this *SandboxFilter) ReportMsg(msg *message.Message) error {
 		TYPE_INSTRUCTIONS, STAT_MAXIMUM)), "count")
 	message.NewIntField(msg, "MaxOutput", int(this.sb.Usage(TYPE_OUTPUT,
 		STAT_MAXIMUM)), "B")
+	if this.sbc.KvStore != nil {
+		message.NewInt64Field(msg, "KvStoreSize", this.sbc.KvStore.Size(), "B")
+	}
 	message.NewInt64Field(msg, "ProcessMessageCount", atomic.LoadInt64(&this.processMessageCount), "count")
 	message.NewInt64Field(msg, "ProcessMessageFailures", atomic.LoadInt64(&this.processMessageFailures), "count")
 	message.NewInt64Field(msg, "InjectMessageCount", atomic.LoadInt64(&this.injectMessageCount), "count")
@@ -191,7 +225,7 @@ func (this *SandboxFilter) Run(fr pipeline.FilterRunner, h pipeline.PluginHelper
 	}
 	// We assign to the return value of Run() for errors in the closure so that
 	// the plugin runner can determine what caused the SandboxFilter to return.
-	this.sb.InjectMessage(func(payload, payload_type, payload_name string) int {
+	inject := func(payload, payload_type, payload_name string) int {
 		if injectionCount == 0 {
 			err = pipeline.TerminatedError("exceeded InjectMessage count")
 			return 2
@@ -208,7 +242,7 @@ func (this *SandboxFilter) Run(fr pipeline.FilterRunner, h pipeline.PluginHelper
 		}
 		if len(payload_type) == 0 { // heka protobuf message
 			hostname := pack.Message.GetHostname()
-			err := proto.Unmarshal([]byte(payload), pack.Message)
+			err := message.UnmarshalMessage([]byte(payload), pack.Message)
 			if err == nil {
 				// do not allow filters to override the following
 				pack.Message.SetType("heka.sandbox." + pack.Message.GetType())
@@ -231,7 +265,20 @@ func (this *SandboxFilter) Run(fr pipeline.FilterRunner, h pipeline.PluginHelper
 		}
 		atomic.AddInt64(&this.injectMessageCount, 1)
 		return 0
-	})
+	}
+	this.sb.InjectMessage(inject)
+
+	var (
+		watcher     *scriptWatcher
+		watchTicker <-chan time.Time
+	)
+	if this.sbc.WatchScript {
+		interval := time.Duration(this.sbc.WatchInterval) * time.Millisecond
+		watcher = newScriptWatcher(this.sbc.ScriptFilename, interval)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		watchTicker = ticker.C
+	}
 
 	for ok {
 		select {
@@ -307,6 +354,15 @@ func (this *SandboxFilter) Run(fr pipeline.FilterRunner, h pipeline.PluginHelper
 			this.timerEventDuration += duration
 			this.timerEventSamples++
 			this.reportLock.Unlock()
+
+		case <-watchTicker:
+			if !watcher.modified() {
+				break
+			}
+			if e := this.reload(fr, inject); e != nil {
+				err = pipeline.TerminatedError(e.Error())
+				ok = false
+			}
 		}
 
 		if terminated {
@@ -345,7 +401,7 @@ func (this *SandboxFilter) Run(fr pipeline.FilterRunner, h pipeline.PluginHelper
 		}
 	}
 
-	if !terminated && this.sbc.TimerEventOnShutdown {
+	if !terminated && this.sb != nil && this.sbc.TimerEventOnShutdown {
 		injectionCount = this.pConfig.Globals.MaxMsgTimerInject
 		if retval = this.sb.TimerEvent(time.Now().UnixNano()); retval != 0 {
 			err = fmt.Errorf("FATAL: %s", this.sb.LastError())
@@ -367,6 +423,32 @@ func (this *SandboxFilter) Run(fr pipeline.FilterRunner, h pipeline.PluginHelper
 	return err
 }
 
+// Swaps in the modified script, keeping the sandbox's global state. Only
+// returns an error if there's no longer a sandbox to run.
+func (this *SandboxFilter) reload(fr pipeline.FilterRunner,
+	inject func(payload, payload_type, payload_name string) int) error {
+
+	this.reportLock.Lock()
+	defer this.reportLock.Unlock()
+	sb, err := reloadSandbox(this.sb, this.sbc, this.preservationFile+".reload")
+	if sb == nil {
+		this.sb = nil
+		return fmt.Errorf("script reload failed: %s", err)
+	}
+	if sb == this.sb {
+		fr.LogError(fmt.Errorf("script not reloaded: %s", err))
+		return nil
+	}
+	this.sb = sb
+	this.sb.InjectMessage(inject)
+	if err != nil {
+		fr.LogError(fmt.Errorf("script reloaded: %s", err))
+	} else {
+		fr.LogMessage("script reloaded")
+	}
+	return nil
+}
+
 func (this *SandboxFilter) destroy() error {
 	this.reportLock.Lock()
 
@@ -380,6 +462,14 @@ func (this *SandboxFilter) destroy() error {
 
 		this.sb = nil
 	}
+	if this.sbc.KvStore != nil {
+		this.sbc.KvStore.Close()
+		this.sbc.KvStore = nil
+	}
+	if this.sbc.Lookup != nil {
+		this.sbc.Lookup.Close()
+		this.sbc.Lookup = nil
+	}
 	this.reportLock.Unlock()
 	return err
 }
@@ -24,11 +24,11 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/gogo/protobuf/proto"
 	"github.com/mozilla-services/heka/message"
 	"github.com/mozilla-services/heka/pipeline"
 	. "github.com/mozilla-services/heka/sandbox"
 	"github.com/mozilla-services/heka/sandbox/lua"
+	"github.com/mozilla-services/heka/sandbox/wasm"
 )
 
 // Heka Input plugin that acts as a wrapper for sandboxed input scripts.
@@ -86,6 +86,11 @@ func (s *SandboxInput) Init(config interface{}) (err error) {
 		if err != nil {
 			return
 		}
+	case "wasm":
+		s.sb, err = wasm.CreateWasmSandbox(s.sbc)
+		if err != nil {
+			return
+		}
 	default:
 		return fmt.Errorf("unsupported script type: %s", s.sbc.ScriptType)
 	}
@@ -111,7 +116,7 @@ func (s *SandboxInput) Run(ir pipeline.InputRunner, h pipeline.PluginHelper) (er
 			pack.Recycle(nil)
 			return 5
 		}
-		if err := proto.Unmarshal([]byte(payload), pack.Message); err != nil {
+		if err := message.UnmarshalMessage([]byte(payload), pack.Message); err != nil {
 			pack.Recycle(nil)
 			return 1
 		}
@@ -45,6 +45,11 @@ type SandboxManagerFilter struct {
 	instructionLimit    uint
 	outputLimit         uint
 	pConfig             *pipeline.PipelineConfig
+	registry            sandboxRegistry
+	registryInterval    time.Duration
+	// Registry entries of the running sandboxes loaded from the registry, by
+	// sandbox name.
+	registered map[string]*registryEntry
 }
 
 // Config struct for `SandboxManagerFilter`.
@@ -69,17 +74,28 @@ type SandboxManagerFilterConfig struct {
 	OutputLimit uint `toml:"output_limit"`
 	// Default message matcher.
 	MessageMatcher string `toml:"message_matcher"`
+	// Type of the key/value store to load sandbox filters from, "consul" or
+	// "etcd". No registry is used if empty.
+	RegistryType string `toml:"registry_type"`
+	// Base URL of the registry's HTTP API.
+	RegistryURL string `toml:"registry_url"`
+	// Key prefix holding a `config` and a `script` key for each filter.
+	RegistryPrefix string `toml:"registry_prefix"`
+	// Interval in seconds at which the registry is checked for changes.
+	RegistryPollInterval uint `toml:"registry_poll_interval"`
 }
 
 func (this *SandboxManagerFilter) ConfigStruct() interface{} {
 	sbDefaults := NewSandboxConfig(this.pConfig.Globals).(*SandboxConfig)
 	return &SandboxManagerFilterConfig{
-		WorkingDirectory: "sbxmgrs",
-		ModuleDirectory:  sbDefaults.ModuleDirectory,
-		MemoryLimit:      sbDefaults.MemoryLimit,
-		InstructionLimit: sbDefaults.InstructionLimit,
-		OutputLimit:      sbDefaults.OutputLimit,
-		MessageMatcher:   "Type == 'heka.control.sandbox'",
+		WorkingDirectory:     "sbxmgrs",
+		ModuleDirectory:      sbDefaults.ModuleDirectory,
+		MemoryLimit:          sbDefaults.MemoryLimit,
+		InstructionLimit:     sbDefaults.InstructionLimit,
+		OutputLimit:          sbDefaults.OutputLimit,
+		MessageMatcher:       "Type == 'heka.control.sandbox'",
+		RegistryPrefix:       "heka/sandboxes",
+		RegistryPollInterval: 10,
 	}
 }
 
@@ -104,6 +120,21 @@ func (this *SandboxManagerFilter) Init(config interface{}) (err error) {
 	this.memoryLimit = conf.MemoryLimit
 	this.instructionLimit = conf.InstructionLimit
 	this.outputLimit = conf.OutputLimit
+	this.registered = make(map[string]*registryEntry)
+	if conf.RegistryType != "" {
+		if conf.RegistryURL == "" {
+			return fmt.Errorf("'registry_url' is required w/ a 'registry_type'")
+		}
+		if conf.RegistryPollInterval == 0 {
+			return fmt.Errorf("'registry_poll_interval' must be greater than zero")
+		}
+		this.registry, err = newSandboxRegistry(conf.RegistryType, conf.RegistryURL,
+			conf.RegistryPrefix)
+		if err != nil {
+			return
+		}
+		this.registryInterval = time.Duration(conf.RegistryPollInterval) * time.Second
+	}
 	err = os.MkdirAll(this.workingDirectory, 0700)
 	return
 }
@@ -145,6 +176,10 @@ func (this *SandboxManagerFilter) createRunner(dir, name string, configSection t
 		conf.InstructionLimit = this.instructionLimit
 		conf.OutputLimit = this.outputLimit
 		conf.PluginType = "filter"
+		if _, ok := this.registered[name]; ok {
+			// Registry script changes are applied by rewriting the script.
+			conf.WatchScript = true
+		}
 		return conf, nil
 	}
 	mutMaker.SetPrepConfig(prepConfig)
@@ -193,47 +228,56 @@ func (this *SandboxManagerFilter) loadSandbox(fr pipeline.FilterRunner,
 
 	fv, _ := msg.GetFieldValue("config")
 	if config, ok := fv.(string); ok {
-		var configFile pipeline.ConfigFile
-		if _, err = toml.Decode(config, &configFile); err != nil {
+		err = this.loadSandboxConfig(fr, h, dir, config, msg.GetPayload())
+	}
+	return
+}
+
+// Writes the configuration and script of a new SandboxFilter to the working
+// directory and starts it.
+func (this *SandboxManagerFilter) loadSandboxConfig(fr pipeline.FilterRunner,
+	h pipeline.PluginHelper, dir, config, script string) (err error) {
+
+	var configFile pipeline.ConfigFile
+	if _, err = toml.Decode(config, &configFile); err != nil {
+		return fmt.Errorf("loadSandbox failed: %s\n", err)
+	}
+
+	for name, conf := range configFile {
+		name = getSandboxName(fr.Name(), name)
+		if _, ok := h.Filter(name); ok {
+			// todo support reload
+			return fmt.Errorf("loadSandbox failed: %s is already running", name)
+		}
+		fr.LogMessage(fmt.Sprintf("Loading: %s", name))
+		confFile := filepath.Join(dir, fmt.Sprintf("%s.toml", name))
+		err = ioutil.WriteFile(confFile, []byte(config), 0600)
+		if err != nil {
+			return
+		}
+		var sbc SandboxConfig
+		// Default, will get overwritten if necessary
+		sbc.ScriptType = "lua"
+		if err = toml.PrimitiveDecode(conf, &sbc); err != nil {
 			return fmt.Errorf("loadSandbox failed: %s\n", err)
 		}
-
-		for name, conf := range configFile {
-			name = getSandboxName(fr.Name(), name)
-			if _, ok := h.Filter(name); ok {
-				// todo support reload
-				return fmt.Errorf("loadSandbox failed: %s is already running", name)
-			}
-			fr.LogMessage(fmt.Sprintf("Loading: %s", name))
-			confFile := filepath.Join(dir, fmt.Sprintf("%s.toml", name))
-			err = ioutil.WriteFile(confFile, []byte(config), 0600)
-			if err != nil {
-				return
-			}
-			var sbc SandboxConfig
-			// Default, will get overwritten if necessary
-			sbc.ScriptType = "lua"
-			if err = toml.PrimitiveDecode(conf, &sbc); err != nil {
-				return fmt.Errorf("loadSandbox failed: %s\n", err)
-			}
-			scriptFile := filepath.Join(dir, fmt.Sprintf("%s.%s", name, sbc.ScriptType))
-			err = ioutil.WriteFile(scriptFile, []byte(msg.GetPayload()), 0600)
-			if err != nil {
-				removeAll(dir, fmt.Sprintf("%s.*", name))
-				return
-			}
-			var runner pipeline.FilterRunner
-			runner, err = this.createRunner(dir, name, conf)
-			if err != nil {
-				removeAll(dir, fmt.Sprintf("%s.*", name))
-				return
-			}
-			err = this.pConfig.AddFilterRunner(runner)
-			if err == nil {
-				atomic.AddInt32(&this.currentFilters, 1)
-			}
-			break // only interested in the first item
+		scriptFile := filepath.Join(dir, fmt.Sprintf("%s.%s", name, sbc.ScriptType))
+		err = ioutil.WriteFile(scriptFile, []byte(script), 0600)
+		if err != nil {
+			removeAll(dir, fmt.Sprintf("%s.*", name))
+			return
 		}
+		var runner pipeline.FilterRunner
+		runner, err = this.createRunner(dir, name, conf)
+		if err != nil {
+			removeAll(dir, fmt.Sprintf("%s.*", name))
+			return
+		}
+		err = this.pConfig.AddFilterRunner(runner)
+		if err == nil {
+			atomic.AddInt32(&this.currentFilters, 1)
+		}
+		break // only interested in the first item
 	}
 	return
 }
@@ -283,9 +327,22 @@ func (this *SandboxManagerFilter) Run(fr pipeline.FilterRunner,
 	var pack *pipeline.PipelinePack
 	var delta int64
 
+	var (
+		registryChan chan map[string]*registryEntry
+		stopChan     chan struct{}
+	)
+	this.restoreRegistered(fr, this.workingDirectory)
 	this.restoreSandboxes(fr, h, this.workingDirectory)
+	if this.registry != nil {
+		registryChan = make(chan map[string]*registryEntry)
+		stopChan = make(chan struct{})
+		defer close(stopChan)
+		go this.pollRegistry(fr, registryChan, stopChan)
+	}
 	for ok {
 		select {
+		case entries := <-registryChan:
+			this.syncRegistry(fr, h, this.workingDirectory, entries)
 		case pack, ok = <-inChan:
 			if !ok {
 				break
@@ -328,6 +385,8 @@ func (this *SandboxManagerFilter) Run(fr pipeline.FilterRunner,
 					name = getSandboxName(fr.Name(), name)
 					if this.pConfig.RemoveFilterRunner(name) {
 						removeAll(this.workingDirectory, fmt.Sprintf("%s.*", name))
+						// A registry entry will be loaded again on the next poll.
+						delete(this.registered, name)
 					}
 				}
 			}
@@ -28,6 +28,7 @@ import (
 	"github.com/mozilla-services/heka/pipeline"
 	. "github.com/mozilla-services/heka/sandbox"
 	"github.com/mozilla-services/heka/sandbox/lua"
+	"github.com/mozilla-services/heka/sandbox/wasm"
 )
 
 // Heka Output plugin that acts as a wrapper for sandboxed output scripts.
@@ -81,6 +82,11 @@ func (s *SandboxOutput) Init(config interface{}) (err error) {
 		if err != nil {
 			return
 		}
+	case "wasm":
+		s.sb, err = wasm.CreateWasmSandbox(s.sbc)
+		if err != nil {
+			return
+		}
 	default:
 		return fmt.Errorf("unsupported script type: %s", s.sbc.ScriptType)
 	}
@@ -0,0 +1,316 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package plugins
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/bbangert/toml"
+	"github.com/mozilla-services/heka/pipeline"
+)
+
+// Extension of the files recording the registry entry a managed sandbox was
+// last loaded from.
+const registryExt = ".registry"
+
+// A sandbox filter declared in a key/value store, as the `config` and
+// `script` keys under `<registry_prefix>/<filter name>/`. The config holds
+// the filter's TOML settings, w/o the section header.
+type registryEntry struct {
+	Config string `json:"config"`
+	Script string `json:"script"`
+}
+
+// A key/value store the SandboxManagerFilter loads sandbox filters from.
+type sandboxRegistry interface {
+	// Returns the entries under the prefix, by filter name.
+	fetch() (map[string]*registryEntry, error)
+}
+
+func newSandboxRegistry(kind, url, prefix string) (sandboxRegistry, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	url = strings.TrimRight(url, "/")
+	prefix = strings.Trim(prefix, "/")
+	switch kind {
+	case "consul":
+		return &consulRegistry{client: client, url: url, prefix: prefix}, nil
+	case "etcd":
+		return &etcdRegistry{client: client, url: url, prefix: prefix}, nil
+	}
+	return nil, fmt.Errorf("unknown registry_type '%s', must be 'consul' or 'etcd'", kind)
+}
+
+// Files a key's value under its filter's entry, ignoring unrelated keys.
+func addRegistryKey(entries map[string]*registryEntry, prefix, key, value string) {
+	key = strings.TrimPrefix(key, "/")
+	if prefix != "" {
+		if !strings.HasPrefix(key, prefix+"/") {
+			return
+		}
+		key = key[len(prefix)+1:]
+	}
+	parts := strings.Split(key, "/")
+	if len(parts) != 2 || parts[0] == "" {
+		return
+	}
+	entry, ok := entries[parts[0]]
+	if !ok {
+		entry = new(registryEntry)
+	}
+	switch parts[1] {
+	case "config":
+		entry.Config = value
+	case "script":
+		entry.Script = value
+	default:
+		return
+	}
+	entries[parts[0]] = entry
+}
+
+// Returns the response body, or nil if the prefix doesn't exist.
+func registryGet(client *http.Client, url string) ([]byte, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("registry request failed: %s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Reads the prefix from Consul's KV HTTP API.
+type consulRegistry struct {
+	client *http.Client
+	url    string
+	prefix string
+}
+
+func (r *consulRegistry) fetch() (map[string]*registryEntry, error) {
+	body, err := registryGet(r.client, fmt.Sprintf("%s/v1/kv/%s?recurse", r.url, r.prefix))
+	entries := make(map[string]*registryEntry)
+	if err != nil || body == nil {
+		return entries, err
+	}
+	// Consul's values are base64 encoded, which []byte decodes.
+	var pairs []struct {
+		Key   string
+		Value []byte
+	}
+	if err = json.Unmarshal(body, &pairs); err != nil {
+		return nil, fmt.Errorf("can't decode Consul response: %s", err)
+	}
+	for _, pair := range pairs {
+		addRegistryKey(entries, r.prefix, pair.Key, string(pair.Value))
+	}
+	return entries, nil
+}
+
+// Reads the prefix from etcd's v2 keys HTTP API.
+type etcdRegistry struct {
+	client *http.Client
+	url    string
+	prefix string
+}
+
+type etcdNode struct {
+	Key   string     `json:"key"`
+	Value string     `json:"value"`
+	Dir   bool       `json:"dir"`
+	Nodes []etcdNode `json:"nodes"`
+}
+
+func (r *etcdRegistry) fetch() (map[string]*registryEntry, error) {
+	body, err := registryGet(r.client, fmt.Sprintf("%s/v2/keys/%s?recursive=true",
+		r.url, r.prefix))
+	entries := make(map[string]*registryEntry)
+	if err != nil || body == nil {
+		return entries, err
+	}
+	var resp struct {
+		Node etcdNode `json:"node"`
+	}
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("can't decode etcd response: %s", err)
+	}
+	var walk func(node etcdNode)
+	walk = func(node etcdNode) {
+		if !node.Dir {
+			addRegistryKey(entries, r.prefix, node.Key, node.Value)
+		}
+		for _, child := range node.Nodes {
+			walk(child)
+		}
+	}
+	walk(resp.Node)
+	return entries, nil
+}
+
+// Polls the registry, sending its entries to the manager's Run loop, which
+// applies them, until the stop channel is closed.
+func (this *SandboxManagerFilter) pollRegistry(fr pipeline.FilterRunner,
+	entriesChan chan<- map[string]*registryEntry, stopChan <-chan struct{}) {
+
+	ticker := time.NewTicker(this.registryInterval)
+	defer ticker.Stop()
+	for {
+		entries, err := this.registry.fetch()
+		if err != nil {
+			fr.LogError(fmt.Errorf("can't read the registry: %s", err))
+		} else {
+			select {
+			case entriesChan <- entries:
+			case <-stopChan:
+				return
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-stopChan:
+			return
+		}
+	}
+}
+
+// Loads the registry markers of the sandboxes restored from the working
+// directory.
+func (this *SandboxManagerFilter) restoreRegistered(fr pipeline.FilterRunner, dir string) {
+	glob := fmt.Sprintf("%s-*%s", getNormalizedName(fr.Name()), registryExt)
+	matches, _ := filepath.Glob(filepath.Join(dir, glob))
+	for _, fn := range matches {
+		contents, err := ioutil.ReadFile(fn)
+		entry := new(registryEntry)
+		if err == nil {
+			err = json.Unmarshal(contents, entry)
+		}
+		if err != nil {
+			fr.LogError(fmt.Errorf("can't read registry marker: %s", err))
+			continue
+		}
+		this.registered[strings.TrimSuffix(filepath.Base(fn), registryExt)] = entry
+	}
+}
+
+// Starts, restarts and stops the managed sandboxes to match the registry's
+// entries. Only the script of a sandbox whose config didn't change is
+// replaced, which the sandbox reloads in place.
+func (this *SandboxManagerFilter) syncRegistry(fr pipeline.FilterRunner,
+	h pipeline.PluginHelper, dir string, entries map[string]*registryEntry) {
+
+	current := make(map[string]bool)
+	for name, entry := range entries {
+		sbName := getSandboxName(fr.Name(), name)
+		current[sbName] = true
+		if entry.Config == "" || entry.Script == "" {
+			fr.LogError(fmt.Errorf("registry entry '%s' needs both a config and a script",
+				name))
+			continue
+		}
+		prev, ok := this.registered[sbName]
+		if !ok {
+			if _, running := h.Filter(sbName); running {
+				fr.LogError(fmt.Errorf("%s is already running w/o a registry entry",
+					sbName))
+				continue
+			}
+		} else if prev.Config == entry.Config {
+			if prev.Script != entry.Script {
+				if err := this.replaceScript(fr, dir, sbName, entry); err != nil {
+					fr.LogError(err)
+				}
+			}
+			continue
+		} else {
+			this.unloadRegistered(dir, sbName)
+		}
+
+		if int(atomic.LoadInt32(&this.currentFilters)) >= this.maxFilters {
+			fr.LogError(fmt.Errorf("%s attempted to load more than %d filters",
+				fr.Name(), this.maxFilters))
+			continue
+		}
+		config := fmt.Sprintf("[%s]\n%s\n", name, entry.Config)
+		this.registered[sbName] = entry
+		err := this.writeRegistryMarker(dir, sbName, entry)
+		if err == nil {
+			err = this.loadSandboxConfig(fr, h, dir, config, entry.Script)
+		}
+		if err != nil {
+			delete(this.registered, sbName)
+			removeAll(dir, fmt.Sprintf("%s.*", sbName))
+			fr.LogError(fmt.Errorf("can't load registry entry '%s': %s", name, err))
+		}
+	}
+
+	for sbName := range this.registered {
+		if !current[sbName] {
+			fr.LogMessage(fmt.Sprintf("Unloading: %s", sbName))
+			this.unloadRegistered(dir, sbName)
+		}
+	}
+}
+
+func (this *SandboxManagerFilter) unloadRegistered(dir, sbName string) {
+	this.pConfig.RemoveFilterRunner(sbName)
+	removeAll(dir, fmt.Sprintf("%s.*", sbName))
+	delete(this.registered, sbName)
+}
+
+func (this *SandboxManagerFilter) writeRegistryMarker(dir, sbName string,
+	entry *registryEntry) error {
+
+	contents, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, sbName+registryExt), contents, 0600)
+}
+
+// Overwrites a running sandbox's script file, which it watches for changes.
+func (this *SandboxManagerFilter) replaceScript(fr pipeline.FilterRunner, dir,
+	sbName string, entry *registryEntry) error {
+
+	var sbc struct {
+		ScriptType string `toml:"script_type"`
+	}
+	sbc.ScriptType = "lua"
+	if _, err := toml.Decode(entry.Config, &sbc); err != nil {
+		return err
+	}
+	fr.LogMessage(fmt.Sprintf("Replacing script: %s", sbName))
+	scriptFile := filepath.Join(dir, fmt.Sprintf("%s.%s", sbName, sbc.ScriptType))
+	tmpFile := scriptFile + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, []byte(entry.Script), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFile, scriptFile); err != nil {
+		return err
+	}
+	this.registered[sbName] = entry
+	return this.writeRegistryMarker(dir, sbName, entry)
+}
@@ -0,0 +1,112 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package plugins
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func RegistrySpec(c gs.Context) {
+	var (
+		path, body string
+		status     int
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+
+		path = r.URL.RequestURI()
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	c.Specify("A Consul registry", func() {
+		registry, err := newSandboxRegistry("consul", server.URL+"/", "/heka/sbx/")
+		c.Assume(err, gs.IsNil)
+		status = http.StatusOK
+
+		c.Specify("reads the entries under the prefix", func() {
+			// "type = 'SandboxFilter'", "-- script" and "other" base64 encoded.
+			body = `[
+				{"Key": "heka/sbx/counter/config", "Value": "dHlwZSA9ICdTYW5kYm94RmlsdGVyJw=="},
+				{"Key": "heka/sbx/counter/script", "Value": "LS0gc2NyaXB0"},
+				{"Key": "heka/sbx/counter/other", "Value": "b3RoZXI="},
+				{"Key": "heka/sbx/stray", "Value": "b3RoZXI="}
+			]`
+			entries, err := registry.fetch()
+			c.Expect(err, gs.IsNil)
+			c.Expect(path, gs.Equals, "/v1/kv/heka/sbx?recurse")
+			c.Expect(len(entries), gs.Equals, 1)
+			c.Expect(entries["counter"].Config, gs.Equals, "type = 'SandboxFilter'")
+			c.Expect(entries["counter"].Script, gs.Equals, "-- script")
+		})
+
+		c.Specify("has no entries if the prefix doesn't exist", func() {
+			status = http.StatusNotFound
+			body = ""
+			entries, err := registry.fetch()
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(entries), gs.Equals, 0)
+		})
+
+		c.Specify("fails on a server error", func() {
+			status = http.StatusInternalServerError
+			_, err := registry.fetch()
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+
+	c.Specify("An etcd registry", func() {
+		registry, err := newSandboxRegistry("etcd", server.URL, "heka/sbx")
+		c.Assume(err, gs.IsNil)
+		status = http.StatusOK
+
+		c.Specify("reads the entries under the prefix", func() {
+			body = `{"action": "get", "node": {"key": "/heka/sbx", "dir": true, "nodes": [
+				{"key": "/heka/sbx/counter", "dir": true, "nodes": [
+					{"key": "/heka/sbx/counter/config", "value": "type = 'SandboxFilter'"},
+					{"key": "/heka/sbx/counter/script", "value": "-- script"}
+				]},
+				{"key": "/heka/sbx/partial", "dir": true, "nodes": [
+					{"key": "/heka/sbx/partial/script", "value": "-- partial"}
+				]}
+			]}}`
+			entries, err := registry.fetch()
+			c.Expect(err, gs.IsNil)
+			c.Expect(path, gs.Equals, "/v2/keys/heka/sbx?recursive=true")
+			c.Expect(len(entries), gs.Equals, 2)
+			c.Expect(entries["counter"].Config, gs.Equals, "type = 'SandboxFilter'")
+			c.Expect(entries["counter"].Script, gs.Equals, "-- script")
+			c.Expect(entries["partial"].Config, gs.Equals, "")
+			c.Expect(entries["partial"].Script, gs.Equals, "-- partial")
+		})
+
+		c.Specify("has no entries if the prefix doesn't exist", func() {
+			status = http.StatusNotFound
+			body = `{"errorCode": 100, "message": "Key not found"}`
+			entries, err := registry.fetch()
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(entries), gs.Equals, 0)
+		})
+	})
+
+	c.Specify("An unknown registry type is rejected", func() {
+		_, err := newSandboxRegistry("zookeeper", server.URL, "heka")
+		c.Expect(err, gs.Not(gs.IsNil))
+	})
+}
@@ -0,0 +1,124 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package plugins
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	. "github.com/mozilla-services/heka/sandbox"
+	"github.com/mozilla-services/heka/sandbox/lua"
+	"github.com/mozilla-services/heka/sandbox/wasm"
+)
+
+// Polls a sandbox script file for changes. Polling rather than relying on
+// file system notifications catches editors that replace the file instead of
+// writing to it and works the same on every platform.
+type scriptWatcher struct {
+	filename  string
+	interval  time.Duration
+	nextCheck time.Time
+	modTime   time.Time
+	size      int64
+}
+
+func newScriptWatcher(filename string, interval time.Duration) *scriptWatcher {
+	w := &scriptWatcher{filename: filename, interval: interval}
+	if info, err := os.Stat(filename); err == nil {
+		w.modTime, w.size = info.ModTime(), info.Size()
+	}
+	w.nextCheck = time.Now().Add(interval)
+	return w
+}
+
+// Returns true at most once per interval, for callers that don't have a
+// ticker to pace the checks.
+func (w *scriptWatcher) due(now time.Time) bool {
+	if now.Before(w.nextCheck) {
+		return false
+	}
+	w.nextCheck = now.Add(w.interval)
+	return true
+}
+
+// Returns true if the script has been modified since the last time this
+// returned true. A missing file doesn't count as a change, so a script that's
+// in the middle of being replaced isn't loaded.
+func (w *scriptWatcher) modified() bool {
+	info, err := os.Stat(w.filename)
+	if err != nil {
+		return false
+	}
+	if info.ModTime().Equal(w.modTime) && info.Size() == w.size {
+		return false
+	}
+	w.modTime, w.size = info.ModTime(), info.Size()
+	return true
+}
+
+func createSandbox(sbc *SandboxConfig) (Sandbox, error) {
+	switch sbc.ScriptType {
+	case "lua":
+		return lua.CreateLuaSandbox(sbc)
+	case "wasm":
+		return wasm.CreateWasmSandbox(sbc)
+	}
+	return nil, fmt.Errorf("unsupported script type: %s", sbc.ScriptType)
+}
+
+// Loads the current version of the sandbox's script into a new sandbox,
+// carrying the global state of the running sandbox over through the given
+// state file, and returns the sandbox that should be used from then on. The
+// new script is loaded w/o any state first, so if it doesn't load at all the
+// running sandbox is returned untouched along w/ the error. If the state can't
+// be carried over the new sandbox starts w/ fresh state instead, and nil is
+// only returned if the new sandbox can't be started at all.
+func reloadSandbox(sb Sandbox, sbc *SandboxConfig, stateFile string) (Sandbox, error) {
+	probe, err := createSandbox(sbc)
+	if err != nil {
+		return sb, err
+	}
+	probe.InjectMessage(func(payload, payload_type, payload_name string) int {
+		return 0 // Discard anything the script injects while loading.
+	})
+	err = probe.Init("")
+	probe.Destroy("")
+	if err != nil {
+		return sb, err
+	}
+
+	defer os.Remove(stateFile)
+	stateErr := sb.Destroy(stateFile)
+	if stateErr == nil {
+		newSb, err := createSandbox(sbc)
+		if err != nil {
+			return nil, err
+		}
+		if stateErr = newSb.Init(stateFile); stateErr == nil {
+			return newSb, nil
+		}
+		newSb.Destroy("")
+	}
+	newSb, err := createSandbox(sbc)
+	if err != nil {
+		return nil, err
+	}
+	if err = newSb.Init(""); err != nil {
+		newSb.Destroy("")
+		return nil, err
+	}
+	return newSb, fmt.Errorf("state not preserved: %s", stateErr)
+}
@@ -0,0 +1,136 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package plugins
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/sandbox"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+// Script that counts messages and reports the count w/ the given label.
+func countScript(label string) string {
+	return fmt.Sprintf(`count = 0
+
+function process_message()
+    count = count + 1
+    return 0
+end
+
+function timer_event(ns)
+    inject_payload("txt", "", string.format("%s: %%d", count))
+end
+`, label)
+}
+
+func ReloadSpec(c gs.Context) {
+	pConfig := pipeline.NewPipelineConfig(nil)
+
+	c.Specify("Reloading a sandbox", func() {
+		dir, err := ioutil.TempDir("", "sandbox_reload_test")
+		c.Assume(err, gs.IsNil)
+		defer os.RemoveAll(dir)
+		script := filepath.Join(dir, "count.lua")
+		stateFile := filepath.Join(dir, "count.data.reload")
+		writeScript := func(src string) {
+			err := ioutil.WriteFile(script, []byte(src), 0644)
+			c.Assume(err, gs.IsNil)
+		}
+		writeScript(countScript("count"))
+
+		sbc := sandbox.NewSandboxConfig(pConfig.Globals).(*sandbox.SandboxConfig)
+		sbc.ScriptFilename = script
+		sbc.ModuleDirectory = "../lua/modules"
+		sbc.PluginType = "filter"
+		sb, err := createSandbox(sbc)
+		c.Assume(err, gs.IsNil)
+		err = sb.Init("")
+		c.Assume(err, gs.IsNil)
+
+		pack := pipeline.NewPipelinePack(nil)
+		pack.Message = getTestMessage()
+		c.Expect(sb.ProcessMessage(pack), gs.Equals, 0)
+		c.Expect(sb.ProcessMessage(pack), gs.Equals, 0)
+
+		var payloads []string
+		capture := func(payload, payload_type, payload_name string) int {
+			payloads = append(payloads, payload)
+			return 0
+		}
+
+		c.Specify("runs the new script w/ the old state", func() {
+			writeScript(countScript("total"))
+			newSb, err := reloadSandbox(sb, sbc, stateFile)
+			c.Expect(err, gs.IsNil)
+			c.Assume(newSb, gs.Not(gs.IsNil))
+			newSb.InjectMessage(capture)
+			c.Expect(newSb.TimerEvent(0), gs.Equals, 0)
+			c.Expect(len(payloads), gs.Equals, 1)
+			c.Expect(payloads[0], gs.Equals, "total: 2")
+			newSb.Destroy("")
+
+			_, err = os.Stat(stateFile)
+			c.Expect(os.IsNotExist(err), gs.IsTrue)
+		})
+
+		c.Specify("keeps the running sandbox if the new script doesn't load", func() {
+			writeScript("function process_message(")
+			newSb, err := reloadSandbox(sb, sbc, stateFile)
+			c.Expect(err, gs.Not(gs.IsNil))
+			c.Expect(newSb, gs.Equals, sb)
+			sb.InjectMessage(capture)
+			c.Expect(sb.TimerEvent(0), gs.Equals, 0)
+			c.Expect(len(payloads), gs.Equals, 1)
+			c.Expect(payloads[0], gs.Equals, "count: 2")
+			sb.Destroy("")
+		})
+	})
+
+	c.Specify("A script watcher", func() {
+		dir, err := ioutil.TempDir("", "sandbox_reload_test")
+		c.Assume(err, gs.IsNil)
+		defer os.RemoveAll(dir)
+		script := filepath.Join(dir, "watched.lua")
+		err = ioutil.WriteFile(script, []byte("-- v1\n"), 0644)
+		c.Assume(err, gs.IsNil)
+		watcher := newScriptWatcher(script, time.Hour)
+
+		c.Specify("detects modifications once", func() {
+			c.Expect(watcher.modified(), gs.IsFalse)
+			err = ioutil.WriteFile(script, []byte("-- version 2\n"), 0644)
+			c.Assume(err, gs.IsNil)
+			c.Expect(watcher.modified(), gs.IsTrue)
+			c.Expect(watcher.modified(), gs.IsFalse)
+		})
+
+		c.Specify("ignores a missing script", func() {
+			os.Remove(script)
+			c.Expect(watcher.modified(), gs.IsFalse)
+		})
+
+		c.Specify("is only due once per interval", func() {
+			now := time.Now()
+			c.Expect(watcher.due(now), gs.IsFalse)
+			c.Expect(watcher.due(now.Add(time.Hour)), gs.IsTrue)
+			c.Expect(watcher.due(now.Add(time.Hour)), gs.IsFalse)
+		})
+	})
+}
@@ -62,10 +62,21 @@ type SandboxConfig struct {
 	OutputLimit          uint   `toml:"output_limit"`
 	CanExit              bool   `toml:"can_exit"`
 	TimerEventOnShutdown bool   `toml:"timer_event_on_shutdown"`
+	WatchScript          bool   `toml:"watch_script"`
+	WatchInterval        uint   `toml:"watch_interval"`
+	UseKvStore           bool   `toml:"use_kv_store"`
+	KvStoreQuota         uint   `toml:"kv_store_quota"`
 	Profile              bool
 	Config               map[string]interface{}
+	Lookups              map[string]LookupConfig
 	Globals              *pipeline.GlobalConfigStruct
 	PluginType           string
+	// Opened by the plugin when UseKvStore is set, shared by every sandbox
+	// the plugin creates.
+	KvStore *KvStore
+	// Created by the plugin when Lookups are configured, shared by every
+	// sandbox the plugin creates.
+	Lookup *Lookup
 }
 
 func NewSandboxConfig(globals *pipeline.GlobalConfigStruct) interface{} {
@@ -77,5 +88,7 @@ func NewSandboxConfig(globals *pipeline.GlobalConfigStruct) interface{} {
 		ScriptType:       "lua",
 		Globals:          globals,
 		CanExit:          true,
+		WatchInterval:    1000,
+		KvStoreQuota:     16 * 1024 * 1024,
 	}
 }
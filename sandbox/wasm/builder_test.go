@@ -0,0 +1,238 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package wasm
+
+// The parts of the binary format the tests' modules use.
+const (
+	typeI32 = 0x7f
+	typeI64 = 0x7e
+
+	externFunc   = 0
+	externMemory = 2
+
+	sectionType      = 1
+	sectionImport    = 2
+	sectionFunction  = 3
+	sectionMemory    = 5
+	sectionGlobal    = 6
+	sectionCode      = 10
+	sectionData      = 11
+	sectionDataCount = 12
+)
+
+// Opcodes of the instructions the tests' modules use.
+const (
+	opUnreachable = 0x00
+	opLoop        = 0x03
+	opIf          = 0x04
+	opEnd         = 0x0b
+	opBr          = 0x0c
+	opReturn      = 0x0f
+	opCall        = 0x10
+	opDrop        = 0x1a
+	opLocalGet    = 0x20
+	opLocalTee    = 0x22
+	opGlobalGet   = 0x23
+	opGlobalSet   = 0x24
+	opI32Store    = 0x36
+	opI32Const    = 0x41
+	opI32Eqz      = 0x45
+	opI32Eq       = 0x46
+	opI64Eqz      = 0x50
+	opI32Add      = 0x6a
+)
+
+type limits struct {
+	min    uint32
+	max    uint32
+	hasMax bool
+}
+
+type importFunc struct {
+	module  string
+	name    string
+	typeIdx uint32
+}
+
+// Builds binary modules for the tests.
+type testModule struct {
+	types   []funcType
+	imports []importFunc
+	funcs   []testFunc
+	memory  *limits
+	globals []testGlobal
+	exports []testExport
+	datas   []testData
+}
+
+type testFunc struct {
+	typeIdx uint32
+	locals  []byte
+	body    []byte
+}
+
+type testGlobal struct {
+	valType byte
+	mutable bool
+	init    []byte
+}
+
+type testExport struct {
+	name  string
+	kind  byte
+	index uint32
+}
+
+type testData struct {
+	offset uint32
+	init   []byte
+}
+
+func uleb(v uint64) (b []byte) {
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7
+		if v != 0 {
+			c |= 0x80
+		}
+		b = append(b, c)
+		if v == 0 {
+			return
+		}
+	}
+}
+
+func sleb(v int64) (b []byte) {
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7
+		if (v == 0 && c&0x40 == 0) || (v == -1 && c&0x40 != 0) {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+// Concatenates the instructions, which are bytes, booleans, ints for opcodes
+// and unsigned immediates or byte slices.
+func asm(parts ...interface{}) (b []byte) {
+	for _, p := range parts {
+		switch p := p.(type) {
+		case byte:
+			b = append(b, p)
+		case bool:
+			if p {
+				b = append(b, 1)
+			} else {
+				b = append(b, 0)
+			}
+		case int:
+			b = append(b, uleb(uint64(p))...)
+		case []byte:
+			b = append(b, p...)
+		default:
+			panic("unsupported code part")
+		}
+	}
+	return
+}
+
+func i32Const(v int32) []byte {
+	return append([]byte{opI32Const}, sleb(int64(v))...)
+}
+
+func name(s string) []byte {
+	return append(uleb(uint64(len(s))), s...)
+}
+
+func vec(n int, items ...[]byte) []byte {
+	b := uleb(uint64(n))
+	for _, item := range items {
+		b = append(b, item...)
+	}
+	return b
+}
+
+func encodeLimits(l limits) []byte {
+	if l.hasMax {
+		return asm(byte(1), int(l.min), int(l.max))
+	}
+	return asm(byte(0), int(l.min))
+}
+
+func (tm *testModule) bytes() []byte {
+	b := append([]byte(nil), wasmMagic...)
+	raw := func(id byte, payload []byte) {
+		b = append(b, id)
+		b = append(b, uleb(uint64(len(payload)))...)
+		b = append(b, payload...)
+	}
+	section := func(id byte, n int, items ...[]byte) {
+		if n > 0 {
+			raw(id, vec(n, items...))
+		}
+	}
+	var items [][]byte
+	for _, t := range tm.types {
+		items = append(items, asm(byte(0x60), vec(len(t.params), t.params),
+			vec(len(t.results), t.results)))
+	}
+	section(sectionType, len(items), items...)
+	items = nil
+	for _, imp := range tm.imports {
+		items = append(items, asm(name(imp.module), name(imp.name),
+			byte(externFunc), int(imp.typeIdx)))
+	}
+	section(sectionImport, len(items), items...)
+	items = nil
+	for _, f := range tm.funcs {
+		items = append(items, uleb(uint64(f.typeIdx)))
+	}
+	section(sectionFunction, len(items), items...)
+	if tm.memory != nil {
+		raw(sectionMemory, vec(1, encodeLimits(*tm.memory)))
+	}
+	items = nil
+	for _, g := range tm.globals {
+		items = append(items, asm(g.valType, g.mutable, g.init,
+			byte(opEnd)))
+	}
+	section(sectionGlobal, len(items), items...)
+	items = nil
+	for _, e := range tm.exports {
+		items = append(items, asm(name(e.name), e.kind, int(e.index)))
+	}
+	section(sectionExport, len(items), items...)
+	if len(tm.datas) > 0 {
+		raw(sectionDataCount, uleb(uint64(len(tm.datas))))
+	}
+	items = nil
+	for _, f := range tm.funcs {
+		var locals [][]byte
+		for _, l := range f.locals {
+			locals = append(locals, []byte{1, l})
+		}
+		body := asm(vec(len(locals), locals...), f.body, byte(opEnd))
+		items = append(items, asm(int(len(body)), body))
+	}
+	section(sectionCode, len(items), items...)
+	items = nil
+	for _, d := range tm.datas {
+		items = append(items, asm(byte(0), i32Const(int32(d.offset)),
+			byte(opEnd), vec(len(d.init), d.init)))
+	}
+	section(sectionData, len(items), items...)
+	return b
+}
@@ -0,0 +1,810 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package wasm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/sandbox"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// Name of the module the host functions are imported from.
+const HOST_MODULE = "heka"
+
+// Size of a WebAssembly memory page.
+const pageSize = 64 * 1024
+
+// The parts of the binary format exportedGlobals needs.
+const (
+	sectionExport = 7
+	externGlobal  = 3
+)
+
+var wasmMagic = []byte{0, 'a', 's', 'm', 1, 0, 0, 0}
+
+// Starts the preservation file, followed by the SHA-256 of the module the
+// state belongs to.
+var preservationMagic = []byte("HEKAWASM")
+
+var (
+	i32 = api.ValueTypeI32
+	i64 = api.ValueTypeI64
+
+	processMessageType = funcType{results: []api.ValueType{i32}}
+	timerEventType     = funcType{params: []api.ValueType{i64}}
+	initializeType     = funcType{}
+)
+
+// The signature of a function.
+type funcType struct {
+	params  []api.ValueType
+	results []api.ValueType
+}
+
+func (ft *funcType) equals(other *funcType) bool {
+	return bytes.Equal(ft.params, other.params) &&
+		bytes.Equal(ft.results, other.results)
+}
+
+func (ft *funcType) String() string {
+	return fmt.Sprintf("(%s) -> (%s)", typeNames(ft.params), typeNames(ft.results))
+}
+
+func typeNames(types []api.ValueType) string {
+	names := make([]string, len(types))
+	for i, t := range types {
+		names[i] = api.ValueTypeName(t)
+	}
+	return strings.Join(names, ", ")
+}
+
+// Raised by the host functions to trap, the message becomes the sandbox's
+// last error.
+type trap string
+
+func (t trap) Error() string {
+	return string(t)
+}
+
+func trapf(format string, args ...interface{}) {
+	panic(trap(fmt.Sprintf(format, args...)))
+}
+
+// Runs WebAssembly modules w/ the same plugin API as the Lua sandbox. The
+// module exports `process_message` and `timer_event` and imports the host
+// functions from the "heka" module, see the sandbox documentation. Modules
+// are compiled to native code by the wazero runtime, which falls back to its
+// interpreter on platforms it can't compile for.
+type WasmSandbox struct {
+	// Usage stats, accessed atomically as they're reported while the
+	// sandbox runs.
+	memory          uint64
+	instructions    uint64
+	maxInstructions uint64
+	output          uint64
+	maxOutput       uint64
+
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+	hash     [sha256.Size]byte
+	// Names of the globals the module exports, the mutable ones are
+	// preserved along w/ its memory.
+	globalNames    []string
+	globals        []api.MutableGlobal
+	mod            api.Module
+	ctx            context.Context
+	cancel         context.CancelFunc
+	processMessage api.Function
+	timerEvent     api.Function
+	status         int32
+	lastError      string
+	pack           *pipeline.PipelinePack
+	injectMessage  func(payload, payload_type, payload_name string) int
+	config         map[string]interface{}
+	sbConfig       *sandbox.SandboxConfig
+}
+
+func CreateWasmSandbox(conf *sandbox.SandboxConfig) (sandbox.Sandbox, error) {
+	if conf.UseKvStore || len(conf.Lookups) > 0 {
+		return nil, errors.New("the wasm script_type doesn't support use_kv_store " +
+			"or lookups")
+	}
+	data, err := ioutil.ReadFile(conf.ScriptFilename)
+	if err != nil {
+		return nil, fmt.Errorf("Sandbox creation failed: %s", err)
+	}
+	globals, err := exportedGlobals(data)
+	if err != nil {
+		return nil, fmt.Errorf("Sandbox creation failed: %s: %s",
+			conf.ScriptFilename, err)
+	}
+	wsb := &WasmSandbox{
+		hash:        sha256.Sum256(data),
+		globalNames: globals,
+		status:      sandbox.STATUS_UNKNOWN,
+		config:      conf.Config,
+		sbConfig:    conf,
+	}
+	wsb.injectMessage = func(p, pt, pn string) int {
+		log.Printf("payload_type: %s\npayload_name: %s\npayload: %s\n", pt, pn, p)
+		return 0
+	}
+
+	var maxPages uint32 = 65536
+	if limit := conf.MemoryLimit; limit > 0 && limit/pageSize < 65536 {
+		maxPages = uint32(limit / pageSize)
+	}
+	// Closing the module when a call's context is done is what lets us
+	// interrupt runaway calls.
+	ctx := context.Background()
+	wsb.runtime = wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(maxPages).
+		WithCloseOnContextDone(true))
+	if err = wsb.instantiateHost(ctx); err == nil {
+		wsb.compiled, err = wsb.runtime.CompileModule(ctx, data)
+	}
+	if err != nil {
+		wsb.runtime.Close(ctx)
+		return nil, fmt.Errorf("Sandbox creation failed: %s: %s",
+			conf.ScriptFilename, err)
+	}
+	return wsb, nil
+}
+
+// Returns the names of the globals exported by the binary module, which
+// wazero doesn't list, in the order they're exported.
+func exportedGlobals(data []byte) (names []string, err error) {
+	malformed := errors.New("malformed module")
+	r := bytes.NewReader(data)
+	header := make([]byte, len(wasmMagic))
+	if _, err = io.ReadFull(r, header); err != nil ||
+		!bytes.Equal(header, wasmMagic) {
+		return nil, errors.New("not a binary WebAssembly module")
+	}
+	for r.Len() > 0 {
+		id, _ := r.ReadByte()
+		size, err := binary.ReadUvarint(r)
+		if err != nil || size > uint64(r.Len()) {
+			return nil, malformed
+		}
+		section := make([]byte, size)
+		r.Read(section)
+		if id != sectionExport {
+			continue
+		}
+		sr := bytes.NewReader(section)
+		count, err := binary.ReadUvarint(sr)
+		if err != nil {
+			return nil, malformed
+		}
+		for i := uint64(0); i < count; i++ {
+			n, err := binary.ReadUvarint(sr)
+			if err != nil || n > uint64(sr.Len()) {
+				return nil, malformed
+			}
+			name := make([]byte, n)
+			sr.Read(name)
+			kind, err := sr.ReadByte()
+			if err == nil {
+				_, err = binary.ReadUvarint(sr)
+			}
+			if err != nil {
+				return nil, malformed
+			}
+			if kind == externGlobal {
+				names = append(names, string(name))
+			}
+		}
+	}
+	return names, nil
+}
+
+// Registers the host functions the module can import.
+func (this *WasmSandbox) instantiateHost(ctx context.Context) error {
+	six := []api.ValueType{i32, i32, i32, i32, i32, i32}
+	four := []api.ValueType{i32, i32, i32, i32}
+	two := []api.ValueType{i32, i32}
+	result := []api.ValueType{i32}
+	hosts := []struct {
+		name string
+		fn   api.GoModuleFunc
+		typ  funcType
+	}{
+		{"read_message", this.hostReadMessage, funcType{six, result}},
+		{"read_message_type", this.hostReadMessageType, funcType{four, result}},
+		{"read_config", this.hostReadConfig, funcType{four, result}},
+		{"inject_message", this.hostInjectMessage, funcType{two, nil}},
+		{"inject_payload", this.hostInjectPayload, funcType{six, nil}},
+		{"set_error", this.hostSetError, funcType{two, nil}},
+	}
+	builder := this.runtime.NewHostModuleBuilder(HOST_MODULE)
+	for _, host := range hosts {
+		builder.NewFunctionBuilder().
+			WithGoModuleFunction(host.fn, host.typ.params, host.typ.results).
+			Export(host.name)
+	}
+	_, err := builder.Instantiate(ctx)
+	return err
+}
+
+// Returns the module's memory, nil if it has none.
+func moduleMemory(mod api.Module) api.Memory {
+	// wazero returns a typed nil for modules w/o memory.
+	if mem := mod.Memory(); mem != nil && !reflect.ValueOf(mem).IsNil() {
+		return mem
+	}
+	return nil
+}
+
+// Returns the module's memory at the address, trapping if it's out of
+// bounds.
+func memory(mod api.Module, ptr, size uint64) []byte {
+	mem := moduleMemory(mod)
+	if mem == nil {
+		trapf("out of bounds memory access")
+	}
+	b, ok := mem.Read(uint32(ptr), uint32(size))
+	if !ok {
+		trapf("out of bounds memory access")
+	}
+	return b
+}
+
+// Writes the value to the buffer if it fits, returning its length.
+func writeValue(mod api.Module, value []byte, ptr, capacity uint64) uint64 {
+	if uint64(len(value)) <= uint64(uint32(capacity)) {
+		copy(memory(mod, ptr, uint64(len(value))), value)
+	}
+	return uint64(uint32(len(value)))
+}
+
+// Returns the message header or field value and its type, ok is false if
+// the message doesn't have it. Numbers are encoded as 8 little-endian bytes,
+// booleans as a single byte.
+func (this *WasmSandbox) messageValue(name string, fi, ai int) (
+	valueType message.Field_ValueType, value []byte, ok bool) {
+
+	if this.pack == nil {
+		return
+	}
+	msg := this.pack.Message
+	integer := func(p interface{}) (message.Field_ValueType, []byte, bool) {
+		var v int64
+		switch p := p.(type) {
+		case *int64:
+			if p == nil {
+				return 0, nil, false
+			}
+			v = *p
+		case *int32:
+			if p == nil {
+				return 0, nil, false
+			}
+			v = int64(*p)
+		}
+		return message.Field_INTEGER, encodeInt(v), true
+	}
+	switch name {
+	case "Type":
+		return message.Field_STRING, []byte(msg.GetType()), true
+	case "Logger":
+		return message.Field_STRING, []byte(msg.GetLogger()), true
+	case "Payload":
+		return message.Field_STRING, []byte(msg.GetPayload()), true
+	case "EnvVersion":
+		return message.Field_STRING, []byte(msg.GetEnvVersion()), true
+	case "Hostname":
+		return message.Field_STRING, []byte(msg.GetHostname()), true
+	case "Uuid":
+		return message.Field_STRING, []byte(msg.GetUuidString()), true
+	case "Timestamp":
+		return integer(msg.Timestamp)
+	case "Severity":
+		return integer(msg.Severity)
+	case "Pid":
+		return integer(msg.Pid)
+	case "raw":
+		if len(this.pack.MsgBytes) == 0 {
+			return
+		}
+		return message.Field_BYTES, this.pack.MsgBytes, true
+	}
+	if !strings.HasPrefix(name, "Fields[") || !strings.HasSuffix(name, "]") {
+		return
+	}
+	fields := this.pack.FieldIndex().FindAllFields(msg, name[7:len(name)-1])
+	if fi < 0 || fi >= len(fields) || ai < 0 {
+		return
+	}
+	field := fields[fi]
+	valueType = field.GetValueType()
+	switch valueType {
+	case message.Field_STRING:
+		if ai < len(field.ValueString) {
+			return valueType, []byte(field.ValueString[ai]), true
+		}
+	case message.Field_BYTES:
+		if ai < len(field.ValueBytes) {
+			return valueType, field.ValueBytes[ai], true
+		}
+	case message.Field_INTEGER:
+		if ai < len(field.ValueInteger) {
+			return valueType, encodeInt(field.ValueInteger[ai]), true
+		}
+	case message.Field_DOUBLE:
+		if ai < len(field.ValueDouble) {
+			return valueType, encodeDouble(field.ValueDouble[ai]), true
+		}
+	case message.Field_BOOL:
+		if ai < len(field.ValueBool) {
+			return valueType, encodeBool(field.ValueBool[ai]), true
+		}
+	}
+	return 0, nil, false
+}
+
+func encodeInt(v int64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, uint64(v))
+	return b
+}
+
+func encodeDouble(v float64) []byte {
+	return encodeInt(int64(math.Float64bits(v)))
+}
+
+func encodeBool(v bool) []byte {
+	if v {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// read_message(name_ptr, name_len, field_index, array_index, buf_ptr,
+// buf_cap i32) i32
+func (this *WasmSandbox) hostReadMessage(ctx context.Context, mod api.Module,
+	stack []uint64) {
+
+	name := string(memory(mod, stack[0], stack[1]))
+	_, value, ok := this.messageValue(name, int(int32(stack[2])), int(int32(stack[3])))
+	if !ok {
+		stack[0] = math.MaxUint32
+		return
+	}
+	stack[0] = writeValue(mod, value, stack[4], stack[5])
+}
+
+// read_message_type(name_ptr, name_len, field_index, array_index i32) i32
+func (this *WasmSandbox) hostReadMessageType(ctx context.Context, mod api.Module,
+	stack []uint64) {
+
+	name := string(memory(mod, stack[0], stack[1]))
+	valueType, _, ok := this.messageValue(name, int(int32(stack[2])), int(int32(stack[3])))
+	if !ok {
+		stack[0] = math.MaxUint32
+		return
+	}
+	stack[0] = uint64(valueType)
+}
+
+// read_config(name_ptr, name_len, buf_ptr, buf_cap i32) i32
+func (this *WasmSandbox) hostReadConfig(ctx context.Context, mod api.Module,
+	stack []uint64) {
+
+	var value []byte
+	switch v := this.config[string(memory(mod, stack[0], stack[1]))].(type) {
+	case string:
+		value = []byte(v)
+	case bool:
+		value = encodeBool(v)
+	case int64:
+		value = encodeDouble(float64(v))
+	case float64:
+		value = encodeDouble(v)
+	default:
+		stack[0] = math.MaxUint32
+		return
+	}
+	stack[0] = writeValue(mod, value, stack[2], stack[3])
+}
+
+// Hands the output to the inject callback, trapping if it's too large or
+// the callback fails.
+func (this *WasmSandbox) inject(fn string, payload []byte, payloadType,
+	payloadName string) {
+
+	size := uint64(len(payload))
+	if limit := uint64(this.sbConfig.OutputLimit); limit > 0 && size > limit {
+		trapf("%s output_limit exceeded", fn)
+	}
+	atomic.StoreUint64(&this.output, size)
+	if size > atomic.LoadUint64(&this.maxOutput) {
+		atomic.StoreUint64(&this.maxOutput, size)
+	}
+	switch this.injectMessage(string(payload), payloadType, payloadName) {
+	case 0:
+	case 1:
+		trapf("%s protobuf unmarshal failed", fn)
+	case 2:
+		trapf("%s exceeded InjectMessage count", fn)
+	case 3:
+		trapf("%s exceeded MaxMsgLoops", fn)
+	case 4:
+		trapf("%s creates a circular reference (matches this plugin's "+
+			"message_matcher)", fn)
+	case 5:
+		trapf("%s aborted", fn)
+	default:
+		trapf("%s unknown error", fn)
+	}
+}
+
+// inject_message(ptr, len i32), the protobuf encoded message.
+func (this *WasmSandbox) hostInjectMessage(ctx context.Context, mod api.Module,
+	stack []uint64) {
+
+	if payload := memory(mod, stack[0], stack[1]); len(payload) > 0 {
+		this.inject("inject_message()", payload, "", "")
+	}
+}
+
+// inject_payload(type_ptr, type_len, name_ptr, name_len, ptr, len i32)
+func (this *WasmSandbox) hostInjectPayload(ctx context.Context, mod api.Module,
+	stack []uint64) {
+
+	payloadType := string(memory(mod, stack[0], stack[1]))
+	if payloadType == "" {
+		payloadType = "txt"
+	}
+	payloadName := string(memory(mod, stack[2], stack[3]))
+	if payload := memory(mod, stack[4], stack[5]); len(payload) > 0 {
+		this.inject("inject_payload()", payload, payloadType, payloadName)
+	}
+}
+
+// set_error(ptr, len i32), the error message for a failed process_message.
+func (this *WasmSandbox) hostSetError(ctx context.Context, mod api.Module,
+	stack []uint64) {
+
+	this.lastError = string(memory(mod, stack[0], stack[1]))
+}
+
+func (this *WasmSandbox) terminate(err string) {
+	this.lastError = err
+	atomic.StoreInt32(&this.status, sandbox.STATUS_TERMINATED)
+}
+
+// Returns the context a call runs in, which is cancelled by Stop. The
+// compiled code isn't metered, so the instruction_limit caps the time a call
+// can run for instead, at a microsecond per instruction.
+func (this *WasmSandbox) callContext() (context.Context, context.CancelFunc) {
+	if limit := this.sbConfig.InstructionLimit; limit > 0 {
+		return context.WithTimeout(this.ctx, time.Duration(limit)*time.Microsecond)
+	}
+	return context.WithCancel(this.ctx)
+}
+
+// Returns the error message for a failed call, the first line of wazero's
+// error w/o the stack trace.
+func callError(err error) string {
+	var t trap
+	if errors.As(err, &t) {
+		return string(t)
+	}
+	var exit *sys.ExitError
+	if errors.As(err, &exit) {
+		switch exit.ExitCode() {
+		case sys.ExitCodeDeadlineExceeded:
+			return "instruction_limit exceeded"
+		case sys.ExitCodeContextCanceled:
+			return "aborted"
+		}
+	}
+	msg := err.Error()
+	if i := strings.IndexByte(msg, '\n'); i >= 0 {
+		msg = msg[:i]
+	}
+	return strings.TrimPrefix(msg, "wasm error: ")
+}
+
+// Checks the function, if the module exports one w/ the name, has the type.
+func (this *WasmSandbox) checkExport(name string, typ *funcType) error {
+	def, ok := this.compiled.ExportedFunctions()[name]
+	if !ok {
+		return nil
+	}
+	if ft := (funcType{def.ParamTypes(), def.ResultTypes()}); !ft.equals(typ) {
+		return fmt.Errorf("function %q has type %s, expected %s", name, &ft, typ)
+	}
+	return nil
+}
+
+func (this *WasmSandbox) Init(dataFile string) (err error) {
+	exports := []struct {
+		name string
+		typ  *funcType
+	}{
+		{"process_message", &processMessageType},
+		{"timer_event", &timerEventType},
+		{"_initialize", &initializeType},
+	}
+	for _, e := range exports {
+		if err = this.checkExport(e.name, e.typ); err != nil {
+			return fmt.Errorf("Init() %s", err)
+		}
+	}
+	this.ctx, this.cancel = context.WithCancel(context.Background())
+	// Reactor modules, e.g. Rust cdylibs and TinyGo's, initialize their
+	// runtime in `_initialize`, which runs after the module's start function
+	// under the same instruction_limit.
+	ctx, cancel := this.callContext()
+	this.mod, err = this.runtime.InstantiateModule(ctx, this.compiled,
+		wazero.NewModuleConfig().WithStartFunctions("_initialize"))
+	cancel()
+	if err != nil {
+		return fmt.Errorf("Init() %s", callError(err))
+	}
+	this.processMessage = this.mod.ExportedFunction("process_message")
+	this.timerEvent = this.mod.ExportedFunction("timer_event")
+	for _, name := range this.globalNames {
+		if g, ok := this.mod.ExportedGlobal(name).(api.MutableGlobal); ok {
+			this.globals = append(this.globals, g)
+		}
+	}
+	atomic.StoreInt32(&this.status, sandbox.STATUS_RUNNING)
+	this.updateMemory()
+	if dataFile != "" {
+		if err = this.restore(dataFile); err != nil {
+			this.terminate(err.Error())
+			return fmt.Errorf("Init() %s", err)
+		}
+		this.updateMemory()
+	}
+	return nil
+}
+
+// Returns the module's whole memory, nil if it has none.
+func (this *WasmSandbox) memoryBytes() []byte {
+	mem := moduleMemory(this.mod)
+	if mem == nil {
+		return nil
+	}
+	b, _ := mem.Read(0, mem.Size())
+	return b
+}
+
+// Restores the memory and globals preserved in the file, unless they belong
+// to a different module.
+func (this *WasmSandbox) restore(dataFile string) error {
+	f, err := os.Open(dataFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	header := make([]byte, len(preservationMagic)+sha256.Size)
+	if _, err = io.ReadFull(r, header); err != nil ||
+		!bytes.Equal(header[:len(preservationMagic)], preservationMagic) {
+		return fmt.Errorf("%s isn't a wasm sandbox preservation file", dataFile)
+	}
+	if !bytes.Equal(header[len(preservationMagic):], this.hash[:]) {
+		log.Printf("Not restoring the data preserved in %s, it was preserved "+
+			"by a different module", dataFile)
+		return nil
+	}
+	var numGlobals, pages uint32
+	if err = binary.Read(r, binary.LittleEndian, &numGlobals); err != nil {
+		return fmt.Errorf("restoring %s: %s", dataFile, err)
+	}
+	if numGlobals != uint32(len(this.globals)) {
+		return fmt.Errorf("restoring %s: %d globals, the module has %d", dataFile,
+			numGlobals, len(this.globals))
+	}
+	globals := make([]uint64, numGlobals)
+	if err = binary.Read(r, binary.LittleEndian, globals); err != nil {
+		return fmt.Errorf("restoring %s: %s", dataFile, err)
+	}
+	if err = binary.Read(r, binary.LittleEndian, &pages); err != nil {
+		return fmt.Errorf("restoring %s: %s", dataFile, err)
+	}
+	data := make([]byte, int(pages)*pageSize)
+	if _, err = io.ReadFull(r, data); err != nil {
+		return fmt.Errorf("restoring %s: %s", dataFile, err)
+	}
+	// The memory can only grow, if it's larger than the preserved one the
+	// rest is cleared.
+	if mem := moduleMemory(this.mod); pages > 0 {
+		if mem == nil {
+			return fmt.Errorf("restoring %s: the module has no memory", dataFile)
+		}
+		if size := mem.Size() / pageSize; pages > size {
+			if _, ok := mem.Grow(pages - size); !ok {
+				return fmt.Errorf("restoring %s: %d pages of memory exceed "+
+					"memory_limit", dataFile, pages)
+			}
+		}
+	}
+	mem := this.memoryBytes()
+	copy(mem, data)
+	for i := len(data); i < len(mem); i++ {
+		mem[i] = 0
+	}
+	for i, g := range this.globals {
+		g.Set(globals[i])
+	}
+	return nil
+}
+
+// Writes the memory and globals to the file.
+func (this *WasmSandbox) preserve(dataFile string) (err error) {
+	f, err := os.Create(dataFile)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if e := f.Close(); err == nil {
+			err = e
+		}
+	}()
+	mem := this.memoryBytes()
+	w := bufio.NewWriter(f)
+	w.Write(preservationMagic)
+	w.Write(this.hash[:])
+	binary.Write(w, binary.LittleEndian, uint32(len(this.globals)))
+	for _, g := range this.globals {
+		binary.Write(w, binary.LittleEndian, g.Get())
+	}
+	binary.Write(w, binary.LittleEndian, uint32(len(mem)/pageSize))
+	w.Write(mem)
+	return w.Flush()
+}
+
+// Interrupts the running call, which fails, and any later ones.
+func (this *WasmSandbox) Stop() {
+	if this.cancel != nil {
+		this.cancel()
+	}
+}
+
+func (this *WasmSandbox) Destroy(dataFile string) (err error) {
+	if dataFile != "" && this.mod != nil && this.Status() == sandbox.STATUS_RUNNING {
+		if err = this.preserve(dataFile); err != nil {
+			err = fmt.Errorf("Destroy() %s", err)
+		}
+	}
+	if this.cancel != nil {
+		this.cancel()
+	}
+	this.runtime.Close(context.Background())
+	return err
+}
+
+func (this *WasmSandbox) Status() int {
+	return int(atomic.LoadInt32(&this.status))
+}
+
+func (this *WasmSandbox) LastError() string {
+	return this.lastError
+}
+
+// The instruction usage is the time the last call ran for in microseconds,
+// matching the instruction_limit.
+func (this *WasmSandbox) Usage(utype, ustat int) uint {
+	var current, maximum *uint64
+	var limit uint
+	switch utype {
+	case sandbox.TYPE_MEMORY:
+		// The memory never shrinks while the module runs, so its current
+		// size is also the maximum.
+		current, maximum = &this.memory, &this.memory
+		limit = this.sbConfig.MemoryLimit
+	case sandbox.TYPE_INSTRUCTIONS:
+		current, maximum = &this.instructions, &this.maxInstructions
+		limit = this.sbConfig.InstructionLimit
+	case sandbox.TYPE_OUTPUT:
+		current, maximum = &this.output, &this.maxOutput
+		limit = this.sbConfig.OutputLimit
+	default:
+		return 0
+	}
+	switch ustat {
+	case sandbox.STAT_LIMIT:
+		return limit
+	case sandbox.STAT_CURRENT:
+		return uint(atomic.LoadUint64(current))
+	case sandbox.STAT_MAXIMUM:
+		return uint(atomic.LoadUint64(maximum))
+	}
+	return 0
+}
+
+func (this *WasmSandbox) updateMemory() {
+	atomic.StoreUint64(&this.memory, uint64(len(this.memoryBytes())))
+}
+
+// Calls the exported function, terminating the sandbox if it traps.
+func (this *WasmSandbox) call(name string, fn api.Function, args ...uint64) (
+	results []uint64, status int) {
+
+	if this.mod == nil || this.Status() != sandbox.STATUS_RUNNING {
+		return nil, 1
+	}
+	if fn == nil {
+		this.terminate(fmt.Sprintf("%s() function was not found", name))
+		return nil, 1
+	}
+	this.lastError = ""
+	ctx, cancel := this.callContext()
+	start := time.Now()
+	results, err := fn.Call(ctx, args...)
+	elapsed := uint64(time.Since(start) / time.Microsecond)
+	cancel()
+	atomic.StoreUint64(&this.instructions, elapsed)
+	if elapsed > atomic.LoadUint64(&this.maxInstructions) {
+		atomic.StoreUint64(&this.maxInstructions, elapsed)
+	}
+	this.updateMemory()
+	if err != nil {
+		msg := fmt.Sprintf("%s() %s", name, callError(err))
+		// Don't terminate if we're aborting so we preserve data on exit.
+		if strings.HasSuffix(msg, "aborted") {
+			this.lastError = msg
+		} else {
+			this.terminate(msg)
+		}
+		return nil, 1
+	}
+	return results, 0
+}
+
+func (this *WasmSandbox) ProcessMessage(pack *pipeline.PipelinePack) int {
+	this.pack = pack
+	results, status := this.call("process_message", this.processMessage)
+	this.pack = nil
+	if status != 0 {
+		return status
+	}
+	return int(int32(results[0]))
+}
+
+func (this *WasmSandbox) TimerEvent(ns int64) int {
+	_, status := this.call("timer_event", this.timerEvent, uint64(ns))
+	return status
+}
+
+func (this *WasmSandbox) InjectMessage(f func(payload, payload_type,
+	payload_name string) int) {
+	this.injectMessage = f
+}
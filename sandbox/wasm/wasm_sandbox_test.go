@@ -0,0 +1,392 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package wasm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	. "github.com/mozilla-services/heka/sandbox"
+)
+
+// A filter that injects the payload and the "count" field of each message,
+// and the number of messages it has seen and the memory it read the "name"
+// config into on each timer event.
+func testFilterModule() *testModule {
+	i32, i64 := byte(typeI32), byte(typeI64)
+	six := []byte{i32, i32, i32, i32, i32, i32}
+	four := []byte{i32, i32, i32, i32}
+	call := func(fn int, args ...int32) (b []byte) {
+		for _, arg := range args {
+			b = append(b, i32Const(arg)...)
+		}
+		return asm(b, opCall, fn)
+	}
+	return &testModule{
+		types: []funcType{
+			{six, []byte{i32}},
+			{six, nil},
+			{nil, []byte{i32}},
+			{[]byte{i64}, nil},
+			{[]byte{i32, i32}, nil},
+			{four, []byte{i32}},
+			{nil, nil},
+		},
+		imports: []importFunc{
+			{HOST_MODULE, "read_message", 0},
+			{HOST_MODULE, "inject_payload", 1},
+			{HOST_MODULE, "inject_message", 4},
+			{HOST_MODULE, "set_error", 4},
+			{HOST_MODULE, "read_config", 5},
+		},
+		funcs: []testFunc{
+			// process_message
+			{2, []byte{i32}, asm(
+				opGlobalGet, 0, i32Const(1), opI32Add, opGlobalSet, 0,
+				call(0, 0, 7, 0, 0, 1024, 1024), opLocalTee, 0,
+				opI32Eqz,
+				opIf, 0x40,
+				call(3, 32, 4),
+				i32Const(-1), opReturn,
+				opEnd,
+				i32Const(24), i32Const(3), i32Const(0), i32Const(0), i32Const(1024),
+				opLocalGet, 0, opCall, 1,
+				call(0, 8, 13, 0, 0, 1536, 8),
+				i32Const(8), opI32Eq,
+				opIf, 0x40,
+				call(1, 24, 3, 0, 0, 1536, 8),
+				opEnd,
+				i32Const(0),
+			)},
+			// timer_event
+			{3, nil, asm(
+				opLocalGet, 0, opI64Eqz,
+				opIf, 0x40, opUnreachable, opEnd,
+				i32Const(2048), opGlobalGet, 0, opI32Store, 2, 0,
+				call(1, 0, 0, 0, 0, 2048, 4),
+				call(2, 2048, 4),
+			)},
+			// _initialize
+			{6, nil, asm(call(4, 40, 4, 3072, 64), opDrop)},
+		},
+		memory:  &limits{min: 1},
+		globals: []testGlobal{{i32, true, i32Const(0)}},
+		exports: []testExport{
+			{"memory", externMemory, 0},
+			{"process_message", externFunc, 5},
+			{"timer_event", externFunc, 6},
+			{"_initialize", externFunc, 7},
+			{"count", externGlobal, 0},
+		},
+		datas: []testData{
+			{offset: 0, init: []byte("Payload")},
+			{offset: 8, init: []byte("Fields[count]")},
+			{offset: 24, init: []byte("txt")},
+			{offset: 32, init: []byte("fail")},
+			{offset: 40, init: []byte("name")},
+		},
+	}
+}
+
+type injected struct {
+	payload, payloadType, payloadName string
+}
+
+// A filter whose process_message never returns.
+func testLoopModule() *testModule {
+	return &testModule{
+		types: []funcType{{nil, []byte{byte(typeI32)}}},
+		funcs: []testFunc{
+			{0, nil, asm(opLoop, 0x40, opBr, 0, opEnd, i32Const(0))},
+		},
+		exports: []testExport{{"process_message", externFunc, 0}},
+	}
+}
+
+func createTestSandbox(t *testing.T, tm *testModule, sbc *SandboxConfig) (
+	Sandbox, error) {
+
+	dir, err := ioutil.TempDir("", "wasm_sandbox_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sbc.ScriptFilename = filepath.Join(dir, "filter.wasm")
+	if err = ioutil.WriteFile(sbc.ScriptFilename, tm.bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return CreateWasmSandbox(sbc)
+}
+
+func newTestSandbox(t *testing.T, tm *testModule, sbc *SandboxConfig) (
+	*WasmSandbox, *[]injected) {
+
+	sb, err := createTestSandbox(t, tm, sbc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output []injected
+	sb.InjectMessage(func(payload, payloadType, payloadName string) int {
+		output = append(output, injected{payload, payloadType, payloadName})
+		return 0
+	})
+	return sb.(*WasmSandbox), &output
+}
+
+func testSandboxConfig() *SandboxConfig {
+	return &SandboxConfig{
+		MemoryLimit:      1024 * 1024,
+		InstructionLimit: 1e6,
+		OutputLimit:      1024,
+		Config:           map[string]interface{}{"name": "wasm"},
+	}
+}
+
+func testPack(payload string) *pipeline.PipelinePack {
+	pack := pipeline.NewPipelinePack(nil)
+	pack.Message.SetPayload(payload)
+	return pack
+}
+
+func TestSandbox(t *testing.T) {
+	sb, output := newTestSandbox(t, testFilterModule(), testSandboxConfig())
+	if sb.Status() != STATUS_UNKNOWN {
+		t.Errorf("status should be unknown before Init, got %d", sb.Status())
+	}
+	if err := sb.Init(""); err != nil {
+		t.Fatal(err)
+	}
+	if sb.Status() != STATUS_RUNNING {
+		t.Errorf("status should be running, got %d", sb.Status())
+	}
+	if name := string(sb.memoryBytes()[3072:3076]); name != "wasm" {
+		t.Errorf("expected _initialize to read the config, got %q", name)
+	}
+
+	pack := testPack("hello")
+	field, _ := message.NewField("count", int64(7), "")
+	pack.Message.AddField(field)
+	if r := sb.ProcessMessage(pack); r != 0 {
+		t.Fatalf("ProcessMessage() returned %d: %s", r, sb.LastError())
+	}
+	expected := []injected{
+		{"hello", "txt", ""},
+		{"\x07\x00\x00\x00\x00\x00\x00\x00", "txt", ""},
+	}
+	if len(*output) != 2 || (*output)[0] != expected[0] || (*output)[1] != expected[1] {
+		t.Errorf("expected %q to be injected, got %q", expected, *output)
+	}
+
+	if r := sb.ProcessMessage(testPack("")); r != -1 {
+		t.Errorf("ProcessMessage() should have failed, returned %d", r)
+	}
+	if sb.LastError() != "fail" || sb.Status() != STATUS_RUNNING {
+		t.Errorf("expected a failure w/o terminating, got %d %q", sb.Status(),
+			sb.LastError())
+	}
+
+	*output = nil
+	if r := sb.TimerEvent(1); r != 0 {
+		t.Fatalf("TimerEvent() returned %d: %s", r, sb.LastError())
+	}
+	expected = []injected{
+		{"\x02\x00\x00\x00", "txt", ""},
+		{"\x02\x00\x00\x00", "", ""},
+	}
+	if len(*output) != 2 || (*output)[0] != expected[0] || (*output)[1] != expected[1] {
+		t.Errorf("expected %q to be injected, got %q", expected, *output)
+	}
+
+	if b := sb.Usage(TYPE_MEMORY, STAT_CURRENT); b != pageSize {
+		t.Errorf("current memory should be %d, using %d", pageSize, b)
+	}
+	if b := sb.Usage(TYPE_MEMORY, STAT_LIMIT); b != 1024*1024 {
+		t.Errorf("memory limit should be 1MiB, using %d", b)
+	}
+	if b := sb.Usage(TYPE_INSTRUCTIONS, STAT_CURRENT); b >
+		sb.Usage(TYPE_INSTRUCTIONS, STAT_MAXIMUM) {
+		t.Errorf("unexpected instructions %d", b)
+	}
+	if b := sb.Usage(TYPE_OUTPUT, STAT_CURRENT); b != 4 {
+		t.Errorf("current output should be 4, using %d", b)
+	}
+	if b := sb.Usage(TYPE_OUTPUT, STAT_MAXIMUM); b != 8 {
+		t.Errorf("maximum output should be 8, using %d", b)
+	}
+	if b := sb.Usage(TYPE_OUTPUT, 99); b != 0 {
+		t.Errorf("invalid index should return 0, received %d", b)
+	}
+
+	if r := sb.TimerEvent(0); r != 1 {
+		t.Errorf("TimerEvent() should have trapped, returned %d", r)
+	}
+	if sb.Status() != STATUS_TERMINATED ||
+		sb.LastError() != "timer_event() unreachable" {
+		t.Errorf("expected the sandbox to terminate, got %d %q", sb.Status(),
+			sb.LastError())
+	}
+	if r := sb.ProcessMessage(testPack("hello")); r != 1 {
+		t.Errorf("a terminated sandbox should return 1, got %d", r)
+	}
+}
+
+func TestSandboxPreservation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wasm_sandbox_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dataFile := filepath.Join(dir, "filter.data")
+
+	sb, _ := newTestSandbox(t, testFilterModule(), testSandboxConfig())
+	if err = sb.Init(""); err != nil {
+		t.Fatal(err)
+	}
+	sb.ProcessMessage(testPack("hello"))
+	sb.ProcessMessage(testPack("preserved"))
+	if err = sb.Destroy(dataFile); err != nil {
+		t.Fatal(err)
+	}
+
+	sb, output := newTestSandbox(t, testFilterModule(), testSandboxConfig())
+	if err = sb.Init(dataFile); err != nil {
+		t.Fatal(err)
+	}
+	if payload := string(sb.memoryBytes()[1024:1033]); payload != "preserved" {
+		t.Errorf("expected the memory to be restored, got %q", payload)
+	}
+	sb.TimerEvent(1)
+	if len(*output) == 0 || (*output)[0].payload != "\x02\x00\x00\x00" {
+		t.Errorf("expected the globals to be restored, got %q", *output)
+	}
+
+	// A different module starts afresh.
+	tm := testFilterModule()
+	tm.datas[3].init = []byte("FAIL")
+	sb, output = newTestSandbox(t, tm, testSandboxConfig())
+	if err = sb.Init(dataFile); err != nil {
+		t.Fatal(err)
+	}
+	sb.TimerEvent(1)
+	if len(*output) == 0 || (*output)[0].payload != "\x00\x00\x00\x00" {
+		t.Errorf("expected fresh globals, got %q", *output)
+	}
+
+	ioutil.WriteFile(dataFile, []byte("garbage"), 0644)
+	sb, _ = newTestSandbox(t, testFilterModule(), testSandboxConfig())
+	if err = sb.Init(dataFile); err == nil {
+		t.Error("expected an error for a corrupt preservation file")
+	}
+}
+
+func TestSandboxLimits(t *testing.T) {
+	sbc := testSandboxConfig()
+	sbc.OutputLimit = 4
+	sb, _ := newTestSandbox(t, testFilterModule(), sbc)
+	sb.Init("")
+	if r := sb.ProcessMessage(testPack("hello")); r != 1 {
+		t.Errorf("ProcessMessage() should have trapped, returned %d", r)
+	}
+	if sb.LastError() != "process_message() inject_payload() output_limit exceeded" {
+		t.Errorf("unexpected error %q", sb.LastError())
+	}
+
+	// The instruction_limit gives each call a microsecond per instruction.
+	sbc = testSandboxConfig()
+	sbc.InstructionLimit = 10000
+	sb, _ = newTestSandbox(t, testLoopModule(), sbc)
+	sb.Init("")
+	if r := sb.ProcessMessage(testPack("hello")); r != 1 {
+		t.Errorf("ProcessMessage() should have trapped, returned %d", r)
+	}
+	if sb.LastError() != "process_message() instruction_limit exceeded" ||
+		sb.Status() != STATUS_TERMINATED {
+		t.Errorf("unexpected error %d %q", sb.Status(), sb.LastError())
+	}
+	if b := sb.Usage(TYPE_INSTRUCTIONS, STAT_MAXIMUM); b < 10000 {
+		t.Errorf("maximum instructions should be at least 10000, using %d", b)
+	}
+	sb.Destroy("")
+
+	sbc = testSandboxConfig()
+	sbc.MemoryLimit = pageSize - 1
+	if _, err := createTestSandbox(t, testFilterModule(), sbc); err == nil ||
+		!strings.Contains(err.Error(), "over limit of 0 pages") {
+		t.Errorf("expected a memory_limit error, got %v", err)
+	}
+
+	sb, _ = newTestSandbox(t, testFilterModule(), testSandboxConfig())
+	sb.Init("")
+	sb.InjectMessage(func(payload, payloadType, payloadName string) int {
+		return 2
+	})
+	sb.ProcessMessage(testPack("hello"))
+	if sb.LastError() != "process_message() inject_payload() exceeded "+
+		"InjectMessage count" || sb.Status() != STATUS_TERMINATED {
+		t.Errorf("unexpected error %q", sb.LastError())
+	}
+
+	// Stop interrupts a call w/o an instruction_limit, w/o terminating.
+	sbc = testSandboxConfig()
+	sbc.InstructionLimit = 0
+	sb, _ = newTestSandbox(t, testLoopModule(), sbc)
+	sb.Init("")
+	done := make(chan int)
+	go func() {
+		done <- sb.ProcessMessage(testPack("hello"))
+	}()
+	time.Sleep(10 * time.Millisecond)
+	sb.Stop()
+	if r := <-done; r != 1 || sb.LastError() != "process_message() aborted" ||
+		sb.Status() != STATUS_RUNNING {
+		t.Errorf("unexpected result %d %d %q", r, sb.Status(), sb.LastError())
+	}
+}
+
+func TestSandboxCreation(t *testing.T) {
+	sbc := testSandboxConfig()
+	sbc.ScriptFilename = "./missing.wasm"
+	if _, err := CreateWasmSandbox(sbc); err == nil {
+		t.Error("expected an error for a missing module")
+	}
+	sbc.UseKvStore = true
+	if _, err := CreateWasmSandbox(sbc); err == nil {
+		t.Error("expected an error for use_kv_store")
+	}
+
+	// Modules w/o the plugin functions load, but terminate when called.
+	sb, _ := newTestSandbox(t, &testModule{}, testSandboxConfig())
+	if err := sb.Init(""); err != nil {
+		t.Fatal(err)
+	}
+	if r := sb.ProcessMessage(testPack("")); r != 1 ||
+		sb.LastError() != "process_message() function was not found" {
+		t.Errorf("unexpected result %d %q", r, sb.LastError())
+	}
+
+	tm := testFilterModule()
+	tm.exports[1].index = 6
+	sb, _ = newTestSandbox(t, tm, testSandboxConfig())
+	if err := sb.Init(""); err == nil || err.Error() != "Init() function "+
+		"\"process_message\" has type (i64) -> (), expected () -> (i32)" {
+		t.Errorf("expected a type error, got %v", err)
+	}
+}